@@ -0,0 +1,311 @@
+// Command agent is the Open-CICD build agent. It registers with the server
+// over the agent gRPC protocol, or over HTTP where gRPC cannot get through,
+// and runs the jobs it is assigned with the shell executor, or in
+// Firecracker microVMs, each in a fresh work directory. Given an update key, it
+// installs the new versions the server rolls out and restarts into them.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"open-cicd/internal/agent"
+	"open-cicd/internal/agenthttp"
+	"open-cicd/internal/jobsig"
+	"open-cicd/internal/logging"
+	"open-cicd/internal/releases"
+	"open-cicd/internal/version"
+)
+
+// executorLabel is the label advertising which executor the agent runs
+// jobs with, so that jobs can require it.
+const executorLabel = "executor"
+
+// Executors the agent runs jobs with.
+const (
+	executorShell       = "shell"
+	executorFirecracker = "firecracker"
+)
+
+// downloadTimeout bounds the download of an agent update.
+const downloadTimeout = 10 * time.Minute
+
+// Transports the agent protocol is spoken over.
+const (
+	transportAuto = "auto"
+	transportGRPC = "grpc"
+	transportHTTP = "http"
+)
+
+func main() {
+	// Settings come from flags, defaulting to OPENCICD_AGENT_* variables
+	hostname, _ := os.Hostname()
+	server := flag.String("server", envOr("OPENCICD_AGENT_SERVER", "localhost:9090"), "address of the server's agent gRPC port")
+	httpURL := flag.String("http-url", os.Getenv("OPENCICD_AGENT_HTTP_URL"), "URL of the server's HTTP API, such as https://ci.example.com, to speak the agent protocol over when gRPC cannot get through")
+	transport := flag.String("transport", envOr("OPENCICD_AGENT_TRANSPORT", transportAuto), "grpc, http, or auto to fall back to -http-url if the gRPC port cannot be reached at registration")
+	token := flag.String("token", os.Getenv("OPENCICD_AGENT_TOKEN"), "agent registration token")
+	name := flag.String("hostname", envOr("OPENCICD_AGENT_HOSTNAME", hostname), "name the agent registers under")
+	labels := flag.String("labels", os.Getenv("OPENCICD_AGENT_LABELS"), "comma-separated key=value labels to advertise")
+	capacity := flag.Int("capacity", envInt("OPENCICD_AGENT_CAPACITY", 1), "number of jobs to run at once; 0 runs one per CPU core, as far as their resource requests fit")
+	workDir := flag.String("workdir", envOr("OPENCICD_AGENT_WORKDIR", filepath.Join(os.TempDir(), "open-cicd-agent")), "directory holding job work directories")
+	passEnv := flag.String("pass-env", os.Getenv("OPENCICD_AGENT_PASS_ENV"), "comma-separated host variables passed on to jobs besides PATH")
+	useTLS := flag.Bool("tls", envBool("OPENCICD_AGENT_TLS"), "connect with TLS, verifying the server against the system roots or -ca-file")
+	caFile := flag.String("ca-file", os.Getenv("OPENCICD_AGENT_CA_FILE"), "PEM file of the CAs the server certificate is verified against; implies -tls")
+	certFile := flag.String("cert-file", os.Getenv("OPENCICD_AGENT_CERT_FILE"), "PEM client certificate presented to servers requiring mutual TLS; implies -tls")
+	keyFile := flag.String("key-file", os.Getenv("OPENCICD_AGENT_KEY_FILE"), "PEM private key of -cert-file")
+	updateKey := flag.String("update-key", os.Getenv("OPENCICD_AGENT_UPDATE_KEY"), "base64 Ed25519 public key agent updates must be signed with; without it updates are refused")
+	executorName := flag.String("executor", envOr("OPENCICD_AGENT_EXECUTOR", executorShell), "executor to run jobs with: shell, or firecracker to run each task in a microVM")
+	fcKernel := flag.String("firecracker-kernel", os.Getenv("OPENCICD_AGENT_FIRECRACKER_KERNEL"), "uncompressed Linux kernel microVMs boot")
+	fcRootFS := flag.String("firecracker-rootfs", os.Getenv("OPENCICD_AGENT_FIRECRACKER_ROOTFS"), "ext4 image microVMs boot from")
+	fcImages := flag.String("firecracker-images", os.Getenv("OPENCICD_AGENT_FIRECRACKER_IMAGES"), "directory of ext4 images by task image, such as golang_1.23.ext4; without it every task boots from -firecracker-rootfs")
+	fcInit := flag.String("firecracker-init", os.Getenv("OPENCICD_AGENT_FIRECRACKER_INIT"), "path of vminit in the images (default /sbin/opencicd-init)")
+	fcBinary := flag.String("firecracker-binary", envOr("OPENCICD_AGENT_FIRECRACKER_BINARY", "firecracker"), "firecracker command")
+	fcVCPUs := flag.Int("firecracker-vcpus", envInt("OPENCICD_AGENT_FIRECRACKER_VCPUS", 2), "vCPUs of microVMs of jobs without a CPU limit")
+	fcMemory := flag.Int("firecracker-memory", envInt("OPENCICD_AGENT_FIRECRACKER_MEMORY", 1024), "MiB of memory of microVMs of jobs without a memory limit")
+	fcNetwork := flag.String("firecracker-network", os.Getenv("OPENCICD_AGENT_FIRECRACKER_NETWORK"), "IPv4 prefix, such as 172.30.0.0/16, split into a /30 per job for the TAP device of its microVMs; without it microVMs have no network")
+	fcNameservers := flag.String("firecracker-nameservers", os.Getenv("OPENCICD_AGENT_FIRECRACKER_NAMESERVERS"), "comma-separated nameservers of microVMs, replacing those of the images")
+	jobKeys := flag.String("job-keys", os.Getenv("OPENCICD_AGENT_JOB_KEYS"), "comma-separated base64 Ed25519 public keys job assignments must be signed with; without any, unsigned assignments are run")
+	flag.Parse()
+
+	if err := logging.Setup(os.Stderr, envOr("LOG_LEVEL", "info"), envOr("LOG_FORMAT", "json")); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+	if *token == "" {
+		fatal("A registration token is required; set -token or OPENCICD_AGENT_TOKEN")
+	}
+	if *capacity < 0 {
+		fatal("Capacity must not be negative", "capacity", *capacity)
+	}
+	switch *transport {
+	case transportAuto, transportGRPC:
+	case transportHTTP:
+		if *httpURL == "" {
+			fatal("The http transport needs the server's URL; set -http-url or OPENCICD_AGENT_HTTP_URL")
+		}
+	default:
+		fatal("Invalid transport, want auto, grpc or http", "transport", *transport)
+	}
+	labelSet, err := parseLabels(*labels)
+	if err != nil {
+		fatal("Invalid labels", "error", err)
+	}
+	var executor agent.Executor
+	switch *executorName {
+	case executorShell:
+		executor = agent.NewShell(splitList(*passEnv)...)
+	case executorFirecracker:
+		var network netip.Prefix
+		if *fcNetwork != "" {
+			if network, err = netip.ParsePrefix(*fcNetwork); err != nil {
+				fatal("Invalid microVM network", "error", err)
+			}
+		}
+		executor, err = agent.NewFirecracker(agent.FirecrackerConfig{
+			Binary:      *fcBinary,
+			Kernel:      *fcKernel,
+			RootFS:      *fcRootFS,
+			Images:      *fcImages,
+			Init:        *fcInit,
+			VCPUs:       *fcVCPUs,
+			MemoryMiB:   *fcMemory,
+			Network:     network,
+			Nameservers: splitList(*fcNameservers),
+		})
+		if err != nil {
+			fatal("Invalid Firecracker executor settings", "error", err)
+		}
+	default:
+		fatal("Invalid executor, want shell or firecracker", "executor", *executorName)
+	}
+	if _, ok := labelSet[executorLabel]; !ok {
+		labelSet[executorLabel] = *executorName
+	}
+	if err := os.MkdirAll(*workDir, 0o700); err != nil {
+		fatal("Failed to create the work directory", "dir", *workDir, "error", err)
+	}
+	var updatePublicKey ed25519.PublicKey
+	if *updateKey != "" {
+		if updatePublicKey, err = releases.ParsePublicKey(*updateKey); err != nil {
+			fatal("Invalid update key", "error", err)
+		}
+	}
+
+	jobKeyring, err := jobsig.ParseKeyring(splitList(*jobKeys))
+	if err != nil {
+		fatal("Invalid job keys", "error", err)
+	}
+
+	creds := insecure.NewCredentials()
+	// Updates are downloaded trusting the same CAs as the server
+	httpClient := &http.Client{Timeout: downloadTimeout}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		tlsConfig, err := clientTLS(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fatal("Invalid TLS settings", "error", err)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+		httpClient.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig.Clone()}
+	}
+	conn, err := grpc.NewClient(*server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		fatal("Invalid server address", "server", *server, "error", err)
+	}
+	defer conn.Close()
+
+	// The HTTP transport long-polls, so its client has no overall timeout
+	var httpConn *agenthttp.Conn
+	if *httpURL != "" && *transport != transportGRPC {
+		httpConn, err = agenthttp.NewConn(*httpURL, &http.Client{Transport: httpClient.Transport})
+		if err != nil {
+			fatal("Invalid HTTP URL", "http_url", *httpURL, "error", err)
+		}
+	}
+	var agentConn grpc.ClientConnInterface = conn
+	var fallback grpc.ClientConnInterface
+	switch {
+	case *transport == transportHTTP:
+		agentConn = httpConn
+	case httpConn != nil:
+		fallback = httpConn
+	}
+
+	a := agent.New(agent.Config{
+		Hostname: *name,
+		Labels:   labelSet,
+		Capacity: *capacity,
+		Token:    *token,
+		WorkDir:  *workDir,
+
+		JobKeys:    jobKeyring,
+		UpdateKey:  updatePublicKey,
+		HTTPClient: httpClient,
+		Fallback:   fallback,
+	}, agentConn, executor)
+
+	// Running jobs are handed back to the server on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	slog.Info("Starting Open-CICD agent", "version", version.Version, "server", *server, "transport", *transport, "http_url", *httpURL, "tls", creds.Info().SecurityProtocol == "tls", "workdir", *workDir, "executor", *executorName, "signed_jobs", len(jobKeyring) > 0, "auto_update", updatePublicKey != nil)
+	err = a.Run(ctx)
+	if errors.Is(err, agent.ErrUpdated) {
+		conn.Close()
+		slog.Info("Restarting into the updated agent")
+		err = agent.Restart()
+	}
+	if err != nil {
+		fatal("Agent failed", "error", err)
+	}
+	slog.Info("Agent stopped")
+}
+
+// clientTLS returns the TLS settings for connecting to the server: its
+// certificate is verified against the CAs in caFile, or the system roots if
+// caFile is empty, and the client certificate is presented if given.
+func clientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("CA file holds no PEM certificates")
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-cert-file and -key-file must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// parseLabels parses a comma-separated list of key=value labels.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range splitList(s) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, want key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envOr returns the value of the environment variable name, or def if it is
+// unset or empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt is envOr for integers.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("Invalid "+name, "value", v)
+	}
+	return n
+}
+
+// envBool is envOr for booleans.
+func envBool(name string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fatal("Invalid "+name, "value", v)
+	}
+	return b
+}
+
+// fatal logs msg and its attributes at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"open-cicd/internal/client"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/types"
+)
+
+// pollInterval is how often run -wait checks on the pipeline.
+const pollInterval = 2 * time.Second
+
+// commands are the subcommands, in the order usage lists them.
+var commands = []command{
+	{
+		name: "run", args: "[flags]",
+		summary: "Run a pipeline definition",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("f", ".opencicd.yaml", "pipeline definition file, or - for standard input")
+			fs.String("repo", "", "repository of the run (owner/repo)")
+			fs.String("ref", "", "git ref of the run")
+			fs.Var(&inputFlag{}, "input", "value of an input the pipeline declares, as NAME=VALUE; repeatable")
+			fs.Bool("wait", false, "wait for the run to finish and exit non-zero unless it succeeds")
+		},
+		run: runPipeline,
+	},
+	{
+		name: "lint", args: "[flags] [file...]",
+		summary: "Check pipeline definitions, by default .opencicd.yaml, for errors without running them",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("repo", "", "repository of the definitions (owner/repo), to check the variables and secrets they use")
+			fs.String("ref", "", "git ref whose variables apply")
+			fs.Bool("strict", false, "exit non-zero on warnings too")
+			fs.Bool("json", false, "print the results as JSON")
+		},
+		run: lintPipelines,
+	},
+	{
+		name: "jobs list", args: "[flags]",
+		summary: "List jobs, newest first",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("project", "", "only jobs of this project (owner/repo)")
+			fs.String("org", "", "only jobs of this organization")
+			fs.String("state", "", "only jobs in this state")
+			fs.String("branch", "", "only jobs of this branch")
+			fs.String("agent", "", "only jobs assigned to this agent")
+			listFlags(fs)
+		},
+		run: listJobs,
+	},
+	{
+		name: "jobs get", args: "<job>",
+		summary: "Show a job as JSON",
+		run:     getJob,
+	},
+	{
+		name: "jobs retry", args: "<job>",
+		summary: "Run a failed, timed out or cancelled job again",
+		run:     retryJob,
+	},
+	{
+		name: "jobs tests", args: "[-failed] <job>",
+		summary: "Show the results of a job's test reports",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("failed", false, "list only the failed tests")
+			fs.Bool("json", false, "print the results as JSON")
+		},
+		run: jobTests,
+	},
+	{
+		name: "pipelines list", args: "[flags]",
+		summary: "List pipeline runs, newest first",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("project", "", "only runs of this project (owner/repo)")
+			fs.String("org", "", "only runs of this organization")
+			fs.String("state", "", "only runs in this state")
+			fs.String("branch", "", "only runs of this branch")
+			fs.String("name", "", "only runs of the pipeline of this name")
+			listFlags(fs)
+		},
+		run: listPipelines,
+	},
+	{
+		name: "pipelines run", args: "-repo owner/repo [-input NAME=VALUE]... <name>",
+		summary: "Run a pipeline again with inputs, from the definition of its latest run",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("repo", "", "repository of the pipeline (owner/repo)")
+			fs.String("ref", "", "run the definition of the pipeline's latest run at this git ref")
+			fs.Var(&inputFlag{}, "input", "value of an input the pipeline declares, as NAME=VALUE; repeatable")
+			fs.Bool("wait", false, "wait for the run to finish and exit non-zero unless it succeeds")
+		},
+		run: startPipeline,
+	},
+	{
+		name: "pipelines get", args: "<pipeline>",
+		summary: "Show a pipeline run as JSON",
+		run:     getPipeline,
+	},
+	{
+		name: "pipelines rerun", args: "[-failed] <pipeline>",
+		summary: "Run a finished pipeline run again",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("failed", false, "run only the stages that did not succeed")
+		},
+		run: rerunPipeline,
+	},
+	{
+		name: "pipelines approve", args: "[-comment text] <pipeline> <stage>",
+		summary: "Approve a manual stage awaiting approval",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("comment", "", "comment recorded with the approval")
+		},
+		run: decideStage(types.Approved),
+	},
+	{
+		name: "pipelines reject", args: "[-comment text] <pipeline> <stage>",
+		summary: "Reject a manual stage awaiting approval",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("comment", "", "comment recorded with the rejection")
+		},
+		run: decideStage(types.Rejected),
+	},
+	{
+		name: "pipelines authorize", args: "[-comment text] [-secrets] <pipeline>",
+		summary: "Let a pipeline run of a pull request from a fork start",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("comment", "", "comment recorded with the authorization")
+			fs.Bool("secrets", false, "let the run have the project's secrets and ID tokens")
+		},
+		run: authorizePipeline,
+	},
+	{
+		name: "environments list", args: "-project owner/repo",
+		summary: "List the environments of a project and what is deployed to each",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("project", "", "project of the environments (owner/repo)")
+			listFlags(fs)
+		},
+		run: listEnvironments,
+	},
+	{
+		name: "environments history", args: "-project owner/repo <environment>",
+		summary: "List the deployments to an environment, newest first",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("project", "", "project of the environment (owner/repo)")
+			listFlags(fs)
+		},
+		run: deploymentHistory,
+	},
+	{
+		name: "reproduce", args: "[flags] <job>",
+		summary: "Run a job's tasks again in Docker on this machine",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("dir", ".", "workspace directory, normally a checkout of the job's commit")
+			fs.String("image", "", "image of the tasks that ran on an agent's host without one")
+			fs.String("docker", "docker", "docker command")
+			fs.Bool("print", false, "print the docker commands instead of running them, with secrets left as references")
+		},
+		run: reproduceJob,
+	},
+	{
+		name: "logs", args: "[-f] <job>",
+		summary: "Print the output of a job",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("f", false, "follow the output until the job finishes and exit non-zero unless it succeeds")
+		},
+		run: jobLogs,
+	},
+	{
+		name: "cancel", args: "[-reason text] <job>",
+		summary: "Cancel a job",
+		flags: func(fs *flag.FlagSet) {
+			fs.String("reason", "", "why the job is cancelled")
+		},
+		run: cancelJob,
+	},
+}
+
+// listFlags defines the flags shared by list commands.
+func listFlags(fs *flag.FlagSet) {
+	fs.Int("limit", 20, "maximum number of items to show")
+	fs.Bool("json", false, "print the items as JSON")
+}
+
+// str, boolean and integer return the value of a flag defined on fs.
+func str(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.String()
+}
+
+func boolean(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func integer(fs *flag.FlagSet, name string) int {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// oneArg returns the single positional argument of a command.
+func oneArg(args []string, what string) (string, error) {
+	if len(args) != 1 {
+		return "", &usageError{msg: "expected one " + what + " ID"}
+	}
+	return args[0], nil
+}
+
+// noArgs rejects positional arguments.
+func noArgs(args []string) error {
+	if len(args) > 0 {
+		return &usageError{msg: "unexpected arguments: " + strings.Join(args, " ")}
+	}
+	return nil
+}
+
+// inputFlag collects the NAME=VALUE values of a repeatable -input flag.
+type inputFlag map[string]string
+
+func (f *inputFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for name, value := range *f {
+		pairs = append(pairs, name+"="+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *inputFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("input %s is not NAME=VALUE", s)
+	}
+	if *f == nil {
+		*f = make(inputFlag)
+	}
+	(*f)[name] = value
+	return nil
+}
+
+// inputs returns the values of the -input flag defined on fs.
+func inputs(fs *flag.FlagSet) map[string]string {
+	return *fs.Lookup("input").Value.(*inputFlag)
+}
+
+// runPipeline handles opencicd run.
+func runPipeline(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	def, err := readDefinition(str(fs, "f"))
+	if err != nil {
+		return err
+	}
+
+	run, err := c.SubmitPipeline(ctx, types.CreatePipelineRequest{
+		Definition: string(def),
+		Repository: str(fs, "repo"),
+		Ref:        str(fs, "ref"),
+		Inputs:     inputs(fs),
+	})
+	if err != nil {
+		return err
+	}
+	return followRun(ctx, c, run, boolean(fs, "wait"))
+}
+
+// startPipeline handles opencicd pipelines run.
+func startPipeline(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return &usageError{msg: "expected one pipeline name"}
+	}
+	if str(fs, "repo") == "" {
+		return &usageError{msg: "-repo is required"}
+	}
+	run, err := c.StartPipeline(ctx, args[0], types.StartPipelineRequest{
+		Repository: str(fs, "repo"),
+		Ref:        str(fs, "ref"),
+		Inputs:     inputs(fs),
+	})
+	if err != nil {
+		return err
+	}
+	return followRun(ctx, c, run, boolean(fs, "wait"))
+}
+
+// followRun prints the stages of a run just started and, with wait, its
+// changes of state until it finishes, failing unless it succeeds.
+func followRun(ctx context.Context, c *client.Client, run *types.Pipeline, wait bool) error {
+	fmt.Printf("pipeline %s (%s) %s\n", run.ID, run.Name, run.State)
+	w := table()
+	for _, stage := range run.Stages {
+		fmt.Fprintf(w, "  %s\t%s\n", stage.Name, strings.Join(stage.JobIDs, " "))
+	}
+	w.Flush()
+	if !wait {
+		return nil
+	}
+
+	state := run.State
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for !run.State.Terminal() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		detail, err := c.GetPipeline(ctx, run.ID)
+		if err != nil {
+			return err
+		}
+		run = detail.Pipeline
+		if run.State != state {
+			fmt.Printf("pipeline %s %s\n", run.ID, run.State)
+			state = run.State
+		}
+	}
+	if run.State != types.PipelineStateSucceeded {
+		return errFailed
+	}
+	return nil
+}
+
+// readDefinition reads the pipeline definition in file, or on standard
+// input if file is -.
+func readDefinition(file string) ([]byte, error) {
+	var def []byte
+	var err error
+	if file == "-" {
+		def, err = io.ReadAll(os.Stdin)
+	} else {
+		def, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pipeline definition: %w", err)
+	}
+	return def, nil
+}
+
+// lintPipelines handles opencicd lint. It prints every problem as
+// file:line: severity: path: message, as editors and pre-commit hooks
+// expect, and fails if a definition has errors, or warnings with -strict.
+func lintPipelines(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	files := args
+	if len(files) == 0 {
+		files = []string{".opencicd.yaml"}
+	}
+	var results []*types.PipelineValidation
+	failed := false
+	for _, file := range files {
+		def, err := readDefinition(file)
+		if err != nil {
+			return err
+		}
+		result, err := c.ValidatePipeline(ctx, types.ValidatePipelineRequest{
+			Definition: string(def),
+			Repository: str(fs, "repo"),
+			Ref:        str(fs, "ref"),
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		results = append(results, result)
+		failed = failed || !result.Valid || (boolean(fs, "strict") && len(result.Warnings) > 0)
+		if boolean(fs, "json") {
+			continue
+		}
+		for _, p := range result.Errors {
+			printProblem(file, "error", p)
+		}
+		for _, p := range result.Warnings {
+			printProblem(file, "warning", p)
+		}
+	}
+	if boolean(fs, "json") {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func printProblem(file, severity string, p types.PipelineProblem) {
+	where := file
+	if p.Line > 0 {
+		where = fmt.Sprintf("%s:%d", file, p.Line)
+	}
+	if p.Path != "" {
+		fmt.Printf("%s: %s: %s: %s\n", where, severity, p.Path, p.Message)
+		return
+	}
+	fmt.Printf("%s: %s: %s\n", where, severity, p.Message)
+}
+
+// listJobs handles opencicd jobs list.
+func listJobs(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	page, err := c.ListJobs(ctx, client.JobListOptions{
+		ListOptions:  client.ListOptions{Limit: integer(fs, "limit"), Desc: true},
+		Project:      str(fs, "project"),
+		Organization: str(fs, "org"),
+		State:        types.JobState(str(fs, "state")),
+		Branch:       str(fs, "branch"),
+		AgentID:      str(fs, "agent"),
+	})
+	if err != nil {
+		return err
+	}
+	if boolean(fs, "json") {
+		return printJSON(page.Items)
+	}
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tSTATE\tPROJECT\tAGENT\tCREATED")
+	for _, job := range page.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Name, job.State,
+			orDash(job.Repository), orDash(job.AgentID), age(job.CreatedAt))
+	}
+	return w.Flush()
+}
+
+// getJob handles opencicd jobs get.
+func getJob(ctx context.Context, c *client.Client, _ *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	job, err := c.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	return printJSON(job)
+}
+
+// retryJob handles opencicd jobs retry.
+func retryJob(ctx context.Context, c *client.Client, _ *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	job, err := c.RetryJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.PipelineID != "" {
+		fmt.Printf("job %s retried as %s in pipeline %s\n", id, job.ID, job.PipelineID)
+		return nil
+	}
+	fmt.Printf("job %s retried as %s\n", id, job.ID)
+	return nil
+}
+
+// jobTests handles opencicd jobs tests, exiting non-zero if any test failed.
+func jobTests(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	tests, err := c.JobTests(ctx, id, boolean(fs, "failed"))
+	if err != nil {
+		return err
+	}
+	if boolean(fs, "json") {
+		return printJSON(tests)
+	}
+	if len(tests.Reports) == 0 {
+		fmt.Printf("job %s uploaded no test reports\n", id)
+		return nil
+	}
+	w := table()
+	fmt.Fprintln(w, "SUITE\tTEST\tSTATUS\tDURATION\tMESSAGE")
+	for _, report := range tests.Reports {
+		for _, suite := range report.Suites {
+			for _, tc := range suite.Cases {
+				message, _, _ := strings.Cut(tc.Message, "\n")
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", suite.Name, tc.Name, tc.Status,
+					tc.Duration.Std().Round(time.Millisecond), orDash(message))
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	sum := tests.Summary
+	fmt.Printf("\n%d tests, %d passed, %d failed, %d skipped in %s\n",
+		sum.Total, sum.Passed, sum.Failed, sum.Skipped, sum.Duration.Std().Round(time.Millisecond))
+	if sum.Failed > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// listPipelines handles opencicd pipelines list.
+func listPipelines(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	page, err := c.ListPipelines(ctx, client.PipelineListOptions{
+		ListOptions:  client.ListOptions{Limit: integer(fs, "limit"), Desc: true},
+		Project:      str(fs, "project"),
+		Organization: str(fs, "org"),
+		State:        types.PipelineState(str(fs, "state")),
+		Branch:       str(fs, "branch"),
+		Name:         str(fs, "name"),
+	})
+	if err != nil {
+		return err
+	}
+	if boolean(fs, "json") {
+		return printJSON(page.Items)
+	}
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tSTATE\tPROJECT\tREF\tCREATED")
+	for _, run := range page.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.Name, run.State,
+			orDash(run.Repository), orDash(run.Ref), age(run.CreatedAt))
+	}
+	return w.Flush()
+}
+
+// getPipeline handles opencicd pipelines get.
+func getPipeline(ctx context.Context, c *client.Client, _ *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "pipeline")
+	if err != nil {
+		return err
+	}
+	run, err := c.GetPipeline(ctx, id)
+	if err != nil {
+		return err
+	}
+	return printJSON(run)
+}
+
+// rerunPipeline handles opencicd pipelines rerun.
+func rerunPipeline(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "pipeline")
+	if err != nil {
+		return err
+	}
+	run, err := c.RerunPipeline(ctx, id, boolean(fs, "failed"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pipeline %s re-run as %s\n", id, run.ID)
+	return nil
+}
+
+// jobLogs handles opencicd logs. Standard error output of the job goes to
+// standard error.
+func jobLogs(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	if !boolean(fs, "f") {
+		body, err := c.Logs(ctx, id)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	}
+
+	state, err := c.FollowLogs(ctx, id, func(chunk client.LogChunk) error {
+		out := os.Stdout
+		if chunk.Stream == logs.Stderr {
+			out = os.Stderr
+		}
+		_, err := io.WriteString(out, chunk.Text)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if state != types.JobStateSucceeded {
+		fmt.Fprintf(os.Stderr, "job %s %s\n", id, state)
+		return errFailed
+	}
+	return nil
+}
+
+// cancelJob handles opencicd cancel.
+func cancelJob(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	job, err := c.CancelJob(ctx, id, str(fs, "reason"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("job %s %s\n", job.ID, job.State)
+	return nil
+}
+
+// decideStage returns the handler of opencicd pipelines approve and
+// pipelines reject.
+func decideStage(decision types.ApprovalDecision) func(context.Context, *client.Client, *flag.FlagSet, []string) error {
+	return func(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+		if len(args) != 2 {
+			return &usageError{msg: "expected a pipeline ID and a stage name"}
+		}
+		run, err := c.DecideStage(ctx, args[0], args[1], decision, str(fs, "comment"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stage %s of pipeline %s %s\n", args[1], run.ID, decision)
+		return nil
+	}
+}
+
+// authorizePipeline handles opencicd pipelines authorize.
+func authorizePipeline(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "pipeline")
+	if err != nil {
+		return err
+	}
+	run, err := c.AuthorizePipeline(ctx, id, str(fs, "comment"), boolean(fs, "secrets"))
+	if err != nil {
+		return err
+	}
+	if run.Restricted {
+		fmt.Printf("pipeline %s authorized without secrets\n", run.ID)
+	} else {
+		fmt.Printf("pipeline %s authorized\n", run.ID)
+	}
+	return nil
+}
+
+// requiredProject returns the -project flag, which the command needs.
+func requiredProject(fs *flag.FlagSet) (string, error) {
+	project := str(fs, "project")
+	if project == "" {
+		return "", &usageError{msg: "-project is required"}
+	}
+	return project, nil
+}
+
+// listEnvironments handles opencicd environments list.
+func listEnvironments(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	project, err := requiredProject(fs)
+	if err != nil {
+		return err
+	}
+	page, err := c.ListEnvironments(ctx, project, client.ListOptions{Limit: integer(fs, "limit")})
+	if err != nil {
+		return err
+	}
+	if boolean(fs, "json") {
+		return printJSON(page.Items)
+	}
+	w := table()
+	fmt.Fprintln(w, "NAME\tCOMMIT\tREF\tDEPLOYED\tDEPLOYING")
+	for _, env := range page.Items {
+		commit, ref, deployed, deploying := "-", "-", "-", "-"
+		if d := env.Current; d != nil {
+			commit, ref, deployed = orDash(shortCommit(d.Commit)), orDash(d.Ref), age(*d.FinishedAt)
+		}
+		if d := env.Active; d != nil {
+			deploying = "job " + d.JobID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", env.Name, commit, ref, deployed, deploying)
+	}
+	return w.Flush()
+}
+
+// deploymentHistory handles opencicd environments history.
+func deploymentHistory(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return &usageError{msg: "expected one environment name"}
+	}
+	project, err := requiredProject(fs)
+	if err != nil {
+		return err
+	}
+	page, err := c.ListDeployments(ctx, project, args[0], client.ListOptions{Limit: integer(fs, "limit"), Desc: true})
+	if err != nil {
+		return err
+	}
+	if boolean(fs, "json") {
+		return printJSON(page.Items)
+	}
+	w := table()
+	fmt.Fprintln(w, "ID\tSTATE\tCOMMIT\tREF\tJOB\tSTARTED")
+	for _, d := range page.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.State,
+			orDash(shortCommit(d.Commit)), orDash(d.Ref), d.JobID, age(d.CreatedAt))
+	}
+	return w.Flush()
+}
+
+// shortCommit abbreviates a commit SHA the way git does.
+func shortCommit(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// table returns a writer aligning tab-separated columns on standard output.
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// printJSON writes v to standard output as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// orDash returns s, or a dash when it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// age describes how long ago t was, to the largest whole unit.
+func age(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,189 @@
+// Command opencicd is the command line client of the Open-CICD server. It
+// submits pipelines, lists and cancels jobs, follows their logs and runs
+// them again locally in Docker.
+//
+// The server URL and API token are read from the config file, by default
+// opencicd/config.yaml under the user configuration directory or the file
+// named by OPENCICD_CONFIG, and then from OPENCICD_SERVER and
+// OPENCICD_TOKEN, which take precedence.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"open-cicd/internal/client"
+)
+
+// defaultServer is the server used when none is configured.
+const defaultServer = "http://localhost:8080"
+
+// config is the contents of the config file.
+type config struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// command is a subcommand. Its name may be two words, as in "jobs list".
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error
+	// flags defines the command's flags on fs before it runs.
+	flags func(fs *flag.FlagSet)
+}
+
+// usageError is a mistake in the command line, reported with the usage of
+// the command.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+// errFailed reports that the job or pipeline a command waited for did not
+// succeed; the command has already said so.
+var errFailed = errors.New("failed")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// run executes the command line args and returns the exit status: 0 on
+// success, 2 for usage errors and 1 for anything else.
+func run(args []string, stderr io.Writer) int {
+	cmd, rest := lookup(args)
+	if cmd == nil {
+		usage(stderr)
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			return 0
+		}
+		fmt.Fprintf(stderr, "\nunknown command %q\n", strings.Join(args, " "))
+		return 2
+	}
+
+	fs := flag.NewFlagSet("opencicd "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: opencicd %s %s\n\n%s.\n", cmd.name, cmd.args, cmd.summary)
+		if hasFlags(fs) {
+			fmt.Fprintln(stderr)
+			fs.PrintDefaults()
+		}
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	if err := fs.Parse(rest); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(stderr, "opencicd:", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	c := client.New(cfg.Server, cfg.Token)
+
+	err = cmd.run(ctx, c, fs, fs.Args())
+	var uerr *usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &uerr):
+		fmt.Fprintln(stderr, "opencicd:", err)
+		fs.Usage()
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	default:
+		fmt.Fprintln(stderr, "opencicd:", err)
+		return 1
+	}
+}
+
+// lookup finds the command named by the first one or two words of args and
+// returns it with the remaining arguments.
+func lookup(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// usage lists the commands.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: opencicd <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-21s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "opencicd <command> -h" for the flags of a command.`)
+}
+
+// hasFlags reports whether any flag is defined on fs.
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// loadConfig reads the config file, if there is one, then the environment.
+func loadConfig() (*config, error) {
+	cfg := &config{Server: defaultServer}
+	path := os.Getenv("OPENCICD_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "opencicd", "config.yaml")
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+		case err != nil:
+			return nil, fmt.Errorf("reading config file: %w", err)
+		default:
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if v := os.Getenv("OPENCICD_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("OPENCICD_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+	if !strings.HasPrefix(cfg.Server, "http://") && !strings.HasPrefix(cfg.Server, "https://") {
+		return nil, fmt.Errorf("server %q must be an http:// or https:// URL", cfg.Server)
+	}
+	return cfg, nil
+}
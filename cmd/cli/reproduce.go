@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"open-cicd/internal/client"
+	"open-cicd/internal/types"
+)
+
+// reproduceJob handles opencicd reproduce: it runs the tasks of a job in
+// Docker on this machine, with the directory given by -dir, normally a
+// checkout of the job's commit, as the workspace. Services are started on
+// a network of their own first. Secrets are taken from the variables of
+// the same name in the environment of the command.
+func reproduceJob(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) error {
+	id, err := oneArg(args, "job")
+	if err != nil {
+		return err
+	}
+	bundle, err := c.ReproduceJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(str(fs, "dir"))
+	if err != nil {
+		return err
+	}
+	r := &reproduction{
+		bundle: bundle,
+		dir:    dir,
+		image:  str(fs, "image"),
+		docker: str(fs, "docker"),
+		dryRun: boolean(fs, "print"),
+		prefix: "opencicd-reproduce-" + bundle.JobID,
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	if !r.dryRun {
+		r.warn()
+	}
+	return r.run(ctx)
+}
+
+// reproduction runs a reproduce bundle with the docker command line.
+type reproduction struct {
+	bundle *types.ReproduceBundle
+	// dir is mounted as the workspace.
+	dir string
+	// image runs the tasks that have none, which ran on an agent's host.
+	image  string
+	docker string
+	// dryRun prints the docker commands rather than running them.
+	dryRun bool
+	// prefix names the containers and network of the run.
+	prefix string
+}
+
+// check rejects bundles that cannot run in Docker.
+func (r *reproduction) check() error {
+	for _, t := range r.bundle.Spec.Tasks {
+		if t.Image == "" && r.image == "" {
+			return &usageError{msg: fmt.Sprintf("task %q has no image, since it ran on an agent's host; pick one with -image", t.Name)}
+		}
+		if len(t.Entrypoint) == 0 {
+			return fmt.Errorf("task %q runs with the %s shell; only tasks with an entrypoint, such as those of sh and bash, can be reproduced", t.Name, r.bundle.Spec.Shell)
+		}
+	}
+	return nil
+}
+
+// warn points out what makes the run differ from the job's: a workspace at
+// another commit and secrets missing from the environment.
+func (r *reproduction) warn() {
+	if commit := r.bundle.Commit; commit != "" {
+		out, err := exec.Command("git", "-C", r.dir, "rev-parse", "HEAD").Output()
+		head := strings.TrimSpace(string(out))
+		if err == nil && head != commit {
+			fmt.Fprintf(os.Stderr, "warning: %s is at %s, the job ran at %s; run git checkout %s\n", r.dir, shortCommit(head), shortCommit(commit), commit)
+		}
+	}
+	for _, name := range r.bundle.Secrets {
+		if _, ok := os.LookupEnv(name); !ok {
+			fmt.Fprintf(os.Stderr, "warning: %s is not set; the job got a secret or ID token in it\n", name)
+		}
+	}
+}
+
+// run starts the services, runs the tasks in order until one fails and
+// removes what it started.
+func (r *reproduction) run(ctx context.Context) error {
+	spec := r.bundle.Spec
+	network := ""
+	if len(spec.Services) > 0 {
+		network = r.prefix
+		if err := r.command(ctx, "network", "create", network); err != nil {
+			return fmt.Errorf("creating network: %w", err)
+		}
+		defer r.cleanup("network", "rm", network)
+	}
+	for _, svc := range spec.Services {
+		name := r.prefix + "-" + svc.Name
+		args := []string{"run", "--detach", "--rm", "--name", name, "--network", network, "--network-alias", svc.Name}
+		args = append(args, r.envArgs(svc.Env, false)...)
+		args = append(args, containerArgs(svc.Image, svc.Entrypoint, svc.Command)...)
+		if err := r.command(ctx, args...); err != nil {
+			return fmt.Errorf("starting service %s: %w", svc.Name, err)
+		}
+		defer r.cleanup("rm", "--force", name)
+	}
+	for i, t := range spec.Tasks {
+		if !r.dryRun {
+			fmt.Fprintf(os.Stderr, "==> task %s\n", t.Name)
+		}
+		name := r.prefix + "-task-" + strconv.Itoa(i)
+		args := []string{"run", "--rm", "--name", name, "--volume", r.dir + ":" + spec.Workspace, "--workdir", spec.Workspace}
+		if network != "" {
+			args = append(args, "--network", network)
+		}
+		if spec.CPUMillis > 0 {
+			args = append(args, "--cpus", strconv.FormatFloat(float64(spec.CPUMillis)/1000, 'f', -1, 64))
+		}
+		if spec.MemoryBytes > 0 {
+			args = append(args, "--memory", strconv.FormatInt(spec.MemoryBytes, 10))
+		}
+		args = append(args, securityArgs(spec.Security)...)
+		env := map[string]string{
+			"CI":                 "true",
+			"OPENCICD_JOB_ID":    r.bundle.JobID,
+			"OPENCICD_JOB_NAME":  r.bundle.Name,
+			"OPENCICD_WORKSPACE": spec.Workspace,
+			"OPENCICD_OUTPUT":    path.Join(spec.Workspace, ".opencicd", "output"),
+		}
+		for k, v := range t.Env {
+			env[k] = v
+		}
+		args = append(args, r.envArgs(env, true)...)
+		image := t.Image
+		if image == "" {
+			image = r.image
+		}
+		args = append(args, containerArgs(r.expand(image), t.Entrypoint, []string{strings.Join(t.Commands, "\n")})...)
+		err := r.command(ctx, args...)
+		if ctx.Err() != nil {
+			// Killing docker run leaves the container running.
+			r.cleanup("rm", "--force", name)
+			return ctx.Err()
+		}
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			fmt.Fprintf(os.Stderr, "task %s failed with exit code %d\n", t.Name, exit.ExitCode())
+			return errFailed
+		}
+		if err != nil {
+			return fmt.Errorf("running task %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// envArgs returns the docker flags setting env, with secret references
+// filled in from the environment of the command, followed by those
+// passing the secrets themselves through if secrets is set.
+func (r *reproduction) envArgs(env map[string]string, secrets bool) []string {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, k := range names {
+		args = append(args, "--env", k+"="+r.expand(env[k]))
+	}
+	if secrets {
+		for _, name := range r.bundle.Secrets {
+			args = append(args, "--env", name)
+		}
+	}
+	return args
+}
+
+// expand fills in the ${NAME} references to secrets the bundle put in
+// place of secret expressions. Dry runs print the references rather than
+// the secrets.
+func (r *reproduction) expand(s string) string {
+	if r.dryRun {
+		return s
+	}
+	for _, name := range r.bundle.Secrets {
+		s = strings.ReplaceAll(s, "${"+name+"}", os.Getenv(name))
+	}
+	return s
+}
+
+// securityArgs returns the docker flags applying the security context of
+// the job's tasks.
+func securityArgs(s *types.SecurityContext) []string {
+	if s == nil {
+		return nil
+	}
+	var args []string
+	if s.RunAsUser != nil {
+		user := strconv.FormatInt(*s.RunAsUser, 10)
+		if s.RunAsGroup != nil {
+			user += ":" + strconv.FormatInt(*s.RunAsGroup, 10)
+		}
+		args = append(args, "--user", user)
+	}
+	if s.ReadOnlyRootFilesystem {
+		args = append(args, "--read-only")
+	}
+	if s.NoNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+	for _, c := range s.CapDrop {
+		args = append(args, "--cap-drop", c)
+	}
+	for _, c := range s.CapAdd {
+		args = append(args, "--cap-add", c)
+	}
+	return args
+}
+
+// containerArgs returns the end of a docker run command line running image
+// with entrypoint and args; docker takes only the first word of an
+// entrypoint as a flag.
+func containerArgs(image string, entrypoint, args []string) []string {
+	var list []string
+	if len(entrypoint) > 0 {
+		list = append(list, "--entrypoint", entrypoint[0], image)
+		list = append(list, entrypoint[1:]...)
+	} else {
+		list = append(list, image)
+	}
+	return append(list, args...)
+}
+
+// command runs docker with args, or prints the command line in a dry run.
+func (r *reproduction) command(ctx context.Context, args ...string) error {
+	if r.dryRun {
+		fmt.Println(shellJoin(append([]string{r.docker}, args...)))
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, r.docker, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// cleanup runs docker with args to remove what the run started, even after
+// it was interrupted.
+func (r *reproduction) cleanup(args ...string) {
+	if r.dryRun {
+		fmt.Println(shellJoin(append([]string{r.docker}, args...)))
+		return
+	}
+	cmd := exec.Command(r.docker, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: docker %s: %v: %s\n", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+}
+
+// shellJoin quotes args for a POSIX shell where needed.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+") == "" {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
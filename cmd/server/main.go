@@ -1,66 +1,817 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"crypto/rsa"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	// Schedules may use any IANA time zone, whether or not the host has the
+	// time zone database installed.
+	_ "time/tzdata"
 
-	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"open-cicd/internal/annotations"
+	"open-cicd/internal/artifacts"
+	"open-cicd/internal/audit"
+	"open-cicd/internal/auth"
+	"open-cicd/internal/blobs"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/certs"
+	"open-cicd/internal/checks"
+	"open-cicd/internal/config"
+	scmcredentials "open-cicd/internal/credentials"
+	"open-cicd/internal/downstream"
+	"open-cicd/internal/environments"
+	"open-cicd/internal/events"
+	"open-cicd/internal/gc"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/jobsig"
+	"open-cicd/internal/kube"
+	"open-cicd/internal/leader"
+	"open-cicd/internal/logging"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/metrics"
+	"open-cicd/internal/notifications"
+	"open-cicd/internal/oidc"
+	"open-cicd/internal/orgs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/projects"
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/rbac"
+	imageregistry "open-cicd/internal/registry"
+	"open-cicd/internal/releases"
+	"open-cicd/internal/schedules"
+	"open-cicd/internal/scm"
+	"open-cicd/internal/secrets"
+	"open-cicd/internal/server"
+	"open-cicd/internal/server/agentrpc"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/snapshots"
+	"open-cicd/internal/sso"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/templates"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+	"open-cicd/internal/variables"
+	"open-cicd/internal/vault"
+	"open-cicd/internal/version"
+	"open-cicd/internal/webhooks"
 )
 
+// grpcStopTimeout bounds how long a leader stepping down waits for agent
+// calls in progress before closing the agent port.
+const grpcStopTimeout = 10 * time.Second
+
 func main() {
-	// Create router
-	r := mux.NewRouter()
-
-	// Health check endpoint
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status": "healthy", "timestamp": "%s"}`, time.Now().Format(time.RFC3339))
-	}).Methods("GET")
-
-	// Basic endpoints (to be implemented)
-	r.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotImplemented)
-		fmt.Fprintf(w, "Agent registration - not implemented yet")
-	}).Methods("POST")
-
-	r.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotImplemented)
-		fmt.Fprintf(w, "Job management - not implemented yet")
-	}).Methods("GET", "POST")
+	// Configuration: defaults, then the YAML file given by -config or
+	// CONFIG_FILE, then environment variables
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file")
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
-	// Server configuration
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Logging: JSON lines on stderr, or key=value lines with format text
+	if err := logging.Setup(os.Stderr, cfg.Logging.Level, cfg.Logging.Format); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+	if *configPath != "" {
+		slog.Info("Loaded configuration", "file", *configPath)
+	}
+
+	// Tracing: spans are exported over OTLP when OTEL_EXPORTER_OTLP_ENDPOINT
+	// is set; the other OTEL_* variables configure the exporter
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+	if !tracing.Enabled() {
+		slog.Info("OTEL_EXPORTER_OTLP_ENDPOINT is not set; tracing is disabled")
+	}
+
+	// Storage: PostgreSQL or SQLite when a database URL is set, in-memory
+	// otherwise
+	databaseURL := cfg.Storage.DatabaseURL
+	store, err := storage.Open(context.Background(), databaseURL)
+	if err != nil {
+		fatal("Failed to open storage", "error", err)
+	}
+	defer store.Close()
+	if databaseURL == "" {
+		slog.Info("DATABASE_URL is not set; using in-memory storage")
+	}
+
+	// Agents send a heartbeat every interval and are marked offline, with
+	// their jobs re-queued, after missing them for the timeout
+	heartbeatInterval := cfg.Agents.HeartbeatInterval
+	heartbeatTimeout := cfg.Agents.HeartbeatTimeout
+
+	// Organizations own projects and their work; each has a registration
+	// token for its own agents, alongside the tokens of shared agents
+	organizations := orgs.NewService(store)
+
+	// Registration tokens agents must present to POST /register
+	tokens := cfg.Auth.AgentRegistrationTokens
+	registry := scheduler.NewRegistry(store, tokens, heartbeatInterval)
+	registry.AcceptOrganizationTokens(organizations)
+	agentTokens := scheduler.NewAgentTokens(store)
+	registry.AcceptAgentTokens(agentTokens)
+	if len(tokens) == 0 {
+		slog.Warn("AGENT_REGISTRATION_TOKENS is empty; only organization agents can register")
+	}
+	// Agents older than AGENT_MIN_VERSION are refused
+	registry.RequireVersion(cfg.Agents.MinVersion)
+
+	// TLS for both listeners, from certificate files or Let's Encrypt; with
+	// a client CA, agents are also tied to their client certificates
+	listeners, err := certs.Load(cfg.Server.TLS)
+	if err != nil {
+		fatal("Invalid TLS configuration", "error", err)
+	}
+	if listeners == nil {
+		slog.Info("TLS is not configured; serving plain HTTP and gRPC")
+	} else if listeners.Mutual {
+		registry.RequireCertificates()
+	}
+
+	jobManager := jobs.NewManager(store, store, store, store)
+	// Assignments are leased for as long as an agent may go without a
+	// heartbeat, which renews them; jobs whose leases run out are re-queued
+	jobManager.SetLeaseDuration(heartbeatTimeout)
+
+	// Project secrets, sealed with SECRETS_MASTER_KEYS ("id=base64,..."; the
+	// first key encrypts, the rest decrypt secrets sealed before a rotation)
+	masterKeys, err := openMasterKeys(cfg.Secrets.MasterKeys)
+	if err != nil {
+		fatal("Invalid secrets master keys", "error", err)
+	}
+	secretService := secrets.NewService(store, masterKeys)
+
+	// Secrets referenced as NAME=vault:<path>#<key> are read from VAULT_ADDR
+	// when their jobs are dispatched, and leases revoked once they finish
+	if v := cfg.Vault; v.Address != "" {
+		client, err := vault.NewClient(vault.Config{
+			Address:    v.Address,
+			Namespace:  v.Namespace,
+			CAFile:     v.CAFile,
+			AuthMethod: v.AuthMethod,
+			AuthMount:  v.AuthMount,
+			RoleID:     v.RoleID,
+			SecretID:   v.SecretID,
+			Role:       v.Role,
+			TokenFile:  v.TokenFile,
+		})
+		if err != nil {
+			fatal("Failed to set up Vault", "error", err)
+		}
+		secretService.SetVault(client)
+		jobManager.Observe(secretService.Observe)
+		slog.Info("Reading secrets from Vault", "address", v.Address, "auth_method", v.AuthMethod)
+	}
+
+	// Job output, with secret values masked, tailed by log followers as
+	// agents upload it and archived in compressed segments on disk or in
+	// S3, expired per project by JOB_LOG_RETENTION ("owner/repo=90d,*=30d")
+	logBlobs, err := openBlobs(context.Background(), cfg.Storage.Logs, "logs")
+	if err != nil {
+		fatal("Failed to open job log storage", "error", err)
+	}
+	logRetention, err := artifacts.NewRetention(cfg.Retention.Logs)
+	if err != nil {
+		fatal("Invalid log retention", "error", err)
+	}
+	logArchive := logs.NewArchive(store, logBlobs, logRetention.Lookup)
+	jobManager.Observe(logArchive.Observe)
+	annotationService := annotations.NewService(store)
+
+	// Past JOB_LOG_LIMIT, or a lower limit of their own, job logs keep the
+	// start and end of the output and the job is annotated with a warning
+	var logLimit int64
+	if l := cfg.Limits.JobLogLimit; l != "" {
+		if logLimit, err = types.ParseLogLimit(l); err != nil {
+			fatal("Invalid JOB_LOG_LIMIT", "error", err)
+		}
+	}
+	logLimits := logs.NewLimited(logs.NewMasked(logArchive, secrets.NewMasker(secretService, jobManager)), jobManager, annotationService, logLimit)
+	jobManager.Observe(logLimits.Observe)
+	logStore := logs.NewFeed(logLimits)
+
+	// Artifacts: metadata in the store, contents on disk or in S3, expired
+	// per project by ARTIFACT_RETENTION ("owner/repo=30d,*=7d")
+	artifactBlobs, err := openBlobs(context.Background(), cfg.Storage.Artifacts, "artifacts")
+	if err != nil {
+		fatal("Failed to open artifact storage", "error", err)
 	}
+	retention, err := artifacts.NewRetention(cfg.Retention.Artifacts)
+	if err != nil {
+		fatal("Invalid artifact retention", "error", err)
+	}
+	artifactService := artifacts.NewService(store, artifactBlobs, retention)
+
+	// Artifacts are shared through links signed with ARTIFACT_SIGNING_KEY
+	// (base64, at least 32 bytes); without one they cannot be
+	var artifactLinks *artifacts.Signer
+	if v := cfg.Auth.ArtifactSigningKey; v != "" {
+		key, err := artifacts.ParseSigningKey(v)
+		if err != nil {
+			fatal("Invalid ARTIFACT_SIGNING_KEY", "error", err)
+		}
+		artifactLinks = artifacts.NewSigner(key)
+	}
+
+	// Status badges are served to those holding a project's badge token,
+	// derived from BADGE_SIGNING_KEY (base64, at least 32 bytes); without
+	// one none are served
+	var badgeKey []byte
+	if v := cfg.Auth.BadgeSigningKey; v != "" {
+		if badgeKey, err = artifacts.ParseSigningKey(v); err != nil {
+			fatal("Invalid BADGE_SIGNING_KEY", "error", err)
+		}
+	}
+
+	// Workspace snapshots of job outputs, restored by the jobs of downstream
+	// stages, on disk or in S3 and expired per project by SNAPSHOT_RETENTION
+	snapshotBlobs, err := openBlobs(context.Background(), cfg.Storage.Snapshots, "snapshots")
+	if err != nil {
+		fatal("Failed to open snapshot storage", "error", err)
+	}
+	snapshotRetention, err := artifacts.NewRetention(cfg.Retention.Snapshots)
+	if err != nil {
+		fatal("Invalid snapshot retention", "error", err)
+	}
+	snapshotService := snapshots.NewService(store, snapshotBlobs, snapshotRetention.Lookup)
+
+	// Dependency caches: content-addressed, evicted least recently used first
+	// to stay within CACHE_QUOTAS ("owner/repo=20GiB,*=5GiB")
+	cacheBlobs, err := openBlobs(context.Background(), cfg.Storage.Caches, "caches")
+	if err != nil {
+		fatal("Failed to open cache storage", "error", err)
+	}
+	quotas, err := cache.NewQuotas(cfg.Limits.CacheQuotas)
+	if err != nil {
+		fatal("Invalid cache quotas", "error", err)
+	}
+	cacheService := cache.NewService(store, cacheBlobs, quotas)
+
+	// Garbage collection applies the retention policies of projects on top
+	// of the retentions and quotas above: it keeps their newest runs, and
+	// their artifacts, logs and caches within the limits each sets
+	collector := gc.NewCollector(store, artifactService, logArchive, snapshotService, cacheService)
+
+	// Agents hold a gRPC stream open; the scheduler pushes work down it
+	hub := agentrpc.NewHub()
+
+	// Assignments are signed with AGENT_JOB_SIGNING_KEY, so that agents
+	// trusting its public key run only jobs the server sent them
+	if err := setJobSigner(hub, cfg.Agents.JobSigningKey); err != nil {
+		fatal("Invalid AGENT_JOB_SIGNING_KEY", "error", err)
+	}
+
+	// The agent release in AGENT_UPDATE_DIR is signed with AGENT_SIGNING_KEY,
+	// served at /agents/download and rolled out to the older agents that
+	// install updates, AGENT_UPDATE_PARALLEL at a time
+	var release *releases.Release
+	var rollout *scheduler.Rollout
+	if u := cfg.Agents.Update; u.Dir != "" {
+		key, err := releases.ParseSigningKey(u.SigningKey)
+		if err != nil {
+			fatal("Invalid AGENT_SIGNING_KEY", "error", err)
+		}
+		release, err = releases.Load(u.Dir, u.Version, key)
+		if err != nil {
+			fatal("Failed to load the agent release", "dir", u.Dir, "error", err)
+		}
+		rollout = scheduler.NewRollout(registry, hub, release, cfg.SCM.ExternalURL, u.Parallel)
+		slog.Info("Rolling out agent release", "version", release.Version, "platforms", release.Platforms(), "public_key", releases.PublicKey(key))
+	}
+	dispatchers := scheduler.Dispatchers{hub}
+
+	// Optionally, jobs also run as pods of a Kubernetes cluster, launched by
+	// a built-in agent with kubernetes.capacity slots
+	var executor *kube.Executor
+	if k := cfg.Kubernetes; k.Enabled {
+		client, err := kube.NewClient(kube.ClientConfig{APIServer: k.APIServer, TokenFile: k.TokenFile, CAFile: k.CAFile})
+		if err != nil {
+			fatal("Failed to set up the Kubernetes executor", "error", err)
+		}
+		executor = kube.NewExecutor(client, k, registry, jobManager, logStore)
+		dispatchers = append(dispatchers, executor)
+	}
+
+	// Deploy jobs record their deployments, and one at a time holds each
+	// environment
+	environmentService := environments.NewService(store, store)
+
+	variableService := variables.NewService(store)
+	jobManager.SetScopeSources(variableService, secretService)
+	jobManager.SetImageBuilder(pipeline.ImageBuilder{Image: cfg.Images.Builder, Registry: cfg.Images.Registry})
+	jobManager.SetImageResolver(imageregistry.NewClient(cfg.Images.RegistryCredentials))
+
+	// OIDC ID tokens for jobs, issued as OIDC_ISSUER or EXTERNAL_URL and
+	// signed with the key in OIDC_SIGNING_KEY_FILE
+	issuer := openIssuer(cfg.OIDC, cfg.SCM.ExternalURL)
+	var idTokens scheduler.IDTokenIssuer
+	if issuer != nil {
+		idTokens = issuer
+	}
+	sched := scheduler.New(registry, jobManager, dispatchers, secretService, variableService, idTokens, environmentService, store)
+	sched.SetMatchTimeout(cfg.Agents.MatchTimeout)
+	hub.OnReady(sched.Kick)
+	hub.OnConnect(sched.Redeliver)
+	if executor != nil {
+		executor.OnReady(sched.Kick)
+		slog.Info("Kubernetes executor enabled", "agent_id", kube.AgentID, "capacity", cfg.Kubernetes.Capacity)
+	}
+	monitor := scheduler.NewMonitor(registry, jobManager, heartbeatTimeout)
+	timeouts := scheduler.NewTimeouts(jobManager)
+	reaper := scheduler.NewReaper(jobManager, dispatchers)
+	reaper.SetTimeout(cfg.Agents.StuckTimeout)
+	logStore.Observe(reaper.ObserveLog)
+	jobManager.Observe(tracing.ObserveJob)
+
+	// Background work every replica does for itself, such as forwarding
+	// events it produced; work that must happen once is left to the leader
+	loopCtx, stopLoops := context.WithCancel(context.Background())
+	defer stopLoops()
+
+	// Credentials organizations and projects store for GitHub and GitLab:
+	// access tokens, deploy keys and GitHub App installations, whose
+	// tokens are renewed as they expire
+	github, gitlab := scm.NewGitHub(cfg.SCM.GitHub.URL), scm.NewGitLab(cfg.SCM.GitLab.URL)
+	scmCredentials := scmcredentials.NewService(store, secretService, organizations)
+	scmCredentials.Register("github", github.Host(), "x-access-token", github)
+	scmCredentials.Register("gitlab", gitlab.Host(), "oauth2", nil)
+
+	// Pipeline states, and the checks projects require, are posted back as
+	// commit statuses to GitHub and GitLab, for repositories with a stored
+	// credential or a status token
+	checkService := checks.NewService(store, jobManager)
+	statuses := scm.NewReporter(cfg.SCM.ExternalURL)
+	statuses.Register("github", github, cfg.SCM.GitHub.StatusTokens)
+	statuses.Register("gitlab", gitlab, cfg.SCM.GitLab.StatusTokens)
+	statuses.SetChecks(checkService)
+	statuses.SetCredentials(scmCredentials)
+	jobManager.ObservePipeline(statuses.Observe)
+	jobManager.Observe(statuses.ObserveJob)
+	go statuses.Run(loopCtx)
 
+	// Deployments finish, and release their environment, as their jobs do
+	jobManager.Observe(environmentService.Observe)
+	go environmentService.Run(loopCtx)
+
+	// Buffered job output is written out, and finished logs settled and
+	// truncated ones completed with their tails, by whichever replica agents
+	// upload to
+	go logArchive.Run(loopCtx)
+	go logLimits.Run(loopCtx)
+
+	// Finished logs, masked as readers see them, are indexed line by line
+	// for GET /search/logs
+	logIndexer := logs.NewIndexer(logStore, store)
+	jobManager.Observe(logIndexer.Observe)
+	go logIndexer.Run(loopCtx)
+
+	// Project notifiers tell Slack channels, HTTP endpoints and email
+	// addresses about finished runs, jobs stuck in the queue and jobs that hung
+	var mailer *notifications.Mailer
+	if n := cfg.Notifications; n.SMTPAddress != "" {
+		mailer = notifications.NewMailer(n.SMTPAddress, n.SMTPFrom, n.SMTPUsername, n.SMTPPassword)
+	}
+	authorizer := rbac.NewAuthorizer(store, store)
+	notificationService := notifications.NewService(store, store, authorizer, store, store, secretService, mailer, cfg.SCM.ExternalURL)
+	notificationService.SetGlobalEmail(cfg.Notifications.EmailTo, cfg.Notifications.EmailEvents)
+	jobManager.ObservePipeline(notificationService.ObservePipeline)
+	jobManager.Observe(notificationService.ObserveJob)
+	registry.OnOffline(notificationService.ObserveAgentOffline)
+	jobManager.ObserveApproval(notificationService.ObserveApproval)
+	reaper.OnLost(notificationService.ObserveLost)
+	go notificationService.Run(loopCtx)
+
+	// Prometheus metrics served on /metrics
+	serverMetrics := metrics.New()
+	jobManager.Observe(serverMetrics.ObserveJob)
+	reaper.OnLost(serverMetrics.ObserveLost)
+	serverMetrics.RegisterQueueDepth(sched.QueueDepth)
+	serverMetrics.RegisterAgents(registry)
+	collector.OnCollected(serverMetrics.ObserveGC)
+
+	// API tokens; ADMIN_TOKEN is accepted as an admin token for creating the
+	// first stored ones
+	adminToken := cfg.Auth.AdminToken
+	if adminToken == "" {
+		slog.Info("ADMIN_TOKEN is not set; only stored API tokens are accepted")
+	}
+	apiTokens := auth.NewTokens(store, adminToken)
+
+	// People sign in through the SSO providers and LDAP directories, if
+	// any, into sessions
+	var ssoService *sso.Service
+	if len(cfg.Auth.SSO) > 0 || len(cfg.Auth.LDAP) > 0 {
+		providers := make([]sso.ProviderConfig, 0, len(cfg.Auth.SSO))
+		for _, p := range cfg.Auth.SSO {
+			providers = append(providers, sso.ProviderConfig(p))
+			slog.Info("SSO sign-in enabled", "provider", p.Name, "issuer", p.Issuer)
+		}
+		directories := make([]sso.LDAPConfig, 0, len(cfg.Auth.LDAP))
+		for _, d := range cfg.Auth.LDAP {
+			directories = append(directories, sso.LDAPConfig(d))
+			slog.Info("LDAP sign-in enabled", "provider", d.Name, "url", d.URL)
+		}
+		ssoService, err = sso.NewService(providers, directories, cfg.SCM.ExternalURL, apiTokens, cfg.Auth.SessionLifetime)
+		if err != nil {
+			fatal("Failed to set up sign-in providers", "error", err)
+		}
+	}
+
+	// Per-repository webhook secrets of each SCM provider:
+	// "owner/repo=secret,*=fallback". GitLab sends them as a token;
+	// GitHub and Bitbucket sign deliveries with them
+	githubSecrets := webhooks.NewSecrets(cfg.SCM.GitHub.WebhookSecrets)
+	gitlabSecrets := webhooks.NewSecrets(cfg.SCM.GitLab.WebhookSecrets)
+	bitbucketSecrets := webhooks.NewSecrets(cfg.SCM.Bitbucket.WebhookSecrets)
+
+	// Webhook deliveries and cron schedules both run the pipeline file of a
+	// repository, fetched with the git client, as are template files from
+	// the allowed template repositories, with the stored credential of
+	// their project if there is one
+	fetcher := &webhooks.GitFetcher{Credentials: scmCredentials}
+	templateService := templates.NewService(store, fetcher, cfg.SCM.TemplateRepositories)
+	triggers := webhooks.NewService(fetcher, templateService, jobManager, store, cfg.SCM.DeliveryRetention)
+	scheduleService := schedules.NewService(store, triggers, jobManager)
+
+	// POST /projects onboards repositories, registering the webhook of the
+	// provider they are hosted on with the secret it delivers with
+	bootstrapper := projects.NewBootstrapper(organizations, templateService, cfg.SCM.ExternalURL)
+	bootstrapper.SetCredentials(scmCredentials)
+	bootstrapper.Register("github", github, github.Host(), githubSecrets)
+	bootstrapper.Register("gitlab", gitlab, gitlab.Host(), gitlabSecrets)
+
+	// Trigger steps start runs of other repositories' pipelines, and those
+	// that wait finish with them
+	downstreamService := downstream.NewService(jobManager, triggers)
+	jobManager.Observe(downstreamService.Observe)
+	jobManager.ObservePipeline(downstreamService.ObservePipeline)
+
+	// Job, pipeline and log changes streamed to WebSocket clients on /ws
+	eventBus := events.NewBus(jobManager.Get)
+	jobManager.Observe(eventBus.ObserveJob)
+	jobManager.ObservePipeline(eventBus.ObservePipeline)
+	logStore.Observe(eventBus.ObserveLog)
+
+	// Rate limits per API token and per source address, off while their
+	// rate is zero, and daily job quotas per project
+	tokenLimiter := ratelimit.New(cfg.Limits.TokenRate, cfg.Limits.TokenBurst)
+	go tokenLimiter.Run(loopCtx)
+	ipLimiter := ratelimit.New(cfg.Limits.IPRate, cfg.Limits.IPBurst)
+	go ipLimiter.Run(loopCtx)
+	jobManager.SetQuotas(jobQuotas(cfg.Limits))
+
+	// Submissions are turned away, or queued with a warning, while the
+	// queue is too deep or no agent is online to work it off
+	backpressure := scheduler.NewBackpressure(registry, jobManager)
+	backpressure.SetLimits(cfg.Limits.MaxQueuedJobs, cfg.Limits.RejectWhenSaturated)
+	go backpressure.Run(loopCtx)
+
+	// Audit log of mutating API requests, optionally forwarded to syslog
+	// and a SIEM webhook
+	var auditSinks []audit.Sink
+	if addr := cfg.Audit.SyslogAddress; addr != "" {
+		sink, err := audit.NewSyslog(addr)
+		if err != nil {
+			fatal("Failed to set up audit syslog", "error", err)
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	if url := cfg.Audit.WebhookURL; url != "" {
+		auditSinks = append(auditSinks, audit.NewWebhook(url, cfg.Audit.WebhookSecret))
+	}
+	auditLog := audit.New(store, auditSinks...)
+	go auditLog.Run(loopCtx)
+
+	// The agent protocol is served on the agent gRPC port and, for agents
+	// that cannot reach it, over HTTP by the router
+	agentService := agentrpc.NewService(registry, jobManager, logStore, snapshotService, cacheService, hub)
+	agentGateway := agentService.NewGateway()
+
+	// Create router
+	r := server.New(server.Config{
+		Registry:      registry,
+		AgentTokens:   agentTokens,
+		Jobs:          jobManager,
+		Logs:          logStore,
+		LogIndex:      store,
+		Artifacts:     artifactService,
+		ArtifactLinks: artifactLinks,
+		BadgeKey:      badgeKey,
+		Annotations:   annotationService,
+		Snapshots:     snapshotService,
+		Cache:         cacheService,
+		Secrets:       secretService,
+		Credentials:   scmCredentials,
+		Variables:     variableService,
+		Checks:        checkService,
+		GC:            collector,
+		Scheduler:     sched,
+		Templates:     templateService,
+		Schedules:     scheduleService,
+		Environments:  environmentService,
+		Tokens:        apiTokens,
+		SSO:           ssoService,
+		ExternalURL:   cfg.SCM.ExternalURL,
+		Metrics:       serverMetrics,
+		Authorizer:    authorizer,
+
+		Organizations: organizations,
+		Projects:      bootstrapper,
+		Notifications: notificationService,
+
+		GitHubSecrets:    githubSecrets,
+		GitLabSecrets:    gitlabSecrets,
+		BitbucketSecrets: bitbucketSecrets,
+		Triggers:         triggers,
+		Events:           eventBus,
+		TokenLimiter:     tokenLimiter,
+		IPLimiter:        ipLimiter,
+		Audit:            auditLog,
+		Release:          release,
+		AgentGateway:     agentGateway,
+		IDTokens:         issuer,
+		Backpressure:     backpressure,
+		Estimator:        scheduler.NewEstimator(registry, jobManager),
+		Store:            store,
+	})
+
+	// Server configuration
+	port := strconv.Itoa(cfg.Server.Port)
 	srv := &http.Server{
 		Addr:         ":" + port,
 		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+		ErrorLog:     logging.ErrorLog(),
 	}
+	if listeners != nil {
+		srv.TLSConfig = listeners.HTTP
+	}
+	// Long-lived requests such as log streams end as soon as shutdown starts
+	// instead of holding it up for the whole grace period.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+	srv.RegisterOnShutdown(cancelRequests)
 
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Starting Open-CICD server on port %s", port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
+		slog.Info("Starting Open-CICD server", "port", port, "tls", listeners != nil, "version", version.Version)
+		var err error
+		if listeners != nil {
+			// The certificates are already in the TLS settings.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Server failed to start", "error", err)
 		}
 	}()
 
+	// Agent gRPC server on its own port
+	grpcPort := strconv.Itoa(cfg.Server.GRPCPort)
+	var grpcOpts []grpc.ServerOption
+	if listeners != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(listeners.GRPC)))
+	}
+
+	// Replicas sharing a database elect a leader, which alone schedules
+	// jobs, fires cron schedules, expires agents, jobs, artifacts, snapshots
+	// and logs, reaps hung jobs, reports stuck jobs and listens on the agent port, so that
+	// agents end up connected to it. The others answer the agent protocol
+	// over HTTP with UNAVAILABLE, so a load balancer in front of several
+	// replicas must send it to the leader.
+	// The in-memory store has a single replica, which always leads
+	elector := leader.New(store)
+	serverMetrics.RegisterLeader(func() bool { return elector.Role() == leader.Leader })
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	elected := make(chan struct{})
+	go func() {
+		defer close(elected)
+		elector.Run(electionCtx, func(ctx context.Context) {
+			grpcSrv := agentService.NewServer(grpcOpts...)
+			lis, err := net.Listen("tcp", ":"+grpcPort)
+			if err != nil {
+				fatal("Agent gRPC server failed to listen", "error", err)
+			}
+			go func() {
+				slog.Info("Starting agent gRPC server", "port", grpcPort, "tls", listeners != nil, "mutual_tls", listeners != nil && listeners.Mutual)
+				if err := grpcSrv.Serve(lis); err != nil {
+					fatal("Agent gRPC server failed", "error", err)
+				}
+			}()
+			agentGateway.Start()
+
+			loops := []func(context.Context){sched.Run, monitor.Run, timeouts.Run, reaper.Run, artifactService.Run, snapshotService.Run, logArchive.Purge, collector.Run, scheduleService.Run, notificationService.WatchQueue, notificationService.PruneDeliveries, triggers.Run, downstreamService.Run}
+			if rollout != nil {
+				loops = append(loops, rollout.Run)
+			}
+			var wg sync.WaitGroup
+			for _, loop := range loops {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					loop(ctx)
+				}()
+			}
+			// The executor stops after the scheduler, so that no
+			// assignment reaches it once it has stopped.
+			execCtx, stopExecutor := context.WithCancel(context.Background())
+			execDone := make(chan struct{})
+			go func() {
+				defer close(execDone)
+				if executor != nil {
+					executor.Run(execCtx)
+				}
+			}()
+
+			<-ctx.Done()
+			wg.Wait()
+			stopExecutor()
+			<-execDone
+			hub.CloseAll()
+			agentGateway.Stop()
+			stopGRPC(grpcSrv, time.Now().Add(grpcStopTimeout))
+			// Agents reconnect to the next leader, which carries on
+			// their logs from what was written out.
+			logArchive.Flush(context.Background())
+		})
+	}()
+
+	// Settings that can change at runtime are reloaded on SIGHUP
+	reloader := config.NewReloader(*configPath, cfg)
+	reloader.OnReload(func(c *config.Config) error { return logging.SetLevel(c.Logging.Level) })
+	reloader.OnReload(func(c *config.Config) error {
+		registry.RequireVersion(c.Agents.MinVersion)
+		sched.SetMatchTimeout(c.Agents.MatchTimeout)
+		reaper.SetTimeout(c.Agents.StuckTimeout)
+		return nil
+	})
+	reloader.OnReload(func(c *config.Config) error { return setJobSigner(hub, c.Agents.JobSigningKey) })
+	reloader.OnReload(func(c *config.Config) error {
+		tokenLimiter.SetRate(c.Limits.TokenRate, c.Limits.TokenBurst)
+		ipLimiter.SetRate(c.Limits.IPRate, c.Limits.IPBurst)
+		jobManager.SetQuotas(jobQuotas(c.Limits))
+		backpressure.SetLimits(c.Limits.MaxQueuedJobs, c.Limits.RejectWhenSaturated)
+		return nil
+	})
+	go reloader.Run(loopCtx)
+
 	// Wait for interrupt signal to gracefully shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
-	// TODO: Implement graceful shutdown
-}
\ No newline at end of file
+	grace := cfg.Server.ShutdownGracePeriod
+	slog.Info("Shutting down server", "grace_period", grace.String())
+	deadline := time.Now().Add(grace)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// On the leader, stop taking new jobs and wait for agents to hand back
+	// in-flight work while the agent port is still up so they can report
+	// in. No agents are connected to the other replicas, so they just stop.
+	if elector.Role() == leader.Leader {
+		if err := jobManager.Drain(ctx); err != nil {
+			slog.Error("Draining jobs", "error", err)
+		}
+	}
+	stopElection()
+	<-elected
+	stopLoops()
+
+	// Give open connections whatever is left of the grace period, but at
+	// least a moment to finish responses already in progress.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), max(time.Until(deadline), time.Second))
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Graceful shutdown incomplete, closing connections", "error", err)
+		srv.Close()
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Flushing traces", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// jobQuotas returns the job quotas configured in limits.
+func jobQuotas(limits config.Limits) jobs.Quotas {
+	return jobs.Quotas{DailyJobs: limits.DailyJobs, Projects: limits.ProjectDailyJobs}
+}
+
+// setJobSigner makes hub sign assignments with key, or stop signing them if
+// key is empty, and logs the public key agents are to trust.
+func setJobSigner(hub *agentrpc.Hub, key string) error {
+	if key == "" {
+		hub.SetSigner(nil)
+		return nil
+	}
+	signer, err := jobsig.NewSigner(key)
+	if err != nil {
+		return err
+	}
+	hub.SetSigner(signer)
+	slog.Info("Signing job assignments", "key_id", signer.KeyID(), "public_key", signer.PublicKey())
+	return nil
+}
+
+// stopGRPC waits for in-progress agent calls to finish, forcing the server
+// closed at deadline.
+func stopGRPC(srv *grpc.Server, deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		srv.Stop()
+	}
+}
+
+// openBlobs returns the store for the blobs named by what: an S3-compatible
+// bucket when one is configured, otherwise a directory, by default under the
+// temporary directory.
+func openBlobs(ctx context.Context, cfg config.Blobs, what string) (blobs.Store, error) {
+	if s3 := cfg.S3; s3.Bucket != "" {
+		slog.Info("Storing "+what+" in S3", "bucket", s3.Bucket, "endpoint", s3.Endpoint)
+		return blobs.NewS3(ctx, blobs.S3Config{
+			Endpoint: s3.Endpoint,
+			Region:   s3.Region,
+			Bucket:   s3.Bucket,
+			Prefix:   s3.Prefix,
+			Insecure: s3.Insecure,
+		})
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "open-cicd-"+what)
+		slog.Warn("No directory or S3 bucket is configured for "+what+"; storing them in the temporary directory, they will not survive the host", "dir", dir)
+	}
+	return blobs.NewDisk(dir)
+}
+
+// openMasterKeys parses the secrets master keys. Without any, a random key is
+// generated so secrets work for the life of the process only.
+func openMasterKeys(keys []string) (secrets.KeyProvider, error) {
+	if len(keys) == 0 {
+		slog.Warn("SECRETS_MASTER_KEYS is not set; using an ephemeral key, secrets will not survive a restart")
+		return secrets.NewEphemeralKeys()
+	}
+	return secrets.ParseLocalKeys(strings.Join(keys, ","))
+}
+
+// openIssuer returns the issuer of job ID tokens, or nil if no issuer URL is
+// configured. Without a signing key one is generated, so tokens are only
+// trusted until the server restarts.
+func openIssuer(cfg config.OIDC, externalURL string) *oidc.Issuer {
+	url := cfg.IssuerURL(externalURL)
+	if url == "" {
+		slog.Info("OIDC_ISSUER and EXTERNAL_URL are not set; jobs cannot get ID tokens")
+		return nil
+	}
+	var (
+		key *rsa.PrivateKey
+		err error
+	)
+	if cfg.SigningKeyFile == "" {
+		slog.Warn("OIDC_SIGNING_KEY_FILE is not set; using an ephemeral key, ID tokens will not verify after a restart")
+		key, err = oidc.GenerateKey()
+	} else {
+		key, err = oidc.LoadKey(cfg.SigningKeyFile)
+	}
+	if err != nil {
+		fatal("Failed to load the OIDC signing key", "error", err)
+	}
+	return oidc.NewIssuer(url, key, cfg.TokenLifetime)
+}
+
+// fatal logs msg and its attributes at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+// Command vminit is the init process of the microVMs the agent's
+// Firecracker executor runs tasks in. It is built statically, with
+// CGO_ENABLED=0, and installed in the root filesystem images the executor
+// boots, at the path the agent's -firecracker-init names. It runs the task
+// the kernel command line names and powers the microVM off.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"open-cicd/internal/microvm"
+)
+
+func main() {
+	if err := microvm.Init(); err != nil {
+		// The executor finds no exit code and fails the job with the
+		// console output.
+		fmt.Fprintln(os.Stderr, "opencicd-init:", err)
+	}
+	microvm.PowerOff()
+}
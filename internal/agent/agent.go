@@ -0,0 +1,526 @@
+// Package agent is the build agent. It registers with the control plane over
+// the gRPC protocol of agentpb, or the same protocol over HTTP where gRPC
+// cannot get through, holds a job stream open to receive
+// assignments, runs each job with an Executor in a fresh work directory of
+// its own, uploads the output as it is produced and reports how the job
+// ended. Agents with job keys run only the assignments the server signed, and
+// agents with an update key install new versions of themselves the server
+// rolls out.
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/jobsig"
+	"open-cicd/internal/types"
+	"open-cicd/internal/version"
+)
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the backoff between
+	// attempts to reach the server.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+	// defaultHeartbeatInterval is used until the server names one.
+	defaultHeartbeatInterval = 10 * time.Second
+	// reportTimeout bounds each status report.
+	reportTimeout = 30 * time.Second
+)
+
+// Config configures an agent.
+type Config struct {
+	// Hostname, Labels and Capacity are advertised to the server, which
+	// only assigns jobs whose labels the agent carries and never more than
+	// Capacity at once, and no more than the machine's resources fit. Zero
+	// runs one job per CPU core.
+	Hostname string
+	Labels   map[string]string
+	Capacity int
+	// Token is an agent registration token accepted by the server.
+	Token string
+	// WorkDir holds the work directories of running jobs.
+	WorkDir string
+	// UpdateKey is the public key agent binaries the server offers must be
+	// signed with. Without one the agent refuses updates.
+	UpdateKey ed25519.PublicKey
+	// JobKeys are the public keys job assignments must be signed with.
+	// With any, unsigned assignments are refused; several are trusted
+	// while the server's key is rotated.
+	JobKeys jobsig.Keyring
+	// HTTPClient downloads updates; it defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Fallback, if set, carries the agent protocol when the server cannot
+	// be reached over the connection the agent was made with, such as an
+	// agenthttp.Conn for networks that only let HTTPS through. Which of
+	// the two the agent uses is settled when it registers.
+	Fallback grpc.ClientConnInterface
+}
+
+// Executor runs the tasks of a job.
+type Executor interface {
+	// Check returns why the executor cannot run job, or nil if it can.
+	Check(job *agentpb.JobAssignment) error
+	// Run runs the tasks of job one after another in dir, writing their
+	// output to stdout and stderr, and stops at the first that fails. It
+	// returns the exit code of the last task run, or an error if a task
+	// could not be started at all.
+	Run(ctx context.Context, job *agentpb.JobAssignment, dir string, stdout, stderr io.Writer) (int, error)
+}
+
+// Agent runs jobs assigned by the control plane.
+type Agent struct {
+	cfg    Config
+	client agentpb.AgentServiceClient
+	// fallback is the client over Config.Fallback, if any, until the agent
+	// registered over one of the two.
+	fallback agentpb.AgentServiceClient
+	executor Executor
+	http     *http.Client
+
+	// id and credential are set by registration.
+	id         string
+	credential string
+
+	mu   sync.Mutex
+	runs map[string]*run
+	// ready is signalled when a slot frees up, so that the job stream
+	// tells the server.
+	ready chan struct{}
+	// updating is the update being installed, during which the agent takes
+	// no jobs; updates hands it to the installing goroutine. failures holds
+	// the report of one that failed until a job stream sends it.
+	updating *agentpb.AgentUpdate
+	updates  chan *agentpb.AgentUpdate
+	failures chan *agentpb.UpdateFailed
+	// updated is set once an update is installed.
+	updated atomic.Bool
+}
+
+// New returns an agent talking to the server over conn and running jobs
+// with executor.
+func New(cfg Config, conn grpc.ClientConnInterface, executor Executor) *Agent {
+	if cfg.Capacity < 1 {
+		cfg.Capacity = runtime.NumCPU()
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var fallback agentpb.AgentServiceClient
+	if cfg.Fallback != nil {
+		fallback = agentpb.NewAgentServiceClient(cfg.Fallback)
+	}
+	return &Agent{
+		cfg:      cfg,
+		client:   agentpb.NewAgentServiceClient(conn),
+		fallback: fallback,
+		executor: executor,
+		http:     client,
+		runs:     make(map[string]*run),
+		ready:    make(chan struct{}, 1),
+		updates:  make(chan *agentpb.AgentUpdate, 1),
+		failures: make(chan *agentpb.UpdateFailed, 1),
+	}
+}
+
+// Run registers the agent and takes jobs until ctx is cancelled, then stops
+// the jobs still running and hands them back to the server to be re-queued.
+// Lost connections are retried with backoff. Once the agent installed an
+// update it stops the same way and returns ErrUpdated.
+func (a *Agent) Run(ctx context.Context) error {
+	interval, err := a.register(ctx)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Registered agent", "agent_id", a.id, "hostname", a.cfg.Hostname, "capacity", a.cfg.Capacity, "version", version.Version)
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go a.installUpdates(ctx, stop)
+
+	hbCtx, stopHeartbeats := context.WithCancel(ctx)
+	defer stopHeartbeats()
+	go a.heartbeats(hbCtx, interval)
+
+	delay := minReconnectDelay
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := a.stream(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		slog.WarnContext(ctx, "Job stream ended; reconnecting", "error", err, "delay", delay.String())
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+
+	a.requeueAll()
+	if a.updated.Load() {
+		return ErrUpdated
+	}
+	return nil
+}
+
+// shells returns the shells the executor has, for executors that say.
+func (a *Agent) shells() []string {
+	e, ok := a.executor.(interface{ HostShells() []types.Shell })
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, s := range e.HostShells() {
+		names = append(names, string(s))
+	}
+	return names
+}
+
+// register exchanges the registration token for an agent ID and credential,
+// retrying while the server is unreachable. While it is unreachable over the
+// agent's connection, registering is tried over the fallback one, which the
+// agent then keeps to. It returns the heartbeat interval the server asks
+// for.
+func (a *Agent) register(ctx context.Context) (time.Duration, error) {
+	req := &agentpb.RegisterAgentRequest{
+		Hostname:   a.cfg.Hostname,
+		Labels:     a.cfg.Labels,
+		Capacity:   int32(a.cfg.Capacity),
+		Token:      a.cfg.Token,
+		Version:    version.Version,
+		Platform:   platform,
+		AutoUpdate: a.cfg.UpdateKey != nil,
+		Shells:     a.shells(),
+	}
+	delay := minReconnectDelay
+	for {
+		resp, err := a.client.RegisterAgent(ctx, req)
+		if unreachable(err) && a.fallback != nil {
+			slog.WarnContext(ctx, "Server is unreachable; registering over the fallback transport", "error", err)
+			if resp, err = a.fallback.RegisterAgent(ctx, req); err == nil {
+				slog.InfoContext(ctx, "Registered over the fallback transport; keeping to it")
+				a.client = a.fallback
+			}
+		}
+		if err == nil {
+			a.fallback = nil
+			a.id, a.credential = resp.GetAgentId(), resp.GetCredential()
+			return heartbeatInterval(resp.GetHeartbeatIntervalSeconds()), nil
+		}
+		switch status.Code(err) {
+		case codes.Unauthenticated, codes.InvalidArgument, codes.FailedPrecondition:
+			return 0, fmt.Errorf("registering agent: %w", err)
+		}
+		slog.WarnContext(ctx, "Registering agent failed; retrying", "error", err, "delay", delay.String())
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// unreachable reports whether a call failed for want of reaching the
+// server.
+func unreachable(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+func heartbeatInterval(seconds int64) time.Duration {
+	if seconds <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// authed returns ctx carrying the agent's credentials for a call.
+func (a *Agent) authed(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-agent-id", a.id, "authorization", "Bearer "+a.credential)
+}
+
+// heartbeats calls Heartbeat every interval until ctx is cancelled, renewing
+// the leases of the running jobs and following interval changes the server
+// announces.
+func (a *Agent) heartbeats(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		runs := a.running()
+		req := &agentpb.HeartbeatRequest{Resources: machineResources(a.cfg.WorkDir)}
+		for _, r := range runs {
+			req.Leases = append(req.Leases, &agentpb.JobLease{JobId: r.job.GetJobId(), Token: r.job.GetLeaseToken()})
+		}
+		// Renewed leases count from before the request left, so that the
+		// agent never believes it holds one longer than the server does.
+		sent := time.Now()
+		resp, err := a.client.Heartbeat(a.authed(ctx), req)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.WarnContext(ctx, "Sending heartbeat failed", "error", err)
+			}
+		} else {
+			interval = heartbeatInterval(resp.GetHeartbeatIntervalSeconds())
+			a.renewed(runs, resp, sent)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// running returns the jobs the agent is running.
+func (a *Agent) running() []*run {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	runs := make([]*run, 0, len(a.runs))
+	for _, r := range a.runs {
+		runs = append(runs, r)
+	}
+	return runs
+}
+
+// renewed applies the answer to a heartbeat sent at sent for runs: the jobs
+// whose leases were revoked are stopped and the others' leases extended.
+func (a *Agent) renewed(runs []*run, resp *agentpb.HeartbeatResponse, sent time.Time) {
+	revoked := make(map[string]bool, len(resp.GetRevokedJobIds()))
+	for _, id := range resp.GetRevokedJobIds() {
+		revoked[id] = true
+	}
+	until := leaseEnd(sent, resp.GetLeaseSeconds())
+	for _, r := range runs {
+		if revoked[r.job.GetJobId()] {
+			slog.Warn("Server revoked the lease on job; stopping it", "job_id", r.job.GetJobId())
+			r.stop(stopLeaseLost, "lease revoked by the server")
+			continue
+		}
+		if !until.IsZero() {
+			r.renew(until)
+		}
+	}
+}
+
+// stream holds a job stream open, announcing free slots and handling the
+// server's messages, until the stream or ctx ends.
+func (a *Agent) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := a.client.StreamJobs(a.authed(ctx))
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Job stream open", "agent_id", a.id)
+
+	// Sends happen on one goroutine: free slots are announced when the
+	// stream opens and whenever a job finishes; acknowledgements are queued
+	// by the receiving side.
+	acks := make(chan *agentpb.JobAck, a.cfg.Capacity+1)
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- a.send(ctx, stream, acks)
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			cancel()
+			if errors.Is(err, io.EOF) {
+				return errors.New("server closed the stream")
+			}
+			return err
+		}
+		switch m := msg.GetMessage().(type) {
+		case *agentpb.ServerMessage_Assignment, *agentpb.ServerMessage_SignedAssignment:
+			ack := a.assigned(ctx, msg)
+			select {
+			case acks <- ack:
+			case err := <-sendErr:
+				return err
+			}
+		case *agentpb.ServerMessage_Cancel:
+			a.cancel(m.Cancel)
+		case *agentpb.ServerMessage_Update:
+			a.offerUpdate(ctx, m.Update)
+		}
+	}
+}
+
+// send writes the agent's side of the job stream.
+func (a *Agent) send(ctx context.Context, stream agentpb.AgentService_StreamJobsClient, acks <-chan *agentpb.JobAck) error {
+	ready := func() error {
+		msg := &agentpb.AgentMessage{Message: &agentpb.AgentMessage_Ready{Ready: &agentpb.Ready{FreeSlots: int32(a.free())}}}
+		return stream.Send(msg)
+	}
+	if err := ready(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return stream.CloseSend()
+		case ack := <-acks:
+			if err := stream.Send(&agentpb.AgentMessage{Message: &agentpb.AgentMessage_Ack{Ack: ack}}); err != nil {
+				return err
+			}
+		case <-a.ready:
+			if err := ready(); err != nil {
+				return err
+			}
+		case failed := <-a.failures:
+			if err := stream.Send(&agentpb.AgentMessage{Message: &agentpb.AgentMessage_UpdateFailed{UpdateFailed: failed}}); err != nil {
+				return err
+			}
+			// The agent takes jobs again.
+			if err := ready(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// free returns the number of jobs the agent can take on, none while it
+// is updating.
+func (a *Agent) free() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.updating != nil {
+		return 0
+	}
+	return max(a.cfg.Capacity-len(a.runs), 0)
+}
+
+// assigned checks the assignment in msg and accepts it if it holds.
+func (a *Agent) assigned(ctx context.Context, msg *agentpb.ServerMessage) *agentpb.JobAck {
+	job, err := a.verify(msg)
+	if err != nil {
+		slog.WarnContext(ctx, "Refused job assignment", "job_id", job.GetJobId(), "error", err)
+		return &agentpb.JobAck{JobId: job.GetJobId(), LeaseToken: job.GetLeaseToken(), Reason: err.Error()}
+	}
+	return a.accept(ctx, job)
+}
+
+// verify returns the assignment in msg, checking its signature against the
+// job keys. Without job keys, assignments are taken as they come. On error
+// the assignment is returned too if it could be decoded, so that it can be
+// refused by its job ID.
+func (a *Agent) verify(msg *agentpb.ServerMessage) (*agentpb.JobAssignment, error) {
+	signed := msg.GetSignedAssignment()
+	if signed == nil {
+		if len(a.cfg.JobKeys) > 0 {
+			return msg.GetAssignment(), errors.New("job assignment is not signed")
+		}
+		return msg.GetAssignment(), nil
+	}
+	job := &agentpb.JobAssignment{}
+	if err := proto.Unmarshal(signed.GetAssignment(), job); err != nil {
+		return nil, fmt.Errorf("decoding job assignment: %w", err)
+	}
+	if len(a.cfg.JobKeys) > 0 {
+		if err := a.cfg.JobKeys.Verify(a.id, signed.GetKeyId(), signed.GetAssignment(), signed.GetSignature()); err != nil {
+			return job, err
+		}
+	}
+	return job, nil
+}
+
+// accept starts an assigned job, or says why it cannot run here.
+func (a *Agent) accept(ctx context.Context, job *agentpb.JobAssignment) *agentpb.JobAck {
+	ack := &agentpb.JobAck{JobId: job.GetJobId(), LeaseToken: job.GetLeaseToken()}
+	if err := a.executor.Check(job); err != nil {
+		ack.Reason = err.Error()
+		return ack
+	}
+	a.mu.Lock()
+	if r, ok := a.runs[job.GetJobId()]; ok {
+		a.mu.Unlock()
+		if r.job.GetLeaseToken() != job.GetLeaseToken() {
+			// The job came back to this agent after its lease on the
+			// earlier assignment ran out; that run stops on its own.
+			ack.Reason = "agent is still stopping an earlier assignment of the job"
+			return ack
+		}
+		// The server re-sent an assignment the agent is already running,
+		// e.g. after a reconnect.
+		ack.Accepted = true
+		return ack
+	}
+	if a.updating != nil {
+		a.mu.Unlock()
+		ack.Reason = "agent is updating"
+		return ack
+	}
+	if len(a.runs) >= a.cfg.Capacity {
+		a.mu.Unlock()
+		ack.Reason = "no free slots"
+		return ack
+	}
+	r := newRun(context.WithoutCancel(ctx), a, job)
+	a.runs[job.GetJobId()] = r
+	a.mu.Unlock()
+
+	slog.InfoContext(ctx, "Accepted job", "job_id", job.GetJobId(), "name", job.GetName())
+	go func() {
+		r.execute()
+		a.mu.Lock()
+		delete(a.runs, job.GetJobId())
+		a.mu.Unlock()
+		select {
+		case a.ready <- struct{}{}:
+		default:
+		}
+	}()
+	ack.Accepted = true
+	return ack
+}
+
+// cancel stops a running job as the server asked.
+func (a *Agent) cancel(msg *agentpb.CancelJob) {
+	a.mu.Lock()
+	r, ok := a.runs[msg.GetJobId()]
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	stop := stopCancel
+	if msg.GetRequeue() {
+		stop = stopRequeue
+	}
+	r.stop(stop, msg.GetReason())
+}
+
+// requeueAll stops every running job, handing it back to the server, and
+// waits for them to finish reporting.
+func (a *Agent) requeueAll() {
+	runs := a.running()
+	for _, r := range runs {
+		r.stop(stopRequeue, "agent is shutting down")
+	}
+	for _, r := range runs {
+		<-r.done
+	}
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agentpb"
+)
+
+// restoreCaches extracts the caches the job mounts into its work directory.
+// Caches only speed jobs up, so one that cannot be restored is left out
+// with a warning, as are all of them on servers that do not serve caches.
+func (r *run) restoreCaches(ctx context.Context, log *slog.Logger, dir string) {
+	for _, mount := range r.job.GetCaches() {
+		stream, err := r.agent.client.RestoreCache(r.agent.authed(ctx), &agentpb.RestoreCacheRequest{
+			JobId: r.job.GetJobId(),
+			Key:   mount.GetKey(),
+		})
+		if err == nil {
+			err = extractSnapshot(&chunkReader{recv: func() ([]byte, error) {
+				chunk, err := stream.Recv()
+				return chunk.GetData(), err
+			}}, dir)
+		}
+		switch status.Code(err) {
+		case codes.OK:
+			log.Info("Restored cache", "key", mount.GetKey())
+			continue
+		case codes.NotFound:
+			continue
+		case codes.Unimplemented:
+			return
+		}
+		log.Warn("Restoring cache failed; running without it", "key", mount.GetKey(), "error", err)
+		// A cache extracted halfway could break the job.
+		if rerr := os.RemoveAll(filepath.Join(dir, filepath.FromSlash(mount.GetPath()))); rerr != nil {
+			log.Warn("Removing partly restored cache", "key", mount.GetKey(), "error", rerr)
+		}
+	}
+}
+
+// saveCaches archives and uploads the caches the job mounts that it left in
+// its work directory. Failures only cost later jobs the cache, so they are
+// logged rather than failing the job.
+func (r *run) saveCaches(ctx context.Context, log *slog.Logger, dir string) {
+	for _, mount := range r.job.GetCaches() {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(mount.GetPath()))); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		resp, err := r.saveCache(ctx, dir, mount)
+		if status.Code(err) == codes.Unimplemented {
+			return
+		}
+		if err != nil {
+			log.Warn("Saving cache failed", "key", mount.GetKey(), "error", err)
+			continue
+		}
+		log.Info("Saved cache", "key", mount.GetKey(), "size", resp.GetSize())
+	}
+}
+
+// saveCache archives the path of a cache mount in the work directory and
+// uploads it under the mount's key.
+func (r *run) saveCache(ctx context.Context, dir string, mount *agentpb.CacheMount) (*agentpb.SaveCacheResponse, error) {
+	ctx, cancel := context.WithCancel(r.agent.authed(ctx))
+	defer cancel()
+	stream, err := r.agent.client.SaveCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeSnapshot(pw, dir, []string{mount.GetPath()})) }()
+	defer pr.Close()
+
+	buf := make([]byte, snapshotChunkBytes)
+	first := true
+	for {
+		n, err := io.ReadFull(pr, buf)
+		if n > 0 || first {
+			chunk := &agentpb.CacheChunk{Data: buf[:n]}
+			if first {
+				chunk.JobId, chunk.Key, chunk.LeaseToken, first = r.job.GetJobId(), mount.GetKey(), r.job.GetLeaseToken(), false
+			}
+			if serr := stream.Send(chunk); serr != nil {
+				// The server ended the stream; CloseAndRecv says why.
+				_, rerr := stream.CloseAndRecv()
+				return nil, errors.Join(serr, rerr)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archiving cache: %w", err)
+		}
+	}
+	return stream.CloseAndRecv()
+}
@@ -0,0 +1,550 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/microvm"
+	"open-cicd/internal/types"
+)
+
+// Defaults of the Firecracker executor.
+const (
+	defaultVCPUs         = 2
+	defaultMemoryMiB     = 1024
+	defaultWorkspaceSize = 8 << 30
+	defaultGuestInit     = "/sbin/opencicd-init"
+	// maxVCPUs is the most vCPUs Firecracker gives a microVM.
+	maxVCPUs = 32
+	// tapPrefix names the TAP devices of microVMs, numbered by network slot.
+	tapPrefix = "ocfc"
+	// guestPath is the PATH of tasks that do not set their own.
+	guestPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// firecrackerLogTail is how much of Firecracker's log a failed boot
+	// reports.
+	firecrackerLogTail = 4 << 10
+)
+
+// FirecrackerConfig configures the Firecracker executor.
+type FirecrackerConfig struct {
+	// Binary is the firecracker command.
+	Binary string
+	// Kernel is the uncompressed Linux kernel microVMs boot.
+	Kernel string
+	// RootFS is the ext4 image microVMs boot from; see Images.
+	RootFS string
+	// Images, if set, is a directory of ext4 images by task image: a task
+	// of image golang:1.23 boots from golang_1.23.ext4 in it, and tasks of
+	// images without one are refused. Otherwise every task boots from
+	// RootFS, whatever its image.
+	Images string
+	// Init is the path, in the images, of cmd/vminit.
+	Init string
+	// VCPUs and MemoryMiB size the microVMs of jobs without resource
+	// limits.
+	VCPUs     int
+	MemoryMiB int
+	// WorkspaceSize is the size of the workspace drive, which is sparse.
+	WorkspaceSize int64
+	// Network, if valid, is split into a /30 per running job: the agent's
+	// end of the TAP device of its microVMs and theirs. Without it
+	// microVMs have no network. Reaching beyond the host takes IP
+	// forwarding and masquerading the prefix.
+	Network netip.Prefix
+	// Nameservers, if set, replace those of the images.
+	Nameservers []string
+}
+
+// Firecracker runs each task of a job in a Firecracker microVM of its own,
+// for jobs that must not share the host's kernel, such as builds of pull
+// requests from forks. Tasks boot from a copy of the image for theirs, so
+// nothing they change outlives them but the workspace, which is packed
+// into a drive every task of the job mounts and unpacked into the work
+// directory once they all succeed. The console of the microVM is the
+// output of the task, its standard error included. Services are not
+// supported, nor security settings but the user and group to run as.
+//
+// The agent must be able to use /dev/kvm and, to give microVMs a network,
+// create TAP devices; mkfs.ext4 and debugfs must be on the PATH.
+type Firecracker struct {
+	cfg FirecrackerConfig
+
+	mu sync.Mutex
+	// slots are the network slots in use, by index.
+	slots map[int]bool
+}
+
+// NewFirecracker returns a Firecracker executor, filling in the defaults of
+// cfg.
+func NewFirecracker(cfg FirecrackerConfig) (*Firecracker, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("the firecracker executor runs on Linux only")
+	}
+	if cfg.Binary == "" {
+		cfg.Binary = "firecracker"
+	}
+	if cfg.Init == "" {
+		cfg.Init = defaultGuestInit
+	}
+	if cfg.VCPUs == 0 {
+		cfg.VCPUs = defaultVCPUs
+	}
+	if cfg.MemoryMiB == 0 {
+		cfg.MemoryMiB = defaultMemoryMiB
+	}
+	if cfg.WorkspaceSize == 0 {
+		cfg.WorkspaceSize = defaultWorkspaceSize
+	}
+	if cfg.VCPUs < 1 || cfg.VCPUs > maxVCPUs || cfg.MemoryMiB < 128 {
+		return nil, fmt.Errorf("microVMs need 1 to %d vCPUs and at least 128 MiB of memory", maxVCPUs)
+	}
+	for _, file := range []string{cfg.Kernel, cfg.RootFS} {
+		if file == "" {
+			return nil, errors.New("the kernel and root filesystem of microVMs are required")
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Network.IsValid() && (!cfg.Network.Addr().Is4() || cfg.Network.Bits() > 30) {
+		return nil, fmt.Errorf("network %s must be an IPv4 prefix of at most /30", cfg.Network)
+	}
+	for _, ns := range cfg.Nameservers {
+		if _, err := netip.ParseAddr(ns); err != nil {
+			return nil, fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	for _, tool := range []string{cfg.Binary, "mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, err
+		}
+	}
+	return &Firecracker{cfg: cfg, slots: make(map[int]bool)}, nil
+}
+
+// HostShells returns the shells tasks run with: those of Linux images,
+// which have sh, and bash for those that have it too.
+func (f *Firecracker) HostShells() []types.Shell {
+	return []types.Shell{types.ShellSh, types.ShellBash}
+}
+
+// Check implements Executor.
+func (f *Firecracker) Check(job *agentpb.JobAssignment) error {
+	spec := job.GetSpec()
+	if len(spec.GetServices()) > 0 {
+		return errors.New("services are not supported by the firecracker executor")
+	}
+	if s := spec.GetSecurity(); s != nil && (s.GetReadOnlyRootFilesystem() || s.GetNoNewPrivileges() || len(s.GetCapAdd())+len(s.GetCapDrop()) > 0) {
+		return errors.New("the firecracker executor runs every task in a microVM of its own and applies only run_as_user and run_as_group of security settings")
+	}
+	if shell := types.Shell(spec.GetShell()).Default(); shell != types.ShellSh && shell != types.ShellBash {
+		return fmt.Errorf("the %s shell is not available in microVMs", shell)
+	}
+	if strings.ContainsFunc(workspace(job), unicode.IsSpace) {
+		return fmt.Errorf("workspace %q cannot be passed to microVMs", workspace(job))
+	}
+	for _, task := range tasks(job) {
+		if _, err := f.rootFS(task.GetImage()); err != nil {
+			return fmt.Errorf("task %s: %w", task.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// rootFS returns the image a task of image boots from.
+func (f *Firecracker) rootFS(image string) (string, error) {
+	if f.cfg.Images == "" || image == "" {
+		return f.cfg.RootFS, nil
+	}
+	file := filepath.Join(f.cfg.Images, strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)+".ext4")
+	if _, err := os.Stat(file); err != nil {
+		return "", fmt.Errorf("image %s has no root filesystem on this agent, such as %s", image, filepath.Base(file))
+	}
+	return file, nil
+}
+
+// workspace returns where the job's workspace is in its microVMs.
+func workspace(job *agentpb.JobAssignment) string {
+	if ws := job.GetSpec().GetWorkspace(); ws != "" {
+		return ws
+	}
+	return types.DefaultWorkspace
+}
+
+// Run implements Executor.
+func (f *Firecracker) Run(ctx context.Context, job *agentpb.JobAssignment, dir string, stdout, stderr io.Writer) (int, error) {
+	vmDir := dir + ".vm"
+	if err := os.Mkdir(vmDir, 0o700); err != nil {
+		return 0, fmt.Errorf("creating microVM directory: %w", err)
+	}
+	defer os.RemoveAll(vmDir)
+
+	slot := -1
+	if f.cfg.Network.IsValid() {
+		var err error
+		if slot, err = f.acquire(); err != nil {
+			return 0, err
+		}
+		defer f.release(slot)
+		if err := f.createTap(ctx, slot); err != nil {
+			return 0, fmt.Errorf("creating TAP device: %w", err)
+		}
+		defer f.deleteTap(slot)
+	}
+
+	list := tasks(job)
+	if err := f.writeTasks(job, list, dir); err != nil {
+		return 0, err
+	}
+	drive := filepath.Join(vmDir, "workspace.ext4")
+	if err := packWorkspace(ctx, dir, drive, f.cfg.WorkspaceSize); err != nil {
+		return 0, err
+	}
+	console := &consoleWriter{w: stdout}
+	for i, task := range list {
+		code, err := f.boot(ctx, job, i, task, vmDir, drive, slot, console)
+		console.flush()
+		switch {
+		case ctx.Err() != nil:
+			return -1, nil
+		case err != nil:
+			return 0, fmt.Errorf("task %s: %w", task.GetName(), err)
+		case code != 0:
+			return code, nil
+		}
+	}
+	if err := unpackWorkspace(ctx, drive, dir); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// writeTasks writes the tasks of job to microvm.TasksFile in dir, with the
+// environment shell tasks get but for the paths in the microVM.
+func (f *Firecracker) writeTasks(job *agentpb.JobAssignment, list []*agentpb.Task, dir string) error {
+	ws := workspace(job)
+	shell := types.Shell(job.GetSpec().GetShell()).Default()
+	security := job.GetSpec().GetSecurity()
+	home := "/root"
+	if security.GetRunAsUser() != 0 {
+		home = ws
+	}
+	var out []microvm.Task
+	for _, task := range list {
+		argv := task.GetEntrypoint()
+		if len(argv) == 0 {
+			argv = shell.Entrypoint()
+		}
+		argv = append(argv[:len(argv):len(argv)], strings.Join(task.GetCommands(), "\n"))
+		vars := map[string]string{
+			"PATH":               guestPath,
+			"HOME":               home,
+			"CI":                 "true",
+			"OPENCICD_JOB_ID":    job.GetJobId(),
+			"OPENCICD_JOB_NAME":  job.GetName(),
+			"OPENCICD_WORKSPACE": ws,
+			"OPENCICD_OUTPUT":    filepath.ToSlash(outputPath(ws)),
+		}
+		for k, v := range task.GetEnv() {
+			vars[k] = v
+		}
+		env := make([]string, 0, len(vars))
+		for k, v := range vars {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		t := microvm.Task{Name: task.GetName(), Argv: argv, Env: env, Nameservers: f.cfg.Nameservers}
+		if security != nil && security.RunAsUser != nil {
+			t.RunAsUser = security.RunAsUser
+			t.RunAsGroup = security.RunAsGroup
+		}
+		out = append(out, t)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, filepath.FromSlash(microvm.TasksFile))
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o600)
+}
+
+// vmConfig is the Firecracker configuration file of a microVM.
+type vmConfig struct {
+	BootSource struct {
+		KernelImagePath string `json:"kernel_image_path"`
+		BootArgs        string `json:"boot_args"`
+	} `json:"boot-source"`
+	Drives        []vmDrive `json:"drives"`
+	MachineConfig struct {
+		VCPUCount  int `json:"vcpu_count"`
+		MemSizeMiB int `json:"mem_size_mib"`
+	} `json:"machine-config"`
+	NetworkInterfaces []vmInterface `json:"network-interfaces,omitempty"`
+}
+
+type vmDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type vmInterface struct {
+	IfaceID     string `json:"iface_id"`
+	GuestMAC    string `json:"guest_mac"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+// boot runs the i-th task of job in a microVM booted from a copy of the
+// image of its task, with the workspace drive and, in a network slot, a
+// network. It returns the exit code of the task.
+func (f *Firecracker) boot(ctx context.Context, job *agentpb.JobAssignment, i int, task *agentpb.Task, vmDir, drive string, slot int, console io.Writer) (int, error) {
+	image, err := f.rootFS(task.GetImage())
+	if err != nil {
+		return 0, err
+	}
+	root := filepath.Join(vmDir, "rootfs.ext4")
+	if err := runTool(ctx, "cp", "--reflink=auto", "--sparse=always", image, root); err != nil {
+		return 0, fmt.Errorf("copying root filesystem: %w", err)
+	}
+	defer os.Remove(root)
+
+	args := []string{
+		"console=ttyS0", "reboot=k", "panic=1", "pci=off", "quiet", "loglevel=1",
+		"init=" + f.cfg.Init,
+		microvm.WorkspaceParam + "=" + workspace(job),
+		microvm.TaskParam + "=" + strconv.Itoa(i),
+	}
+	var cfg vmConfig
+	cfg.BootSource.KernelImagePath = f.cfg.Kernel
+	cfg.Drives = []vmDrive{
+		{DriveID: "rootfs", PathOnHost: root, IsRootDevice: true},
+		{DriveID: "workspace", PathOnHost: drive},
+	}
+	cfg.MachineConfig.VCPUCount = f.cfg.VCPUs
+	if millis := job.GetSpec().GetResources().GetCpuMillis(); millis > 0 {
+		cfg.MachineConfig.VCPUCount = int(min((millis+999)/1000, maxVCPUs))
+	}
+	cfg.MachineConfig.MemSizeMiB = f.cfg.MemoryMiB
+	if memory := job.GetSpec().GetResources().GetMemoryBytes(); memory > 0 {
+		cfg.MachineConfig.MemSizeMiB = int(max(memory>>20, 128))
+	}
+	if slot >= 0 {
+		host, guest := f.addresses(slot)
+		args = append(args, fmt.Sprintf("ip=%s::%s:255.255.255.252::eth0:off", guest, host))
+		cfg.NetworkInterfaces = []vmInterface{{
+			IfaceID:     "eth0",
+			GuestMAC:    fmt.Sprintf("06:00:%02x:%02x:%02x:%02x", guest.As4()[0], guest.As4()[1], guest.As4()[2], guest.As4()[3]),
+			HostDevName: tapName(slot),
+		}}
+	}
+	cfg.BootSource.BootArgs = strings.Join(args, " ")
+	config := filepath.Join(vmDir, "vm.json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(config, data, 0o600); err != nil {
+		return 0, err
+	}
+	logFile := filepath.Join(vmDir, "firecracker.log")
+	if err := os.WriteFile(logFile, nil, 0o600); err != nil {
+		return 0, err
+	}
+
+	cmd := exec.CommandContext(ctx, f.cfg.Binary, "--no-api", "--config-file", config, "--log-path", logFile, "--level", "Warning")
+	cmd.Stdout = console
+	cmd.WaitDelay = shellWaitDelay
+	isolate(cmd)
+	runErr := cmd.Run()
+	if ctx.Err() != nil {
+		return -1, nil
+	}
+	out, err := toolOutput(ctx, "debugfs", "-R", "cat /"+microvm.ExitFile(i), drive)
+	if err != nil {
+		return 0, err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		// The task never ran: the microVM did not boot, or init failed.
+		log, _ := os.ReadFile(logFile)
+		if len(log) > firecrackerLogTail {
+			log = log[len(log)-firecrackerLogTail:]
+		}
+		err = errors.New("the microVM exited without running the task")
+		if runErr != nil {
+			err = fmt.Errorf("%w: %v", err, runErr)
+		}
+		if log = bytes.TrimSpace(log); len(log) > 0 {
+			err = fmt.Errorf("%w; firecracker logged: %s", err, log)
+		}
+		return 0, err
+	}
+	return code, nil
+}
+
+// acquire takes the lowest free network slot.
+func (f *Firecracker) acquire() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	slots := 1 << (32 - f.cfg.Network.Bits() - 2)
+	for i := range slots {
+		if !f.slots[i] {
+			f.slots[i] = true
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("network %s has room for %d microVMs, which are all running", f.cfg.Network, slots)
+}
+
+func (f *Firecracker) release(slot int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.slots, slot)
+}
+
+// addresses returns the addresses of the agent's and the microVM's end of
+// the TAP device of slot.
+func (f *Firecracker) addresses(slot int) (host, guest netip.Addr) {
+	base := f.cfg.Network.Masked().Addr().As4()
+	n := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	n += uint32(slot) * 4
+	addr := func(n uint32) netip.Addr {
+		return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+	return addr(n + 1), addr(n + 2)
+}
+
+func tapName(slot int) string {
+	return tapPrefix + strconv.Itoa(slot)
+}
+
+// createTap creates the TAP device of slot, replacing any an agent that
+// died left behind.
+func (f *Firecracker) createTap(ctx context.Context, slot int) error {
+	name := tapName(slot)
+	host, _ := f.addresses(slot)
+	f.deleteTap(slot)
+	for _, args := range [][]string{
+		{"tuntap", "add", "dev", name, "mode", "tap"},
+		{"addr", "add", host.String() + "/30", "dev", name},
+		{"link", "set", name, "up"},
+	} {
+		if err := runTool(ctx, "ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Firecracker) deleteTap(slot int) {
+	exec.Command("ip", "link", "del", tapName(slot)).Run()
+}
+
+// packWorkspace creates the workspace drive, a sparse ext4 image of size
+// bytes holding the files of dir.
+func packWorkspace(ctx context.Context, dir, drive string, size int64) error {
+	file, err := os.Create(drive)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := runTool(ctx, "mkfs.ext4", "-q", "-F", "-d", dir, drive); err != nil {
+		return fmt.Errorf("packing workspace: %w", err)
+	}
+	return nil
+}
+
+// unpackWorkspace replaces the files of dir with those of the workspace
+// drive, but for the files only microVMs use.
+func unpackWorkspace(ctx context.Context, drive, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err := runTool(ctx, "debugfs", "-R", "rdump / "+dir, drive); err != nil {
+		return fmt.Errorf("unpacking workspace: %w", err)
+	}
+	os.Remove(filepath.Join(dir, "lost+found"))
+	return os.RemoveAll(filepath.Join(dir, filepath.FromSlash(filepath.Dir(microvm.TasksFile))))
+}
+
+// runTool runs a command, failing with its standard error if it fails.
+func runTool(ctx context.Context, name string, args ...string) error {
+	_, err := toolOutput(ctx, name, args...)
+	return err
+}
+
+// toolOutput runs a command and returns its standard output, failing with
+// its standard error if it fails.
+func toolOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// consoleWriter writes the output of a serial console with its line
+// endings, \r\n, turned back into \n.
+type consoleWriter struct {
+	w io.Writer
+	// cr is set while a \r ending a write may start a line ending.
+	cr bool
+}
+
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	if c.cr && (len(p) == 0 || p[0] != '\n') {
+		b.WriteByte('\r')
+	}
+	c.cr = false
+	data := p
+	if bytes.HasSuffix(data, []byte("\r")) {
+		data, c.cr = data[:len(data)-1], true
+	}
+	b.Write(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+	if _, err := c.w.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes a \r held back at the end of the output.
+func (c *consoleWriter) flush() {
+	if c.cr {
+		c.w.Write([]byte("\r"))
+		c.cr = false
+	}
+}
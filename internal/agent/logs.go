@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+
+	"open-cicd/internal/agentpb"
+)
+
+// logChunkBytes is the largest log chunk uploaded at once.
+const logChunkBytes = 32 << 10
+
+// uploader streams the output of a job to the server. Its writers may be
+// used from several goroutines; chunks are sent in the order written.
+type uploader struct {
+	agent *Agent
+	jobID string
+	// lease is the fencing token of the job's assignment.
+	lease int64
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	stream agentpb.AgentService_StreamLogsClient
+	// err is the first upload error. Output written after it is dropped,
+	// so that a broken upload does not fail the job itself.
+	err error
+}
+
+func newUploader(a *Agent, jobID string, lease int64) *uploader {
+	return &uploader{agent: a, jobID: jobID, lease: lease}
+}
+
+// stdout and stderr return writers for the two output streams of the job.
+func (u *uploader) stdout() io.Writer {
+	return logWriter{u: u, stream: agentpb.LogStream_LOG_STREAM_STDOUT}
+}
+
+func (u *uploader) stderr() io.Writer {
+	return logWriter{u: u, stream: agentpb.LogStream_LOG_STREAM_STDERR}
+}
+
+type logWriter struct {
+	u      *uploader
+	stream agentpb.LogStream
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.u.send(w.stream, p)
+	return len(p), nil
+}
+
+// send uploads p, opening the log stream on first use.
+func (u *uploader) send(stream agentpb.LogStream, p []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return
+	}
+	if u.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := u.agent.client.StreamLogs(u.agent.authed(ctx))
+		if err != nil {
+			cancel()
+			u.fail(err)
+			return
+		}
+		u.stream, u.cancel = s, cancel
+	}
+	for len(p) > 0 {
+		n := min(len(p), logChunkBytes)
+		// The stream may keep the chunk until it is sent, so it gets a copy.
+		data := append([]byte(nil), p[:n]...)
+		if err := u.stream.Send(&agentpb.LogChunk{JobId: u.jobID, Stream: stream, Data: data, LeaseToken: u.lease}); err != nil {
+			u.fail(err)
+			return
+		}
+		p = p[n:]
+	}
+}
+
+// fail records the first upload error. Callers must hold the lock.
+func (u *uploader) fail(err error) {
+	if errors.Is(err, io.EOF) && u.stream != nil {
+		// The server ended the stream; CloseAndRecv has its status.
+		if _, recvErr := u.stream.CloseAndRecv(); recvErr != nil {
+			err = recvErr
+		}
+	}
+	slog.Warn("Uploading job output failed; dropping the rest", "job_id", u.jobID, "error", err)
+	u.err = err
+}
+
+// close finishes the upload, waiting for the server to store everything
+// sent, and returns the first upload error.
+func (u *uploader) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stream == nil {
+		return u.err
+	}
+	defer u.cancel()
+	if u.err != nil {
+		return u.err
+	}
+	if _, err := u.stream.CloseAndRecv(); err != nil {
+		u.err = err
+	}
+	return u.err
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package agent
+
+import "os/exec"
+
+// isolate leaves cmd as is; only the task process itself is killed when the
+// job is stopped.
+func isolate(*exec.Cmd) {}
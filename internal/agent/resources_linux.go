@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"open-cicd/internal/agentpb"
+)
+
+// machineResources measures the machine for heartbeats: its cores, less
+// the one-minute load average, its memory and what the kernel counts as
+// available of it, and the size and free space of the filesystem of dir.
+// It returns nil if the kernel cannot be asked.
+func machineResources(dir string) *agentpb.MachineResources {
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil
+	}
+	loadavg, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return nil
+	}
+	cpu := int64(runtime.NumCPU()) * 1000
+	var load float64
+	if fields := strings.Fields(string(loadavg)); len(fields) > 0 {
+		load, _ = strconv.ParseFloat(fields[0], 64)
+	}
+	mem := parseMeminfo(meminfo)
+	return &agentpb.MachineResources{
+		TotalCpuMillis:       cpu,
+		TotalMemoryBytes:     mem["MemTotal"],
+		TotalDiskBytes:       int64(fs.Blocks) * int64(fs.Bsize),
+		AvailableCpuMillis:   max(cpu-int64(load*1000), 0),
+		AvailableMemoryBytes: mem["MemAvailable"],
+		AvailableDiskBytes:   int64(fs.Bavail) * int64(fs.Bsize),
+	}
+}
+
+// parseMeminfo returns the sizes /proc/meminfo lists, in bytes.
+func parseMeminfo(data []byte) map[string]int64 {
+	sizes := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			n *= 1024
+		}
+		sizes[name] = n
+	}
+	return sizes
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package agent
+
+import "open-cicd/internal/agentpb"
+
+// machineResources returns nil: the agent only measures Linux machines, and
+// the server schedules others by their capacity alone.
+func machineResources(string) *agentpb.MachineResources { return nil }
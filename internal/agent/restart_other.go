@@ -0,0 +1,11 @@
+//go:build !unix
+
+package agent
+
+import "errors"
+
+// Restart is not supported on this platform; the agent has to be started
+// again by whatever supervises it.
+func Restart() error {
+	return errors.New("restarting in place is not supported on this platform")
+}
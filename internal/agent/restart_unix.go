@@ -0,0 +1,18 @@
+//go:build unix
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// Restart replaces the process with a fresh run of its executable, with the
+// same arguments and environment, once Run returned ErrUpdated.
+func Restart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
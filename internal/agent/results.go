@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// outputPath is the file in the work directory dir that jobs append the
+// results they report to, as key=value lines; jobs find it in
+// OPENCICD_OUTPUT.
+func outputPath(dir string) string {
+	return filepath.Join(dir, ".opencicd", "output")
+}
+
+// readResults reads the results the job left in its output file, the last
+// value of a key winning. A job that wrote none has no results.
+func readResults(dir string) (map[string]string, error) {
+	data, err := os.ReadFile(outputPath(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d of OPENCICD_OUTPUT is not key=value", i+1)
+		}
+		results[key] = value
+	}
+	if err := types.ValidateResults(results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"open-cicd/internal/agentpb"
+)
+
+// stopReason says why a job is being stopped before it finished.
+type stopReason int
+
+const (
+	// stopNone means the job runs until it finishes or times out.
+	stopNone stopReason = iota
+	// stopCancel means the job was cancelled and is reported cancelled.
+	stopCancel
+	// stopRequeue means the job is handed back to the server, which
+	// re-queues it to run elsewhere.
+	stopRequeue
+	// stopLeaseLost means the agent lost the lease on the job, which the
+	// server may have handed to another agent, so it is dropped without
+	// being reported.
+	stopLeaseLost
+)
+
+// leaseMargin is the part of each lease term the agent gives up, so that it
+// stops a job whose lease it could not renew before the server expires the
+// lease. It covers the time an assignment takes to arrive and clocks that
+// run at slightly different rates.
+const leaseMargin = 4
+
+// leaseEnd returns until when a lease of term seconds granted at from is
+// held, or the zero time for servers that grant no lease.
+func leaseEnd(from time.Time, term int64) time.Time {
+	if term <= 0 {
+		return time.Time{}
+	}
+	d := time.Duration(term) * time.Second
+	return from.Add(d - d/leaseMargin)
+}
+
+// run is a job the agent is running.
+type run struct {
+	agent *Agent
+	job   *agentpb.JobAssignment
+	ctx   context.Context
+	// abort stops the executor.
+	abort context.CancelFunc
+	// done is closed once the job's final state is reported.
+	done chan struct{}
+
+	mu         sync.Mutex
+	stopped    stopReason
+	stopReason string
+	// leaseUntil is when the agent stops the job unless it renewed the
+	// lease by then; zero if the server grants no lease.
+	leaseUntil time.Time
+	// renewed is signalled when leaseUntil moves.
+	renewed chan struct{}
+}
+
+func newRun(ctx context.Context, a *Agent, job *agentpb.JobAssignment) *run {
+	ctx, abort := context.WithCancel(ctx)
+	return &run{
+		agent:      a,
+		job:        job,
+		ctx:        ctx,
+		abort:      abort,
+		done:       make(chan struct{}),
+		leaseUntil: leaseEnd(time.Now(), job.GetLeaseSeconds()),
+		renewed:    make(chan struct{}, 1),
+	}
+}
+
+// renew extends the lease of the job to until.
+func (r *run) renew(until time.Time) {
+	r.mu.Lock()
+	if until.After(r.leaseUntil) {
+		r.leaseUntil = until
+	}
+	r.mu.Unlock()
+	select {
+	case r.renewed <- struct{}{}:
+	default:
+	}
+}
+
+// watchLease stops the job once its lease runs out without having been
+// renewed, before the server may hand the job to another agent. It returns
+// when the job ends.
+func (r *run) watchLease() {
+	r.mu.Lock()
+	until := r.leaseUntil
+	r.mu.Unlock()
+	if until.IsZero() {
+		return
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.renewed:
+		case <-timer.C:
+		}
+		r.mu.Lock()
+		until = r.leaseUntil
+		r.mu.Unlock()
+		left := time.Until(until)
+		if left <= 0 {
+			slog.Warn("Lease on job ran out before it could be renewed; stopping it", "job_id", r.job.GetJobId())
+			r.stop(stopLeaseLost, "lease ran out")
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(left)
+	}
+}
+
+// stop stops the job for reason. The first reason given wins.
+func (r *run) stop(reason stopReason, msg string) {
+	r.mu.Lock()
+	if r.stopped == stopNone {
+		r.stopped, r.stopReason = reason, msg
+	}
+	r.mu.Unlock()
+	r.abort()
+}
+
+// stoppedFor returns why the job was stopped, if it was.
+func (r *run) stoppedFor() (stopReason, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped, r.stopReason
+}
+
+// execute runs the job from start to finish: it reports the job running,
+// restores the snapshots of upstream jobs and the caches it mounts into a
+// work directory of its own, runs it there with its output uploaded, saves
+// its caches, results and outputs if it succeeded and reports the state it
+// ended in.
+func (r *run) execute() {
+	defer close(r.done)
+	defer r.abort()
+	log := slog.With("job_id", r.job.GetJobId())
+	go r.watchLease()
+
+	resp, err := r.report(&agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_RUNNING})
+	if err != nil {
+		// The job was cancelled or handed elsewhere before it started.
+		log.Warn("Reporting job running failed; dropping job", "error", err)
+		return
+	}
+	if resp.GetRequeueRequested() {
+		r.stop(stopRequeue, "requeue requested")
+	}
+
+	dir, err := os.MkdirTemp(r.agent.cfg.WorkDir, "job-")
+	if err != nil {
+		r.finish(log, &agentpb.ReportStatusRequest{
+			State:          agentpb.JobState_JOB_STATE_FAILED,
+			Reason:         fmt.Sprintf("creating work directory: %v", err),
+			Infrastructure: true,
+		})
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn("Removing work directory", "dir", dir, "error", err)
+		}
+	}()
+
+	ctx := r.ctx
+	if seconds := r.job.GetTimeoutSeconds(); seconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+		defer cancel()
+	}
+
+	if err := r.restoreSnapshots(ctx, dir); err != nil {
+		r.finish(log, r.outcome(ctx, 0, err))
+		return
+	}
+	r.restoreCaches(ctx, log, dir)
+
+	uploader := newUploader(r.agent, r.job.GetJobId(), r.job.GetLeaseToken())
+	log.Info("Running job", "dir", filepath.Base(dir))
+	code, runErr := r.agent.executor.Run(ctx, r.job, dir, uploader.stdout(), uploader.stderr())
+	if err := uploader.close(); err != nil {
+		log.Warn("Uploading job output failed", "error", err)
+	}
+	outcome := r.outcome(ctx, code, runErr)
+	if outcome.GetState() == agentpb.JobState_JOB_STATE_SUCCEEDED {
+		r.saveCaches(ctx, log, dir)
+		results, err := readResults(dir)
+		if err != nil {
+			// The job wrote its output file wrong, so it is to blame.
+			outcome = &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_FAILED, Reason: fmt.Sprintf("reading job results: %v", err)}
+		}
+		outcome.Results = results
+	}
+	if outcome.GetState() == agentpb.JobState_JOB_STATE_SUCCEEDED && len(r.job.GetOutputs()) > 0 {
+		// Downstream jobs start once this one is reported succeeded, so
+		// its outputs must be stored first.
+		if err := r.saveSnapshot(ctx, dir); err != nil {
+			outcome = r.outcome(ctx, 0, fmt.Errorf("saving workspace snapshot: %w", err))
+		}
+	}
+	r.finish(log, outcome)
+}
+
+// outcome decides the final state of the job from how the executor
+// returned.
+func (r *run) outcome(ctx context.Context, code int, runErr error) *agentpb.ReportStatusRequest {
+	stopped, reason := r.stoppedFor()
+	switch {
+	case stopped == stopLeaseLost:
+		// finish does not report it.
+		return &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_FAILED, Reason: reason}
+	case stopped == stopRequeue:
+		return &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_QUEUED, Reason: reason}
+	case stopped == stopCancel:
+		return &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_CANCELLED, Reason: reason}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &agentpb.ReportStatusRequest{
+			State:  agentpb.JobState_JOB_STATE_TIMED_OUT,
+			Reason: fmt.Sprintf("timed out after %ds", r.job.GetTimeoutSeconds()),
+		}
+	case runErr != nil:
+		return &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_FAILED, Reason: runErr.Error(), Infrastructure: true}
+	case code != 0:
+		return &agentpb.ReportStatusRequest{
+			State:    agentpb.JobState_JOB_STATE_FAILED,
+			ExitCode: proto.Int32(int32(code)),
+			Reason:   fmt.Sprintf("exited with code %d", code),
+		}
+	default:
+		return &agentpb.ReportStatusRequest{State: agentpb.JobState_JOB_STATE_SUCCEEDED, ExitCode: proto.Int32(0)}
+	}
+}
+
+// finish reports the final state of the job, unless the agent lost its
+// lease.
+func (r *run) finish(log *slog.Logger, req *agentpb.ReportStatusRequest) {
+	if stopped, reason := r.stoppedFor(); stopped == stopLeaseLost {
+		log.Warn("Dropped job without reporting it", "reason", reason)
+		return
+	}
+	if _, err := r.report(req); err != nil {
+		log.Error("Reporting job state failed", "state", req.GetState().String(), "error", err)
+		return
+	}
+	log.Info("Job finished", "state", req.GetState().String(), "reason", req.GetReason())
+}
+
+// report sends a state change of the job to the server under the job's
+// lease. The report is not tied to the job's context, so that stopped jobs
+// are still reported.
+func (r *run) report(req *agentpb.ReportStatusRequest) (*agentpb.ReportStatusResponse, error) {
+	req.JobId = r.job.GetJobId()
+	req.LeaseToken = r.job.GetLeaseToken()
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	return r.agent.client.ReportStatus(r.agent.authed(ctx), req)
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// lineEnding is what script files end their lines with on this platform.
+var lineEnding = func() string {
+	if runtime.GOOS == "windows" {
+		return "\r\n"
+	}
+	return "\n"
+}()
+
+// shellBinaries are the programs the shells are run as.
+var shellBinaries = map[types.Shell]string{
+	types.ShellSh:         "sh",
+	types.ShellBash:       "bash",
+	types.ShellPwsh:       "pwsh",
+	types.ShellPowerShell: "powershell",
+	types.ShellCmd:        "cmd",
+}
+
+// hostShells returns the shells that run on this platform and are found on
+// the PATH.
+func hostShells() []types.Shell {
+	var found []types.Shell
+	for _, s := range types.Shells {
+		if !s.RunsOn(runtime.GOOS) {
+			continue
+		}
+		if _, err := exec.LookPath(shellBinaries[s]); err == nil {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// scriptCommand writes the commands of the i-th task of a job to a script
+// file for shell in dir and returns the command line that runs it. Scripts
+// stop at the first command that fails or exits non-zero, like sh -e.
+func scriptCommand(shell types.Shell, i int, commands []string, dir string) ([]string, error) {
+	var (
+		lines []string
+		ext   string
+		bom   string
+		cmd   []string
+	)
+	switch shell {
+	case types.ShellPwsh, types.ShellPowerShell:
+		ext = ".ps1"
+		lines = append(lines, "$ErrorActionPreference = 'Stop'", "$ProgressPreference = 'SilentlyContinue'")
+		for _, c := range commands {
+			lines = append(lines, c, "if ((Test-Path -LiteralPath variable:\\LASTEXITCODE) -and $LASTEXITCODE -ne 0) { exit $LASTEXITCODE }")
+		}
+		lines = append(lines, "exit 0")
+		if shell == types.ShellPowerShell {
+			// Windows PowerShell reads files without a byte order mark in
+			// the legacy code page.
+			bom = "\ufeff"
+		}
+		cmd = []string{shellBinaries[shell], "-NoLogo", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}
+	case types.ShellCmd:
+		ext = ".cmd"
+		lines = append(lines, "@echo off")
+		for _, c := range commands {
+			lines = append(lines, c, "if %errorlevel% neq 0 exit /b %errorlevel%")
+		}
+		cmd = []string{shellBinaries[shell], "/D", "/E:ON", "/V:OFF", "/C"}
+	default:
+		return nil, fmt.Errorf("the %s shell does not run script files", shell)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("task-%d%s", i, ext))
+	script := bom + strings.Join(lines, lineEnding) + lineEnding
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		return nil, fmt.Errorf("writing script: %w", err)
+	}
+	return append(cmd, path), nil
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/types"
+)
+
+// shellWaitDelay is how long a stopped task's output is still read after
+// its processes are killed.
+const shellWaitDelay = 5 * time.Second
+
+// windowsEnv are the host variables programs on Windows cannot do without,
+// passed on to jobs there besides PATH.
+var windowsEnv = []string{"SYSTEMROOT", "WINDIR", "COMSPEC", "PATHEXT", "PROGRAMFILES", "PROGRAMDATA"}
+
+// Shell runs the tasks of a job as processes on the agent's host, in the
+// job's work directory, ignoring their images. Tasks see only the
+// environment of the job and the host variables named in PassEnv, never the
+// agent's own. Tasks without an entrypoint run from a script file with the
+// job's shell; see scriptCommand.
+type Shell struct {
+	PassEnv []string
+	// Shells are the shells found on the host.
+	Shells []types.Shell
+}
+
+// NewShell returns a shell executor passing PATH, on Windows the variables
+// its programs need, and the given host variables on to jobs.
+func NewShell(passEnv ...string) *Shell {
+	pass := []string{"PATH"}
+	if runtime.GOOS == "windows" {
+		pass = append(pass, windowsEnv...)
+	}
+	return &Shell{PassEnv: append(pass, passEnv...), Shells: hostShells()}
+}
+
+// HostShells returns the shells found on the host, which the agent
+// advertises so that jobs only land on it if it has theirs.
+func (s *Shell) HostShells() []types.Shell {
+	return s.Shells
+}
+
+// Check implements Executor. Services and security settings need
+// containers, which the shell executor does not have, and the job's shell
+// must be on the host.
+func (s *Shell) Check(job *agentpb.JobAssignment) error {
+	if len(job.GetSpec().GetServices()) > 0 {
+		return errors.New("services require the Docker executor; this agent runs jobs with the shell executor")
+	}
+	if job.GetSpec().GetSecurity() != nil {
+		return errors.New("security settings require a container executor; this agent runs jobs with the shell executor, as its own user")
+	}
+	shell := types.Shell(job.GetSpec().GetShell()).Default()
+	if !slices.Contains(s.Shells, shell) {
+		return fmt.Errorf("the %s shell is not available on this agent", shell)
+	}
+	return nil
+}
+
+// Run implements Executor.
+func (s *Shell) Run(ctx context.Context, job *agentpb.JobAssignment, dir string, stdout, stderr io.Writer) (int, error) {
+	tmp := filepath.Join(dir, ".tmp")
+	if err := os.Mkdir(tmp, 0o700); err != nil {
+		return 0, fmt.Errorf("creating temporary directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath(dir)), 0o700); err != nil {
+		return 0, fmt.Errorf("creating output directory: %w", err)
+	}
+	shell := types.Shell(job.GetSpec().GetShell()).Default()
+	for i, task := range tasks(job) {
+		argv := task.GetEntrypoint()
+		if len(argv) == 0 {
+			argv = shell.Entrypoint()
+		}
+		if len(argv) > 0 {
+			argv = append(argv[:len(argv):len(argv)], strings.Join(task.GetCommands(), "\n"))
+		} else {
+			var err error
+			if argv, err = scriptCommand(shell, i, task.GetCommands(), tmp); err != nil {
+				return 0, fmt.Errorf("task %s: %w", task.GetName(), err)
+			}
+		}
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Dir = dir
+		cmd.Env = s.env(job, task, dir, tmp)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		cmd.WaitDelay = shellWaitDelay
+		isolate(cmd)
+
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exitErr):
+			return exitErr.ExitCode(), nil
+		case ctx.Err() != nil:
+			return -1, nil
+		default:
+			return 0, fmt.Errorf("starting task %s: %w", task.GetName(), err)
+		}
+	}
+	return 0, nil
+}
+
+// tasks returns the tasks of job. Assignments without an execution spec
+// run their commands as a single task.
+func tasks(job *agentpb.JobAssignment) []*agentpb.Task {
+	if spec := job.GetSpec(); spec != nil && len(spec.GetTasks()) > 0 {
+		return spec.GetTasks()
+	}
+	return []*agentpb.Task{{Name: job.GetName(), Commands: job.GetCommands(), Env: job.GetEnv()}}
+}
+
+// env returns the environment of a task: the passed-through host variables,
+// then the variables describing the job, then the task's own.
+func (s *Shell) env(job *agentpb.JobAssignment, task *agentpb.Task, dir, tmp string) []string {
+	vars := make(map[string]string)
+	for _, name := range s.PassEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		}
+	}
+	vars["HOME"] = dir
+	vars["TMPDIR"] = tmp
+	if runtime.GOOS == "windows" {
+		vars["USERPROFILE"] = dir
+		vars["TEMP"] = tmp
+		vars["TMP"] = tmp
+	}
+	vars["CI"] = "true"
+	vars["OPENCICD_JOB_ID"] = job.GetJobId()
+	vars["OPENCICD_JOB_NAME"] = job.GetName()
+	vars["OPENCICD_WORKSPACE"] = dir
+	vars["OPENCICD_OUTPUT"] = outputPath(dir)
+	for k, v := range task.GetEnv() {
+		vars[k] = v
+	}
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agentpb"
+)
+
+// snapshotChunkBytes is the largest snapshot chunk uploaded at once.
+const snapshotChunkBytes = 256 << 10
+
+// restoreSnapshots extracts the snapshots the server lists for the job into
+// its work directory, in order, so that later ones win. Servers that do not
+// serve snapshots have none to restore.
+func (r *run) restoreSnapshots(ctx context.Context, dir string) error {
+	client := r.agent.client
+	resp, err := client.ListSnapshots(r.agent.authed(ctx), &agentpb.ListSnapshotsRequest{JobId: r.job.GetJobId()})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing snapshots: %w", err)
+	}
+	for _, snapshot := range resp.GetSnapshots() {
+		stream, err := client.DownloadSnapshot(r.agent.authed(ctx), &agentpb.DownloadSnapshotRequest{
+			JobId:         r.job.GetJobId(),
+			SnapshotJobId: snapshot.GetJobId(),
+		})
+		if err == nil {
+			err = extractSnapshot(&chunkReader{recv: func() ([]byte, error) {
+				chunk, err := stream.Recv()
+				return chunk.GetData(), err
+			}}, dir)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring snapshot of job %s of stage %s: %w", snapshot.GetJobId(), snapshot.GetStage(), err)
+		}
+	}
+	return nil
+}
+
+// saveSnapshot archives the outputs of the job in its work directory and
+// uploads them.
+func (r *run) saveSnapshot(ctx context.Context, dir string) error {
+	ctx, cancel := context.WithCancel(r.agent.authed(ctx))
+	defer cancel()
+	stream, err := r.agent.client.UploadSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeSnapshot(pw, dir, r.job.GetOutputs())) }()
+	defer pr.Close()
+
+	buf := make([]byte, snapshotChunkBytes)
+	first := true
+	for {
+		n, err := io.ReadFull(pr, buf)
+		if n > 0 || first {
+			chunk := &agentpb.SnapshotChunk{Data: buf[:n]}
+			if first {
+				chunk.JobId, chunk.LeaseToken, first = r.job.GetJobId(), r.job.GetLeaseToken(), false
+			}
+			if serr := stream.Send(chunk); serr != nil {
+				// The server ended the stream; CloseAndRecv says why.
+				_, rerr := stream.CloseAndRecv()
+				return errors.Join(serr, rerr)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// writeSnapshot writes a gzipped tar of the given paths of dir, which may be
+// files, directories or symbolic links, to w. Every path must exist.
+func writeSnapshot(w io.Writer, dir string, paths []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, p := range paths {
+		root := filepath.Join(dir, filepath.FromSlash(p))
+		if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("output %s does not exist", p)
+		}
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return addToSnapshot(tw, dir, name, d)
+		})
+		if err != nil {
+			return fmt.Errorf("archiving output %s: %w", p, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addToSnapshot adds the file name of dir to the archive.
+func addToSnapshot(tw *tar.Writer, dir, name string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(name); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractSnapshot extracts a gzipped tar into dir, replacing what is there.
+// Entries and link targets that would leave dir are refused.
+func extractSnapshot(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("snapshot entry %q leaves the workspace", hdr.Name)
+		}
+		name := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, mode|0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := replace(name); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || !filepath.IsLocal(filepath.Join(filepath.Dir(rel), hdr.Linkname)) {
+				return fmt.Errorf("snapshot link %q points out of the workspace", hdr.Name)
+			}
+			if err := replace(name); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, name); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replace removes the file or link at name, if there is one, so that it is
+// written afresh rather than through a link.
+func replace(name string) error {
+	info, err := os.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	return os.Remove(name)
+}
+
+// chunkReader reads the data of the chunks of a snapshot or cache download.
+type chunkReader struct {
+	recv func() ([]byte, error)
+	buf  []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		data, err := c.recv()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = data
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
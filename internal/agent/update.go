@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/releases"
+)
+
+// maxBinaryBytes caps the size of a downloaded agent binary.
+const maxBinaryBytes = 512 << 20
+
+// ErrUpdated is returned by Run once the agent installed a new version of
+// itself. The caller should Restart into it.
+var ErrUpdated = errors.New("agent was updated")
+
+// platform is the platform the agent reports and installs binaries for.
+var platform = runtime.GOOS + "/" + runtime.GOARCH
+
+// offerUpdate handles an update the server sent. Agents without an update
+// key refuse it; otherwise the agent stops taking jobs and installs the
+// update once the running ones finish.
+func (a *Agent) offerUpdate(ctx context.Context, u *agentpb.AgentUpdate) {
+	if a.cfg.UpdateKey == nil {
+		a.updateFailed(u, errors.New("the agent has no update key to verify binaries with"))
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.updating != nil {
+		return
+	}
+	a.updating = u
+	a.updates <- u
+	slog.InfoContext(ctx, "Updating agent once running jobs finish", "version", u.GetVersion(), "running", len(a.runs))
+}
+
+// installUpdates installs the updates the server offers until ctx is
+// cancelled. Once one is installed, it calls stop so that Run returns.
+func (a *Agent) installUpdates(ctx context.Context, stop func()) {
+	for {
+		var u *agentpb.AgentUpdate
+		select {
+		case <-ctx.Done():
+			return
+		case u = <-a.updates:
+		}
+		a.mu.Lock()
+		runs := make([]*run, 0, len(a.runs))
+		for _, r := range a.runs {
+			runs = append(runs, r)
+		}
+		a.mu.Unlock()
+		for _, r := range runs {
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := a.install(ctx, u); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "installing agent update", "version", u.GetVersion(), "error", err)
+			a.updateFailed(u, err)
+			continue
+		}
+		slog.InfoContext(ctx, "Installed agent update; restarting", "version", u.GetVersion())
+		a.updated.Store(true)
+		stop()
+		return
+	}
+}
+
+// updateFailed tells the server the agent could not install u, and takes
+// jobs again.
+func (a *Agent) updateFailed(u *agentpb.AgentUpdate, err error) {
+	a.mu.Lock()
+	if a.updating == u {
+		a.updating = nil
+	}
+	a.mu.Unlock()
+	msg := &agentpb.UpdateFailed{Version: u.GetVersion(), Reason: err.Error()}
+	// Only the latest failure matters to the server.
+	select {
+	case <-a.failures:
+	default:
+	}
+	a.failures <- msg
+}
+
+// install downloads the binary of u, checks its digest and signature, and
+// puts it in place of the running executable.
+func (a *Agent) install(ctx context.Context, u *agentpb.AgentUpdate) error {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("locating the agent executable: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.GetUrl(), nil)
+	if err != nil {
+		return fmt.Errorf("invalid download URL: %w", err)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("downloading agent binary: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading agent binary: server responded %s", resp.Status)
+	}
+
+	// The binary is written next to the executable so that it can be
+	// renamed over it.
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".update-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, maxBinaryBytes+1))
+	if err != nil {
+		return fmt.Errorf("downloading agent binary: %w", err)
+	}
+	if n > maxBinaryBytes {
+		return fmt.Errorf("agent binary is larger than %d MiB", maxBinaryBytes>>20)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != u.GetSha256() {
+		return fmt.Errorf("downloaded binary has digest %s, expected %s", digest, u.GetSha256())
+	}
+	if err := releases.Verify(a.cfg.UpdateKey, u.GetVersion(), platform, digest, u.GetSignature()); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		return fmt.Errorf("making agent binary executable: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing agent binary: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("replacing the agent executable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package agenthttp carries the agent gRPC protocol over plain HTTP/1.1
+// requests, for agents whose network only lets HTTPS through proxies that
+// would break gRPC's long-lived HTTP/2 streams. Gateway serves the methods
+// of a gRPC service on the server's HTTP port and Conn calls them from the
+// agent in place of a gRPC connection, so that both sides run the same code
+// whichever transport carries the calls.
+//
+// Messages are framed as in gRPC-Web: a flag byte, a 4-byte big-endian
+// length and the encoded message, with the call's status in a final trailer
+// frame. Unary and server-streaming calls are one request each. Streams the
+// client sends on, such as the job stream and log uploads, are sessions of
+// short requests instead: the client opens the stream, posts the messages it
+// sends in batches and long-polls for those the server sends, so that no
+// request stays open for longer than a proxy is likely to allow.
+package agenthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Prefix is the path under which Gateway serves the methods, each at
+// Prefix/<service>/<method>.
+const Prefix = "/agent-api"
+
+const (
+	contentType = "application/grpc-web+proto"
+
+	flagMessage byte = 0
+	flagTrailer byte = 0x80
+	// maxFrameBytes bounds a single message, well above the largest chunk
+	// agents send.
+	maxFrameBytes = 16 << 20
+
+	// Query parameters of the requests of a session: op is one of the ops
+	// below and stream the session's ID, which opening it returns in the
+	// streamHeader header.
+	opParam      = "op"
+	streamParam  = "stream"
+	streamHeader = "X-Agent-Stream"
+	opSend       = "send"
+	opRecv       = "recv"
+	opClose      = "close"
+	opCancel     = "cancel"
+
+	// pollWait is how long a receive waits for the server to send
+	// something before it returns empty, short enough to pass proxies that
+	// end idle requests.
+	pollWait = 25 * time.Second
+	// keepAliveInterval is how often the client touches a session it has
+	// nothing to send on, and idleTimeout how long the server keeps a
+	// session nobody touched before cancelling it.
+	keepAliveInterval = 20 * time.Second
+	idleTimeout       = time.Minute
+)
+
+// writeFrame writes one frame of data with flag to w.
+func writeFrame(w io.Writer, flag byte, data []byte) error {
+	var header [5]byte
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame reads the next frame from r. It returns io.EOF if r ends
+// before the frame starts.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, errors.New("truncated frame header")
+		}
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrameBytes {
+		return 0, nil, fmt.Errorf("frame of %d bytes is larger than %d", n, maxFrameBytes)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, fmt.Errorf("reading frame: %w", err)
+	}
+	return header[0], data, nil
+}
+
+// trailer encodes the status of err, nil meaning OK, as the header block of
+// a trailer frame.
+func trailer(err error) []byte {
+	st := statusOf(err)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "grpc-status: %d\r\n", st.Code())
+	if st.Message() != "" {
+		fmt.Fprintf(&b, "grpc-message: %s\r\n", url.PathEscape(st.Message()))
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// parseTrailer decodes the status in a trailer frame, returning nil for OK.
+func parseTrailer(data []byte) error {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return status.Errorf(codes.Internal, "malformed trailer: %v", err)
+	}
+	code, err := strconv.ParseUint(header.Get("Grpc-Status"), 10, 32)
+	if err != nil {
+		return status.Errorf(codes.Internal, "malformed grpc-status %q", header.Get("Grpc-Status"))
+	}
+	msg, err := url.PathUnescape(header.Get("Grpc-Message"))
+	if err != nil {
+		msg = header.Get("Grpc-Message")
+	}
+	return status.Error(codes.Code(code), msg)
+}
+
+// statusOf returns the status of a call that ended with err.
+func statusOf(err error) *status.Status {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if _, ok := status.FromError(err); !ok {
+			return status.FromContextError(err)
+		}
+	}
+	return status.Convert(err)
+}
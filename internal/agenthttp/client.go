@@ -0,0 +1,437 @@
+package agenthttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// sendBatchBytes is how much a stream buffers of what the client sends
+	// before posting it, and sendDelay how long it waits for more. Streams
+	// the server sends on too post every message at once.
+	sendBatchBytes = 1 << 20
+	sendDelay      = 250 * time.Millisecond
+	// cancelTimeout bounds telling the server a stream was cancelled.
+	cancelTimeout = 5 * time.Second
+)
+
+// Conn calls the methods of a Gateway. It implements
+// grpc.ClientConnInterface, so generated clients use it like a gRPC
+// connection. Errors of the HTTP transport, such as an unreachable server,
+// are reported as UNAVAILABLE.
+type Conn struct {
+	base   string
+	client *http.Client
+}
+
+var _ grpc.ClientConnInterface = (*Conn)(nil)
+
+// NewConn returns a connection to the gateway of the server at serverURL,
+// such as https://ci.example.com, made with client. The client must not
+// have a timeout shorter than a long poll, about half a minute.
+func NewConn(serverURL string, client *http.Client) (*Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("server URL %q is not an http or https URL", serverURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Conn{base: strings.TrimSuffix(u.String(), "/") + Prefix, client: client}, nil
+}
+
+// post calls method with body, adding the query of a session op, and
+// returns the response once it is known to come from a gateway.
+func (c *Conn) post(ctx context.Context, method string, query url.Values, body []byte) (*http.Response, error) {
+	target := c.base + method
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	req.Header.Set("Content-Type", contentType)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for k, values := range md {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) {
+		resp.Body.Close()
+		return nil, status.Errorf(httpCode(resp.StatusCode), "agent protocol gateway answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// httpCode maps the status of a response that did not come from a gateway,
+// such as one of a proxy in between.
+func httpCode(code int) codes.Code {
+	switch code {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusOK, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+// read reads the frames of a response, handing each message to msg. It
+// returns whether the response ended with a trailer, and its status.
+func read(body io.Reader, msg func([]byte)) (bool, error) {
+	for {
+		flag, data, err := readFrame(body)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, status.Error(codes.Unavailable, err.Error())
+		}
+		if flag&flagTrailer != 0 {
+			return true, parseTrailer(data)
+		}
+		msg(data)
+	}
+}
+
+func frame(m any) ([]byte, error) {
+	data, err := proto.Marshal(m.(proto.Message))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encoding message: %v", err)
+	}
+	var b bytes.Buffer
+	writeFrame(&b, flagMessage, data)
+	return b.Bytes(), nil
+}
+
+func decode(data []byte, m any) error {
+	if err := proto.Unmarshal(data, m.(proto.Message)); err != nil {
+		return status.Errorf(codes.Internal, "decoding message: %v", err)
+	}
+	return nil
+}
+
+// Invoke implements grpc.ClientConnInterface.
+func (c *Conn) Invoke(ctx context.Context, method string, args, reply any, _ ...grpc.CallOption) error {
+	body, err := frame(args)
+	if err != nil {
+		return err
+	}
+	resp, err := c.post(ctx, method, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out []byte
+	ended, err := read(resp.Body, func(data []byte) { out = data })
+	if err != nil {
+		return err
+	}
+	if !ended {
+		return status.Error(codes.Unavailable, "response ended without a status")
+	}
+	if out == nil {
+		return status.Error(codes.Internal, "response carries no message")
+	}
+	return decode(out, reply)
+}
+
+// NewStream implements grpc.ClientConnInterface.
+func (c *Conn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+	if !desc.ClientStreams {
+		return &responseStream{conn: c, ctx: ctx, method: method}, nil
+	}
+	resp, err := c.post(ctx, method, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if _, err := read(resp.Body, func([]byte) {}); err != nil {
+		return nil, err
+	}
+	id := resp.Header.Get(streamHeader)
+	if id == "" {
+		return nil, status.Error(codes.Internal, "gateway named no stream")
+	}
+	s := &sessionStream{conn: c, ctx: ctx, method: method, id: id, eager: desc.ServerStreams, last: time.Now(), done: make(chan struct{})}
+	s.stopCancel = context.AfterFunc(ctx, s.abandon)
+	go s.keepAlive()
+	return s, nil
+}
+
+// responseStream is a call whose client sends one message: it is posted
+// when the client closes its side, and the messages the server sends are
+// read from the response as they come.
+type responseStream struct {
+	conn   *Conn
+	ctx    context.Context
+	method string
+
+	req  []byte
+	body io.ReadCloser
+	err  error
+}
+
+func (s *responseStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *responseStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *responseStream) Context() context.Context     { return s.ctx }
+
+func (s *responseStream) SendMsg(m any) error {
+	req, err := frame(m)
+	if err != nil {
+		return err
+	}
+	s.req = req
+	return nil
+}
+
+func (s *responseStream) CloseSend() error {
+	if s.body != nil || s.err != nil {
+		return nil
+	}
+	resp, err := s.conn.post(s.ctx, s.method, nil, s.req)
+	if err != nil {
+		s.err = err
+		return nil
+	}
+	s.body = resp.Body
+	return nil
+}
+
+func (s *responseStream) RecvMsg(m any) error {
+	s.CloseSend()
+	if s.err != nil {
+		return s.err
+	}
+	flag, data, err := readFrame(s.body)
+	switch {
+	case errors.Is(err, io.EOF):
+		s.err = status.Error(codes.Unavailable, "response ended without a status")
+	case err != nil && s.ctx.Err() != nil:
+		s.err = status.FromContextError(s.ctx.Err()).Err()
+	case err != nil:
+		s.err = status.Error(codes.Unavailable, err.Error())
+	case flag&flagTrailer != 0:
+		if s.err = parseTrailer(data); s.err == nil {
+			s.err = io.EOF
+		}
+	default:
+		return decode(data, m)
+	}
+	s.body.Close()
+	return s.err
+}
+
+// sessionStream is a call the client sends on, served by a session of the
+// gateway.
+type sessionStream struct {
+	conn   *Conn
+	ctx    context.Context
+	method string
+	id     string
+	// eager streams post each message at once rather than batching them.
+	eager      bool
+	stopCancel func() bool
+
+	mu sync.Mutex
+	// buf holds the frames not posted yet and flush is the timer that
+	// posts them.
+	buf   bytes.Buffer
+	flush *time.Timer
+	// sendErr is why posting failed, which ends the client's side.
+	sendErr error
+	closed  bool
+	// last is when the stream last posted anything.
+	last time.Time
+
+	// queue holds the messages received and not read yet, and end the
+	// status the stream ended with, io.EOF for OK.
+	queue [][]byte
+	end   error
+	// done is closed once the stream ended.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (s *sessionStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *sessionStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *sessionStream) Context() context.Context     { return s.ctx }
+
+// op posts op on the session with body and reads the response, handing
+// each message to msg.
+func (s *sessionStream) op(ctx context.Context, op string, body []byte, msg func([]byte)) (bool, error) {
+	resp, err := s.conn.post(ctx, s.method, url.Values{opParam: {op}, streamParam: {s.id}}, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if msg == nil {
+		msg = func([]byte) {}
+	}
+	return read(resp.Body, msg)
+}
+
+func (s *sessionStream) SendMsg(m any) error {
+	data, err := frame(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendErr != nil || s.closed {
+		return io.EOF
+	}
+	s.buf.Write(data)
+	if s.eager || s.buf.Len() >= sendBatchBytes {
+		return s.post()
+	}
+	if s.flush == nil {
+		s.flush = time.AfterFunc(sendDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.post()
+		})
+	}
+	return nil
+}
+
+// post posts the buffered frames. Once posting fails the client's side
+// ends; like on a gRPC stream, SendMsg then returns io.EOF and RecvMsg the
+// status. Callers must hold s.mu.
+func (s *sessionStream) post() error {
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+	if s.sendErr != nil {
+		return io.EOF
+	}
+	body := bytes.Clone(s.buf.Bytes())
+	s.buf.Reset()
+	s.last = time.Now()
+	if _, err := s.op(s.ctx, opSend, body, nil); err != nil {
+		s.sendErr = err
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *sessionStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.buf.Len() > 0 {
+		s.post()
+	}
+	if s.sendErr != nil {
+		return nil
+	}
+	s.last = time.Now()
+	if _, err := s.op(s.ctx, opClose, nil, nil); err != nil {
+		s.sendErr = err
+	}
+	return nil
+}
+
+func (s *sessionStream) RecvMsg(m any) error {
+	for {
+		if len(s.queue) > 0 {
+			data := s.queue[0]
+			s.queue = s.queue[1:]
+			return decode(data, m)
+		}
+		if s.end != nil {
+			return s.end
+		}
+		if err := s.ctx.Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		s.mu.Lock()
+		s.last = time.Now()
+		s.mu.Unlock()
+		ended, err := s.op(s.ctx, opRecv, nil, func(data []byte) { s.queue = append(s.queue, data) })
+		switch {
+		case ended && err == nil:
+			s.finish(io.EOF)
+		case ended:
+			s.finish(err)
+		case err != nil:
+			// The request failed rather than the call; the session is
+			// given up like a broken gRPC connection.
+			s.finish(err)
+			s.abandon()
+		}
+	}
+}
+
+// finish records that the stream ended with end.
+func (s *sessionStream) finish(end error) {
+	s.end = end
+	s.doneOnce.Do(func() {
+		close(s.done)
+		s.stopCancel()
+	})
+}
+
+// abandon tells the gateway to cancel the session, when the client's
+// context is cancelled before the stream ended or a request failed. The
+// gateway times out sessions it is not told about.
+func (s *sessionStream) abandon() {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(s.ctx), cancelTimeout)
+	defer cancel()
+	s.op(ctx, opCancel, nil, nil)
+}
+
+// keepAlive posts an empty send whenever the stream posted nothing for
+// keepAliveInterval, so that the gateway does not time out a session the
+// client is quiet on, such as the log upload of a job printing nothing.
+func (s *sessionStream) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if !s.closed && s.sendErr == nil && time.Since(s.last) >= keepAliveInterval {
+			s.post()
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,476 @@
+package agenthttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"open-cicd/internal/utils"
+)
+
+// sessionBuffer is the number of messages queued in each direction of a
+// session before the side sending them waits.
+const sessionBuffer = 16
+
+type gatewayKey struct{}
+
+// FromGateway reports whether ctx is that of a call served by a Gateway.
+func FromGateway(ctx context.Context) bool {
+	return ctx.Value(gatewayKey{}) != nil
+}
+
+// Gateway serves the methods of a gRPC service over HTTP. Calls run through
+// the same interceptors as on the gRPC server, with the request headers as
+// their incoming metadata and the TLS state of the connection as their
+// peer's, so that they authenticate the same way.
+type Gateway struct {
+	desc   *grpc.ServiceDesc
+	impl   any
+	unary  grpc.UnaryServerInterceptor
+	stream grpc.StreamServerInterceptor
+
+	mu       sync.Mutex
+	serving  bool
+	sessions map[string]*session
+}
+
+// NewGateway returns a gateway to impl, which implements the service desc
+// describes. It answers every call with UNAVAILABLE until it is started.
+func NewGateway(desc *grpc.ServiceDesc, impl any, unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor) *Gateway {
+	return &Gateway{desc: desc, impl: impl, unary: unary, stream: stream, sessions: make(map[string]*session)}
+}
+
+// Start makes the gateway serve calls.
+func (g *Gateway) Start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.serving = true
+}
+
+// Stop cancels the open streams and answers calls with UNAVAILABLE until
+// the gateway is started again. Clients are expected to retry, like those
+// of a gRPC server that went away.
+func (g *Gateway) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.serving = false
+	for id, s := range g.sessions {
+		s.cancel()
+		s.idle.Stop()
+		delete(g.sessions, id)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		utils.WriteError(w, http.StatusMethodNotAllowed, "agent protocol calls are POST requests")
+		return
+	}
+	fullMethod := strings.TrimPrefix(r.URL.Path, Prefix)
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	w.Header().Set("Content-Type", contentType)
+	g.mu.Lock()
+	serving := g.serving
+	g.mu.Unlock()
+	if !serving {
+		g.finish(w, status.Error(codes.Unavailable, "agent protocol is not served by this server"))
+		return
+	}
+	if service != g.desc.ServiceName {
+		g.finish(w, status.Errorf(codes.Unimplemented, "unknown service %s", service))
+		return
+	}
+	for _, md := range g.desc.Methods {
+		if md.MethodName == method {
+			g.serveUnary(w, r, md)
+			return
+		}
+	}
+	for _, sd := range g.desc.Streams {
+		if sd.StreamName != method {
+			continue
+		}
+		if sd.ClientStreams {
+			g.serveSession(w, r, fullMethod, sd)
+		} else {
+			g.serveServerStream(w, r, fullMethod, sd)
+		}
+		return
+	}
+	g.finish(w, status.Errorf(codes.Unimplemented, "unknown method %s", method))
+}
+
+// incoming returns the context of a call made by r, detached from r if
+// detach is set so that it outlives the request.
+func incoming(r *http.Request, detach bool) context.Context {
+	ctx := r.Context()
+	if detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md[strings.ToLower(k)] = v
+	}
+	ctx = metadata.NewIncomingContext(ctx, md)
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx = peer.NewContext(ctx, p)
+	return context.WithValue(ctx, gatewayKey{}, true)
+}
+
+// remoteAddr is the address of the client of a call, as a net.Addr.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// finish writes the trailer frame of a call that ended with err.
+func (g *Gateway) finish(w io.Writer, err error) {
+	if werr := writeFrame(w, flagTrailer, trailer(err)); werr != nil {
+		slog.Debug("writing agent protocol trailer", "error", werr)
+	}
+}
+
+// request reads the single message of a unary or server-streaming call.
+func request(r *http.Request) ([]byte, error) {
+	flag, data, err := readFrame(r.Body)
+	if errors.Is(err, io.EOF) {
+		return nil, status.Error(codes.InvalidArgument, "request carries no message")
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if flag != flagMessage {
+		return nil, status.Error(codes.InvalidArgument, "request carries no message")
+	}
+	return data, nil
+}
+
+// serveUnary serves a unary call. The method handler passes the interceptor
+// the same info as on the gRPC server.
+func (g *Gateway) serveUnary(w http.ResponseWriter, r *http.Request, md grpc.MethodDesc) {
+	data, err := request(r)
+	if err != nil {
+		g.finish(w, err)
+		return
+	}
+	dec := func(m any) error {
+		if err := proto.Unmarshal(data, m.(proto.Message)); err != nil {
+			return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+		}
+		return nil
+	}
+	resp, err := md.Handler(g.impl, incoming(r, false), dec, g.unary)
+	if err == nil {
+		var out []byte
+		if out, err = proto.Marshal(resp.(proto.Message)); err == nil {
+			err = writeFrame(w, flagMessage, out)
+		}
+	}
+	g.finish(w, err)
+}
+
+// run runs the handler of a stream through the stream interceptor.
+func (g *Gateway) run(fullMethod string, sd grpc.StreamDesc, ss grpc.ServerStream) error {
+	if g.stream == nil {
+		return sd.Handler(g.impl, ss)
+	}
+	info := &grpc.StreamServerInfo{FullMethod: fullMethod, IsClientStream: sd.ClientStreams, IsServerStream: sd.ServerStreams}
+	return g.stream(g.impl, ss, info, sd.Handler)
+}
+
+// serveServerStream serves a call whose client sends one message, writing
+// the messages the server sends as the response goes.
+func (g *Gateway) serveServerStream(w http.ResponseWriter, r *http.Request, fullMethod string, sd grpc.StreamDesc) {
+	data, err := request(r)
+	if err != nil {
+		g.finish(w, err)
+		return
+	}
+	clearWriteDeadline(w)
+	rc := http.NewResponseController(w)
+	ss := &serverStream{ctx: incoming(r, false)}
+	ss.recv = func() ([]byte, error) {
+		if data == nil {
+			return nil, io.EOF
+		}
+		d := data
+		data = nil
+		return d, nil
+	}
+	ss.send = func(b []byte) error {
+		if err := writeFrame(w, flagMessage, b); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	g.finish(w, g.run(fullMethod, sd, ss))
+}
+
+// session is a stream the client sends on, served over several requests.
+// Its handler runs on its own, reading what send requests queue in inbox
+// and queueing what it sends in outbox for receive requests.
+type session struct {
+	id string
+	// owner is the Authorization header of the request that opened the
+	// session; the requests that follow must carry the same.
+	owner  string
+	ctx    context.Context
+	cancel context.CancelFunc
+	inbox  chan []byte
+	outbox chan []byte
+	// closed is closed once the client is done sending.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// done is closed once the handler returned; err is what it returned.
+	done chan struct{}
+	err  error
+	// idle cancels the session once nobody touched it for idleTimeout.
+	idle *time.Timer
+}
+
+func (s *session) closeSend() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// serveSession serves the requests of a stream the client sends on. A
+// request without an op opens a session; the others name it.
+func (g *Gateway) serveSession(w http.ResponseWriter, r *http.Request, fullMethod string, sd grpc.StreamDesc) {
+	q := r.URL.Query()
+	op := q.Get(opParam)
+	if op == "" {
+		g.open(w, r, fullMethod, sd)
+		return
+	}
+	g.mu.Lock()
+	s, ok := g.sessions[q.Get(streamParam)]
+	g.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(s.owner), []byte(r.Header.Get("Authorization"))) != 1 {
+		g.finish(w, status.Error(codes.NotFound, "stream not found; it ended or timed out"))
+		return
+	}
+	s.idle.Reset(idleTimeout)
+	defer s.idle.Reset(idleTimeout)
+
+	switch op {
+	case opSend:
+		g.finish(w, s.receive(r))
+	case opRecv:
+		g.poll(w, r, s)
+	case opClose:
+		s.closeSend()
+		g.finish(w, nil)
+	case opCancel:
+		s.cancel()
+		g.remove(s)
+		g.finish(w, nil)
+	default:
+		g.finish(w, status.Errorf(codes.InvalidArgument, "unknown stream op %q", op))
+	}
+}
+
+// open starts the handler of a new session and returns its ID.
+func (g *Gateway) open(w http.ResponseWriter, r *http.Request, fullMethod string, sd grpc.StreamDesc) {
+	ctx, cancel := context.WithCancel(incoming(r, true))
+	s := &session{
+		id:     utils.NewSecret(16),
+		owner:  r.Header.Get("Authorization"),
+		ctx:    ctx,
+		cancel: cancel,
+		inbox:  make(chan []byte, sessionBuffer),
+		outbox: make(chan []byte, sessionBuffer),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.idle = time.AfterFunc(idleTimeout, func() {
+		slog.Warn("Agent protocol stream timed out", "method", fullMethod)
+		s.cancel()
+		g.remove(s)
+	})
+	g.mu.Lock()
+	if !g.serving {
+		g.mu.Unlock()
+		cancel()
+		s.idle.Stop()
+		g.finish(w, status.Error(codes.Unavailable, "agent protocol is not served by this server"))
+		return
+	}
+	g.sessions[s.id] = s
+	g.mu.Unlock()
+
+	ss := &serverStream{ctx: ctx}
+	ss.recv = func() ([]byte, error) {
+		// Messages queued before the client closed its side come first.
+		select {
+		case data := <-s.inbox:
+			return data, nil
+		default:
+		}
+		select {
+		case data := <-s.inbox:
+			return data, nil
+		case <-s.closed:
+			select {
+			case data := <-s.inbox:
+				return data, nil
+			default:
+				return nil, io.EOF
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ss.send = func(b []byte) error {
+		select {
+		case s.outbox <- b:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	go func() {
+		s.err = g.run(fullMethod, sd, ss)
+		close(s.done)
+	}()
+	w.Header().Set(streamHeader, s.id)
+	g.finish(w, nil)
+}
+
+// remove forgets s if it is still open.
+func (g *Gateway) remove(s *session) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sessions[s.id] == s {
+		delete(g.sessions, s.id)
+	}
+	s.idle.Stop()
+}
+
+// receive queues the messages in the body of r for the handler of s. Once
+// the handler returned, they are dropped: the client learns why from its
+// next receive.
+func (s *session) receive(r *http.Request) error {
+	for {
+		flag, data, err := readFrame(r.Body)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if flag != flagMessage {
+			return status.Error(codes.InvalidArgument, "unexpected trailer in request")
+		}
+		select {
+		case s.inbox <- data:
+		case <-s.done:
+			return nil
+		case <-r.Context().Done():
+			return status.FromContextError(r.Context().Err()).Err()
+		}
+	}
+}
+
+// poll writes what the handler of s sent, waiting up to pollWait for it to
+// send anything. Once the handler returned and everything it sent is
+// written, the response ends with its status and the session is removed.
+// Messages of a response the client never reads are lost, as they are
+// when a gRPC connection breaks.
+func (g *Gateway) poll(w http.ResponseWriter, r *http.Request, s *session) {
+	clearWriteDeadline(w)
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+	select {
+	case data := <-s.outbox:
+		if err := writeFrame(w, flagMessage, data); err != nil {
+			return
+		}
+	case <-s.done:
+	case <-timer.C:
+		return
+	case <-r.Context().Done():
+		return
+	}
+	for {
+		select {
+		case data := <-s.outbox:
+			if err := writeFrame(w, flagMessage, data); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case <-s.done:
+			// The handler may have sent more before returning.
+			if len(s.outbox) > 0 {
+				continue
+			}
+			g.remove(s)
+			g.finish(w, s.err)
+		default:
+		}
+		return
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for a response that
+// waits for the server to send.
+func clearWriteDeadline(w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("clearing write deadline", "for", "agent protocol call", "error", err)
+	}
+}
+
+// serverStream is the server side of a stream served by the gateway.
+type serverStream struct {
+	ctx  context.Context
+	recv func() ([]byte, error)
+	send func([]byte) error
+}
+
+func (s *serverStream) Context() context.Context     { return s.ctx }
+func (s *serverStream) SetHeader(metadata.MD) error  { return nil }
+func (s *serverStream) SendHeader(metadata.MD) error { return nil }
+func (s *serverStream) SetTrailer(metadata.MD)       {}
+
+func (s *serverStream) SendMsg(m any) error {
+	data, err := proto.Marshal(m.(proto.Message))
+	if err != nil {
+		return status.Errorf(codes.Internal, "encoding message: %v", err)
+	}
+	return s.send(data)
+}
+
+func (s *serverStream) RecvMsg(m any) error {
+	data, err := s.recv()
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(data, m.(proto.Message)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "decoding message: %v", err)
+	}
+	return nil
+}
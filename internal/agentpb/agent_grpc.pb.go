@@ -0,0 +1,497 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: agent.proto
+
+package agentpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AgentService_RegisterAgent_FullMethodName    = "/opencicd.agent.v1.AgentService/RegisterAgent"
+	AgentService_StreamJobs_FullMethodName       = "/opencicd.agent.v1.AgentService/StreamJobs"
+	AgentService_ReportStatus_FullMethodName     = "/opencicd.agent.v1.AgentService/ReportStatus"
+	AgentService_StreamLogs_FullMethodName       = "/opencicd.agent.v1.AgentService/StreamLogs"
+	AgentService_Heartbeat_FullMethodName        = "/opencicd.agent.v1.AgentService/Heartbeat"
+	AgentService_UploadSnapshot_FullMethodName   = "/opencicd.agent.v1.AgentService/UploadSnapshot"
+	AgentService_ListSnapshots_FullMethodName    = "/opencicd.agent.v1.AgentService/ListSnapshots"
+	AgentService_DownloadSnapshot_FullMethodName = "/opencicd.agent.v1.AgentService/DownloadSnapshot"
+	AgentService_RestoreCache_FullMethodName     = "/opencicd.agent.v1.AgentService/RestoreCache"
+	AgentService_SaveCache_FullMethodName        = "/opencicd.agent.v1.AgentService/SaveCache"
+)
+
+// AgentServiceClient is the client API for AgentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// AgentService is the persistent control channel between the control plane
+// and build agents. Agents register once over a unary call, then hold a
+// StreamJobs stream open for the lifetime of the process to receive work.
+type AgentServiceClient interface {
+	// RegisterAgent exchanges a registration token for an agent ID and a
+	// session credential. All other calls authenticate with the credential.
+	RegisterAgent(ctx context.Context, in *RegisterAgentRequest, opts ...grpc.CallOption) (*RegisterAgentResponse, error)
+	// StreamJobs is a bidirectional stream: the agent announces readiness and
+	// acknowledges assignments, the server pushes assignments and cancels.
+	StreamJobs(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, ServerMessage], error)
+	// ReportStatus records a job state change observed by the agent. Reports,
+	// log chunks and snapshot uploads carry the fencing token of the job's
+	// assignment and are refused once the agent no longer holds its lease.
+	ReportStatus(ctx context.Context, in *ReportStatusRequest, opts ...grpc.CallOption) (*ReportStatusResponse, error)
+	// StreamLogs uploads job output as it is produced.
+	StreamLogs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogChunk, StreamLogsResponse], error)
+	// Heartbeat tells the server the agent is alive and renews the leases on
+	// the jobs it runs. Agents call it every heartbeat interval; one that
+	// stays silent for longer than the server's timeout is marked offline,
+	// and jobs whose leases run out are re-queued.
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
+	// UploadSnapshot stores the archive of a job's outputs once the job has
+	// succeeded and before it is reported so. The first chunk names the job.
+	UploadSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SnapshotChunk, UploadSnapshotResponse], error)
+	// ListSnapshots returns the snapshots a job restores into its workspace
+	// before it starts: those of the succeeded jobs of the stages its stage
+	// needs, in the order they are to be extracted.
+	ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error)
+	// DownloadSnapshot streams the archive of one of the snapshots listed for
+	// a job.
+	DownloadSnapshot(ctx context.Context, in *DownloadSnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error)
+	// RestoreCache streams the archive of one of the caches a job mounts, or
+	// fails with NOT_FOUND if the project has not saved it yet.
+	RestoreCache(ctx context.Context, in *RestoreCacheRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[CacheChunk], error)
+	// SaveCache stores the archive of one of the caches a job mounts once the
+	// job has succeeded. The first chunk names the job and the cache.
+	SaveCache(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[CacheChunk, SaveCacheResponse], error)
+}
+
+type agentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAgentServiceClient(cc grpc.ClientConnInterface) AgentServiceClient {
+	return &agentServiceClient{cc}
+}
+
+func (c *agentServiceClient) RegisterAgent(ctx context.Context, in *RegisterAgentRequest, opts ...grpc.CallOption) (*RegisterAgentResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterAgentResponse)
+	err := c.cc.Invoke(ctx, AgentService_RegisterAgent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) StreamJobs(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, ServerMessage], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[0], AgentService_StreamJobs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AgentMessage, ServerMessage]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_StreamJobsClient = grpc.BidiStreamingClient[AgentMessage, ServerMessage]
+
+func (c *agentServiceClient) ReportStatus(ctx context.Context, in *ReportStatusRequest, opts ...grpc.CallOption) (*ReportStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReportStatusResponse)
+	err := c.cc.Invoke(ctx, AgentService_ReportStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) StreamLogs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogChunk, StreamLogsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[1], AgentService_StreamLogs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LogChunk, StreamLogsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_StreamLogsClient = grpc.ClientStreamingClient[LogChunk, StreamLogsResponse]
+
+func (c *agentServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, AgentService_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) UploadSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SnapshotChunk, UploadSnapshotResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[2], AgentService_UploadSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SnapshotChunk, UploadSnapshotResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_UploadSnapshotClient = grpc.ClientStreamingClient[SnapshotChunk, UploadSnapshotResponse]
+
+func (c *agentServiceClient) ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSnapshotsResponse)
+	err := c.cc.Invoke(ctx, AgentService_ListSnapshots_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) DownloadSnapshot(ctx context.Context, in *DownloadSnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[3], AgentService_DownloadSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadSnapshotRequest, SnapshotChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_DownloadSnapshotClient = grpc.ServerStreamingClient[SnapshotChunk]
+
+func (c *agentServiceClient) RestoreCache(ctx context.Context, in *RestoreCacheRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[CacheChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[4], AgentService_RestoreCache_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RestoreCacheRequest, CacheChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_RestoreCacheClient = grpc.ServerStreamingClient[CacheChunk]
+
+func (c *agentServiceClient) SaveCache(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[CacheChunk, SaveCacheResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[5], AgentService_SaveCache_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[CacheChunk, SaveCacheResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_SaveCacheClient = grpc.ClientStreamingClient[CacheChunk, SaveCacheResponse]
+
+// AgentServiceServer is the server API for AgentService service.
+// All implementations must embed UnimplementedAgentServiceServer
+// for forward compatibility.
+//
+// AgentService is the persistent control channel between the control plane
+// and build agents. Agents register once over a unary call, then hold a
+// StreamJobs stream open for the lifetime of the process to receive work.
+type AgentServiceServer interface {
+	// RegisterAgent exchanges a registration token for an agent ID and a
+	// session credential. All other calls authenticate with the credential.
+	RegisterAgent(context.Context, *RegisterAgentRequest) (*RegisterAgentResponse, error)
+	// StreamJobs is a bidirectional stream: the agent announces readiness and
+	// acknowledges assignments, the server pushes assignments and cancels.
+	StreamJobs(grpc.BidiStreamingServer[AgentMessage, ServerMessage]) error
+	// ReportStatus records a job state change observed by the agent. Reports,
+	// log chunks and snapshot uploads carry the fencing token of the job's
+	// assignment and are refused once the agent no longer holds its lease.
+	ReportStatus(context.Context, *ReportStatusRequest) (*ReportStatusResponse, error)
+	// StreamLogs uploads job output as it is produced.
+	StreamLogs(grpc.ClientStreamingServer[LogChunk, StreamLogsResponse]) error
+	// Heartbeat tells the server the agent is alive and renews the leases on
+	// the jobs it runs. Agents call it every heartbeat interval; one that
+	// stays silent for longer than the server's timeout is marked offline,
+	// and jobs whose leases run out are re-queued.
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
+	// UploadSnapshot stores the archive of a job's outputs once the job has
+	// succeeded and before it is reported so. The first chunk names the job.
+	UploadSnapshot(grpc.ClientStreamingServer[SnapshotChunk, UploadSnapshotResponse]) error
+	// ListSnapshots returns the snapshots a job restores into its workspace
+	// before it starts: those of the succeeded jobs of the stages its stage
+	// needs, in the order they are to be extracted.
+	ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error)
+	// DownloadSnapshot streams the archive of one of the snapshots listed for
+	// a job.
+	DownloadSnapshot(*DownloadSnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error
+	// RestoreCache streams the archive of one of the caches a job mounts, or
+	// fails with NOT_FOUND if the project has not saved it yet.
+	RestoreCache(*RestoreCacheRequest, grpc.ServerStreamingServer[CacheChunk]) error
+	// SaveCache stores the archive of one of the caches a job mounts once the
+	// job has succeeded. The first chunk names the job and the cache.
+	SaveCache(grpc.ClientStreamingServer[CacheChunk, SaveCacheResponse]) error
+	mustEmbedUnimplementedAgentServiceServer()
+}
+
+// UnimplementedAgentServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAgentServiceServer struct{}
+
+func (UnimplementedAgentServiceServer) RegisterAgent(context.Context, *RegisterAgentRequest) (*RegisterAgentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterAgent not implemented")
+}
+func (UnimplementedAgentServiceServer) StreamJobs(grpc.BidiStreamingServer[AgentMessage, ServerMessage]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamJobs not implemented")
+}
+func (UnimplementedAgentServiceServer) ReportStatus(context.Context, *ReportStatusRequest) (*ReportStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportStatus not implemented")
+}
+func (UnimplementedAgentServiceServer) StreamLogs(grpc.ClientStreamingServer[LogChunk, StreamLogsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamLogs not implemented")
+}
+func (UnimplementedAgentServiceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedAgentServiceServer) UploadSnapshot(grpc.ClientStreamingServer[SnapshotChunk, UploadSnapshotResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method UploadSnapshot not implemented")
+}
+func (UnimplementedAgentServiceServer) ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSnapshots not implemented")
+}
+func (UnimplementedAgentServiceServer) DownloadSnapshot(*DownloadSnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadSnapshot not implemented")
+}
+func (UnimplementedAgentServiceServer) RestoreCache(*RestoreCacheRequest, grpc.ServerStreamingServer[CacheChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method RestoreCache not implemented")
+}
+func (UnimplementedAgentServiceServer) SaveCache(grpc.ClientStreamingServer[CacheChunk, SaveCacheResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method SaveCache not implemented")
+}
+func (UnimplementedAgentServiceServer) mustEmbedUnimplementedAgentServiceServer() {}
+func (UnimplementedAgentServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeAgentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AgentServiceServer will
+// result in compilation errors.
+type UnsafeAgentServiceServer interface {
+	mustEmbedUnimplementedAgentServiceServer()
+}
+
+func RegisterAgentServiceServer(s grpc.ServiceRegistrar, srv AgentServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAgentServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AgentService_ServiceDesc, srv)
+}
+
+func _AgentService_RegisterAgent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterAgentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).RegisterAgent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_RegisterAgent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).RegisterAgent(ctx, req.(*RegisterAgentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_StreamJobs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServiceServer).StreamJobs(&grpc.GenericServerStream[AgentMessage, ServerMessage]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_StreamJobsServer = grpc.BidiStreamingServer[AgentMessage, ServerMessage]
+
+func _AgentService_ReportStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).ReportStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_ReportStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).ReportStatus(ctx, req.(*ReportStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_StreamLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServiceServer).StreamLogs(&grpc.GenericServerStream[LogChunk, StreamLogsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_StreamLogsServer = grpc.ClientStreamingServer[LogChunk, StreamLogsResponse]
+
+func _AgentService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_UploadSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServiceServer).UploadSnapshot(&grpc.GenericServerStream[SnapshotChunk, UploadSnapshotResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_UploadSnapshotServer = grpc.ClientStreamingServer[SnapshotChunk, UploadSnapshotResponse]
+
+func _AgentService_ListSnapshots_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSnapshotsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).ListSnapshots(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_ListSnapshots_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).ListSnapshots(ctx, req.(*ListSnapshotsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_DownloadSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadSnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).DownloadSnapshot(m, &grpc.GenericServerStream[DownloadSnapshotRequest, SnapshotChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_DownloadSnapshotServer = grpc.ServerStreamingServer[SnapshotChunk]
+
+func _AgentService_RestoreCache_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RestoreCacheRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).RestoreCache(m, &grpc.GenericServerStream[RestoreCacheRequest, CacheChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_RestoreCacheServer = grpc.ServerStreamingServer[CacheChunk]
+
+func _AgentService_SaveCache_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServiceServer).SaveCache(&grpc.GenericServerStream[CacheChunk, SaveCacheResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AgentService_SaveCacheServer = grpc.ClientStreamingServer[CacheChunk, SaveCacheResponse]
+
+// AgentService_ServiceDesc is the grpc.ServiceDesc for AgentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AgentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opencicd.agent.v1.AgentService",
+	HandlerType: (*AgentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterAgent",
+			Handler:    _AgentService_RegisterAgent_Handler,
+		},
+		{
+			MethodName: "ReportStatus",
+			Handler:    _AgentService_ReportStatus_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _AgentService_Heartbeat_Handler,
+		},
+		{
+			MethodName: "ListSnapshots",
+			Handler:    _AgentService_ListSnapshots_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamJobs",
+			Handler:       _AgentService_StreamJobs_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "StreamLogs",
+			Handler:       _AgentService_StreamLogs_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "UploadSnapshot",
+			Handler:       _AgentService_UploadSnapshot_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "DownloadSnapshot",
+			Handler:       _AgentService_DownloadSnapshot_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "RestoreCache",
+			Handler:       _AgentService_RestoreCache_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SaveCache",
+			Handler:       _AgentService_SaveCache_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "agent.proto",
+}
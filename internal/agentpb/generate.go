@@ -0,0 +1,5 @@
+// Package agentpb contains the gRPC protocol spoken between the control plane
+// and build agents. The Go code is generated from agent.proto.
+package agentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
@@ -0,0 +1,70 @@
+// Package annotations keeps the warnings, errors and markdown summaries the
+// steps of a pipeline run publish while their jobs run, such as the
+// findings of a linter on lines of the repository, so that they show up
+// with the run instead of only in the logs.
+package annotations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrTooMany is returned when publishing annotations would leave a job with
+// more than types.MaxAnnotationsPerJob.
+var ErrTooMany = fmt.Errorf("a job may publish at most %d annotations", types.MaxAnnotationsPerJob)
+
+// Service stores and lists annotations.
+type Service struct {
+	store storage.AnnotationStore
+	now   func() time.Time
+}
+
+// NewService returns a Service that keeps annotations in store.
+func NewService(store storage.AnnotationStore) *Service {
+	return &Service{store: store, now: time.Now}
+}
+
+// Publish adds annotations to job and returns them as stored.
+func (s *Service) Publish(ctx context.Context, job *types.Job, annotations []types.NewAnnotation) ([]*types.Annotation, error) {
+	n, err := s.store.CountAnnotations(ctx, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("counting annotations: %w", err)
+	}
+	if n+len(annotations) > types.MaxAnnotationsPerJob {
+		return nil, ErrTooMany
+	}
+	now := s.now()
+	stored := make([]*types.Annotation, len(annotations))
+	for i, a := range annotations {
+		stored[i] = &types.Annotation{
+			JobID:      job.ID,
+			JobName:    job.Name,
+			PipelineID: job.PipelineID,
+			Project:    job.Repository,
+			Level:      a.Level,
+			Title:      a.Title,
+			Message:    a.Message,
+			Path:       a.Path,
+			StartLine:  a.StartLine,
+			EndLine:    a.EndLine,
+			CreatedAt:  now,
+		}
+	}
+	if err := s.store.AddAnnotations(ctx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// List returns the annotations of the jobs with the given IDs, in the order
+// they were published.
+func (s *Service) List(ctx context.Context, jobIDs ...string) ([]*types.Annotation, error) {
+	if len(jobIDs) == 0 {
+		return []*types.Annotation{}, nil
+	}
+	return s.store.ListAnnotations(ctx, jobIDs)
+}
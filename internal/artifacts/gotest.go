@@ -0,0 +1,167 @@
+package artifacts
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// goTestEvent is a line of go test -json output.
+type goTestEvent struct {
+	Action  string  `json:"Action"`
+	Package string  `json:"Package"`
+	Test    string  `json:"Test"`
+	Elapsed float64 `json:"Elapsed"`
+	Output  string  `json:"Output"`
+}
+
+// goTestPackage collects the events of one package.
+type goTestPackage struct {
+	suite types.TestSuite
+	// index maps test names to their case in suite.Cases.
+	index map[string]int
+	// output holds what each test printed, and the package itself under "".
+	output map[string]*strings.Builder
+	failed bool
+}
+
+// parseGoTest reads the output of go test -json. Lines that are not JSON,
+// such as build errors printed by older Go versions, are skipped.
+func parseGoTest(r io.Reader) ([]types.TestSuite, error) {
+	var order []string
+	packages := make(map[string]*goTestPackage)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	events := 0
+	for scanner.Scan() {
+		var e goTestEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Action == "" {
+			continue
+		}
+		events++
+		p, ok := packages[e.Package]
+		if !ok {
+			p = &goTestPackage{
+				suite:  types.TestSuite{Name: e.Package},
+				index:  make(map[string]int),
+				output: make(map[string]*strings.Builder),
+			}
+			packages[e.Package] = p
+			order = append(order, e.Package)
+		}
+		p.add(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if events == 0 {
+		return nil, errors.New("no go test -json events")
+	}
+
+	suites := make([]types.TestSuite, 0, len(order))
+	for _, name := range order {
+		suites = append(suites, packages[name].finish())
+	}
+	return suites, nil
+}
+
+func (p *goTestPackage) add(e goTestEvent) {
+	if e.Action == "output" {
+		b, ok := p.output[e.Test]
+		if !ok {
+			b = &strings.Builder{}
+			p.output[e.Test] = b
+		}
+		b.WriteString(e.Output)
+		return
+	}
+	if e.Test == "" {
+		switch e.Action {
+		case "pass", "fail", "skip":
+			p.suite.Summary.Duration = seconds(e.Elapsed)
+			p.failed = e.Action == "fail"
+		}
+		return
+	}
+	i, ok := p.index[e.Test]
+	if !ok {
+		i = len(p.suite.Cases)
+		p.index[e.Test] = i
+		// A test that never reports an outcome crashed or timed out.
+		p.suite.Cases = append(p.suite.Cases, types.TestCase{
+			Name: e.Test, Classname: e.Package, Status: types.TestFailed, Message: "test did not finish",
+		})
+	}
+	c := &p.suite.Cases[i]
+	switch e.Action {
+	case "pass":
+		c.Status, c.Message = types.TestPassed, ""
+	case "fail":
+		c.Status, c.Message = types.TestFailed, ""
+	case "skip":
+		c.Status, c.Message = types.TestSkipped, ""
+	default:
+		return
+	}
+	c.Duration = seconds(e.Elapsed)
+}
+
+// finish fills in the output of failed and skipped tests and returns the
+// package's suite. A package that failed without a failing test, such as
+// one that did not build, is reported as a failed case of its own.
+func (p *goTestPackage) finish() types.TestSuite {
+	anyFailed := false
+	for i := range p.suite.Cases {
+		c := &p.suite.Cases[i]
+		if c.Status == types.TestPassed {
+			continue
+		}
+		anyFailed = anyFailed || c.Status == types.TestFailed
+		var out string
+		if b, ok := p.output[c.Name]; ok {
+			out = b.String()
+		}
+		if c.Message == "" {
+			c.Message = goTestMessage(out)
+		}
+		if c.Status == types.TestFailed {
+			c.Output = tail(out)
+		}
+	}
+	if p.failed && !anyFailed {
+		var out string
+		if b, ok := p.output[""]; ok {
+			out = b.String()
+		}
+		p.suite.Cases = append(p.suite.Cases, types.TestCase{
+			Name: p.suite.Name, Classname: p.suite.Name, Status: types.TestFailed,
+			Message: goTestMessage(out), Output: tail(out),
+		})
+	}
+	p.suite.Summarize()
+	return p.suite
+}
+
+// goTestMessage returns what a test printed, without the lines go test
+// adds around it.
+func goTestMessage(output string) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "=== ") || strings.HasPrefix(trimmed, "--- ") ||
+			trimmed == "FAIL" || trimmed == "PASS" || strings.HasPrefix(trimmed, "FAIL\t") || strings.HasPrefix(trimmed, "ok  \t") {
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+	return tail(strings.Join(lines, "\n"))
+}
+
+func seconds(s float64) types.Duration {
+	return types.Duration(time.Duration(s * float64(time.Second)))
+}
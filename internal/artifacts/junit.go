@@ -0,0 +1,136 @@
+package artifacts
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// junitSuite is a <testsuite> element. Suites may nest, as some runners
+// group them by package.
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Time   string       `xml:"time,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+// junitCase is a <testcase> element. A case without a failure, error or
+// skipped child passed.
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure"`
+	Error     *junitProblem `xml:"error"`
+	Skipped   *junitProblem `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+	SystemErr string        `xml:"system-err"`
+}
+
+// junitProblem is a <failure>, <error> or <skipped> element.
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnit reads a JUnit XML report whose root is either <testsuites> or
+// a single <testsuite>.
+func parseJUnit(r io.Reader) ([]types.TestSuite, error) {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no testsuites or testsuite element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var root junitSuite
+		switch start.Name.Local {
+		case "testsuites", "testsuite":
+			if err := dec.DecodeElement(&root, &start); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected root element <%s>, expected testsuites or testsuite", start.Name.Local)
+		}
+		var suites []types.TestSuite
+		if start.Name.Local == "testsuite" {
+			suites = flattenJUnit(root, nil)
+		} else {
+			for _, s := range root.Suites {
+				suites = flattenJUnit(s, suites)
+			}
+		}
+		return suites, nil
+	}
+}
+
+// flattenJUnit appends suite and the suites nested in it to suites. Suites
+// without cases of their own only group others and are left out.
+func flattenJUnit(suite junitSuite, suites []types.TestSuite) []types.TestSuite {
+	if len(suite.Cases) > 0 {
+		s := types.TestSuite{Name: suite.Name, Summary: types.TestSummary{Duration: junitTime(suite.Time)}}
+		for _, c := range suite.Cases {
+			s.Cases = append(s.Cases, junitResult(c))
+		}
+		s.Summarize()
+		suites = append(suites, s)
+	}
+	for _, nested := range suite.Suites {
+		suites = flattenJUnit(nested, suites)
+	}
+	return suites
+}
+
+func junitResult(c junitCase) types.TestCase {
+	tc := types.TestCase{Name: c.Name, Classname: c.Classname, Status: types.TestPassed, Duration: junitTime(c.Time)}
+	switch {
+	case c.Failure != nil:
+		tc.Status, tc.Message = types.TestFailed, c.Failure.describe()
+	case c.Error != nil:
+		tc.Status, tc.Message = types.TestFailed, c.Error.describe()
+	case c.Skipped != nil:
+		tc.Status, tc.Message = types.TestSkipped, c.Skipped.describe()
+	}
+	if tc.Status == types.TestFailed {
+		tc.Output = tail(strings.TrimSpace(c.SystemOut + "\n" + c.SystemErr))
+	}
+	return tc
+}
+
+// describe returns the message of a failure, error or skip, followed by its
+// details such as a stack trace.
+func (p *junitProblem) describe() string {
+	parts := make([]string, 0, 2)
+	for _, s := range []string{p.Message, strings.TrimSpace(p.Text)} {
+		if s != "" && (len(parts) == 0 || parts[0] != s) {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return p.Type
+	}
+	return tail(strings.Join(parts, "\n"))
+}
+
+// junitTime parses a time attribute in seconds. Some runners write
+// thousands separators; unreadable times count as zero.
+func junitTime(s string) types.Duration {
+	seconds, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return types.Duration(time.Duration(seconds * float64(time.Second)))
+}
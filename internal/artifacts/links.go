@@ -0,0 +1,80 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// minSigningKeyBytes is the shortest signing key accepted.
+const minSigningKeyBytes = 32
+
+var (
+	// ErrLinkExpired is returned for a signed link past its expiry.
+	ErrLinkExpired = errors.New("link expired")
+	// ErrInvalidSignature is returned for a signed link whose signature does
+	// not match its job, path and expiry.
+	ErrInvalidSignature = errors.New("invalid link signature")
+)
+
+// Signer signs and checks links to artifacts that anyone holding them may
+// download until they expire, without an API token. A link names the job,
+// the path and the expiry, and carries an HMAC-SHA256 of them; it cannot
+// be revoked except by rotating the key, which revokes every link.
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewSigner returns a Signer using key.
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key, now: time.Now}
+}
+
+// ParseSigningKey decodes a base64 signing key of at least 32 bytes.
+func ParseSigningKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signing key: %w", err)
+	}
+	if len(key) < minSigningKeyBytes {
+		return nil, fmt.Errorf("signing key must be at least %d bytes, got %d", minSigningKeyBytes, len(key))
+	}
+	return key, nil
+}
+
+// Sign returns the signature of a link to the artifact at path of job that
+// lasts until expires.
+func (s *Signer) Sign(jobID, path string, expires time.Time) string {
+	return hex.EncodeToString(s.mac(jobID, path, expires.Unix()))
+}
+
+// Verify checks the signature of a link to the artifact at path of job
+// that lasts until expires, a Unix time as Sign's links carry it. It
+// returns ErrLinkExpired or ErrInvalidSignature for links that do not
+// grant access.
+func (s *Signer) Verify(jobID, path, expires, signature string) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, s.mac(jobID, path, unix)) {
+		return ErrInvalidSignature
+	}
+	if !s.now().Before(time.Unix(unix, 0)) {
+		return ErrLinkExpired
+	}
+	return nil
+}
+
+func (s *Signer) mac(jobID, path string, expires int64) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(jobID + "\n" + path + "\n" + strconv.FormatInt(expires, 10)))
+	return h.Sum(nil)
+}
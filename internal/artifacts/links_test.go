@@ -0,0 +1,71 @@
+package artifacts
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignerVerify(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	s := NewSigner(bytes.Repeat([]byte{1}, minSigningKeyBytes))
+	s.now = func() time.Time { return now }
+	other := NewSigner(bytes.Repeat([]byte{2}, minSigningKeyBytes))
+
+	expires := now.Add(time.Hour)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	sig := s.Sign("j1", "dist/app.tar.gz", expires)
+	past := now.Add(-time.Second)
+	tests := []struct {
+		name      string
+		job, path string
+		expires   string
+		signature string
+		wantErr   error
+	}{
+		{"valid", "j1", "dist/app.tar.gz", unix, sig, nil},
+		{"other job", "j2", "dist/app.tar.gz", unix, sig, ErrInvalidSignature},
+		{"other path", "j1", "dist/secret.key", unix, sig, ErrInvalidSignature},
+		{"extended expiry", "j1", "dist/app.tar.gz", strconv.FormatInt(expires.Add(time.Hour).Unix(), 10), sig, ErrInvalidSignature},
+		{"expiry not a number", "j1", "dist/app.tar.gz", "soon", sig, ErrInvalidSignature},
+		{"signature not hex", "j1", "dist/app.tar.gz", unix, "zz", ErrInvalidSignature},
+		{"signed with another key", "j1", "dist/app.tar.gz", unix, other.Sign("j1", "dist/app.tar.gz", expires), ErrInvalidSignature},
+		{"expired", "j1", "dist/app.tar.gz", strconv.FormatInt(past.Unix(), 10), s.Sign("j1", "dist/app.tar.gz", past), ErrLinkExpired},
+		{"expires now", "j1", "dist/app.tar.gz", strconv.FormatInt(now.Unix(), 10), s.Sign("j1", "dist/app.tar.gz", now), ErrLinkExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Verify(tt.job, tt.path, tt.expires, tt.signature)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Verify = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		valid bool
+	}{
+		{"32 bytes", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)), true},
+		{"64 bytes", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 64)), true},
+		{"too short", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 31)), false},
+		{"not base64", "not base64!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSigningKey(tt.in)
+			if tt.valid != (err == nil) {
+				t.Errorf("ParseSigningKey error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/types"
+)
+
+// maxReportBytes caps the size of a test report that is parsed. Larger
+// artifacts are stored but not indexed.
+const maxReportBytes = 64 << 20
+
+// maxOutputBytes is how much of a failure message or test output is kept.
+const maxOutputBytes = 4 << 10
+
+// ErrInvalidReport is returned by Upload when a test report artifact cannot
+// be parsed.
+var ErrInvalidReport = errors.New("invalid test report")
+
+// parseReport reads the contents of artifact as a test report of format.
+// Errors in the report itself wrap ErrInvalidReport.
+func (s *Service) parseReport(ctx context.Context, artifact *types.Artifact, format types.TestReportFormat) ([]types.TestSuite, error) {
+	if artifact.Size > maxReportBytes {
+		return nil, fmt.Errorf("%w: larger than %d MiB", ErrInvalidReport, maxReportBytes>>20)
+	}
+	contents, err := s.blobs.Open(ctx, blobKey(artifact.JobID, artifact.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+
+	var suites []types.TestSuite
+	switch format {
+	case types.TestReportJUnit:
+		suites, err = parseJUnit(contents)
+	case types.TestReportGoTest:
+		suites, err = parseGoTest(contents)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	return suites, nil
+}
+
+// newTestReport returns the report parsed from an artifact of job.
+func newTestReport(job *types.Job, artifact *types.Artifact, suites []types.TestSuite) *types.TestReport {
+	report := &types.TestReport{
+		JobID:      job.ID,
+		Path:       artifact.Path,
+		Project:    job.Repository,
+		PipelineID: job.PipelineID,
+		Ref:        job.Ref,
+		Format:     artifact.Report,
+		Suites:     suites,
+		CreatedAt:  artifact.CreatedAt,
+	}
+	if report.Suites == nil {
+		report.Suites = []types.TestSuite{}
+	}
+	for _, suite := range suites {
+		report.Summary.Add(suite.Summary)
+	}
+	return report
+}
+
+// Tests returns the results of every test report uploaded by a job. With
+// failedOnly, only the cases that failed are listed; the summaries still
+// count all of them.
+func (s *Service) Tests(ctx context.Context, jobID string, failedOnly bool) (*types.JobTests, error) {
+	reports, err := s.store.ListTestReports(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	tests := &types.JobTests{JobID: jobID, Reports: reports}
+	for _, report := range reports {
+		tests.Summary.Add(report.Summary)
+		if failedOnly {
+			report.FailedOnly()
+		}
+	}
+	return tests, nil
+}
+
+// tail returns the last maxOutputBytes of s, where the cause of a failure
+// usually is.
+func tail(s string) string {
+	if len(s) <= maxOutputBytes {
+		return s
+	}
+	s = s[len(s)-maxOutputBytes:]
+	// Do not start in the middle of a UTF-8 sequence.
+	for i := 0; i < len(s) && i < 4; i++ {
+		if s[i]&0xC0 != 0x80 {
+			return "…" + s[i:]
+		}
+	}
+	return "…" + s
+}
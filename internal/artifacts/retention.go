@@ -0,0 +1,58 @@
+package artifacts
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wildcardProject is the Retention key used for projects without their own
+// entry.
+const wildcardProject = "*"
+
+// Retention maps projects (owner/name) to how long their artifacts are kept.
+// Projects without an entry, and no wildcard, keep artifacts forever.
+type Retention map[string]time.Duration
+
+// NewRetention returns the retention of projects given as durations by
+// project, such as 30d. Durations use Go syntax plus a "d" suffix for days.
+// The project "*" sets the retention of unlisted projects.
+func NewRetention(durations map[string]string) (Retention, error) {
+	retention := make(Retention, len(durations))
+	for _, project := range slices.Sorted(maps.Keys(durations)) {
+		d, err := parseRetentionDuration(durations[project])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention for %s: %w", project, err)
+		}
+		retention[strings.ToLower(project)] = d
+	}
+	return retention, nil
+}
+
+func parseRetentionDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("%q is not a positive number of days", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", v)
+	}
+	return d, nil
+}
+
+// Lookup returns how long the project's artifacts are kept, falling back to
+// the wildcard entry.
+func (r Retention) Lookup(project string) (time.Duration, bool) {
+	if d, ok := r[strings.ToLower(project)]; ok {
+		return d, true
+	}
+	d, ok := r[wildcardProject]
+	return d, ok
+}
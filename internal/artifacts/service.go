@@ -0,0 +1,198 @@
+// Package artifacts stores the files agents upload as job outputs. Metadata
+// is kept in the control plane store and contents in a blob store.
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/blobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// reapInterval is how often expired artifacts are deleted.
+const reapInterval = time.Hour
+
+// reapBatch is how many expired artifacts are deleted per store query.
+const reapBatch = 100
+
+// Service uploads, serves and expires artifacts.
+type Service struct {
+	store     storage.ArtifactStore
+	blobs     blobs.Store
+	retention Retention
+	now       func() time.Time
+}
+
+// NewService returns a Service that records artifacts in store, keeps their
+// contents in blobStore and expires them according to retention.
+func NewService(store storage.ArtifactStore, blobStore blobs.Store, retention Retention) *Service {
+	return &Service{store: store, blobs: blobStore, retention: retention, now: time.Now}
+}
+
+func blobKey(jobID, path string) string {
+	return jobID + "/" + path
+}
+
+// Upload stores the contents of r as the artifact at path of job, replacing
+// any earlier upload to the same path. If report names a test report format
+// the contents are parsed into the job's test results; when they cannot be,
+// the artifact is still stored and returned with an error wrapping
+// ErrInvalidReport.
+func (s *Service) Upload(ctx context.Context, job *types.Job, path, contentType string, report types.TestReportFormat, r io.Reader) (*types.Artifact, error) {
+	if err := types.ValidateArtifactPath(path); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, hash)}
+	key := blobKey(job.ID, path)
+	if err := s.blobs.Put(ctx, key, counter); err != nil {
+		return nil, fmt.Errorf("storing artifact contents: %w", err)
+	}
+
+	now := s.now()
+	artifact := &types.Artifact{
+		JobID:       job.ID,
+		Path:        path,
+		Project:     job.Repository,
+		Size:        counter.n,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		ContentType: contentType,
+		CreatedAt:   now,
+	}
+	if keep, ok := s.retention.Lookup(job.Repository); ok {
+		expires := now.Add(keep)
+		artifact.ExpiresAt = &expires
+	}
+	var (
+		suites    []types.TestSuite
+		reportErr error
+	)
+	if report != "" {
+		suites, reportErr = s.parseReport(ctx, artifact, report)
+		if reportErr == nil {
+			artifact.Report = report
+		} else if !errors.Is(reportErr, ErrInvalidReport) {
+			s.discard(ctx, key)
+			return nil, fmt.Errorf("reading test report: %w", reportErr)
+		}
+	}
+	if err := s.store.PutArtifact(ctx, artifact); err != nil {
+		s.discard(ctx, key)
+		return nil, fmt.Errorf("recording artifact: %w", err)
+	}
+	if reportErr != nil {
+		return artifact, reportErr
+	}
+	if artifact.Report != "" {
+		if err := s.store.PutTestReport(ctx, newTestReport(job, artifact, suites)); err != nil {
+			return artifact, fmt.Errorf("recording test report: %w", err)
+		}
+	}
+	return artifact, nil
+}
+
+// discard deletes the contents of an artifact that could not be recorded.
+func (s *Service) discard(ctx context.Context, key string) {
+	if err := s.blobs.Delete(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "removing contents of unrecorded artifact", "key", key, "error", err)
+	}
+}
+
+// Open returns an artifact and its contents. The caller closes the reader.
+func (s *Service) Open(ctx context.Context, jobID, path string) (*types.Artifact, io.ReadSeekCloser, error) {
+	artifact, err := s.store.GetArtifact(ctx, jobID, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := s.blobs.Open(ctx, blobKey(jobID, path))
+	if errors.Is(err, blobs.ErrNotFound) {
+		return nil, nil, fmt.Errorf("contents of artifact %s are missing: %w", blobKey(jobID, path), storage.ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return artifact, contents, nil
+}
+
+// Get returns the artifact at path of a job, without its contents.
+func (s *Service) Get(ctx context.Context, jobID, path string) (*types.Artifact, error) {
+	return s.store.GetArtifact(ctx, jobID, path)
+}
+
+// List returns the artifacts of a job ordered by path.
+func (s *Service) List(ctx context.Context, jobID string) ([]*types.Artifact, error) {
+	return s.store.ListArtifacts(ctx, jobID)
+}
+
+// Run deletes expired artifacts on start and then every reapInterval until
+// ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		n, err := s.reap(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "deleting expired artifacts", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Deleted expired artifacts", "artifacts", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap deletes every artifact that has expired.
+func (s *Service) reap(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		expired, err := s.store.ListExpiredArtifacts(ctx, s.now(), reapBatch)
+		if err != nil {
+			return deleted, err
+		}
+		for _, a := range expired {
+			if err := s.Delete(ctx, a); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(expired) < reapBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// Delete deletes an artifact, contents first so that a failure leaves the
+// record to retry.
+func (s *Service) Delete(ctx context.Context, a *types.Artifact) error {
+	if err := s.blobs.Delete(ctx, blobKey(a.JobID, a.Path)); err != nil {
+		return fmt.Errorf("deleting contents of %s: %w", blobKey(a.JobID, a.Path), err)
+	}
+	if err := s.store.DeleteArtifact(ctx, a.JobID, a.Path); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("deleting artifact %s: %w", blobKey(a.JobID, a.Path), err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+// Package audit keeps the audit log of mutating API requests: who did what
+// and when, with a summary of the request and its result. Events are
+// appended to the store and, optionally, forwarded to sinks such as syslog
+// or a SIEM webhook.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+const (
+	// queueSize is how many events may wait for the sinks before new ones
+	// are dropped from forwarding. They are stored regardless.
+	queueSize = 1024
+	// sendTimeout bounds one delivery of an event to a sink.
+	sendTimeout = 10 * time.Second
+)
+
+// Sink receives every audit event after it is stored.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	Send(ctx context.Context, event *types.AuditEvent) error
+}
+
+// Log records audit events.
+type Log struct {
+	store storage.AuditStore
+	sinks []Sink
+	queue chan *types.AuditEvent
+	now   func() time.Time
+}
+
+// New returns a log appending to store and forwarding to sinks once Run is
+// started.
+func New(store storage.AuditStore, sinks ...Sink) *Log {
+	return &Log{store: store, sinks: sinks, queue: make(chan *types.AuditEvent, queueSize), now: time.Now}
+}
+
+// Record assigns the event an ID and time and appends it. Forwarding to the
+// sinks happens in the background and never holds up the caller.
+func (l *Log) Record(ctx context.Context, event *types.AuditEvent) error {
+	event.ID = utils.NewID()
+	event.At = l.now()
+	if err := l.store.AppendAudit(ctx, event); err != nil {
+		return err
+	}
+	if len(l.sinks) == 0 {
+		return nil
+	}
+	select {
+	case l.queue <- event.Clone():
+	default:
+		slog.WarnContext(ctx, "Audit sinks are falling behind; not forwarding event", "audit_id", event.ID)
+	}
+	return nil
+}
+
+// List returns the events matching filter.
+func (l *Log) List(ctx context.Context, filter storage.AuditFilter) ([]*types.AuditEvent, error) {
+	return l.store.ListAudit(ctx, filter)
+}
+
+// Run forwards recorded events to the sinks until ctx is done.
+func (l *Log) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-l.queue:
+			for _, sink := range l.sinks {
+				sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+				if err := sink.Send(sendCtx, event); err != nil {
+					slog.Warn("Forwarding audit event failed", "sink", sink.Name(), "audit_id", event.ID, "error", err)
+				}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxValueLen is how many characters of a string field a summary keeps.
+const maxValueLen = 120
+
+// sensitiveFields are the fields whose values summaries never show. Fields
+// ending in _ followed by one of them are covered as well.
+var sensitiveFields = []string{"value", "token", "secret", "password", "credential", "key"}
+
+// Summarize describes a request body for the audit log. JSON objects are
+// summarized field by field: strings, numbers and booleans are shown,
+// strings shortened, arrays and objects reduced to their size, and the
+// values of sensitive fields redacted. Other bodies are described by type
+// and size only.
+func Summarize(contentType string, body []byte) map[string]string {
+	if len(body) == 0 {
+		return nil
+	}
+	// Like request validation, any body holding a JSON object counts as
+	// JSON whatever its declared type, since clients such as curl -d
+	// declare a form.
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil {
+		summary := make(map[string]string, len(fields))
+		for name, raw := range fields {
+			summary[name] = summarizeValue(name, raw)
+		}
+		return summary
+	}
+	media, _, _ := mime.ParseMediaType(contentType)
+	if media == "" {
+		media = "unknown"
+	}
+	return map[string]string{"content_type": media, "bytes": strconv.Itoa(len(body))}
+}
+
+func summarizeValue(name string, raw json.RawMessage) string {
+	if sensitive(name) {
+		return "[redacted]"
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "[invalid]"
+	}
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if utf8.RuneCountInString(v) > maxValueLen {
+			return string([]rune(v)[:maxValueLen]) + "…"
+		}
+		return v
+	case []any:
+		return "[" + strconv.Itoa(len(v)) + " items]"
+	case map[string]any:
+		return "{" + strconv.Itoa(len(v)) + " fields}"
+	default:
+		return string(raw)
+	}
+}
+
+// sensitive reports whether a field holds a secret by its name.
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveFields {
+		if name == s || strings.HasSuffix(name, "_"+s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/url"
+
+	"open-cicd/internal/types"
+)
+
+// syslogTag is the program name audit messages are logged under.
+const syslogTag = "open-cicd-audit"
+
+// Syslog writes every event as a JSON message to syslog, at notice level in
+// the auth facility.
+type Syslog struct {
+	w *syslog.Writer
+}
+
+// NewSyslog connects to the syslog daemon at addr, given as udp://host:port
+// or tcp://host:port, or to the local daemon if addr is "local".
+func NewSyslog(addr string) (*Syslog, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("syslog address %q is not local, udp://host:port or tcp://host:port", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_NOTICE|syslog.LOG_AUTH, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return &Syslog{w: w}, nil
+}
+
+// Name implements Sink.
+func (s *Syslog) Name() string { return "syslog" }
+
+// Send implements Sink. The writer reconnects by itself after errors.
+func (s *Syslog) Send(_ context.Context, event *types.AuditEvent) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.w.Notice(string(msg))
+}
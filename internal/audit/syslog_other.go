@@ -0,0 +1,26 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"context"
+	"errors"
+
+	"open-cicd/internal/types"
+)
+
+// Syslog is not available on this platform.
+type Syslog struct{}
+
+// NewSyslog always fails: this platform has no syslog.
+func NewSyslog(string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+// Name implements Sink.
+func (s *Syslog) Name() string { return "syslog" }
+
+// Send implements Sink.
+func (s *Syslog) Send(context.Context, *types.AuditEvent) error {
+	return errors.New("syslog is not supported on this platform")
+}
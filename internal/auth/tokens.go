@@ -0,0 +1,154 @@
+// Package auth issues and verifies API tokens and tracks the caller a
+// request was authenticated as.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrInvalidToken is returned for unknown, malformed or expired API tokens.
+var ErrInvalidToken = errors.New("invalid API token")
+
+const (
+	// tokenPrefix marks API token secrets so they are easy to recognise, for
+	// example by secret scanners.
+	tokenPrefix = "oc_"
+	tokenBytes  = 32
+)
+
+// BootstrapTokenID identifies the admin token configured at startup, which
+// is not stored and cannot be deleted through the API.
+const BootstrapTokenID = "bootstrap"
+
+// Tokens manages API tokens on top of a TokenStore.
+type Tokens struct {
+	store     storage.TokenStore
+	bootstrap []byte
+	now       func() time.Time
+}
+
+// NewTokens returns a token manager. A non-empty bootstrap secret is accepted
+// as an admin token so the first real tokens can be created.
+func NewTokens(store storage.TokenStore, bootstrap string) *Tokens {
+	return &Tokens{store: store, bootstrap: []byte(bootstrap), now: time.Now}
+}
+
+// Create issues a new token acting as user, confined to org unless it is
+// empty, and returns it with its plaintext secret, which is not retrievable
+// afterwards.
+func (t *Tokens) Create(ctx context.Context, name, user string, scope types.Scope, org string) (*types.APIToken, string, error) {
+	secret := tokenPrefix + utils.NewSecret(tokenBytes)
+	token := &types.APIToken{
+		ID:           utils.NewID(),
+		Name:         name,
+		User:         user,
+		Scope:        scope,
+		Organization: org,
+		Hash:         utils.HashSecret(secret),
+		CreatedAt:    t.now(),
+	}
+	if err := t.store.CreateToken(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// CreateSession issues the session token of user, who signed in through
+// the SSO provider named provider as a member of groups, valid for
+// lifetime. Sessions have the admin scope, so what they may do is up to
+// the role bindings of their user and groups. Sessions that expired are
+// deleted first.
+func (t *Tokens) CreateSession(ctx context.Context, provider, user string, groups []string, lifetime time.Duration) (*types.APIToken, string, error) {
+	if err := t.deleteExpired(ctx); err != nil {
+		return nil, "", fmt.Errorf("deleting expired sessions: %w", err)
+	}
+	secret := tokenPrefix + utils.NewSecret(tokenBytes)
+	now := t.now()
+	expires := now.Add(lifetime)
+	token := &types.APIToken{
+		ID:        utils.NewID(),
+		Name:      "session via " + provider,
+		User:      user,
+		Scope:     types.ScopeAdmin,
+		Provider:  provider,
+		Groups:    groups,
+		Hash:      utils.HashSecret(secret),
+		ExpiresAt: &expires,
+		CreatedAt: now,
+	}
+	if err := t.store.CreateToken(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// deleteExpired deletes the tokens that expired.
+func (t *Tokens) deleteExpired(ctx context.Context) error {
+	tokens, err := t.store.ListTokens(ctx)
+	if err != nil {
+		return err
+	}
+	now := t.now()
+	for _, token := range tokens {
+		if !token.Expired(now) {
+			continue
+		}
+		if err := t.store.DeleteToken(ctx, token.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the token a bearer secret belongs to.
+func (t *Tokens) Authenticate(ctx context.Context, secret string) (*types.APIToken, error) {
+	if len(t.bootstrap) > 0 && subtle.ConstantTimeCompare(t.bootstrap, []byte(secret)) == 1 {
+		return &types.APIToken{ID: BootstrapTokenID, Name: BootstrapTokenID, Scope: types.ScopeAdmin}, nil
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+	token, err := t.store.GetTokenByHash(ctx, utils.HashSecret(secret))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Expired(t.now()) {
+		return nil, fmt.Errorf("%w: the token expired", ErrInvalidToken)
+	}
+	return token, nil
+}
+
+// List returns all stored tokens.
+func (t *Tokens) List(ctx context.Context) ([]*types.APIToken, error) {
+	return t.store.ListTokens(ctx)
+}
+
+// Delete revokes a token.
+func (t *Tokens) Delete(ctx context.Context, id string) error {
+	return t.store.DeleteToken(ctx, id)
+}
+
+type tokenKey struct{}
+
+// WithToken returns a context carrying the token a request authenticated with.
+func WithToken(ctx context.Context, token *types.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFrom returns the token stored by WithToken, or nil.
+func TokenFrom(ctx context.Context) *types.APIToken {
+	token, _ := ctx.Value(tokenKey{}).(*types.APIToken)
+	return token
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// wildcardProject is the Quotas key used for projects without their own
+// entry.
+const wildcardProject = "*"
+
+// Quotas maps projects (owner/name) to the total size in bytes their cache
+// entries may take. Projects without an entry, and no wildcard, are
+// unlimited.
+type Quotas map[string]int64
+
+// NewQuotas returns the quotas of projects given as sizes such as 20GiB by
+// project. Sizes take an optional B, KB, MB, GB or TB suffix, or KiB, MiB,
+// GiB or TiB for powers of 1024. The project "*" sets the quota of unlisted
+// projects.
+func NewQuotas(sizes map[string]string) (Quotas, error) {
+	quotas := make(Quotas, len(sizes))
+	for _, project := range slices.Sorted(maps.Keys(sizes)) {
+		n, err := parseSize(sizes[project])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache quota for %s: %w", project, err)
+		}
+		quotas[strings.ToLower(project)] = n
+	}
+	return quotas, nil
+}
+
+// sizeUnits lists size suffixes, longest first so that "GiB" is tried
+// before "B".
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func parseSize(v string) (int64, error) {
+	number, factor := v, int64(1)
+	for _, u := range sizeUnits {
+		if n, ok := strings.CutSuffix(v, u.suffix); ok {
+			number, factor = n, u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", v)
+	}
+	return n * factor, nil
+}
+
+// Lookup returns the project's quota, falling back to the wildcard entry.
+func (q Quotas) Lookup(project string) (int64, bool) {
+	if n, ok := q[strings.ToLower(project)]; ok {
+		return n, true
+	}
+	n, ok := q[wildcardProject]
+	return n, ok
+}
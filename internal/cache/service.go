@@ -0,0 +1,236 @@
+// Package cache stores dependency caches, such as Go modules or
+// node_modules, that agents save and restore under keys derived from
+// lockfile hashes. Contents are content-addressed so identical caches are
+// stored once, and each project's entries are evicted least recently used
+// first to stay within its quota.
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/blobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrOverQuota is returned when a cache is larger than its project's quota.
+var ErrOverQuota = errors.New("cache is larger than the project quota")
+
+// Service saves, restores and evicts cache entries.
+type Service struct {
+	store  storage.CacheStore
+	blobs  blobs.Store
+	quotas Quotas
+	now    func() time.Time
+
+	// mu serialises changes to entries and blobs, so a blob is never
+	// deleted while a save is starting to share it.
+	mu sync.Mutex
+}
+
+// NewService returns a Service that records entries in store, keeps their
+// contents in blobStore and evicts them according to quotas.
+func NewService(store storage.CacheStore, blobStore blobs.Store, quotas Quotas) *Service {
+	return &Service{store: store, blobs: blobStore, quotas: quotas, now: time.Now}
+}
+
+func blobKey(digest string) string {
+	return strings.Replace(digest, ":", "/", 1)
+}
+
+// Restore returns the project's entry for key and its contents, and marks
+// the entry used. If there is no entry for key, it falls back to the most
+// recently saved entry whose key starts with the first of fallbacks that
+// has one. The caller closes the reader.
+func (s *Service) Restore(ctx context.Context, project, key string, fallbacks []string) (*types.CacheEntry, io.ReadSeekCloser, error) {
+	entry, err := s.store.GetCacheEntry(ctx, project, key)
+	fallback := false
+	if errors.Is(err, storage.ErrNotFound) && len(fallbacks) > 0 {
+		entry, err = s.latest(ctx, project, fallbacks)
+		fallback = err == nil
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		s.record(ctx, &types.CacheStats{Project: project, Key: key, Misses: 1})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := s.blobs.Open(ctx, blobKey(entry.Digest))
+	if errors.Is(err, blobs.ErrNotFound) {
+		s.record(ctx, &types.CacheStats{Project: project, Key: key, Misses: 1})
+		return nil, nil, fmt.Errorf("contents of cache %s are missing: %w", entry.Key, storage.ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if fallback {
+		s.record(ctx, &types.CacheStats{Project: project, Key: key, FallbackHits: 1})
+	} else {
+		s.record(ctx, &types.CacheStats{Project: project, Key: key, Hits: 1})
+	}
+	now := s.now()
+	if err := s.store.TouchCacheEntry(ctx, project, entry.Key, now); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.ErrorContext(ctx, "marking cache used", "project", project, "key", entry.Key, "error", err)
+	}
+	entry.LastUsedAt = now
+	return entry, contents, nil
+}
+
+// latest returns the most recently saved entry of the project whose key
+// starts with the first of prefixes that any key starts with.
+func (s *Service) latest(ctx context.Context, project string, prefixes []string) (*types.CacheEntry, error) {
+	entries, err := s.store.ListCacheEntries(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		var found *types.CacheEntry
+		for _, e := range entries {
+			if strings.HasPrefix(e.Key, prefix) && (found == nil || e.CreatedAt.After(found.CreatedAt)) {
+				found = e
+			}
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+// Save stores the contents of r as the project's entry for key, replacing
+// any earlier entry, then evicts the project's least recently used entries
+// until it is back within quota. The contents are spooled to a temporary
+// file first to learn their digest.
+func (s *Service) Save(ctx context.Context, project, key string, r io.Reader) (*types.CacheEntry, error) {
+	if err := types.ValidateCacheKey(key); err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp("", "open-cicd-cache-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), r)
+	if err != nil {
+		return nil, err
+	}
+	quota, limited := s.quotas.Lookup(project)
+	if limited && size > quota {
+		return nil, fmt.Errorf("%w: %d bytes, quota %d", ErrOverQuota, size, quota)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	refs, err := s.store.CountCacheDigest(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	if refs == 0 {
+		if err := s.blobs.Put(ctx, blobKey(digest), spool); err != nil {
+			return nil, fmt.Errorf("storing cache contents: %w", err)
+		}
+	}
+
+	previous, err := s.store.GetCacheEntry(ctx, project, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	now := s.now()
+	entry := &types.CacheEntry{
+		Project:    project,
+		Key:        key,
+		Digest:     digest,
+		Size:       size,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+	if err := s.store.PutCacheEntry(ctx, entry); err != nil {
+		return nil, fmt.Errorf("recording cache entry: %w", err)
+	}
+	if previous != nil && previous.Digest != digest {
+		s.release(ctx, previous.Digest)
+	}
+	s.record(ctx, &types.CacheStats{Project: project, Key: key, Saves: 1})
+	if limited {
+		if _, err := s.evict(ctx, project, key, quota, false); err != nil {
+			slog.ErrorContext(ctx, "evicting caches", "project", project, "error", err)
+		}
+	}
+	return entry, nil
+}
+
+// Trim evicts the project's least recently used entries until their total
+// size is within quota, returning those evicted. With dryRun it only
+// returns those it would evict.
+func (s *Service) Trim(ctx context.Context, project string, quota int64, dryRun bool) ([]*types.CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evict(ctx, project, "", quota, dryRun)
+}
+
+// evict deletes the project's least recently used entries, other than the
+// one just saved under keep, until their total size is within quota, and
+// returns them. With dryRun nothing is deleted. Callers must hold s.mu.
+func (s *Service) evict(ctx context.Context, project, keep string, quota int64, dryRun bool) ([]*types.CacheEntry, error) {
+	entries, err := s.store.ListCacheEntries(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	var evicted []*types.CacheEntry
+	for _, e := range entries {
+		if total <= quota {
+			break
+		}
+		if e.Key == keep {
+			continue
+		}
+		if !dryRun {
+			if err := s.store.DeleteCacheEntry(ctx, project, e.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return evicted, err
+			}
+			s.release(ctx, e.Digest)
+			slog.InfoContext(ctx, "Evicted cache", "project", project, "key", e.Key, "bytes", e.Size, "last_used_at", e.LastUsedAt)
+		}
+		total -= e.Size
+		evicted = append(evicted, e)
+	}
+	return evicted, nil
+}
+
+// release deletes the contents with digest once no entry refers to them.
+// Callers must hold s.mu.
+func (s *Service) release(ctx context.Context, digest string) {
+	refs, err := s.store.CountCacheDigest(ctx, digest)
+	if err != nil {
+		slog.ErrorContext(ctx, "counting references to cache contents", "digest", digest, "error", err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := s.blobs.Delete(ctx, blobKey(digest)); err != nil {
+		slog.ErrorContext(ctx, "deleting cache contents", "digest", digest, "error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"open-cicd/internal/types"
+)
+
+// ErrReadOnly is returned when the cache policy of a job's pipeline run
+// keeps it from saving caches.
+var ErrReadOnly = errors.New("caches are read-only for this job")
+
+// CheckWritable returns an error wrapping ErrReadOnly if the cache policy
+// of job's run keeps it from saving the cache key, and counts the refusal.
+func (s *Service) CheckWritable(ctx context.Context, job *types.Job, key string) error {
+	if job.CacheReadOnly == "" {
+		return nil
+	}
+	s.record(ctx, &types.CacheStats{Project: job.Repository, Key: key, RefusedSaves: 1})
+	return fmt.Errorf("%w: %s", ErrReadOnly, job.CacheReadOnly)
+}
+
+// Stats returns the statistics of the project's cache keys, or only of key
+// if it is not empty, with their total.
+func (s *Service) Stats(ctx context.Context, project, key string) (*types.CacheStatsReport, error) {
+	list, err := s.store.ListCacheStats(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	report := &types.CacheStatsReport{Total: types.CacheStats{Project: project, Key: key}, Keys: []types.CacheStats{}}
+	for _, stats := range list {
+		if key != "" && stats.Key != key {
+			continue
+		}
+		stats.ComputeHitRate()
+		report.Keys = append(report.Keys, *stats)
+		report.Total.Add(stats)
+	}
+	report.Total.ComputeHitRate()
+	return report, nil
+}
+
+// record adds delta to the statistics of its key. Statistics are best
+// effort: failing to record them does not fail the lookup or save.
+func (s *Service) record(ctx context.Context, delta *types.CacheStats) {
+	delta.UpdatedAt = s.now()
+	if err := s.store.AddCacheStats(ctx, delta); err != nil {
+		slog.ErrorContext(ctx, "recording cache statistics", "project", delta.Project, "key", delta.Key, "error", err)
+	}
+}
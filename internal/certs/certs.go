@@ -0,0 +1,109 @@
+// Package certs builds the TLS settings of the server's listeners, from
+// certificate files or from certificates obtained from Let's Encrypt, and
+// identifies agents by the client certificates they present.
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"open-cicd/internal/config"
+)
+
+// Listeners holds the TLS settings of the HTTP API and the agent gRPC port.
+type Listeners struct {
+	HTTP *tls.Config
+	GRPC *tls.Config
+	// Mutual is set when agents must present client certificates.
+	Mutual bool
+}
+
+// Load returns the TLS settings described by cfg, or nil if TLS is off.
+//
+// With mutual TLS the agent port rejects connections without a client
+// certificate signed by the client CA. The API also serves users, who do not
+// have one, so it only verifies certificates that are presented; the agent
+// endpoints then insist on one.
+func Load(cfg config.TLS) (*Listeners, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	l := &Listeners{
+		HTTP: &tls.Config{MinVersion: tls.VersionTLS12},
+		GRPC: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if len(cfg.AutocertHosts) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(trimAll(cfg.AutocertHosts)...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		// The manager's own settings answer TLS-ALPN-01 challenges.
+		l.HTTP = m.TLSConfig()
+		l.HTTP.MinVersion = tls.VersionTLS12
+		l.GRPC.GetCertificate = m.GetCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading server certificate: %w", err)
+		}
+		l.HTTP.Certificates = []tls.Certificate{cert}
+		l.GRPC.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		l.HTTP.ClientCAs, l.HTTP.ClientAuth = pool, tls.VerifyClientCertIfGiven
+		l.GRPC.ClientCAs, l.GRPC.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		l.Mutual = true
+	}
+	return l, nil
+}
+
+// loadPool reads the PEM certificates in path.
+func loadPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client CA file holds no PEM certificates")
+	}
+	return pool, nil
+}
+
+func trimAll(hosts []string) []string {
+	trimmed := make([]string, len(hosts))
+	for i, h := range hosts {
+		trimmed[i] = strings.TrimSpace(h)
+	}
+	return trimmed
+}
+
+// Fingerprint returns the hex SHA-256 digest of a certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// PeerFingerprint returns the fingerprint of the verified client certificate
+// of a connection, or "" if it has none.
+func PeerFingerprint(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return Fingerprint(state.VerifiedChains[0][0])
+}
@@ -0,0 +1,152 @@
+// Package checks keeps the checks each project requires of its runs: whole
+// pipelines, or single stages of them, that must pass before changes are
+// merged. The scm Reporter posts each as a commit status of its own, so
+// that branch protection rules on the SCM can require them one by one.
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Service stores required checks and works out their state for runs.
+type Service struct {
+	store storage.RequiredCheckStore
+	jobs  *jobs.Manager
+	now   func() time.Time
+}
+
+// NewService returns a Service that keeps required checks in store and
+// follows the runs of manager.
+func NewService(store storage.RequiredCheckStore, manager *jobs.Manager) *Service {
+	return &Service{store: store, jobs: manager, now: time.Now}
+}
+
+// Get returns the checks project requires, which are none until it sets
+// them.
+func (s *Service) Get(ctx context.Context, project string) (*types.RequiredChecks, error) {
+	checks, err := s.store.GetRequiredChecks(ctx, project)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &types.RequiredChecks{Project: project, Checks: []types.RequiredCheck{}}, nil
+	}
+	return checks, err
+}
+
+// Set replaces the checks project requires, on behalf of updatedBy.
+func (s *Service) Set(ctx context.Context, project string, req types.PutRequiredChecksRequest, updatedBy string) (*types.RequiredChecks, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	checks := &types.RequiredChecks{
+		Project:   project,
+		Checks:    make([]types.RequiredCheck, len(req.Checks)),
+		UpdatedBy: updatedBy,
+		UpdatedAt: s.now(),
+	}
+	for i, c := range req.Checks {
+		c.Context = types.CheckContext(c.Name)
+		checks.Checks[i] = c
+	}
+	if err := s.store.PutRequiredChecks(ctx, checks); err != nil {
+		return nil, fmt.Errorf("storing required checks: %w", err)
+	}
+	return checks, nil
+}
+
+// Results returns the run with the given ID and the state of each check
+// its project requires of it, if any.
+func (s *Service) Results(ctx context.Context, pipelineID string) (*types.Pipeline, []types.CheckResult, error) {
+	run, err := s.jobs.GetPipeline(ctx, pipelineID)
+	if err != nil {
+		return nil, nil, err
+	}
+	required, err := s.Get(ctx, run.Repository)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading required checks of %s: %w", run.Repository, err)
+	}
+	var (
+		results []types.CheckResult
+		stages  map[string]types.StageState
+	)
+	for _, check := range required.Checks {
+		if !check.Matches(run) {
+			continue
+		}
+		if check.Stage == "" {
+			state, description := runState(run)
+			results = append(results, types.CheckResult{Check: check, State: state, Description: description})
+			continue
+		}
+		if stages == nil {
+			timeline, err := s.jobs.PipelineTimeline(ctx, run)
+			if err != nil {
+				return nil, nil, fmt.Errorf("building timeline of %s: %w", run.ID, err)
+			}
+			stages = make(map[string]types.StageState, len(timeline.Stages))
+			for _, st := range timeline.Stages {
+				stages[st.Stage] = st.State
+			}
+		}
+		st, ok := stages[check.Stage]
+		if !ok {
+			results = append(results, types.CheckResult{Check: check, State: types.CheckFailed,
+				Description: fmt.Sprintf("Pipeline %s has no stage %s", run.Name, check.Stage)})
+			continue
+		}
+		state, description := stageState(run, st)
+		results = append(results, types.CheckResult{Check: check, State: state, Description: description})
+	}
+	return run, results, nil
+}
+
+// runState describes the state of a check following the whole of run.
+func runState(run *types.Pipeline) (types.CheckState, string) {
+	switch run.State {
+	case types.PipelineStateRunning:
+		return types.CheckRunning, "Running"
+	case types.PipelineStateSucceeded:
+		return types.CheckSucceeded, "Pipeline succeeded"
+	case types.PipelineStateFailed:
+		return types.CheckFailed, "Pipeline failed"
+	case types.PipelineStateCancelled:
+		return types.CheckCancelled, "Pipeline was cancelled"
+	}
+	return types.CheckPending, "Queued"
+}
+
+// stageState describes the state of a check following a stage of run that
+// is in state st. A skipped stage passes only if the run does, since it is
+// also skipped when a stage it needs fails.
+func stageState(run *types.Pipeline, st types.StageState) (types.CheckState, string) {
+	switch st {
+	case types.StageStateWaiting:
+		return types.CheckPending, "Waiting for the stages it needs"
+	case types.StageStateAwaitingApproval:
+		return types.CheckPending, "Awaiting approval"
+	case types.StageStateRunning:
+		return types.CheckRunning, "Running"
+	case types.StageStateSucceeded:
+		return types.CheckSucceeded, "Stage succeeded"
+	case types.StageStateFailed:
+		return types.CheckFailed, "Stage failed"
+	case types.StageStateCancelled:
+		return types.CheckCancelled, "Stage was cancelled"
+	case types.StageStateSkipped:
+		switch run.State {
+		case types.PipelineStateSucceeded:
+			return types.CheckSucceeded, "Stage was skipped"
+		case types.PipelineStateFailed:
+			return types.CheckFailed, "Stage was skipped, and the pipeline failed"
+		case types.PipelineStateCancelled:
+			return types.CheckCancelled, "Stage was skipped, and the pipeline was cancelled"
+		}
+		return types.CheckPending, "Stage was skipped; waiting for the pipeline to finish"
+	}
+	return types.CheckPending, "Queued"
+}
@@ -0,0 +1,403 @@
+// Package client is a Go client for the control plane HTTP API, used by the
+// opencicd command line tool.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// requestTimeout bounds API calls other than log streams.
+const requestTimeout = 30 * time.Second
+
+// Client calls the API of one server with one bearer token.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// New returns a client for the server at base, such as
+// https://ci.example.com, authenticating with token.
+func New(base, token string) *Client {
+	return &Client{base: strings.TrimSuffix(base, "/"), token: token, http: &http.Client{}}
+}
+
+// FieldError is a problem with one field of a rejected request body, or
+// with one line of a rejected pipeline definition.
+type FieldError struct {
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// APIError is an error response of the server.
+type APIError struct {
+	Status int
+	// Code is the error code of the response, one of the types.Code
+	// constants; it is empty if the body was not an error envelope.
+	Code    types.ErrorCode
+	Message string
+	// Errors lists the problems found in an invalid request body or
+	// pipeline definition, or in the inputs passed to a run, if the server
+	// named them.
+	Errors []FieldError
+	// RequestID identifies the request in the server's logs.
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("%d: %s", e.Status, msg)
+	}
+	details := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		var b strings.Builder
+		if fe.Line > 0 {
+			fmt.Fprintf(&b, "line %d: ", fe.Line)
+		}
+		if fe.Path != "" {
+			b.WriteString(fe.Path + ": ")
+		}
+		b.WriteString(fe.Message)
+		details[i] = b.String()
+	}
+	return fmt.Sprintf("%d: %s: %s", e.Status, msg, strings.Join(details, "; "))
+}
+
+// ListOptions are the paging parameters of list calls. Zero values take the
+// server defaults.
+type ListOptions struct {
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	// Sort is created or updated, and Desc reverses the order.
+	Sort string
+	Desc bool
+}
+
+// values returns the query parameters of o.
+func (o ListOptions) values() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	set(q, "cursor", o.Cursor)
+	set(q, "sort", o.Sort)
+	if o.Desc {
+		q.Set("order", "desc")
+	}
+	return q
+}
+
+// Page is one page of a list. NextCursor is set when there may be more.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// JobListOptions filters ListJobs. Empty fields match every job.
+type JobListOptions struct {
+	ListOptions
+	Project      string
+	Organization string
+	State        types.JobState
+	Branch       string
+	AgentID      string
+}
+
+// ListJobs returns a page of the jobs the token may view.
+func (c *Client) ListJobs(ctx context.Context, opts JobListOptions) (*Page[types.Job], error) {
+	q := opts.values()
+	set(q, "project", opts.Project)
+	set(q, "organization", opts.Organization)
+	set(q, "state", string(opts.State))
+	set(q, "branch", opts.Branch)
+	set(q, "agent", opts.AgentID)
+	var page Page[types.Job]
+	if err := c.do(ctx, http.MethodGet, "/jobs?"+q.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetJob returns the job with the given ID.
+func (c *Client) GetJob(ctx context.Context, id string) (*types.Job, error) {
+	var job types.Job
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ReproduceJob returns what running a job again outside CI takes.
+func (c *Client) ReproduceJob(ctx context.Context, id string) (*types.ReproduceBundle, error) {
+	var bundle types.ReproduceBundle
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/reproduce", nil, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// SubmitJob submits a job.
+func (c *Client) SubmitJob(ctx context.Context, req types.CreateJobRequest) (*types.Job, error) {
+	var job types.Job
+	if err := c.do(ctx, http.MethodPost, "/jobs", req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels a job, recording reason if it is not empty, and returns
+// the job as left by the cancellation.
+func (c *Client) CancelJob(ctx context.Context, id, reason string) (*types.Job, error) {
+	var job types.Job
+	err := c.do(ctx, http.MethodPost, "/jobs/"+url.PathEscape(id)+"/cancel", types.CancelJobRequest{Reason: reason}, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RetryJob runs a failed, timed out or cancelled job again and returns the
+// new job.
+func (c *Client) RetryJob(ctx context.Context, id string) (*types.Job, error) {
+	var job types.Job
+	if err := c.do(ctx, http.MethodPost, "/jobs/"+url.PathEscape(id)+"/retry", nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// JobTests returns the results of the test reports a job uploaded. With
+// failedOnly, only failed test cases are listed.
+func (c *Client) JobTests(ctx context.Context, id string, failedOnly bool) (*types.JobTests, error) {
+	p := "/jobs/" + url.PathEscape(id) + "/tests"
+	if failedOnly {
+		p += "?failed=true"
+	}
+	var tests types.JobTests
+	if err := c.do(ctx, http.MethodGet, p, nil, &tests); err != nil {
+		return nil, err
+	}
+	return &tests, nil
+}
+
+// PipelineListOptions filters ListPipelines. Empty fields match every run.
+type PipelineListOptions struct {
+	ListOptions
+	Project      string
+	Organization string
+	State        types.PipelineState
+	Branch       string
+	// Name matches runs of the pipeline of that name.
+	Name string
+}
+
+// ListPipelines returns a page of the pipeline runs the token may view.
+func (c *Client) ListPipelines(ctx context.Context, opts PipelineListOptions) (*Page[types.Pipeline], error) {
+	q := opts.values()
+	set(q, "project", opts.Project)
+	set(q, "organization", opts.Organization)
+	set(q, "state", string(opts.State))
+	set(q, "branch", opts.Branch)
+	set(q, "name", opts.Name)
+	var page Page[types.Pipeline]
+	if err := c.do(ctx, http.MethodGet, "/pipelines?"+q.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetPipeline returns the pipeline run with the given ID and the
+// annotations of its jobs.
+func (c *Client) GetPipeline(ctx context.Context, id string) (*types.PipelineDetail, error) {
+	var run types.PipelineDetail
+	if err := c.do(ctx, http.MethodGet, "/pipelines/"+url.PathEscape(id), nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// RerunPipeline starts a new run of a finished pipeline run. With
+// failedOnly, only the stages that did not succeed run again.
+func (c *Client) RerunPipeline(ctx context.Context, id string, failedOnly bool) (*types.Pipeline, error) {
+	var run types.Pipeline
+	err := c.do(ctx, http.MethodPost, "/pipelines/"+url.PathEscape(id)+"/rerun", types.RerunPipelineRequest{FailedOnly: failedOnly}, &run)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// DecideStage approves or rejects a manual stage of a pipeline run that is
+// awaiting approval, recording comment if it is not empty, and returns the
+// run with the decision recorded.
+func (c *Client) DecideStage(ctx context.Context, id, stage string, decision types.ApprovalDecision, comment string) (*types.Pipeline, error) {
+	action := "approve"
+	if decision == types.Rejected {
+		action = "reject"
+	}
+	var run types.Pipeline
+	p := "/pipelines/" + url.PathEscape(id) + "/stages/" + url.PathEscape(stage) + "/" + action
+	if err := c.do(ctx, http.MethodPost, p, types.StageDecisionRequest{Comment: comment}, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// AuthorizePipeline lets a run of a pull request from a fork that awaits
+// authorization start, with the project's secrets if secrets is set, and
+// returns the run.
+func (c *Client) AuthorizePipeline(ctx context.Context, id, comment string, secrets bool) (*types.Pipeline, error) {
+	var run types.Pipeline
+	req := types.AuthorizePipelineRequest{Comment: comment, Secrets: secrets}
+	if err := c.do(ctx, http.MethodPost, "/pipelines/"+url.PathEscape(id)+"/authorize", req, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ListEnvironments returns a page of the environments of project.
+func (c *Client) ListEnvironments(ctx context.Context, project string, opts ListOptions) (*Page[types.Environment], error) {
+	q := opts.values()
+	set(q, "project", project)
+	var page Page[types.Environment]
+	if err := c.do(ctx, http.MethodGet, "/environments?"+q.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ListDeployments returns a page of the deployments to an environment of
+// project.
+func (c *Client) ListDeployments(ctx context.Context, project, environment string, opts ListOptions) (*Page[types.Deployment], error) {
+	q := opts.values()
+	set(q, "project", project)
+	var page Page[types.Deployment]
+	p := "/environments/" + url.PathEscape(environment) + "/deployments?" + q.Encode()
+	if err := c.do(ctx, http.MethodGet, p, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// SubmitPipeline runs the YAML pipeline definition of req. Its repository
+// and ref may be empty.
+func (c *Client) SubmitPipeline(ctx context.Context, req types.CreatePipelineRequest) (*types.Pipeline, error) {
+	var run types.Pipeline
+	if err := c.do(ctx, http.MethodPost, "/pipelines", req, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// StartPipeline starts a manual run of the pipeline named name, with the
+// definition of its latest run in the repository of req and the inputs of
+// req.
+func (c *Client) StartPipeline(ctx context.Context, name string, req types.StartPipelineRequest) (*types.Pipeline, error) {
+	var run types.Pipeline
+	if err := c.do(ctx, http.MethodPost, "/pipelines/"+url.PathEscape(name)+"/runs", req, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ValidatePipeline checks the YAML pipeline definition of req without
+// running it. A definition that does not validate is not an error: the
+// result lists its problems.
+func (c *Client) ValidatePipeline(ctx context.Context, req types.ValidatePipelineRequest) (*types.PipelineValidation, error) {
+	var result types.PipelineValidation
+	if err := c.do(ctx, http.MethodPost, "/pipelines/validate", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// do sends a JSON request and decodes the response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, p string, body, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := c.request(ctx, method, p, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, p, err)
+	}
+	return nil
+}
+
+func (c *Client) request(ctx context.Context, method, p string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+p, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// apiError reads the error body of resp. The server answers errors with a
+// types.ErrorResponse, whose details list the problems of invalid request
+// bodies and pipeline definitions.
+func apiError(resp *http.Response) error {
+	var body struct {
+		types.ErrorResponse
+		Details json.RawMessage `json:"details"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err := json.Unmarshal(data, &body); err != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+	apiErr := &APIError{Status: resp.StatusCode, Code: body.Code, Message: body.Message, RequestID: body.RequestID}
+	switch body.Code {
+	case types.CodeInvalidRequestBody, types.CodeInvalidPipeline, types.CodeInvalidInputs:
+		_ = json.Unmarshal(body.Details, &apiErr.Errors)
+	}
+	return apiErr
+}
+
+// set adds the query parameter name unless v is empty.
+func set(q url.Values, name, v string) {
+	if v != "" {
+		q.Set(name, v)
+	}
+}
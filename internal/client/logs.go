@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"open-cicd/internal/logs"
+	"open-cicd/internal/types"
+)
+
+// reconnectDelay is how long FollowLogs waits before resuming a log stream
+// that broke off.
+const reconnectDelay = 2 * time.Second
+
+// maxReconnects caps how many times in a row FollowLogs resumes a stream
+// without receiving anything.
+const maxReconnects = 5
+
+// LogChunk is a piece of job output. Offset is its byte position within the
+// job's combined log.
+type LogChunk struct {
+	Stream logs.Stream `json:"stream"`
+	Offset int64       `json:"offset"`
+	Text   string      `json:"text"`
+	At     time.Time   `json:"at"`
+}
+
+// Logs returns the output of a job up to now.
+func (c *Client) Logs(ctx context.Context, id string) (io.ReadCloser, error) {
+	req, err := c.request(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/logs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, apiError(resp)
+	}
+	return resp.Body, nil
+}
+
+// FollowLogs passes the output of a job to fn as it is uploaded, until the
+// job finishes, and returns its final state. Streams that break off are
+// resumed where they stopped.
+func (c *Client) FollowLogs(ctx context.Context, id string, fn func(LogChunk) error) (types.JobState, error) {
+	var offset int64
+	failures := 0
+	// Errors of fn end the stream for good, unlike broken connections.
+	var fnErr error
+	handle := func(chunk LogChunk) error {
+		fnErr = fn(chunk)
+		return fnErr
+	}
+	for {
+		next, state, err := c.streamLogs(ctx, id, offset, handle)
+		if err == nil {
+			return state, nil
+		}
+		var apiErr *APIError
+		if fnErr != nil || errors.As(err, &apiErr) || ctx.Err() != nil {
+			return "", err
+		}
+		if next > offset {
+			failures = 0
+		}
+		offset = next
+		if failures++; failures > maxReconnects {
+			return "", fmt.Errorf("following logs: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// streamLogs reads the log event stream of a job from offset. It returns the
+// offset reached and, once the stream ends normally, the job's final state.
+func (c *Client) streamLogs(ctx context.Context, id string, offset int64, fn func(LogChunk) error) (int64, types.JobState, error) {
+	p := "/jobs/" + url.PathEscape(id) + "/logs?offset=" + strconv.FormatInt(offset, 10)
+	req, err := c.request(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return offset, "", err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return offset, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return offset, "", apiError(resp)
+	}
+
+	var event, data, eventID string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				data = value
+			case "id":
+				eventID = value
+			}
+			continue
+		}
+		// A blank line ends an event.
+		switch event {
+		case "log":
+			var chunk LogChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				return offset, "", fmt.Errorf("decoding log event: %w", err)
+			}
+			if err := fn(chunk); err != nil {
+				return offset, "", err
+			}
+			if n, err := strconv.ParseInt(eventID, 10, 64); err == nil {
+				offset = n
+			}
+		case "end":
+			var end struct {
+				State types.JobState `json:"state"`
+			}
+			if err := json.Unmarshal([]byte(data), &end); err != nil {
+				return offset, "", fmt.Errorf("decoding end event: %w", err)
+			}
+			return offset, end.State, nil
+		}
+		event, data, eventID = "", "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return offset, "", err
+	}
+	return offset, "", io.ErrUnexpectedEOF
+}
@@ -0,0 +1,1318 @@
+// Package config loads the control plane configuration from an optional YAML
+// file and the environment, validates it, and reloads the settings that can
+// change at runtime when the process receives SIGHUP.
+//
+// Values are taken from built-in defaults, then the file, then environment
+// variables, so existing deployments configured only through the
+// environment keep working.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/mail"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"open-cicd/internal/artifacts"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/logging"
+	"open-cicd/internal/releases"
+	"open-cicd/internal/secrets"
+	"open-cicd/internal/types"
+	"open-cicd/internal/version"
+)
+
+// Config is the control plane configuration.
+type Config struct {
+	Server        Server        `yaml:"server"`
+	Storage       Storage       `yaml:"storage"`
+	Auth          Auth          `yaml:"auth"`
+	Agents        Agents        `yaml:"agents"`
+	Logging       Logging       `yaml:"logging"`
+	Kubernetes    Kubernetes    `yaml:"kubernetes"`
+	SCM           SCM           `yaml:"scm"`
+	Limits        Limits        `yaml:"limits"`
+	Audit         Audit         `yaml:"audit"`
+	Notifications Notifications `yaml:"notifications"`
+	OIDC          OIDC          `yaml:"oidc"`
+	Images        Images        `yaml:"images"`
+	Vault         Vault         `yaml:"vault"`
+	Secrets       Secrets       `yaml:"secrets"`
+	Retention     Retention     `yaml:"retention"`
+}
+
+// Server configures the listeners and their timeouts.
+type Server struct {
+	// Port is the HTTP API port (PORT).
+	Port int `yaml:"port"`
+	// GRPCPort is the agent gRPC port (GRPC_PORT).
+	GRPCPort     int           `yaml:"grpc_port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownGracePeriod bounds how long shutdown waits for in-flight work
+	// (SHUTDOWN_GRACE_PERIOD).
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+	// TLS turns on HTTPS for the API and TLS for the agent port.
+	TLS TLS `yaml:"tls"`
+}
+
+// TLS configures the server certificate, taken either from files or from
+// Let's Encrypt, and optionally requires agents to present client
+// certificates. Both listeners use the same settings; TLS is off when
+// neither certificate files nor autocert hosts are set.
+type TLS struct {
+	// CertFile and KeyFile hold the PEM certificate chain and private key
+	// (TLS_CERT_FILE and TLS_KEY_FILE).
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// AutocertHosts are the host names to obtain certificates for from
+	// Let's Encrypt (TLS_AUTOCERT_HOSTS, comma-separated). Challenges are
+	// answered over TLS, so the API port must be reachable as port 443.
+	AutocertHosts []string `yaml:"autocert_hosts"`
+	// AutocertCacheDir keeps obtained certificates across restarts
+	// (TLS_AUTOCERT_CACHE_DIR).
+	AutocertCacheDir string `yaml:"autocert_cache_dir"`
+	// AutocertEmail is the contact address of the ACME account
+	// (TLS_AUTOCERT_EMAIL).
+	AutocertEmail string `yaml:"autocert_email"`
+	// ClientCAFile turns on mutual TLS for agents: they must present a
+	// client certificate signed by one of the PEM certificates in the file,
+	// and keep using the certificate they registered with
+	// (TLS_CLIENT_CA_FILE).
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// Enabled reports whether the listeners use TLS.
+func (t *TLS) Enabled() bool {
+	return t.CertFile != "" || len(t.AutocertHosts) > 0
+}
+
+// Storage selects the control plane store and where the contents of job
+// logs, artifacts, workspace snapshots and dependency caches are kept.
+type Storage struct {
+	// DatabaseURL is a postgres:// URL, a sqlite:// URL followed by the
+	// path of the database file, or empty for in-memory storage
+	// (DATABASE_URL).
+	DatabaseURL string `yaml:"database_url"`
+	// Logs holds the archived segments of job logs (JOB_LOG_DIR and
+	// JOB_LOG_S3_*).
+	Logs Blobs `yaml:"logs"`
+	// Artifacts holds the contents of artifacts (ARTIFACT_DIR and
+	// ARTIFACT_S3_*).
+	Artifacts Blobs `yaml:"artifacts"`
+	// Snapshots holds workspace snapshots (SNAPSHOT_DIR and SNAPSHOT_S3_*).
+	Snapshots Blobs `yaml:"snapshots"`
+	// Caches holds dependency caches (CACHE_DIR and CACHE_S3_*).
+	Caches Blobs `yaml:"caches"`
+}
+
+// Blobs locates one kind of blob: an S3-compatible bucket when S3.Bucket
+// is set, otherwise the directory Dir. With neither, blobs are written to
+// the temporary directory and lost with it, which is only allowed with
+// in-memory storage.
+type Blobs struct {
+	// Dir is the directory blobs are written under (<PREFIX>_DIR).
+	Dir string `yaml:"dir"`
+	S3  S3     `yaml:"s3"`
+}
+
+// S3 locates an S3-compatible bucket.
+type S3 struct {
+	// Bucket is the name of the bucket (<PREFIX>_S3_BUCKET).
+	Bucket string `yaml:"bucket"`
+	// Endpoint is the host of the service, s3.amazonaws.com by default
+	// (<PREFIX>_S3_ENDPOINT), and Region its region (<PREFIX>_S3_REGION).
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	// Prefix is prepended to the keys of the objects (<PREFIX>_S3_PREFIX).
+	Prefix string `yaml:"prefix"`
+	// Insecure talks plain HTTP to the endpoint (<PREFIX>_S3_INSECURE).
+	Insecure bool `yaml:"insecure"`
+}
+
+// Durable reports whether blobs outlive the server's host.
+func (b *Blobs) Durable() bool {
+	return b.Dir != "" || b.S3.Bucket != ""
+}
+
+// Auth configures the bootstrap credentials and signing in through SSO
+// providers and LDAP directories.
+type Auth struct {
+	// AdminToken is accepted as an admin API token (ADMIN_TOKEN).
+	AdminToken string `yaml:"admin_token"`
+	// AgentRegistrationTokens are the tokens agents may register with
+	// (AGENT_REGISTRATION_TOKENS, comma-separated).
+	AgentRegistrationTokens []string `yaml:"agent_registration_tokens"`
+	// SSO lists the OpenID Connect providers people may sign in with, such
+	// as Okta, Azure AD or Google. The providers redirect back to
+	// scm.external_url, which is then required.
+	SSO []SSOProvider `yaml:"sso"`
+	// LDAP lists the LDAP directories, such as Active Directory, people may
+	// sign in to with their directory password. Names are shared with the
+	// SSO providers.
+	LDAP []LDAPProvider `yaml:"ldap"`
+	// SessionLifetime is how long the session of someone who signed in
+	// through SSO or LDAP lasts (AUTH_SESSION_LIFETIME).
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+	// ArtifactSigningKey, if set, is the base64 key of at least 32 bytes
+	// artifact download links are signed with (ARTIFACT_SIGNING_KEY).
+	// Without one artifacts cannot be shared through links.
+	ArtifactSigningKey string `yaml:"artifact_signing_key"`
+	// BadgeSigningKey, if set, is the base64 key of at least 32 bytes the
+	// tokens of status badge URLs are derived from (BADGE_SIGNING_KEY).
+	// Without one no badges are served.
+	BadgeSigningKey string `yaml:"badge_signing_key"`
+}
+
+// SSOProvider configures signing in through one OpenID Connect provider.
+// Register <external_url>/auth/sso/<name>/callback as its redirect URI.
+type SSOProvider struct {
+	// Name identifies the provider in URLs, and DisplayName on the sign-in
+	// page; it defaults to Name.
+	Name        string `yaml:"name"`
+	DisplayName string `yaml:"display_name"`
+	// Issuer is the issuer URL the provider's discovery document is
+	// fetched under, such as https://accounts.google.com.
+	Issuer string `yaml:"issuer"`
+	// ClientID and ClientSecret are the credentials of the server's client
+	// registration with the provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Scopes are requested besides openid; they default to email, profile
+	// and groups.
+	Scopes []string `yaml:"scopes"`
+	// UsernameClaim is the ID token claim users are named by in role
+	// bindings, email by default. An email that the provider says is not
+	// verified is refused.
+	UsernameClaim string `yaml:"username_claim"`
+	// GroupsClaim is the claim listing the user's groups, which role
+	// bindings to group:<name> apply to; groups by default.
+	GroupsClaim string `yaml:"groups_claim"`
+	// AllowedGroups, if set, lets only members of one of them sign in.
+	AllowedGroups []string `yaml:"allowed_groups"`
+}
+
+// LDAPProvider configures signing in to one LDAP directory. A sign-in binds
+// as the service account, searches for the user and their groups, then
+// checks the password by binding as the user.
+type LDAPProvider struct {
+	// Name identifies the directory in URLs, and DisplayName on the
+	// sign-in page; it defaults to Name.
+	Name        string `yaml:"name"`
+	DisplayName string `yaml:"display_name"`
+	// URL is the ldap:// or ldaps:// URL of the directory. StartTLS
+	// upgrades ldap:// connections to TLS, verified against the PEM CAs in
+	// CAFile or the system roots.
+	URL      string `yaml:"url"`
+	StartTLS bool   `yaml:"start_tls"`
+	CAFile   string `yaml:"ca_file"`
+	// BindDN and BindPassword are the service account users and groups are
+	// searched as; searches are anonymous without them.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	// UserBaseDN is searched for the entry matching UserFilter, in which
+	// {username} stands for the name signed in with; it defaults to
+	// (uid={username}), and is (sAMAccountName={username}) for Active
+	// Directory.
+	UserBaseDN string `yaml:"user_base_dn"`
+	UserFilter string `yaml:"user_filter"`
+	// UsernameAttribute is the attribute of the user's entry users are
+	// named by in role bindings, such as mail; by default the name signed
+	// in with.
+	UsernameAttribute string `yaml:"username_attribute"`
+	// GroupBaseDN, if set, is searched for the user's groups: entries
+	// matching GroupFilter, in which {dn} stands for the user's DN and
+	// {username} for the name signed in with. It defaults to
+	// (member={dn}); (member:1.2.840.113556.1.4.1941:={dn}) also finds the
+	// nested groups of Active Directory. Role bindings to group:<name>
+	// apply to the groups' GroupNameAttribute, cn by default.
+	GroupBaseDN        string `yaml:"group_base_dn"`
+	GroupFilter        string `yaml:"group_filter"`
+	GroupNameAttribute string `yaml:"group_name_attribute"`
+	// AllowedGroups, if set, lets only members of one of them sign in.
+	AllowedGroups []string `yaml:"allowed_groups"`
+}
+
+// Agents configures agent liveness tracking and job matching.
+type Agents struct {
+	// HeartbeatInterval is how often agents are told to send heartbeats
+	// (AGENT_HEARTBEAT_INTERVAL).
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// HeartbeatTimeout is how long an agent may go without one before it is
+	// marked offline (AGENT_HEARTBEAT_TIMEOUT).
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+	// MatchTimeout is how long a queued job waits for an agent carrying its
+	// labels before it fails with "no matching agents"; zero waits forever
+	// (AGENT_MATCH_TIMEOUT). It can be changed by reloading.
+	MatchTimeout time.Duration `yaml:"match_timeout" reload:"true"`
+	// StuckTimeout is how long a job may stay assigned without starting,
+	// or run without printing anything, before it is marked lost: failed,
+	// or retried if its retry policy covers infrastructure failures. Zero
+	// never marks jobs lost (AGENT_STUCK_TIMEOUT). It can be changed by
+	// reloading.
+	StuckTimeout time.Duration `yaml:"stuck_timeout" reload:"true"`
+	// MinVersion, if set, is the oldest agent version allowed to register
+	// (AGENT_MIN_VERSION). Agents that report no version are refused too.
+	// It can be changed by reloading.
+	MinVersion string `yaml:"min_version" reload:"true"`
+	// JobSigningKey, if set, is the base64 Ed25519 private key, or its
+	// seed, every job assignment is signed with (AGENT_JOB_SIGNING_KEY).
+	// Agents given its public key refuse assignments it did not sign. It
+	// can be changed by reloading, once agents trust the new key too.
+	JobSigningKey string `yaml:"job_signing_key" reload:"true"`
+	// Update rolls a release of the agent out to the connected agents.
+	Update AgentUpdate `yaml:"update"`
+}
+
+// AgentUpdate configures the agent release served at /agents/download and
+// rolled out to the agents older than it. It is off unless Dir is set.
+type AgentUpdate struct {
+	// Dir holds the binaries of the release, named open-cicd-agent-<os>-<arch>
+	// (AGENT_UPDATE_DIR).
+	Dir string `yaml:"dir"`
+	// Version is the version the binaries were built as
+	// (AGENT_UPDATE_VERSION).
+	Version string `yaml:"version"`
+	// SigningKey is the base64 Ed25519 private key, or its seed, the
+	// binaries are signed with (AGENT_SIGNING_KEY). Agents verify them
+	// against its public key, which the server logs at startup.
+	SigningKey string `yaml:"signing_key"`
+	// Parallel is how many agents update at once (AGENT_UPDATE_PARALLEL).
+	Parallel int `yaml:"parallel"`
+}
+
+// Logging configures the structured logger.
+type Logging struct {
+	// Level is debug, info, warn or error (LOG_LEVEL). It can be changed
+	// by reloading.
+	Level string `yaml:"level" reload:"true"`
+	// Format is json or text (LOG_FORMAT).
+	Format string `yaml:"format"`
+}
+
+// Kubernetes configures the executor that runs jobs as Kubernetes Jobs
+// launched by the server itself rather than on agents.
+type Kubernetes struct {
+	// Enabled turns the executor on (KUBERNETES_EXECUTOR).
+	Enabled bool `yaml:"enabled"`
+	// APIServer, TokenFile and CAFile locate the cluster. They default to the
+	// in-cluster service account of the server's own pod.
+	APIServer string `yaml:"api_server"`
+	TokenFile string `yaml:"token_file"`
+	CAFile    string `yaml:"ca_file"`
+	// Capacity is how many jobs the executor runs at once.
+	Capacity int `yaml:"capacity"`
+	// Labels are advertised like agent labels, so jobs requiring them run
+	// on the executor.
+	Labels map[string]string `yaml:"labels"`
+	// Default applies to projects without an entry in Projects.
+	Default KubernetesProject `yaml:"default"`
+	// Projects maps "owner/repo" to the settings of its jobs.
+	Projects map[string]KubernetesProject `yaml:"projects"`
+}
+
+// KubernetesProject configures where and with which resources the jobs of a
+// project run.
+type KubernetesProject struct {
+	Namespace      string `yaml:"namespace"`
+	ServiceAccount string `yaml:"service_account"`
+	// CPURequest and MemoryRequest are reserved for every container of a
+	// job, in the units of job resource limits.
+	CPURequest    string `yaml:"cpu_request"`
+	MemoryRequest string `yaml:"memory_request"`
+}
+
+// Project returns the settings for the jobs of project. Empty fields of a
+// project entry fall back to the defaults.
+func (k *Kubernetes) Project(project string) KubernetesProject {
+	p, ok := k.Projects[project]
+	if !ok {
+		return k.Default
+	}
+	if p.Namespace == "" {
+		p.Namespace = k.Default.Namespace
+	}
+	if p.ServiceAccount == "" {
+		p.ServiceAccount = k.Default.ServiceAccount
+	}
+	if p.CPURequest == "" {
+		p.CPURequest = k.Default.CPURequest
+	}
+	if p.MemoryRequest == "" {
+		p.MemoryRequest = k.Default.MemoryRequest
+	}
+	return p
+}
+
+// SCM configures reporting the status of pipeline runs back to the SCM
+// providers their commits came from.
+type SCM struct {
+	// ExternalURL is the base URL the server is reached at, used to link
+	// statuses to their runs (EXTERNAL_URL).
+	ExternalURL string `yaml:"external_url"`
+	// GitHub configures github.com or a GitHub Enterprise Server.
+	GitHub SCMProvider `yaml:"github"`
+	// GitLab configures gitlab.com or a self-managed instance.
+	GitLab SCMProvider `yaml:"gitlab"`
+	// Bitbucket configures the webhooks Bitbucket Cloud delivers.
+	Bitbucket Bitbucket `yaml:"bitbucket"`
+
+	// TemplateRepositories lists the URL prefixes of the repositories
+	// pipeline definitions may include template files from, as in
+	// https://github.com/acme/ (PIPELINE_TEMPLATE_REPOSITORIES, comma
+	// separated). Without any, definitions can only include templates
+	// published on the server.
+	TemplateRepositories []string `yaml:"template_repositories"`
+
+	// DeliveryRetention is how long received webhook deliveries are kept
+	// for inspection and redelivery (WEBHOOK_DELIVERY_RETENTION); 0 keeps
+	// them forever.
+	DeliveryRetention time.Duration `yaml:"delivery_retention"`
+}
+
+// SCMProvider configures the status API of one provider and the webhooks
+// it delivers.
+type SCMProvider struct {
+	// URL is the API base URL for GitHub (GITHUB_API_URL) and the instance
+	// URL for GitLab (GITLAB_URL).
+	URL string `yaml:"url"`
+	// StatusTokens maps "owner/repo" to the access token statuses of its
+	// commits are posted with; "*" applies to unlisted repositories
+	// (GITHUB_STATUS_TOKENS and GITLAB_STATUS_TOKENS, as
+	// "owner/repo=token,*=token"). Repositories without a token get no
+	// statuses.
+	StatusTokens map[string]string `yaml:"status_tokens"`
+	// WebhookSecrets maps "owner/repo" to the secret its webhook deliveries
+	// are verified with, which GitLab sends as a token and GitHub signs
+	// them with; "*" applies to unlisted repositories
+	// (GITHUB_WEBHOOK_SECRETS and GITLAB_WEBHOOK_SECRETS, as
+	// "owner/repo=secret,*=secret"). Deliveries of repositories without a
+	// secret are refused.
+	WebhookSecrets map[string]string `yaml:"webhook_secrets"`
+}
+
+// Bitbucket configures Bitbucket Cloud, which only triggers runs.
+type Bitbucket struct {
+	// WebhookSecrets are the secrets deliveries are signed with, as for the
+	// other providers (BITBUCKET_WEBHOOK_SECRETS).
+	WebhookSecrets map[string]string `yaml:"webhook_secrets"`
+}
+
+// Limits protects the server from clients that call the API too often and
+// projects that submit too many jobs. Zero rates and quotas are unlimited.
+type Limits struct {
+	// TokenRate is the sustained requests per second allowed for each API
+	// token (RATE_LIMIT_TOKEN_RPS), and TokenBurst how many it may make at
+	// once (RATE_LIMIT_TOKEN_BURST).
+	TokenRate  float64 `yaml:"token_rate" reload:"true"`
+	TokenBurst int     `yaml:"token_burst" reload:"true"`
+	// IPRate and IPBurst limit every request, authenticated or not, by
+	// source address (RATE_LIMIT_IP_RPS and RATE_LIMIT_IP_BURST). Rates and
+	// bursts can be changed by reloading.
+	IPRate  float64 `yaml:"ip_rate" reload:"true"`
+	IPBurst int     `yaml:"ip_burst" reload:"true"`
+	// DailyJobs is how many jobs each project may submit per UTC day,
+	// through the API, webhooks or schedules (PROJECT_DAILY_JOB_QUOTA). It
+	// can be changed by reloading.
+	DailyJobs int `yaml:"daily_jobs" reload:"true"`
+	// ProjectDailyJobs overrides DailyJobs for "owner/repo" projects
+	// (PROJECT_DAILY_JOB_QUOTAS, as "owner/repo=500,..."). It can be
+	// changed by reloading.
+	ProjectDailyJobs map[string]int `yaml:"project_daily_jobs" reload:"true"`
+
+	// MaxQueuedJobs is how many jobs may wait for an agent before the queue
+	// counts as saturated (QUEUE_MAX_DEPTH); 0 allows any number. The
+	// queue is also saturated while no agent is online.
+	MaxQueuedJobs int `yaml:"max_queued_jobs" reload:"true"`
+	// RejectWhenSaturated refuses job and pipeline submissions with 503
+	// while the queue is saturated (QUEUE_REJECT_WHEN_SATURATED); otherwise
+	// they are queued with a warning. Both can be changed by reloading.
+	RejectWhenSaturated bool `yaml:"reject_when_saturated" reload:"true"`
+
+	// JobLogLimit caps the output kept in each job's log, as an amount of
+	// bytes such as "100Mi" (JOB_LOG_LIMIT); empty keeps all of it. Jobs
+	// may set a lower limit of their own.
+	JobLogLimit string `yaml:"job_log_limit"`
+
+	// CacheQuotas maps "owner/repo" to the size such as 20GiB its
+	// dependency caches may take, the least recently used being evicted
+	// beyond it; "*" applies to unlisted projects (CACHE_QUOTAS, as
+	// "owner/repo=20GiB,*=5GiB"). Projects without a quota are unlimited.
+	CacheQuotas map[string]string `yaml:"cache_quotas"`
+}
+
+// Audit configures where audit events are forwarded besides the store.
+type Audit struct {
+	// SyslogAddress is "local" for the local syslog daemon, or
+	// udp://host:port or tcp://host:port (AUDIT_SYSLOG_ADDRESS).
+	SyslogAddress string `yaml:"syslog_address"`
+	// WebhookURL receives every event as a JSON POST (AUDIT_WEBHOOK_URL),
+	// signed with WebhookSecret if set (AUDIT_WEBHOOK_SECRET).
+	WebhookURL    string `yaml:"webhook_url"`
+	WebhookSecret string `yaml:"webhook_secret"`
+}
+
+// OIDC configures the OpenID Connect ID tokens jobs get to assume cloud
+// roles. Tokens are only issued with an issuer URL, which cloud providers
+// fetch the discovery documents under /.well-known from.
+type OIDC struct {
+	// Issuer is the issuer URL of the tokens (OIDC_ISSUER); it defaults to
+	// scm.external_url.
+	Issuer string `yaml:"issuer"`
+	// SigningKeyFile holds the PEM RSA private key tokens are signed with
+	// (OIDC_SIGNING_KEY_FILE). Without one the server generates a key on
+	// every start, which clouds only trust until it restarts and which
+	// differs between replicas.
+	SigningKeyFile string `yaml:"signing_key_file"`
+	// TokenLifetime is how long tokens are valid after the job they were
+	// issued to is dispatched (OIDC_TOKEN_LIFETIME).
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+// IssuerURL returns the issuer URL tokens are issued as, empty if none is
+// configured.
+func (o *OIDC) IssuerURL(externalURL string) string {
+	if o.Issuer != "" {
+		return o.Issuer
+	}
+	return externalURL
+}
+
+// Images configures how the build_image steps of pipelines build and push
+// container images.
+type Images struct {
+	// Builder is the BuildKit image the builds run in (IMAGE_BUILDER),
+	// which must provide buildctl-daemonless.sh; it defaults to the rootless
+	// moby/buildkit image.
+	Builder string `yaml:"builder"`
+	// Registry is the host, with an optional port and path, images named
+	// without a registry are pushed to (IMAGE_REGISTRY); without one they
+	// go to Docker Hub.
+	Registry string `yaml:"registry"`
+	// RegistryCredentials maps registry hosts to the "user:password" the
+	// manifests of multi-arch images are read with when steps ask for
+	// resolve_image (IMAGE_REGISTRY_CREDENTIALS, as
+	// "ghcr.io=user:token,docker.io=user:token"). Other registries are read
+	// anonymously.
+	RegistryCredentials map[string]string `yaml:"registry_credentials"`
+}
+
+// Vault configures reading the secrets jobs reference as
+// NAME=vault:<path>#<key> from HashiCorp Vault. It is off unless Address is
+// set.
+type Vault struct {
+	// Address is the URL of the Vault server (VAULT_ADDR).
+	Address string `yaml:"address"`
+	// Namespace is the Vault Enterprise namespace, if any
+	// (VAULT_NAMESPACE).
+	Namespace string `yaml:"namespace"`
+	// CAFile holds the PEM CAs the server certificate is verified against
+	// (VAULT_CACERT).
+	CAFile string `yaml:"ca_file"`
+	// AuthMethod is approle or kubernetes (VAULT_AUTH_METHOD), and
+	// AuthMount the path it is mounted at, which defaults to its name
+	// (VAULT_AUTH_MOUNT).
+	AuthMethod string `yaml:"auth_method"`
+	AuthMount  string `yaml:"auth_mount"`
+	// RoleID and SecretID are the AppRole credentials (VAULT_ROLE_ID and
+	// VAULT_SECRET_ID).
+	RoleID   string `yaml:"role_id"`
+	SecretID string `yaml:"secret_id"`
+	// Role is the Kubernetes auth role (VAULT_ROLE), logged in to with the
+	// service account token in TokenFile, by default that of the server's
+	// own pod (VAULT_KUBERNETES_TOKEN_FILE).
+	Role      string `yaml:"role"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// Secrets configures how project secrets are sealed in the store.
+type Secrets struct {
+	// MasterKeys are the keys secrets are sealed with, as id=base64 entries
+	// of 32 bytes each (SECRETS_MASTER_KEYS, comma-separated). The first
+	// seals new secrets; the others open the secrets sealed before a
+	// rotation. Without any, a key is generated on every start and secrets
+	// do not survive a restart.
+	MasterKeys []string `yaml:"master_keys"`
+}
+
+// Retention says how long the server keeps job output. Each setting maps
+// "owner/repo" to a duration such as 30d or 72h, with "*" applying to
+// unlisted projects; projects without an entry keep the output until the
+// retention policy of the project deletes it.
+type Retention struct {
+	// Logs is the retention of job logs (JOB_LOG_RETENTION, as
+	// "owner/repo=90d,*=30d").
+	Logs map[string]string `yaml:"logs"`
+	// Artifacts is the retention of artifacts, from their upload
+	// (ARTIFACT_RETENTION).
+	Artifacts map[string]string `yaml:"artifacts"`
+	// Snapshots is the retention of the workspace snapshots downstream
+	// stages restore (SNAPSHOT_RETENTION).
+	Snapshots map[string]string `yaml:"snapshots"`
+}
+
+// Notifications configures the SMTP relay email notifications are sent
+// through; email notifiers and notification preferences cannot be set
+// without one, and the server's own recipients.
+type Notifications struct {
+	// SMTPAddress is the relay's host:port (SMTP_ADDRESS). Mail is sent
+	// over TLS when the relay offers STARTTLS.
+	SMTPAddress string `yaml:"smtp_address"`
+	// SMTPFrom is the sender address of notification emails (SMTP_FROM).
+	SMTPFrom string `yaml:"smtp_from"`
+	// SMTPUsername and SMTPPassword authenticate with the relay, if set
+	// (SMTP_USERNAME and SMTP_PASSWORD).
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// EmailTo are mailed the EmailEvents of every project, on top of the
+	// project's own notifiers (NOTIFICATION_EMAIL_TO and
+	// NOTIFICATION_EMAIL_EVENTS, comma-separated). EmailEvents default to
+	// pipeline_failed.
+	EmailTo     []string                  `yaml:"email_to"`
+	EmailEvents []types.NotificationEvent `yaml:"email_events"`
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:                8080,
+			GRPCPort:            9090,
+			ReadTimeout:         15 * time.Second,
+			WriteTimeout:        15 * time.Second,
+			IdleTimeout:         60 * time.Second,
+			ShutdownGracePeriod: 30 * time.Second,
+		},
+		Agents: Agents{
+			HeartbeatInterval: 10 * time.Second,
+			HeartbeatTimeout:  30 * time.Second,
+			MatchTimeout:      10 * time.Minute,
+			StuckTimeout:      time.Hour,
+			Update:            AgentUpdate{Parallel: 1},
+		},
+		Storage: Storage{
+			Logs:      Blobs{S3: S3{Endpoint: "s3.amazonaws.com"}},
+			Artifacts: Blobs{S3: S3{Endpoint: "s3.amazonaws.com"}},
+			Snapshots: Blobs{S3: S3{Endpoint: "s3.amazonaws.com"}},
+			Caches:    Blobs{S3: S3{Endpoint: "s3.amazonaws.com"}},
+		},
+		Auth:    Auth{SessionLifetime: 12 * time.Hour},
+		Logging: Logging{Level: "info", Format: "json"},
+		Kubernetes: Kubernetes{
+			Capacity: 10,
+			Default:  KubernetesProject{Namespace: "default"},
+		},
+		SCM: SCM{
+			GitHub:            SCMProvider{URL: "https://api.github.com"},
+			GitLab:            SCMProvider{URL: "https://gitlab.com"},
+			DeliveryRetention: 30 * 24 * time.Hour,
+		},
+		Limits: Limits{TokenBurst: 20, IPBurst: 50, JobLogLimit: "100Mi"},
+		OIDC:   OIDC{TokenLifetime: time.Hour},
+		Notifications: Notifications{
+			EmailEvents: []types.NotificationEvent{types.EventPipelineFailed},
+		},
+	}
+}
+
+// Load reads the configuration file at path, if path is not empty, applies
+// environment overrides and validates the result. Errors name the field or
+// variable at fault.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := decode(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decode merges a YAML document into cfg, rejecting unknown fields.
+func decode(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return errors.New(strings.Join(typeErr.Errors, "; "))
+		}
+		return err
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with the environment variables that are set.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(key string, dst *string) {
+		if v, ok := lookup(key); ok && v != "" {
+			*dst = v
+		}
+	}
+	port := func(key string, dst *int) {
+		if v, ok := lookup(key); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a port number", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if v, ok := lookup(key); ok && v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration such as 30s", key, v))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	rate := func(key string, dst *float64) {
+		if v, ok := lookup(key); ok && v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", key, v))
+				return
+			}
+			*dst = f
+		}
+	}
+	count := func(key string, dst *int) {
+		if v, ok := lookup(key); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a whole number", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	boolean := func(key string, dst *bool) {
+		if v, ok := lookup(key); ok && v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", key, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	blobs := func(prefix string, dst *Blobs) {
+		str(prefix+"_DIR", &dst.Dir)
+		str(prefix+"_S3_BUCKET", &dst.S3.Bucket)
+		str(prefix+"_S3_ENDPOINT", &dst.S3.Endpoint)
+		str(prefix+"_S3_REGION", &dst.S3.Region)
+		str(prefix+"_S3_PREFIX", &dst.S3.Prefix)
+		boolean(prefix+"_S3_INSECURE", &dst.S3.Insecure)
+	}
+
+	pairs := func(key string, dst *map[string]string) {
+		if v, ok := lookup(key); ok && v != "" {
+			m := make(map[string]string)
+			for _, pair := range strings.Split(v, ",") {
+				pair = strings.TrimSpace(pair)
+				if pair == "" {
+					continue
+				}
+				k, value, ok := strings.Cut(pair, "=")
+				if !ok || k == "" || value == "" {
+					errs = append(errs, fmt.Errorf("%s: invalid entry %q, want key=value", key, pair))
+					return
+				}
+				m[k] = value
+			}
+			*dst = m
+		}
+	}
+
+	port("PORT", &c.Server.Port)
+	port("GRPC_PORT", &c.Server.GRPCPort)
+	duration("SHUTDOWN_GRACE_PERIOD", &c.Server.ShutdownGracePeriod)
+	str("TLS_CERT_FILE", &c.Server.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.Server.TLS.KeyFile)
+	if v, ok := lookup("TLS_AUTOCERT_HOSTS"); ok && v != "" {
+		c.Server.TLS.AutocertHosts = strings.Split(v, ",")
+	}
+	str("TLS_AUTOCERT_CACHE_DIR", &c.Server.TLS.AutocertCacheDir)
+	str("TLS_AUTOCERT_EMAIL", &c.Server.TLS.AutocertEmail)
+	str("TLS_CLIENT_CA_FILE", &c.Server.TLS.ClientCAFile)
+	str("DATABASE_URL", &c.Storage.DatabaseURL)
+	blobs("JOB_LOG", &c.Storage.Logs)
+	blobs("ARTIFACT", &c.Storage.Artifacts)
+	blobs("SNAPSHOT", &c.Storage.Snapshots)
+	blobs("CACHE", &c.Storage.Caches)
+	str("ADMIN_TOKEN", &c.Auth.AdminToken)
+	if v, ok := lookup("AGENT_REGISTRATION_TOKENS"); ok && v != "" {
+		c.Auth.AgentRegistrationTokens = strings.Split(v, ",")
+	}
+	duration("AUTH_SESSION_LIFETIME", &c.Auth.SessionLifetime)
+	str("ARTIFACT_SIGNING_KEY", &c.Auth.ArtifactSigningKey)
+	str("BADGE_SIGNING_KEY", &c.Auth.BadgeSigningKey)
+	duration("AGENT_HEARTBEAT_INTERVAL", &c.Agents.HeartbeatInterval)
+	duration("AGENT_HEARTBEAT_TIMEOUT", &c.Agents.HeartbeatTimeout)
+	duration("AGENT_MATCH_TIMEOUT", &c.Agents.MatchTimeout)
+	duration("AGENT_STUCK_TIMEOUT", &c.Agents.StuckTimeout)
+	str("AGENT_MIN_VERSION", &c.Agents.MinVersion)
+	str("AGENT_JOB_SIGNING_KEY", &c.Agents.JobSigningKey)
+	str("AGENT_UPDATE_DIR", &c.Agents.Update.Dir)
+	str("AGENT_UPDATE_VERSION", &c.Agents.Update.Version)
+	str("AGENT_SIGNING_KEY", &c.Agents.Update.SigningKey)
+	count("AGENT_UPDATE_PARALLEL", &c.Agents.Update.Parallel)
+	str("VAULT_ADDR", &c.Vault.Address)
+	str("VAULT_NAMESPACE", &c.Vault.Namespace)
+	str("VAULT_CACERT", &c.Vault.CAFile)
+	str("VAULT_AUTH_METHOD", &c.Vault.AuthMethod)
+	str("VAULT_AUTH_MOUNT", &c.Vault.AuthMount)
+	str("VAULT_ROLE_ID", &c.Vault.RoleID)
+	str("VAULT_SECRET_ID", &c.Vault.SecretID)
+	str("VAULT_ROLE", &c.Vault.Role)
+	str("VAULT_KUBERNETES_TOKEN_FILE", &c.Vault.TokenFile)
+	if v, ok := lookup("SECRETS_MASTER_KEYS"); ok && v != "" {
+		c.Secrets.MasterKeys = strings.Split(v, ",")
+	}
+	pairs("JOB_LOG_RETENTION", &c.Retention.Logs)
+	pairs("ARTIFACT_RETENTION", &c.Retention.Artifacts)
+	pairs("SNAPSHOT_RETENTION", &c.Retention.Snapshots)
+	str("LOG_LEVEL", &c.Logging.Level)
+	str("LOG_FORMAT", &c.Logging.Format)
+	if v, ok := lookup("KUBERNETES_EXECUTOR"); ok && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("KUBERNETES_EXECUTOR: %q is not a boolean", v))
+		}
+		c.Kubernetes.Enabled = enabled
+	}
+	str("EXTERNAL_URL", &c.SCM.ExternalURL)
+	str("GITHUB_API_URL", &c.SCM.GitHub.URL)
+	str("GITLAB_URL", &c.SCM.GitLab.URL)
+	pairs("GITHUB_STATUS_TOKENS", &c.SCM.GitHub.StatusTokens)
+	pairs("GITLAB_STATUS_TOKENS", &c.SCM.GitLab.StatusTokens)
+	pairs("GITHUB_WEBHOOK_SECRETS", &c.SCM.GitHub.WebhookSecrets)
+	pairs("GITLAB_WEBHOOK_SECRETS", &c.SCM.GitLab.WebhookSecrets)
+	pairs("BITBUCKET_WEBHOOK_SECRETS", &c.SCM.Bitbucket.WebhookSecrets)
+	if v, ok := lookup("PIPELINE_TEMPLATE_REPOSITORIES"); ok && v != "" {
+		c.SCM.TemplateRepositories = strings.Split(v, ",")
+	}
+	duration("WEBHOOK_DELIVERY_RETENTION", &c.SCM.DeliveryRetention)
+	str("AUDIT_SYSLOG_ADDRESS", &c.Audit.SyslogAddress)
+	str("AUDIT_WEBHOOK_URL", &c.Audit.WebhookURL)
+	str("AUDIT_WEBHOOK_SECRET", &c.Audit.WebhookSecret)
+	str("SMTP_ADDRESS", &c.Notifications.SMTPAddress)
+	str("SMTP_FROM", &c.Notifications.SMTPFrom)
+	str("SMTP_USERNAME", &c.Notifications.SMTPUsername)
+	str("SMTP_PASSWORD", &c.Notifications.SMTPPassword)
+	if v, ok := lookup("NOTIFICATION_EMAIL_TO"); ok && v != "" {
+		c.Notifications.EmailTo = strings.Split(v, ",")
+	}
+	if v, ok := lookup("NOTIFICATION_EMAIL_EVENTS"); ok && v != "" {
+		c.Notifications.EmailEvents = nil
+		for _, event := range strings.Split(v, ",") {
+			c.Notifications.EmailEvents = append(c.Notifications.EmailEvents, types.NotificationEvent(event))
+		}
+	}
+	str("OIDC_ISSUER", &c.OIDC.Issuer)
+	str("OIDC_SIGNING_KEY_FILE", &c.OIDC.SigningKeyFile)
+	duration("OIDC_TOKEN_LIFETIME", &c.OIDC.TokenLifetime)
+	str("IMAGE_BUILDER", &c.Images.Builder)
+	str("IMAGE_REGISTRY", &c.Images.Registry)
+	pairs("IMAGE_REGISTRY_CREDENTIALS", &c.Images.RegistryCredentials)
+	rate("RATE_LIMIT_TOKEN_RPS", &c.Limits.TokenRate)
+	count("RATE_LIMIT_TOKEN_BURST", &c.Limits.TokenBurst)
+	rate("RATE_LIMIT_IP_RPS", &c.Limits.IPRate)
+	count("RATE_LIMIT_IP_BURST", &c.Limits.IPBurst)
+	count("PROJECT_DAILY_JOB_QUOTA", &c.Limits.DailyJobs)
+	count("QUEUE_MAX_DEPTH", &c.Limits.MaxQueuedJobs)
+	str("JOB_LOG_LIMIT", &c.Limits.JobLogLimit)
+	pairs("CACHE_QUOTAS", &c.Limits.CacheQuotas)
+	if v, ok := lookup("QUEUE_REJECT_WHEN_SATURATED"); ok && v != "" {
+		reject, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("QUEUE_REJECT_WHEN_SATURATED: %q is not a boolean", v))
+		}
+		c.Limits.RejectWhenSaturated = reject
+	}
+	var quotas map[string]string
+	pairs("PROJECT_DAILY_JOB_QUOTAS", &quotas)
+	if quotas != nil {
+		c.Limits.ProjectDailyJobs = make(map[string]int, len(quotas))
+		for project, v := range quotas {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("PROJECT_DAILY_JOB_QUOTAS: %q is not a whole number for %s", v, project))
+				continue
+			}
+			c.Limits.ProjectDailyJobs[project] = n
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for _, p := range []struct {
+		name  string
+		value int
+	}{
+		{"server.port", c.Server.Port},
+		{"server.grpc_port", c.Server.GRPCPort},
+	} {
+		if p.value < 1 || p.value > 65535 {
+			addf("%s: %d is not between 1 and 65535", p.name, p.value)
+		}
+	}
+	if c.Server.Port == c.Server.GRPCPort {
+		addf("server.grpc_port: must differ from server.port (%d)", c.Server.Port)
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_grace_period", c.Server.ShutdownGracePeriod},
+		{"agents.heartbeat_interval", c.Agents.HeartbeatInterval},
+		{"agents.heartbeat_timeout", c.Agents.HeartbeatTimeout},
+	} {
+		if d.value <= 0 {
+			addf("%s: must be a positive duration", d.name)
+		}
+	}
+	if c.Agents.MatchTimeout < 0 {
+		addf("agents.match_timeout: must not be negative")
+	}
+	if c.Agents.StuckTimeout < 0 {
+		addf("agents.stuck_timeout: must not be negative")
+	}
+	if c.Agents.HeartbeatTimeout <= c.Agents.HeartbeatInterval {
+		addf("agents.heartbeat_timeout: %s must be longer than agents.heartbeat_interval (%s)", c.Agents.HeartbeatTimeout, c.Agents.HeartbeatInterval)
+	}
+
+	errs = append(errs, c.Server.TLS.validate()...)
+	errs = append(errs, c.Agents.validate(c.SCM.ExternalURL)...)
+
+	url := c.Storage.DatabaseURL
+	switch {
+	case url == "", strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+	case strings.HasPrefix(url, "sqlite://"):
+		if path := strings.TrimPrefix(url, "sqlite://"); path == "" || strings.Contains(path, "?") {
+			addf("storage.database_url: sqlite:// must be followed by the path of the database file")
+		}
+	default:
+		addf("storage.database_url: must be a postgres://, postgresql:// or sqlite:// URL")
+	}
+	for _, b := range []struct {
+		name  string
+		value Blobs
+	}{
+		{"storage.logs", c.Storage.Logs},
+		{"storage.artifacts", c.Storage.Artifacts},
+		{"storage.snapshots", c.Storage.Snapshots},
+		{"storage.caches", c.Storage.Caches},
+	} {
+		switch {
+		case b.value.Dir != "" && b.value.S3.Bucket != "":
+			addf("%s: dir and s3.bucket cannot be set together", b.name)
+		case b.value.S3.Bucket != "" && b.value.S3.Endpoint == "":
+			addf("%s.s3.endpoint: is required with s3.bucket", b.name)
+		case url != "" && !b.value.Durable():
+			addf("%s: dir or s3.bucket is required with storage.database_url, or the stored %s are lost with the temporary directory", b.name, strings.TrimPrefix(b.name, "storage."))
+		}
+	}
+	for i, t := range c.Auth.AgentRegistrationTokens {
+		if strings.TrimSpace(t) == "" {
+			addf("auth.agent_registration_tokens[%d]: token is empty", i)
+		}
+	}
+	errs = append(errs, c.Auth.validate(c.SCM.ExternalURL)...)
+
+	if r := c.Images.Registry; strings.Contains(r, "://") || strings.ContainsAny(r, " \t@") {
+		addf("images.registry: %q must be a registry host such as ghcr.io or registry.example.com:5000", r)
+	}
+	if strings.TrimSpace(c.Images.Builder) != c.Images.Builder {
+		addf("images.builder: %q has surrounding whitespace", c.Images.Builder)
+	}
+	for host, credentials := range c.Images.RegistryCredentials {
+		if user, _, ok := strings.Cut(credentials, ":"); !ok || user == "" {
+			addf("images.registry_credentials[%s]: want user:password", host)
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		addf("logging.level: %v", err)
+	}
+	if f := strings.ToLower(c.Logging.Format); f != "json" && f != "text" {
+		addf("logging.format: unknown format %q, expected json or text", c.Logging.Format)
+	}
+
+	if c.Kubernetes.Enabled {
+		errs = append(errs, c.Kubernetes.validate()...)
+	}
+
+	errs = append(errs, c.Limits.validate()...)
+	if c.SCM.DeliveryRetention < 0 {
+		addf("scm.delivery_retention: %s must not be negative", c.SCM.DeliveryRetention)
+	}
+	for _, w := range []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{"scm.github.webhook_secrets", c.SCM.GitHub.WebhookSecrets},
+		{"scm.gitlab.webhook_secrets", c.SCM.GitLab.WebhookSecrets},
+		{"scm.bitbucket.webhook_secrets", c.SCM.Bitbucket.WebhookSecrets},
+	} {
+		for _, repo := range slices.Sorted(maps.Keys(w.secrets)) {
+			if w.secrets[repo] == "" {
+				addf("%s.%s: secret is empty", w.name, repo)
+			}
+		}
+	}
+	if l := c.OIDC.TokenLifetime; l < time.Minute || l > 24*time.Hour {
+		addf("oidc.token_lifetime: %s must be between 1m and 24h", l)
+	}
+	if addr := c.Audit.SyslogAddress; addr != "" && addr != "local" {
+		if parsed, err := neturl.Parse(addr); err != nil || (parsed.Scheme != "udp" && parsed.Scheme != "tcp") || parsed.Host == "" {
+			addf("audit.syslog_address: %q is not local, udp://host:port or tcp://host:port", addr)
+		}
+	}
+
+	if n := c.Notifications; n.SMTPAddress != "" {
+		if _, _, err := net.SplitHostPort(n.SMTPAddress); err != nil {
+			addf("notifications.smtp_address: %q is not host:port", n.SMTPAddress)
+		}
+		if _, err := mail.ParseAddress(n.SMTPFrom); err != nil {
+			addf("notifications.smtp_from: %q is not an email address", n.SMTPFrom)
+		}
+	}
+	if n := c.Notifications; len(n.EmailTo) > 0 {
+		if n.SMTPAddress == "" {
+			addf("notifications.email_to: smtp_address is required to send email")
+		}
+		for _, addr := range n.EmailTo {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				addf("notifications.email_to: %q is not an email address", addr)
+			}
+		}
+		if len(n.EmailEvents) == 0 {
+			addf("notifications.email_events: at least one event is required with email_to")
+		}
+		for _, event := range n.EmailEvents {
+			if !slices.Contains(types.UserEvents, event) {
+				addf("notifications.email_events: %q is not one of %v", event, types.UserEvents)
+			}
+		}
+	}
+
+	if keys := c.Secrets.MasterKeys; len(keys) > 0 {
+		if _, err := secrets.ParseLocalKeys(strings.Join(keys, ",")); err != nil {
+			addf("secrets.master_keys: %v", err)
+		}
+	}
+	for _, r := range []struct {
+		name  string
+		value map[string]string
+	}{
+		{"retention.logs", c.Retention.Logs},
+		{"retention.artifacts", c.Retention.Artifacts},
+		{"retention.snapshots", c.Retention.Snapshots},
+	} {
+		if _, err := artifacts.NewRetention(r.value); err != nil {
+			addf("%s: %v", r.name, err)
+		}
+	}
+
+	if v := c.Vault; v.Address != "" {
+		switch v.AuthMethod {
+		case "approle":
+			if v.RoleID == "" || v.SecretID == "" {
+				addf("vault: role_id and secret_id are required with the approle auth method")
+			}
+		case "kubernetes":
+			if v.Role == "" {
+				addf("vault.role: is required with the kubernetes auth method")
+			}
+		default:
+			addf("vault.auth_method: unknown method %q, expected approle or kubernetes", v.AuthMethod)
+		}
+	}
+
+	for _, u := range []struct {
+		name     string
+		value    string
+		required bool
+	}{
+		{"scm.external_url", c.SCM.ExternalURL, false},
+		{"oidc.issuer", c.OIDC.Issuer, false},
+		{"scm.github.url", c.SCM.GitHub.URL, true},
+		{"scm.gitlab.url", c.SCM.GitLab.URL, true},
+		{"audit.webhook_url", c.Audit.WebhookURL, false},
+		{"vault.address", c.Vault.Address, false},
+	} {
+		if u.value == "" && !u.required {
+			continue
+		}
+		if parsed, err := neturl.Parse(u.value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			addf("%s: %q is not an http or https URL", u.name, u.value)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ssoNamePattern matches the names of SSO providers, which appear in URLs.
+var ssoNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+func (a *Auth) validate(externalURL string) []error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if l := a.SessionLifetime; l < 5*time.Minute || l > 30*24*time.Hour {
+		addf("auth.session_lifetime: %s must be between 5m and 720h", l)
+	}
+	if a.ArtifactSigningKey != "" {
+		if _, err := artifacts.ParseSigningKey(a.ArtifactSigningKey); err != nil {
+			addf("auth.artifact_signing_key: %v", err)
+		}
+	}
+	if a.BadgeSigningKey != "" {
+		if _, err := artifacts.ParseSigningKey(a.BadgeSigningKey); err != nil {
+			addf("auth.badge_signing_key: %v", err)
+		}
+	}
+	if len(a.SSO) > 0 && externalURL == "" {
+		addf("auth.sso: scm.external_url is required for providers to redirect back to")
+	}
+	seen := make(map[string]bool)
+	for i, p := range a.SSO {
+		field := fmt.Sprintf("auth.sso[%d]", i)
+		switch {
+		case !ssoNamePattern.MatchString(p.Name):
+			addf("%s.name: %q must be lowercase letters, digits and dashes", field, p.Name)
+		case seen[p.Name]:
+			addf("%s.name: provider %q is configured twice", field, p.Name)
+		}
+		seen[p.Name] = true
+		if parsed, err := neturl.Parse(p.Issuer); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			addf("%s.issuer: %q is not an http or https URL", field, p.Issuer)
+		}
+		if p.ClientID == "" {
+			addf("%s.client_id: is required", field)
+		}
+	}
+	for i, d := range a.LDAP {
+		field := fmt.Sprintf("auth.ldap[%d]", i)
+		switch {
+		case !ssoNamePattern.MatchString(d.Name):
+			addf("%s.name: %q must be lowercase letters, digits and dashes", field, d.Name)
+		case seen[d.Name]:
+			addf("%s.name: provider %q is configured twice", field, d.Name)
+		}
+		seen[d.Name] = true
+		parsed, err := neturl.Parse(d.URL)
+		switch {
+		case err != nil || (parsed.Scheme != "ldap" && parsed.Scheme != "ldaps") || parsed.Host == "":
+			addf("%s.url: %q is not an ldap or ldaps URL", field, d.URL)
+		case d.StartTLS && parsed.Scheme == "ldaps":
+			addf("%s.start_tls: ldaps URLs already use TLS", field)
+		}
+		if (d.BindDN == "") != (d.BindPassword == "") {
+			addf("%s: bind_dn and bind_password must be set together", field)
+		}
+		if d.UserBaseDN == "" {
+			addf("%s.user_base_dn: is required", field)
+		}
+		if d.UserFilter != "" && !strings.Contains(d.UserFilter, "{username}") {
+			addf("%s.user_filter: %q must contain {username}", field, d.UserFilter)
+		}
+		if d.GroupFilter != "" && !strings.Contains(d.GroupFilter, "{dn}") && !strings.Contains(d.GroupFilter, "{username}") {
+			addf("%s.group_filter: %q must contain {dn} or {username}", field, d.GroupFilter)
+		}
+	}
+	return errs
+}
+
+func (t *TLS) validate() []error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		addf("server.tls: cert_file and key_file must be set together")
+	}
+	if t.CertFile != "" && len(t.AutocertHosts) > 0 {
+		addf("server.tls.autocert_hosts: cannot be combined with cert_file")
+	}
+	for i, host := range t.AutocertHosts {
+		if strings.TrimSpace(host) == "" {
+			addf("server.tls.autocert_hosts[%d]: host is empty", i)
+		}
+	}
+	if len(t.AutocertHosts) > 0 && t.AutocertCacheDir == "" {
+		addf("server.tls.autocert_cache_dir: is required with autocert_hosts")
+	}
+	if t.ClientCAFile != "" && !t.Enabled() {
+		addf("server.tls.client_ca_file: requires cert_file or autocert_hosts")
+	}
+	return errs
+}
+
+func (a *Agents) validate(externalURL string) []error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if a.MinVersion != "" {
+		if _, err := version.Parse(a.MinVersion); err != nil {
+			addf("agents.min_version: %v", err)
+		}
+	}
+	if a.JobSigningKey != "" {
+		if _, err := releases.ParseSigningKey(a.JobSigningKey); err != nil {
+			addf("agents.job_signing_key: %v", err)
+		}
+	}
+	u := a.Update
+	if u.Dir == "" {
+		return errs
+	}
+	if _, err := version.Parse(u.Version); err != nil {
+		addf("agents.update.version: %v", err)
+	}
+	if u.SigningKey == "" {
+		addf("agents.update.signing_key: is required with agents.update.dir")
+	} else if _, err := releases.ParseSigningKey(u.SigningKey); err != nil {
+		addf("agents.update.signing_key: %v", err)
+	}
+	if u.Parallel < 1 {
+		addf("agents.update.parallel: must be at least 1")
+	}
+	// Agents are sent the download URL under the external URL.
+	if externalURL == "" {
+		addf("scm.external_url: is required with agents.update.dir")
+	}
+	return errs
+}
+
+func (l *Limits) validate() []error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	for _, r := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"limits.token", l.TokenRate, l.TokenBurst},
+		{"limits.ip", l.IPRate, l.IPBurst},
+	} {
+		if r.rate < 0 {
+			addf("%s_rate: must not be negative", r.name)
+		}
+		if r.rate > 0 && r.burst < 1 {
+			addf("%s_burst: must be at least 1", r.name)
+		}
+	}
+	if l.DailyJobs < 0 {
+		addf("limits.daily_jobs: must not be negative")
+	}
+	if l.MaxQueuedJobs < 0 {
+		addf("limits.max_queued_jobs: must not be negative")
+	}
+	if l.JobLogLimit != "" {
+		if _, err := types.ParseLogLimit(l.JobLogLimit); err != nil {
+			addf("limits.job_log_limit: %v", err)
+		}
+	}
+	if _, err := cache.NewQuotas(l.CacheQuotas); err != nil {
+		addf("limits.cache_quotas: %v", err)
+	}
+	projects := make([]string, 0, len(l.ProjectDailyJobs))
+	for project := range l.ProjectDailyJobs {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		if l.ProjectDailyJobs[project] < 0 {
+			addf("limits.project_daily_jobs.%s: must not be negative", project)
+		}
+	}
+	return errs
+}
+
+// dnsLabel matches Kubernetes namespace and service account names.
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func (k *Kubernetes) validate() []error {
+	var errs []error
+	addf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if k.Capacity < 1 {
+		addf("kubernetes.capacity: must be at least 1")
+	}
+	if err := types.ValidateLabels(k.Labels); err != nil {
+		addf("kubernetes.labels: %v", err)
+	}
+	if k.Default.Namespace == "" {
+		addf("kubernetes.default.namespace: is required")
+	}
+	check := func(path string, p KubernetesProject) {
+		if p.Namespace != "" && !dnsLabel.MatchString(p.Namespace) {
+			addf("%s.namespace: %q is not a valid namespace name", path, p.Namespace)
+		}
+		if p.ServiceAccount != "" && !dnsLabel.MatchString(p.ServiceAccount) {
+			addf("%s.service_account: %q is not a valid service account name", path, p.ServiceAccount)
+		}
+		if _, _, err := (&types.Resources{CPU: p.CPURequest}).Limits(); err != nil {
+			addf("%s.cpu_request: %v", path, err)
+		}
+		if _, _, err := (&types.Resources{Memory: p.MemoryRequest}).Limits(); err != nil {
+			addf("%s.memory_request: %v", path, err)
+		}
+	}
+	check("kubernetes.default", k.Default)
+	projects := make([]string, 0, len(k.Projects))
+	for name := range k.Projects {
+		projects = append(projects, name)
+	}
+	sort.Strings(projects)
+	for _, name := range projects {
+		check("kubernetes.projects."+name, k.Projects[name])
+	}
+	return errs
+}
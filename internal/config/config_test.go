@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStorageBlobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"in-memory storage in the temporary directory", nil, ""},
+		{"durable database and blobs", map[string]string{
+			"DATABASE_URL":      "sqlite:///var/lib/open-cicd/db",
+			"JOB_LOG_DIR":       "/var/lib/open-cicd/logs",
+			"ARTIFACT_DIR":      "/var/lib/open-cicd/artifacts",
+			"SNAPSHOT_DIR":      "/var/lib/open-cicd/snapshots",
+			"CACHE_S3_BUCKET":   "caches",
+			"CACHE_S3_REGION":   "eu-west-1",
+			"CACHE_S3_INSECURE": "true",
+		}, ""},
+		{"durable database and blobs in the temporary directory", map[string]string{
+			"DATABASE_URL": "sqlite:///var/lib/open-cicd/db",
+			"JOB_LOG_DIR":  "/var/lib/open-cicd/logs",
+		}, "storage.artifacts: dir or s3.bucket is required"},
+		{"directory and bucket", map[string]string{
+			"ARTIFACT_DIR":       "/var/lib/open-cicd/artifacts",
+			"ARTIFACT_S3_BUCKET": "artifacts",
+		}, "storage.artifacts: dir and s3.bucket cannot be set together"},
+		{"insecure not a boolean", map[string]string{"CACHE_S3_INSECURE": "maybe"}, "CACHE_S3_INSECURE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			err := cfg.applyEnv(func(key string) (string, bool) {
+				v, ok := tt.env[key]
+				return v, ok
+			})
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("config error = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("config error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := Default()
+	env := map[string]string{"CACHE_S3_BUCKET": "caches", "CACHE_S3_PREFIX": "ci/"}
+	if err := cfg.applyEnv(func(key string) (string, bool) { v, ok := env[key]; return v, ok }); err != nil {
+		t.Fatalf("applyEnv: %v", err)
+	}
+	if s3 := cfg.Storage.Caches.S3; s3.Bucket != "caches" || s3.Prefix != "ci/" || s3.Endpoint != "s3.amazonaws.com" {
+		t.Errorf("caches bucket = %+v, want caches under ci/ at the default endpoint", s3)
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Reloader re-reads the configuration on SIGHUP and hands the new values to
+// the parts of the server that can apply them without a restart. Settings
+// that need a restart are reported and otherwise ignored.
+type Reloader struct {
+	path string
+
+	mu      sync.Mutex
+	current *Config
+	hooks   []func(*Config) error
+}
+
+// NewReloader returns a Reloader for the file at path, holding initial as
+// the configuration in effect.
+func NewReloader(path string, initial *Config) *Reloader {
+	return &Reloader{path: path, current: initial}
+}
+
+// Current returns the configuration in effect.
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// OnReload registers fn to apply a reloaded configuration. Hooks run in
+// registration order; an error is logged and does not stop the others.
+func (r *Reloader) OnReload(fn func(*Config) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+// Run reloads the configuration on every SIGHUP until ctx is cancelled.
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				slog.Error("Reloading configuration failed; keeping the current one", "error", err)
+			}
+		}
+	}
+}
+
+// Reload loads and validates the configuration and, if it is valid, applies
+// it. An invalid configuration leaves the current one in effect.
+func (r *Reloader) Reload() error {
+	next, err := Load(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, field := range restartRequired(r.current, next) {
+		slog.Warn("Configuration change needs a restart to take effect", "field", field)
+	}
+	for _, hook := range r.hooks {
+		if err := hook(next); err != nil {
+			slog.Error("Applying reloaded configuration", "error", err)
+		}
+	}
+	r.current = next
+	slog.Info("Reloaded configuration", "file", r.path)
+	return nil
+}
+
+// restartRequired lists the sections, or fields, that differ between old and
+// next but are only read at startup. Fields tagged reload:"true" are applied
+// by the hooks; a section holding any is compared field by field, others as
+// a whole.
+func restartRequired(old, next *Config) []string {
+	return changedFields(reflect.ValueOf(*old), reflect.ValueOf(*next), "")
+}
+
+func changedFields(old, next reflect.Value, prefix string) []string {
+	var changed []string
+	for i := range old.NumField() {
+		f := old.Type().Field(i)
+		if f.Tag.Get("reload") == "true" {
+			continue
+		}
+		name := prefix + strings.Split(f.Tag.Get("yaml"), ",")[0]
+		switch {
+		case f.Type.Kind() == reflect.Struct && reloadable(f.Type):
+			changed = append(changed, changedFields(old.Field(i), next.Field(i), name+".")...)
+		case !reflect.DeepEqual(old.Field(i).Interface(), next.Field(i).Interface()):
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reloadable reports whether any field of the struct type t can be changed
+// by reloading.
+func reloadable(t reflect.Type) bool {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Tag.Get("reload") == "true" || (f.Type.Kind() == reflect.Struct && reloadable(f.Type)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   []string
+	}{
+		{"nothing", func(*Config) {}, nil},
+		{"log level", func(c *Config) { c.Logging.Level = "debug" }, nil},
+		{"log format", func(c *Config) { c.Logging.Format = "text" }, []string{"logging.format"}},
+		{"agent settings", func(c *Config) {
+			c.Agents.MatchTimeout = time.Minute
+			c.Agents.MinVersion = "1.2.0"
+			c.Agents.HeartbeatInterval = time.Second
+			c.Agents.Update.Parallel = 4
+		}, []string{"agents.heartbeat_interval", "agents.update"}},
+		{"limits", func(c *Config) {
+			c.Limits.IPRate = 5
+			c.Limits.ProjectDailyJobs = map[string]int{"acme/app": 10}
+			c.Limits.CacheQuotas = map[string]string{"*": "5GiB"}
+		}, []string{"limits.cache_quotas"}},
+		{"blob storage", func(c *Config) { c.Storage.Artifacts.Dir = "/var/lib/open-cicd/artifacts" }, []string{"storage"}},
+		{"sections", func(c *Config) {
+			c.Server.Port = 8081
+			c.Retention.Logs = map[string]string{"*": "30d"}
+		}, []string{"server", "retention"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := Default()
+			tt.change(next)
+			if got := restartRequired(Default(), next); !slices.Equal(got, tt.want) {
+				t.Errorf("restartRequired = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRestartRequiredCoversConfig changes every setting in turn, so that a
+// section added to Config without a reload tag is reported rather than
+// silently ignored on reload.
+func TestRestartRequiredCoversConfig(t *testing.T) {
+	var walk func(path string, typ reflect.Type, field func(*Config) reflect.Value)
+	walk = func(path string, typ reflect.Type, field func(*Config) reflect.Value) {
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			name := path + f.Tag.Get("yaml")
+			at := func(c *Config) reflect.Value { return field(c).Field(i) }
+			if f.Type.Kind() == reflect.Struct {
+				walk(name+".", f.Type, at)
+				continue
+			}
+			next := Default()
+			v := at(next)
+			switch v.Kind() {
+			case reflect.String:
+				v.SetString(v.String() + "x")
+			case reflect.Bool:
+				v.SetBool(!v.Bool())
+			case reflect.Int, reflect.Int64:
+				v.SetInt(v.Int() + 1)
+			case reflect.Float64:
+				v.SetFloat(v.Float() + 1)
+			case reflect.Slice:
+				v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+			case reflect.Map:
+				m := reflect.MakeMap(v.Type())
+				m.SetMapIndex(reflect.ValueOf("x").Convert(v.Type().Key()), reflect.Zero(v.Type().Elem()))
+				v.Set(m)
+			default:
+				t.Fatalf("%s: cannot change a %s", name, v.Kind())
+			}
+			changed := restartRequired(Default(), next)
+			if reload := f.Tag.Get("reload") == "true"; reload != (len(changed) == 0) {
+				t.Errorf("changing %s (reload tag %v) needs a restart of %q", name, reload, changed)
+			}
+		}
+	}
+	walk("", reflect.TypeFor[Config](), func(c *Config) reflect.Value { return reflect.ValueOf(c).Elem() })
+}
@@ -0,0 +1,320 @@
+// Package credentials keeps the credentials the server reaches SCM
+// providers with, for the projects of an organization or for one project:
+// access tokens, SSH deploy keys and GitHub App installations. They are
+// sealed like secrets. The scm Reporter posts commit statuses with them,
+// the webhooks fetcher clones with them and project bootstrapping
+// registers webhooks with them.
+package credentials
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/scm"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// refreshBefore is how long before they expire installation tokens are
+// replaced, so that a token handed out lasts the request it is for.
+const refreshBefore = 5 * time.Minute
+
+// ErrWrongOrganization is returned when a project credential is stored for
+// an organization the project does not belong to.
+var ErrWrongOrganization = errors.New("project belongs to another organization")
+
+// Sealer encrypts values at rest, as secrets.Service does.
+type Sealer interface {
+	Seal(ctx context.Context, value, additional []byte) (types.SealedValue, error)
+	Open(ctx context.Context, sealed types.SealedValue, additional []byte) ([]byte, error)
+}
+
+// Organizations looks up organizations and the projects they own, as
+// orgs.Service does.
+type Organizations interface {
+	Get(ctx context.Context, name string) (*types.Organization, error)
+	GetProject(ctx context.Context, name string) (*types.Project, error)
+}
+
+// AppTokenIssuer issues GitHub App installation tokens, as scm.GitHub
+// does.
+type AppTokenIssuer interface {
+	InstallationToken(ctx context.Context, appID, installationID int64, key *rsa.PrivateKey) (string, time.Time, error)
+}
+
+// provider is a registered provider.
+type provider struct {
+	host string
+	// username is what git sends with a token over HTTPS.
+	username string
+	apps     AppTokenIssuer
+}
+
+// appToken is an installation token and the credential it was issued for.
+type appToken struct {
+	token     string
+	expires   time.Time
+	updatedAt time.Time
+}
+
+// Service stores credentials and hands them out for repositories.
+type Service struct {
+	store     storage.SCMCredentialStore
+	sealer    Sealer
+	orgs      Organizations
+	now       func() time.Time
+	providers map[string]provider
+
+	mu     sync.Mutex
+	tokens map[string]appToken
+}
+
+// NewService returns a Service that keeps credentials in store, sealed by
+// sealer, for the organizations and projects of orgs.
+func NewService(store storage.SCMCredentialStore, sealer Sealer, orgs Organizations) *Service {
+	return &Service{
+		store:     store,
+		sealer:    sealer,
+		orgs:      orgs,
+		now:       time.Now,
+		providers: make(map[string]provider),
+		tokens:    make(map[string]appToken),
+	}
+}
+
+// Register hands out the credentials of the named provider, as in
+// types.Trigger.Provider, for repositories cloned from host. git sends
+// tokens over HTTPS with username; apps issues the installation tokens of
+// github_app credentials, and is nil for providers without apps. It must
+// be called before the Service is used.
+func (s *Service) Register(name, host, username string, apps AppTokenIssuer) {
+	s.providers[name] = provider{host: strings.ToLower(host), username: username, apps: apps}
+}
+
+// additionalData binds a sealed credential to its organization, project
+// and provider.
+func additionalData(organization, project, provider string) []byte {
+	return []byte(organization + "\x00" + project + "\x00" + provider)
+}
+
+// Put stores the credential req describes for provider, replacing any
+// earlier one, as the organization's if project is empty and as the
+// project's otherwise, on behalf of updatedBy. It fails with
+// storage.ErrNotFound if the organization or project does not exist and
+// ErrWrongOrganization if the project is another organization's.
+func (s *Service) Put(ctx context.Context, organization, project, provider string, req types.PutSCMCredentialRequest, updatedBy string) (*types.SCMCredential, error) {
+	if err := req.Validate(provider); err != nil {
+		return nil, err
+	}
+	if err := s.checkScope(ctx, organization, project); err != nil {
+		return nil, err
+	}
+	sealed, err := s.sealer.Seal(ctx, []byte(req.Secret()), additionalData(organization, project, provider))
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	credential := &types.SCMCredential{
+		Organization:   organization,
+		Project:        project,
+		Provider:       provider,
+		Kind:           req.Kind,
+		AppID:          req.AppID,
+		InstallationID: req.InstallationID,
+		UpdatedBy:      updatedBy,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Sealed:         sealed,
+	}
+	previous, err := s.store.GetSCMCredential(ctx, organization, project, provider)
+	switch {
+	case err == nil:
+		credential.CreatedAt = previous.CreatedAt
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	if err := s.store.PutSCMCredential(ctx, credential); err != nil {
+		return nil, fmt.Errorf("storing SCM credential: %w", err)
+	}
+	s.forget(organization, project, provider)
+	return credential, nil
+}
+
+// checkScope checks that the organization exists and owns the project, if
+// one is given.
+func (s *Service) checkScope(ctx context.Context, organization, project string) error {
+	if _, err := s.orgs.Get(ctx, organization); err != nil {
+		return err
+	}
+	if project == "" {
+		return nil
+	}
+	p, err := s.orgs.GetProject(ctx, project)
+	if err != nil {
+		return err
+	}
+	if p.Organization != organization {
+		return fmt.Errorf("%w: %s belongs to %s", ErrWrongOrganization, project, p.Organization)
+	}
+	return nil
+}
+
+// List returns the credentials of the organization and its projects,
+// without their tokens or keys.
+func (s *Service) List(ctx context.Context, organization string) ([]*types.SCMCredential, error) {
+	return s.store.ListSCMCredentials(ctx, organization)
+}
+
+// Delete removes the credential of the organization, or of its project if
+// project is set, for provider.
+func (s *Service) Delete(ctx context.Context, organization, project, provider string) error {
+	if err := s.store.DeleteSCMCredential(ctx, organization, project, provider); err != nil {
+		return err
+	}
+	s.forget(organization, project, provider)
+	return nil
+}
+
+// Token implements scm.TokenSource: it returns the access token of the
+// credential of repo's project for provider, or else of its organization's,
+// issuing an installation token for GitHub Apps. Repositories that are no
+// project, and credentials that are deploy keys, have no token.
+func (s *Service) Token(ctx context.Context, provider, repo string) (string, bool, error) {
+	credential, err := s.lookup(ctx, provider, repo)
+	if err != nil || credential == nil {
+		return "", false, err
+	}
+	return s.token(ctx, credential)
+}
+
+// OrganizationToken returns the access token of the organization's own
+// credential for provider, as Token does. Projects being onboarded have
+// no credential of their own yet.
+func (s *Service) OrganizationToken(ctx context.Context, organization, provider string) (string, bool, error) {
+	credential, err := s.store.GetSCMCredential(ctx, organization, "", provider)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return s.token(ctx, credential)
+}
+
+// GitAuth returns how git authenticates to the repository at cloneURL with
+// the credential of its project, or of the project's organization, on the
+// provider serving its host. It returns nil for repositories without one,
+// which are cloned anonymously.
+func (s *Service) GitAuth(ctx context.Context, cloneURL string) (*scm.GitAuth, error) {
+	host, repo, err := scm.ParseRepositoryURL(cloneURL)
+	if err != nil {
+		return nil, nil
+	}
+	for name, p := range s.providers {
+		if p.host != host {
+			continue
+		}
+		credential, err := s.lookup(ctx, name, repo)
+		if err != nil || credential == nil {
+			return nil, err
+		}
+		if credential.Kind == types.SCMCredentialDeployKey {
+			key, err := s.open(ctx, credential)
+			if err != nil {
+				return nil, err
+			}
+			return &scm.GitAuth{SSHKey: key}, nil
+		}
+		token, _, err := s.token(ctx, credential)
+		if err != nil {
+			return nil, err
+		}
+		return &scm.GitAuth{Username: p.username, Password: token}, nil
+	}
+	return nil, nil
+}
+
+// lookup returns the credential repo's project has for provider, or else
+// its organization's, or nil if neither has one or repo is no project.
+func (s *Service) lookup(ctx context.Context, provider, repo string) (*types.SCMCredential, error) {
+	project, err := s.orgs.GetProject(ctx, repo)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range []string{project.Name, ""} {
+		credential, err := s.store.GetSCMCredential(ctx, project.Organization, scope, provider)
+		if err == nil {
+			return credential, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// token returns the access token of a credential, issuing a new
+// installation token for GitHub Apps unless the last one lasts a while
+// longer.
+func (s *Service) token(ctx context.Context, credential *types.SCMCredential) (string, bool, error) {
+	switch credential.Kind {
+	case types.SCMCredentialToken:
+		token, err := s.open(ctx, credential)
+		return token, err == nil, err
+	case types.SCMCredentialGitHubApp:
+	default:
+		return "", false, nil
+	}
+	key := string(additionalData(credential.Organization, credential.Project, credential.Provider))
+	s.mu.Lock()
+	cached, ok := s.tokens[key]
+	s.mu.Unlock()
+	if ok && cached.updatedAt.Equal(credential.UpdatedAt) && s.now().Add(refreshBefore).Before(cached.expires) {
+		return cached.token, true, nil
+	}
+	p, ok := s.providers[credential.Provider]
+	if !ok || p.apps == nil {
+		return "", false, fmt.Errorf("provider %s has no apps", credential.Provider)
+	}
+	pem, err := s.open(ctx, credential)
+	if err != nil {
+		return "", false, err
+	}
+	private, err := types.ParseRSAPrivateKey(pem)
+	if err != nil {
+		return "", false, fmt.Errorf("private key of app %d: %w", credential.AppID, err)
+	}
+	token, expires, err := p.apps.InstallationToken(ctx, credential.AppID, credential.InstallationID, private)
+	if err != nil {
+		return "", false, fmt.Errorf("getting a token of installation %d of app %d: %w", credential.InstallationID, credential.AppID, err)
+	}
+	s.mu.Lock()
+	s.tokens[key] = appToken{token: token, expires: expires, updatedAt: credential.UpdatedAt}
+	s.mu.Unlock()
+	return token, true, nil
+}
+
+// open decrypts the token or private key of a credential.
+func (s *Service) open(ctx context.Context, credential *types.SCMCredential) (string, error) {
+	value, err := s.sealer.Open(ctx, credential.Sealed, additionalData(credential.Organization, credential.Project, credential.Provider))
+	if err != nil {
+		return "", fmt.Errorf("decrypting SCM credential: %w", err)
+	}
+	return string(value), nil
+}
+
+// forget drops the installation token issued for a credential that was
+// replaced or deleted.
+func (s *Service) forget(organization, project, provider string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, string(additionalData(organization, project, provider)))
+}
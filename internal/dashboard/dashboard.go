@@ -0,0 +1,52 @@
+// Package dashboard serves the web dashboard: a single page, embedded in
+// the server binary, that lists recent pipeline runs, follows job logs live
+// and shows the agents and the queue. It only talks to the JSON API and the
+// WebSocket event stream, with an API token the user pastes in or a session
+// from signing in through SSO or LDAP, so it needs no server-side state or
+// routes of its own.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed static
+var files embed.FS
+
+// AssetPrefix is the path the page's scripts and styles are served under.
+const AssetPrefix = "/ui/"
+
+// contentSecurityPolicy keeps the page to its own scripts and styles and
+// to the server's API and event stream.
+const contentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; connect-src 'self' ws: wss:; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// Handler serves the page at / and its assets under AssetPrefix.
+func Handler() http.Handler {
+	static, err := fs.Sub(files, "static")
+	if err != nil {
+		// The directory is embedded, so this cannot happen.
+		panic(err)
+	}
+	assets := http.StripPrefix(AssetPrefix, http.FileServerFS(static))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		if r.URL.Path == "/" {
+			// The page is small and changes with every release.
+			h.Set("Cache-Control", "no-cache")
+			http.ServeFileFS(w, r, static, "index.html")
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			// Directories are not listed.
+			http.NotFound(w, r)
+			return
+		}
+		assets.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,370 @@
+// The Open-CICD dashboard. Views are picked by the location hash and built
+// from the JSON API; the event stream at /ws keeps them up to date.
+"use strict";
+
+const tokenKey = "opencicd.token";
+// sessionKey marks tokens that are SSO or LDAP sessions, which signing out
+// revokes.
+const sessionKey = "opencicd.session";
+const view = document.getElementById("view");
+const statusLine = document.getElementById("status");
+const signout = document.getElementById("signout");
+
+// socket is the event stream of the current view, closed when it changes.
+let socket = null;
+// timer refreshes the current view, for what events do not cover.
+let timer = null;
+
+function token() {
+  return localStorage.getItem(tokenKey);
+}
+
+// el builds an element. Strings become text nodes, never markup.
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (v === undefined || v === null || v === false) continue;
+    if (k === "class") node.className = v;
+    else node.setAttribute(k, v);
+  }
+  for (const child of children.flat()) {
+    if (child === undefined || child === null) continue;
+    node.append(child instanceof Node ? child : String(child));
+  }
+  return node;
+}
+
+function stateBadge(state) {
+  return el("span", { class: "state state-" + state }, state || "unknown");
+}
+
+function ago(iso) {
+  if (!iso) return "";
+  const s = Math.round((Date.now() - new Date(iso).getTime()) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.round(s / 60) + "m ago";
+  if (s < 86400) return Math.round(s / 3600) + "h ago";
+  return new Date(iso).toLocaleString();
+}
+
+function shortRef(ref) {
+  return (ref || "").replace(/^refs\/(heads|tags)\//, "");
+}
+
+class Unauthorized extends Error {}
+
+async function api(path, opts = {}) {
+  const headers = { Authorization: "Bearer " + token() };
+  const resp = await fetch(path, { ...opts, headers: { ...headers, ...(opts.headers || {}) } });
+  if (resp.status === 401) throw new Unauthorized("the token was not accepted");
+  if (!resp.ok) {
+    let msg = resp.statusText;
+    try { msg = (await resp.json()).message || msg; } catch (e) { /* not JSON */ }
+    throw new Error(msg);
+  }
+  return opts.text ? resp.text() : resp.json();
+}
+
+// subscribe opens the event stream with the given query and calls onEvent
+// with every event. onOpen is called whenever the stream (re)connects, so
+// that views can catch up on what they missed.
+function subscribe(query, onEvent, onOpen) {
+  const proto = location.protocol === "https:" ? "wss:" : "ws:";
+  const params = new URLSearchParams(query);
+  params.set("access_token", token());
+  const ws = new WebSocket(proto + "//" + location.host + "/ws?" + params);
+  ws.onopen = () => {
+    statusLine.textContent = "live";
+    if (onOpen) onOpen();
+  };
+  ws.onmessage = (msg) => {
+    const event = JSON.parse(msg.data);
+    if (event.type === "error") {
+      statusLine.textContent = "disconnected: " + event.error;
+      return;
+    }
+    onEvent(event);
+  };
+  ws.onclose = () => {
+    if (socket !== ws) return;
+    statusLine.textContent = "reconnecting…";
+    setTimeout(() => {
+      if (socket === ws) socket = subscribe(query, onEvent, onOpen);
+    }, 3000);
+  };
+  return ws;
+}
+
+function showSignin(message) {
+  signout.hidden = true;
+  statusLine.textContent = "";
+  const form = document.getElementById("signin").content.firstElementChild.cloneNode(true);
+  const error = form.querySelector(".error");
+  if (message) {
+    error.textContent = message;
+    error.hidden = false;
+  }
+  form.addEventListener("submit", (e) => {
+    e.preventDefault();
+    localStorage.setItem(tokenKey, form.elements.token.value.trim());
+    localStorage.removeItem(sessionKey);
+    route();
+  });
+  view.replaceChildren(form);
+  const sso = form.querySelector(".sso");
+  fetch("/auth/sso")
+    .then((resp) => (resp.ok ? resp.json() : []))
+    .then((providers) => {
+      sso.replaceChildren(...providers.map((p) => p.kind === "ldap"
+        ? directorySignin(p, error)
+        : el("a", { class: "button", href: p.login_url }, "Sign in with " + p.display_name)));
+      sso.hidden = providers.length === 0;
+    })
+    .catch(() => { /* token sign-in still works */ });
+}
+
+// directorySignin builds the username and password fields of an LDAP
+// directory. They sit inside the token form, so they post on their own
+// rather than submitting it.
+function directorySignin(p, error) {
+  const username = el("input", { autocomplete: "username", placeholder: p.display_name + " username" });
+  const password = el("input", { type: "password", autocomplete: "current-password", placeholder: "Password" });
+  const button = el("button", { type: "button" }, "Sign in to " + p.display_name);
+  const submit = async () => {
+    error.hidden = true;
+    const resp = await fetch(p.login_url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ username: username.value.trim(), password: password.value }),
+    });
+    let body = {};
+    try { body = await resp.json(); } catch (e) { /* not JSON */ }
+    if (!resp.ok) throw new Error(body.message || resp.statusText);
+    localStorage.setItem(tokenKey, body.token);
+    localStorage.setItem(sessionKey, "1");
+    route();
+  };
+  const fail = (err) => {
+    error.textContent = err.message;
+    error.hidden = false;
+  };
+  button.addEventListener("click", () => submit().catch(fail));
+  for (const input of [username, password]) {
+    input.addEventListener("keydown", (e) => {
+      if (e.key !== "Enter") return;
+      e.preventDefault();
+      submit().catch(fail);
+    });
+  }
+  return el("fieldset", { class: "directory" }, el("legend", {}, p.display_name), username, password, button);
+}
+
+// takeSignin picks up what signing in through SSO sent back in the location
+// hash: a session token, or why signing in failed. The hash is cleared so
+// that the token does not stay in the address bar or history.
+function takeSignin() {
+  const params = new URLSearchParams(location.hash.replace(/^#/, ""));
+  const session = params.get("session");
+  const failed = params.get("sso-error");
+  if (session === null && failed === null) return null;
+  history.replaceState(null, "", location.pathname + "#/");
+  if (session) {
+    localStorage.setItem(tokenKey, session);
+    localStorage.setItem(sessionKey, "1");
+  }
+  return failed;
+}
+
+// Pipelines -------------------------------------------------------------
+
+async function pipelinesView() {
+  const cards = el("div", { class: "cards" });
+  const body = el("tbody");
+  view.replaceChildren(
+    el("h1", {}, "Pipelines"),
+    cards,
+    el("table", {},
+      el("thead", {}, el("tr", {}, ["Run", "Project", "Ref", "State", "Created"].map((h) => el("th", {}, h)))),
+      body),
+  );
+  const rows = new Map();
+  const row = (run) => el("tr", {},
+    el("td", {}, el("a", { href: "#/pipelines/" + run.id }, run.name || run.id)),
+    el("td", {}, run.repository || ""),
+    el("td", {}, shortRef(run.ref)),
+    el("td", {}, stateBadge(run.state)),
+    el("td", { title: run.created_at }, ago(run.created_at)));
+  const upsert = (run, prepend) => {
+    const next = row(run);
+    const old = rows.get(run.id);
+    if (old) old.replaceWith(next);
+    else if (prepend) body.prepend(next);
+    else body.append(next);
+    rows.set(run.id, next);
+  };
+  const load = async () => {
+    const [list, health, agents] = await Promise.all([
+      api("/pipelines?order=desc&limit=50"),
+      fetch("/health").then((r) => r.json()),
+      api("/agents?limit=200"),
+    ]);
+    body.replaceChildren();
+    rows.clear();
+    for (const run of list.items) upsert(run, false);
+    const online = agents.items.filter((a) => a.state === "online").length;
+    cards.replaceChildren(
+      card(health.queue.queued_jobs, "queued jobs"),
+      card(online + " / " + agents.items.length, "agents online"),
+      card(health.status, "server"));
+  };
+  await load();
+  socket = subscribe({ topics: "pipeline.*" }, (event) => {
+    if (event.pipeline) upsert(event.pipeline, true);
+  });
+  timer = setInterval(() => load().catch(report), 15000);
+}
+
+function card(value, label) {
+  return el("div", { class: "card" }, el("div", { class: "value" }, value), el("div", { class: "label" }, label));
+}
+
+async function pipelineView(id) {
+  const header = el("div");
+  const stages = el("div", { class: "stages" });
+  view.replaceChildren(header, stages);
+  const load = async () => {
+    const [run, graph] = await Promise.all([api("/pipelines/" + id), api("/pipelines/" + id + "/graph")]);
+    header.replaceChildren(
+      el("h1", {}, (run.name || "Pipeline") + " ", stateBadge(run.state)),
+      el("dl", { class: "meta" },
+        el("dt", {}, "Project"), el("dd", {}, run.repository || ""),
+        el("dt", {}, "Ref"), el("dd", {}, shortRef(run.ref)),
+        el("dt", {}, "Commit"), el("dd", {}, (run.commit || "").slice(0, 12)),
+        el("dt", {}, "Created"), el("dd", { title: run.created_at }, ago(run.created_at)),
+        run.parent ? [el("dt", {}, "Started by"), el("dd", {}, el("a", { href: "#/pipelines/" + run.parent.pipeline_id }, run.parent.repository))] : null,
+        (run.children || []).length ? [el("dt", {}, "Downstream"), el("dd", {}, run.children.map((c) => el("div", {}, el("a", { href: "#/pipelines/" + c.pipeline_id }, c.repository))))] : null));
+    const levels = [];
+    for (const node of graph.nodes) (levels[node.level] = levels[node.level] || []).push(node);
+    stages.replaceChildren(...levels.map((nodes) => el("div", {}, nodes.map((node) =>
+      el("div", { class: "stage" },
+        el("strong", {}, node.stage), " ", stateBadge(node.state),
+        el("ul", {}, node.jobs.map((job) => el("li", {},
+          el("a", { href: "#/jobs/" + job.id }, job.name.slice(node.stage.length + 1) || job.name), " ", stateBadge(job.state)))))))));
+  };
+  await load();
+  socket = subscribe({ pipeline: id, topics: "job.queued,job.started,job.finished,job.updated,pipeline.*" }, () => load().catch(report));
+}
+
+// Jobs ------------------------------------------------------------------
+
+async function jobView(id) {
+  const header = el("div");
+  const log = el("pre", { class: "log" });
+  view.replaceChildren(header, el("h2", {}, "Log"), log);
+  const encoder = new TextEncoder();
+  const decoder = new TextDecoder();
+  // received counts the bytes of the log shown, which chunk offsets are
+  // relative to.
+  let received = 0;
+  const append = (text) => {
+    const follow = log.scrollTop + log.clientHeight >= log.scrollHeight - 8;
+    log.append(text);
+    received += encoder.encode(text).length;
+    if (follow) log.scrollTop = log.scrollHeight;
+  };
+  const catchUp = async () => append(await api("/jobs/" + id + "/logs?offset=" + received, { text: true }));
+  const render = (job) => header.replaceChildren(
+    el("h1", {}, job.name + " ", stateBadge(job.state)),
+    el("dl", { class: "meta" },
+      el("dt", {}, "Pipeline"), el("dd", {}, job.pipeline_id ? el("a", { href: "#/pipelines/" + job.pipeline_id }, job.pipeline_id) : "none"),
+      el("dt", {}, "Image"), el("dd", {}, job.image || ""),
+      el("dt", {}, "Agent"), el("dd", {}, job.agent_id || ""),
+      el("dt", {}, "Attempt"), el("dd", {}, job.attempt || 1),
+      job.downstream ? [el("dt", {}, "Downstream"), el("dd", {}, el("a", { href: "#/pipelines/" + job.downstream }, job.downstream))] : null,
+      el("dt", {}, "Updated"), el("dd", { title: job.updated_at }, ago(job.updated_at))));
+  render(await api("/jobs/" + id));
+  await catchUp();
+  socket = subscribe({ job: id }, (event) => {
+    if (event.job) render(event.job);
+    const chunk = event.log;
+    if (!chunk) return;
+    const bytes = encoder.encode(chunk.text);
+    if (chunk.offset > received) {
+      // Output was missed; the API has it.
+      catchUp().catch(report);
+    } else if (chunk.offset + bytes.length > received) {
+      append(decoder.decode(bytes.slice(received - chunk.offset)));
+    }
+  }, () => catchUp().catch(report));
+}
+
+// Agents ----------------------------------------------------------------
+
+async function agentsView() {
+  const body = el("tbody");
+  view.replaceChildren(
+    el("h1", {}, "Agents"),
+    el("table", {},
+      el("thead", {}, el("tr", {}, ["Hostname", "State", "Capacity", "Organization", "Version", "Last seen"].map((h) => el("th", {}, h)))),
+      body));
+  const load = async () => {
+    const agents = await api("/agents?limit=200");
+    body.replaceChildren(...agents.items.map((a) => el("tr", {},
+      el("td", { title: a.id }, a.hostname),
+      el("td", {}, stateBadge(a.state)),
+      el("td", {}, a.capacity),
+      el("td", {}, a.organization || el("span", { class: "muted" }, "shared")),
+      el("td", {}, a.version || ""),
+      el("td", { title: a.last_seen_at }, ago(a.last_seen_at)))));
+  };
+  await load();
+  timer = setInterval(() => load().catch(report), 10000);
+}
+
+// Routing ---------------------------------------------------------------
+
+function report(err) {
+  if (err instanceof Unauthorized) {
+    showSignin(err.message);
+    return;
+  }
+  statusLine.textContent = "error: " + err.message;
+}
+
+async function route() {
+  if (socket) {
+    const old = socket;
+    socket = null;
+    old.close();
+  }
+  clearInterval(timer);
+  if (!token()) {
+    showSignin();
+    return;
+  }
+  signout.hidden = false;
+  statusLine.textContent = "";
+  const path = location.hash.replace(/^#/, "") || "/";
+  let m;
+  try {
+    if ((m = path.match(/^\/pipelines\/([^/]+)$/))) await pipelineView(decodeURIComponent(m[1]));
+    else if ((m = path.match(/^\/jobs\/([^/]+)$/))) await jobView(decodeURIComponent(m[1]));
+    else if (path === "/agents") await agentsView();
+    else await pipelinesView();
+  } catch (err) {
+    report(err);
+  }
+}
+
+signout.addEventListener("click", () => {
+  if (localStorage.getItem(sessionKey)) {
+    api("/auth/logout", { method: "POST", text: true }).catch(() => { /* it expires anyway */ });
+  }
+  localStorage.removeItem(tokenKey);
+  localStorage.removeItem(sessionKey);
+  route();
+});
+window.addEventListener("hashchange", route);
+const signinError = takeSignin();
+if (signinError) showSignin(signinError);
+else route();
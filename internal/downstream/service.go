@@ -0,0 +1,217 @@
+// Package downstream runs the jobs of trigger steps, which start a run of
+// another repository's pipeline instead of handing anything to an agent.
+// A waiting trigger step follows its downstream run and finishes with it,
+// reporting the run's outputs as its results.
+package downstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/webhooks"
+)
+
+const (
+	// pollInterval is how often trigger steps are looked at without being
+	// kicked, which catches changes made through other replicas.
+	pollInterval = 15 * time.Second
+	// triggerTimeout bounds fetching the downstream pipeline file.
+	triggerTimeout = time.Minute
+)
+
+// Service starts and follows the downstream runs of trigger steps.
+type Service struct {
+	jobs    *jobs.Manager
+	trigger *webhooks.Service
+	kick    chan struct{}
+}
+
+// NewService returns a Service that runs the trigger steps of the job
+// manager's runs, starting downstream runs with trigger.
+func NewService(manager *jobs.Manager, trigger *webhooks.Service) *Service {
+	return &Service{jobs: manager, trigger: trigger, kick: make(chan struct{}, 1)}
+}
+
+// Observe is a job observer that wakes Run when a trigger step changes.
+func (s *Service) Observe(job *types.Job) {
+	if job.Trigger != nil {
+		s.wake()
+	}
+}
+
+// ObservePipeline is a pipeline observer that wakes Run when a downstream
+// run changes.
+func (s *Service) ObservePipeline(run *types.Pipeline) {
+	if run.Parent != nil {
+		s.wake()
+	}
+}
+
+func (s *Service) wake() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs trigger steps until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.pass(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "running trigger steps", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+	}
+}
+
+// pass starts the downstream runs of queued trigger steps, finishes the
+// running ones whose downstream runs finished and the cancelling ones.
+func (s *Service) pass(ctx context.Context) error {
+	for _, state := range []types.JobState{types.JobStateQueued, types.JobStateRunning, types.JobStateCancelling} {
+		list, err := s.jobs.List(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		for _, job := range list {
+			if job.Trigger == nil || ctx.Err() != nil {
+				continue
+			}
+			switch state {
+			case types.JobStateQueued:
+				err = s.start(ctx, job)
+			case types.JobStateRunning:
+				err = s.follow(ctx, job)
+			default:
+				err = s.cancel(ctx, job)
+			}
+			if err != nil && !errors.Is(err, types.ErrInvalidTransition) && !errors.Is(err, storage.ErrNotFound) {
+				slog.ErrorContext(ctx, "running trigger step", "job_id", job.ID, "state", state, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// start starts the downstream run of a queued trigger step. A step whose
+// run cannot be started fails with the reason.
+func (s *Service) start(ctx context.Context, queued *types.Job) error {
+	job, t, err := s.jobs.StartDownstream(ctx, queued.ID)
+	if errors.Is(err, jobs.ErrCrossOrganization) {
+		return s.finish(ctx, queued.ID, types.JobStateFailed, err.Error(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	parent, err := s.jobs.GetPipeline(ctx, job.PipelineID)
+	if err != nil {
+		return err
+	}
+	ref := types.QualifyRef(t.Ref)
+	branch, ok := strings.CutPrefix(ref, "refs/heads/")
+	if !ok {
+		branch = ""
+	}
+	trigger := &types.Trigger{
+		Event:      types.TriggerEventPipeline,
+		Repository: t.Repository,
+		CloneURL:   t.CloneURL,
+		Ref:        ref,
+		Branch:     branch,
+		Parent:     &types.PipelineLink{PipelineID: parent.ID, Repository: parent.Repository, JobID: job.ID},
+		Inputs:     t.Inputs,
+		// Code from a fork may start runs, but not trusted ones.
+		Fork: parent.Restricted,
+	}
+	if parent.Trigger != nil {
+		trigger.Actor = parent.Trigger.Actor
+	}
+	tctx, cancel := context.WithTimeout(ctx, triggerTimeout)
+	child, err := s.trigger.Trigger(tctx, trigger)
+	cancel()
+	if err != nil {
+		return s.finish(ctx, job.ID, types.JobStateFailed, "starting downstream pipeline: "+err.Error(), nil)
+	}
+	if _, err := s.jobs.LinkDownstream(ctx, job.ID, child); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Trigger step started downstream pipeline", "job_id", job.ID, "pipeline_id", child.ID, "repository", child.Repository, "ref", child.Ref)
+	if !t.Wait {
+		return s.finish(ctx, job.ID, types.JobStateSucceeded, "started downstream pipeline "+child.ID, nil)
+	}
+	return nil
+}
+
+// follow finishes a running trigger step once its downstream run has
+// finished, or right away if it does not wait for it. A step that never
+// got to link its run, because the server stopped in between, fails.
+func (s *Service) follow(ctx context.Context, job *types.Job) error {
+	if job.Downstream == "" {
+		return s.finish(ctx, job.ID, types.JobStateFailed, "downstream pipeline was not started", nil)
+	}
+	if !job.Trigger.Wait {
+		return s.finish(ctx, job.ID, types.JobStateSucceeded, "started downstream pipeline "+job.Downstream, nil)
+	}
+	child, err := s.jobs.GetPipeline(ctx, job.Downstream)
+	if errors.Is(err, storage.ErrNotFound) {
+		return s.finish(ctx, job.ID, types.JobStateFailed, "downstream pipeline "+job.Downstream+" no longer exists", nil)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case !child.State.Terminal():
+		return nil
+	case child.State != types.PipelineStateSucceeded:
+		return s.finish(ctx, job.ID, types.JobStateFailed, fmt.Sprintf("downstream pipeline %s %s", child.ID, child.State), nil)
+	}
+	if err := types.ValidateResults(child.Outputs); err != nil {
+		return s.finish(ctx, job.ID, types.JobStateFailed, fmt.Sprintf("outputs of downstream pipeline %s: %v", child.ID, err), nil)
+	}
+	return s.finish(ctx, job.ID, types.JobStateSucceeded, "downstream pipeline "+child.ID+" succeeded", child.Outputs)
+}
+
+// cancel cancels a cancelling trigger step, and the downstream run it
+// waits for.
+func (s *Service) cancel(ctx context.Context, job *types.Job) error {
+	reason := job.Transitions[len(job.Transitions)-1].Reason
+	if job.Downstream != "" && job.Trigger.Wait {
+		child, err := s.jobs.GetPipeline(ctx, job.Downstream)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		for _, id := range childJobs(child) {
+			_, err := s.jobs.Cancel(ctx, id, "pipeline "+job.PipelineID, "trigger step "+job.ID+" was cancelled")
+			if err != nil && !errors.Is(err, types.ErrInvalidTransition) {
+				slog.ErrorContext(ctx, "cancelling downstream job", "pipeline_id", job.Downstream, "job_id", id, "error", err)
+			}
+		}
+	}
+	return s.finish(ctx, job.ID, types.JobStateCancelled, reason, nil)
+}
+
+// childJobs returns the jobs of a downstream run, which may be nil.
+func childJobs(child *types.Pipeline) []string {
+	if child == nil {
+		return nil
+	}
+	return child.JobIDs
+}
+
+func (s *Service) finish(ctx context.Context, id string, state types.JobState, reason string, results map[string]string) error {
+	_, err := s.jobs.UpdateStatus(ctx, id, types.JobStatusRequest{State: state, Reason: reason, Results: results})
+	return err
+}
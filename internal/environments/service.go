@@ -0,0 +1,281 @@
+// Package environments tracks what each project has deployed where. Deploy
+// jobs name the environment they deploy to; the scheduler starts one of them
+// per environment at a time through Begin, which records a deployment that
+// holds the environment's lock until the job finishes.
+package environments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrLocked is returned by Begin while another deploy job holds the
+// environment.
+var ErrLocked = errors.New("environment is locked by another deployment")
+
+// errUnchanged aborts an environment update that turned out to be
+// unnecessary.
+var errUnchanged = errors.New("environment unchanged")
+
+// queueSize bounds the environments waiting to be settled after a deploy
+// job changed. Beyond it they are dropped; the next Begin on the
+// environment settles it instead.
+const queueSize = 256
+
+// key identifies an environment.
+type key struct{ project, name string }
+
+// Service records deployments on top of an EnvironmentStore.
+type Service struct {
+	store storage.EnvironmentStore
+	jobs  storage.JobStore
+	queue chan key
+	now   func() time.Time
+}
+
+// NewService returns a service keeping environments in store and looking
+// deploy jobs up in jobs.
+func NewService(store storage.EnvironmentStore, jobs storage.JobStore) *Service {
+	return &Service{store: store, jobs: jobs, queue: make(chan key, queueSize), now: time.Now}
+}
+
+// Get returns an environment of project.
+func (s *Service) Get(ctx context.Context, project, name string) (*types.Environment, error) {
+	return s.store.GetEnvironment(ctx, project, name)
+}
+
+// List returns the environments of project ordered by name.
+func (s *Service) List(ctx context.Context, project string) ([]*types.Environment, error) {
+	return s.store.ListEnvironments(ctx, project)
+}
+
+// Deployments returns the deployments matching filter.
+func (s *Service) Deployments(ctx context.Context, filter storage.DeploymentFilter) ([]*types.Deployment, error) {
+	return s.store.ListDeployments(ctx, filter)
+}
+
+// Locked reports whether another deploy job holds the environment job
+// deploys to. A job that does not deploy is never held up.
+func (s *Service) Locked(ctx context.Context, job *types.Job) (bool, error) {
+	if job.Environment == "" {
+		return false, nil
+	}
+	active, _, err := s.active(ctx, job.Repository, job.Environment)
+	if err != nil {
+		return false, err
+	}
+	return active != nil && !active.done && active.JobID != job.ID, nil
+}
+
+// Begin records the deployment of an assigned deploy job and takes the
+// environment's lock for it. It fails with an error wrapping ErrLocked if
+// another deploy job holds the lock. A deployment whose job finished without
+// releasing the lock is settled first, and an earlier deployment by the
+// same job, which was handed back to the queue, is recorded as cancelled.
+func (s *Service) Begin(ctx context.Context, job *types.Job) error {
+	if job.Environment == "" {
+		return nil
+	}
+	active, expected, err := s.active(ctx, job.Repository, job.Environment)
+	if err != nil {
+		return err
+	}
+	if active != nil && !active.done {
+		if active.JobID != job.ID {
+			return fmt.Errorf("%w: deployment %s by job %s is in progress", ErrLocked, active.ID, active.JobID)
+		}
+		active.state, active.reason = types.DeploymentStateCancelled, "job was handed back to the queue"
+	}
+
+	now := s.now()
+	deployment := &types.Deployment{
+		ID:          utils.NewID(),
+		Project:     job.Repository,
+		Environment: job.Environment,
+		JobID:       job.ID,
+		Attempt:     job.Attempt,
+		PipelineID:  job.PipelineID,
+		Ref:         job.Ref,
+		Commit:      job.Commit,
+		State:       types.DeploymentStateInProgress,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	var finished *types.Deployment
+	_, err = s.store.UpdateEnvironment(ctx, job.Repository, job.Environment, func(env *types.Environment) error {
+		if activeID(env) != expected {
+			return fmt.Errorf("%w: another deployment began meanwhile", ErrLocked)
+		}
+		finished = nil
+		if active != nil {
+			finished = s.finish(env, active.state, active.reason, now)
+		}
+		if env.CreatedAt.IsZero() {
+			env.CreatedAt = now
+		}
+		env.Active = deployment
+		env.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if finished != nil {
+		if err := s.store.PutDeployment(ctx, finished); err != nil {
+			return err
+		}
+	}
+	return s.store.PutDeployment(ctx, deployment)
+}
+
+// Observe queues the environment of a deploy job that finished or went back
+// to the queue, to be settled by Run. It is meant to be registered with
+// jobs.Manager.Observe and never blocks.
+func (s *Service) Observe(job *types.Job) {
+	if job.Environment == "" || !(job.State.Terminal() || job.State == types.JobStateQueued) {
+		return
+	}
+	select {
+	case s.queue <- key{job.Repository, job.Environment}:
+	default:
+		slog.Warn("Dropped environment update, too many waiting", "project", job.Repository, "environment", job.Environment, "job_id", job.ID)
+	}
+}
+
+// Run settles queued environments until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case k := <-s.queue:
+			if err := s.settle(ctx, k.project, k.name); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "settling environment", "project", k.project, "environment", k.name, "error", err)
+			}
+		}
+	}
+}
+
+// settle finishes the environment's active deployment and releases its lock
+// if the deploy job is done with it.
+func (s *Service) settle(ctx context.Context, project, name string) error {
+	active, expected, err := s.active(ctx, project, name)
+	if err != nil || active == nil || !active.done {
+		return err
+	}
+	var finished *types.Deployment
+	_, err = s.store.UpdateEnvironment(ctx, project, name, func(env *types.Environment) error {
+		if activeID(env) != expected {
+			return errUnchanged
+		}
+		finished = s.finish(env, active.state, active.reason, s.now())
+		return nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Finished deployment", "project", project, "environment", name,
+		"deployment_id", finished.ID, "job_id", finished.JobID, "state", finished.State)
+	return s.store.PutDeployment(ctx, finished)
+}
+
+// activeDeployment is an environment's active deployment along with how it
+// ended, if its job is done with it.
+type activeDeployment struct {
+	*types.Deployment
+	done   bool
+	state  types.DeploymentState
+	reason string
+}
+
+// active returns the active deployment of an environment, or nil, and the
+// ID to expect when updating the environment based on it. Jobs are looked
+// up before the update since the store may not be used from within one.
+func (s *Service) active(ctx context.Context, project, name string) (*activeDeployment, string, error) {
+	env, err := s.store.GetEnvironment(ctx, project, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil || env.Active == nil {
+		return nil, "", err
+	}
+	a := &activeDeployment{Deployment: env.Active}
+	a.state, a.reason, a.done, err = s.outcome(ctx, env.Active)
+	if err != nil {
+		return nil, "", err
+	}
+	return a, env.Active.ID, nil
+}
+
+// activeID returns the ID of the environment's active deployment, or "".
+func activeID(env *types.Environment) string {
+	if env.Active == nil {
+		return ""
+	}
+	return env.Active.ID
+}
+
+// finish ends the environment's active deployment in state, releasing the
+// lock, and returns it. A successful deployment becomes the current one.
+func (s *Service) finish(env *types.Environment, state types.DeploymentState, reason string, at time.Time) *types.Deployment {
+	d := env.Active
+	d.State = state
+	d.Reason = reason
+	d.UpdatedAt = at
+	d.FinishedAt = &at
+	env.Active = nil
+	env.UpdatedAt = at
+	if state == types.DeploymentStateSucceeded {
+		env.Current = d.Clone()
+	}
+	return d
+}
+
+// outcome tells how deployment d ended, from the current state of its job,
+// or that it has not ended yet.
+func (s *Service) outcome(ctx context.Context, d *types.Deployment) (state types.DeploymentState, reason string, done bool, err error) {
+	job, err := s.jobs.GetJob(ctx, d.JobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return types.DeploymentStateCancelled, "job no longer exists", true, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	if job.Attempt > d.Attempt {
+		for _, a := range job.Attempts {
+			if a.Attempt == d.Attempt {
+				reason = a.Reason
+			}
+		}
+		return types.DeploymentStateFailed, reason, true, nil
+	}
+	switch job.State {
+	case types.JobStateSucceeded:
+		return types.DeploymentStateSucceeded, "", true, nil
+	case types.JobStateFailed, types.JobStateTimedOut:
+		return types.DeploymentStateFailed, lastReason(job), true, nil
+	case types.JobStateCancelled, types.JobStateSkipped:
+		return types.DeploymentStateCancelled, lastReason(job), true, nil
+	case types.JobStateQueued, types.JobStatePending:
+		return types.DeploymentStateCancelled, "job was handed back to the queue", true, nil
+	}
+	return "", "", false, nil
+}
+
+// lastReason returns the reason given for the job's latest state change.
+func lastReason(job *types.Job) string {
+	if t, ok := job.LastTransition(job.State); ok {
+		return t.Reason
+	}
+	return ""
+}
@@ -0,0 +1,296 @@
+// Package events fans job, pipeline and log changes out to subscribers, such
+// as WebSocket clients, as they happen.
+package events
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/logs"
+	"open-cicd/internal/types"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind by before
+// it is dropped.
+const subscriberBuffer = 256
+
+// Event types.
+const (
+	JobQueued        = "job.queued"
+	JobStarted       = "job.started"
+	JobFinished      = "job.finished"
+	JobUpdated       = "job.updated"
+	JobLog           = "job.log"
+	PipelineStarted  = "pipeline.started"
+	PipelineFinished = "pipeline.finished"
+	PipelineUpdated  = "pipeline.updated"
+)
+
+// Types lists every event type.
+var Types = []string{
+	JobQueued, JobStarted, JobFinished, JobUpdated, JobLog,
+	PipelineStarted, PipelineFinished, PipelineUpdated,
+}
+
+// ValidTopic reports whether topic names an event type, or is a prefix of
+// one followed by "*".
+func ValidTopic(topic string) bool {
+	prefix, wildcard := strings.CutSuffix(topic, "*")
+	for _, t := range Types {
+		if t == topic || (wildcard && strings.HasPrefix(t, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is one change. Job and pipeline events carry the new version of the
+// job or run; log events carry the output appended.
+type Event struct {
+	Type     string          `json:"type"`
+	At       time.Time       `json:"at"`
+	Project  string          `json:"project,omitempty"`
+	Job      *types.Job      `json:"job,omitempty"`
+	Pipeline *types.Pipeline `json:"pipeline,omitempty"`
+	Log      *Log            `json:"log,omitempty"`
+}
+
+// Log is the output of a job.log event.
+type Log struct {
+	JobID  string      `json:"job_id"`
+	Stream logs.Stream `json:"stream"`
+	Offset int64       `json:"offset"`
+	Text   string      `json:"text"`
+}
+
+// jobEvent returns the type of the event for a job in state.
+func jobEvent(state types.JobState) string {
+	switch {
+	case state == types.JobStateQueued:
+		return JobQueued
+	case state == types.JobStateRunning:
+		return JobStarted
+	case state.Terminal():
+		return JobFinished
+	default:
+		return JobUpdated
+	}
+}
+
+// pipelineEvent returns the type of the event for a run in state.
+func pipelineEvent(state types.PipelineState) string {
+	switch {
+	case state == types.PipelineStateRunning:
+		return PipelineStarted
+	case state.Terminal():
+		return PipelineFinished
+	default:
+		return PipelineUpdated
+	}
+}
+
+// Filter selects the events a subscriber receives. Empty fields match every
+// event.
+type Filter struct {
+	// Topics are event types, or prefixes ending in "*" such as "job.*".
+	Topics     []string
+	Project    string
+	JobID      string
+	PipelineID string
+	// Allowed reports whether the subscriber may view a project. Events of
+	// other projects are never delivered.
+	Allowed func(project string) bool
+}
+
+// matches reports whether e passes the filter.
+func (f Filter) matches(e Event) bool {
+	if f.Allowed != nil && !f.Allowed(e.Project) {
+		return false
+	}
+	if f.Project != "" && e.Project != f.Project {
+		return false
+	}
+	if f.JobID != "" && e.jobID() != f.JobID {
+		return false
+	}
+	if f.PipelineID != "" && e.pipelineID() != f.PipelineID {
+		return false
+	}
+	if len(f.Topics) == 0 {
+		return true
+	}
+	for _, topic := range f.Topics {
+		prefix, wildcard := strings.CutSuffix(topic, "*")
+		if topic == e.Type || (wildcard && strings.HasPrefix(e.Type, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// jobID and pipelineID return the job and pipeline run the event is about,
+// if any.
+func (e Event) jobID() string {
+	switch {
+	case e.Job != nil:
+		return e.Job.ID
+	case e.Log != nil:
+		return e.Log.JobID
+	}
+	return ""
+}
+
+func (e Event) pipelineID() string {
+	switch {
+	case e.Pipeline != nil:
+		return e.Pipeline.ID
+	case e.Job != nil:
+		return e.Job.PipelineID
+	}
+	return ""
+}
+
+// Subscription receives the events matching its filter on C. C is closed
+// when the subscription is closed, or when the subscriber fell too far behind
+// and was dropped.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	filter  Filter
+	bus     *Bus
+	dropped bool
+}
+
+// Dropped reports whether the subscription was closed because its events
+// were not read fast enough. It is only meaningful once C is closed.
+func (s *Subscription) Dropped() bool {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.dropped
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// JobLookup loads a job, for finding the project of log output.
+type JobLookup func(ctx context.Context, id string) (*types.Job, error)
+
+// Bus delivers events to subscribers. Its Observe methods are registered
+// with the job manager and the log feed; they never block, dropping
+// subscribers that fall behind instead.
+type Bus struct {
+	lookup JobLookup
+	now    func() time.Time
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+	// projects caches the project of unfinished jobs, for log events.
+	projects map[string]string
+}
+
+// NewBus returns a bus with no subscribers. lookup finds the project of jobs
+// whose output arrives before the bus has seen them.
+func NewBus(lookup JobLookup) *Bus {
+	return &Bus{
+		lookup:   lookup,
+		now:      time.Now,
+		subs:     make(map[*Subscription]struct{}),
+		projects: make(map[string]string),
+	}
+}
+
+// Subscribe returns a subscription to the events matching filter.
+func (b *Bus) Subscribe(filter Filter) *Subscription {
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// remove closes s if it is still subscribed. Callers must hold the lock.
+func (b *Bus) remove(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// ObserveJob publishes the change of a job.
+func (b *Bus) ObserveJob(job *types.Job) {
+	b.mu.Lock()
+	if job.State.Terminal() {
+		delete(b.projects, job.ID)
+	} else {
+		b.projects[job.ID] = job.Repository
+	}
+	b.mu.Unlock()
+	b.publish(Event{Type: jobEvent(job.State), At: job.UpdatedAt, Project: job.Repository, Job: job})
+}
+
+// ObservePipeline publishes the change of a pipeline run.
+func (b *Bus) ObservePipeline(run *types.Pipeline) {
+	b.publish(Event{Type: pipelineEvent(run.State), At: run.UpdatedAt, Project: run.Repository, Pipeline: run})
+}
+
+// ObserveLog publishes output appended to the log of a job.
+func (b *Bus) ObserveLog(jobID string, chunk logs.Chunk) {
+	if len(chunk.Data) == 0 {
+		// Output past a log limit, which is not stored.
+		return
+	}
+	b.mu.Lock()
+	project, ok := b.projects[jobID]
+	subscribed := len(b.subs) > 0
+	b.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	if !ok {
+		job, err := b.lookup(context.Background(), jobID)
+		if err != nil {
+			slog.Error("loading job for log event", "job_id", jobID, "error", err)
+			return
+		}
+		project = job.Repository
+		if !job.State.Terminal() {
+			b.mu.Lock()
+			b.projects[jobID] = project
+			b.mu.Unlock()
+		}
+	}
+	b.publish(Event{
+		Type:    JobLog,
+		At:      chunk.At,
+		Project: project,
+		Log:     &Log{JobID: jobID, Stream: chunk.Stream, Offset: chunk.Offset, Text: string(chunk.Data)},
+	})
+}
+
+// publish delivers e to every subscriber whose filter it matches.
+func (b *Bus) publish(e Event) {
+	if e.At.IsZero() {
+		e.At = b.now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.filter.matches(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped = true
+			b.remove(s)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Package gc collects what the retention policies of projects no longer
+// keep: runs beyond the newest ones kept, with their jobs, logs, artifacts,
+// test reports and workspace snapshots; artifacts and logs past their
+// retention; and caches beyond their project's quota. A collection can be a
+// dry run, which reports what it would delete and deletes nothing.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/artifacts"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/snapshots"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// collectInterval is how often the projects with a retention policy are
+// collected.
+const collectInterval = time.Hour
+
+// collectBatch is how many runs or jobs are read per store query.
+const collectBatch = 100
+
+// Store is what the collector reads and deletes records through. Records
+// with contents in the blob store are deleted by their services.
+type Store interface {
+	storage.RetentionPolicyStore
+	storage.PipelineStore
+	storage.JobStore
+	storage.ArtifactStore
+	storage.JobLogStore
+	storage.SnapshotStore
+}
+
+// Collector applies the retention policies of projects.
+type Collector struct {
+	store       Store
+	artifacts   *artifacts.Service
+	logs        *logs.Archive
+	snapshots   *snapshots.Service
+	caches      *cache.Service
+	now         func() time.Time
+	onCollected []func(*types.GCReport)
+}
+
+// NewCollector returns a Collector that keeps policies in store and
+// deletes contents through the given services.
+func NewCollector(store Store, artifactService *artifacts.Service, logArchive *logs.Archive, snapshotService *snapshots.Service, cacheService *cache.Service) *Collector {
+	return &Collector{
+		store:     store,
+		artifacts: artifactService,
+		logs:      logArchive,
+		snapshots: snapshotService,
+		caches:    cacheService,
+		now:       time.Now,
+	}
+}
+
+// OnCollected registers fn to be called with the report of every
+// collection that was not a dry run, including those that failed part way.
+// fn must not block.
+func (c *Collector) OnCollected(fn func(*types.GCReport)) {
+	c.onCollected = append(c.onCollected, fn)
+}
+
+// Policy returns the retention policy of project, or storage.ErrNotFound
+// if it has none.
+func (c *Collector) Policy(ctx context.Context, project string) (*types.RetentionPolicy, error) {
+	return c.store.GetRetentionPolicy(ctx, project)
+}
+
+// SetPolicy replaces the retention policy of project on behalf of
+// updatedBy. The request must have been validated.
+func (c *Collector) SetPolicy(ctx context.Context, project string, req types.PutRetentionPolicyRequest, updatedBy string) (*types.RetentionPolicy, error) {
+	policy := &types.RetentionPolicy{
+		Project:           project,
+		KeepRuns:          req.KeepRuns,
+		ArtifactRetention: req.ArtifactRetention,
+		LogRetention:      req.LogRetention,
+		CacheQuota:        req.CacheQuota,
+		UpdatedBy:         updatedBy,
+		UpdatedAt:         c.now(),
+	}
+	if err := c.store.PutRetentionPolicy(ctx, policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// DeletePolicy removes the retention policy of project, which then keeps
+// everything.
+func (c *Collector) DeletePolicy(ctx context.Context, project string) error {
+	return c.store.DeleteRetentionPolicy(ctx, project)
+}
+
+// Run collects every project with a retention policy on start and then
+// every collectInterval until ctx is cancelled.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.collectAll(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "listing retention policies", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectAll collects every project with a retention policy. A project
+// that fails is logged and left for the next run.
+func (c *Collector) collectAll(ctx context.Context) error {
+	policies, err := c.store.ListRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		report, err := c.collect(ctx, policy, false)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.ErrorContext(ctx, "collecting garbage", "project", policy.Project, "error", err)
+		}
+		if report.ReclaimedBytes > 0 || len(report.Deleted) > 0 {
+			slog.InfoContext(ctx, "Collected garbage", "project", policy.Project,
+				"runs", report.Deleted[types.GCRun], "jobs", report.Deleted[types.GCJob],
+				"artifacts", report.Deleted[types.GCArtifact], "logs", report.Deleted[types.GCLog],
+				"caches", report.Deleted[types.GCCache], "bytes", report.ReclaimedBytes)
+		}
+	}
+	return nil
+}
+
+// Collect applies the retention policy of project now and reports what was
+// deleted; with dryRun it reports what would be and deletes nothing. It
+// returns storage.ErrNotFound if the project has no policy. On failure the
+// report covers what was deleted before it.
+func (c *Collector) Collect(ctx context.Context, project string, dryRun bool) (*types.GCReport, error) {
+	policy, err := c.store.GetRetentionPolicy(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return c.collect(ctx, policy, dryRun)
+}
+
+// pass is one collection of a project.
+type pass struct {
+	policy *types.RetentionPolicy
+	report *types.GCReport
+	// collected holds the jobs deleted with their runs, so later steps do
+	// not count them again on dry runs, where they are still there.
+	collected map[string]bool
+}
+
+func (c *Collector) collect(ctx context.Context, policy *types.RetentionPolicy, dryRun bool) (*types.GCReport, error) {
+	p := &pass{
+		policy:    policy,
+		report:    types.NewGCReport(policy.Project, dryRun, c.now()),
+		collected: make(map[string]bool),
+	}
+	err := c.collectRuns(ctx, p)
+	if err == nil {
+		err = c.collectExpired(ctx, p)
+	}
+	if err == nil {
+		err = c.collectCaches(ctx, p)
+	}
+	p.report.FinishedAt = c.now()
+	if !dryRun {
+		for _, fn := range c.onCollected {
+			fn(p.report)
+		}
+	}
+	return p.report, err
+}
+
+// collectRuns deletes the finished runs of the project beyond the newest
+// KeepRuns. Runs in progress are neither counted nor deleted, and jobs a
+// kept run carried over from an earlier one are kept with it.
+func (c *Collector) collectRuns(ctx context.Context, p *pass) error {
+	if p.policy.KeepRuns == 0 {
+		return nil
+	}
+	var (
+		kept     int
+		keptJobs = make(map[string]bool)
+		reason   = fmt.Sprintf("older than the newest %d finished runs", p.policy.KeepRuns)
+	)
+	filter := storage.PipelineFilter{Repository: p.policy.Project, Page: storage.Page{Desc: true, Limit: collectBatch}}
+	for {
+		runs, err := c.store.ListPipelines(ctx, filter)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			if !run.State.Terminal() || kept < p.policy.KeepRuns {
+				if run.State.Terminal() {
+					kept++
+				}
+				for _, id := range run.JobIDs {
+					keptJobs[id] = true
+				}
+				continue
+			}
+			var bytes int64
+			for _, id := range run.JobIDs {
+				if keptJobs[id] || p.collected[id] {
+					continue
+				}
+				n, err := c.deleteJob(ctx, p, id)
+				if err != nil {
+					return err
+				}
+				bytes += n
+			}
+			if !p.report.DryRun {
+				if err := c.store.DeletePipeline(ctx, run.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+					return fmt.Errorf("deleting run %s: %w", run.ID, err)
+				}
+			}
+			p.report.Count(types.GCRun, 1, 0)
+			p.report.Add(types.GCItem{Kind: types.GCRun, ID: run.ID, Bytes: bytes, Reason: reason})
+		}
+		if len(runs) < collectBatch {
+			return nil
+		}
+		last := runs[len(runs)-1]
+		filter.Page.After = &storage.Cursor{Time: last.CreatedAt, ID: last.ID}
+	}
+}
+
+// deleteJob deletes a job of a deleted run with everything it holds and
+// returns the bytes that took.
+func (c *Collector) deleteJob(ctx context.Context, p *pass, id string) (int64, error) {
+	p.collected[id] = true
+	if _, err := c.store.GetJob(ctx, id); errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var bytes int64
+	list, err := c.store.ListArtifacts(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range list {
+		if !p.report.DryRun {
+			if err := c.artifacts.Delete(ctx, a); err != nil {
+				return bytes, err
+			}
+		}
+		p.report.Count(types.GCArtifact, 1, a.Size)
+		bytes += a.Size
+	}
+	log, err := c.store.GetJobLog(ctx, id)
+	switch {
+	case err == nil:
+		if !p.report.DryRun {
+			if err := c.logs.Delete(ctx, log); err != nil {
+				return bytes, err
+			}
+		}
+		p.report.Count(types.GCLog, 1, log.Size)
+		bytes += log.Size
+	case !errors.Is(err, storage.ErrNotFound):
+		return bytes, err
+	}
+	snapshot, err := c.store.GetSnapshot(ctx, id)
+	switch {
+	case err == nil:
+		if !p.report.DryRun {
+			if err := c.snapshots.Delete(ctx, id); err != nil {
+				return bytes, err
+			}
+		}
+		p.report.Count(types.GCSnapshot, 1, snapshot.Size)
+		bytes += snapshot.Size
+	case !errors.Is(err, storage.ErrNotFound):
+		return bytes, err
+	}
+	if !p.report.DryRun {
+		if err := c.store.DeleteJob(ctx, id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return bytes, fmt.Errorf("deleting job %s: %w", id, err)
+		}
+	}
+	p.report.Count(types.GCJob, 1, 0)
+	return bytes, nil
+}
+
+// collectExpired deletes the artifacts uploaded and the logs of jobs
+// finished longer ago than the project keeps them. Jobs are read oldest
+// first up to the later of the two cutoffs.
+func (c *Collector) collectExpired(ctx context.Context, p *pass) error {
+	var artifactsBefore, logsBefore time.Time
+	if p.policy.ArtifactRetention > 0 {
+		artifactsBefore = p.report.StartedAt.Add(-p.policy.ArtifactRetention.Std())
+	}
+	if p.policy.LogRetention > 0 {
+		logsBefore = p.report.StartedAt.Add(-p.policy.LogRetention.Std())
+	}
+	until := artifactsBefore
+	if logsBefore.After(until) {
+		until = logsBefore
+	}
+	if until.IsZero() {
+		return nil
+	}
+	artifactReason := fmt.Sprintf("uploaded more than %s ago", p.policy.ArtifactRetention.Std())
+	logReason := fmt.Sprintf("job finished more than %s ago", p.policy.LogRetention.Std())
+
+	filter := storage.JobFilter{Repository: p.policy.Project, Page: storage.Page{Limit: collectBatch}}
+	for {
+		jobs, err := c.store.ListJobs(ctx, filter)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if !job.CreatedAt.Before(until) {
+				return nil
+			}
+			if !job.State.Terminal() || p.collected[job.ID] {
+				continue
+			}
+			if job.CreatedAt.Before(artifactsBefore) {
+				if err := c.expireArtifacts(ctx, p, job.ID, artifactsBefore, artifactReason); err != nil {
+					return err
+				}
+			}
+			if job.UpdatedAt.Before(logsBefore) {
+				if err := c.expireLog(ctx, p, job.ID, logReason); err != nil {
+					return err
+				}
+			}
+		}
+		if len(jobs) < collectBatch {
+			return nil
+		}
+		last := jobs[len(jobs)-1]
+		filter.Page.After = &storage.Cursor{Time: last.CreatedAt, ID: last.ID}
+	}
+}
+
+// expireArtifacts deletes the artifacts of a job uploaded before t.
+func (c *Collector) expireArtifacts(ctx context.Context, p *pass, jobID string, t time.Time, reason string) error {
+	list, err := c.store.ListArtifacts(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		if !a.CreatedAt.Before(t) {
+			continue
+		}
+		if !p.report.DryRun {
+			if err := c.artifacts.Delete(ctx, a); err != nil {
+				return err
+			}
+		}
+		p.report.Count(types.GCArtifact, 1, a.Size)
+		p.report.Add(types.GCItem{Kind: types.GCArtifact, ID: a.JobID + "/" + a.Path, Bytes: a.Size, Reason: reason})
+	}
+	return nil
+}
+
+// expireLog deletes the log of a job, if it still has one.
+func (c *Collector) expireLog(ctx context.Context, p *pass, jobID, reason string) error {
+	log, err := c.store.GetJobLog(ctx, jobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !p.report.DryRun {
+		if err := c.logs.Delete(ctx, log); err != nil {
+			return err
+		}
+	}
+	p.report.Count(types.GCLog, 1, log.Size)
+	p.report.Add(types.GCItem{Kind: types.GCLog, ID: jobID, Bytes: log.Size, Reason: reason})
+	return nil
+}
+
+// collectCaches evicts the project's least recently used caches until they
+// are within its cache quota.
+func (c *Collector) collectCaches(ctx context.Context, p *pass) error {
+	if p.policy.CacheQuota == 0 {
+		return nil
+	}
+	evicted, err := c.caches.Trim(ctx, p.policy.Project, p.policy.CacheQuota, p.report.DryRun)
+	reason := fmt.Sprintf("least recently used beyond the cache quota of %d bytes", p.policy.CacheQuota)
+	for _, e := range evicted {
+		p.report.Count(types.GCCache, 1, e.Size)
+		p.report.Add(types.GCItem{Kind: types.GCCache, ID: e.Key, Bytes: e.Size, Reason: reason})
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"open-cicd/internal/types"
+)
+
+var (
+	// ErrStageNotFound is returned for a stage the pipeline run does not
+	// have.
+	ErrStageNotFound = errors.New("stage not found")
+	// ErrNotAwaitingApproval is returned when deciding on a stage that is
+	// not a manual stage ready to run.
+	ErrNotAwaitingApproval = errors.New("stage is not awaiting approval")
+	// ErrNotAwaitingAuthorization is returned when authorizing a run that
+	// does not wait for it.
+	ErrNotAwaitingAuthorization = errors.New("pipeline is not awaiting authorization")
+)
+
+// DecideStage records by's decision on a manual stage of a pipeline run
+// whose needs have succeeded, then queues the stage's jobs if it was
+// approved or skips them, and the stages needing it, if it was rejected.
+// It returns the run with the decision recorded.
+func (m *Manager) DecideStage(ctx context.Context, id, stage string, decision types.ApprovalDecision, by, comment string) (*types.Pipeline, error) {
+	run, err := m.pipelines.GetPipeline(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	st := run.Stage(stage)
+	if st == nil {
+		return nil, ErrStageNotFound
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Manual {
+		return nil, fmt.Errorf("%w: %s is not a manual stage", ErrNotAwaitingApproval, stage)
+	}
+	if st.Approval != nil {
+		return nil, fmt.Errorf("%w: %s was already %s by %s", ErrNotAwaitingApproval, stage, st.Approval.Decision, st.Approval.By)
+	}
+	if !awaitingApproval(run, st, jobs) {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNotAwaitingApproval, stage, stageState(stageJobs(st, jobs)))
+	}
+
+	approval := &types.StageApproval{Decision: decision, By: by, Comment: comment, At: m.now()}
+	updated, err := m.pipelines.UpdatePipeline(ctx, id, func(p *types.Pipeline) error {
+		s := p.Stage(stage)
+		if s.Approval != nil {
+			return fmt.Errorf("%w: %s was already %s by %s", ErrNotAwaitingApproval, stage, s.Approval.Decision, s.Approval.By)
+		}
+		s.Approval = approval
+		p.UpdatedAt = approval.At
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.notifyPipeline(updated)
+	if err := m.syncPipeline(ctx, id); err != nil {
+		return nil, fmt.Errorf("releasing stage %s: %w", stage, err)
+	}
+	return m.pipelines.GetPipeline(ctx, id)
+}
+
+// AuthorizePipeline lets a run of a pull request from a fork that awaits
+// authorization start, on behalf of by, and returns it. With secrets the
+// run's jobs get its secrets and ID tokens and may save caches, like those
+// of trusted code; otherwise they stay restricted.
+func (m *Manager) AuthorizePipeline(ctx context.Context, id, by, comment string, secrets bool) (*types.Pipeline, error) {
+	run, err := m.pipelines.GetPipeline(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := awaitingAuthorization(run); err != nil {
+		return nil, err
+	}
+	if secrets {
+		// The jobs are lifted first, while nothing can dispatch them.
+		for _, jobID := range run.JobIDs {
+			_, err := m.store.UpdateJob(ctx, jobID, func(j *types.Job) error {
+				j.Restricted = false
+				if j.CacheReadOnly == forkCacheReadOnly {
+					j.CacheReadOnly = ""
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("lifting restriction of job %s: %w", jobID, err)
+			}
+		}
+	}
+
+	authorization := &types.RunAuthorization{By: by, Comment: comment, Secrets: secrets, At: m.now()}
+	updated, err := m.pipelines.UpdatePipeline(ctx, id, func(p *types.Pipeline) error {
+		if err := awaitingAuthorization(p); err != nil {
+			return err
+		}
+		p.AwaitingAuthorization, p.Authorization = false, authorization
+		if secrets {
+			p.Restricted = false
+		}
+		p.UpdatedAt = authorization.At
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.notifyPipeline(updated)
+	if err := m.syncPipeline(ctx, id); err != nil {
+		return nil, fmt.Errorf("releasing pipeline: %w", err)
+	}
+	return m.pipelines.GetPipeline(ctx, id)
+}
+
+// awaitingAuthorization returns why run cannot be authorized, or nil if it
+// can.
+func awaitingAuthorization(run *types.Pipeline) error {
+	switch {
+	case run.Authorization != nil:
+		return fmt.Errorf("%w: already authorized by %s", ErrNotAwaitingAuthorization, run.Authorization.By)
+	case !run.AwaitingAuthorization:
+		return ErrNotAwaitingAuthorization
+	case run.State != types.PipelineStatePending:
+		return fmt.Errorf("%w: pipeline is %s", ErrNotAwaitingAuthorization, run.State)
+	}
+	return nil
+}
+
+// announceApprovals records when the manual stages of a run that now await
+// approval started waiting and tells the approval observers about each of
+// them, once. It returns the run as updated, or run itself when no stage
+// started waiting.
+func (m *Manager) announceApprovals(ctx context.Context, run *types.Pipeline, jobs map[string]*types.Job) *types.Pipeline {
+	waiting := false
+	for i := range run.Stages {
+		st := &run.Stages[i]
+		if st.AwaitingSince == nil && awaitingApproval(run, st, jobs) {
+			waiting = true
+		}
+	}
+	if !waiting {
+		return run
+	}
+	var started []string
+	now := m.now()
+	updated, err := m.pipelines.UpdatePipeline(ctx, run.ID, func(p *types.Pipeline) error {
+		started = started[:0]
+		for i := range p.Stages {
+			st := &p.Stages[i]
+			if st.AwaitingSince == nil && awaitingApproval(p, st, jobs) {
+				st.AwaitingSince = &now
+				started = append(started, st.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "recording stages awaiting approval", "pipeline_id", run.ID, "error", err)
+		return run
+	}
+	for _, stage := range started {
+		m.notifyApproval(updated, stage)
+	}
+	return updated
+}
+
+// awaitingApproval reports whether st is a manual stage without a decision
+// whose jobs are pending and whose needs have all succeeded.
+func awaitingApproval(run *types.Pipeline, st *types.PipelineStage, jobs map[string]*types.Job) bool {
+	if !st.Manual || st.Approval != nil || !hasPending(stageJobs(st, jobs)) {
+		return false
+	}
+	for _, need := range st.Needs {
+		needed := run.Stage(need)
+		if needed == nil {
+			return false
+		}
+		if succeeded, _ := needOutcome(stageJobs(needed, jobs)); !succeeded {
+			return false
+		}
+	}
+	return true
+}
+
+// stageJobs returns the jobs of st from jobs, which holds every job of the
+// run.
+func stageJobs(st *types.PipelineStage, jobs map[string]*types.Job) []*types.Job {
+	list := make([]*types.Job, 0, len(st.JobIDs))
+	for _, id := range st.JobIDs {
+		list = append(list, jobs[id])
+	}
+	return list
+}
@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+
+	"open-cicd/internal/types"
+)
+
+// ComparePipelines compares two runs, typically of the same pipeline, from
+// the timelines and environments of their jobs, matched by name. Runs still
+// in progress compare with the durations so far of their finished jobs.
+func (m *Manager) ComparePipelines(ctx context.Context, base, head *types.Pipeline) (*types.PipelineComparison, error) {
+	baseJobs, err := m.runJobs(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	headJobs, err := m.runJobs(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	baseTL, headTL := runTimeline(base, baseJobs, now), runTimeline(head, headJobs, now)
+
+	c := &types.PipelineComparison{
+		Base:           comparedRun(base, baseTL),
+		Head:           comparedRun(head, headTL),
+		DurationDelta:  headTL.Duration - baseTL.Duration,
+		QueueTimeDelta: headTL.QueueTime - baseTL.QueueTime,
+		Added:          []string{},
+		Removed:        []string{},
+		Jobs:           []types.JobComparison{},
+		Variables:      diffVariables("", base.Inputs, head.Inputs),
+	}
+
+	baseByName := timelinesByName(baseTL)
+	headByName := timelinesByName(headTL)
+	for _, stage := range headTL.Stages {
+		for _, h := range stage.Jobs {
+			b, ok := baseByName[h.Name]
+			if !ok {
+				c.Added = append(c.Added, h.Name)
+				continue
+			}
+			c.Jobs = append(c.Jobs, types.JobComparison{
+				Name:           h.Name,
+				Stage:          stage.Stage,
+				BaseState:      b.State,
+				HeadState:      h.State,
+				BaseDuration:   b.Duration,
+				HeadDuration:   h.Duration,
+				DurationDelta:  h.Duration - b.Duration,
+				QueueTimeDelta: h.QueueTime - b.QueueTime,
+			})
+			c.Variables = append(c.Variables, diffVariables(h.Name, baseJobs[b.ID].Env, headJobs[h.ID].Env)...)
+		}
+	}
+	for _, stage := range baseTL.Stages {
+		for _, b := range stage.Jobs {
+			if _, ok := headByName[b.Name]; !ok {
+				c.Removed = append(c.Removed, b.Name)
+			}
+		}
+	}
+	slices.SortStableFunc(c.Jobs, func(a, b types.JobComparison) int { return cmp.Compare(b.DurationDelta, a.DurationDelta) })
+	return c, nil
+}
+
+// comparedRun summarizes a run of a comparison.
+func comparedRun(run *types.Pipeline, tl *types.PipelineTimeline) types.ComparedRun {
+	return types.ComparedRun{
+		ID:        run.ID,
+		Name:      run.Name,
+		Ref:       run.Ref,
+		Commit:    run.Commit,
+		State:     run.State,
+		CreatedAt: run.CreatedAt,
+		QueueTime: tl.QueueTime,
+		Duration:  tl.Duration,
+	}
+}
+
+// timelinesByName indexes the job timelines of a run by job name.
+func timelinesByName(tl *types.PipelineTimeline) map[string]types.JobTimeline {
+	byName := make(map[string]types.JobTimeline)
+	for _, stage := range tl.Stages {
+		for _, job := range stage.Jobs {
+			byName[job.Name] = job
+		}
+	}
+	return byName
+}
+
+// diffVariables lists the variables set differently in base and head, by
+// name.
+func diffVariables(job string, base, head map[string]string) []types.VariableChange {
+	names := slices.Sorted(maps.Keys(base))
+	for name := range head {
+		if _, ok := base[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	changes := []types.VariableChange{}
+	for _, name := range names {
+		b, inBase := base[name]
+		h, inHead := head[name]
+		if inBase && inHead && b == h {
+			continue
+		}
+		change := types.VariableChange{Job: job, Name: name}
+		if inBase {
+			change.Base = &b
+		}
+		if inHead {
+			change.Head = &h
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
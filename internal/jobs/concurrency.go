@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// groupRuns returns the unfinished runs of repository in a concurrency
+// group, oldest first.
+func (m *Manager) groupRuns(ctx context.Context, repository, group string) ([]*types.Pipeline, error) {
+	var runs []*types.Pipeline
+	for _, state := range []types.PipelineState{types.PipelineStatePending, types.PipelineStateRunning} {
+		list, err := m.pipelines.ListPipelines(ctx, storage.PipelineFilter{State: state, Repository: repository})
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range list {
+			if run.Concurrency == group {
+				runs = append(runs, run)
+			}
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+	return runs, nil
+}
+
+// supersede cancels the unfinished jobs of runs, which run replaces.
+func (m *Manager) supersede(ctx context.Context, run *types.Pipeline, runs []*types.Pipeline) {
+	reason := "superseded by pipeline " + run.ID
+	for _, old := range runs {
+		for _, id := range old.JobIDs {
+			_, err := m.Cancel(ctx, id, "pipeline "+run.ID, reason)
+			if err != nil && !errors.Is(err, types.ErrInvalidTransition) {
+				slog.ErrorContext(ctx, "cancelling superseded job", "pipeline_id", old.ID, "job_id", id, "error", err)
+			}
+		}
+		slog.InfoContext(ctx, "Superseded pipeline", "pipeline_id", old.ID, "superseded_by", run.ID, "concurrency", run.Concurrency)
+	}
+}
+
+// held reports whether a pending run still waits for authorization or for
+// an earlier run of its concurrency group. The run waits for the latest
+// unfinished run created before it; WaitingFor is kept up to date as those
+// runs finish.
+func (m *Manager) held(ctx context.Context, run *types.Pipeline) (bool, error) {
+	if run.AwaitingAuthorization {
+		return true, nil
+	}
+	if run.WaitingFor == "" || run.State != types.PipelineStatePending {
+		return false, nil
+	}
+	runs, err := m.groupRuns(ctx, run.Repository, run.Concurrency)
+	if err != nil {
+		return false, err
+	}
+	ahead := ""
+	for _, r := range runs {
+		if r.ID == run.ID {
+			break
+		}
+		ahead = r.ID
+	}
+	if ahead == run.WaitingFor {
+		return true, nil
+	}
+	updated, err := m.pipelines.UpdatePipeline(ctx, run.ID, func(p *types.Pipeline) error {
+		p.WaitingFor = ahead
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	run.WaitingFor = updated.WaitingFor
+	if ahead == "" {
+		slog.InfoContext(ctx, "Released pipeline from its concurrency group", "pipeline_id", run.ID, "concurrency", run.Concurrency)
+		m.notifyPipeline(updated)
+	}
+	return ahead != "", nil
+}
+
+// releaseNext brings the first waiting run of the concurrency group of run,
+// which just finished, up to date so that it starts if nothing else is
+// ahead of it.
+func (m *Manager) releaseNext(ctx context.Context, run *types.Pipeline) {
+	runs, err := m.groupRuns(ctx, run.Repository, run.Concurrency)
+	if err != nil {
+		slog.ErrorContext(ctx, "loading concurrency group", "pipeline_id", run.ID, "concurrency", run.Concurrency, "error", err)
+		return
+	}
+	for _, next := range runs {
+		if next.WaitingFor == "" {
+			continue
+		}
+		if err := m.syncPipeline(ctx, next.ID); err != nil {
+			slog.ErrorContext(ctx, "releasing pipeline from its concurrency group", "pipeline_id", next.ID, "error", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrCrossOrganization is returned by StartDownstream for trigger steps
+// naming a repository of another organization than their run's.
+var ErrCrossOrganization = errors.New("trigger steps may only start pipelines of their own organization")
+
+// StartDownstream moves the queued job of a trigger step straight to
+// running, holding no agent or lease, and returns it with its trigger
+// resolved against the results of its run. The caller starts the
+// downstream run and links it with LinkDownstream.
+func (m *Manager) StartDownstream(ctx context.Context, id string) (*types.Job, *types.PipelineTrigger, error) {
+	job, err := m.store.GetJob(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.Trigger == nil {
+		return nil, nil, fmt.Errorf("job %s is not a trigger step", id)
+	}
+	run, err := m.pipelines.GetPipeline(ctx, job.PipelineID)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, nil, err
+	}
+	list := make([]*types.Job, 0, len(run.JobIDs))
+	for _, jobID := range run.JobIDs {
+		list = append(list, jobs[jobID])
+	}
+	fields := pipeline.ResolveResults(map[string]string{
+		"repository": job.Trigger.Repository,
+		"clone_url":  job.Trigger.CloneURL,
+		"ref":        job.Trigger.Ref,
+	}, collectResults(list))
+	trigger := &types.PipelineTrigger{
+		Repository: fields["repository"],
+		CloneURL:   fields["clone_url"],
+		Ref:        fields["ref"],
+		Inputs:     pipeline.ResolveResults(job.Trigger.Inputs, collectResults(list)),
+		Wait:       job.Trigger.Wait,
+	}
+	org, err := storage.OrganizationOf(ctx, m.projects, trigger.Repository)
+	if err != nil {
+		return nil, nil, err
+	}
+	if org != job.Organization {
+		return nil, nil, fmt.Errorf("%w: %s is not in organization %q", ErrCrossOrganization, trigger.Repository, job.Organization)
+	}
+
+	job, err = m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+		if err := j.Transition(types.JobStateAssigned, m.now(), "starting downstream pipeline"); err != nil {
+			return err
+		}
+		return j.Transition(types.JobStateRunning, m.now(), "")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	m.transitioned(ctx, job)
+	return job, trigger, nil
+}
+
+// LinkDownstream records child as the downstream run the trigger step job
+// started, on the job and among the children of its run.
+func (m *Manager) LinkDownstream(ctx context.Context, id string, child *types.Pipeline) (*types.Job, error) {
+	job, err := m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+		j.Downstream = child.ID
+		j.UpdatedAt = m.now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	run, err := m.pipelines.UpdatePipeline(ctx, job.PipelineID, func(p *types.Pipeline) error {
+		p.Children = append(p.Children, types.PipelineLink{PipelineID: child.ID, Repository: child.Repository, JobID: job.ID})
+		p.UpdatedAt = m.now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.notifyPipeline(run)
+	m.notify(job)
+	return job, nil
+}
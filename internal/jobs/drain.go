@@ -0,0 +1,144 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrShuttingDown is returned by Submit once the manager has started draining.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// drainPollInterval is how often Drain checks whether agents have handed
+// their jobs back.
+const drainPollInterval = 500 * time.Millisecond
+
+// Draining reports whether the manager has stopped accepting new jobs.
+func (m *Manager) Draining() bool {
+	return m.draining.Load()
+}
+
+// Drain stops accepting new submissions and asks agents to hand back every
+// assigned or running job. It waits until agents acknowledge by reporting the
+// jobs as queued, or until ctx is done, at which point jobs still held by
+// agents whose leases ran out are re-queued by the server so they survive a
+// restart. The others stay with their agents until the leases are renewed
+// or expire.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.draining.Store(true)
+
+	pending, err := m.markForRequeue(ctx)
+	if err != nil {
+		return err
+	}
+	if pending == 0 {
+		return nil
+	}
+	slog.InfoContext(ctx, "Waiting for agents to hand back in-flight jobs", "jobs", pending)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return m.forceRequeue()
+		case <-ticker.C:
+			held, err := m.inFlight(ctx)
+			if err != nil {
+				return err
+			}
+			if len(held) == 0 {
+				slog.InfoContext(ctx, "All in-flight jobs handed back")
+				return nil
+			}
+		}
+	}
+}
+
+// inFlight returns all jobs currently held by agents. The jobs of trigger
+// steps are held by no agent and keep following their downstream runs.
+func (m *Manager) inFlight(ctx context.Context) ([]*types.Job, error) {
+	var held []*types.Job
+	for _, state := range []types.JobState{types.JobStateAssigned, types.JobStateRunning} {
+		list, err := m.store.ListJobs(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		for _, job := range list {
+			if job.Trigger == nil {
+				held = append(held, job)
+			}
+		}
+	}
+	return held, nil
+}
+
+// markForRequeue flags every in-flight job for re-queue and returns how many
+// were flagged.
+func (m *Manager) markForRequeue(ctx context.Context) (int, error) {
+	held, err := m.inFlight(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range held {
+		updated, err := m.store.UpdateJob(ctx, job.ID, func(j *types.Job) error {
+			j.RequeueRequested = true
+			j.UpdatedAt = m.now()
+			return nil
+		})
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("marking job %s for re-queue: %w", job.ID, err)
+		}
+		m.notify(updated)
+	}
+	return len(held), nil
+}
+
+// forceRequeue re-queues jobs whose agents did not acknowledge in time and
+// whose leases ran out, as the agents of the others may still be running
+// them. It uses a fresh context since the drain deadline has already passed.
+func (m *Manager) forceRequeue() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	held, err := m.inFlight(ctx)
+	if err != nil {
+		return err
+	}
+	requeued, leased := 0, 0
+	for _, job := range held {
+		updated, err := m.store.UpdateJob(ctx, job.ID, func(j *types.Job) error {
+			if j.LeaseExpiresAt != nil && !j.LeaseExpired(m.now()) {
+				return errLeaseLive
+			}
+			if err := j.Transition(types.JobStateQueued, m.now(), "server shut down before agent acknowledged"); err != nil {
+				return err
+			}
+			j.AgentID = ""
+			j.RequeueRequested = false
+			return nil
+		})
+		if errors.Is(err, errLeaseLive) {
+			leased++
+			continue
+		}
+		if errors.Is(err, types.ErrInvalidTransition) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("re-queueing job %s: %w", job.ID, err)
+		}
+		m.transitioned(ctx, updated)
+		requeued++
+	}
+	slog.Warn("Drain deadline passed; re-queued unacknowledged jobs", "jobs", requeued, "leased", leased)
+	return nil
+}
@@ -0,0 +1,250 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/types"
+)
+
+// stageState derives a stage's state from the states of its jobs. Failed
+// jobs that allow failure count as succeeded; timed out jobs as failed.
+func stageState(jobs []*types.Job) types.StageState {
+	counts := make(map[types.JobState]int)
+	for _, j := range jobs {
+		if j.Passed() {
+			counts[types.JobStateSucceeded]++
+			continue
+		}
+		state := j.State
+		if state.Failure() {
+			state = types.JobStateFailed
+		}
+		counts[state]++
+	}
+	done := 0
+	for state, n := range counts {
+		if state.Terminal() {
+			done += n
+		}
+	}
+	switch {
+	case done == len(jobs) && counts[types.JobStateFailed] > 0:
+		return types.StageStateFailed
+	case done == len(jobs) && counts[types.JobStateCancelled] > 0:
+		return types.StageStateCancelled
+	case done == len(jobs) && counts[types.JobStateSkipped] > 0:
+		return types.StageStateSkipped
+	case done == len(jobs):
+		return types.StageStateSucceeded
+	case counts[types.JobStatePending] == len(jobs):
+		return types.StageStateWaiting
+	case counts[types.JobStateQueued] == len(jobs):
+		return types.StageStateQueued
+	default:
+		return types.StageStateRunning
+	}
+}
+
+// needOutcome reports whether a stage another stage needs has succeeded,
+// and whether it can no longer succeed because one of its jobs finished
+// without passing. A dependent is skipped as soon as that happens rather
+// than after the rest of the stage finishes.
+func needOutcome(jobs []*types.Job) (succeeded, broken bool) {
+	succeeded = true
+	for _, j := range jobs {
+		if !j.Passed() {
+			succeeded = false
+			if j.State.Terminal() {
+				broken = true
+			}
+		}
+	}
+	return succeeded, broken
+}
+
+func hasPending(jobs []*types.Job) bool {
+	for _, j := range jobs {
+		if j.State == types.JobStatePending {
+			return true
+		}
+	}
+	return false
+}
+
+// advanceStages queues the pending jobs of every stage whose needs have all
+// succeeded, once approved if the stage is manual, with the outputs of the
+// steps of the stages they need resolved, and skips those of
+// stages with a need that cannot succeed or whose approval was rejected,
+// repeating until nothing changes so that skips cascade down the graph.
+// jobs is updated in place; the changed jobs are returned for notification.
+func (m *Manager) advanceStages(ctx context.Context, run *types.Pipeline, jobs map[string]*types.Job) ([]*types.Job, error) {
+	byName := make(map[string]*types.PipelineStage, len(run.Stages))
+	for i := range run.Stages {
+		byName[run.Stages[i].Name] = &run.Stages[i]
+	}
+
+	var changed []*types.Job
+	for progress := true; progress; {
+		progress = false
+		for i := range run.Stages {
+			st := &run.Stages[i]
+			if !hasPending(stageJobs(st, jobs)) {
+				continue
+			}
+			next, reason := types.JobStateQueued, "needed stages succeeded: "+strings.Join(st.Needs, ", ")
+			if len(st.Needs) == 0 {
+				reason = released(run)
+			}
+			for _, need := range st.Needs {
+				needed, ok := byName[need]
+				if !ok {
+					return changed, fmt.Errorf("stage %s needs unknown stage %s", st.Name, need)
+				}
+				succeeded, broken := needOutcome(stageJobs(needed, jobs))
+				if broken {
+					next, reason = types.JobStateSkipped, "needed stage "+need+" did not succeed"
+					break
+				}
+				if !succeeded {
+					next = ""
+				}
+			}
+			if next == types.JobStateQueued && st.Manual {
+				switch {
+				case st.Approval == nil:
+					next = ""
+				case st.Approval.Decision == types.Rejected:
+					next, reason = types.JobStateSkipped, st.Approval.Reason()
+				default:
+					reason = st.Approval.Reason()
+				}
+			}
+			if next == "" {
+				continue
+			}
+			var results map[string]string
+			if next == types.JobStateQueued {
+				results = collectResults(slices.Collect(maps.Values(jobs)))
+			}
+			for _, id := range st.JobIDs {
+				updated, err := m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+					if err := j.Transition(next, m.now(), reason); err != nil {
+						return err
+					}
+					if next == types.JobStateQueued {
+						pipeline.ResolveStepOutputs(j, results)
+					}
+					return nil
+				})
+				if errors.Is(err, types.ErrInvalidTransition) {
+					// Not pending, e.g. cancelled while waiting.
+					continue
+				}
+				if err != nil {
+					return changed, fmt.Errorf("moving job %s to %s: %w", id, next, err)
+				}
+				jobs[id] = updated
+				changed = append(changed, updated)
+				progress = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// released describes why the stages without needs of a run that was held
+// were released.
+func released(run *types.Pipeline) string {
+	var reasons []string
+	if run.Authorization != nil {
+		reasons = append(reasons, run.Authorization.Reason())
+	}
+	if run.Concurrency != "" {
+		reasons = append(reasons, "earlier runs of concurrency group "+run.Concurrency+" finished")
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// PipelineGraph returns the stage graph of a pipeline run with the current
+// state of every stage and job.
+func (m *Manager) PipelineGraph(ctx context.Context, run *types.Pipeline) (*types.PipelineGraph, error) {
+	graph := &types.PipelineGraph{
+		PipelineID: run.ID,
+		State:      run.State,
+		Nodes:      make([]types.GraphNode, 0, len(run.Stages)),
+		Edges:      []types.GraphEdge{},
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	levels := stageLevels(run.Stages)
+	for i := range run.Stages {
+		st := &run.Stages[i]
+		node := types.GraphNode{
+			Stage:    st.Name,
+			Level:    levels[st.Name],
+			Jobs:     make([]types.GraphJob, 0, len(st.JobIDs)),
+			Manual:   st.Manual,
+			Approval: st.Approval,
+		}
+		list := stageJobs(st, jobs)
+		for _, job := range list {
+			gj := types.GraphJob{
+				ID:           job.ID,
+				Name:         job.Name,
+				State:        job.State,
+				Matrix:       job.Matrix,
+				AllowFailure: job.AllowFailure,
+			}
+			if job.Attempt > 1 {
+				gj.Attempt = job.Attempt
+			}
+			if job.PipelineID != run.ID {
+				gj.ReusedFrom = job.PipelineID
+			}
+			node.Jobs = append(node.Jobs, gj)
+		}
+		node.State = stageState(list)
+		if awaitingApproval(run, st, jobs) {
+			node.State = types.StageStateAwaitingApproval
+		}
+		graph.Nodes = append(graph.Nodes, node)
+		for _, need := range st.Needs {
+			graph.Edges = append(graph.Edges, types.GraphEdge{From: need, To: st.Name})
+		}
+	}
+	return graph, nil
+}
+
+// stageLevels returns the length of the longest chain of needs leading to
+// each stage. Pipeline definitions are validated to be acyclic.
+func stageLevels(stages []types.PipelineStage) map[string]int {
+	needs := make(map[string][]string, len(stages))
+	for _, st := range stages {
+		needs[st.Name] = st.Needs
+	}
+	levels := make(map[string]int, len(stages))
+	var level func(name string) int
+	level = func(name string) int {
+		if l, ok := levels[name]; ok {
+			return l
+		}
+		l := 0
+		for _, need := range needs[name] {
+			l = max(l, level(need)+1)
+		}
+		levels[name] = l
+		return l
+	}
+	for _, st := range stages {
+		level(st.Name)
+	}
+	return levels
+}
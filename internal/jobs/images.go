@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/types"
+)
+
+// ErrImageNotResolved is returned for submissions whose image is to be
+// resolved into its variants when that fails, such as because the image
+// does not exist or no resolver is set.
+var ErrImageNotResolved = errors.New("resolving image")
+
+// ImageResolver looks up the variants of a multi-arch image in its
+// registry, as registry.Client does.
+type ImageResolver interface {
+	// Resolve returns the variants of image for the operating system os,
+	// pinned by digest and keyed by architecture.
+	Resolve(ctx context.Context, image, os string) (map[string]string, error)
+}
+
+// DefaultBuilderImage is the BuildKit image image builds run in unless
+// SetImageBuilder names another.
+const DefaultBuilderImage = "moby/buildkit:v0.16.0-rootless"
+
+// SetImageBuilder sets how the build_image steps of submitted definitions
+// run. It must be called before the manager takes submissions.
+func (m *Manager) SetImageBuilder(b pipeline.ImageBuilder) {
+	m.images = b
+}
+
+// buildImage turns job into the BuildKit job of the image build of its
+// step, keeping the secrets its step declares.
+func (m *Manager) buildImage(job *types.Job, b *pipeline.ImageBuild) {
+	builder := m.images
+	builder.Image = cmp.Or(builder.Image, DefaultBuilderImage)
+	spec := builder.Job(b)
+	job.Image = spec.Image
+	job.Entrypoint = nil
+	job.Commands = spec.Commands
+	job.Caches = spec.Caches
+	for _, name := range spec.Secrets {
+		if !slices.Contains(job.Secrets, name) {
+			job.Secrets = append(job.Secrets, name)
+		}
+	}
+}
+
+// SetImageResolver sets what looks up the variants of the images jobs ask
+// to have resolved, with resolve_image. It must be called before the
+// manager takes submissions.
+func (m *Manager) SetImageResolver(r ImageResolver) {
+	m.resolver = r
+}
+
+// resolveImage returns the variants of job's image for its operating
+// system, Linux unless it names another, so that it runs on agents of any
+// architecture the image is built for, in the same image on each.
+func (m *Manager) resolveImage(ctx context.Context, job *types.Job) (map[string]string, error) {
+	if m.resolver == nil {
+		return nil, fmt.Errorf("%w %s: no registry client is configured", ErrImageNotResolved, job.Image)
+	}
+	images, err := m.resolver.Resolve(ctx, job.Image, cmp.Or(job.OS, types.OSLinux))
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrImageNotResolved, job.Image, err)
+	}
+	if job.Arch != "" && images[job.Arch] == "" {
+		return nil, fmt.Errorf("%w %s: it has no %s variant", ErrImageNotResolved, job.Image, job.Arch)
+	}
+	return images, nil
+}
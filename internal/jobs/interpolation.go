@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/types"
+)
+
+// VariableSource returns the variables that apply to a ref of a project, by
+// name, which ${{ vars.NAME }} expressions resolve to.
+type VariableSource interface {
+	Env(ctx context.Context, project, ref string) (map[string]string, error)
+}
+
+// SecretSource lists the secrets of a project without their values, which
+// ${{ secrets.NAME }} expressions may refer to.
+type SecretSource interface {
+	List(ctx context.Context, project string) ([]*types.Secret, error)
+}
+
+// SetScopeSources sets where the variables and secrets the expressions of
+// submitted definitions refer to come from. Without them every variable
+// and secret expression is undefined. It must be called before the manager
+// takes submissions.
+func (m *Manager) SetScopeSources(variables VariableSource, secrets SecretSource) {
+	m.variables, m.secrets = variables, secrets
+}
+
+// Interpolate resolves the expressions of def for a run of repository at
+// ref and commit started by t, which is nil for runs submitted through the
+// API, and passed inputs, as pipeline.Definition.Interpolate describes. It
+// returns the inputs of the run. A definition referring to a variable or
+// secret that is not defined, or passed an input it does not declare, fails
+// with a pipeline.ErrorList.
+func (m *Manager) Interpolate(ctx context.Context, def *pipeline.Definition, repository, ref, commit string, t *types.Trigger, inputs map[string]string) (map[string]string, error) {
+	inputs, err := def.ResolveInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	scope := &pipeline.Scope{Trigger: pipeline.NewConditionContext(t, repository, ref), Commit: commit, Inputs: inputs}
+	if t != nil && t.Commit != "" {
+		scope.Commit = t.Commit
+	}
+	if m.variables != nil {
+		vars, err := m.variables.Env(ctx, repository, ref)
+		if err != nil {
+			return nil, fmt.Errorf("loading variables: %w", err)
+		}
+		scope.Vars = vars
+	}
+	if m.secrets != nil && repository != "" {
+		secrets, err := m.secrets.List(ctx, repository)
+		if err != nil {
+			return nil, fmt.Errorf("listing secrets: %w", err)
+		}
+		for _, secret := range secrets {
+			scope.Secrets = append(scope.Secrets, secret.Name)
+		}
+	}
+	if err := def.Interpolate(scope); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// DefaultLeaseDuration is how long an assignment is leased for until it is
+// renewed, unless SetLeaseDuration says otherwise.
+const DefaultLeaseDuration = 30 * time.Second
+
+// ErrLeaseLost is returned when an agent acts on a job under a lease it no
+// longer holds: the job was re-queued, finished or assigned again.
+var ErrLeaseLost = errors.New("agent no longer holds the lease on the job")
+
+// errLeaseLive stops a lease from being expired once it turns out to have
+// been renewed, or the job assigned again, in the meantime.
+var errLeaseLive = errors.New("lease has not expired")
+
+// SetLeaseDuration sets how long assignments are leased for. Agents renew
+// their leases with every heartbeat, so it must be several heartbeat
+// intervals long. It can be called at any time and applies from the next
+// assignment or renewal on.
+func (m *Manager) SetLeaseDuration(d time.Duration) {
+	m.lease.Store(int64(d))
+}
+
+func (m *Manager) leaseDuration() time.Duration {
+	if d := time.Duration(m.lease.Load()); d > 0 {
+		return d
+	}
+	return DefaultLeaseDuration
+}
+
+// Report applies a status report of the agent req names acting on a job
+// under the lease of req.LeaseToken. It fails with ErrLeaseLost unless the
+// agent still holds that lease, so that an agent that lost the job, for
+// example to a lease that expired while it was cut off, cannot change it
+// under the agent running it now.
+func (m *Manager) Report(ctx context.Context, id string, req types.JobStatusRequest) (*types.Job, error) {
+	return m.update(ctx, id, req, func(j *types.Job) error {
+		if !j.HoldsLease(req.AgentID, req.LeaseToken) {
+			return ErrLeaseLost
+		}
+		return nil
+	})
+}
+
+// RenewLeases extends the leases an agent holds, given as fencing tokens by
+// job ID, by the lease duration from now. It returns the IDs of the jobs
+// whose leases the agent no longer holds, which it must stop, and the
+// duration the others were renewed for.
+func (m *Manager) RenewLeases(ctx context.Context, agentID string, leases map[string]int64) ([]string, time.Duration, error) {
+	d := m.leaseDuration()
+	var revoked []string
+	for id, token := range leases {
+		_, err := m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+			if !j.HoldsLease(agentID, token) {
+				return ErrLeaseLost
+			}
+			// A lease that expired lives on until ExpireLeases re-queues
+			// the job, so renewing it is still safe.
+			expires := m.now().Add(d)
+			j.LeaseExpiresAt = &expires
+			return nil
+		})
+		if errors.Is(err, ErrLeaseLost) || errors.Is(err, storage.ErrNotFound) {
+			revoked = append(revoked, id)
+			continue
+		}
+		if err != nil {
+			return revoked, d, fmt.Errorf("renewing lease on job %s: %w", id, err)
+		}
+	}
+	return revoked, d, nil
+}
+
+// ExpireLeases hands every job whose lease ran out back to the queue and
+// returns those jobs; jobs that were being cancelled are marked cancelled
+// instead. Agents stop the jobs whose leases they could not renew before
+// the leases run out, so a re-queued job cannot run twice.
+func (m *Manager) ExpireLeases(ctx context.Context) ([]*types.Job, error) {
+	now := m.now()
+	var requeued []*types.Job
+	for _, state := range []types.JobState{types.JobStateAssigned, types.JobStateRunning, types.JobStateCancelling} {
+		held, err := m.store.ListJobs(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return requeued, fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		for _, job := range held {
+			if !job.LeaseExpired(now) {
+				continue
+			}
+			next := types.JobStateQueued
+			if state == types.JobStateCancelling {
+				next = types.JobStateCancelled
+			}
+			update := types.JobStatusRequest{State: next, AgentID: job.AgentID, Reason: "lease of agent " + job.AgentID + " expired"}
+			updated, err := m.update(ctx, job.ID, update, func(j *types.Job) error {
+				if j.LeaseToken != job.LeaseToken || !j.LeaseExpired(now) {
+					return errLeaseLive
+				}
+				return nil
+			})
+			if errors.Is(err, errLeaseLive) || errors.Is(err, types.ErrInvalidTransition) || errors.Is(err, ErrAgentMismatch) || errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return requeued, fmt.Errorf("expiring lease on job %s: %w", job.ID, err)
+			}
+			if next == types.JobStateQueued {
+				requeued = append(requeued, updated)
+			}
+		}
+	}
+	return requeued, nil
+}
+
+// MarkLost gives up on a job that hangs on its agent, although the agent
+// keeps renewing its lease: the job fails with reason as a failure of the
+// environment it ran in, which its retry policy may cover, in which case it
+// is queued for its next attempt instead. The agent no longer holds the
+// lease and stops the job. It fails with ErrLeaseLost unless the job is
+// still in the state of job, assigned or running, under the same
+// assignment.
+func (m *Manager) MarkLost(ctx context.Context, job *types.Job, reason string) (*types.Job, error) {
+	update := types.JobStatusRequest{State: types.JobStateFailed, AgentID: job.AgentID, Infrastructure: true, Reason: reason}
+	return m.update(ctx, job.ID, update, func(j *types.Job) error {
+		if j.State != job.State || j.State == types.JobStateCancelling || !j.HoldsLease(job.AgentID, job.LeaseToken) {
+			return ErrLeaseLost
+		}
+		return nil
+	})
+}
@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// clock is a time that tests move by hand.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newLeaseManager(t *testing.T) (*Manager, *clock) {
+	t.Helper()
+	store := storage.NewMemory()
+	m := NewManager(store, store, store, store)
+	c := &clock{t: time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)}
+	m.now = c.now
+	m.SetLeaseDuration(time.Minute)
+	return m, c
+}
+
+// assigned submits a job and assigns it to agent.
+func assigned(t *testing.T, m *Manager, agent string) *types.Job {
+	t.Helper()
+	ctx := context.Background()
+	job, err := m.Submit(ctx, types.CreateJobRequest{Name: "build", Repository: "acme/app", Image: "golang", Commands: []string{"make"}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	job, err = m.Assign(ctx, job.ID, agent)
+	if err != nil {
+		t.Fatalf("Assign: %v", err)
+	}
+	return job
+}
+
+func TestReportFencing(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup leaves a job held by some agent and returns the agent and
+		// fencing token the report is made under.
+		setup   func(t *testing.T, m *Manager, c *clock) (job *types.Job, agent string, token int64)
+		wantErr error
+	}{
+		{
+			name: "holder of the lease",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				job := assigned(t, m, "a")
+				return job, "a", job.LeaseToken
+			},
+		},
+		{
+			name: "stale token",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				job := assigned(t, m, "a")
+				return job, "a", job.LeaseToken - 1
+			},
+			wantErr: ErrLeaseLost,
+		},
+		{
+			name: "other agent",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				job := assigned(t, m, "a")
+				return job, "b", job.LeaseToken
+			},
+			wantErr: ErrLeaseLost,
+		},
+		{
+			name: "agent of an earlier assignment",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				ctx := context.Background()
+				job := assigned(t, m, "a")
+				if _, err := m.Requeue(ctx, job.ID, "agent went away"); err != nil {
+					t.Fatalf("Requeue: %v", err)
+				}
+				if _, err := m.Assign(ctx, job.ID, "b"); err != nil {
+					t.Fatalf("Assign: %v", err)
+				}
+				return job, "a", job.LeaseToken
+			},
+			wantErr: ErrLeaseLost,
+		},
+		{
+			name: "same agent assigned again",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				ctx := context.Background()
+				job := assigned(t, m, "a")
+				if _, err := m.Requeue(ctx, job.ID, "agent reconnected"); err != nil {
+					t.Fatalf("Requeue: %v", err)
+				}
+				if _, err := m.Assign(ctx, job.ID, "a"); err != nil {
+					t.Fatalf("Assign: %v", err)
+				}
+				return job, "a", job.LeaseToken
+			},
+			wantErr: ErrLeaseLost,
+		},
+		{
+			name: "expired lease",
+			setup: func(t *testing.T, m *Manager, c *clock) (*types.Job, string, int64) {
+				job := assigned(t, m, "a")
+				c.t = c.t.Add(2 * time.Minute)
+				if _, err := m.ExpireLeases(context.Background()); err != nil {
+					t.Fatalf("ExpireLeases: %v", err)
+				}
+				return job, "a", job.LeaseToken
+			},
+			wantErr: ErrLeaseLost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, c := newLeaseManager(t)
+			job, agent, token := tt.setup(t, m, c)
+			before, err := m.Get(context.Background(), job.ID)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			_, err = m.Report(context.Background(), job.ID, types.JobStatusRequest{State: types.JobStateRunning, AgentID: agent, LeaseToken: token})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Report error = %v, want %v", err, tt.wantErr)
+			}
+			after, err := m.Get(context.Background(), job.ID)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if tt.wantErr != nil && (after.State != before.State || after.AgentID != before.AgentID) {
+				t.Errorf("rejected report moved the job from %s on %q to %s on %q", before.State, before.AgentID, after.State, after.AgentID)
+			}
+		})
+	}
+}
+
+func TestRenewLeases(t *testing.T) {
+	m, c := newLeaseManager(t)
+	ctx := context.Background()
+	held := assigned(t, m, "a")
+	lost := assigned(t, m, "a")
+	if _, err := m.Requeue(ctx, lost.ID, "agent went away"); err != nil {
+		t.Fatalf("Requeue: %v", err)
+	}
+	c.t = c.t.Add(30 * time.Second)
+	revoked, d, err := m.RenewLeases(ctx, "a", map[string]int64{
+		held.ID:   held.LeaseToken,
+		lost.ID:   lost.LeaseToken,
+		"missing": 1,
+	})
+	if err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+	slices.Sort(revoked)
+	want := []string{lost.ID, "missing"}
+	slices.Sort(want)
+	if !slices.Equal(revoked, want) {
+		t.Errorf("revoked %v, want %v", revoked, want)
+	}
+	if d != time.Minute {
+		t.Errorf("renewed for %v, want %v", d, time.Minute)
+	}
+	job, err := m.Get(ctx, held.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := c.t.Add(time.Minute); job.LeaseExpiresAt == nil || !job.LeaseExpiresAt.Equal(want) {
+		t.Errorf("lease expires at %v, want %v", job.LeaseExpiresAt, want)
+	}
+}
+
+func TestExpireLeases(t *testing.T) {
+	m, c := newLeaseManager(t)
+	ctx := context.Background()
+	expiring := assigned(t, m, "a")
+	renewed := assigned(t, m, "b")
+
+	c.t = c.t.Add(45 * time.Second)
+	if _, _, err := m.RenewLeases(ctx, "b", map[string]int64{renewed.ID: renewed.LeaseToken}); err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+	c.t = c.t.Add(30 * time.Second)
+	requeued, err := m.ExpireLeases(ctx)
+	if err != nil {
+		t.Fatalf("ExpireLeases: %v", err)
+	}
+	if len(requeued) != 1 || requeued[0].ID != expiring.ID {
+		t.Fatalf("requeued %v, want only %s", requeued, expiring.ID)
+	}
+	if job := requeued[0]; job.State != types.JobStateQueued || job.AgentID != "" {
+		t.Errorf("expired job is %s on %q, want queued on no agent", job.State, job.AgentID)
+	}
+	job, err := m.Get(ctx, renewed.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if job.State != types.JobStateAssigned || job.AgentID != "b" {
+		t.Errorf("renewed job is %s on %q, want assigned on b", job.State, job.AgentID)
+	}
+
+	// The next assignment is fenced off from the agent that lost the job.
+	next, err := m.Assign(ctx, expiring.ID, "b")
+	if err != nil {
+		t.Fatalf("Assign: %v", err)
+	}
+	if next.LeaseToken <= expiring.LeaseToken {
+		t.Errorf("fencing token went from %d to %d, want it to grow", expiring.LeaseToken, next.LeaseToken)
+	}
+}
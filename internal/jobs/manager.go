@@ -0,0 +1,383 @@
+// Package jobs owns the job lifecycle: submission, state transitions and
+// queries. All job state changes go through a Manager so the job state
+// machine is enforced in one place.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrAgentMismatch is returned when an agent reports on a job assigned to a
+// different agent.
+var ErrAgentMismatch = errors.New("job is assigned to a different agent")
+
+// Manager implements job submission and lifecycle transitions.
+type Manager struct {
+	store     storage.JobStore
+	pipelines storage.PipelineStore
+	projects  storage.OrganizationStore
+	limits    storage.ProjectQuotaStore
+	now       func() time.Time
+	draining  atomic.Bool
+	// lease is how long assignments are leased for, as a time.Duration;
+	// zero means DefaultLeaseDuration.
+	lease atomic.Int64
+	// variables and secrets resolve the expressions of definitions; see
+	// SetScopeSources.
+	variables VariableSource
+	secrets   SecretSource
+	// images runs the image builds of steps; see SetImageBuilder.
+	images pipeline.ImageBuilder
+	// resolver looks up the variants of multi-arch images; see
+	// SetImageResolver.
+	resolver ImageResolver
+
+	mu                sync.RWMutex
+	observers         []func(*types.Job)
+	pipelineObservers []func(*types.Pipeline)
+	approvalObservers []func(*types.Pipeline, string)
+
+	// quotaMu guards quotas and serializes submissions under a quota.
+	quotaMu sync.Mutex
+	quotas  Quotas
+
+	// concurrencyMu serializes submissions of runs with a concurrency
+	// group, so that each sees the runs submitted before it.
+	concurrencyMu sync.Mutex
+}
+
+// NewManager returns a Manager backed by the given job and pipeline stores.
+// Jobs and runs are recorded under the organization projects finds owning
+// their repository, and submitted within the project quotas in limits.
+func NewManager(store storage.JobStore, pipelines storage.PipelineStore, projects storage.OrganizationStore, limits storage.ProjectQuotaStore) *Manager {
+	return &Manager{store: store, pipelines: pipelines, projects: projects, limits: limits, now: time.Now}
+}
+
+// Submit records a new job in the queued state. It fails with
+// ErrShuttingDown once Drain has been called, with a *QuotaError when the
+// project has used up its daily job quota, with a *QueueLimitError when it
+// has as many jobs queued as its quota allows, and with
+// ErrImageNotResolved when the variants of its image cannot be looked up.
+func (m *Manager) Submit(ctx context.Context, req types.CreateJobRequest) (*types.Job, error) {
+	if m.Draining() {
+		return nil, ErrShuttingDown
+	}
+	priority := req.Priority
+	if priority == "" {
+		priority = types.PriorityNormal
+	}
+	org, err := storage.OrganizationOf(ctx, m.projects, req.Repository)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	job := &types.Job{
+		ID:           utils.NewID(),
+		Name:         req.Name,
+		Repository:   req.Repository,
+		Organization: org,
+		Ref:          req.Ref,
+		Commit:       req.Commit,
+		Environment:  req.Environment,
+		Image:        req.Image,
+		Entrypoint:   req.Entrypoint,
+		OS:           req.OS,
+		Shell:        types.ShellFor(req.OS, req.Shell),
+		Arch:         req.Arch,
+		Images:       req.Images,
+		Commands:     req.Commands,
+		Tasks:        req.Tasks,
+		Services:     req.Services,
+		Resources:    req.Resources,
+		Requests:     req.Requests,
+		Security:     req.Security,
+		Workspace:    req.Workspace,
+		Env:          req.Env,
+		Timeout:      req.Timeout,
+		LogLimit:     req.LogLimit,
+		Priority:     priority,
+		Labels:       req.Labels,
+		Secrets:      req.Secrets,
+		IDTokens:     req.IDTokens,
+		Retry:        req.Retry,
+		Attempt:      1,
+		State:        types.JobStateQueued,
+		TraceContext: tracing.Inject(ctx),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Transitions: []types.JobTransition{
+			{To: types.JobStateQueued, At: now},
+		},
+	}
+	if req.ResolveImage {
+		if job.Images, err = m.resolveImage(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+	release, err := m.reserve(ctx, job.Repository, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = m.store.CreateJob(ctx, job)
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("creating job: %w", err)
+	}
+	m.notify(job)
+	return job, nil
+}
+
+// Observe registers fn to be called with the new version of a job whenever
+// one is created or changes. Observers run synchronously and must not block.
+func (m *Manager) Observe(fn func(*types.Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+func (m *Manager) notify(job *types.Job) {
+	m.mu.RLock()
+	observers := m.observers
+	m.mu.RUnlock()
+	for _, fn := range observers {
+		fn(job.Clone())
+	}
+}
+
+// ObservePipeline registers fn to be called with the new version of a
+// pipeline run whenever one is created or changes state. Observers run
+// synchronously and must not block.
+func (m *Manager) ObservePipeline(fn func(*types.Pipeline)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pipelineObservers = append(m.pipelineObservers, fn)
+}
+
+func (m *Manager) notifyPipeline(run *types.Pipeline) {
+	m.mu.RLock()
+	observers := m.pipelineObservers
+	m.mu.RUnlock()
+	for _, fn := range observers {
+		fn(run.Clone())
+	}
+}
+
+// ObserveApproval registers fn to be called with a pipeline run and the name
+// of one of its manual stages when the stage starts awaiting approval.
+// Observers run synchronously and must not block.
+func (m *Manager) ObserveApproval(fn func(*types.Pipeline, string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.approvalObservers = append(m.approvalObservers, fn)
+}
+
+func (m *Manager) notifyApproval(run *types.Pipeline, stage string) {
+	m.mu.RLock()
+	observers := m.approvalObservers
+	m.mu.RUnlock()
+	for _, fn := range observers {
+		fn(run.Clone(), stage)
+	}
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(ctx context.Context, id string) (*types.Job, error) {
+	return m.store.GetJob(ctx, id)
+}
+
+// List returns jobs matching filter, in the order and range filter.Page
+// selects.
+func (m *Manager) List(ctx context.Context, filter storage.JobFilter) ([]*types.Job, error) {
+	return m.store.ListJobs(ctx, filter)
+}
+
+// UpdateStatus applies a status report to a job. Assigning a job binds it to
+// the reporting agent and leases it to the agent under a new fencing token;
+// later reports must come from that same agent.
+func (m *Manager) UpdateStatus(ctx context.Context, id string, req types.JobStatusRequest) (*types.Job, error) {
+	return m.update(ctx, id, req, nil)
+}
+
+// update applies a status report to a job once check, if given, accepts the
+// stored job.
+func (m *Manager) update(ctx context.Context, id string, req types.JobStatusRequest, check func(*types.Job) error) (*types.Job, error) {
+	job, err := m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+		if check != nil {
+			if err := check(j); err != nil {
+				return err
+			}
+		}
+		if req.AgentID != "" && j.AgentID != "" && req.AgentID != j.AgentID {
+			return ErrAgentMismatch
+		}
+		if j.State == types.JobStatePending {
+			return fmt.Errorf("%w: job %s is waiting for the stages it needs", types.ErrInvalidTransition, j.ID)
+		}
+		if req.State == types.JobStateFailed {
+			// A failure the job's retry policy covers queues the next
+			// attempt instead.
+			retried, err := j.Fail(m.now(), req.ExitCode, req.Infrastructure, req.Reason)
+			if err != nil || retried {
+				return err
+			}
+		} else if err := j.Transition(req.State, m.now(), req.Reason); err != nil {
+			return err
+		}
+		switch req.State {
+		case types.JobStateAssigned:
+			j.AgentID = req.AgentID
+			j.LeaseToken++
+			expires := m.now().Add(m.leaseDuration())
+			j.LeaseExpiresAt = &expires
+		case types.JobStateQueued:
+			j.AgentID = ""
+			j.RequeueRequested = false
+		case types.JobStateSucceeded:
+			j.Results = req.Results
+		}
+		if req.ExitCode != nil {
+			code := *req.ExitCode
+			j.ExitCode = &code
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.transitioned(ctx, job)
+	return job, nil
+}
+
+// Assign binds a queued job to an agent.
+func (m *Manager) Assign(ctx context.Context, id, agentID string) (*types.Job, error) {
+	return m.UpdateStatus(ctx, id, types.JobStatusRequest{State: types.JobStateAssigned, AgentID: agentID})
+}
+
+// Requeue hands a job held by an agent back to the queue.
+func (m *Manager) Requeue(ctx context.Context, id, reason string) (*types.Job, error) {
+	return m.UpdateStatus(ctx, id, types.JobStatusRequest{State: types.JobStateQueued, Reason: reason})
+}
+
+// Cancel requests cancellation of a job on behalf of requestedBy. A queued
+// or pending job is cancelled at once. A job held by an agent moves to cancelling and
+// is finished by the agent reporting it cancelled once it has stopped;
+// cancelling such a job again is a no-op.
+func (m *Manager) Cancel(ctx context.Context, id, requestedBy, reason string) (*types.Job, error) {
+	if reason == "" {
+		reason = "cancelled by " + requestedBy
+	}
+	changed := true
+	job, err := m.store.UpdateJob(ctx, id, func(j *types.Job) error {
+		next := types.JobStateCancelling
+		switch j.State {
+		case types.JobStateCancelling:
+			changed = false
+			return nil
+		case types.JobStateQueued, types.JobStatePending:
+			next = types.JobStateCancelled
+		}
+		if err := j.Transition(next, m.now(), reason); err != nil {
+			return err
+		}
+		j.CancelledBy = requestedBy
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		m.transitioned(ctx, job)
+	}
+	return job, nil
+}
+
+// RequeueAgentJobs hands every job held by one of the given agents back to
+// the queue, for agents that disappeared without reporting. Jobs that were
+// being cancelled are marked cancelled instead. Jobs whose lease has not
+// run out are left to ExpireLeases, as their agent may still be running
+// them. It returns the re-queued jobs.
+func (m *Manager) RequeueAgentJobs(ctx context.Context, agentIDs []string, reason string) ([]*types.Job, error) {
+	gone := make(map[string]bool, len(agentIDs))
+	for _, id := range agentIDs {
+		gone[id] = true
+	}
+	expired := func(j *types.Job) error {
+		if j.LeaseExpiresAt != nil && !j.LeaseExpired(m.now()) {
+			return errLeaseLive
+		}
+		return nil
+	}
+	held, err := m.inFlight(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var requeued []*types.Job
+	for _, job := range held {
+		if !gone[job.AgentID] {
+			continue
+		}
+		// Reporting on the agent's behalf makes the update fail if the job
+		// finished or moved to another agent in the meantime.
+		update := types.JobStatusRequest{State: types.JobStateQueued, AgentID: job.AgentID, Reason: reason}
+		updated, err := m.update(ctx, job.ID, update, expired)
+		if errors.Is(err, errLeaseLive) || errors.Is(err, types.ErrInvalidTransition) || errors.Is(err, ErrAgentMismatch) || errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return requeued, fmt.Errorf("re-queueing job %s: %w", job.ID, err)
+		}
+		requeued = append(requeued, updated)
+	}
+
+	cancelling, err := m.store.ListJobs(ctx, storage.JobFilter{State: types.JobStateCancelling})
+	if err != nil {
+		return requeued, fmt.Errorf("listing cancelling jobs: %w", err)
+	}
+	for _, job := range cancelling {
+		if !gone[job.AgentID] {
+			continue
+		}
+		update := types.JobStatusRequest{State: types.JobStateCancelled, AgentID: job.AgentID, Reason: reason}
+		_, err := m.update(ctx, job.ID, update, expired)
+		if err != nil && !errors.Is(err, errLeaseLive) && !errors.Is(err, types.ErrInvalidTransition) && !errors.Is(err, storage.ErrNotFound) {
+			return requeued, fmt.Errorf("cancelling job %s: %w", job.ID, err)
+		}
+	}
+	return requeued, nil
+}
+
+// AgentJobs returns the jobs an agent holds: assigned to it, running on it
+// or being cancelled on it.
+func (m *Manager) AgentJobs(ctx context.Context, agentID string) ([]*types.Job, error) {
+	var held []*types.Job
+	for _, state := range []types.JobState{types.JobStateAssigned, types.JobStateRunning, types.JobStateCancelling} {
+		list, err := m.store.ListJobs(ctx, storage.JobFilter{State: state, AgentID: agentID})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		held = append(held, list...)
+	}
+	return held, nil
+}
+
+// transitioned runs the follow-up work for a job that changed state.
+func (m *Manager) transitioned(ctx context.Context, job *types.Job) {
+	if job.PipelineID != "" {
+		if err := m.syncPipeline(ctx, job.PipelineID); err != nil {
+			slog.ErrorContext(ctx, "updating pipeline after job change", "pipeline_id", job.PipelineID, "job_id", job.ID, "error", err)
+		}
+	}
+	m.notify(job)
+}
@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrInvalidInputs is returned by StartPipeline, wrapping a
+// pipeline.ErrorList, for inputs the pipeline does not declare or take and
+// required inputs not passed.
+var ErrInvalidInputs = errors.New("invalid inputs")
+
+// StartPipeline starts a manual run of the pipeline named name of
+// repository on behalf of by, passed inputs. The run is of the definition
+// of the pipeline's latest run at ref, or at any ref if ref is empty, and
+// at that run's ref. It fails with storage.ErrNotFound if the pipeline has
+// no such run, and as SubmitPipeline does otherwise.
+func (m *Manager) StartPipeline(ctx context.Context, repository, name, ref, by string, inputs map[string]string) (*types.Pipeline, error) {
+	latest, err := m.pipelines.ListPipelines(ctx, storage.PipelineFilter{
+		Repository: repository,
+		Name:       name,
+		Branch:     ref,
+		Page:       storage.Page{Desc: true, Limit: 1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(latest) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	run := latest[0]
+	def, err := pipeline.Parse([]byte(run.Definition))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the definition of pipeline %s: %w", run.ID, err)
+	}
+	if _, err := def.ResolveInputs(inputs); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInputs, err)
+	}
+	return m.SubmitPipeline(ctx, PipelineSubmission{
+		Definition: def,
+		Source:     run.Definition,
+		Repository: run.Repository,
+		Ref:        run.Ref,
+		Trigger: &types.Trigger{
+			Event:      types.TriggerEventManual,
+			Repository: run.Repository,
+			Ref:        run.Ref,
+			Actor:      by,
+		},
+		Inputs: inputs,
+	})
+}
@@ -0,0 +1,493 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrNothingToRun is returned by SubmitPipeline when the path filters and
+// conditions of the definition leave no step to run for the trigger.
+var ErrNothingToRun = errors.New("no step of the pipeline runs for this trigger")
+
+// forkCacheReadOnly is why the jobs of restricted runs may not save caches.
+const forkCacheReadOnly = "caches are read-only on code from forks"
+
+// PipelineSubmission describes a pipeline run to create from a parsed
+// definition.
+type PipelineSubmission struct {
+	Definition *pipeline.Definition
+	Source     string
+	Repository string
+	Ref        string
+	Commit     string
+	Trigger    *types.Trigger
+	// Inputs are the values passed for the inputs the definition declares.
+	Inputs map[string]string
+
+	// rerun is set when the run re-runs an earlier one.
+	rerun *rerun
+}
+
+// SubmitPipeline records a pipeline run and expands every step of every
+// stage into a job, or one job per leg for matrix steps. Jobs of stages without needs are queued at once; the
+// others are pending until the stages they need succeed. A run with a
+// concurrency group either cancels the unfinished runs of its group or, by
+// default, keeps all its jobs pending until they have finished. The jobs carry the
+// trace context of the expansion so that their scheduling and execution join
+// the submitter's trace. All jobs of the run count against the daily job
+// quota of its project; a run that does not fit fails with a *QuotaError.
+// A re-run carries over the jobs of the earlier run it is told to re-use.
+// Stages and steps whose path filters or if conditions leave them out for
+// the trigger get no jobs, and a run left with none fails with
+// ErrNothingToRun. The expressions of the definition are resolved first
+// with Interpolate, and the run fails with its pipeline.ErrorList if they
+// refer to anything undefined. Runs of code from forks are restricted, and
+// those of pull requests from forks keep all their jobs pending until
+// AuthorizePipeline lets them start.
+func (m *Manager) SubmitPipeline(ctx context.Context, sub PipelineSubmission) (run *types.Pipeline, err error) {
+	if m.Draining() {
+		return nil, ErrShuttingDown
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "pipeline.expand")
+	defer func() {
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+	traceContext := tracing.Inject(ctx)
+
+	def := sub.Definition
+	inputs, err := m.Interpolate(ctx, def, sub.Repository, sub.Ref, sub.Commit, sub.Trigger, sub.Inputs)
+	if err != nil {
+		return nil, err
+	}
+	priority := types.Priority(def.Priority)
+	if priority == "" {
+		priority = types.PriorityNormal
+	}
+	org, err := storage.OrganizationOf(ctx, m.projects, sub.Repository)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	run = &types.Pipeline{
+		ID:           utils.NewID(),
+		Name:         def.Name,
+		Repository:   sub.Repository,
+		Organization: org,
+		Ref:          sub.Ref,
+		Commit:       sub.Commit,
+		Trigger:      sub.Trigger,
+		Inputs:       inputs,
+		State:        types.PipelineStatePending,
+		Definition:   sub.Source,
+		Concurrency:  def.ConcurrencyGroup(sub.Ref),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if sub.rerun != nil {
+		run.RerunOf, run.RerunBy = sub.rerun.of.ID, sub.rerun.by
+	}
+	if sub.Trigger.Trust() == types.TriggerFork {
+		run.Restricted = true
+		switch {
+		case sub.rerun != nil:
+			// Whoever may re-run the run may authorize it, and does so
+			// by re-running it; secrets are only granted explicitly.
+			run.Authorization = &types.RunAuthorization{By: sub.rerun.by, Comment: "re-run of pipeline " + sub.rerun.of.ID, At: now}
+		case sub.Trigger.Event == types.TriggerEventPullRequest:
+			run.AwaitingAuthorization = true
+		}
+	}
+	if len(def.Outputs) > 0 {
+		run.OutputExpressions = def.Outputs
+	}
+	if sub.Trigger != nil && sub.Trigger.Parent != nil {
+		parent := *sub.Trigger.Parent
+		run.Parent = &parent
+	}
+	var superseded []*types.Pipeline
+	if run.Concurrency != "" {
+		m.concurrencyMu.Lock()
+		defer m.concurrencyMu.Unlock()
+		runs, err := m.groupRuns(ctx, run.Repository, run.Concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("loading concurrency group: %w", err)
+		}
+		switch {
+		case def.Concurrency.CancelInProgress:
+			superseded = runs
+		case len(runs) > 0:
+			run.WaitingFor = runs[len(runs)-1].ID
+		}
+	}
+
+	cond := pipeline.NewConditionContext(sub.Trigger, sub.Repository, sub.Ref)
+	var cacheFallbacks []string
+	if def.Cache != nil {
+		cacheFallbacks = def.Cache.FallbackKeys
+	}
+	cacheReadOnly := def.Cache.ReadOnly(sub.Trigger, sub.Ref)
+	if run.Restricted && cacheReadOnly == "" {
+		cacheReadOnly = forkCacheReadOnly
+	}
+	var created []*types.Job
+	for i := range def.Stages {
+		stage := &def.Stages[i]
+		runStage := def.StageRuns(stage, &cond)
+		ps := types.PipelineStage{Name: stage.Name, Needs: stage.Needs, JobIDs: []string{}, Manual: stage.When == pipeline.WhenManual}
+		for _, approver := range stage.Approvers {
+			// Definitions are validated, so every approver parses.
+			if subject, err := types.ParseSubject(approver); err == nil {
+				ps.Approvers = append(ps.Approvers, subject)
+			}
+		}
+		// Stages with needs, manual ones, and every stage of a run waiting
+		// for its concurrency group or for authorization, wait until
+		// advanceStages releases them.
+		initial := types.JobStateQueued
+		if len(stage.Needs) > 0 || ps.Manual || run.WaitingFor != "" || run.AwaitingAuthorization {
+			initial = types.JobStatePending
+		}
+		reused := 0
+		for j := range stage.Steps {
+			step := &stage.Steps[j]
+			// Stages left out by their path filters and stages and steps
+			// whose conditions do not hold get no jobs; an empty stage
+			// counts as succeeded.
+			if !runStage || !pipeline.Runs(step.If, &cond) {
+				continue
+			}
+			for _, leg := range step.Legs() {
+				job := &types.Job{
+					ID:           utils.NewID(),
+					Name:         stage.Name + "/" + step.Name,
+					Repository:   sub.Repository,
+					Organization: org,
+					Ref:          sub.Ref,
+					Commit:       sub.Commit,
+					PipelineID:   run.ID,
+					Stage:        stage.Name,
+					Environment:  stage.Environment,
+					Image:        stage.StepImage(step),
+					Entrypoint:   step.Entrypoint,
+					OS:           stage.StepOS(step),
+					Shell:        types.ShellFor(stage.StepOS(step), stage.StepShell(step)),
+					Arch:         step.Arch,
+					Images:       maps.Clone(step.Images),
+					Commands:     step.Commands,
+					Tasks:        step.Tasks,
+					Services:     stage.StepServices(step),
+					Resources:    stage.StepResources(step),
+					Requests:     stage.StepRequests(step),
+					Security:     step.Security.Clone(),
+					Workspace:    def.Workspace,
+					Env:          def.StepEnv(stage, step, leg),
+					Timeout:      def.StepTimeout(stage, step),
+					LogLimit:     step.LogLimit,
+					Priority:     priority,
+					Labels:       def.StepLabels(stage, step, leg),
+					Secrets:      def.StepSecrets(stage, step),
+					IDTokens:     step.IDTokens,
+					Restricted:   run.Restricted,
+					Retry:        step.Retry,
+					Outputs:      step.Outputs,
+					Attempt:      1,
+					State:        initial,
+					TraceContext: traceContext,
+					CreatedAt:    now,
+					UpdatedAt:    now,
+					Transitions: []types.JobTransition{
+						{To: initial, At: now},
+					},
+				}
+				if step.BuildImage != nil {
+					m.buildImage(job, step.BuildImage)
+				}
+				if len(job.Images) > 0 {
+					// The variants replace the stage's image.
+					job.Image = ""
+				}
+				if step.ResolveImage {
+					if job.Images, err = m.resolveImage(ctx, job); err != nil {
+						return nil, fmt.Errorf("step %s: %w", job.Name, err)
+					}
+				}
+				if len(job.Caches) > 0 {
+					job.CacheFallbacks = slices.Clone(cacheFallbacks)
+					job.CacheReadOnly = cacheReadOnly
+				}
+				if step.Trigger != nil {
+					// The downstream runner runs the step, not an agent.
+					trigger := *step.Trigger
+					trigger.Inputs = maps.Clone(trigger.Inputs)
+					job.Trigger, job.Image, job.Commands = &trigger, "", nil
+				}
+				if step.Matrix != nil {
+					job.Name += " (" + leg.String() + ")"
+					job.Matrix = leg.Values()
+					job.AllowFailure = step.Matrix.AllowFailure
+				}
+				if earlier := sub.rerun.earlier(job.Name); earlier != nil {
+					if sub.rerun.reuse[earlier.ID] {
+						ps.JobIDs = append(ps.JobIDs, earlier.ID)
+						run.JobIDs = append(run.JobIDs, earlier.ID)
+						reused++
+						continue
+					}
+					job.RetryOf = earlier.ID
+				}
+				ps.JobIDs = append(ps.JobIDs, job.ID)
+				run.JobIDs = append(run.JobIDs, job.ID)
+				created = append(created, job)
+			}
+		}
+		if reused > 0 && reused == len(ps.JobIDs) {
+			// A manual stage carried over keeps the decision that let it
+			// run.
+			if earlier := sub.rerun.of.Stage(ps.Name); earlier != nil {
+				ps.Approval = earlier.Approval
+			}
+		}
+		run.Stages = append(run.Stages, ps)
+	}
+	if len(run.JobIDs) == 0 {
+		return nil, ErrNothingToRun
+	}
+	span.SetAttributes(
+		attribute.String("pipeline.id", run.ID),
+		attribute.String("pipeline.name", run.Name),
+		attribute.String("pipeline.repository", run.Repository),
+		attribute.Int("pipeline.jobs", len(created)),
+	)
+
+	// Jobs of later stages only count against the queue limit of the
+	// project once they are queued, and are never refused then.
+	queued := 0
+	for _, job := range created {
+		if job.State == types.JobStateQueued {
+			queued++
+		}
+	}
+	release, err := m.reserve(ctx, run.Repository, len(created), queued)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := m.pipelines.CreatePipeline(ctx, run); err != nil {
+		return nil, fmt.Errorf("creating pipeline: %w", err)
+	}
+	for _, job := range created {
+		if err := m.store.CreateJob(ctx, job); err != nil {
+			m.failPipeline(ctx, run.ID, err)
+			return nil, fmt.Errorf("creating job %s: %w", job.Name, err)
+		}
+	}
+	m.notifyPipeline(run)
+	for _, job := range created {
+		m.notify(job)
+	}
+	m.supersede(ctx, run, superseded)
+	if sub.rerun == nil && run.WaitingFor == "" && !run.AwaitingAuthorization {
+		// Manual stages without needs await approval right away.
+		jobs := make(map[string]*types.Job, len(created))
+		for _, job := range created {
+			jobs[job.ID] = job
+		}
+		run = m.announceApprovals(ctx, run, jobs)
+	}
+	if sub.rerun != nil && run.WaitingFor == "" {
+		// Stages whose needs were all carried over start, or are skipped,
+		// right away.
+		if err := m.syncPipeline(ctx, run.ID); err != nil {
+			slog.ErrorContext(ctx, "releasing stages of re-run pipeline", "pipeline_id", run.ID, "error", err)
+			return run, nil
+		}
+		return m.pipelines.GetPipeline(ctx, run.ID)
+	}
+	return run, nil
+}
+
+// GetPipeline returns the pipeline run with the given ID.
+func (m *Manager) GetPipeline(ctx context.Context, id string) (*types.Pipeline, error) {
+	return m.pipelines.GetPipeline(ctx, id)
+}
+
+// ListPipelines returns pipeline runs matching filter, in the order and
+// range filter.Page selects.
+func (m *Manager) ListPipelines(ctx context.Context, filter storage.PipelineFilter) ([]*types.Pipeline, error) {
+	return m.pipelines.ListPipelines(ctx, filter)
+}
+
+// LatestResult returns the most recent run on branch of repository that
+// succeeded or failed.
+func (m *Manager) LatestResult(ctx context.Context, repository, branch string) (*types.Pipeline, error) {
+	states := []types.PipelineState{types.PipelineStateSucceeded, types.PipelineStateFailed}
+	return m.pipelines.LatestPipeline(ctx, repository, storage.BranchRefs(branch), states)
+}
+
+func (m *Manager) failPipeline(ctx context.Context, id string, cause error) {
+	run, err := m.pipelines.UpdatePipeline(ctx, id, func(p *types.Pipeline) error {
+		return p.Transition(types.PipelineStateFailed, m.now())
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "marking pipeline failed", "pipeline_id", id, "cause", cause, "error", err)
+		return
+	}
+	m.notifyPipeline(run)
+}
+
+// syncPipeline releases or skips the stages waiting on the ones that changed
+// and recomputes the state of a pipeline run from its jobs after one of them
+// changed state. Nothing is released while the run waits for its
+// concurrency group, and a run that finishes lets the next one in its group
+// start.
+func (m *Manager) syncPipeline(ctx context.Context, id string) error {
+	run, err := m.pipelines.GetPipeline(ctx, id)
+	if err != nil {
+		return err
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return err
+	}
+	held, err := m.held(ctx, run)
+	if err != nil {
+		return err
+	}
+	var changed []*types.Job
+	if !held {
+		changed, err = m.advanceStages(ctx, run, jobs)
+	}
+	// Released jobs are announced without re-entering syncPipeline, which
+	// would only repeat this pass.
+	for _, job := range changed {
+		m.notify(job)
+	}
+	if err != nil {
+		return err
+	}
+	if !held {
+		run = m.announceApprovals(ctx, run, jobs)
+	}
+
+	list := make([]*types.Job, 0, len(run.JobIDs))
+	for _, jobID := range run.JobIDs {
+		list = append(list, jobs[jobID])
+	}
+	next := rollup(list)
+	results := collectResults(list)
+	if next == run.State && maps.Equal(results, run.Results) {
+		return nil
+	}
+	updated, err := m.pipelines.UpdatePipeline(ctx, id, func(p *types.Pipeline) error {
+		p.Results = results
+		if next == types.PipelineStateSucceeded {
+			p.Outputs = pipeline.ResolveResults(p.OutputExpressions, results)
+		}
+		if p.State == next {
+			return nil
+		}
+		if p.State == types.PipelineStatePending && next.Terminal() {
+			// A pipeline can finish without ever running, e.g. when every
+			// job is cancelled while queued.
+			if err := p.Transition(types.PipelineStateRunning, m.now()); err != nil {
+				return err
+			}
+		}
+		return p.Transition(next, m.now())
+	})
+	if errors.Is(err, types.ErrInvalidTransition) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if next == run.State {
+		// Only the results changed, which observers do not follow.
+		return nil
+	}
+	m.notifyPipeline(updated)
+	if updated.State.Terminal() && updated.Concurrency != "" {
+		m.releaseNext(ctx, updated)
+	}
+	return nil
+}
+
+// collectResults gathers the results of the succeeded jobs of a run, keyed
+// by job name and result key.
+func collectResults(jobs []*types.Job) map[string]string {
+	var results map[string]string
+	for _, job := range jobs {
+		if job.State != types.JobStateSucceeded {
+			continue
+		}
+		for k, v := range job.Results {
+			if results == nil {
+				results = make(map[string]string)
+			}
+			results[job.Name+"."+k] = v
+		}
+	}
+	return results
+}
+
+// runJobs loads every job of run, keyed by ID.
+func (m *Manager) runJobs(ctx context.Context, run *types.Pipeline) (map[string]*types.Job, error) {
+	jobs := make(map[string]*types.Job, len(run.JobIDs))
+	for _, jobID := range run.JobIDs {
+		job, err := m.store.GetJob(ctx, jobID)
+		if err != nil {
+			return nil, fmt.Errorf("loading job %s: %w", jobID, err)
+		}
+		jobs[jobID] = job
+	}
+	return jobs, nil
+}
+
+// rollup derives a pipeline state from the states of its jobs. Failures of
+// jobs that allow failure count as finished.
+func rollup(jobs []*types.Job) types.PipelineState {
+	var active, failed, cancelled, finished bool
+	all := true
+	for _, j := range jobs {
+		switch {
+		case j.State == types.JobStateAssigned, j.State == types.JobStateRunning, j.State == types.JobStateCancelling:
+			active = true
+		case j.Passed():
+			finished = true
+		case j.State.Failure():
+			failed = true
+		case j.State == types.JobStateCancelled, j.State == types.JobStateSkipped:
+			cancelled = true
+		}
+		if !j.State.Terminal() {
+			all = false
+		}
+	}
+	switch {
+	case all && failed:
+		return types.PipelineStateFailed
+	case all && cancelled:
+		return types.PipelineStateCancelled
+	case all:
+		return types.PipelineStateSucceeded
+	case active || failed || cancelled || finished:
+		return types.PipelineStateRunning
+	default:
+		return types.PipelineStatePending
+	}
+}
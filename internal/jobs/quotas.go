@@ -0,0 +1,150 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Quotas caps how many jobs each project may submit per UTC day. Zero is
+// unlimited.
+type Quotas struct {
+	DailyJobs int
+	// Projects overrides DailyJobs for individual projects.
+	Projects map[string]int
+}
+
+// limit returns the daily job quota of project.
+func (q Quotas) limit(project string) int {
+	if n, ok := q.Projects[project]; ok {
+		return n
+	}
+	return q.DailyJobs
+}
+
+// QuotaError is returned when a submission would take a project over its
+// daily job quota.
+type QuotaError struct {
+	Project string
+	Limit   int
+	// Used is how many jobs the project has submitted today.
+	Used int
+	// Reset is when the quota starts over.
+	Reset time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("project %q has submitted %d of its %d jobs for today; the quota resets at %s",
+		e.Project, e.Used, e.Limit, e.Reset.Format(time.RFC3339))
+}
+
+// QueueLimitError is returned when a submission would queue more jobs of a
+// project than its quota allows.
+type QueueLimitError struct {
+	Project string
+	Limit   int
+	// Queued is how many of the project's jobs are queued.
+	Queued int
+}
+
+func (e *QueueLimitError) Error() string {
+	return fmt.Sprintf("project %q has %d jobs queued and may queue at most %d; try again once some have started",
+		e.Project, e.Queued, e.Limit)
+}
+
+// SetQuotas replaces the daily job quotas. It can be called at any time.
+func (m *Manager) SetQuotas(q Quotas) {
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+	m.quotas = q
+}
+
+// reserve checks that project may submit n more jobs today, queued of them
+// right away. On success the returned release func must be called once the
+// jobs are stored; until then other submissions wait, so that concurrent
+// ones cannot overshoot the quotas together.
+func (m *Manager) reserve(ctx context.Context, project string, n, queued int) (release func(), err error) {
+	quota, err := m.ProjectQuota(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("loading project quota: %w", err)
+	}
+	m.quotaMu.Lock()
+	limit := m.quotas.limit(project)
+	if limit == 0 && quota.MaxQueuedJobs == 0 {
+		m.quotaMu.Unlock()
+		return func() {}, nil
+	}
+	if limit > 0 {
+		day := m.now().UTC().Truncate(24 * time.Hour)
+		used, err := m.store.CountJobs(ctx, project, day)
+		if err != nil {
+			m.quotaMu.Unlock()
+			return nil, fmt.Errorf("counting jobs for quota: %w", err)
+		}
+		if used+n > limit {
+			m.quotaMu.Unlock()
+			return nil, &QuotaError{Project: project, Limit: limit, Used: used, Reset: day.Add(24 * time.Hour)}
+		}
+	}
+	if max := quota.MaxQueuedJobs; max > 0 && queued > 0 {
+		// Counting stops at the limit, which is all it takes to tell the
+		// project is at it.
+		jobs, err := m.store.ListJobs(ctx, storage.JobFilter{State: types.JobStateQueued, Repository: project, Page: storage.Page{Limit: max}})
+		if err != nil {
+			m.quotaMu.Unlock()
+			return nil, fmt.Errorf("counting queued jobs for quota: %w", err)
+		}
+		if len(jobs)+queued > max {
+			m.quotaMu.Unlock()
+			return nil, &QueueLimitError{Project: project, Limit: max, Queued: len(jobs)}
+		}
+	}
+	return m.quotaMu.Unlock, nil
+}
+
+// ProjectQuota returns the quota of project, the default if it has none.
+func (m *Manager) ProjectQuota(ctx context.Context, project string) (*types.ProjectQuota, error) {
+	quota, err := m.limits.GetProjectQuota(ctx, project)
+	if errors.Is(err, storage.ErrNotFound) {
+		return types.DefaultProjectQuota(project), nil
+	}
+	return quota, err
+}
+
+// ProjectQuotas returns the quotas set on projects, ordered by project.
+func (m *Manager) ProjectQuotas(ctx context.Context) ([]*types.ProjectQuota, error) {
+	return m.limits.ListProjectQuotas(ctx)
+}
+
+// SetProjectQuota replaces the quota of project on behalf of updatedBy.
+// Jobs already queued or running are not affected, but the scheduler holds
+// jobs back until the project is within its concurrency limit again.
+func (m *Manager) SetProjectQuota(ctx context.Context, project string, req types.PutProjectQuotaRequest, updatedBy string) (*types.ProjectQuota, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	quota := &types.ProjectQuota{
+		Project:           project,
+		MaxConcurrentJobs: req.MaxConcurrentJobs,
+		MaxQueuedJobs:     req.MaxQueuedJobs,
+		Weight:            req.Weight,
+		UpdatedBy:         updatedBy,
+		UpdatedAt:         m.now(),
+	}
+	if quota.Weight == 0 {
+		quota.Weight = 1
+	}
+	if err := m.limits.PutProjectQuota(ctx, quota); err != nil {
+		return nil, fmt.Errorf("storing project quota: %w", err)
+	}
+	return quota, nil
+}
+
+// DeleteProjectQuota returns project to the default quota.
+func (m *Manager) DeleteProjectQuota(ctx context.Context, project string) error {
+	return m.limits.DeleteProjectQuota(ctx, project)
+}
@@ -0,0 +1,267 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+var (
+	// ErrNotFinished is returned when re-running a pipeline run, or
+	// retrying one of its jobs, before the run has finished.
+	ErrNotFinished = errors.New("pipeline run has not finished")
+	// ErrNothingToRerun is returned when re-running only the failed stages
+	// of a run in which every stage succeeded.
+	ErrNothingToRerun = errors.New("every stage of the pipeline run succeeded")
+	// ErrNotRetryable is returned when retrying a job that did not fail.
+	ErrNotRetryable = errors.New("only failed, timed out or cancelled jobs can be retried")
+)
+
+// rerun is what a pipeline submission carries over from the run it
+// re-runs.
+type rerun struct {
+	of *types.Pipeline
+	by string
+	// jobs holds the jobs of the earlier run by name, and reuse the IDs of
+	// those carried over instead of run again.
+	jobs  map[string]*types.Job
+	reuse map[string]bool
+}
+
+// earlier returns the job of the earlier run with the given name, or nil.
+// It is nil for a submission that re-runs nothing.
+func (r *rerun) earlier(name string) *types.Job {
+	if r == nil {
+		return nil
+	}
+	return r.jobs[name]
+}
+
+// RerunPipeline starts a new run of the definition of a finished pipeline
+// run on behalf of by, with the same repository, ref, commit and trigger.
+// With failedOnly, the jobs of the stages that succeeded are carried over
+// into the new run, logs and artifacts included, and only the other stages
+// run again.
+func (m *Manager) RerunPipeline(ctx context.Context, id, by string, failedOnly bool) (*types.Pipeline, error) {
+	run, err := m.pipelines.GetPipeline(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !run.State.Terminal() {
+		return nil, fmt.Errorf("%w: pipeline %s is %s", ErrNotFinished, run.ID, run.State)
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	reuse := make(map[string]bool)
+	if failedOnly {
+		for i := range run.Stages {
+			st := &run.Stages[i]
+			if succeeded, _ := needOutcome(stageJobs(st, jobs)); succeeded {
+				for _, jobID := range st.JobIDs {
+					reuse[jobID] = true
+				}
+			}
+		}
+		if len(reuse) == len(run.JobIDs) {
+			return nil, ErrNothingToRerun
+		}
+	}
+	return m.rerun(ctx, run, jobs, reuse, by)
+}
+
+// RetryJob runs a job that failed, timed out or was cancelled again on
+// behalf of by, and returns the new job. A job of a pipeline run is retried
+// in a re-run of the pipeline, which has to have finished: every other job
+// is carried over except those of stages depending on the job's stage that
+// did not succeed, which run again once it has.
+func (m *Manager) RetryJob(ctx context.Context, id, by string) (*types.Job, error) {
+	job, err := m.store.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !job.State.Failure() && job.State != types.JobStateCancelled {
+		return nil, fmt.Errorf("%w: job %s is %s", ErrNotRetryable, job.ID, job.State)
+	}
+	if job.PipelineID == "" {
+		return m.resubmit(ctx, job, by)
+	}
+
+	run, err := m.pipelines.GetPipeline(ctx, job.PipelineID)
+	if err != nil {
+		return nil, fmt.Errorf("loading pipeline %s: %w", job.PipelineID, err)
+	}
+	if !run.State.Terminal() {
+		return nil, fmt.Errorf("%w: pipeline %s is %s", ErrNotFinished, run.ID, run.State)
+	}
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	after := dependents(run, job.Stage)
+	reuse := make(map[string]bool, len(jobs))
+	for i := range run.Stages {
+		st := &run.Stages[i]
+		for _, jobID := range st.JobIDs {
+			if jobID != job.ID && !(after[st.Name] && !jobs[jobID].Passed()) {
+				reuse[jobID] = true
+			}
+		}
+	}
+	next, err := m.rerun(ctx, run, jobs, reuse, by)
+	if err != nil {
+		return nil, err
+	}
+	for _, jobID := range next.JobIDs {
+		if reuse[jobID] {
+			continue
+		}
+		retried, err := m.store.GetJob(ctx, jobID)
+		if err != nil {
+			return nil, fmt.Errorf("loading job %s: %w", jobID, err)
+		}
+		if retried.RetryOf == job.ID {
+			return retried, nil
+		}
+	}
+	return nil, fmt.Errorf("re-run %s of pipeline %s has no job %s", next.ID, run.ID, job.Name)
+}
+
+// rerun submits the definition of run again, carrying over the jobs whose
+// IDs are in reuse. jobs holds every job of run.
+func (m *Manager) rerun(ctx context.Context, run *types.Pipeline, jobs map[string]*types.Job, reuse map[string]bool, by string) (*types.Pipeline, error) {
+	def, err := pipeline.Parse([]byte(run.Definition))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the definition of pipeline %s: %w", run.ID, err)
+	}
+	byName := make(map[string]*types.Job, len(jobs))
+	for _, job := range jobs {
+		byName[job.Name] = job
+	}
+	return m.SubmitPipeline(ctx, PipelineSubmission{
+		Definition: def,
+		Source:     run.Definition,
+		Repository: run.Repository,
+		Ref:        run.Ref,
+		Commit:     run.Commit,
+		Trigger:    run.Trigger,
+		Inputs:     run.Inputs,
+		rerun:      &rerun{of: run, by: by, jobs: byName, reuse: reuse},
+	})
+}
+
+// resubmit queues a copy of a job that is not part of a pipeline run.
+func (m *Manager) resubmit(ctx context.Context, job *types.Job, by string) (*types.Job, error) {
+	if m.Draining() {
+		return nil, ErrShuttingDown
+	}
+	org, err := storage.OrganizationOf(ctx, m.projects, job.Repository)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	retry := job.Clone()
+	retry.ID = utils.NewID()
+	retry.Organization = org
+	retry.RetryOf = job.ID
+	retry.Attempt, retry.Attempts, retry.RetryAt = 1, nil, nil
+	retry.State, retry.AgentID, retry.ExitCode = types.JobStateQueued, "", nil
+	retry.RequeueRequested, retry.CancelledBy = false, ""
+	retry.TraceContext = tracing.Inject(ctx)
+	retry.CreatedAt, retry.UpdatedAt = now, now
+	retry.Transitions = []types.JobTransition{
+		{To: types.JobStateQueued, At: now, Reason: "retry of job " + job.ID + " by " + by},
+	}
+	release, err := m.reserve(ctx, retry.Repository, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = m.store.CreateJob(ctx, retry)
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("creating job: %w", err)
+	}
+	m.notify(retry)
+	return retry, nil
+}
+
+// UpstreamJobs returns the succeeded jobs of the stages the stage of job
+// needs, directly or through other stages, in the order of the stages of its
+// run. Jobs outside pipeline runs have none.
+func (m *Manager) UpstreamJobs(ctx context.Context, job *types.Job) ([]*types.Job, error) {
+	if job.PipelineID == "" {
+		return nil, nil
+	}
+	run, err := m.pipelines.GetPipeline(ctx, job.PipelineID)
+	if err != nil {
+		return nil, fmt.Errorf("loading pipeline %s: %w", job.PipelineID, err)
+	}
+	before := needed(run, job.Stage)
+	var upstream []*types.Job
+	for i := range run.Stages {
+		st := &run.Stages[i]
+		if !before[st.Name] {
+			continue
+		}
+		for _, id := range st.JobIDs {
+			j, err := m.store.GetJob(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("loading job %s: %w", id, err)
+			}
+			if j.State == types.JobStateSucceeded {
+				upstream = append(upstream, j)
+			}
+		}
+	}
+	return upstream, nil
+}
+
+// needed returns the stages of run that stage needs, directly or through
+// other stages.
+func needed(run *types.Pipeline, stage string) map[string]bool {
+	needs := make(map[string][]string, len(run.Stages))
+	for _, st := range run.Stages {
+		needs[st.Name] = st.Needs
+	}
+	before := make(map[string]bool)
+	pending := append([]string(nil), needs[stage]...)
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if before[name] {
+			continue
+		}
+		before[name] = true
+		pending = append(pending, needs[name]...)
+	}
+	return before
+}
+
+// dependents returns the stages of run that need stage, directly or
+// through other stages.
+func dependents(run *types.Pipeline, stage string) map[string]bool {
+	after := make(map[string]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, st := range run.Stages {
+			if after[st.Name] {
+				continue
+			}
+			for _, need := range st.Needs {
+				if need == stage || after[need] {
+					after[st.Name] = true
+					progress = true
+					break
+				}
+			}
+		}
+	}
+	return after
+}
@@ -0,0 +1,244 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// analyticsBatch is how many runs are loaded per store query while
+// computing analytics.
+const analyticsBatch = 500
+
+// PipelineTimeline returns when a run, its stages and their jobs waited,
+// started and finished, as recorded in the state transitions of the jobs.
+func (m *Manager) PipelineTimeline(ctx context.Context, run *types.Pipeline) (*types.PipelineTimeline, error) {
+	jobs, err := m.runJobs(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	return runTimeline(run, jobs, m.now()), nil
+}
+
+// runTimeline builds the timeline of run from its jobs, keyed by ID.
+func runTimeline(run *types.Pipeline, jobs map[string]*types.Job, now time.Time) *types.PipelineTimeline {
+	tl := &types.PipelineTimeline{
+		PipelineID: run.ID,
+		State:      run.State,
+		CreatedAt:  run.CreatedAt,
+		Stages:     make([]types.StageTimeline, 0, len(run.Stages)),
+	}
+	for i := range run.Stages {
+		st := &run.Stages[i]
+		list := stageJobs(st, jobs)
+		stl := types.StageTimeline{
+			Stage: st.Name,
+			State: stageState(list),
+			Jobs:  make([]types.JobTimeline, 0, len(list)),
+		}
+		if awaitingApproval(run, st, jobs) {
+			stl.State = types.StageStateAwaitingApproval
+		}
+		done := true
+		for _, job := range list {
+			jtl := jobTimeline(job, now)
+			if job.PipelineID != run.ID {
+				jtl.ReusedFrom = job.PipelineID
+			}
+			stl.QueuedAt = earliest(stl.QueuedAt, jtl.QueuedAt)
+			stl.StartedAt = earliest(stl.StartedAt, jtl.StartedAt)
+			if jtl.FinishedAt == nil {
+				done = false
+			} else if stl.FinishedAt == nil || jtl.FinishedAt.After(*stl.FinishedAt) {
+				stl.FinishedAt = jtl.FinishedAt
+			}
+			stl.Jobs = append(stl.Jobs, jtl)
+		}
+		if !done {
+			stl.FinishedAt = nil
+		}
+		stl.QueueTime = between(stl.QueuedAt, stl.StartedAt)
+		stl.Duration = between(stl.StartedAt, stl.FinishedAt)
+		tl.StartedAt = earliest(tl.StartedAt, stl.StartedAt)
+		tl.Stages = append(tl.Stages, stl)
+	}
+	if run.State.Terminal() {
+		t := run.UpdatedAt
+		tl.FinishedAt = &t
+	}
+	tl.QueueTime = between(&tl.CreatedAt, tl.StartedAt)
+	tl.Duration = between(&tl.CreatedAt, tl.FinishedAt)
+	return tl
+}
+
+// jobTimeline reads the timeline of a job from its transitions. A job still
+// waiting counts as queued up to now.
+func jobTimeline(job *types.Job, now time.Time) types.JobTimeline {
+	tl := types.JobTimeline{ID: job.ID, Name: job.Name, State: job.State}
+	var queued time.Duration
+	var waitingSince *time.Time
+	for _, tr := range job.Transitions {
+		at := tr.At
+		if waitingSince != nil {
+			queued += at.Sub(*waitingSince)
+			waitingSince = nil
+		}
+		switch {
+		case tr.To == types.JobStateQueued || tr.To == types.JobStateAssigned:
+			if tl.QueuedAt == nil {
+				tl.QueuedAt = &at
+			}
+			waitingSince = &at
+		case tr.To == types.JobStateRunning:
+			if tl.StartedAt == nil {
+				tl.StartedAt = &at
+			}
+		case tr.To.Terminal():
+			tl.FinishedAt = &at
+		}
+	}
+	if waitingSince != nil && !job.State.Terminal() {
+		queued += now.Sub(*waitingSince)
+	}
+	tl.QueueTime = types.Duration(queued)
+	tl.Duration = between(tl.StartedAt, tl.FinishedAt)
+	return tl
+}
+
+// earliest returns the earlier of two optional times.
+func earliest(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.Before(*a)) {
+		return b
+	}
+	return a
+}
+
+// between returns the time from start to end, or 0 unless both are set.
+func between(start, end *time.Time) types.Duration {
+	if start == nil || end == nil || end.Before(*start) {
+		return 0
+	}
+	return types.Duration(end.Sub(*start))
+}
+
+// AnalyticsQuery selects the runs PipelineAnalytics summarizes.
+type AnalyticsQuery struct {
+	// Filter narrows the runs as for ListPipelines; its State and Page are
+	// ignored.
+	Filter storage.PipelineFilter
+	// Name, if set, keeps only the runs of the pipeline with that name.
+	Name string
+	// Since and Until bound the creation times of the runs.
+	Since, Until time.Time
+	Interval     types.AnalyticsInterval
+}
+
+// PipelineAnalytics summarizes the durations of the finished runs matching
+// q that keep accepts, per pipeline and per interval, so that regressions
+// show as a rising p50 or p95. Runs still in progress are left out.
+func (m *Manager) PipelineAnalytics(ctx context.Context, q AnalyticsQuery, keep func(*types.Pipeline) bool) (*types.PipelineAnalytics, error) {
+	type pipelineKey struct{ repository, name string }
+	type series struct {
+		all     []*types.Pipeline
+		buckets map[time.Time][]*types.Pipeline
+	}
+	bySeries := make(map[pipelineKey]*series)
+
+	filter := q.Filter
+	filter.State = ""
+	filter.Page = storage.Page{After: &storage.Cursor{Time: q.Since}, Limit: analyticsBatch}
+	for {
+		runs, err := m.pipelines.ListPipelines(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("listing pipelines: %w", err)
+		}
+		for _, run := range runs {
+			if !run.CreatedAt.Before(q.Until) {
+				continue
+			}
+			if !run.State.Terminal() || (q.Name != "" && run.Name != q.Name) || !keep(run) {
+				continue
+			}
+			k := pipelineKey{run.Repository, run.Name}
+			s, ok := bySeries[k]
+			if !ok {
+				s = &series{buckets: make(map[time.Time][]*types.Pipeline)}
+				bySeries[k] = s
+			}
+			s.all = append(s.all, run)
+			start := q.Interval.Truncate(run.CreatedAt)
+			s.buckets[start] = append(s.buckets[start], run)
+		}
+		if len(runs) < analyticsBatch || !runs[len(runs)-1].CreatedAt.Before(q.Until) {
+			break
+		}
+		last := runs[len(runs)-1]
+		filter.Page.After = &storage.Cursor{Time: last.CreatedAt, ID: last.ID}
+	}
+
+	out := &types.PipelineAnalytics{
+		Since:     q.Since,
+		Until:     q.Until,
+		Interval:  q.Interval,
+		Pipelines: make([]types.PipelineStats, 0, len(bySeries)),
+	}
+	for k, s := range bySeries {
+		stats := types.PipelineStats{
+			Repository: k.repository,
+			Name:       k.name,
+			RunStats:   runStats(s.all),
+			Buckets:    make([]types.PipelineBucket, 0, len(s.buckets)),
+		}
+		for start, runs := range s.buckets {
+			stats.Buckets = append(stats.Buckets, types.PipelineBucket{Start: start, RunStats: runStats(runs)})
+		}
+		sort.Slice(stats.Buckets, func(i, j int) bool { return stats.Buckets[i].Start.Before(stats.Buckets[j].Start) })
+		out.Pipelines = append(out.Pipelines, stats)
+	}
+	sort.Slice(out.Pipelines, func(i, j int) bool {
+		a, b := out.Pipelines[i], out.Pipelines[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.Name < b.Name
+	})
+	return out, nil
+}
+
+// runStats counts finished runs by outcome and takes the percentiles of
+// their durations.
+func runStats(runs []*types.Pipeline) types.RunStats {
+	stats := types.RunStats{Runs: len(runs)}
+	durations := make([]time.Duration, 0, len(runs))
+	for _, run := range runs {
+		switch run.State {
+		case types.PipelineStateSucceeded:
+			stats.Succeeded++
+		case types.PipelineStateFailed:
+			stats.Failed++
+		case types.PipelineStateCancelled:
+			stats.Cancelled++
+		}
+		durations = append(durations, max(run.UpdatedAt.Sub(run.CreatedAt), 0))
+	}
+	slices.Sort(durations)
+	stats.P50 = types.Duration(percentile(durations, 50))
+	stats.P95 = types.Duration(percentile(durations, 95))
+	return stats
+}
+
+// percentile returns the p-th percentile of sorted by the nearest-rank
+// method, or 0 for no values.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
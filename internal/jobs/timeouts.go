@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ExpireTimeouts moves every running job past its deadline to timed out and
+// returns those jobs. Observers see the change and tell the agents to stop.
+func (m *Manager) ExpireTimeouts(ctx context.Context) ([]*types.Job, error) {
+	running, err := m.store.ListJobs(ctx, storage.JobFilter{State: types.JobStateRunning})
+	if err != nil {
+		return nil, fmt.Errorf("listing running jobs: %w", err)
+	}
+	now := m.now()
+	var expired []*types.Job
+	for _, job := range running {
+		deadline, ok := job.Deadline()
+		if !ok || now.Before(deadline) {
+			continue
+		}
+		// Reporting on the agent's behalf makes the update fail if the job
+		// finished or moved to another agent in the meantime.
+		update := types.JobStatusRequest{
+			State:   types.JobStateTimedOut,
+			AgentID: job.AgentID,
+			Reason:  fmt.Sprintf("timed out after %s", job.Timeout.Std()),
+		}
+		updated, err := m.UpdateStatus(ctx, job.ID, update)
+		if errors.Is(err, types.ErrInvalidTransition) || errors.Is(err, ErrAgentMismatch) || errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return expired, fmt.Errorf("timing out job %s: %w", job.ID, err)
+		}
+		expired = append(expired, updated)
+	}
+	return expired, nil
+}
@@ -0,0 +1,100 @@
+// Package jobsig signs the job assignments the server dispatches and checks
+// them on agents, so that an agent runs nothing that did not come from the
+// server even if the connection to it is intercepted. Keys are Ed25519 and
+// named by their fingerprint, so that agents can trust the old and the new
+// key while the server's is rotated.
+package jobsig
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/releases"
+)
+
+var (
+	// ErrUnknownKey is returned for an assignment signed with a key the agent
+	// does not trust.
+	ErrUnknownKey = errors.New("job assignment is signed with an untrusted key")
+	// ErrBadSignature is returned for an assignment whose signature does not
+	// verify.
+	ErrBadSignature = errors.New("job assignment signature does not verify")
+)
+
+// Message is what the server signs for an assignment encoded as assignment.
+// It names the agent the assignment is for, so that one captured on its way
+// to an agent cannot be replayed to another.
+func Message(agentID string, assignment []byte) []byte {
+	msg := make([]byte, 0, len("open-cicd job \n")+len(agentID)+len(assignment))
+	msg = append(msg, "open-cicd job "+agentID+"\n"...)
+	return append(msg, assignment...)
+}
+
+// KeyID returns the name of key: the first 8 bytes of the SHA-256 digest of
+// the public key, in hex.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Signer signs job assignments with the server's key.
+type Signer struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+// NewSigner returns a Signer for a base64 Ed25519 private key, or its seed.
+func NewSigner(key string) (*Signer, error) {
+	priv, err := releases.ParseSigningKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{key: priv, id: KeyID(priv.Public().(ed25519.PublicKey))}, nil
+}
+
+// KeyID returns the name of the signing key.
+func (s *Signer) KeyID() string {
+	return s.id
+}
+
+// PublicKey returns the base64 public key agents are to trust.
+func (s *Signer) PublicKey() string {
+	return releases.PublicKey(s.key)
+}
+
+// Sign returns the signature of assignment, sent to agentID.
+func (s *Signer) Sign(agentID string, assignment []byte) []byte {
+	return ed25519.Sign(s.key, Message(agentID, assignment))
+}
+
+// Keyring holds the public keys an agent trusts, by key ID.
+type Keyring map[string]ed25519.PublicKey
+
+// ParseKeyring decodes base64 Ed25519 public keys.
+func ParseKeyring(keys []string) (Keyring, error) {
+	ring := make(Keyring, len(keys))
+	for _, k := range keys {
+		pub, err := releases.ParsePublicKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("job key %s: %w", k, err)
+		}
+		ring[KeyID(pub)] = pub
+	}
+	return ring, nil
+}
+
+// Verify checks that assignment, sent to agentID, was signed with the
+// trusted key named keyID.
+func (r Keyring) Verify(agentID, keyID string, assignment, signature []byte) error {
+	pub, ok := r[keyID]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if !ed25519.Verify(pub, Message(agentID, assignment), signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
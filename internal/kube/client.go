@@ -0,0 +1,226 @@
+// Package kube runs jobs as Kubernetes Jobs launched by the server itself,
+// so that no long-lived agents are needed. It talks to the API server over
+// its REST API with the small subset of objects it uses.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// requestTimeout bounds API calls other than log streams.
+const requestTimeout = 15 * time.Second
+
+// ClientConfig locates an API server. Empty fields default to the in-cluster
+// service account of the pod the server runs in.
+type ClientConfig struct {
+	APIServer string
+	TokenFile string
+	CAFile    string
+}
+
+// Client is a minimal Kubernetes API client.
+type Client struct {
+	base      string
+	tokenFile string
+	http      *http.Client
+}
+
+// NewClient returns a client for the API server described by cfg.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a cluster; set the API server address")
+		}
+		cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = path.Join(serviceAccountDir, "token")
+	}
+	if cfg.CAFile == "" {
+		if _, err := os.Stat(path.Join(serviceAccountDir, "ca.crt")); err == nil {
+			cfg.CAFile = path.Join(serviceAccountDir, "ca.crt")
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &Client{
+		base:      strings.TrimSuffix(cfg.APIServer, "/"),
+		tokenFile: cfg.TokenFile,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// APIError is an error status returned by the API server.
+type APIError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+// IsNotFound reports whether err is an API error for a missing object.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// CreateJob creates a Job in namespace and returns it as stored.
+func (c *Client) CreateJob(ctx context.Context, namespace string, job *Job) (*Job, error) {
+	var created Job
+	if err := c.do(ctx, http.MethodPost, "/apis/batch/v1/namespaces/"+namespace+"/jobs", job, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetJob returns the named Job.
+func (c *Client) GetJob(ctx context.Context, namespace, name string) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, http.MethodGet, "/apis/batch/v1/namespaces/"+namespace+"/jobs/"+name, nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// DeleteJob deletes the named Job along with its pods and the objects it owns.
+func (c *Client) DeleteJob(ctx context.Context, namespace, name string) error {
+	body := map[string]string{"propagationPolicy": "Background"}
+	return c.do(ctx, http.MethodDelete, "/apis/batch/v1/namespaces/"+namespace+"/jobs/"+name, body, nil)
+}
+
+// CreateSecret creates a Secret in namespace.
+func (c *Client) CreateSecret(ctx context.Context, namespace string, secret *Secret) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/namespaces/"+namespace+"/secrets", secret, nil)
+}
+
+// ListPods returns the pods of namespace matching the label selector.
+func (c *Client) ListPods(ctx context.Context, namespace, selector string) ([]Pod, error) {
+	var list struct {
+		Items []Pod `json:"items"`
+	}
+	p := "/api/v1/namespaces/" + namespace + "/pods?labelSelector=" + url.QueryEscape(selector)
+	if err := c.do(ctx, http.MethodGet, p, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// Logs follows the output of a container until it exits or ctx is
+// cancelled. With since set, only output written after it is returned.
+func (c *Client) Logs(ctx context.Context, namespace, pod, container string, since time.Time) (io.ReadCloser, error) {
+	q := url.Values{"container": {container}, "follow": {"true"}}
+	if !since.IsZero() {
+		q.Set("sinceTime", since.UTC().Format(time.RFC3339))
+	}
+	req, err := c.request(ctx, http.MethodGet, "/api/v1/namespaces/"+namespace+"/pods/"+pod+"/log?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, apiError(resp)
+	}
+	return resp.Body, nil
+}
+
+// do sends a JSON request and decodes the response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, p string, body, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := c.request(ctx, method, p, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, p, err)
+	}
+	return nil
+}
+
+func (c *Client) request(ctx context.Context, method, p string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+p, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	// Projected service account tokens are rotated, so the file is read
+	// for every request.
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	if t := strings.TrimSpace(string(token)); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	return req, nil
+}
+
+// apiError decodes the Status object of a failed response.
+func apiError(resp *http.Response) error {
+	var status struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &status); err != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(data))
+	}
+	return &APIError{Code: resp.StatusCode, Reason: status.Reason, Message: status.Message}
+}
@@ -0,0 +1,563 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"open-cicd/internal/config"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// AgentID identifies the executor in the agent registry.
+const AgentID = "kubernetes"
+
+const (
+	// pollInterval is how often pod status is checked.
+	pollInterval = 2 * time.Second
+	// dispatchTimeout bounds creating the objects of a job.
+	dispatchTimeout = 30 * time.Second
+	// logFlushTimeout is how long a finished job waits for its log streams
+	// to drain before its final state is reported.
+	logFlushTimeout = 10 * time.Second
+	// logChunkBytes is the largest log chunk appended at once.
+	logChunkBytes = 32 << 10
+)
+
+// deadlineExceeded is the reason given for pods and Jobs that ran past
+// their active deadline, the job's timeout.
+const deadlineExceeded = "DeadlineExceeded"
+
+// stuckReasons are container waiting reasons that will not resolve without
+// changing the job, so the job fails instead of waiting forever.
+var stuckReasons = map[string]bool{
+	"ImagePullBackOff":     true,
+	"InvalidImageName":     true,
+	"CreateContainerError": true,
+}
+
+// Executor runs jobs as Kubernetes Jobs. To the scheduler it is a built-in
+// agent with a fixed number of slots, and it implements
+// scheduler.Dispatcher for that agent: it creates a Job per assignment,
+// watches its pod, streams the container logs into the log store and
+// reports the job's progress like an agent would.
+type Executor struct {
+	client   *Client
+	cfg      config.Kubernetes
+	registry *scheduler.Registry
+	jobs     *jobs.Manager
+	logs     logs.Store
+	online   atomic.Bool
+	ctx      context.Context
+	// watches counts the running watch goroutines.
+	watches sync.WaitGroup
+
+	mu      sync.Mutex
+	runs    map[string]*execution
+	onReady func()
+}
+
+// execution is a job running in the cluster.
+type execution struct {
+	job       *types.Job
+	namespace string
+	tasks     []string
+	ctx       context.Context
+	stop      context.CancelFunc
+}
+
+// NewExecutor returns an executor creating jobs through client with the
+// given settings and reporting to manager and logStore.
+func NewExecutor(client *Client, cfg config.Kubernetes, registry *scheduler.Registry, manager *jobs.Manager, logStore logs.Store) *Executor {
+	return &Executor{
+		client:   client,
+		cfg:      cfg,
+		registry: registry,
+		jobs:     manager,
+		logs:     logStore,
+		ctx:      context.Background(),
+		runs:     make(map[string]*execution),
+	}
+}
+
+// OnReady registers fn to be called when the executor has free slots again.
+func (e *Executor) OnReady(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onReady = fn
+}
+
+// Run registers the executor as an agent, picks up the jobs it was running
+// before a restart and keeps the agent alive until ctx is cancelled. It
+// returns once it stopped watching its jobs, which keep running in the
+// cluster; a later Run, for example when this replica becomes leader again,
+// picks them up once more.
+func (e *Executor) Run(ctx context.Context) {
+	e.ctx = ctx
+	defer e.watches.Wait()
+	defer e.online.Store(false)
+	ticker := time.NewTicker(e.registry.HeartbeatInterval())
+	defer ticker.Stop()
+	for {
+		if !e.online.Load() {
+			if _, err := e.registry.RegisterBuiltin(ctx, AgentID, "kubernetes", e.cfg.Labels, e.cfg.Capacity); err != nil {
+				slog.ErrorContext(ctx, "registering kubernetes executor", "error", err)
+			} else {
+				e.resume(ctx)
+				e.online.Store(true)
+				slog.InfoContext(ctx, "Kubernetes executor online", "agent_id", AgentID, "capacity", e.cfg.Capacity)
+				e.ready()
+			}
+		} else if _, err := e.registry.Heartbeat(ctx, AgentID, nil); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "recording kubernetes executor heartbeat", "error", err)
+		}
+		if e.online.Load() {
+			e.renewLeases(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewLeases renews the leases on the jobs the executor runs, like an
+// agent's heartbeat does, and stops the jobs whose leases it lost, deleting
+// their Kubernetes Jobs.
+func (e *Executor) renewLeases(ctx context.Context) {
+	e.mu.Lock()
+	leases := make(map[string]int64, len(e.runs))
+	for id, x := range e.runs {
+		leases[id] = x.job.LeaseToken
+	}
+	e.mu.Unlock()
+	if len(leases) == 0 {
+		return
+	}
+	revoked, _, err := e.jobs.RenewLeases(ctx, AgentID, leases)
+	if err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "renewing kubernetes job leases", "error", err)
+	}
+	for _, id := range revoked {
+		e.mu.Lock()
+		x, ok := e.runs[id]
+		e.mu.Unlock()
+		if !ok {
+			continue
+		}
+		slog.WarnContext(ctx, "Lost lease on kubernetes job; deleting it", "job_id", id)
+		x.stop()
+		if err := e.client.DeleteJob(ctx, x.namespace, objectName(x.job)); err != nil && !IsNotFound(err) {
+			slog.ErrorContext(ctx, "deleting kubernetes job", "job_id", id, "error", err)
+		}
+	}
+}
+
+// Ready implements scheduler.Dispatcher.
+func (e *Executor) Ready() map[string]int {
+	if !e.online.Load() {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return map[string]int{AgentID: e.cfg.Capacity - len(e.runs)}
+}
+
+// Dispatch implements scheduler.Dispatcher by creating the Kubernetes Job,
+// and the Secret holding the job's secrets, in the project's namespace.
+func (e *Executor) Dispatch(agentID string, job *types.Job) error {
+	if agentID != AgentID {
+		return scheduler.ErrAgentNotConnected
+	}
+	project := e.cfg.Project(job.Repository)
+	spec, err := job.ExecSpec()
+	var k8sJob *Job
+	var secret *Secret
+	if err == nil {
+		k8sJob, secret, err = manifest(job, spec, project)
+	}
+	if err != nil {
+		// The job cannot run in the cluster however often it is retried.
+		go e.report(context.Background(), job.ID, types.JobStatusRequest{State: types.JobStateFailed, Reason: "invalid kubernetes job: " + err.Error()})
+		return nil
+	}
+	x := &execution{job: job, namespace: project.Namespace}
+	for _, t := range spec.Tasks {
+		x.tasks = append(x.tasks, t.Name)
+	}
+	if err := e.reserve(x); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, dispatchTimeout)
+	defer cancel()
+	created, err := e.client.CreateJob(ctx, x.namespace, k8sJob)
+	if err != nil {
+		e.release(x)
+		return fmt.Errorf("creating kubernetes job: %w", err)
+	}
+	if secret != nil {
+		// Owned by the Job, the Secret is deleted along with it. Pods wait
+		// for the Secret to appear before their containers start.
+		secret.Metadata.OwnerReferences = []OwnerReference{{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       created.Metadata.Name,
+			UID:        created.Metadata.UID,
+		}}
+		if err := e.client.CreateSecret(ctx, x.namespace, secret); err != nil {
+			if derr := e.client.DeleteJob(ctx, x.namespace, created.Metadata.Name); derr != nil {
+				slog.ErrorContext(ctx, "deleting kubernetes job after failing to create its secret", "job_id", job.ID, "error", derr)
+			}
+			e.release(x)
+			return fmt.Errorf("creating kubernetes secret: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "Created kubernetes job", "job_id", job.ID, "namespace", x.namespace, "name", created.Metadata.Name)
+	e.watches.Add(1)
+	go e.watch(x, false)
+	return nil
+}
+
+// Cancel implements scheduler.Dispatcher. The Kubernetes Job is deleted in
+// the background and the job reported cancelled, or queued with requeue.
+func (e *Executor) Cancel(agentID, jobID, reason string, requeue bool) error {
+	if agentID != AgentID {
+		return scheduler.ErrAgentNotConnected
+	}
+	e.mu.Lock()
+	x, ok := e.runs[jobID]
+	e.mu.Unlock()
+	if !ok {
+		return scheduler.ErrAgentNotConnected
+	}
+	x.stop()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dispatchTimeout)
+		defer cancel()
+		if err := e.client.DeleteJob(ctx, x.namespace, objectName(x.job)); err != nil && !IsNotFound(err) {
+			slog.ErrorContext(ctx, "deleting kubernetes job", "job_id", jobID, "error", err)
+		}
+		state := types.JobStateCancelled
+		if requeue {
+			state = types.JobStateQueued
+		}
+		e.report(ctx, jobID, types.JobStatusRequest{State: state, Reason: reason})
+	}()
+	return nil
+}
+
+// reserve takes a slot for x, failing when none is free.
+func (e *Executor) reserve(x *execution) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.runs) >= e.cfg.Capacity {
+		return errors.New("kubernetes executor has no free slots")
+	}
+	x.ctx, x.stop = context.WithCancel(e.ctx)
+	e.runs[x.job.ID] = x
+	return nil
+}
+
+// release frees the slot of x.
+func (e *Executor) release(x *execution) {
+	x.stop()
+	e.mu.Lock()
+	delete(e.runs, x.job.ID)
+	e.mu.Unlock()
+	e.ready()
+}
+
+func (e *Executor) ready() {
+	e.mu.Lock()
+	onReady := e.onReady
+	e.mu.Unlock()
+	if onReady != nil {
+		onReady()
+	}
+}
+
+// resume picks up the jobs held by the executor before a restart: those
+// whose Kubernetes Job still exists are watched again, the others go back
+// to the queue.
+func (e *Executor) resume(ctx context.Context) {
+	for _, state := range []types.JobState{types.JobStateAssigned, types.JobStateRunning, types.JobStateCancelling} {
+		held, err := e.jobs.List(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			slog.ErrorContext(ctx, "listing jobs held by kubernetes executor", "error", err)
+			continue
+		}
+		for _, job := range held {
+			if job.AgentID != AgentID {
+				continue
+			}
+			namespace := e.cfg.Project(job.Repository).Namespace
+			_, err := e.client.GetJob(ctx, namespace, objectName(job))
+			switch {
+			case IsNotFound(err):
+				next := types.JobStateQueued
+				if state == types.JobStateCancelling {
+					next = types.JobStateCancelled
+				}
+				e.report(ctx, job.ID, types.JobStatusRequest{State: next, Reason: "kubernetes job not found after restart"})
+				continue
+			case err != nil:
+				slog.ErrorContext(ctx, "looking up kubernetes job", "job_id", job.ID, "error", err)
+				continue
+			}
+			if state == types.JobStateCancelling {
+				if err := e.client.DeleteJob(ctx, namespace, objectName(job)); err != nil && !IsNotFound(err) {
+					slog.ErrorContext(ctx, "deleting kubernetes job", "job_id", job.ID, "error", err)
+					continue
+				}
+				e.report(ctx, job.ID, types.JobStatusRequest{State: types.JobStateCancelled, Reason: job.Transitions[len(job.Transitions)-1].Reason})
+				continue
+			}
+			x := &execution{job: job, namespace: namespace}
+			spec, err := job.ExecSpec()
+			if err == nil {
+				for _, t := range spec.Tasks {
+					x.tasks = append(x.tasks, t.Name)
+				}
+			}
+			if err := e.reserve(x); err != nil {
+				slog.ErrorContext(ctx, "resuming kubernetes job", "job_id", job.ID, "error", err)
+				continue
+			}
+			slog.InfoContext(ctx, "Resumed kubernetes job", "job_id", job.ID, "namespace", namespace)
+			e.watches.Add(1)
+			go e.watch(x, true)
+		}
+	}
+}
+
+// watch follows the pod of x until it finishes, reporting the job running
+// once its containers start and its outcome at the end. A resumed watch only
+// streams output written from now on, since earlier output was stored
+// before the restart.
+func (e *Executor) watch(x *execution, resumed bool) {
+	defer e.watches.Done()
+	defer e.release(x)
+	ctx := x.ctx
+	id := x.job.ID
+	since := time.Time{}
+	if resumed {
+		since = time.Now()
+	}
+	started := resumed && x.job.State == types.JobStateRunning
+	var streamed chan struct{}
+	if started {
+		streamed = e.stream(x, since)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pods, err := e.client.ListPods(ctx, x.namespace, podSelector(x.job))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "listing kubernetes pods", "job_id", id, "error", err)
+			}
+			continue
+		}
+		if len(pods) == 0 {
+			// The Job controller removes the pod of a Job that ran past its
+			// deadline.
+			k8sJob, err := e.client.GetJob(ctx, x.namespace, objectName(x.job))
+			switch {
+			case IsNotFound(err):
+				e.report(ctx, id, types.JobStatusRequest{State: types.JobStateFailed, Reason: "kubernetes job was deleted", Infrastructure: true})
+				return
+			case err == nil && k8sJob.Status != nil && k8sJob.Status.Failed() != nil:
+				c := k8sJob.Status.Failed()
+				update := types.JobStatusRequest{
+					State:          types.JobStateFailed,
+					Reason:         "kubernetes job failed: " + c.Reason + ": " + c.Message,
+					Infrastructure: true,
+				}
+				if c.Reason == deadlineExceeded {
+					update = types.JobStatusRequest{State: types.JobStateTimedOut, Reason: fmt.Sprintf("timed out after %s", x.job.Timeout.Std())}
+				}
+				e.report(ctx, id, update)
+				return
+			}
+			continue
+		}
+		pod := pods[0]
+		if reason, stuck := stuckContainer(&pod.Status); stuck {
+			if err := e.client.DeleteJob(ctx, x.namespace, objectName(x.job)); err != nil && !IsNotFound(err) {
+				slog.ErrorContext(ctx, "deleting stuck kubernetes job", "job_id", id, "error", err)
+			}
+			e.report(ctx, id, types.JobStatusRequest{State: types.JobStateFailed, Reason: reason, Infrastructure: true})
+			return
+		}
+		terminal := pod.Status.Phase == PodSucceeded || pod.Status.Phase == PodFailed
+		if !started && (pod.Status.Phase == PodRunning || terminal) {
+			started = true
+			e.report(ctx, id, types.JobStatusRequest{State: types.JobStateRunning})
+			streamed = e.stream(x, since)
+		}
+		if !terminal {
+			continue
+		}
+		select {
+		case <-streamed:
+		case <-time.After(logFlushTimeout):
+			slog.WarnContext(ctx, "gave up waiting for kubernetes job logs", "job_id", id)
+		case <-ctx.Done():
+			return
+		}
+		update := outcome(&pod, x.tasks)
+		e.report(ctx, id, update)
+		slog.InfoContext(ctx, "Kubernetes job finished", "job_id", id, "state", update.State)
+		return
+	}
+}
+
+// stream copies the output of each task container into the log store in
+// task order and closes the returned channel when all of it is stored.
+func (e *Executor) stream(x *execution, since time.Time) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := x.ctx
+		id := x.job.ID
+		for i, name := range x.tasks {
+			container := taskContainer(i)
+			pod, ok := e.started(ctx, x, container)
+			if !ok {
+				return
+			}
+			if len(x.tasks) > 1 {
+				e.appendLog(ctx, id, []byte("==> task "+name+"\n"))
+			}
+			r, err := e.client.Logs(ctx, x.namespace, pod, container, since)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "streaming kubernetes job logs", "job_id", id, "container", container, "error", err)
+				}
+				continue
+			}
+			buf := make([]byte, logChunkBytes)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					e.appendLog(ctx, id, buf[:n])
+				}
+				if err != nil {
+					if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+						slog.ErrorContext(ctx, "reading kubernetes job logs", "job_id", id, "container", container, "error", err)
+					}
+					break
+				}
+			}
+			r.Close()
+		}
+	}()
+	return done
+}
+
+// started waits until container has started or exited and returns the name
+// of its pod.
+func (e *Executor) started(ctx context.Context, x *execution, container string) (string, bool) {
+	for {
+		pods, err := e.client.ListPods(ctx, x.namespace, podSelector(x.job))
+		if err == nil && len(pods) > 0 {
+			pod := pods[0]
+			if s := pod.Status.Container(container); s != nil && (s.State.Running != nil || s.State.Terminated != nil) {
+				return pod.Metadata.Name, true
+			}
+			if pod.Status.Phase == PodSucceeded || pod.Status.Phase == PodFailed {
+				// The pod ended before the container ran.
+				return "", false
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (e *Executor) appendLog(ctx context.Context, jobID string, data []byte) {
+	if _, err := e.logs.Append(ctx, jobID, logs.Stdout, data); err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "storing kubernetes job logs", "job_id", jobID, "error", err)
+	}
+}
+
+// report applies a status update as the executor's agent. Updates racing
+// with another change to the job, such as a cancellation, are dropped.
+func (e *Executor) report(ctx context.Context, jobID string, update types.JobStatusRequest) {
+	update.AgentID = AgentID
+	_, err := e.jobs.UpdateStatus(ctx, jobID, update)
+	switch {
+	case err == nil, errors.Is(err, types.ErrInvalidTransition), errors.Is(err, jobs.ErrAgentMismatch), errors.Is(err, storage.ErrNotFound):
+	default:
+		slog.ErrorContext(ctx, "reporting kubernetes job status", "job_id", jobID, "state", update.State, "error", err)
+	}
+}
+
+// stuckContainer reports a container of the pod that cannot start.
+func stuckContainer(status *PodStatus) (string, bool) {
+	for _, list := range [][]ContainerStatus{status.InitContainerStatuses, status.ContainerStatuses} {
+		for _, c := range list {
+			if w := c.State.Waiting; w != nil && stuckReasons[w.Reason] {
+				return fmt.Sprintf("container %s cannot start: %s: %s", c.Name, w.Reason, w.Message), true
+			}
+		}
+	}
+	return "", false
+}
+
+// outcome returns the final status of the job of a finished pod: the first
+// task that exited non-zero fails the job. A pod that ran out of time timed
+// out; one that failed otherwise, for example by being evicted, is an
+// infrastructure failure.
+func outcome(pod *Pod, tasks []string) types.JobStatusRequest {
+	if pod.Status.Reason == deadlineExceeded {
+		return types.JobStatusRequest{State: types.JobStateTimedOut, Reason: "kubernetes pod ran past its deadline: " + pod.Status.Message}
+	}
+	for i, name := range tasks {
+		s := pod.Status.Container(taskContainer(i))
+		if s == nil || s.State.Terminated == nil {
+			continue
+		}
+		if t := s.State.Terminated; t.ExitCode != 0 {
+			reason := fmt.Sprintf("task %s exited with code %d", name, t.ExitCode)
+			if t.Reason != "" {
+				reason += " (" + t.Reason + ")"
+			}
+			code := int(t.ExitCode)
+			return types.JobStatusRequest{State: types.JobStateFailed, ExitCode: &code, Reason: reason}
+		}
+	}
+	code := 0
+	if pod.Status.Phase == PodSucceeded {
+		return types.JobStatusRequest{State: types.JobStateSucceeded, ExitCode: &code}
+	}
+	reason := "kubernetes pod failed"
+	if pod.Status.Reason != "" {
+		reason += ": " + pod.Status.Reason
+	}
+	if pod.Status.Message != "" {
+		reason += ": " + pod.Status.Message
+	}
+	code = 1
+	return types.JobStatusRequest{State: types.JobStateFailed, ExitCode: &code, Reason: reason, Infrastructure: true}
+}
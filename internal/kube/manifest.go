@@ -0,0 +1,228 @@
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"open-cicd/internal/config"
+	"open-cicd/internal/types"
+)
+
+const (
+	// labelJobID marks the pods of a job so they can be found again.
+	labelJobID = "open-cicd.io/job-id"
+	// labelAttempt tells the pods of retried attempts of a job apart.
+	labelAttempt = "open-cicd.io/attempt"
+	// annotationJobName records the job name for people browsing the cluster.
+	annotationJobName = "open-cicd.io/job-name"
+	workspaceVolume   = "workspace"
+	// finishedTTL keeps finished Jobs and their pods around for debugging.
+	finishedTTL int32 = 3600
+)
+
+// objectName returns the name of the Job and Secret of an attempt of a job.
+// Finished Jobs are kept for a while, so every attempt gets its own.
+func objectName(job *types.Job) string {
+	if job.Attempt > 1 {
+		return "open-cicd-" + job.ID + "-" + strconv.Itoa(job.Attempt)
+	}
+	return "open-cicd-" + job.ID
+}
+
+// objectLabels returns the labels of the objects of an attempt of a job.
+func objectLabels(job *types.Job) map[string]string {
+	return map[string]string{labelJobID: job.ID, labelAttempt: strconv.Itoa(max(job.Attempt, 1))}
+}
+
+// podSelector selects the pods of an attempt of a job.
+func podSelector(job *types.Job) string {
+	return labelJobID + "=" + job.ID + "," + labelAttempt + "=" + strconv.Itoa(max(job.Attempt, 1))
+}
+
+// taskContainer returns the container name of the i-th task of a job. Task
+// names are not necessarily valid container names.
+func taskContainer(i int) string {
+	return "task-" + strconv.Itoa(i)
+}
+
+// manifest returns the Job that runs job as described by spec with the
+// settings of its project, and the Secret holding the job's secret
+// variables, or nil when it declares none. Tasks run in order as init
+// containers followed by the last task as the main container; services are
+// sidecars started before them and reachable under their names.
+func manifest(job *types.Job, spec *types.ExecSpec, project config.KubernetesProject) (*Job, *Secret, error) {
+	cpuRequest, memoryRequest, err := (&types.Resources{CPU: project.CPURequest, Memory: project.MemoryRequest}).Limits()
+	if err != nil {
+		return nil, nil, err
+	}
+	resources := ResourceRequirements{
+		Limits:   quantities(spec.CPUMillis, spec.MemoryBytes),
+		Requests: quantities(capAt(cpuRequest, spec.CPUMillis), capAt(memoryRequest, spec.MemoryBytes)),
+	}
+	name := objectName(job)
+	mounts := []VolumeMount{{Name: workspaceVolume, MountPath: spec.Workspace}}
+
+	var secret *Secret
+	// Secret values are added to the job environment at dispatch; they are
+	// read from the Secret rather than written into the pod spec.
+	secretValues := make(map[string]string)
+	for _, k := range job.Secrets {
+		if v, ok := job.Env[k]; ok {
+			secretValues[k] = v
+		}
+	}
+	if len(secretValues) > 0 {
+		secret = &Secret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata:   ObjectMeta{Name: name, Labels: objectLabels(job)},
+			Type:       "Opaque",
+			StringData: secretValues,
+		}
+	}
+	env := func(vars map[string]string) []EnvVar {
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		list := make([]EnvVar, 0, len(keys))
+		for _, k := range keys {
+			if v, ok := secretValues[k]; ok && vars[k] == v {
+				list = append(list, EnvVar{Name: k, ValueFrom: &EnvVarSource{SecretKeyRef: &SecretKeySelector{Name: name, Key: k}}})
+				continue
+			}
+			list = append(list, EnvVar{Name: k, Value: vars[k]})
+		}
+		return list
+	}
+
+	pod := PodSpec{
+		RestartPolicy: "Never",
+		Volumes:       []Volume{{Name: workspaceVolume, EmptyDir: &EmptyDir{}}},
+	}
+	if project.ServiceAccount != "" {
+		pod.ServiceAccountName = project.ServiceAccount
+	} else {
+		// Jobs only get API credentials when a service account is chosen
+		// for them.
+		automount := false
+		pod.AutomountServiceAccountToken = &automount
+	}
+	var hostnames []string
+	for i, svc := range spec.Services {
+		pod.InitContainers = append(pod.InitContainers, Container{
+			Name:          "service-" + strconv.Itoa(i),
+			Image:         svc.Image,
+			Command:       svc.Entrypoint,
+			Args:          svc.Command,
+			Env:           env(svc.Env),
+			VolumeMounts:  mounts,
+			Resources:     resources,
+			RestartPolicy: "Always",
+		})
+		hostnames = append(hostnames, svc.Name)
+	}
+	if len(hostnames) > 0 {
+		pod.HostAliases = []HostAlias{{IP: "127.0.0.1", Hostnames: hostnames}}
+	}
+	for i, t := range spec.Tasks {
+		if t.Image == "" {
+			return nil, nil, fmt.Errorf("task %q has no image", t.Name)
+		}
+		if len(t.Entrypoint) == 0 {
+			return nil, nil, fmt.Errorf("task %q needs an entrypoint to run with the %s shell", t.Name, spec.Shell)
+		}
+		c := Container{
+			Name:            taskContainer(i),
+			Image:           t.Image,
+			Command:         t.Entrypoint,
+			Args:            []string{strings.Join(t.Commands, "\n")},
+			Env:             env(t.Env),
+			WorkingDir:      spec.Workspace,
+			VolumeMounts:    mounts,
+			Resources:       resources,
+			SecurityContext: securityContext(spec.Security),
+		}
+		if i < len(spec.Tasks)-1 {
+			pod.InitContainers = append(pod.InitContainers, c)
+		} else {
+			pod.Containers = append(pod.Containers, c)
+		}
+	}
+
+	backoff := int32(0)
+	ttl := finishedTTL
+	k8sJob := &Job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata: ObjectMeta{
+			Name:        name,
+			Labels:      objectLabels(job),
+			Annotations: map[string]string{annotationJobName: job.Name},
+		},
+		Spec: JobSpec{
+			BackoffLimit:            &backoff,
+			TTLSecondsAfterFinished: &ttl,
+			Template: PodTemplateSpec{
+				Metadata: ObjectMeta{Labels: objectLabels(job)},
+				Spec:     pod,
+			},
+		},
+	}
+	if timeout := int64(job.Timeout.Std().Seconds()); timeout > 0 {
+		k8sJob.Spec.ActiveDeadlineSeconds = &timeout
+	}
+	return k8sJob, secret, nil
+}
+
+// securityContext converts the security context of a job's tasks, or
+// returns nil for jobs without one.
+func securityContext(s *types.SecurityContext) *SecurityContext {
+	if s == nil {
+		return nil
+	}
+	c := &SecurityContext{RunAsUser: s.RunAsUser, RunAsGroup: s.RunAsGroup}
+	if s.RunAsUser != nil && *s.RunAsUser != 0 {
+		nonRoot := true
+		c.RunAsNonRoot = &nonRoot
+	}
+	if s.ReadOnlyRootFilesystem {
+		readOnly := true
+		c.ReadOnlyRootFilesystem = &readOnly
+	}
+	if s.NoNewPrivileges {
+		escalation := false
+		c.AllowPrivilegeEscalation = &escalation
+	}
+	if len(s.CapAdd)+len(s.CapDrop) > 0 {
+		c.Capabilities = &Capabilities{Add: s.CapAdd, Drop: s.CapDrop}
+	}
+	return c
+}
+
+// quantities formats CPU and memory amounts, leaving out zero ones.
+func quantities(cpuMillis, memoryBytes int64) map[string]string {
+	q := make(map[string]string)
+	if cpuMillis > 0 {
+		q["cpu"] = strconv.FormatInt(cpuMillis, 10) + "m"
+	}
+	if memoryBytes > 0 {
+		q["memory"] = strconv.FormatInt(memoryBytes, 10)
+	}
+	if len(q) == 0 {
+		return nil
+	}
+	return q
+}
+
+// capAt returns request, lowered to limit when a limit is set, since
+// Kubernetes rejects requests above the limit.
+func capAt(request, limit int64) int64 {
+	if limit > 0 && request > limit {
+		return limit
+	}
+	return request
+}
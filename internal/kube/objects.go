@@ -0,0 +1,235 @@
+package kube
+
+import "time"
+
+// The types below mirror the fields of the Kubernetes API objects the
+// executor reads and writes; everything else is left to server defaults.
+
+// ObjectMeta is the metadata common to all objects.
+type ObjectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+// OwnerReference makes an object garbage collected along with its owner.
+type OwnerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+}
+
+// Job is a batch/v1 Job.
+type Job struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       JobSpec    `json:"spec"`
+	Status     *JobStatus `json:"status,omitempty"`
+}
+
+// JobSpec runs a pod to completion once.
+type JobSpec struct {
+	BackoffLimit            *int32          `json:"backoffLimit,omitempty"`
+	ActiveDeadlineSeconds   *int64          `json:"activeDeadlineSeconds,omitempty"`
+	TTLSecondsAfterFinished *int32          `json:"ttlSecondsAfterFinished,omitempty"`
+	Template                PodTemplateSpec `json:"template"`
+}
+
+// JobStatus is the observed state of a Job.
+type JobStatus struct {
+	Conditions []JobCondition `json:"conditions,omitempty"`
+}
+
+// JobCondition is a condition of a Job, such as "Failed".
+type JobCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Failed returns the Failed condition of a Job, or nil while it has not failed.
+func (s *JobStatus) Failed() *JobCondition {
+	for i := range s.Conditions {
+		if c := &s.Conditions[i]; c.Type == "Failed" && c.Status == "True" {
+			return c
+		}
+	}
+	return nil
+}
+
+// PodTemplateSpec describes the pods a Job creates.
+type PodTemplateSpec struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+}
+
+// PodSpec describes the containers of a pod.
+type PodSpec struct {
+	RestartPolicy                string      `json:"restartPolicy"`
+	ServiceAccountName           string      `json:"serviceAccountName,omitempty"`
+	AutomountServiceAccountToken *bool       `json:"automountServiceAccountToken,omitempty"`
+	InitContainers               []Container `json:"initContainers,omitempty"`
+	Containers                   []Container `json:"containers"`
+	Volumes                      []Volume    `json:"volumes,omitempty"`
+	HostAliases                  []HostAlias `json:"hostAliases,omitempty"`
+}
+
+// Container is a container of a pod. An init container with RestartPolicy
+// Always is a sidecar: it starts before the following init containers and
+// runs until the main containers exit.
+type Container struct {
+	Name            string               `json:"name"`
+	Image           string               `json:"image"`
+	Command         []string             `json:"command,omitempty"`
+	Args            []string             `json:"args,omitempty"`
+	Env             []EnvVar             `json:"env,omitempty"`
+	WorkingDir      string               `json:"workingDir,omitempty"`
+	VolumeMounts    []VolumeMount        `json:"volumeMounts,omitempty"`
+	Resources       ResourceRequirements `json:"resources,omitempty"`
+	RestartPolicy   string               `json:"restartPolicy,omitempty"`
+	SecurityContext *SecurityContext     `json:"securityContext,omitempty"`
+}
+
+// SecurityContext restricts the privileges of a container.
+type SecurityContext struct {
+	RunAsUser                *int64        `json:"runAsUser,omitempty"`
+	RunAsGroup               *int64        `json:"runAsGroup,omitempty"`
+	RunAsNonRoot             *bool         `json:"runAsNonRoot,omitempty"`
+	ReadOnlyRootFilesystem   *bool         `json:"readOnlyRootFilesystem,omitempty"`
+	AllowPrivilegeEscalation *bool         `json:"allowPrivilegeEscalation,omitempty"`
+	Capabilities             *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Capabilities are the Linux capabilities added to and dropped from a
+// container's defaults.
+type Capabilities struct {
+	Add  []string `json:"add,omitempty"`
+	Drop []string `json:"drop,omitempty"`
+}
+
+// EnvVar sets an environment variable from a value or a Secret key.
+type EnvVar struct {
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
+}
+
+// EnvVarSource reads an environment variable from a Secret.
+type EnvVarSource struct {
+	SecretKeyRef *SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// SecretKeySelector names a key of a Secret.
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// VolumeMount mounts a pod volume into a container.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+// ResourceRequirements are the requests and limits of a container, in
+// Kubernetes quantity notation.
+type ResourceRequirements struct {
+	Limits   map[string]string `json:"limits,omitempty"`
+	Requests map[string]string `json:"requests,omitempty"`
+}
+
+// Volume is a pod volume. Only empty directories are used.
+type Volume struct {
+	Name     string    `json:"name"`
+	EmptyDir *EmptyDir `json:"emptyDir,omitempty"`
+}
+
+// EmptyDir is a scratch volume that lives as long as its pod.
+type EmptyDir struct{}
+
+// HostAlias adds entries to the pod's hosts file.
+type HostAlias struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// Secret is a v1 Secret.
+type Secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type"`
+	StringData map[string]string `json:"stringData"`
+}
+
+// Pod is the part of a v1 Pod the executor watches.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   PodStatus  `json:"status"`
+}
+
+// Pod phases.
+const (
+	PodPending   = "Pending"
+	PodRunning   = "Running"
+	PodSucceeded = "Succeeded"
+	PodFailed    = "Failed"
+)
+
+// PodStatus is the observed state of a pod.
+type PodStatus struct {
+	Phase                 string            `json:"phase"`
+	Reason                string            `json:"reason,omitempty"`
+	Message               string            `json:"message,omitempty"`
+	InitContainerStatuses []ContainerStatus `json:"initContainerStatuses,omitempty"`
+	ContainerStatuses     []ContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+// Container returns the status of the named container, or nil.
+func (s *PodStatus) Container(name string) *ContainerStatus {
+	for _, list := range [][]ContainerStatus{s.InitContainerStatuses, s.ContainerStatuses} {
+		for i := range list {
+			if list[i].Name == name {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// ContainerStatus is the observed state of a container.
+type ContainerStatus struct {
+	Name  string         `json:"name"`
+	State ContainerState `json:"state"`
+}
+
+// ContainerState holds exactly one of its fields.
+type ContainerState struct {
+	Waiting    *ContainerStateWaiting    `json:"waiting,omitempty"`
+	Running    *ContainerStateRunning    `json:"running,omitempty"`
+	Terminated *ContainerStateTerminated `json:"terminated,omitempty"`
+}
+
+// ContainerStateWaiting is a container that has not started.
+type ContainerStateWaiting struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ContainerStateRunning is a running container.
+type ContainerStateRunning struct {
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// ContainerStateTerminated is a container that exited.
+type ContainerStateTerminated struct {
+	ExitCode int32  `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
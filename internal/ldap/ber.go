@@ -0,0 +1,160 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER tags of the universal types LDAP uses.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+)
+
+// maxElementBytes bounds a single response, well above any entry a search
+// for a user or their groups returns.
+const maxElementBytes = 16 << 20
+
+// element is a decoded BER element: its tag and its contents.
+type element struct {
+	tag      byte
+	contents []byte
+}
+
+// encode returns the BER encoding of an element with tag and contents,
+// which are the concatenated encodings of the children of constructed
+// elements.
+func encode(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	out := append([]byte{tag}, encodeLength(n)...)
+	for _, c := range contents {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func encodeInteger(tag byte, n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n >= -0x80 && n < 0x80) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return encode(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeBool(tag byte, v bool) []byte {
+	if v {
+		return encode(tag, []byte{0xff})
+	}
+	return encode(tag, []byte{0})
+}
+
+// readElement reads one element from r.
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return element{}, unexpected(err)
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		size := int(first &^ 0x80)
+		if size == 0 || size > 4 {
+			return element{}, fmt.Errorf("unsupported BER length of %d bytes", size)
+		}
+		n = 0
+		for range size {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, unexpected(err)
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxElementBytes {
+		return element{}, fmt.Errorf("response of %d bytes is larger than %d", n, maxElementBytes)
+	}
+	contents := make([]byte, n)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return element{}, unexpected(err)
+	}
+	return element{tag: tag, contents: contents}, nil
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// children decodes the contents of a constructed element.
+func (e element) children() ([]element, error) {
+	var list []element
+	data := e.contents
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated BER element")
+		}
+		tag, n, header := data[0], int(data[1]), 2
+		if data[1]&0x80 != 0 {
+			size := int(data[1] &^ 0x80)
+			if size == 0 || size > 4 || len(data) < 2+size {
+				return nil, errors.New("malformed BER length")
+			}
+			n = 0
+			for _, b := range data[2 : 2+size] {
+				n = n<<8 | int(b)
+			}
+			header += size
+		}
+		if n < 0 || len(data)-header < n {
+			return nil, errors.New("truncated BER element")
+		}
+		list = append(list, element{tag: tag, contents: data[header : header+n]})
+		data = data[header+n:]
+	}
+	return list, nil
+}
+
+// integer decodes the contents of an INTEGER or ENUMERATED element.
+func (e element) integer() (int64, error) {
+	if len(e.contents) == 0 || len(e.contents) > 8 {
+		return 0, errors.New("malformed BER integer")
+	}
+	n := int64(int8(e.contents[0]))
+	for _, b := range e.contents[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
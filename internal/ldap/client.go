@@ -0,0 +1,348 @@
+// Package ldap is a minimal LDAPv3 client: enough of RFC 4511 to bind with a
+// password, optionally after StartTLS, and to search for users and groups.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol operations and result codes of RFC 4511 the client uses.
+const (
+	opBindRequest        = 0x60
+	opBindResponse       = 0x61
+	opUnbindRequest      = 0x42
+	opSearchRequest      = 0x63
+	opSearchEntry        = 0x64
+	opSearchDone         = 0x65
+	opSearchReference    = 0x73
+	opExtendedRequest    = 0x77
+	opExtendedResponse   = 0x78
+	startTLSOID          = "1.3.6.1.4.1.1466.20037"
+	resultSuccess        = 0
+	resultSizeLimit      = 4
+	resultInvalidCredent = 49
+)
+
+// ErrInvalidCredentials is returned by Bind for a wrong DN or password.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ResultError is an operation the server answered with a result other than
+// success.
+type ResultError struct {
+	Op      string
+	Code    int64
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: result code %d", e.Op, e.Code)
+	}
+	return fmt.Sprintf("%s: result code %d: %s", e.Op, e.Code, e.Message)
+}
+
+// Is makes an invalidCredentials result match ErrInvalidCredentials.
+func (e *ResultError) Is(target error) bool {
+	return target == ErrInvalidCredentials && e.Code == resultInvalidCredent
+}
+
+// Conn is a connection to an LDAP server. Its operations are synchronous
+// and it must not be used concurrently.
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	id      int64
+	timeout time.Duration
+}
+
+// Dial connects to the server at rawURL, an ldap:// or ldaps:// URL, using
+// tlsConfig for ldaps and startTLS. Each operation on the connection must
+// finish within timeout.
+func Dial(ctx context.Context, rawURL string, startTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("URL %q is not ldap:// or ldaps://", rawURL)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	if startTLS && u.Scheme == "ldap" {
+		if err := c.startTLS(ctx, tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startTLS upgrades the connection to TLS.
+func (c *Conn) startTLS(ctx context.Context, tlsConfig *tls.Config) error {
+	resp, err := c.roundTrip(encode(opExtendedRequest, encodeString(0x80, startTLSOID)), opExtendedResponse)
+	if err != nil {
+		return fmt.Errorf("StartTLS: %w", err)
+	}
+	if err := result("StartTLS", resp); err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, tlsConfig)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("StartTLS: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// Bind authenticates the connection as dn with password. Empty passwords
+// are refused rather than sent, since servers treat them as an
+// unauthenticated bind that succeeds.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return fmt.Errorf("bind as %q: %w", dn, ErrInvalidCredentials)
+	}
+	req := encode(opBindRequest,
+		encodeInteger(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(0x80, password),
+	)
+	resp, err := c.roundTrip(req, opBindResponse)
+	if err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+	return result("bind", resp)
+}
+
+// SearchRequest is a search of the subtree below BaseDN for entries
+// matching Filter, in the string form of RFC 4515, returning Attributes of
+// at most SizeLimit entries, or all of them if it is zero.
+type SearchRequest struct {
+	BaseDN     string
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Entry is an entry a search found. Attributes are keyed by their lower
+// case names.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute named name, or "".
+func (e *Entry) Get(name string) string {
+	if values := e.Attributes[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Search runs req and returns the entries found. References to other
+// servers are ignored. A search exceeding its size limit returns the
+// entries sent before the server stopped.
+func (c *Conn) Search(req SearchRequest) ([]*Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([][]byte, 0, len(req.Attributes))
+	for _, a := range req.Attributes {
+		attrs = append(attrs, encodeString(tagOctetString, a))
+	}
+	id, err := c.send(encode(opSearchRequest,
+		encodeString(tagOctetString, req.BaseDN),
+		encodeInteger(tagEnumerated, 2), // wholeSubtree
+		encodeInteger(tagEnumerated, 0), // neverDerefAliases
+		encodeInteger(tagInteger, int64(req.SizeLimit)),
+		encodeInteger(tagInteger, int64(c.timeout/time.Second)),
+		encodeBool(tagBoolean, false),
+		filter,
+		encode(tagSequence, attrs...),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	var entries []*Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, fmt.Errorf("search: %w", err)
+		}
+		switch op.tag {
+		case opSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, fmt.Errorf("search: %w", err)
+			}
+			entries = append(entries, entry)
+		case opSearchReference:
+		case opSearchDone:
+			if err := result("search", op); err != nil {
+				var re *ResultError
+				if errors.As(err, &re) && re.Code == resultSizeLimit {
+					return entries, nil
+				}
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("search: unexpected response 0x%02x", op.tag)
+		}
+	}
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.send(encode(opUnbindRequest))
+	return c.conn.Close()
+}
+
+// roundTrip sends op and returns the response to it, which must be of type
+// want.
+func (c *Conn) roundTrip(op []byte, want byte) (element, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return element{}, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return element{}, err
+	}
+	if resp.tag != want {
+		return element{}, fmt.Errorf("unexpected response 0x%02x", resp.tag)
+	}
+	return resp, nil
+}
+
+// send writes op as the next message and returns its ID.
+func (c *Conn) send(op []byte) (int64, error) {
+	c.id++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(encode(tagSequence, encodeInteger(tagInteger, c.id), op))
+	return c.id, err
+}
+
+// receive reads the next message, which must answer the message with ID
+// id, and returns its protocol operation.
+func (c *Conn) receive(id int64) (element, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	msg, err := readElement(c.r)
+	if err != nil {
+		return element{}, err
+	}
+	if msg.tag != tagSequence {
+		return element{}, fmt.Errorf("malformed message 0x%02x", msg.tag)
+	}
+	parts, err := msg.children()
+	if err != nil {
+		return element{}, err
+	}
+	if len(parts) < 2 || parts[0].tag != tagInteger {
+		return element{}, errors.New("malformed message")
+	}
+	got, err := parts[0].integer()
+	if err != nil {
+		return element{}, err
+	}
+	if got == 0 {
+		// An unsolicited notification, such as the server disconnecting.
+		if err := result("notice", parts[1]); err != nil {
+			return element{}, err
+		}
+		return element{}, errors.New("server sent an unsolicited notification")
+	}
+	if got != id {
+		return element{}, fmt.Errorf("response to message %d while waiting for %d", got, id)
+	}
+	return parts[1], nil
+}
+
+// result returns the error an LDAPResult reports, if any.
+func result(op string, e element) error {
+	parts, err := e.children()
+	if err != nil {
+		return err
+	}
+	if len(parts) < 3 || parts[0].tag != tagEnumerated {
+		return fmt.Errorf("%s: malformed result", op)
+	}
+	code, err := parts[0].integer()
+	if err != nil {
+		return err
+	}
+	if code == resultSuccess {
+		return nil
+	}
+	return &ResultError{Op: op, Code: code, Message: string(parts[2].contents)}
+}
+
+// parseEntry decodes a SearchResultEntry.
+func parseEntry(e element) (*Entry, error) {
+	parts, err := e.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 2 || parts[0].tag != tagOctetString || parts[1].tag != tagSequence {
+		return nil, errors.New("malformed entry")
+	}
+	entry := &Entry{DN: string(parts[0].contents), Attributes: make(map[string][]string)}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		fields, err := attr.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != 2 || fields[0].tag != tagOctetString || fields[1].tag != tagSet {
+			return nil, errors.New("malformed attribute")
+		}
+		values, err := fields[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(fields[0].contents))
+		for _, v := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(v.contents))
+		}
+	}
+	return entry, nil
+}
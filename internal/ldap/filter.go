@@ -0,0 +1,220 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices of a SearchRequest, RFC 4511 section 4.5.1.7.
+const (
+	filterAnd        = 0xa0
+	filterOr         = 0xa1
+	filterNot        = 0xa2
+	filterEquality   = 0xa3
+	filterSubstrings = 0xa4
+	filterGreater    = 0xa5
+	filterLess       = 0xa6
+	filterPresent    = 0x87
+	filterApprox     = 0xa8
+	filterExtensible = 0xa9
+)
+
+// EscapeFilter escapes s for use as a value in a search filter, so that
+// a user name cannot change the filter it is put in.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ValidateFilter checks that filter is a well-formed search filter.
+func ValidateFilter(filter string) error {
+	_, err := compileFilter(filter)
+	return err
+}
+
+// compileFilter encodes a filter in the string form of RFC 4515, such as
+// (&(objectClass=person)(uid=jdoe)).
+func compileFilter(s string) ([]byte, error) {
+	f, rest, err := parseFilter(s)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", s, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("filter %q: unexpected %q after the filter", s, rest)
+	}
+	return f, nil
+}
+
+// parseFilter encodes the parenthesized filter at the start of s and
+// returns what follows it.
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected ( at %q", s)
+	}
+	s = s[1:]
+	var f []byte
+	var err error
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			var part []byte
+			if part, s, err = parseFilter(s); err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			return nil, "", fmt.Errorf("empty %c", tag)
+		}
+		f = encode(tag, parts...)
+	case strings.HasPrefix(s, "!"):
+		var inner []byte
+		if inner, s, err = parseFilter(s[1:]); err != nil {
+			return nil, "", err
+		}
+		f = encode(filterNot, inner)
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("missing ) in %q", s)
+		}
+		if f, err = parseItem(s[:end]); err != nil {
+			return nil, "", err
+		}
+		s = s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("expected ) at %q", s)
+	}
+	return f, s[1:], nil
+}
+
+// parseItem encodes a simple filter such as uid=jdoe, without the
+// parentheses.
+func parseItem(s string) ([]byte, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("%q is not attribute=value", s)
+	}
+	attr, raw := s[:i], s[i+1:]
+	switch attr[len(attr)-1] {
+	case '>', '<', '~', ':':
+		op := attr[len(attr)-1]
+		attr = attr[:len(attr)-1]
+		value, err := unescapeFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case '>':
+			return encode(filterGreater, encodeString(tagOctetString, attr), encodeString(tagOctetString, value)), nil
+		case '<':
+			return encode(filterLess, encodeString(tagOctetString, attr), encodeString(tagOctetString, value)), nil
+		case '~':
+			return encode(filterApprox, encodeString(tagOctetString, attr), encodeString(tagOctetString, value)), nil
+		}
+		return extensible(attr, value)
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("%q names no attribute", s)
+	}
+	if raw == "*" {
+		return encodeString(filterPresent, attr), nil
+	}
+	if !strings.Contains(raw, "*") {
+		value, err := unescapeFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		return encode(filterEquality, encodeString(tagOctetString, attr), encodeString(tagOctetString, value)), nil
+	}
+	parts := strings.Split(raw, "*")
+	var subs [][]byte
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := unescapeFilter(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(0x81) // any
+		switch i {
+		case 0:
+			tag = 0x80 // initial
+		case len(parts) - 1:
+			tag = 0x82 // final
+		}
+		subs = append(subs, encodeString(tag, value))
+	}
+	return encode(filterSubstrings, encodeString(tagOctetString, attr), encode(tagSequence, subs...)), nil
+}
+
+// extensible encodes an extensible match, whose attribute part, such as
+// member:1.2.840.113556.1.4.1941 or cn:dn, precedes :=.
+func extensible(spec, value string) ([]byte, error) {
+	fields := strings.Split(spec, ":")
+	var parts [][]byte
+	var attr string
+	dn := false
+	for i, field := range fields {
+		switch {
+		case i == 0:
+			attr = field
+		case strings.EqualFold(field, "dn"):
+			dn = true
+		case field != "":
+			parts = append(parts, encodeString(0x81, field))
+		}
+	}
+	if attr != "" {
+		parts = append(parts, encodeString(0x82, attr))
+	}
+	if attr == "" && len(parts) == 0 {
+		return nil, fmt.Errorf("extensible match %q names neither attribute nor rule", spec)
+	}
+	parts = append(parts, encodeString(0x83, value))
+	if dn {
+		parts = append(parts, encodeBool(0x84, true))
+	}
+	return encode(filterExtensible, parts...), nil
+}
+
+// unescapeFilter decodes the \XX escapes of a filter value.
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("incomplete escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,70 @@
+package ldap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"jdoe", "jdoe"},
+		{"", ""},
+		{"*", `\2a`},
+		{"admin)(uid=*", `admin\29\28uid=\2a`},
+		{`a\b`, `a\5cb`},
+		{"nul\x00", `nul\00`},
+		{"José", "José"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := EscapeFilter(tt.in)
+			if got != tt.want {
+				t.Errorf("EscapeFilter(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			// The escaped value matches the user name as it is, whatever
+			// it holds.
+			f, err := compileFilter("(uid=" + got + ")")
+			if err != nil {
+				t.Fatalf("compiling filter of %q: %v", tt.in, err)
+			}
+			want := encode(filterEquality, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, tt.in))
+			if !bytes.Equal(f, want) {
+				t.Errorf("filter of %q is not an equality match of uid", tt.in)
+			}
+		})
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"(uid=jdoe)", true},
+		{"(&(objectClass=person)(uid=jdoe))", true},
+		{"(|(cn=a*)(cn=*b)(cn=*c*))", true},
+		{"(!(memberOf=cn=admins,dc=example,dc=com))", true},
+		{"(member:1.2.840.113556.1.4.1941:=cn=jdoe,dc=example,dc=com)", true},
+		{"(uidNumber>=1000)", true},
+		{"(mail=*)", true},
+		{`(cn=a\2ab)`, true},
+		{"uid=jdoe", false},
+		{"(uid=jdoe", false},
+		{"(uid=jdoe))", false},
+		{"(&)", false},
+		{"(=jdoe)", false},
+		{"(uid)", false},
+		{`(cn=a\2)`, false},
+		{"(:=x)", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := ValidateFilter(tt.filter)
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateFilter(%q) = %v, want valid %v", tt.filter, err, tt.valid)
+			}
+		})
+	}
+}
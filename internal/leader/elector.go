@@ -0,0 +1,98 @@
+// Package leader elects one of the server replicas sharing a store to run
+// the work that must happen exactly once, such as scheduling jobs and firing
+// cron schedules. Every replica serves the API regardless.
+package leader
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"open-cicd/internal/storage"
+)
+
+const (
+	// lockName names the lock held by the leader.
+	lockName = "open-cicd/leader"
+	// retryInterval is how often a follower tries to take over.
+	retryInterval = 5 * time.Second
+	// releaseTimeout bounds giving the lock up at the end of a term.
+	releaseTimeout = 5 * time.Second
+)
+
+// Role is what a replica currently does.
+type Role string
+
+const (
+	// Follower serves the API only.
+	Follower Role = "follower"
+	// Leader also runs the work handed to Elector.Run.
+	Leader Role = "leader"
+)
+
+// Elector campaigns for leadership on behalf of one replica.
+type Elector struct {
+	locks   storage.LockStore
+	leading atomic.Bool
+}
+
+// New returns an elector taking the leader lock from locks.
+func New(locks storage.LockStore) *Elector {
+	return &Elector{locks: locks}
+}
+
+// Role returns the replica's current role.
+func (e *Elector) Role() Role {
+	if e.leading.Load() {
+		return Leader
+	}
+	return Follower
+}
+
+// Run campaigns for leadership until ctx is done. Each time the replica
+// becomes leader, lead is called with a context that is cancelled when the
+// lock is lost or ctx is done; the lock is only given up once lead returns,
+// so lead must stop everything it started before returning.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	for {
+		lease, ok, err := e.locks.TryLock(ctx, lockName)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			slog.ErrorContext(ctx, "campaigning for leadership", "error", err)
+		case ok:
+			e.term(ctx, lease, lead)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// term runs lead while lease is held, then releases it.
+func (e *Elector) term(ctx context.Context, lease storage.Lease, lead func(ctx context.Context)) {
+	termCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lease.Lost():
+			slog.WarnContext(ctx, "Lost leadership; stopping leader work")
+			cancel()
+		case <-termCtx.Done():
+		}
+	}()
+
+	e.leading.Store(true)
+	slog.InfoContext(ctx, "Became leader")
+	lead(termCtx)
+	e.leading.Store(false)
+
+	releaseCtx, cancelRelease := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancelRelease()
+	if err := lease.Release(releaseCtx); err != nil {
+		slog.WarnContext(ctx, "Releasing leadership", "error", err)
+	}
+	slog.InfoContext(ctx, "Stepped down as leader")
+}
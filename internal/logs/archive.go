@@ -0,0 +1,453 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"open-cicd/internal/blobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+const (
+	// segmentSize is how many bytes of output are buffered before they are
+	// written out as a segment.
+	segmentSize = 1 << 20
+	// flushInterval is how long output may stay buffered before it is
+	// written out although its segment is not full, and how often finished
+	// jobs are settled.
+	flushInterval = 5 * time.Second
+	// purgeInterval is how often expired logs are deleted.
+	purgeInterval = time.Hour
+	// purgeBatch is how many expired logs are deleted per store query.
+	purgeBatch = 100
+)
+
+// Archive is a Store that keeps job logs in a blob store, on local disk or
+// in S3. Output is buffered per job and written out in gzip-compressed
+// segments of up to segmentSize bytes, or every flushInterval for jobs that
+// write less; the segments of each job are recorded in the control plane
+// store, so that a read from an offset fetches only the segments past it.
+// Output still buffered is read from memory, on the replica the agents
+// upload to. Once a job has finished its log expires according to the
+// retention of its project.
+type Archive struct {
+	store     storage.JobLogStore
+	blobs     blobs.Store
+	retention func(project string) (time.Duration, bool)
+	now       func() time.Time
+
+	mu       sync.Mutex
+	buffers  map[string]*buffer
+	finished map[string]string
+}
+
+// buffer holds the output of a job not written out yet.
+type buffer struct {
+	mu sync.Mutex
+	// loaded tells whether the job's record was read; log is nil for a job
+	// with no segments yet.
+	loaded bool
+	log    *types.JobLog
+	// size is the length of the log including the buffered chunks, which
+	// start at the end of the last segment.
+	size   int64
+	chunks []Chunk
+	bytes  int
+	since  time.Time
+	// closed is set once the buffer is dropped from the archive, to send
+	// appends still waiting on it to a fresh one.
+	closed bool
+}
+
+// NewArchive returns an Archive that records logs in store and keeps their
+// segments in blobStore. retention returns how long the logs of a project
+// are kept once its job has finished; projects it has no duration for keep
+// them forever.
+func NewArchive(store storage.JobLogStore, blobStore blobs.Store, retention func(project string) (time.Duration, bool)) *Archive {
+	return &Archive{
+		store:     store,
+		blobs:     blobStore,
+		retention: retention,
+		now:       time.Now,
+		buffers:   make(map[string]*buffer),
+		finished:  make(map[string]string),
+	}
+}
+
+// segmentKey returns the blob key of the segment of a job's log starting at
+// offset. Keys sort in the order of the segments.
+func segmentKey(jobID string, offset int64) string {
+	return fmt.Sprintf("%s/%020d.jsonl.gz", jobID, offset)
+}
+
+// buffer returns the buffer of a job, locked, creating it if needed.
+func (a *Archive) buffer(jobID string) *buffer {
+	for {
+		a.mu.Lock()
+		b, ok := a.buffers[jobID]
+		if !ok {
+			b = &buffer{}
+			a.buffers[jobID] = b
+		}
+		a.mu.Unlock()
+		b.mu.Lock()
+		if !b.closed {
+			return b
+		}
+		b.mu.Unlock()
+	}
+}
+
+// load reads the job's record into b if it was not yet. Callers must hold
+// b.mu.
+func (a *Archive) load(ctx context.Context, jobID string, b *buffer) error {
+	if b.loaded {
+		return nil
+	}
+	log, err := a.store.GetJobLog(ctx, jobID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("getting log record: %w", err)
+	default:
+		b.log, b.size = log, log.Size
+	}
+	b.loaded = true
+	return nil
+}
+
+// Append implements Store. Once the buffered output of the job reaches
+// segmentSize it is written out; if that fails, the output stays buffered
+// and is written out later.
+func (a *Archive) Append(ctx context.Context, jobID string, stream Stream, data []byte) (Chunk, error) {
+	b := a.buffer(jobID)
+	defer b.mu.Unlock()
+	if err := a.load(ctx, jobID, b); err != nil {
+		return Chunk{}, err
+	}
+	now := a.now()
+	c := Chunk{
+		JobID:  jobID,
+		Stream: stream,
+		Offset: b.size,
+		Data:   append([]byte(nil), data...),
+		At:     now,
+	}
+	if len(b.chunks) == 0 {
+		b.since = now
+	}
+	b.chunks = append(b.chunks, c)
+	b.bytes += len(data)
+	b.size += int64(len(data))
+	if b.bytes >= segmentSize {
+		if err := a.write(ctx, jobID, b, ""); err != nil {
+			slog.ErrorContext(ctx, "writing log segment", "job_id", jobID, "error", err)
+		}
+	}
+	return c, nil
+}
+
+// Read implements Store. Only the segments that end past from are fetched.
+func (a *Archive) Read(ctx context.Context, jobID string, from int64) ([]Chunk, error) {
+	// The buffered chunks are taken before the record is read: a segment
+	// written in between then holds chunks already taken, rather than the
+	// chunks being in neither.
+	var buffered []Chunk
+	limit := int64(math.MaxInt64)
+	a.mu.Lock()
+	b := a.buffers[jobID]
+	a.mu.Unlock()
+	if b != nil {
+		b.mu.Lock()
+		if b.loaded && len(b.chunks) > 0 {
+			buffered = append(buffered, b.chunks...)
+			limit = b.chunks[0].Offset
+		}
+		b.mu.Unlock()
+	}
+
+	log, err := a.store.GetJobLog(ctx, jobID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("getting log record: %w", err)
+	}
+	var out []Chunk
+	if log != nil {
+		for _, seg := range log.Segments {
+			if seg.Offset >= limit {
+				break
+			}
+			if seg.End() <= from {
+				continue
+			}
+			chunks, err := a.readSegment(ctx, jobID, seg)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, trim(chunks, from)...)
+		}
+	}
+	return append(out, trim(buffered, from)...), nil
+}
+
+// readSegment decompresses a segment of a job's log.
+func (a *Archive) readSegment(ctx context.Context, jobID string, seg types.LogSegment) ([]Chunk, error) {
+	key := segmentKey(jobID, seg.Offset)
+	f, err := a.blobs.Open(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("opening log segment %s: %w", key, err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading log segment %s: %w", key, err)
+	}
+	chunks := make([]Chunk, 0, seg.Chunks)
+	dec := json.NewDecoder(zr)
+	for {
+		var c Chunk
+		if err := dec.Decode(&c); errors.Is(err, io.EOF) {
+			return chunks, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading log segment %s: %w", key, err)
+		}
+		chunks = append(chunks, c)
+	}
+}
+
+// trim drops the chunks, and the part of a chunk, before offset from.
+func trim(chunks []Chunk, from int64) []Chunk {
+	var out []Chunk
+	for _, c := range chunks {
+		end := c.Offset + int64(len(c.Data))
+		if end <= from {
+			continue
+		}
+		if c.Offset < from {
+			c.Data = c.Data[from-c.Offset:]
+			c.Offset = from
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// write writes the buffered chunks of a job out as a segment and records
+// it. A non-empty project marks the job as finished, which sets when its
+// log expires even with nothing left to write. Callers must hold b.mu.
+func (a *Archive) write(ctx context.Context, jobID string, b *buffer, project string) error {
+	if len(b.chunks) == 0 && (project == "" || b.log == nil) {
+		return nil
+	}
+	now := a.now()
+	log := &types.JobLog{JobID: jobID, CreatedAt: now}
+	if b.log != nil {
+		log = b.log.Clone()
+	}
+	if len(b.chunks) > 0 {
+		seg, err := a.writeSegment(ctx, jobID, b.chunks)
+		if err != nil {
+			return err
+		}
+		log.Segments = append(log.Segments, seg)
+	}
+	log.Size = b.size
+	log.UpdatedAt = now
+	if project != "" {
+		log.Project = project
+		log.ExpiresAt = nil
+		if d, ok := a.retention(project); ok {
+			t := now.Add(d)
+			log.ExpiresAt = &t
+		}
+	}
+	if err := a.store.PutJobLog(ctx, log); err != nil {
+		return fmt.Errorf("recording log segment: %w", err)
+	}
+	b.log = log
+	b.chunks, b.bytes = nil, 0
+	return nil
+}
+
+// writeSegment compresses chunks, one JSON object per line, and stores them
+// as the segment starting at the first chunk.
+func (a *Archive) writeSegment(ctx context.Context, jobID string, chunks []Chunk) (types.LogSegment, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	var size int64
+	for _, c := range chunks {
+		if err := enc.Encode(c); err != nil {
+			return types.LogSegment{}, err
+		}
+		size += int64(len(c.Data))
+	}
+	if err := zw.Close(); err != nil {
+		return types.LogSegment{}, err
+	}
+	seg := types.LogSegment{
+		Offset:     chunks[0].Offset,
+		Size:       size,
+		StoredSize: int64(buf.Len()),
+		Chunks:     len(chunks),
+		CreatedAt:  a.now(),
+	}
+	key := segmentKey(jobID, seg.Offset)
+	if err := a.blobs.Put(ctx, key, &buf); err != nil {
+		return types.LogSegment{}, fmt.Errorf("storing log segment %s: %w", key, err)
+	}
+	return seg, nil
+}
+
+// Observe notes finished jobs, whose remaining output Run writes out and
+// whose logs start to expire. It is meant to be registered with
+// jobs.Manager.Observe.
+func (a *Archive) Observe(job *types.Job) {
+	if !job.State.Terminal() {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.finished[job.ID] = job.Repository
+}
+
+// Run writes out buffered output and settles finished jobs every
+// flushInterval until ctx is cancelled.
+func (a *Archive) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.flush(ctx, false)
+	}
+}
+
+// Flush writes out all buffered output, such as before the server stops or
+// agents move to another replica.
+func (a *Archive) Flush(ctx context.Context) {
+	a.flush(ctx, true)
+}
+
+// flush writes out the output of finished jobs and, unless all is set, of
+// jobs whose output was buffered for flushInterval. Buffers left empty are
+// dropped; failures are logged and retried on the next flush.
+func (a *Archive) flush(ctx context.Context, all bool) {
+	a.mu.Lock()
+	finished := a.finished
+	a.finished = make(map[string]string)
+	ids := make([]string, 0, len(a.buffers)+len(finished))
+	for id := range a.buffers {
+		ids = append(ids, id)
+	}
+	for id := range finished {
+		if _, ok := a.buffers[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	a.mu.Unlock()
+
+	now := a.now()
+	for _, id := range ids {
+		project := finished[id]
+		b := a.buffer(id)
+		due := all || project != "" || (len(b.chunks) > 0 && now.Sub(b.since) >= flushInterval)
+		if !due {
+			b.mu.Unlock()
+			continue
+		}
+		err := a.load(ctx, id, b)
+		if err == nil {
+			err = a.write(ctx, id, b, project)
+		}
+		if err != nil {
+			b.mu.Unlock()
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "writing job log", "job_id", id, "error", err)
+			}
+			if project != "" {
+				a.mu.Lock()
+				a.finished[id] = project
+				a.mu.Unlock()
+			}
+			continue
+		}
+		if len(b.chunks) == 0 {
+			b.closed = true
+			a.mu.Lock()
+			if a.buffers[id] == b {
+				delete(a.buffers, id)
+			}
+			a.mu.Unlock()
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Purge deletes expired logs on start and then every purgeInterval until
+// ctx is cancelled.
+func (a *Archive) Purge(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := a.purge(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "deleting expired logs", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Deleted expired logs", "jobs", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge deletes every log that has expired.
+func (a *Archive) purge(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		expired, err := a.store.ListExpiredJobLogs(ctx, a.now(), purgeBatch)
+		if err != nil {
+			return deleted, err
+		}
+		for _, log := range expired {
+			if err := a.Delete(ctx, log); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(expired) < purgeBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// Delete deletes the archived log of a job, segments first so that a
+// failure leaves the record to retry.
+func (a *Archive) Delete(ctx context.Context, log *types.JobLog) error {
+	for _, seg := range log.Segments {
+		key := segmentKey(log.JobID, seg.Offset)
+		if err := a.blobs.Delete(ctx, key); err != nil {
+			return fmt.Errorf("deleting log segment %s: %w", key, err)
+		}
+	}
+	if err := a.store.DeleteJobLog(ctx, log.JobID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("deleting log record of job %s: %w", log.JobID, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package logs
+
+import (
+	"context"
+	"sync"
+)
+
+// Feed wraps a Store and lets readers wait for a job's log to change, so
+// that logs can be tailed without polling.
+type Feed struct {
+	Store
+
+	mu        sync.Mutex
+	waiters   map[string]chan struct{}
+	observers []func(jobID string, c Chunk)
+}
+
+// NewFeed returns a Feed backed by store.
+func NewFeed(store Store) *Feed {
+	return &Feed{Store: store, waiters: make(map[string]chan struct{})}
+}
+
+// Observe registers fn to be called with every chunk appended, as stored.
+// Observers run synchronously and must not block.
+func (f *Feed) Observe(fn func(jobID string, c Chunk)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observers = append(f.observers, fn)
+}
+
+// Append stores a chunk, wakes everyone waiting on the job and passes the
+// chunk to the observers.
+func (f *Feed) Append(ctx context.Context, jobID string, stream Stream, data []byte) (Chunk, error) {
+	c, err := f.Store.Append(ctx, jobID, stream, data)
+	if err != nil {
+		return c, err
+	}
+	f.Notify(jobID)
+	f.mu.Lock()
+	observers := f.observers
+	f.mu.Unlock()
+	for _, fn := range observers {
+		fn(jobID, c)
+	}
+	return c, nil
+}
+
+// Wait returns a channel that is closed the next time the job's log grows or
+// Notify is called for it. Take the channel before reading so that a chunk
+// appended in between is not missed.
+func (f *Feed) Wait(jobID string) <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.waiters[jobID]
+	if !ok {
+		ch = make(chan struct{})
+		f.waiters[jobID] = ch
+	}
+	return ch
+}
+
+// Notify wakes everyone waiting on the job, for example because it finished
+// and no more output will arrive.
+func (f *Feed) Notify(jobID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ch, ok := f.waiters[jobID]; ok {
+		close(ch)
+		delete(f.waiters, jobID)
+	}
+}
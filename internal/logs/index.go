@@ -0,0 +1,195 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+const (
+	// indexDelay is how long after a job finishes its log is indexed, so
+	// that output uploaded late and output still buffered by the archive
+	// are included.
+	indexDelay = 30 * time.Second
+	// indexInterval is how often logs due to be indexed are.
+	indexInterval = 10 * time.Second
+	// indexAttempts is how many times indexing a log is tried before it is
+	// given up on.
+	indexAttempts = 3
+	// maxIndexedLines caps the lines indexed per job; the rest of longer
+	// logs cannot be searched.
+	maxIndexedLines = 100_000
+	// maxIndexedLineBytes caps the length of an indexed line.
+	maxIndexedLineBytes = 2 << 10
+)
+
+// ansiEscape matches the terminal escape sequences of coloured output.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// Indexer adds the logs of finished jobs to the search index, line by line,
+// once their output has settled.
+type Indexer struct {
+	logs  Store
+	index storage.LogIndexStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]*pendingLog
+}
+
+// pendingLog is a finished job whose log is waiting to be indexed.
+type pendingLog struct {
+	project  string
+	finished time.Time
+	due      time.Time
+	attempts int
+}
+
+// NewIndexer returns an Indexer that reads logs from logs and indexes them
+// in index.
+func NewIndexer(logs Store, index storage.LogIndexStore) *Indexer {
+	return &Indexer{logs: logs, index: index, now: time.Now, pending: make(map[string]*pendingLog)}
+}
+
+// Observe queues the logs of finished jobs to be indexed. It is meant to be
+// registered with jobs.Manager.Observe and never blocks.
+func (x *Indexer) Observe(job *types.Job) {
+	if !job.State.Terminal() {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.pending[job.ID] = &pendingLog{project: job.Repository, finished: job.UpdatedAt, due: x.now().Add(indexDelay)}
+}
+
+// Run indexes the logs that are due every indexInterval until ctx is
+// cancelled.
+func (x *Indexer) Run(ctx context.Context) {
+	ticker := time.NewTicker(indexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		x.indexDue(ctx)
+	}
+}
+
+// indexDue indexes the logs that are due. Failures are retried on later
+// runs, up to indexAttempts times.
+func (x *Indexer) indexDue(ctx context.Context) {
+	now := x.now()
+	x.mu.Lock()
+	due := make(map[string]*pendingLog)
+	for id, p := range x.pending {
+		if !p.due.After(now) {
+			due[id] = p
+			delete(x.pending, id)
+		}
+	}
+	x.mu.Unlock()
+
+	for id, p := range due {
+		err := x.indexJob(ctx, id, p)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		p.attempts++
+		if p.attempts >= indexAttempts {
+			slog.ErrorContext(ctx, "Giving up indexing job log", "job_id", id, "error", err)
+			continue
+		}
+		slog.WarnContext(ctx, "indexing job log", "job_id", id, "error", err)
+		p.due = now.Add(indexInterval)
+		x.mu.Lock()
+		if _, ok := x.pending[id]; !ok {
+			x.pending[id] = p
+		}
+		x.mu.Unlock()
+	}
+}
+
+// indexJob reads a job's whole log and replaces its indexed lines.
+func (x *Indexer) indexJob(ctx context.Context, jobID string, p *pendingLog) error {
+	chunks, err := x.logs.Read(ctx, jobID, 0)
+	if err != nil {
+		return fmt.Errorf("reading log: %w", err)
+	}
+	lines := Lines(chunks)
+	indexed := make([]*types.LogLine, 0, len(lines))
+	for _, line := range lines {
+		if len(indexed) == maxIndexedLines {
+			break
+		}
+		if line.Text == "" {
+			continue
+		}
+		line.ID = fmt.Sprintf("%s/%08d", jobID, line.Number)
+		line.JobID = jobID
+		line.Project = p.project
+		line.FinishedAt = p.finished
+		indexed = append(indexed, line)
+	}
+	return x.index.IndexJobLog(ctx, jobID, indexed)
+}
+
+// Lines splits the output of a job into its lines, numbered from 1, as
+// shown in a terminal: escape sequences are dropped, and a line rewritten
+// after a carriage return, as by progress bars, keeps its last text. Lines
+// longer than maxIndexedLineBytes are cut short.
+func Lines(chunks []Chunk) []*types.LogLine {
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Offset < chunks[j].Offset })
+	var (
+		lines []*types.LogLine
+		buf   bytes.Buffer
+		start int64
+	)
+	emit := func() {
+		text := buf.Bytes()
+		if i := bytes.LastIndexByte(bytes.TrimRight(text, "\r"), '\r'); i >= 0 {
+			text = text[i+1:]
+		}
+		text = bytes.TrimRight(ansiEscape.ReplaceAll(text, nil), "\r")
+		if len(text) > maxIndexedLineBytes {
+			text = text[:maxIndexedLineBytes]
+			for len(text) > 0 && !utf8.Valid(text) {
+				text = text[:len(text)-1]
+			}
+		}
+		lines = append(lines, &types.LogLine{Number: len(lines) + 1, Offset: start, Text: string(bytes.ToValidUTF8(text, nil))})
+		buf.Reset()
+	}
+	for _, c := range chunks {
+		data := c.Data
+		offset := c.Offset
+		for len(data) > 0 {
+			if buf.Len() == 0 {
+				start = offset
+			}
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				buf.Write(data)
+				break
+			}
+			buf.Write(data[:i])
+			emit()
+			data = data[i+1:]
+			offset += int64(i + 1)
+		}
+	}
+	if buf.Len() > 0 {
+		emit()
+	}
+	return lines
+}
@@ -0,0 +1,316 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+const (
+	// tailDivisor sets the share of a log limit that holds the end of the
+	// output, a quarter; the rest holds its start.
+	tailDivisor = 4
+	// limitInterval is how often the tails of finished jobs are stored.
+	limitInterval = time.Second
+)
+
+// JobGetter looks up the job a log belongs to.
+type JobGetter interface {
+	Get(ctx context.Context, id string) (*types.Job, error)
+}
+
+// Annotator publishes annotations on jobs, as annotations.Service does.
+type Annotator interface {
+	Publish(ctx context.Context, job *types.Job, annotations []types.NewAnnotation) ([]*types.Annotation, error)
+}
+
+// Limited is a Store that caps the output kept of each job at its log
+// limit, the job's own or the server's, whichever is lower. Once the start
+// of the output fills three quarters of the limit, a marker is stored in
+// its place and the rest is held in memory, which keeps only the newest
+// quarter of the limit. When the job finishes, Run stores that tail after a
+// marker telling how much was skipped, and publishes a warning annotation
+// on the job. Jobs are never failed or held up by their limit.
+//
+// Every attempt of a job starts counting afresh, as do jobs running while
+// the server restarts, whose output may then exceed their limit.
+type Limited struct {
+	Store
+	jobs      JobGetter
+	annotator Annotator
+	limit     int64
+	now       func() time.Time
+
+	mu       sync.Mutex
+	logs     map[string]*limitedLog
+	finished map[string]bool
+}
+
+// limitedLog tracks the output of a job attempt against its limit.
+type limitedLog struct {
+	mu  sync.Mutex
+	job *types.Job
+	// limit is 0 for jobs that may keep all their output.
+	limit int64
+	// offset is where the next chunk stored starts, and written how much
+	// output was stored, not counting markers.
+	offset  int64
+	written int64
+	// truncated is set once the start of the output filled its share of
+	// the limit. held counts the output received since, and tail holds the
+	// newest of it, tailBytes in all.
+	truncated bool
+	held      int64
+	tail      []Chunk
+	tailBytes int64
+	// marked is set once the marker before the tail is stored.
+	marked bool
+}
+
+// NewLimited returns a Store that appends the output of jobs to store up
+// to their log limits; limit is the server's, 0 for none. Truncated logs
+// are reported to annotator.
+func NewLimited(store Store, jobs JobGetter, annotator Annotator, limit int64) *Limited {
+	return &Limited{
+		Store:     store,
+		jobs:      jobs,
+		annotator: annotator,
+		limit:     limit,
+		now:       time.Now,
+		logs:      make(map[string]*limitedLog),
+		finished:  make(map[string]bool),
+	}
+}
+
+// Append implements Store. Output past the start of a truncated log is not
+// stored; the chunk returned for it is empty, at the end of the log.
+func (x *Limited) Append(ctx context.Context, jobID string, stream Stream, data []byte) (Chunk, error) {
+	l, err := x.log(ctx, jobID)
+	if err != nil {
+		return Chunk{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		l.hold(stream, data)
+		return Chunk{JobID: jobID, Stream: stream, Offset: l.offset, At: x.now()}, nil
+	}
+	head := l.limit - l.limit/tailDivisor
+	if l.limit == 0 || l.written+int64(len(data)) <= head {
+		return l.store(ctx, x.Store, stream, data, int64(len(data)))
+	}
+	// The whole lines that still fit are kept before the marker.
+	keep := bytes.LastIndexByte(data[:head-l.written], '\n') + 1
+	marker := fmt.Sprintf("==> The log reached its limit of %s; output is skipped from here on, except the last %s, which is added when the job finishes\n",
+		formatSize(l.limit), formatSize(l.limit/tailDivisor))
+	c, err := l.store(ctx, x.Store, stream, append(data[:keep:keep], marker...), int64(keep))
+	if err != nil {
+		return c, err
+	}
+	l.truncated = true
+	l.hold(stream, data[keep:])
+	return c, nil
+}
+
+// log returns the limit state of a job, creating it on the job's first
+// output.
+func (x *Limited) log(ctx context.Context, jobID string) (*limitedLog, error) {
+	x.mu.Lock()
+	l, ok := x.logs[jobID]
+	x.mu.Unlock()
+	if ok {
+		return l, nil
+	}
+	job, err := x.jobs.Get(ctx, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("getting job: %w", err)
+	}
+	limit := x.limit
+	if job.LogLimit != "" {
+		// Invalid limits are rejected when jobs are submitted.
+		if n, err := types.ParseLogLimit(job.LogLimit); err == nil && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if l, ok := x.logs[jobID]; ok {
+		return l, nil
+	}
+	l = &limitedLog{job: job, limit: limit}
+	x.logs[jobID] = l
+	if job.State.Terminal() {
+		// Output uploaded late; nothing else would let go of the state.
+		x.finished[jobID] = true
+	}
+	return l, nil
+}
+
+// store appends data, of which n bytes are output, to the log. Callers
+// must hold l.mu.
+func (l *limitedLog) store(ctx context.Context, store Store, stream Stream, data []byte, n int64) (Chunk, error) {
+	c, err := store.Append(ctx, l.job.ID, stream, data)
+	if err != nil {
+		return c, err
+	}
+	l.offset = c.Offset + int64(len(c.Data))
+	l.written += n
+	return c, nil
+}
+
+// hold adds skipped output to the tail, dropping the oldest output beyond
+// the tail's share of the limit. Callers must hold l.mu.
+func (l *limitedLog) hold(stream Stream, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	l.held += int64(len(data))
+	if n := len(l.tail); n > 0 && l.tail[n-1].Stream == stream {
+		l.tail[n-1].Data = append(l.tail[n-1].Data, data...)
+	} else {
+		l.tail = append(l.tail, Chunk{Stream: stream, Data: bytes.Clone(data)})
+	}
+	l.tailBytes += int64(len(data))
+	size := l.limit / tailDivisor
+	for l.tailBytes > size {
+		excess := l.tailBytes - size
+		first := &l.tail[0]
+		if int64(len(first.Data)) <= excess {
+			l.tailBytes -= int64(len(first.Data))
+			l.tail = l.tail[1:]
+			continue
+		}
+		first.Data = first.Data[excess:]
+		l.tailBytes -= excess
+	}
+}
+
+// Observe notes finished jobs, whose tails Run stores. It is meant to be
+// registered with jobs.Manager.Observe and never blocks.
+func (x *Limited) Observe(job *types.Job) {
+	if !job.State.Terminal() {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.logs[job.ID]; ok {
+		x.finished[job.ID] = true
+	}
+}
+
+// Run stores the tails of the truncated logs of finished jobs every
+// limitInterval until ctx is cancelled.
+func (x *Limited) Run(ctx context.Context) {
+	ticker := time.NewTicker(limitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		x.mu.Lock()
+		ids := make([]string, 0, len(x.finished))
+		for id := range x.finished {
+			ids = append(ids, id)
+		}
+		x.mu.Unlock()
+		for _, id := range ids {
+			if err := x.finish(ctx, id); err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "storing the tail of a truncated log", "job_id", id, "error", err)
+				}
+				continue
+			}
+			x.mu.Lock()
+			delete(x.finished, id)
+			delete(x.logs, id)
+			x.mu.Unlock()
+		}
+	}
+}
+
+// finish stores the tail of a finished job's truncated log and annotates
+// the job. Failures to store leave the rest of the tail to be stored on
+// the next try.
+func (x *Limited) finish(ctx context.Context, jobID string) error {
+	x.mu.Lock()
+	l := x.logs[jobID]
+	x.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.truncated {
+		return nil
+	}
+	if !l.marked {
+		// The tail starts at the first whole line.
+		if len(l.tail) > 0 {
+			first := &l.tail[0]
+			if i := bytes.IndexByte(first.Data, '\n'); i >= 0 {
+				first.Data = first.Data[i+1:]
+				l.tailBytes -= int64(i + 1)
+			}
+		}
+		head, tail, skipped := l.written, l.tailBytes, l.held-l.tailBytes
+		marker := fmt.Sprintf("==> %s of output skipped\n", formatSize(skipped))
+		stream := Stdout
+		var data []byte
+		if len(l.tail) > 0 {
+			stream, data = l.tail[0].Stream, l.tail[0].Data
+		}
+		if _, err := l.store(ctx, x.Store, stream, append([]byte(marker), data...), int64(len(data))); err != nil {
+			return err
+		}
+		if len(l.tail) > 0 {
+			l.tail = l.tail[1:]
+		}
+		l.marked = true
+		x.annotate(ctx, l.job, l.limit, head, tail, skipped)
+	}
+	for len(l.tail) > 0 {
+		if _, err := l.store(ctx, x.Store, l.tail[0].Stream, l.tail[0].Data, int64(len(l.tail[0].Data))); err != nil {
+			return err
+		}
+		l.tail = l.tail[1:]
+	}
+	return nil
+}
+
+// annotate warns on job that its log keeps only the first head and the
+// last tail bytes of its output. Failures are only logged, since the log
+// itself tells.
+func (x *Limited) annotate(ctx context.Context, job *types.Job, limit, head, tail, skipped int64) {
+	msg := fmt.Sprintf("The job wrote %s of output, more than its log limit of %s. The log keeps the first %s and the last %s; the %s in between was skipped.",
+		formatSize(head+skipped+tail), formatSize(limit), formatSize(head), formatSize(tail), formatSize(skipped))
+	_, err := x.annotator.Publish(ctx, job, []types.NewAnnotation{{
+		Level:   types.AnnotationWarning,
+		Title:   "Log truncated",
+		Message: msg,
+	}})
+	if err != nil {
+		slog.ErrorContext(ctx, "annotating truncated log", "job_id", job.ID, "error", err)
+	}
+}
+
+// formatSize renders an amount of bytes in the largest binary unit it
+// reaches, such as 1.5 GiB.
+func formatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -0,0 +1,32 @@
+package logs
+
+import "context"
+
+// Masker redacts sensitive values from job output.
+type Masker interface {
+	// Mask returns data with every sensitive value of the job replaced.
+	Mask(ctx context.Context, jobID string, data []byte) ([]byte, error)
+}
+
+// Masked is a Store that passes every appended chunk through a Masker
+// before storing it, so the unmasked output is never kept or streamed.
+// Values are matched within a chunk; agents send output in whole lines so
+// that a value is not split across chunks.
+type Masked struct {
+	Store
+	masker Masker
+}
+
+// NewMasked returns a Store that masks chunks with masker before appending
+// them to store.
+func NewMasked(store Store, masker Masker) *Masked {
+	return &Masked{Store: store, masker: masker}
+}
+
+func (m *Masked) Append(ctx context.Context, jobID string, stream Stream, data []byte) (Chunk, error) {
+	masked, err := m.masker.Mask(ctx, jobID, data)
+	if err != nil {
+		return Chunk{}, err
+	}
+	return m.Store.Append(ctx, jobID, stream, masked)
+}
@@ -0,0 +1,82 @@
+// Package logs stores the output of jobs as agents upload it.
+package logs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Stream identifies which output stream a chunk came from.
+type Stream string
+
+const (
+	Stdout Stream = "stdout"
+	Stderr Stream = "stderr"
+)
+
+// Chunk is a piece of job output. Offset is the byte position of the chunk
+// within the job's combined log.
+type Chunk struct {
+	JobID  string    `json:"job_id"`
+	Stream Stream    `json:"stream"`
+	Offset int64     `json:"offset"`
+	Data   []byte    `json:"data"`
+	At     time.Time `json:"at"`
+}
+
+// Store persists job log chunks.
+type Store interface {
+	// Append adds data to the end of a job's log and returns the stored chunk.
+	Append(ctx context.Context, jobID string, stream Stream, data []byte) (Chunk, error)
+	// Read returns every chunk of a job's log starting at byte offset from.
+	Read(ctx context.Context, jobID string, from int64) ([]Chunk, error)
+}
+
+// Memory is an in-memory Store.
+type Memory struct {
+	mu     sync.RWMutex
+	chunks map[string][]Chunk
+	sizes  map[string]int64
+}
+
+// NewMemory returns an empty in-memory log store.
+func NewMemory() *Memory {
+	return &Memory{
+		chunks: make(map[string][]Chunk),
+		sizes:  make(map[string]int64),
+	}
+}
+
+func (m *Memory) Append(_ context.Context, jobID string, stream Stream, data []byte) (Chunk, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := Chunk{
+		JobID:  jobID,
+		Stream: stream,
+		Offset: m.sizes[jobID],
+		Data:   append([]byte(nil), data...),
+		At:     time.Now(),
+	}
+	m.chunks[jobID] = append(m.chunks[jobID], c)
+	m.sizes[jobID] += int64(len(data))
+	return c, nil
+}
+
+func (m *Memory) Read(_ context.Context, jobID string, from int64) ([]Chunk, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Chunk
+	for _, c := range m.chunks[jobID] {
+		end := c.Offset + int64(len(c.Data))
+		if end <= from {
+			continue
+		}
+		if c.Offset < from {
+			c.Data = c.Data[from-c.Offset:]
+			c.Offset = from
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
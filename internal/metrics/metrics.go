@@ -0,0 +1,209 @@
+// Package metrics exposes control plane metrics in the Prometheus format.
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"open-cicd/internal/types"
+)
+
+const namespace = "open_cicd"
+
+// scrapeTimeout bounds the store queries made while collecting a scrape.
+const scrapeTimeout = 5 * time.Second
+
+// Metrics holds the collectors of one control plane. Each Metrics has its own
+// registry, so several can coexist in a process.
+type Metrics struct {
+	registry        *prometheus.Registry
+	httpDuration    *prometheus.HistogramVec
+	jobDuration     *prometheus.HistogramVec
+	dispatchLatency prometheus.Histogram
+	jobsLost        *prometheus.CounterVec
+	gcDeleted       *prometheus.CounterVec
+	gcReclaimed     *prometheus.CounterVec
+}
+
+// New returns Metrics with the HTTP, job and dispatch collectors plus the
+// standard Go runtime and process collectors registered.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "job_duration_seconds",
+			Help:      "Time jobs spent running on an agent, by final state.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"outcome"}),
+		dispatchLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dispatch_latency_seconds",
+			Help:      "Time from a job being queued to its assignment to an agent.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}),
+		jobsLost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_lost_total",
+			Help:      "Jobs given up on after hanging on their agent, by whether they were retried.",
+		}, []string{"retried"}),
+		gcDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_deleted_total",
+			Help:      "Records deleted by garbage collection, by kind.",
+		}, []string{"kind"}),
+		gcReclaimed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_reclaimed_bytes_total",
+			Help:      "Bytes of blob storage freed by garbage collection, by kind of record.",
+		}, []string{"kind"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpDuration,
+		m.jobDuration,
+		m.dispatchLatency,
+		m.jobsLost,
+		m.gcDeleted,
+		m.gcReclaimed,
+	)
+	return m
+}
+
+// Handler returns the handler serving the metrics in the exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveRequest records an HTTP request handled by the route with the given
+// path template.
+func (m *Metrics) ObserveRequest(route, method string, code int, d time.Duration) {
+	m.httpDuration.WithLabelValues(route, method, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// ObserveJob records the timings of a job change. It is meant to be
+// registered as a job manager observer: assignments feed the dispatch latency
+// and final states the job duration. Updates that did not change the job's
+// state are ignored so nothing is counted twice.
+func (m *Metrics) ObserveJob(job *types.Job) {
+	if len(job.Transitions) < 2 {
+		return
+	}
+	last := job.Transitions[len(job.Transitions)-1]
+	if !last.At.Equal(job.UpdatedAt) {
+		return
+	}
+	switch {
+	case last.To == types.JobStateAssigned && last.From == types.JobStateQueued:
+		queued := job.Transitions[len(job.Transitions)-2]
+		m.dispatchLatency.Observe(last.At.Sub(queued.At).Seconds())
+	case last.To.Terminal():
+		// Jobs that never started, such as ones cancelled while queued, have
+		// no running time to report.
+		if started, ok := job.LastTransition(types.JobStateRunning); ok {
+			m.jobDuration.WithLabelValues(string(last.To)).Observe(last.At.Sub(started.At).Seconds())
+		}
+	}
+}
+
+// ObserveLost counts a job marked lost, as it is afterwards. It is meant to
+// be registered with scheduler.Reaper.OnLost.
+func (m *Metrics) ObserveLost(job *types.Job) {
+	m.jobsLost.WithLabelValues(strconv.FormatBool(job.State == types.JobStateQueued)).Inc()
+}
+
+// ObserveGC counts what a garbage collection deleted. It is meant to be
+// registered with gc.Collector.OnCollected.
+func (m *Metrics) ObserveGC(report *types.GCReport) {
+	for kind, n := range report.Deleted {
+		m.gcDeleted.WithLabelValues(string(kind)).Add(float64(n))
+	}
+	for kind, bytes := range report.Reclaimed {
+		m.gcReclaimed.WithLabelValues(string(kind)).Add(float64(bytes))
+	}
+}
+
+// RegisterQueueDepth reports the number of queued jobs as returned by depth
+// at scrape time.
+func (m *Metrics) RegisterQueueDepth(depth func() int) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of jobs waiting in the scheduler queue.",
+	}, func() float64 { return float64(depth()) }))
+}
+
+// RegisterLeader reports 1 while leading returns true and 0 otherwise, so
+// that the replica currently scheduling jobs can be told apart.
+func (m *Metrics) RegisterLeader(leading func() bool) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the leader, which schedules jobs.",
+	}, func() float64 {
+		if leading() {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// AgentLister lists registered agents.
+type AgentLister interface {
+	List(ctx context.Context) ([]*types.Agent, error)
+}
+
+// RegisterAgents reports the number of registered agents in each state,
+// listed from agents at scrape time.
+func (m *Metrics) RegisterAgents(agents AgentLister) {
+	m.registry.MustRegister(&agentCollector{
+		agents: agents,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "agents"),
+			"Number of registered agents by state.",
+			[]string{"state"}, nil,
+		),
+	})
+}
+
+// agentCollector counts agents per state on every scrape.
+type agentCollector struct {
+	agents AgentLister
+	desc   *prometheus.Desc
+}
+
+func (c *agentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *agentCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+	list, err := c.agents.List(ctx)
+	if err != nil {
+		slog.Error("listing agents for metrics", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	counts := make(map[types.AgentState]int)
+	for _, a := range list {
+		counts[a.State]++
+	}
+	for _, state := range types.AgentStates {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts[state]), string(state))
+	}
+}
@@ -0,0 +1,150 @@
+package microvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Init runs the task the kernel command line names, as the init process of
+// a microVM: it mounts what the task needs, runs it on the console and
+// leaves its exit code on the workspace drive, which it unmounts. The
+// caller powers the microVM off after, as PowerOff does.
+func Init() error {
+	for _, m := range []struct{ source, target, fstype string }{
+		{"proc", "/proc", "proc"},
+		{"sysfs", "/sys", "sysfs"},
+		{"devtmpfs", "/dev", "devtmpfs"},
+		{"tmpfs", "/tmp", "tmpfs"},
+		{"tmpfs", "/run", "tmpfs"},
+	} {
+		if err := os.MkdirAll(m.target, 0o755); err != nil {
+			return err
+		}
+		// The kernel may have mounted devtmpfs already.
+		if err := syscall.Mount(m.source, m.target, m.fstype, 0, ""); err != nil && !errors.Is(err, syscall.EBUSY) {
+			return fmt.Errorf("mounting %s: %w", m.target, err)
+		}
+	}
+	if err := os.Chmod("/tmp", 0o1777); err != nil {
+		return err
+	}
+	if err := loopbackUp(); err != nil {
+		return fmt.Errorf("bringing up the loopback interface: %w", err)
+	}
+
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return err
+	}
+	params := Params(string(cmdline))
+	workspace := params[WorkspaceParam]
+	index, err := strconv.Atoi(params[TaskParam])
+	if workspace == "" || err != nil {
+		return fmt.Errorf("the kernel command line names no workspace and task: %s", cmdline)
+	}
+	if err := os.MkdirAll(workspace, 0o755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(WorkspaceDevice, workspace, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("mounting the workspace: %w", err)
+	}
+	defer func() {
+		syscall.Sync()
+		syscall.Unmount(workspace, 0)
+	}()
+
+	data, err := os.ReadFile(filepath.Join(workspace, TasksFile))
+	if err != nil {
+		return err
+	}
+	var tasks []Task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return fmt.Errorf("decoding tasks: %w", err)
+	}
+	if index < 0 || index >= len(tasks) {
+		return fmt.Errorf("there is no task %d", index)
+	}
+	task := tasks[index]
+	if len(task.Nameservers) > 0 {
+		var b strings.Builder
+		for _, ns := range task.Nameservers {
+			fmt.Fprintf(&b, "nameserver %s\n", ns)
+		}
+		if err := os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0o644); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(task.Argv[0], task.Argv[1:]...)
+	cmd.Dir = workspace
+	cmd.Env = task.Env
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if task.RunAsUser != nil {
+		uid, gid := uint32(*task.RunAsUser), uint32(*task.RunAsUser)
+		if task.RunAsGroup != nil {
+			gid = uint32(*task.RunAsGroup)
+		}
+		if err := chownAll(workspace, int(uid), int(gid)); err != nil {
+			return fmt.Errorf("handing the workspace to user %d: %w", uid, err)
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	code := 0
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		code = exitErr.ExitCode()
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "starting task %s: %v\n", task.Name, err)
+		code = 127
+	}
+	return os.WriteFile(filepath.Join(workspace, ExitFile(index)), []byte(strconv.Itoa(code)), 0o644)
+}
+
+// PowerOff stops the microVM. Firecracker exits when its guest reboots.
+func PowerOff() {
+	syscall.Sync()
+	syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+}
+
+// chownAll hands the files under dir to uid and gid.
+func chownAll(dir string, uid, gid int) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// loopbackUp brings up lo, which the kernel configures only eth0 of.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// struct ifreq: the interface name, then its flags.
+	var req [40]byte
+	copy(req[:syscall.IFNAMSIZ], "lo")
+	flags := (*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ]))
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	*flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Package microvm is what the Firecracker executor of the agent and the
+// init program of its microVMs, cmd/vminit, agree on. The executor packs
+// the job's work directory, with the tasks of the job in TasksFile, into
+// the workspace drive, /dev/vdb, and boots one microVM per task. Init
+// mounts the drive at the workspace named on the kernel command line, runs
+// the task named there, leaves its exit code in ExitFile and powers the
+// microVM off.
+package microvm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Files of the workspace drive, relative to the workspace.
+const (
+	// TasksFile holds the JSON array of the Tasks of the job.
+	TasksFile = ".opencicd/vm/tasks.json"
+	// exitFile is where the exit code of each task is left.
+	exitFile = ".opencicd/vm/exit-"
+)
+
+// Parameters of the kernel command line init reads.
+const (
+	// WorkspaceParam is where init mounts the workspace drive.
+	WorkspaceParam = "opencicd.workspace"
+	// TaskParam is the index of the task in TasksFile that init runs.
+	TaskParam = "opencicd.task"
+)
+
+// WorkspaceDevice is the block device of the workspace drive, the second
+// drive of the microVM after its root filesystem.
+const WorkspaceDevice = "/dev/vdb"
+
+// Task is a task of a job as init runs it.
+type Task struct {
+	Name string `json:"name"`
+	// Argv is the command line of the task, its commands included.
+	Argv []string `json:"argv"`
+	// Env is the whole environment of the task, as KEY=VALUE.
+	Env []string `json:"env"`
+	// RunAsUser and RunAsGroup are the user and group the task runs as,
+	// rather than root; the workspace is handed to them first.
+	RunAsUser  *int64 `json:"run_as_user,omitempty"`
+	RunAsGroup *int64 `json:"run_as_group,omitempty"`
+	// Nameservers, if set, replace those of the image's resolv.conf.
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// ExitFile returns the file, relative to the workspace, the exit code of
+// the i-th task is left in.
+func ExitFile(i int) string {
+	return exitFile + strconv.Itoa(i)
+}
+
+// Params parses the parameters of a kernel command line.
+func Params(cmdline string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range strings.Fields(cmdline) {
+		k, v, _ := strings.Cut(field, "=")
+		params[k] = v
+	}
+	return params
+}
@@ -0,0 +1,186 @@
+package notifications
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// Message is what a notifier delivers about an event. It is also the data
+// notifier templates are executed with.
+type Message struct {
+	Event types.NotificationEvent `json:"event"`
+	// Project is empty for agent_offline messages, and Organization for
+	// projects no organization owns.
+	Project      string          `json:"project,omitempty"`
+	Organization string          `json:"organization,omitempty"`
+	Pipeline     *types.Pipeline `json:"pipeline,omitempty"`
+	// Job is the stuck job of job_stuck messages, the lost job of job_lost
+	// ones and the failed job of job_failed ones.
+	Job *types.Job `json:"job,omitempty"`
+	// Agent is the agent of agent_offline messages.
+	Agent *types.Agent `json:"agent,omitempty"`
+	// Waiting is how long the job of a job_stuck message has been queued.
+	Waiting string `json:"waiting,omitempty"`
+	// Reason is why the job of a job_lost or job_failed message was given
+	// up on.
+	Reason string `json:"reason,omitempty"`
+	// Stage is the stage of an approval_needed message.
+	Stage string `json:"stage,omitempty"`
+	// URL links to the run or the job, if the server's external URL is set.
+	URL string `json:"url,omitempty"`
+	// Text is the rendered message.
+	Text string `json:"text"`
+	// HTML is the rendered HTML part of emails, if they have one.
+	HTML string `json:"-"`
+}
+
+// Subject returns the first line of the message, used as the subject of
+// emails.
+func (m *Message) Subject() string {
+	subject, _, _ := strings.Cut(m.Text, "\n")
+	return subject
+}
+
+// defaultTemplates are the messages of notifiers without a template.
+var defaultTemplates = map[types.NotificationEvent]*template.Template{
+	types.EventPipelineFailed: template.Must(template.New("message").Parse(
+		`Pipeline {{.Pipeline.Name}} failed on {{.Project}} {{.Pipeline.Ref}}{{with .Pipeline.Commit}} ({{.}}){{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventPipelineSucceeded: template.Must(template.New("message").Parse(
+		`Pipeline {{.Pipeline.Name}} succeeded on {{.Project}} {{.Pipeline.Ref}}{{with .Pipeline.Commit}} ({{.}}){{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventPipelineFixed: template.Must(template.New("message").Parse(
+		`Pipeline {{.Pipeline.Name}} is fixed on {{.Project}} {{.Pipeline.Ref}}{{with .Pipeline.Commit}} ({{.}}){{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventApprovalNeeded: template.Must(template.New("message").Parse(
+		`Stage {{.Stage}} of pipeline {{.Pipeline.Name}} on {{.Project}} {{.Pipeline.Ref}} is waiting for approval{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventJobStuck: template.Must(template.New("message").Parse(
+		`Job {{.Job.Name}} of {{.Project}} has been queued for {{.Waiting}} without starting{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventJobLost: template.Must(template.New("message").Parse(
+		`Job {{.Job.Name}} of {{.Project}} hung and was {{if eq .Job.State "queued"}}retried{{else}}failed{{end}}: {{.Reason}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventPipelineStarted: template.Must(template.New("message").Parse(
+		`Pipeline {{.Pipeline.Name}} started on {{.Project}} {{.Pipeline.Ref}}{{with .Pipeline.Commit}} ({{.}}){{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventPipelineFinished: template.Must(template.New("message").Parse(
+		`Pipeline {{.Pipeline.Name}} {{.Pipeline.State}} on {{.Project}} {{.Pipeline.Ref}}{{with .Pipeline.Commit}} ({{.}}){{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventJobFailed: template.Must(template.New("message").Parse(
+		`Job {{.Job.Name}} of {{.Project}} {{if eq .Job.State "timed_out"}}timed out{{else}}failed{{end}}{{with .Reason}}: {{.}}{{end}}{{with .URL}}` + "\n" + `{{.}}{{end}}`)),
+	types.EventAgentOffline: template.Must(template.New("message").Parse(
+		`Agent {{.Agent.Hostname}} ({{.Agent.ID}}) of {{.Organization}} went offline`)),
+}
+
+// htmlLayout is the default HTML email of an event, around the heading and
+// body it defines and with its heading in the colour substituted for %s.
+const htmlLayout = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #1f2328;">
+<h2 style="color: %s;">{{template "heading" .}}</h2>
+{{template "body" .}}
+{{with .URL}}<p><a href="{{.}}">View in Open-CICD</a></p>{{end}}
+</body>
+</html>
+`
+
+// runDetails lists the ref and commit of a pipeline run in HTML emails.
+const runDetails = `{{define "body"}}<p>Project <b>{{.Project}}</b>, ref <code>{{.Pipeline.Ref}}</code>{{with .Pipeline.Commit}}, commit <code>{{.}}</code>{{end}}.</p>{{end}}`
+
+// htmlEvent is the heading, body and heading colour of the default HTML
+// email of an event.
+type htmlEvent struct {
+	heading, body, colour string
+}
+
+var htmlEvents = map[types.NotificationEvent]htmlEvent{
+	types.EventPipelineFailed:    {`Pipeline {{.Pipeline.Name}} failed`, runDetails, "#cf222e"},
+	types.EventPipelineSucceeded: {`Pipeline {{.Pipeline.Name}} succeeded`, runDetails, "#1a7f37"},
+	types.EventPipelineFixed:     {`Pipeline {{.Pipeline.Name}} is fixed`, runDetails, "#1a7f37"},
+	types.EventApprovalNeeded: {`Stage {{.Stage}} is waiting for approval`,
+		`{{define "body"}}<p>Pipeline <b>{{.Pipeline.Name}}</b> of <b>{{.Project}}</b> on <code>{{.Pipeline.Ref}}</code> waits for stage <b>{{.Stage}}</b> to be approved or rejected.</p>{{end}}`, "#9a6700"},
+	types.EventJobStuck: {`Job {{.Job.Name}} is stuck`,
+		`{{define "body"}}<p>Job <b>{{.Job.Name}}</b> of <b>{{.Project}}</b> has been queued for {{.Waiting}} without starting.</p>{{end}}`, "#9a6700"},
+	types.EventJobLost: {`Job {{.Job.Name}} hung`,
+		`{{define "body"}}<p>Job <b>{{.Job.Name}}</b> of <b>{{.Project}}</b> hung and was {{if eq .Job.State "queued"}}retried{{else}}failed{{end}}.</p><p>{{.Reason}}</p>{{end}}`, "#cf222e"},
+	types.EventPipelineStarted:  {`Pipeline {{.Pipeline.Name}} started`, runDetails, "#0969da"},
+	types.EventPipelineFinished: {`Pipeline {{.Pipeline.Name}} {{.Pipeline.State}}`, runDetails, "#1f2328"},
+	types.EventJobFailed: {`Job {{.Job.Name}} {{if eq .Job.State "timed_out"}}timed out{{else}}failed{{end}}`,
+		`{{define "body"}}<p>Job <b>{{.Job.Name}}</b> of <b>{{.Project}}</b> {{if eq .Job.State "timed_out"}}timed out{{else}}failed{{end}}.</p>{{with .Reason}}<p>{{.}}</p>{{end}}{{end}}`, "#cf222e"},
+	types.EventAgentOffline: {`Agent {{.Agent.Hostname}} went offline`,
+		`{{define "body"}}<p>Agent <b>{{.Agent.Hostname}}</b> (<code>{{.Agent.ID}}</code>) of <b>{{.Organization}}</b> stopped sending heartbeats or disconnected, and takes no jobs until it is back.</p>{{end}}`, "#9a6700"},
+}
+
+// defaultHTMLTemplates are the HTML parts of the emails of email notifiers
+// with neither a template nor an HTML template.
+var defaultHTMLTemplates = func() map[types.NotificationEvent]*htmltemplate.Template {
+	templates := make(map[types.NotificationEvent]*htmltemplate.Template, len(htmlEvents))
+	for name, e := range htmlEvents {
+		tmpl := htmltemplate.Must(htmltemplate.New("message").Parse(fmt.Sprintf(htmlLayout, e.colour)))
+		htmltemplate.Must(tmpl.Parse(`{{define "heading"}}` + e.heading + `{{end}}`))
+		htmltemplate.Must(tmpl.Parse(e.body))
+		templates[name] = tmpl
+	}
+	return templates
+}()
+
+// message renders the message notifier delivers for event e.
+func (s *Service) message(notifier *types.Notifier, name types.NotificationEvent, e event) (*Message, error) {
+	m := &Message{Event: name, Project: e.project(), Organization: e.organization(), Pipeline: e.run, Job: e.job, Agent: e.agent, Stage: e.stage}
+	switch {
+	case e.agent != nil:
+	case e.job != nil:
+		if e.lost || e.failed {
+			m.Reason = failureReason(e.job)
+		} else if since, ok := e.job.LastTransition(types.JobStateQueued); ok {
+			m.Waiting = s.now().Sub(since.At).Round(time.Second).String()
+		}
+		if s.externalURL != "" {
+			m.URL = s.externalURL + "/jobs/" + e.job.ID
+		}
+	case s.externalURL != "":
+		m.URL = s.externalURL + "/pipelines/" + e.run.ID
+	}
+
+	tmpl := defaultTemplates[name]
+	if notifier.Template != "" {
+		var err error
+		if tmpl, err = template.New("message").Parse(notifier.Template); err != nil {
+			return nil, err
+		}
+	}
+	var text strings.Builder
+	if err := tmpl.Execute(&text, m); err != nil {
+		return nil, err
+	}
+	m.Text = text.String()
+
+	// Emails get an HTML part unless their notifier replaced the plain
+	// text one only.
+	if notifier.Kind != types.NotifierEmail || (notifier.Template != "" && notifier.HTMLTemplate == "") {
+		return m, nil
+	}
+	htmlTmpl := defaultHTMLTemplates[name]
+	if notifier.HTMLTemplate != "" {
+		var err error
+		if htmlTmpl, err = htmltemplate.New("message").Parse(notifier.HTMLTemplate); err != nil {
+			return nil, err
+		}
+	}
+	var html strings.Builder
+	if err := htmlTmpl.Execute(&html, m); err != nil {
+		return nil, err
+	}
+	m.HTML = html.String()
+	return m, nil
+}
+
+// failureReason returns why a job was given up on: the reason its failed
+// attempt records if it was retried, or that of its failure.
+func failureReason(job *types.Job) string {
+	if job.State == types.JobStateQueued && len(job.Attempts) > 0 {
+		return job.Attempts[len(job.Attempts)-1].Reason
+	}
+	if len(job.Transitions) == 0 {
+		return ""
+	}
+	return job.Transitions[len(job.Transitions)-1].Reason
+}
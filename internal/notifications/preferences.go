@@ -0,0 +1,126 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/types"
+)
+
+// globalNotifierID names the email notifier of the server's own recipients
+// in logs. It is not stored, so deliveries through it are not recorded.
+const globalNotifierID = "global"
+
+// userNotifierPrefix starts the IDs of the email notifiers of users
+// following a project, which are not stored either.
+const userNotifierPrefix = "user:"
+
+// SetGlobalEmail mails events of every project to the addresses in to, on
+// top of the notifiers of the project. Nothing is mailed while to is empty.
+// It must be called before Run.
+func (s *Service) SetGlobalEmail(to []string, events []types.NotificationEvent) {
+	if len(to) == 0 || s.mailer == nil {
+		s.global = nil
+		return
+	}
+	s.global = &types.Notifier{
+		ID:      globalNotifierID,
+		Kind:    types.NotifierEmail,
+		To:      slices.Clone(to),
+		Events:  slices.Clone(events),
+		Enabled: true,
+	}
+}
+
+// Preferences returns the notification preferences of user.
+func (s *Service) Preferences(ctx context.Context, user string) (*types.NotificationPreferences, error) {
+	return s.prefs.GetNotificationPreferences(ctx, user)
+}
+
+// PutPreferences replaces the notification preferences of their user.
+func (s *Service) PutPreferences(ctx context.Context, prefs *types.NotificationPreferences) error {
+	if s.mailer == nil {
+		return ErrEmailDisabled
+	}
+	prefs.UpdatedAt = s.now()
+	return s.prefs.PutNotificationPreferences(ctx, prefs)
+}
+
+// DeletePreferences removes the notification preferences of user, who is
+// then only mailed by the notifiers naming their address.
+func (s *Service) DeletePreferences(ctx context.Context, user string) error {
+	return s.prefs.DeleteNotificationPreferences(ctx, user)
+}
+
+// subscribers returns the notifiers of project and of organization, if it
+// is not empty, the global email notifier if one is set, and an email
+// notifier for each user following project who may view it.
+func (s *Service) subscribers(ctx context.Context, project, organization string, prefs []*types.NotificationPreferences) ([]*types.Notifier, error) {
+	notifiers, err := s.store.ListNotifiers(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	if organization != "" {
+		shared, err := s.store.ListOrganizationNotifiers(ctx, organization)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, shared...)
+	}
+	if s.global != nil {
+		global := *s.global
+		global.Project = project
+		notifiers = append(notifiers, &global)
+	}
+	if s.mailer == nil {
+		return notifiers, nil
+	}
+	for _, p := range prefs {
+		if !p.Enabled || !slices.Contains(p.Projects, project) {
+			continue
+		}
+		err := s.authz.Authorize(auth.WithToken(ctx, &types.APIToken{User: p.User}), types.ActionView, project)
+		if errors.Is(err, rbac.ErrForbidden) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, &types.Notifier{
+			ID:      userNotifierPrefix + p.User,
+			Project: project,
+			Kind:    types.NotifierEmail,
+			To:      []string{p.Email},
+			Events:  p.Events,
+			Enabled: true,
+		})
+	}
+	return notifiers, nil
+}
+
+// unmuted returns notifier without the addresses of the users who muted
+// event, or nil if none is left. Notifiers other than email ones are
+// returned as they are.
+func unmuted(notifier *types.Notifier, event types.NotificationEvent, prefs []*types.NotificationPreferences) *types.Notifier {
+	if notifier.Kind != types.NotifierEmail {
+		return notifier
+	}
+	to := slices.DeleteFunc(slices.Clone(notifier.To), func(addr string) bool {
+		return slices.ContainsFunc(prefs, func(p *types.NotificationPreferences) bool {
+			return p.Mutes(event) && strings.EqualFold(p.Email, addr)
+		})
+	})
+	if len(to) == len(notifier.To) {
+		return notifier
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	n := *notifier
+	n.To = to
+	return &n
+}
@@ -0,0 +1,118 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+
+	"open-cicd/internal/types"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook notifier's body, as
+// "sha256=<hex>", when the notifier has a signing secret or key.
+const SignatureHeader = "X-Open-CICD-Signature-256"
+
+// send makes one attempt at delivering message through notifier. It returns
+// the status code the endpoint answered with, or zero if there was no
+// answer or the notifier is an email one.
+func (s *Service) send(ctx context.Context, notifier *types.Notifier, message *Message) (int, error) {
+	switch notifier.Kind {
+	case types.NotifierSlack:
+		url, _, err := s.endpoint(ctx, notifier)
+		if err != nil {
+			return 0, err
+		}
+		return s.post(ctx, url, nil, map[string]string{"text": message.Text})
+	case types.NotifierWebhook:
+		url, key, err := s.endpoint(ctx, notifier)
+		if err != nil {
+			return 0, err
+		}
+		return s.post(ctx, url, key, message)
+	case types.NotifierEmail:
+		if s.mailer == nil {
+			return 0, ErrEmailDisabled
+		}
+		return 0, s.mailer.Send(ctx, notifier.To, "[Open-CICD] "+message.Subject(), message.Text, message.HTML)
+	}
+	return 0, fmt.Errorf("unknown notifier kind %q", notifier.Kind)
+}
+
+// endpoint returns the URL notifier posts to and the key its bodies are
+// signed with, if any, resolving the project secrets it names or opening
+// the signing key sealed with it.
+func (s *Service) endpoint(ctx context.Context, notifier *types.Notifier) (string, []byte, error) {
+	if notifier.HasSigningKey {
+		key, err := s.secrets.Open(ctx, notifier.SigningKey, signingKeyData(notifier.ID))
+		if err != nil {
+			return "", nil, fmt.Errorf("decrypting signing key: %w", err)
+		}
+		return notifier.URL, key, nil
+	}
+	var names []string
+	if notifier.URLSecret != "" {
+		names = append(names, notifier.URLSecret)
+	}
+	if notifier.SigningSecret != "" {
+		names = append(names, notifier.SigningSecret)
+	}
+	if len(names) == 0 {
+		return notifier.URL, nil, nil
+	}
+	values, err := s.secrets.Resolve(ctx, notifier.Project, names)
+	if err != nil {
+		return "", nil, err
+	}
+	url := notifier.URL
+	if notifier.URLSecret != "" {
+		url = values[notifier.URLSecret]
+	}
+	var key []byte
+	if notifier.SigningSecret != "" {
+		key = []byte(values[notifier.SigningSecret])
+	}
+	return url, key, nil
+}
+
+// post sends body as JSON to url, signed with key if it is not empty, and
+// returns the status code of the answer. Responses other than 2xx count as
+// failures.
+func (s *Service) post(ctx context.Context, url string, key []byte, body any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, errors.New("invalid notifier URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		// Leave the URL out: it may have come from a secret.
+		return 0, fmt.Errorf("%s request: %w", urlErr.Op, urlErr.Err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
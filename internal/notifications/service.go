@@ -0,0 +1,589 @@
+// Package notifications tells people about a project's pipeline runs,
+// stages awaiting approval and stuck, lost and failed jobs through the
+// notifiers the project or its organization configured: Slack incoming
+// webhooks, generic HTTP webhooks and email. Organization notifiers are also
+// told about the organization's agents going offline. The server's own
+// recipients and users following the project are mailed too. Events are
+// picked up from the job manager and the agent registry without holding
+// them up, rendered with each notifier's template and delivered in the
+// background, with retries. Every delivery of a stored notifier is logged.
+package notifications
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+const (
+	// queueSize bounds the events and the deliveries waiting to be
+	// processed. Beyond it they are dropped rather than holding up state
+	// changes.
+	queueSize = 256
+	// workers is how many deliveries are attempted at once, so that a slow
+	// endpoint does not hold up every other notifier.
+	workers = 4
+	// deliveryAttempts is how many times a delivery is tried, and
+	// retryDelay how long the first retry waits; each retry waits twice as
+	// long as the one before.
+	deliveryAttempts = 5
+	retryDelay       = 2 * time.Second
+	// sendTimeout bounds a single delivery attempt.
+	sendTimeout = 15 * time.Second
+	// deliveryRetention is how long delivery logs are kept, and
+	// pruneInterval how often older ones are deleted.
+	deliveryRetention = 30 * 24 * time.Hour
+	pruneInterval     = time.Hour
+	// startedLimit bounds the runs remembered as reported started; beyond
+	// it they are forgotten, at the cost of reporting a run twice.
+	startedLimit = 4096
+)
+
+var (
+	// ErrEmailDisabled is returned when creating an email notifier on a
+	// server without an SMTP relay.
+	ErrEmailDisabled = errors.New("email notifications are not configured on this server")
+	// ErrInvalid is wrapped by the error Update returns when the change
+	// would leave the notifier invalid.
+	ErrInvalid = errors.New("invalid notifier")
+)
+
+// SecretResolver decrypts the project secrets notifiers name for their URL
+// and signing key, and seals the signing keys of organization notifiers, as
+// secrets.Service does.
+type SecretResolver interface {
+	Resolve(ctx context.Context, project string, names []string) (map[string]string, error)
+	Seal(ctx context.Context, value, additional []byte) (types.SealedValue, error)
+	Open(ctx context.Context, sealed types.SealedValue, additional []byte) ([]byte, error)
+}
+
+// event is something that happened to a project or to an agent of an
+// organization, waiting to be matched with their notifiers.
+type event struct {
+	run *types.Pipeline
+	job *types.Job
+	// agent, for agent_offline, is the agent that went offline.
+	agent *types.Agent
+	// stuck, for job_stuck, is the notifier the job is stuck for.
+	stuck *types.Notifier
+	// lost marks job_lost events and failed job_failed ones.
+	lost   bool
+	failed bool
+	// stage, for approval_needed, is the stage of run awaiting approval.
+	stage string
+}
+
+// project returns the project the event happened to, or "" for agents.
+func (e event) project() string {
+	switch {
+	case e.agent != nil:
+		return ""
+	case e.job != nil:
+		return e.job.Repository
+	}
+	return e.run.Repository
+}
+
+// organization returns the organization the event happened to, if any.
+func (e event) organization() string {
+	switch {
+	case e.agent != nil:
+		return e.agent.Organization
+	case e.job != nil:
+		return e.job.Organization
+	}
+	return e.run.Organization
+}
+
+// delivery is a message waiting to be delivered by a notifier.
+type delivery struct {
+	notifier *types.Notifier
+	message  *Message
+}
+
+// Service stores notifiers and delivers their messages.
+type Service struct {
+	store       storage.NotifierStore
+	prefs       storage.NotificationPreferenceStore
+	authz       *rbac.Authorizer
+	pipelines   storage.PipelineStore
+	jobs        storage.JobStore
+	secrets     SecretResolver
+	mailer      *Mailer
+	externalURL string
+	client      *http.Client
+	events      chan event
+	deliveries  chan delivery
+	now         func() time.Time
+	// global mails every project's events to the server's own recipients;
+	// see SetGlobalEmail.
+	global *types.Notifier
+
+	// reported holds the notifier and job pairs job_stuck was queued for,
+	// so that a job is reported once per notifier. Only WatchQueue uses it.
+	reported map[stuckKey]bool
+
+	// started holds the runs pipeline_started was queued for, as observers
+	// see a running run again whenever it changes.
+	mu      sync.Mutex
+	started map[string]bool
+}
+
+// NewService returns a service keeping notifiers in store and the
+// preferences of users in prefs, and reading runs and jobs from pipelines
+// and jobs. Users are mailed about the projects they follow while authz
+// lets them view them. Messages link to runs under externalURL, if it is
+// not empty; email notifications need mailer, which may be nil.
+func NewService(store storage.NotifierStore, prefs storage.NotificationPreferenceStore, authz *rbac.Authorizer, pipelines storage.PipelineStore, jobs storage.JobStore, secrets SecretResolver, mailer *Mailer, externalURL string) *Service {
+	return &Service{
+		store:       store,
+		prefs:       prefs,
+		authz:       authz,
+		pipelines:   pipelines,
+		jobs:        jobs,
+		secrets:     secrets,
+		mailer:      mailer,
+		externalURL: strings.TrimSuffix(externalURL, "/"),
+		client:      &http.Client{Timeout: sendTimeout},
+		events:      make(chan event, queueSize),
+		deliveries:  make(chan delivery, queueSize),
+		now:         time.Now,
+		reported:    make(map[stuckKey]bool),
+		started:     make(map[string]bool),
+	}
+}
+
+// signingKeyData binds the sealed signing key of a notifier to it.
+func signingKeyData(id string) []byte {
+	return []byte("notifier\x00" + id)
+}
+
+// Create records a new notifier on behalf of createdBy.
+func (s *Service) Create(ctx context.Context, req types.CreateNotifierRequest, createdBy string) (*types.Notifier, error) {
+	if req.Kind == types.NotifierEmail && s.mailer == nil {
+		return nil, ErrEmailDisabled
+	}
+	now := s.now()
+	notifier := req.Notifier()
+	notifier.ID = utils.NewID()
+	notifier.CreatedBy = createdBy
+	notifier.CreatedAt = now
+	notifier.UpdatedAt = now
+	if req.SigningKey != "" {
+		sealed, err := s.secrets.Seal(ctx, []byte(req.SigningKey), signingKeyData(notifier.ID))
+		if err != nil {
+			return nil, fmt.Errorf("sealing signing key: %w", err)
+		}
+		notifier.SigningKey = sealed
+	}
+	if err := s.store.CreateNotifier(ctx, notifier); err != nil {
+		return nil, err
+	}
+	return notifier, nil
+}
+
+// Get returns the notifier with the given ID.
+func (s *Service) Get(ctx context.Context, id string) (*types.Notifier, error) {
+	return s.store.GetNotifier(ctx, id)
+}
+
+// List returns the notifiers of project, oldest first.
+func (s *Service) List(ctx context.Context, project string) ([]*types.Notifier, error) {
+	return s.store.ListNotifiers(ctx, project)
+}
+
+// ListOrganization returns the notifiers of organization, oldest first.
+func (s *Service) ListOrganization(ctx context.Context, organization string) ([]*types.Notifier, error) {
+	return s.store.ListOrganizationNotifiers(ctx, organization)
+}
+
+// Deliveries returns the deliveries of the notifier with the given ID, in
+// the order and range page selects.
+func (s *Service) Deliveries(ctx context.Context, id string, page storage.Page) ([]*types.NotifierDelivery, error) {
+	return s.store.ListNotifierDeliveries(ctx, id, page)
+}
+
+// Update applies req to the notifier. The result is validated as a whole;
+// an invalid one is reported with an error wrapping ErrInvalid.
+func (s *Service) Update(ctx context.Context, id string, req types.UpdateNotifierRequest) (*types.Notifier, error) {
+	return s.store.UpdateNotifier(ctx, id, func(n *types.Notifier) error {
+		req.Apply(n)
+		if err := n.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		if n.Kind == types.NotifierEmail && s.mailer == nil {
+			return ErrEmailDisabled
+		}
+		if req.SigningKey != nil && *req.SigningKey != "" {
+			sealed, err := s.secrets.Seal(ctx, []byte(*req.SigningKey), signingKeyData(n.ID))
+			if err != nil {
+				return fmt.Errorf("sealing signing key: %w", err)
+			}
+			n.SigningKey = sealed
+		}
+		n.UpdatedAt = s.now()
+		return nil
+	})
+}
+
+// Delete removes the notifier and its deliveries.
+func (s *Service) Delete(ctx context.Context, id string) error {
+	return s.store.DeleteNotifier(ctx, id)
+}
+
+// Test delivers a sample message through the notifier right away, without
+// retrying, so that its settings can be checked.
+func (s *Service) Test(ctx context.Context, notifier *types.Notifier) error {
+	owner := notifier.Project
+	if owner == "" {
+		owner = notifier.Organization
+	}
+	message := &Message{
+		Event:        "test",
+		Project:      notifier.Project,
+		Organization: notifier.Organization,
+		Text:         "Test notification from Open-CICD for " + owner,
+	}
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	_, err := s.send(ctx, notifier, message)
+	return err
+}
+
+// ObservePipeline queues a run that started or finished, to be matched
+// with the notifiers of its project and organization by Run. It is meant to
+// be registered with jobs.Manager.ObservePipeline and never blocks.
+func (s *Service) ObservePipeline(run *types.Pipeline) {
+	s.mu.Lock()
+	switch {
+	case run.State == types.PipelineStateRunning:
+		if s.started[run.ID] {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.started) >= startedLimit {
+			clear(s.started)
+		}
+		s.started[run.ID] = true
+	case run.State.Terminal():
+		delete(s.started, run.ID)
+	default:
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.enqueue(event{run: run})
+}
+
+// ObserveJob queues a job that failed or timed out, to be matched with the
+// notifiers of its project and organization by Run. It is meant to be
+// registered with jobs.Manager.Observe and never blocks.
+func (s *Service) ObserveJob(job *types.Job) {
+	if job.State.Failure() {
+		s.enqueue(event{job: job, failed: true})
+	}
+}
+
+// ObserveAgentOffline queues an agent of an organization that went
+// offline, to be matched with the notifiers of its organization by Run.
+// Shared agents belong to no organization and are left out. It is meant to
+// be registered with scheduler.Registry.OnOffline and never blocks.
+func (s *Service) ObserveAgentOffline(agent *types.Agent) {
+	if agent.Organization != "" {
+		s.enqueue(event{agent: agent})
+	}
+}
+
+// ObserveLost queues a job that hung and was marked lost, to be matched
+// with the notifiers of its project by Run. It is meant to be registered
+// with scheduler.Reaper.OnLost and never blocks.
+func (s *Service) ObserveLost(job *types.Job) {
+	s.enqueue(event{job: job, lost: true})
+}
+
+// ObserveApproval queues a stage of a run that started awaiting approval,
+// to be matched with the notifiers of its project by Run. It is meant to be
+// registered with jobs.Manager.ObserveApproval and never blocks.
+func (s *Service) ObserveApproval(run *types.Pipeline, stage string) {
+	s.enqueue(event{run: run, stage: stage})
+}
+
+func (s *Service) enqueue(e event) {
+	select {
+	case s.events <- e:
+	default:
+		slog.Warn("Dropped notification event, too many waiting", "project", e.project(), "organization", e.organization())
+	}
+}
+
+// Run matches queued events with notifiers and delivers their messages
+// until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-s.deliveries:
+					s.deliver(ctx, d)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.events:
+			if err := s.dispatch(ctx, e); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "matching notifiers", "project", e.project(), "error", err)
+			}
+		}
+	}
+}
+
+// dispatch queues the messages of the notifiers subscribed to e. Email is
+// not sent to the users who muted the event.
+func (s *Service) dispatch(ctx context.Context, e event) error {
+	prefs, err := s.prefs.ListNotificationPreferences(ctx)
+	if err != nil {
+		return err
+	}
+	var notifiers []*types.Notifier
+	var events []types.NotificationEvent
+	switch {
+	case e.stuck != nil:
+		notifiers = []*types.Notifier{e.stuck}
+		events = []types.NotificationEvent{types.EventJobStuck}
+	case e.agent != nil:
+		notifiers, err = s.store.ListOrganizationNotifiers(ctx, e.agent.Organization)
+		if err != nil {
+			return err
+		}
+		events = []types.NotificationEvent{types.EventAgentOffline}
+	default:
+		notifiers, err = s.subscribers(ctx, e.project(), e.organization(), prefs)
+		if err != nil || len(notifiers) == 0 {
+			return err
+		}
+		switch {
+		case e.lost:
+			events = []types.NotificationEvent{types.EventJobLost}
+		case e.failed:
+			events = []types.NotificationEvent{types.EventJobFailed}
+		case e.stage != "":
+			events = []types.NotificationEvent{types.EventApprovalNeeded}
+		default:
+			events, err = s.runEvents(ctx, e.run)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, notifier := range notifiers {
+		for _, name := range events {
+			if !notifier.Subscribed(name) {
+				continue
+			}
+			// A notifier gets one message per event, the most specific
+			// one it subscribes to.
+			if notifier = unmuted(notifier, name, prefs); notifier == nil {
+				break
+			}
+			message, err := s.message(notifier, name, e)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to render notification", "notifier_id", notifier.ID, "event", name, "error", err)
+				s.record(ctx, notifier.ID, err)
+				break
+			}
+			select {
+			case s.deliveries <- delivery{notifier: notifier, message: message}:
+			default:
+				slog.WarnContext(ctx, "Dropped notification, too many waiting to be delivered", "notifier_id", notifier.ID, "event", name)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// runEvents returns the events a run that started or finished stands for,
+// the most specific first.
+func (s *Service) runEvents(ctx context.Context, run *types.Pipeline) ([]types.NotificationEvent, error) {
+	switch run.State {
+	case types.PipelineStateRunning:
+		return []types.NotificationEvent{types.EventPipelineStarted}, nil
+	case types.PipelineStateFailed:
+		return []types.NotificationEvent{types.EventPipelineFailed, types.EventPipelineFinished}, nil
+	case types.PipelineStateCancelled:
+		return []types.NotificationEvent{types.EventPipelineFinished}, nil
+	}
+	previous, err := s.previous(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.State == types.PipelineStateFailed {
+		return []types.NotificationEvent{types.EventPipelineFixed, types.EventPipelineSucceeded, types.EventPipelineFinished}, nil
+	}
+	return []types.NotificationEvent{types.EventPipelineSucceeded, types.EventPipelineFinished}, nil
+}
+
+// previousScan bounds how many earlier runs of a repository are looked at
+// for the previous run of the same pipeline.
+const previousScan = 200
+
+// previous returns the latest run of the same pipeline and ref as run that
+// failed or succeeded before it, or nil.
+func (s *Service) previous(ctx context.Context, run *types.Pipeline) (*types.Pipeline, error) {
+	page := storage.Page{Desc: true, Limit: 50}
+	for scanned := 0; scanned < previousScan; {
+		list, err := s.pipelines.ListPipelines(ctx, storage.PipelineFilter{Repository: run.Repository, Page: page})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range list {
+			if p.ID != run.ID && p.Name == run.Name && p.Ref == run.Ref && p.CreatedAt.Before(run.CreatedAt) &&
+				(p.State == types.PipelineStateFailed || p.State == types.PipelineStateSucceeded) {
+				return p, nil
+			}
+		}
+		if len(list) < page.Limit {
+			return nil, nil
+		}
+		scanned += len(list)
+		last := list[len(list)-1]
+		page.After = &storage.Cursor{Time: last.CreatedAt, ID: last.ID}
+	}
+	return nil, nil
+}
+
+// deliver sends a message, retrying with a growing delay, and records how
+// it went on the notifier and in its delivery log.
+func (s *Service) deliver(ctx context.Context, d delivery) {
+	delay := retryDelay
+	var err error
+	var attempts []types.NotifierAttempt
+	for attempt := 1; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		at := s.now()
+		var code int
+		code, err = s.send(sendCtx, d.notifier, d.message)
+		cancel()
+		a := types.NotifierAttempt{StatusCode: code, At: at}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		attempts = append(attempts, a)
+		if err == nil || attempt == deliveryAttempts || ctx.Err() != nil {
+			break
+		}
+		slog.DebugContext(ctx, "Retrying notification", "notifier_id", d.notifier.ID, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to deliver notification", "notifier_id", d.notifier.ID, "kind", d.notifier.Kind,
+			"event", d.message.Event, "project", d.notifier.Project, "organization", d.notifier.Organization, "attempts", deliveryAttempts, "error", err)
+	} else {
+		slog.InfoContext(ctx, "Delivered notification", "notifier_id", d.notifier.ID, "kind", d.notifier.Kind,
+			"event", d.message.Event, "project", d.notifier.Project, "organization", d.notifier.Organization)
+	}
+	s.record(ctx, d.notifier.ID, err)
+	if stored(d.notifier) {
+		s.log(ctx, d, attempts, err)
+	}
+}
+
+// stored reports whether notifier is one of those kept in the store, rather
+// than the global one or that of a user, which have no delivery log.
+func stored(notifier *types.Notifier) bool {
+	return notifier.ID != globalNotifierID && !strings.HasPrefix(notifier.ID, userNotifierPrefix)
+}
+
+// log adds a delivery to the delivery log of its notifier.
+func (s *Service) log(ctx context.Context, d delivery, attempts []types.NotifierAttempt, deliveryErr error) {
+	entry := &types.NotifierDelivery{
+		ID:         utils.NewID(),
+		NotifierID: d.notifier.ID,
+		Event:      d.message.Event,
+		Project:    d.message.Project,
+		Status:     types.NotifierDelivered,
+		Attempts:   attempts,
+		CreatedAt:  attempts[0].At,
+	}
+	if deliveryErr != nil {
+		entry.Status = types.NotifierFailed
+	}
+	switch {
+	case d.message.Job != nil:
+		entry.Job = d.message.Job.ID
+		entry.Pipeline = d.message.Job.PipelineID
+	case d.message.Pipeline != nil:
+		entry.Pipeline = d.message.Pipeline.ID
+	case d.message.Agent != nil:
+		entry.Agent = d.message.Agent.ID
+	}
+	err := s.store.CreateNotifierDelivery(ctx, entry)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.ErrorContext(ctx, "logging notification delivery", "notifier_id", d.notifier.ID, "error", err)
+	}
+}
+
+// PruneDeliveries deletes the delivery logs older than deliveryRetention, on
+// start and then every pruneInterval, until ctx is cancelled. It runs on the
+// leader only.
+func (s *Service) PruneDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := s.store.DeleteNotifierDeliveries(ctx, s.now().Add(-deliveryRetention))
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "deleting old notifier deliveries", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Deleted old notifier deliveries", "deliveries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record notes the outcome of a delivery on the notifier.
+func (s *Service) record(ctx context.Context, id string, deliveryErr error) {
+	now := s.now()
+	_, err := s.store.UpdateNotifier(ctx, id, func(n *types.Notifier) error {
+		n.LastDeliveryAt = &now
+		n.LastError = ""
+		if deliveryErr != nil {
+			n.LastError = deliveryErr.Error()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.ErrorContext(ctx, "recording notification delivery", "notifier_id", id, "error", err)
+	}
+}
@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// stuckInterval is how often queued jobs are checked against the stuck
+// thresholds of their notifiers.
+const stuckInterval = 30 * time.Second
+
+// stuckKey identifies a job reported as stuck to a notifier.
+type stuckKey struct{ notifier, job string }
+
+// WatchQueue reports jobs queued for longer than the thresholds of the
+// job_stuck notifiers of their projects until ctx is cancelled. Each job is
+// reported once per notifier while it stays queued. It runs on the leader
+// only, so that replicas do not report the same job.
+func (s *Service) WatchQueue(ctx context.Context) {
+	ticker := time.NewTicker(stuckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.checkQueue(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "checking for stuck jobs", "error", err)
+			}
+		}
+	}
+}
+
+// checkQueue queues a job_stuck event for every queued job that crossed the
+// threshold of a notifier of its project or organization it was not
+// reported to yet.
+func (s *Service) checkQueue(ctx context.Context) error {
+	notifiers, err := s.store.ListNotifiers(ctx, "")
+	if err != nil {
+		return err
+	}
+	shared, err := s.store.ListOrganizationNotifiers(ctx, "")
+	if err != nil {
+		return err
+	}
+	byProject := make(map[string][]*types.Notifier)
+	byOrganization := make(map[string][]*types.Notifier)
+	for _, n := range notifiers {
+		if n.Subscribed(types.EventJobStuck) {
+			byProject[n.Project] = append(byProject[n.Project], n)
+		}
+	}
+	for _, n := range shared {
+		if n.Subscribed(types.EventJobStuck) {
+			byOrganization[n.Organization] = append(byOrganization[n.Organization], n)
+		}
+	}
+
+	queued := make(map[string]bool)
+	if len(byProject) > 0 || len(byOrganization) > 0 {
+		jobs, err := s.jobs.ListJobs(ctx, storage.JobFilter{State: types.JobStateQueued})
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		for _, job := range jobs {
+			queued[job.ID] = true
+			since, ok := job.LastTransition(types.JobStateQueued)
+			if !ok {
+				continue
+			}
+			candidates := byProject[job.Repository]
+			if job.Organization != "" {
+				candidates = append(slices.Clip(candidates), byOrganization[job.Organization]...)
+			}
+			for _, n := range candidates {
+				k := stuckKey{n.ID, job.ID}
+				if s.reported[k] || now.Sub(since.At) < n.StuckThreshold() {
+					continue
+				}
+				s.reported[k] = true
+				s.enqueue(event{job: job, stuck: n})
+			}
+		}
+	}
+
+	// Forget jobs that left the queue, so that one queued again is
+	// reported again.
+	for k := range s.reported {
+		if !queued[k.job] {
+			delete(s.reported, k)
+		}
+	}
+	return nil
+}
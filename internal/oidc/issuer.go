@@ -0,0 +1,215 @@
+// Package oidc issues the OpenID Connect ID tokens jobs exchange for cloud
+// credentials, such as with AWS AssumeRoleWithWebIdentity or GCP workload
+// identity federation, instead of storing long-lived cloud keys as secrets.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// Algorithm is the JWS algorithm tokens are signed with. RS256 is the one
+// every cloud provider accepts.
+const Algorithm = "RS256"
+
+// ErrNoProject is returned for jobs without a project, which have nothing
+// to put in the subject of their tokens.
+var ErrNoProject = errors.New("jobs without a repository cannot get ID tokens")
+
+// Claims are the claims of a job's ID token. Subject is
+// project:<owner/repo>:ref:<ref> for most jobs, and
+// project:<owner/repo>:environment:<name> for deploy jobs, so that cloud
+// trust policies can tell deployments to production from other builds.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+
+	Project      string `json:"project"`
+	Organization string `json:"organization,omitempty"`
+	Ref          string `json:"ref,omitempty"`
+	// Branch is set for jobs on a branch, and empty for other refs such as
+	// tags.
+	Branch      string `json:"branch,omitempty"`
+	Commit      string `json:"commit,omitempty"`
+	PipelineID  string `json:"pipeline_id,omitempty"`
+	JobID       string `json:"job_id"`
+	JobName     string `json:"job_name"`
+	Environment string `json:"environment,omitempty"`
+}
+
+// claimNames lists the claims tokens carry, for the discovery document.
+var claimNames = []string{
+	"iss", "sub", "aud", "iat", "nbf", "exp", "jti",
+	"project", "organization", "ref", "branch", "commit", "pipeline_id", "job_id", "job_name", "environment",
+}
+
+// Issuer signs ID tokens for jobs.
+type Issuer struct {
+	url      string
+	key      *rsa.PrivateKey
+	keyID    string
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+// NewIssuer returns an Issuer identified by url, the base URL the discovery
+// documents are served under, signing with key tokens valid for lifetime.
+func NewIssuer(url string, key *rsa.PrivateKey, lifetime time.Duration) *Issuer {
+	return &Issuer{
+		url:      strings.TrimSuffix(url, "/"),
+		key:      key,
+		keyID:    thumbprint(&key.PublicKey),
+		lifetime: lifetime,
+		now:      time.Now,
+	}
+}
+
+// LoadKey reads a PEM encoded RSA private key, in PKCS #1 or PKCS #8 form.
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM block", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return checkKey(key)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s holds no RSA private key: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, not an RSA private key", path, parsed)
+	}
+	return checkKey(key)
+}
+
+// GenerateKey returns a new key, for servers without a configured one.
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func checkKey(key *rsa.PrivateKey) (*rsa.PrivateKey, error) {
+	if key.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA key is %d bits, at least 2048 are required", key.N.BitLen())
+	}
+	return key, nil
+}
+
+// Issue returns an ID token for audience describing job. Tokens are issued
+// when a job is dispatched, so its time in the queue does not count against
+// their lifetime.
+func (i *Issuer) Issue(job *types.Job, audience string) (string, error) {
+	if job.Repository == "" {
+		return "", ErrNoProject
+	}
+	now := i.now()
+	claims := Claims{
+		Issuer:       i.url,
+		Subject:      Subject(job),
+		Audience:     audience,
+		IssuedAt:     now.Unix(),
+		NotBefore:    now.Unix(),
+		ExpiresAt:    now.Add(i.lifetime).Unix(),
+		ID:           utils.NewID(),
+		Project:      job.Repository,
+		Organization: job.Organization,
+		Ref:          job.Ref,
+		Branch:       types.RefBranch(job.Ref),
+		Commit:       job.Commit,
+		PipelineID:   job.PipelineID,
+		JobID:        job.ID,
+		JobName:      job.Name,
+		Environment:  job.Environment,
+	}
+	return i.sign(claims)
+}
+
+// Subject returns the subject of the tokens of job.
+func Subject(job *types.Job) string {
+	if job.Environment != "" {
+		return "project:" + job.Repository + ":environment:" + job.Environment
+	}
+	return "project:" + job.Repository + ":ref:" + job.Ref
+}
+
+func (i *Issuer) sign(claims Claims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": Algorithm, "typ": "JWT", "kid": i.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing ID token: %w", err)
+	}
+	return signed + "." + encode(sig), nil
+}
+
+// Configuration returns the discovery document of the issuer.
+func (i *Issuer) Configuration() types.OIDCConfiguration {
+	return types.OIDCConfiguration{
+		Issuer:                           i.url,
+		JWKSURI:                          i.url + "/.well-known/jwks.json",
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{Algorithm},
+		ScopesSupported:                  []string{"openid"},
+		ClaimsSupported:                  claimNames,
+	}
+}
+
+// Keys returns the public keys that verify the issuer's tokens.
+func (i *Issuer) Keys() types.JSONWebKeySet {
+	pub := &i.key.PublicKey
+	return types.JSONWebKeySet{Keys: []types.JSONWebKey{{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: Algorithm,
+		KeyID:     i.keyID,
+		N:         encode(pub.N.Bytes()),
+		E:         encode(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+}
+
+// thumbprint returns the RFC 7638 thumbprint of key, used as its key ID so
+// that the same key gets the same ID on every replica.
+func thumbprint(key *rsa.PublicKey) string {
+	e := encode(big.NewInt(int64(key.E)).Bytes())
+	// The members are in lexicographic order, without whitespace.
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + encode(key.N.Bytes()) + `"}`))
+	return encode(sum[:])
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
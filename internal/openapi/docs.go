@@ -0,0 +1,63 @@
+package openapi
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"open-cicd/internal/utils"
+)
+
+// swaggerUIVersion pins the Swagger UI release the docs page loads.
+const swaggerUIVersion = "5.17.14"
+
+// Handler serves the document as JSON. It is rendered on the first request,
+// once every route has been added.
+func (s *Spec) Handler() http.HandlerFunc {
+	var (
+		once sync.Once
+		doc  []byte
+		err  error
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { doc, err = json.Marshal(s) })
+		if err != nil {
+			slog.ErrorContext(r.Context(), "rendering OpenAPI document", "error", err)
+			utils.WriteError(w, http.StatusInternalServerError, "failed to render OpenAPI document")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@{{.Version}}/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({url: {{.SpecURL}}, dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`))
+
+// DocsHandler serves a Swagger UI page for the document at specURL. The
+// page loads Swagger UI itself from a CDN.
+func (s *Spec) DocsHandler(specURL string) http.HandlerFunc {
+	data := struct{ Title, Version, SpecURL string }{s.title, swaggerUIVersion, specURL}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := docsPage.Execute(w, data); err != nil {
+			slog.ErrorContext(r.Context(), "rendering API docs page", "error", err)
+		}
+	}
+}
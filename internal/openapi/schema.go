@@ -0,0 +1,194 @@
+// Package openapi describes the control plane API as an OpenAPI 3 document
+// built from the Go types its handlers decode and encode, and validates
+// request bodies against it. Describing the API from the types themselves
+// keeps the document from drifting away from the code.
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of the OpenAPI schema object the generator produces.
+type Schema struct {
+	Ref         string   `json:"$ref,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Nullable    bool     `json:"nullable,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Items       *Schema  `json:"items,omitempty"`
+	// OneOf lists alternatives, of which a value must match at least one.
+	OneOf      []*Schema          `json:"oneOf,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// AdditionalProperties is the schema of the values of a map. Objects
+	// generated from structs set NoAdditional instead, as the API rejects
+	// unknown fields.
+	AdditionalProperties *Schema `json:"-"`
+	NoAdditional         bool    `json:"-"`
+}
+
+// MarshalJSON writes additionalProperties as a schema or as false.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	type plain Schema
+	out := struct {
+		*plain
+		AdditionalProperties any `json:"additionalProperties,omitempty"`
+	}{plain: (*plain)(s)}
+	switch {
+	case s.AdditionalProperties != nil:
+		out.AdditionalProperties = s.AdditionalProperties
+	case s.NoAdditional:
+		out.AdditionalProperties = false
+	}
+	return json.Marshal(out)
+}
+
+// refPrefix is where named schemas live in the document.
+const refPrefix = "#/components/schemas/"
+
+var (
+	timeType            = reflect.TypeFor[time.Time]()
+	rawMessageType      = reflect.TypeFor[json.RawMessage]()
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// generator turns Go types into schemas, collecting named struct types as
+// components so that each is described once.
+type generator struct {
+	components map[string]*Schema
+	// names maps each described struct type to its component name.
+	names map[reflect.Type]string
+	// custom holds the schemas of types with their own JSON encoding.
+	custom map[reflect.Type]*Schema
+}
+
+func newGenerator() *generator {
+	return &generator{
+		components: make(map[string]*Schema),
+		names:      make(map[reflect.Type]string),
+		custom:     make(map[reflect.Type]*Schema),
+	}
+}
+
+// schema returns the schema of values of t.
+func (g *generator) schema(t reflect.Type) *Schema {
+	if s, ok := g.custom[t]; ok {
+		return s
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		return &Schema{}
+	case t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface &&
+		(t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textUnmarshalerType)):
+		// Types with their own encoding must be registered with Define to
+		// be described; anything is accepted for them otherwise.
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := *g.schema(t.Elem())
+		if s.Ref != "" {
+			return &Schema{OneOf: []*Schema{{Ref: s.Ref}}, Nullable: true}
+		}
+		s.Nullable = true
+		return &s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		return g.object(t)
+	default:
+		return &Schema{}
+	}
+}
+
+// object returns a reference to the component describing struct type t,
+// adding the component first if needed. Anonymous structs are described
+// inline.
+func (g *generator) object(t reflect.Type) *Schema {
+	if t.Name() == "" {
+		return g.fields(t)
+	}
+	if name, ok := g.names[t]; ok {
+		return &Schema{Ref: refPrefix + name}
+	}
+	name := t.Name()
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i]
+	}
+	if _, taken := g.components[name]; taken {
+		name = pkgName(t) + "." + name
+	}
+	g.names[t] = name
+	// The placeholder lets recursive types refer to themselves.
+	g.components[name] = &Schema{}
+	*g.components[name] = *g.fields(t)
+	return &Schema{Ref: refPrefix + name}
+}
+
+// fields describes the JSON fields of struct type t. Embedded structs
+// contribute their fields, as encoding/json flattens them. Fields tagged
+// openapi:"required" must be present.
+func (g *generator) fields(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema), NoAdditional: true}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded := g.fields(ft)
+				for k, v := range embedded.Properties {
+					s.Properties[k] = v
+				}
+				s.Required = append(s.Required, embedded.Required...)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		if f.Tag.Get("openapi") == "required" {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// pkgName returns the last element of the package path of t.
+func pkgName(t reflect.Type) string {
+	path := t.PkgPath()
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
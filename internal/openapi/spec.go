@@ -0,0 +1,227 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// Operation describes one route of the API.
+type Operation struct {
+	Summary string
+	// Tag groups the operation with related ones.
+	Tag string
+	// Scope is the token scope the route requires; empty for routes that
+	// carry their own credentials or none.
+	Scope string
+	// Query lists the query parameters the route understands.
+	Query []Param
+	// Request is a value of the JSON request body type, if the route takes
+	// one. RequestOptional routes may be called without a body.
+	Request         any
+	RequestOptional bool
+	// RawRequest lists media types the route also accepts as a raw body,
+	// which are not validated.
+	RawRequest []string
+	// Status is the status of a successful response; zero means 200.
+	Status int
+	// Response is a value of the JSON response body type, or List(value)
+	// for list endpoints. RawResponse names the media type of routes that
+	// answer with something else.
+	Response    any
+	RawResponse string
+}
+
+// Param is a query parameter.
+type Param struct {
+	Name        string
+	Description string
+}
+
+// list marks a response as a page of a list; see List.
+type list struct {
+	item any
+}
+
+// List describes the paged envelope list endpoints answer with, whose
+// items are like item.
+func List(item any) any {
+	return list{item: item}
+}
+
+// pageParams are the query parameters every list endpoint understands.
+var pageParams = []Param{
+	{Name: "limit", Description: "Maximum number of items to return."},
+	{Name: "cursor", Description: "The next_cursor of the previous page."},
+	{Name: "sort", Description: "created or updated; the time items are ordered by."},
+	{Name: "order", Description: "asc or desc."},
+}
+
+// route is a registered operation.
+type route struct {
+	method string
+	path   string
+	op     Operation
+	// body and response are the schemas of the JSON request and response
+	// bodies, if any.
+	body     *Schema
+	response *Schema
+}
+
+// Spec is the OpenAPI document of the API.
+type Spec struct {
+	title   string
+	version string
+	gen     *generator
+	routes  []route
+	// index finds the route of a method and path template in routes.
+	index map[string]int
+	// failed is the schema of error responses.
+	failed *Schema
+}
+
+// NewSpec returns an empty document for the API with the given title and
+// version.
+func NewSpec(title, version string) *Spec {
+	s := &Spec{title: title, version: version, gen: newGenerator(), index: make(map[string]int)}
+	codes := make([]string, len(types.ErrorCodes))
+	for i, code := range types.ErrorCodes {
+		codes[i] = string(code)
+	}
+	s.gen.custom[reflect.TypeFor[types.ErrorCode]()] = &Schema{Type: "string", Enum: codes}
+	s.failed = s.gen.schema(reflect.TypeFor[types.ErrorResponse]())
+	return s
+}
+
+// Define sets the schema of values of the type of v, for types with their
+// own JSON encoding. It must be called before the type is used in an
+// operation.
+func (s *Spec) Define(v any, schema *Schema) {
+	s.gen.custom[reflect.TypeOf(v)] = schema
+}
+
+// Add describes the route for method at path, a gorilla/mux path template.
+func (s *Spec) Add(method, path string, op Operation) {
+	rt := route{method: method, path: path, op: op}
+	if op.Request != nil {
+		rt.body = s.gen.schema(reflect.TypeOf(op.Request))
+	}
+	switch resp := op.Response.(type) {
+	case nil:
+	case list:
+		rt.response = &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"items":       {Type: "array", Items: s.gen.schema(reflect.TypeOf(resp.item))},
+				"next_cursor": {Type: "string", Description: "Set when there may be more items."},
+			},
+			Required: []string{"items"},
+		}
+	default:
+		rt.response = s.gen.schema(reflect.TypeOf(resp))
+	}
+	s.index[method+" "+path] = len(s.routes)
+	s.routes = append(s.routes, rt)
+}
+
+// pathVar matches a variable of a mux path template, with an optional
+// pattern.
+var pathVar = regexp.MustCompile(`\{([^{}:]+)(?::[^{}]+)?\}`)
+
+// MarshalJSON renders the document.
+func (s *Spec) MarshalJSON() ([]byte, error) {
+	paths := make(map[string]map[string]any)
+	for _, rt := range s.routes {
+		path := pathVar.ReplaceAllString(rt.path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(rt.method)] = s.operation(rt)
+	}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": s.title, "version": s.version},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": s.gen.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	return json.Marshal(doc)
+}
+
+// operation renders the operation object of rt.
+func (s *Spec) operation(rt route) map[string]any {
+	op := rt.op
+	out := map[string]any{"summary": op.Summary}
+	if op.Tag != "" {
+		out["tags"] = []string{op.Tag}
+	}
+	if op.Scope != "" {
+		out["security"] = []map[string][]string{{"bearer": {}}}
+		out["description"] = "Requires a token with the " + op.Scope + " scope or above."
+	}
+
+	var params []map[string]any
+	for _, m := range pathVar.FindAllStringSubmatch(rt.path, -1) {
+		params = append(params, map[string]any{
+			"name": m[1], "in": "path", "required": true, "schema": &Schema{Type: "string"},
+		})
+	}
+	query := op.Query
+	if _, ok := op.Response.(list); ok {
+		query = slices.Concat(query, pageParams)
+	}
+	for _, p := range query {
+		params = append(params, map[string]any{
+			"name": p.Name, "in": "query", "description": p.Description, "schema": &Schema{Type: "string"},
+		})
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+
+	if rt.body != nil || len(op.RawRequest) > 0 {
+		content := make(map[string]any)
+		if rt.body != nil {
+			content["application/json"] = map[string]any{"schema": rt.body}
+		}
+		for _, media := range op.RawRequest {
+			content[media] = map[string]any{"schema": &Schema{Type: "string"}}
+		}
+		out["requestBody"] = map[string]any{"required": !op.RequestOptional, "content": content}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case rt.response != nil:
+		resp["content"] = map[string]any{"application/json": map[string]any{"schema": rt.response}}
+	case op.RawResponse != "":
+		resp["content"] = map[string]any{op.RawResponse: map[string]any{}}
+	}
+	failed := map[string]any{"application/json": map[string]any{"schema": s.failed}}
+	responses := map[string]any{
+		strconv.Itoa(status): resp,
+		"default":            map[string]any{"description": "The request failed; code tells why.", "content": failed},
+	}
+	if rt.body != nil {
+		responses["400"] = map[string]any{
+			"description": "The request body is invalid; the INVALID_REQUEST_BODY details list the problems.",
+			"content":     failed,
+		}
+	}
+	out["responses"] = responses
+	return out
+}
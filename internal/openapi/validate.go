@@ -0,0 +1,188 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// FieldError is a problem with one field of a request body, listed in the
+// details of INVALID_REQUEST_BODY errors. Path locates the field, as in
+// tasks[0].image; it is empty for the body as a whole.
+type FieldError struct {
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Validate wraps the handler of the route for method at path, checking its
+// JSON request body against the document before the handler runs. Bodies
+// that do not match are answered with a 400 INVALID_REQUEST_BODY error
+// listing every problem found.
+// Bodies of the route's raw media types are passed through, and routes
+// without a JSON request body are returned unchanged.
+func (s *Spec) Validate(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	i, ok := s.index[method+" "+path]
+	if !ok || s.routes[i].body == nil {
+		return next
+	}
+	rt := s.routes[i]
+	return func(w http.ResponseWriter, r *http.Request) {
+		if media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); slices.Contains(rt.op.RawRequest, media) {
+			// Raw bodies are left to the handler. Any other body is decoded
+			// as JSON, whatever its declared type.
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, utils.MaxBodyBytes))
+		if err != nil {
+			utils.WriteError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(bytes.TrimSpace(body)) == 0 && rt.op.RequestOptional {
+			next(w, r)
+			return
+		}
+		if errs := s.check(body, rt.body); len(errs) > 0 {
+			utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidRequestBody, "invalid request body", errs)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// check returns the problems of body against schema.
+func (s *Spec) check(body []byte, schema *Schema) []FieldError {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return []FieldError{{Message: "request body is empty"}}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return []FieldError{{Message: "request body is not valid JSON: " + err.Error()}}
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return []FieldError{{Message: "request body must contain a single JSON value"}}
+	}
+	var errs []FieldError
+	s.value(v, schema, "", &errs)
+	return errs
+}
+
+// value checks v, found at path, against schema.
+func (s *Spec) value(v any, schema *Schema, path string, errs *[]FieldError) {
+	if schema.Ref != "" {
+		schema = s.gen.components[strings.TrimPrefix(schema.Ref, refPrefix)]
+	}
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if v == nil {
+		if !schema.Nullable && (schema.Type != "" || len(schema.OneOf) > 0) {
+			fail("must not be null")
+		}
+		return
+	}
+	if len(schema.OneOf) > 0 {
+		for _, alt := range schema.OneOf {
+			var altErrs []FieldError
+			s.value(v, alt, path, &altErrs)
+			if len(altErrs) == 0 {
+				return
+			}
+			if len(schema.OneOf) == 1 {
+				*errs = append(*errs, altErrs...)
+				return
+			}
+		}
+		types := make([]string, len(schema.OneOf))
+		for i, alt := range schema.OneOf {
+			types[i] = alt.Type
+		}
+		fail("must be a %s", strings.Join(types, " or "))
+		return
+	}
+
+	switch schema.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, str) {
+			fail("must be one of %s", strings.Join(schema.Enum, ", "))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			fail("must be an integer")
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			fail("must be a number")
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		for i, item := range items {
+			s.value(item, schema.Items, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				*errs = append(*errs, FieldError{Path: join(path, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := schema.AdditionalProperties
+			if schema.Properties != nil {
+				if prop, ok := schema.Properties[name]; ok {
+					field = prop
+				}
+			}
+			switch {
+			case field != nil:
+				s.value(obj[name], field, join(path, name), errs)
+			case schema.NoAdditional:
+				*errs = append(*errs, FieldError{Path: join(path, name), Message: "is not a known field"})
+			}
+		}
+	}
+}
+
+// join appends the field name to path.
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,148 @@
+// Package orgs manages the organizations that share a server and the
+// projects they own. Which organization owns a project decides who may reach
+// its jobs, pipelines, secrets and schedules, and which agents may run them.
+package orgs
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrHasProjects is returned when deleting an organization that still owns
+// projects.
+var ErrHasProjects = errors.New("organization still owns projects")
+
+const (
+	// registrationTokenPrefix marks organization registration tokens so
+	// they are easy to recognise, for example by secret scanners.
+	registrationTokenPrefix = "ocr_"
+	registrationTokenBytes  = 32
+)
+
+// Service manages organizations and projects on top of an
+// OrganizationStore.
+type Service struct {
+	store storage.OrganizationStore
+	now   func() time.Time
+}
+
+// NewService returns a service backed by store.
+func NewService(store storage.OrganizationStore) *Service {
+	return &Service{store: store, now: time.Now}
+}
+
+// Create records a new organization and returns it with the plaintext
+// registration token of its agents, which is not retrievable afterwards.
+func (s *Service) Create(ctx context.Context, req types.CreateOrganizationRequest) (*types.Organization, string, error) {
+	token := newRegistrationToken()
+	org := &types.Organization{
+		Name:                  req.Name,
+		DisplayName:           req.DisplayName,
+		RegistrationTokenHash: utils.HashSecret(token),
+		CreatedAt:             s.now(),
+	}
+	if err := s.store.CreateOrganization(ctx, org); err != nil {
+		return nil, "", err
+	}
+	return org, token, nil
+}
+
+// Get returns the organization with the given name.
+func (s *Service) Get(ctx context.Context, name string) (*types.Organization, error) {
+	return s.store.GetOrganization(ctx, name)
+}
+
+// List returns every organization.
+func (s *Service) List(ctx context.Context) ([]*types.Organization, error) {
+	return s.store.ListOrganizations(ctx)
+}
+
+// Delete removes an organization. Projects are never deleted, so that their
+// history cannot pass to another organization, and an organization that
+// owns any fails with ErrHasProjects.
+func (s *Service) Delete(ctx context.Context, name string) error {
+	if _, err := s.store.GetOrganization(ctx, name); err != nil {
+		return err
+	}
+	projects, err := s.ListProjects(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(projects) > 0 {
+		return fmt.Errorf("%w: %s owns %d", ErrHasProjects, name, len(projects))
+	}
+	return s.store.DeleteOrganization(ctx, name)
+}
+
+// RotateRegistrationToken replaces the organization's registration token
+// and returns the new one. Agents already registered keep working.
+func (s *Service) RotateRegistrationToken(ctx context.Context, name string) (*types.Organization, string, error) {
+	token := newRegistrationToken()
+	org, err := s.store.UpdateOrganization(ctx, name, func(o *types.Organization) error {
+		o.RegistrationTokenHash = utils.HashSecret(token)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return org, token, nil
+}
+
+// OrganizationForToken returns the organization whose registration token
+// is token, or false if there is none.
+func (s *Service) OrganizationForToken(ctx context.Context, token string) (string, bool, error) {
+	orgs, err := s.store.ListOrganizations(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	hash := []byte(utils.HashSecret(token))
+	for _, org := range orgs {
+		if subtle.ConstantTimeCompare(hash, []byte(org.RegistrationTokenHash)) == 1 {
+			return org.Name, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// CreateProject records a project owned by org. It fails with
+// storage.ErrConflict if the project already exists, in this organization or
+// another, and with storage.ErrNotFound if org does not.
+func (s *Service) CreateProject(ctx context.Context, org string, req types.CreateProjectRequest) (*types.Project, error) {
+	project := &types.Project{Name: req.Name, Organization: org, CreatedAt: s.now()}
+	if err := s.store.CreateProject(ctx, project); err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+// GetProject returns the project with the given name.
+func (s *Service) GetProject(ctx context.Context, name string) (*types.Project, error) {
+	return s.store.GetProject(ctx, name)
+}
+
+// ListProjects returns the projects of org, or of every organization if org
+// is empty.
+func (s *Service) ListProjects(ctx context.Context, org string) ([]*types.Project, error) {
+	projects, err := s.store.ListProjects(ctx)
+	if err != nil || org == "" {
+		return projects, err
+	}
+	owned := projects[:0]
+	for _, p := range projects {
+		if p.Organization == org {
+			owned = append(owned, p)
+		}
+	}
+	return owned, nil
+}
+
+func newRegistrationToken() string {
+	return registrationTokenPrefix + utils.NewSecret(registrationTokenBytes)
+}
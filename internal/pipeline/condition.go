@@ -0,0 +1,546 @@
+package pipeline
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+
+	"open-cicd/internal/types"
+)
+
+// Condition is a parsed if expression of a stage or step, such as
+//
+//	branch == "main" && changed("src/**", "go.mod")
+//
+// Expressions compare the variables of ConditionContext, named event,
+// branch, tag, ref, repository, provider and actor, with == and != against
+// quoted strings or each other, and combine the results with &&, || and !
+// and parentheses. matches(value, "glob", ...) reports whether a value
+// matches one of the globs, and changed("glob", ...) whether the trigger
+// changed a file matching one of them. true and false are also accepted.
+type Condition struct {
+	root condNode
+}
+
+// ConditionContext is what the conditions of a run are evaluated against.
+type ConditionContext struct {
+	Event      string
+	Branch     string
+	Tag        string
+	Ref        string
+	Repository string
+	Provider   string
+	Actor      string
+	// ChangedFiles are the paths the triggering push changed, or nil if
+	// they are unknown, as for manual and scheduled runs, in which case
+	// changed() is always true so that no step is left out for lack of
+	// information.
+	ChangedFiles []string
+}
+
+// NewConditionContext returns the context of a run of repository at ref
+// started by t, which is nil for runs submitted through the API.
+func NewConditionContext(t *types.Trigger, repository, ref string) ConditionContext {
+	c := ConditionContext{Event: string(types.TriggerEventManual), Repository: repository, Ref: ref}
+	if t != nil {
+		c = ConditionContext{
+			Event:        string(t.Event),
+			Branch:       t.Branch,
+			Tag:          t.Tag,
+			Ref:          cmp.Or(t.Ref, ref),
+			Repository:   cmp.Or(t.Repository, repository),
+			Provider:     t.Provider,
+			Actor:        t.Actor,
+			ChangedFiles: t.ChangedFiles,
+		}
+	}
+	if c.Branch == "" && c.Tag == "" {
+		if tag, ok := strings.CutPrefix(c.Ref, "refs/tags/"); ok {
+			c.Tag = tag
+		} else {
+			c.Branch = strings.TrimPrefix(c.Ref, "refs/heads/")
+		}
+	}
+	return c
+}
+
+// variable returns the value of a context variable and whether it exists.
+func (c *ConditionContext) variable(name string) (string, bool) {
+	switch name {
+	case "event":
+		return c.Event, true
+	case "branch":
+		return c.Branch, true
+	case "tag":
+		return c.Tag, true
+	case "ref":
+		return c.Ref, true
+	case "repository":
+		return c.Repository, true
+	case "provider":
+		return c.Provider, true
+	case "actor":
+		return c.Actor, true
+	}
+	return "", false
+}
+
+// conditionVariables lists the variables conditions may use, for errors.
+const conditionVariables = "event, branch, tag, ref, repository, provider or actor"
+
+// ParseCondition parses an if expression.
+func ParseCondition(s string) (*Condition, error) {
+	tokens, err := lexCondition(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at column %d", t, t.pos)
+	}
+	return &Condition{root: root}, nil
+}
+
+// Eval reports whether the condition holds in c.
+func (cond *Condition) Eval(c *ConditionContext) bool {
+	return cond.root.eval(c)
+}
+
+// usesChanged reports whether the condition calls changed().
+func (cond *Condition) usesChanged() bool {
+	var walk func(n condNode) bool
+	walk = func(n condNode) bool {
+		switch n := n.(type) {
+		case condOr:
+			return walk(n.left) || walk(n.right)
+		case condAnd:
+			return walk(n.left) || walk(n.right)
+		case condNot:
+			return walk(n.operand)
+		case condChanged:
+			return true
+		}
+		return false
+	}
+	return walk(cond.root)
+}
+
+// Runs reports whether an if expression, which is empty or valid, holds in
+// c. Empty expressions always hold.
+func Runs(expr string, c *ConditionContext) bool {
+	if expr == "" {
+		return true
+	}
+	cond, err := ParseCondition(expr)
+	if err != nil {
+		// Definitions are validated, so this does not happen; running the
+		// step is the safer mistake.
+		return true
+	}
+	return cond.Eval(c)
+}
+
+// Plan reports which stages and steps of the definition run in c. Steps of
+// a stage that does not run do not run either.
+func (d *Definition) Plan(c *ConditionContext) *types.PipelinePlan {
+	plan := &types.PipelinePlan{
+		Name:         d.Name,
+		Paths:        d.Paths,
+		PathsIgnore:  d.PathsIgnore,
+		ChangedFiles: c.ChangedFiles,
+		Runs:         d.Runs(c),
+		Stages:       make([]types.StagePlan, 0, len(d.Stages)),
+	}
+	for i := range d.Stages {
+		stage := &d.Stages[i]
+		sp := types.StagePlan{
+			Name:        stage.Name,
+			If:          stage.If,
+			Paths:       stage.Paths,
+			PathsIgnore: stage.PathsIgnore,
+			Runs:        d.StageRuns(stage, c),
+			Steps:       make([]types.StepPlan, 0, len(stage.Steps)),
+		}
+		for j := range stage.Steps {
+			step := &stage.Steps[j]
+			stp := types.StepPlan{Name: step.Name, If: step.If, Runs: sp.Runs && Runs(step.If, c)}
+			if stp.Runs {
+				stp.Jobs = len(step.Legs())
+				plan.Jobs += stp.Jobs
+			}
+			sp.Steps = append(sp.Steps, stp)
+		}
+		plan.Stages = append(plan.Stages, sp)
+	}
+	return plan
+}
+
+// MatchGlob reports whether name matches pattern, where * and ? match
+// within a path segment as in path.Match and ** matches any number of
+// whole segments.
+func MatchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validGlob reports whether every segment of pattern is a valid path.Match
+// pattern.
+func validGlob(pattern string) bool {
+	for _, seg := range strings.Split(pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type condNode interface {
+	eval(c *ConditionContext) bool
+}
+
+type (
+	condOr      struct{ left, right condNode }
+	condAnd     struct{ left, right condNode }
+	condNot     struct{ operand condNode }
+	condLiteral bool
+	condCompare struct {
+		left, right condValue
+		equal       bool
+	}
+	condMatches struct {
+		value condValue
+		globs []string
+	}
+	condChanged struct{ globs []string }
+)
+
+func (n condOr) eval(c *ConditionContext) bool    { return n.left.eval(c) || n.right.eval(c) }
+func (n condAnd) eval(c *ConditionContext) bool   { return n.left.eval(c) && n.right.eval(c) }
+func (n condNot) eval(c *ConditionContext) bool   { return !n.operand.eval(c) }
+func (n condLiteral) eval(*ConditionContext) bool { return bool(n) }
+func (n condCompare) eval(c *ConditionContext) bool {
+	return (n.left.value(c) == n.right.value(c)) == n.equal
+}
+
+func (n condMatches) eval(c *ConditionContext) bool {
+	v := n.value.value(c)
+	return slices.ContainsFunc(n.globs, func(g string) bool { return MatchGlob(g, v) })
+}
+
+func (n condChanged) eval(c *ConditionContext) bool {
+	if c.ChangedFiles == nil {
+		return true
+	}
+	for _, f := range c.ChangedFiles {
+		if slices.ContainsFunc(n.globs, func(g string) bool { return MatchGlob(g, f) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// condValue is an operand of a comparison: a variable or a string.
+type condValue struct {
+	variable string
+	literal  string
+}
+
+func (v condValue) value(c *ConditionContext) string {
+	if v.variable == "" {
+		return v.literal
+	}
+	s, _ := c.variable(v.variable)
+	return s
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokEq
+	tokNe
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type condToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t condToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexCondition splits an expression into tokens. Positions are 1-based
+// columns.
+func lexCondition(s string) ([]condToken, error) {
+	var tokens []condToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at column %d", pos)
+			}
+			tokens = append(tokens, condToken{tokString, b.String(), pos})
+			i = j + 1
+		case strings.HasPrefix(s[i:], "=="):
+			tokens = append(tokens, condToken{tokEq, "==", pos})
+			i += 2
+		case strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, condToken{tokNe, "!=", pos})
+			i += 2
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, condToken{tokAnd, "&&", pos})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, condToken{tokOr, "||", pos})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, condToken{tokNot, "!", pos})
+			i++
+		case c == '(':
+			tokens = append(tokens, condToken{tokLParen, "(", pos})
+			i++
+		case c == ')':
+			tokens = append(tokens, condToken{tokRParen, ")", pos})
+			i++
+		case c == ',':
+			tokens = append(tokens, condToken{tokComma, ",", pos})
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, condToken{tokIdent, s[i:j], pos})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at column %d", c, pos)
+		}
+	}
+	return append(tokens, condToken{kind: tokEOF, pos: len(s) + 1}), nil
+}
+
+// condParser is a recursive descent parser of conditions: || binds looser
+// than &&, which binds looser than !.
+type condParser struct {
+	tokens []condToken
+	next   int
+}
+
+func (p *condParser) peek() condToken { return p.tokens[p.next] }
+
+func (p *condParser) take() condToken {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *condParser) expect(kind tokenKind, what string) (condToken, error) {
+	t := p.take()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at column %d, found %s", what, t.pos, t)
+	}
+	return t, nil
+}
+
+func (p *condParser) or() (condNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.take()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = condOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) and() (condNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.take()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = condAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) unary() (condNode, error) {
+	if p.peek().kind == tokNot {
+		p.take()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *condParser) primary() (condNode, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokLParen:
+		p.take()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case t.kind == tokIdent && (t.text == "true" || t.text == "false"):
+		p.take()
+		return condLiteral(t.text == "true"), nil
+	case t.kind == tokIdent && p.tokens[p.next+1].kind == tokLParen:
+		return p.call()
+	}
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	op := p.take()
+	if op.kind != tokEq && op.kind != tokNe {
+		return nil, fmt.Errorf("expected == or != at column %d, found %s", op.pos, op)
+	}
+	right, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return condCompare{left: left, right: right, equal: op.kind == tokEq}, nil
+}
+
+// call parses matches(value, glob, ...) or changed(glob, ...).
+func (p *condParser) call() (condNode, error) {
+	name := p.take()
+	p.take() // (
+	switch name.text {
+	case "matches":
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokComma, `","`); err != nil {
+			return nil, err
+		}
+		globs, err := p.globs()
+		if err != nil {
+			return nil, err
+		}
+		return condMatches{value: v, globs: globs}, nil
+	case "changed":
+		globs, err := p.globs()
+		if err != nil {
+			return nil, err
+		}
+		return condChanged{globs: globs}, nil
+	}
+	return nil, fmt.Errorf("unknown function %q at column %d, expected matches or changed", name.text, name.pos)
+}
+
+// globs parses one or more quoted globs and the closing parenthesis.
+func (p *condParser) globs() ([]string, error) {
+	var globs []string
+	for {
+		t, err := p.expect(tokString, "a quoted glob")
+		if err != nil {
+			return nil, err
+		}
+		if !validGlob(t.text) {
+			return nil, fmt.Errorf("invalid glob %q at column %d", t.text, t.pos)
+		}
+		globs = append(globs, t.text)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.take()
+	}
+	if _, err := p.expect(tokRParen, `")"`); err != nil {
+		return nil, err
+	}
+	return globs, nil
+}
+
+// value parses a variable or a quoted string.
+func (p *condParser) value() (condValue, error) {
+	t := p.take()
+	switch t.kind {
+	case tokString:
+		return condValue{literal: t.text}, nil
+	case tokIdent:
+		var c ConditionContext
+		if _, ok := c.variable(t.text); !ok {
+			return condValue{}, fmt.Errorf("unknown variable %q at column %d, expected %s", t.text, t.pos, conditionVariables)
+		}
+		return condValue{variable: t.text}, nil
+	}
+	return condValue{}, fmt.Errorf("expected a variable or a quoted string at column %d, found %s", t.pos, t)
+}
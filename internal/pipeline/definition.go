@@ -0,0 +1,448 @@
+// Package pipeline parses and validates .opencicd.yaml pipeline definitions.
+package pipeline
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// DefaultFilename is the conventional location of a pipeline definition in a
+// repository.
+const DefaultFilename = ".opencicd.yaml"
+
+// WhenManual is the when of a stage that waits for an approval once its
+// needs have succeeded.
+const WhenManual = "manual"
+
+// Definition is a parsed pipeline file.
+type Definition struct {
+	Name string `yaml:"name" json:"name"`
+	// Priority is the scheduling priority of every job in the run; it
+	// defaults to normal.
+	Priority string            `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Env      map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// Secrets names project secrets injected into every job's environment,
+	// or reads them from Vault as NAME=vault:<path>#<key>.
+	Secrets []string `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	// Labels are agent labels every job of the run requires.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Timeout bounds the running time of every job of the run, unless its
+	// stage or step sets its own.
+	Timeout types.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Workspace is where the workspace is mounted in every container; it
+	// defaults to /workspace.
+	Workspace string `yaml:"workspace,omitempty" json:"workspace,omitempty"`
+	// Concurrency lets only one run of the repository in the same group be
+	// in flight at a time.
+	Concurrency *Concurrency `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	// Cache governs how the jobs of the run use the caches they mount:
+	// which keys they fall back to and whether they may save them.
+	Cache *types.CachePolicy `yaml:"cache,omitempty" json:"cache,omitempty"`
+	// Paths and PathsIgnore are globs of the files a push must change for
+	// the run to happen at all, as told by PathsMatch, so that for example
+	// pushes touching only docs/** start nothing.
+	Paths       []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+	PathsIgnore []string `yaml:"paths_ignore,omitempty" json:"paths_ignore,omitempty"`
+	// Inputs declares the inputs runs take, which ${{ inputs.NAME }}
+	// expressions resolve to. Trigger steps of other pipelines, and
+	// submissions through the API, pass them.
+	Inputs map[string]Input `yaml:"inputs,omitempty" json:"inputs,omitempty"`
+	// Outputs are values the run publishes once it succeeds, such as
+	// ${{ results.build/image.digest }}, for the pipeline that triggered it.
+	Outputs map[string]string `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+	// Include names the templates whose steps the definition's steps may
+	// extend. Expand replaces them by what they contribute.
+	Include []Include `yaml:"include,omitempty" json:"include,omitempty"`
+	Stages  []Stage   `yaml:"stages" json:"stages"`
+
+	// lines maps a field path such as "stages[1].steps[0].commands" to the
+	// source line it was declared on, for error reporting.
+	lines map[string]int
+}
+
+// Concurrency groups the runs of a repository so that only one of them is
+// in flight. A new run waits for the runs of its group before it, or, with
+// CancelInProgress, cancels them.
+type Concurrency struct {
+	// Group is the key runs are grouped by. ${ref} and ${branch} stand for
+	// the ref of the run and its branch name, so that for example
+	// "deploy-${branch}" gives every branch a group of its own.
+	Group            string `yaml:"group" json:"group"`
+	CancelInProgress bool   `yaml:"cancel_in_progress,omitempty" json:"cancel_in_progress,omitempty"`
+}
+
+// concurrencyVariables are the placeholders a concurrency group may use.
+var concurrencyVariables = []string{"ref", "branch"}
+
+// ConcurrencyGroup returns the concurrency group of a run of ref, or "" if
+// the definition sets none.
+func (d *Definition) ConcurrencyGroup(ref string) string {
+	if d.Concurrency == nil {
+		return ""
+	}
+	branch, _ := strings.CutPrefix(ref, "refs/heads/")
+	return strings.NewReplacer("${ref}", ref, "${branch}", branch).Replace(d.Concurrency.Group)
+}
+
+// Stage is a group of steps. A stage starts only after every stage listed in
+// Needs has succeeded, and a manual one only once it is approved too.
+type Stage struct {
+	Name  string   `yaml:"name" json:"name"`
+	Needs []string `yaml:"needs,omitempty" json:"needs,omitempty"`
+	// When is WhenManual for a stage that waits for an approval, or empty.
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
+	// If is a Condition the stage only runs under; a stage whose condition
+	// does not hold has no jobs and counts as succeeded for the stages that
+	// need it.
+	If string `yaml:"if,omitempty" json:"if,omitempty"`
+	// Paths and PathsIgnore filter the stage by the files a push changed
+	// as those of the definition filter the run; a stage they leave out
+	// is treated as one whose condition does not hold.
+	Paths       []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+	PathsIgnore []string `yaml:"paths_ignore,omitempty" json:"paths_ignore,omitempty"`
+	// Approvers restricts who may approve a manual stage to these users,
+	// or teams written as "team:<name>".
+	Approvers []string `yaml:"approvers,omitempty" json:"approvers,omitempty"`
+	// Environment names the environment the stage's jobs deploy to, such
+	// as staging or production. The server records their deployments and
+	// runs one deploy job per environment at a time.
+	Environment string `yaml:"environment,omitempty" json:"environment,omitempty"`
+	Image       string `yaml:"image,omitempty" json:"image,omitempty"`
+	// OS restricts the stage's jobs to agents running that operating
+	// system: linux, darwin or windows. Shell is what their commands run
+	// with: sh, bash, pwsh, powershell or cmd; by default sh, or powershell
+	// on Windows.
+	OS    string            `yaml:"os,omitempty" json:"os,omitempty"`
+	Shell types.Shell       `yaml:"shell,omitempty" json:"shell,omitempty"`
+	Env   map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// Secrets names project secrets injected into the stage's jobs.
+	Secrets []string `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	// Labels restricts the stage's jobs to agents carrying all of them.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Services run alongside every step of the stage.
+	Services  []types.Service  `yaml:"services,omitempty" json:"services,omitempty"`
+	Resources *types.Resources `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// Requests is what the stage's jobs need of an agent to be scheduled
+	// on it.
+	Requests *types.ResourceRequests `yaml:"requests,omitempty" json:"requests,omitempty"`
+	Timeout  types.Duration          `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Steps    []Step                  `yaml:"steps" json:"steps"`
+}
+
+// Step is a single job: a list of shell commands run in one container. A
+// step with a matrix expands into one job per matrix leg.
+type Step struct {
+	Name string `yaml:"name" json:"name"`
+	// Extends names a step of an included template, as alias/step, that
+	// this one builds on; see Expand.
+	Extends string `yaml:"extends,omitempty" json:"extends,omitempty"`
+	// If is a Condition the step only runs under.
+	If         string   `yaml:"if,omitempty" json:"if,omitempty"`
+	Image      string   `yaml:"image,omitempty" json:"image,omitempty"`
+	Entrypoint []string `yaml:"entrypoint,omitempty" json:"entrypoint,omitempty"`
+	Commands   []string `yaml:"commands,omitempty" json:"commands,omitempty"`
+	// OS and Shell override the stage's.
+	OS    string      `yaml:"os,omitempty" json:"os,omitempty"`
+	Shell types.Shell `yaml:"shell,omitempty" json:"shell,omitempty"`
+	// Arch restricts the step's jobs to agents of one architecture, such
+	// as arm64. Images are variants of the step's image keyed by
+	// architecture, such as {amd64: ..., arm64: ...}, in place of Image;
+	// ResolveImage has the server look up the variants of a multi-arch
+	// Image in its registry when the run starts instead. Either way the
+	// jobs run on agents of any architecture with a variant, each in its
+	// own.
+	Arch         string            `yaml:"arch,omitempty" json:"arch,omitempty"`
+	Images       map[string]string `yaml:"images,omitempty" json:"images,omitempty"`
+	ResolveImage bool              `yaml:"resolve_image,omitempty" json:"resolve_image,omitempty"`
+	// Tasks run in place of Commands, each in its own container, sharing
+	// the workspace.
+	Tasks []types.Task `yaml:"tasks,omitempty" json:"tasks,omitempty"`
+	// BuildImage builds and pushes a container image in place of Commands
+	// and Tasks; see ImageBuild.
+	BuildImage *ImageBuild `yaml:"build_image,omitempty" json:"build_image,omitempty"`
+	// Trigger starts a run of another repository's pipeline in place of
+	// running anything itself; see types.PipelineTrigger.
+	Trigger *types.PipelineTrigger `yaml:"trigger,omitempty" json:"trigger,omitempty"`
+	Env     map[string]string      `yaml:"env,omitempty" json:"env,omitempty"`
+	Secrets []string               `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	// IDTokens maps environment variables to the audiences of the OIDC ID
+	// tokens the step's jobs get in them, such as sts.amazonaws.com.
+	IDTokens map[string]string `yaml:"id_tokens,omitempty" json:"id_tokens,omitempty"`
+	// Labels add to the agent labels the stage requires.
+	Labels   map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Matrix   *Matrix           `yaml:"matrix,omitempty" json:"matrix,omitempty"`
+	Services []types.Service   `yaml:"services,omitempty" json:"services,omitempty"`
+	// Resources override the stage's limits.
+	Resources *types.Resources `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// Requests override the stage's requests.
+	Requests *types.ResourceRequests `yaml:"requests,omitempty" json:"requests,omitempty"`
+	// Security restricts the privileges of the step's task containers: the
+	// user they run as, a read-only root filesystem, no new privileges and
+	// the capabilities they have.
+	Security *types.SecurityContext `yaml:"security,omitempty" json:"security,omitempty"`
+	// Retry re-runs the step's jobs when they fail.
+	Retry   *types.RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty"`
+	Timeout types.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// LogLimit caps the output kept in the logs of the step's jobs, such as
+	// "50Mi"; past it, the start and end of the output are kept.
+	LogLimit string `yaml:"log_limit,omitempty" json:"log_limit,omitempty"`
+	// Outputs are files and directories of the workspace, relative to it,
+	// that are snapshotted when the step's jobs succeed and restored into
+	// the workspaces of the jobs of the stages that need this one, on
+	// whichever agents they run.
+	Outputs []string `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+}
+
+// Matrix lists the values each axis takes across the legs of a step. Every
+// combination of one value per axis is a leg.
+type Matrix struct {
+	// Env axes set an environment variable in each leg.
+	Env map[string][]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// Labels axes add a required agent label to each leg.
+	Labels map[string][]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// AllowFailure lets legs fail without failing the stage.
+	AllowFailure bool `yaml:"allow_failure,omitempty" json:"allow_failure,omitempty"`
+}
+
+// Leg is one combination of matrix values.
+type Leg struct {
+	Env    map[string]string
+	Labels map[string]string
+}
+
+// Values returns the axis values of the leg keyed by axis name.
+func (l Leg) Values() map[string]string {
+	if len(l.Env)+len(l.Labels) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(l.Env)+len(l.Labels))
+	for _, level := range []map[string]string{l.Env, l.Labels} {
+		for k, v := range level {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// String formats the leg as "AXIS=value, ..." with axes sorted by name.
+func (l Leg) String() string {
+	return types.FormatLabels(l.Values())
+}
+
+// Size returns the number of legs the matrix expands into.
+func (m *Matrix) Size() int {
+	n := 1
+	for _, axes := range []map[string][]string{m.Env, m.Labels} {
+		for _, values := range axes {
+			n *= len(values)
+		}
+	}
+	return n
+}
+
+// Legs returns every combination of the matrix values. Axes vary in name
+// order, env axes before label axes, with the last axis varying fastest.
+func (m *Matrix) Legs() []Leg {
+	legs := []Leg{{}}
+	for _, axes := range []struct {
+		values map[string][]string
+		label  bool
+	}{{m.Env, false}, {m.Labels, true}} {
+		for _, name := range axisNames(axes.values) {
+			next := make([]Leg, 0, len(legs)*len(axes.values[name]))
+			for _, leg := range legs {
+				for _, value := range axes.values[name] {
+					l := Leg{Env: leg.Env, Labels: leg.Labels}
+					if axes.label {
+						l.Labels = with(leg.Labels, name, value)
+					} else {
+						l.Env = with(leg.Env, name, value)
+					}
+					next = append(next, l)
+				}
+			}
+			legs = next
+		}
+	}
+	return legs
+}
+
+// axisNames returns the names of the axes in sorted order.
+func axisNames(axes map[string][]string) []string {
+	names := make([]string, 0, len(axes))
+	for name := range axes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// with returns a copy of m with key set to value.
+func with(m map[string]string, key, value string) map[string]string {
+	c := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	c[key] = value
+	return c
+}
+
+// Legs returns the legs a step expands into: those of its matrix, or a
+// single empty leg when it has none.
+func (s *Step) Legs() []Leg {
+	if s.Matrix == nil {
+		return []Leg{{}}
+	}
+	return s.Matrix.Legs()
+}
+
+// Stage returns the stage with the given name, or nil.
+func (d *Definition) Stage(name string) *Stage {
+	for i := range d.Stages {
+		if d.Stages[i].Name == name {
+			return &d.Stages[i]
+		}
+	}
+	return nil
+}
+
+// StepImage returns the image a step runs in: its own, or its stage's.
+func (s *Stage) StepImage(step *Step) string {
+	if step.Image != "" {
+		return step.Image
+	}
+	return s.Image
+}
+
+// StepServices returns the services a step runs with: the stage's, then
+// the step's, which replace stage services of the same name.
+func (s *Stage) StepServices(step *Step) []types.Service {
+	if len(step.Services) == 0 {
+		return s.Services
+	}
+	services := make([]types.Service, 0, len(s.Services)+len(step.Services))
+	for _, svc := range s.Services {
+		if !slices.ContainsFunc(step.Services, func(o types.Service) bool { return o.Name == svc.Name }) {
+			services = append(services, svc)
+		}
+	}
+	return append(services, step.Services...)
+}
+
+// StepResources returns the resource limits of a step: its own, or its
+// stage's.
+func (s *Stage) StepResources(step *Step) *types.Resources {
+	if step.Resources != nil {
+		return step.Resources
+	}
+	return s.Resources
+}
+
+// StepOS returns the operating system a step asks for: its own, or its
+// stage's.
+func (s *Stage) StepOS(step *Step) string {
+	if step.OS != "" {
+		return step.OS
+	}
+	return s.OS
+}
+
+// StepShell returns the shell of a step: its own, or its stage's.
+func (s *Stage) StepShell(step *Step) types.Shell {
+	if step.Shell != "" {
+		return step.Shell
+	}
+	return s.Shell
+}
+
+// StepRequests returns the resource requests of a step: its own, or its
+// stage's.
+func (s *Stage) StepRequests(step *Step) *types.ResourceRequests {
+	if step.Requests != nil {
+		return step.Requests
+	}
+	return s.Requests
+}
+
+// StepTimeout returns the timeout of a step: its own, its stage's or the
+// pipeline's, whichever is set first.
+func (d *Definition) StepTimeout(stage *Stage, step *Step) types.Duration {
+	for _, t := range []types.Duration{step.Timeout, stage.Timeout} {
+		if t > 0 {
+			return t
+		}
+	}
+	return d.Timeout
+}
+
+// StepEnv returns the environment for a leg of a step, merging pipeline,
+// stage, step and matrix variables with later levels taking precedence.
+func (d *Definition) StepEnv(stage *Stage, step *Step, leg Leg) map[string]string {
+	env := make(map[string]string, len(d.Env)+len(stage.Env)+len(step.Env)+len(leg.Env))
+	for _, level := range []map[string]string{d.Env, stage.Env, step.Env, leg.Env} {
+		for k, v := range level {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// StepLabels returns the agent labels required by a leg of a step, merging
+// pipeline, stage, step and matrix labels with later levels taking
+// precedence.
+func (d *Definition) StepLabels(stage *Stage, step *Step, leg Leg) map[string]string {
+	if len(d.Labels)+len(stage.Labels)+len(step.Labels)+len(leg.Labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(d.Labels)+len(stage.Labels)+len(step.Labels)+len(leg.Labels))
+	for _, level := range []map[string]string{d.Labels, stage.Labels, step.Labels, leg.Labels} {
+		for k, v := range level {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// StepSecrets returns the secrets a step declares at the pipeline, stage or
+// step level, one per name: an entry of a stage or step replaces one of the
+// same name at an outer level.
+func (d *Definition) StepSecrets(stage *Stage, step *Step) []string {
+	var entries []string
+	index := make(map[string]int)
+	for _, level := range [][]string{d.Secrets, stage.Secrets, step.Secrets} {
+		for _, entry := range level {
+			name, _, _ := strings.Cut(entry, "=")
+			if i, ok := index[name]; ok {
+				entries[i] = entry
+				continue
+			}
+			index[name] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// vaultSecrets returns the Vault references declared anywhere in the
+// definition, by the name of the secret.
+func (d *Definition) vaultSecrets() map[string]string {
+	refs := make(map[string]string)
+	add := func(level []string) {
+		for _, entry := range level {
+			if name, ref, ok := strings.Cut(entry, "="); ok && ref != "" {
+				refs[name] = entry
+			}
+		}
+	}
+	add(d.Secrets)
+	for _, s := range d.Stages {
+		add(s.Secrets)
+		for _, step := range s.Steps {
+			add(step.Secrets)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,271 @@
+package pipeline
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+var (
+	// imageNamePattern matches image repositories such as
+	// ghcr.io/acme/web or acme/web, without a tag or digest.
+	imageNamePattern = regexp.MustCompile(`^(?:[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*(?::[0-9]+)?/)?[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	imageTagPattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	platformPattern  = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(?:/[a-z0-9]+)?$`)
+)
+
+// ImageBuild builds a container image from a Dockerfile in the workspace
+// with BuildKit and pushes it, as a step of its own:
+//
+//   - name: image
+//     build_image:
+//     image: ghcr.io/acme/web
+//     tags: [latest, "${{ trigger.commit }}"]
+//     credentials: {username: GHCR_USER, password: GHCR_TOKEN}
+//
+// The step's job reports the digest it pushed as its result digest, and the
+// pushed reference as image. Unless NoCache is set, BuildKit's layer cache
+// is kept between the project's builds of the image in the cache store.
+type ImageBuild struct {
+	// Context is the directory of the workspace the image is built from;
+	// it defaults to the workspace itself.
+	Context string `yaml:"context,omitempty" json:"context,omitempty"`
+	// Dockerfile is the path of the Dockerfile relative to Context; it
+	// defaults to Dockerfile.
+	Dockerfile string `yaml:"dockerfile,omitempty" json:"dockerfile,omitempty"`
+	// Image is the repository the image is pushed to. A name without a
+	// registry host goes to the registry the server is configured with.
+	Image string `yaml:"image" json:"image"`
+	// Tags are the tags pushed; they default to latest.
+	Tags      []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Args      map[string]string `yaml:"args,omitempty" json:"args,omitempty"`
+	Target    string            `yaml:"target,omitempty" json:"target,omitempty"`
+	Platforms []string          `yaml:"platforms,omitempty" json:"platforms,omitempty"`
+	NoCache   bool              `yaml:"no_cache,omitempty" json:"no_cache,omitempty"`
+	// Credentials name the project secrets the registry is logged in to
+	// with. Without them the image is pushed without logging in.
+	Credentials *RegistryCredentials `yaml:"credentials,omitempty" json:"credentials,omitempty"`
+}
+
+// RegistryCredentials name the project secrets holding a registry username
+// and password or token.
+type RegistryCredentials struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// imageBuild checks the image build of a step. Values holding expressions
+// are checked once Interpolate has resolved them.
+func (v *validator) imageBuild(sp string, step *Step) {
+	b := step.BuildImage
+	if b == nil {
+		return
+	}
+	switch {
+	case len(step.Commands) > 0 || len(step.Tasks) > 0:
+		v.addf(sp, "step %q cannot have build_image along with commands or tasks", step.Name)
+	case step.Image != "" || len(step.Images) > 0 || step.ResolveImage || step.Entrypoint != nil:
+		v.addf(sp, "step %q runs in the image builder and cannot set image, images, resolve_image or entrypoint", step.Name)
+	case len(step.Services) > 0:
+		v.addf(sp, "step %q cannot run services with build_image", step.Name)
+	}
+	for _, p := range []struct{ field, value string }{{"context", b.Context}, {"dockerfile", path.Join(b.Context, b.Dockerfile)}} {
+		if p.value == "" || p.value == "." || strings.Contains(p.value, exprOpen) {
+			continue
+		}
+		if err := types.ValidateOutputPath(p.value); err != nil {
+			v.addf(sp+"."+p.field, "%s", strings.Replace(err.Error(), "output path", p.field, 1))
+		}
+	}
+	for _, e := range b.check() {
+		v.addf(sp+"."+e.Path, "%s", e.Message)
+	}
+	if c := b.Credentials; c != nil {
+		v.secrets(sp+".credentials", []string{c.Username, c.Password})
+	}
+	for _, k := range slices.Sorted(maps.Keys(b.Args)) {
+		if !envKeyPattern.MatchString(k) {
+			v.addf(sp+".args."+k, "invalid build argument name %q", k)
+		}
+	}
+	for i, p := range b.Platforms {
+		if !platformPattern.MatchString(p) {
+			v.addf(fmt.Sprintf("%s.platforms[%d]", sp, i), "invalid platform %q, expected os/arch such as linux/amd64", p)
+		}
+	}
+}
+
+// check returns the problems of the image name and tags of the build,
+// leaving out values that hold expressions, with paths relative to it.
+func (b *ImageBuild) check() ErrorList {
+	var errs ErrorList
+	switch {
+	case b.Image == "":
+		errs = append(errs, &Error{Path: "image", Message: "build_image needs the image to push"})
+	case !strings.Contains(b.Image, exprOpen) && !imageNamePattern.MatchString(b.Image):
+		errs = append(errs, &Error{Path: "image", Message: fmt.Sprintf("invalid image name %q, expected a repository such as ghcr.io/acme/web without a tag", b.Image)})
+	}
+	for i, tag := range b.Tags {
+		if !strings.Contains(tag, exprOpen) && !imageTagPattern.MatchString(tag) {
+			errs = append(errs, &Error{Path: fmt.Sprintf("tags[%d]", i), Message: fmt.Sprintf("invalid image tag %q", tag)})
+		}
+	}
+	return errs
+}
+
+// checkImageBuilds reports the invalid image names and tags the expressions
+// of the definition resolved to.
+func (d *Definition) checkImageBuilds() ErrorList {
+	var errs ErrorList
+	for i := range d.Stages {
+		for j := range d.Stages[i].Steps {
+			b := d.Stages[i].Steps[j].BuildImage
+			if b == nil {
+				continue
+			}
+			bp := fmt.Sprintf("stages[%d].steps[%d].build_image", i, j)
+			for _, e := range b.check() {
+				e.Path = bp + "." + e.Path
+				e.Line = d.line(e.Path)
+				errs = append(errs, e)
+			}
+		}
+	}
+	return errs
+}
+
+// ImageBuilder is how the server runs the image builds of steps.
+type ImageBuilder struct {
+	// Image is the BuildKit image the builds run in, which must provide
+	// buildctl-daemonless.sh.
+	Image string
+	// Registry is the registry host images named without one are pushed
+	// to; without one they go to Docker Hub.
+	Registry string
+}
+
+// buildDir holds the files the job of an image build keeps in the
+// workspace: the layer cache, registry login and build metadata.
+const buildDir = ".opencicd/build"
+
+// BuildJob is what the job of an image build runs.
+type BuildJob struct {
+	Image    string
+	Commands []string
+	// Secrets are the registry credentials the commands read from the
+	// environment.
+	Secrets []string
+	Caches  []types.CacheMount
+}
+
+// Job returns the BuildKit job that runs the image build b, whose
+// expressions have been resolved.
+func (ib *ImageBuilder) Job(b *ImageBuild) BuildJob {
+	image := ib.qualify(b.Image)
+	tags := b.Tags
+	if len(tags) == 0 {
+		tags = []string{"latest"}
+	}
+	refs := make([]string, len(tags))
+	for i, tag := range tags {
+		refs[i] = image + ":" + tag
+	}
+	dir := cmp.Or(b.Context, ".")
+	dockerfile := path.Join(dir, cmp.Or(b.Dockerfile, "Dockerfile"))
+
+	job := BuildJob{Image: ib.Image}
+	cmds := []string{"mkdir -p " + buildDir}
+	if c := b.Credentials; c != nil {
+		job.Secrets = []string{c.Username, c.Password}
+		cmds = append(cmds,
+			`export DOCKER_CONFIG="$PWD/`+buildDir+`/docker"`,
+			`mkdir -p "$DOCKER_CONFIG"`,
+			fmt.Sprintf(`auth=$(printf '%%s:%%s' "$%s" "$%s" | base64 | tr -d '\n')`, c.Username, c.Password),
+			fmt.Sprintf(`printf '{"auths":{"%%s":{"auth":"%%s"}}}\n' %s "$auth" > "$DOCKER_CONFIG/config.json"`, shellQuote(registryAuthKey(image))),
+		)
+	}
+	build := []string{
+		"buildctl-daemonless.sh build",
+		"--frontend dockerfile.v0",
+		"--local context=" + shellQuote(dir),
+		"--local dockerfile=" + shellQuote(path.Dir(dockerfile)),
+		"--opt filename=" + shellQuote(path.Base(dockerfile)),
+	}
+	if b.Target != "" {
+		build = append(build, "--opt target="+shellQuote(b.Target))
+	}
+	for _, k := range slices.Sorted(maps.Keys(b.Args)) {
+		build = append(build, "--opt "+shellQuote("build-arg:"+k+"="+b.Args[k]))
+	}
+	if len(b.Platforms) > 0 {
+		build = append(build, "--opt platform="+shellQuote(strings.Join(b.Platforms, ",")))
+	}
+	cache := buildDir + "/cache"
+	if !b.NoCache {
+		job.Caches = []types.CacheMount{{Key: cacheKey(image), Path: cache}}
+		// BuildKit refuses to import a cache that does not exist yet.
+		cmds = append(cmds, "set --", "if [ -f "+cache+"/index.json ]; then set -- --import-cache type=local,src="+cache+"; fi")
+		build = append(build, `"$@"`, "--export-cache type=local,dest="+cache+".next,mode=max")
+	}
+	build = append(build,
+		"--output "+shellQuote(`type=image,"name=`+strings.Join(refs, ",")+`",push=true`),
+		"--metadata-file "+buildDir+"/metadata.json",
+	)
+	cmds = append(cmds, strings.Join(build, " "))
+	if !b.NoCache {
+		// The export starts afresh so that layers no longer used do not
+		// pile up in the cache.
+		cmds = append(cmds, "rm -rf "+cache+" && mv "+cache+".next "+cache)
+	}
+	cmds = append(cmds,
+		`digest=$(sed -n 's/.*"containerimage.digest": *"\([^"]*\)".*/\1/p' `+buildDir+`/metadata.json)`,
+		fmt.Sprintf(`echo "Pushed %s@$digest"`, image),
+		fmt.Sprintf(`printf 'digest=%%s\nimage=%%s@%%s\n' "$digest" %s "$digest" >> "${OPENCICD_OUTPUT:-/dev/null}"`, shellQuote(image)),
+	)
+	job.Commands = cmds
+	return job
+}
+
+// qualify prefixes the configured registry to an image named without a
+// registry host. As with Docker, a first component with a dot or a port, or
+// localhost, is a host.
+func (ib *ImageBuilder) qualify(image string) string {
+	first, _, ok := strings.Cut(image, "/")
+	if ib.Registry == "" || (ok && (strings.ContainsAny(first, ".:") || first == "localhost")) {
+		return image
+	}
+	return strings.TrimSuffix(ib.Registry, "/") + "/" + image
+}
+
+// registryAuthKey returns the key of the Docker config auths entry of the
+// registry image is pushed to.
+func registryAuthKey(image string) string {
+	first, _, ok := strings.Cut(image, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return "https://index.docker.io/v1/"
+}
+
+// cacheKey returns the key the layer cache of builds of image is kept
+// under.
+func cacheKey(image string) string {
+	key := []byte("buildkit-" + image)
+	for i, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			key[i] = '_'
+		}
+	}
+	return string(key)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
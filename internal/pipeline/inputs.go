@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InputType is the type of the values an input takes.
+type InputType string
+
+const (
+	InputString  InputType = "string"
+	InputChoice  InputType = "choice"
+	InputBoolean InputType = "boolean"
+)
+
+// Input is an input a pipeline declares, such as the version a deploy
+// pipeline deploys. An input may be declared by its default alone, as a
+// string input:
+//
+//	inputs:
+//	  IMAGE: app:latest
+//	  ENVIRONMENT:
+//	    type: choice
+//	    options: [staging, production]
+//	    required: true
+type Input struct {
+	// Type is string, the default, choice or boolean.
+	Type        InputType `yaml:"type,omitempty" json:"type,omitempty"`
+	Description string    `yaml:"description,omitempty" json:"description,omitempty"`
+	// Default is the value of the input in runs that pass none. Choice
+	// inputs default to their first option and boolean inputs to false.
+	Default string `yaml:"default,omitempty" json:"default,omitempty"`
+	// Required inputs have no default; every run must pass them a value.
+	Required bool `yaml:"required,omitempty" json:"required,omitempty"`
+	// Options are the values a choice input takes.
+	Options []string `yaml:"options,omitempty" json:"options,omitempty"`
+}
+
+// UnmarshalYAML reads an input declared in full, or by its default alone.
+func (in *Input) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*in = Input{}
+		return node.Decode(&in.Default)
+	}
+	type plain Input
+	return node.Decode((*plain)(in))
+}
+
+// kind returns the type of the input, string if it declares none.
+func (in *Input) kind() InputType {
+	if in.Type == "" {
+		return InputString
+	}
+	return in.Type
+}
+
+// defaultValue returns the value of the input in runs that pass none.
+func (in *Input) defaultValue() string {
+	switch {
+	case in.Default != "":
+		return in.Default
+	case in.kind() == InputChoice && len(in.Options) > 0:
+		return in.Options[0]
+	case in.kind() == InputBoolean:
+		return "false"
+	}
+	return ""
+}
+
+// check returns value as the input takes it, booleans spelled true or
+// false, or an error if the input does not take it.
+func (in *Input) check(value string) (string, error) {
+	switch in.kind() {
+	case InputBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not true or false", value)
+		}
+		return strconv.FormatBool(b), nil
+	case InputChoice:
+		if !slices.Contains(in.Options, value) {
+			return "", fmt.Errorf("%q is not one of %s", value, quoteList(in.Options))
+		}
+	}
+	return value, nil
+}
+
+// inputs checks the inputs the definition declares.
+func (v *validator) inputs() {
+	d := v.def
+	for _, name := range slices.Sorted(maps.Keys(d.Inputs)) {
+		in, path := d.Inputs[name], "inputs."+name
+		if !envKeyPattern.MatchString(name) {
+			v.addf(path, "invalid input name %q", name)
+		}
+		switch in.kind() {
+		case InputString, InputBoolean:
+			if len(in.Options) > 0 {
+				v.addf(path+".options", "input %s is not a choice and takes no options", name)
+			}
+		case InputChoice:
+			if len(in.Options) == 0 {
+				v.addf(path+".options", "choice input %s needs options", name)
+			}
+			seen := make(map[string]bool, len(in.Options))
+			for i, option := range in.Options {
+				if seen[option] {
+					v.addf(fmt.Sprintf("%s.options[%d]", path, i), "input %s has option %q more than once", name, option)
+				}
+				seen[option] = true
+			}
+		default:
+			v.addf(path+".type", "unknown input type %q, expected string, choice or boolean", in.Type)
+			continue
+		}
+		if in.Default == "" {
+			continue
+		}
+		if in.Required {
+			v.addf(path+".default", "required input %s cannot have a default", name)
+		} else if _, err := in.check(in.Default); err != nil {
+			v.addf(path+".default", "default of input %s: %v", name, err)
+		}
+	}
+}
+
+// quoteList formats values as a comma-separated list of quoted strings.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
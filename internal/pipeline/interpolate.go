@@ -0,0 +1,620 @@
+package pipeline
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// Expressions are written ${{ namespace.name }} in the images, entrypoints,
+// commands, environments, tasks, services, image builds and matrix env
+// values of a definition, and in its outputs and the inputs of its trigger
+// steps:
+//
+//	${{ vars.REGISTRY }}          a global or project variable
+//	${{ secrets.NPM_TOKEN }}      a project secret, or one read from Vault
+//	${{ inputs.IMAGE }}           an input the definition declares
+//	${{ trigger.branch }}         the trigger, as the variables of
+//	                              conditions name it, or trigger.commit
+//	${{ results.build/image.digest }}
+//	                              a result a job reported, only in outputs
+//	                              and trigger inputs
+//	${{ steps.image.outputs.digest }}
+//	                              an output a step of a stage the stage
+//	                              needs wrote to OPENCICD_OUTPUT, or of
+//	                              stage/step if several such stages have
+//	                              the step
+//
+// Validate checks their syntax and Interpolate resolves them for a run.
+const (
+	exprOpen  = "${{"
+	exprClose = "}}"
+)
+
+// Namespaces of expressions.
+const (
+	namespaceVars    = "vars"
+	namespaceSecrets = "secrets"
+	namespaceTrigger = "trigger"
+	namespaceInputs  = "inputs"
+	namespaceResults = "results"
+	namespaceSteps   = "steps"
+)
+
+// triggerCommit is the trigger variable conditions lack.
+const triggerCommit = "commit"
+
+// expression is a parsed ${{ namespace.name }}.
+type expression struct {
+	namespace string
+	name      string
+}
+
+func (e expression) String() string {
+	return exprOpen + " " + e.namespace + "." + e.name + " " + exprClose
+}
+
+// parseExpression parses what is between the braces of an expression.
+func parseExpression(s string) (expression, error) {
+	inner := strings.TrimSpace(s)
+	namespace, name, ok := strings.Cut(inner, ".")
+	if !ok {
+		return expression{}, fmt.Errorf("expression %s %s %s must be namespace.name, such as vars.NAME", exprOpen, inner, exprClose)
+	}
+	e := expression{namespace: namespace, name: name}
+	switch namespace {
+	case namespaceVars:
+		if !envKeyPattern.MatchString(name) {
+			return e, fmt.Errorf("expression %s names invalid variable name %q", e, name)
+		}
+	case namespaceSecrets:
+		if !envKeyPattern.MatchString(name) {
+			return e, fmt.Errorf("expression %s names invalid secret name %q", e, name)
+		}
+	case namespaceTrigger:
+		var c ConditionContext
+		if _, known := c.variable(name); !known && name != triggerCommit {
+			return e, fmt.Errorf("expression %s names unknown trigger variable %q, expected %s", e, name, triggerVariables)
+		}
+	case namespaceInputs:
+		if !envKeyPattern.MatchString(name) {
+			return e, fmt.Errorf("expression %s names invalid input name %q", e, name)
+		}
+	case namespaceResults:
+		if _, _, _, ok := splitResult(name); !ok {
+			return e, fmt.Errorf("expression %s must name a result as stage/step.key", e)
+		}
+	case namespaceSteps:
+		if _, _, _, ok := splitStepOutput(name); !ok {
+			return e, fmt.Errorf("expression %s must name an output as step.outputs.key or stage/step.outputs.key", e)
+		}
+	default:
+		return e, fmt.Errorf("expression %s has unknown namespace %q, expected vars, secrets, inputs, trigger, results or steps", e, namespace)
+	}
+	return e, nil
+}
+
+// splitResult splits the name of a results expression into the stage and
+// step of the job that reports the result and its key. Keys have no dots,
+// so the key is what follows the last one.
+func splitResult(name string) (stage, step, key string, ok bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", "", "", false
+	}
+	key = name[i+1:]
+	stage, step, ok = strings.Cut(name[:i], "/")
+	ok = ok && namePattern.MatchString(stage) && namePattern.MatchString(step) && types.ValidateResultKey(key) == nil
+	return stage, step, key, ok
+}
+
+// splitStepOutput splits the name of a steps expression into the stage, if
+// it names one, and step of the job that writes the output and its key.
+func splitStepOutput(name string) (stage, step, key string, ok bool) {
+	i := strings.LastIndex(name, ".outputs.")
+	if i < 0 {
+		return "", "", "", false
+	}
+	key = name[i+len(".outputs."):]
+	stage, step, qualified := strings.Cut(name[:i], "/")
+	if !qualified {
+		stage, step = "", name[:i]
+	}
+	ok = (!qualified || namePattern.MatchString(stage)) && namePattern.MatchString(step) && types.ValidateResultKey(key) == nil
+	return stage, step, key, ok
+}
+
+// triggerVariables lists the trigger variables expressions may use, for
+// errors.
+const triggerVariables = "event, branch, tag, ref, repository, provider, actor or commit"
+
+// replaceExpressions returns s with every expression replaced by what fn
+// returns for it. It fails on the first expression that does not parse.
+func replaceExpressions(s string, fn func(expression) string) (string, error) {
+	if !strings.Contains(s, exprOpen) {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, exprOpen)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		rest := s[i+len(exprOpen):]
+		j := strings.Index(rest, exprClose)
+		if j < 0 {
+			return "", fmt.Errorf("expression %q is not closed with %s", s[i:], exprClose)
+		}
+		e, err := parseExpression(rest[:j])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(fn(e))
+		s = rest[j+len(exprClose):]
+	}
+}
+
+// Scope is what the expressions of a definition resolve against for a run.
+type Scope struct {
+	// Trigger gives the trigger variables but commit.
+	Trigger ConditionContext
+	// Commit is the commit the run builds, if known.
+	Commit string
+	// Vars are the variables that apply to the run, by name.
+	Vars map[string]string
+	// Secrets names the secrets of the project. Their values are not part
+	// of the scope: secret expressions are left for ReplaceSecrets to
+	// resolve when a job is dispatched, so that they are never stored.
+	Secrets []string
+	// Inputs are the inputs of the run, as ResolveInputs returns them.
+	Inputs map[string]string
+}
+
+// Interpolate replaces the variable, input and trigger expressions of the
+// definition with their values in scope. A secret expression is kept and
+// its secret, or the Vault reference the definition declares for it, added
+// to the secrets of the definition, stage or step it is written in, so that
+// the job gets the value and its logs mask it. Results
+// expressions are kept for ResolveResults, once the jobs they name have
+// reported. Steps expressions are kept, naming the stage of their step,
+// for ResolveStepOutputs to resolve once the stages a job needs succeeded;
+// in outputs and trigger inputs they become the results expressions of
+// their step. It returns an ErrorList naming every expression that refers
+// to a variable, secret, input, result or step output scope or the
+// definition does not define, or that is used where it cannot be.
+func (d *Definition) Interpolate(scope *Scope) error {
+	var errs ErrorList
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, &Error{Line: d.line(path), Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	// resolve returns what e is replaced by in the field at path. Fields
+	// passed on to other runs have no secrets to add to. Fields take
+	// results and step outputs from the stages from needs, or from any
+	// stage if from is nil.
+	vault := d.vaultSecrets()
+	resolve := func(path string, e expression, secrets *[]string, passedOn bool, from *Stage) string {
+		switch e.namespace {
+		case namespaceVars:
+			v, ok := scope.Vars[e.name]
+			if !ok {
+				fail(path, "expression %s refers to undefined variable %s", e, e.name)
+			}
+			return v
+		case namespaceSecrets:
+			switch {
+			case passedOn:
+				fail(path, "expression %s cannot pass a secret on to another run", e)
+			case vault[e.name] != "":
+				// The secret is read from Vault where it is used too.
+				if !slices.Contains(*secrets, vault[e.name]) {
+					*secrets = append(*secrets, vault[e.name])
+				}
+			case !slices.Contains(scope.Secrets, e.name):
+				fail(path, "expression %s refers to undefined secret %s", e, e.name)
+			case !slices.Contains(*secrets, e.name):
+				*secrets = append(*secrets, e.name)
+			}
+			return e.String()
+		case namespaceInputs:
+			v, ok := scope.Inputs[e.name]
+			if !ok {
+				fail(path, "expression %s refers to undeclared input %s", e, e.name)
+			}
+			return v
+		case namespaceResults:
+			if !passedOn {
+				fail(path, "expression %s can only be used in outputs and trigger inputs", e)
+			} else if msg := d.checkResult(e.name, from); msg != "" {
+				fail(path, "expression %s %s", e, msg)
+			}
+			return e.String()
+		case namespaceSteps:
+			_, _, key, _ := splitStepOutput(e.name)
+			step, msg := d.outputStep(e.name, from)
+			switch {
+			case msg != "":
+				fail(path, "expression %s %s", e, msg)
+				return e.String()
+			case passedOn:
+				return expression{namespace: namespaceResults, name: step + "." + key}.String()
+			}
+			return expression{namespace: namespaceSteps, name: step + ".outputs." + key}.String()
+		}
+		if e.name == triggerCommit {
+			return scope.Commit
+		}
+		v, _ := scope.Trigger.variable(e.name)
+		return v
+	}
+	replace := func(path string, s *string, fn func(expression) string) {
+		out, err := replaceExpressions(*s, fn)
+		if err != nil {
+			fail(path, "%v", err)
+			return
+		}
+		*s = out
+	}
+	d.expressions(func(path string, s *string, secrets *[]string, from *Stage) {
+		replace(path, s, func(e expression) string {
+			if e.namespace == namespaceSteps && from == nil {
+				// The field applies to every stage, some of which need none.
+				fail(path, "expression %s can only be used in stages and steps", e)
+				return e.String()
+			}
+			return resolve(path, e, secrets, false, from)
+		})
+	})
+	d.passedOn(func(path string, s *string, from *Stage) {
+		replace(path, s, func(e expression) string { return resolve(path, e, nil, true, from) })
+	})
+	if len(errs) == 0 {
+		errs = d.checkImageBuilds()
+	}
+	return errs.err()
+}
+
+// checkResult returns why the result name of a results expression cannot
+// be resolved for the stage from, or for the whole run if from is nil, or
+// the empty string if it can.
+func (d *Definition) checkResult(name string, from *Stage) string {
+	stageName, stepName, _, _ := splitResult(name)
+	stage := d.Stage(stageName)
+	if stage == nil {
+		return fmt.Sprintf("refers to unknown stage %q", stageName)
+	}
+	i := slices.IndexFunc(stage.Steps, func(s Step) bool { return s.Name == stepName })
+	switch {
+	case i < 0:
+		return fmt.Sprintf("refers to unknown step %q of stage %q", stepName, stageName)
+	case stage.Steps[i].Matrix != nil:
+		return fmt.Sprintf("refers to matrix step %q, whose jobs report their results apart", stepName)
+	case from != nil && !d.needs(from, stageName):
+		return fmt.Sprintf("refers to stage %q, which stage %q does not need", stageName, from.Name)
+	}
+	return ""
+}
+
+// outputStep returns the step whose output the steps expression name
+// refers to, as stage/step, or why it cannot be resolved for the stage
+// from, or for the whole run if from is nil. A step named without its stage
+// must be a step of just one of the stages from needs.
+func (d *Definition) outputStep(name string, from *Stage) (string, string) {
+	stage, step, key, _ := splitStepOutput(name)
+	if stage == "" {
+		var found, elsewhere []string
+		for i := range d.Stages {
+			s := &d.Stages[i]
+			if !slices.ContainsFunc(s.Steps, func(st Step) bool { return st.Name == step }) {
+				continue
+			}
+			if from == nil || d.needs(from, s.Name) {
+				found = append(found, s.Name)
+			} else {
+				elsewhere = append(elsewhere, s.Name)
+			}
+		}
+		switch {
+		case len(found) > 1:
+			return "", fmt.Sprintf("refers to step %q of several stages (%s); name it as stage/step", step, strings.Join(found, ", "))
+		case len(found) == 1:
+			stage = found[0]
+		case len(elsewhere) > 0:
+			stage = elsewhere[0]
+		default:
+			return "", fmt.Sprintf("refers to unknown step %q", step)
+		}
+	}
+	if msg := d.checkResult(stage+"/"+step+"."+key, from); msg != "" {
+		return "", msg
+	}
+	return stage + "/" + step, ""
+}
+
+// needs reports whether stage needs the stage called name, directly or
+// through the stages it needs.
+func (d *Definition) needs(stage *Stage, name string) bool {
+	seen := make(map[string]bool)
+	queue := slices.Clone(stage.Needs)
+	for len(queue) > 0 {
+		need := queue[0]
+		queue = queue[1:]
+		if need == name {
+			return true
+		}
+		if seen[need] {
+			continue
+		}
+		seen[need] = true
+		if s := d.Stage(need); s != nil {
+			queue = append(queue, s.Needs...)
+		}
+	}
+	return false
+}
+
+// ResolveInputs returns the inputs of a run passed the given values: every
+// input the definition declares, with the value passed for it or its
+// default, booleans spelled true or false. It returns an ErrorList naming
+// every value passed for an input the definition does not declare, or that
+// the input does not take, and every required input not passed.
+func (d *Definition) ResolveInputs(passed map[string]string) (map[string]string, error) {
+	var errs ErrorList
+	fail := func(name, format string, args ...any) {
+		path := "inputs"
+		if _, ok := d.Inputs[name]; ok {
+			path += "." + name
+		}
+		errs = append(errs, &Error{Line: d.line(path), Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	for _, name := range slices.Sorted(maps.Keys(passed)) {
+		if _, ok := d.Inputs[name]; !ok {
+			fail(name, "pipeline declares no input %s", name)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(d.Inputs) == 0 {
+		return nil, nil
+	}
+	inputs := make(map[string]string, len(d.Inputs))
+	for _, name := range slices.Sorted(maps.Keys(d.Inputs)) {
+		in := d.Inputs[name]
+		value, ok := passed[name]
+		if !ok {
+			if in.Required {
+				fail(name, "input %s is required", name)
+				continue
+			}
+			value = in.defaultValue()
+		}
+		value, err := in.check(value)
+		if err != nil {
+			fail(name, "input %s: %v", name, err)
+			continue
+		}
+		inputs[name] = value
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return inputs, nil
+}
+
+// ResolveResults returns values with their results expressions replaced by
+// the results of a run, keyed as types.Pipeline.Results keys them. Results
+// the run lacks resolve to the empty string.
+func ResolveResults(values, results map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		// Interpolate kept only expressions that parse.
+		resolved, err := replaceExpressions(v, func(e expression) string {
+			if e.namespace != namespaceResults {
+				return e.String()
+			}
+			stage, step, key, _ := splitResult(e.name)
+			return results[stage+"/"+step+"."+key]
+		})
+		if err == nil {
+			v = resolved
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// expressions reports every malformed expression of the definition.
+func (v *validator) expressions() {
+	check := func(path string, s *string) {
+		if _, err := replaceExpressions(*s, func(expression) string { return "" }); err != nil {
+			v.addf(path, "%v", err)
+		}
+	}
+	v.def.expressions(func(path string, s *string, _ *[]string, _ *Stage) { check(path, s) })
+	v.def.passedOn(func(path string, s *string, _ *Stage) { check(path, s) })
+}
+
+// expressions calls visit with the path of every field of the definition
+// that may hold expressions, a pointer to it, the secrets of the level it
+// is written at and the stage it belongs to, or nil for the fields of the
+// definition itself.
+func (d *Definition) expressions(visitStage func(path string, s *string, secrets *[]string, stage *Stage)) {
+	visitEnv("env", d.Env, &d.Secrets, func(path string, s *string, secrets *[]string) { visitStage(path, s, secrets, nil) })
+	for i := range d.Stages {
+		s := &d.Stages[i]
+		visit := func(path string, v *string, secrets *[]string) { visitStage(path, v, secrets, s) }
+		path := fmt.Sprintf("stages[%d]", i)
+		visit(path+".image", &s.Image, &s.Secrets)
+		visitEnv(path+".env", s.Env, &s.Secrets, visit)
+		visitServices(path+".services", s.Services, &s.Secrets, visit)
+		for j := range s.Steps {
+			step := &s.Steps[j]
+			sp := fmt.Sprintf("%s.steps[%d]", path, j)
+			visit(sp+".image", &step.Image, &step.Secrets)
+			visitList(sp+".entrypoint", step.Entrypoint, &step.Secrets, visit)
+			visitList(sp+".commands", step.Commands, &step.Secrets, visit)
+			for k := range step.Tasks {
+				t := &step.Tasks[k]
+				tp := fmt.Sprintf("%s.tasks[%d]", sp, k)
+				visit(tp+".image", &t.Image, &step.Secrets)
+				visitList(tp+".entrypoint", t.Entrypoint, &step.Secrets, visit)
+				visitList(tp+".commands", t.Commands, &step.Secrets, visit)
+				visitEnv(tp+".env", t.Env, &step.Secrets, visit)
+			}
+			visitEnv(sp+".env", step.Env, &step.Secrets, visit)
+			visitServices(sp+".services", step.Services, &step.Secrets, visit)
+			if b := step.BuildImage; b != nil {
+				bp := sp + ".build_image"
+				for _, f := range []struct {
+					name  string
+					value *string
+				}{{"context", &b.Context}, {"dockerfile", &b.Dockerfile}, {"image", &b.Image}, {"target", &b.Target}} {
+					visit(bp+"."+f.name, f.value, &step.Secrets)
+				}
+				visitList(bp+".tags", b.Tags, &step.Secrets, visit)
+				visitEnv(bp+".args", b.Args, &step.Secrets, visit)
+			}
+			if step.Matrix != nil {
+				for _, axis := range slices.Sorted(maps.Keys(step.Matrix.Env)) {
+					visitList(sp+".matrix.env."+axis, step.Matrix.Env[axis], &step.Secrets, visit)
+				}
+			}
+		}
+	}
+}
+
+// passedOn calls visit with the path of every field of the definition that
+// is passed on to other runs, a pointer to it and the stage of the trigger
+// step it belongs to, or nil for the outputs of the definition.
+func (d *Definition) passedOn(visit func(path string, s *string, from *Stage)) {
+	for _, k := range slices.Sorted(maps.Keys(d.Outputs)) {
+		v := d.Outputs[k]
+		visit("outputs."+k, &v, nil)
+		d.Outputs[k] = v
+	}
+	for i := range d.Stages {
+		s := &d.Stages[i]
+		for j := range s.Steps {
+			t := s.Steps[j].Trigger
+			if t == nil {
+				continue
+			}
+			tp := fmt.Sprintf("stages[%d].steps[%d].trigger", i, j)
+			for _, f := range []struct {
+				name  string
+				value *string
+			}{{"repository", &t.Repository}, {"clone_url", &t.CloneURL}, {"ref", &t.Ref}} {
+				visit(tp+"."+f.name, f.value, s)
+			}
+			for _, k := range slices.Sorted(maps.Keys(t.Inputs)) {
+				v := t.Inputs[k]
+				visit(tp+".inputs."+k, &v, s)
+				t.Inputs[k] = v
+			}
+		}
+	}
+}
+
+func visitList(path string, list []string, secrets *[]string, visit func(string, *string, *[]string)) {
+	for i := range list {
+		visit(fmt.Sprintf("%s[%d]", path, i), &list[i], secrets)
+	}
+}
+
+func visitEnv(path string, env map[string]string, secrets *[]string, visit func(string, *string, *[]string)) {
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		v := env[k]
+		visit(path+"."+k, &v, secrets)
+		env[k] = v
+	}
+}
+
+func visitServices(path string, services []types.Service, secrets *[]string, visit func(string, *string, *[]string)) {
+	for i := range services {
+		svc := &services[i]
+		sp := fmt.Sprintf("%s[%d]", path, i)
+		visit(sp+".image", &svc.Image, secrets)
+		visitList(sp+".entrypoint", svc.Entrypoint, secrets, visit)
+		visitList(sp+".command", svc.Command, secrets, visit)
+		visitEnv(sp+".env", svc.Env, secrets, visit)
+	}
+}
+
+// ReplaceSecrets replaces the secret expressions Interpolate left in the
+// fields of job with values, by secret name, keeping any whose secret
+// values lacks. The job is changed in place, so callers pass a copy of one
+// that is stored.
+func ReplaceSecrets(job *types.Job, values map[string]string) {
+	replaceJobExpressions(job, func(e expression) (string, bool) {
+		v, ok := values[e.name]
+		return v, ok && e.namespace == namespaceSecrets
+	})
+}
+
+// ResolveStepOutputs replaces the steps expressions Interpolate left in
+// the fields of job with the results of a run, keyed as
+// types.Pipeline.Results keys them. Outputs the run lacks, such as those
+// of steps that were skipped, resolve to the empty string.
+func ResolveStepOutputs(job *types.Job, results map[string]string) {
+	replaceJobExpressions(job, func(e expression) (string, bool) {
+		if e.namespace != namespaceSteps {
+			return "", false
+		}
+		stage, step, key, _ := splitStepOutput(e.name)
+		return results[stage+"/"+step+"."+key], true
+	})
+}
+
+// replaceJobExpressions replaces the expressions in the fields of job for
+// which fn returns true with what it returns.
+func replaceJobExpressions(job *types.Job, fn func(expression) (string, bool)) {
+	replace := func(s *string) {
+		// Stored jobs went through Interpolate, so every expression parses.
+		out, err := replaceExpressions(*s, func(e expression) string {
+			if v, ok := fn(e); ok {
+				return v
+			}
+			return e.String()
+		})
+		if err == nil {
+			*s = out
+		}
+	}
+	replaceList := func(list []string) {
+		for i := range list {
+			replace(&list[i])
+		}
+	}
+	replaceEnv := func(env map[string]string) {
+		for k, v := range env {
+			replace(&v)
+			env[k] = v
+		}
+	}
+	replace(&job.Image)
+	replaceList(job.Entrypoint)
+	replaceList(job.Commands)
+	replaceEnv(job.Env)
+	for i := range job.Tasks {
+		t := &job.Tasks[i]
+		replace(&t.Image)
+		replaceList(t.Entrypoint)
+		replaceList(t.Commands)
+		replaceEnv(t.Env)
+	}
+	for i := range job.Services {
+		svc := &job.Services[i]
+		replace(&svc.Image)
+		replaceList(svc.Entrypoint)
+		replaceList(svc.Command)
+		replaceEnv(svc.Env)
+	}
+}
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"open-cicd/internal/types"
+)
+
+// interpolationDefinition returns a definition whose test stage, which
+// needs build, runs command in its unit step, and whose lint stage needs
+// nothing.
+func interpolationDefinition(t *testing.T, command string) *Definition {
+	t.Helper()
+	def, err := Parse([]byte(fmt.Sprintf(`name: ci
+stages:
+  - name: build
+    image: golang
+    steps:
+      - name: compile
+        commands: [make]
+  - name: lint
+    image: golang
+    steps:
+      - name: vet
+        commands: [go vet]
+  - name: test
+    needs: [build]
+    image: golang
+    steps:
+      - name: unit
+        commands:
+          - %q
+`, command)))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return def
+}
+
+func TestInterpolate(t *testing.T) {
+	scope := &Scope{
+		Trigger: ConditionContext{Event: "push", Branch: "main", Ref: "refs/heads/main"},
+		Commit:  "abc123",
+		Vars:    map[string]string{"REGISTRY": "registry.example.com"},
+		Secrets: []string{"TOKEN"},
+		Inputs:  map[string]string{"IMAGE": "app"},
+	}
+	tests := []struct {
+		name    string
+		command string
+		want    string
+		// secrets are the secrets the unit step gets.
+		secrets []string
+		wantErr string
+	}{
+		{
+			name:    "no expressions",
+			command: "make test",
+			want:    "make test",
+		},
+		{
+			name:    "variable",
+			command: "push ${{ vars.REGISTRY }}/${{inputs.IMAGE}}",
+			want:    "push registry.example.com/app",
+		},
+		{
+			name:    "trigger",
+			command: "echo ${{ trigger.branch }} ${{ trigger.commit }}",
+			want:    "echo main abc123",
+		},
+		{
+			name:    "secret is kept",
+			command: "login ${{ secrets.TOKEN }} ${{ secrets.TOKEN }}",
+			want:    "login ${{ secrets.TOKEN }} ${{ secrets.TOKEN }}",
+			secrets: []string{"TOKEN"},
+		},
+		{
+			name:    "step output names its stage",
+			command: "echo ${{ steps.compile.outputs.version }}",
+			want:    "echo ${{ steps.build/compile.outputs.version }}",
+		},
+		{
+			name:    "undefined variable",
+			command: "echo ${{ vars.MISSING }}",
+			wantErr: "undefined variable MISSING",
+		},
+		{
+			name:    "undefined secret",
+			command: "echo ${{ secrets.MISSING }}",
+			wantErr: "undefined secret MISSING",
+		},
+		{
+			name:    "undeclared input",
+			command: "echo ${{ inputs.MISSING }}",
+			wantErr: "undeclared input MISSING",
+		},
+		{
+			name:    "results outside outputs",
+			command: "echo ${{ results.build/compile.digest }}",
+			wantErr: "can only be used in outputs and trigger inputs",
+		},
+		{
+			name:    "output of a stage not needed",
+			command: "echo ${{ steps.vet.outputs.report }}",
+			wantErr: `stage "lint", which stage "test" does not need`,
+		},
+		{
+			name:    "output of an unknown step",
+			command: "echo ${{ steps.missing.outputs.version }}",
+			wantErr: `unknown step "missing"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def := interpolationDefinition(t, tt.command)
+			err := def.Interpolate(scope)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Interpolate error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), "line ") {
+					t.Errorf("Interpolate error = %v, want a line number", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Interpolate: %v", err)
+			}
+			step := def.Stages[2].Steps[0]
+			if got := step.Commands[0]; got != tt.want {
+				t.Errorf("command = %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(step.Secrets, tt.secrets) {
+				t.Errorf("secrets = %v, want %v", step.Secrets, tt.secrets)
+			}
+		})
+	}
+}
+
+func TestResolveStepOutputs(t *testing.T) {
+	results := map[string]string{
+		"build/compile.version": "1.2.3",
+		"build/compile.digest":  "sha256:abc",
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "output",
+			in:   "deploy ${{ steps.build/compile.outputs.version }}",
+			want: "deploy 1.2.3",
+		},
+		{
+			name: "several outputs",
+			in:   "${{ steps.build/compile.outputs.version }}@${{ steps.build/compile.outputs.digest }}",
+			want: "1.2.3@sha256:abc",
+		},
+		{
+			name: "missing output is empty",
+			in:   "deploy ${{ steps.build/compile.outputs.missing }}",
+			want: "deploy ",
+		},
+		{
+			name: "other expressions are kept",
+			in:   "login ${{ secrets.TOKEN }}",
+			want: "login ${{ secrets.TOKEN }}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &types.Job{
+				Image:    tt.in,
+				Commands: []string{tt.in},
+				Env:      map[string]string{"VALUE": tt.in},
+				Tasks:    []types.Task{{Commands: []string{tt.in}}},
+			}
+			ResolveStepOutputs(job, results)
+			for field, got := range map[string]string{
+				"image":        job.Image,
+				"command":      job.Commands[0],
+				"env":          job.Env["VALUE"],
+				"task command": job.Tasks[0].Commands[0],
+			} {
+				if got != tt.want {
+					t.Errorf("%s = %q, want %q", field, got, tt.want)
+				}
+			}
+		})
+	}
+}
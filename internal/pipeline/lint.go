@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Warnings returns what is suspect in a valid definition without keeping
+// it from running: inputs no expression uses and stages needed twice by
+// the same stage. They are reported in source order.
+func (d *Definition) Warnings() ErrorList {
+	var warnings ErrorList
+	add := func(path, format string, args ...any) {
+		warnings = append(warnings, &Error{Line: d.line(path), Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	used := d.references(namespaceInputs)
+	for _, name := range slices.Sorted(maps.Keys(d.Inputs)) {
+		if !used[name] {
+			add("inputs."+name, "input %s is declared but no expression uses it", name)
+		}
+	}
+
+	for i := range d.Stages {
+		s := &d.Stages[i]
+		seen := make(map[string]bool, len(s.Needs))
+		for j, need := range s.Needs {
+			if seen[need] {
+				add(fmt.Sprintf("stages[%d].needs[%d]", i, j), "stage %q needs stage %q more than once", s.Name, need)
+			}
+			seen[need] = true
+		}
+	}
+	slices.SortStableFunc(warnings, func(a, b *Error) int { return a.Line - b.Line })
+	return warnings
+}
+
+// UsesVariables reports whether expressions of the definition refer to
+// variables or secrets, which differ from project to project.
+func (d *Definition) UsesVariables() bool {
+	return len(d.references(namespaceVars)) > 0 || len(d.references(namespaceSecrets)) > 0
+}
+
+// references returns the names the expressions of the definition refer to
+// in namespace.
+func (d *Definition) references(namespace string) map[string]bool {
+	names := make(map[string]bool)
+	record := func(s *string) {
+		// Validate has checked that every expression parses.
+		replaceExpressions(*s, func(e expression) string {
+			if e.namespace == namespace {
+				names[e.name] = true
+			}
+			return e.String()
+		})
+	}
+	d.expressions(func(_ string, s *string, _ *[]string, _ *Stage) { record(s) })
+	d.passedOn(func(_ string, s *string, _ *Stage) { record(s) })
+	return names
+}
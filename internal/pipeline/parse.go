@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlLine extracts the line number yaml.v3 embeds in its error messages.
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Parse decodes and validates a pipeline definition. On failure the returned
+// error is an ErrorList describing every problem found, with line numbers.
+func Parse(data []byte) (*Definition, error) {
+	var root yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&root); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrorList{{Message: "pipeline definition is empty"}}
+		}
+		return nil, yamlErrors(err)
+	}
+	doc := &root
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		doc = doc.Content[0]
+	}
+
+	def := &Definition{lines: make(map[string]int)}
+	var errs ErrorList
+	checkFields(doc, reflect.TypeOf(*def), "", def.lines, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := doc.Decode(def); err != nil {
+		return nil, yamlErrors(err)
+	}
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// yamlErrors converts a yaml.v3 error into an ErrorList.
+func yamlErrors(err error) ErrorList {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	errs := make(ErrorList, 0, len(msgs))
+	for _, msg := range msgs {
+		e := &Error{Message: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Message = m[2]
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// checkFields walks node alongside the Go type it will be decoded into,
+// reporting mapping keys that do not correspond to a field and recording the
+// line of every field path in lines.
+func checkFields(node *yaml.Node, t reflect.Type, path string, lines map[string]int, errs *ErrorList) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if path != "" {
+		lines[path] = node.Line
+	}
+	// Types that read themselves may take shorthands; written out in full
+	// they are checked like any other.
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) && node.Kind != yaml.MappingNode {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return // yaml.v3 reports the type mismatch with a line number
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			child := joinPath(path, key.Value)
+			ft, ok := fields[key.Value]
+			if !ok {
+				*errs = append(*errs, &Error{
+					Line:    key.Line,
+					Path:    child,
+					Message: fmt.Sprintf("unknown field %q (expected one of: %s)", key.Value, strings.Join(sortedKeys(fields), ", ")),
+				})
+				continue
+			}
+			checkFields(value, ft, child, lines, errs)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), lines, errs)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkFields(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value), lines, errs)
+		}
+	}
+}
+
+// yamlFields maps the YAML key of every exported field of t to its type.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]reflect.Type) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
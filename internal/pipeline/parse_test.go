@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	def, err := Parse([]byte(`
+name: ci
+env:
+  GO: "1.23"
+stages:
+  - name: build
+    image: golang
+    steps:
+      - name: compile
+        commands: [go build ./...]
+  - name: test
+    needs: [build]
+    image: golang
+    steps:
+      - name: unit
+        commands: [go test ./...]
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if def.Name != "ci" || len(def.Stages) != 2 {
+		t.Fatalf("parsed %q with %d stages, want ci with 2", def.Name, len(def.Stages))
+	}
+	if got := def.Stages[1].Needs; len(got) != 1 || got[0] != "build" {
+		t.Errorf("needs of test = %v, want [build]", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want lists the line and a part of the message of every error,
+		// in order.
+		want []Error
+	}{
+		{
+			name: "empty",
+			yaml: ``,
+			want: []Error{{Message: "empty"}},
+		},
+		{
+			name: "syntax",
+			yaml: "name: ci\nstages:\n\t- name: build\n",
+			want: []Error{{Line: 3}},
+		},
+		{
+			name: "unknown field",
+			yaml: `name: ci
+stages:
+  - name: build
+    image: golang
+    stpes:
+      - name: compile
+`,
+			want: []Error{{Line: 5, Message: "stpes"}},
+		},
+		{
+			name: "wrong type",
+			yaml: `name: ci
+stages:
+  - name: build
+    image: golang
+    steps:
+      - name: compile
+        commands: {go: build}
+`,
+			want: []Error{{Line: 7}},
+		},
+		{
+			name: "unknown need",
+			yaml: `name: ci
+stages:
+  - name: build
+    image: golang
+    steps:
+      - name: compile
+        commands: [make]
+  - name: test
+    needs: [buld]
+    image: golang
+    steps:
+      - name: unit
+        commands: [make test]
+`,
+			want: []Error{{Line: 9, Message: "buld"}},
+		},
+		{
+			name: "several errors in source order",
+			yaml: `name: ci
+stages:
+  - name: build
+    image: golang
+    foo: 1
+    steps:
+      - name: compile
+        bar: 2
+`,
+			want: []Error{{Line: 5, Message: "foo"}, {Line: 8, Message: "bar"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.yaml))
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("Parse error = %v, want an ErrorList", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Parse errors = %v, want %d", errs, len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := errs[i]
+				if got.Line != want.Line || !strings.Contains(got.Error(), want.Message) {
+					t.Errorf("error %d = %q, want line %d mentioning %q", i, got, want.Line, want.Message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package pipeline
+
+import "slices"
+
+// PathsMatch reports whether a push that changed files runs a pipeline or
+// stage filtered by paths and ignore. Files matching a glob of ignore are
+// left out first; the push runs it if any file is left and, when paths is
+// set, one of them matches a glob of paths. Unknown changed files, as for
+// manual and scheduled runs, always match, as does a filter that sets
+// neither list.
+func PathsMatch(paths, ignore, files []string) bool {
+	if files == nil || (len(paths) == 0 && len(ignore) == 0) {
+		return true
+	}
+	for _, f := range files {
+		if matchAny(ignore, f) {
+			continue
+		}
+		if len(paths) == 0 || matchAny(paths, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether name matches one of the globs.
+func matchAny(globs []string, name string) bool {
+	return slices.ContainsFunc(globs, func(g string) bool { return MatchGlob(g, name) })
+}
+
+// Runs reports whether the path filters of the definition let a run happen
+// in c.
+func (d *Definition) Runs(c *ConditionContext) bool {
+	return PathsMatch(d.Paths, d.PathsIgnore, c.ChangedFiles)
+}
+
+// StageRuns reports whether stage runs in c: the run happens, the stage's
+// own path filters match and its if condition holds.
+func (d *Definition) StageRuns(stage *Stage, c *ConditionContext) bool {
+	return d.Runs(c) && PathsMatch(stage.Paths, stage.PathsIgnore, c.ChangedFiles) && Runs(stage.If, c)
+}
+
+// UsesChangedFiles reports whether which stages and steps of the definition
+// run depends on the files a push changed, through path filters or changed()
+// conditions, so that it is worth finding them out when the provider does
+// not report them.
+func (d *Definition) UsesChangedFiles() bool {
+	if len(d.Paths) > 0 || len(d.PathsIgnore) > 0 {
+		return true
+	}
+	for i := range d.Stages {
+		stage := &d.Stages[i]
+		if len(stage.Paths) > 0 || len(stage.PathsIgnore) > 0 || usesChanged(stage.If) {
+			return true
+		}
+		for j := range stage.Steps {
+			if usesChanged(stage.Steps[j].If) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesChanged reports whether an if expression calls changed().
+func usesChanged(expr string) bool {
+	if expr == "" {
+		return false
+	}
+	cond, err := ParseCondition(expr)
+	return err == nil && cond.usesChanged()
+}
@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"open-cicd/internal/types"
+)
+
+// ErrNotReproducible is returned for jobs that do not run on agents, such
+// as trigger steps, which the server runs itself.
+var ErrNotReproducible = errors.New("job does not run on an agent")
+
+// Reproduce returns the bundle that runs job again outside CI, given the
+// environment the variables applied to it give it, as when it was
+// dispatched. The job's own environment overrides variables of the same
+// name. Secrets and ID tokens keep their names but not their values: the
+// variables they would be in are left out of the environment and secret
+// expressions refer to them instead, so that the bundle can be handed to
+// anyone who may see the job.
+func Reproduce(job *types.Job, variables map[string]string) (*types.ReproduceBundle, error) {
+	if job.Trigger != nil {
+		return nil, ErrNotReproducible
+	}
+	c := job.Clone()
+	env := make(map[string]string, len(variables)+len(c.Env))
+	for name, value := range variables {
+		env[name] = value
+	}
+	for name, value := range c.Env {
+		env[name] = value
+	}
+	c.Env = env
+
+	withheld := make(map[string]bool)
+	refs := make(map[string]string)
+	for _, entry := range c.Secrets {
+		ref, err := types.ParseSecretRef(entry)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", entry, err)
+		}
+		withheld[ref.Name] = true
+		refs[ref.Name] = "${" + ref.Name + "}"
+	}
+	for name := range c.IDTokens {
+		withheld[name] = true
+	}
+	ReplaceSecrets(c, refs)
+	for name := range withheld {
+		delete(c.Env, name)
+		for i := range c.Tasks {
+			delete(c.Tasks[i].Env, name)
+		}
+	}
+
+	spec, err := c.ExecSpec()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]string, 0, len(withheld))
+	for name := range withheld {
+		secrets = append(secrets, name)
+	}
+	sort.Strings(secrets)
+	return &types.ReproduceBundle{
+		JobID:      job.ID,
+		Name:       job.Name,
+		Repository: job.Repository,
+		Ref:        job.Ref,
+		Commit:     job.Commit,
+		Spec:       *spec,
+		Secrets:    secrets,
+	}, nil
+}
@@ -0,0 +1,312 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LatestVersion stands for the newest published version of a template.
+const LatestVersion = "latest"
+
+// Include names a template file: a template published on the server, or a
+// file in a shared template repository.
+type Include struct {
+	// Template is a published template as name@version, where version may
+	// be LatestVersion.
+	Template string `yaml:"template,omitempty" json:"template,omitempty"`
+	// Repository is the clone URL of a template repository, File the path
+	// of the template in it and Ref the branch, tag or commit to read it
+	// at.
+	Repository string `yaml:"repository,omitempty" json:"repository,omitempty"`
+	File       string `yaml:"file,omitempty" json:"file,omitempty"`
+	Ref        string `yaml:"ref,omitempty" json:"ref,omitempty"`
+	// As is the alias steps extend the template's steps by; it defaults to
+	// the template's name, or the file's name without its extension.
+	As string `yaml:"as,omitempty" json:"as,omitempty"`
+}
+
+// TemplateRef splits the Template of an include into its name and version.
+func (inc *Include) TemplateRef() (name, version string) {
+	name, version, _ = strings.Cut(inc.Template, "@")
+	return name, version
+}
+
+// Alias returns the name steps refer to the include by.
+func (inc *Include) Alias() string {
+	switch {
+	case inc.As != "":
+		return inc.As
+	case inc.Template != "":
+		name, _ := inc.TemplateRef()
+		return name
+	}
+	base := path.Base(inc.File)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// String describes the include in error messages.
+func (inc *Include) String() string {
+	if inc.Template != "" {
+		return "template " + inc.Template
+	}
+	return fmt.Sprintf("%s in %s at %s", inc.File, inc.Repository, inc.Ref)
+}
+
+// Template is a parsed template file: a library of steps that definitions
+// include and extend. Templates cannot include other templates.
+type Template struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	Steps       []Step `yaml:"steps" json:"steps"`
+}
+
+// Step returns the template's step called name.
+func (t *Template) Step(name string) (*Step, bool) {
+	for i := range t.Steps {
+		if t.Steps[i].Name == name {
+			return &t.Steps[i], true
+		}
+	}
+	return nil, false
+}
+
+// ParseTemplate decodes and validates a template file. On failure the
+// returned error is an ErrorList, with line numbers.
+func ParseTemplate(data []byte) (*Template, error) {
+	var root yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&root); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrorList{{Message: "template is empty"}}
+		}
+		return nil, yamlErrors(err)
+	}
+	doc := &root
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		doc = doc.Content[0]
+	}
+
+	t := &Template{}
+	lines := make(map[string]int)
+	var errs ErrorList
+	checkFields(doc, reflect.TypeOf(*t), "", lines, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := doc.Decode(t); err != nil {
+		return nil, yamlErrors(err)
+	}
+
+	// The steps are checked as those of a stage of a definition would be,
+	// so that errors point at the template's own lines.
+	v := &validator{def: &Definition{lines: lines}, template: true}
+	switch {
+	case strings.TrimSpace(t.Name) == "":
+		v.addf("name", "template name is required")
+	case !namePattern.MatchString(t.Name):
+		v.addf("name", "template name %q may only contain letters, digits, '.', '_' and '-'", t.Name)
+	}
+	if len(t.Steps) == 0 {
+		v.addf("steps", "template has no steps")
+	} else {
+		v.steps("", &Stage{Name: t.Name, Steps: t.Steps})
+	}
+	if err := v.errs.err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TemplateLoader loads the templates definitions include.
+type TemplateLoader interface {
+	LoadTemplate(ctx context.Context, inc Include) (*Template, error)
+}
+
+// Expand loads the templates the definition includes and completes every
+// step that extends one of their steps. The extending step starts from a
+// copy of the template's step: fields it sets replace the template's, except
+// env and labels, which are merged with the step's entries winning, and
+// secrets, which are added. Once expanded the definition includes nothing
+// and is validated again in full.
+func (d *Definition) Expand(ctx context.Context, loader TemplateLoader) error {
+	if len(d.Include) == 0 {
+		return nil
+	}
+	if loader == nil {
+		return ErrorList{{Line: d.line("include"), Path: "include", Message: "this server does not support templates"}}
+	}
+	templates := make(map[string]*Template, len(d.Include))
+	var errs ErrorList
+	for i, inc := range d.Include {
+		t, err := loader.LoadTemplate(ctx, inc)
+		if err != nil {
+			p := fmt.Sprintf("include[%d]", i)
+			errs = append(errs, &Error{Line: d.line(p), Path: p, Message: fmt.Sprintf("loading %s: %v", inc.String(), err)})
+			continue
+		}
+		templates[inc.Alias()] = t
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for i := range d.Stages {
+		for j := range d.Stages[i].Steps {
+			step := &d.Stages[i].Steps[j]
+			if step.Extends == "" {
+				continue
+			}
+			p := fmt.Sprintf("stages[%d].steps[%d].extends", i, j)
+			alias, name, _ := strings.Cut(step.Extends, "/")
+			t, ok := templates[alias]
+			if !ok {
+				errs = append(errs, &Error{Line: d.line(p), Path: p, Message: fmt.Sprintf("no included template is called %q", alias)})
+				continue
+			}
+			base, ok := t.Step(name)
+			if !ok {
+				errs = append(errs, &Error{Line: d.line(p), Path: p, Message: fmt.Sprintf("template %q has no step %q", alias, name)})
+				continue
+			}
+			*step = extendStep(*base, *step)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	d.Include = nil
+	return d.Validate()
+}
+
+// ParseExpanded parses a pipeline file and expands the templates it
+// includes with loader. It also returns the source to record for the run:
+// data itself, or the expanded definition if it included templates, so
+// that re-running the run does not depend on templates that may have moved
+// on since.
+func ParseExpanded(ctx context.Context, data []byte, loader TemplateLoader) (*Definition, []byte, error) {
+	d, err := Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(d.Include) == 0 {
+		return d, data, nil
+	}
+	if err := d.Expand(ctx, loader); err != nil {
+		return nil, nil, err
+	}
+	source, err := d.YAML()
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding expanded definition: %w", err)
+	}
+	return d, source, nil
+}
+
+// extendStep returns base overridden by step, as Expand describes; ID
+// tokens are merged like env.
+func extendStep(base, step Step) Step {
+	out := base
+	out.Name = step.Name
+	out.Extends = ""
+	if step.If != "" {
+		out.If = step.If
+	}
+	// Image variants and an image replace each other.
+	if step.Image != "" || step.Images != nil {
+		out.Image, out.Images = step.Image, step.Images
+	}
+	if step.Entrypoint != nil {
+		out.Entrypoint = step.Entrypoint
+	}
+	if step.OS != "" {
+		out.OS = step.OS
+	}
+	if step.Shell != "" {
+		out.Shell = step.Shell
+	}
+	if step.Arch != "" {
+		out.Arch = step.Arch
+	}
+	if step.ResolveImage {
+		out.ResolveImage = true
+	}
+	// Commands, tasks, image builds and triggers are alternatives: setting
+	// any replaces them all.
+	if len(step.Commands) > 0 || len(step.Tasks) > 0 || step.BuildImage != nil || step.Trigger != nil {
+		out.Commands, out.Tasks, out.BuildImage, out.Trigger = step.Commands, step.Tasks, step.BuildImage, step.Trigger
+	}
+	out.Env = mergeMaps(base.Env, step.Env)
+	out.Labels = mergeMaps(base.Labels, step.Labels)
+	out.IDTokens = mergeMaps(base.IDTokens, step.IDTokens)
+	out.Secrets = slices.Clone(base.Secrets)
+	for _, s := range step.Secrets {
+		if !slices.Contains(out.Secrets, s) {
+			out.Secrets = append(out.Secrets, s)
+		}
+	}
+	if step.Matrix != nil {
+		out.Matrix = step.Matrix
+	}
+	if step.Services != nil {
+		out.Services = step.Services
+	}
+	if step.Resources != nil {
+		out.Resources = step.Resources
+	}
+	if step.Requests != nil {
+		out.Requests = step.Requests
+	}
+	if step.Security != nil {
+		out.Security = step.Security
+	}
+	if step.Retry != nil {
+		out.Retry = step.Retry
+	}
+	if step.Timeout != 0 {
+		out.Timeout = step.Timeout
+	}
+	if step.LogLimit != "" {
+		out.LogLimit = step.LogLimit
+	}
+	if step.Outputs != nil {
+		out.Outputs = step.Outputs
+	}
+	return out
+}
+
+// mergeMaps returns the entries of base and over, those of over winning.
+func mergeMaps(base, over map[string]string) map[string]string {
+	if len(base)+len(over) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
+
+// YAML encodes the definition as a pipeline file, such as to record an
+// expanded definition that no longer depends on its templates.
+func (d *Definition) YAML() ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
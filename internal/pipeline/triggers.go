@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"maps"
+	"slices"
+
+	"open-cicd/internal/types"
+)
+
+// maxOutputs caps the outputs of a definition, which a waiting trigger step
+// of the parent run reports as its results.
+const maxOutputs = 64
+
+// trigger checks the trigger of a step. Trigger steps run nothing, so they
+// take none of the settings of the steps that do.
+func (v *validator) trigger(sp string, step *Step) {
+	t := step.Trigger
+	if t == nil {
+		return
+	}
+	switch {
+	case len(step.Commands) > 0 || len(step.Tasks) > 0 || step.BuildImage != nil:
+		v.addf(sp, "step %q cannot have trigger along with commands, tasks or build_image", step.Name)
+	case step.Image != "" || len(step.Images) > 0 || step.ResolveImage || step.Arch != "" || step.Entrypoint != nil || len(step.Services) > 0:
+		v.addf(sp, "step %q starts a downstream run and cannot set image, images, resolve_image, arch, entrypoint or services", step.Name)
+	case step.Matrix != nil || step.Retry != nil || len(step.Outputs) > 0:
+		v.addf(sp, "step %q starts a downstream run and cannot set matrix, retry or outputs", step.Name)
+	}
+	for _, f := range []struct{ name, value string }{{"repository", t.Repository}, {"clone_url", t.CloneURL}, {"ref", t.Ref}} {
+		if f.value == "" {
+			v.addf(sp+"."+f.name, "trigger needs the %s of the downstream pipeline", f.name)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(t.Inputs)) {
+		if !envKeyPattern.MatchString(k) {
+			v.addf(sp+".inputs."+k, "invalid input name %q", k)
+		}
+	}
+}
+
+// inputsOutputs checks the inputs and outputs the definition declares.
+func (v *validator) inputsOutputs() {
+	d := v.def
+	v.inputs()
+	if len(d.Outputs) > maxOutputs {
+		v.addf("outputs", "a pipeline may declare at most %d outputs", maxOutputs)
+	}
+	for _, k := range slices.Sorted(maps.Keys(d.Outputs)) {
+		if types.ValidateResultKey(k) != nil {
+			v.addf("outputs."+k, "invalid output name %q, expected letters, digits, '_' and '-'", k)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// maxMatrixLegs caps the number of jobs a single matrix step expands into.
+const maxMatrixLegs = 256
+
+var (
+	namePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Validate checks the semantic rules of a definition: required fields,
+// unique names, known stage dependencies and the absence of dependency
+// cycles. It returns an ErrorList or nil.
+func (d *Definition) Validate() error {
+	v := &validator{def: d}
+	v.validate()
+	return v.errs.err()
+}
+
+type validator struct {
+	def  *Definition
+	errs ErrorList
+	// template is set when checking the steps of a template rather than
+	// of a definition.
+	template bool
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.errs = append(v.errs, &Error{
+		Line:    v.def.line(path),
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// line returns the source line of path, falling back to its nearest
+// recorded parent.
+func (d *Definition) line(path string) int {
+	for path != "" {
+		if l, ok := d.lines[path]; ok {
+			return l
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+func (v *validator) validate() {
+	d := v.def
+	if strings.TrimSpace(d.Name) == "" {
+		v.addf("name", "pipeline name is required")
+	}
+	if d.Priority != "" && !types.Priority(d.Priority).Valid() {
+		v.addf("priority", "unknown priority %q, expected high, normal or low", d.Priority)
+	}
+	v.env("env", d.Env)
+	v.secrets("secrets", d.Secrets)
+	v.labels("labels", d.Labels)
+	v.timeout("timeout", d.Timeout)
+	if d.Workspace != "" {
+		if err := types.ValidateWorkspace(d.Workspace); err != nil {
+			v.addf("workspace", "%v", err)
+		}
+	}
+	v.concurrency(d.Concurrency)
+	if d.Cache != nil {
+		if err := d.Cache.Validate(); err != nil {
+			v.addf("cache", "%v", err)
+		}
+	}
+	v.globs("paths", d.Paths)
+	v.globs("paths_ignore", d.PathsIgnore)
+	v.includes(d.Include)
+	v.inputsOutputs()
+	if len(d.Stages) == 0 {
+		v.addf("stages", "at least one stage is required")
+		return
+	}
+
+	stages := make(map[string]bool, len(d.Stages))
+	for i := range d.Stages {
+		s := &d.Stages[i]
+		path := fmt.Sprintf("stages[%d]", i)
+		switch {
+		case s.Name == "":
+			v.addf(path+".name", "stage name is required")
+		case !namePattern.MatchString(s.Name):
+			v.addf(path+".name", "stage name %q may only contain letters, digits, '.', '_' and '-'", s.Name)
+		case stages[s.Name]:
+			v.addf(path+".name", "duplicate stage name %q", s.Name)
+		}
+		stages[s.Name] = true
+		v.env(path+".env", s.Env)
+		v.secrets(path+".secrets", s.Secrets)
+		v.labels(path+".labels", s.Labels)
+		v.timeout(path+".timeout", s.Timeout)
+		v.services(path+".services", s.Services)
+		v.resources(path+".resources", s.Resources)
+		v.requests(path+".requests", s.Requests)
+		v.platform(path, s.OS, s.Shell)
+		v.approval(path, s)
+		v.condition(path+".if", s.If)
+		v.globs(path+".paths", s.Paths)
+		v.globs(path+".paths_ignore", s.PathsIgnore)
+		if s.Environment != "" {
+			if err := types.ValidateEnvironmentName(s.Environment); err != nil {
+				v.addf(path+".environment", "%v", err)
+			}
+		}
+		v.steps(path, s)
+	}
+	v.expressions()
+
+	for i := range d.Stages {
+		s := &d.Stages[i]
+		for j, need := range s.Needs {
+			path := fmt.Sprintf("stages[%d].needs[%d]", i, j)
+			switch {
+			case need == s.Name:
+				v.addf(path, "stage %q cannot depend on itself", s.Name)
+			case !stages[need]:
+				v.addf(path, "stage %q needs unknown stage %q", s.Name, need)
+			}
+		}
+	}
+	if len(v.errs) == 0 {
+		v.cycles()
+	}
+}
+
+func (v *validator) steps(path string, s *Stage) {
+	path = joinPath(path, "steps")
+	if len(s.Steps) == 0 {
+		v.addf(path, "stage %q has no steps", s.Name)
+		return
+	}
+	names := make(map[string]bool, len(s.Steps))
+	for j := range s.Steps {
+		step := &s.Steps[j]
+		sp := fmt.Sprintf("%s[%d]", path, j)
+		switch {
+		case step.Name == "":
+			v.addf(sp+".name", "step name is required")
+		case !namePattern.MatchString(step.Name):
+			v.addf(sp+".name", "step name %q may only contain letters, digits, '.', '_' and '-'", step.Name)
+		case names[step.Name]:
+			v.addf(sp+".name", "duplicate step name %q in stage %q", step.Name, s.Name)
+		}
+		names[step.Name] = true
+		v.extends(sp+".extends", step)
+		v.condition(sp+".if", step.If)
+		switch {
+		// A step extending a template's gets its commands from it.
+		case len(step.Commands) == 0 && len(step.Tasks) == 0 && step.BuildImage == nil && step.Trigger == nil && step.Extends == "":
+			v.addf(sp+".commands", "step %q has no commands, tasks, build_image or trigger", step.Name)
+		case len(step.Commands) > 0 && len(step.Tasks) > 0:
+			v.addf(sp+".tasks", "step %q cannot have both commands and tasks", step.Name)
+		}
+		v.commands(sp+".commands", step.Commands)
+		v.tasks(sp, s, step)
+		v.imageBuild(sp+".build_image", step)
+		v.trigger(sp+".trigger", step)
+		v.services(sp+".services", step.Services)
+		v.resources(sp+".resources", step.Resources)
+		v.requests(sp+".requests", step.Requests)
+		v.security(sp+".security", s, step)
+		if step.OS != "" || step.Shell != "" {
+			v.platform(sp, s.StepOS(step), s.StepShell(step))
+		}
+		v.images(sp, s, step)
+		v.env(sp+".env", step.Env)
+		v.secrets(sp+".secrets", step.Secrets)
+		if err := types.ValidateIDTokens(step.IDTokens); err != nil {
+			v.addf(sp+".id_tokens", "%v", err)
+		}
+		v.labels(sp+".labels", step.Labels)
+		v.timeout(sp+".timeout", step.Timeout)
+		if step.LogLimit != "" {
+			if _, err := types.ParseLogLimit(step.LogLimit); err != nil {
+				v.addf(sp+".log_limit", "%v", err)
+			}
+		}
+		if step.Retry != nil {
+			if err := step.Retry.Validate(); err != nil {
+				v.addf(sp+".retry", "%v", err)
+			}
+		}
+		if step.Matrix != nil {
+			v.matrix(sp+".matrix", step.Matrix)
+		}
+		for k, output := range step.Outputs {
+			if err := types.ValidateOutputPath(output); err != nil {
+				v.addf(fmt.Sprintf("%s.outputs[%d]", sp, k), "%v", err)
+			}
+		}
+	}
+}
+
+// extends checks the template step a step extends.
+func (v *validator) extends(path string, step *Step) {
+	switch {
+	case step.Extends == "":
+	case v.template:
+		v.addf(path, "template steps cannot extend other templates")
+	case len(v.def.Include) == 0:
+		v.addf(path, "step %q extends %q but the definition includes no templates", step.Name, step.Extends)
+	default:
+		alias, name, ok := strings.Cut(step.Extends, "/")
+		if !ok || !namePattern.MatchString(alias) || !namePattern.MatchString(name) {
+			v.addf(path, "extends %q must name a template step as alias/step", step.Extends)
+		}
+	}
+}
+
+// includes checks the templates a definition includes.
+func (v *validator) includes(includes []Include) {
+	aliases := make(map[string]bool, len(includes))
+	for i := range includes {
+		inc := &includes[i]
+		path := fmt.Sprintf("include[%d]", i)
+		switch {
+		case inc.Template != "" && inc.Repository != "":
+			v.addf(path, "include either a template or a repository file, not both")
+		case inc.Template != "":
+			name, version := inc.TemplateRef()
+			if !namePattern.MatchString(name) || version == "" {
+				v.addf(path+".template", "template %q must be name@version, where version may be %s", inc.Template, LatestVersion)
+			}
+			if inc.File != "" || inc.Ref != "" {
+				v.addf(path, "file and ref only apply to repository includes")
+			}
+		case inc.Repository != "":
+			if inc.File == "" {
+				v.addf(path+".file", "the template file in %s is required", inc.Repository)
+			}
+			if inc.Ref == "" {
+				v.addf(path+".ref", "the ref to read %s at is required", inc.Repository)
+			}
+		default:
+			v.addf(path, "include a template or a repository file")
+			continue
+		}
+		alias := inc.Alias()
+		switch {
+		case !namePattern.MatchString(alias):
+			v.addf(path+".as", "alias %q may only contain letters, digits, '.', '_' and '-'", alias)
+		case aliases[alias]:
+			v.addf(path+".as", "two includes are called %q; set as on one of them", alias)
+		}
+		aliases[alias] = true
+	}
+}
+
+// approval checks the when and approvers of a stage.
+func (v *validator) approval(path string, s *Stage) {
+	switch {
+	case s.When != "" && s.When != WhenManual:
+		v.addf(path+".when", "unknown when %q, expected %q", s.When, WhenManual)
+	case s.When == "" && len(s.Approvers) > 0:
+		v.addf(path+".approvers", "stage %q has approvers but is not manual", s.Name)
+	}
+	for i, approver := range s.Approvers {
+		if _, err := types.ParseSubject(approver); err != nil {
+			v.addf(fmt.Sprintf("%s.approvers[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// condition checks the if expression of a stage or step.
+func (v *validator) condition(path, expr string) {
+	if expr == "" {
+		return
+	}
+	if _, err := ParseCondition(expr); err != nil {
+		v.addf(path, "invalid condition: %v", err)
+	}
+}
+
+// globs checks the path globs of a paths or paths_ignore filter.
+func (v *validator) globs(path string, globs []string) {
+	for i, g := range globs {
+		if g == "" || !validGlob(g) {
+			v.addf(fmt.Sprintf("%s[%d]", path, i), "invalid path glob %q", g)
+		}
+	}
+}
+
+// concurrencyPlaceholder matches a ${name} placeholder.
+var concurrencyPlaceholder = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// concurrency checks the concurrency group of the definition.
+func (v *validator) concurrency(c *Concurrency) {
+	if c == nil {
+		return
+	}
+	if strings.TrimSpace(c.Group) == "" {
+		v.addf("concurrency.group", "concurrency group is required")
+	}
+	for _, m := range concurrencyPlaceholder.FindAllStringSubmatch(c.Group, -1) {
+		if !slices.Contains(concurrencyVariables, m[1]) {
+			v.addf("concurrency.group", "unknown placeholder %s, expected ${%s}", m[0], strings.Join(concurrencyVariables, "} or ${"))
+		}
+	}
+}
+
+func (v *validator) commands(path string, commands []string) {
+	for k, c := range commands {
+		if strings.TrimSpace(c) == "" {
+			v.addf(fmt.Sprintf("%s[%d]", path, k), "command is empty")
+		}
+	}
+}
+
+// tasks checks the tasks of a step. When the step runs with services every
+// container needs an image, since services require the Docker executor.
+func (v *validator) tasks(path string, s *Stage, step *Step) {
+	// The image of a step extending a template's may come from it, and is
+	// checked once the definition is expanded.
+	withServices := len(s.StepServices(step)) > 0 && step.Extends == ""
+	if withServices && len(step.Tasks) == 0 && s.StepImage(step) == "" && len(step.Images) == 0 {
+		v.addf(path+".image", "step %q needs an image to run with services", step.Name)
+	}
+	names := make(map[string]bool, len(step.Tasks))
+	for i := range step.Tasks {
+		t := &step.Tasks[i]
+		tp := fmt.Sprintf("%s.tasks[%d]", path, i)
+		switch {
+		case t.Name == "":
+			v.addf(tp+".name", "task name is required")
+		case !namePattern.MatchString(t.Name):
+			v.addf(tp+".name", "task name %q may only contain letters, digits, '.', '_' and '-'", t.Name)
+		case names[t.Name]:
+			v.addf(tp+".name", "duplicate task name %q in step %q", t.Name, step.Name)
+		}
+		names[t.Name] = true
+		if len(t.Commands) == 0 {
+			v.addf(tp+".commands", "task %q has no commands", t.Name)
+		}
+		v.commands(tp+".commands", t.Commands)
+		v.env(tp+".env", t.Env)
+		if withServices && t.Image == "" && s.StepImage(step) == "" && len(step.Images) == 0 {
+			v.addf(tp+".image", "task %q needs an image to run with services", t.Name)
+		}
+	}
+}
+
+func (v *validator) services(path string, services []types.Service) {
+	names := make(map[string]bool, len(services))
+	for i := range services {
+		svc := &services[i]
+		sp := fmt.Sprintf("%s[%d]", path, i)
+		if err := types.ValidateServiceName(svc.Name); err != nil {
+			v.addf(sp+".name", "%v", err)
+		} else if names[svc.Name] {
+			v.addf(sp+".name", "duplicate service name %q", svc.Name)
+		}
+		names[svc.Name] = true
+		if svc.Image == "" {
+			v.addf(sp+".image", "service %q has no image", svc.Name)
+		}
+		v.env(sp+".env", svc.Env)
+	}
+}
+
+func (v *validator) resources(path string, r *types.Resources) {
+	if r == nil {
+		return
+	}
+	if _, _, err := (&types.Resources{CPU: r.CPU}).Limits(); err != nil {
+		v.addf(path+".cpu", "%v", err)
+	}
+	if _, _, err := (&types.Resources{Memory: r.Memory}).Limits(); err != nil {
+		v.addf(path+".memory", "%v", err)
+	}
+}
+
+// security checks the security context of a step, which only Linux
+// containers have.
+func (v *validator) security(path string, s *Stage, step *Step) {
+	if step.Security == nil {
+		return
+	}
+	if err := step.Security.Validate(); err != nil {
+		v.addf(path, "%v", err)
+	}
+	if os := s.StepOS(step); os != "" && os != "linux" {
+		v.addf(path, "step %q runs on %s, which has no container security settings", step.Name, os)
+	}
+}
+
+// platform checks the operating system and shell jobs ask for at path, and
+// that the shell, or the default on the operating system, runs on it.
+// images checks the architecture a step asks for and how its image is
+// picked by architecture. The image of a step extending a template's may
+// come from it, and is checked once the definition is expanded.
+func (v *validator) images(sp string, s *Stage, step *Step) {
+	if err := types.ValidateImages(step.Image, step.Images, false, step.Arch); err != nil {
+		v.addf(sp, "%v", err)
+	}
+	switch {
+	case !step.ResolveImage:
+	case len(step.Images) > 0:
+		v.addf(sp+".resolve_image", "step %q cannot have both images and resolve_image", step.Name)
+	case s.StepImage(step) == "" && step.Extends == "":
+		v.addf(sp+".resolve_image", "step %q has no image to resolve", step.Name)
+	}
+}
+
+func (v *validator) platform(path, os string, shell types.Shell) {
+	shell = types.ShellFor(os, shell)
+	if os != "" {
+		if err := types.ValidateOS(os); err != nil {
+			v.addf(path+".os", "%v", err)
+			return
+		}
+	}
+	switch {
+	case !shell.Valid():
+		v.addf(path+".shell", "unknown shell %q", shell)
+	case os != "" && !shell.RunsOn(os):
+		v.addf(path+".shell", "the %s shell does not run on %s", shell.Default(), os)
+	}
+}
+
+func (v *validator) requests(path string, r *types.ResourceRequests) {
+	if r == nil {
+		return
+	}
+	if _, err := (&types.ResourceRequests{CPU: r.CPU}).Amounts(); err != nil {
+		v.addf(path+".cpu", "%v", err)
+	}
+	if _, err := (&types.ResourceRequests{Memory: r.Memory}).Amounts(); err != nil {
+		v.addf(path+".memory", "%v", err)
+	}
+	if _, err := (&types.ResourceRequests{Disk: r.Disk}).Amounts(); err != nil {
+		v.addf(path+".disk", "%v", err)
+	}
+}
+
+func (v *validator) matrix(path string, m *Matrix) {
+	if len(m.Env)+len(m.Labels) == 0 {
+		v.addf(path, "matrix has no env or labels axes")
+		return
+	}
+	for _, name := range axisNames(m.Env) {
+		if !envKeyPattern.MatchString(name) {
+			v.addf(path+".env."+name, "invalid environment variable name %q", name)
+		}
+		if _, ok := m.Labels[name]; ok {
+			v.addf(path+".labels."+name, "matrix axis %q is declared in both env and labels", name)
+		}
+	}
+	for _, name := range axisNames(m.Labels) {
+		if err := types.ValidateLabels(map[string]string{name: ""}); err != nil {
+			v.addf(path+".labels."+name, "%v", err)
+			continue
+		}
+		for i, value := range m.Labels[name] {
+			if err := types.ValidateLabels(map[string]string{name: value}); err != nil {
+				v.addf(fmt.Sprintf("%s.labels.%s[%d]", path, name, i), "%v", err)
+			}
+		}
+	}
+	for _, axes := range []struct {
+		kind   string
+		values map[string][]string
+	}{{"env", m.Env}, {"labels", m.Labels}} {
+		for _, name := range axisNames(axes.values) {
+			values := axes.values[name]
+			ap := path + "." + axes.kind + "." + name
+			if len(values) == 0 {
+				v.addf(ap, "matrix axis %q has no values", name)
+			}
+			seen := make(map[string]bool, len(values))
+			for i, value := range values {
+				if seen[value] {
+					v.addf(fmt.Sprintf("%s[%d]", ap, i), "duplicate value %q for matrix axis %q", value, name)
+				}
+				seen[value] = true
+			}
+		}
+	}
+	if n := m.Size(); n > maxMatrixLegs {
+		v.addf(path, "matrix expands into %d jobs, at most %d are allowed", n, maxMatrixLegs)
+	}
+}
+
+func (v *validator) env(path string, env map[string]string) {
+	for k := range env {
+		if !envKeyPattern.MatchString(k) {
+			v.addf(path+"."+k, "invalid environment variable name %q", k)
+		}
+	}
+}
+
+func (v *validator) timeout(path string, d types.Duration) {
+	if d < 0 {
+		v.addf(path, "timeout must not be negative")
+	}
+}
+
+func (v *validator) labels(path string, labels map[string]string) {
+	if err := types.ValidateLabels(labels); err != nil {
+		v.addf(path, "%v", err)
+	}
+}
+
+func (v *validator) secrets(path string, entries []string) {
+	for i, entry := range entries {
+		if _, err := types.ParseSecretRef(entry); err != nil {
+			v.addf(fmt.Sprintf("%s[%d]", path, i), "invalid secret: %v", err)
+		}
+	}
+}
+
+// cycles reports dependency cycles between stages using a depth-first search.
+func (v *validator) cycles() {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	d := v.def
+	state := make(map[string]int, len(d.Stages))
+	index := make(map[string]int, len(d.Stages))
+	for i, s := range d.Stages {
+		index[s.Name] = i
+	}
+
+	var stack []string
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			start := 0
+			for i, n := range stack {
+				if n == name {
+					start = i
+				}
+			}
+			cycle := append(append([]string(nil), stack[start:]...), name)
+			v.addf(fmt.Sprintf("stages[%d].needs", index[name]), "dependency cycle: %s", strings.Join(cycle, " -> "))
+			return false
+		case done:
+			return true
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, need := range d.Stages[index[name]].Needs {
+			if !visit(need) {
+				return false
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return true
+	}
+	for _, s := range d.Stages {
+		if state[s.Name] == unvisited && !visit(s.Name) {
+			return
+		}
+	}
+}
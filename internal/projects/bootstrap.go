@@ -0,0 +1,257 @@
+// Package projects onboards repositories in one step: it creates their
+// project, registers the server's webhook on their SCM provider and checks
+// the pipeline file they carry, if any.
+package projects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"open-cicd/internal/orgs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/scm"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/webhooks"
+)
+
+var (
+	// ErrInvalidRepository is returned for repository URLs that do not
+	// name a repository.
+	ErrInvalidRepository = errors.New("invalid repository")
+	// ErrUnknownProvider is returned for repositories on a host no
+	// registered provider serves.
+	ErrUnknownProvider = errors.New("unknown SCM provider")
+	// ErrWebhooksNotConfigured is returned when the server cannot receive
+	// the repository's webhooks: it has no external URL, or no webhook
+	// secret for the repository.
+	ErrWebhooksNotConfigured = errors.New("webhooks are not configured")
+	// ErrProvider is returned when the SCM provider fails a request other
+	// than by refusing the credential or not finding the repository.
+	ErrProvider = errors.New("SCM provider request failed")
+	// ErrNoCredential is returned when the request gives no credential and
+	// the organization stores none with a token for the provider.
+	ErrNoCredential = errors.New("no SCM credential")
+)
+
+// Result is the outcome of bootstrapping a project.
+type Result struct {
+	Project       *types.Project `json:"project"`
+	Webhook       Webhook        `json:"webhook"`
+	DefaultBranch string         `json:"default_branch"`
+	// PipelineFile is the path of the pipeline definition found on the
+	// default branch; it is empty if the repository has none yet.
+	PipelineFile string `json:"pipeline_file,omitempty"`
+	// Validation is the dry run of the pipeline file for a push to the
+	// default branch, if there is one.
+	Validation *Validation `json:"validation,omitempty"`
+}
+
+// Webhook is the webhook registered on the repository.
+type Webhook struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+}
+
+// Validation is whether a pipeline file parses and validates and, if it
+// does, which stages and steps it would run.
+type Validation struct {
+	Valid  bool                `json:"valid"`
+	Errors pipeline.ErrorList  `json:"errors,omitempty"`
+	Plan   *types.PipelinePlan `json:"plan,omitempty"`
+}
+
+// provider is a registered RepositoryAPI.
+type provider struct {
+	api     scm.RepositoryAPI
+	host    string
+	secrets webhooks.Secrets
+}
+
+// OrganizationTokens looks up the access tokens organizations store for
+// providers, as credentials.Service does.
+type OrganizationTokens interface {
+	OrganizationToken(ctx context.Context, organization, provider string) (string, bool, error)
+}
+
+// Bootstrapper onboards repositories.
+type Bootstrapper struct {
+	orgs        *orgs.Service
+	templates   pipeline.TemplateLoader
+	externalURL string
+	providers   map[string]provider
+	credentials OrganizationTokens
+}
+
+// NewBootstrapper returns a Bootstrapper that creates projects with service,
+// expands the templates pipeline files include with templates and registers
+// webhooks delivering under externalURL.
+func NewBootstrapper(service *orgs.Service, templates pipeline.TemplateLoader, externalURL string) *Bootstrapper {
+	return &Bootstrapper{
+		orgs:        service,
+		templates:   templates,
+		externalURL: strings.TrimSuffix(externalURL, "/"),
+		providers:   make(map[string]provider),
+	}
+}
+
+// Register onboards repositories of the named provider, as in
+// types.Trigger.Provider, hosted on host, through api. Their webhooks are
+// registered with the secrets deliveries to /webhooks/<name> are
+// authenticated with.
+func (b *Bootstrapper) Register(name string, api scm.RepositoryAPI, host string, secrets webhooks.Secrets) {
+	b.providers[name] = provider{api: api, host: strings.ToLower(host), secrets: secrets}
+}
+
+// SetCredentials makes Bootstrap fall back to the credential the
+// organization stores for the provider when the request gives none.
+func (b *Bootstrapper) SetCredentials(credentials OrganizationTokens) {
+	b.credentials = credentials
+}
+
+// Bootstrap creates the project of the repository req names in its
+// organization and registers the server's webhook on it. The pipeline file
+// on the default branch, if any, is dry run for a push; an invalid one is
+// reported in the result but does not stop the project from being created.
+//
+// It fails with storage.ErrNotFound if the organization does not exist,
+// storage.ErrConflict if the project already does, scm.ErrNotFound or
+// scm.ErrAccessDenied if the credential cannot reach the repository, and
+// ErrInvalidRepository, ErrUnknownProvider, ErrNoCredential,
+// ErrWebhooksNotConfigured or ErrProvider.
+func (b *Bootstrapper) Bootstrap(ctx context.Context, req types.BootstrapProjectRequest) (*Result, error) {
+	host, path, err := scm.ParseRepositoryURL(req.RepositoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRepository, err)
+	}
+	name, p, err := b.provider(req.Provider, host)
+	if err != nil {
+		return nil, err
+	}
+	if b.externalURL == "" {
+		return nil, fmt.Errorf("%w: the server has no external URL for providers to deliver to", ErrWebhooksNotConfigured)
+	}
+	if _, err := b.orgs.Get(ctx, req.Organization); err != nil {
+		return nil, err
+	}
+	credential, err := b.credential(ctx, req, name)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := p.api.Repository(ctx, credential, path)
+	if err != nil {
+		return nil, providerError("reading repository "+path, err)
+	}
+	project := types.CreateProjectRequest{Name: repo.FullName}
+	if err := project.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRepository, err)
+	}
+	switch _, err := b.orgs.GetProject(ctx, repo.FullName); {
+	case err == nil:
+		return nil, fmt.Errorf("%w: project %s already exists", storage.ErrConflict, repo.FullName)
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	secret, ok := p.secrets.Lookup(repo.FullName)
+	if !ok {
+		return nil, fmt.Errorf("%w: the server has no %s webhook secret for %s", ErrWebhooksNotConfigured, name, repo.FullName)
+	}
+
+	result := &Result{DefaultBranch: repo.DefaultBranch}
+	source, err := p.api.File(ctx, credential, repo.FullName, repo.DefaultBranch, pipeline.DefaultFilename)
+	switch {
+	case err == nil:
+		result.PipelineFile = pipeline.DefaultFilename
+		result.Validation = b.validate(ctx, source, name, repo)
+	case !errors.Is(err, scm.ErrNotFound):
+		return nil, providerError("reading "+pipeline.DefaultFilename+" of "+repo.FullName, err)
+	}
+
+	hook := scm.Hook{URL: b.externalURL + "/webhooks/" + name, Secret: secret}
+	id, err := p.api.CreateHook(ctx, credential, repo.FullName, hook)
+	if err != nil {
+		return nil, providerError("registering webhook on "+repo.FullName, err)
+	}
+	result.Webhook = Webhook{Provider: name, ID: id, URL: hook.URL}
+
+	result.Project, err = b.orgs.CreateProject(ctx, req.Organization, project)
+	if err != nil {
+		// The project was created concurrently, or its organization
+		// deleted; the webhook stays, as deliveries for it are harmless.
+		slog.WarnContext(ctx, "Registered webhook of a project that could not be created", "project", repo.FullName, "provider", name, "hook_id", id, "error", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// credential returns the token the request gives, or else the one the
+// organization stores for the provider.
+func (b *Bootstrapper) credential(ctx context.Context, req types.BootstrapProjectRequest, provider string) (string, error) {
+	if req.Credential != "" {
+		return req.Credential, nil
+	}
+	if b.credentials != nil {
+		token, ok, err := b.credentials.OrganizationToken(ctx, req.Organization, provider)
+		if err != nil {
+			return "", fmt.Errorf("looking up the %s credential of %s: %w", provider, req.Organization, err)
+		}
+		if ok {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("%w: give a credential, or store a %s token or app for %s", ErrNoCredential, provider, req.Organization)
+}
+
+// provider returns the provider named, or that of host if name is empty.
+func (b *Bootstrapper) provider(name, host string) (string, provider, error) {
+	if name != "" {
+		p, ok := b.providers[name]
+		if !ok {
+			return "", provider{}, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+		}
+		return name, p, nil
+	}
+	for name, p := range b.providers {
+		if p.host == host {
+			return name, p, nil
+		}
+	}
+	return "", provider{}, fmt.Errorf("%w for host %s; set provider", ErrUnknownProvider, host)
+}
+
+// validate dry runs a pipeline file for a push to the default branch of
+// repo.
+func (b *Bootstrapper) validate(ctx context.Context, source []byte, provider string, repo *scm.Repository) *Validation {
+	def, _, err := pipeline.ParseExpanded(ctx, source, b.templates)
+	if err != nil {
+		var list pipeline.ErrorList
+		if !errors.As(err, &list) {
+			list = pipeline.ErrorList{{Message: err.Error()}}
+		}
+		return &Validation{Errors: list}
+	}
+	trigger := &types.Trigger{
+		Provider:   provider,
+		Event:      types.TriggerEventPush,
+		Repository: repo.FullName,
+		CloneURL:   repo.CloneURL,
+		Ref:        "refs/heads/" + repo.DefaultBranch,
+		Branch:     repo.DefaultBranch,
+	}
+	cond := pipeline.NewConditionContext(trigger, repo.FullName, trigger.Ref)
+	return &Validation{Valid: true, Plan: def.Plan(&cond)}
+}
+
+// providerError describes the failure of a request to a provider, wrapping
+// ErrProvider unless the provider refused the credential or found nothing.
+func providerError(action string, err error) error {
+	if errors.Is(err, scm.ErrNotFound) || errors.Is(err, scm.ErrAccessDenied) {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	return fmt.Errorf("%s: %w: %w", action, ErrProvider, err)
+}
@@ -0,0 +1,121 @@
+// Package ratelimit limits how often clients may call the API, with one
+// token bucket for each key, such as an API token or a source address.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have filled up again are
+// forgotten.
+const sweepInterval = time.Minute
+
+// Limiter hands out requests at a sustained rate per key, allowing bursts of
+// up to burst requests. A nil Limiter allows everything.
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing rate requests per second for each key, and
+// bursts of up to burst requests. A zero rate allows everything.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetRate changes the rate and burst of every key, such as when the
+// configuration is reloaded. Buckets keep the requests they hold, up to the
+// new burst; a zero rate allows everything and forgets them.
+func (l *Limiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+	if rate <= 0 {
+		clear(l.buckets)
+	}
+}
+
+// Allow takes a request from the bucket of key. If the bucket is empty it
+// reports false and how long it takes until the next request is allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.fill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// fill returns the tokens in b at now.
+func (l *Limiter) fill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// Run forgets full buckets every sweep interval until ctx is done, so that
+// keys seen once do not pile up. A full bucket behaves like a new one.
+func (l *Limiter) Run(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.sweep()
+		}
+	}
+}
+
+func (l *Limiter) sweep() {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if l.fill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RetryAfter formats a wait as the value of a Retry-After header, in whole
+// seconds rounded up so that clients do not retry too early.
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,300 @@
+// Package rbac decides what the caller of a request may do, based on roles
+// bound to users, teams and SSO groups per project. Anything not granted by
+// a binding is denied, and a token confined to an organization is denied
+// everything outside it whatever its bindings grant.
+package rbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrForbidden is returned when no role binding grants the requested action.
+var ErrForbidden = errors.New("permission denied")
+
+// Authorizer evaluates and manages role bindings and teams.
+type Authorizer struct {
+	store    storage.RBACStore
+	projects storage.OrganizationStore
+	now      func() time.Time
+}
+
+// NewAuthorizer returns an authorizer backed by store, which finds the
+// organizations owning projects in projects.
+func NewAuthorizer(store storage.RBACStore, projects storage.OrganizationStore) *Authorizer {
+	return &Authorizer{store: store, projects: projects, now: time.Now}
+}
+
+// Authorize returns nil if the caller in ctx may perform action on project,
+// and an error wrapping ErrForbidden otherwise. Resources outside any
+// project, such as agents and tokens, use types.AllProjects.
+func (a *Authorizer) Authorize(ctx context.Context, action types.Action, project string) error {
+	allowed, err := a.Filter(ctx, action)
+	if err != nil {
+		return err
+	}
+	if !allowed(project) {
+		return fmt.Errorf("%w: %s may not %s %s", ErrForbidden, caller(ctx), action, describe(project))
+	}
+	return nil
+}
+
+// Filter returns a predicate reporting whether the caller in ctx may perform
+// action on a project, for narrowing lists to what the caller may see.
+func (a *Authorizer) Filter(ctx context.Context, action types.Action) (func(project string) bool, error) {
+	token := auth.TokenFrom(ctx)
+	switch {
+	case token == nil:
+		return func(string) bool { return false }, nil
+	case token.ID == auth.BootstrapTokenID:
+		// The bootstrap token sets up the first bindings.
+		return func(string) bool { return true }, nil
+	case token.User == "":
+		return func(string) bool { return false }, nil
+	}
+
+	bindings, err := a.grants(ctx, token, action)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := a.projects.ListProjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading projects: %w", err)
+	}
+	owner := make(map[string]string, len(projects))
+	for _, p := range projects {
+		owner[p.Name] = p.Organization
+	}
+
+	// An organization's bindings only reach its own projects.
+	all := false
+	orgs := make(map[string]bool)
+	granted := make(map[string]bool)
+	for _, b := range bindings {
+		switch {
+		case b.Project == types.AllProjects && b.Organization == "":
+			all = true
+		case b.Project == types.AllProjects:
+			orgs[b.Organization] = true
+		case b.Organization == "" || owner[b.Project] == b.Organization:
+			granted[b.Project] = true
+		}
+	}
+	return func(project string) bool {
+		org := owner[project]
+		if token.Organization != "" && (org != token.Organization || project == types.AllProjects) {
+			return false
+		}
+		return all || (org != "" && orgs[org]) || (project != "" && granted[project])
+	}, nil
+}
+
+// AuthorizeOrganization returns nil if the caller in ctx may perform action
+// on the resources of org that belong to none of its projects, such as its
+// agents and tokens, and an error wrapping ErrForbidden otherwise. An empty
+// org means the server's own resources, like Authorize with
+// types.AllProjects.
+func (a *Authorizer) AuthorizeOrganization(ctx context.Context, action types.Action, org string) error {
+	allowed, err := a.FilterOrganizations(ctx, action)
+	if err != nil {
+		return err
+	}
+	if !allowed(org) {
+		return fmt.Errorf("%w: %s may not %s %s", ErrForbidden, caller(ctx), action, describeOrganization(org))
+	}
+	return nil
+}
+
+// FilterOrganizations returns a predicate reporting whether the caller in
+// ctx may perform action on the resources of an organization, for narrowing
+// lists of agents and tokens. That takes a binding on all projects, either
+// of the organization or of the whole server; only the latter reaches the
+// server's own resources, for which the organization is "".
+func (a *Authorizer) FilterOrganizations(ctx context.Context, action types.Action) (func(org string) bool, error) {
+	token := auth.TokenFrom(ctx)
+	switch {
+	case token == nil:
+		return func(string) bool { return false }, nil
+	case token.ID == auth.BootstrapTokenID:
+		return func(string) bool { return true }, nil
+	case token.User == "":
+		return func(string) bool { return false }, nil
+	}
+
+	bindings, err := a.grants(ctx, token, action)
+	if err != nil {
+		return nil, err
+	}
+	all := false
+	orgs := make(map[string]bool)
+	for _, b := range bindings {
+		switch {
+		case b.Project != types.AllProjects:
+		case b.Organization == "":
+			all = true
+		default:
+			orgs[b.Organization] = true
+		}
+	}
+	return func(org string) bool {
+		if token.Organization != "" && org != token.Organization {
+			return false
+		}
+		return all || (org != "" && orgs[org])
+	}, nil
+}
+
+// AuthorizeApproval returns nil if the caller in ctx is one of approvers,
+// by name or as a member of a team or SSO group, or if approvers is empty,
+// and an error wrapping ErrForbidden otherwise. It does not check the
+// caller's roles.
+func (a *Authorizer) AuthorizeApproval(ctx context.Context, approvers []types.Subject) error {
+	token := auth.TokenFrom(ctx)
+	if len(approvers) == 0 || (token != nil && token.ID == auth.BootstrapTokenID) {
+		return nil
+	}
+	if token != nil && token.User != "" {
+		teams, err := a.store.ListTeams(ctx)
+		if err != nil {
+			return fmt.Errorf("loading teams: %w", err)
+		}
+		for _, approver := range approvers {
+			switch approver.Kind {
+			case types.SubjectUser:
+				if approver.Name == token.User {
+					return nil
+				}
+			case types.SubjectTeam:
+				i := slices.IndexFunc(teams, func(t *types.Team) bool { return t.Name == approver.Name })
+				if i >= 0 && teams[i].HasMember(token.User) {
+					return nil
+				}
+			case types.SubjectGroup:
+				if slices.Contains(token.Groups, approver.Name) {
+					return nil
+				}
+			}
+		}
+	}
+	names := make([]string, len(approvers))
+	for i, approver := range approvers {
+		names[i] = approver.String()
+	}
+	return fmt.Errorf("%w: %s is not one of the approvers %s", ErrForbidden, caller(ctx), strings.Join(names, ", "))
+}
+
+// grants returns the bindings that grant action to the user of token,
+// directly, through a team or through an SSO group of the token's session.
+func (a *Authorizer) grants(ctx context.Context, token *types.APIToken, action types.Action) ([]*types.RoleBinding, error) {
+	bindings, err := a.store.ListRoleBindings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading role bindings: %w", err)
+	}
+	teams, err := a.store.ListTeams(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading teams: %w", err)
+	}
+	member := make(map[string]bool)
+	for _, t := range teams {
+		if t.HasMember(token.User) {
+			member[t.Name] = true
+		}
+	}
+	var granting []*types.RoleBinding
+	for _, b := range bindings {
+		applies := (b.Subject.Kind == types.SubjectUser && b.Subject.Name == token.User) ||
+			(b.Subject.Kind == types.SubjectTeam && member[b.Subject.Name]) ||
+			(b.Subject.Kind == types.SubjectGroup && slices.Contains(token.Groups, b.Subject.Name))
+		if applies && b.Role.Allows(action) {
+			granting = append(granting, b)
+		}
+	}
+	return granting, nil
+}
+
+// CreateBinding grants a role on a project to a user, team or SSO group.
+func (a *Authorizer) CreateBinding(ctx context.Context, req types.CreateRoleBindingRequest) (*types.RoleBinding, error) {
+	binding := &types.RoleBinding{
+		ID:           utils.NewID(),
+		Subject:      req.Subject,
+		Role:         req.Role,
+		Project:      req.Project,
+		Organization: req.Organization,
+		CreatedAt:    a.now(),
+	}
+	if err := a.store.CreateRoleBinding(ctx, binding); err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+// ListBindings returns every role binding.
+func (a *Authorizer) ListBindings(ctx context.Context) ([]*types.RoleBinding, error) {
+	return a.store.ListRoleBindings(ctx)
+}
+
+// DeleteBinding revokes a role binding.
+func (a *Authorizer) DeleteBinding(ctx context.Context, id string) error {
+	return a.store.DeleteRoleBinding(ctx, id)
+}
+
+// PutTeam creates a team or replaces its members.
+func (a *Authorizer) PutTeam(ctx context.Context, name string, members []string) (*types.Team, error) {
+	team := &types.Team{Name: name, Members: members, UpdatedAt: a.now()}
+	if team.Members == nil {
+		team.Members = []string{}
+	}
+	if err := a.store.PutTeam(ctx, team); err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// ListTeams returns every team.
+func (a *Authorizer) ListTeams(ctx context.Context) ([]*types.Team, error) {
+	return a.store.ListTeams(ctx)
+}
+
+// DeleteTeam removes a team. Bindings to it stop granting anything.
+func (a *Authorizer) DeleteTeam(ctx context.Context, name string) error {
+	return a.store.DeleteTeam(ctx, name)
+}
+
+func caller(ctx context.Context) string {
+	token := auth.TokenFrom(ctx)
+	switch {
+	case token == nil:
+		return "anonymous caller"
+	case token.User == "":
+		return "token " + token.Name
+	default:
+		return "user " + token.User
+	}
+}
+
+func describeOrganization(org string) string {
+	if org == "" {
+		return "resources outside any organization"
+	}
+	return "organization " + org
+}
+
+func describe(project string) string {
+	switch project {
+	case types.AllProjects:
+		return "all projects"
+	case "":
+		return "jobs outside any project"
+	default:
+		return "project " + project
+	}
+}
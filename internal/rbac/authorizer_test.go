@@ -0,0 +1,94 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+func TestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	if err := store.CreateOrganization(ctx, &types.Organization{Name: "globex"}); err != nil {
+		t.Fatalf("CreateOrganization: %v", err)
+	}
+	if err := store.CreateProject(ctx, &types.Project{Name: "globex/site", Organization: "globex"}); err != nil {
+		t.Fatalf("CreateProject: %v", err)
+	}
+	a := NewAuthorizer(store, store)
+	for _, req := range []types.CreateRoleBindingRequest{
+		{Subject: types.Subject{Kind: types.SubjectUser, Name: "viewer"}, Role: types.RoleViewer, Project: "acme/app"},
+		{Subject: types.Subject{Kind: types.SubjectUser, Name: "dev"}, Role: types.RoleDeveloper, Project: "acme/app"},
+		{Subject: types.Subject{Kind: types.SubjectUser, Name: "root"}, Role: types.RoleAdmin, Project: types.AllProjects},
+		{Subject: types.Subject{Kind: types.SubjectTeam, Name: "web"}, Role: types.RoleDeveloper, Project: "acme/web"},
+		{Subject: types.Subject{Kind: types.SubjectTeam, Name: "gone"}, Role: types.RoleAdmin, Project: types.AllProjects},
+		{Subject: types.Subject{Kind: types.SubjectUser, Name: "gadmin"}, Role: types.RoleAdmin, Project: types.AllProjects, Organization: "globex"},
+		{Subject: types.Subject{Kind: types.SubjectUser, Name: "gdev"}, Role: types.RoleDeveloper, Project: "acme/app", Organization: "globex"},
+	} {
+		if _, err := a.CreateBinding(ctx, req); err != nil {
+			t.Fatalf("CreateBinding: %v", err)
+		}
+	}
+	if _, err := a.PutTeam(ctx, "web", []string{"alice"}); err != nil {
+		t.Fatalf("PutTeam: %v", err)
+	}
+	if _, err := a.PutTeam(ctx, "gone", []string{"mallory"}); err != nil {
+		t.Fatalf("PutTeam: %v", err)
+	}
+	if err := a.DeleteTeam(ctx, "gone"); err != nil {
+		t.Fatalf("DeleteTeam: %v", err)
+	}
+
+	user := func(name string) *types.APIToken { return &types.APIToken{ID: "t-" + name, Name: name, User: name} }
+	orgToken := func(name, org string) *types.APIToken {
+		return &types.APIToken{ID: "t-" + name, Name: name, User: name, Organization: org}
+	}
+	tests := []struct {
+		name    string
+		token   *types.APIToken
+		action  types.Action
+		project string
+		allowed bool
+	}{
+		{"anonymous", nil, types.ActionView, "acme/app", false},
+		{"token without a user", &types.APIToken{ID: "t", Name: "ci"}, types.ActionView, "acme/app", false},
+		{"bootstrap token", &types.APIToken{ID: auth.BootstrapTokenID}, types.ActionManage, types.AllProjects, true},
+		{"viewer views", user("viewer"), types.ActionView, "acme/app", true},
+		{"viewer cannot run", user("viewer"), types.ActionRun, "acme/app", false},
+		{"viewer sees only its project", user("viewer"), types.ActionView, "acme/web", false},
+		{"developer runs", user("dev"), types.ActionRun, "acme/app", true},
+		{"developer cannot manage", user("dev"), types.ActionManage, "acme/app", false},
+		{"binding on all projects", user("root"), types.ActionManage, "acme/other", true},
+		{"binding on all projects covers no project", user("root"), types.ActionRun, "", true},
+		{"project binding does not cover no project", user("dev"), types.ActionView, "", false},
+		{"team member", user("alice"), types.ActionRun, "acme/web", true},
+		{"team member elsewhere", user("alice"), types.ActionView, "acme/app", false},
+		{"member of a deleted team", user("mallory"), types.ActionView, "acme/app", false},
+		{"unbound user", user("stranger"), types.ActionView, "acme/app", false},
+		{"organization binding", user("gadmin"), types.ActionManage, "globex/site", true},
+		{"organization binding elsewhere", user("gadmin"), types.ActionView, "acme/app", false},
+		{"organization binding covers no project", user("gadmin"), types.ActionView, "", false},
+		{"organization binding on a foreign project", user("gdev"), types.ActionView, "acme/app", false},
+		{"organization token in its organization", orgToken("root", "globex"), types.ActionManage, "globex/site", true},
+		{"organization token elsewhere", orgToken("root", "globex"), types.ActionView, "acme/app", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := ctx
+			if tt.token != nil {
+				ctx = auth.WithToken(ctx, tt.token)
+			}
+			err := a.Authorize(ctx, tt.action, tt.project)
+			if tt.allowed && err != nil {
+				t.Errorf("Authorize = %v, want nil", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrForbidden) {
+				t.Errorf("Authorize = %v, want %v", err, ErrForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Package registry reads image manifests from container registries over
+// the OCI distribution API, to find the architectures a multi-arch image
+// is built for and the digest of the variant for each.
+package registry
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requestTimeout bounds every API call.
+	requestTimeout = 15 * time.Second
+	// cacheTTL is how long resolved images are remembered, so that the
+	// jobs of a run, and runs started together, look an image up once.
+	cacheTTL = 5 * time.Minute
+	// maxBody caps the manifests and tokens read.
+	maxBody = 4 << 20
+)
+
+// Media types of the manifests the client reads.
+const (
+	mediaOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Client resolves images against their registries, anonymously or with
+// the credentials configured for each registry host.
+type Client struct {
+	http        *http.Client
+	credentials map[string]string
+	now         func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+// cached is an image resolved at some time.
+type cached struct {
+	variants map[string]string
+	at       time.Time
+}
+
+// NewClient returns a Client. credentials maps registry hosts, such as
+// ghcr.io or docker.io, to the user:password to authenticate with.
+func NewClient(credentials map[string]string) *Client {
+	return &Client{
+		http:        &http.Client{Timeout: requestTimeout},
+		credentials: credentials,
+		now:         time.Now,
+		cache:       make(map[string]cached),
+	}
+}
+
+// Resolve returns the variants of image for the operating system os,
+// pinned by digest and keyed by architecture, such as
+// {"amd64": "node@sha256:...", "arm64": "node@sha256:..."}. An image that
+// is not multi-arch has a single variant, for the architecture it was
+// built for.
+func (c *Client) Resolve(ctx context.Context, image, os string) (map[string]string, error) {
+	key := os + " " + image
+	c.mu.Lock()
+	hit, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(hit.at) < cacheTTL {
+		return maps.Clone(hit.variants), nil
+	}
+
+	ref, err := parseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{client: c, ref: ref}
+	body, mediaType, err := s.get(ctx, "manifests/"+ref.ref(), mediaOCIIndex, mediaDockerList, mediaOCIManifest, mediaDockerManifest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+		Manifests []struct {
+			Digest   string   `json:"digest"`
+			Platform platform `json:"platform"`
+		} `json:"manifests"`
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest of %s: %w", image, err)
+	}
+	mediaType = cmp.Or(mediaType, manifest.MediaType)
+
+	variants := make(map[string]string)
+	switch mediaType {
+	case mediaOCIIndex, mediaDockerList:
+		for _, m := range manifest.Manifests {
+			// Attestations are listed with the unknown platform.
+			if m.Platform.OS != os || m.Platform.Architecture == "unknown" {
+				continue
+			}
+			if _, ok := variants[m.Platform.Architecture]; !ok {
+				variants[m.Platform.Architecture] = ref.pinned(m.Digest)
+			}
+		}
+	case mediaOCIManifest, mediaDockerManifest:
+		// A single image says its platform in its config.
+		if manifest.Config.Digest == "" {
+			return nil, fmt.Errorf("manifest of %s has no config", image)
+		}
+		config, _, err := s.get(ctx, "blobs/"+manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var p platform
+		if err := json.Unmarshal(config, &p); err != nil {
+			return nil, fmt.Errorf("decoding config of %s: %w", image, err)
+		}
+		if p.OS == os {
+			sum := sha256.Sum256(body)
+			variants[p.Architecture] = ref.pinned("sha256:" + hex.EncodeToString(sum[:]))
+		}
+	default:
+		return nil, fmt.Errorf("manifest of %s has unsupported media type %q", image, mediaType)
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("image %s has no %s variant", image, os)
+	}
+
+	c.mu.Lock()
+	c.cache[key] = cached{variants: variants, at: c.now()}
+	c.mu.Unlock()
+	return maps.Clone(variants), nil
+}
+
+// platform is the platform of an image.
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// session makes the requests of one resolution, keeping the authorization
+// a registry asked for.
+type session struct {
+	client        *Client
+	ref           reference
+	authorization string
+}
+
+// get fetches path below the image's repository, such as manifests/latest,
+// and returns the body and its media type. A registry answering 401 is
+// asked for a token, or sent the configured credentials, and the request
+// tried once more.
+func (s *session) get(ctx context.Context, path string, accept ...string) ([]byte, string, error) {
+	u := s.ref.baseURL() + "/v2/" + s.ref.repository + "/" + path
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		resp, err := s.client.http.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			if err := s.authorize(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+		mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+		return body, strings.TrimSpace(mediaType), nil
+	}
+}
+
+// authorize answers the challenge of a registry: a Bearer challenge with a
+// token from its token service, a Basic one with the credentials.
+func (s *session) authorize(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	user, password, hasCredentials := strings.Cut(s.client.credentials[s.ref.host], ":")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredentials {
+			return fmt.Errorf("registry %s needs credentials", s.ref.host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, password)
+		s.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry %s asks for unsupported authentication %q", s.ref.host, scheme)
+	}
+	values := parseChallenge(params)
+	realm := values["realm"]
+	if realm == "" {
+		return fmt.Errorf("registry %s sent a Bearer challenge without a realm", s.ref.host)
+	}
+	q := url.Values{}
+	if service := values["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", cmp.Or(values["scope"], "repository:"+s.ref.repository+":pull"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if hasCredentials {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := s.client.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getting a token for %s: %s", s.ref.host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBody)).Decode(&token); err != nil {
+		return fmt.Errorf("decoding token for %s: %w", s.ref.host, err)
+	}
+	t := cmp.Or(token.Token, token.AccessToken)
+	if t == "" {
+		return errors.New("token service sent no token")
+	}
+	s.authorization = "Bearer " + t
+	return nil
+}
+
+// parseChallenge parses the key="value" parameters of a WWW-Authenticate
+// challenge.
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:end+1], rest[end+2:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return values
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dockerHub is the registry of images named without one, and dockerHubAPI
+// the host serving its API.
+const (
+	dockerHub    = "docker.io"
+	dockerHubAPI = "registry-1.docker.io"
+)
+
+// reference is a parsed image reference such as ghcr.io/acme/app:1.2.
+type reference struct {
+	// name is the image as written, without its tag or digest.
+	name string
+	// host is the registry, docker.io for images named without one, and
+	// repository the path within it, with library/ added for official
+	// Docker Hub images.
+	host       string
+	repository string
+	// tag or digest is what the reference picks, latest by default.
+	tag    string
+	digest string
+}
+
+// parseReference parses an image reference the way Docker does: the first
+// path component names the registry if it has a dot or port, or is
+// localhost.
+func parseReference(image string) (reference, error) {
+	var r reference
+	rest := image
+	if name, digest, ok := strings.Cut(rest, "@"); ok {
+		rest, r.digest = name, digest
+		if !strings.HasPrefix(digest, "sha256:") {
+			return reference{}, fmt.Errorf("image %q has an invalid digest", image)
+		}
+	}
+	if i := strings.LastIndexByte(rest, ':'); i > strings.LastIndexByte(rest, '/') {
+		rest, r.tag = rest[:i], rest[i+1:]
+	}
+	if rest == "" || strings.ContainsAny(rest, " \t") || strings.HasSuffix(rest, "/") {
+		return reference{}, fmt.Errorf("invalid image %q", image)
+	}
+	if r.tag == "" && r.digest == "" {
+		r.tag = "latest"
+	}
+	r.name = rest
+	first, path, ok := strings.Cut(rest, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.host, r.repository = first, path
+	} else {
+		r.host, r.repository = dockerHub, rest
+	}
+	if r.host == dockerHub && !strings.Contains(r.repository, "/") {
+		r.repository = "library/" + r.repository
+	}
+	return r, nil
+}
+
+// ref returns what a manifest request for the reference asks for.
+func (r reference) ref() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+// pinned returns the reference to the image with the given digest.
+func (r reference) pinned(digest string) string {
+	return r.name + "@" + digest
+}
+
+// baseURL returns the URL of the registry's API. Registries on localhost
+// are reached over plain HTTP, as Docker does.
+func (r reference) baseURL() string {
+	host := r.host
+	if host == dockerHub {
+		host = dockerHubAPI
+	}
+	if hostname, _, _ := strings.Cut(host, ":"); hostname == "localhost" || hostname == "127.0.0.1" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
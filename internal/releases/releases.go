@@ -0,0 +1,131 @@
+// Package releases holds the agent binaries the server hands out to agents
+// updating themselves, and the Ed25519 signatures agents check them against
+// before installing them.
+package releases
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"open-cicd/internal/version"
+)
+
+// binaryPrefix starts the file name of every agent binary in a release
+// directory, followed by the platform, as in open-cicd-agent-linux-amd64.
+// Windows binaries may end in .exe.
+const binaryPrefix = "open-cicd-agent-"
+
+// ErrNoBinary is returned when a release has no binary for a platform.
+var ErrNoBinary = errors.New("no agent binary for this platform")
+
+// Binary is the agent binary of a release for one platform.
+type Binary struct {
+	Version string
+	// Platform is the GOOS/GOARCH the binary runs on, such as linux/amd64.
+	Platform string
+	Path     string
+	Size     int64
+	// SHA256 is the hex digest of the binary and Signature the base64
+	// Ed25519 signature of Message for it.
+	SHA256    string
+	Signature string
+}
+
+// Release is one version of the agent, built for several platforms.
+type Release struct {
+	Version  string
+	binaries map[string]*Binary
+}
+
+// Load reads the agent binaries of version from dir and signs them with key.
+// Files not named after a platform are ignored; a release needs at least one
+// binary.
+func Load(dir, v string, key ed25519.PrivateKey) (*Release, error) {
+	if _, err := version.Parse(v); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading release directory: %w", err)
+	}
+	r := &Release{Version: v, binaries: make(map[string]*Binary)}
+	for _, e := range entries {
+		platform, ok := platformOf(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		b, err := load(filepath.Join(dir, e.Name()), v, platform, key)
+		if err != nil {
+			return nil, err
+		}
+		r.binaries[platform] = b
+	}
+	if len(r.binaries) == 0 {
+		return nil, fmt.Errorf("release directory %s has no %s<os>-<arch> binaries", dir, binaryPrefix)
+	}
+	return r, nil
+}
+
+// platformOf returns the platform an agent binary is named after.
+func platformOf(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, binaryPrefix)
+	if !ok {
+		return "", false
+	}
+	rest = strings.TrimSuffix(rest, ".exe")
+	goos, goarch, ok := strings.Cut(rest, "-")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "-") {
+		return "", false
+	}
+	return goos + "/" + goarch, true
+}
+
+func load(path, v, platform string, key ed25519.PrivateKey) (*Binary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening agent binary: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("reading agent binary %s: %w", path, err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	return &Binary{
+		Version:   v,
+		Platform:  platform,
+		Path:      path,
+		Size:      size,
+		SHA256:    digest,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, Message(v, platform, digest))),
+	}, nil
+}
+
+// Binary returns the release's binary for platform.
+func (r *Release) Binary(platform string) (*Binary, error) {
+	b, ok := r.binaries[platform]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoBinary, platform)
+	}
+	return b, nil
+}
+
+// Platforms lists the platforms the release has binaries for, sorted.
+func (r *Release) Platforms() []string {
+	platforms := make([]string, 0, len(r.binaries))
+	for p := range r.binaries {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
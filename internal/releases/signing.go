@@ -0,0 +1,64 @@
+package releases
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrBadSignature is returned when a binary was not signed with the key an
+// agent trusts.
+var ErrBadSignature = errors.New("agent binary signature does not verify")
+
+// Message is what the server signs for a binary. It names the version and
+// platform as well as the digest, so that a signed binary cannot be passed
+// off as another version, such as to downgrade agents to one with a known
+// flaw.
+func Message(version, platform, sha256 string) []byte {
+	return []byte("open-cicd agent " + version + " " + platform + " sha256:" + sha256)
+}
+
+// Verify checks signature, base64 encoded, against the Message for a binary.
+func Verify(key ed25519.PublicKey, version, platform, sha256, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, Message(version, platform, sha256), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParseSigningKey decodes a base64 Ed25519 private key, either its 32-byte
+// seed or the 64-byte key.
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("signing key is not base64: %w", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	default:
+		return nil, fmt.Errorf("signing key is %d bytes, expected a %d-byte seed or %d-byte key", len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64: %w", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, expected %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// PublicKey returns the base64 public key agents verify binaries signed with
+// key against.
+func PublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
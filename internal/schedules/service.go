@@ -0,0 +1,274 @@
+// Package schedules starts pipeline runs at the times given by cron
+// expressions. Schedules are persisted with the time they next run at, so
+// runs missed while the server was down are noticed when it comes back.
+package schedules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/webhooks"
+)
+
+const (
+	// pollInterval is how often due schedules are looked for. Cron
+	// expressions have minute resolution.
+	pollInterval = 10 * time.Second
+	// missedAfter is how late a run may start before it counts as missed,
+	// which is only the case when the server was down or the schedule could
+	// not be claimed for a while.
+	missedAfter = time.Minute
+	// triggerTimeout bounds fetching the pipeline file for a run.
+	triggerTimeout = time.Minute
+)
+
+// errUnchanged aborts a schedule update that turned out to be unnecessary.
+var errUnchanged = errors.New("schedule unchanged")
+
+// Service stores schedules and starts their runs.
+type Service struct {
+	store   storage.ScheduleStore
+	trigger *webhooks.Service
+	jobs    *jobs.Manager
+	now     func() time.Time
+}
+
+// NewService returns a Service that keeps schedules in store and starts
+// their runs with trigger. The job manager tells whether a schedule's
+// previous run is still active.
+func NewService(store storage.ScheduleStore, trigger *webhooks.Service, manager *jobs.Manager) *Service {
+	return &Service{store: store, trigger: trigger, jobs: manager, now: time.Now}
+}
+
+// Create records a new schedule on behalf of createdBy. Schedules are
+// enabled and catch up on missed runs unless the request says otherwise.
+func (s *Service) Create(ctx context.Context, req types.CreateScheduleRequest, createdBy string) (*types.Schedule, error) {
+	now := s.now()
+	schedule := &types.Schedule{
+		ID:           utils.NewID(),
+		Name:         req.Name,
+		Repository:   req.Repository,
+		CloneURL:     req.CloneURL,
+		Ref:          types.QualifyRef(req.Ref),
+		Cron:         strings.TrimSpace(req.Cron),
+		Timezone:     req.Timezone,
+		Enabled:      req.Enabled == nil || *req.Enabled,
+		SkipIfActive: req.SkipIfActive,
+		CatchUp:      req.CatchUp == nil || *req.CatchUp,
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.reschedule(schedule, now); err != nil {
+		return nil, err
+	}
+	if err := s.store.CreateSchedule(ctx, schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// Get returns the schedule with the given ID.
+func (s *Service) Get(ctx context.Context, id string) (*types.Schedule, error) {
+	return s.store.GetSchedule(ctx, id)
+}
+
+// List returns every schedule, oldest first.
+func (s *Service) List(ctx context.Context) ([]*types.Schedule, error) {
+	return s.store.ListSchedules(ctx)
+}
+
+// Update changes the fields set in req. The next run is worked out again
+// from now, so changing the timing or re-enabling a schedule does not
+// catch up on runs from before.
+func (s *Service) Update(ctx context.Context, id string, req types.UpdateScheduleRequest) (*types.Schedule, error) {
+	return s.store.UpdateSchedule(ctx, id, func(schedule *types.Schedule) error {
+		wasEnabled, cron, timezone := schedule.Enabled, schedule.Cron, schedule.Timezone
+		req.Apply(schedule)
+		now := s.now()
+		schedule.UpdatedAt = now
+		if schedule.Enabled == wasEnabled && schedule.Cron == cron && schedule.Timezone == timezone {
+			return nil
+		}
+		return s.reschedule(schedule, now)
+	})
+}
+
+// SetEnabled enables or disables a schedule.
+func (s *Service) SetEnabled(ctx context.Context, id string, enabled bool) (*types.Schedule, error) {
+	return s.Update(ctx, id, types.UpdateScheduleRequest{Enabled: &enabled})
+}
+
+// Delete removes a schedule. Runs it already started are not affected.
+func (s *Service) Delete(ctx context.Context, id string) error {
+	return s.store.DeleteSchedule(ctx, id)
+}
+
+// reschedule sets when an enabled schedule next runs after now, and clears
+// it for a disabled one.
+func (s *Service) reschedule(schedule *types.Schedule, now time.Time) error {
+	if !schedule.Enabled {
+		schedule.NextRunAt = nil
+		return nil
+	}
+	next, err := schedule.Next(now)
+	if err != nil {
+		return err
+	}
+	schedule.NextRunAt = next
+	return nil
+}
+
+// Run starts the runs of due schedules until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.runDue(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "running due schedules", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDue handles every schedule that is due, the longest overdue first.
+func (s *Service) runDue(ctx context.Context) error {
+	due, err := s.store.ListDueSchedules(ctx, s.now())
+	if err != nil {
+		return err
+	}
+	for _, schedule := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := s.runOne(ctx, schedule); err != nil {
+			slog.ErrorContext(ctx, "running schedule", "schedule_id", schedule.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// action is what a due schedule does this time round.
+type action int
+
+const (
+	actionRun action = iota
+	actionSkipActive
+	actionSkipMissed
+)
+
+// runOne claims a due run of schedule by moving its next run time on, then
+// starts the run unless it is to be skipped. Claiming first means that a
+// run is started at most once, even with several servers sharing a store.
+func (s *Service) runOne(ctx context.Context, schedule *types.Schedule) error {
+	active, err := s.previousActive(ctx, schedule)
+	if err != nil {
+		return err
+	}
+	var (
+		due  time.Time
+		todo action
+	)
+	claimed, err := s.store.UpdateSchedule(ctx, schedule.ID, func(sc *types.Schedule) error {
+		now := s.now()
+		if !sc.Enabled || sc.NextRunAt == nil || sc.NextRunAt.After(now) || !sc.NextRunAt.Equal(*schedule.NextRunAt) {
+			return errUnchanged
+		}
+		due = *sc.NextRunAt
+		switch {
+		case sc.SkipIfActive && active:
+			todo = actionSkipActive
+			sc.LastError = fmt.Sprintf("skipped the run due at %s: pipeline %s is still active", due.Format(time.RFC3339), sc.LastPipelineID)
+		case now.Sub(due) > missedAfter && !sc.CatchUp:
+			todo = actionSkipMissed
+			sc.LastError = fmt.Sprintf("skipped the runs missed since %s", due.Format(time.RFC3339))
+		default:
+			todo = actionRun
+			sc.LastRunAt = &now
+			sc.LastError = ""
+		}
+		sc.UpdatedAt = now
+		return s.reschedule(sc, now)
+	})
+	if errors.Is(err, errUnchanged) || errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch todo {
+	case actionSkipActive:
+		slog.InfoContext(ctx, "Skipped scheduled run, previous run still active", "schedule_id", claimed.ID, "due", due, "pipeline_id", claimed.LastPipelineID)
+		return nil
+	case actionSkipMissed:
+		slog.WarnContext(ctx, "Skipped missed scheduled runs", "schedule_id", claimed.ID, "since", due)
+		return nil
+	}
+
+	run, runErr := s.start(ctx, claimed)
+	_, err = s.store.UpdateSchedule(ctx, claimed.ID, func(sc *types.Schedule) error {
+		if runErr != nil {
+			sc.LastError = runErr.Error()
+		} else {
+			sc.LastPipelineID = run.ID
+		}
+		return nil
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		err = nil
+	}
+	if runErr != nil {
+		slog.WarnContext(ctx, "Scheduled run failed to start", "schedule_id", claimed.ID, "repository", claimed.Repository, "ref", claimed.Ref, "error", runErr)
+		return err
+	}
+	slog.InfoContext(ctx, "Schedule started pipeline", "schedule_id", claimed.ID, "repository", claimed.Repository, "ref", claimed.Ref, "due", due, "pipeline_id", run.ID)
+	return err
+}
+
+// previousActive reports whether the last run the schedule started has not
+// finished yet.
+func (s *Service) previousActive(ctx context.Context, schedule *types.Schedule) (bool, error) {
+	if !schedule.SkipIfActive || schedule.LastPipelineID == "" {
+		return false, nil
+	}
+	run, err := s.jobs.GetPipeline(ctx, schedule.LastPipelineID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting pipeline %s: %w", schedule.LastPipelineID, err)
+	}
+	return !run.State.Terminal(), nil
+}
+
+// start triggers a run of the pipeline file at the schedule's ref.
+func (s *Service) start(ctx context.Context, schedule *types.Schedule) (*types.Pipeline, error) {
+	ctx, cancel := context.WithTimeout(ctx, triggerTimeout)
+	defer cancel()
+	branch, ok := strings.CutPrefix(schedule.Ref, "refs/heads/")
+	if !ok {
+		branch = ""
+	}
+	return s.trigger.Trigger(ctx, &types.Trigger{
+		Event:      types.TriggerEventSchedule,
+		Repository: schedule.Repository,
+		CloneURL:   schedule.CloneURL,
+		Ref:        schedule.Ref,
+		Branch:     branch,
+		Actor:      schedule.CreatedBy,
+		Schedule:   schedule.ID,
+	})
+}
@@ -0,0 +1,193 @@
+package scm
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// githubStates maps status states to GitHub's, which have no running or
+// cancelled state.
+var githubStates = map[State]string{
+	StatePending:   "pending",
+	StateRunning:   "pending",
+	StateSuccess:   "success",
+	StateFailure:   "failure",
+	StateCancelled: "error",
+}
+
+// GitHub posts commit statuses through the GitHub REST API.
+type GitHub struct {
+	api  string
+	http *http.Client
+}
+
+// NewGitHub returns a GitHub client for the API at apiURL, such as
+// https://api.github.com or https://github.example.com/api/v3.
+func NewGitHub(apiURL string) *GitHub {
+	return &GitHub{api: strings.TrimSuffix(apiURL, "/"), http: &http.Client{}}
+}
+
+// PostStatus implements StatusPoster.
+func (g *GitHub) PostStatus(ctx context.Context, token string, status Status) error {
+	owner, repo, ok := strings.Cut(status.Repository, "/")
+	if !ok {
+		return errRepository(status.Repository)
+	}
+	body := map[string]string{
+		"state":       githubStates[status.State],
+		"context":     status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		body["target_url"] = status.TargetURL
+	}
+	p := "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo) + "/statuses/" + url.PathEscape(status.Commit)
+	return postJSON(ctx, g.http, g.api+p, g.headers(token), body)
+}
+
+// Host returns the host repositories served by the API are cloned from:
+// github.com for api.github.com, and the API host of Enterprise Servers.
+func (g *GitHub) Host() string {
+	u, err := url.Parse(g.api)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "api.github.com" {
+		return "github.com"
+	}
+	return host
+}
+
+// Repository implements RepositoryAPI.
+func (g *GitHub) Repository(ctx context.Context, token, repo string) (*Repository, error) {
+	p, err := githubRepoPath(repo)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+		CloneURL      string `json:"clone_url"`
+	}
+	if err := getJSON(ctx, g.http, g.api+p, g.headers(token), &resp); err != nil {
+		return nil, err
+	}
+	return &Repository{FullName: resp.FullName, DefaultBranch: resp.DefaultBranch, CloneURL: resp.CloneURL}, nil
+}
+
+// File implements RepositoryAPI.
+func (g *GitHub) File(ctx context.Context, token, repo, ref, path string) ([]byte, error) {
+	p, err := githubRepoPath(repo)
+	if err != nil {
+		return nil, err
+	}
+	headers := g.headers(token)
+	headers["Accept"] = "application/vnd.github.raw"
+	u := g.api + p + "/contents/" + escapePath(path) + "?ref=" + url.QueryEscape(ref)
+	return send(ctx, g.http, http.MethodGet, u, headers, nil)
+}
+
+// CreateHook implements RepositoryAPI, subscribing to pushes, tags
+// included, and pull requests.
+func (g *GitHub) CreateHook(ctx context.Context, token, repo string, hook Hook) (string, error) {
+	p, err := githubRepoPath(repo)
+	if err != nil {
+		return "", err
+	}
+	body := map[string]any{
+		"name":   "web",
+		"active": true,
+		"events": []string{"push", "pull_request"},
+		"config": map[string]string{
+			"url":          hook.URL,
+			"content_type": "json",
+			"secret":       hook.Secret,
+			"insecure_ssl": "0",
+		},
+	}
+	data, err := send(ctx, g.http, http.MethodPost, g.api+p+"/hooks", g.headers(token), body)
+	if err != nil {
+		return "", err
+	}
+	return hookID(data)
+}
+
+// InstallationToken signs in as the GitHub App appID with its private key
+// and returns a token of its installation installationID, which GitHub
+// lets expire after an hour, and when it expires.
+func (g *GitHub) InstallationToken(ctx context.Context, appID, installationID int64, key *rsa.PrivateKey) (string, time.Time, error) {
+	now := time.Now()
+	// GitHub allows for clock drift by accepting tokens issued up to a
+	// minute ahead, and takes them for ten minutes at most.
+	jwt, err := appJWT(appID, key, now.Add(-time.Minute), now.Add(9*time.Minute))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	u := g.api + "/app/installations/" + strconv.FormatInt(installationID, 10) + "/access_tokens"
+	data, err := send(ctx, g.http, http.MethodPost, u, g.headers(jwt), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding installation token: %w", err)
+	}
+	if resp.Token == "" {
+		return "", time.Time{}, errors.New("GitHub returned no installation token")
+	}
+	return resp.Token, resp.ExpiresAt, nil
+}
+
+// appJWT returns the JSON Web Token a GitHub App authenticates as itself
+// with, signed with RS256.
+func appJWT(appID int64, key *rsa.PrivateKey, issued, expires time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iat": issued.Unix(),
+		"exp": expires.Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing app token: %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (g *GitHub) headers(token string) map[string]string {
+	return map[string]string{
+		"Authorization":        "Bearer " + token,
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+}
+
+// githubRepoPath returns the API path of repo.
+func githubRepoPath(repo string) (string, error) {
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok || strings.Contains(name, "/") {
+		return "", errRepository(repo)
+	}
+	return "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name), nil
+}
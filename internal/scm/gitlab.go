@@ -0,0 +1,103 @@
+package scm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitlabStates maps status states to GitLab's commit status states.
+var gitlabStates = map[State]string{
+	StatePending:   "pending",
+	StateRunning:   "running",
+	StateSuccess:   "success",
+	StateFailure:   "failed",
+	StateCancelled: "canceled",
+}
+
+// GitLab posts commit statuses through the GitLab REST API.
+type GitLab struct {
+	base string
+	http *http.Client
+}
+
+// NewGitLab returns a GitLab client for the instance at baseURL, such as
+// https://gitlab.com.
+func NewGitLab(baseURL string) *GitLab {
+	return &GitLab{base: strings.TrimSuffix(baseURL, "/"), http: &http.Client{}}
+}
+
+// PostStatus implements StatusPoster.
+func (g *GitLab) PostStatus(ctx context.Context, token string, status Status) error {
+	if !strings.Contains(status.Repository, "/") {
+		return errRepository(status.Repository)
+	}
+	body := map[string]string{
+		"state":       gitlabStates[status.State],
+		"name":        status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		body["target_url"] = status.TargetURL
+	}
+	// Projects are addressed by their URL-encoded path, slashes included.
+	p := "/api/v4/projects/" + url.PathEscape(status.Repository) + "/statuses/" + url.PathEscape(status.Commit)
+	return postJSON(ctx, g.http, g.base+p, map[string]string{"PRIVATE-TOKEN": token}, body)
+}
+
+// Host returns the host of the instance, which repositories are cloned
+// from.
+func (g *GitLab) Host() string {
+	u, err := url.Parse(g.base)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Repository implements RepositoryAPI.
+func (g *GitLab) Repository(ctx context.Context, token, repo string) (*Repository, error) {
+	if !strings.Contains(repo, "/") {
+		return nil, errRepository(repo)
+	}
+	var resp struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+		HTTPURLToRepo     string `json:"http_url_to_repo"`
+	}
+	if err := getJSON(ctx, g.http, g.base+"/api/v4/projects/"+url.PathEscape(repo), map[string]string{"PRIVATE-TOKEN": token}, &resp); err != nil {
+		return nil, err
+	}
+	return &Repository{FullName: resp.PathWithNamespace, DefaultBranch: resp.DefaultBranch, CloneURL: resp.HTTPURLToRepo}, nil
+}
+
+// File implements RepositoryAPI.
+func (g *GitLab) File(ctx context.Context, token, repo, ref, path string) ([]byte, error) {
+	if !strings.Contains(repo, "/") {
+		return nil, errRepository(repo)
+	}
+	u := g.base + "/api/v4/projects/" + url.PathEscape(repo) + "/repository/files/" + url.PathEscape(path) + "/raw?ref=" + url.QueryEscape(ref)
+	return send(ctx, g.http, http.MethodGet, u, map[string]string{"PRIVATE-TOKEN": token}, nil)
+}
+
+// CreateHook implements RepositoryAPI, subscribing to pushes, tag pushes
+// and merge requests.
+func (g *GitLab) CreateHook(ctx context.Context, token, repo string, hook Hook) (string, error) {
+	if !strings.Contains(repo, "/") {
+		return "", errRepository(repo)
+	}
+	body := map[string]any{
+		"url":                     hook.URL,
+		"token":                   hook.Secret,
+		"push_events":             true,
+		"tag_push_events":         true,
+		"merge_requests_events":   true,
+		"enable_ssl_verification": true,
+	}
+	data, err := send(ctx, g.http, http.MethodPost, g.base+"/api/v4/projects/"+url.PathEscape(repo)+"/hooks", map[string]string{"PRIVATE-TOKEN": token}, body)
+	if err != nil {
+		return "", err
+	}
+	return hookID(data)
+}
@@ -0,0 +1,89 @@
+package scm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when a repository or file does not exist, or
+	// the token may not see it.
+	ErrNotFound = errors.New("not found")
+	// ErrAccessDenied is returned when the provider refuses the token.
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// errRepository is returned for repository names a provider cannot address.
+func errRepository(repo string) error {
+	return fmt.Errorf("repository %q is not of the form owner/name", repo)
+}
+
+// postJSON sends body as JSON to u with the given headers and fails unless
+// the response is a success.
+func postJSON(ctx context.Context, client *http.Client, u string, headers map[string]string, body any) error {
+	_, err := send(ctx, client, http.MethodPost, u, headers, body)
+	return err
+}
+
+// send sends a request, with body encoded as JSON unless it is nil, and
+// returns the body of a successful response. Not found and authentication
+// failures wrap ErrNotFound and ErrAccessDenied.
+func send(ctx context.Context, client *http.Client, method, u string, headers map[string]string, body any) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			err = fmt.Errorf("%w: %w", ErrNotFound, err)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			err = fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+}
+
+// maxResponseBytes bounds the responses read from providers, pipeline files
+// included.
+const maxResponseBytes = 4 << 20
+
+// getJSON sends a GET request and decodes the JSON response into out.
+func getJSON(ctx context.Context, client *http.Client, u string, headers map[string]string, out any) error {
+	data, err := send(ctx, client, http.MethodGet, u, headers, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding response of %s: %w", u, err)
+	}
+	return nil
+}
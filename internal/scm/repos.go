@@ -0,0 +1,94 @@
+package scm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Repository is a repository as its provider describes it.
+type Repository struct {
+	// FullName is the path of the repository, such as owner/name or
+	// group/subgroup/name on GitLab.
+	FullName      string
+	DefaultBranch string
+	CloneURL      string
+}
+
+// Hook is a webhook to register on a repository.
+type Hook struct {
+	// URL receives the deliveries.
+	URL string
+	// Secret signs or authenticates the deliveries, as the provider does.
+	Secret string
+}
+
+// GitAuth is how git authenticates to a repository: with Username and
+// Password over HTTPS, or with the SSH private key SSHKey.
+type GitAuth struct {
+	Username string
+	Password string
+	SSHKey   string
+}
+
+// RepositoryAPI reads repositories and registers webhooks on one SCM
+// provider, with the access token of a user who may administer them.
+type RepositoryAPI interface {
+	Repository(ctx context.Context, token, repo string) (*Repository, error)
+	// File returns the contents of the file at path on ref. It fails with
+	// ErrNotFound if there is none.
+	File(ctx context.Context, token, repo, ref, path string) ([]byte, error)
+	// CreateHook registers hook for the events pipelines are triggered by
+	// and returns its ID.
+	CreateHook(ctx context.Context, token, repo string, hook Hook) (string, error)
+}
+
+// ParseRepositoryURL splits the URL of a repository, as an HTTPS URL such as
+// https://github.com/owner/name or an SSH one such as
+// git@github.com:owner/name.git, into its host and path.
+func ParseRepositoryURL(raw string) (host, repo string, err error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		// scp-like SSH syntax: [user@]host:path
+		if at := strings.Index(raw, "@"); at >= 0 {
+			raw = raw[at+1:]
+		}
+		h, p, ok := strings.Cut(raw, ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid repository URL %q", raw)
+		}
+		raw = "ssh://" + h + "/" + p
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository URL: %w", err)
+	}
+	repo = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Hostname() == "" || !strings.Contains(repo, "/") {
+		return "", "", fmt.Errorf("repository URL %q does not name a host and an owner/name path", raw)
+	}
+	return strings.ToLower(u.Hostname()), repo, nil
+}
+
+// hookID reads the numeric ID of a created hook from the response.
+func hookID(data []byte) (string, error) {
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("decoding created hook: %w", err)
+	}
+	return strconv.FormatInt(resp.ID, 10), nil
+}
+
+// escapePath escapes each segment of a file path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,343 @@
+// Package scm reports the status of pipeline runs back to the SCM providers
+// their commits came from, so that commits and pull requests show build
+// status inline, along with a status of its own for each check the project
+// requires. Each provider implements StatusPoster; the Reporter picks the
+// one a run was triggered from and the repository's access token.
+// Providers also implement RepositoryAPI, through which projects are
+// onboarded with their webhooks registered for them.
+package scm
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+const (
+	// queueSize bounds the statuses waiting to be posted. Statuses beyond it
+	// are dropped rather than holding up pipeline state changes.
+	queueSize = 256
+	// postTimeout bounds posting a single status.
+	postTimeout = 15 * time.Second
+	// wildcardRepo is the Tokens key used for repositories without their
+	// own entry.
+	wildcardRepo = "*"
+)
+
+// State is the state of a commit status, common to all providers.
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StateSuccess   State = "success"
+	StateFailure   State = "failure"
+	StateCancelled State = "cancelled"
+)
+
+// Status is a commit status to post.
+type Status struct {
+	Repository string
+	Commit     string
+	State      State
+	// Context names the check the status belongs to, so that later statuses
+	// replace earlier ones.
+	Context     string
+	Description string
+	// TargetURL links the status to its run; it may be empty.
+	TargetURL string
+}
+
+// StatusPoster sets commit statuses on one SCM provider.
+type StatusPoster interface {
+	PostStatus(ctx context.Context, token string, status Status) error
+}
+
+// Tokens maps repositories (owner/name) to the access tokens their statuses
+// are posted with.
+type Tokens map[string]string
+
+// Lookup returns the token of repo, falling back to the wildcard entry.
+func (t Tokens) Lookup(repo string) (string, bool) {
+	for k, token := range t {
+		if strings.EqualFold(k, repo) {
+			return token, true
+		}
+	}
+	token, ok := t[wildcardRepo]
+	return token, ok
+}
+
+// TokenSource looks up the access tokens stored for repositories, as
+// credentials.Service does.
+type TokenSource interface {
+	// Token returns the token of repo on the named provider; ok is false if
+	// none is stored.
+	Token(ctx context.Context, provider, repo string) (token string, ok bool, err error)
+}
+
+// CheckSource works out the state of the checks projects require of their
+// runs.
+type CheckSource interface {
+	// Results returns the run with the given ID and the state of each
+	// check its project requires of it.
+	Results(ctx context.Context, pipelineID string) (*types.Pipeline, []types.CheckResult, error)
+}
+
+// provider is a registered StatusPoster and its tokens.
+type provider struct {
+	poster StatusPoster
+	tokens Tokens
+}
+
+// queued is a status waiting to be posted to a provider, or the run whose
+// required checks are to be posted if pipelineID is set.
+type queued struct {
+	provider   string
+	status     Status
+	pipelineID string
+}
+
+// Reporter posts the status of pipeline runs as they change state.
+type Reporter struct {
+	providers   map[string]provider
+	externalURL string
+	queue       chan queued
+	checks      CheckSource
+	credentials TokenSource
+
+	// mu guards refreshing, the runs queued for their checks to be posted,
+	// so that a run is queued once however many of its jobs change.
+	mu         sync.Mutex
+	refreshing map[string]bool
+	// posted is the state last posted for each run and check context, so
+	// that a check is posted again only when its state changes. Only Run
+	// uses it.
+	posted map[string]State
+}
+
+// NewReporter returns a Reporter that links statuses to runs under
+// externalURL, if it is not empty.
+func NewReporter(externalURL string) *Reporter {
+	return &Reporter{
+		providers:   make(map[string]provider),
+		externalURL: strings.TrimSuffix(externalURL, "/"),
+		queue:       make(chan queued, queueSize),
+		refreshing:  make(map[string]bool),
+		posted:      make(map[string]State),
+	}
+}
+
+// Register posts the statuses of runs triggered from the named provider,
+// as in types.Trigger.Provider, with poster and tokens. It must be called
+// before Run.
+func (r *Reporter) Register(name string, poster StatusPoster, tokens Tokens) {
+	r.providers[name] = provider{poster: poster, tokens: tokens}
+}
+
+// SetChecks makes the Reporter post a status for each check the project of
+// a run requires, as source works them out. It must be called before Run.
+func (r *Reporter) SetChecks(source CheckSource) {
+	r.checks = source
+}
+
+// SetCredentials makes the Reporter post statuses with the tokens source
+// stores for repositories, in preference to the tokens providers were
+// registered with. It must be called before Run.
+func (r *Reporter) SetCredentials(source TokenSource) {
+	r.credentials = source
+}
+
+// Observe queues the status of a run that was created or changed state. It
+// is meant to be registered with jobs.Manager.ObservePipeline and never
+// blocks. Runs that were not triggered by a registered provider, or whose
+// repository has no token, are ignored; without credentials to look up,
+// before they are queued.
+func (r *Reporter) Observe(run *types.Pipeline) {
+	if run.Trigger == nil || run.Commit == "" {
+		return
+	}
+	p, ok := r.providers[run.Trigger.Provider]
+	if !ok {
+		return
+	}
+	if _, ok := p.tokens.Lookup(run.Repository); !ok && r.credentials == nil {
+		return
+	}
+	status := r.status(run)
+	select {
+	case r.queue <- queued{provider: run.Trigger.Provider, status: status}:
+	default:
+		slog.Warn("Dropped commit status, too many waiting to be posted", "pipeline_id", run.ID, "repository", run.Repository, "state", status.State)
+	}
+	r.refresh(run.ID)
+}
+
+// ObserveJob queues the required checks of the run of a job that was
+// created or changed state, since the stage a check follows may have
+// changed with it. It is meant to be registered with jobs.Manager.Observe
+// and never blocks.
+func (r *Reporter) ObserveJob(job *types.Job) {
+	if job.PipelineID != "" {
+		r.refresh(job.PipelineID)
+	}
+}
+
+// refresh queues the required checks of the run with the given ID, unless
+// they are queued already.
+func (r *Reporter) refresh(pipelineID string) {
+	if r.checks == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refreshing[pipelineID] {
+		return
+	}
+	select {
+	case r.queue <- queued{pipelineID: pipelineID}:
+		r.refreshing[pipelineID] = true
+	default:
+		slog.Warn("Dropped required checks, too many statuses waiting to be posted", "pipeline_id", pipelineID)
+	}
+}
+
+// status describes the state of run.
+func (r *Reporter) status(run *types.Pipeline) Status {
+	var state State
+	var description string
+	switch run.State {
+	case types.PipelineStatePending:
+		state, description = StatePending, "Queued"
+	case types.PipelineStateRunning:
+		state, description = StateRunning, "Running"
+	case types.PipelineStateSucceeded:
+		state, description = StateSuccess, "Pipeline succeeded"
+	case types.PipelineStateFailed:
+		state, description = StateFailure, "Pipeline failed"
+	case types.PipelineStateCancelled:
+		state, description = StateCancelled, "Pipeline was cancelled"
+	}
+	status := Status{
+		Repository:  run.Repository,
+		Commit:      run.Commit,
+		State:       state,
+		Context:     "open-cicd/" + run.Name,
+		Description: description,
+	}
+	if r.externalURL != "" {
+		status.TargetURL = r.externalURL + "/pipelines/" + run.ID
+	}
+	return status
+}
+
+// Run posts queued statuses until ctx is cancelled. Statuses are posted in
+// order, so a run's final status is never overtaken by an earlier one.
+func (r *Reporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-r.queue:
+			if q.pipelineID != "" {
+				r.postChecks(ctx, q.pipelineID)
+				continue
+			}
+			r.post(ctx, q.provider, q.status)
+		}
+	}
+}
+
+func (r *Reporter) post(ctx context.Context, name string, status Status) {
+	ctx, cancel := context.WithTimeout(ctx, postTimeout)
+	defer cancel()
+	token, ok := r.token(ctx, name, status.Repository)
+	if !ok {
+		return
+	}
+	p := r.providers[name]
+	if err := p.poster.PostStatus(ctx, token, status); err != nil {
+		slog.WarnContext(ctx, "Failed to post commit status", "provider", name, "repository", status.Repository, "commit", status.Commit, "state", status.State, "error", err)
+	}
+}
+
+// token returns the token the statuses of repo are posted with: the one
+// stored for it, if any, or else the one the provider was registered with.
+func (r *Reporter) token(ctx context.Context, provider, repo string) (string, bool) {
+	if r.credentials != nil {
+		token, ok, err := r.credentials.Token(ctx, provider, repo)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to look up SCM credential", "provider", provider, "repository", repo, "error", err)
+		}
+		if ok {
+			return token, true
+		}
+	}
+	return r.providers[provider].tokens.Lookup(repo)
+}
+
+// postChecks posts the state of each check the project of the run with the
+// given ID requires of it whose state changed since it was last posted.
+func (r *Reporter) postChecks(ctx context.Context, pipelineID string) {
+	r.mu.Lock()
+	delete(r.refreshing, pipelineID)
+	r.mu.Unlock()
+
+	run, results, err := r.checks.Results(ctx, pipelineID)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to work out required checks", "pipeline_id", pipelineID, "error", err)
+		return
+	}
+	if run.Trigger == nil || run.Commit == "" {
+		return
+	}
+	if _, ok := r.providers[run.Trigger.Provider]; !ok {
+		return
+	}
+	for _, result := range results {
+		if result.Check.Context == r.status(run).Context {
+			// The status of the whole run already goes by that name.
+			continue
+		}
+		status := Status{
+			Repository:  run.Repository,
+			Commit:      run.Commit,
+			State:       checkState(result.State),
+			Context:     result.Check.Context,
+			Description: result.Description,
+		}
+		if r.externalURL != "" {
+			status.TargetURL = r.externalURL + "/pipelines/" + run.ID
+		}
+		key := run.ID + " " + status.Context
+		if r.posted[key] == status.State {
+			continue
+		}
+		r.post(ctx, run.Trigger.Provider, status)
+		r.posted[key] = status.State
+	}
+	if run.State.Terminal() {
+		for _, result := range results {
+			delete(r.posted, run.ID+" "+result.Check.Context)
+		}
+	}
+}
+
+// checkState maps the state of a required check to that of its status.
+func checkState(state types.CheckState) State {
+	switch state {
+	case types.CheckRunning:
+		return StateRunning
+	case types.CheckSucceeded:
+		return StateSuccess
+	case types.CheckFailed:
+		return StateFailure
+	case types.CheckCancelled:
+		return StateCancelled
+	}
+	return StatePending
+}
@@ -0,0 +1,136 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps the per-secret data keys with master keys
+// it never reveals, in the manner of a KMS. An external KMS can implement
+// it in place of LocalKeys.
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the current master key and returns
+	// that key's ID along with the wrapped data key.
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by the master key keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// ErrUnknownKey is returned when a secret was sealed with a master key the
+// provider does not have.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// LocalKeys is a KeyProvider holding master keys in memory. The first key
+// wraps new data keys; the others are kept to unwrap secrets sealed before
+// a rotation.
+type LocalKeys struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseLocalKeys parses a comma-separated list of id=key pairs such as
+// "k2=BASE64,k1=BASE64", where each key is 32 bytes of standard base64.
+// The first pair is the primary key.
+func ParseLocalKeys(s string) (*LocalKeys, error) {
+	lk := &LocalKeys{keys: make(map[string]cipher.AEAD)}
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		// The entry is not quoted in errors since it may be a bare key.
+		id, encoded, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || encoded == "" {
+			return nil, fmt.Errorf("invalid master key entry %d, want id=base64", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s is not valid base64: %w", id, err)
+		}
+		if err := lk.add(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if lk.primary == "" {
+		return nil, errors.New("no master keys given")
+	}
+	return lk, nil
+}
+
+// NewEphemeralKeys returns a LocalKeys with a single random master key.
+// Secrets sealed with it cannot be read after a restart.
+func NewEphemeralKeys() (*LocalKeys, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	lk := &LocalKeys{keys: make(map[string]cipher.AEAD)}
+	if err := lk.add("ephemeral", key); err != nil {
+		return nil, err
+	}
+	return lk, nil
+}
+
+func (lk *LocalKeys) add(id string, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("master key %s must be 32 bytes, got %d", id, len(key))
+	}
+	if _, ok := lk.keys[id]; ok {
+		return fmt.Errorf("duplicate master key %s", id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	lk.keys[id] = aead
+	if lk.primary == "" {
+		lk.primary = id
+	}
+	return nil
+}
+
+func (lk *LocalKeys) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(lk.keys[lk.primary], dataKey, []byte(lk.primary))
+	return lk.primary, wrapped, err
+}
+
+func (lk *LocalKeys) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := lk.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the
+// result.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
@@ -0,0 +1,130 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Mask replaces secret values in job output.
+const Mask = "***"
+
+// minMaskLength is the length below which a value is not masked, since
+// replacing every occurrence of a one- or two-character value would mangle
+// the log without hiding anything.
+const minMaskLength = 4
+
+// Masker is a logs.Masker that hides the values of the secrets a job
+// declares. Values are resolved when the job's first chunk arrives and
+// forgotten once the job finishes.
+type Masker struct {
+	secrets *Service
+	jobs    *jobs.Manager
+
+	mu     sync.Mutex
+	values map[string][][]byte
+}
+
+// NewMasker returns a Masker resolving secrets with service. It observes
+// manager to forget the values of finished jobs.
+func NewMasker(service *Service, manager *jobs.Manager) *Masker {
+	m := &Masker{secrets: service, jobs: manager, values: make(map[string][][]byte)}
+	manager.Observe(m.jobChanged)
+	return m
+}
+
+func (m *Masker) jobChanged(job *types.Job) {
+	if job.State.Terminal() {
+		m.mu.Lock()
+		delete(m.values, job.ID)
+		m.mu.Unlock()
+	}
+}
+
+// Mask implements logs.Masker. A job's output is rejected rather than
+// stored unmasked if its secrets cannot be loaded.
+func (m *Masker) Mask(ctx context.Context, jobID string, data []byte) ([]byte, error) {
+	values, err := m.jobValues(ctx, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("loading secrets of job %s to mask its logs: %w", jobID, err)
+	}
+	for _, v := range values {
+		data = bytes.ReplaceAll(data, v, []byte(Mask))
+	}
+	return data, nil
+}
+
+// jobValues returns the byte strings to mask in the job's output, longest
+// first so that a value containing another is replaced whole.
+func (m *Masker) jobValues(ctx context.Context, jobID string) ([][]byte, error) {
+	m.mu.Lock()
+	values, ok := m.values[jobID]
+	m.mu.Unlock()
+	if ok {
+		return values, nil
+	}
+
+	job, err := m.jobs.Get(ctx, jobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(job.Secrets) > 0 {
+		// Missing secrets are not an error here; the scheduler fails jobs
+		// that declare them before they can produce output. Vault values
+		// are those read when the job was dispatched.
+		var names []string
+		for _, entry := range job.Secrets {
+			if ref, err := types.ParseSecretRef(entry); err == nil && !ref.Vault() {
+				names = append(names, ref.Name)
+			}
+		}
+		resolved, _, err := m.secrets.lookup(ctx, job.Repository, names)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range m.secrets.heldValues(job.ID) {
+			resolved[name] = value
+		}
+		values = maskValues(resolved)
+	}
+	if !job.State.Terminal() {
+		m.mu.Lock()
+		m.values[jobID] = values
+		m.mu.Unlock()
+	}
+	return values, nil
+}
+
+// maskValues returns each secret value, and each line of multi-line values,
+// that is long enough to mask.
+func maskValues(secrets map[string]string) [][]byte {
+	seen := make(map[string]bool)
+	var values [][]byte
+	add := func(v string) {
+		if len(v) >= minMaskLength && !seen[v] {
+			seen[v] = true
+			values = append(values, []byte(v))
+		}
+	}
+	for _, v := range secrets {
+		add(v)
+		if strings.Contains(v, "\n") {
+			for _, line := range strings.Split(v, "\n") {
+				add(strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
@@ -0,0 +1,176 @@
+// Package secrets stores per-project secrets encrypted at rest, resolves
+// them, and the secrets jobs reference in HashiCorp Vault, for the jobs that
+// declare them and masks their values in job logs.
+//
+// Values are sealed with envelope encryption: each secret has its own
+// random AES-256-GCM data key, and the data key is wrapped by a master key
+// held by a KeyProvider. Only the sealed value and wrapped key are stored.
+package secrets
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/vault"
+)
+
+// ErrNotDefined is returned when a job declares a secret its project does
+// not have.
+var ErrNotDefined = errors.New("secret is not defined")
+
+// Service stores and resolves secrets.
+type Service struct {
+	store storage.SecretStore
+	keys  KeyProvider
+	now   func() time.Time
+
+	// vault, if set, reads Vault references; held keeps what was read for
+	// each job until it finishes.
+	mu    sync.Mutex
+	vault *vault.Client
+	held  map[string]*held
+}
+
+// NewService returns a Service that keeps secrets in store, sealed with
+// data keys wrapped by keys.
+func NewService(store storage.SecretStore, keys KeyProvider) *Service {
+	return &Service{store: store, keys: keys, now: time.Now, held: make(map[string]*held)}
+}
+
+// additionalData binds a sealed value to the secret it belongs to, so that a
+// ciphertext copied to another secret's row fails to open.
+func additionalData(project, name string) []byte {
+	return []byte(project + "\x00" + name)
+}
+
+// Put stores value as the project's secret name, replacing any earlier
+// value, on behalf of updatedBy.
+func (s *Service) Put(ctx context.Context, project, name, value, updatedBy string) (*types.Secret, error) {
+	if err := types.ValidateSecretName(name); err != nil {
+		return nil, err
+	}
+	sealed, err := s.Seal(ctx, []byte(value), additionalData(project, name))
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	secret := &types.Secret{
+		Project:   project,
+		Name:      name,
+		UpdatedBy: updatedBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Sealed:    sealed,
+	}
+	previous, err := s.store.GetSecret(ctx, project, name)
+	switch {
+	case err == nil:
+		secret.CreatedAt = previous.CreatedAt
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	if err := s.store.PutSecret(ctx, secret); err != nil {
+		return nil, fmt.Errorf("storing secret: %w", err)
+	}
+	return secret, nil
+}
+
+// List returns the project's secrets ordered by name. Values are not
+// decrypted.
+func (s *Service) List(ctx context.Context, project string) ([]*types.Secret, error) {
+	return s.store.ListSecrets(ctx, project)
+}
+
+// Delete removes the project's secret name.
+func (s *Service) Delete(ctx context.Context, project, name string) error {
+	return s.store.DeleteSecret(ctx, project, name)
+}
+
+// Resolve decrypts the project's secrets with the given names. If any of
+// them is not defined the error wraps ErrNotDefined and lists them all.
+func (s *Service) Resolve(ctx context.Context, project string, names []string) (map[string]string, error) {
+	values, missing, err := s.lookup(ctx, project, names)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w in %s: %s", ErrNotDefined, project, strings.Join(missing, ", "))
+	}
+	return values, nil
+}
+
+// lookup decrypts the named secrets that exist and returns the names of
+// those that do not.
+func (s *Service) lookup(ctx context.Context, project string, names []string) (map[string]string, []string, error) {
+	values := make(map[string]string, len(names))
+	var missing []string
+	for _, name := range names {
+		secret, err := s.store.GetSecret(ctx, project, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			missing = append(missing, name)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := s.decrypt(ctx, secret)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypting secret %s of %s: %w", name, project, err)
+		}
+		values[name] = value
+	}
+	return values, missing, nil
+}
+
+func (s *Service) decrypt(ctx context.Context, secret *types.Secret) (string, error) {
+	plaintext, err := s.Open(ctx, secret.Sealed, additionalData(secret.Project, secret.Name))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Seal encrypts value with a data key of its own, wrapped by the master
+// key, for values kept encrypted elsewhere than in secrets, such as SCM
+// credentials. additional binds the sealed value to what it belongs to;
+// Open needs the same.
+func (s *Service) Seal(ctx context.Context, value, additional []byte) (types.SealedValue, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return types.SealedValue{}, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return types.SealedValue{}, err
+	}
+	ciphertext, err := seal(aead, value, additional)
+	if err != nil {
+		return types.SealedValue{}, fmt.Errorf("encrypting value: %w", err)
+	}
+	keyID, wrapped, err := s.keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return types.SealedValue{}, fmt.Errorf("wrapping data key: %w", err)
+	}
+	return types.SealedValue{KeyID: keyID, WrappedKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+// Open decrypts a value sealed by Seal with the same additional data.
+func (s *Service) Open(ctx context.Context, sealed types.SealedValue, additional []byte) ([]byte, error) {
+	dataKey, err := s.keys.UnwrapKey(ctx, sealed.KeyID, sealed.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, sealed.Ciphertext, additional)
+}
@@ -0,0 +1,177 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"open-cicd/internal/storage"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func mustKeys(t *testing.T, s string) *LocalKeys {
+	t.Helper()
+	keys, err := ParseLocalKeys(s)
+	if err != nil {
+		t.Fatalf("ParseLocalKeys: %v", err)
+	}
+	return keys
+}
+
+func TestParseLocalKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		primary string
+		wantErr string
+	}{
+		{"one key", "k1=" + testKey(1), "k1", ""},
+		{"first key is primary", "k2=" + testKey(2) + ", k1=" + testKey(1), "k2", ""},
+		{"empty", "", "", "no master keys"},
+		{"missing id", "=" + testKey(1), "", "want id=base64"},
+		{"not base64", "k1=***", "", "not valid base64"},
+		{"short key", "k1=" + base64.StdEncoding.EncodeToString([]byte("short")), "", "must be 32 bytes"},
+		{"duplicate id", "k1=" + testKey(1) + ",k1=" + testKey(2), "", "duplicate master key k1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ParseLocalKeys(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseLocalKeys error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLocalKeys: %v", err)
+			}
+			if keys.primary != tt.primary {
+				t.Errorf("primary key = %q, want %q", keys.primary, tt.primary)
+			}
+		})
+	}
+}
+
+func TestServiceSealsSecrets(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	s := NewService(store, mustKeys(t, "k1="+testKey(1)))
+	if _, err := s.Put(ctx, "acme/app", "TOKEN", "hunter22", "jdoe"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	stored, err := store.GetSecret(ctx, "acme/app", "TOKEN")
+	if err != nil {
+		t.Fatalf("GetSecret: %v", err)
+	}
+	if bytes.Contains(stored.Sealed.Ciphertext, []byte("hunter22")) || stored.Sealed.KeyID != "k1" {
+		t.Errorf("stored secret is not sealed with k1: %+v", stored.Sealed)
+	}
+
+	values, err := s.Resolve(ctx, "acme/app", []string{"TOKEN"})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if values["TOKEN"] != "hunter22" {
+		t.Errorf("resolved %q, want hunter22", values["TOKEN"])
+	}
+
+	// Secrets belong to their project.
+	_, err = s.Resolve(ctx, "acme/web", []string{"TOKEN", "OTHER"})
+	if !errors.Is(err, ErrNotDefined) || !strings.Contains(err.Error(), "TOKEN, OTHER") {
+		t.Errorf("Resolve in another project error = %v, want %v naming both secrets", err, ErrNotDefined)
+	}
+}
+
+func TestServiceRejectsMovedCiphertext(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	s := NewService(store, mustKeys(t, "k1="+testKey(1)))
+	for _, name := range []string{"A", "B"} {
+		if _, err := s.Put(ctx, "acme/app", name, "value-of-"+name, "jdoe"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	a, err := store.GetSecret(ctx, "acme/app", "A")
+	if err != nil {
+		t.Fatalf("GetSecret: %v", err)
+	}
+	b, err := store.GetSecret(ctx, "acme/app", "B")
+	if err != nil {
+		t.Fatalf("GetSecret: %v", err)
+	}
+	b.Sealed = a.Sealed
+	if err := store.PutSecret(ctx, b); err != nil {
+		t.Fatalf("PutSecret: %v", err)
+	}
+	if values, err := s.Resolve(ctx, "acme/app", []string{"B"}); err == nil {
+		t.Errorf("Resolve of a ciphertext moved from A = %q, want an error", values["B"])
+	}
+}
+
+func TestServiceKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	old := NewService(store, mustKeys(t, "k1="+testKey(1)))
+	if _, err := old.Put(ctx, "acme/app", "TOKEN", "hunter22", "jdoe"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rotated := NewService(store, mustKeys(t, "k2="+testKey(2)+",k1="+testKey(1)))
+	if values, err := rotated.Resolve(ctx, "acme/app", []string{"TOKEN"}); err != nil || values["TOKEN"] != "hunter22" {
+		t.Errorf("Resolve after rotation = %q, %v, want hunter22", values["TOKEN"], err)
+	}
+	if _, err := rotated.Put(ctx, "acme/app", "NEW", "value", "jdoe"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if stored, err := store.GetSecret(ctx, "acme/app", "NEW"); err != nil || stored.Sealed.KeyID != "k2" {
+		t.Fatalf("new secret not sealed with k2: %v", err)
+	}
+
+	dropped := NewService(store, mustKeys(t, "k2="+testKey(2)))
+	if _, err := dropped.Resolve(ctx, "acme/app", []string{"TOKEN"}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Resolve without k1 error = %v, want %v", err, ErrUnknownKey)
+	}
+	wrong := NewService(store, mustKeys(t, "k1="+testKey(9)))
+	if _, err := wrong.Resolve(ctx, "acme/app", []string{"TOKEN"}); err == nil {
+		t.Errorf("Resolve with another key under the same ID succeeded")
+	}
+}
+
+func TestMaskValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    []string
+	}{
+		{"short values are not masked", map[string]string{"A": "abc", "B": "abcd"}, []string{"abcd"}},
+		{"longest first", map[string]string{"A": "token", "B": "token-long"}, []string{"token-long", "token"}},
+		{"lines of multi-line values", map[string]string{"KEY": "line-one\r\nline-two"}, []string{"line-one\r\nline-two", "line-one", "line-two"}},
+		{"duplicates once", map[string]string{"A": "same-value", "B": "same-value"}, []string{"same-value"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range maskValues(tt.secrets) {
+				got = append(got, string(v))
+			}
+			for i := 1; i < len(got); i++ {
+				if len(got[i]) > len(got[i-1]) {
+					t.Errorf("maskValues = %q, want the longest first", got)
+				}
+			}
+			slices.Sort(got)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(got, want) {
+				t.Errorf("maskValues = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+	"open-cicd/internal/vault"
+)
+
+// revokeTimeout bounds revoking the leases of a finished job.
+const revokeTimeout = 30 * time.Second
+
+// errNoVault fails jobs referencing Vault secrets when no Vault is
+// configured. It wraps ErrNotDefined so that such jobs fail rather than
+// wait.
+var errNoVault = fmt.Errorf("%w: the server is not configured to read secrets from Vault", ErrNotDefined)
+
+// held is what the service keeps of the Vault secrets read for a job until
+// it finishes: the values, to mask in its logs, and the leases to revoke.
+type held struct {
+	values map[string]string
+	leases []string
+}
+
+// SetVault makes the service read the secrets jobs reference as
+// NAME=vault:<path>#<key> with client.
+func (s *Service) SetVault(client *vault.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vault = client
+}
+
+// ResolveJob resolves the secrets job declares: project secrets are
+// decrypted and Vault references read. The Vault values and the leases of
+// dynamic secrets are held for the job until Observe sees it finish, when
+// the leases are revoked; resolving the job again, as when it is
+// dispatched anew, revokes the earlier ones first. A project secret that
+// is not defined, or a Vault secret or key that does not exist or may not
+// be read, is reported with an error wrapping ErrNotDefined.
+func (s *Service) ResolveJob(ctx context.Context, job *types.Job) (map[string]string, error) {
+	var names []string
+	var refs []types.SecretRef
+	for _, entry := range job.Secrets {
+		ref, err := types.ParseSecretRef(entry)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Vault() {
+			refs = append(refs, ref)
+		} else {
+			names = append(names, ref.Name)
+		}
+	}
+	values, err := s.Resolve(ctx, job.Repository, names)
+	if err != nil || len(refs) == 0 {
+		return values, err
+	}
+	s.release(ctx, job.ID)
+	read, err := s.readVault(ctx, job.ID, refs)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range read {
+		values[name] = value
+	}
+	return values, nil
+}
+
+// readVault reads the Vault references of a job, each path once, and holds
+// what was read for it. Leases taken before an error are revoked.
+func (s *Service) readVault(ctx context.Context, jobID string, refs []types.SecretRef) (map[string]string, error) {
+	s.mu.Lock()
+	client := s.vault
+	s.mu.Unlock()
+	if client == nil {
+		return nil, errNoVault
+	}
+	h := &held{values: make(map[string]string, len(refs))}
+	secrets := make(map[string]*vault.Secret)
+	var missing []string
+	for _, ref := range refs {
+		secret, ok := secrets[ref.VaultPath]
+		if !ok {
+			var err error
+			secret, err = client.Read(ctx, ref.VaultPath)
+			switch {
+			case vault.IsNotFound(err), vault.IsForbidden(err):
+				missing = append(missing, fmt.Sprintf("%s (%s: %v)", ref.Name, ref.VaultPath, err))
+				continue
+			case err != nil:
+				s.revoke(ctx, client, h.leases)
+				return nil, fmt.Errorf("reading %s from Vault: %w", ref.VaultPath, err)
+			}
+			secrets[ref.VaultPath] = secret
+			if secret.LeaseID != "" {
+				h.leases = append(h.leases, secret.LeaseID)
+			}
+		}
+		value, ok := secret.Data[ref.VaultKey]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s (%s has no key %s)", ref.Name, ref.VaultPath, ref.VaultKey))
+			continue
+		}
+		h.values[ref.Name] = value
+	}
+	if len(missing) > 0 {
+		s.revoke(ctx, client, h.leases)
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w in Vault: %s", ErrNotDefined, strings.Join(missing, ", "))
+	}
+	s.mu.Lock()
+	s.held[jobID] = h
+	s.mu.Unlock()
+	return h.values, nil
+}
+
+// heldValues returns the Vault values held for a job.
+func (s *Service) heldValues(jobID string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.held[jobID]; ok {
+		return h.values
+	}
+	return nil
+}
+
+// Observe revokes the Vault leases of a job that finished, in the
+// background. It is meant to be registered with jobs.Manager.Observe and
+// never blocks.
+func (s *Service) Observe(job *types.Job) {
+	if !job.State.Terminal() {
+		return
+	}
+	s.mu.Lock()
+	_, ok := s.held[job.ID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+		defer cancel()
+		s.release(ctx, job.ID)
+	}()
+}
+
+// release forgets what was held for a job and revokes its leases.
+func (s *Service) release(ctx context.Context, jobID string) {
+	s.mu.Lock()
+	h, ok := s.held[jobID]
+	delete(s.held, jobID)
+	client := s.vault
+	s.mu.Unlock()
+	if ok && client != nil {
+		s.revoke(ctx, client, h.leases)
+	}
+}
+
+// revoke revokes leases, logging those that could not be; Vault revokes
+// them itself once they expire.
+func (s *Service) revoke(ctx context.Context, client *vault.Client, leases []string) {
+	for _, lease := range leases {
+		if err := client.Revoke(ctx, lease); err != nil {
+			slog.WarnContext(ctx, "Revoking Vault lease failed; it expires on its own", "lease_id", lease, "error", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package agentrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/certs"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/types"
+)
+
+// Metadata keys agents use to authenticate every call after registration.
+const (
+	agentIDKey       = "x-agent-id"
+	authorizationKey = "authorization"
+)
+
+type agentKey struct{}
+
+// agentFrom returns the authenticated agent stored in ctx by the interceptors.
+func agentFrom(ctx context.Context) *types.Agent {
+	agent, _ := ctx.Value(agentKey{}).(*types.Agent)
+	return agent
+}
+
+// authenticate verifies the agent ID and bearer credential in the incoming
+// metadata.
+func (s *Service) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := first(md.Get(agentIDKey))
+	credential, ok := strings.CutPrefix(first(md.Get(authorizationKey)), "Bearer ")
+	if id == "" || !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing agent credentials")
+	}
+	agent, err := s.registry.Authenticate(ctx, id, credential, peerFingerprint(ctx))
+	if errors.Is(err, scheduler.ErrInvalidCredential) ||
+		errors.Is(err, scheduler.ErrCertificateRequired) ||
+		errors.Is(err, scheduler.ErrCertificateMismatch) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "authenticating agent")
+	}
+	return context.WithValue(ctx, agentKey{}, agent), nil
+}
+
+// peerFingerprint returns the fingerprint of the verified client certificate
+// of the calling connection, or "" if it has none.
+func peerFingerprint(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return certs.PeerFingerprint(&info.State)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// unaryAuth authenticates every unary call except registration.
+func (s *Service) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if info.FullMethod == agentpb.AgentService_RegisterAgent_FullMethodName {
+		return handler(ctx, req)
+	}
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuth authenticates every streaming call.
+func (s *Service) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authedStream) Context() context.Context { return a.ctx }
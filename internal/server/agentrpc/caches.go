@@ -0,0 +1,153 @@
+package agentrpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// maxCacheBytes caps the size of a single cache a job saves, whatever the
+// quota of its project.
+const maxCacheBytes = 10 << 30
+
+// errCacheTooLarge is returned while reading an upload that goes past
+// maxCacheBytes.
+var errCacheTooLarge = fmt.Errorf("cache is larger than %d bytes", maxCacheBytes)
+
+// RestoreCache implements agentpb.AgentServiceServer. Jobs may only restore
+// the caches they mount, from the caches of their repository, falling back
+// to the key prefixes of their run's cache policy.
+func (s *Service) RestoreCache(req *agentpb.RestoreCacheRequest, stream agentpb.AgentService_RestoreCacheServer) error {
+	ctx := stream.Context()
+	job, err := s.agentJob(ctx, req.GetJobId())
+	if err != nil {
+		return err
+	}
+	if err := mountsCache(job, req.GetKey()); err != nil {
+		return err
+	}
+	_, contents, err := s.caches.Restore(ctx, job.Repository, req.GetKey(), job.CacheFallbacks)
+	if errors.Is(err, storage.ErrNotFound) {
+		return status.Errorf(codes.NotFound, "cache %s not found", req.GetKey())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "restoring cache", "job_id", job.ID, "key", req.GetKey(), "error", err)
+		return status.Error(codes.Internal, "failed to read cache")
+	}
+	defer contents.Close()
+	buf := make([]byte, snapshotChunkBytes)
+	for {
+		n, err := contents.Read(buf)
+		if n > 0 {
+			if serr := stream.Send(&agentpb.CacheChunk{JobId: job.ID, Key: req.GetKey(), Data: buf[:n]}); serr != nil {
+				return serr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "reading cache", "job_id", job.ID, "key", req.GetKey(), "error", err)
+			return status.Error(codes.Internal, "failed to read cache")
+		}
+	}
+}
+
+// SaveCache implements agentpb.AgentServiceServer. Agents may only save the
+// caches that running jobs whose leases they hold mount, if the cache policy
+// of the job's run allows it.
+func (s *Service) SaveCache(stream agentpb.AgentService_SaveCacheServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return status.Error(codes.InvalidArgument, "cache upload names no job")
+	}
+	if err != nil {
+		return err
+	}
+	job, err := s.agentJob(ctx, first.GetJobId())
+	if err != nil {
+		return err
+	}
+	if job.State != types.JobStateRunning {
+		return status.Errorf(codes.FailedPrecondition, "job %s is %s, not running", job.ID, job.State)
+	}
+	if !job.HoldsLease(job.AgentID, first.GetLeaseToken()) {
+		return status.Errorf(codes.FailedPrecondition, "job %s: %v", job.ID, jobs.ErrLeaseLost)
+	}
+	if err := mountsCache(job, first.GetKey()); err != nil {
+		return err
+	}
+	if err := s.caches.CheckWritable(ctx, job, first.GetKey()); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	r := &cacheReader{stream: stream, jobID: job.ID, buf: first.GetData()}
+	entry, err := s.caches.Save(ctx, job.Repository, first.GetKey(), r)
+	switch {
+	case errors.Is(err, errCacheTooLarge), errors.Is(err, cache.ErrOverQuota):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case r.err != nil:
+		return r.err
+	case err != nil:
+		slog.ErrorContext(ctx, "saving cache", "job_id", job.ID, "key", first.GetKey(), "error", err)
+		return status.Error(codes.Internal, "failed to save cache")
+	}
+	slog.InfoContext(ctx, "Saved cache", "job_id", job.ID, "key", entry.Key, "size", entry.Size)
+	return stream.SendAndClose(&agentpb.SaveCacheResponse{Size: entry.Size, Digest: entry.Digest})
+}
+
+// mountsCache returns a status error unless job mounts the cache key.
+func mountsCache(job *types.Job, key string) error {
+	if !slices.ContainsFunc(job.Caches, func(c types.CacheMount) bool { return c.Key == key }) {
+		return status.Errorf(codes.PermissionDenied, "job %s does not mount cache %s", job.ID, key)
+	}
+	return nil
+}
+
+// cacheReader reads the data of the chunks of a cache upload until the
+// agent closes its side of the stream.
+type cacheReader struct {
+	stream agentpb.AgentService_SaveCacheServer
+	jobID  string
+	buf    []byte
+	n      int64
+	// err is the error that broke the stream, as opposed to the end of the
+	// upload.
+	err error
+}
+
+func (r *cacheReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if id := chunk.GetJobId(); id != "" && id != r.jobID {
+			r.err = status.Errorf(codes.InvalidArgument, "cache upload of job %s carries a chunk of job %s", r.jobID, id)
+			return 0, r.err
+		}
+		r.buf = chunk.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	if r.n += int64(n); r.n > maxCacheBytes {
+		return n, errCacheTooLarge
+	}
+	return n, nil
+}
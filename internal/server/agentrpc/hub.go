@@ -0,0 +1,305 @@
+package agentrpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/jobsig"
+	"open-cicd/internal/releases"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/types"
+)
+
+// sendBuffer is the number of server messages queued per agent before
+// Dispatch reports the agent as unresponsive.
+const sendBuffer = 16
+
+// session is one open StreamJobs stream.
+type session struct {
+	agentID string
+	send    chan *agentpb.ServerMessage
+	free    int
+
+	// done is closed when the server ends the stream; closeErr says why.
+	done     chan struct{}
+	closeErr error
+}
+
+// Hub tracks open agent streams and implements scheduler.Dispatcher.
+type Hub struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	onReady  func()
+	// onConnect is called with the agent of every stream that opens.
+	onConnect func(agentID string)
+	// signer, if set, signs the assignments sent to agents.
+	signer *jobsig.Signer
+}
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{sessions: make(map[string]*session)}
+}
+
+// OnReady registers fn to be called whenever an agent announces free slots.
+func (h *Hub) OnReady(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onReady = fn
+}
+
+// OnConnect registers fn to be called whenever an agent opens its job
+// stream, such as when it reconnects after the server restarted.
+func (h *Hub) OnConnect(fn func(agentID string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onConnect = fn
+}
+
+// SetSigner makes the hub sign the job assignments it sends with signer, or
+// send them unsigned if signer is nil.
+func (h *Hub) SetSigner(signer *jobsig.Signer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.signer = signer
+}
+
+// attach registers a new stream for an agent, closing any previous one,
+// and tells the OnConnect callback.
+func (h *Hub) attach(agentID string) *session {
+	s := &session{
+		agentID: agentID,
+		send:    make(chan *agentpb.ServerMessage, sendBuffer),
+		done:    make(chan struct{}),
+	}
+	h.mu.Lock()
+	if old, ok := h.sessions[agentID]; ok {
+		old.close(status.Error(codes.Aborted, "superseded by a newer stream from the same agent"))
+	}
+	h.sessions[agentID] = s
+	onConnect := h.onConnect
+	h.mu.Unlock()
+	if onConnect != nil {
+		onConnect(agentID)
+	}
+	return s
+}
+
+// detach removes s if it is still the agent's current stream. It reports
+// whether s was current.
+func (h *Hub) detach(s *session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[s.agentID] != s {
+		return false
+	}
+	delete(h.sessions, s.agentID)
+	return true
+}
+
+// CloseAll ends every open stream, e.g. during shutdown. Agents are expected
+// to reconnect.
+func (h *Hub) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.sessions {
+		s.close(status.Error(codes.Unavailable, "server is shutting down"))
+	}
+}
+
+// close ends the session's stream with err. Callers must hold the hub lock.
+func (s *session) close(err error) {
+	select {
+	case <-s.done:
+	default:
+		s.closeErr = err
+		close(s.done)
+	}
+}
+
+// setFree records the number of free slots an agent announced.
+func (h *Hub) setFree(s *session, free int) {
+	h.mu.Lock()
+	s.free = free
+	onReady := h.onReady
+	h.mu.Unlock()
+	if onReady != nil && free > 0 {
+		onReady()
+	}
+}
+
+// Connected reports whether agentID has an open stream.
+func (h *Hub) Connected(agentID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.sessions[agentID]
+	return ok
+}
+
+// Ready implements scheduler.Dispatcher.
+func (h *Hub) Ready() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ready := make(map[string]int, len(h.sessions))
+	for id, s := range h.sessions {
+		ready[id] = s.free
+	}
+	return ready
+}
+
+// Dispatch implements scheduler.Dispatcher.
+func (h *Hub) Dispatch(agentID string, job *types.Job) error {
+	spec, err := execSpec(job)
+	if err != nil {
+		return fmt.Errorf("building execution spec of job %s: %w", job.ID, err)
+	}
+	var leaseSeconds int64
+	if job.LeaseExpiresAt != nil {
+		leaseSeconds = int64(time.Until(*job.LeaseExpiresAt) / time.Second)
+	}
+	assignment := &agentpb.JobAssignment{
+		JobId:          job.ID,
+		Name:           job.Name,
+		Image:          job.Image,
+		Commands:       job.Commands,
+		Env:            job.Env,
+		TimeoutSeconds: int64(job.Timeout.Std().Seconds()),
+		Spec:           spec,
+		Outputs:        job.Outputs,
+		LeaseToken:     job.LeaseToken,
+		LeaseSeconds:   leaseSeconds,
+		Caches:         cacheMounts(job.Caches),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[agentID]
+	if !ok {
+		return scheduler.ErrAgentNotConnected
+	}
+	msg, err := h.assignment(agentID, assignment)
+	if err != nil {
+		return fmt.Errorf("signing job %s: %w", job.ID, err)
+	}
+	if err := s.push(msg); err != nil {
+		return err
+	}
+	s.free--
+	return nil
+}
+
+// assignment wraps an assignment for agentID in a server message, signed if
+// the hub has a signer. Callers must hold the hub lock.
+func (h *Hub) assignment(agentID string, assignment *agentpb.JobAssignment) (*agentpb.ServerMessage, error) {
+	if h.signer == nil {
+		return &agentpb.ServerMessage{Message: &agentpb.ServerMessage_Assignment{Assignment: assignment}}, nil
+	}
+	data, err := proto.Marshal(assignment)
+	if err != nil {
+		return nil, err
+	}
+	return &agentpb.ServerMessage{Message: &agentpb.ServerMessage_SignedAssignment{SignedAssignment: &agentpb.SignedJobAssignment{
+		Assignment: data,
+		KeyId:      h.signer.KeyID(),
+		Signature:  h.signer.Sign(agentID, data),
+	}}}, nil
+}
+
+// cacheMounts converts the caches of a job to their wire form.
+func cacheMounts(caches []types.CacheMount) []*agentpb.CacheMount {
+	var out []*agentpb.CacheMount
+	for _, c := range caches {
+		out = append(out, &agentpb.CacheMount{Key: c.Key, Path: c.Path})
+	}
+	return out
+}
+
+// execSpec converts the execution spec of job to its wire form.
+func execSpec(job *types.Job) (*agentpb.ExecSpec, error) {
+	spec, err := job.ExecSpec()
+	if err != nil {
+		return nil, err
+	}
+	pb := &agentpb.ExecSpec{
+		Workspace: spec.Workspace,
+		Shell:     string(spec.Shell),
+		Resources: &agentpb.Resources{CpuMillis: spec.CPUMillis, MemoryBytes: spec.MemoryBytes},
+	}
+	if s := spec.Security; s != nil {
+		pb.Security = &agentpb.SecurityContext{
+			RunAsUser:              s.RunAsUser,
+			RunAsGroup:             s.RunAsGroup,
+			ReadOnlyRootFilesystem: s.ReadOnlyRootFilesystem,
+			NoNewPrivileges:        s.NoNewPrivileges,
+			CapAdd:                 s.CapAdd,
+			CapDrop:                s.CapDrop,
+		}
+	}
+	for _, t := range spec.Tasks {
+		pb.Tasks = append(pb.Tasks, &agentpb.Task{
+			Name:       t.Name,
+			Image:      t.Image,
+			Entrypoint: t.Entrypoint,
+			Commands:   t.Commands,
+			Env:        t.Env,
+		})
+	}
+	for _, svc := range spec.Services {
+		pb.Services = append(pb.Services, &agentpb.Service{
+			Name:       svc.Name,
+			Image:      svc.Image,
+			Entrypoint: svc.Entrypoint,
+			Command:    svc.Command,
+			Env:        svc.Env,
+		})
+	}
+	return pb, nil
+}
+
+// Cancel implements scheduler.Dispatcher.
+func (h *Hub) Cancel(agentID, jobID, reason string, requeue bool) error {
+	msg := &agentpb.ServerMessage{Message: &agentpb.ServerMessage_Cancel{Cancel: &agentpb.CancelJob{
+		JobId:   jobID,
+		Reason:  reason,
+		Requeue: requeue,
+	}}}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[agentID]
+	if !ok {
+		return scheduler.ErrAgentNotConnected
+	}
+	return s.push(msg)
+}
+
+// Update implements scheduler.Updater.
+func (h *Hub) Update(agentID string, binary *releases.Binary, url string) error {
+	msg := &agentpb.ServerMessage{Message: &agentpb.ServerMessage_Update{Update: &agentpb.AgentUpdate{
+		Version:   binary.Version,
+		Url:       url,
+		Sha256:    binary.SHA256,
+		Signature: binary.Signature,
+	}}}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[agentID]
+	if !ok {
+		return scheduler.ErrAgentNotConnected
+	}
+	return s.push(msg)
+}
+
+// push queues msg without blocking. Callers must hold the hub lock.
+func (s *session) push(msg *agentpb.ServerMessage) error {
+	select {
+	case s.send <- msg:
+		return nil
+	default:
+		return fmt.Errorf("agent %s is not draining its stream", s.agentID)
+	}
+}
@@ -0,0 +1,337 @@
+// Package agentrpc serves the gRPC agent protocol defined in agentpb.
+package agentrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agenthttp"
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/snapshots"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Service implements agentpb.AgentServiceServer.
+type Service struct {
+	agentpb.UnimplementedAgentServiceServer
+
+	registry  *scheduler.Registry
+	jobs      *jobs.Manager
+	logs      logs.Store
+	snapshots *snapshots.Service
+	caches    *cache.Service
+	hub       *Hub
+}
+
+// NewService returns the agent protocol service. Open job streams are
+// tracked in hub, the workspace snapshots agents take are kept by
+// snapshotService and the caches of their jobs by cacheService.
+func NewService(registry *scheduler.Registry, manager *jobs.Manager, logStore logs.Store, snapshotService *snapshots.Service, cacheService *cache.Service, hub *Hub) *Service {
+	return &Service{registry: registry, jobs: manager, logs: logStore, snapshots: snapshotService, caches: cacheService, hub: hub}
+}
+
+// NewServer returns a gRPC server with the agent service and its
+// authentication interceptors registered.
+func (s *Service) NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(s.unaryAuth),
+		grpc.ChainStreamInterceptor(s.streamAuth),
+	)
+	srv := grpc.NewServer(opts...)
+	agentpb.RegisterAgentServiceServer(srv, s)
+	return srv
+}
+
+// NewGateway returns a gateway serving the agent service over HTTP, for
+// agents that cannot reach the gRPC port, with the same authentication.
+func (s *Service) NewGateway() *agenthttp.Gateway {
+	return agenthttp.NewGateway(&agentpb.AgentService_ServiceDesc, s, s.unaryAuth, s.streamAuth)
+}
+
+// RegisterAgent implements agentpb.AgentServiceServer.
+func (s *Service) RegisterAgent(ctx context.Context, req *agentpb.RegisterAgentRequest) (*agentpb.RegisterAgentResponse, error) {
+	in := types.RegisterAgentRequest{
+		Hostname: req.GetHostname(),
+		Labels:   req.GetLabels(),
+		Capacity: int(req.GetCapacity()),
+		Token:    req.GetToken(),
+
+		Version:    req.GetVersion(),
+		Platform:   req.GetPlatform(),
+		AutoUpdate: req.GetAutoUpdate(),
+		Transport:  types.AgentTransportGRPC,
+	}
+	if agenthttp.FromGateway(ctx) {
+		in.Transport = types.AgentTransportHTTP
+	}
+	for _, s := range req.GetShells() {
+		in.Shells = append(in.Shells, types.Shell(s))
+	}
+	if err := in.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	agent, credential, err := s.registry.Register(ctx, in, peerFingerprint(ctx))
+	if errors.Is(err, scheduler.ErrInvalidToken) || errors.Is(err, scheduler.ErrCertificateRequired) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if errors.Is(err, scheduler.ErrVersionTooOld) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "registering agent", "hostname", in.Hostname, "error", err)
+		return nil, status.Error(codes.Internal, "failed to register agent")
+	}
+	slog.InfoContext(ctx, "Registered agent over the agent protocol", "agent_id", agent.ID, "hostname", agent.Hostname, "version", agent.Version, "transport", agent.Transport)
+	return &agentpb.RegisterAgentResponse{
+		AgentId:                  agent.ID,
+		Credential:               credential,
+		HeartbeatIntervalSeconds: s.heartbeatSeconds(),
+	}, nil
+}
+
+// Heartbeat implements agentpb.AgentServiceServer. It renews the leases the
+// agent sends and names those it no longer holds.
+func (s *Service) Heartbeat(ctx context.Context, req *agentpb.HeartbeatRequest) (*agentpb.HeartbeatResponse, error) {
+	agent := agentFrom(ctx)
+	if _, err := s.registry.Heartbeat(ctx, agent.ID, agentResources(req.GetResources())); err != nil {
+		slog.ErrorContext(ctx, "recording heartbeat", "agent_id", agent.ID, "error", err)
+		return nil, status.Error(codes.Internal, "failed to record heartbeat")
+	}
+	leases := make(map[string]int64, len(req.GetLeases()))
+	for _, lease := range req.GetLeases() {
+		leases[lease.GetJobId()] = lease.GetToken()
+	}
+	revoked, renewed, err := s.jobs.RenewLeases(ctx, agent.ID, leases)
+	if err != nil {
+		slog.ErrorContext(ctx, "renewing job leases", "agent_id", agent.ID, "error", err)
+		return nil, status.Error(codes.Internal, "failed to renew leases")
+	}
+	for _, id := range revoked {
+		slog.WarnContext(ctx, "Agent holds a revoked lease; telling it to stop the job", "agent_id", agent.ID, "job_id", id)
+	}
+	return &agentpb.HeartbeatResponse{
+		HeartbeatIntervalSeconds: s.heartbeatSeconds(),
+		RevokedJobIds:            revoked,
+		LeaseSeconds:             int64(renewed / time.Second),
+	}, nil
+}
+
+// agentResources converts a heartbeat's report of the agent's machine, which
+// may be nil.
+func agentResources(m *agentpb.MachineResources) *types.AgentResources {
+	if m == nil {
+		return nil
+	}
+	return &types.AgentResources{
+		Total: types.ResourceAmounts{
+			CPUMillis:   max(m.GetTotalCpuMillis(), 0),
+			MemoryBytes: max(m.GetTotalMemoryBytes(), 0),
+			DiskBytes:   max(m.GetTotalDiskBytes(), 0),
+		},
+		Available: types.ResourceAmounts{
+			CPUMillis:   max(m.GetAvailableCpuMillis(), 0),
+			MemoryBytes: max(m.GetAvailableMemoryBytes(), 0),
+			DiskBytes:   max(m.GetAvailableDiskBytes(), 0),
+		},
+	}
+}
+
+func (s *Service) heartbeatSeconds() int64 {
+	return int64(s.registry.HeartbeatInterval() / time.Second)
+}
+
+// StreamJobs implements agentpb.AgentServiceServer. The stream stays open
+// for as long as the agent is connected; the agent is online while it does
+// and keeps sending heartbeats. Messages on the stream count as heartbeats.
+func (s *Service) StreamJobs(stream agentpb.AgentService_StreamJobsServer) error {
+	ctx := stream.Context()
+	agent := agentFrom(ctx)
+
+	if _, err := s.registry.Heartbeat(ctx, agent.ID, nil); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "bringing agent online: %v", err)
+	}
+	sess := s.hub.attach(agent.ID)
+	slog.InfoContext(ctx, "Agent connected", "agent_id", agent.ID)
+	defer func() {
+		if s.hub.detach(sess) {
+			if _, err := s.registry.SetState(context.Background(), agent.ID, types.AgentStateOffline); err != nil && !errors.Is(err, types.ErrInvalidTransition) {
+				slog.Error("marking agent offline", "agent_id", agent.ID, "error", err)
+			}
+			slog.Info("Agent disconnected", "agent_id", agent.ID)
+		}
+	}()
+
+	recvErr := make(chan error, 1)
+	go func() { recvErr <- s.receive(ctx, sess, stream) }()
+
+	for {
+		select {
+		case msg := <-sess.send:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-sess.done:
+			return sess.closeErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// receive handles messages sent by the agent until the stream ends.
+func (s *Service) receive(ctx context.Context, sess *session, stream agentpb.AgentService_StreamJobsServer) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if _, err := s.registry.Heartbeat(ctx, sess.agentID, nil); err != nil {
+			slog.ErrorContext(ctx, "recording heartbeat", "agent_id", sess.agentID, "error", err)
+		}
+		switch m := msg.GetMessage().(type) {
+		case *agentpb.AgentMessage_Ready:
+			s.hub.setFree(sess, int(m.Ready.GetFreeSlots()))
+		case *agentpb.AgentMessage_Ack:
+			if m.Ack.GetAccepted() {
+				continue
+			}
+			slog.WarnContext(ctx, "Agent rejected job", "agent_id", sess.agentID, "job_id", m.Ack.GetJobId(), "reason", m.Ack.GetReason())
+			// A rejection arriving after the assignment's lease ran out
+			// must not take the job from the agent it went to next.
+			update := types.JobStatusRequest{
+				State:      types.JobStateQueued,
+				AgentID:    sess.agentID,
+				Reason:     "rejected by agent: " + m.Ack.GetReason(),
+				LeaseToken: m.Ack.GetLeaseToken(),
+			}
+			if _, err := s.jobs.Report(ctx, m.Ack.GetJobId(), update); err != nil && !errors.Is(err, jobs.ErrLeaseLost) {
+				slog.ErrorContext(ctx, "re-queueing rejected job", "job_id", m.Ack.GetJobId(), "error", err)
+			}
+		case *agentpb.AgentMessage_UpdateFailed:
+			failed := m.UpdateFailed
+			slog.WarnContext(ctx, "Agent could not update", "agent_id", sess.agentID, "version", failed.GetVersion(), "reason", failed.GetReason())
+			if _, err := s.registry.FailUpdate(ctx, sess.agentID, failed.GetVersion(), failed.GetReason()); err != nil {
+				slog.ErrorContext(ctx, "recording failed agent update", "agent_id", sess.agentID, "error", err)
+			}
+		}
+	}
+}
+
+// jobStates maps protocol job states to server job states.
+var jobStates = map[agentpb.JobState]types.JobState{
+	agentpb.JobState_JOB_STATE_RUNNING:   types.JobStateRunning,
+	agentpb.JobState_JOB_STATE_SUCCEEDED: types.JobStateSucceeded,
+	agentpb.JobState_JOB_STATE_FAILED:    types.JobStateFailed,
+	agentpb.JobState_JOB_STATE_CANCELLED: types.JobStateCancelled,
+	agentpb.JobState_JOB_STATE_QUEUED:    types.JobStateQueued,
+	agentpb.JobState_JOB_STATE_TIMED_OUT: types.JobStateTimedOut,
+}
+
+// ReportStatus implements agentpb.AgentServiceServer. Only the agent
+// holding the lease of the job's current assignment may report on it.
+func (s *Service) ReportStatus(ctx context.Context, req *agentpb.ReportStatusRequest) (*agentpb.ReportStatusResponse, error) {
+	agent := agentFrom(ctx)
+	state, ok := jobStates[req.GetState()]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported job state %s", req.GetState())
+	}
+	update := types.JobStatusRequest{
+		State:          state,
+		AgentID:        agent.ID,
+		Reason:         req.GetReason(),
+		Infrastructure: req.GetInfrastructure(),
+		LeaseToken:     req.GetLeaseToken(),
+		Results:        req.GetResults(),
+	}
+	if len(update.Results) > 0 && state != types.JobStateSucceeded {
+		return nil, status.Error(codes.InvalidArgument, "results can only be reported with state succeeded")
+	}
+	if err := types.ValidateResults(update.Results); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.ExitCode != nil {
+		code := int(req.GetExitCode())
+		update.ExitCode = &code
+	}
+
+	job, err := s.jobs.Report(ctx, req.GetJobId(), update)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return nil, status.Error(codes.NotFound, "job not found")
+	case errors.Is(err, types.ErrInvalidTransition), errors.Is(err, jobs.ErrAgentMismatch), errors.Is(err, jobs.ErrLeaseLost):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		slog.ErrorContext(ctx, "updating job status", "job_id", req.GetJobId(), "error", err)
+		return nil, status.Error(codes.Internal, "failed to update job status")
+	}
+	return &agentpb.ReportStatusResponse{RequeueRequested: job.RequeueRequested}, nil
+}
+
+// logStreams maps protocol log streams to stored log streams.
+var logStreams = map[agentpb.LogStream]logs.Stream{
+	agentpb.LogStream_LOG_STREAM_UNSPECIFIED: logs.Stdout,
+	agentpb.LogStream_LOG_STREAM_STDOUT:      logs.Stdout,
+	agentpb.LogStream_LOG_STREAM_STDERR:      logs.Stderr,
+}
+
+// leaseRecheckInterval is how long a log stream goes on appending the output
+// of a job before the lease of its agent is checked again.
+const leaseRecheckInterval = time.Second
+
+// StreamLogs implements agentpb.AgentServiceServer. Agents may only upload
+// logs for jobs assigned to them whose leases they hold.
+func (s *Service) StreamLogs(stream agentpb.AgentService_StreamLogsServer) error {
+	ctx := stream.Context()
+	agent := agentFrom(ctx)
+	// owned records when the lease on each job was last found held.
+	owned := make(map[string]time.Time)
+	var received int64
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&agentpb.StreamLogsResponse{BytesReceived: received})
+		}
+		if err != nil {
+			return err
+		}
+		jobID := chunk.GetJobId()
+		if checked, ok := owned[jobID]; !ok || time.Since(checked) > leaseRecheckInterval {
+			job, err := s.jobs.Get(ctx, jobID)
+			if errors.Is(err, storage.ErrNotFound) {
+				return status.Errorf(codes.NotFound, "job %s not found", jobID)
+			}
+			if err != nil {
+				return status.Error(codes.Internal, "loading job")
+			}
+			if job.AgentID != agent.ID {
+				return status.Errorf(codes.PermissionDenied, "job %s is not assigned to this agent", jobID)
+			}
+			if !job.HoldsLease(agent.ID, chunk.GetLeaseToken()) {
+				return status.Errorf(codes.FailedPrecondition, "job %s: %v", jobID, jobs.ErrLeaseLost)
+			}
+			owned[jobID] = time.Now()
+		}
+		if _, err := s.logs.Append(ctx, jobID, logStreams[chunk.GetStream()], chunk.GetData()); err != nil {
+			slog.ErrorContext(ctx, "appending logs", "job_id", jobID, "error", err)
+			return status.Error(codes.Internal, "failed to store logs")
+		}
+		received += int64(len(chunk.GetData()))
+	}
+}
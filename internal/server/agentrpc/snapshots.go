@@ -0,0 +1,223 @@
+package agentrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"open-cicd/internal/agentpb"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// maxSnapshotBytes caps the size of a single workspace snapshot.
+const maxSnapshotBytes = 10 << 30
+
+// snapshotChunkBytes is how much of a snapshot each downloaded chunk holds.
+const snapshotChunkBytes = 256 << 10
+
+// errSnapshotTooLarge is returned while reading an upload that goes past
+// maxSnapshotBytes.
+var errSnapshotTooLarge = fmt.Errorf("snapshot is larger than %d bytes", maxSnapshotBytes)
+
+// UploadSnapshot implements agentpb.AgentServiceServer. Agents may only
+// upload the snapshots of running jobs that have outputs and whose leases
+// they hold.
+func (s *Service) UploadSnapshot(stream agentpb.AgentService_UploadSnapshotServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return status.Error(codes.InvalidArgument, "snapshot upload names no job")
+	}
+	if err != nil {
+		return err
+	}
+	job, err := s.agentJob(ctx, first.GetJobId())
+	if err != nil {
+		return err
+	}
+	if job.State != types.JobStateRunning {
+		return status.Errorf(codes.FailedPrecondition, "job %s is %s, not running", job.ID, job.State)
+	}
+	if !job.HoldsLease(job.AgentID, first.GetLeaseToken()) {
+		return status.Errorf(codes.FailedPrecondition, "job %s: %v", job.ID, jobs.ErrLeaseLost)
+	}
+	if len(job.Outputs) == 0 {
+		return status.Errorf(codes.FailedPrecondition, "job %s declares no outputs", job.ID)
+	}
+
+	r := &snapshotReader{stream: stream, jobID: job.ID, buf: first.GetData()}
+	snapshot, err := s.snapshots.Save(ctx, job, r)
+	switch {
+	case errors.Is(err, errSnapshotTooLarge):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case r.err != nil:
+		// The stream broke or sent chunks of another job.
+		return r.err
+	case err != nil:
+		slog.ErrorContext(ctx, "saving workspace snapshot", "job_id", job.ID, "error", err)
+		return status.Error(codes.Internal, "failed to save snapshot")
+	}
+	slog.InfoContext(ctx, "Saved workspace snapshot", "job_id", job.ID, "size", snapshot.Size)
+	return stream.SendAndClose(&agentpb.UploadSnapshotResponse{BytesReceived: snapshot.Size, Sha256: snapshot.SHA256})
+}
+
+// snapshotReader reads the data of the chunks of an upload until the agent
+// closes its side of the stream.
+type snapshotReader struct {
+	stream agentpb.AgentService_UploadSnapshotServer
+	jobID  string
+	buf    []byte
+	n      int64
+	// err is the error that broke the stream, as opposed to the end of the
+	// upload.
+	err error
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if id := chunk.GetJobId(); id != "" && id != r.jobID {
+			r.err = status.Errorf(codes.InvalidArgument, "snapshot upload of job %s carries a chunk of job %s", r.jobID, id)
+			return 0, r.err
+		}
+		r.buf = chunk.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	if r.n += int64(n); r.n > maxSnapshotBytes {
+		return n, errSnapshotTooLarge
+	}
+	return n, nil
+}
+
+// ListSnapshots implements agentpb.AgentServiceServer.
+func (s *Service) ListSnapshots(ctx context.Context, req *agentpb.ListSnapshotsRequest) (*agentpb.ListSnapshotsResponse, error) {
+	job, err := s.agentJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := s.upstreamSnapshots(ctx, job)
+	if err != nil {
+		slog.ErrorContext(ctx, "listing upstream snapshots", "job_id", job.ID, "error", err)
+		return nil, status.Error(codes.Internal, "failed to list snapshots")
+	}
+	resp := &agentpb.ListSnapshotsResponse{}
+	for _, snapshot := range snapshots {
+		resp.Snapshots = append(resp.Snapshots, &agentpb.Snapshot{
+			JobId:  snapshot.JobID,
+			Stage:  snapshot.Stage,
+			Paths:  snapshot.Paths,
+			Size:   snapshot.Size,
+			Sha256: snapshot.SHA256,
+		})
+	}
+	return resp, nil
+}
+
+// DownloadSnapshot implements agentpb.AgentServiceServer. Jobs may only
+// download the snapshots listed for them.
+func (s *Service) DownloadSnapshot(req *agentpb.DownloadSnapshotRequest, stream agentpb.AgentService_DownloadSnapshotServer) error {
+	ctx := stream.Context()
+	job, err := s.agentJob(ctx, req.GetJobId())
+	if err != nil {
+		return err
+	}
+	snapshots, err := s.upstreamSnapshots(ctx, job)
+	if err != nil {
+		slog.ErrorContext(ctx, "listing upstream snapshots", "job_id", job.ID, "error", err)
+		return status.Error(codes.Internal, "failed to list snapshots")
+	}
+	listed := false
+	for _, snapshot := range snapshots {
+		listed = listed || snapshot.JobID == req.GetSnapshotJobId()
+	}
+	if !listed {
+		return status.Errorf(codes.PermissionDenied, "job %s does not restore a snapshot of job %s", job.ID, req.GetSnapshotJobId())
+	}
+
+	_, contents, err := s.snapshots.Open(ctx, req.GetSnapshotJobId())
+	if errors.Is(err, storage.ErrNotFound) {
+		return status.Errorf(codes.NotFound, "snapshot of job %s not found", req.GetSnapshotJobId())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "opening workspace snapshot", "job_id", req.GetSnapshotJobId(), "error", err)
+		return status.Error(codes.Internal, "failed to read snapshot")
+	}
+	defer contents.Close()
+	buf := make([]byte, snapshotChunkBytes)
+	for {
+		n, err := contents.Read(buf)
+		if n > 0 {
+			if serr := stream.Send(&agentpb.SnapshotChunk{JobId: req.GetSnapshotJobId(), Data: buf[:n]}); serr != nil {
+				return serr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "reading workspace snapshot", "job_id", req.GetSnapshotJobId(), "error", err)
+			return status.Error(codes.Internal, "failed to read snapshot")
+		}
+	}
+}
+
+// upstreamSnapshots returns the snapshots of the upstream jobs of job that
+// took one, in the order they are to be restored.
+func (s *Service) upstreamSnapshots(ctx context.Context, job *types.Job) ([]*types.WorkspaceSnapshot, error) {
+	upstream, err := s.jobs.UpstreamJobs(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*types.WorkspaceSnapshot
+	for _, j := range upstream {
+		if len(j.Outputs) == 0 {
+			continue
+		}
+		snapshot, err := s.snapshots.Get(ctx, j.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			// The snapshot expired, or the job ran before its step
+			// declared outputs.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// agentJob returns a job assigned to the calling agent that has not
+// finished, or a status error.
+func (s *Service) agentJob(ctx context.Context, jobID string) (*types.Job, error) {
+	agent := agentFrom(ctx)
+	job, err := s.jobs.Get(ctx, jobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "job %s not found", jobID)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "loading job")
+	}
+	if job.AgentID != agent.ID {
+		return nil, status.Errorf(codes.PermissionDenied, "job %s is not assigned to this agent", jobID)
+	}
+	if job.State.Terminal() {
+		return nil, status.Errorf(codes.FailedPrecondition, "job %s has finished", jobID)
+	}
+	return job, nil
+}
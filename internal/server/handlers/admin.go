@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"open-cicd/internal/logging"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// AdminHandler lets server administrators look into and steer the
+// scheduler during incidents. Every endpoint needs the manage permission
+// server-wide.
+type AdminHandler struct {
+	scheduler *scheduler.Scheduler
+	authz     *rbac.Authorizer
+}
+
+// NewAdminHandler returns a handler for the given scheduler.
+func NewAdminHandler(sched *scheduler.Scheduler, authz *rbac.Authorizer) *AdminHandler {
+	return &AdminHandler{scheduler: sched, authz: authz}
+}
+
+// Scheduler handles GET /admin/scheduler, reporting the queue, whether
+// scheduling is paused and the jobs every agent holds.
+func (h *AdminHandler) Scheduler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	status, err := h.scheduler.Status(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reporting scheduler status", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to report scheduler status")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// Pause handles POST /admin/scheduler/pause, which stops jobs from being
+// scheduled until POST /admin/scheduler/resume.
+func (h *AdminHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	var req types.PauseSchedulingRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	pause, err := h.scheduler.Pause(r.Context(), caller(r), req.Reason)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "pausing scheduler", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to pause scheduling")
+		return
+	}
+	slog.WarnContext(r.Context(), "Paused scheduling", "by", pause.By, "reason", pause.Reason)
+	utils.WriteJSON(w, http.StatusOK, pause)
+}
+
+// Resume handles POST /admin/scheduler/resume.
+func (h *AdminHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	if err := h.scheduler.Resume(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "resuming scheduler", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resume scheduling")
+		return
+	}
+	slog.InfoContext(r.Context(), "Resumed scheduling", "user", caller(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogLevel handles GET /admin/log-level, reporting the minimum level this
+// replica logs.
+func (h *AdminHandler) LogLevel(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, types.LogLevel{Level: logging.Level()})
+}
+
+// SetLogLevel handles PUT /admin/log-level. The level only changes on the
+// replica serving the request, and reloading the configuration sets it back
+// to the configured one.
+func (h *AdminHandler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	var req types.LogLevel
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := logging.SetLevel(req.Level); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	level := logging.Level()
+	slog.WarnContext(r.Context(), "Changed log level", "level", level, "user", caller(r))
+	utils.WriteJSON(w, http.StatusOK, types.LogLevel{Level: level})
+}
+
+// ReconcileAgents handles POST /admin/agents/reconcile, bringing the
+// recorded state of agents and their jobs in line with the agents connected
+// now. Only the leader, which the agents connect to, can tell.
+func (h *AdminHandler) ReconcileAgents(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	report, err := h.scheduler.Reconcile(r.Context())
+	if errors.Is(err, scheduler.ErrNotScheduling) {
+		utils.WriteErrorCode(w, http.StatusServiceUnavailable, types.CodeNotLeader, "this replica is not the leader; send the request to the leader")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reconciling agents", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to reconcile agents")
+		return
+	}
+	slog.InfoContext(r.Context(), "Reconciled agents", "offline", len(report.Offline), "online", len(report.Online),
+		"requeued", len(report.Requeued), "expired", len(report.Expired), "user", caller(r))
+	utils.WriteJSON(w, http.StatusOK, report)
+}
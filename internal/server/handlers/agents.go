@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/certs"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// AgentHandler serves agent registration and lifecycle endpoints.
+type AgentHandler struct {
+	registry *scheduler.Registry
+	jobs     *jobs.Manager
+	authz    *rbac.Authorizer
+}
+
+// NewAgentHandler returns a handler backed by the given registry, reporting
+// the jobs agents hold from manager. Agents belong to no project, so reading
+// and managing them needs a role on all projects: of their organization, or
+// of the whole server for shared agents.
+func NewAgentHandler(registry *scheduler.Registry, manager *jobs.Manager, authz *rbac.Authorizer) *AgentHandler {
+	return &AgentHandler{registry: registry, jobs: manager, authz: authz}
+}
+
+// Register handles POST /register.
+func (h *AgentHandler) Register(w http.ResponseWriter, r *http.Request) {
+	var req types.RegisterAgentRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	agent, credential, err := h.registry.Register(r.Context(), req, certs.PeerFingerprint(r.TLS))
+	if errors.Is(err, scheduler.ErrInvalidToken) || errors.Is(err, scheduler.ErrCertificateRequired) {
+		utils.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if errors.Is(err, scheduler.ErrVersionTooOld) || errors.Is(err, scheduler.ErrLabelsNotAllowed) {
+		utils.WriteError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "registering agent", "hostname", req.Hostname, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to register agent")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Registered agent", "agent_id", agent.ID, "hostname", agent.Hostname, "organization", agent.Organization, "version", agent.Version)
+	utils.WriteJSON(w, http.StatusCreated, types.RegisterAgentResponse{
+		AgentID:           agent.ID,
+		Credential:        credential,
+		State:             agent.State,
+		HeartbeatInterval: types.Duration(h.registry.HeartbeatInterval()),
+	})
+}
+
+// List handles GET /agents, returning a page of the registered agents the
+// caller may view. The optional state and organization query parameters
+// filter by agent state and organization. Agents are sorted by registration
+// time.
+func (h *AgentHandler) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := types.AgentState(q.Get("state"))
+	if state != "" && !state.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, "unknown agent state "+string(state))
+		return
+	}
+	org := q.Get("organization")
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := organizations(w, r, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	agents, err := h.registry.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing agents", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list agents")
+		return
+	}
+	list, next := collectLoaded(page, agents,
+		func(agent *types.Agent) bool {
+			return allowed(agent.Organization) && (state == "" || agent.State == state) &&
+				(org == "" || agent.Organization == org)
+		},
+		func(agent *types.Agent) storage.Cursor {
+			return page.Position(agent.RegisteredAt, agent.UpdatedAt, agent.ID)
+		})
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /agents/{id}.
+func (h *AgentHandler) Get(w http.ResponseWriter, r *http.Request) {
+	agent, ok := h.load(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, agent)
+}
+
+// load fetches the agent named in the route and checks that the caller may
+// perform action on the agents of its organization. On failure it writes the
+// error response and returns false.
+func (h *AgentHandler) load(w http.ResponseWriter, r *http.Request, action types.Action) (*types.Agent, bool) {
+	agent, err := h.registry.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentNotFound, "agent not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting agent", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get agent")
+		return nil, false
+	}
+	if !authorizeOrganization(w, r, h.authz, action, agent.Organization) {
+		return nil, false
+	}
+	return agent, true
+}
+
+// UpdateState handles PUT /agents/{id}/state.
+func (h *AgentHandler) UpdateState(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.load(w, r, types.ActionManage); !ok {
+		return
+	}
+	var req types.UpdateAgentStateRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	agent, err := h.registry.SetState(r.Context(), mux.Vars(r)["id"], req.State)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentNotFound, "agent not found")
+	case errors.Is(err, types.ErrInvalidTransition):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "updating agent state", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to update agent state")
+	default:
+		utils.WriteJSON(w, http.StatusOK, agent)
+	}
+}
+
+// Drain handles POST /agents/{id}/drain on behalf of the calling token,
+// draining the agent for maintenance. The body is optional. The response
+// reports the jobs the agent still holds; poll GET /agents/{id}/drain until
+// it is drained.
+func (h *AgentHandler) Drain(w http.ResponseWriter, r *http.Request) {
+	var req types.DrainAgentRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, ok := h.load(w, r, types.ActionManage); !ok {
+		return
+	}
+	agent, err := h.registry.Drain(r.Context(), mux.Vars(r)["id"], caller(r), req.Reason)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentNotFound, "agent not found")
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "draining agent", "agent_id", mux.Vars(r)["id"], "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to drain agent")
+		return
+	}
+	slog.InfoContext(r.Context(), "Drained agent", "agent_id", agent.ID, "hostname", agent.Hostname, "by", agent.Drain.By, "reason", agent.Drain.Reason)
+	h.writeDrainStatus(w, r, agent)
+}
+
+// DrainStatus handles GET /agents/{id}/drain, reporting the jobs the agent
+// still holds and whether it is drained.
+func (h *AgentHandler) DrainStatus(w http.ResponseWriter, r *http.Request) {
+	agent, ok := h.load(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	h.writeDrainStatus(w, r, agent)
+}
+
+// Resume handles POST /agents/{id}/resume, ending the agent's drain.
+func (h *AgentHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.load(w, r, types.ActionManage); !ok {
+		return
+	}
+	agent, err := h.registry.Resume(r.Context(), mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentNotFound, "agent not found")
+	case err != nil:
+		slog.ErrorContext(r.Context(), "resuming agent", "agent_id", mux.Vars(r)["id"], "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resume agent")
+	default:
+		slog.InfoContext(r.Context(), "Resumed agent", "agent_id", agent.ID, "hostname", agent.Hostname, "state", agent.State, "by", caller(r))
+		utils.WriteJSON(w, http.StatusOK, agent)
+	}
+}
+
+// writeDrainStatus writes the drain progress of agent.
+func (h *AgentHandler) writeDrainStatus(w http.ResponseWriter, r *http.Request, agent *types.Agent) {
+	held, err := h.jobs.AgentJobs(r.Context(), agent.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing agent jobs", "agent_id", agent.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list agent jobs")
+		return
+	}
+	status := types.AgentDrainStatus{
+		Agent:   agent,
+		Jobs:    make([]types.HeldJob, 0, len(held)),
+		Drained: agent.State != types.AgentStateOnline && agent.State != types.AgentStateRegistered && len(held) == 0,
+	}
+	for _, job := range held {
+		status.Jobs = append(status.Jobs, types.HeldJob{ID: job.ID, Name: job.Name, State: job.State, PipelineID: job.PipelineID})
+	}
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// Heartbeat handles POST /agents/{id}/heartbeat. Agents authenticate with the
+// session credential issued at registration as a bearer token.
+func (h *AgentHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authenticateAgent(w, r, h.registry, id) {
+		return
+	}
+
+	agent, err := h.registry.Heartbeat(r.Context(), id, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recording heartbeat", "agent_id", id, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to record heartbeat")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, types.HeartbeatResponse{
+		State:             agent.State,
+		HeartbeatInterval: types.Duration(h.registry.HeartbeatInterval()),
+	})
+}
+
+// authenticateAgent checks the session credential the agent sent as a bearer
+// token. On failure it writes the error response and returns false.
+func authenticateAgent(w http.ResponseWriter, r *http.Request, registry *scheduler.Registry, id string) bool {
+	credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || credential == "" || id == "" {
+		utils.WriteError(w, http.StatusUnauthorized, "missing agent credential")
+		return false
+	}
+	if _, err := registry.Authenticate(r.Context(), id, credential, certs.PeerFingerprint(r.TLS)); err != nil {
+		if rejected(err) {
+			utils.WriteError(w, http.StatusUnauthorized, err.Error())
+			return false
+		}
+		slog.ErrorContext(r.Context(), "authenticating agent", "agent_id", id, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authenticate agent")
+		return false
+	}
+	return true
+}
+
+// rejected reports whether an authentication error is the agent's fault
+// rather than the server's.
+func rejected(err error) bool {
+	return errors.Is(err, scheduler.ErrInvalidCredential) ||
+		errors.Is(err, scheduler.ErrCertificateRequired) ||
+		errors.Is(err, scheduler.ErrCertificateMismatch)
+}
+
+// heldJob authenticates the calling agent, named by the X-Agent-ID header,
+// and returns the job with the given ID if that agent holds it and it is in
+// progress. On failure it writes the error response and returns false.
+func heldJob(w http.ResponseWriter, r *http.Request, registry *scheduler.Registry, manager *jobs.Manager, jobID string) (*types.Job, bool) {
+	agentID := r.Header.Get("X-Agent-ID")
+	if !authenticateAgent(w, r, registry, agentID) {
+		return nil, false
+	}
+	job, err := manager.Get(r.Context(), jobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeJobNotFound, "job not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting job", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get job")
+		return nil, false
+	}
+	if job.State != types.JobStateAssigned && job.State != types.JobStateRunning && job.State != types.JobStateCancelling {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeJobNotInProgress, "job is not in progress")
+		return nil, false
+	}
+	if job.AgentID != agentID {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeAgentMismatch, jobs.ErrAgentMismatch.Error())
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// AgentTokenHandler serves the registration tokens handed out for
+// registering agents. Managing them needs permission to manage the
+// organization their agents register into, or the whole server for tokens
+// of shared agents.
+type AgentTokenHandler struct {
+	tokens *scheduler.AgentTokens
+	authz  *rbac.Authorizer
+}
+
+// NewAgentTokenHandler returns a handler backed by the given token manager.
+func NewAgentTokenHandler(tokens *scheduler.AgentTokens, authz *rbac.Authorizer) *AgentTokenHandler {
+	return &AgentTokenHandler{tokens: tokens, authz: authz}
+}
+
+// Create handles POST /agent-tokens.
+func (h *AgentTokenHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateAgentTokenRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, req.Organization) {
+		return
+	}
+
+	token, secret, err := h.tokens.Create(r.Context(), req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating agent token", "name", req.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create agent token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Created agent token", "token_id", token.ID, "name", token.Name, "organization", token.Organization,
+		"max_uses", token.MaxUses, "expires_at", token.ExpiresAt, "user", token.CreatedBy)
+	utils.WriteJSON(w, http.StatusCreated, types.CreateAgentTokenResponse{AgentToken: *token, Token: secret})
+}
+
+// List handles GET /agent-tokens, returning a page of the agent tokens the
+// caller may manage, revoked and expired ones included. Both sort orders
+// list them by creation time.
+func (h *AgentTokenHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := organizations(w, r, h.authz, types.ActionManage)
+	if !ok {
+		return
+	}
+	tokens, err := h.tokens.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing agent tokens", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list agent tokens")
+		return
+	}
+	list, next := collectLoaded(page, tokens,
+		func(token *types.AgentToken) bool { return allowed(token.Organization) },
+		func(token *types.AgentToken) storage.Cursor {
+			return page.Position(token.CreatedAt, token.CreatedAt, token.ID)
+		})
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /agent-tokens/{id}.
+func (h *AgentTokenHandler) Get(w http.ResponseWriter, r *http.Request) {
+	token, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, token)
+}
+
+// Revoke handles DELETE /agent-tokens/{id}. The token stays listed as
+// revoked, and the agents it registered keep working.
+func (h *AgentTokenHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	token, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	revoked, err := h.tokens.Revoke(r.Context(), token.ID, caller(r))
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentTokenNotFound, "agent token not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoking agent token", "token_id", token.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to revoke agent token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Revoked agent token", "token_id", revoked.ID, "uses", revoked.Uses, "user", caller(r))
+	utils.WriteJSON(w, http.StatusOK, revoked)
+}
+
+// load fetches the token named in the path and checks that the caller may
+// manage it. If not, it writes the error response and returns false.
+func (h *AgentTokenHandler) load(w http.ResponseWriter, r *http.Request) (*types.AgentToken, bool) {
+	token, err := h.tokens.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeAgentTokenNotFound, "agent token not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting agent token", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get agent token")
+		return nil, false
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, token.Organization) {
+		return nil, false
+	}
+	return token, true
+}
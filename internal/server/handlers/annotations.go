@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/annotations"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// AnnotationHandler serves the annotations steps publish from agents and
+// lists them for users.
+type AnnotationHandler struct {
+	jobs        *jobs.Manager
+	annotations *annotations.Service
+	registry    *scheduler.Registry
+	authz       *rbac.Authorizer
+}
+
+// NewAnnotationHandler returns a handler storing annotations with service.
+// Publishing is authenticated against registry.
+func NewAnnotationHandler(manager *jobs.Manager, service *annotations.Service, registry *scheduler.Registry, authz *rbac.Authorizer) *AnnotationHandler {
+	return &AnnotationHandler{jobs: manager, annotations: service, registry: registry, authz: authz}
+}
+
+// Create handles POST /jobs/{id}/annotations. Like artifact uploads, it is
+// authenticated with the session credential of the agent holding the job,
+// which its steps publish through while the job is in progress.
+func (h *AnnotationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	job, ok := heldJob(w, r, h.registry, h.jobs, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	var req types.CreateAnnotationsRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stored, err := h.annotations.Publish(r.Context(), job, req.Annotations)
+	if errors.Is(err, annotations.ErrTooMany) {
+		utils.WriteError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "publishing annotations", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store annotations")
+		return
+	}
+	slog.InfoContext(r.Context(), "Stored annotations", "job_id", job.ID, "count", len(stored))
+	utils.WriteJSON(w, http.StatusCreated, stored)
+}
+
+// List handles GET /jobs/{id}/annotations, returning the job's annotations
+// in the order they were published.
+func (h *AnnotationHandler) List(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	list, err := h.annotations.List(r.Context(), job.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing annotations", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list annotations")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/artifacts"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// maxArtifactBytes caps the size of a single artifact upload.
+const maxArtifactBytes = 5 << 30
+
+// ArtifactHandler serves artifact uploads from agents and downloads for
+// users.
+type ArtifactHandler struct {
+	jobs      *jobs.Manager
+	artifacts *artifacts.Service
+	registry  *scheduler.Registry
+	authz     *rbac.Authorizer
+	// links signs links to artifacts; nil when they are disabled.
+	links       *artifacts.Signer
+	externalURL string
+}
+
+// NewArtifactHandler returns a handler storing artifacts with service.
+// Uploads are authenticated against registry. links signs the links
+// artifacts are shared with, on a server reached at externalURL, and is
+// nil when sharing is disabled.
+func NewArtifactHandler(manager *jobs.Manager, service *artifacts.Service, registry *scheduler.Registry, authz *rbac.Authorizer, links *artifacts.Signer, externalURL string) *ArtifactHandler {
+	return &ArtifactHandler{
+		jobs:        manager,
+		artifacts:   service,
+		registry:    registry,
+		authz:       authz,
+		links:       links,
+		externalURL: strings.TrimSuffix(externalURL, "/"),
+	}
+}
+
+// Upload handles PUT /jobs/{id}/artifacts/{path}. The body is the raw file.
+// Agents authenticate with their session credential as a bearer token and
+// name themselves in the X-Agent-ID header; only the agent holding the job
+// may upload while the job is in progress. With ?report=junit or
+// ?report=go-test-json the file is also parsed as a test report; one that
+// cannot be parsed is stored anyway and answered with 400.
+func (h *ArtifactHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	job, ok := heldJob(w, r, h.registry, h.jobs, vars["id"])
+	if !ok {
+		return
+	}
+	if err := types.ValidateArtifactPath(vars["path"]); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var report types.TestReportFormat
+	if v := r.URL.Query().Get("report"); v != "" {
+		format, err := types.ParseTestReportFormat(v)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		report = format
+	}
+
+	clearReadDeadline(r.Context(), w, "artifact upload")
+	body := http.MaxBytesReader(w, r.Body, maxArtifactBytes)
+	artifact, err := h.artifacts.Upload(r.Context(), job, vars["path"], r.Header.Get("Content-Type"), report, body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		utils.WriteError(w, http.StatusRequestEntityTooLarge, "artifact is too large")
+		return
+	}
+	if errors.Is(err, artifacts.ErrInvalidReport) {
+		utils.WriteError(w, http.StatusBadRequest, "artifact stored, but its test report could not be parsed: "+err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "uploading artifact", "job_id", job.ID, "path", vars["path"], "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store artifact")
+		return
+	}
+	slog.InfoContext(r.Context(), "Stored artifact", "job_id", job.ID, "path", artifact.Path, "bytes", artifact.Size, "report", artifact.Report)
+	utils.WriteJSON(w, http.StatusCreated, artifact)
+}
+
+// List handles GET /jobs/{id}/artifacts, returning a page of the job's
+// artifacts. Artifacts are replaced rather than updated, so both sort orders
+// list them by the time they were stored.
+func (h *ArtifactHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	all, err := h.artifacts.List(r.Context(), job.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing artifacts", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list artifacts")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Artifact) bool { return true },
+		func(artifact *types.Artifact) storage.Cursor {
+			return page.Position(artifact.CreatedAt, artifact.CreatedAt, artifact.Path)
+		})
+	writeList(w, page, list, next)
+}
+
+// Tests handles GET /jobs/{id}/tests, returning the results of the test
+// reports the job uploaded. With ?failed=true only failed cases are listed.
+func (h *ArtifactHandler) Tests(w http.ResponseWriter, r *http.Request) {
+	failedOnly := false
+	if v := r.URL.Query().Get("failed"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "failed must be true or false")
+			return
+		}
+		failedOnly = b
+	}
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	tests, err := h.artifacts.Tests(r.Context(), job.ID, failedOnly)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing test reports", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list test reports")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, tests)
+}
+
+// Download handles GET /jobs/{id}/artifacts/{path}. Range and conditional
+// requests are supported; the ETag is the artifact's SHA-256.
+func (h *ArtifactHandler) Download(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	h.serve(w, r, job.ID, mux.Vars(r)["path"])
+}
+
+// CreateLink handles POST /jobs/{id}/artifact-links, signing a link to one
+// of the job's artifacts that anyone holding it may download until it
+// expires. Sharing an artifact takes the run permission on its project.
+func (h *ArtifactHandler) CreateLink(w http.ResponseWriter, r *http.Request) {
+	if h.links == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeArtifactLinksNotConfigured, "the server signs no artifact links")
+		return
+	}
+	var req types.CreateArtifactLinkRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionRun)
+	if !ok {
+		return
+	}
+	artifact, err := h.artifacts.Get(r.Context(), job.ID, req.Path)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeArtifactNotFound, "artifact not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting artifact", "job_id", job.ID, "path", req.Path, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get artifact")
+		return
+	}
+	expires := time.Now().Add(req.Lifetime()).Truncate(time.Second)
+	if artifact.ExpiresAt != nil && artifact.ExpiresAt.Before(expires) {
+		expires = artifact.ExpiresAt.Truncate(time.Second)
+	}
+
+	segments := strings.Split(artifact.Path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", h.links.Sign(job.ID, artifact.Path, expires))
+	link := types.ArtifactLink{
+		URL:       h.baseURL(r) + "/artifacts/signed/" + url.PathEscape(job.ID) + "/" + strings.Join(segments, "/") + "?" + query.Encode(),
+		JobID:     job.ID,
+		Path:      artifact.Path,
+		ExpiresAt: expires,
+	}
+	slog.InfoContext(r.Context(), "Signed artifact link", "job_id", job.ID, "path", artifact.Path,
+		"expires_at", expires, "user", caller(r))
+	utils.WriteJSON(w, http.StatusCreated, link)
+}
+
+// DownloadSigned handles GET /artifacts/signed/{id}/{path}, serving the
+// artifact of a signed link without an API token, as Download does.
+func (h *ArtifactHandler) DownloadSigned(w http.ResponseWriter, r *http.Request) {
+	if h.links == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeArtifactLinksNotConfigured, "the server signs no artifact links")
+		return
+	}
+	vars := mux.Vars(r)
+	q := r.URL.Query()
+	err := h.links.Verify(vars["id"], vars["path"], q.Get("expires"), q.Get("signature"))
+	if errors.Is(err, artifacts.ErrLinkExpired) {
+		utils.WriteError(w, http.StatusGone, "the link has expired")
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusForbidden, "the link is not valid")
+		return
+	}
+	h.serve(w, r, vars["id"], vars["path"])
+}
+
+// baseURL returns the URL the server is reached at, as configured or else
+// as the request reached it.
+func (h *ArtifactHandler) baseURL(r *http.Request) string {
+	if h.externalURL != "" {
+		return h.externalURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// serve writes the contents of the artifact at p of the job.
+func (h *ArtifactHandler) serve(w http.ResponseWriter, r *http.Request, jobID, p string) {
+	artifact, contents, err := h.artifacts.Open(r.Context(), jobID, p)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeArtifactNotFound, "artifact not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "opening artifact", "job_id", jobID, "path", p, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to read artifact")
+		return
+	}
+	defer contents.Close()
+
+	clearWriteDeadline(r.Context(), w, "artifact download")
+	contentType := artifact.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+artifact.SHA256+`"`)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(artifact.Path)}))
+	http.ServeContent(w, r, artifact.Path, artifact.CreatedAt, contents)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"open-cicd/internal/audit"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// AuditHandler serves the audit log.
+type AuditHandler struct {
+	log   *audit.Log
+	authz *rbac.Authorizer
+}
+
+// NewAuditHandler returns a handler reading log. The audit log spans all
+// projects, so reading it needs the admin role on all of them.
+func NewAuditHandler(log *audit.Log, authz *rbac.Authorizer) *AuditHandler {
+	return &AuditHandler{log: log, authz: authz}
+}
+
+// List handles GET /audit, returning a page of audit events. The optional
+// actor, resource, since and until query parameters filter the events;
+// resource also matches the paths beneath it, and since and until are
+// RFC 3339 times. Events never change, so both sort orders list them by
+// time.
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := storage.AuditFilter{Actor: q.Get("actor"), Resource: q.Get("resource")}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, t.name+" must be an RFC 3339 time such as 2024-05-01T00:00:00Z")
+			return
+		}
+		*t.dst = parsed
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionManage, types.AllProjects) {
+		return
+	}
+
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.AuditEvent, error) {
+			filter.Page = p
+			return h.log.List(r.Context(), filter)
+		},
+		func(*types.AuditEvent) bool { return true },
+		func(e *types.AuditEvent) storage.Cursor { return storage.Cursor{Time: e.At, ID: e.ID} })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing audit events", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list audit events")
+		return
+	}
+	writeList(w, page, list, next)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// authorize checks that the caller may perform action on project. If not, it
+// writes the error response and returns false.
+func authorize(w http.ResponseWriter, r *http.Request, authz *rbac.Authorizer, action types.Action, project string) bool {
+	err := authz.Authorize(r.Context(), action, project)
+	if errors.Is(err, rbac.ErrForbidden) {
+		utils.WriteError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authorizing request", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize request")
+		return false
+	}
+	return true
+}
+
+// authorizeOrganization checks that the caller may perform action on the
+// resources of org outside its projects, or on the server's own if org is
+// empty. If not, it writes the error response and returns false.
+func authorizeOrganization(w http.ResponseWriter, r *http.Request, authz *rbac.Authorizer, action types.Action, org string) bool {
+	err := authz.AuthorizeOrganization(r.Context(), action, org)
+	if errors.Is(err, rbac.ErrForbidden) {
+		utils.WriteError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authorizing request", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize request")
+		return false
+	}
+	return true
+}
+
+// organizations returns a predicate for the organizations on whose own
+// resources the caller may perform action. If it cannot be determined, it
+// writes the error response and returns false.
+func organizations(w http.ResponseWriter, r *http.Request, authz *rbac.Authorizer, action types.Action) (func(org string) bool, bool) {
+	allowed, err := authz.FilterOrganizations(r.Context(), action)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authorizing request", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize request")
+		return nil, false
+	}
+	return allowed, true
+}
+
+// viewable returns a predicate for the projects the caller may view. If it
+// cannot be determined, it writes the error response and returns false.
+func viewable(w http.ResponseWriter, r *http.Request, authz *rbac.Authorizer) (func(project string) bool, bool) {
+	allowed, err := authz.Filter(r.Context(), types.ActionView)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authorizing request", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize request")
+		return nil, false
+	}
+	return allowed, true
+}
+
+// caller names the user making the request, for records such as who
+// cancelled a job: the token's user, or the token's name if it has none.
+func caller(r *http.Request) string {
+	token := auth.TokenFrom(r.Context())
+	if token.User != "" {
+		return token.User
+	}
+	return token.Name
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// badgeMaxAge is how long clients and image proxies may cache a badge
+// before checking for a newer result.
+const badgeMaxAge = time.Minute
+
+// badge is one of the results a status badge can show.
+type badge struct {
+	text  string
+	color string
+	// width is the width of the value half of the badge, in pixels.
+	width int
+}
+
+var (
+	badgePassing = badge{text: "passing", color: "#4c1", width: 53}
+	badgeFailing = badge{text: "failing", color: "#e05d44", width: 47}
+	badgeUnknown = badge{text: "unknown", color: "#9f9f9f", width: 59}
+)
+
+// badgeLabelWidth is the width of the "build" label half of the badge.
+const badgeLabelWidth = 37
+
+// badgeTemplate renders a flat badge. Its arguments are the total width, the
+// label width, the value width and color, the centers of the label and value
+// text, and the value text.
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="build: %[7]s">
+<title>build: %[7]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[4]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[5]d" y="15" fill="#010101" fill-opacity=".3">build</text><text x="%[5]d" y="14">build</text>
+<text x="%[6]d" y="15" fill="#010101" fill-opacity=".3">%[7]s</text><text x="%[6]d" y="14">%[7]s</text>
+</g>
+</svg>
+`
+
+// svg renders the badge.
+func (b badge) svg() []byte {
+	return fmt.Appendf(nil, badgeTemplate,
+		badgeLabelWidth+b.width, badgeLabelWidth, b.width, b.color,
+		badgeLabelWidth/2, badgeLabelWidth+b.width/2, b.text)
+}
+
+// BadgeHandler serves build status badges for embedding in READMEs.
+type BadgeHandler struct {
+	jobs        *jobs.Manager
+	authz       *rbac.Authorizer
+	key         []byte
+	externalURL string
+}
+
+// NewBadgeHandler returns a handler backed by the given job manager. The
+// badge token of a project is an HMAC-SHA256 of its name under key; without
+// a key no badges are served. Badge URLs are built on externalURL, or on
+// the URL the request reached the server at.
+func NewBadgeHandler(manager *jobs.Manager, authz *rbac.Authorizer, key []byte, externalURL string) *BadgeHandler {
+	return &BadgeHandler{jobs: manager, authz: authz, key: key, externalURL: strings.TrimRight(externalURL, "/")}
+}
+
+// URL handles GET /projects/{project}/badge, returning the badge URL of the
+// branch given in the query to those who may view the project.
+func (h *BadgeHandler) URL(w http.ResponseWriter, r *http.Request) {
+	if h.key == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeBadgesNotConfigured, "the server serves no status badges")
+		return
+	}
+	project, branch := mux.Vars(r)["project"], r.URL.Query().Get("branch")
+	if branch == "" || strings.Contains(branch, "/") {
+		utils.WriteError(w, http.StatusBadRequest, "branch is required, without slashes")
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	base := h.externalURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	segments := strings.Split(project, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	utils.WriteJSON(w, http.StatusOK, types.ProjectBadge{
+		Project: project,
+		Branch:  branch,
+		URL:     base + "/badges/" + strings.Join(segments, "/") + "/" + url.PathEscape(branch) + ".svg?token=" + hex.EncodeToString(h.mac(project)),
+	})
+}
+
+// mac returns the badge token of project, which URLs carry hex-encoded.
+func (h *BadgeHandler) mac(project string) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte("badge\n" + project))
+	return mac.Sum(nil)
+}
+
+// Get handles GET /badges/{project}/{branch}.svg, rendering the result of
+// the latest run on the branch that succeeded or failed. Running and
+// cancelled runs do not change the badge, and branches without a finished
+// run show as unknown. Badges are served without an API token, as image
+// requests from README pages carry no credentials, but only with the
+// project's badge token; without it every project is not found alike, so
+// that badges do not tell which projects exist.
+func (h *BadgeHandler) Get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project, branch := vars["project"], vars["branch"]
+	given, err := hex.DecodeString(r.URL.Query().Get("token"))
+	if h.key == nil || err != nil || !hmac.Equal(given, h.mac(project)) {
+		utils.WriteError(w, http.StatusNotFound, "badge not found")
+		return
+	}
+
+	b := badgeUnknown
+	cacheControl := fmt.Sprintf("max-age=%d, must-revalidate", int(badgeMaxAge.Seconds()))
+	run, err := h.jobs.LatestResult(r.Context(), project, branch)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+	case err != nil:
+		slog.ErrorContext(r.Context(), "getting latest pipeline result", "repository", project, "branch", branch, "error", err)
+		cacheControl = "no-store"
+	case run.State == types.PipelineStateSucceeded:
+		b = badgePassing
+	default:
+		b = badgeFailing
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `"`+b.text+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.svg()))
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/cache"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// maxCacheBytes caps the size of a single cache upload.
+const maxCacheBytes = 10 << 30
+
+// CacheHandler serves the dependency cache to agents, and its statistics to
+// users.
+type CacheHandler struct {
+	cache    *cache.Service
+	jobs     *jobs.Manager
+	registry *scheduler.Registry
+	authz    *rbac.Authorizer
+}
+
+// NewCacheHandler returns a handler serving caches from service. Requests of
+// agents are authenticated against registry.
+func NewCacheHandler(service *cache.Service, manager *jobs.Manager, registry *scheduler.Registry, authz *rbac.Authorizer) *CacheHandler {
+	return &CacheHandler{cache: service, jobs: manager, registry: registry, authz: authz}
+}
+
+// cacheJob authenticates a cache request. Agents send their session
+// credential as a bearer token, their ID in X-Agent-ID and the job they are
+// running in X-Job-ID; the job's repository is the project whose caches are
+// used.
+func (h *CacheHandler) cacheJob(w http.ResponseWriter, r *http.Request) (*types.Job, bool) {
+	jobID := r.Header.Get("X-Job-ID")
+	if jobID == "" {
+		utils.WriteError(w, http.StatusBadRequest, "X-Job-ID header is required")
+		return nil, false
+	}
+	return heldJob(w, r, h.registry, h.jobs, jobID)
+}
+
+// Restore handles GET /cache/{key}, falling back to the key prefixes of the
+// cache policy of the job's run. A miss is answered with 404.
+func (h *CacheHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.cacheJob(w, r)
+	if !ok {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	entry, contents, err := h.cache.Restore(r.Context(), job.Repository, key, job.CacheFallbacks)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeCacheNotFound, "cache not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "restoring cache", "project", job.Repository, "key", key, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to restore cache")
+		return
+	}
+	defer contents.Close()
+
+	clearWriteDeadline(r.Context(), w, "cache restore")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+strings.TrimPrefix(entry.Digest, "sha256:")+`"`)
+	http.ServeContent(w, r, key, entry.CreatedAt, contents)
+}
+
+// Save handles PUT /cache/{key}. The body is the raw cache archive. Jobs
+// whose run's cache policy makes caches read-only are answered with 403.
+func (h *CacheHandler) Save(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.cacheJob(w, r)
+	if !ok {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if err := types.ValidateCacheKey(key); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.cache.CheckWritable(r.Context(), job, key); err != nil {
+		utils.WriteError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	clearReadDeadline(r.Context(), w, "cache upload")
+	entry, err := h.cache.Save(r.Context(), job.Repository, key, http.MaxBytesReader(w, r.Body, maxCacheBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		utils.WriteError(w, http.StatusRequestEntityTooLarge, "cache is too large")
+	case errors.Is(err, cache.ErrOverQuota):
+		utils.WriteError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "saving cache", "project", job.Repository, "key", key, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to save cache")
+	default:
+		slog.InfoContext(r.Context(), "Saved cache", "project", job.Repository, "key", key, "bytes", entry.Size)
+		utils.WriteJSON(w, http.StatusCreated, entry)
+	}
+}
+
+// Stats handles GET /cache/stats, returning the hit and miss counts of the
+// cache keys of the project in the query, or of one of its keys.
+func (h *CacheHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		utils.WriteError(w, http.StatusBadRequest, "project is required")
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	report, err := h.cache.Stats(r.Context(), project, r.URL.Query().Get("key"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting cache statistics", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get cache statistics")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, report)
+}
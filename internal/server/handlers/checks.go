@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/checks"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// CheckHandler serves the checks projects require of their runs.
+type CheckHandler struct {
+	checks *checks.Service
+	authz  *rbac.Authorizer
+}
+
+// NewCheckHandler returns a handler backed by the given check service.
+func NewCheckHandler(service *checks.Service, authz *rbac.Authorizer) *CheckHandler {
+	return &CheckHandler{checks: service, authz: authz}
+}
+
+// Get handles GET /projects/{project}/required-checks, the pipelines and
+// stages that must pass and the names of the commit statuses they are
+// reported to the SCM as.
+func (h *CheckHandler) Get(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	required, err := h.checks.Get(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting required checks", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get required checks")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, required)
+}
+
+// Put handles PUT /projects/{project}/required-checks.
+func (h *CheckHandler) Put(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	var req types.PutRequiredChecksRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	required, err := h.checks.Set(r.Context(), project, req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing required checks", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store required checks")
+		return
+	}
+	slog.InfoContext(r.Context(), "Set required checks", "project", project, "checks", len(required.Checks), "user", required.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, required)
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// clearReadDeadline lifts the server's read timeout for a request whose body
+// may legitimately take long to arrive, such as a large upload.
+func clearReadDeadline(ctx context.Context, w http.ResponseWriter, what string) {
+	err := http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.WarnContext(ctx, "clearing read deadline", "for", what, "error", err)
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for a response that
+// may legitimately take long, such as a download or a followed log.
+func clearWriteDeadline(ctx context.Context, w http.ResponseWriter, what string) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.WarnContext(ctx, "clearing write deadline", "for", what, "error", err)
+	}
+}
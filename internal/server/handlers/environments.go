@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/environments"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// EnvironmentHandler serves the environments of projects and their
+// deployment history. Environments are created by the jobs deploying to
+// them, so they are read-only here.
+type EnvironmentHandler struct {
+	environments *environments.Service
+	authz        *rbac.Authorizer
+}
+
+// NewEnvironmentHandler returns a handler backed by the given service.
+func NewEnvironmentHandler(service *environments.Service, authz *rbac.Authorizer) *EnvironmentHandler {
+	return &EnvironmentHandler{environments: service, authz: authz}
+}
+
+// environmentProject returns the project named by the required project
+// query parameter, writing a 400 response if it is missing, and checks that
+// the caller may view it.
+func (h *EnvironmentHandler) environmentProject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		utils.WriteError(w, http.StatusBadRequest, "project query parameter is required")
+		return "", false
+	}
+	return project, authorize(w, r, h.authz, types.ActionView, project)
+}
+
+// List handles GET /environments?project=owner/repo, returning a page of
+// the project's environments with what is deployed to each.
+func (h *EnvironmentHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	project, ok := h.environmentProject(w, r)
+	if !ok {
+		return
+	}
+	all, err := h.environments.List(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing environments", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list environments")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Environment) bool { return true },
+		func(env *types.Environment) storage.Cursor {
+			return page.Position(env.CreatedAt, env.UpdatedAt, env.Name)
+		})
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /environments/{name}?project=owner/repo.
+func (h *EnvironmentHandler) Get(w http.ResponseWriter, r *http.Request) {
+	project, ok := h.environmentProject(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	env, err := h.environments.Get(r.Context(), project, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeEnvironmentNotFound, "environment not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting environment", "project", project, "environment", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get environment")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, env)
+}
+
+// Deployments handles GET /environments/{name}/deployments?project=owner/repo,
+// returning a page of the environment's deployment history.
+func (h *EnvironmentHandler) Deployments(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	project, ok := h.environmentProject(w, r)
+	if !ok {
+		return
+	}
+	filter := storage.DeploymentFilter{Project: project, Environment: mux.Vars(r)["name"]}
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.Deployment, error) {
+			filter.Page = p
+			return h.environments.Deployments(r.Context(), filter)
+		},
+		func(*types.Deployment) bool { return true },
+		func(d *types.Deployment) storage.Cursor { return page.Position(d.CreatedAt, d.UpdatedAt, d.ID) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing deployments", "project", project, "environment", filter.Environment, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list deployments")
+		return
+	}
+	writeList(w, page, list, next)
+}
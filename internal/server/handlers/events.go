@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"open-cicd/internal/events"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/utils"
+)
+
+// wsPingInterval is how often an idle WebSocket gets a ping so that proxies
+// do not close it.
+const wsPingInterval = 30 * time.Second
+
+// EventHandler streams job, pipeline and log events over WebSockets.
+type EventHandler struct {
+	bus   *events.Bus
+	authz *rbac.Authorizer
+}
+
+// NewEventHandler returns a handler streaming the events of bus.
+func NewEventHandler(bus *events.Bus, authz *rbac.Authorizer) *EventHandler {
+	return &EventHandler{bus: bus, authz: authz}
+}
+
+// errorEvent is sent before the server closes a WebSocket on its own.
+type errorEvent struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// Stream handles GET /ws, upgrading the request to a WebSocket that carries
+// one JSON event per message. Clients choose the events they get with the
+// topics query parameter, a comma-separated list of event types or prefixes
+// such as job.*, and narrow them down with project, job and pipeline. Only
+// events of projects the caller may view are sent. Clients that fall too far
+// behind are disconnected.
+func (h *EventHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		utils.WriteError(w, http.StatusUpgradeRequired, "this endpoint only serves WebSocket connections")
+		return
+	}
+	q := r.URL.Query()
+	filter := events.Filter{Project: q.Get("project"), JobID: q.Get("job"), PipelineID: q.Get("pipeline")}
+	for _, topic := range strings.Split(q.Get("topics"), ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" {
+			continue
+		}
+		if !events.ValidTopic(topic) {
+			utils.WriteError(w, http.StatusBadRequest, "unknown topic "+topic+", expected one of "+strings.Join(events.Types, ", ")+" or a prefix ending in *")
+			return
+		}
+		filter.Topics = append(filter.Topics, topic)
+	}
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+	filter.Allowed = allowed
+
+	ctx := r.Context()
+	clearReadDeadline(ctx, w, "event stream")
+	clearWriteDeadline(ctx, w, "event stream")
+	srv := websocket.Server{
+		// Clients authenticate with a token rather than cookies, so requests
+		// from any origin are accepted.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { h.serve(ctx, ws, filter) },
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// serve sends the events matching filter until the client goes away, the
+// server shuts down or the client is dropped for falling behind.
+func (h *EventHandler) serve(ctx context.Context, ws *websocket.Conn, filter events.Filter) {
+	sub := h.bus.Subscribe(filter)
+	defer sub.Close()
+
+	// Clients have nothing to say; reading only notices when they leave.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				if sub.Dropped() {
+					_ = websocket.JSON.Send(ws, errorEvent{Type: "error", Error: "client is not keeping up with events"})
+				}
+				return
+			}
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-ping.C:
+			ws.PayloadType = websocket.PingFrame
+			_, err := ws.Write(nil)
+			ws.PayloadType = websocket.TextFrame
+			if err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// readinessTimeout bounds the checks of a readiness probe, which should
+// answer well within the probe's own timeout.
+const readinessTimeout = 2 * time.Second
+
+// HealthHandler reports whether the control plane is up and takes work.
+type HealthHandler struct {
+	store        storage.HealthStore
+	jobs         *jobs.Manager
+	backpressure *scheduler.Backpressure
+}
+
+// NewHealthHandler returns a handler checking store, manager and
+// backpressure.
+func NewHealthHandler(store storage.HealthStore, manager *jobs.Manager, backpressure *scheduler.Backpressure) *HealthHandler {
+	return &HealthHandler{store: store, jobs: manager, backpressure: backpressure}
+}
+
+// Health handles GET /health, kept for load balancers configured before
+// /healthz and /readyz. It responds 503 while the queue is saturated and
+// submissions are rejected, so that load balancers can send work elsewhere;
+// a saturated queue that still takes submissions is only reported in the
+// body.
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	resp := types.HealthResponse{
+		Status:    "healthy",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Queue:     h.backpressure.State(),
+	}
+	status := http.StatusOK
+	if resp.Queue.Saturated {
+		resp.Status = "saturated"
+		if resp.Queue.Rejecting {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	utils.WriteJSON(w, status, resp)
+}
+
+// Live handles GET /healthz, the liveness probe. The server answering at
+// all is the whole check: a replica whose dependencies are down is not
+// helped by a restart, and /readyz takes it out of rotation instead.
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, types.LivenessResponse{
+		Status:    "alive",
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// Ready handles GET /readyz, the readiness probe. It responds 503 unless the
+// store is reachable, its schema is migrated, the queue is under its limit
+// and the server is not shutting down, listing the outcome of each check.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	checks := []struct {
+		name string
+		run  func(context.Context) (string, error)
+	}{
+		{"storage", h.checkStorage},
+		{"migrations", h.checkMigrations},
+		{"queue", h.checkQueue},
+		{"shutdown", h.checkShutdown},
+	}
+	resp := types.ReadinessResponse{
+		Status:    "ready",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Checks:    make([]types.ReadinessCheck, 0, len(checks)),
+	}
+	status := http.StatusOK
+	for _, c := range checks {
+		start := time.Now()
+		msg, err := c.run(ctx)
+		check := types.ReadinessCheck{Name: c.name, OK: err == nil, Message: msg, Duration: types.Duration(time.Since(start))}
+		if err != nil {
+			check.Message = err.Error()
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+		resp.Checks = append(resp.Checks, check)
+	}
+	utils.WriteJSON(w, status, resp)
+}
+
+func (h *HealthHandler) checkStorage(ctx context.Context) (string, error) {
+	if err := h.store.Ping(ctx); err != nil {
+		return "", fmt.Errorf("store is unreachable: %w", err)
+	}
+	return "store is reachable", nil
+}
+
+func (h *HealthHandler) checkMigrations(ctx context.Context) (string, error) {
+	schema, err := h.store.Schema(ctx)
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("reading the schema version: %w", err)
+	case schema.Dirty:
+		return "", fmt.Errorf("migration %d failed halfway and must be fixed manually", schema.Version)
+	case !schema.Current():
+		return "", fmt.Errorf("schema is at version %d, the server needs %d", schema.Version, schema.Latest)
+	case schema.Latest == 0:
+		return "store has no schema to migrate", nil
+	}
+	return fmt.Sprintf("schema is at version %d", schema.Version), nil
+}
+
+// checkQueue fails only for a queue over its limit. A queue saturated for
+// want of agents is reported but passes: agents register through the API,
+// so taking replicas out of rotation would keep them from coming online.
+func (h *HealthHandler) checkQueue(context.Context) (string, error) {
+	state := h.backpressure.State()
+	if state.MaxQueuedJobs > 0 && state.QueuedJobs >= state.MaxQueuedJobs {
+		return "", fmt.Errorf("%d jobs are queued, the limit is %d", state.QueuedJobs, state.MaxQueuedJobs)
+	}
+	msg := fmt.Sprintf("%d jobs are queued", state.QueuedJobs)
+	if state.MaxQueuedJobs > 0 {
+		msg += fmt.Sprintf(", the limit is %d", state.MaxQueuedJobs)
+	}
+	if !state.CheckedAt.IsZero() && state.OnlineAgents == 0 {
+		msg += "; no agents are online"
+	}
+	return msg, nil
+}
+
+func (h *HealthHandler) checkShutdown(context.Context) (string, error) {
+	if h.jobs.Draining() {
+		return "", jobs.ErrShuttingDown
+	}
+	return "server is taking work", nil
+}
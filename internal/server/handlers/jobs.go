@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/variables"
+)
+
+// JobHandler serves job submission and lifecycle endpoints.
+type JobHandler struct {
+	jobs         *jobs.Manager
+	backpressure *scheduler.Backpressure
+	estimator    *scheduler.Estimator
+	variables    *variables.Service
+	registry     *scheduler.Registry
+	authz        *rbac.Authorizer
+}
+
+// NewJobHandler returns a handler backed by the given job manager. A job
+// belongs to the project of its repository. Submissions are checked against
+// backpressure first, and queued jobs explained by estimator. Reproduce
+// bundles get the variables of service. Status reports are authenticated
+// against registry.
+func NewJobHandler(manager *jobs.Manager, backpressure *scheduler.Backpressure, estimator *scheduler.Estimator, service *variables.Service, registry *scheduler.Registry, authz *rbac.Authorizer) *JobHandler {
+	return &JobHandler{jobs: manager, backpressure: backpressure, estimator: estimator, variables: service, registry: registry, authz: authz}
+}
+
+// Create handles POST /jobs.
+func (h *JobHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateJobRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionRun, req.Repository) {
+		return
+	}
+	status, ok := admit(w, h.backpressure)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.Submit(r.Context(), req)
+	if errors.Is(err, jobs.ErrShuttingDown) {
+		w.Header().Set("Retry-After", "30")
+		utils.WriteError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if quotaExceeded(w, err) {
+		return
+	}
+	if errors.Is(err, jobs.ErrImageNotResolved) {
+		utils.WriteError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "submitting job", "name", req.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to submit job")
+		return
+	}
+	h.backpressure.Accepted(1)
+	utils.WriteJSON(w, status, job)
+}
+
+// admit checks whether the queue takes a submission. While it is saturated
+// and submissions are rejected, admit writes a 503 response telling the
+// client when to retry and returns false. Otherwise it returns the status of
+// a successful submission: 201 Created, or 202 Accepted along with a Warning
+// header when the queue is saturated and the work may wait a while.
+func admit(w http.ResponseWriter, backpressure *scheduler.Backpressure) (int, bool) {
+	state := backpressure.State()
+	if !state.Saturated {
+		return http.StatusCreated, true
+	}
+	reason := "job queue is saturated: " + strings.Join(state.Reasons, "; ")
+	if state.Rejecting {
+		w.Header().Set("Retry-After", "30")
+		utils.WriteErrorCode(w, http.StatusServiceUnavailable, types.CodeQueueFull, reason)
+		return 0, false
+	}
+	w.Header().Set("Warning", `299 open-cicd "`+reason+`"`)
+	return http.StatusAccepted, true
+}
+
+// quotaExceeded writes a 429 response telling the client when the quota
+// resets if err is a *jobs.QuotaError, or when to try again if it is a
+// *jobs.QueueLimitError, and reports whether it did.
+func quotaExceeded(w http.ResponseWriter, err error) bool {
+	var quota *jobs.QuotaError
+	if errors.As(err, &quota) {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(time.Until(quota.Reset)))
+		utils.WriteErrorCode(w, http.StatusTooManyRequests, types.CodeQuotaExceeded, quota.Error())
+		return true
+	}
+	var queue *jobs.QueueLimitError
+	if errors.As(err, &queue) {
+		w.Header().Set("Retry-After", "30")
+		utils.WriteErrorCode(w, http.StatusTooManyRequests, types.CodeQueueLimitExceeded, queue.Error())
+		return true
+	}
+	return false
+}
+
+// List handles GET /jobs, returning a page of the jobs of projects the
+// caller may view. The optional project, organization, state, branch and
+// agent query parameters filter the jobs; see parsePage for paging and
+// sorting.
+func (h *JobHandler) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := storage.JobFilter{
+		State:        types.JobState(q.Get("state")),
+		Repository:   q.Get("project"),
+		Organization: q.Get("organization"),
+		Branch:       q.Get("branch"),
+		AgentID:      q.Get("agent"),
+	}
+	if filter.State != "" && !filter.State.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, "unknown job state "+string(filter.State))
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.Job, error) {
+			filter.Page = p
+			return h.jobs.List(r.Context(), filter)
+		},
+		func(job *types.Job) bool { return allowed(job.Repository) },
+		func(job *types.Job) storage.Cursor { return page.Position(job.CreatedAt, job.UpdatedAt, job.ID) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing jobs", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list jobs")
+		return
+	}
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /jobs/{id}.
+func (h *JobHandler) Get(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	details := types.JobDetails{Job: *job}
+	if h.estimator != nil {
+		// A job is still worth showing without its place in the queue.
+		status, err := h.estimator.Explain(r.Context(), job)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "explaining queued job", "job_id", job.ID, "error", err)
+		}
+		details.Queue = status
+	}
+	utils.WriteJSON(w, http.StatusOK, details)
+}
+
+// Reproduce handles GET /jobs/{id}/reproduce, returning what running the
+// job again outside CI takes. Whoever may view the job may see the
+// variables that applied to it, but not its secrets.
+func (h *JobHandler) Reproduce(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	env, err := h.variables.Env(r.Context(), job.Repository, job.Ref)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "resolving variables", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resolve variables")
+		return
+	}
+	bundle, err := pipeline.Reproduce(job, env)
+	if errors.Is(err, pipeline.ErrNotReproducible) {
+		utils.WriteError(w, http.StatusConflict, "trigger jobs run on the server and cannot be reproduced")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "building reproduce bundle", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to build reproduce bundle")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, bundle)
+}
+
+// loadJob fetches the job named in the route and checks that the caller may
+// perform action on its project. On failure it writes the error response and
+// returns false.
+func loadJob(w http.ResponseWriter, r *http.Request, manager *jobs.Manager, authz *rbac.Authorizer, action types.Action) (*types.Job, bool) {
+	job, err := manager.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeJobNotFound, "job not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting job", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get job")
+		return nil, false
+	}
+	if !authorize(w, r, authz, action, job.Repository) {
+		return nil, false
+	}
+	return job, true
+}
+
+// UpdateStatus handles POST /jobs/{id}/status, on which an agent reports
+// on a job it was assigned, authenticated by its session credential. The
+// report is only applied while the agent holds the lease of lease_token, so
+// that a job handed to another agent cannot be moved by the one that lost
+// it. Jobs are assigned by the scheduler and cancelled through
+// POST /jobs/{id}/cancel, never here.
+func (h *JobHandler) UpdateStatus(w http.ResponseWriter, r *http.Request) {
+	var req types.JobStatusRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case req.LeaseToken == 0:
+		utils.WriteError(w, http.StatusBadRequest, "lease_token is required")
+		return
+	case req.State == types.JobStateAssigned:
+		utils.WriteError(w, http.StatusBadRequest, "jobs are only assigned by the scheduler")
+		return
+	}
+	held, ok := heldJob(w, r, h.registry, h.jobs, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if req.AgentID != "" && req.AgentID != held.AgentID {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeAgentMismatch, jobs.ErrAgentMismatch.Error())
+		return
+	}
+	req.AgentID = held.AgentID
+
+	job, err := h.jobs.Report(r.Context(), mux.Vars(r)["id"], req)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeJobNotFound, "job not found")
+	case errors.Is(err, types.ErrInvalidTransition), errors.Is(err, jobs.ErrAgentMismatch), errors.Is(err, jobs.ErrLeaseLost):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "updating job status", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to update job status")
+	default:
+		utils.WriteJSON(w, http.StatusOK, job)
+	}
+}
+
+// Retry handles POST /jobs/{id}/retry, running a job that failed, timed out
+// or was cancelled again as a new job. A job of a pipeline run is retried in
+// a re-run of the pipeline; the new job names it in pipeline_id.
+func (h *JobHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionRun)
+	if !ok {
+		return
+	}
+	retry, err := h.jobs.RetryJob(r.Context(), job.ID, caller(r))
+	if rerunFailed(w, err) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "retrying job", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to retry job")
+		return
+	}
+	slog.InfoContext(r.Context(), "Retried job", "job_id", retry.ID, "retry_of", job.ID, "pipeline_id", retry.PipelineID, "by", caller(r))
+	utils.WriteJSON(w, http.StatusCreated, retry)
+}
+
+// Cancel handles POST /jobs/{id}/cancel on behalf of the calling token. The
+// body is optional. A queued job is cancelled immediately and answered with
+// 200; a job held by an agent moves to cancelling and is answered with 202
+// until the agent confirms.
+func (h *JobHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	var req types.CancelJobRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, ok := loadJob(w, r, h.jobs, h.authz, types.ActionRun); !ok {
+		return
+	}
+	job, err := h.jobs.Cancel(r.Context(), mux.Vars(r)["id"], caller(r), req.Reason)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeJobNotFound, "job not found")
+	case errors.Is(err, types.ErrInvalidTransition):
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeJobFinished, "job has already finished")
+	case err != nil:
+		slog.ErrorContext(r.Context(), "cancelling job", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to cancel job")
+	case job.State == types.JobStateCancelling:
+		utils.WriteJSON(w, http.StatusAccepted, job)
+	default:
+		utils.WriteJSON(w, http.StatusOK, job)
+	}
+}
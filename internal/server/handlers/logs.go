@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment line so that
+// proxies do not close it.
+const sseKeepAlive = 15 * time.Second
+
+// LogHandler serves job output.
+type LogHandler struct {
+	jobs  *jobs.Manager
+	feed  *logs.Feed
+	index storage.LogIndexStore
+	authz *rbac.Authorizer
+}
+
+// NewLogHandler returns a handler reading logs from feed and searching them in
+// index. It subscribes to job changes so that followers are released as soon
+// as a job finishes.
+func NewLogHandler(manager *jobs.Manager, feed *logs.Feed, index storage.LogIndexStore, authz *rbac.Authorizer) *LogHandler {
+	manager.Observe(func(job *types.Job) {
+		if job.State.Terminal() {
+			feed.Notify(job.ID)
+		}
+	})
+	return &LogHandler{jobs: manager, feed: feed, index: index, authz: authz}
+}
+
+// logEvent is the data of a "log" server-sent event.
+type logEvent struct {
+	Stream logs.Stream `json:"stream"`
+	Offset int64       `json:"offset"`
+	Text   string      `json:"text"`
+	At     time.Time   `json:"at"`
+}
+
+// endEvent is the data of the "end" event sent once a job's log is complete.
+type endEvent struct {
+	State types.JobState `json:"state"`
+}
+
+// Get handles GET /jobs/{id}/logs. Clients that accept text/event-stream get
+// the log as server-sent events and, unless ?follow=false is set, keep
+// receiving chunks as agents upload them until the job finishes. Other
+// clients get the log up to now as plain text. The log can be resumed from a
+// byte offset with ?offset= or the Last-Event-ID header.
+func (h *LogHandler) Get(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	from, err := logOffset(q.Get("offset"), r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	follow := true
+	if v := q.Get("follow"); v != "" {
+		if follow, err = strconv.ParseBool(v); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "follow must be true or false")
+			return
+		}
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.writeText(w, r, job.ID, from)
+		return
+	}
+	h.stream(r.Context(), w, job, from, follow)
+}
+
+// writeText writes the log from offset as a plain text response.
+func (h *LogHandler) writeText(w http.ResponseWriter, r *http.Request, jobID string, from int64) {
+	chunks, err := h.feed.Read(r.Context(), jobID, from)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reading logs", "job_id", jobID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to read logs")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	for _, c := range chunks {
+		if _, err := w.Write(c.Data); err != nil {
+			return
+		}
+	}
+}
+
+// stream sends the log as server-sent events. Each chunk's event ID is the
+// offset just past it, which is where a reconnecting client resumes.
+func (h *LogHandler) stream(ctx context.Context, w http.ResponseWriter, job *types.Job, from int64, follow bool) {
+	rc := http.NewResponseController(w)
+	clearWriteDeadline(ctx, w, "log stream")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		// Take the wait channel first so nothing appended between the read
+		// and the wait is missed.
+		wake := h.feed.Wait(job.ID)
+		chunks, err := h.feed.Read(ctx, job.ID, from)
+		if err != nil {
+			slog.ErrorContext(ctx, "reading logs", "job_id", job.ID, "error", err)
+			return
+		}
+		for _, c := range chunks {
+			next := c.Offset + int64(len(c.Data))
+			ev := logEvent{Stream: c.Stream, Offset: c.Offset, Text: string(c.Data), At: c.At}
+			if err := writeEvent(w, "log", strconv.FormatInt(next, 10), ev); err != nil {
+				return
+			}
+			from = next
+		}
+
+		if !follow || job.State.Terminal() {
+			break
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-wake:
+			// A chunk may have been stored after the job was last loaded,
+			// so the log is read once more before stopping on a final state.
+			latest, err := h.jobs.Get(ctx, job.ID)
+			if err != nil {
+				slog.ErrorContext(ctx, "getting job", "job_id", job.ID, "error", err)
+				return
+			}
+			job = latest
+		}
+	}
+	_ = writeEvent(w, "end", "", endEvent{State: job.State})
+	_ = rc.Flush()
+}
+
+// writeEvent writes one server-sent event with a JSON payload.
+func writeEvent(w http.ResponseWriter, event, id string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// logOffset parses the byte offset to resume from. The query parameter takes
+// precedence over the Last-Event-ID header.
+func logOffset(query, lastEventID string) (int64, error) {
+	v := query
+	if v == "" {
+		v = lastEventID
+	}
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("offset must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// Search handles GET /search/logs, returning a page of the log lines of
+// finished jobs that match q, in projects the caller may view. Lines are
+// ordered by when their job finished; the optional project and job query
+// parameters narrow the search. Logs become searchable shortly after their
+// job finishes.
+func (h *LogHandler) Search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	search := storage.LogSearch{Query: strings.TrimSpace(q.Get("q")), Project: q.Get("project"), JobID: q.Get("job")}
+	if search.Query == "" {
+		utils.WriteError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Lines are only ordered by when their job finished.
+	page.Sort = storage.SortCreated
+
+	allowed := func(string) bool { return true }
+	if search.Project != "" {
+		if !authorize(w, r, h.authz, types.ActionView, search.Project) {
+			return
+		}
+	} else {
+		var ok bool
+		if allowed, ok = viewable(w, r, h.authz); !ok {
+			return
+		}
+	}
+
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.LogLine, error) {
+			search.Page = p
+			return h.index.SearchLogs(r.Context(), search)
+		},
+		func(line *types.LogLine) bool { return allowed(line.Project) },
+		func(line *types.LogLine) storage.Cursor { return storage.Cursor{Time: line.FinishedAt, ID: line.ID} })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "searching logs", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to search logs")
+		return
+	}
+	writeList(w, page, list, next)
+}
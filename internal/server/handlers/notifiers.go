@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/notifications"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// NotifierHandler manages the notifiers of projects and organizations.
+// Viewing them requires permission to view the project or organization;
+// changing them, since they may name the project's secrets, requires
+// permission to manage it.
+type NotifierHandler struct {
+	notifications *notifications.Service
+	authz         *rbac.Authorizer
+}
+
+// NewNotifierHandler returns a handler backed by the given service.
+func NewNotifierHandler(service *notifications.Service, authz *rbac.Authorizer) *NotifierHandler {
+	return &NotifierHandler{notifications: service, authz: authz}
+}
+
+// List handles GET /notifiers?project=owner/repo, returning a page of the
+// project's notifiers, or GET /notifiers?organization=name, returning a page
+// of the organization's.
+func (h *NotifierHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	project := r.URL.Query().Get("project")
+	org := r.URL.Query().Get("organization")
+	if (project == "") == (org == "") {
+		utils.WriteError(w, http.StatusBadRequest, "exactly one of the project and organization query parameters is required")
+		return
+	}
+	var all []*types.Notifier
+	if org != "" {
+		if !authorizeOrganization(w, r, h.authz, types.ActionView, org) {
+			return
+		}
+		all, err = h.notifications.ListOrganization(r.Context(), org)
+	} else {
+		if !authorize(w, r, h.authz, types.ActionView, project) {
+			return
+		}
+		all, err = h.notifications.List(r.Context(), project)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing notifiers", "project", project, "organization", org, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list notifiers")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Notifier) bool { return true },
+		func(n *types.Notifier) storage.Cursor { return page.Position(n.CreatedAt, n.UpdatedAt, n.ID) })
+	writeList(w, page, list, next)
+}
+
+// Create handles POST /notifiers.
+func (h *NotifierHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateNotifierRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Organization != "" {
+		if !authorizeOrganization(w, r, h.authz, types.ActionManage, req.Organization) {
+			return
+		}
+	} else if !authorize(w, r, h.authz, types.ActionManage, req.Project) {
+		return
+	}
+	notifier, err := h.notifications.Create(r.Context(), req, caller(r))
+	if errors.Is(err, notifications.ErrEmailDisabled) {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating notifier", "project", req.Project, "organization", req.Organization, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create notifier")
+		return
+	}
+	slog.InfoContext(r.Context(), "Created notifier", "notifier_id", notifier.ID, "project", notifier.Project, "organization", notifier.Organization,
+		"kind", notifier.Kind, "user", notifier.CreatedBy)
+	utils.WriteJSON(w, http.StatusCreated, notifier)
+}
+
+// Get handles GET /notifiers/{id}.
+func (h *NotifierHandler) Get(w http.ResponseWriter, r *http.Request) {
+	notifier, ok := h.load(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, notifier)
+}
+
+// Update handles PATCH /notifiers/{id}.
+func (h *NotifierHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var req types.UpdateNotifierRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	notifier, ok := h.load(w, r, types.ActionManage)
+	if !ok {
+		return
+	}
+	updated, err := h.notifications.Update(r.Context(), notifier.ID, req)
+	switch {
+	case errors.Is(err, notifications.ErrInvalid), errors.Is(err, notifications.ErrEmailDisabled):
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeNotifierNotFound, "notifier not found")
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "updating notifier", "notifier_id", notifier.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to update notifier")
+		return
+	}
+	slog.InfoContext(r.Context(), "Updated notifier", "notifier_id", updated.ID, "enabled", updated.Enabled, "user", caller(r))
+	utils.WriteJSON(w, http.StatusOK, updated)
+}
+
+// Delete handles DELETE /notifiers/{id}.
+func (h *NotifierHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	notifier, ok := h.load(w, r, types.ActionManage)
+	if !ok {
+		return
+	}
+	err := h.notifications.Delete(r.Context(), notifier.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeNotifierNotFound, "notifier not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting notifier", "notifier_id", notifier.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete notifier")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted notifier", "notifier_id", notifier.ID, "user", caller(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Test handles POST /notifiers/{id}/test, delivering a sample message
+// right away. A failed delivery is reported with 502 and its error.
+func (h *NotifierHandler) Test(w http.ResponseWriter, r *http.Request) {
+	notifier, ok := h.load(w, r, types.ActionManage)
+	if !ok {
+		return
+	}
+	if err := h.notifications.Test(r.Context(), notifier); err != nil {
+		utils.WriteError(w, http.StatusBadGateway, "delivery failed: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deliveries handles GET /notifiers/{id}/deliveries, returning a page of the
+// notifier's delivery log with the attempts of each delivery.
+func (h *NotifierHandler) Deliveries(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	notifier, ok := h.load(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.NotifierDelivery, error) {
+			return h.notifications.Deliveries(r.Context(), notifier.ID, p)
+		},
+		func(*types.NotifierDelivery) bool { return true },
+		func(d *types.NotifierDelivery) storage.Cursor { return page.Position(d.CreatedAt, d.CreatedAt, d.ID) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing notifier deliveries", "notifier_id", notifier.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list notifier deliveries")
+		return
+	}
+	writeList(w, page, list, next)
+}
+
+// load fetches the notifier named in the path and checks that the caller
+// may perform action on its project or organization. If not, it writes the
+// error response and returns false.
+func (h *NotifierHandler) load(w http.ResponseWriter, r *http.Request, action types.Action) (*types.Notifier, bool) {
+	notifier, err := h.notifications.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeNotifierNotFound, "notifier not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting notifier", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get notifier")
+		return nil, false
+	}
+	if notifier.Organization != "" {
+		if !authorizeOrganization(w, r, h.authz, action, notifier.Organization) {
+			return nil, false
+		}
+	} else if !authorize(w, r, h.authz, action, notifier.Project) {
+		return nil, false
+	}
+	return notifier, true
+}
+
+// Preferences handles GET /notifications/preferences, returning the
+// notification preferences of the calling user.
+func (h *NotifierHandler) Preferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := preferenceUser(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := h.notifications.Preferences(r.Context(), user)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePreferencesNotFound, "no notification preferences set")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting notification preferences", "user", user, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get notification preferences")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, prefs)
+}
+
+// PutPreferences handles PUT /notifications/preferences, replacing the
+// notification preferences of the calling user. Only projects the user may
+// view can be followed.
+func (h *NotifierHandler) PutPreferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := preferenceUser(w, r)
+	if !ok {
+		return
+	}
+	var req types.PutNotificationPreferencesRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, project := range req.Projects {
+		if !authorize(w, r, h.authz, types.ActionView, project) {
+			return
+		}
+	}
+	prefs := req.Preferences(user)
+	err := h.notifications.PutPreferences(r.Context(), prefs)
+	if errors.Is(err, notifications.ErrEmailDisabled) {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "setting notification preferences", "user", user, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to set notification preferences")
+		return
+	}
+	slog.InfoContext(r.Context(), "Set notification preferences", "user", user, "projects", len(prefs.Projects), "enabled", prefs.Enabled)
+	utils.WriteJSON(w, http.StatusOK, prefs)
+}
+
+// DeletePreferences handles DELETE /notifications/preferences, removing the
+// notification preferences of the calling user.
+func (h *NotifierHandler) DeletePreferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := preferenceUser(w, r)
+	if !ok {
+		return
+	}
+	err := h.notifications.DeletePreferences(r.Context(), user)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePreferencesNotFound, "no notification preferences set")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting notification preferences", "user", user, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete notification preferences")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted notification preferences", "user", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preferenceUser returns the user of the calling token, whose notification
+// preferences are at stake. Tokens without a user have none; for them it
+// writes a 403 response and returns false.
+func preferenceUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := auth.TokenFrom(r.Context()).User
+	if user == "" {
+		utils.WriteError(w, http.StatusForbidden, "notification preferences belong to users; this token has none")
+		return "", false
+	}
+	return user, true
+}
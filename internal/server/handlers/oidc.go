@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+
+	"open-cicd/internal/oidc"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// OIDCHandler serves the discovery documents cloud providers verify the ID
+// tokens of jobs with.
+type OIDCHandler struct {
+	issuer *oidc.Issuer
+}
+
+// NewOIDCHandler returns a handler serving the documents of issuer, which is
+// nil when the server issues no ID tokens.
+func NewOIDCHandler(issuer *oidc.Issuer) *OIDCHandler {
+	return &OIDCHandler{issuer: issuer}
+}
+
+// Configuration handles GET /.well-known/openid-configuration.
+func (h *OIDCHandler) Configuration(w http.ResponseWriter, r *http.Request) {
+	if h.issuer == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeIDTokensNotConfigured, "the server issues no ID tokens")
+		return
+	}
+	// Providers fetch the documents whenever they verify a token; a short
+	// cache spares the server without delaying a key change for long.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, h.issuer.Configuration())
+}
+
+// Keys handles GET /.well-known/jwks.json.
+func (h *OIDCHandler) Keys(w http.ResponseWriter, r *http.Request) {
+	if h.issuer == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeIDTokensNotConfigured, "the server issues no ID tokens")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, h.issuer.Keys())
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/orgs"
+	"open-cicd/internal/projects"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/scm"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// OrganizationHandler serves the organization and project endpoints.
+// Creating and deleting organizations needs the admin role on the whole
+// server; everything else needs a role on all projects of the organization.
+type OrganizationHandler struct {
+	orgs      *orgs.Service
+	bootstrap *projects.Bootstrapper
+	authz     *rbac.Authorizer
+}
+
+// NewOrganizationHandler returns a handler backed by the given service,
+// onboarding repositories with bootstrap.
+func NewOrganizationHandler(service *orgs.Service, bootstrap *projects.Bootstrapper, authz *rbac.Authorizer) *OrganizationHandler {
+	return &OrganizationHandler{orgs: service, bootstrap: bootstrap, authz: authz}
+}
+
+// List handles GET /orgs, returning a page of the organizations the caller
+// may view. Organizations are never updated, so both sort orders list them
+// by creation time.
+func (h *OrganizationHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := organizations(w, r, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	list, err := h.orgs.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing organizations", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list organizations")
+		return
+	}
+	orgs, next := collectLoaded(page, list,
+		func(org *types.Organization) bool { return allowed(org.Name) },
+		func(org *types.Organization) storage.Cursor {
+			return page.Position(org.CreatedAt, org.CreatedAt, org.Name)
+		})
+	writeList(w, page, orgs, next)
+}
+
+// Create handles POST /orgs. The response carries the registration token of
+// the organization's agents, which is only shown once.
+func (h *OrganizationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	var req types.CreateOrganizationRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	org, token, err := h.orgs.Create(r.Context(), req)
+	if errors.Is(err, storage.ErrConflict) {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeOrganizationExists, "organization "+req.Name+" already exists")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating organization", "organization", req.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create organization")
+		return
+	}
+	slog.InfoContext(r.Context(), "Created organization", "organization", org.Name)
+	utils.WriteJSON(w, http.StatusCreated, types.CreateOrganizationResponse{Organization: *org, RegistrationToken: token})
+}
+
+// Get handles GET /orgs/{name}.
+func (h *OrganizationHandler) Get(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionView, name) {
+		return
+	}
+	org, err := h.orgs.Get(r.Context(), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting organization", "organization", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get organization")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, org)
+}
+
+// Delete handles DELETE /orgs/{name}. Only organizations without projects
+// can be deleted.
+func (h *OrganizationHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err := h.orgs.Delete(r.Context(), name)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+	case errors.Is(err, orgs.ErrHasProjects):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "deleting organization", "organization", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete organization")
+	default:
+		slog.InfoContext(r.Context(), "Deleted organization", "organization", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RotateRegistrationToken handles POST /orgs/{name}/registration-token,
+// replacing the token the organization's agents register with.
+func (h *OrganizationHandler) RotateRegistrationToken(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, name) {
+		return
+	}
+	org, token, err := h.orgs.RotateRegistrationToken(r.Context(), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "rotating registration token", "organization", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to rotate registration token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Rotated registration token", "organization", name)
+	utils.WriteJSON(w, http.StatusOK, types.CreateOrganizationResponse{Organization: *org, RegistrationToken: token})
+}
+
+// ListProjects handles GET /orgs/{name}/projects, returning a page of the
+// organization's projects that the caller may view. Projects are never
+// updated, so both sort orders list them by creation time.
+func (h *OrganizationHandler) ListProjects(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	projects, err := h.orgs.ListProjects(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing projects", "organization", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list projects")
+		return
+	}
+	list, next := collectLoaded(page, projects,
+		func(project *types.Project) bool { return allowed(project.Name) },
+		func(project *types.Project) storage.Cursor {
+			return page.Position(project.CreatedAt, project.CreatedAt, project.Name)
+		})
+	writeList(w, page, list, next)
+}
+
+// CreateProject handles POST /orgs/{name}/projects. A repository can belong
+// to one organization only, and stays with it.
+func (h *OrganizationHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, name) {
+		return
+	}
+	var req types.CreateProjectRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	project, err := h.orgs.CreateProject(r.Context(), name, req)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+	case errors.Is(err, storage.ErrConflict):
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeProjectInOrganization, "project "+req.Name+" already belongs to an organization")
+	case err != nil:
+		slog.ErrorContext(r.Context(), "creating project", "organization", name, "project", req.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create project")
+	default:
+		slog.InfoContext(r.Context(), "Created project", "organization", name, "project", project.Name)
+		utils.WriteJSON(w, http.StatusCreated, project)
+	}
+}
+
+// BootstrapProject handles POST /projects, onboarding a repository: its
+// project is created in the organization, the server's webhook registered
+// on it with the SCM credential given or stored, and its pipeline file, if any, dry
+// run for a push to the default branch.
+func (h *OrganizationHandler) BootstrapProject(w http.ResponseWriter, r *http.Request) {
+	var req types.BootstrapProjectRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, req.Organization) {
+		return
+	}
+
+	result, err := h.bootstrap.Bootstrap(r.Context(), req)
+	switch {
+	case errors.Is(err, projects.ErrInvalidRepository), errors.Is(err, projects.ErrUnknownProvider), errors.Is(err, projects.ErrNoCredential):
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+	case errors.Is(err, storage.ErrConflict):
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeProjectExists, err.Error())
+	case errors.Is(err, scm.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRepositoryNotFound, err.Error())
+	case errors.Is(err, scm.ErrAccessDenied):
+		utils.WriteErrorCode(w, http.StatusUnprocessableEntity, types.CodeSCMAccessDenied, err.Error())
+	case errors.Is(err, projects.ErrWebhooksNotConfigured):
+		utils.WriteErrorCode(w, http.StatusUnprocessableEntity, types.CodeWebhooksNotConfigured, err.Error())
+	case errors.Is(err, projects.ErrProvider):
+		slog.WarnContext(r.Context(), "bootstrapping project", "organization", req.Organization, "repository", req.RepositoryURL, "error", err)
+		utils.WriteErrorCode(w, http.StatusBadGateway, types.CodeSCMUnavailable, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "bootstrapping project", "organization", req.Organization, "repository", req.RepositoryURL, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to bootstrap project")
+	default:
+		slog.InfoContext(r.Context(), "Bootstrapped project", "organization", req.Organization, "project", result.Project.Name,
+			"provider", result.Webhook.Provider, "hook_id", result.Webhook.ID, "pipeline_file", result.PipelineFile)
+		utils.WriteJSON(w, http.StatusCreated, result)
+	}
+}
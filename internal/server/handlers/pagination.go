@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/utils"
+)
+
+const (
+	// defaultPageLimit is the page size of list requests without a limit.
+	defaultPageLimit = 100
+	// maxPageLimit caps the page size a list request may ask for.
+	maxPageLimit = 1000
+	// minFetch is the fewest records fetched at a time while filling a
+	// page, so that pages of callers who may view few of the records do not
+	// take one query per record.
+	minFetch = 100
+)
+
+// listResponse is the envelope of every list endpoint. NextCursor is set
+// when there may be more records; passing it back as the cursor query
+// parameter, along with the same filters and sort order, fetches them.
+type listResponse[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursorToken is the decoded form of a cursor. It records the sort order it
+// was issued for, so that it is not applied to a list ordered differently.
+type cursorToken struct {
+	Sort storage.SortField `json:"s"`
+	Desc bool              `json:"d,omitempty"`
+	Time time.Time         `json:"t"`
+	ID   string            `json:"id"`
+}
+
+// parsePage reads the limit, cursor, sort and order query parameters of a
+// list request. Lists are ordered by creation time, oldest first, unless
+// sort=updated or order=desc say otherwise.
+func parsePage(r *http.Request) (storage.Page, error) {
+	q := r.URL.Query()
+	page := storage.Page{Sort: storage.SortCreated, Limit: defaultPageLimit}
+
+	switch field := storage.SortField(q.Get("sort")); field {
+	case "", storage.SortCreated:
+	case storage.SortUpdated:
+		page.Sort = field
+	default:
+		return page, fmt.Errorf("sort must be %s or %s", storage.SortCreated, storage.SortUpdated)
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		page.Desc = true
+	default:
+		return page, errors.New("order must be asc or desc")
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+	if v := q.Get("cursor"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		var token cursorToken
+		if err == nil {
+			err = json.Unmarshal(raw, &token)
+		}
+		if err != nil || token.ID == "" {
+			return page, errors.New("invalid cursor")
+		}
+		if token.Sort != page.Sort || token.Desc != page.Desc {
+			return page, errors.New("cursor was issued for a different sort order")
+		}
+		page.After = &storage.Cursor{Time: token.Time, ID: token.ID}
+	}
+	return page, nil
+}
+
+// collect fills the page of a list from fetch, keeping only the records keep
+// accepts. Records the caller may not view are dropped after fetching, so it
+// fetches again until the page is full or the list ends. It returns the
+// position of the last record as the next cursor, unless the list ended.
+func collect[T any](page storage.Page, fetch func(storage.Page) ([]T, error), keep func(T) bool, pos func(T) storage.Cursor) ([]T, *storage.Cursor, error) {
+	limit := page.Limit
+	items := make([]T, 0, limit)
+	for {
+		// One record beyond the page tells whether there are more.
+		page.Limit = max(limit+1-len(items), minFetch)
+		batch, err := fetch(page)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range batch {
+			if !keep(record) {
+				continue
+			}
+			if len(items) == limit {
+				next := pos(items[len(items)-1])
+				return items, &next, nil
+			}
+			items = append(items, record)
+		}
+		if len(batch) < page.Limit {
+			return items, nil, nil
+		}
+		after := pos(batch[len(batch)-1])
+		page.After = &after
+	}
+}
+
+// collectLoaded is collect for lists that are loaded whole, such as tokens
+// or a job's artifacts, which stay small.
+func collectLoaded[T any](page storage.Page, records []T, keep func(T) bool, pos func(T) storage.Cursor) ([]T, *storage.Cursor) {
+	order := func(a, b storage.Cursor) int {
+		c := cmp.Or(a.Time.Compare(b.Time), cmp.Compare(a.ID, b.ID))
+		if page.Desc {
+			return -c
+		}
+		return c
+	}
+	records = slices.Clone(records)
+	slices.SortFunc(records, func(a, b T) int { return order(pos(a), pos(b)) })
+	fetch := func(p storage.Page) ([]T, error) {
+		rest := records
+		if p.After != nil {
+			rest = rest[sort.Search(len(rest), func(i int) bool { return order(pos(rest[i]), *p.After) > 0 }):]
+		}
+		return rest[:min(p.Limit, len(rest))], nil
+	}
+	items, next, _ := collect(page, fetch, keep, pos)
+	return items, next
+}
+
+// writeList writes a page of a list ordered as page is, with the cursor of
+// the page after it if next is set.
+func writeList[T any](w http.ResponseWriter, page storage.Page, items []T, next *storage.Cursor) {
+	resp := listResponse[T]{Items: items}
+	if next != nil {
+		raw, _ := json.Marshal(cursorToken{Sort: page.Sort, Desc: page.Desc, Time: next.Time, ID: next.ID})
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	utils.WriteJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,690 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/annotations"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// maxDefinitionBytes caps the size of a pipeline definition upload.
+const maxDefinitionBytes = 1 << 20
+
+const (
+	// defaultAnalyticsRange is how far back analytics look without since.
+	defaultAnalyticsRange = 30 * 24 * time.Hour
+	// maxAnalyticsRange bounds the range of one analytics request.
+	maxAnalyticsRange = 366 * 24 * time.Hour
+)
+
+// PipelineHandler serves pipeline submission and query endpoints.
+type PipelineHandler struct {
+	jobs         *jobs.Manager
+	backpressure *scheduler.Backpressure
+	templates    pipeline.TemplateLoader
+	annotations  *annotations.Service
+	authz        *rbac.Authorizer
+}
+
+// NewPipelineHandler returns a handler backed by the given job manager. A
+// pipeline belongs to the project of its repository. Submissions are checked
+// against backpressure first, the templates definitions include are loaded
+// with templates and runs are shown with the annotations of their jobs.
+func NewPipelineHandler(manager *jobs.Manager, backpressure *scheduler.Backpressure, templates pipeline.TemplateLoader, notes *annotations.Service, authz *rbac.Authorizer) *PipelineHandler {
+	return &PipelineHandler{jobs: manager, backpressure: backpressure, templates: templates, annotations: notes, authz: authz}
+}
+
+// Create handles POST /pipelines. It accepts either a JSON
+// CreatePipelineRequest or, with a YAML content type, the raw definition.
+func (h *PipelineHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreatePipelineRequest
+	if isYAML(r.Header.Get("Content-Type")) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDefinitionBytes))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "reading definition: "+err.Error())
+			return
+		}
+		req.Definition = string(body)
+		req.Repository = r.URL.Query().Get("repository")
+		req.Ref = r.URL.Query().Get("ref")
+		for _, input := range r.URL.Query()["input"] {
+			name, value, ok := strings.Cut(input, "=")
+			if !ok {
+				utils.WriteError(w, http.StatusBadRequest, "input "+input+" is not NAME=VALUE")
+				return
+			}
+			if req.Inputs == nil {
+				req.Inputs = make(map[string]string)
+			}
+			req.Inputs[name] = value
+		}
+	} else if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionRun, req.Repository) {
+		return
+	}
+
+	def, source, err := pipeline.ParseExpanded(r.Context(), []byte(req.Definition), h.templates)
+	var list pipeline.ErrorList
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	status, ok := admit(w, h.backpressure)
+	if !ok {
+		return
+	}
+
+	run, err := h.jobs.SubmitPipeline(r.Context(), jobs.PipelineSubmission{
+		Definition: def,
+		Source:     string(source),
+		Repository: req.Repository,
+		Ref:        req.Ref,
+		Inputs:     req.Inputs,
+	})
+	if errors.Is(err, jobs.ErrShuttingDown) {
+		w.Header().Set("Retry-After", "30")
+		utils.WriteError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if quotaExceeded(w, err) {
+		return
+	}
+	if errors.Is(err, jobs.ErrNothingToRun) || errors.Is(err, jobs.ErrImageNotResolved) {
+		utils.WriteError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "submitting pipeline", "pipeline", def.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to submit pipeline")
+		return
+	}
+	// Jobs of later stages are not queued yet, but will be soon enough
+	// to count until the next refresh.
+	h.backpressure.Accepted(len(run.JobIDs))
+	utils.WriteJSON(w, status, run)
+}
+
+// Start handles POST /pipelines/{name}/runs, starting a manual run of the
+// named pipeline with the inputs passed, from the definition of its latest
+// run.
+func (h *PipelineHandler) Start(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req types.StartPipelineRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionRun, req.Repository) {
+		return
+	}
+	status, ok := admit(w, h.backpressure)
+	if !ok {
+		return
+	}
+
+	run, err := h.jobs.StartPipeline(r.Context(), req.Repository, name, req.Ref, caller(r), req.Inputs)
+	var list pipeline.ErrorList
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		msg := "pipeline " + name + " has not run in " + req.Repository
+		if req.Ref != "" {
+			msg += " at " + req.Ref
+		}
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePipelineNotFound, msg)
+		return
+	case errors.Is(err, jobs.ErrInvalidInputs) && errors.As(err, &list):
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidInputs, "invalid inputs", list)
+		return
+	case errors.Is(err, jobs.ErrNothingToRun), errors.Is(err, jobs.ErrImageNotResolved):
+		utils.WriteError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case rerunFailed(w, err):
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "starting pipeline", "pipeline", name, "repository", req.Repository, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to start pipeline")
+		return
+	}
+	slog.InfoContext(r.Context(), "Started pipeline", "pipeline_id", run.ID, "pipeline", name, "repository", run.Repository, "ref", run.Ref, "by", caller(r))
+	h.backpressure.Accepted(len(run.JobIDs))
+	utils.WriteJSON(w, status, run)
+}
+
+// DryRun handles POST /pipelines/dry-run, reporting which stages and steps
+// of a definition would run for a trigger without starting anything.
+func (h *PipelineHandler) DryRun(w http.ResponseWriter, r *http.Request) {
+	var req types.DryRunPipelineRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	def, _, err := pipeline.ParseExpanded(r.Context(), []byte(req.Definition), h.templates)
+	var list pipeline.ErrorList
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cond := pipeline.NewConditionContext(req.Trigger, req.Repository, req.Ref)
+	utils.WriteJSON(w, http.StatusOK, def.Plan(&cond))
+}
+
+// Preview handles POST /pipelines/preview, returning a definition with its
+// templates expanded and its expressions resolved as they would be for a
+// run of the repository at ref started by the trigger. Secret expressions
+// are kept as they are, since their values are only ever given to jobs.
+// The caller must be able to view the repository, whose variables the
+// definition is resolved with.
+func (h *PipelineHandler) Preview(w http.ResponseWriter, r *http.Request) {
+	var req types.DryRunPipelineRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Repository == "" && req.Trigger != nil {
+		req.Repository = req.Trigger.Repository
+	}
+	if req.Repository != "" && !authorize(w, r, h.authz, types.ActionView, req.Repository) {
+		return
+	}
+	def, _, err := pipeline.ParseExpanded(r.Context(), []byte(req.Definition), h.templates)
+	var list pipeline.ErrorList
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ref := req.Ref
+	if ref == "" && req.Trigger != nil {
+		ref = req.Trigger.Ref
+	}
+	_, err = h.jobs.Interpolate(r.Context(), def, req.Repository, ref, "", req.Trigger, req.Inputs)
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "resolving pipeline definition", "repository", req.Repository, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resolve pipeline definition")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, def)
+}
+
+// Validate handles POST /pipelines/validate, checking a definition as
+// running it would without running it: unknown keys, dependency cycles,
+// malformed expressions and, given a repository, expressions referring to
+// variables or secrets the project lacks. It accepts a JSON
+// ValidatePipelineRequest or, with a YAML content type, the raw definition,
+// and answers 200 either way, with the problems found.
+func (h *PipelineHandler) Validate(w http.ResponseWriter, r *http.Request) {
+	var req types.ValidatePipelineRequest
+	if isYAML(r.Header.Get("Content-Type")) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDefinitionBytes))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, "reading definition: "+err.Error())
+			return
+		}
+		req.Definition = string(body)
+		req.Repository = r.URL.Query().Get("repository")
+		req.Ref = r.URL.Query().Get("ref")
+	} else if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Repository != "" && !authorize(w, r, h.authz, types.ActionView, req.Repository) {
+		return
+	}
+
+	result := types.PipelineValidation{Errors: []types.PipelineProblem{}, Warnings: []types.PipelineProblem{}}
+	def, _, err := pipeline.ParseExpanded(r.Context(), []byte(req.Definition), h.templates)
+	if err != nil {
+		result.Errors = problems(err)
+		utils.WriteJSON(w, http.StatusOK, result)
+		return
+	}
+	// Warnings look for the input expressions interpolating replaces.
+	result.Warnings = problems(def.Warnings())
+	switch {
+	case req.Repository == "" && def.UsesVariables():
+		result.Warnings = append(result.Warnings, types.PipelineProblem{
+			Message: "variables and secrets were not checked; give the repository of the definition to check them",
+		})
+	case req.Repository != "":
+		_, err = h.jobs.Interpolate(r.Context(), def, req.Repository, req.Ref, "", nil, nil)
+		var list pipeline.ErrorList
+		if err != nil && !errors.As(err, &list) {
+			slog.ErrorContext(r.Context(), "resolving pipeline definition", "repository", req.Repository, "error", err)
+			utils.WriteError(w, http.StatusInternalServerError, "failed to resolve pipeline definition")
+			return
+		}
+		result.Errors = problems(list)
+	}
+	result.Valid = len(result.Errors) == 0
+	utils.WriteJSON(w, http.StatusOK, result)
+}
+
+// problems returns the problems err describes: those of an ErrorList, or
+// err itself, such as a template that failed to load.
+func problems(err error) []types.PipelineProblem {
+	out := []types.PipelineProblem{}
+	if err == nil {
+		return out
+	}
+	var list pipeline.ErrorList
+	if !errors.As(err, &list) {
+		return append(out, types.PipelineProblem{Message: err.Error()})
+	}
+	for _, e := range list {
+		out = append(out, types.PipelineProblem{Line: e.Line, Path: e.Path, Message: e.Message})
+	}
+	return out
+}
+
+// List handles GET /pipelines, returning a page of the runs of projects the
+// caller may view. The optional project, organization, state and branch
+// query parameters filter the runs; see parsePage for paging and sorting.
+func (h *PipelineHandler) List(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := storage.PipelineFilter{
+		State:        types.PipelineState(q.Get("state")),
+		Repository:   q.Get("project"),
+		Organization: q.Get("organization"),
+		Branch:       q.Get("branch"),
+		Name:         q.Get("name"),
+	}
+	if filter.State != "" && !filter.State.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, "unknown pipeline state "+string(filter.State))
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.Pipeline, error) {
+			filter.Page = p
+			return h.jobs.ListPipelines(r.Context(), filter)
+		},
+		func(run *types.Pipeline) bool { return allowed(run.Repository) },
+		func(run *types.Pipeline) storage.Cursor { return page.Position(run.CreatedAt, run.UpdatedAt, run.ID) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing pipelines", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list pipelines")
+		return
+	}
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /pipelines/{id}, the run with the annotations its jobs
+// published, those carried over by a rerun included.
+func (h *PipelineHandler) Get(w http.ResponseWriter, r *http.Request) {
+	run, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.annotations.List(r.Context(), run.JobIDs...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing annotations", "pipeline_id", run.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list annotations")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, types.PipelineDetail{
+		Pipeline:         run,
+		AnnotationCounts: types.CountAnnotations(list),
+		Annotations:      list,
+	})
+}
+
+// Graph handles GET /pipelines/{id}/graph, the stage dependency graph of a
+// run with the current state of each stage and job.
+func (h *PipelineHandler) Graph(w http.ResponseWriter, r *http.Request) {
+	run, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	graph, err := h.jobs.PipelineGraph(r.Context(), run)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "building pipeline graph", "pipeline_id", run.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to build pipeline graph")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, graph)
+}
+
+// Timeline handles GET /pipelines/{id}/timeline, when a run and each of its
+// stages and jobs waited, started and finished.
+func (h *PipelineHandler) Timeline(w http.ResponseWriter, r *http.Request) {
+	run, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	timeline, err := h.jobs.PipelineTimeline(r.Context(), run)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "building pipeline timeline", "pipeline_id", run.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to build pipeline timeline")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, timeline)
+}
+
+// Compare handles GET /pipelines/compare, how the run head differs from
+// the run base, both named by ID in the query: the jobs only one of them
+// has, how the duration of each job both have changed and the inputs and
+// job variables that differ.
+func (h *PipelineHandler) Compare(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("base") == "" || q.Get("head") == "" {
+		utils.WriteError(w, http.StatusBadRequest, "base and head are required")
+		return
+	}
+	base, ok := h.loadID(w, r, q.Get("base"))
+	if !ok {
+		return
+	}
+	head, ok := h.loadID(w, r, q.Get("head"))
+	if !ok {
+		return
+	}
+	comparison, err := h.jobs.ComparePipelines(r.Context(), base, head)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "comparing pipelines", "base", base.ID, "head", head.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to compare pipelines")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, comparison)
+}
+
+// Analytics handles GET /analytics, the p50 and p95 durations of the
+// finished runs of each pipeline of projects the caller may view, overall
+// and per hour, day or week. The optional project, organization, branch and
+// name query parameters filter the runs; since and until are RFC 3339 times
+// bounding when the runs were created, by default the last 30 days.
+func (h *PipelineHandler) Analytics(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := jobs.AnalyticsQuery{
+		Filter: storage.PipelineFilter{
+			Repository:   q.Get("project"),
+			Organization: q.Get("organization"),
+			Branch:       q.Get("branch"),
+		},
+		Name:  q.Get("name"),
+		Until: time.Now(),
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, t.name+" must be an RFC 3339 time such as 2024-05-01T00:00:00Z")
+			return
+		}
+		*t.dst = parsed
+	}
+	if query.Since.IsZero() {
+		query.Since = query.Until.Add(-defaultAnalyticsRange)
+	}
+	if !query.Since.Before(query.Until) {
+		utils.WriteError(w, http.StatusBadRequest, "since must be before until")
+		return
+	}
+	if query.Until.Sub(query.Since) > maxAnalyticsRange {
+		utils.WriteError(w, http.StatusBadRequest, "since and until may be at most 366 days apart")
+		return
+	}
+	interval, err := types.ParseAnalyticsInterval(q.Get("interval"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Interval = interval
+
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+	analytics, err := h.jobs.PipelineAnalytics(r.Context(), query, func(run *types.Pipeline) bool { return allowed(run.Repository) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "computing pipeline analytics", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to compute pipeline analytics")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, analytics)
+}
+
+// Rerun handles POST /pipelines/{id}/rerun, starting a new run of a
+// finished run's definition for the same commit and trigger. With
+// failed_only, the stages that succeeded are carried over instead of run
+// again.
+func (h *PipelineHandler) Rerun(w http.ResponseWriter, r *http.Request) {
+	var req types.RerunPipelineRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	run, ok := h.load(w, r)
+	if !ok || !authorize(w, r, h.authz, types.ActionRun, run.Repository) {
+		return
+	}
+	next, err := h.jobs.RerunPipeline(r.Context(), run.ID, caller(r), req.FailedOnly)
+	if rerunFailed(w, err) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "re-running pipeline", "pipeline_id", run.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to re-run pipeline")
+		return
+	}
+	slog.InfoContext(r.Context(), "Re-ran pipeline", "pipeline_id", next.ID, "rerun_of", run.ID, "failed_only", req.FailedOnly, "by", caller(r))
+	utils.WriteJSON(w, http.StatusCreated, next)
+}
+
+// rerunFailed writes the response for the errors a re-run or retry is
+// refused with, and reports whether err was one of them.
+func rerunFailed(w http.ResponseWriter, err error) bool {
+	var list pipeline.ErrorList
+	switch {
+	case errors.As(err, &list):
+		// The variables or secrets the run's definition refers to have
+		// been deleted since.
+		utils.WriteErrorDetails(w, http.StatusUnprocessableEntity, types.CodeInvalidPipeline, "pipeline definition no longer resolves", list)
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePipelineNotFound, "pipeline not found")
+	case errors.Is(err, jobs.ErrNotFinished), errors.Is(err, jobs.ErrNothingToRerun), errors.Is(err, jobs.ErrNotRetryable):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, jobs.ErrShuttingDown):
+		w.Header().Set("Retry-After", "30")
+		utils.WriteError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		return quotaExceeded(w, err)
+	}
+	return true
+}
+
+// Approve handles POST /pipelines/{id}/stages/{stage}/approve, releasing the
+// jobs of a manual stage that is awaiting approval.
+func (h *PipelineHandler) Approve(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, types.Approved)
+}
+
+// Reject handles POST /pipelines/{id}/stages/{stage}/reject, skipping a
+// manual stage that is awaiting approval and the stages that need it.
+func (h *PipelineHandler) Reject(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, types.Rejected)
+}
+
+// decide records a decision on a manual stage. The caller needs to be
+// allowed to run the project's pipelines and, if the stage lists
+// approvers, to be one of them.
+func (h *PipelineHandler) decide(w http.ResponseWriter, r *http.Request, decision types.ApprovalDecision) {
+	var req types.StageDecisionRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	run, ok := h.load(w, r)
+	if !ok || !authorize(w, r, h.authz, types.ActionRun, run.Repository) {
+		return
+	}
+	name := mux.Vars(r)["stage"]
+	stage := run.Stage(name)
+	if stage == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeStageNotFound, "stage not found")
+		return
+	}
+	err := h.authz.AuthorizeApproval(r.Context(), stage.Approvers)
+	if errors.Is(err, rbac.ErrForbidden) {
+		utils.WriteError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "authorizing approval", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize request")
+		return
+	}
+
+	updated, err := h.jobs.DecideStage(r.Context(), run.ID, name, decision, caller(r), req.Comment)
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, jobs.ErrStageNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeStageNotFound, "stage not found")
+	case errors.Is(err, jobs.ErrNotAwaitingApproval):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "deciding on stage", "pipeline_id", run.ID, "stage", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to record the decision")
+	default:
+		slog.InfoContext(r.Context(), "Decided on manual stage", "pipeline_id", run.ID, "stage", name, "decision", decision, "by", caller(r))
+		utils.WriteJSON(w, http.StatusOK, updated)
+	}
+}
+
+// Authorize handles POST /pipelines/{id}/authorize, letting a run of a pull
+// request from a fork start. The caller needs to be allowed to run the
+// project's pipelines, and to manage the project to grant the run secrets.
+func (h *PipelineHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	var req types.AuthorizePipelineRequest
+	if r.ContentLength != 0 {
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	run, ok := h.load(w, r)
+	if !ok || !authorize(w, r, h.authz, types.ActionRun, run.Repository) {
+		return
+	}
+	if req.Secrets && !authorize(w, r, h.authz, types.ActionManage, run.Repository) {
+		return
+	}
+	updated, err := h.jobs.AuthorizePipeline(r.Context(), run.ID, caller(r), req.Comment, req.Secrets)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePipelineNotFound, "pipeline not found")
+	case errors.Is(err, jobs.ErrNotAwaitingAuthorization):
+		utils.WriteError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "authorizing pipeline", "pipeline_id", run.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to authorize the pipeline")
+	default:
+		slog.InfoContext(r.Context(), "Authorized pipeline", "pipeline_id", run.ID, "secrets", req.Secrets, "by", caller(r))
+		utils.WriteJSON(w, http.StatusOK, updated)
+	}
+}
+
+// load fetches the pipeline named in the path and checks that the caller
+// may view it. If not, it writes the error response and returns false.
+func (h *PipelineHandler) load(w http.ResponseWriter, r *http.Request) (*types.Pipeline, bool) {
+	return h.loadID(w, r, mux.Vars(r)["id"])
+}
+
+// loadID is load for the pipeline with the given ID.
+func (h *PipelineHandler) loadID(w http.ResponseWriter, r *http.Request, id string) (*types.Pipeline, bool) {
+	run, err := h.jobs.GetPipeline(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodePipelineNotFound, "pipeline not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting pipeline", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get pipeline")
+		return nil, false
+	}
+	if !authorize(w, r, h.authz, types.ActionView, run.Repository) {
+		return nil, false
+	}
+	return run, true
+}
+
+// isYAML reports whether a Content-Type header denotes a YAML body.
+func isYAML(contentType string) bool {
+	return strings.Contains(contentType, "yaml")
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// QuotaHandler manages the quotas that limit what each project takes of the
+// shared agent fleet.
+type QuotaHandler struct {
+	jobs  *jobs.Manager
+	authz *rbac.Authorizer
+}
+
+// NewQuotaHandler returns a handler backed by the given job manager.
+// Projects may read their own quota, but only those with a role on all
+// projects of the server may set quotas, lest a project lift its own.
+func NewQuotaHandler(manager *jobs.Manager, authz *rbac.Authorizer) *QuotaHandler {
+	return &QuotaHandler{jobs: manager, authz: authz}
+}
+
+// List handles GET /quotas, returning a page of the quotas set on projects.
+func (h *QuotaHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionView, "") {
+		return
+	}
+	all, err := h.jobs.ProjectQuotas(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing project quotas", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list quotas")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.ProjectQuota) bool { return true },
+		func(quota *types.ProjectQuota) storage.Cursor {
+			return page.Position(quota.UpdatedAt, quota.UpdatedAt, quota.Project)
+		})
+	writeList(w, page, list, next)
+}
+
+// Get handles GET /projects/{project}/quota, returning the default quota for
+// projects without one.
+func (h *QuotaHandler) Get(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	quota, err := h.jobs.ProjectQuota(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting project quota", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get quota")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, quota)
+}
+
+// Put handles PUT /projects/{project}/quota.
+func (h *QuotaHandler) Put(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	var req types.PutProjectQuotaRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	quota, err := h.jobs.SetProjectQuota(r.Context(), project, req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing project quota", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store quota")
+		return
+	}
+	slog.InfoContext(r.Context(), "Set project quota", "project", project,
+		"max_concurrent_jobs", quota.MaxConcurrentJobs, "max_queued_jobs", quota.MaxQueuedJobs, "weight", quota.Weight, "user", quota.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, quota)
+}
+
+// Delete handles DELETE /projects/{project}/quota, returning the project to
+// the default quota.
+func (h *QuotaHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	err := h.jobs.DeleteProjectQuota(r.Context(), project)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeQuotaNotFound, "project has no quota")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting project quota", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete quota")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted project quota", "project", project)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// RBACHandler serves the role binding and team management endpoints. They
+// need the admin role on all projects; the bindings of an organization can
+// also be managed with the admin role on all of its projects.
+type RBACHandler struct {
+	authz *rbac.Authorizer
+}
+
+// NewRBACHandler returns a handler backed by the given authorizer.
+func NewRBACHandler(authz *rbac.Authorizer) *RBACHandler {
+	return &RBACHandler{authz: authz}
+}
+
+// ListBindings handles GET /rbac/bindings, returning a page of the role
+// bindings the caller may manage. The optional project and organization
+// query parameters filter by project and organization. Bindings are never
+// updated, so both sort orders list them by creation time.
+func (h *RBACHandler) ListBindings(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	project, org := q.Get("project"), q.Get("organization")
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := organizations(w, r, h.authz, types.ActionManage)
+	if !ok {
+		return
+	}
+	bindings, err := h.authz.ListBindings(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing role bindings", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list role bindings")
+		return
+	}
+	list, next := collectLoaded(page, bindings,
+		func(binding *types.RoleBinding) bool {
+			return allowed(binding.Organization) && (project == "" || binding.Project == project) &&
+				(org == "" || binding.Organization == org)
+		},
+		func(binding *types.RoleBinding) storage.Cursor {
+			return page.Position(binding.CreatedAt, binding.CreatedAt, binding.ID)
+		})
+	writeList(w, page, list, next)
+}
+
+// CreateBinding handles POST /rbac/bindings.
+func (h *RBACHandler) CreateBinding(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateRoleBindingRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, req.Organization) {
+		return
+	}
+
+	binding, err := h.authz.CreateBinding(r.Context(), req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating role binding", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create role binding")
+		return
+	}
+	slog.InfoContext(r.Context(), "Bound role", "role", binding.Role, "project", binding.Project, "organization", binding.Organization, "subject_kind", binding.Subject.Kind, "subject", binding.Subject.Name)
+	utils.WriteJSON(w, http.StatusCreated, binding)
+}
+
+// DeleteBinding handles DELETE /rbac/bindings/{id}.
+func (h *RBACHandler) DeleteBinding(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	bindings, err := h.authz.ListBindings(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing role bindings", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete role binding")
+		return
+	}
+	i := slices.IndexFunc(bindings, func(b *types.RoleBinding) bool { return b.ID == id })
+	if i < 0 {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRoleBindingNotFound, "role binding not found")
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, bindings[i].Organization) {
+		return
+	}
+	err = h.authz.DeleteBinding(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRoleBindingNotFound, "role binding not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting role binding", "binding_id", id, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete role binding")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTeams handles GET /rbac/teams, returning a page of the teams. Teams
+// only record when they were last changed, which both sort orders use.
+func (h *RBACHandler) ListTeams(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionManage, types.AllProjects) {
+		return
+	}
+	teams, err := h.authz.ListTeams(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing teams", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list teams")
+		return
+	}
+	list, next := collectLoaded(page, teams,
+		func(*types.Team) bool { return true },
+		func(team *types.Team) storage.Cursor {
+			return page.Position(team.UpdatedAt, team.UpdatedAt, team.Name)
+		})
+	writeList(w, page, list, next)
+}
+
+// PutTeam handles PUT /rbac/teams/{name}, creating the team or replacing its
+// members.
+func (h *RBACHandler) PutTeam(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, h.authz, types.ActionManage, types.AllProjects) {
+		return
+	}
+	var req types.PutTeamRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	team, err := h.authz.PutTeam(r.Context(), name, req.Members)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "saving team", "team", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to save team")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, team)
+}
+
+// DeleteTeam handles DELETE /rbac/teams/{name}.
+func (h *RBACHandler) DeleteTeam(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, h.authz, types.ActionManage, types.AllProjects) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err := h.authz.DeleteTeam(r.Context(), name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeTeamNotFound, "team not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting team", "team", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete team")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"open-cicd/internal/releases"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// Headers describing a downloaded agent binary, which agents and installers
+// check it against.
+const (
+	headerAgentVersion   = "X-Agent-Version"
+	headerAgentSHA256    = "X-Agent-SHA256"
+	headerAgentSignature = "X-Agent-Signature"
+)
+
+// ReleaseHandler serves the agent binaries of the release the server rolls
+// out.
+type ReleaseHandler struct {
+	release *releases.Release
+}
+
+// NewReleaseHandler returns a handler serving release, which is nil when the
+// server has none.
+func NewReleaseHandler(release *releases.Release) *ReleaseHandler {
+	return &ReleaseHandler{release: release}
+}
+
+// Download handles GET /agents/download. The platform query parameter names
+// the GOOS/GOARCH to download the binary for; version, if given, must be the
+// release's. Binaries are not secret, so anyone may download them; the
+// headers carry the digest and signature to check them against.
+func (h *ReleaseHandler) Download(w http.ResponseWriter, r *http.Request) {
+	if h.release == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeReleaseNotFound, "the server has no agent release to download")
+		return
+	}
+	q := r.URL.Query()
+	platform := q.Get("platform")
+	if platform == "" {
+		utils.WriteError(w, http.StatusBadRequest, "platform is required, one of "+strings.Join(h.release.Platforms(), ", "))
+		return
+	}
+	if v := q.Get("version"); v != "" && v != h.release.Version {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeReleaseNotFound, "agent version "+v+" is not available; the server has "+h.release.Version)
+		return
+	}
+	binary, err := h.release.Binary(platform)
+	if errors.Is(err, releases.ErrNoBinary) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeReleaseNotFound, err.Error()+"; available: "+strings.Join(h.release.Platforms(), ", "))
+		return
+	}
+	f, err := os.Open(binary.Path)
+	var info os.FileInfo
+	if err == nil {
+		defer f.Close()
+		info, err = f.Stat()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "opening agent binary", "path", binary.Path, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to open agent binary")
+		return
+	}
+	// The file changing under a running server would invalidate the
+	// signature computed when it was loaded.
+	if info.Size() != binary.Size {
+		slog.ErrorContext(r.Context(), "agent binary changed since it was signed", "path", binary.Path)
+		utils.WriteError(w, http.StatusInternalServerError, "agent binary changed since it was signed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(binary.Path)+`"`)
+	w.Header().Set("ETag", `"`+binary.SHA256+`"`)
+	w.Header().Set(headerAgentVersion, binary.Version)
+	w.Header().Set(headerAgentSHA256, binary.SHA256)
+	w.Header().Set(headerAgentSignature, binary.Signature)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/gc"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// RetentionHandler manages the retention policies garbage collection
+// applies to projects, and runs collections on demand.
+type RetentionHandler struct {
+	gc    *gc.Collector
+	authz *rbac.Authorizer
+}
+
+// NewRetentionHandler returns a handler backed by the given collector.
+func NewRetentionHandler(collector *gc.Collector, authz *rbac.Authorizer) *RetentionHandler {
+	return &RetentionHandler{gc: collector, authz: authz}
+}
+
+// Get handles GET /projects/{project}/retention.
+func (h *RetentionHandler) Get(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	policy, err := h.gc.Policy(r.Context(), project)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRetentionNotFound, "project has no retention policy")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting retention policy", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get retention policy")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, policy)
+}
+
+// Put handles PUT /projects/{project}/retention.
+func (h *RetentionHandler) Put(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	var req types.PutRetentionPolicyRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	policy, err := h.gc.SetPolicy(r.Context(), project, req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing retention policy", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store retention policy")
+		return
+	}
+	slog.InfoContext(r.Context(), "Set retention policy", "project", project,
+		"keep_runs", policy.KeepRuns, "artifact_retention", policy.ArtifactRetention.Std(),
+		"log_retention", policy.LogRetention.Std(), "cache_quota", policy.CacheQuota, "user", policy.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, policy)
+}
+
+// Delete handles DELETE /projects/{project}/retention, after which garbage
+// collection keeps everything of the project.
+func (h *RetentionHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	err := h.gc.DeletePolicy(r.Context(), project)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRetentionNotFound, "project has no retention policy")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting retention policy", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete retention policy")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted retention policy", "project", project)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Preview handles GET /projects/{project}/gc, reporting what collecting the
+// project now would delete without deleting it.
+func (h *RetentionHandler) Preview(w http.ResponseWriter, r *http.Request) {
+	h.collect(w, r, types.ActionView, true)
+}
+
+// Collect handles POST /projects/{project}/gc, collecting the project now
+// rather than at the next periodic collection.
+func (h *RetentionHandler) Collect(w http.ResponseWriter, r *http.Request) {
+	h.collect(w, r, types.ActionManage, false)
+}
+
+func (h *RetentionHandler) collect(w http.ResponseWriter, r *http.Request, action types.Action, dryRun bool) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, action, project) {
+		return
+	}
+	report, err := h.gc.Collect(r.Context(), project, dryRun)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeRetentionNotFound, "project has no retention policy")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "collecting garbage", "project", project, "dry_run", dryRun, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to collect garbage")
+		return
+	}
+	if !dryRun {
+		slog.InfoContext(r.Context(), "Collected garbage", "project", project,
+			"runs", report.Deleted[types.GCRun], "bytes", report.ReclaimedBytes, "user", caller(r))
+	}
+	utils.WriteJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/schedules"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ScheduleHandler manages cron schedules. A schedule belongs to the project
+// of its repository; changing one requires permission to run its pipelines.
+type ScheduleHandler struct {
+	schedules *schedules.Service
+	authz     *rbac.Authorizer
+}
+
+// NewScheduleHandler returns a handler backed by the given schedule service.
+func NewScheduleHandler(service *schedules.Service, authz *rbac.Authorizer) *ScheduleHandler {
+	return &ScheduleHandler{schedules: service, authz: authz}
+}
+
+// List handles GET /schedules, returning a page of the schedules of
+// projects the caller may view. The optional project and branch query
+// parameters filter the schedules.
+func (h *ScheduleHandler) List(w http.ResponseWriter, r *http.Request) {
+	project, branch := r.URL.Query().Get("project"), r.URL.Query().Get("branch")
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+	all, err := h.schedules.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing schedules", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list schedules")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(schedule *types.Schedule) bool {
+			return allowed(schedule.Repository) &&
+				(project == "" || schedule.Repository == project) &&
+				(branch == "" || slices.Contains(storage.BranchRefs(branch), schedule.Ref))
+		},
+		func(schedule *types.Schedule) storage.Cursor {
+			return page.Position(schedule.CreatedAt, schedule.UpdatedAt, schedule.ID)
+		})
+	writeList(w, page, list, next)
+}
+
+// Create handles POST /schedules.
+func (h *ScheduleHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateScheduleRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionRun, req.Repository) {
+		return
+	}
+	schedule, err := h.schedules.Create(r.Context(), req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating schedule", "repository", req.Repository, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create schedule")
+		return
+	}
+	slog.InfoContext(r.Context(), "Created schedule", "schedule_id", schedule.ID, "repository", schedule.Repository, "cron", schedule.Cron, "user", schedule.CreatedBy)
+	utils.WriteJSON(w, http.StatusCreated, schedule)
+}
+
+// Get handles GET /schedules/{id}.
+func (h *ScheduleHandler) Get(w http.ResponseWriter, r *http.Request) {
+	schedule, ok := h.load(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, schedule)
+}
+
+// Update handles PATCH /schedules/{id}.
+func (h *ScheduleHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var req types.UpdateScheduleRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.update(w, r, req)
+}
+
+// Enable handles POST /schedules/{id}/enable.
+func (h *ScheduleHandler) Enable(w http.ResponseWriter, r *http.Request) {
+	enabled := true
+	h.update(w, r, types.UpdateScheduleRequest{Enabled: &enabled})
+}
+
+// Disable handles POST /schedules/{id}/disable.
+func (h *ScheduleHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	enabled := false
+	h.update(w, r, types.UpdateScheduleRequest{Enabled: &enabled})
+}
+
+// update applies a validated change to the schedule named in the path and
+// writes the response.
+func (h *ScheduleHandler) update(w http.ResponseWriter, r *http.Request, req types.UpdateScheduleRequest) {
+	schedule, ok := h.load(w, r, types.ActionRun)
+	if !ok {
+		return
+	}
+	updated, err := h.schedules.Update(r.Context(), schedule.ID, req)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeScheduleNotFound, "schedule not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "updating schedule", "schedule_id", schedule.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to update schedule")
+		return
+	}
+	slog.InfoContext(r.Context(), "Updated schedule", "schedule_id", updated.ID, "enabled", updated.Enabled, "user", caller(r))
+	utils.WriteJSON(w, http.StatusOK, updated)
+}
+
+// Delete handles DELETE /schedules/{id}.
+func (h *ScheduleHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	schedule, ok := h.load(w, r, types.ActionRun)
+	if !ok {
+		return
+	}
+	err := h.schedules.Delete(r.Context(), schedule.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeScheduleNotFound, "schedule not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting schedule", "schedule_id", schedule.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete schedule")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted schedule", "schedule_id", schedule.ID, "user", caller(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// load fetches the schedule named in the path and checks that the caller
+// may perform action on its project. If not, it writes the error response
+// and returns false.
+func (h *ScheduleHandler) load(w http.ResponseWriter, r *http.Request, action types.Action) (*types.Schedule, bool) {
+	schedule, err := h.schedules.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeScheduleNotFound, "schedule not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting schedule", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get schedule")
+		return nil, false
+	}
+	if !authorize(w, r, h.authz, action, schedule.Repository) {
+		return nil, false
+	}
+	return schedule, true
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/credentials"
+	"open-cicd/internal/orgs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// SCMCredentialHandler manages the credentials organizations and projects
+// store for their SCM providers. Tokens and keys can be written but are
+// never returned.
+type SCMCredentialHandler struct {
+	credentials *credentials.Service
+	orgs        *orgs.Service
+	authz       *rbac.Authorizer
+}
+
+// NewSCMCredentialHandler returns a handler backed by the given credential
+// service, looking up the organizations of projects in orgs.
+func NewSCMCredentialHandler(service *credentials.Service, orgs *orgs.Service, authz *rbac.Authorizer) *SCMCredentialHandler {
+	return &SCMCredentialHandler{credentials: service, orgs: orgs, authz: authz}
+}
+
+// List handles GET /orgs/{name}/scm-credentials, returning a page of the
+// credentials of the organization and its projects.
+func (h *SCMCredentialHandler) List(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionView, name) {
+		return
+	}
+	all, err := h.credentials.List(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing SCM credentials", "organization", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list SCM credentials")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.SCMCredential) bool { return true },
+		func(c *types.SCMCredential) storage.Cursor {
+			return page.Position(c.CreatedAt, c.UpdatedAt, c.Project+" "+c.Provider)
+		})
+	writeList(w, page, list, next)
+}
+
+// PutOrganization handles PUT /orgs/{name}/scm-credentials/{provider}, the
+// credential of every project of the organization without its own.
+func (h *SCMCredentialHandler) PutOrganization(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, name) {
+		return
+	}
+	h.put(w, r, name, "")
+}
+
+// PutProject handles PUT /projects/{project}/scm-credentials/{provider}.
+func (h *SCMCredentialHandler) PutProject(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	org, ok := h.organization(w, r, project)
+	if !ok {
+		return
+	}
+	h.put(w, r, org, project)
+}
+
+func (h *SCMCredentialHandler) put(w http.ResponseWriter, r *http.Request, org, project string) {
+	provider := mux.Vars(r)["provider"]
+	var req types.PutSCMCredentialRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(provider); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	credential, err := h.credentials.Put(r.Context(), org, project, provider, req, caller(r))
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeOrganizationNotFound, "organization not found")
+	case errors.Is(err, credentials.ErrWrongOrganization):
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeProjectInOrganization, err.Error())
+	case err != nil:
+		slog.ErrorContext(r.Context(), "storing SCM credential", "organization", org, "project", project, "provider", provider, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store SCM credential")
+	default:
+		slog.InfoContext(r.Context(), "Stored SCM credential", "organization", org, "project", project, "provider", provider,
+			"kind", credential.Kind, "user", credential.UpdatedBy)
+		utils.WriteJSON(w, http.StatusOK, credential)
+	}
+}
+
+// DeleteOrganization handles DELETE /orgs/{name}/scm-credentials/{provider}.
+func (h *SCMCredentialHandler) DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, name) {
+		return
+	}
+	h.delete(w, r, name, "")
+}
+
+// DeleteProject handles DELETE /projects/{project}/scm-credentials/{provider}.
+func (h *SCMCredentialHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	org, ok := h.organization(w, r, project)
+	if !ok {
+		return
+	}
+	h.delete(w, r, org, project)
+}
+
+func (h *SCMCredentialHandler) delete(w http.ResponseWriter, r *http.Request, org, project string) {
+	provider := mux.Vars(r)["provider"]
+	err := h.credentials.Delete(r.Context(), org, project, provider)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSCMCredentialNotFound, "SCM credential not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting SCM credential", "organization", org, "project", project, "provider", provider, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete SCM credential")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted SCM credential", "organization", org, "project", project, "provider", provider)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// organization returns the organization of project, writing a 404
+// response if it belongs to none.
+func (h *SCMCredentialHandler) organization(w http.ResponseWriter, r *http.Request, project string) (string, bool) {
+	p, err := h.orgs.GetProject(r.Context(), project)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeNotFound, "project not found; add it to an organization first")
+		return "", false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting project", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get project")
+		return "", false
+	}
+	return p.Organization, true
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/secrets"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// SecretHandler manages project secrets. Values can be written but are
+// never returned.
+type SecretHandler struct {
+	secrets *secrets.Service
+	authz   *rbac.Authorizer
+}
+
+// NewSecretHandler returns a handler backed by the given secret service.
+func NewSecretHandler(service *secrets.Service, authz *rbac.Authorizer) *SecretHandler {
+	return &SecretHandler{secrets: service, authz: authz}
+}
+
+// secretProject returns the project named by the required project query
+// parameter, writing a 400 response if it is missing.
+func secretProject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		utils.WriteError(w, http.StatusBadRequest, "project query parameter is required")
+		return "", false
+	}
+	return project, true
+}
+
+// List handles GET /secrets?project=owner/repo, returning a page of the
+// project's secrets.
+func (h *SecretHandler) List(w http.ResponseWriter, r *http.Request) {
+	project, ok := secretProject(w, r)
+	if !ok {
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	all, err := h.secrets.List(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing secrets", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list secrets")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Secret) bool { return true },
+		func(secret *types.Secret) storage.Cursor {
+			return page.Position(secret.CreatedAt, secret.UpdatedAt, secret.Name)
+		})
+	writeList(w, page, list, next)
+}
+
+// Put handles PUT /secrets/{name}?project=owner/repo.
+func (h *SecretHandler) Put(w http.ResponseWriter, r *http.Request) {
+	project, ok := secretProject(w, r)
+	if !ok || !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := types.ValidateSecretName(name); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req types.PutSecretRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret, err := h.secrets.Put(r.Context(), project, name, req.Value, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing secret", "project", project, "secret", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store secret")
+		return
+	}
+	slog.InfoContext(r.Context(), "Stored secret", "project", project, "secret", name, "user", secret.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, secret)
+}
+
+// Delete handles DELETE /secrets/{name}?project=owner/repo.
+func (h *SecretHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	project, ok := secretProject(w, r)
+	if !ok || !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err := h.secrets.Delete(r.Context(), project, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSecretNotFound, "secret not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting secret", "project", project, "secret", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete secret")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted secret", "project", project, "secret", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/snapshots"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// SnapshotHandler serves the workspace snapshots of jobs to users. Agents
+// upload and restore them over gRPC.
+type SnapshotHandler struct {
+	jobs      *jobs.Manager
+	snapshots *snapshots.Service
+	authz     *rbac.Authorizer
+}
+
+// NewSnapshotHandler returns a handler serving snapshots from service.
+func NewSnapshotHandler(manager *jobs.Manager, service *snapshots.Service, authz *rbac.Authorizer) *SnapshotHandler {
+	return &SnapshotHandler{jobs: manager, snapshots: service, authz: authz}
+}
+
+// Get handles GET /jobs/{id}/snapshot.
+func (h *SnapshotHandler) Get(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	snapshot, err := h.snapshots.Get(r.Context(), job.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSnapshotNotFound, "snapshot not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting workspace snapshot", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get snapshot")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, snapshot)
+}
+
+// Download handles GET /jobs/{id}/snapshot/download: the gzipped tar of the
+// job's outputs. Range and conditional requests are supported; the ETag is
+// the archive's SHA-256.
+func (h *SnapshotHandler) Download(w http.ResponseWriter, r *http.Request) {
+	job, ok := loadJob(w, r, h.jobs, h.authz, types.ActionView)
+	if !ok {
+		return
+	}
+	snapshot, contents, err := h.snapshots.Open(r.Context(), job.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSnapshotNotFound, "snapshot not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "opening workspace snapshot", "job_id", job.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to read snapshot")
+		return
+	}
+	defer contents.Close()
+
+	clearWriteDeadline(r.Context(), w, "snapshot download")
+	name := "snapshot-" + job.ID + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("ETag", `"`+snapshot.SHA256+`"`)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, snapshot.CreatedAt, contents)
+}
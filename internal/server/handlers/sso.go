@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/sso"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+const (
+	// ssoCookie holds the state of a sign-in between sending the browser
+	// to the provider and its return, for ssoCookieAge seconds at most.
+	ssoCookie    = "opencicd_sso"
+	ssoCookieAge = 600
+	ssoPath      = "/auth/sso/"
+)
+
+// SSOHandler serves signing in through SSO providers and LDAP directories.
+// Browsers go through OpenID Connect providers from the dashboard: the
+// callback sends them back to the dashboard with the secret of their new
+// session in the URL fragment, which never reaches a server, or with the
+// reason the sign-in failed. Directories take a username and password and
+// return the session.
+type SSOHandler struct {
+	sso    *sso.Service
+	tokens *auth.Tokens
+	authz  *rbac.Authorizer
+	// secure marks the sign-in cookie Secure, for servers reached over
+	// HTTPS.
+	secure bool
+}
+
+// NewSSOHandler returns a handler signing in through service, which may be
+// nil when no provider is configured, for a server reached at externalURL.
+// Sessions are revoked through tokens.
+func NewSSOHandler(service *sso.Service, tokens *auth.Tokens, externalURL string, authz *rbac.Authorizer) *SSOHandler {
+	return &SSOHandler{sso: service, tokens: tokens, authz: authz, secure: strings.HasPrefix(externalURL, "https://")}
+}
+
+// List handles GET /auth/sso, listing the providers people can sign in
+// with.
+func (h *SSOHandler) List(w http.ResponseWriter, r *http.Request) {
+	providers := []types.SSOProvider{}
+	if h.sso != nil {
+		providers = h.sso.Providers()
+	}
+	utils.WriteJSON(w, http.StatusOK, providers)
+}
+
+// Login handles GET /auth/sso/{provider}/login, sending the browser to the
+// provider to sign in.
+func (h *SSOHandler) Login(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	if h.sso == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	target, state, err := h.sso.Begin(r.Context(), name)
+	if errors.Is(err, sso.ErrUnknownProvider) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	if errors.Is(err, sso.ErrNotSupported) {
+		utils.WriteError(w, http.StatusBadRequest, "sign in to this provider by posting a username and password")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "starting SSO sign-in", "provider", name, "error", err)
+		utils.WriteError(w, http.StatusBadGateway, "failed to reach the SSO provider")
+		return
+	}
+	h.setCookie(w, state, ssoCookieAge)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// Callback handles GET /auth/sso/{provider}/callback, where the provider
+// sends the browser back after signing in.
+func (h *SSOHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	if h.sso == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	q := r.URL.Query()
+	var saved string
+	if c, err := r.Cookie(ssoCookie); err == nil {
+		saved = c.Value
+	}
+	h.setCookie(w, "", -1)
+	if e := q.Get("error"); e != "" {
+		msg := "the provider refused the sign-in: " + e
+		if d := q.Get("error_description"); d != "" {
+			msg += ": " + d
+		}
+		backToDashboard(w, r, "sso-error", msg)
+		return
+	}
+	_, secret, err := h.sso.Complete(r.Context(), name, saved, q.Get("state"), q.Get("code"))
+	switch {
+	case errors.Is(err, sso.ErrUnknownProvider), errors.Is(err, sso.ErrNotSupported):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	case errors.Is(err, sso.ErrLoginFailed):
+		slog.WarnContext(r.Context(), "SSO sign-in refused", "provider", name, "reason", err)
+		backToDashboard(w, r, "sso-error", err.Error())
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "completing SSO sign-in", "provider", name, "error", err)
+		backToDashboard(w, r, "sso-error", "sign-in failed; please try again")
+		return
+	}
+	backToDashboard(w, r, "session", secret)
+}
+
+// PasswordLogin handles POST /auth/sso/{provider}/login, signing in to an
+// LDAP directory with a username and password and returning the session.
+func (h *SSOHandler) PasswordLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	if h.sso == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	var req types.PasswordLoginRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	token, secret, err := h.sso.Login(r.Context(), name, req.Username, req.Password)
+	switch {
+	case errors.Is(err, sso.ErrUnknownProvider):
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	case errors.Is(err, sso.ErrNotSupported):
+		utils.WriteError(w, http.StatusBadRequest, "sign in to this provider through GET "+sso.LoginPath(name))
+		return
+	case errors.Is(err, sso.ErrLoginFailed):
+		slog.WarnContext(r.Context(), "SSO sign-in refused", "provider", name, "username", req.Username, "reason", err)
+		utils.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "signing in to directory", "provider", name, "error", err)
+		utils.WriteError(w, http.StatusBadGateway, "failed to reach the directory")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSON(w, http.StatusCreated, types.CreateTokenResponse{APIToken: *token, Token: secret})
+}
+
+// Test handles POST /auth/sso/{provider}/test, checking that the provider
+// can be reached with its configuration. A failed check is reported with
+// 502 and its error.
+func (h *SSOHandler) Test(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	name := mux.Vars(r)["provider"]
+	if h.sso == nil {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	err := h.sso.Test(r.Context(), name)
+	if errors.Is(err, sso.ErrUnknownProvider) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeSSOProviderNotFound, "SSO provider not found")
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadGateway, "check failed: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Logout handles POST /auth/logout, revoking the session the request was
+// made with. API tokens are revoked through DELETE /tokens/{id} instead.
+func (h *SSOHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	token := auth.TokenFrom(r.Context())
+	if token == nil || token.Provider == "" {
+		utils.WriteError(w, http.StatusBadRequest, "only SSO sessions can be signed out of; revoke API tokens instead")
+		return
+	}
+	if err := h.tokens.Delete(r.Context(), token.ID); err != nil {
+		slog.ErrorContext(r.Context(), "deleting session", "token_id", token.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to sign out")
+		return
+	}
+	slog.InfoContext(r.Context(), "Signed out", "user", token.User, "token_id", token.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCookie sets the sign-in cookie to value for maxAge seconds, or
+// clears it if maxAge is negative. It is only sent back to the callback.
+// Lax lets it through the provider's top-level redirect back.
+func (h *SSOHandler) setCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     ssoPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// backToDashboard sends the browser to the dashboard with key set to value
+// in the URL fragment.
+func backToDashboard(w http.ResponseWriter, r *http.Request, key, value string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, "/#"+key+"="+url.QueryEscape(value), http.StatusFound)
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/templates"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// TemplateHandler publishes the pipeline templates definitions include and
+// resolves definitions that include them.
+type TemplateHandler struct {
+	templates *templates.Service
+	authz     *rbac.Authorizer
+}
+
+// NewTemplateHandler returns a handler backed by the given template service.
+// Templates are shared by every project, so publishing and deleting them
+// needs a role on all projects of the server; any token may read them.
+func NewTemplateHandler(service *templates.Service, authz *rbac.Authorizer) *TemplateHandler {
+	return &TemplateHandler{templates: service, authz: authz}
+}
+
+// List handles GET /templates?name=lint, returning a page of the published
+// template versions, oldest first.
+func (h *TemplateHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	all, err := h.templates.List(r.Context(), r.URL.Query().Get("name"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing templates", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list templates")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Template) bool { return true },
+		func(t *types.Template) storage.Cursor {
+			return page.Position(t.CreatedAt, t.CreatedAt, t.Name+"@"+t.Version)
+		})
+	writeList(w, page, list, next)
+}
+
+// Publish handles POST /templates. A version, once published, cannot be
+// replaced: publishing it again responds 409.
+func (h *TemplateHandler) Publish(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	var req types.PublishTemplateRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	template, err := h.templates.Publish(r.Context(), req, caller(r))
+	var list pipeline.ErrorList
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid template", list)
+		return
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeTemplateVersionExists, "this version of the template is already published")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "publishing template", "version", req.Version, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to publish template")
+		return
+	}
+	slog.InfoContext(r.Context(), "Published template", "template", template.Name, "version", template.Version, "user", template.PublishedBy)
+	utils.WriteJSON(w, http.StatusCreated, template)
+}
+
+// Get handles GET /templates/{name}/{version}, where version may be latest.
+func (h *TemplateHandler) Get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	template, err := h.templates.Get(r.Context(), vars["name"], vars["version"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeTemplateNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		// Only malformed versions fail other than by not being found.
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, template)
+}
+
+// Delete handles DELETE /templates/{name}/{version}.
+func (h *TemplateHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, "") {
+		return
+	}
+	vars := mux.Vars(r)
+	err := h.templates.Delete(r.Context(), vars["name"], vars["version"])
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeTemplateNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting template", "template", vars["name"], "version", vars["version"], "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete template")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted template", "template", vars["name"], "version", vars["version"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Resolve handles POST /templates/resolve, returning a pipeline definition
+// with the templates it includes expanded, as it would run.
+func (h *TemplateHandler) Resolve(w http.ResponseWriter, r *http.Request) {
+	var req types.ResolveTemplatesRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Definition == "" {
+		utils.WriteError(w, http.StatusBadRequest, "definition is required")
+		return
+	}
+	resolved, err := h.templates.Resolve(r.Context(), req.Definition)
+	var list pipeline.ErrorList
+	if errors.As(err, &list) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "resolving templates", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resolve templates")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resolved)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// TokenHandler serves API token management endpoints.
+type TokenHandler struct {
+	tokens *auth.Tokens
+	authz  *rbac.Authorizer
+}
+
+// NewTokenHandler returns a handler backed by the given token manager.
+// Managing tokens needs the admin role on all projects: of the organization
+// the tokens are confined to, or of the whole server for the others.
+func NewTokenHandler(tokens *auth.Tokens, authz *rbac.Authorizer) *TokenHandler {
+	return &TokenHandler{tokens: tokens, authz: authz}
+}
+
+// Create handles POST /tokens. A token confined to an organization can only
+// create tokens confined to the same one.
+func (h *TokenHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req types.CreateTokenRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, req.Organization) {
+		return
+	}
+
+	token, secret, err := h.tokens.Create(r.Context(), req.Name, req.User, req.Scope, req.Organization)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "creating API token", "name", req.Name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to create token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Created API token", "token_id", token.ID, "name", token.Name, "scope", token.Scope, "user", token.User, "organization", token.Organization)
+	utils.WriteJSON(w, http.StatusCreated, types.CreateTokenResponse{APIToken: *token, Token: secret})
+}
+
+// List handles GET /tokens, returning a page of the API tokens the caller
+// may manage. Tokens are never updated, so both sort orders list them by
+// creation time.
+func (h *TokenHandler) List(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, ok := organizations(w, r, h.authz, types.ActionManage)
+	if !ok {
+		return
+	}
+	tokens, err := h.tokens.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing API tokens", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list tokens")
+		return
+	}
+	list, next := collectLoaded(page, tokens,
+		func(token *types.APIToken) bool { return allowed(token.Organization) },
+		func(token *types.APIToken) storage.Cursor {
+			return page.Position(token.CreatedAt, token.CreatedAt, token.ID)
+		})
+	writeList(w, page, list, next)
+}
+
+// Delete handles DELETE /tokens/{id}.
+func (h *TokenHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	tokens, err := h.tokens.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing API tokens", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete token")
+		return
+	}
+	i := slices.IndexFunc(tokens, func(t *types.APIToken) bool { return t.ID == id })
+	if i < 0 {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeTokenNotFound, "token not found")
+		return
+	}
+	if !authorizeOrganization(w, r, h.authz, types.ActionManage, tokens[i].Organization) {
+		return
+	}
+	err = h.tokens.Delete(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeTokenNotFound, "token not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting API token", "token_id", id, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete token")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted API token", "token_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/variables"
+)
+
+// VariableHandler manages the plain environment variables given to jobs,
+// global ones and those of each project, and the branches projects protect.
+type VariableHandler struct {
+	variables *variables.Service
+	authz     *rbac.Authorizer
+}
+
+// NewVariableHandler returns a handler backed by the given variable service.
+// Global variables reach every project, so reading and managing them needs a
+// role on all projects of the server.
+func NewVariableHandler(service *variables.Service, authz *rbac.Authorizer) *VariableHandler {
+	return &VariableHandler{variables: service, authz: authz}
+}
+
+// allowed checks that the caller may perform action on the variables of
+// project, or on the global ones if project is empty. On failure it writes
+// the error response and returns false.
+func (h *VariableHandler) allowed(w http.ResponseWriter, r *http.Request, action types.Action, project string) bool {
+	if project == "" {
+		return authorizeOrganization(w, r, h.authz, action, "")
+	}
+	return authorize(w, r, h.authz, action, project)
+}
+
+// ListGlobal handles GET /variables, returning a page of the global
+// variables.
+func (h *VariableHandler) ListGlobal(w http.ResponseWriter, r *http.Request) {
+	h.list(w, r, "")
+}
+
+// List handles GET /projects/{project}/variables, returning a page of the
+// project's variables.
+func (h *VariableHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.list(w, r, mux.Vars(r)["project"])
+}
+
+func (h *VariableHandler) list(w http.ResponseWriter, r *http.Request, project string) {
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !h.allowed(w, r, types.ActionView, project) {
+		return
+	}
+	all, err := h.variables.List(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing variables", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list variables")
+		return
+	}
+	list, next := collectLoaded(page, all,
+		func(*types.Variable) bool { return true },
+		func(variable *types.Variable) storage.Cursor {
+			return page.Position(variable.CreatedAt, variable.UpdatedAt, variable.Name)
+		})
+	writeList(w, page, list, next)
+}
+
+// PutGlobal handles PUT /variables/{name}.
+func (h *VariableHandler) PutGlobal(w http.ResponseWriter, r *http.Request) {
+	h.put(w, r, "")
+}
+
+// Put handles PUT /projects/{project}/variables/{name}.
+func (h *VariableHandler) Put(w http.ResponseWriter, r *http.Request) {
+	h.put(w, r, mux.Vars(r)["project"])
+}
+
+func (h *VariableHandler) put(w http.ResponseWriter, r *http.Request, project string) {
+	if !h.allowed(w, r, types.ActionManage, project) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := types.ValidateVariableName(name); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req types.PutVariableRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	variable, err := h.variables.Put(r.Context(), project, name, req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing variable", "project", project, "variable", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store variable")
+		return
+	}
+	slog.InfoContext(r.Context(), "Stored variable", "project", project, "variable", name, "user", variable.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, variable)
+}
+
+// DeleteGlobal handles DELETE /variables/{name}.
+func (h *VariableHandler) DeleteGlobal(w http.ResponseWriter, r *http.Request) {
+	h.delete(w, r, "")
+}
+
+// Delete handles DELETE /projects/{project}/variables/{name}.
+func (h *VariableHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	h.delete(w, r, mux.Vars(r)["project"])
+}
+
+func (h *VariableHandler) delete(w http.ResponseWriter, r *http.Request, project string) {
+	if !h.allowed(w, r, types.ActionManage, project) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err := h.variables.Delete(r.Context(), project, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeVariableNotFound, "variable not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting variable", "project", project, "variable", name, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to delete variable")
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted variable", "project", project, "variable", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Resolved handles GET /projects/{project}/variables/resolved?ref=main,
+// returning the variables jobs of the project get on ref in the order they
+// are merged. Only the global and project variables are listed: a job's own
+// environment and its secrets override them in turn.
+func (h *VariableHandler) Resolved(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		utils.WriteError(w, http.StatusBadRequest, "ref query parameter is required")
+		return
+	}
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	resolved, err := h.variables.Resolve(r.Context(), project, ref)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "resolving variables", "project", project, "ref", ref, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to resolve variables")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, resolved)
+}
+
+// ProtectedBranches handles GET /projects/{project}/protected-branches.
+func (h *VariableHandler) ProtectedBranches(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionView, project) {
+		return
+	}
+	branches, err := h.variables.ProtectedBranches(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting protected branches", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get protected branches")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, branches)
+}
+
+// SetProtectedBranches handles PUT /projects/{project}/protected-branches.
+func (h *VariableHandler) SetProtectedBranches(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["project"]
+	if !authorize(w, r, h.authz, types.ActionManage, project) {
+		return
+	}
+	var req types.PutProtectedBranchesRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	branches, err := h.variables.SetProtectedBranches(r.Context(), project, req, caller(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "storing protected branches", "project", project, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to store protected branches")
+		return
+	}
+	slog.InfoContext(r.Context(), "Set protected branches", "project", project, "patterns", branches.Patterns, "user", branches.UpdatedBy)
+	utils.WriteJSON(w, http.StatusOK, branches)
+}
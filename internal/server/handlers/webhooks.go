@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/webhooks"
+)
+
+const (
+	// maxWebhookBytes caps the size of a webhook delivery; GitHub payloads
+	// are limited to 25MB but pushes are far smaller in practice.
+	maxWebhookBytes = 5 << 20
+	// webhookTimeout bounds fetching the pipeline file for a delivery.
+	webhookTimeout = 30 * time.Second
+)
+
+// WebhookHandler receives SCM webhook deliveries, records them and replays
+// them on request.
+type WebhookHandler struct {
+	github    webhooks.Secrets
+	gitlab    webhooks.Secrets
+	bitbucket webhooks.Secrets
+	service   *webhooks.Service
+	authz     *rbac.Authorizer
+}
+
+// NewWebhookHandler returns a handler that authenticates deliveries with
+// the given per-repository secrets of each provider. Viewing and
+// redelivering recorded deliveries needs a role on their project.
+func NewWebhookHandler(github, gitlab, bitbucket webhooks.Secrets, service *webhooks.Service, authz *rbac.Authorizer) *WebhookHandler {
+	return &WebhookHandler{github: github, gitlab: gitlab, bitbucket: bitbucket, service: service, authz: authz}
+}
+
+// webhookResponse acknowledges a delivery. Deliveries that start several
+// runs, such as a Bitbucket push to several branches, list them all.
+type webhookResponse struct {
+	Status      string   `json:"status"`
+	Message     string   `json:"message,omitempty"`
+	PipelineID  string   `json:"pipeline_id,omitempty"`
+	PipelineIDs []string `json:"pipeline_ids,omitempty"`
+}
+
+// GitHub handles POST /webhooks/github.
+func (h *WebhookHandler) GitHub(w http.ResponseWriter, r *http.Request) {
+	body, ok := readDelivery(w, r)
+	if !ok {
+		return
+	}
+	repo, secret, ok := lookupSecret(w, h.github, body, webhooks.GitHubRepository)
+	if !ok {
+		return
+	}
+	if err := webhooks.VerifyGitHubSignature(secret, body, r.Header.Get("X-Hub-Signature-256")); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "ping" {
+		utils.WriteJSON(w, http.StatusOK, webhookResponse{Status: "pong"})
+		return
+	}
+	h.receive(w, r, newDelivery("github", event, r.Header.Get("X-GitHub-Delivery"), repo, body))
+}
+
+// GitLab handles POST /webhooks/gitlab.
+func (h *WebhookHandler) GitLab(w http.ResponseWriter, r *http.Request) {
+	body, ok := readDelivery(w, r)
+	if !ok {
+		return
+	}
+	repo, secret, ok := lookupSecret(w, h.gitlab, body, webhooks.GitLabRepository)
+	if !ok {
+		return
+	}
+	if err := webhooks.VerifyGitLabToken(secret, r.Header.Get("X-Gitlab-Token")); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	h.receive(w, r, newDelivery("gitlab", r.Header.Get("X-Gitlab-Event"), r.Header.Get("X-Gitlab-Event-UUID"), repo, body))
+}
+
+// Bitbucket handles POST /webhooks/bitbucket, for Bitbucket Server and Data
+// Center.
+func (h *WebhookHandler) Bitbucket(w http.ResponseWriter, r *http.Request) {
+	body, ok := readDelivery(w, r)
+	if !ok {
+		return
+	}
+	// Connection tests from the webhook settings page carry no repository.
+	event := r.Header.Get("X-Event-Key")
+	if event == "diagnostics:ping" {
+		utils.WriteJSON(w, http.StatusOK, webhookResponse{Status: "pong"})
+		return
+	}
+	repo, secret, ok := lookupSecret(w, h.bitbucket, body, webhooks.BitbucketRepository)
+	if !ok {
+		return
+	}
+	if err := webhooks.VerifyBitbucketSignature(secret, body, r.Header.Get("X-Hub-Signature")); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	h.receive(w, r, newDelivery("bitbucket", event, r.Header.Get("X-Request-Id"), repo, body))
+}
+
+// ListDeliveries handles GET /webhooks/deliveries, returning a page of the
+// recorded deliveries without their payloads, oldest first.
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := storage.WebhookDeliveryFilter{
+		Provider:   q.Get("provider"),
+		Repository: q.Get("project"),
+		Event:      q.Get("event"),
+		Status:     types.DeliveryStatus(q.Get("status")),
+	}
+	if filter.Status != "" && !filter.Status.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, "unknown delivery status "+string(filter.Status))
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	allowed, ok := viewable(w, r, h.authz)
+	if !ok {
+		return
+	}
+
+	list, next, err := collect(page,
+		func(p storage.Page) ([]*types.WebhookDelivery, error) {
+			filter.Page = p
+			return h.service.Deliveries(r.Context(), filter)
+		},
+		func(d *types.WebhookDelivery) bool { return allowed(d.Repository) },
+		func(d *types.WebhookDelivery) storage.Cursor { return page.Position(d.ReceivedAt, d.UpdatedAt, d.ID) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing webhook deliveries", "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to list webhook deliveries")
+		return
+	}
+	writeList(w, page, list, next)
+}
+
+// GetDelivery handles GET /webhooks/deliveries/{id}, returning the delivery
+// with its payload.
+func (h *WebhookHandler) GetDelivery(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.loadDelivery(w, r, types.ActionView)
+	if !ok {
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, d)
+}
+
+// Redeliver handles POST /webhooks/deliveries/{id}/redeliver, processing a
+// recorded delivery again as if the provider had just sent it, typically
+// after a transient failure such as the repository being unreachable. The
+// payload was verified on receipt and is not verified again. Deliveries
+// that started runs are refused, since replaying them would start the runs
+// again.
+func (h *WebhookHandler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.loadDelivery(w, r, types.ActionRun)
+	if !ok {
+		return
+	}
+	if d.Status == types.DeliveryTriggered {
+		utils.WriteErrorCode(w, http.StatusConflict, types.CodeDeliveryAlreadyStarted, "webhook delivery already started pipelines")
+		return
+	}
+
+	attempt := h.process(nil, r.Context(), d, caller(r))
+	updated, err := h.service.RecordAttempt(r.Context(), d.ID, attempt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recording webhook delivery", "delivery", d.ID, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to record webhook delivery")
+		return
+	}
+	slog.InfoContext(r.Context(), "Redelivered webhook delivery", "provider", d.Provider, "delivery", d.ID, "status", attempt.Status, "user", attempt.By)
+	utils.WriteJSON(w, http.StatusOK, updated)
+}
+
+// loadDelivery fetches the delivery named in the path and checks that the
+// caller may perform action on its project. If not, it writes the error
+// response and returns false.
+func (h *WebhookHandler) loadDelivery(w http.ResponseWriter, r *http.Request, action types.Action) (*types.WebhookDelivery, bool) {
+	id := mux.Vars(r)["id"]
+	d, err := h.service.Delivery(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.WriteErrorCode(w, http.StatusNotFound, types.CodeDeliveryNotFound, "webhook delivery not found")
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "getting webhook delivery", "delivery", id, "error", err)
+		utils.WriteError(w, http.StatusInternalServerError, "failed to get webhook delivery")
+		return nil, false
+	}
+	if !authorize(w, r, h.authz, action, d.Repository) {
+		return nil, false
+	}
+	return d, true
+}
+
+// newDelivery returns the record of a verified delivery as received.
+func newDelivery(provider, event, deliveryID, repo string, body []byte) *types.WebhookDelivery {
+	return &types.WebhookDelivery{
+		ID:         utils.NewID(),
+		Provider:   provider,
+		Event:      event,
+		DeliveryID: deliveryID,
+		Repository: repo,
+		Payload:    string(body),
+		ReceivedAt: time.Now(),
+	}
+}
+
+// receive processes a verified delivery, writes the response and records
+// the delivery with its outcome. Failing to record it does not fail the
+// delivery, as its runs have already started.
+func (h *WebhookHandler) receive(w http.ResponseWriter, r *http.Request, d *types.WebhookDelivery) {
+	d.Record(h.process(w, r.Context(), d, ""))
+	if err := h.service.Record(r.Context(), d); err != nil {
+		slog.ErrorContext(r.Context(), "recording webhook delivery", "provider", d.Provider, "delivery", d.ID, "error", err)
+	}
+}
+
+// process parses a delivery and triggers its runs, writing the response to
+// w unless it is nil, and returns the outcome as an attempt made by by.
+func (h *WebhookHandler) process(w http.ResponseWriter, ctx context.Context, d *types.WebhookDelivery, by string) types.DeliveryAttempt {
+	rec := &deliveryRecorder{w: w}
+	triggers, err := webhooks.ParseDelivery(d)
+	if parsed(rec, err) {
+		h.trigger(rec, ctx, triggers, d.DeliveryID)
+	}
+	return rec.attempt(by)
+}
+
+// deliveryRecorder captures the response to a delivery so that its outcome
+// can be recorded, passing it on to the provider's connection if there is
+// one.
+type deliveryRecorder struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *deliveryRecorder) Header() http.Header {
+	if rec.w != nil {
+		return rec.w.Header()
+	}
+	if rec.header == nil {
+		rec.header = make(http.Header)
+	}
+	return rec.header
+}
+
+func (rec *deliveryRecorder) WriteHeader(status int) {
+	rec.status = status
+	if rec.w != nil {
+		rec.w.WriteHeader(status)
+	}
+}
+
+func (rec *deliveryRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	if rec.w != nil {
+		return rec.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// attempt returns the outcome of the captured response.
+func (rec *deliveryRecorder) attempt(by string) types.DeliveryAttempt {
+	var resp struct {
+		Message     string   `json:"message"`
+		PipelineID  string   `json:"pipeline_id"`
+		PipelineIDs []string `json:"pipeline_ids"`
+	}
+	_ = json.Unmarshal(rec.body.Bytes(), &resp)
+	a := types.DeliveryAttempt{
+		StatusCode:  rec.status,
+		Message:     resp.Message,
+		PipelineIDs: resp.PipelineIDs,
+		By:          by,
+		At:          time.Now(),
+	}
+	if resp.PipelineID != "" {
+		a.PipelineIDs = []string{resp.PipelineID}
+	}
+	switch rec.status {
+	case http.StatusCreated:
+		a.Status = types.DeliveryTriggered
+	case http.StatusAccepted:
+		a.Status = types.DeliveryIgnored
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		a.Status = types.DeliveryRejected
+	default:
+		a.Status = types.DeliveryFailed
+	}
+	return a
+}
+
+// readDelivery reads the body of a delivery. If it cannot, it writes the
+// error response and returns false.
+func readDelivery(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "reading payload: "+err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// lookupSecret finds the repository a delivery names, using the provider's
+// repository extractor, and its secret. If there is none, it writes the
+// error response and returns false.
+func lookupSecret(w http.ResponseWriter, secrets webhooks.Secrets, body []byte, repository func([]byte) (string, error)) (string, string, bool) {
+	repo, err := repository(body)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+	secret, ok := secrets.Lookup(repo)
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, "no webhook secret configured for "+repo)
+		return "", "", false
+	}
+	return repo, secret, true
+}
+
+// parsed handles the error of parsing a verified delivery: ignored events
+// are acknowledged and malformed ones rejected. It returns true if the
+// delivery is to trigger runs.
+func parsed(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, webhooks.ErrIgnored) {
+		utils.WriteJSON(w, http.StatusAccepted, webhookResponse{Status: "ignored", Message: err.Error()})
+		return false
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// trigger enqueues a pipeline run for each trigger of a verified delivery
+// and writes the response. It stops at the first trigger that fails; runs
+// already started are kept.
+func (h *WebhookHandler) trigger(w http.ResponseWriter, ctx context.Context, triggers []*types.Trigger, delivery string) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	var ids []string
+	for _, trigger := range triggers {
+		run, err := h.service.Trigger(ctx, trigger)
+		var list pipeline.ErrorList
+		switch {
+		case errors.As(err, &list):
+			utils.WriteErrorDetails(w, http.StatusUnprocessableEntity, types.CodeInvalidPipeline, "invalid pipeline definition", list)
+			return
+		case errors.Is(err, webhooks.ErrFileNotFound), errors.Is(err, jobs.ErrNothingToRun):
+			if len(triggers) > 1 {
+				// Not every branch of a push need have a pipeline, or
+				// one that runs on it.
+				continue
+			}
+			utils.WriteJSON(w, http.StatusAccepted, webhookResponse{Status: "ignored", Message: err.Error()})
+			return
+		case errors.Is(err, jobs.ErrImageNotResolved):
+			slog.WarnContext(ctx, "Webhook delivery failed to resolve an image", "provider", trigger.Provider, "delivery", delivery, "repository", trigger.Repository, "error", err)
+			utils.WriteError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		case errors.Is(err, jobs.ErrShuttingDown):
+			w.Header().Set("Retry-After", "30")
+			utils.WriteError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		case quotaExceeded(w, err):
+			slog.WarnContext(ctx, "Webhook delivery rejected by job quota", "provider", trigger.Provider, "delivery", delivery, "repository", trigger.Repository, "error", err)
+			return
+		case err != nil:
+			slog.ErrorContext(ctx, "handling webhook delivery", "provider", trigger.Provider, "delivery", delivery, "repository", trigger.Repository, "error", err)
+			utils.WriteError(w, http.StatusBadGateway, "failed to trigger pipeline")
+			return
+		}
+		slog.InfoContext(ctx, "Webhook delivery started pipeline", "provider", trigger.Provider, "delivery", delivery, "event", trigger.Event, "repository", trigger.Repository, "branch", trigger.Branch, "pipeline_id", run.ID)
+		ids = append(ids, run.ID)
+	}
+	switch len(ids) {
+	case 0:
+		utils.WriteJSON(w, http.StatusAccepted, webhookResponse{Status: "ignored", Message: "no pushed branch has a " + pipeline.DefaultFilename})
+	case 1:
+		utils.WriteJSON(w, http.StatusCreated, webhookResponse{Status: "triggered", PipelineID: ids[0]})
+	default:
+		utils.WriteJSON(w, http.StatusCreated, webhookResponse{Status: "triggered", PipelineIDs: ids})
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"open-cicd/internal/audit"
+	"open-cicd/internal/auth"
+	"open-cicd/internal/logging"
+	"open-cicd/internal/types"
+)
+
+// maxAuditBody is how much of a request body is read for its audit summary.
+// Larger bodies are described by type only.
+const maxAuditBody = 64 << 10
+
+// Audit wraps h so that every request it serves is recorded in log once
+// answered. It must run inside Auth.Require, which establishes the actor.
+func Audit(log *audit.Log, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The body is read ahead for the summary and put back for h.
+		// Read errors reach h through the rest of the body.
+		head, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+
+		payload := audit.Summarize(r.Header.Get("Content-Type"), head)
+		if len(head) == maxAuditBody {
+			payload = map[string]string{"content_type": r.Header.Get("Content-Type"), "bytes": "more than 64KiB"}
+		}
+		token := auth.TokenFrom(r.Context())
+		actor := token.User
+		if actor == "" {
+			actor = token.Name
+		}
+		event := &types.AuditEvent{
+			Actor:      actor,
+			TokenID:    token.ID,
+			Method:     r.Method,
+			Route:      routeTemplate(r),
+			Resource:   r.URL.Path,
+			Payload:    payload,
+			Status:     rec.status,
+			Outcome:    types.OutcomeOf(rec.status),
+			RequestID:  logging.RequestID(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+		}
+		// The event is kept even if the client has gone away meanwhile.
+		if err := log.Record(context.WithoutCancel(r.Context()), event); err != nil {
+			slog.ErrorContext(r.Context(), "recording audit event", "method", r.Method, "path", r.URL.Path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package middleware contains HTTP middleware shared by the API routes.
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// Auth authenticates API requests with bearer tokens.
+type Auth struct {
+	tokens  *auth.Tokens
+	limiter *ratelimit.Limiter
+}
+
+// NewAuth returns middleware that checks tokens against tokens and limits
+// the requests of each token with limiter, which may be nil.
+func NewAuth(tokens *auth.Tokens, limiter *ratelimit.Limiter) *Auth {
+	return &Auth{tokens: tokens, limiter: limiter}
+}
+
+// Require wraps h so that it only runs for requests carrying a token whose
+// scope allows scope. Missing or unknown tokens get 401, tokens over their
+// rate limit 429 and insufficient scopes 403, all with the usual JSON error
+// body.
+func (a *Auth) Require(scope types.Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := bearer(r)
+		if !ok || secret == "" {
+			unauthorized(w, "missing bearer token")
+			return
+		}
+		token, err := a.tokens.Authenticate(r.Context(), secret)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			unauthorized(w, err.Error())
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "authenticating API token", "error", err)
+			utils.WriteError(w, http.StatusInternalServerError, "failed to authenticate request")
+			return
+		}
+		if !allow(w, a.limiter, "token:"+token.ID) {
+			return
+		}
+		if !token.Scope.Allows(scope) {
+			utils.WriteErrorCode(w, http.StatusForbidden, types.CodeInsufficientScope, "token scope "+string(token.Scope)+" does not allow this request; "+string(scope)+" is required")
+			return
+		}
+		h(w, r.WithContext(auth.WithToken(r.Context(), token)))
+	}
+}
+
+// bearer returns the bearer token of r. Browsers cannot set headers on
+// WebSocket handshakes, so those may pass the token as the access_token
+// query parameter instead.
+func bearer(r *http.Request) (string, bool) {
+	if secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return secret, true
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && r.URL.Query().Has("access_token") {
+		return r.URL.Query().Get("access_token"), true
+	}
+	return "", false
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="open-cicd"`)
+	utils.WriteError(w, http.StatusUnauthorized, msg)
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+func TestAuthRequire(t *testing.T) {
+	ctx := context.Background()
+	tokens := auth.NewTokens(storage.NewMemory(), "bootstrap-secret")
+	_, reader, err := tokens.Create(ctx, "reader", "jdoe", types.ScopeReadOnly, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, submitter, err := tokens.Create(ctx, "ci", "jdoe", types.ScopeSubmitJobs, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	revoked, revokedSecret, err := tokens.Create(ctx, "old", "jdoe", types.ScopeAdmin, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := tokens.Delete(ctx, revoked.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		scope  types.Scope
+		want   int
+	}{
+		{"no header", "", types.ScopeReadOnly, http.StatusUnauthorized},
+		{"not bearer", "Basic " + reader, types.ScopeReadOnly, http.StatusUnauthorized},
+		{"empty bearer", "Bearer ", types.ScopeReadOnly, http.StatusUnauthorized},
+		{"unknown token", "Bearer oc_unknown", types.ScopeReadOnly, http.StatusUnauthorized},
+		{"revoked token", "Bearer " + revokedSecret, types.ScopeReadOnly, http.StatusUnauthorized},
+		{"read-only reads", "Bearer " + reader, types.ScopeReadOnly, http.StatusOK},
+		{"read-only cannot submit", "Bearer " + reader, types.ScopeSubmitJobs, http.StatusForbidden},
+		{"submit-jobs submits", "Bearer " + submitter, types.ScopeSubmitJobs, http.StatusOK},
+		{"submit-jobs cannot administer", "Bearer " + submitter, types.ScopeAdmin, http.StatusForbidden},
+		{"bootstrap token administers", "Bearer bootstrap-secret", types.ScopeAdmin, http.StatusOK},
+	}
+	a := NewAuth(tokens, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen *types.APIToken
+			h := a.Require(tt.scope, func(w http.ResponseWriter, r *http.Request) {
+				seen = auth.TokenFrom(r.Context())
+			})
+			req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusOK && seen == nil {
+				t.Errorf("handler ran without the token in its context")
+			}
+			if tt.want != http.StatusOK && seen != nil {
+				t.Errorf("handler ran for a rejected request")
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	ctx := context.Background()
+	tokens := auth.NewTokens(storage.NewMemory(), "")
+	_, busy, err := tokens.Create(ctx, "busy", "jdoe", types.ScopeReadOnly, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, quiet, err := tokens.Create(ctx, "quiet", "jdoe", types.ScopeReadOnly, "")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	h := NewAuth(tokens, ratelimit.New(1.0/60, 2)).Require(types.ScopeReadOnly, func(http.ResponseWriter, *http.Request) {})
+	request := func(secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := request(busy); got != want {
+			t.Errorf("request %d of the busy token: status = %d, want %d", i+1, got, want)
+		}
+	}
+	// Every token has a bucket of its own.
+	if got := request(quiet); got != http.StatusOK {
+		t.Errorf("request of the quiet token: status = %d, want %d", got, http.StatusOK)
+	}
+}
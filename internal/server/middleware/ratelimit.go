@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// RateLimit returns router middleware that limits the requests of each
+// source address. Behind a proxy every request comes from the proxy's
+// address, so the limit then applies to all clients together.
+func RateLimit(limiter *ratelimit.Limiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if !allow(w, limiter, "ip:"+host) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow takes a request for key from limiter. When the limit is reached it
+// writes a 429 response telling the client when to retry, and returns false.
+func allow(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) bool {
+	ok, wait := limiter.Allow(key)
+	if !ok {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		utils.WriteErrorCode(w, http.StatusTooManyRequests, types.CodeRateLimited, "rate limit exceeded; retry after "+ratelimit.RetryAfter(wait)+"s")
+	}
+	return ok
+}
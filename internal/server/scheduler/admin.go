@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// ErrNotScheduling is returned by Reconcile on replicas that do not run the
+// scheduler, as only the leader has agents connected.
+var ErrNotScheduling = errors.New("this replica is not scheduling jobs")
+
+// Pause stops scheduling until Resume, on whichever replica leads: queued
+// jobs stay queued, while jobs already assigned run on. Pausing a paused
+// scheduler returns the pause already in place.
+func (s *Scheduler) Pause(ctx context.Context, by, reason string) (*types.SchedulerPause, error) {
+	pause := &types.SchedulerPause{By: by, Reason: reason, StartedAt: s.now()}
+	err := s.pauses.CreateSchedulerPause(ctx, pause)
+	if errors.Is(err, storage.ErrConflict) {
+		pause, err = s.pauses.GetSchedulerPause(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.paused.Store(pause)
+	return pause, nil
+}
+
+// Resume lifts the pause of scheduling, if any, and schedules the queued
+// jobs.
+func (s *Scheduler) Resume(ctx context.Context) error {
+	if err := s.pauses.DeleteSchedulerPause(ctx); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	s.paused.Store(nil)
+	s.Kick()
+	return nil
+}
+
+// loadPause picks up pauses and resumes made through other replicas.
+func (s *Scheduler) loadPause(ctx context.Context) error {
+	pause, err := s.pauses.GetSchedulerPause(ctx)
+	if errors.Is(err, storage.ErrNotFound) {
+		s.paused.Store(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.paused.Store(pause)
+	return nil
+}
+
+// Status reports the scheduler's pause, its queue and the jobs every agent
+// holds. The queue and which agents are connected are only known on the
+// leader; other replicas report them empty.
+func (s *Scheduler) Status(ctx context.Context) (*types.SchedulerStatus, error) {
+	status := &types.SchedulerStatus{
+		Leader:   s.running.Load(),
+		Draining: s.jobs.Draining(),
+		Queue:    []types.QueuedJob{},
+		Agents:   []types.AgentAssignments{},
+	}
+	pause, err := s.pauses.GetSchedulerPause(ctx)
+	switch {
+	case err == nil:
+		status.Paused = pause
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, fmt.Errorf("getting scheduler pause: %w", err)
+	}
+
+	var ready map[string]int
+	if status.Leader {
+		ready = s.dispatcher.Ready()
+		for _, job := range s.queue.Jobs() {
+			status.Queue = append(status.Queue, types.QueuedJob{
+				ID:         job.ID,
+				Name:       job.Name,
+				Repository: job.Repository,
+				PipelineID: job.PipelineID,
+				Priority:   job.Priority,
+				Labels:     job.Labels,
+				QueuedAt:   queuedAt(job),
+			})
+		}
+	}
+
+	held := make(map[string][]types.HeldJob)
+	for _, state := range activeStates {
+		list, err := s.jobs.List(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		for _, job := range list {
+			if job.AgentID != "" {
+				held[job.AgentID] = append(held[job.AgentID], types.HeldJob{ID: job.ID, Name: job.Name, State: job.State, PipelineID: job.PipelineID})
+			}
+		}
+	}
+	agents, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing agents: %w", err)
+	}
+	for _, agent := range agents {
+		free, connected := ready[agent.ID]
+		jobs := held[agent.ID]
+		if jobs == nil {
+			jobs = []types.HeldJob{}
+		}
+		status.Agents = append(status.Agents, types.AgentAssignments{
+			ID:           agent.ID,
+			Hostname:     agent.Hostname,
+			Organization: agent.Organization,
+			State:        agent.State,
+			Connected:    connected,
+			FreeSlots:    free,
+			Capacity:     agent.Capacity,
+			Jobs:         jobs,
+		})
+	}
+	return status, nil
+}
+
+// Reconcile brings the recorded state of agents in line with the agents
+// connected now, rather than waiting for heartbeats to be missed and leases
+// to run out: agents are marked online or offline as they are connected or
+// not, the jobs of agents not connected whose leases ran out go back to
+// the queue, and connected agents are sent the jobs they were assigned but
+// have not started again. The queue is then rebuilt from the store. It
+// returns ErrNotScheduling unless Run is running.
+func (s *Scheduler) Reconcile(ctx context.Context) (*types.ReconcileReport, error) {
+	if !s.running.Load() {
+		return nil, ErrNotScheduling
+	}
+	report := &types.ReconcileReport{Offline: []string{}, Online: []string{}, Requeued: []string{}, Expired: []string{}, Redelivered: []string{}}
+	agents, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing agents: %w", err)
+	}
+	ready := s.dispatcher.Ready()
+	var gone []string
+	for _, agent := range agents {
+		_, connected := ready[agent.ID]
+		updated, changed, err := s.registry.Reconcile(ctx, agent.ID, connected)
+		if err != nil {
+			return report, fmt.Errorf("reconciling agent %s: %w", agent.ID, err)
+		}
+		switch {
+		case changed && updated.State == types.AgentStateOffline:
+			slog.WarnContext(ctx, "Agent not connected; marked offline", "agent_id", agent.ID)
+			report.Offline = append(report.Offline, agent.ID)
+		case changed:
+			slog.InfoContext(ctx, "Agent connected; marked online", "agent_id", agent.ID, "state", updated.State)
+			report.Online = append(report.Online, agent.ID)
+		}
+		if !connected {
+			gone = append(gone, agent.ID)
+		}
+	}
+
+	if len(gone) > 0 {
+		requeued, err := s.jobs.RequeueAgentJobs(ctx, gone, "agent not connected")
+		for _, job := range requeued {
+			slog.InfoContext(ctx, "Re-queued job from disconnected agent", "job_id", job.ID, "job", job.Name)
+			report.Requeued = append(report.Requeued, job.ID)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	expired, err := s.jobs.ExpireLeases(ctx)
+	for _, job := range expired {
+		slog.WarnContext(ctx, "Lease on job expired; re-queued it", "job_id", job.ID, "job", job.Name, "lease_token", job.LeaseToken)
+		report.Expired = append(report.Expired, job.ID)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	for _, agent := range agents {
+		if _, connected := ready[agent.ID]; connected {
+			s.Redeliver(agent.ID)
+			report.Redelivered = append(report.Redelivered, agent.ID)
+		}
+	}
+	s.resyncRequested.Store(true)
+	s.Kick()
+	return report, nil
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+// ErrLabelsNotAllowed is returned when an agent registers with a label its
+// registration token does not allow.
+var ErrLabelsNotAllowed = errors.New("labels not allowed")
+
+const (
+	// agentTokenPrefix marks the registration tokens handed out through
+	// AgentTokens, so that they are easy to recognise, for example by
+	// secret scanners, and told apart from the other registration tokens.
+	agentTokenPrefix = "oca_"
+	agentTokenBytes  = 32
+)
+
+// AgentTokens manages registration tokens that expire, register a limited
+// number of agents and restrict their labels, so that registering agents
+// can be delegated without handing out a permanent token.
+type AgentTokens struct {
+	store storage.AgentTokenStore
+	now   func() time.Time
+}
+
+// NewAgentTokens returns a manager of the agent tokens in store.
+func NewAgentTokens(store storage.AgentTokenStore) *AgentTokens {
+	return &AgentTokens{store: store, now: time.Now}
+}
+
+// Create issues a token on behalf of createdBy and returns it with its
+// plaintext secret, which is not retrievable afterwards.
+func (t *AgentTokens) Create(ctx context.Context, req types.CreateAgentTokenRequest, createdBy string) (*types.AgentToken, string, error) {
+	secret := agentTokenPrefix + utils.NewSecret(agentTokenBytes)
+	now := t.now()
+	token := &types.AgentToken{
+		ID:           utils.NewID(),
+		Name:         req.Name,
+		Organization: req.Organization,
+		Labels:       req.Labels,
+		MaxUses:      req.MaxUses,
+		ExpiresAt:    now.Add(req.ExpiresIn.Std()),
+		Hash:         utils.HashSecret(secret),
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+	}
+	if err := t.store.CreateAgentToken(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// Get returns the token with the given ID.
+func (t *AgentTokens) Get(ctx context.Context, id string) (*types.AgentToken, error) {
+	return t.store.GetAgentToken(ctx, id)
+}
+
+// List returns every token, revoked and expired ones included, oldest
+// first.
+func (t *AgentTokens) List(ctx context.Context) ([]*types.AgentToken, error) {
+	return t.store.ListAgentTokens(ctx)
+}
+
+// Revoke stops the token from registering more agents on behalf of by.
+// Agents it registered keep working. Revoking a revoked token changes
+// nothing.
+func (t *AgentTokens) Revoke(ctx context.Context, id, by string) (*types.AgentToken, error) {
+	return t.store.UpdateAgentToken(ctx, id, func(token *types.AgentToken) error {
+		if token.RevokedAt != nil {
+			return nil
+		}
+		now := t.now()
+		token.RevokedAt = &now
+		token.RevokedBy = by
+		return nil
+	})
+}
+
+// redeem counts a registration of an agent with labels against the token
+// whose secret is secret and returns the organization it registers agents
+// into. It returns false if secret is not an agent token, and an error
+// wrapping ErrInvalidToken if the token cannot be used anymore or
+// ErrLabelsNotAllowed if it does not allow labels.
+func (t *AgentTokens) redeem(ctx context.Context, secret string, labels map[string]string) (string, bool, error) {
+	if !strings.HasPrefix(secret, agentTokenPrefix) {
+		return "", false, nil
+	}
+	token, err := t.store.GetAgentTokenByHash(ctx, utils.HashSecret(secret))
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	token, err = t.store.UpdateAgentToken(ctx, token.ID, func(token *types.AgentToken) error {
+		now := t.now()
+		if err := token.Usable(now); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		if err := token.Admits(labels); err != nil {
+			return fmt.Errorf("%w: %v", ErrLabelsNotAllowed, err)
+		}
+		token.Uses++
+		token.LastUsedAt = &now
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return token.Organization, true, nil
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// saturationInterval is how often the backpressure state is recomputed.
+const saturationInterval = 5 * time.Second
+
+// Backpressure tells whether the queue is saturated: it holds more jobs
+// than the configured limit, or no agent is online to run any of them. The
+// state is computed from the store, so that every replica agrees on it, and
+// only refreshed every few seconds; jobs a replica accepts in between count
+// right away, so that a burst of submissions still stops at the limit.
+type Backpressure struct {
+	registry *Registry
+	jobs     *jobs.Manager
+	now      func() time.Time
+
+	mu     sync.Mutex
+	max    int
+	reject bool
+	state  types.Saturation
+}
+
+// NewBackpressure returns a Backpressure over the jobs of manager and the
+// agents of registry. Nothing is saturated until its first refresh.
+func NewBackpressure(registry *Registry, manager *jobs.Manager) *Backpressure {
+	return &Backpressure{registry: registry, jobs: manager, now: time.Now}
+}
+
+// SetLimits sets how many jobs may be queued, where 0 means any number, and
+// whether submissions are rejected rather than queued with a warning while
+// the queue is saturated. It can be called at any time.
+func (b *Backpressure) SetLimits(maxQueued int, reject bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max, b.reject = maxQueued, reject
+	b.state.MaxQueuedJobs = maxQueued
+	b.state.Rejecting = reject
+	b.evaluate()
+}
+
+// Run refreshes the state until ctx is cancelled.
+func (b *Backpressure) Run(ctx context.Context) {
+	ticker := time.NewTicker(saturationInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "checking queue saturation", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// State returns the current saturation state.
+func (b *Backpressure) State() types.Saturation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	state.Reasons = append([]string(nil), b.state.Reasons...)
+	return state
+}
+
+// Accepted counts n jobs submitted since the last refresh as queued.
+func (b *Backpressure) Accepted(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state.QueuedJobs += n
+	b.evaluate()
+}
+
+// refresh counts the queued jobs and online agents.
+func (b *Backpressure) refresh(ctx context.Context) error {
+	b.mu.Lock()
+	limit := b.max
+	b.mu.Unlock()
+
+	// Counting stops one past the limit, which is all it takes to tell
+	// the queue is over it.
+	page := storage.Page{}
+	if limit > 0 {
+		page.Limit = limit + 1
+	}
+	queued, err := b.jobs.List(ctx, storage.JobFilter{State: types.JobStateQueued, Page: page})
+	if err != nil {
+		return fmt.Errorf("listing queued jobs: %w", err)
+	}
+	agents, err := b.registry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing agents: %w", err)
+	}
+	online := 0
+	for _, agent := range agents {
+		if agent.State == types.AgentStateOnline {
+			online++
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	was := b.state.Saturated
+	b.state.QueuedJobs = len(queued)
+	b.state.OnlineAgents = online
+	b.state.CheckedAt = b.now()
+	b.evaluate()
+	switch {
+	case b.state.Saturated && !was:
+		slog.WarnContext(ctx, "Job queue is saturated", "reasons", b.state.Reasons, "rejecting", b.state.Rejecting)
+	case !b.state.Saturated && was:
+		slog.InfoContext(ctx, "Job queue is no longer saturated", "queued", b.state.QueuedJobs, "online_agents", online)
+	}
+	return nil
+}
+
+// evaluate derives whether the queue is saturated from the counts. Callers
+// must hold b.mu.
+func (b *Backpressure) evaluate() {
+	var reasons []string
+	// Before the first refresh nothing was counted yet.
+	if !b.state.CheckedAt.IsZero() && b.state.OnlineAgents == 0 {
+		reasons = append(reasons, "no agents are online")
+	}
+	if b.max > 0 && b.state.QueuedJobs >= b.max {
+		reasons = append(reasons, fmt.Sprintf("%d jobs are queued, the limit is %d", b.state.QueuedJobs, b.max))
+	}
+	b.state.Reasons = reasons
+	b.state.Saturated = len(reasons) > 0
+}
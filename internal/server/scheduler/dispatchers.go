@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"errors"
+
+	"open-cicd/internal/types"
+)
+
+// Dispatchers delivers work through several dispatchers, such as the agent
+// stream hub and executors built into the server. Each agent is served by
+// one of them; the others report ErrAgentNotConnected for it.
+type Dispatchers []Dispatcher
+
+// Ready implements Dispatcher.
+func (d Dispatchers) Ready() map[string]int {
+	ready := make(map[string]int)
+	for _, x := range d {
+		for id, free := range x.Ready() {
+			ready[id] = free
+		}
+	}
+	return ready
+}
+
+// Dispatch implements Dispatcher.
+func (d Dispatchers) Dispatch(agentID string, job *types.Job) error {
+	for _, x := range d {
+		if err := x.Dispatch(agentID, job); !errors.Is(err, ErrAgentNotConnected) {
+			return err
+		}
+	}
+	return ErrAgentNotConnected
+}
+
+// Cancel implements Dispatcher.
+func (d Dispatchers) Cancel(agentID, jobID, reason string, requeue bool) error {
+	for _, x := range d {
+		if err := x.Cancel(agentID, jobID, reason, requeue); !errors.Is(err, ErrAgentNotConnected) {
+			return err
+		}
+	}
+	return ErrAgentNotConnected
+}
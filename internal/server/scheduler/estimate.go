@@ -0,0 +1,297 @@
+package scheduler
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+const (
+	// historySize is how many recently succeeded jobs the typical
+	// durations of jobs are taken from.
+	historySize = 500
+	// historyTTL is how long the typical durations are reused.
+	historyTTL = time.Minute
+	// maxAhead bounds the jobs ahead of one that its start is estimated
+	// from.
+	maxAhead = 1000
+)
+
+// Estimator tells where queued jobs stand: how many jobs are ahead of
+// them, why they have not started and when they should. Like
+// Backpressure it works from the store, so that every replica gives the
+// same answer whichever one schedules.
+type Estimator struct {
+	registry *Registry
+	jobs     *jobs.Manager
+	now      func() time.Time
+
+	mu      sync.Mutex
+	history *durations
+}
+
+// durations are the typical running times of jobs, by repository and job
+// name, and over all jobs.
+type durations struct {
+	byJob   map[jobKey]time.Duration
+	overall time.Duration
+	at      time.Time
+}
+
+// jobKey identifies the jobs of one step or submission across runs.
+type jobKey struct{ repository, name string }
+
+// NewEstimator returns an Estimator over the jobs of manager and the agents
+// of registry.
+func NewEstimator(registry *Registry, manager *jobs.Manager) *Estimator {
+	return &Estimator{registry: registry, jobs: manager, now: time.Now}
+}
+
+// Explain returns the queue status of job, or nil if it is not queued.
+func (e *Estimator) Explain(ctx context.Context, job *types.Job) (*types.QueueStatus, error) {
+	if job.State != types.JobStateQueued {
+		return nil, nil
+	}
+	now := e.now()
+	agents, err := e.registry.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing agents: %w", err)
+	}
+	status := &types.QueueStatus{Position: 1, Labels: job.Labels}
+
+	// The agents that could run the job, and those of them taking jobs.
+	var online []*types.Agent
+	capacity := 0
+	for _, a := range agents {
+		if a.State == types.AgentStateOffline || !canRun(a, job) {
+			continue
+		}
+		status.MatchingAgents++
+		if a.State == types.AgentStateOnline {
+			online = append(online, a)
+			capacity += a.Capacity
+		}
+	}
+	if status.MatchingAgents == 0 {
+		status.Reason = missingAgents(job)
+		return status, nil
+	}
+	if len(online) == 0 {
+		status.Reason = fmt.Sprintf("the %d agents that can run the job take no jobs right now, being draining or not yet connected", status.MatchingAgents)
+		return status, nil
+	}
+
+	history, err := e.durations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// When each slot of the online agents frees up, judging by how long
+	// the jobs holding them typically run.
+	var releases []time.Time
+	unknown := false
+	for _, a := range online {
+		var held []time.Time
+		for _, state := range activeStates {
+			list, err := e.jobs.List(ctx, storage.JobFilter{State: state, AgentID: a.ID})
+			if err != nil {
+				return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+			}
+			for _, active := range list {
+				typical, ok := history.typical(active)
+				unknown = unknown || !ok
+				held = append(held, later(now, startedAt(active).Add(typical)))
+			}
+		}
+		slices.SortFunc(held, time.Time.Compare)
+		// Jobs beyond the agent's capacity hold no slot of their own: the
+		// first to finish free none.
+		if extra := len(held) - a.Capacity; extra > 0 {
+			held = held[extra:]
+		}
+		status.FreeSlots += max(a.Capacity-len(held), 0)
+		for range max(a.Capacity-len(held), 0) {
+			held = append(held, now)
+		}
+		releases = append(releases, held...)
+	}
+
+	queued, err := e.jobs.List(ctx, storage.JobFilter{State: types.JobStateQueued})
+	if err != nil {
+		return nil, fmt.Errorf("listing queued jobs: %w", err)
+	}
+	var ahead []*types.Job
+	for _, other := range queued {
+		if other.ID != job.ID && before(other, job) && slices.ContainsFunc(online, func(a *types.Agent) bool { return canRun(a, other) }) {
+			ahead = append(ahead, other)
+		}
+	}
+	slices.SortFunc(ahead, func(a, b *types.Job) int {
+		if before(a, b) {
+			return -1
+		}
+		return 1
+	})
+	status.Position = len(ahead) + 1
+
+	quota, err := e.jobs.ProjectQuota(ctx, job.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("loading quota of %s: %w", job.Repository, err)
+	}
+	switch {
+	case job.Waiting(now):
+		status.Reason = "the job waits out its retry backoff until " + job.RetryAt.Format(time.RFC3339)
+	case quota.MaxConcurrentJobs > 0:
+		active := 0
+		for _, state := range activeStates {
+			list, err := e.jobs.List(ctx, storage.JobFilter{State: state, Repository: job.Repository})
+			if err != nil {
+				return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+			}
+			active += len(list)
+		}
+		if active >= quota.MaxConcurrentJobs {
+			status.Reason = fmt.Sprintf("project %s has %d jobs running, as many as its quota allows", job.Repository, active)
+		}
+	}
+	if status.Reason == "" {
+		switch {
+		case len(ahead) < status.FreeSlots:
+			status.Reason = "an agent is free; the job should start shortly"
+		case len(ahead) == 0:
+			status.Reason = fmt.Sprintf("all %d slots of the agents that can run the job are busy", capacity)
+		default:
+			status.Reason = fmt.Sprintf("%d jobs are ahead of this one and all %d slots of the agents that can run the job are busy", len(ahead), capacity)
+		}
+	}
+
+	if len(releases) == 0 || (unknown && status.FreeSlots <= len(ahead)) {
+		return status, nil
+	}
+	// Hand the slots to the jobs ahead in turn; the job starts when the
+	// next one frees up after them.
+	for _, other := range ahead[:min(len(ahead), maxAhead)] {
+		typical, ok := history.typical(other)
+		if !ok {
+			return status, nil
+		}
+		i := slices.Index(releases, slices.MinFunc(releases, time.Time.Compare))
+		releases[i] = releases[i].Add(typical)
+	}
+	start := slices.MinFunc(releases, time.Time.Compare)
+	if job.RetryAt != nil {
+		start = later(start, *job.RetryAt)
+	}
+	start = start.Truncate(time.Second)
+	status.EstimatedStart = &start
+	return status, nil
+}
+
+// before reports whether a is ahead of b in the queue: of a higher
+// priority, or of the same priority and queued before it.
+func before(a, b *types.Job) bool {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	if c := queuedAt(a).Compare(queuedAt(b)); c != 0 {
+		return c < 0
+	}
+	return a.ID < b.ID
+}
+
+// rank returns the position of the job's priority, normal for unknown
+// ones, as the queue orders them.
+func rank(job *types.Job) int {
+	if r := job.Priority.Rank(); r >= 0 {
+		return r
+	}
+	return types.PriorityNormal.Rank()
+}
+
+// queuedAt returns when the job was last queued.
+func queuedAt(job *types.Job) time.Time {
+	return lastTransition(job, types.JobStateQueued, job.CreatedAt)
+}
+
+// startedAt returns when the job last started running, or was assigned if
+// it has not yet.
+func startedAt(job *types.Job) time.Time {
+	return lastTransition(job, types.JobStateRunning, lastTransition(job, types.JobStateAssigned, job.UpdatedAt))
+}
+
+// lastTransition returns when the job last moved to state, or otherwise.
+func lastTransition(job *types.Job, state types.JobState, otherwise time.Time) time.Time {
+	for i := len(job.Transitions) - 1; i >= 0; i-- {
+		if job.Transitions[i].To == state {
+			return job.Transitions[i].At
+		}
+	}
+	return otherwise
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// durations returns the typical running times of jobs, recomputed from the
+// most recently succeeded jobs every historyTTL.
+func (e *Estimator) durations(ctx context.Context) (*durations, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.history != nil && e.now().Sub(e.history.at) < historyTTL {
+		return e.history, nil
+	}
+	recent, err := e.jobs.List(ctx, storage.JobFilter{
+		State: types.JobStateSucceeded,
+		Page:  storage.Page{Sort: storage.SortUpdated, Desc: true, Limit: historySize},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing succeeded jobs: %w", err)
+	}
+	byJob := make(map[jobKey][]time.Duration)
+	var all []time.Duration
+	for _, job := range recent {
+		ran := job.UpdatedAt.Sub(startedAt(job))
+		if ran < 0 {
+			continue
+		}
+		k := jobKey{job.Repository, job.Name}
+		byJob[k] = append(byJob[k], ran)
+		all = append(all, ran)
+	}
+	d := &durations{byJob: make(map[jobKey]time.Duration, len(byJob)), overall: median(all), at: e.now()}
+	for k, list := range byJob {
+		d.byJob[k] = median(list)
+	}
+	e.history = d
+	return d, nil
+}
+
+// typical returns how long the job typically runs: as long as its earlier
+// runs did, or else as jobs in general do. It reports false without any
+// history to go by.
+func (d *durations) typical(job *types.Job) (time.Duration, bool) {
+	if t, ok := d.byJob[jobKey{job.Repository, job.Name}]; ok {
+		return t, true
+	}
+	return d.overall, len(d.byJob) > 0
+}
+
+// median returns the median of durations, or 0 for none.
+func median(list []time.Duration) time.Duration {
+	if len(list) == 0 {
+		return 0
+	}
+	sorted := slices.SortedFunc(slices.Values(list), cmp.Compare[time.Duration])
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/types"
+)
+
+// Monitor marks agents offline once they miss heartbeats for longer than the
+// timeout and hands the jobs they held back to the queue, as well as jobs
+// whose leases their agents failed to renew.
+type Monitor struct {
+	registry *Registry
+	jobs     *jobs.Manager
+	timeout  time.Duration
+}
+
+// NewMonitor returns a liveness monitor for the agents in registry.
+func NewMonitor(registry *Registry, manager *jobs.Manager, timeout time.Duration) *Monitor {
+	return &Monitor{registry: registry, jobs: manager, timeout: timeout}
+}
+
+// Run checks agent liveness several times per timeout until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(max(m.timeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.check(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "checking agent liveness", "error", err)
+		}
+	}
+}
+
+// check expires agents not seen within the timeout and then the leases
+// that ran out. Jobs are re-queued for every stale agent, including ones
+// already offline because their stream dropped, so work is not stranded on
+// an agent that never came back.
+func (m *Monitor) check(ctx context.Context) error {
+	agents, err := m.registry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing agents: %w", err)
+	}
+	cutoff := m.registry.now().Add(-m.timeout)
+	var stale []string
+	for _, agent := range agents {
+		if !agent.LastSeenAt.Before(cutoff) {
+			continue
+		}
+		expired, err := m.registry.expire(ctx, agent.ID, cutoff)
+		if err != nil {
+			return fmt.Errorf("marking agent %s offline: %w", agent.ID, err)
+		}
+		if !expired {
+			continue
+		}
+		if agent.State != types.AgentStateOffline {
+			slog.WarnContext(ctx, "Agent missed heartbeats; marked offline", "agent_id", agent.ID, "last_seen_at", agent.LastSeenAt)
+		}
+		stale = append(stale, agent.ID)
+	}
+	if len(stale) > 0 {
+		requeued, err := m.jobs.RequeueAgentJobs(ctx, stale, "agent stopped sending heartbeats")
+		for _, job := range requeued {
+			slog.InfoContext(ctx, "Re-queued job from unresponsive agent", "job_id", job.ID, "job", job.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	expired, err := m.jobs.ExpireLeases(ctx)
+	for _, job := range expired {
+		slog.WarnContext(ctx, "Lease on job expired; re-queued it", "job_id", job.ID, "job", job.Name, "lease_token", job.LeaseToken)
+	}
+	return err
+}
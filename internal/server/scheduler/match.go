@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// SetMatchTimeout sets how long a queued job waits for an agent carrying
+// its labels to appear before it fails. Zero waits forever.
+func (s *Scheduler) SetMatchTimeout(d time.Duration) {
+	s.matchTimeout.Store(int64(d))
+}
+
+// failUnmatched fails the queued jobs that no agent has been able to run
+// for the match timeout: no agent that is not offline serves their
+// organization, carries their labels, runs their platform and is large enough
+// for their requests.
+// Jobs whose matching agents are only busy keep waiting.
+func (s *Scheduler) failUnmatched(ctx context.Context, queued []*types.Job) error {
+	timeout := time.Duration(s.matchTimeout.Load())
+	if timeout <= 0 {
+		s.unmatched = nil
+		return nil
+	}
+	agents, err := s.registry.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	waiting := make(map[string]time.Time)
+	for _, job := range queued {
+		if matchingAgent(agents, job) {
+			continue
+		}
+		since, ok := s.unmatched[job.ID]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < timeout {
+			waiting[job.ID] = since
+			continue
+		}
+		reason := noMatchReason(job, timeout)
+		update := types.JobStatusRequest{State: types.JobStateFailed, Reason: reason}
+		if _, err := s.jobs.UpdateStatus(ctx, job.ID, update); err != nil && !errors.Is(err, types.ErrInvalidTransition) {
+			slog.ErrorContext(ctx, "failing job without matching agents", "job_id", job.ID, "error", err)
+			continue
+		}
+		slog.WarnContext(ctx, "Failed job", "job_id", job.ID, "job", job.Name, "reason", reason)
+	}
+	s.unmatched = waiting
+	return nil
+}
+
+// matchingAgent reports whether an agent that is not offline serves the
+// job's organization, carries its labels, runs its platform and, if it
+// reports its resources, has as much in all as the job requests.
+func matchingAgent(agents []*types.Agent, job *types.Job) bool {
+	for _, a := range agents {
+		if a.State != types.AgentStateOffline && canRun(a, job) {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun reports whether the agent, whatever its state, serves the job's
+// organization, carries its labels, runs its platform and, if it reports
+// its resources, has as much in all as the job requests.
+func canRun(a *types.Agent, job *types.Job) bool {
+	if !a.Serves(job) || !types.MatchLabels(a.Labels, job.Labels) || !a.RunsPlatform(job) {
+		return false
+	}
+	return a.Resources == nil || a.Resources.Total.Covers(job.ResourceRequests())
+}
+
+// noMatchReason explains why a job could not be scheduled.
+func noMatchReason(job *types.Job, waited time.Duration) string {
+	return fmt.Sprintf("no matching agents: %s (waited %s)", missingAgents(job), waited)
+}
+
+// missingAgents describes the agents a job waits for, none of which is
+// there, such as "no agent running linux has labels gpu=true".
+func missingAgents(job *types.Job) string {
+	var scope string
+	if job.Organization != "" {
+		scope = " of organization " + job.Organization + " or shared"
+	}
+	var fits string
+	if job.OS != "" {
+		fits += " running " + job.OS
+	}
+	if job.Arch != "" {
+		fits += " on " + job.Arch
+	} else if len(job.Images) > 0 {
+		fits += " on " + strings.Join(slices.Sorted(maps.Keys(job.Images)), " or ")
+	}
+	if job.Shell != "" {
+		fits += " with the " + string(job.Shell) + " shell"
+	}
+	if job.ResourceRequests() != (types.ResourceAmounts{}) {
+		fits += " large enough for its resource requests"
+	}
+	if len(job.Labels) == 0 {
+		return fmt.Sprintf("no agent%s%s available", scope, fits)
+	}
+	return fmt.Sprintf("no agent%s%s has labels %s", scope, fits, types.FormatLabels(job.Labels))
+}
@@ -0,0 +1,220 @@
+package scheduler
+
+import (
+	"slices"
+	"sort"
+	"sync"
+
+	"open-cicd/internal/types"
+)
+
+// Queue holds queued jobs in priority order. Each priority level keeps a FIFO
+// list per repository and takes repositories in turns, so a repository that
+// queues many jobs cannot starve the others at the same priority. Pick can
+// weigh the turns by how much of the fleet each repository already uses.
+type Queue struct {
+	mu     sync.Mutex
+	levels []*level
+	jobs   map[string]*types.Job
+}
+
+// level is the queue of one priority.
+type level struct {
+	// repos maps a repository to its jobs, oldest first.
+	repos map[string][]*types.Job
+	// order is the rotation of repositories with queued jobs; the head is
+	// served next.
+	order []string
+}
+
+// NewQueue returns an empty queue.
+func NewQueue() *Queue {
+	q := &Queue{jobs: make(map[string]*types.Job)}
+	for range types.Priorities {
+		q.levels = append(q.levels, &level{repos: make(map[string][]*types.Job)})
+	}
+	return q
+}
+
+// Len returns the number of queued jobs.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// Push adds a job to the back of its repository's list. Pushing a job that is
+// already queued is a no-op so that the order of older jobs is kept.
+func (q *Queue) Push(job *types.Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.push(job)
+}
+
+func (q *Queue) push(job *types.Job) {
+	if _, ok := q.jobs[job.ID]; ok {
+		return
+	}
+	q.jobs[job.ID] = job
+	l := q.levelOf(job)
+	if _, ok := l.repos[job.Repository]; !ok {
+		l.order = append(l.order, job.Repository)
+	}
+	l.repos[job.Repository] = append(l.repos[job.Repository], job)
+}
+
+// Remove drops a job from the queue if it is present.
+func (q *Queue) Remove(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	delete(q.jobs, id)
+	l := q.levelOf(job)
+	list := l.repos[job.Repository]
+	for i, queued := range list {
+		if queued.ID == id {
+			l.remove(job.Repository, i)
+			return
+		}
+	}
+}
+
+// Reset replaces the queue contents with jobs, which must be ordered oldest
+// first. Repositories keep their place in the rotation when they still have
+// jobs queued.
+func (q *Queue) Reset(jobs []*types.Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	orders := make([][]string, len(q.levels))
+	for i, l := range q.levels {
+		orders[i] = l.order
+		q.levels[i] = &level{repos: make(map[string][]*types.Job)}
+	}
+	q.jobs = make(map[string]*types.Job, len(jobs))
+	for _, job := range jobs {
+		q.push(job)
+	}
+	for i, l := range q.levels {
+		l.order = keepOrder(orders[i], l.order)
+	}
+}
+
+// Pick removes and returns the first job that fits. Levels are scanned from
+// the highest priority down; within a level repositories are tried in turn
+// and each repository's jobs oldest first. A repository that gets a job moves
+// to the back of the rotation. If share is not nil, repositories with a
+// smaller share go first, and those with equal shares in turn. Pick returns
+// nil if no queued job fits.
+func (q *Queue) Pick(fits func(*types.Job) bool, share func(repo string) float64) *types.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, l := range q.levels {
+		order := l.order
+		if share != nil {
+			order = slices.Clone(l.order)
+			shares := make(map[string]float64, len(order))
+			for _, repo := range order {
+				shares[repo] = share(repo)
+			}
+			sort.SliceStable(order, func(i, j int) bool { return shares[order[i]] < shares[order[j]] })
+		}
+		for _, repo := range order {
+			for i, job := range l.repos[repo] {
+				if !fits(job) {
+					continue
+				}
+				delete(q.jobs, job.ID)
+				l.remove(repo, i)
+				l.rotate(repo)
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// Jobs returns the queued jobs in the order Pick takes them when every job
+// fits and repositories have equal shares: levels from the highest priority
+// down, and within a level one job of each repository in turn.
+func (q *Queue) Jobs() []*types.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]*types.Job, 0, len(q.jobs))
+	for _, l := range q.levels {
+		for turn := 0; ; turn++ {
+			taken := false
+			for _, repo := range l.order {
+				if list := l.repos[repo]; turn < len(list) {
+					jobs = append(jobs, list[turn])
+					taken = true
+				}
+			}
+			if !taken {
+				break
+			}
+		}
+	}
+	return jobs
+}
+
+func (q *Queue) levelOf(job *types.Job) *level {
+	rank := job.Priority.Rank()
+	if rank < 0 {
+		rank = types.PriorityNormal.Rank()
+	}
+	return q.levels[rank]
+}
+
+// remove deletes the i-th job of repo, dropping the repository from the
+// rotation once it has no jobs left.
+func (l *level) remove(repo string, i int) {
+	list := l.repos[repo]
+	list = append(list[:i:i], list[i+1:]...)
+	if len(list) > 0 {
+		l.repos[repo] = list
+		return
+	}
+	delete(l.repos, repo)
+	for k, r := range l.order {
+		if r == repo {
+			l.order = append(l.order[:k:k], l.order[k+1:]...)
+			return
+		}
+	}
+}
+
+// rotate moves repo to the back of the rotation if it is still queued.
+func (l *level) rotate(repo string) {
+	for k, r := range l.order {
+		if r == repo {
+			l.order = append(append(l.order[:k:k], l.order[k+1:]...), repo)
+			return
+		}
+	}
+}
+
+// keepOrder returns the repositories in current, with those present in
+// previous first and in their previous order.
+func keepOrder(previous, current []string) []string {
+	present := make(map[string]bool, len(current))
+	for _, r := range current {
+		present[r] = true
+	}
+	order := make([]string, 0, len(current))
+	seen := make(map[string]bool, len(current))
+	for _, r := range previous {
+		if present[r] {
+			order = append(order, r)
+			seen[r] = true
+		}
+	}
+	for _, r := range current {
+		if !seen[r] {
+			order = append(order, r)
+		}
+	}
+	return order
+}
@@ -0,0 +1,208 @@
+package scheduler
+
+import (
+	"slices"
+	"testing"
+
+	"open-cicd/internal/types"
+)
+
+func job(id, repo string, priority types.Priority) *types.Job {
+	return &types.Job{ID: id, Repository: repo, Priority: priority}
+}
+
+func fitsAll(*types.Job) bool { return true }
+
+// drain picks jobs with fits and share until none is left and returns their
+// IDs.
+func drain(q *Queue, fits func(*types.Job) bool, share func(string) float64) []string {
+	var ids []string
+	for {
+		j := q.Pick(fits, share)
+		if j == nil {
+			return ids
+		}
+		ids = append(ids, j.ID)
+	}
+}
+
+func TestQueuePick(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []*types.Job
+		fits  func(*types.Job) bool
+		share map[string]float64
+		want  []string
+	}{
+		{
+			name: "fifo within a repository",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("a2", "a", types.PriorityNormal),
+				job("a3", "a", types.PriorityNormal),
+			},
+			want: []string{"a1", "a2", "a3"},
+		},
+		{
+			name: "higher priority first",
+			jobs: []*types.Job{
+				job("low", "a", types.PriorityLow),
+				job("normal", "a", types.PriorityNormal),
+				job("high", "a", types.PriorityHigh),
+			},
+			want: []string{"high", "normal", "low"},
+		},
+		{
+			name: "unknown priority is normal",
+			jobs: []*types.Job{
+				job("low", "a", types.PriorityLow),
+				job("none", "a", ""),
+				job("high", "a", types.PriorityHigh),
+			},
+			want: []string{"high", "none", "low"},
+		},
+		{
+			name: "repositories take turns",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("a2", "a", types.PriorityNormal),
+				job("a3", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+				job("c1", "c", types.PriorityNormal),
+				job("b2", "b", types.PriorityNormal),
+			},
+			want: []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name: "turns are kept per priority",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("a2", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+				job("bh", "b", types.PriorityHigh),
+			},
+			want: []string{"bh", "a1", "b1", "a2"},
+		},
+		{
+			name: "jobs that do not fit are skipped",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityHigh),
+				job("a2", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+			},
+			fits: func(j *types.Job) bool { return j.ID != "a1" },
+			want: []string{"a2", "b1"},
+		},
+		{
+			name: "smaller share goes first",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("a2", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+				job("b2", "b", types.PriorityNormal),
+			},
+			share: map[string]float64{"a": 0.5, "b": 0.1},
+			want:  []string{"b1", "b2", "a1", "a2"},
+		},
+		{
+			name: "equal shares take turns",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("a2", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+			},
+			share: map[string]float64{"a": 0.2, "b": 0.2},
+			want:  []string{"a1", "b1", "a2"},
+		},
+		{
+			name: "pushing a queued job again is a no-op",
+			jobs: []*types.Job{
+				job("a1", "a", types.PriorityNormal),
+				job("b1", "b", types.PriorityNormal),
+				job("a1", "a", types.PriorityNormal),
+			},
+			want: []string{"a1", "b1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue()
+			for _, j := range tt.jobs {
+				q.Push(j)
+			}
+			fits := tt.fits
+			if fits == nil {
+				fits = fitsAll
+			}
+			var share func(string) float64
+			if tt.share != nil {
+				share = func(repo string) float64 { return tt.share[repo] }
+			}
+			if got := drain(q, fits, share); !slices.Equal(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueJobs(t *testing.T) {
+	q := NewQueue()
+	for _, j := range []*types.Job{
+		job("a1", "a", types.PriorityNormal),
+		job("a2", "a", types.PriorityNormal),
+		job("b1", "b", types.PriorityNormal),
+		job("c1", "c", types.PriorityLow),
+		job("h1", "c", types.PriorityHigh),
+	} {
+		q.Push(j)
+	}
+	var listed []string
+	for _, j := range q.Jobs() {
+		listed = append(listed, j.ID)
+	}
+	want := []string{"h1", "a1", "b1", "a2", "c1"}
+	if !slices.Equal(listed, want) {
+		t.Errorf("Jobs() = %v, want %v", listed, want)
+	}
+	// Listing takes nothing off the queue, and Pick agrees with it.
+	if got := drain(q, fitsAll, nil); !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q := NewQueue()
+	for _, j := range []*types.Job{
+		job("a1", "a", types.PriorityNormal),
+		job("a2", "a", types.PriorityNormal),
+		job("b1", "b", types.PriorityNormal),
+	} {
+		q.Push(j)
+	}
+	q.Remove("a1")
+	q.Remove("missing")
+	if got := q.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+	if got, want := drain(q, fitsAll, nil), []string{"a2", "b1"}; !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+}
+
+func TestQueueResetKeepsRotation(t *testing.T) {
+	q := NewQueue()
+	a1, a2 := job("a1", "a", types.PriorityNormal), job("a2", "a", types.PriorityNormal)
+	b1 := job("b1", "b", types.PriorityNormal)
+	for _, j := range []*types.Job{a1, a2, b1} {
+		q.Push(j)
+	}
+	// Serving a moves it behind b.
+	if j := q.Pick(fitsAll, nil); j.ID != "a1" {
+		t.Fatalf("picked %s, want a1", j.ID)
+	}
+	c1 := job("c1", "c", types.PriorityNormal)
+	q.Reset([]*types.Job{a2, b1, c1})
+	if got, want := drain(q, fitsAll, nil), []string{"b1", "a2", "c1"}; !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// reapInterval is how often held jobs are checked for hanging, at most.
+const reapInterval = 30 * time.Second
+
+// Reaper gives up on jobs that hang although their agents keep renewing
+// the leases: jobs assigned that never start, and running jobs that print
+// nothing, for longer than the stuck timeout. Such jobs are marked lost,
+// which fails them or retries them as their retry policy says, and their
+// agents are told to stop them.
+//
+// Output is tracked as it reaches this replica, so the reaper runs on the
+// leader, which the agents upload to. No job counts as quiet for longer
+// than the reaper has been running.
+type Reaper struct {
+	jobs       *jobs.Manager
+	dispatcher Dispatcher
+	timeout    atomic.Int64
+	now        func() time.Time
+
+	mu     sync.Mutex
+	since  time.Time
+	output map[string]time.Time
+	onLost []func(*types.Job)
+}
+
+// NewReaper returns a reaper for the jobs of manager that stops them
+// through dispatcher. It reaps nothing until SetTimeout gives it a timeout.
+func NewReaper(manager *jobs.Manager, dispatcher Dispatcher) *Reaper {
+	return &Reaper{jobs: manager, dispatcher: dispatcher, now: time.Now, output: make(map[string]time.Time)}
+}
+
+// SetTimeout sets how long a job may stay assigned without starting, or run
+// without output, before it is marked lost. Zero never marks jobs lost.
+func (r *Reaper) SetTimeout(d time.Duration) {
+	r.timeout.Store(int64(d))
+}
+
+// OnLost registers fn to be called with every job marked lost, as it is
+// afterwards: failed, or queued for its next attempt. fn must not block.
+func (r *Reaper) OnLost(fn func(*types.Job)) {
+	r.onLost = append(r.onLost, fn)
+}
+
+// ObserveLog notes output of a job. It is meant to be registered with
+// logs.Feed.Observe and never blocks.
+func (r *Reaper) ObserveLog(jobID string, c logs.Chunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.At.After(r.output[jobID]) {
+		r.output[jobID] = c.At
+	}
+}
+
+// Run checks held jobs for hanging until ctx is cancelled.
+func (r *Reaper) Run(ctx context.Context) {
+	r.mu.Lock()
+	r.since = r.now()
+	r.mu.Unlock()
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.reap(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "checking for hung jobs", "error", err)
+		}
+	}
+}
+
+// reap marks lost every assigned or running job that has been quiet for
+// longer than the timeout. Jobs of trigger steps, which the server runs
+// by waiting for a downstream run, are left alone.
+func (r *Reaper) reap(ctx context.Context) error {
+	timeout := time.Duration(r.timeout.Load())
+	var held []*types.Job
+	for _, state := range []types.JobState{types.JobStateAssigned, types.JobStateRunning} {
+		list, err := r.jobs.List(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		held = append(held, list...)
+	}
+
+	now := r.now()
+	var quiet []*types.Job
+	r.mu.Lock()
+	live := make(map[string]time.Time, len(held))
+	for _, job := range held {
+		last := r.since
+		if t, ok := job.LastTransition(job.State); ok && t.At.After(last) {
+			last = t.At
+		}
+		if t, ok := r.output[job.ID]; ok {
+			live[job.ID] = t
+			if t.After(last) {
+				last = t
+			}
+		}
+		if timeout > 0 && job.Trigger == nil && now.Sub(last) > timeout {
+			quiet = append(quiet, job)
+		}
+	}
+	// Forget jobs no longer held, whose output no longer matters.
+	r.output = live
+	r.mu.Unlock()
+
+	for _, job := range quiet {
+		reason := fmt.Sprintf("lost: running without output for %s", timeout)
+		if job.State == types.JobStateAssigned {
+			reason = fmt.Sprintf("lost: assigned for %s without starting", timeout)
+		}
+		lost, err := r.jobs.MarkLost(ctx, job, reason)
+		if errors.Is(err, jobs.ErrLeaseLost) || errors.Is(err, types.ErrInvalidTransition) || errors.Is(err, jobs.ErrAgentMismatch) || errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("marking job %s lost: %w", job.ID, err)
+		}
+		slog.WarnContext(ctx, "Job hung; marked it lost", "job_id", job.ID, "job", job.Name, "agent_id", job.AgentID, "reason", reason, "retried", lost.State == types.JobStateQueued)
+		if err := r.dispatcher.Cancel(job.AgentID, job.ID, reason, false); err != nil && !errors.Is(err, ErrAgentNotConnected) {
+			slog.ErrorContext(ctx, "asking agent to stop lost job", "agent_id", job.AgentID, "job_id", job.ID, "error", err)
+		}
+		for _, fn := range r.onLost {
+			fn(lost)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Nothing the scheduler keeps in memory is needed to resume after a restart
+// or a change of leader: the store holds every job's state, agent and lease.
+// The queue is rebuilt from it in the order jobs entered it. Running jobs
+// stay with their agents, which renew the leases as before; those an agent
+// no longer has run out and go back to the queue. Jobs assigned but not
+// started may never have reached their agent, as the server can stop
+// between assigning a job and pushing it, so they are sent again when the
+// agent connects. An agent that already has such a job accepts it again
+// under the same lease, so no job runs twice.
+
+// queuedOrder sorts jobs in the order they entered the queue, last, which
+// is the order job notifications push them in.
+func queuedOrder(jobs []*types.Job) {
+	queuedAt := func(j *types.Job) time.Time {
+		if t, ok := j.LastTransition(types.JobStateQueued); ok {
+			return t.At
+		}
+		return j.CreatedAt
+	}
+	slices.SortStableFunc(jobs, func(a, b *types.Job) int {
+		return queuedAt(a).Compare(queuedAt(b))
+	})
+}
+
+// Redeliver asks the scheduler to send the agent the jobs it was assigned
+// but has not started again. It is meant to be called whenever an agent
+// opens its job stream, and never blocks.
+func (s *Scheduler) Redeliver(agentID string) {
+	s.redeliverMu.Lock()
+	s.redeliver[agentID] = true
+	s.redeliverMu.Unlock()
+	s.Kick()
+}
+
+// redeliverAssigned sends the agents Redeliver was called for the jobs
+// they were assigned but have not started. Deploy jobs go back to the
+// queue instead, so that their deployments are recorded afresh, and jobs
+// whose lease ran out are left to expire.
+func (s *Scheduler) redeliverAssigned(ctx context.Context) {
+	s.redeliverMu.Lock()
+	agents := s.redeliver
+	s.redeliver = make(map[string]bool)
+	s.redeliverMu.Unlock()
+
+	now := s.now()
+	for _, agentID := range slices.Sorted(maps.Keys(agents)) {
+		assigned, err := s.jobs.List(ctx, storage.JobFilter{State: types.JobStateAssigned, AgentID: agentID})
+		if err != nil {
+			slog.ErrorContext(ctx, "listing jobs assigned to agent", "agent_id", agentID, "error", err)
+			continue
+		}
+		for _, job := range assigned {
+			if job.Trigger != nil || job.LeaseExpired(now) {
+				continue
+			}
+			if job.Environment != "" {
+				if _, err := s.jobs.Requeue(ctx, job.ID, "assignment may not have reached the agent"); err != nil {
+					slog.ErrorContext(ctx, "re-queueing deploy job", "job_id", job.ID, "error", err)
+				}
+				continue
+			}
+			sent, err := s.deliver(ctx, job)
+			if err != nil {
+				slog.ErrorContext(ctx, "sending assigned job again", "job_id", job.ID, "agent_id", agentID, "error", err)
+				continue
+			}
+			if sent {
+				slog.InfoContext(ctx, "Sent assigned job again", "job_id", job.ID, "job", job.Name, "agent_id", agentID)
+			}
+		}
+	}
+}
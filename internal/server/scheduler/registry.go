@@ -0,0 +1,476 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/version"
+)
+
+var (
+	// ErrInvalidToken is returned when an agent presents an unknown registration token.
+	ErrInvalidToken = errors.New("invalid registration token")
+	// ErrInvalidCredential is returned when an agent session credential does not match.
+	ErrInvalidCredential = errors.New("invalid agent credential")
+	// ErrCertificateRequired is returned when client certificates are
+	// required and an agent did not present one.
+	ErrCertificateRequired = errors.New("a client certificate is required")
+	// ErrCertificateMismatch is returned when an agent presents a different
+	// client certificate than the one it registered with.
+	ErrCertificateMismatch = errors.New("client certificate does not match the one the agent registered with")
+	// ErrVersionTooOld is returned when an agent older than the minimum
+	// version tries to register.
+	ErrVersionTooOld = errors.New("agent version is older than the minimum the server accepts")
+)
+
+// errUnchanged aborts an agent update that turned out to be unnecessary.
+var errUnchanged = errors.New("agent unchanged")
+
+// credentialBytes is the entropy of issued agent session credentials.
+const credentialBytes = 32
+
+// OrganizationTokens finds the organization whose agents register with a
+// token.
+type OrganizationTokens interface {
+	OrganizationForToken(ctx context.Context, token string) (string, bool, error)
+}
+
+// Registry tracks agents and their lifecycle state on top of an AgentStore.
+type Registry struct {
+	store       storage.AgentStore
+	tokens      [][]byte
+	orgs        OrganizationTokens
+	agentTokens *AgentTokens
+	heartbeat   time.Duration
+	now         func() time.Time
+	// requireCerts ties every agent to the client certificate it
+	// registered with.
+	requireCerts bool
+	// minVersion, if set, is the oldest agent version that may register.
+	minVersion atomic.Pointer[string]
+	// offline are called with agents that went offline.
+	offline []func(*types.Agent)
+}
+
+// NewRegistry returns a registry that accepts the given registration tokens
+// for shared agents and tells agents to send a heartbeat every heartbeat
+// interval.
+func NewRegistry(store storage.AgentStore, tokens []string, heartbeat time.Duration) *Registry {
+	r := &Registry{store: store, heartbeat: heartbeat, now: time.Now}
+	for _, t := range tokens {
+		if t != "" {
+			r.tokens = append(r.tokens, []byte(t))
+		}
+	}
+	return r
+}
+
+// OnOffline registers fn to be called with an agent that went offline,
+// because it stopped sending heartbeats or disconnected. Callbacks run
+// synchronously and must not block. It must be called before the registry
+// is used.
+func (r *Registry) OnOffline(fn func(*types.Agent)) {
+	r.offline = append(r.offline, fn)
+}
+
+func (r *Registry) wentOffline(agent *types.Agent) {
+	for _, fn := range r.offline {
+		fn(agent.Clone())
+	}
+}
+
+// AcceptOrganizationTokens also accepts the registration tokens of
+// organizations, registering agents that present one into its organization.
+// It must be called before the registry is used.
+func (r *Registry) AcceptOrganizationTokens(orgs OrganizationTokens) {
+	r.orgs = orgs
+}
+
+// AcceptAgentTokens also accepts the registration tokens handed out
+// through tokens, within their expiry, use limit and label restrictions. It
+// must be called before the registry is used.
+func (r *Registry) AcceptAgentTokens(tokens *AgentTokens) {
+	r.agentTokens = tokens
+}
+
+// RequireCertificates makes registration and authentication require the
+// fingerprint of a verified client certificate, which must stay the same for
+// the lifetime of an agent. It must be called before the registry is used.
+func (r *Registry) RequireCertificates() {
+	r.requireCerts = true
+}
+
+// RequireVersion refuses the registration of agents older than min, and of
+// those that do not report a version; an empty min accepts every version.
+// Agents already registered are not affected until they register again. It
+// may be called while the registry is in use, such as when the
+// configuration is reloaded.
+func (r *Registry) RequireVersion(min string) {
+	r.minVersion.Store(&min)
+}
+
+// Register validates the registration token and records a new agent along
+// with the fingerprint of its client certificate, if it presented one. An
+// organization's token registers the agent into that organization, and so
+// does a handed out token confined to one; the token is checked last, so
+// that a registration refused for another reason does not count against
+// its use limit. It returns the stored agent and the plaintext session
+// credential, which is not retrievable afterwards.
+func (r *Registry) Register(ctx context.Context, req types.RegisterAgentRequest, fingerprint string) (*types.Agent, string, error) {
+	if r.requireCerts && fingerprint == "" {
+		return nil, "", ErrCertificateRequired
+	}
+	if min := r.minVersion.Load(); min != nil && *min != "" && version.Older(req.Version, *min) {
+		v := req.Version
+		if v == "" {
+			v = "unknown"
+		}
+		return nil, "", fmt.Errorf("%w: agent is %s, the minimum is %s", ErrVersionTooOld, v, *min)
+	}
+	org, err := r.organizationFor(ctx, req.Token, req.Labels)
+	if err != nil {
+		return nil, "", err
+	}
+	capacity := req.Capacity
+	if capacity == 0 {
+		capacity = 1
+	}
+	credential := utils.NewSecret(credentialBytes)
+	now := r.now()
+	agent := &types.Agent{
+		ID:             utils.NewID(),
+		Hostname:       req.Hostname,
+		Labels:         req.Labels,
+		Capacity:       capacity,
+		State:          types.AgentStateRegistered,
+		CredentialHash: utils.HashSecret(credential),
+		Organization:   org,
+		Version:        req.Version,
+		Platform:       req.Platform,
+		Shells:         req.Shells,
+		AutoUpdate:     req.AutoUpdate,
+		Transport:      req.Transport,
+		// The fingerprint is recorded even when certificates are not
+		// required, so that operators can see which agents have one.
+		CertificateFingerprint: fingerprint,
+		RegisteredAt:           now,
+		LastSeenAt:             now,
+		UpdatedAt:              now,
+	}
+	if err := r.store.CreateAgent(ctx, agent); err != nil {
+		return nil, "", err
+	}
+	return agent, credential, nil
+}
+
+// RegisterBuiltin records or refreshes an agent run by the server itself,
+// such as an executor, and brings it online. Built-in agents have no
+// credential, so they can never authenticate over the agent protocol.
+func (r *Registry) RegisterBuiltin(ctx context.Context, id, hostname string, labels map[string]string, capacity int) (*types.Agent, error) {
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		now := r.now()
+		if err := bringOnline(a, now); err != nil {
+			return err
+		}
+		a.Hostname = hostname
+		a.Labels = labels
+		a.Capacity = capacity
+		a.LastSeenAt = now
+		a.UpdatedAt = now
+		return nil
+	})
+	if !errors.Is(err, storage.ErrNotFound) {
+		return agent, err
+	}
+	now := r.now()
+	agent = &types.Agent{
+		ID:           id,
+		Hostname:     hostname,
+		Labels:       labels,
+		Capacity:     capacity,
+		State:        types.AgentStateOnline,
+		RegisteredAt: now,
+		LastSeenAt:   now,
+		UpdatedAt:    now,
+	}
+	if err := r.store.CreateAgent(ctx, agent); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// Authenticate checks an agent's session credential, and when certificates
+// are required the fingerprint of its client certificate, and returns the
+// agent.
+func (r *Registry) Authenticate(ctx context.Context, id, credential, fingerprint string) (*types.Agent, error) {
+	agent, err := r.store.GetAgent(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidCredential
+	}
+	if err != nil {
+		return nil, err
+	}
+	if agent.CredentialHash == "" {
+		return nil, ErrInvalidCredential
+	}
+	got := utils.HashSecret(credential)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(agent.CredentialHash)) != 1 {
+		return nil, ErrInvalidCredential
+	}
+	if r.requireCerts {
+		if fingerprint == "" {
+			return nil, ErrCertificateRequired
+		}
+		// Agents registered before certificates were required have none
+		// recorded and must register again.
+		if fingerprint != agent.CertificateFingerprint {
+			return nil, ErrCertificateMismatch
+		}
+	}
+	return agent, nil
+}
+
+// Get returns the agent with the given ID.
+func (r *Registry) Get(ctx context.Context, id string) (*types.Agent, error) {
+	return r.store.GetAgent(ctx, id)
+}
+
+// List returns all known agents.
+func (r *Registry) List(ctx context.Context) ([]*types.Agent, error) {
+	return r.store.ListAgents(ctx)
+}
+
+// SetState moves an agent to a new lifecycle state, enforcing the agent state
+// machine. Moving an agent online ends its maintenance drain.
+func (r *Registry) SetState(ctx context.Context, id string, state types.AgentState) (*types.Agent, error) {
+	var previous types.AgentState
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		previous = a.State
+		if err := a.Transition(state, r.now()); err != nil {
+			return err
+		}
+		if state == types.AgentStateOnline {
+			a.Drain = nil
+		}
+		return nil
+	})
+	if err == nil && state == types.AgentStateOffline && previous != types.AgentStateOffline {
+		r.wentOffline(agent)
+	}
+	return agent, err
+}
+
+// Drain drains an agent for maintenance: it takes no new jobs, even after
+// reconnecting, until it is resumed, and the jobs it holds run to
+// completion. Draining an agent that already is keeps the original drain.
+func (r *Registry) Drain(ctx context.Context, id, by, reason string) (*types.Agent, error) {
+	return r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		now := r.now()
+		if a.Drain == nil {
+			a.Drain = &types.AgentDrain{By: by, Reason: reason, StartedAt: now}
+		}
+		if a.State == types.AgentStateOnline {
+			return a.Transition(types.AgentStateDraining, now)
+		}
+		a.UpdatedAt = now
+		return nil
+	})
+}
+
+// Resume ends the drain of an agent, bringing it back online if it is
+// connected. An agent still installing an update stays draining until the
+// update finishes.
+func (r *Registry) Resume(ctx context.Context, id string) (*types.Agent, error) {
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		if a.Drain == nil && a.State != types.AgentStateDraining {
+			return errUnchanged
+		}
+		a.Drain = nil
+		now := r.now()
+		if a.State == types.AgentStateDraining && !installingUpdate(a) {
+			return a.Transition(types.AgentStateOnline, now)
+		}
+		a.UpdatedAt = now
+		return nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return r.store.GetAgent(ctx, id)
+	}
+	return agent, err
+}
+
+// installingUpdate reports whether the rolling update drained agent to
+// install a version it has not yet failed to install.
+func installingUpdate(a *types.Agent) bool {
+	return a.Update != nil && a.Update.Error == ""
+}
+
+// BeginUpdate records that an online agent was asked to update to version
+// and drains it, so that it takes no new jobs while it does.
+func (r *Registry) BeginUpdate(ctx context.Context, id, version string) (*types.Agent, error) {
+	return r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		now := r.now()
+		if err := a.Transition(types.AgentStateDraining, now); err != nil {
+			return err
+		}
+		a.Update = &types.AgentUpdate{Version: version, StartedAt: now}
+		return nil
+	})
+}
+
+// FailUpdate records why an agent could not update to version and brings it
+// back online if the update drained it and it is not drained for
+// maintenance.
+func (r *Registry) FailUpdate(ctx context.Context, id, version, reason string) (*types.Agent, error) {
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		if a.Update == nil || a.Update.Version != version || a.Update.Error != "" {
+			return errUnchanged
+		}
+		a.Update.Error = reason
+		if a.State == types.AgentStateDraining && a.Drain == nil {
+			return a.Transition(types.AgentStateOnline, r.now())
+		}
+		a.UpdatedAt = r.now()
+		return nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return r.store.GetAgent(ctx, id)
+	}
+	return agent, err
+}
+
+// HeartbeatInterval returns how often agents are asked to send a heartbeat.
+func (r *Registry) HeartbeatInterval() time.Duration {
+	return r.heartbeat
+}
+
+// Heartbeat records that an agent is alive. Agents that are registered or
+// were marked offline come back online, or draining if they are drained for
+// maintenance; draining agents stay draining. Resources, if not nil, replace
+// what the agent last reported of its machine.
+func (r *Registry) Heartbeat(ctx context.Context, id string, resources *types.AgentResources) (*types.Agent, error) {
+	return r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		now := r.now()
+		if err := bringOnline(a, now); err != nil {
+			return err
+		}
+		a.LastSeenAt = now
+		if resources != nil {
+			report := *resources
+			report.ReportedAt = now
+			a.Resources = &report
+		}
+		return nil
+	})
+}
+
+// bringOnline moves an agent that is registered or offline online, and on to
+// draining if it is drained for maintenance. Agents in other states are left
+// as they are.
+func bringOnline(a *types.Agent, now time.Time) error {
+	if a.State != types.AgentStateRegistered && a.State != types.AgentStateOffline {
+		return nil
+	}
+	if err := a.Transition(types.AgentStateOnline, now); err != nil {
+		return err
+	}
+	if a.Drain != nil {
+		return a.Transition(types.AgentStateDraining, now)
+	}
+	return nil
+}
+
+// Reconcile brings the recorded state of an agent in line with whether it
+// is connected: a connected agent recorded offline comes back online, or
+// draining if it is drained for maintenance, and one recorded online or
+// draining that is not connected goes offline. Registered agents are left
+// as they are. It reports whether the state changed.
+func (r *Registry) Reconcile(ctx context.Context, id string, connected bool) (*types.Agent, bool, error) {
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		now := r.now()
+		switch {
+		case connected && a.State == types.AgentStateOffline:
+			return bringOnline(a, now)
+		case !connected && (a.State == types.AgentStateOnline || a.State == types.AgentStateDraining):
+			return a.Transition(types.AgentStateOffline, now)
+		}
+		return errUnchanged
+	})
+	if errors.Is(err, errUnchanged) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if agent.State == types.AgentStateOffline {
+		r.wentOffline(agent)
+	}
+	return agent, true, nil
+}
+
+// expire marks an agent offline if it has not been seen since cutoff. It
+// reports whether the agent is stale, re-checking under the store's update
+// so that a heartbeat racing with the check wins.
+func (r *Registry) expire(ctx context.Context, id string, cutoff time.Time) (bool, error) {
+	stale := false
+	agent, err := r.store.UpdateAgent(ctx, id, func(a *types.Agent) error {
+		stale = a.LastSeenAt.Before(cutoff)
+		if !stale || a.State == types.AgentStateOffline {
+			return errUnchanged
+		}
+		return a.Transition(types.AgentStateOffline, r.now())
+	})
+	if errors.Is(err, errUnchanged) {
+		return stale, nil
+	}
+	if err == nil {
+		r.wentOffline(agent)
+	}
+	return stale, err
+}
+
+// organizationFor returns the organization a registration token registers
+// an agent with labels into, "" for the shared tokens, or an error wrapping
+// ErrInvalidToken or ErrLabelsNotAllowed.
+func (r *Registry) organizationFor(ctx context.Context, token string, labels map[string]string) (string, error) {
+	if r.validToken(token) {
+		return "", nil
+	}
+	if r.agentTokens != nil {
+		org, ok, err := r.agentTokens.redeem(ctx, token, labels)
+		if err != nil && !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrLabelsNotAllowed) {
+			return "", fmt.Errorf("looking up registration token: %w", err)
+		}
+		if err != nil || ok {
+			return org, err
+		}
+	}
+	if r.orgs == nil {
+		return "", ErrInvalidToken
+	}
+	org, ok, err := r.orgs.OrganizationForToken(ctx, token)
+	if err != nil {
+		return "", fmt.Errorf("looking up registration token: %w", err)
+	}
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	return org, nil
+}
+
+func (r *Registry) validToken(token string) bool {
+	ok := false
+	for _, t := range r.tokens {
+		if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
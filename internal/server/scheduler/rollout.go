@@ -0,0 +1,139 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"open-cicd/internal/releases"
+	"open-cicd/internal/types"
+	"open-cicd/internal/version"
+)
+
+// rolloutInterval is how often the rollout looks for agents to update.
+const rolloutInterval = 15 * time.Second
+
+// Updater asks agents connected to the server to update themselves.
+type Updater interface {
+	// Connected reports whether the agent has a job stream open.
+	Connected(agentID string) bool
+	// Update asks the agent to install binary, downloading it from url.
+	Update(agentID string, binary *releases.Binary, url string) error
+}
+
+// Rollout updates the agents older than a release to it, a few at a time.
+// Only connected agents that are online and said they install updates are
+// asked to; each is drained first, so that its running jobs finish before
+// it restarts into the new version and registers again.
+type Rollout struct {
+	registry *Registry
+	updater  Updater
+	release  *releases.Release
+	// baseURL is the server's external URL, which agents download the
+	// release from.
+	baseURL  string
+	parallel int
+}
+
+// NewRollout returns a rollout of release through updater that has at most
+// parallel agents updating at once.
+func NewRollout(registry *Registry, updater Updater, release *releases.Release, baseURL string, parallel int) *Rollout {
+	return &Rollout{
+		registry: registry,
+		updater:  updater,
+		release:  release,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		parallel: max(parallel, 1),
+	}
+}
+
+// Run updates agents until ctx is cancelled.
+func (r *Rollout) Run(ctx context.Context) {
+	ticker := time.NewTicker(rolloutInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.step(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "rolling out agent update", "version", r.release.Version, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// step asks outdated agents to update until parallel agents are updating.
+func (r *Rollout) step(ctx context.Context) error {
+	agents, err := r.registry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing agents: %w", err)
+	}
+	updating := 0
+	var outdated []*types.Agent
+	for _, agent := range agents {
+		switch {
+		case r.updating(agent):
+			updating++
+		case r.outdated(agent):
+			outdated = append(outdated, agent)
+		}
+	}
+	for _, agent := range outdated {
+		if updating >= r.parallel {
+			break
+		}
+		binary, err := r.release.Binary(agent.Platform)
+		if err != nil {
+			continue
+		}
+		if _, err := r.registry.BeginUpdate(ctx, agent.ID, r.release.Version); err != nil {
+			// The agent was drained or went away since it was listed.
+			if errors.Is(err, types.ErrInvalidTransition) {
+				continue
+			}
+			return fmt.Errorf("draining agent %s: %w", agent.ID, err)
+		}
+		if err := r.updater.Update(agent.ID, binary, r.downloadURL(binary)); err != nil {
+			if _, ferr := r.registry.FailUpdate(ctx, agent.ID, r.release.Version, "sending the update: "+err.Error()); ferr != nil {
+				return fmt.Errorf("recording failed update of agent %s: %w", agent.ID, ferr)
+			}
+			continue
+		}
+		slog.InfoContext(ctx, "Asked agent to update", "agent_id", agent.ID, "hostname", agent.Hostname, "from", agent.Version, "to", r.release.Version)
+		updating++
+	}
+	return nil
+}
+
+// updating reports whether agent is still installing the release.
+func (r *Rollout) updating(agent *types.Agent) bool {
+	return agent.Update != nil && agent.Update.Version == r.release.Version && agent.Update.Error == "" &&
+		agent.State == types.AgentStateDraining && r.updater.Connected(agent.ID)
+}
+
+// outdated reports whether agent should be asked to install the release.
+// Agents that were already asked to are not asked again, even if they could
+// not install it.
+func (r *Rollout) outdated(agent *types.Agent) bool {
+	if !agent.AutoUpdate || agent.State != types.AgentStateOnline || !version.Older(agent.Version, r.release.Version) {
+		return false
+	}
+	if agent.Update != nil && agent.Update.Version == r.release.Version {
+		return false
+	}
+	if _, err := r.release.Binary(agent.Platform); err != nil {
+		return false
+	}
+	return r.updater.Connected(agent.ID)
+}
+
+// downloadURL returns where agents download binary from.
+func (r *Rollout) downloadURL(binary *releases.Binary) string {
+	q := url.Values{"platform": {binary.Platform}, "version": {binary.Version}}
+	return r.baseURL + "/agents/download?" + q.Encode()
+}
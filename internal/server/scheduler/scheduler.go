@@ -0,0 +1,754 @@
+// Package scheduler assigns queued jobs to connected agents and pushes the
+// assignments to them.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"open-cicd/internal/environments"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/oidc"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/secrets"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+)
+
+// ErrAgentNotConnected is returned by a Dispatcher for agents without an open
+// job stream.
+var ErrAgentNotConnected = errors.New("agent is not connected")
+
+// resyncInterval is how often the scheduler runs without being kicked, to
+// pick up anything a missed notification left behind.
+const resyncInterval = 2 * time.Second
+
+// Dispatcher delivers work to agents over their persistent connections.
+type Dispatcher interface {
+	// Ready returns the free job slots announced by each connected agent.
+	Ready() map[string]int
+	// Dispatch pushes a job assignment to an agent, consuming one slot.
+	Dispatch(agentID string, job *types.Job) error
+	// Cancel asks an agent to stop a job. With requeue set the agent hands
+	// the job back instead of reporting it cancelled.
+	Cancel(agentID, jobID, reason string, requeue bool) error
+}
+
+// SecretResolver resolves the secrets a job declares, by name. A secret the
+// project or Vault does not have is reported with an error wrapping
+// secrets.ErrNotDefined.
+type SecretResolver interface {
+	ResolveJob(ctx context.Context, job *types.Job) (map[string]string, error)
+}
+
+// VariableResolver returns the environment the global and project
+// variables that apply to ref give a job of project.
+type VariableResolver interface {
+	Env(ctx context.Context, project, ref string) (map[string]string, error)
+}
+
+// IDTokenIssuer issues the OIDC ID tokens jobs ask for. A job the issuer
+// cannot describe, such as one without a project, is reported with an error
+// wrapping oidc.ErrNoProject.
+type IDTokenIssuer interface {
+	Issue(job *types.Job, audience string) (string, error)
+}
+
+// errNoIssuer fails jobs asking for ID tokens when no issuer is configured.
+var errNoIssuer = errors.New("the server is not configured to issue ID tokens")
+
+// EnvironmentLocks serializes deploy jobs per environment. Begin fails with
+// an error wrapping environments.ErrLocked while another deploy job holds
+// the environment.
+type EnvironmentLocks interface {
+	Locked(ctx context.Context, job *types.Job) (bool, error)
+	Begin(ctx context.Context, job *types.Job) error
+}
+
+// Scheduler matches queued jobs with agents that have free slots and carry
+// the labels the job requires.
+type Scheduler struct {
+	registry   *Registry
+	jobs       *jobs.Manager
+	dispatcher Dispatcher
+	secrets    SecretResolver
+	variables  VariableResolver
+	idTokens   IDTokenIssuer
+	locks      EnvironmentLocks
+	pauses     storage.SchedulerPauseStore
+	queue      *Queue
+	kick       chan struct{}
+	// paused is the pause of scheduling, as last loaded from pauses, or
+	// nil while scheduling.
+	paused atomic.Pointer[types.SchedulerPause]
+	// resyncRequested makes the next pass resync even if it was kicked.
+	resyncRequested atomic.Bool
+
+	// matchTimeout is how long a queued job may wait without any agent
+	// that could run it, as a time.Duration; zero waits forever.
+	matchTimeout atomic.Int64
+	// unmatched records since when each such job has been waiting. It is
+	// only used by Run.
+	unmatched map[string]time.Time
+	now       func() time.Time
+
+	// running is set while Run is. Job notifications are ignored
+	// otherwise, as the scheduler of another replica is in charge.
+	running atomic.Bool
+	// signalled holds the cancelling jobs whose agents have been asked to
+	// stop them.
+	signalledMu sync.Mutex
+	signalled   map[string]bool
+	// redeliver holds the agents whose assigned jobs are to be sent again.
+	redeliverMu sync.Mutex
+	redeliver   map[string]bool
+}
+
+// New returns a scheduler. It subscribes to job changes so that newly queued
+// jobs are scheduled immediately and re-queue requests reach agents. Jobs
+// are dispatched with the variables from variables, their declared secrets
+// resolved by resolver and the ID tokens they ask for issued by idTokens,
+// which may be nil, and deploy jobs only start once locks lets them. No job
+// is scheduled while pauses records a pause.
+func New(registry *Registry, manager *jobs.Manager, dispatcher Dispatcher, resolver SecretResolver, variables VariableResolver, idTokens IDTokenIssuer, locks EnvironmentLocks, pauses storage.SchedulerPauseStore) *Scheduler {
+	s := &Scheduler{
+		registry:   registry,
+		jobs:       manager,
+		dispatcher: dispatcher,
+		secrets:    resolver,
+		variables:  variables,
+		idTokens:   idTokens,
+		locks:      locks,
+		pauses:     pauses,
+		queue:      NewQueue(),
+		kick:       make(chan struct{}, 1),
+		now:        time.Now,
+		signalled:  make(map[string]bool),
+		redeliver:  make(map[string]bool),
+	}
+	manager.Observe(s.jobChanged)
+	return s
+}
+
+// Kick asks the scheduler to run a pass soon. It never blocks.
+func (s *Scheduler) Kick() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// QueueDepth returns the number of jobs waiting to be scheduled.
+func (s *Scheduler) QueueDepth() int {
+	return s.queue.Len()
+}
+
+// Run schedules jobs until ctx is cancelled. The queue is loaded from the
+// job store on start and on every resync tick; in between it is kept up to
+// date by job notifications. Only one replica runs the scheduler at a time,
+// and the resync also picks up changes made through the others. The agents
+// connected when Run starts are sent the jobs they were assigned but have
+// not started again, as are agents that connect later; see Redeliver.
+// While scheduling is paused, queued jobs stay queued but assigned jobs are
+// still sent again.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.running.Store(true)
+	defer s.running.Store(false)
+	s.unmatched = nil
+	for agentID := range s.dispatcher.Ready() {
+		s.Redeliver(agentID)
+	}
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	resync := true
+	for {
+		if resync {
+			if err := s.resync(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "loading job queue", "error", err)
+			}
+			if err := s.loadPause(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "loading scheduler pause", "error", err)
+			}
+		}
+		if !s.jobs.Draining() {
+			s.redeliverAssigned(ctx)
+			if s.paused.Load() == nil {
+				if err := s.schedule(ctx); err != nil && ctx.Err() == nil {
+					slog.ErrorContext(ctx, "scheduler pass failed", "error", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.kick:
+			resync = s.resyncRequested.Swap(false)
+		case <-ticker.C:
+			resync = true
+		}
+	}
+}
+
+// resync rebuilds the queue from the queued jobs in the store, in the order
+// they entered it. The jobs of trigger steps are left to the downstream
+// runner.
+func (s *Scheduler) resync(ctx context.Context) error {
+	queued, err := s.jobs.List(ctx, storage.JobFilter{State: types.JobStateQueued})
+	if err != nil {
+		return err
+	}
+	queued = slices.DeleteFunc(queued, func(j *types.Job) bool { return j.Trigger != nil })
+	queuedOrder(queued)
+	s.queue.Reset(queued)
+	if err := s.signalCancelling(ctx); err != nil {
+		return err
+	}
+	if s.jobs.Draining() {
+		return nil
+	}
+	return s.failUnmatched(ctx, queued)
+}
+
+// signalCancelling asks agents to stop the cancelling jobs they have not
+// been asked about yet: those cancelled through another replica, or before
+// this one started scheduling. Trigger steps have no agent to ask.
+func (s *Scheduler) signalCancelling(ctx context.Context) error {
+	cancelling, err := s.jobs.List(ctx, storage.JobFilter{State: types.JobStateCancelling})
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(cancelling))
+	var pending []*types.Job
+	s.signalledMu.Lock()
+	for _, job := range cancelling {
+		if job.Trigger != nil {
+			continue
+		}
+		current[job.ID] = true
+		if !s.signalled[job.ID] {
+			pending = append(pending, job)
+		}
+	}
+	s.signalled = current
+	s.signalledMu.Unlock()
+	for _, job := range pending {
+		s.cancel(job)
+	}
+	return nil
+}
+
+// jobChanged reacts to job updates from the job manager. The jobs of
+// trigger steps are the downstream runner's.
+func (s *Scheduler) jobChanged(job *types.Job) {
+	if !s.running.Load() || job.Trigger != nil {
+		return
+	}
+	if job.State == types.JobStateQueued {
+		s.queue.Push(job)
+		s.Kick()
+		return
+	}
+	s.queue.Remove(job.ID)
+	switch {
+	case job.State == types.JobStateCancelling:
+		s.cancel(job)
+	case job.State == types.JobStateTimedOut && job.AgentID != "":
+		// The job is already final; the agent only needs to stop it.
+		reason := job.Transitions[len(job.Transitions)-1].Reason
+		if err := s.dispatcher.Cancel(job.AgentID, job.ID, reason, false); err != nil && !errors.Is(err, ErrAgentNotConnected) {
+			slog.Error("asking agent to stop timed out job", "agent_id", job.AgentID, "job_id", job.ID, "error", err)
+		}
+	case job.RequeueRequested && job.AgentID != "":
+		if err := s.dispatcher.Cancel(job.AgentID, job.ID, "server is shutting down", true); err != nil {
+			slog.Error("asking agent to hand back job", "agent_id", job.AgentID, "job_id", job.ID, "error", err)
+		}
+	}
+}
+
+// cancel asks the agent holding a cancelling job to stop it. If the signal
+// cannot be delivered, usually because the agent is not connected, nothing
+// will confirm the cancellation, so the job is marked cancelled right away.
+func (s *Scheduler) cancel(job *types.Job) {
+	s.signalledMu.Lock()
+	s.signalled[job.ID] = true
+	s.signalledMu.Unlock()
+	reason := job.Transitions[len(job.Transitions)-1].Reason
+	err := s.dispatcher.Cancel(job.AgentID, job.ID, reason, false)
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, ErrAgentNotConnected) {
+		slog.Error("asking agent to cancel job", "agent_id", job.AgentID, "job_id", job.ID, "error", err)
+	}
+	// Observers must not block the manager, so finish the job separately.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		update := types.JobStatusRequest{State: types.JobStateCancelled, AgentID: job.AgentID, Reason: reason + " (agent not connected)"}
+		if _, err := s.jobs.UpdateStatus(ctx, job.ID, update); err != nil && !errors.Is(err, types.ErrInvalidTransition) {
+			slog.ErrorContext(ctx, "cancelling job held by disconnected agent", "job_id", job.ID, "agent_id", job.AgentID, "error", err)
+		}
+	}()
+}
+
+// schedule assigns queued jobs in queue order to online agents with free
+// slots that serve the job's organization, whose labels satisfy the job,
+// that run its platform and, if they report their resources, that have room
+// for the job's requests; see pickAgent for which of them is preferred.
+// Projects take turns in order of their fair share, the fewest active jobs
+// per unit of weight first. Jobs that no available agent can take, that wait
+// out a retry backoff, whose project has as many jobs active as its quota
+// allows, or that deploy to an environment another deploy job holds, stay
+// queued.
+func (s *Scheduler) schedule(ctx context.Context) error {
+	if s.queue.Len() == 0 {
+		return nil
+	}
+	available, err := s.availableAgents(ctx)
+	if err != nil {
+		return err
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	usage, err := s.loadUsage(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range available {
+		a.room = usage.room(a.agent)
+	}
+	now := s.now()
+	// Locks are looked up before picking so that the queue is not locked
+	// while the store is read.
+	free := s.freeEnvironments(ctx)
+	held := make(map[environmentKey]bool)
+	for len(available) > 0 {
+		var agent *slot
+		job := s.queue.Pick(func(job *types.Job) bool {
+			if job.Waiting(now) || usage.full(job.Repository) || environmentHeld(free, held, job) {
+				return false
+			}
+			agent = pickAgent(available, job)
+			return agent != nil
+		}, usage.share)
+		if job == nil {
+			return nil
+		}
+		err := s.assign(ctx, job, agent.id)
+		if err == nil {
+			usage.active[job.Repository]++
+		}
+		if job.Environment != "" && (err == nil || errors.Is(err, environments.ErrLocked)) {
+			// Either this job holds the environment now, or another does.
+			held[environmentKey{job.Repository, job.Environment}] = true
+		}
+		switch {
+		case errors.Is(err, types.ErrInvalidTransition):
+			continue
+		case errors.Is(err, environments.ErrLocked):
+			slog.InfoContext(ctx, "Environment is locked; job stays queued", "job_id", job.ID, "environment", job.Environment, "reason", err)
+			continue
+		case err != nil:
+			slog.ErrorContext(ctx, "assigning job", "job_id", job.ID, "agent_id", agent.id, "error", err)
+			delete(available, agent.id)
+			continue
+		}
+		if agent.room != nil {
+			*agent.room = agent.room.Sub(job.ResourceRequests())
+		}
+		if agent.free--; agent.free == 0 {
+			delete(available, agent.id)
+		}
+	}
+	return nil
+}
+
+// activeStates are the states of jobs that hold an agent.
+var activeStates = []types.JobState{types.JobStateAssigned, types.JobStateRunning, types.JobStateCancelling}
+
+// usage is what each project takes of the fleet during a pass.
+type usage struct {
+	// active counts the jobs of each project that hold an agent.
+	active map[string]int
+	quotas map[string]*types.ProjectQuota
+	// committed sums the requests of the active jobs of each agent.
+	committed map[string]types.ResourceAmounts
+}
+
+// loadUsage counts the active jobs of each project, sums their requests per
+// agent and loads the projects' quotas.
+func (s *Scheduler) loadUsage(ctx context.Context) (*usage, error) {
+	u := &usage{
+		active:    make(map[string]int),
+		quotas:    make(map[string]*types.ProjectQuota),
+		committed: make(map[string]types.ResourceAmounts),
+	}
+	for _, state := range activeStates {
+		jobs, err := s.jobs.List(ctx, storage.JobFilter{State: state})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s jobs: %w", state, err)
+		}
+		for _, job := range jobs {
+			u.active[job.Repository]++
+			if job.AgentID != "" {
+				u.committed[job.AgentID] = u.committed[job.AgentID].Add(job.ResourceRequests())
+			}
+		}
+	}
+	quotas, err := s.jobs.ProjectQuotas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading project quotas: %w", err)
+	}
+	for _, q := range quotas {
+		u.quotas[q.Project] = q
+	}
+	return u, nil
+}
+
+// full reports whether project has as many jobs active as its quota allows.
+func (u *usage) full(project string) bool {
+	q, ok := u.quotas[project]
+	return ok && q.MaxConcurrentJobs > 0 && u.active[project] >= q.MaxConcurrentJobs
+}
+
+// share returns the active jobs of project per unit of its weight.
+func (u *usage) share(project string) float64 {
+	weight := 1
+	if q, ok := u.quotas[project]; ok && q.Weight > 0 {
+		weight = q.Weight
+	}
+	return float64(u.active[project]) / float64(weight)
+}
+
+// room returns what the agent has left for more jobs: what its machine has,
+// less what its active jobs request, and no more than it last found free.
+// It is nil for agents that do not report their resources.
+func (u *usage) room(agent *types.Agent) *types.ResourceAmounts {
+	if agent.Resources == nil {
+		return nil
+	}
+	room := agent.Resources.Total.Sub(u.committed[agent.ID]).Min(agent.Resources.Available)
+	return &room
+}
+
+// environmentKey identifies the environment of a project.
+type environmentKey struct{ project, name string }
+
+// freeEnvironments returns the IDs of the queued deploy jobs whose
+// environment no other deploy job holds.
+func (s *Scheduler) freeEnvironments(ctx context.Context) map[string]bool {
+	free := make(map[string]bool)
+	for _, job := range s.queue.Jobs() {
+		if job.Environment == "" {
+			continue
+		}
+		locked, err := s.locks.Locked(ctx, job)
+		if err != nil {
+			slog.ErrorContext(ctx, "checking environment lock", "job_id", job.ID, "environment", job.Environment, "error", err)
+			continue
+		}
+		free[job.ID] = !locked
+	}
+	return free
+}
+
+// environmentHeld reports whether job deploys to an environment that is not
+// free to it, or that another job took earlier in the pass. A deploy job
+// missing from free, whose lock could not be checked or which was queued
+// after the locks were looked up, counts as held until the next pass.
+func environmentHeld(free map[string]bool, held map[environmentKey]bool, job *types.Job) bool {
+	if job.Environment == "" {
+		return false
+	}
+	return !free[job.ID] || held[environmentKey{job.Repository, job.Environment}]
+}
+
+// slot is an agent that can take more work.
+type slot struct {
+	id    string
+	agent *types.Agent
+	free  int
+	// room is what the agent has left for the requests of more jobs, or
+	// nil if it does not report its resources.
+	room *types.ResourceAmounts
+}
+
+// availableAgents returns connected agents that accept work and have at
+// least one free slot.
+func (s *Scheduler) availableAgents(ctx context.Context) (map[string]*slot, error) {
+	available := make(map[string]*slot)
+	for id, free := range s.dispatcher.Ready() {
+		if free <= 0 {
+			continue
+		}
+		agent, err := s.registry.Get(ctx, id)
+		if err != nil || agent.State != types.AgentStateOnline {
+			continue
+		}
+		available[id] = &slot{id: id, agent: agent, free: free}
+	}
+	return available, nil
+}
+
+// pickAgent returns the agent to run job on among those matching its labels,
+// serving its organization, running its platform and with room for its
+// requests, or nil. Jobs that request resources are packed: agents that
+// report theirs come first, the one with the least CPU left first, so that
+// larger agents stay free for larger jobs. Otherwise the agent with the most
+// free slots is preferred.
+func pickAgent(available map[string]*slot, job *types.Job) *slot {
+	requests := job.ResourceRequests()
+	pack := requests != types.ResourceAmounts{}
+	var best *slot
+	for _, a := range available {
+		if !a.agent.Serves(job) || !types.MatchLabels(a.agent.Labels, job.Labels) || !a.agent.RunsPlatform(job) {
+			continue
+		}
+		if a.room != nil && !a.room.Covers(requests) {
+			continue
+		}
+		if best == nil || better(a, best, pack) {
+			best = a
+		}
+	}
+	return best
+}
+
+// better reports whether a is preferred over b; see pickAgent.
+func better(a, b *slot, pack bool) bool {
+	if pack {
+		if (a.room != nil) != (b.room != nil) {
+			return a.room != nil
+		}
+		if a.room != nil && a.room.CPUMillis != b.room.CPUMillis {
+			return a.room.CPUMillis < b.room.CPUMillis
+		}
+	}
+	if a.free != b.free {
+		return a.free > b.free
+	}
+	return a.id < b.id
+}
+
+// assign binds job to the agent, records its deployment if it is a deploy
+// job, and pushes it with its variables, secrets and ID tokens added to the
+// environment. If the deployment cannot begin, the push fails, or the
+// variables or secrets cannot be loaded, the job is returned to the queue; a
+// job declaring a secret its project does not have, or asking for ID tokens
+// that cannot be issued for it, fails instead. Both steps are traced in the
+// job's own trace.
+func (s *Scheduler) assign(ctx context.Context, job *types.Job, agentID string) (err error) {
+	ctx, span := tracing.Tracer().Start(tracing.JobContext(ctx, job), "scheduler.assign")
+	span.SetAttributes(tracing.JobAttributes(job)...)
+	span.SetAttributes(attribute.String("agent.id", agentID))
+	defer func() {
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+
+	assigned, err := s.jobs.Assign(ctx, job.ID, agentID)
+	if err != nil {
+		return err
+	}
+	if err := s.locks.Begin(ctx, assigned); err != nil {
+		reason := "recording deployment failed"
+		if errors.Is(err, environments.ErrLocked) {
+			reason = "environment " + job.Environment + " is locked"
+		}
+		if _, rerr := s.jobs.Requeue(ctx, job.ID, reason); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failing to begin deployment", "job_id", job.ID, "error", rerr)
+		}
+		return err
+	}
+	sent, err := s.deliver(ctx, assigned)
+	if err != nil || !sent {
+		return err
+	}
+	slog.InfoContext(ctx, "Assigned job", "job_id", job.ID, "job", job.Name, "agent_id", agentID)
+	return nil
+}
+
+// deliver pushes an assigned job to its agent in the variant of its image
+// for the agent's architecture, with its variables, secrets and ID tokens
+// added to the environment, and reports whether it was sent. A job whose
+// image, variables or secrets cannot be picked or loaded, or that cannot be
+// pushed, is returned to the queue; one that declares a secret its project
+// does not have, or asks for ID tokens that cannot be issued for it, fails.
+func (s *Scheduler) deliver(ctx context.Context, assigned *types.Job) (bool, error) {
+	withImage, err := s.injectImage(ctx, assigned)
+	if err != nil {
+		if _, rerr := s.jobs.Requeue(ctx, assigned.ID, "picking image failed"); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failing to pick its image", "job_id", assigned.ID, "error", rerr)
+		}
+		return false, err
+	}
+	withVariables, err := s.injectVariables(ctx, withImage)
+	if err != nil {
+		if _, rerr := s.jobs.Requeue(ctx, assigned.ID, "loading variables failed"); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failing to load variables", "job_id", assigned.ID, "error", rerr)
+		}
+		return false, err
+	}
+	withSecrets, err := s.injectSecrets(ctx, withVariables)
+	if errors.Is(err, secrets.ErrNotDefined) {
+		update := types.JobStatusRequest{State: types.JobStateFailed, AgentID: assigned.AgentID, Reason: err.Error()}
+		if _, ferr := s.jobs.UpdateStatus(ctx, assigned.ID, update); ferr != nil {
+			slog.ErrorContext(ctx, "failing job with undefined secrets", "job_id", assigned.ID, "error", ferr)
+		}
+		slog.WarnContext(ctx, "Failed job", "job_id", assigned.ID, "job", assigned.Name, "reason", err)
+		return false, nil
+	}
+	if err != nil {
+		if _, rerr := s.jobs.Requeue(ctx, assigned.ID, "loading secrets failed"); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failing to load secrets", "job_id", assigned.ID, "error", rerr)
+		}
+		return false, err
+	}
+	withTokens, err := s.injectIDTokens(withSecrets)
+	if errors.Is(err, oidc.ErrNoProject) || errors.Is(err, errNoIssuer) {
+		update := types.JobStatusRequest{State: types.JobStateFailed, AgentID: assigned.AgentID, Reason: err.Error()}
+		if _, ferr := s.jobs.UpdateStatus(ctx, assigned.ID, update); ferr != nil {
+			slog.ErrorContext(ctx, "failing job without ID tokens", "job_id", assigned.ID, "error", ferr)
+		}
+		slog.WarnContext(ctx, "Failed job", "job_id", assigned.ID, "job", assigned.Name, "reason", err)
+		return false, nil
+	}
+	if err != nil {
+		if _, rerr := s.jobs.Requeue(ctx, assigned.ID, "issuing ID tokens failed"); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failing to issue ID tokens", "job_id", assigned.ID, "error", rerr)
+		}
+		return false, err
+	}
+	if err := s.dispatch(ctx, assigned.AgentID, withTokens); err != nil {
+		if _, rerr := s.jobs.Requeue(ctx, assigned.ID, "dispatch failed: "+err.Error()); rerr != nil {
+			slog.ErrorContext(ctx, "re-queueing job after failed dispatch", "job_id", assigned.ID, "error", rerr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// injectImage returns a copy of job with the variant of its image for the
+// architecture of its agent as its image, if it has variants. Like the
+// environment, the pick only exists in the assignment sent to the agent,
+// so that the job can be assigned again to an agent of another
+// architecture.
+func (s *Scheduler) injectImage(ctx context.Context, job *types.Job) (*types.Job, error) {
+	if len(job.Images) == 0 {
+		return job, nil
+	}
+	agent, err := s.registry.Get(ctx, job.AgentID)
+	if err != nil {
+		return nil, fmt.Errorf("loading agent: %w", err)
+	}
+	image := job.Images[agent.Arch()]
+	if image == "" {
+		return nil, fmt.Errorf("job has no image for %s agents", agent.Arch())
+	}
+	c := job.Clone()
+	c.Image = image
+	return c, nil
+}
+
+// injectVariables returns a copy of job with the variables that apply to it
+// added to the environment. The environment the job's definition sets
+// overrides variables of the same name.
+func (s *Scheduler) injectVariables(ctx context.Context, job *types.Job) (*types.Job, error) {
+	env, err := s.variables.Env(ctx, job.Repository, job.Ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(env) == 0 {
+		return job, nil
+	}
+	c := job.Clone()
+	for name, value := range c.Env {
+		env[name] = value
+	}
+	c.Env = env
+	return c, nil
+}
+
+// injectSecrets returns a copy of job with its declared secrets added to the
+// environment, overriding variables of the same name, and put in place of
+// the secret expressions of its definition. The values exist only in the
+// assignment sent to the agent and are never stored. Restricted jobs get
+// none: their secret expressions resolve to nothing instead.
+func (s *Scheduler) injectSecrets(ctx context.Context, job *types.Job) (*types.Job, error) {
+	if len(job.Secrets) == 0 {
+		return job, nil
+	}
+	if job.Restricted {
+		withheld := make(map[string]string, len(job.Secrets))
+		for _, entry := range job.Secrets {
+			if ref, err := types.ParseSecretRef(entry); err == nil {
+				withheld[ref.Name] = ""
+			}
+		}
+		c := job.Clone()
+		pipeline.ReplaceSecrets(c, withheld)
+		return c, nil
+	}
+	values, err := s.secrets.ResolveJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	c := job.Clone()
+	pipeline.ReplaceSecrets(c, values)
+	if c.Env == nil {
+		c.Env = make(map[string]string, len(values))
+	}
+	for name, value := range values {
+		c.Env[name] = value
+	}
+	return c, nil
+}
+
+// injectIDTokens returns a copy of job with the ID tokens it asks for added
+// to the environment, overriding variables and secrets of the same name.
+// Like secrets, the tokens only exist in the assignment sent to the agent,
+// and restricted jobs get none.
+func (s *Scheduler) injectIDTokens(job *types.Job) (*types.Job, error) {
+	if len(job.IDTokens) == 0 || job.Restricted {
+		return job, nil
+	}
+	if s.idTokens == nil {
+		return nil, errNoIssuer
+	}
+	c := job.Clone()
+	if c.Env == nil {
+		c.Env = make(map[string]string, len(job.IDTokens))
+	}
+	for name, audience := range job.IDTokens {
+		token, err := s.idTokens.Issue(job, audience)
+		if err != nil {
+			return nil, fmt.Errorf("issuing ID token %s: %w", name, err)
+		}
+		c.Env[name] = token
+	}
+	return c, nil
+}
+
+// dispatch pushes an assigned job down the agent's stream in its own span.
+func (s *Scheduler) dispatch(ctx context.Context, agentID string, job *types.Job) error {
+	_, span := tracing.Tracer().Start(ctx, "agent.dispatch")
+	defer span.End()
+	span.SetAttributes(attribute.String("agent.id", agentID), attribute.String("job.id", job.ID))
+	if err := s.dispatcher.Dispatch(agentID, job); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/jobs"
+)
+
+// timeoutInterval is how often running jobs are checked against their
+// deadlines.
+const timeoutInterval = time.Second
+
+// Timeouts times out running jobs once they pass their deadline. The
+// scheduler then asks their agents to stop them.
+type Timeouts struct {
+	jobs *jobs.Manager
+}
+
+// NewTimeouts returns a deadline tracker for the jobs of manager.
+func NewTimeouts(manager *jobs.Manager) *Timeouts {
+	return &Timeouts{jobs: manager}
+}
+
+// Run checks deadlines until ctx is cancelled.
+func (t *Timeouts) Run(ctx context.Context) {
+	ticker := time.NewTicker(timeoutInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := t.jobs.ExpireTimeouts(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "checking job timeouts", "error", err)
+		}
+		for _, job := range expired {
+			slog.WarnContext(ctx, "Job timed out", "job_id", job.ID, "job", job.Name, "agent_id", job.AgentID, "timeout", job.Timeout.Std().String())
+		}
+	}
+}
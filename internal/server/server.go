@@ -0,0 +1,977 @@
+// Package server wires the control plane HTTP API together.
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"open-cicd/internal/agenthttp"
+	"open-cicd/internal/annotations"
+	"open-cicd/internal/artifacts"
+	"open-cicd/internal/audit"
+	"open-cicd/internal/auth"
+	"open-cicd/internal/cache"
+	"open-cicd/internal/checks"
+	"open-cicd/internal/credentials"
+	"open-cicd/internal/dashboard"
+	"open-cicd/internal/environments"
+	"open-cicd/internal/events"
+	"open-cicd/internal/gc"
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/logs"
+	"open-cicd/internal/metrics"
+	"open-cicd/internal/notifications"
+	"open-cicd/internal/oidc"
+	"open-cicd/internal/openapi"
+	"open-cicd/internal/orgs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/projects"
+	"open-cicd/internal/ratelimit"
+	"open-cicd/internal/rbac"
+	"open-cicd/internal/releases"
+	"open-cicd/internal/schedules"
+	"open-cicd/internal/secrets"
+	"open-cicd/internal/server/handlers"
+	"open-cicd/internal/server/middleware"
+	"open-cicd/internal/server/scheduler"
+	"open-cicd/internal/snapshots"
+	"open-cicd/internal/sso"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/templates"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+	"open-cicd/internal/variables"
+	"open-cicd/internal/webhooks"
+)
+
+// Config holds the dependencies the HTTP server is built from.
+type Config struct {
+	Registry *scheduler.Registry
+	Jobs     *jobs.Manager
+	Logs     *logs.Feed
+	// LogIndex holds the indexed lines of finished logs.
+	LogIndex storage.LogIndexStore
+	// Artifacts stores job outputs uploaded by agents.
+	Artifacts *artifacts.Service
+	// ArtifactLinks signs the links artifacts are shared with; nil
+	// disables sharing.
+	ArtifactLinks *artifacts.Signer
+	// BadgeKey derives the tokens of status badge URLs; nil serves no
+	// badges.
+	BadgeKey []byte
+	// Annotations holds the annotations steps publish on their runs.
+	Annotations *annotations.Service
+	// Snapshots holds the workspace snapshots agents take of job outputs.
+	Snapshots *snapshots.Service
+	// Cache holds dependency caches saved by agents.
+	Cache *cache.Service
+	// Secrets holds encrypted project secrets.
+	Secrets *secrets.Service
+	// Credentials holds the encrypted SCM credentials of organizations and
+	// projects.
+	Credentials *credentials.Service
+	// Variables holds the plain environment variables given to jobs.
+	Variables *variables.Service
+	// GC applies the retention policies of projects.
+	GC *gc.Collector
+	// Checks holds the checks projects require of their runs.
+	Checks *checks.Service
+	// Templates holds the templates pipeline definitions include.
+	Templates *templates.Service
+	// Schedules starts pipeline runs on cron schedules.
+	Schedules *schedules.Service
+	// Environments records what deploy jobs deployed where.
+	Environments *environments.Service
+	// Notifications delivers messages about project events.
+	Notifications *notifications.Service
+	Tokens        *auth.Tokens
+	// SSO signs people in through OpenID Connect providers, if any are
+	// configured.
+	SSO *sso.Service
+	// ExternalURL is the base URL the server is reached at.
+	ExternalURL string
+	// AgentTokens holds the registration tokens handed out for registering
+	// agents.
+	AgentTokens *scheduler.AgentTokens
+	Metrics     *metrics.Metrics
+	// Authorizer decides what each token's user may do per project.
+	Authorizer *rbac.Authorizer
+	// Organizations holds the tenants of the server and their projects.
+	Organizations *orgs.Service
+	// Projects onboards repositories, registering their webhooks.
+	Projects *projects.Bootstrapper
+	// GitHubSecrets, GitLabSecrets and BitbucketSecrets authenticate
+	// deliveries to /webhooks/github, /webhooks/gitlab and
+	// /webhooks/bitbucket.
+	GitHubSecrets    webhooks.Secrets
+	GitLabSecrets    webhooks.Secrets
+	BitbucketSecrets webhooks.Secrets
+	// Triggers starts the pipeline runs of webhook deliveries.
+	Triggers *webhooks.Service
+	// Events fans job, pipeline and log changes out to WebSocket clients.
+	Events *events.Bus
+	// TokenLimiter limits the requests of each API token and IPLimiter
+	// those of each source address; nil limiters allow everything.
+	TokenLimiter *ratelimit.Limiter
+	IPLimiter    *ratelimit.Limiter
+	// Audit records every mutating API request.
+	Audit *audit.Log
+	// Release is the agent release served at /agents/download, if any.
+	Release *releases.Release
+	// AgentGateway serves the agent protocol over HTTP under
+	// agenthttp.Prefix, if set.
+	AgentGateway http.Handler
+	// IDTokens issues the OIDC ID tokens of jobs, if the server is
+	// configured to.
+	IDTokens *oidc.Issuer
+	// Backpressure turns submissions away while the queue is saturated.
+	Backpressure *scheduler.Backpressure
+	// Estimator explains where queued jobs stand in GET /jobs/{id}.
+	Estimator *scheduler.Estimator
+	// Scheduler is inspected and steered through /admin.
+	Scheduler *scheduler.Scheduler
+	// Store is checked by the readiness probe.
+	Store storage.HealthStore
+}
+
+// Server is the control plane HTTP handler.
+type Server struct {
+	handler   http.Handler
+	router    *mux.Router
+	metrics   *metrics.Metrics
+	limiter   *ratelimit.Limiter
+	auth      *middleware.Auth
+	audit     *audit.Log
+	health    *handlers.HealthHandler
+	agents    *handlers.AgentHandler
+	releases  *handlers.ReleaseHandler
+	oidc      *handlers.OIDCHandler
+	jobs      *handlers.JobHandler
+	logs      *handlers.LogHandler
+	artifacts *handlers.ArtifactHandler
+	notes     *handlers.AnnotationHandler
+	snapshots *handlers.SnapshotHandler
+	cache     *handlers.CacheHandler
+	secrets   *handlers.SecretHandler
+	scmCreds  *handlers.SCMCredentialHandler
+	variables *handlers.VariableHandler
+	checks    *handlers.CheckHandler
+	quotas    *handlers.QuotaHandler
+	retention *handlers.RetentionHandler
+	pipelines *handlers.PipelineHandler
+	templates *handlers.TemplateHandler
+	schedules *handlers.ScheduleHandler
+	envs      *handlers.EnvironmentHandler
+	notifiers *handlers.NotifierHandler
+	tokens    *handlers.TokenHandler
+	sso       *handlers.SSOHandler
+	agentToks *handlers.AgentTokenHandler
+	rbac      *handlers.RBACHandler
+	orgs      *handlers.OrganizationHandler
+	webhooks  *handlers.WebhookHandler
+	badges    *handlers.BadgeHandler
+	events    *handlers.EventHandler
+	auditLog  *handlers.AuditHandler
+	admin     *handlers.AdminHandler
+	gateway   http.Handler
+	// spec describes every route and validates request bodies.
+	spec *openapi.Spec
+}
+
+// New builds a Server and registers all routes.
+func New(cfg Config) *Server {
+	s := &Server{
+		router:    mux.NewRouter(),
+		metrics:   cfg.Metrics,
+		limiter:   cfg.IPLimiter,
+		auth:      middleware.NewAuth(cfg.Tokens, cfg.TokenLimiter),
+		audit:     cfg.Audit,
+		health:    handlers.NewHealthHandler(cfg.Store, cfg.Jobs, cfg.Backpressure),
+		agents:    handlers.NewAgentHandler(cfg.Registry, cfg.Jobs, cfg.Authorizer),
+		releases:  handlers.NewReleaseHandler(cfg.Release),
+		oidc:      handlers.NewOIDCHandler(cfg.IDTokens),
+		jobs:      handlers.NewJobHandler(cfg.Jobs, cfg.Backpressure, cfg.Estimator, cfg.Variables, cfg.Registry, cfg.Authorizer),
+		logs:      handlers.NewLogHandler(cfg.Jobs, cfg.Logs, cfg.LogIndex, cfg.Authorizer),
+		artifacts: handlers.NewArtifactHandler(cfg.Jobs, cfg.Artifacts, cfg.Registry, cfg.Authorizer, cfg.ArtifactLinks, cfg.ExternalURL),
+		notes:     handlers.NewAnnotationHandler(cfg.Jobs, cfg.Annotations, cfg.Registry, cfg.Authorizer),
+		snapshots: handlers.NewSnapshotHandler(cfg.Jobs, cfg.Snapshots, cfg.Authorizer),
+		cache:     handlers.NewCacheHandler(cfg.Cache, cfg.Jobs, cfg.Registry, cfg.Authorizer),
+		secrets:   handlers.NewSecretHandler(cfg.Secrets, cfg.Authorizer),
+		scmCreds:  handlers.NewSCMCredentialHandler(cfg.Credentials, cfg.Organizations, cfg.Authorizer),
+		variables: handlers.NewVariableHandler(cfg.Variables, cfg.Authorizer),
+		checks:    handlers.NewCheckHandler(cfg.Checks, cfg.Authorizer),
+		quotas:    handlers.NewQuotaHandler(cfg.Jobs, cfg.Authorizer),
+		retention: handlers.NewRetentionHandler(cfg.GC, cfg.Authorizer),
+		pipelines: handlers.NewPipelineHandler(cfg.Jobs, cfg.Backpressure, cfg.Templates, cfg.Annotations, cfg.Authorizer),
+		templates: handlers.NewTemplateHandler(cfg.Templates, cfg.Authorizer),
+		schedules: handlers.NewScheduleHandler(cfg.Schedules, cfg.Authorizer),
+		envs:      handlers.NewEnvironmentHandler(cfg.Environments, cfg.Authorizer),
+		notifiers: handlers.NewNotifierHandler(cfg.Notifications, cfg.Authorizer),
+		tokens:    handlers.NewTokenHandler(cfg.Tokens, cfg.Authorizer),
+		sso:       handlers.NewSSOHandler(cfg.SSO, cfg.Tokens, cfg.ExternalURL, cfg.Authorizer),
+		agentToks: handlers.NewAgentTokenHandler(cfg.AgentTokens, cfg.Authorizer),
+		rbac:      handlers.NewRBACHandler(cfg.Authorizer),
+		orgs:      handlers.NewOrganizationHandler(cfg.Organizations, cfg.Projects, cfg.Authorizer),
+		webhooks:  handlers.NewWebhookHandler(cfg.GitHubSecrets, cfg.GitLabSecrets, cfg.BitbucketSecrets, cfg.Triggers, cfg.Authorizer),
+		badges:    handlers.NewBadgeHandler(cfg.Jobs, cfg.Authorizer, cfg.BadgeKey, cfg.ExternalURL),
+		events:    handlers.NewEventHandler(cfg.Events, cfg.Authorizer),
+		auditLog:  handlers.NewAuditHandler(cfg.Audit, cfg.Authorizer),
+		admin:     handlers.NewAdminHandler(cfg.Scheduler, cfg.Authorizer),
+		gateway:   cfg.AgentGateway,
+		spec:      openapi.NewSpec("Open-CICD", "1.0"),
+	}
+	s.routes()
+	// Unmatched requests answer with the same error bodies as handlers.
+	s.router.NotFoundHandler = http.HandlerFunc(notFound)
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	// Request IDs are assigned outside the router so that unmatched
+	// requests get one too.
+	s.handler = middleware.RequestID(s.router)
+	return s
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	utils.WriteError(w, http.StatusNotFound, fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	utils.WriteError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+}
+
+// routes registers every endpoint and describes it in the API document.
+// API routes require a bearer token with at least the given scope; handlers
+// then check the token user's roles on the project involved. Only the health
+// probes, /metrics, the OIDC discovery documents, the API document, the
+// dashboard page, signing in through SSO and LDAP and status badges are
+// open; agent registration, heartbeats, the agent protocol over HTTP, job
+// status reports, artifact uploads, published annotations and the cache,
+// and SCM webhooks, carry their own credentials instead. Every matched
+// request is traced, recorded in the HTTP metrics and counted against the
+// rate limit of its source address.
+func (s *Server) routes() {
+	read, submit, admin := types.ScopeReadOnly, types.ScopeSubmitJobs, types.ScopeAdmin
+	open := types.Scope("")
+	s.router.Use(middleware.Tracing(), middleware.Metrics(s.metrics), middleware.RateLimit(s.limiter))
+	s.spec.Define(types.Duration(0), &openapi.Schema{
+		Description: "A Go duration such as 1m30s, or a number of seconds.",
+		OneOf:       []*openapi.Schema{{Type: "string"}, {Type: "number"}},
+	})
+	project := openapi.Param{Name: "project", Description: "Only items of this project (owner/repo)."}
+	branch := openapi.Param{Name: "branch", Description: "Only items of this branch."}
+	organization := openapi.Param{Name: "organization", Description: "Only items of this organization."}
+
+	s.handle("GET", "/health", open, s.health.Health, openapi.Operation{
+		Summary: "Report that the server is up and whether its job queue is saturated", Tag: "server",
+		Response: types.HealthResponse{},
+	})
+	s.handle("GET", "/healthz", open, s.health.Live, openapi.Operation{
+		Summary: "Liveness probe: report that the server process is running", Tag: "server",
+		Response: types.LivenessResponse{},
+	})
+	s.handle("GET", "/readyz", open, s.health.Ready, openapi.Operation{
+		Summary: "Readiness probe: check the store, its schema, the queue and shutdown", Tag: "server",
+		Response: types.ReadinessResponse{},
+	})
+	s.handle("GET", "/.well-known/openid-configuration", open, s.oidc.Configuration, openapi.Operation{
+		Summary: "OpenID Provider metadata of the issuer of job ID tokens", Tag: "oidc",
+		Response: types.OIDCConfiguration{},
+	})
+	s.handle("GET", "/.well-known/jwks.json", open, s.oidc.Keys, openapi.Operation{
+		Summary: "Public keys that verify job ID tokens", Tag: "oidc",
+		Response: types.JSONWebKeySet{},
+	})
+	s.handle("GET", "/metrics", open, s.metrics.Handler().ServeHTTP, openapi.Operation{
+		Summary: "Prometheus metrics", Tag: "server", RawResponse: "text/plain",
+	})
+	s.router.HandleFunc("/openapi.json", s.spec.Handler()).Methods("GET")
+	s.router.HandleFunc("/docs", s.spec.DocsHandler("/openapi.json")).Methods("GET")
+
+	// Web dashboard; the page signs in to the API with a token of its own
+	ui := dashboard.Handler()
+	s.router.Handle("/", ui).Methods("GET")
+	s.router.PathPrefix(dashboard.AssetPrefix).Handler(ui).Methods("GET")
+
+	// Signing in through SSO providers and LDAP directories, which issues
+	// session tokens
+	s.handle("GET", "/auth/sso", open, s.sso.List, openapi.Operation{
+		Summary: "List the SSO providers and LDAP directories people can sign in with", Tag: "auth", Response: []types.SSOProvider{},
+	})
+	s.handle("GET", "/auth/sso/{provider}/login", open, s.sso.Login, openapi.Operation{
+		Summary: "Start signing in through an SSO provider", Tag: "auth", Status: http.StatusFound,
+	})
+	s.handle("POST", "/auth/sso/{provider}/login", open, s.sso.PasswordLogin, openapi.Operation{
+		Summary: "Sign in to an LDAP directory with a username and password", Tag: "auth",
+		Request: types.PasswordLoginRequest{}, Response: types.CreateTokenResponse{}, Status: http.StatusCreated,
+	})
+	s.handle("GET", "/auth/sso/{provider}/callback", open, s.sso.Callback, openapi.Operation{
+		Summary: "Finish signing in and return to the dashboard with a session token", Tag: "auth", Status: http.StatusFound,
+	})
+	s.handle("POST", "/auth/logout", read, s.sso.Logout, openapi.Operation{
+		Summary: "Revoke the session token of the request", Tag: "auth", Status: http.StatusNoContent,
+	})
+	s.handle("POST", "/auth/sso/{provider}/test", admin, s.sso.Test, openapi.Operation{
+		Summary: "Check that an SSO provider or LDAP directory can be reached with its configuration", Tag: "auth", Status: http.StatusNoContent,
+	})
+
+	// API tokens
+	s.handle("GET", "/tokens", admin, s.tokens.List, openapi.Operation{
+		Summary: "List API tokens", Tag: "tokens", Response: openapi.List(types.APIToken{}),
+	})
+	s.handle("POST", "/tokens", admin, s.tokens.Create, openapi.Operation{
+		Summary: "Create an API token", Tag: "tokens",
+		Request: types.CreateTokenRequest{}, Status: http.StatusCreated, Response: types.CreateTokenResponse{},
+	})
+	s.handle("DELETE", "/tokens/{id}", admin, s.tokens.Delete, openapi.Operation{
+		Summary: "Revoke an API token", Tag: "tokens", Status: http.StatusNoContent,
+	})
+
+	// Agent registration tokens with an expiry, a use limit and label
+	// restrictions
+	s.handle("GET", "/agent-tokens", admin, s.agentToks.List, openapi.Operation{
+		Summary: "List agent registration tokens", Tag: "tokens", Response: openapi.List(types.AgentToken{}),
+	})
+	s.handle("POST", "/agent-tokens", admin, s.agentToks.Create, openapi.Operation{
+		Summary: "Create an agent registration token", Tag: "tokens",
+		Request: types.CreateAgentTokenRequest{}, Status: http.StatusCreated, Response: types.CreateAgentTokenResponse{},
+	})
+	s.handle("GET", "/agent-tokens/{id}", admin, s.agentToks.Get, openapi.Operation{
+		Summary: "Get an agent registration token with its use count", Tag: "tokens", Response: types.AgentToken{},
+	})
+	s.handle("DELETE", "/agent-tokens/{id}", admin, s.agentToks.Revoke, openapi.Operation{
+		Summary: "Revoke an agent registration token", Tag: "tokens", Response: types.AgentToken{},
+	})
+
+	// Access control
+	s.handle("GET", "/rbac/bindings", admin, s.rbac.ListBindings, openapi.Operation{
+		Summary: "List role bindings", Tag: "rbac", Query: []openapi.Param{project, organization},
+		Response: openapi.List(types.RoleBinding{}),
+	})
+	s.handle("POST", "/rbac/bindings", admin, s.rbac.CreateBinding, openapi.Operation{
+		Summary: "Grant a role on a project", Tag: "rbac",
+		Request: types.CreateRoleBindingRequest{}, Status: http.StatusCreated, Response: types.RoleBinding{},
+	})
+	s.handle("DELETE", "/rbac/bindings/{id}", admin, s.rbac.DeleteBinding, openapi.Operation{
+		Summary: "Remove a role binding", Tag: "rbac", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/rbac/teams", admin, s.rbac.ListTeams, openapi.Operation{
+		Summary: "List teams", Tag: "rbac", Response: openapi.List(types.Team{}),
+	})
+	s.handle("PUT", "/rbac/teams/{name}", admin, s.rbac.PutTeam, openapi.Operation{
+		Summary: "Create a team or replace its members", Tag: "rbac",
+		Request: types.PutTeamRequest{}, Response: types.Team{},
+	})
+	s.handle("DELETE", "/rbac/teams/{name}", admin, s.rbac.DeleteTeam, openapi.Operation{
+		Summary: "Delete a team", Tag: "rbac", Status: http.StatusNoContent,
+	})
+
+	// Organizations and the projects they own
+	s.handle("GET", "/orgs", read, s.orgs.List, openapi.Operation{
+		Summary: "List organizations", Tag: "orgs", Response: openapi.List(types.Organization{}),
+	})
+	s.handle("POST", "/orgs", admin, s.orgs.Create, openapi.Operation{
+		Summary: "Create an organization", Tag: "orgs",
+		Request: types.CreateOrganizationRequest{}, Status: http.StatusCreated, Response: types.CreateOrganizationResponse{},
+	})
+	s.handle("GET", "/orgs/{name}", read, s.orgs.Get, openapi.Operation{
+		Summary: "Get an organization", Tag: "orgs", Response: types.Organization{},
+	})
+	s.handle("DELETE", "/orgs/{name}", admin, s.orgs.Delete, openapi.Operation{
+		Summary: "Delete an organization without projects", Tag: "orgs", Status: http.StatusNoContent,
+	})
+	s.handle("POST", "/orgs/{name}/registration-token", admin, s.orgs.RotateRegistrationToken, openapi.Operation{
+		Summary: "Replace the registration token of an organization's agents", Tag: "orgs",
+		Response: types.CreateOrganizationResponse{},
+	})
+	s.handle("GET", "/orgs/{name}/projects", read, s.orgs.ListProjects, openapi.Operation{
+		Summary: "List the projects of an organization", Tag: "orgs", Response: openapi.List(types.Project{}),
+	})
+	s.handle("POST", "/orgs/{name}/projects", admin, s.orgs.CreateProject, openapi.Operation{
+		Summary: "Add a project to an organization", Tag: "orgs",
+		Request: types.CreateProjectRequest{}, Status: http.StatusCreated, Response: types.Project{},
+	})
+	s.handle("POST", "/projects", admin, s.orgs.BootstrapProject, openapi.Operation{
+		Summary: "Onboard a repository: create its project, register its webhook and check its pipeline file", Tag: "orgs",
+		Request: types.BootstrapProjectRequest{}, Status: http.StatusCreated, Response: projects.Result{},
+	})
+
+	// SCM credentials of organizations and their projects, write-only. A
+	// project's own credential for a provider takes precedence over its
+	// organization's.
+	s.handle("GET", "/orgs/{name}/scm-credentials", read, s.scmCreds.List, openapi.Operation{
+		Summary: "List the SCM credentials of an organization and its projects, without their tokens or keys", Tag: "orgs",
+		Response: openapi.List(types.SCMCredential{}),
+	})
+	s.handle("PUT", "/orgs/{name}/scm-credentials/{provider}", admin, s.scmCreds.PutOrganization, openapi.Operation{
+		Summary: "Set the SCM credential of an organization for a provider", Tag: "orgs",
+		Request: types.PutSCMCredentialRequest{}, Response: types.SCMCredential{},
+	})
+	s.handle("DELETE", "/orgs/{name}/scm-credentials/{provider}", admin, s.scmCreds.DeleteOrganization, openapi.Operation{
+		Summary: "Delete the SCM credential of an organization for a provider", Tag: "orgs", Status: http.StatusNoContent,
+	})
+	s.handle("PUT", "/projects/{project:.+}/scm-credentials/{provider}", admin, s.scmCreds.PutProject, openapi.Operation{
+		Summary: "Set the SCM credential of a project for a provider", Tag: "orgs",
+		Request: types.PutSCMCredentialRequest{}, Response: types.SCMCredential{},
+	})
+	s.handle("DELETE", "/projects/{project:.+}/scm-credentials/{provider}", admin, s.scmCreds.DeleteProject, openapi.Operation{
+		Summary: "Delete the SCM credential of a project for a provider", Tag: "orgs", Status: http.StatusNoContent,
+	})
+
+	// Project secrets, write-only
+	secretProject := openapi.Param{Name: "project", Description: "The project (owner/repo) the secrets belong to. Required."}
+	s.handle("GET", "/secrets", read, s.secrets.List, openapi.Operation{
+		Summary: "List the secrets of a project, without their values", Tag: "secrets",
+		Query: []openapi.Param{secretProject}, Response: openapi.List(types.Secret{}),
+	})
+	s.handle("PUT", "/secrets/{name}", admin, s.secrets.Put, openapi.Operation{
+		Summary: "Set a project secret", Tag: "secrets", Query: []openapi.Param{secretProject},
+		Request: types.PutSecretRequest{}, Response: types.Secret{},
+	})
+	s.handle("DELETE", "/secrets/{name}", admin, s.secrets.Delete, openapi.Operation{
+		Summary: "Delete a project secret", Tag: "secrets", Query: []openapi.Param{secretProject},
+		Status: http.StatusNoContent,
+	})
+
+	// Environment variables, global and per project. Jobs get the global
+	// variables, then the project's, then their own environment, then their
+	// secrets, each overriding the earlier ones of the same name.
+	s.handle("GET", "/variables", read, s.variables.ListGlobal, openapi.Operation{
+		Summary: "List the global variables given to the jobs of every project", Tag: "variables",
+		Response: openapi.List(types.Variable{}),
+	})
+	s.handle("PUT", "/variables/{name}", admin, s.variables.PutGlobal, openapi.Operation{
+		Summary: "Set a global variable", Tag: "variables",
+		Request: types.PutVariableRequest{}, Response: types.Variable{},
+	})
+	s.handle("DELETE", "/variables/{name}", admin, s.variables.DeleteGlobal, openapi.Operation{
+		Summary: "Delete a global variable", Tag: "variables", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/projects/{project:.+}/variables", read, s.variables.List, openapi.Operation{
+		Summary: "List the variables of a project", Tag: "variables",
+		Response: openapi.List(types.Variable{}),
+	})
+	s.handle("GET", "/projects/{project:.+}/variables/resolved", read, s.variables.Resolved, openapi.Operation{
+		Summary: "List the variables jobs of a project get on a ref, lowest precedence first", Tag: "variables",
+		Query:    []openapi.Param{{Name: "ref", Description: "The branch or ref, such as main or refs/tags/v1. Required."}},
+		Response: types.ResolvedVariables{},
+	})
+	s.handle("PUT", "/projects/{project:.+}/variables/{name}", admin, s.variables.Put, openapi.Operation{
+		Summary: "Set a project variable", Tag: "variables",
+		Request: types.PutVariableRequest{}, Response: types.Variable{},
+	})
+	s.handle("DELETE", "/projects/{project:.+}/variables/{name}", admin, s.variables.Delete, openapi.Operation{
+		Summary: "Delete a project variable", Tag: "variables", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/projects/{project:.+}/protected-branches", read, s.variables.ProtectedBranches, openapi.Operation{
+		Summary: "Get the branches protected variables are given to", Tag: "variables",
+		Response: types.ProtectedBranches{},
+	})
+	s.handle("PUT", "/projects/{project:.+}/protected-branches", admin, s.variables.SetProtectedBranches, openapi.Operation{
+		Summary: "Set the branches protected variables are given to", Tag: "variables",
+		Request: types.PutProtectedBranchesRequest{}, Response: types.ProtectedBranches{},
+	})
+
+	// Required checks, reported to the SCM one commit status each for
+	// branch protection rules
+	s.handle("GET", "/projects/{project:.+}/required-checks", read, s.checks.Get, openapi.Operation{
+		Summary: "Get the pipelines and stages a project requires to pass", Tag: "checks",
+		Response: types.RequiredChecks{},
+	})
+	s.handle("PUT", "/projects/{project:.+}/required-checks", admin, s.checks.Put, openapi.Operation{
+		Summary: "Set the pipelines and stages a project requires to pass", Tag: "checks",
+		Request: types.PutRequiredChecksRequest{}, Response: types.RequiredChecks{},
+	})
+
+	// Project quotas, limiting the concurrent and queued jobs of a project
+	// and weighing its share of contended agents
+	s.handle("GET", "/quotas", read, s.quotas.List, openapi.Operation{
+		Summary: "List the quotas set on projects", Tag: "quotas",
+		Response: openapi.List(types.ProjectQuota{}),
+	})
+	s.handle("GET", "/projects/{project:.+}/quota", read, s.quotas.Get, openapi.Operation{
+		Summary: "Get the quota of a project", Tag: "quotas",
+		Response: types.ProjectQuota{},
+	})
+	s.handle("PUT", "/projects/{project:.+}/quota", admin, s.quotas.Put, openapi.Operation{
+		Summary: "Set the quota of a project", Tag: "quotas",
+		Request: types.PutProjectQuotaRequest{}, Response: types.ProjectQuota{},
+	})
+	s.handle("DELETE", "/projects/{project:.+}/quota", admin, s.quotas.Delete, openapi.Operation{
+		Summary: "Return a project to the default quota", Tag: "quotas", Status: http.StatusNoContent,
+	})
+
+	// Retention policies, deciding which runs, artifacts, logs and caches
+	// of a project garbage collection deletes
+	s.handle("GET", "/projects/{project:.+}/retention", read, s.retention.Get, openapi.Operation{
+		Summary: "Get the retention policy of a project", Tag: "retention",
+		Response: types.RetentionPolicy{},
+	})
+	s.handle("PUT", "/projects/{project:.+}/retention", admin, s.retention.Put, openapi.Operation{
+		Summary: "Set the retention policy of a project", Tag: "retention",
+		Request: types.PutRetentionPolicyRequest{}, Response: types.RetentionPolicy{},
+	})
+	s.handle("DELETE", "/projects/{project:.+}/retention", admin, s.retention.Delete, openapi.Operation{
+		Summary: "Remove the retention policy of a project, keeping everything", Tag: "retention", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/projects/{project:.+}/gc", read, s.retention.Preview, openapi.Operation{
+		Summary: "Report what garbage collection of a project would delete now", Tag: "retention",
+		Response: types.GCReport{},
+	})
+	s.handle("POST", "/projects/{project:.+}/gc", admin, s.retention.Collect, openapi.Operation{
+		Summary: "Collect the garbage of a project now", Tag: "retention",
+		Response: types.GCReport{},
+	})
+
+	// Pipeline templates, libraries of steps definitions include by name
+	// and version and extend
+	s.handle("GET", "/templates", read, s.templates.List, openapi.Operation{
+		Summary: "List the published template versions, oldest first", Tag: "templates",
+		Query:    []openapi.Param{{Name: "name", Description: "Only versions of this template."}},
+		Response: openapi.List(types.Template{}),
+	})
+	s.handle("POST", "/templates", admin, s.templates.Publish, openapi.Operation{
+		Summary: "Publish a version of a template", Tag: "templates",
+		Request: types.PublishTemplateRequest{}, Response: types.Template{}, Status: http.StatusCreated,
+	})
+	s.handle("POST", "/templates/resolve", read, s.templates.Resolve, openapi.Operation{
+		Summary: "Expand the templates a pipeline definition includes", Tag: "templates",
+		Request: types.ResolveTemplatesRequest{}, Response: types.ResolveTemplatesResponse{},
+	})
+	s.handle("GET", "/templates/{name}/{version}", read, s.templates.Get, openapi.Operation{
+		Summary: "Get a version of a template, or its latest", Tag: "templates",
+		Response: types.Template{},
+	})
+	s.handle("DELETE", "/templates/{name}/{version}", admin, s.templates.Delete, openapi.Operation{
+		Summary: "Delete a version of a template", Tag: "templates", Status: http.StatusNoContent,
+	})
+
+	// Deployment environments, created by the jobs deploying to them
+	envProject := openapi.Param{Name: "project", Description: "The project (owner/repo) the environments belong to. Required."}
+	s.handle("GET", "/environments", read, s.envs.List, openapi.Operation{
+		Summary: "List the environments of a project and what is deployed to each", Tag: "environments",
+		Query: []openapi.Param{envProject}, Response: openapi.List(types.Environment{}),
+	})
+	s.handle("GET", "/environments/{name}", read, s.envs.Get, openapi.Operation{
+		Summary: "Get an environment with its current and active deployments", Tag: "environments",
+		Query: []openapi.Param{envProject}, Response: types.Environment{},
+	})
+	s.handle("GET", "/environments/{name}/deployments", read, s.envs.Deployments, openapi.Operation{
+		Summary: "List the deployments to an environment", Tag: "environments",
+		Query: []openapi.Param{envProject}, Response: openapi.List(types.Deployment{}),
+	})
+
+	// Project and organization notifiers: Slack, webhook and email
+	// messages on pipeline, job and agent events
+	s.handle("GET", "/notifiers", read, s.notifiers.List, openapi.Operation{
+		Summary: "List the notifiers of a project or organization", Tag: "notifiers",
+		Query: []openapi.Param{
+			{Name: "project", Description: "The project (owner/repo) the notifiers belong to."},
+			{Name: "organization", Description: "The organization the notifiers belong to, instead of a project."},
+		},
+		Response: openapi.List(types.Notifier{}),
+	})
+	s.handle("POST", "/notifiers", admin, s.notifiers.Create, openapi.Operation{
+		Summary: "Create a notifier", Tag: "notifiers",
+		Request: types.CreateNotifierRequest{}, Status: http.StatusCreated, Response: types.Notifier{},
+	})
+	s.handle("GET", "/notifiers/{id}", read, s.notifiers.Get, openapi.Operation{
+		Summary: "Get a notifier with the outcome of its latest delivery", Tag: "notifiers", Response: types.Notifier{},
+	})
+	s.handle("PATCH", "/notifiers/{id}", admin, s.notifiers.Update, openapi.Operation{
+		Summary: "Change a notifier", Tag: "notifiers",
+		Request: types.UpdateNotifierRequest{}, Response: types.Notifier{},
+	})
+	s.handle("DELETE", "/notifiers/{id}", admin, s.notifiers.Delete, openapi.Operation{
+		Summary: "Delete a notifier", Tag: "notifiers", Status: http.StatusNoContent,
+	})
+	s.handle("POST", "/notifiers/{id}/test", admin, s.notifiers.Test, openapi.Operation{
+		Summary: "Deliver a test message through a notifier", Tag: "notifiers", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/notifiers/{id}/deliveries", read, s.notifiers.Deliveries, openapi.Operation{
+		Summary: "List the recent deliveries of a notifier with their attempts", Tag: "notifiers",
+		Response: openapi.List(types.NotifierDelivery{}),
+	})
+	// Notification preferences: the projects and events a user is mailed
+	// about
+	s.handle("GET", "/notifications/preferences", read, s.notifiers.Preferences, openapi.Operation{
+		Summary: "Get the notification preferences of the calling user", Tag: "notifiers", Response: types.NotificationPreferences{},
+	})
+	s.handle("PUT", "/notifications/preferences", submit, s.notifiers.PutPreferences, openapi.Operation{
+		Summary: "Set the notification preferences of the calling user", Tag: "notifiers",
+		Request: types.PutNotificationPreferencesRequest{}, Response: types.NotificationPreferences{},
+	})
+	s.handle("DELETE", "/notifications/preferences", submit, s.notifiers.DeletePreferences, openapi.Operation{
+		Summary: "Delete the notification preferences of the calling user", Tag: "notifiers", Status: http.StatusNoContent,
+	})
+
+	// Agent lifecycle
+	s.handle("POST", "/register", open, s.agents.Register, openapi.Operation{
+		Summary: "Register an agent with a registration token", Tag: "agents",
+		Request: types.RegisterAgentRequest{}, Status: http.StatusCreated, Response: types.RegisterAgentResponse{},
+	})
+	s.handle("GET", "/agents", read, s.agents.List, openapi.Operation{
+		Summary: "List agents", Tag: "agents",
+		Query:    []openapi.Param{organization, {Name: "state", Description: "Only agents in this state."}},
+		Response: openapi.List(types.Agent{}),
+	})
+	s.handle("GET", "/agents/download", open, s.releases.Download, openapi.Operation{
+		Summary: "Download the signed agent binary the server rolls out", Tag: "agents", RawResponse: "application/octet-stream",
+		Query: []openapi.Param{
+			{Name: "platform", Description: "GOOS/GOARCH of the binary, such as linux/amd64."},
+			{Name: "version", Description: "Fail unless the release is this version."},
+		},
+	})
+	s.handle("GET", "/agents/{id}", read, s.agents.Get, openapi.Operation{
+		Summary: "Get an agent", Tag: "agents", Response: types.Agent{},
+	})
+	s.handle("PUT", "/agents/{id}/state", admin, s.agents.UpdateState, openapi.Operation{
+		Summary: "Drain, resume or take an agent offline", Tag: "agents",
+		Request: types.UpdateAgentStateRequest{}, Response: types.Agent{},
+	})
+	s.handle("POST", "/agents/{id}/drain", admin, s.agents.Drain, openapi.Operation{
+		Summary: "Drain an agent for maintenance, letting its current jobs finish", Tag: "agents",
+		Request: types.DrainAgentRequest{}, RequestOptional: true, Response: types.AgentDrainStatus{},
+	})
+	s.handle("GET", "/agents/{id}/drain", read, s.agents.DrainStatus, openapi.Operation{
+		Summary: "Report the jobs a draining agent still holds", Tag: "agents", Response: types.AgentDrainStatus{},
+	})
+	s.handle("POST", "/agents/{id}/resume", admin, s.agents.Resume, openapi.Operation{
+		Summary: "End the drain of an agent", Tag: "agents", Response: types.Agent{},
+	})
+	s.handle("POST", "/agents/{id}/heartbeat", open, s.agents.Heartbeat, openapi.Operation{
+		Summary: "Record an agent heartbeat, with the agent's session credential", Tag: "agents",
+		Response: types.HeartbeatResponse{},
+	})
+	// The agent protocol for agents that cannot reach the gRPC port. Its
+	// calls are framed protobuf messages rather than JSON, so they are not
+	// in the API document.
+	if s.gateway != nil {
+		s.router.PathPrefix(agenthttp.Prefix + "/").Handler(s.gateway).Methods("POST")
+	}
+
+	// Jobs
+	s.handle("GET", "/jobs", read, s.jobs.List, openapi.Operation{
+		Summary: "List jobs", Tag: "jobs",
+		Query: []openapi.Param{
+			project, organization, branch,
+			{Name: "state", Description: "Only jobs in this state."},
+			{Name: "agent", Description: "Only jobs assigned to this agent."},
+		},
+		Response: openapi.List(types.Job{}),
+	})
+	s.handle("POST", "/jobs", submit, s.jobs.Create, openapi.Operation{
+		Summary: "Submit a job", Tag: "jobs",
+		Request: types.CreateJobRequest{}, Status: http.StatusCreated, Response: types.Job{},
+	})
+	s.handle("GET", "/jobs/{id}", read, s.jobs.Get, openapi.Operation{
+		Summary: "Get a job", Tag: "jobs", Response: types.JobDetails{},
+	})
+	s.handle("POST", "/jobs/{id}/status", open, s.jobs.UpdateStatus, openapi.Operation{
+		Summary: "Report a state change of a job as the agent holding its lease, with the agent's session credential", Tag: "jobs",
+		Request: types.JobStatusRequest{}, Response: types.Job{},
+	})
+	s.handle("POST", "/jobs/{id}/cancel", submit, s.jobs.Cancel, openapi.Operation{
+		Summary: "Cancel a job", Tag: "jobs",
+		Request: types.CancelJobRequest{}, RequestOptional: true, Response: types.Job{},
+	})
+	s.handle("POST", "/jobs/{id}/retry", submit, s.jobs.Retry, openapi.Operation{
+		Summary: "Run a failed, timed out or cancelled job again", Tag: "jobs",
+		Status: http.StatusCreated, Response: types.Job{},
+	})
+	s.handle("GET", "/jobs/{id}/reproduce", read, s.jobs.Reproduce, openapi.Operation{
+		Summary: "Get what running a job again outside CI takes, without its secrets", Tag: "jobs",
+		Response: types.ReproduceBundle{},
+	})
+	s.handle("GET", "/jobs/{id}/logs", read, s.logs.Get, openapi.Operation{
+		Summary: "Read or follow a job's log", Tag: "jobs", RawResponse: "text/plain",
+		Query: []openapi.Param{{Name: "follow", Description: "false stops the event stream at the end of the log so far."}},
+	})
+	s.handle("GET", "/search/logs", read, s.logs.Search, openapi.Operation{
+		Summary: "Search the logs of finished jobs", Tag: "jobs",
+		Query: []openapi.Param{
+			{Name: "q", Description: "Words that must appear in a line, \"quoted phrases\" and -excluded words. Required."},
+			project,
+			{Name: "job", Description: "Only lines of this job."},
+		},
+		Response: openapi.List(types.LogLine{}),
+	})
+	s.handle("GET", "/jobs/{id}/artifacts", read, s.artifacts.List, openapi.Operation{
+		Summary: "List a job's artifacts", Tag: "artifacts", Response: openapi.List(types.Artifact{}),
+	})
+	s.handle("GET", "/jobs/{id}/artifacts/{path:.+}", read, s.artifacts.Download, openapi.Operation{
+		Summary: "Download an artifact", Tag: "artifacts", RawResponse: "application/octet-stream",
+	})
+	s.handle("PUT", "/jobs/{id}/artifacts/{path:.+}", open, s.artifacts.Upload, openapi.Operation{
+		Summary: "Upload an artifact, with the agent's session credential", Tag: "artifacts",
+		RawRequest: []string{"application/octet-stream"}, Status: http.StatusCreated, Response: types.Artifact{},
+		Query: []openapi.Param{{Name: "report", Description: "junit or go-test-json parses the file as a test report."}},
+	})
+	s.handle("POST", "/jobs/{id}/artifact-links", submit, s.artifacts.CreateLink, openapi.Operation{
+		Summary: "Sign a link to an artifact that anyone may download until it expires", Tag: "artifacts",
+		Request: types.CreateArtifactLinkRequest{}, Status: http.StatusCreated, Response: types.ArtifactLink{},
+	})
+	s.handle("GET", "/artifacts/signed/{id}/{path:.+}", open, s.artifacts.DownloadSigned, openapi.Operation{
+		Summary: "Download an artifact with a signed link", Tag: "artifacts", RawResponse: "application/octet-stream",
+		Query: []openapi.Param{
+			{Name: "expires", Description: "The expiry of the link, in Unix seconds. Required."},
+			{Name: "signature", Description: "The signature of the link. Required."},
+		},
+	})
+	s.handle("GET", "/jobs/{id}/annotations", read, s.notes.List, openapi.Operation{
+		Summary: "List the annotations a job's steps published", Tag: "jobs", Response: []types.Annotation{},
+	})
+	s.handle("POST", "/jobs/{id}/annotations", open, s.notes.Create, openapi.Operation{
+		Summary: "Publish annotations on a job, with the agent's session credential", Tag: "jobs",
+		Request: types.CreateAnnotationsRequest{}, Status: http.StatusCreated, Response: []types.Annotation{},
+	})
+	s.handle("GET", "/jobs/{id}/snapshot", read, s.snapshots.Get, openapi.Operation{
+		Summary: "Get the workspace snapshot of a job's outputs", Tag: "artifacts", Response: types.WorkspaceSnapshot{},
+	})
+	s.handle("GET", "/jobs/{id}/snapshot/download", read, s.snapshots.Download, openapi.Operation{
+		Summary: "Download the workspace snapshot of a job's outputs", Tag: "artifacts", RawResponse: "application/gzip",
+	})
+	s.handle("GET", "/jobs/{id}/tests", read, s.artifacts.Tests, openapi.Operation{
+		Summary: "Get the results of a job's test reports", Tag: "artifacts", Response: types.JobTests{},
+		Query: []openapi.Param{{Name: "failed", Description: "true lists only the failed test cases."}},
+	})
+
+	// Dependency cache, used by agents
+	// Registered ahead of /cache/{key}, which would match it too.
+	s.handle("GET", "/cache/stats", read, s.cache.Stats, openapi.Operation{
+		Summary: "Get the cache hit and miss counts of a project, per key", Tag: "cache",
+		Query: []openapi.Param{
+			{Name: "project", Description: "The project (owner/repo). Required."},
+			{Name: "key", Description: "Only the counts of this key."},
+		},
+		Response: types.CacheStatsReport{},
+	})
+	s.handle("GET", "/cache/{key}", open, s.cache.Restore, openapi.Operation{
+		Summary: "Restore a dependency cache, with the agent's session credential", Tag: "cache",
+		RawResponse: "application/octet-stream",
+	})
+	s.handle("PUT", "/cache/{key}", open, s.cache.Save, openapi.Operation{
+		Summary: "Save a dependency cache, with the agent's session credential", Tag: "cache",
+		RawRequest: []string{"application/octet-stream"}, Status: http.StatusCreated, Response: types.CacheEntry{},
+	})
+
+	// Pipelines
+	s.handle("GET", "/pipelines", read, s.pipelines.List, openapi.Operation{
+		Summary: "List pipeline runs", Tag: "pipelines",
+		Query: []openapi.Param{
+			project, organization, branch,
+			{Name: "state", Description: "Only runs in this state."},
+			{Name: "name", Description: "Only runs of the pipeline of this name."},
+		},
+		Response: openapi.List(types.Pipeline{}),
+	})
+	s.handle("POST", "/pipelines", submit, s.pipelines.Create, openapi.Operation{
+		Summary: "Run a pipeline definition", Tag: "pipelines",
+		Query: []openapi.Param{
+			{Name: "repository", Description: "The repository of a YAML definition."},
+			{Name: "ref", Description: "The ref of a YAML definition."},
+		},
+		Request: types.CreatePipelineRequest{}, RawRequest: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		Status: http.StatusCreated, Response: types.Pipeline{},
+	})
+	s.handle("POST", "/pipelines/dry-run", read, s.pipelines.DryRun, openapi.Operation{
+		Summary: "Show which stages and steps of a definition would run for a trigger", Tag: "pipelines",
+		Request: types.DryRunPipelineRequest{}, Response: types.PipelinePlan{},
+	})
+	s.handle("POST", "/pipelines/preview", read, s.pipelines.Preview, openapi.Operation{
+		Summary: "Show a definition with its templates expanded and its expressions resolved for a trigger", Tag: "pipelines",
+		Request: types.DryRunPipelineRequest{}, Response: pipeline.Definition{},
+	})
+	s.handle("POST", "/pipelines/validate", read, s.pipelines.Validate, openapi.Operation{
+		Summary: "Check a definition for errors and likely mistakes without running it", Tag: "pipelines",
+		Request: types.ValidatePipelineRequest{}, RawRequest: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		Response: types.PipelineValidation{},
+	})
+	// Registered ahead of /pipelines/{id}, which would match it too.
+	s.handle("GET", "/pipelines/compare", read, s.pipelines.Compare, openapi.Operation{
+		Summary: "Compare two pipeline runs: jobs added and removed, job duration changes and differing variables", Tag: "pipelines",
+		Query: []openapi.Param{
+			{Name: "base", Description: "The ID of the run to compare against. Required."},
+			{Name: "head", Description: "The ID of the run to compare. Required."},
+		},
+		Response: types.PipelineComparison{},
+	})
+	s.handle("GET", "/pipelines/{id}", read, s.pipelines.Get, openapi.Operation{
+		Summary: "Get a pipeline run and the annotations of its jobs", Tag: "pipelines", Response: types.PipelineDetail{},
+	})
+	s.handle("GET", "/pipelines/{id}/graph", read, s.pipelines.Graph, openapi.Operation{
+		Summary: "Get the stage graph of a pipeline run", Tag: "pipelines", Response: types.PipelineGraph{},
+	})
+	s.handle("GET", "/pipelines/{id}/timeline", read, s.pipelines.Timeline, openapi.Operation{
+		Summary: "Get when a pipeline run and its stages and jobs waited, started and finished", Tag: "pipelines",
+		Response: types.PipelineTimeline{},
+	})
+	s.handle("POST", "/pipelines/{id}/rerun", submit, s.pipelines.Rerun, openapi.Operation{
+		Summary: "Re-run a finished pipeline run, or only its failed stages", Tag: "pipelines",
+		Request: types.RerunPipelineRequest{}, RequestOptional: true, Status: http.StatusCreated, Response: types.Pipeline{},
+	})
+	s.handle("POST", "/pipelines/{name}/runs", submit, s.pipelines.Start, openapi.Operation{
+		Summary: "Start a manual run of a pipeline with inputs, from the definition of its latest run", Tag: "pipelines",
+		Request: types.StartPipelineRequest{}, Status: http.StatusCreated, Response: types.Pipeline{},
+	})
+	s.handle("POST", "/pipelines/{id}/authorize", submit, s.pipelines.Authorize, openapi.Operation{
+		Summary: "Let a pipeline of a pull request from a fork run", Tag: "pipelines",
+		Request: types.AuthorizePipelineRequest{}, RequestOptional: true, Response: types.Pipeline{},
+	})
+	s.handle("POST", "/pipelines/{id}/stages/{stage}/approve", submit, s.pipelines.Approve, openapi.Operation{
+		Summary: "Approve a manual stage awaiting approval", Tag: "pipelines",
+		Request: types.StageDecisionRequest{}, RequestOptional: true, Response: types.Pipeline{},
+	})
+	s.handle("POST", "/pipelines/{id}/stages/{stage}/reject", submit, s.pipelines.Reject, openapi.Operation{
+		Summary: "Reject a manual stage awaiting approval", Tag: "pipelines",
+		Request: types.StageDecisionRequest{}, RequestOptional: true, Response: types.Pipeline{},
+	})
+	s.handle("GET", "/analytics", read, s.pipelines.Analytics, openapi.Operation{
+		Summary: "Get the p50 and p95 durations of finished pipeline runs, overall and per interval", Tag: "pipelines",
+		Query: []openapi.Param{
+			project, organization, branch,
+			{Name: "name", Description: "Only runs of the pipeline with this name."},
+			{Name: "since", Description: "Only runs created at or after this RFC 3339 time; by default 30 days before until."},
+			{Name: "until", Description: "Only runs created before this RFC 3339 time; by default now."},
+			{Name: "interval", Description: "The width of the buckets: hour, day (the default) or week."},
+		},
+		Response: types.PipelineAnalytics{},
+	})
+
+	// Cron schedules
+	s.handle("GET", "/schedules", read, s.schedules.List, openapi.Operation{
+		Summary: "List schedules", Tag: "schedules", Query: []openapi.Param{project, branch},
+		Response: openapi.List(types.Schedule{}),
+	})
+	s.handle("POST", "/schedules", submit, s.schedules.Create, openapi.Operation{
+		Summary: "Create a schedule", Tag: "schedules",
+		Request: types.CreateScheduleRequest{}, Status: http.StatusCreated, Response: types.Schedule{},
+	})
+	s.handle("GET", "/schedules/{id}", read, s.schedules.Get, openapi.Operation{
+		Summary: "Get a schedule", Tag: "schedules", Response: types.Schedule{},
+	})
+	s.handle("PATCH", "/schedules/{id}", submit, s.schedules.Update, openapi.Operation{
+		Summary: "Change a schedule", Tag: "schedules",
+		Request: types.UpdateScheduleRequest{}, Response: types.Schedule{},
+	})
+	s.handle("DELETE", "/schedules/{id}", submit, s.schedules.Delete, openapi.Operation{
+		Summary: "Delete a schedule", Tag: "schedules", Status: http.StatusNoContent,
+	})
+	s.handle("POST", "/schedules/{id}/enable", submit, s.schedules.Enable, openapi.Operation{
+		Summary: "Enable a schedule", Tag: "schedules", Response: types.Schedule{},
+	})
+	s.handle("POST", "/schedules/{id}/disable", submit, s.schedules.Disable, openapi.Operation{
+		Summary: "Disable a schedule", Tag: "schedules", Response: types.Schedule{},
+	})
+
+	// SCM webhooks, authenticated by their signature or token, and the
+	// record of their deliveries
+	s.handle("POST", "/webhooks/github", open, s.webhooks.GitHub, openapi.Operation{
+		Summary: "Receive a GitHub webhook delivery", Tag: "webhooks", RawRequest: []string{"application/json"},
+	})
+	s.handle("POST", "/webhooks/gitlab", open, s.webhooks.GitLab, openapi.Operation{
+		Summary: "Receive a GitLab webhook delivery", Tag: "webhooks", RawRequest: []string{"application/json"},
+	})
+	s.handle("POST", "/webhooks/bitbucket", open, s.webhooks.Bitbucket, openapi.Operation{
+		Summary: "Receive a Bitbucket Server webhook delivery", Tag: "webhooks", RawRequest: []string{"application/json"},
+	})
+	s.handle("GET", "/webhooks/deliveries", read, s.webhooks.ListDeliveries, openapi.Operation{
+		Summary: "List recorded webhook deliveries", Tag: "webhooks",
+		Query: []openapi.Param{
+			project,
+			{Name: "provider", Description: "Only deliveries from this provider: github, gitlab or bitbucket."},
+			{Name: "event", Description: "Only deliveries of this event, as named by the provider."},
+			{Name: "status", Description: "Only deliveries whose latest attempt had this outcome: triggered, ignored, rejected or failed."},
+		},
+		Response: openapi.List(types.WebhookDelivery{}),
+	})
+	s.handle("GET", "/webhooks/deliveries/{id}", read, s.webhooks.GetDelivery, openapi.Operation{
+		Summary: "Get a recorded webhook delivery with its payload", Tag: "webhooks", Response: types.WebhookDelivery{},
+	})
+	s.handle("POST", "/webhooks/deliveries/{id}/redeliver", submit, s.webhooks.Redeliver, openapi.Operation{
+		Summary: "Process a recorded webhook delivery again", Tag: "webhooks", Response: types.WebhookDelivery{},
+	})
+
+	// Status badges
+	s.handle("GET", "/projects/{project:.+}/badge", read, s.badges.URL, openapi.Operation{
+		Summary: "Get the URL of a branch's status badge, with the project's badge token", Tag: "badges",
+		Query:    []openapi.Param{{Name: "branch", Description: "The branch the badge shows. Required."}},
+		Response: types.ProjectBadge{},
+	})
+	s.handle("GET", "/badges/{project:.+}/{branch}.svg", open, s.badges.Get, openapi.Operation{
+		Summary: "Render the build status of a branch as an SVG badge", Tag: "badges", RawResponse: "image/svg+xml",
+		Query: []openapi.Param{{Name: "token", Description: "The project's badge token. Required."}},
+	})
+
+	// Real-time events
+	s.handle("GET", "/ws", read, s.events.Stream, openapi.Operation{
+		Summary: "Stream job, pipeline and log events over a WebSocket", Tag: "events",
+		Query: []openapi.Param{
+			{Name: "topics", Description: "Comma-separated event types or prefixes such as job.*; all events if unset."},
+			project,
+			{Name: "job", Description: "Only events of this job."},
+			{Name: "pipeline", Description: "Only events of this pipeline run and its jobs."},
+			{Name: "access_token", Description: "API token, for clients that cannot set the Authorization header."},
+		},
+		Status: http.StatusSwitchingProtocols,
+	})
+
+	// Audit log
+	s.handle("GET", "/audit", admin, s.auditLog.List, openapi.Operation{
+		Summary: "List audit events of mutating API requests", Tag: "audit",
+		Query: []openapi.Param{
+			{Name: "actor", Description: "Only requests of this user or token name."},
+			{Name: "resource", Description: "Only requests on this path or the paths beneath it, such as /jobs/{id}."},
+			{Name: "since", Description: "Only requests at or after this RFC 3339 time."},
+			{Name: "until", Description: "Only requests before this RFC 3339 time."},
+		},
+		Response: openapi.List(types.AuditEvent{}),
+	})
+
+	// Administration of the scheduler and the server during incidents.
+	s.handle("GET", "/admin/scheduler", admin, s.admin.Scheduler, openapi.Operation{
+		Summary: "Report the job queue, whether scheduling is paused and the jobs each agent holds", Tag: "admin",
+		Response: types.SchedulerStatus{},
+	})
+	s.handle("POST", "/admin/scheduler/pause", admin, s.admin.Pause, openapi.Operation{
+		Summary: "Pause scheduling of queued jobs on every replica", Tag: "admin",
+		Request: types.PauseSchedulingRequest{}, RequestOptional: true, Response: types.SchedulerPause{},
+	})
+	s.handle("POST", "/admin/scheduler/resume", admin, s.admin.Resume, openapi.Operation{
+		Summary: "Resume scheduling of queued jobs", Tag: "admin", Status: http.StatusNoContent,
+	})
+	s.handle("GET", "/admin/log-level", admin, s.admin.LogLevel, openapi.Operation{
+		Summary: "Get the minimum level this replica logs", Tag: "admin", Response: types.LogLevel{},
+	})
+	s.handle("PUT", "/admin/log-level", admin, s.admin.SetLogLevel, openapi.Operation{
+		Summary: "Change the minimum level this replica logs until the configuration is reloaded", Tag: "admin",
+		Request: types.LogLevel{}, Response: types.LogLevel{},
+	})
+	s.handle("POST", "/admin/agents/reconcile", admin, s.admin.ReconcileAgents, openapi.Operation{
+		Summary: "Bring the recorded state of agents and their jobs in line with the connected agents", Tag: "admin",
+		Response: types.ReconcileReport{},
+	})
+}
+
+// handle registers h for method at path and describes the route in the API
+// document. Routes with a scope require a token with it; JSON request bodies
+// are validated against the document once the caller is authenticated.
+// Requests with a token that change something are recorded in the audit
+// log, whether they succeed or not.
+func (s *Server) handle(method, path string, scope types.Scope, h http.HandlerFunc, op openapi.Operation) {
+	op.Scope = string(scope)
+	s.spec.Add(method, path, op)
+	h = s.spec.Validate(method, path, h)
+	if scope != "" {
+		if method != http.MethodGet && method != http.MethodHead {
+			h = middleware.Audit(s.audit, h)
+		}
+		h = s.auth.Require(scope, h)
+	}
+	s.router.HandleFunc(path, h).Methods(method)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,166 @@
+// Package snapshots stores the workspace snapshots agents take of the
+// outputs of jobs, so that the jobs of downstream stages can restore them on
+// other agents instead of building them again. Records are kept in the
+// control plane store and archives in a blob store.
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/blobs"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// reapInterval is how often expired snapshots are deleted.
+const reapInterval = time.Hour
+
+// reapBatch is how many expired snapshots are deleted per store query.
+const reapBatch = 100
+
+// Service saves, serves and expires workspace snapshots.
+type Service struct {
+	store     storage.SnapshotStore
+	blobs     blobs.Store
+	retention func(project string) (time.Duration, bool)
+	now       func() time.Time
+}
+
+// NewService returns a Service that records snapshots in store, keeps their
+// archives in blobStore and expires them after the retention of their
+// project, if retention gives one.
+func NewService(store storage.SnapshotStore, blobStore blobs.Store, retention func(project string) (time.Duration, bool)) *Service {
+	return &Service{store: store, blobs: blobStore, retention: retention, now: time.Now}
+}
+
+func blobKey(jobID string) string {
+	return jobID + ".tar.gz"
+}
+
+// Save stores the archive read from r as the snapshot of job's outputs,
+// replacing any earlier one.
+func (s *Service) Save(ctx context.Context, job *types.Job, r io.Reader) (*types.WorkspaceSnapshot, error) {
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, hash)}
+	key := blobKey(job.ID)
+	if err := s.blobs.Put(ctx, key, counter); err != nil {
+		return nil, fmt.Errorf("storing snapshot contents: %w", err)
+	}
+
+	now := s.now()
+	snapshot := &types.WorkspaceSnapshot{
+		JobID:      job.ID,
+		Project:    job.Repository,
+		PipelineID: job.PipelineID,
+		Stage:      job.Stage,
+		Paths:      append([]string(nil), job.Outputs...),
+		Size:       counter.n,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt:  now,
+	}
+	if keep, ok := s.retention(job.Repository); ok {
+		expires := now.Add(keep)
+		snapshot.ExpiresAt = &expires
+	}
+	if err := s.store.PutSnapshot(ctx, snapshot); err != nil {
+		if derr := s.blobs.Delete(ctx, key); derr != nil {
+			slog.ErrorContext(ctx, "removing contents of unrecorded snapshot", "job_id", job.ID, "error", derr)
+		}
+		return nil, fmt.Errorf("recording snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// Get returns the snapshot of a job.
+func (s *Service) Get(ctx context.Context, jobID string) (*types.WorkspaceSnapshot, error) {
+	return s.store.GetSnapshot(ctx, jobID)
+}
+
+// Open returns the snapshot of a job and its archive. The caller closes the
+// reader.
+func (s *Service) Open(ctx context.Context, jobID string) (*types.WorkspaceSnapshot, io.ReadSeekCloser, error) {
+	snapshot, err := s.store.GetSnapshot(ctx, jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := s.blobs.Open(ctx, blobKey(jobID))
+	if errors.Is(err, blobs.ErrNotFound) {
+		return nil, nil, fmt.Errorf("contents of snapshot of job %s are missing: %w", jobID, storage.ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, contents, nil
+}
+
+// Run deletes expired snapshots on start and then every reapInterval until
+// ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		n, err := s.reap(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "deleting expired workspace snapshots", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Deleted expired workspace snapshots", "snapshots", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap deletes every snapshot that has expired.
+func (s *Service) reap(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		expired, err := s.store.ListExpiredSnapshots(ctx, s.now(), reapBatch)
+		if err != nil {
+			return deleted, err
+		}
+		for _, snapshot := range expired {
+			if err := s.Delete(ctx, snapshot.JobID); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(expired) < reapBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// Delete deletes the snapshot of a job, contents first so that a failure
+// leaves the record to retry.
+func (s *Service) Delete(ctx context.Context, jobID string) error {
+	if err := s.blobs.Delete(ctx, blobKey(jobID)); err != nil {
+		return fmt.Errorf("deleting contents of snapshot of job %s: %w", jobID, err)
+	}
+	if err := s.store.DeleteSnapshot(ctx, jobID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("deleting snapshot of job %s: %w", jobID, err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,198 @@
+package sso
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"open-cicd/internal/ldap"
+	"open-cicd/internal/types"
+)
+
+// ldapTimeout bounds connecting to a directory and each operation on it.
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig configures one LDAP directory; see config.LDAPProvider.
+type LDAPConfig struct {
+	Name               string
+	DisplayName        string
+	URL                string
+	StartTLS           bool
+	CAFile             string
+	BindDN             string
+	BindPassword       string
+	UserBaseDN         string
+	UserFilter         string
+	UsernameAttribute  string
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string
+	AllowedGroups      []string
+}
+
+// errBadCredentials is the reason given for every sign-in refused before
+// the password was checked, so that it does not tell which users exist.
+var errBadCredentials = fmt.Errorf("%w: invalid username or password", ErrLoginFailed)
+
+// ldapProvider is a configured LDAP directory. Each sign-in connects anew:
+// it binds as the service account, finds the user and their groups, then
+// checks the password by binding as the user.
+type ldapProvider struct {
+	cfg LDAPConfig
+	tls *tls.Config
+}
+
+func newLDAPProvider(cfg LDAPConfig) (*ldapProvider, error) {
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = cfg.Name
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={username})"
+	}
+	if cfg.GroupFilter == "" {
+		cfg.GroupFilter = "(member={dn})"
+	}
+	if cfg.GroupNameAttribute == "" {
+		cfg.GroupNameAttribute = "cn"
+	}
+	p := &ldapProvider{cfg: cfg}
+	for _, filter := range []string{cfg.UserFilter, cfg.GroupFilter} {
+		if err := ldap.ValidateFilter(p.filter(filter, "user", "cn=user")); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	p.tls = tlsConfig
+	return p, nil
+}
+
+// Info describes the directory for the sign-in page.
+func (p *ldapProvider) Info() types.SSOProvider {
+	return types.SSOProvider{Name: p.cfg.Name, DisplayName: p.cfg.DisplayName, Kind: types.SSOKindLDAP, LoginURL: LoginPath(p.cfg.Name)}
+}
+
+// Test connects and binds as the service account, then checks that the
+// user and group base DNs can be searched.
+func (p *ldapProvider) Test(ctx context.Context) error {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	bases := []string{p.cfg.UserBaseDN}
+	if p.cfg.GroupBaseDN != "" {
+		bases = append(bases, p.cfg.GroupBaseDN)
+	}
+	for _, base := range bases {
+		entries, err := conn.Search(ldap.SearchRequest{BaseDN: base, Filter: "(objectClass=*)", Attributes: []string{"1.1"}, SizeLimit: 1})
+		if err != nil {
+			return fmt.Errorf("searching %s: %w", base, err)
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("searching %s found no entries", base)
+		}
+	}
+	return nil
+}
+
+// authenticate checks username's password and returns the user and the
+// names of their groups.
+func (p *ldapProvider) authenticate(ctx context.Context, username, password string) (string, []string, error) {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	attrs := []string{"1.1"} // no attributes
+	if p.cfg.UsernameAttribute != "" {
+		attrs = []string{p.cfg.UsernameAttribute}
+	}
+	users, err := conn.Search(ldap.SearchRequest{BaseDN: p.cfg.UserBaseDN, Filter: p.filter(p.cfg.UserFilter, username, ""), Attributes: attrs, SizeLimit: 2})
+	if err != nil {
+		return "", nil, fmt.Errorf("searching for user: %w", err)
+	}
+	switch len(users) {
+	case 0:
+		return "", nil, errBadCredentials
+	case 1:
+	default:
+		slog.WarnContext(ctx, "Username matches several directory entries", "provider", p.cfg.Name, "username", username)
+		return "", nil, errBadCredentials
+	}
+	entry := users[0]
+	user := username
+	if p.cfg.UsernameAttribute != "" {
+		if user = entry.Get(p.cfg.UsernameAttribute); user == "" {
+			return "", nil, fmt.Errorf("entry %s has no %s attribute", entry.DN, p.cfg.UsernameAttribute)
+		}
+	}
+
+	// Groups are searched for as the service account, which users may not
+	// be allowed to do.
+	var groups []string
+	if p.cfg.GroupBaseDN != "" {
+		entries, err := conn.Search(ldap.SearchRequest{
+			BaseDN:     p.cfg.GroupBaseDN,
+			Filter:     p.filter(p.cfg.GroupFilter, username, entry.DN),
+			Attributes: []string{p.cfg.GroupNameAttribute},
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("searching for groups: %w", err)
+		}
+		for _, g := range entries {
+			if name := g.Get(p.cfg.GroupNameAttribute); name != "" {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	if err := conn.Bind(entry.DN, password); errors.Is(err, ldap.ErrInvalidCredentials) {
+		return "", nil, errBadCredentials
+	} else if err != nil {
+		return "", nil, fmt.Errorf("binding as user: %w", err)
+	}
+	if !allowed(groups, p.cfg.AllowedGroups) {
+		return "", nil, fmt.Errorf("%w: %s is in none of the groups allowed to sign in", ErrLoginFailed, user)
+	}
+	return user, groups, nil
+}
+
+// connect dials the directory and binds as the service account, if one is
+// configured; searches are anonymous otherwise.
+func (p *ldapProvider) connect(ctx context.Context) (*ldap.Conn, error) {
+	conn, err := ldap.Dial(ctx, p.cfg.URL, p.cfg.StartTLS, p.tls, ldapTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", p.cfg.URL, err)
+	}
+	if p.cfg.BindDN != "" {
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("binding as %s: %w", p.cfg.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// filter fills in the {username} and {dn} placeholders of a configured
+// search filter, escaped so that they cannot change the filter.
+func (p *ldapProvider) filter(filter, username, dn string) string {
+	return strings.NewReplacer("{username}", ldap.EscapeFilter(username), "{dn}", ldap.EscapeFilter(dn)).Replace(filter)
+}
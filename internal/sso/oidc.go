@@ -0,0 +1,339 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+const (
+	// maxDocumentBytes bounds the discovery documents, key sets and token
+	// responses read from providers.
+	maxDocumentBytes = 1 << 20
+	// keysRefresh is how long fetched signing keys are used before they
+	// are fetched again, and keysRetry how soon an unknown key ID may
+	// fetch them again, for providers that rotate keys.
+	keysRefresh = time.Hour
+	keysRetry   = time.Minute
+	// clockSkew is how far the clocks of the server and a provider may
+	// differ when checking the times in ID tokens.
+	clockSkew = time.Minute
+)
+
+// metadata is the part of a provider's discovery document the server uses.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is a configured OpenID Connect provider. Its discovery
+// document is fetched on first use and its signing keys whenever they are
+// needed and stale.
+type oidcProvider struct {
+	cfg         ProviderConfig
+	redirectURL string
+	client      *http.Client
+
+	mu      sync.Mutex
+	meta    *metadata
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// Info describes the provider for the sign-in page.
+func (p *oidcProvider) Info() types.SSOProvider {
+	return types.SSOProvider{Name: p.cfg.Name, DisplayName: p.cfg.DisplayName, Kind: types.SSOKindOIDC, LoginURL: LoginPath(p.cfg.Name)}
+}
+
+// Test fetches the provider's discovery document and signing keys, which
+// signing in needs. The client credentials are only checked by signing in.
+func (p *oidcProvider) Test(ctx context.Context) error {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := p.fetchKeys(ctx, meta)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("the provider publishes no RSA signing keys")
+	}
+	return nil
+}
+
+// discover returns the provider's metadata, fetching it the first time.
+func (p *oidcProvider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta metadata
+	if err := p.get(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("fetching discovery document: %w", err)
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery document names issuer %q instead of %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an authorization, token or JWKS endpoint")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// authURL returns the URL that starts signing in at the provider.
+func (p *oidcProvider) authURL(meta *metadata, state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// exchange redeems an authorization code for the ID token of the user who
+// signed in.
+func (p *oidcProvider) exchange(ctx context.Context, meta *metadata, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentBytes)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint answered %s: %w", resp.Status, err)
+	}
+	switch {
+	case body.Error != "":
+		return "", fmt.Errorf("token endpoint refused the code: %s %s", body.Error, body.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("token endpoint answered %s", resp.Status)
+	case body.IDToken == "":
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// verify checks the signature, issuer, audience, lifetime and nonce of an
+// ID token and returns its claims.
+func (p *oidcProvider) verify(ctx context.Context, meta *metadata, idToken, nonce string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token is not a JWS")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decoding ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token is signed with %q, only RS256 is supported", header.Alg)
+	}
+	key, err := p.key(ctx, meta, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("ID token signature is not base64url")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("ID token signature does not verify")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("ID token was issued by %q, not %q", iss, meta.Issuer)
+	}
+	if !audienceIncludes(claims["aud"], p.cfg.ClientID) {
+		return nil, errors.New("ID token is not meant for this server")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token was issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("ID token nonce does not match the sign-in")
+	}
+	return claims, nil
+}
+
+// key returns the signing key with ID kid, fetching the key set if it is
+// stale or, at most every keysRetry, if it lacks the key.
+func (p *oidcProvider) key(ctx context.Context, meta *metadata, kid string, now time.Time) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.lookup(kid)
+	stale := now.Sub(p.fetched) > keysRefresh
+	if ok && !stale {
+		return key, nil
+	}
+	if !ok && !stale && now.Sub(p.fetched) < keysRetry {
+		return nil, fmt.Errorf("ID token is signed with unknown key %q", kid)
+	}
+	keys, err := p.fetchKeys(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.fetched = keys, now
+	if key, ok = p.lookup(kid); !ok {
+		return nil, fmt.Errorf("ID token is signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys fetches the provider's RSA signing keys by key ID.
+func (p *oidcProvider) fetchKeys(ctx context.Context, meta *metadata) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.get(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// lookup returns the fetched key with ID kid. Tokens without a key ID may
+// only be signed with the provider's only key. Callers must hold p.mu.
+func (p *oidcProvider) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// get fetches the JSON document at rawURL into v.
+func (p *oidcProvider) get(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDocumentBytes)).Decode(v)
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWS into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceIncludes reports whether the aud claim, a string or a list of
+// them, names clientID.
+func audienceIncludes(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		return slices.Contains(aud, any(clientID))
+	}
+	return false
+}
+
+// stringClaims returns a claim that is a string or a list of strings as a
+// list.
+func stringClaims(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []any:
+		var list []string
+		for _, v := range claim {
+			if s, ok := v.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
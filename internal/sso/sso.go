@@ -0,0 +1,263 @@
+// Package sso signs people in through OpenID Connect providers such as
+// Okta, Azure AD and Google, and through LDAP directories such as Active
+// Directory. The authorization code flow with PKCE hands the server an ID
+// token; directories check a password by binding as the user. Either way,
+// the user and their groups become a session token: an API token that
+// expires, which role bindings to the user and to group:<name> apply to.
+package sso
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"open-cicd/internal/auth"
+	"open-cicd/internal/types"
+	"open-cicd/internal/utils"
+)
+
+var (
+	// ErrUnknownProvider is returned for providers that are not configured.
+	ErrUnknownProvider = errors.New("unknown SSO provider")
+	// ErrLoginFailed wraps the reasons a sign-in is refused.
+	ErrLoginFailed = errors.New("sign-in failed")
+	// ErrNotSupported is returned for signing in to a provider in a way
+	// its kind does not support, such as with a password through OpenID
+	// Connect.
+	ErrNotSupported = errors.New("the provider does not support signing in this way")
+)
+
+// Provider is a way of signing in that the service issues sessions for.
+type Provider interface {
+	// Info describes the provider for the sign-in page.
+	Info() types.SSOProvider
+	// Test checks that the provider can be reached and its configuration
+	// works, for administrators setting it up.
+	Test(ctx context.Context) error
+}
+
+// passwordProvider is a provider people sign in to with a username and
+// password, such as an LDAP directory. authenticate returns the user and
+// their groups; errors about the credentials wrap ErrLoginFailed.
+type passwordProvider interface {
+	Provider
+	authenticate(ctx context.Context, username, password string) (string, []string, error)
+}
+
+// ProviderConfig configures one OpenID Connect provider; see
+// config.SSOProvider.
+type ProviderConfig struct {
+	Name          string
+	DisplayName   string
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	Scopes        []string
+	UsernameClaim string
+	GroupsClaim   string
+	AllowedGroups []string
+}
+
+// stateBytes is the entropy of the state, nonce and PKCE verifier of a
+// sign-in.
+const stateBytes = 24
+
+// Service runs sign-ins through the configured providers and issues the
+// sessions of those that succeed.
+type Service struct {
+	providers map[string]Provider
+	order     []string
+	tokens    *auth.Tokens
+	lifetime  time.Duration
+	now       func() time.Time
+}
+
+// NewService returns a service for OpenID Connect providers, which
+// redirect back to externalURL, and LDAP directories, issuing sessions
+// valid for lifetime through tokens.
+func NewService(providers []ProviderConfig, directories []LDAPConfig, externalURL string, tokens *auth.Tokens, lifetime time.Duration) (*Service, error) {
+	s := &Service{
+		providers: make(map[string]Provider, len(providers)+len(directories)),
+		tokens:    tokens,
+		lifetime:  lifetime,
+		now:       time.Now,
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, cfg := range providers {
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"email", "profile", "groups"}
+		}
+		if cfg.UsernameClaim == "" {
+			cfg.UsernameClaim = "email"
+		}
+		if cfg.GroupsClaim == "" {
+			cfg.GroupsClaim = "groups"
+		}
+		s.providers[cfg.Name] = &oidcProvider{
+			cfg:         cfg,
+			redirectURL: strings.TrimSuffix(externalURL, "/") + CallbackPath(cfg.Name),
+			client:      client,
+		}
+		s.order = append(s.order, cfg.Name)
+	}
+	for _, cfg := range directories {
+		p, err := newLDAPProvider(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("directory %s: %w", cfg.Name, err)
+		}
+		s.providers[cfg.Name] = p
+		s.order = append(s.order, cfg.Name)
+	}
+	return s, nil
+}
+
+// LoginPath and CallbackPath return where signing in through the provider
+// named name starts and where the provider redirects back to.
+func LoginPath(name string) string    { return "/auth/sso/" + url.PathEscape(name) + "/login" }
+func CallbackPath(name string) string { return "/auth/sso/" + url.PathEscape(name) + "/callback" }
+
+// Providers lists the configured providers in configuration order.
+func (s *Service) Providers() []types.SSOProvider {
+	list := make([]types.SSOProvider, 0, len(s.order))
+	for _, name := range s.order {
+		list = append(list, s.providers[name].Info())
+	}
+	return list
+}
+
+// Test checks the provider named name; see Provider.
+func (s *Service) Test(ctx context.Context, name string) error {
+	p, ok := s.providers[name]
+	if !ok {
+		return ErrUnknownProvider
+	}
+	return p.Test(ctx)
+}
+
+// Begin starts signing in through the provider named name. It returns the
+// URL to send the browser to and the state of the sign-in, which the
+// browser must present to Complete, such as in a cookie.
+func (s *Service) Begin(ctx context.Context, name string) (string, string, error) {
+	p, err := s.oidc(name)
+	if err != nil {
+		return "", "", err
+	}
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("provider %s: %w", name, err)
+	}
+	state, nonce, verifier := utils.NewSecret(stateBytes), utils.NewSecret(stateBytes), utils.NewSecret(stateBytes)
+	return p.authURL(meta, state, nonce, verifier), strings.Join([]string{name, state, nonce, verifier}, "."), nil
+}
+
+// Complete finishes a sign-in through the provider named name, given the
+// state Begin returned and the state and code the provider redirected
+// back with. It returns the session of the user with its secret. Errors
+// about the sign-in itself, as opposed to failures of the server, wrap
+// ErrLoginFailed.
+func (s *Service) Complete(ctx context.Context, name, saved, state, code string) (*types.APIToken, string, error) {
+	p, err := s.oidc(name)
+	if err != nil {
+		return nil, "", err
+	}
+	parts := strings.Split(saved, ".")
+	if len(parts) != 4 || parts[0] != name || state == "" || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(state)) != 1 {
+		return nil, "", fmt.Errorf("%w: the sign-in expired or was started elsewhere; please try again", ErrLoginFailed)
+	}
+	nonce, verifier := parts[2], parts[3]
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("provider %s: %w", name, err)
+	}
+	idToken, err := p.exchange(ctx, meta, code, verifier)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+	claims, err := p.verify(ctx, meta, idToken, nonce, s.now())
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+	user, groups, err := p.identity(claims)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+	return s.session(ctx, name, user, groups)
+}
+
+// Login signs in to the provider named name, a directory, with a username
+// and password. It returns the session of the user with its secret. Errors
+// about the credentials wrap ErrLoginFailed.
+func (s *Service) Login(ctx context.Context, name, username, password string) (*types.APIToken, string, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, "", ErrUnknownProvider
+	}
+	pp, ok := p.(passwordProvider)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	user, groups, err := pp.authenticate(ctx, username, password)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.session(ctx, name, user, groups)
+}
+
+// session issues the session of user, in groups, who signed in through the
+// provider named name.
+func (s *Service) session(ctx context.Context, name, user string, groups []string) (*types.APIToken, string, error) {
+	token, secret, err := s.tokens.CreateSession(ctx, name, user, groups, s.lifetime)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating session: %w", err)
+	}
+	slog.InfoContext(ctx, "Signed in", "provider", name, "user", user, "groups", groups, "token_id", token.ID)
+	return token, secret, nil
+}
+
+// oidc returns the OpenID Connect provider named name.
+func (s *Service) oidc(name string) (*oidcProvider, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	op, ok := p.(*oidcProvider)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return op, nil
+}
+
+// allowed reports whether someone in groups may sign in, given the groups
+// a provider allows, if any.
+func allowed(groups, allowedGroups []string) bool {
+	return len(allowedGroups) == 0 || slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(allowedGroups, g) })
+}
+
+// identity returns the user and groups an ID token's claims name, if the
+// user may sign in.
+func (p *oidcProvider) identity(claims map[string]any) (string, []string, error) {
+	user, _ := claims[p.cfg.UsernameClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("ID token has no %s claim", p.cfg.UsernameClaim)
+	}
+	if p.cfg.UsernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", nil, fmt.Errorf("email %s is not verified", user)
+		}
+	}
+	groups := stringClaims(claims[p.cfg.GroupsClaim])
+	if !allowed(groups, p.cfg.AllowedGroups) {
+		return "", nil, fmt.Errorf("%s is in none of the groups allowed to sign in", user)
+	}
+	return user, groups, nil
+}
@@ -0,0 +1,1867 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// Memory is an in-memory implementation of the storage interfaces. It is safe
+// for concurrent use and intended for development and tests.
+type Memory struct {
+	mu         sync.RWMutex
+	agents     map[string]*types.Agent
+	jobs       map[string]*types.Job
+	pipelines  map[string]*types.Pipeline
+	tokens     map[string]*types.APIToken
+	agentToks  map[string]*types.AgentToken
+	bindings   map[string]*types.RoleBinding
+	teams      map[string]*types.Team
+	orgs       map[string]*types.Organization
+	projects   map[string]*types.Project
+	artifacts  map[artifactKey]*types.Artifact
+	reports    map[artifactKey]*types.TestReport
+	notes      []*types.Annotation
+	logs       map[string]*types.JobLog
+	logLines   map[string][]*types.LogLine
+	snapshots  map[string]*types.WorkspaceSnapshot
+	caches     map[cacheKey]*types.CacheEntry
+	cacheStats map[cacheKey]*types.CacheStats
+	secrets    map[secretKey]*types.Secret
+	scmCreds   map[scmCredentialKey]*types.SCMCredential
+	variables  map[secretKey]*types.Variable
+	protected  map[string]*types.ProtectedBranches
+	checks     map[string]*types.RequiredChecks
+	templates  map[templateKey]*types.Template
+	quotas     map[string]*types.ProjectQuota
+	retention  map[string]*types.RetentionPolicy
+	pause      *types.SchedulerPause
+	deliveries map[string]*types.WebhookDelivery
+	schedules  map[string]*types.Schedule
+	envs       map[environmentKey]*types.Environment
+	deploys    map[string]*types.Deployment
+	notifiers  map[string]*types.Notifier
+	sent       map[string]*types.NotifierDelivery
+	prefs      map[string]*types.NotificationPreferences
+	audit      []*types.AuditEvent
+	locks      map[string]*memoryLease
+
+	// seq records insertion order so records created in the same instant
+	// still list in a stable order.
+	seq  map[string]uint64
+	next uint64
+}
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		agents:     make(map[string]*types.Agent),
+		jobs:       make(map[string]*types.Job),
+		pipelines:  make(map[string]*types.Pipeline),
+		tokens:     make(map[string]*types.APIToken),
+		agentToks:  make(map[string]*types.AgentToken),
+		bindings:   make(map[string]*types.RoleBinding),
+		teams:      make(map[string]*types.Team),
+		orgs:       make(map[string]*types.Organization),
+		projects:   make(map[string]*types.Project),
+		artifacts:  make(map[artifactKey]*types.Artifact),
+		reports:    make(map[artifactKey]*types.TestReport),
+		logs:       make(map[string]*types.JobLog),
+		logLines:   make(map[string][]*types.LogLine),
+		snapshots:  make(map[string]*types.WorkspaceSnapshot),
+		caches:     make(map[cacheKey]*types.CacheEntry),
+		cacheStats: make(map[cacheKey]*types.CacheStats),
+		secrets:    make(map[secretKey]*types.Secret),
+		scmCreds:   make(map[scmCredentialKey]*types.SCMCredential),
+		variables:  make(map[secretKey]*types.Variable),
+		protected:  make(map[string]*types.ProtectedBranches),
+		checks:     make(map[string]*types.RequiredChecks),
+		templates:  make(map[templateKey]*types.Template),
+		quotas:     make(map[string]*types.ProjectQuota),
+		retention:  make(map[string]*types.RetentionPolicy),
+		deliveries: make(map[string]*types.WebhookDelivery),
+		schedules:  make(map[string]*types.Schedule),
+		envs:       make(map[environmentKey]*types.Environment),
+		deploys:    make(map[string]*types.Deployment),
+		notifiers:  make(map[string]*types.Notifier),
+		sent:       make(map[string]*types.NotifierDelivery),
+		prefs:      make(map[string]*types.NotificationPreferences),
+		locks:      make(map[string]*memoryLease),
+		seq:        make(map[string]uint64),
+	}
+}
+
+// inserted records the insertion order of id. Callers must hold m.mu.
+func (m *Memory) inserted(id string) {
+	m.next++
+	m.seq[id] = m.next
+}
+
+// before orders records by time, then by insertion order. Callers must hold m.mu.
+func (m *Memory) before(ti time.Time, idi string, tj time.Time, idj string) bool {
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	return m.seq[idi] < m.seq[idj]
+}
+
+// paginate orders records as p says and returns the ones it selects; pos
+// gives the position of a record. Callers must hold m.mu.
+func paginate[T any](m *Memory, records []T, p Page, pos func(T) Cursor) []T {
+	less := func(a, b Cursor) bool { return m.before(a.Time, a.ID, b.Time, b.ID) }
+	if p.Desc {
+		less = func(a, b Cursor) bool { return m.before(b.Time, b.ID, a.Time, a.ID) }
+	}
+	sort.Slice(records, func(i, j int) bool { return less(pos(records[i]), pos(records[j])) })
+	if p.After != nil {
+		records = records[sort.Search(len(records), func(i int) bool { return less(*p.After, pos(records[i])) }):]
+	}
+	if p.Limit > 0 && len(records) > p.Limit {
+		records = records[:p.Limit]
+	}
+	return records
+}
+
+// matchesBranch reports whether ref is a ref of branch, or branch is empty.
+func matchesBranch(ref, branch string) bool {
+	return branch == "" || slices.Contains(BranchRefs(branch), ref)
+}
+
+// Close implements Store. The in-memory store holds no resources.
+func (m *Memory) Close() error { return nil }
+
+// Ping always succeeds, as does Schema: the in-memory store has no schema to
+// migrate.
+func (m *Memory) Ping(context.Context) error { return nil }
+
+func (m *Memory) Schema(context.Context) (SchemaStatus, error) { return SchemaStatus{}, nil }
+
+func (m *Memory) CreateAgent(_ context.Context, agent *types.Agent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.agents[agent.ID]; ok {
+		return ErrConflict
+	}
+	m.agents[agent.ID] = agent.Clone()
+	m.inserted(agent.ID)
+	return nil
+}
+
+func (m *Memory) GetAgent(_ context.Context, id string) (*types.Agent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	agent, ok := m.agents[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return agent.Clone(), nil
+}
+
+func (m *Memory) ListAgents(_ context.Context) ([]*types.Agent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	agents := make([]*types.Agent, 0, len(m.agents))
+	for _, agent := range m.agents {
+		agents = append(agents, agent.Clone())
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return m.before(agents[i].RegisteredAt, agents[i].ID, agents[j].RegisteredAt, agents[j].ID)
+	})
+	return agents, nil
+}
+
+func (m *Memory) UpdateAgent(_ context.Context, id string, fn func(*types.Agent) error) (*types.Agent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, ok := m.agents[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := agent.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.agents[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) CreateJob(_ context.Context, job *types.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[job.ID]; ok {
+		return ErrConflict
+	}
+	m.jobs[job.ID] = job.Clone()
+	m.inserted(job.ID)
+	return nil
+}
+
+func (m *Memory) GetJob(_ context.Context, id string) (*types.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return job.Clone(), nil
+}
+
+func (m *Memory) ListJobs(_ context.Context, filter JobFilter) ([]*types.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	jobs := make([]*types.Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		switch {
+		case filter.State != "" && job.State != filter.State,
+			filter.Repository != "" && job.Repository != filter.Repository,
+			filter.Organization != "" && job.Organization != filter.Organization,
+			!matchesBranch(job.Ref, filter.Branch),
+			filter.AgentID != "" && job.AgentID != filter.AgentID:
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	jobs = paginate(m, jobs, filter.Page, func(j *types.Job) Cursor {
+		return filter.Page.Position(j.CreatedAt, j.UpdatedAt, j.ID)
+	})
+	for i, job := range jobs {
+		jobs[i] = job.Clone()
+	}
+	return jobs, nil
+}
+
+func (m *Memory) CountJobs(_ context.Context, repository string, since time.Time) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, job := range m.jobs {
+		if job.Repository == repository && !job.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) UpdateJob(_ context.Context, id string, fn func(*types.Job) error) (*types.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := job.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.jobs[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) DeleteJob(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.jobs, id)
+	for k := range m.reports {
+		if k.jobID == id {
+			delete(m.reports, k)
+		}
+	}
+	m.notes = slices.DeleteFunc(m.notes, func(a *types.Annotation) bool { return a.JobID == id })
+	return nil
+}
+
+func (m *Memory) CreatePipeline(_ context.Context, pipeline *types.Pipeline) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pipelines[pipeline.ID]; ok {
+		return ErrConflict
+	}
+	m.pipelines[pipeline.ID] = pipeline.Clone()
+	m.inserted(pipeline.ID)
+	return nil
+}
+
+func (m *Memory) GetPipeline(_ context.Context, id string) (*types.Pipeline, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pipeline, ok := m.pipelines[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return pipeline.Clone(), nil
+}
+
+func (m *Memory) ListPipelines(_ context.Context, filter PipelineFilter) ([]*types.Pipeline, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pipelines := make([]*types.Pipeline, 0, len(m.pipelines))
+	for _, pipeline := range m.pipelines {
+		switch {
+		case filter.State != "" && pipeline.State != filter.State,
+			filter.Repository != "" && pipeline.Repository != filter.Repository,
+			filter.Organization != "" && pipeline.Organization != filter.Organization,
+			filter.Name != "" && pipeline.Name != filter.Name,
+			!matchesBranch(pipeline.Ref, filter.Branch):
+			continue
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	pipelines = paginate(m, pipelines, filter.Page, func(p *types.Pipeline) Cursor {
+		return filter.Page.Position(p.CreatedAt, p.UpdatedAt, p.ID)
+	})
+	for i, pipeline := range pipelines {
+		pipelines[i] = pipeline.Clone()
+	}
+	return pipelines, nil
+}
+
+func (m *Memory) LatestPipeline(_ context.Context, repository string, refs []string, states []types.PipelineState) (*types.Pipeline, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var latest *types.Pipeline
+	for _, pipeline := range m.pipelines {
+		if pipeline.Repository != repository || !slices.Contains(refs, pipeline.Ref) || !slices.Contains(states, pipeline.State) {
+			continue
+		}
+		if latest == nil || m.before(latest.CreatedAt, latest.ID, pipeline.CreatedAt, pipeline.ID) {
+			latest = pipeline
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	return latest.Clone(), nil
+}
+
+func (m *Memory) UpdatePipeline(_ context.Context, id string, fn func(*types.Pipeline) error) (*types.Pipeline, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pipeline, ok := m.pipelines[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := pipeline.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.pipelines[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) DeletePipeline(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pipelines[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.pipelines, id)
+	return nil
+}
+
+func (m *Memory) CreateToken(_ context.Context, token *types.APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == token.ID || t.Hash == token.Hash {
+			return ErrConflict
+		}
+	}
+	c := *token
+	m.tokens[token.ID] = &c
+	m.inserted(token.ID)
+	return nil
+}
+
+func (m *Memory) GetTokenByHash(_ context.Context, hash string) (*types.APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.tokens {
+		if t.Hash == hash {
+			c := *t
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) ListTokens(_ context.Context) ([]*types.APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tokens := make([]*types.APIToken, 0, len(m.tokens))
+	for _, t := range m.tokens {
+		c := *t
+		tokens = append(tokens, &c)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return m.before(tokens[i].CreatedAt, tokens[i].ID, tokens[j].CreatedAt, tokens[j].ID)
+	})
+	return tokens, nil
+}
+
+func (m *Memory) DeleteToken(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.tokens, id)
+	return nil
+}
+
+func (m *Memory) CreateAgentToken(_ context.Context, token *types.AgentToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.agentToks {
+		if t.ID == token.ID || t.Hash == token.Hash {
+			return ErrConflict
+		}
+	}
+	m.agentToks[token.ID] = token.Clone()
+	m.inserted(token.ID)
+	return nil
+}
+
+func (m *Memory) GetAgentToken(_ context.Context, id string) (*types.AgentToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	token, ok := m.agentToks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return token.Clone(), nil
+}
+
+func (m *Memory) GetAgentTokenByHash(_ context.Context, hash string) (*types.AgentToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.agentToks {
+		if t.Hash == hash {
+			return t.Clone(), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) ListAgentTokens(_ context.Context) ([]*types.AgentToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tokens := make([]*types.AgentToken, 0, len(m.agentToks))
+	for _, t := range m.agentToks {
+		tokens = append(tokens, t.Clone())
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return m.before(tokens[i].CreatedAt, tokens[i].ID, tokens[j].CreatedAt, tokens[j].ID)
+	})
+	return tokens, nil
+}
+
+func (m *Memory) UpdateAgentToken(_ context.Context, id string, fn func(*types.AgentToken) error) (*types.AgentToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.agentToks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := token.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.agentToks[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) CreateRoleBinding(_ context.Context, binding *types.RoleBinding) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bindings[binding.ID]; ok {
+		return ErrConflict
+	}
+	c := *binding
+	m.bindings[binding.ID] = &c
+	m.inserted(binding.ID)
+	return nil
+}
+
+func (m *Memory) ListRoleBindings(_ context.Context) ([]*types.RoleBinding, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bindings := make([]*types.RoleBinding, 0, len(m.bindings))
+	for _, b := range m.bindings {
+		c := *b
+		bindings = append(bindings, &c)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		return m.before(bindings[i].CreatedAt, bindings[i].ID, bindings[j].CreatedAt, bindings[j].ID)
+	})
+	return bindings, nil
+}
+
+func (m *Memory) DeleteRoleBinding(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bindings[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.bindings, id)
+	return nil
+}
+
+func (m *Memory) PutTeam(_ context.Context, team *types.Team) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.teams[team.Name] = team.Clone()
+	return nil
+}
+
+func (m *Memory) ListTeams(_ context.Context) ([]*types.Team, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	teams := make([]*types.Team, 0, len(m.teams))
+	for _, t := range m.teams {
+		teams = append(teams, t.Clone())
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams, nil
+}
+
+func (m *Memory) DeleteTeam(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.teams[name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.teams, name)
+	return nil
+}
+
+func (m *Memory) CreateOrganization(_ context.Context, org *types.Organization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[org.Name]; ok {
+		return ErrConflict
+	}
+	c := *org
+	m.orgs[org.Name] = &c
+	return nil
+}
+
+func (m *Memory) GetOrganization(_ context.Context, name string) (*types.Organization, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	org, ok := m.orgs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *org
+	return &c, nil
+}
+
+func (m *Memory) ListOrganizations(_ context.Context) ([]*types.Organization, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orgs := make([]*types.Organization, 0, len(m.orgs))
+	for _, o := range m.orgs {
+		c := *o
+		orgs = append(orgs, &c)
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs, nil
+}
+
+func (m *Memory) UpdateOrganization(_ context.Context, name string, fn func(*types.Organization) error) (*types.Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	org, ok := m.orgs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := *org
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	m.orgs[name] = &updated
+	c := updated
+	return &c, nil
+}
+
+func (m *Memory) DeleteOrganization(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[name]; !ok {
+		return ErrNotFound
+	}
+	for _, p := range m.projects {
+		if p.Organization == name {
+			return fmt.Errorf("organization %s still owns project %s", name, p.Name)
+		}
+	}
+	delete(m.orgs, name)
+	return nil
+}
+
+func (m *Memory) CreateProject(_ context.Context, project *types.Project) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[project.Organization]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.projects[project.Name]; ok {
+		return ErrConflict
+	}
+	c := *project
+	m.projects[project.Name] = &c
+	return nil
+}
+
+func (m *Memory) GetProject(_ context.Context, name string) (*types.Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	project, ok := m.projects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *project
+	return &c, nil
+}
+
+func (m *Memory) ListProjects(_ context.Context) ([]*types.Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	projects := make([]*types.Project, 0, len(m.projects))
+	for _, p := range m.projects {
+		c := *p
+		projects = append(projects, &c)
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects, nil
+}
+
+// artifactKey identifies an artifact in the in-memory store.
+type artifactKey struct{ jobID, path string }
+
+func (m *Memory) PutArtifact(_ context.Context, artifact *types.Artifact) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.artifacts[artifactKey{artifact.JobID, artifact.Path}] = artifact.Clone()
+	return nil
+}
+
+func (m *Memory) GetArtifact(_ context.Context, jobID, path string) (*types.Artifact, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.artifacts[artifactKey{jobID, path}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return a.Clone(), nil
+}
+
+func (m *Memory) ListArtifacts(_ context.Context, jobID string) ([]*types.Artifact, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	artifacts := []*types.Artifact{}
+	for k, a := range m.artifacts {
+		if k.jobID == jobID {
+			artifacts = append(artifacts, a.Clone())
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Path < artifacts[j].Path })
+	return artifacts, nil
+}
+
+func (m *Memory) ListExpiredArtifacts(_ context.Context, t time.Time, limit int) ([]*types.Artifact, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	artifacts := []*types.Artifact{}
+	for _, a := range m.artifacts {
+		if a.ExpiresAt != nil && a.ExpiresAt.Before(t) {
+			artifacts = append(artifacts, a.Clone())
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].ExpiresAt.Before(*artifacts[j].ExpiresAt) })
+	if len(artifacts) > limit {
+		artifacts = artifacts[:limit]
+	}
+	return artifacts, nil
+}
+
+func (m *Memory) DeleteArtifact(_ context.Context, jobID, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := artifactKey{jobID, path}
+	if _, ok := m.artifacts[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.artifacts, k)
+	return nil
+}
+
+func (m *Memory) PutTestReport(_ context.Context, report *types.TestReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports[artifactKey{report.JobID, report.Path}] = report.Clone()
+	return nil
+}
+
+func (m *Memory) ListTestReports(_ context.Context, jobID string) ([]*types.TestReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	reports := []*types.TestReport{}
+	for k, r := range m.reports {
+		if k.jobID == jobID {
+			reports = append(reports, r.Clone())
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Path < reports[j].Path })
+	return reports, nil
+}
+
+func (m *Memory) AddAnnotations(_ context.Context, annotations []*types.Annotation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range annotations {
+		m.notes = append(m.notes, a.Clone())
+	}
+	return nil
+}
+
+func (m *Memory) ListAnnotations(_ context.Context, jobIDs []string) ([]*types.Annotation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	annotations := []*types.Annotation{}
+	for _, a := range m.notes {
+		if slices.Contains(jobIDs, a.JobID) {
+			annotations = append(annotations, a.Clone())
+		}
+	}
+	return annotations, nil
+}
+
+func (m *Memory) CountAnnotations(_ context.Context, jobID string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, a := range m.notes {
+		if a.JobID == jobID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) PutJobLog(_ context.Context, log *types.JobLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logs[log.JobID] = log.Clone()
+	return nil
+}
+
+func (m *Memory) GetJobLog(_ context.Context, jobID string) (*types.JobLog, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	l, ok := m.logs[jobID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return l.Clone(), nil
+}
+
+func (m *Memory) ListExpiredJobLogs(_ context.Context, t time.Time, limit int) ([]*types.JobLog, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	logs := []*types.JobLog{}
+	for _, l := range m.logs {
+		if l.ExpiresAt != nil && l.ExpiresAt.Before(t) {
+			logs = append(logs, l.Clone())
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].ExpiresAt.Before(*logs[j].ExpiresAt) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (m *Memory) DeleteJobLog(_ context.Context, jobID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unindexJobLog(jobID)
+	if _, ok := m.logs[jobID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.logs, jobID)
+	return nil
+}
+
+func (m *Memory) IndexJobLog(_ context.Context, jobID string, lines []*types.LogLine) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unindexJobLog(jobID)
+	indexed := make([]*types.LogLine, len(lines))
+	for i, line := range lines {
+		c := *line
+		indexed[i] = &c
+		m.inserted(c.ID)
+	}
+	m.logLines[jobID] = indexed
+	return nil
+}
+
+// unindexJobLog drops the indexed lines of a job. Callers must hold m.mu.
+func (m *Memory) unindexJobLog(jobID string) {
+	for _, line := range m.logLines[jobID] {
+		delete(m.seq, line.ID)
+	}
+	delete(m.logLines, jobID)
+}
+
+func (m *Memory) SearchLogs(_ context.Context, search LogSearch) ([]*types.LogLine, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	query := parseLogQuery(search.Query)
+	var lines []*types.LogLine
+	for jobID, indexed := range m.logLines {
+		if search.JobID != "" && jobID != search.JobID {
+			continue
+		}
+		for _, line := range indexed {
+			if (search.Project == "" || line.Project == search.Project) && query.matches(line.Text) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = paginate(m, lines, search.Page, func(l *types.LogLine) Cursor {
+		return Cursor{Time: l.FinishedAt, ID: l.ID}
+	})
+	out := make([]*types.LogLine, len(lines))
+	for i, line := range lines {
+		c := *line
+		out[i] = &c
+	}
+	return out, nil
+}
+
+// logQuery is a search query as the in-memory store understands it, close
+// to PostgreSQL's websearch_to_tsquery: words and quoted phrases that must
+// all appear, and words prefixed with - that must not.
+type logQuery struct {
+	include, exclude []string
+}
+
+func parseLogQuery(q string) logQuery {
+	var query logQuery
+	q = strings.ToLower(q)
+	for q != "" {
+		q = strings.TrimLeft(q, " \t")
+		if q == "" {
+			break
+		}
+		if phrase, ok := strings.CutPrefix(q, `"`); ok {
+			phrase, q, _ = strings.Cut(phrase, `"`)
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				query.include = append(query.include, phrase)
+			}
+			continue
+		}
+		word, rest, _ := strings.Cut(q, " ")
+		q = rest
+		if w, ok := strings.CutPrefix(word, "-"); ok {
+			if w != "" {
+				query.exclude = append(query.exclude, w)
+			}
+			continue
+		}
+		query.include = append(query.include, word)
+	}
+	return query
+}
+
+// matches reports whether text has every included term and none of the
+// excluded ones. A query without included terms matches nothing.
+func (q logQuery) matches(text string) bool {
+	if len(q.include) == 0 {
+		return false
+	}
+	text = strings.ToLower(text)
+	for _, term := range q.include {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	for _, term := range q.exclude {
+		if strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Memory) PutSnapshot(_ context.Context, snapshot *types.WorkspaceSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[snapshot.JobID] = snapshot.Clone()
+	return nil
+}
+
+func (m *Memory) GetSnapshot(_ context.Context, jobID string) (*types.WorkspaceSnapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.snapshots[jobID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.Clone(), nil
+}
+
+func (m *Memory) ListExpiredSnapshots(_ context.Context, t time.Time, limit int) ([]*types.WorkspaceSnapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snapshots := []*types.WorkspaceSnapshot{}
+	for _, s := range m.snapshots {
+		if s.ExpiresAt != nil && s.ExpiresAt.Before(t) {
+			snapshots = append(snapshots, s.Clone())
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ExpiresAt.Before(*snapshots[j].ExpiresAt) })
+	if len(snapshots) > limit {
+		snapshots = snapshots[:limit]
+	}
+	return snapshots, nil
+}
+
+func (m *Memory) DeleteSnapshot(_ context.Context, jobID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.snapshots[jobID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.snapshots, jobID)
+	return nil
+}
+
+// cacheKey identifies a cache entry in the in-memory store.
+type cacheKey struct{ project, key string }
+
+func (m *Memory) PutCacheEntry(_ context.Context, entry *types.CacheEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *entry
+	m.caches[cacheKey{entry.Project, entry.Key}] = &c
+	return nil
+}
+
+func (m *Memory) GetCacheEntry(_ context.Context, project, key string) (*types.CacheEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.caches[cacheKey{project, key}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *e
+	return &c, nil
+}
+
+func (m *Memory) TouchCacheEntry(_ context.Context, project, key string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.caches[cacheKey{project, key}]
+	if !ok {
+		return ErrNotFound
+	}
+	e.LastUsedAt = t
+	return nil
+}
+
+func (m *Memory) ListCacheEntries(_ context.Context, project string) ([]*types.CacheEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := []*types.CacheEntry{}
+	for k, e := range m.caches {
+		if k.project == project {
+			c := *e
+			entries = append(entries, &c)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastUsedAt.Equal(entries[j].LastUsedAt) {
+			return entries[i].LastUsedAt.Before(entries[j].LastUsedAt)
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+func (m *Memory) DeleteCacheEntry(_ context.Context, project, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := cacheKey{project, key}
+	if _, ok := m.caches[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.caches, k)
+	return nil
+}
+
+func (m *Memory) CountCacheDigest(_ context.Context, digest string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, e := range m.caches {
+		if e.Digest == digest {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) AddCacheStats(_ context.Context, delta *types.CacheStats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := cacheKey{delta.Project, delta.Key}
+	stats, ok := m.cacheStats[k]
+	if !ok {
+		stats = &types.CacheStats{Project: delta.Project, Key: delta.Key}
+		m.cacheStats[k] = stats
+	}
+	stats.Add(delta)
+	stats.UpdatedAt = delta.UpdatedAt
+	return nil
+}
+
+func (m *Memory) ListCacheStats(_ context.Context, project string) ([]*types.CacheStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := []*types.CacheStats{}
+	for k, stats := range m.cacheStats {
+		if k.project == project {
+			c := *stats
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+// secretKey identifies a secret or variable in the in-memory store.
+type secretKey struct{ project, name string }
+
+// cloneSecret copies a secret, including its sealed value.
+func cloneSecret(s *types.Secret) *types.Secret {
+	c := *s
+	c.Sealed.WrappedKey = append([]byte(nil), s.Sealed.WrappedKey...)
+	c.Sealed.Ciphertext = append([]byte(nil), s.Sealed.Ciphertext...)
+	return &c
+}
+
+func (m *Memory) PutSecret(_ context.Context, secret *types.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[secretKey{secret.Project, secret.Name}] = cloneSecret(secret)
+	return nil
+}
+
+func (m *Memory) GetSecret(_ context.Context, project, name string) (*types.Secret, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.secrets[secretKey{project, name}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneSecret(s), nil
+}
+
+func (m *Memory) ListSecrets(_ context.Context, project string) ([]*types.Secret, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	secrets := []*types.Secret{}
+	for k, s := range m.secrets {
+		if k.project == project {
+			secrets = append(secrets, cloneSecret(s))
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
+
+func (m *Memory) DeleteSecret(_ context.Context, project, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := secretKey{project, name}
+	if _, ok := m.secrets[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.secrets, k)
+	return nil
+}
+
+// scmCredentialKey identifies an SCM credential in the in-memory store.
+type scmCredentialKey struct{ organization, project, provider string }
+
+// cloneSCMCredential copies a credential, including its sealed value.
+func cloneSCMCredential(c *types.SCMCredential) *types.SCMCredential {
+	cp := *c
+	cp.Sealed.WrappedKey = append([]byte(nil), c.Sealed.WrappedKey...)
+	cp.Sealed.Ciphertext = append([]byte(nil), c.Sealed.Ciphertext...)
+	return &cp
+}
+
+func (m *Memory) PutSCMCredential(_ context.Context, credential *types.SCMCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scmCreds[scmCredentialKey{credential.Organization, credential.Project, credential.Provider}] = cloneSCMCredential(credential)
+	return nil
+}
+
+func (m *Memory) GetSCMCredential(_ context.Context, organization, project, provider string) (*types.SCMCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.scmCreds[scmCredentialKey{organization, project, provider}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneSCMCredential(c), nil
+}
+
+func (m *Memory) ListSCMCredentials(_ context.Context, organization string) ([]*types.SCMCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := []*types.SCMCredential{}
+	for k, c := range m.scmCreds {
+		if k.organization == organization {
+			list = append(list, cloneSCMCredential(c))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Project != list[j].Project {
+			return list[i].Project < list[j].Project
+		}
+		return list[i].Provider < list[j].Provider
+	})
+	return list, nil
+}
+
+func (m *Memory) DeleteSCMCredential(_ context.Context, organization, project, provider string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := scmCredentialKey{organization, project, provider}
+	if _, ok := m.scmCreds[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.scmCreds, k)
+	return nil
+}
+
+func (m *Memory) PutVariable(_ context.Context, variable *types.Variable) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.variables[secretKey{variable.Project, variable.Name}] = variable.Clone()
+	return nil
+}
+
+func (m *Memory) GetVariable(_ context.Context, project, name string) (*types.Variable, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.variables[secretKey{project, name}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v.Clone(), nil
+}
+
+func (m *Memory) ListVariables(_ context.Context, project string) ([]*types.Variable, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	variables := []*types.Variable{}
+	for k, v := range m.variables {
+		if k.project == project {
+			variables = append(variables, v.Clone())
+		}
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	return variables, nil
+}
+
+func (m *Memory) DeleteVariable(_ context.Context, project, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := secretKey{project, name}
+	if _, ok := m.variables[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.variables, k)
+	return nil
+}
+
+func (m *Memory) GetProtectedBranches(_ context.Context, project string) (*types.ProtectedBranches, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.protected[project]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *b
+	c.Patterns = append([]string(nil), b.Patterns...)
+	return &c, nil
+}
+
+func (m *Memory) PutProtectedBranches(_ context.Context, branches *types.ProtectedBranches) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *branches
+	c.Patterns = append([]string(nil), branches.Patterns...)
+	m.protected[branches.Project] = &c
+	return nil
+}
+
+func (m *Memory) GetRequiredChecks(_ context.Context, project string) (*types.RequiredChecks, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	checks, ok := m.checks[project]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return checks.Clone(), nil
+}
+
+func (m *Memory) PutRequiredChecks(_ context.Context, checks *types.RequiredChecks) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[checks.Project] = checks.Clone()
+	return nil
+}
+
+func (m *Memory) GetProjectQuota(_ context.Context, project string) (*types.ProjectQuota, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	q, ok := m.quotas[project]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *q
+	return &c, nil
+}
+
+func (m *Memory) PutProjectQuota(_ context.Context, quota *types.ProjectQuota) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *quota
+	m.quotas[quota.Project] = &c
+	return nil
+}
+
+func (m *Memory) ListProjectQuotas(_ context.Context) ([]*types.ProjectQuota, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	quotas := make([]*types.ProjectQuota, 0, len(m.quotas))
+	for _, q := range m.quotas {
+		c := *q
+		quotas = append(quotas, &c)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Project < quotas[j].Project })
+	return quotas, nil
+}
+
+func (m *Memory) DeleteProjectQuota(_ context.Context, project string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.quotas[project]; !ok {
+		return ErrNotFound
+	}
+	delete(m.quotas, project)
+	return nil
+}
+
+func (m *Memory) GetRetentionPolicy(_ context.Context, project string) (*types.RetentionPolicy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.retention[project]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *p
+	return &c, nil
+}
+
+func (m *Memory) PutRetentionPolicy(_ context.Context, policy *types.RetentionPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *policy
+	m.retention[policy.Project] = &c
+	return nil
+}
+
+func (m *Memory) ListRetentionPolicies(_ context.Context) ([]*types.RetentionPolicy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	policies := make([]*types.RetentionPolicy, 0, len(m.retention))
+	for _, p := range m.retention {
+		c := *p
+		policies = append(policies, &c)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Project < policies[j].Project })
+	return policies, nil
+}
+
+func (m *Memory) DeleteRetentionPolicy(_ context.Context, project string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.retention[project]; !ok {
+		return ErrNotFound
+	}
+	delete(m.retention, project)
+	return nil
+}
+
+func (m *Memory) GetSchedulerPause(_ context.Context) (*types.SchedulerPause, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.pause == nil {
+		return nil, ErrNotFound
+	}
+	c := *m.pause
+	return &c, nil
+}
+
+func (m *Memory) CreateSchedulerPause(_ context.Context, pause *types.SchedulerPause) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pause != nil {
+		return ErrConflict
+	}
+	c := *pause
+	m.pause = &c
+	return nil
+}
+
+func (m *Memory) DeleteSchedulerPause(_ context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pause == nil {
+		return ErrNotFound
+	}
+	m.pause = nil
+	return nil
+}
+
+// templateKey identifies a version of a template.
+type templateKey struct{ name, version string }
+
+func (m *Memory) CreateTemplate(_ context.Context, template *types.Template) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := templateKey{template.Name, template.Version}
+	if _, ok := m.templates[k]; ok {
+		return ErrConflict
+	}
+	m.templates[k] = template.Clone()
+	return nil
+}
+
+func (m *Memory) GetTemplate(_ context.Context, name, version string) (*types.Template, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.templates[templateKey{name, version}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t.Clone(), nil
+}
+
+func (m *Memory) ListTemplates(_ context.Context, name string) ([]*types.Template, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	templates := []*types.Template{}
+	for k, t := range m.templates {
+		if name == "" || k.name == name {
+			templates = append(templates, t.Clone())
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		a, b := templates[i], templates[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	return templates, nil
+}
+
+func (m *Memory) DeleteTemplate(_ context.Context, name, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := templateKey{name, version}
+	if _, ok := m.templates[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.templates, k)
+	return nil
+}
+
+func (m *Memory) CreateWebhookDelivery(_ context.Context, delivery *types.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deliveries[delivery.ID]; ok {
+		return ErrConflict
+	}
+	m.deliveries[delivery.ID] = delivery.Clone()
+	m.inserted(delivery.ID)
+	return nil
+}
+
+func (m *Memory) GetWebhookDelivery(_ context.Context, id string) (*types.WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	delivery, ok := m.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return delivery.Clone(), nil
+}
+
+func (m *Memory) ListWebhookDeliveries(_ context.Context, filter WebhookDeliveryFilter) ([]*types.WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deliveries := make([]*types.WebhookDelivery, 0, len(m.deliveries))
+	for _, d := range m.deliveries {
+		switch {
+		case filter.Provider != "" && d.Provider != filter.Provider,
+			filter.Repository != "" && d.Repository != filter.Repository,
+			filter.Event != "" && d.Event != filter.Event,
+			filter.Status != "" && d.Status != filter.Status:
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	deliveries = paginate(m, deliveries, filter.Page, func(d *types.WebhookDelivery) Cursor {
+		return filter.Page.Position(d.ReceivedAt, d.UpdatedAt, d.ID)
+	})
+	for i, d := range deliveries {
+		deliveries[i] = d.Clone()
+		deliveries[i].Payload = ""
+	}
+	return deliveries, nil
+}
+
+func (m *Memory) UpdateWebhookDelivery(_ context.Context, id string, fn func(*types.WebhookDelivery) error) (*types.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delivery, ok := m.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := delivery.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.deliveries[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) DeleteWebhookDeliveries(_ context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, d := range m.deliveries {
+		if d.ReceivedAt.Before(t) {
+			delete(m.deliveries, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) CreateSchedule(_ context.Context, schedule *types.Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[schedule.ID]; ok {
+		return ErrConflict
+	}
+	m.schedules[schedule.ID] = schedule.Clone()
+	m.inserted(schedule.ID)
+	return nil
+}
+
+func (m *Memory) GetSchedule(_ context.Context, id string) (*types.Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	schedule, ok := m.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return schedule.Clone(), nil
+}
+
+func (m *Memory) ListSchedules(_ context.Context) ([]*types.Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	schedules := make([]*types.Schedule, 0, len(m.schedules))
+	for _, schedule := range m.schedules {
+		schedules = append(schedules, schedule.Clone())
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return m.before(schedules[i].CreatedAt, schedules[i].ID, schedules[j].CreatedAt, schedules[j].ID)
+	})
+	return schedules, nil
+}
+
+func (m *Memory) ListDueSchedules(_ context.Context, t time.Time) ([]*types.Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	schedules := []*types.Schedule{}
+	for _, schedule := range m.schedules {
+		if schedule.Enabled && schedule.NextRunAt != nil && !schedule.NextRunAt.After(t) {
+			schedules = append(schedules, schedule.Clone())
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return m.before(*schedules[i].NextRunAt, schedules[i].ID, *schedules[j].NextRunAt, schedules[j].ID)
+	})
+	return schedules, nil
+}
+
+func (m *Memory) UpdateSchedule(_ context.Context, id string, fn func(*types.Schedule) error) (*types.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedule, ok := m.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := schedule.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.schedules[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) DeleteSchedule(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.schedules, id)
+	return nil
+}
+
+// Environments and deployments
+
+// environmentKey identifies an environment in the in-memory store.
+type environmentKey struct{ project, name string }
+
+func (m *Memory) GetEnvironment(_ context.Context, project, name string) (*types.Environment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	env, ok := m.envs[environmentKey{project, name}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return env.Clone(), nil
+}
+
+func (m *Memory) ListEnvironments(_ context.Context, project string) ([]*types.Environment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	envs := []*types.Environment{}
+	for k, env := range m.envs {
+		if k.project == project {
+			envs = append(envs, env.Clone())
+		}
+	}
+	sort.Slice(envs, func(i, j int) bool { return envs[i].Name < envs[j].Name })
+	return envs, nil
+}
+
+func (m *Memory) UpdateEnvironment(_ context.Context, project, name string, fn func(*types.Environment) error) (*types.Environment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := environmentKey{project, name}
+	updated := &types.Environment{Project: project, Name: name}
+	if env, ok := m.envs[k]; ok {
+		updated = env.Clone()
+	}
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.envs[k] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) PutDeployment(_ context.Context, deployment *types.Deployment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deploys[deployment.ID]; !ok {
+		m.inserted(deployment.ID)
+	}
+	m.deploys[deployment.ID] = deployment.Clone()
+	return nil
+}
+
+func (m *Memory) ListDeployments(_ context.Context, filter DeploymentFilter) ([]*types.Deployment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deployments := []*types.Deployment{}
+	for _, d := range m.deploys {
+		if (filter.Project == "" || d.Project == filter.Project) &&
+			(filter.Environment == "" || d.Environment == filter.Environment) {
+			deployments = append(deployments, d)
+		}
+	}
+	deployments = paginate(m, deployments, filter.Page, func(d *types.Deployment) Cursor {
+		return filter.Page.Position(d.CreatedAt, d.UpdatedAt, d.ID)
+	})
+	for i, d := range deployments {
+		deployments[i] = d.Clone()
+	}
+	return deployments, nil
+}
+
+// Notifiers
+
+func (m *Memory) CreateNotifier(_ context.Context, notifier *types.Notifier) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.notifiers[notifier.ID]; ok {
+		return ErrConflict
+	}
+	m.notifiers[notifier.ID] = notifier.Clone()
+	m.inserted(notifier.ID)
+	return nil
+}
+
+func (m *Memory) GetNotifier(_ context.Context, id string) (*types.Notifier, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	notifier, ok := m.notifiers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return notifier.Clone(), nil
+}
+
+func (m *Memory) ListNotifiers(_ context.Context, project string) ([]*types.Notifier, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	notifiers := []*types.Notifier{}
+	for _, notifier := range m.notifiers {
+		if notifier.Organization == "" && (project == "" || notifier.Project == project) {
+			notifiers = append(notifiers, notifier.Clone())
+		}
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return m.before(notifiers[i].CreatedAt, notifiers[i].ID, notifiers[j].CreatedAt, notifiers[j].ID)
+	})
+	return notifiers, nil
+}
+
+func (m *Memory) ListOrganizationNotifiers(_ context.Context, organization string) ([]*types.Notifier, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	notifiers := []*types.Notifier{}
+	for _, notifier := range m.notifiers {
+		if notifier.Organization != "" && (organization == "" || notifier.Organization == organization) {
+			notifiers = append(notifiers, notifier.Clone())
+		}
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return m.before(notifiers[i].CreatedAt, notifiers[i].ID, notifiers[j].CreatedAt, notifiers[j].ID)
+	})
+	return notifiers, nil
+}
+
+func (m *Memory) UpdateNotifier(_ context.Context, id string, fn func(*types.Notifier) error) (*types.Notifier, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notifier, ok := m.notifiers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := notifier.Clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	m.notifiers[id] = updated
+	return updated.Clone(), nil
+}
+
+func (m *Memory) DeleteNotifier(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.notifiers[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.notifiers, id)
+	for deliveryID, d := range m.sent {
+		if d.NotifierID == id {
+			delete(m.sent, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateNotifierDelivery(_ context.Context, delivery *types.NotifierDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sent[delivery.ID]; ok {
+		return ErrConflict
+	}
+	m.sent[delivery.ID] = delivery.Clone()
+	m.inserted(delivery.ID)
+	return nil
+}
+
+func (m *Memory) ListNotifierDeliveries(_ context.Context, notifierID string, page Page) ([]*types.NotifierDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deliveries := []*types.NotifierDelivery{}
+	for _, d := range m.sent {
+		if d.NotifierID == notifierID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	deliveries = paginate(m, deliveries, page, func(d *types.NotifierDelivery) Cursor {
+		return page.Position(d.CreatedAt, d.CreatedAt, d.ID)
+	})
+	for i, d := range deliveries {
+		deliveries[i] = d.Clone()
+	}
+	return deliveries, nil
+}
+
+func (m *Memory) DeleteNotifierDeliveries(_ context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, d := range m.sent {
+		if d.CreatedAt.Before(t) {
+			delete(m.sent, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Notification preferences
+
+func (m *Memory) GetNotificationPreferences(_ context.Context, user string) (*types.NotificationPreferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	prefs, ok := m.prefs[user]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return prefs.Clone(), nil
+}
+
+func (m *Memory) PutNotificationPreferences(_ context.Context, prefs *types.NotificationPreferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefs[prefs.User] = prefs.Clone()
+	return nil
+}
+
+func (m *Memory) ListNotificationPreferences(_ context.Context) ([]*types.NotificationPreferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]*types.NotificationPreferences, 0, len(m.prefs))
+	for _, prefs := range m.prefs {
+		list = append(list, prefs.Clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].User < list[j].User })
+	return list, nil
+}
+
+func (m *Memory) DeleteNotificationPreferences(_ context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.prefs[user]; !ok {
+		return ErrNotFound
+	}
+	delete(m.prefs, user)
+	return nil
+}
+
+// Audit
+
+func (m *Memory) AppendAudit(_ context.Context, event *types.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit = append(m.audit, event.Clone())
+	m.inserted(event.ID)
+	return nil
+}
+
+func (m *Memory) ListAudit(_ context.Context, filter AuditFilter) ([]*types.AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := make([]*types.AuditEvent, 0, len(m.audit))
+	for _, e := range m.audit {
+		switch {
+		case filter.Actor != "" && e.Actor != filter.Actor,
+			!underResource(e.Resource, filter.Resource),
+			!filter.Since.IsZero() && e.At.Before(filter.Since),
+			!filter.Until.IsZero() && !e.At.Before(filter.Until):
+			continue
+		}
+		events = append(events, e)
+	}
+	events = paginate(m, events, filter.Page, func(e *types.AuditEvent) Cursor {
+		return Cursor{Time: e.At, ID: e.ID}
+	})
+	for i, e := range events {
+		events[i] = e.Clone()
+	}
+	return events, nil
+}
+
+// underResource reports whether path is resource or beneath it, or resource
+// is empty.
+func underResource(path, resource string) bool {
+	resource = strings.TrimSuffix(resource, "/")
+	return resource == "" || path == resource || strings.HasPrefix(path, resource+"/")
+}
+
+// Locks
+
+// memoryLease is a lock held in a Memory store. Nothing outside the process
+// can take it away, so it is never lost.
+type memoryLease struct {
+	m    *Memory
+	name string
+}
+
+func (m *Memory) TryLock(_ context.Context, name string) (Lease, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, held := m.locks[name]; held {
+		return nil, false, nil
+	}
+	l := &memoryLease{m: m, name: name}
+	m.locks[name] = l
+	return l, true, nil
+}
+
+func (l *memoryLease) Lost() <-chan struct{} {
+	return nil
+}
+
+func (l *memoryLease) Release(context.Context) error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	if l.m.locks[l.name] == l {
+		delete(l.m.locks, l.name)
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS pipelines;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS agents;
@@ -0,0 +1,39 @@
+-- Core control plane tables. Each row keeps the full record as a JSONB
+-- document alongside the columns used for lookups and filtering.
+
+CREATE TABLE agents (
+    id              TEXT PRIMARY KEY,
+    hostname        TEXT NOT NULL,
+    state           TEXT NOT NULL,
+    credential_hash TEXT NOT NULL,
+    registered_at   TIMESTAMPTZ NOT NULL,
+    updated_at      TIMESTAMPTZ NOT NULL,
+    data            JSONB NOT NULL
+);
+
+CREATE INDEX agents_state_idx ON agents (state);
+
+CREATE TABLE jobs (
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    state      TEXT NOT NULL,
+    agent_id   TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX jobs_state_created_at_idx ON jobs (state, created_at);
+CREATE INDEX jobs_created_at_idx ON jobs (created_at);
+
+CREATE TABLE pipelines (
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    state      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX pipelines_state_created_at_idx ON pipelines (state, created_at);
+CREATE INDEX pipelines_created_at_idx ON pipelines (created_at);
@@ -0,0 +1,8 @@
+-- API tokens. Only the SHA-256 hash of each secret is stored.
+
+CREATE TABLE api_tokens (
+    id         TEXT PRIMARY KEY,
+    hash       TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
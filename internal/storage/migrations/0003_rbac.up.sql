@@ -0,0 +1,13 @@
+-- Teams and the role bindings that grant users and teams access to projects.
+
+CREATE TABLE teams (
+    name       TEXT PRIMARY KEY,
+    updated_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE TABLE role_bindings (
+    id         TEXT PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
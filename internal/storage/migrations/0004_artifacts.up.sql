@@ -0,0 +1,11 @@
+-- Artifact metadata. The contents are kept in the configured blob store.
+
+CREATE TABLE artifacts (
+    job_id     TEXT NOT NULL,
+    path       TEXT NOT NULL,
+    expires_at TIMESTAMPTZ,
+    data       JSONB NOT NULL,
+    PRIMARY KEY (job_id, path)
+);
+
+CREATE INDEX artifacts_expires_at_idx ON artifacts (expires_at) WHERE expires_at IS NOT NULL;
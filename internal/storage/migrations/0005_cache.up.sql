@@ -0,0 +1,13 @@
+-- Dependency cache entries. Contents are content-addressed blobs that
+-- entries with the same digest share.
+
+CREATE TABLE cache_entries (
+    project      TEXT NOT NULL,
+    key          TEXT NOT NULL,
+    digest       TEXT NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    data         JSONB NOT NULL,
+    PRIMARY KEY (project, key)
+);
+
+CREATE INDEX cache_entries_digest_idx ON cache_entries (digest);
@@ -0,0 +1,12 @@
+-- Project secrets, encrypted at rest. The value is sealed with a per-secret
+-- data key, which is itself wrapped by the master key key_id.
+
+CREATE TABLE secrets (
+    project     TEXT NOT NULL,
+    name        TEXT NOT NULL,
+    key_id      TEXT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    ciphertext  BYTEA NOT NULL,
+    data        JSONB NOT NULL,
+    PRIMARY KEY (project, name)
+);
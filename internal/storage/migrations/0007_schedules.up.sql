@@ -0,0 +1,13 @@
+-- Cron schedules that start pipeline runs. next_run_at is null while a
+-- schedule is disabled.
+
+CREATE TABLE schedules (
+    id          TEXT PRIMARY KEY,
+    repository  TEXT NOT NULL,
+    enabled     BOOLEAN NOT NULL,
+    next_run_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL,
+    data        JSONB NOT NULL
+);
+
+CREATE INDEX schedules_next_run_at_idx ON schedules (next_run_at) WHERE enabled;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS pipelines_repository_ref_created_at_idx;
+ALTER TABLE pipelines DROP COLUMN IF EXISTS ref, DROP COLUMN IF EXISTS repository;
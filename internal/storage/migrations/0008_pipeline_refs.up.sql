@@ -0,0 +1,12 @@
+-- The repository and ref of each pipeline run, so the latest run of a branch
+-- can be found without scanning every run.
+
+ALTER TABLE pipelines
+    ADD COLUMN repository TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ref        TEXT NOT NULL DEFAULT '';
+
+UPDATE pipelines
+SET repository = COALESCE(data->>'repository', ''),
+    ref        = COALESCE(data->>'ref', '');
+
+CREATE INDEX pipelines_repository_ref_created_at_idx ON pipelines (repository, ref, created_at);
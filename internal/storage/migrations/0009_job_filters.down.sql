@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS pipelines_updated_at_idx;
+DROP INDEX IF EXISTS jobs_updated_at_idx;
+DROP INDEX IF EXISTS jobs_agent_id_created_at_idx;
+DROP INDEX IF EXISTS jobs_repository_created_at_idx;
+ALTER TABLE jobs DROP COLUMN IF EXISTS ref, DROP COLUMN IF EXISTS repository;
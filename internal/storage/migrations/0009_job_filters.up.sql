@@ -0,0 +1,15 @@
+-- The repository and ref of each job, for filtering job lists, and indexes
+-- for listing jobs and pipeline runs by update time.
+
+ALTER TABLE jobs
+    ADD COLUMN repository TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ref        TEXT NOT NULL DEFAULT '';
+
+UPDATE jobs
+SET repository = COALESCE(data->>'repository', ''),
+    ref        = COALESCE(data->>'ref', '');
+
+CREATE INDEX jobs_repository_created_at_idx ON jobs (repository, created_at);
+CREATE INDEX jobs_agent_id_created_at_idx ON jobs (agent_id, created_at);
+CREATE INDEX jobs_updated_at_idx ON jobs (updated_at);
+CREATE INDEX pipelines_updated_at_idx ON pipelines (updated_at);
@@ -0,0 +1,24 @@
+-- The audit log of mutating API requests. Events are append-only: a
+-- trigger refuses to change or delete them.
+
+CREATE TABLE audit_events (
+    id         TEXT PRIMARY KEY,
+    actor      TEXT NOT NULL,
+    resource   TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_created_at_idx ON audit_events (actor, created_at);
+CREATE INDEX audit_events_resource_idx ON audit_events (resource text_pattern_ops);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit events cannot be changed or deleted';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
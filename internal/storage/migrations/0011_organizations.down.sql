@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS pipelines_organization_created_at_idx;
+DROP INDEX IF EXISTS jobs_organization_created_at_idx;
+ALTER TABLE pipelines DROP COLUMN IF EXISTS organization;
+ALTER TABLE jobs DROP COLUMN IF EXISTS organization;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,25 @@
+-- Organizations, the projects they own, and the organization of each job
+-- and pipeline run, for listing an organization's work.
+
+CREATE TABLE organizations (
+    name                    TEXT PRIMARY KEY,
+    registration_token_hash TEXT NOT NULL UNIQUE,
+    created_at              TIMESTAMPTZ NOT NULL,
+    data                    JSONB NOT NULL
+);
+
+-- Deleting an organization that still owns projects is refused.
+CREATE TABLE projects (
+    name         TEXT PRIMARY KEY,
+    organization TEXT NOT NULL REFERENCES organizations (name) ON DELETE RESTRICT,
+    created_at   TIMESTAMPTZ NOT NULL,
+    data         JSONB NOT NULL
+);
+
+CREATE INDEX projects_organization_idx ON projects (organization);
+
+ALTER TABLE jobs ADD COLUMN organization TEXT NOT NULL DEFAULT '';
+ALTER TABLE pipelines ADD COLUMN organization TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX jobs_organization_created_at_idx ON jobs (organization, created_at);
+CREATE INDEX pipelines_organization_created_at_idx ON pipelines (organization, created_at);
@@ -0,0 +1,23 @@
+-- Deployment environments of each project and the history of their
+-- deployments. The environment's document holds its current and active
+-- deployments.
+
+CREATE TABLE environments (
+    project    TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL,
+    PRIMARY KEY (project, name)
+);
+
+CREATE TABLE deployments (
+    id          TEXT PRIMARY KEY,
+    project     TEXT NOT NULL,
+    environment TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL,
+    data        JSONB NOT NULL
+);
+
+CREATE INDEX deployments_environment_created_at_idx ON deployments (project, environment, created_at);
@@ -0,0 +1,11 @@
+-- Notifiers deliver messages about a project's pipeline and job events to
+-- Slack, HTTP endpoints or email.
+
+CREATE TABLE notifiers (
+    id         TEXT PRIMARY KEY,
+    project    TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX notifiers_project_idx ON notifiers (project, created_at);
@@ -0,0 +1,14 @@
+-- Test results parsed from the JUnit XML and go test -json reports jobs
+-- upload as artifacts. They outlive the artifacts, so that results can be
+-- compared across runs of a project.
+
+CREATE TABLE test_reports (
+    job_id     TEXT NOT NULL,
+    path       TEXT NOT NULL,
+    project    TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL,
+    PRIMARY KEY (job_id, path)
+);
+
+CREATE INDEX test_reports_project_created_at_idx ON test_reports (project, created_at);
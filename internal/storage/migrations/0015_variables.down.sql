@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS protected_branches;
+DROP TABLE IF EXISTS variables;
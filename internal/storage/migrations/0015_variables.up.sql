@@ -0,0 +1,15 @@
+-- Variables are plain environment variables given to the jobs of a project,
+-- or of every project when project is empty. Protected branches select the
+-- jobs that variables marked protected are given to.
+
+CREATE TABLE variables (
+    project TEXT NOT NULL,
+    name    TEXT NOT NULL,
+    data    JSONB NOT NULL,
+    PRIMARY KEY (project, name)
+);
+
+CREATE TABLE protected_branches (
+    project TEXT PRIMARY KEY,
+    data    JSONB NOT NULL
+);
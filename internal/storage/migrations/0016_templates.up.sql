@@ -0,0 +1,11 @@
+-- Templates are published versions of template files, libraries of steps
+-- that pipeline definitions include and extend. A version never changes
+-- once published.
+
+CREATE TABLE templates (
+    name       TEXT NOT NULL,
+    version    TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL,
+    PRIMARY KEY (name, version)
+);
@@ -0,0 +1,7 @@
+-- Project quotas limit the concurrent and queued jobs of a project and set
+-- its fair-share weight when agents are contended.
+
+CREATE TABLE project_quotas (
+    project TEXT PRIMARY KEY,
+    data    JSONB NOT NULL
+);
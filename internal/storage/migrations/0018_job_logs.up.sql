@@ -0,0 +1,10 @@
+-- Job log records: the compressed segments each job's output was written
+-- in. The segments themselves are kept in the configured blob store.
+
+CREATE TABLE job_logs (
+    job_id     TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX job_logs_expires_at_idx ON job_logs (expires_at) WHERE expires_at IS NOT NULL;
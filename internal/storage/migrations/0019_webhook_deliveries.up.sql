@@ -0,0 +1,18 @@
+-- Verified webhook deliveries with the outcome of every attempt to process
+-- them, so that failed ones can be redelivered. created_at is when the
+-- delivery was received.
+
+CREATE TABLE webhook_deliveries (
+    id         TEXT PRIMARY KEY,
+    provider   TEXT NOT NULL,
+    repository TEXT NOT NULL,
+    event      TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_created_at_idx ON webhook_deliveries (created_at);
+CREATE INDEX webhook_deliveries_status_created_at_idx ON webhook_deliveries (status, created_at);
+CREATE INDEX webhook_deliveries_repository_created_at_idx ON webhook_deliveries (repository, created_at);
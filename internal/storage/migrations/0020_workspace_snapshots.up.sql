@@ -0,0 +1,11 @@
+-- Workspace snapshot records: the outputs a job left in its workspace, for
+-- the jobs of downstream stages to restore. The archives themselves are kept
+-- in the configured blob store.
+
+CREATE TABLE workspace_snapshots (
+    job_id     TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ,
+    data       JSONB NOT NULL
+);
+
+CREATE INDEX workspace_snapshots_expires_at_idx ON workspace_snapshots (expires_at) WHERE expires_at IS NOT NULL;
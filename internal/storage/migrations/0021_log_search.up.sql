@@ -0,0 +1,15 @@
+-- Full-text index of the logs of finished jobs, one row per line. Lines are
+-- dropped along with their job's log record.
+
+CREATE TABLE job_log_lines (
+    id          TEXT PRIMARY KEY,
+    job_id      TEXT NOT NULL,
+    project     TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    data        JSONB NOT NULL,
+    search      TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', data->>'text')) STORED
+);
+
+CREATE INDEX job_log_lines_job_id_idx ON job_log_lines (job_id);
+CREATE INDEX job_log_lines_created_at_idx ON job_log_lines (created_at, id);
+CREATE INDEX job_log_lines_search_idx ON job_log_lines USING GIN (search);
@@ -0,0 +1,14 @@
+-- Lookup and save counts of each cache key of a project. The counts are
+-- plain columns so that concurrent updates add up.
+
+CREATE TABLE cache_stats (
+    project       TEXT NOT NULL,
+    key           TEXT NOT NULL,
+    hits          BIGINT NOT NULL DEFAULT 0,
+    fallback_hits BIGINT NOT NULL DEFAULT 0,
+    misses        BIGINT NOT NULL DEFAULT 0,
+    saves         BIGINT NOT NULL DEFAULT 0,
+    refused_saves BIGINT NOT NULL DEFAULT 0,
+    updated_at    TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (project, key)
+);
@@ -0,0 +1,7 @@
+-- The pipelines and stages each project requires to pass, reported to the
+-- SCM as commit statuses of their own for branch protection rules.
+
+CREATE TABLE required_checks (
+    project TEXT PRIMARY KEY,
+    data    JSONB NOT NULL
+);
@@ -0,0 +1,14 @@
+-- The credentials the server reaches SCM providers with, for the projects of
+-- an organization or, when project is set, for one of them. The token or
+-- private key is sealed like a secret's value.
+
+CREATE TABLE scm_credentials (
+    organization TEXT NOT NULL,
+    project      TEXT NOT NULL,
+    provider     TEXT NOT NULL,
+    key_id       TEXT NOT NULL,
+    wrapped_key  BYTEA NOT NULL,
+    ciphertext   BYTEA NOT NULL,
+    data         JSONB NOT NULL,
+    PRIMARY KEY (organization, project, provider)
+);
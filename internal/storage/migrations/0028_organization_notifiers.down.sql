@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS notifier_deliveries;
+DELETE FROM notifiers WHERE organization <> '';
+DROP INDEX IF EXISTS notifiers_organization_idx;
+ALTER TABLE notifiers
+    DROP COLUMN IF EXISTS organization,
+    DROP COLUMN IF EXISTS key_id,
+    DROP COLUMN IF EXISTS wrapped_key,
+    DROP COLUMN IF EXISTS ciphertext;
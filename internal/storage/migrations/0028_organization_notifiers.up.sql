@@ -0,0 +1,23 @@
+-- Organization notifiers deliver the events of every project of an
+-- organization, and those of its agents; their project is empty. Having no
+-- project secrets to name, they keep their signing key sealed like a
+-- secret's value. Deliveries record what every notifier sent, and are
+-- pruned after a while.
+
+ALTER TABLE notifiers
+    ADD COLUMN organization TEXT NOT NULL DEFAULT '',
+    ADD COLUMN key_id       TEXT NOT NULL DEFAULT '',
+    ADD COLUMN wrapped_key  BYTEA,
+    ADD COLUMN ciphertext   BYTEA;
+
+CREATE INDEX notifiers_organization_idx ON notifiers (organization, created_at);
+
+CREATE TABLE notifier_deliveries (
+    id          TEXT PRIMARY KEY,
+    notifier_id TEXT NOT NULL REFERENCES notifiers (id) ON DELETE CASCADE,
+    created_at  TIMESTAMPTZ NOT NULL,
+    data        JSONB NOT NULL
+);
+
+CREATE INDEX notifier_deliveries_notifier_idx ON notifier_deliveries (notifier_id, created_at);
+CREATE INDEX notifier_deliveries_created_idx ON notifier_deliveries (created_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS pipelines_repository_name_created_at_idx;
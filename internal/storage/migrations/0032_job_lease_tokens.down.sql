@@ -0,0 +1,2 @@
+UPDATE jobs SET data = jsonb_set(data, '{lease_token}', to_jsonb(lease_token)) WHERE lease_token <> 0;
+ALTER TABLE jobs DROP COLUMN IF EXISTS lease_token;
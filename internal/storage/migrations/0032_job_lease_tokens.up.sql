@@ -0,0 +1,9 @@
+-- The fencing token of each job's lease is kept out of the job document,
+-- which is served to anyone who may view the job, so that only the agent
+-- it was assigned to knows it.
+
+ALTER TABLE jobs ADD COLUMN lease_token BIGINT NOT NULL DEFAULT 0;
+
+UPDATE jobs
+SET lease_token = COALESCE((data->>'lease_token')::BIGINT, 0),
+    data        = data - 'lease_token';
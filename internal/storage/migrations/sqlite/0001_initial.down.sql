@@ -0,0 +1,24 @@
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS notifiers;
+DROP TABLE IF EXISTS deployments;
+DROP TABLE IF EXISTS environments;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS templates;
+DROP TABLE IF EXISTS project_quotas;
+DROP TABLE IF EXISTS protected_branches;
+DROP TABLE IF EXISTS variables;
+DROP TABLE IF EXISTS secrets;
+DROP TABLE IF EXISTS cache_entries;
+DROP TABLE IF EXISTS workspace_snapshots;
+DROP TABLE IF EXISTS job_logs;
+DROP TABLE IF EXISTS test_reports;
+DROP TABLE IF EXISTS artifacts;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS organizations;
+DROP TABLE IF EXISTS role_bindings;
+DROP TABLE IF EXISTS teams;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS pipelines;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS agents;
@@ -0,0 +1,252 @@
+-- The schema of SQLite, at the state of the PostgreSQL migrations up to
+-- 0020_workspace_snapshots. Each row keeps the full record as a JSON
+-- document, stored as the bytes it was encoded to, alongside the columns
+-- used for lookups and filtering. Times are written in UTC, so that they
+-- compare in the order they happened.
+
+CREATE TABLE agents (
+    id              TEXT PRIMARY KEY,
+    hostname        TEXT NOT NULL,
+    state           TEXT NOT NULL,
+    credential_hash TEXT NOT NULL,
+    registered_at   TIMESTAMP NOT NULL,
+    updated_at      TIMESTAMP NOT NULL,
+    data            BLOB NOT NULL
+);
+
+CREATE INDEX agents_state_idx ON agents (state);
+
+CREATE TABLE jobs (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    state        TEXT NOT NULL,
+    agent_id     TEXT,
+    repository   TEXT NOT NULL DEFAULT '',
+    organization TEXT NOT NULL DEFAULT '',
+    ref          TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL,
+    data         BLOB NOT NULL
+);
+
+CREATE INDEX jobs_state_created_at_idx ON jobs (state, created_at);
+CREATE INDEX jobs_created_at_idx ON jobs (created_at);
+CREATE INDEX jobs_updated_at_idx ON jobs (updated_at);
+CREATE INDEX jobs_repository_created_at_idx ON jobs (repository, created_at);
+CREATE INDEX jobs_agent_id_created_at_idx ON jobs (agent_id, created_at);
+CREATE INDEX jobs_organization_created_at_idx ON jobs (organization, created_at);
+
+CREATE TABLE pipelines (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    state        TEXT NOT NULL,
+    repository   TEXT NOT NULL DEFAULT '',
+    organization TEXT NOT NULL DEFAULT '',
+    ref          TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL,
+    data         BLOB NOT NULL
+);
+
+CREATE INDEX pipelines_state_created_at_idx ON pipelines (state, created_at);
+CREATE INDEX pipelines_created_at_idx ON pipelines (created_at);
+CREATE INDEX pipelines_updated_at_idx ON pipelines (updated_at);
+CREATE INDEX pipelines_repository_ref_created_at_idx ON pipelines (repository, ref, created_at);
+CREATE INDEX pipelines_organization_created_at_idx ON pipelines (organization, created_at);
+
+CREATE TABLE api_tokens (
+    id         TEXT PRIMARY KEY,
+    hash       TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE TABLE teams (
+    name       TEXT PRIMARY KEY,
+    updated_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE TABLE role_bindings (
+    id         TEXT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE TABLE organizations (
+    name                    TEXT PRIMARY KEY,
+    registration_token_hash TEXT NOT NULL UNIQUE,
+    created_at              TIMESTAMP NOT NULL,
+    data                    BLOB NOT NULL
+);
+
+-- Deleting an organization that still owns projects is refused.
+CREATE TABLE projects (
+    name         TEXT PRIMARY KEY,
+    organization TEXT NOT NULL REFERENCES organizations (name),
+    created_at   TIMESTAMP NOT NULL,
+    data         BLOB NOT NULL
+);
+
+CREATE INDEX projects_organization_idx ON projects (organization);
+
+CREATE TABLE artifacts (
+    job_id     TEXT NOT NULL,
+    path       TEXT NOT NULL,
+    expires_at TIMESTAMP,
+    data       BLOB NOT NULL,
+    PRIMARY KEY (job_id, path)
+);
+
+CREATE INDEX artifacts_expires_at_idx ON artifacts (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE test_reports (
+    job_id     TEXT NOT NULL,
+    path       TEXT NOT NULL,
+    project    TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL,
+    PRIMARY KEY (job_id, path)
+);
+
+CREATE INDEX test_reports_project_created_at_idx ON test_reports (project, created_at);
+
+CREATE TABLE job_logs (
+    job_id     TEXT PRIMARY KEY,
+    expires_at TIMESTAMP,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX job_logs_expires_at_idx ON job_logs (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE workspace_snapshots (
+    job_id     TEXT PRIMARY KEY,
+    expires_at TIMESTAMP,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX workspace_snapshots_expires_at_idx ON workspace_snapshots (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE cache_entries (
+    project      TEXT NOT NULL,
+    key          TEXT NOT NULL,
+    digest       TEXT NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    data         BLOB NOT NULL,
+    PRIMARY KEY (project, key)
+);
+
+CREATE INDEX cache_entries_digest_idx ON cache_entries (digest);
+
+CREATE TABLE secrets (
+    project     TEXT NOT NULL,
+    name        TEXT NOT NULL,
+    key_id      TEXT NOT NULL,
+    wrapped_key BLOB NOT NULL,
+    ciphertext  BLOB NOT NULL,
+    data        BLOB NOT NULL,
+    PRIMARY KEY (project, name)
+);
+
+CREATE TABLE variables (
+    project TEXT NOT NULL,
+    name    TEXT NOT NULL,
+    data    BLOB NOT NULL,
+    PRIMARY KEY (project, name)
+);
+
+CREATE TABLE protected_branches (
+    project TEXT PRIMARY KEY,
+    data    BLOB NOT NULL
+);
+
+CREATE TABLE project_quotas (
+    project TEXT PRIMARY KEY,
+    data    BLOB NOT NULL
+);
+
+CREATE TABLE templates (
+    name       TEXT NOT NULL,
+    version    TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL,
+    PRIMARY KEY (name, version)
+);
+
+CREATE TABLE webhook_deliveries (
+    id         TEXT PRIMARY KEY,
+    provider   TEXT NOT NULL,
+    repository TEXT NOT NULL,
+    event      TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_created_at_idx ON webhook_deliveries (created_at);
+CREATE INDEX webhook_deliveries_status_created_at_idx ON webhook_deliveries (status, created_at);
+CREATE INDEX webhook_deliveries_repository_created_at_idx ON webhook_deliveries (repository, created_at);
+
+CREATE TABLE schedules (
+    id          TEXT PRIMARY KEY,
+    repository  TEXT NOT NULL,
+    enabled     BOOLEAN NOT NULL,
+    next_run_at TIMESTAMP,
+    created_at  TIMESTAMP NOT NULL,
+    data        BLOB NOT NULL
+);
+
+CREATE INDEX schedules_next_run_at_idx ON schedules (next_run_at) WHERE enabled;
+
+CREATE TABLE environments (
+    project    TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL,
+    PRIMARY KEY (project, name)
+);
+
+CREATE TABLE deployments (
+    id          TEXT PRIMARY KEY,
+    project     TEXT NOT NULL,
+    environment TEXT NOT NULL,
+    created_at  TIMESTAMP NOT NULL,
+    updated_at  TIMESTAMP NOT NULL,
+    data        BLOB NOT NULL
+);
+
+CREATE INDEX deployments_environment_created_at_idx ON deployments (project, environment, created_at);
+
+CREATE TABLE notifiers (
+    id         TEXT PRIMARY KEY,
+    project    TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX notifiers_project_idx ON notifiers (project, created_at);
+
+-- The audit log is append-only: triggers refuse to change or delete events.
+CREATE TABLE audit_events (
+    id         TEXT PRIMARY KEY,
+    actor      TEXT NOT NULL,
+    resource   TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_created_at_idx ON audit_events (actor, created_at);
+CREATE INDEX audit_events_resource_idx ON audit_events (resource);
+
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events cannot be changed or deleted');
+END;
+
+CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events cannot be changed or deleted');
+END;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS job_log_lines_search;
+DROP TABLE IF EXISTS job_log_lines;
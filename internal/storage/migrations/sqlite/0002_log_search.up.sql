@@ -0,0 +1,27 @@
+-- Full-text index of the logs of finished jobs, one row per line, kept in
+-- job_log_lines_search by triggers. Lines are dropped along with their
+-- job's log record.
+
+CREATE TABLE job_log_lines (
+    id         TEXT PRIMARY KEY,
+    job_id     TEXT NOT NULL,
+    project    TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX job_log_lines_job_id_idx ON job_log_lines (job_id);
+CREATE INDEX job_log_lines_created_at_idx ON job_log_lines (created_at, id);
+
+CREATE VIRTUAL TABLE job_log_lines_search USING fts5 (text, tokenize = 'unicode61');
+
+CREATE TRIGGER job_log_lines_search_insert AFTER INSERT ON job_log_lines
+BEGIN
+    INSERT INTO job_log_lines_search (rowid, text)
+    VALUES (new.rowid, json_extract(CAST(new.data AS TEXT), '$.text'));
+END;
+
+CREATE TRIGGER job_log_lines_search_delete AFTER DELETE ON job_log_lines
+BEGIN
+    DELETE FROM job_log_lines_search WHERE rowid = old.rowid;
+END;
@@ -0,0 +1,7 @@
+-- The notification preferences of users: the projects they follow by email
+-- and the events they muted.
+
+CREATE TABLE notification_preferences (
+    user_name TEXT PRIMARY KEY,
+    data      BLOB NOT NULL
+);
@@ -0,0 +1,10 @@
+-- Registration tokens handed out for registering agents, with an expiry, a
+-- use limit and the labels their agents may carry. Only the SHA-256 hash of
+-- each secret is stored.
+
+CREATE TABLE agent_tokens (
+    id         TEXT PRIMARY KEY,
+    hash       TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
@@ -0,0 +1,11 @@
+-- Warnings, errors and markdown summaries the steps of a run publish while
+-- their jobs run. seq keeps them in the order they were published.
+
+CREATE TABLE annotations (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id     TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data       BLOB NOT NULL
+);
+
+CREATE INDEX annotations_job_id_idx ON annotations (job_id);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS notifier_deliveries;
+DELETE FROM notifiers WHERE organization <> '';
+DROP INDEX IF EXISTS notifiers_organization_idx;
+ALTER TABLE notifiers DROP COLUMN organization;
+ALTER TABLE notifiers DROP COLUMN key_id;
+ALTER TABLE notifiers DROP COLUMN wrapped_key;
+ALTER TABLE notifiers DROP COLUMN ciphertext;
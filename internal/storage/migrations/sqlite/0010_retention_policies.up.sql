@@ -0,0 +1,8 @@
+-- Retention policies say how many runs of a project garbage collection
+-- keeps, how long it keeps their artifacts and logs, and how large the
+-- project's caches may grow.
+
+CREATE TABLE retention_policies (
+    project TEXT PRIMARY KEY,
+    data    BLOB NOT NULL
+);
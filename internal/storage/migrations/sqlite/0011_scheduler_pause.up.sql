@@ -0,0 +1,7 @@
+-- The server-wide pause of scheduling, set by admins during incidents. The
+-- table holds at most one row, whose presence means scheduling is paused.
+
+CREATE TABLE scheduler_pause (
+    singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+    data      BLOB NOT NULL
+);
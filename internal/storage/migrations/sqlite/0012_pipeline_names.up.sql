@@ -0,0 +1,4 @@
+-- Runs of a pipeline are looked up by name, to start the pipeline again
+-- with other inputs.
+
+CREATE INDEX pipelines_repository_name_created_at_idx ON pipelines (repository, name, created_at);
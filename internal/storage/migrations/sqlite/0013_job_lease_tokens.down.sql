@@ -0,0 +1,2 @@
+UPDATE jobs SET data = CAST(json_set(CAST(data AS TEXT), '$.lease_token', lease_token) AS BLOB) WHERE lease_token <> 0;
+ALTER TABLE jobs DROP COLUMN lease_token;
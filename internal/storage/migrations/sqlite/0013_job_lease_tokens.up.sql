@@ -0,0 +1,9 @@
+-- The fencing token of each job's lease is kept out of the job document,
+-- which is served to anyone who may view the job, so that only the agent
+-- it was assigned to knows it.
+
+ALTER TABLE jobs ADD COLUMN lease_token INTEGER NOT NULL DEFAULT 0;
+
+UPDATE jobs
+SET lease_token = COALESCE(json_extract(CAST(data AS TEXT), '$.lease_token'), 0),
+    data        = CAST(json_remove(CAST(data AS TEXT), '$.lease_token') AS BLOB);
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgres is the dialect of PostgreSQL.
+var postgres = &dialect{
+	migrations:       "migrations",
+	lockMigrations:   `SELECT pg_advisory_lock($1)`,
+	unlockMigrations: `SELECT pg_advisory_unlock($1)`,
+	forUpdate:        " FOR UPDATE",
+	anyOf: func(n int) string {
+		return fmt.Sprintf("= ANY($%d)", n)
+	},
+	list: func(values []string) any {
+		return pq.Array(values)
+	},
+	withoutPayload: "data - 'payload'",
+	matchLogs: func(n int, query string) (string, any) {
+		return fmt.Sprintf("search @@ websearch_to_tsquery('simple', $%d)", n), query
+	},
+	tryLock: postgresTryLock,
+}
+
+// OpenPostgres connects to PostgreSQL, verifies the connection and applies
+// pending migrations.
+func OpenPostgres(ctx context.Context, databaseURL string) (*SQL, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("storage: opening postgres: %w", err)
+	}
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: connecting to postgres: %w", err)
+	}
+	if err := migrate(ctx, db, postgres); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: migrating postgres: %w", err)
+	}
+	return &SQL{db: db, dialect: postgres}, nil
+}
+
+// leaseCheckInterval is how often a held advisory lock's connection is
+// checked.
+const leaseCheckInterval = 5 * time.Second
+
+// postgresLease is a session-level advisory lock, held for as long as the
+// connection that took it stays open.
+type postgresLease struct {
+	conn *sql.Conn
+	key  int64
+	lost chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// postgresTryLock takes an advisory lock keyed by the hash of name on a
+// connection of its own. If the connection breaks, PostgreSQL releases the
+// lock once it notices, which is never before the lease below does.
+func postgresTryLock(ctx context.Context, db *sql.DB, name string) (Lease, bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	key := int64(h.Sum64())
+	var held bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&held); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !held {
+		conn.Close()
+		return nil, false, nil
+	}
+	l := &postgresLease{conn: conn, key: key, lost: make(chan struct{}), stop: make(chan struct{}), done: make(chan struct{})}
+	go l.watch()
+	return l, true, nil
+}
+
+// watch closes l.lost as soon as the connection holding the lock fails.
+func (l *postgresLease) watch() {
+	defer close(l.done)
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), leaseCheckInterval)
+		_, err := l.conn.ExecContext(ctx, `SELECT 1`)
+		cancel()
+		if err != nil {
+			close(l.lost)
+			return
+		}
+	}
+}
+
+func (l *postgresLease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release unlocks and returns the connection to the pool. A connection that
+// lost the lock, or could not unlock it, is discarded instead, since only
+// closing its session frees the lock for sure.
+func (l *postgresLease) Release(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		discard := true
+		select {
+		case <-l.lost:
+		default:
+			_, err = l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, l.key)
+			discard = err != nil
+		}
+		if discard {
+			l.conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		l.conn.Close()
+	})
+	return err
+}
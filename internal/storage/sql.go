@@ -0,0 +1,2204 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"open-cicd/internal/types"
+)
+
+// SQL implements Store on top of a SQL database: PostgreSQL, opened by
+// OpenPostgres, or SQLite, opened by OpenSQLite.
+type SQL struct {
+	db      *sql.DB
+	dialect *dialect
+}
+
+// dialect holds what differs between the databases SQL runs on.
+type dialect struct {
+	// migrations is the directory of the database's embedded migrations.
+	migrations string
+	// lockMigrations and unlockMigrations take and give up the lock, keyed
+	// by $1, that serialises the migration runs of several servers. They
+	// are empty where a single server uses the database.
+	lockMigrations, unlockMigrations string
+	// forUpdate ends a SELECT that locks the rows it reads until the end of
+	// the transaction. It is empty where transactions lock the whole
+	// database as they begin.
+	forUpdate string
+	// anyOf returns the condition that a column, written before it, equals
+	// one of the values of argument $n, which list makes.
+	anyOf func(n int) string
+	list  func(values []string) any
+	// withoutPayload selects the document of a webhook delivery without its
+	// payload.
+	withoutPayload string
+	// matchLogs returns the condition that a log line matches query,
+	// given as argument $n, and the argument.
+	matchLogs func(n int, query string) (string, any)
+	// tryLock implements TryLock.
+	tryLock func(ctx context.Context, db *sql.DB, name string) (Lease, bool, error)
+}
+
+// Close closes the underlying connection pool.
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks the connection to the database.
+func (s *SQL) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Schema reads the version of the schema from schema_migrations.
+func (s *SQL) Schema(ctx context.Context) (SchemaStatus, error) {
+	latest, err := latestMigration(s.dialect.migrations)
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	version, dirty, err := schemaVersion(ctx, s.db)
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	return SchemaStatus{Version: version, Latest: latest, Dirty: dirty}, nil
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (s *SQL) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isUniqueViolation reports whether err is a violation of a unique or
+// primary key constraint.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var liteErr *sqlite.Error
+	return errors.As(err, &liteErr) &&
+		(liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+// isForeignKeyViolation reports whether err is a violation of a foreign key
+// constraint.
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503"
+	}
+	var liteErr *sqlite.Error
+	return errors.As(err, &liteErr) && liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+}
+
+// decodeDoc unmarshals a JSON document column, mapping sql.ErrNoRows to
+// ErrNotFound.
+func decodeDoc(scanErr error, data []byte, v any) error {
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	return json.Unmarshal(data, v)
+}
+
+// pageSQL returns the condition that selects the records after p.After and
+// the ORDER BY and LIMIT clauses of p, along with their arguments. The
+// arguments are numbered from $n on.
+func pageSQL(p Page, n int) (after, order string, args []any) {
+	column, cmp, dir := "created_at", ">", "ASC"
+	if p.Sort == SortUpdated {
+		column = "updated_at"
+	}
+	if p.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	after = "TRUE"
+	if p.After != nil {
+		after = fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, cmp, n, n+1)
+		args = append(args, p.After.Time, p.After.ID)
+		n += 2
+	}
+	order = fmt.Sprintf("ORDER BY %s %s, id %s", column, dir, dir)
+	if p.Limit > 0 {
+		order += fmt.Sprintf(" LIMIT $%d", n)
+		args = append(args, p.Limit)
+	}
+	return after, order, args
+}
+
+// Agents
+
+func (s *SQL) CreateAgent(ctx context.Context, agent *types.Agent) error {
+	data, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO agents (id, hostname, state, credential_hash, registered_at, updated_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		agent.ID, agent.Hostname, agent.State, agent.CredentialHash, agent.RegisteredAt, agent.UpdatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanAgent(row interface{ Scan(...any) error }) (*types.Agent, error) {
+	var (
+		agent types.Agent
+		hash  string
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&hash, &data), data, &agent); err != nil {
+		return nil, err
+	}
+	agent.CredentialHash = hash
+	return &agent, nil
+}
+
+func (s *SQL) GetAgent(ctx context.Context, id string) (*types.Agent, error) {
+	return scanAgent(s.db.QueryRowContext(ctx, `SELECT credential_hash, data FROM agents WHERE id = $1`, id))
+}
+
+func (s *SQL) ListAgents(ctx context.Context) ([]*types.Agent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT credential_hash, data FROM agents ORDER BY registered_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	agents := []*types.Agent{}
+	for rows.Next() {
+		agent, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+	return agents, rows.Err()
+}
+
+func (s *SQL) UpdateAgent(ctx context.Context, id string, fn func(*types.Agent) error) (*types.Agent, error) {
+	var agent *types.Agent
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		agent, err = scanAgent(tx.QueryRowContext(ctx, `SELECT credential_hash, data FROM agents WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(agent); err != nil {
+			return err
+		}
+		data, err := json.Marshal(agent)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE agents SET hostname = $2, state = $3, credential_hash = $4, updated_at = $5, data = $6
+			WHERE id = $1`,
+			agent.ID, agent.Hostname, agent.State, agent.CredentialHash, agent.UpdatedAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// Jobs
+
+func (s *SQL) CreateJob(ctx context.Context, job *types.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO jobs (id, name, state, agent_id, repository, organization, ref, lease_token, created_at, updated_at, data)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10, $11)`,
+		job.ID, job.Name, job.State, job.AgentID, job.Repository, job.Organization, job.Ref, job.LeaseToken, job.CreatedAt, job.UpdatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanJob(row interface{ Scan(...any) error }) (*types.Job, error) {
+	var (
+		job   types.Job
+		token int64
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&token, &data), data, &job); err != nil {
+		return nil, err
+	}
+	job.LeaseToken = token
+	return &job, nil
+}
+
+func (s *SQL) GetJob(ctx context.Context, id string) (*types.Job, error) {
+	return scanJob(s.db.QueryRowContext(ctx, `SELECT lease_token, data FROM jobs WHERE id = $1`, id))
+}
+
+func (s *SQL) ListJobs(ctx context.Context, filter JobFilter) ([]*types.Job, error) {
+	after, order, args := pageSQL(filter.Page, 6)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT lease_token, data FROM jobs
+		WHERE ($1 = '' OR state = $1)
+		  AND ($2 = '' OR repository = $2)
+		  AND ($3 = '' OR ref IN ('refs/heads/' || $3, $3))
+		  AND ($4 = '' OR agent_id = $4)
+		  AND ($5 = '' OR organization = $5)
+		  AND `+after+`
+		`+order,
+		append([]any{filter.State, filter.Repository, filter.Branch, filter.AgentID, filter.Organization}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*types.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *SQL) CountJobs(ctx context.Context, repository string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM jobs WHERE repository = $1 AND created_at >= $2`,
+		repository, since).Scan(&n)
+	return n, err
+}
+
+func (s *SQL) UpdateJob(ctx context.Context, id string, fn func(*types.Job) error) (*types.Job, error) {
+	var job *types.Job
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		job, err = scanJob(tx.QueryRowContext(ctx, `SELECT lease_token, data FROM jobs WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE jobs SET name = $2, state = $3, agent_id = NULLIF($4, ''), lease_token = $5, updated_at = $6, data = $7
+			WHERE id = $1`,
+			job.ID, job.Name, job.State, job.AgentID, job.LeaseToken, job.UpdatedAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *SQL) DeleteJob(ctx context.Context, id string) error {
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"test_reports", "annotations"} {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE job_id = $1`, id); err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	if err == nil && deleted == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Pipelines
+
+func (s *SQL) CreatePipeline(ctx context.Context, pipeline *types.Pipeline) error {
+	data, err := json.Marshal(pipeline)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO pipelines (id, name, state, repository, organization, ref, created_at, updated_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		pipeline.ID, pipeline.Name, pipeline.State, pipeline.Repository, pipeline.Organization, pipeline.Ref, pipeline.CreatedAt, pipeline.UpdatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanPipeline(row interface{ Scan(...any) error }) (*types.Pipeline, error) {
+	var (
+		pipeline types.Pipeline
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &pipeline); err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+func (s *SQL) GetPipeline(ctx context.Context, id string) (*types.Pipeline, error) {
+	return scanPipeline(s.db.QueryRowContext(ctx, `SELECT data FROM pipelines WHERE id = $1`, id))
+}
+
+func (s *SQL) ListPipelines(ctx context.Context, filter PipelineFilter) ([]*types.Pipeline, error) {
+	after, order, args := pageSQL(filter.Page, 6)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM pipelines
+		WHERE ($1 = '' OR state = $1)
+		  AND ($2 = '' OR repository = $2)
+		  AND ($3 = '' OR ref IN ('refs/heads/' || $3, $3))
+		  AND ($4 = '' OR organization = $4)
+		  AND ($5 = '' OR name = $5)
+		  AND `+after+`
+		`+order,
+		append([]any{filter.State, filter.Repository, filter.Branch, filter.Organization, filter.Name}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pipelines := []*types.Pipeline{}
+	for rows.Next() {
+		pipeline, err := scanPipeline(rows)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	return pipelines, rows.Err()
+}
+
+func (s *SQL) LatestPipeline(ctx context.Context, repository string, refs []string, states []types.PipelineState) (*types.Pipeline, error) {
+	stateNames := make([]string, len(states))
+	for i, state := range states {
+		stateNames[i] = string(state)
+	}
+	return scanPipeline(s.db.QueryRowContext(ctx, `
+		SELECT data FROM pipelines
+		WHERE repository = $1 AND ref `+s.dialect.anyOf(2)+` AND state `+s.dialect.anyOf(3)+`
+		ORDER BY created_at DESC
+		LIMIT 1`, repository, s.dialect.list(refs), s.dialect.list(stateNames)))
+}
+
+func (s *SQL) UpdatePipeline(ctx context.Context, id string, fn func(*types.Pipeline) error) (*types.Pipeline, error) {
+	var pipeline *types.Pipeline
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		pipeline, err = scanPipeline(tx.QueryRowContext(ctx, `SELECT data FROM pipelines WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(pipeline); err != nil {
+			return err
+		}
+		data, err := json.Marshal(pipeline)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE pipelines SET name = $2, state = $3, updated_at = $4, data = $5
+			WHERE id = $1`,
+			pipeline.ID, pipeline.Name, pipeline.State, pipeline.UpdatedAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (s *SQL) DeletePipeline(ctx context.Context, id string) error {
+	return s.execRow(ctx, `DELETE FROM pipelines WHERE id = $1`, id)
+}
+
+// API tokens
+
+func (s *SQL) CreateToken(ctx context.Context, token *types.APIToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO api_tokens (id, hash, created_at, data)
+		VALUES ($1, $2, $3, $4)`,
+		token.ID, token.Hash, token.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanToken(row interface{ Scan(...any) error }) (*types.APIToken, error) {
+	var (
+		token types.APIToken
+		hash  string
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&hash, &data), data, &token); err != nil {
+		return nil, err
+	}
+	token.Hash = hash
+	return &token, nil
+}
+
+func (s *SQL) GetTokenByHash(ctx context.Context, hash string) (*types.APIToken, error) {
+	return scanToken(s.db.QueryRowContext(ctx, `SELECT hash, data FROM api_tokens WHERE hash = $1`, hash))
+}
+
+func (s *SQL) ListTokens(ctx context.Context) ([]*types.APIToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT hash, data FROM api_tokens ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*types.APIToken{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQL) DeleteToken(ctx context.Context, id string) error {
+	return s.execRow(ctx, `DELETE FROM api_tokens WHERE id = $1`, id)
+}
+
+// Agent registration tokens
+
+func (s *SQL) CreateAgentToken(ctx context.Context, token *types.AgentToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO agent_tokens (id, hash, created_at, data)
+		VALUES ($1, $2, $3, $4)`,
+		token.ID, token.Hash, token.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanAgentToken(row interface{ Scan(...any) error }) (*types.AgentToken, error) {
+	var (
+		token types.AgentToken
+		hash  string
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&hash, &data), data, &token); err != nil {
+		return nil, err
+	}
+	token.Hash = hash
+	return &token, nil
+}
+
+func (s *SQL) GetAgentToken(ctx context.Context, id string) (*types.AgentToken, error) {
+	return scanAgentToken(s.db.QueryRowContext(ctx, `SELECT hash, data FROM agent_tokens WHERE id = $1`, id))
+}
+
+func (s *SQL) GetAgentTokenByHash(ctx context.Context, hash string) (*types.AgentToken, error) {
+	return scanAgentToken(s.db.QueryRowContext(ctx, `SELECT hash, data FROM agent_tokens WHERE hash = $1`, hash))
+}
+
+func (s *SQL) ListAgentTokens(ctx context.Context) ([]*types.AgentToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT hash, data FROM agent_tokens ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*types.AgentToken{}
+	for rows.Next() {
+		token, err := scanAgentToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQL) UpdateAgentToken(ctx context.Context, id string, fn func(*types.AgentToken) error) (*types.AgentToken, error) {
+	var token *types.AgentToken
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		token, err = scanAgentToken(tx.QueryRowContext(ctx, `SELECT hash, data FROM agent_tokens WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(token); err != nil {
+			return err
+		}
+		data, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE agent_tokens SET data = $2 WHERE id = $1`, token.ID, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Role bindings and teams
+
+func (s *SQL) CreateRoleBinding(ctx context.Context, binding *types.RoleBinding) error {
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO role_bindings (id, created_at, data)
+		VALUES ($1, $2, $3)`,
+		binding.ID, binding.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQL) ListRoleBindings(ctx context.Context) ([]*types.RoleBinding, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM role_bindings ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bindings := []*types.RoleBinding{}
+	for rows.Next() {
+		var (
+			binding types.RoleBinding
+			data    []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &binding); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, &binding)
+	}
+	return bindings, rows.Err()
+}
+
+func (s *SQL) DeleteRoleBinding(ctx context.Context, id string) error {
+	return s.execRow(ctx, `DELETE FROM role_bindings WHERE id = $1`, id)
+}
+
+func (s *SQL) PutTeam(ctx context.Context, team *types.Team) error {
+	data, err := json.Marshal(team)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO teams (name, updated_at, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET updated_at = EXCLUDED.updated_at, data = EXCLUDED.data`,
+		team.Name, team.UpdatedAt, data)
+	return err
+}
+
+func (s *SQL) ListTeams(ctx context.Context) ([]*types.Team, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM teams ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	teams := []*types.Team{}
+	for rows.Next() {
+		var (
+			team types.Team
+			data []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &team); err != nil {
+			return nil, err
+		}
+		teams = append(teams, &team)
+	}
+	return teams, rows.Err()
+}
+
+func (s *SQL) DeleteTeam(ctx context.Context, name string) error {
+	return s.execRow(ctx, `DELETE FROM teams WHERE name = $1`, name)
+}
+
+// Organizations and projects
+
+func (s *SQL) CreateOrganization(ctx context.Context, org *types.Organization) error {
+	data, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO organizations (name, registration_token_hash, created_at, data)
+		VALUES ($1, $2, $3, $4)`,
+		org.Name, org.RegistrationTokenHash, org.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanOrganization(row interface{ Scan(...any) error }) (*types.Organization, error) {
+	var (
+		org  types.Organization
+		hash string
+		data []byte
+	)
+	if err := decodeDoc(row.Scan(&hash, &data), data, &org); err != nil {
+		return nil, err
+	}
+	org.RegistrationTokenHash = hash
+	return &org, nil
+}
+
+func (s *SQL) GetOrganization(ctx context.Context, name string) (*types.Organization, error) {
+	return scanOrganization(s.db.QueryRowContext(ctx, `SELECT registration_token_hash, data FROM organizations WHERE name = $1`, name))
+}
+
+func (s *SQL) ListOrganizations(ctx context.Context) ([]*types.Organization, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT registration_token_hash, data FROM organizations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []*types.Organization{}
+	for rows.Next() {
+		org, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *SQL) UpdateOrganization(ctx context.Context, name string, fn func(*types.Organization) error) (*types.Organization, error) {
+	var org *types.Organization
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		org, err = scanOrganization(tx.QueryRowContext(ctx, `SELECT registration_token_hash, data FROM organizations WHERE name = $1`+s.dialect.forUpdate, name))
+		if err != nil {
+			return err
+		}
+		if err := fn(org); err != nil {
+			return err
+		}
+		data, err := json.Marshal(org)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE organizations SET registration_token_hash = $2, data = $3
+			WHERE name = $1`,
+			org.Name, org.RegistrationTokenHash, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (s *SQL) DeleteOrganization(ctx context.Context, name string) error {
+	err := s.execRow(ctx, `DELETE FROM organizations WHERE name = $1`, name)
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("organization %s still owns projects", name)
+	}
+	return err
+}
+
+func (s *SQL) CreateProject(ctx context.Context, project *types.Project) error {
+	data, err := json.Marshal(project)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO projects (name, organization, created_at, data)
+		VALUES ($1, $2, $3, $4)`,
+		project.Name, project.Organization, project.CreatedAt, data)
+	switch {
+	case isUniqueViolation(err):
+		return ErrConflict
+	case isForeignKeyViolation(err):
+		return ErrNotFound
+	}
+	return err
+}
+
+func scanProject(row interface{ Scan(...any) error }) (*types.Project, error) {
+	var (
+		project types.Project
+		data    []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &project); err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+func (s *SQL) GetProject(ctx context.Context, name string) (*types.Project, error) {
+	return scanProject(s.db.QueryRowContext(ctx, `SELECT data FROM projects WHERE name = $1`, name))
+}
+
+func (s *SQL) ListProjects(ctx context.Context) ([]*types.Project, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM projects ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	projects := []*types.Project{}
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+// Artifacts
+
+func (s *SQL) PutArtifact(ctx context.Context, artifact *types.Artifact) error {
+	data, err := json.Marshal(artifact)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO artifacts (job_id, path, expires_at, data)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (job_id, path) DO UPDATE SET expires_at = EXCLUDED.expires_at, data = EXCLUDED.data`,
+		artifact.JobID, artifact.Path, artifact.ExpiresAt, data)
+	return err
+}
+
+func (s *SQL) GetArtifact(ctx context.Context, jobID, path string) (*types.Artifact, error) {
+	var (
+		artifact types.Artifact
+		data     []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM artifacts WHERE job_id = $1 AND path = $2`, jobID, path)
+	if err := decodeDoc(row.Scan(&data), data, &artifact); err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+func (s *SQL) ListArtifacts(ctx context.Context, jobID string) ([]*types.Artifact, error) {
+	return s.listArtifacts(ctx, `SELECT data FROM artifacts WHERE job_id = $1 ORDER BY path`, jobID)
+}
+
+func (s *SQL) ListExpiredArtifacts(ctx context.Context, t time.Time, limit int) ([]*types.Artifact, error) {
+	return s.listArtifacts(ctx, `
+		SELECT data FROM artifacts WHERE expires_at < $1
+		ORDER BY expires_at LIMIT $2`, t, limit)
+}
+
+func (s *SQL) listArtifacts(ctx context.Context, query string, args ...any) ([]*types.Artifact, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	artifacts := []*types.Artifact{}
+	for rows.Next() {
+		var (
+			artifact types.Artifact
+			data     []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &artifact); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, &artifact)
+	}
+	return artifacts, rows.Err()
+}
+
+func (s *SQL) DeleteArtifact(ctx context.Context, jobID, path string) error {
+	return s.execRow(ctx, `DELETE FROM artifacts WHERE job_id = $1 AND path = $2`, jobID, path)
+}
+
+func (s *SQL) PutTestReport(ctx context.Context, report *types.TestReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO test_reports (job_id, path, project, created_at, data)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (job_id, path) DO UPDATE SET created_at = EXCLUDED.created_at, data = EXCLUDED.data`,
+		report.JobID, report.Path, report.Project, report.CreatedAt, data)
+	return err
+}
+
+func (s *SQL) ListTestReports(ctx context.Context, jobID string) ([]*types.TestReport, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM test_reports WHERE job_id = $1 ORDER BY path`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := []*types.TestReport{}
+	for rows.Next() {
+		var (
+			report types.TestReport
+			data   []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, &report)
+	}
+	return reports, rows.Err()
+}
+
+// Annotations
+
+func (s *SQL) AddAnnotations(ctx context.Context, annotations []*types.Annotation) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, a := range annotations {
+			data, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO annotations (job_id, created_at, data) VALUES ($1, $2, $3)`,
+				a.JobID, a.CreatedAt, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQL) ListAnnotations(ctx context.Context, jobIDs []string) ([]*types.Annotation, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM annotations WHERE job_id `+s.dialect.anyOf(1)+` ORDER BY seq`, s.dialect.list(jobIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	annotations := []*types.Annotation{}
+	for rows.Next() {
+		var (
+			a    types.Annotation
+			data []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &a); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, &a)
+	}
+	return annotations, rows.Err()
+}
+
+func (s *SQL) CountAnnotations(ctx context.Context, jobID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM annotations WHERE job_id = $1`, jobID).Scan(&n)
+	return n, err
+}
+
+// Job logs
+
+func (s *SQL) PutJobLog(ctx context.Context, log *types.JobLog) error {
+	data, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO job_logs (job_id, expires_at, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (job_id) DO UPDATE SET expires_at = EXCLUDED.expires_at, data = EXCLUDED.data`,
+		log.JobID, log.ExpiresAt, data)
+	return err
+}
+
+func (s *SQL) GetJobLog(ctx context.Context, jobID string) (*types.JobLog, error) {
+	var (
+		log  types.JobLog
+		data []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM job_logs WHERE job_id = $1`, jobID)
+	if err := decodeDoc(row.Scan(&data), data, &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (s *SQL) ListExpiredJobLogs(ctx context.Context, t time.Time, limit int) ([]*types.JobLog, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM job_logs WHERE expires_at < $1
+		ORDER BY expires_at LIMIT $2`, t, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []*types.JobLog{}
+	for rows.Next() {
+		var (
+			log  types.JobLog
+			data []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &log); err != nil {
+			return nil, err
+		}
+		logs = append(logs, &log)
+	}
+	return logs, rows.Err()
+}
+
+func (s *SQL) DeleteJobLog(ctx context.Context, jobID string) error {
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM job_log_lines WHERE job_id = $1`, jobID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM job_logs WHERE job_id = $1`, jobID)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	if err == nil && deleted == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Log search
+
+func (s *SQL) IndexJobLog(ctx context.Context, jobID string, lines []*types.LogLine) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM job_log_lines WHERE job_id = $1`, jobID); err != nil {
+			return err
+		}
+		stmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO job_log_lines (id, job_id, project, created_at, data)
+			VALUES ($1, $2, $3, $4, $5)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, line := range lines {
+			data, err := json.Marshal(line)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.ExecContext(ctx, line.ID, line.JobID, line.Project, line.FinishedAt, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQL) SearchLogs(ctx context.Context, search LogSearch) ([]*types.LogLine, error) {
+	// Lines have one time only, kept in created_at.
+	search.Page.Sort = SortCreated
+	match, query := s.dialect.matchLogs(1, search.Query)
+	after, order, args := pageSQL(search.Page, 4)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM job_log_lines
+		WHERE `+match+`
+		  AND ($2 = '' OR project = $2)
+		  AND ($3 = '' OR job_id = $3)
+		  AND `+after+`
+		`+order,
+		append([]any{query, search.Project, search.JobID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lines := []*types.LogLine{}
+	for rows.Next() {
+		var (
+			data []byte
+			line types.LogLine
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, &line)
+	}
+	return lines, rows.Err()
+}
+
+// Workspace snapshots
+
+func (s *SQL) PutSnapshot(ctx context.Context, snapshot *types.WorkspaceSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO workspace_snapshots (job_id, expires_at, data)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (job_id) DO UPDATE SET expires_at = EXCLUDED.expires_at, data = EXCLUDED.data`,
+		snapshot.JobID, snapshot.ExpiresAt, data)
+	return err
+}
+
+func (s *SQL) GetSnapshot(ctx context.Context, jobID string) (*types.WorkspaceSnapshot, error) {
+	var (
+		snapshot types.WorkspaceSnapshot
+		data     []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM workspace_snapshots WHERE job_id = $1`, jobID)
+	if err := decodeDoc(row.Scan(&data), data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *SQL) ListExpiredSnapshots(ctx context.Context, t time.Time, limit int) ([]*types.WorkspaceSnapshot, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM workspace_snapshots WHERE expires_at < $1
+		ORDER BY expires_at LIMIT $2`, t, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshots := []*types.WorkspaceSnapshot{}
+	for rows.Next() {
+		var (
+			snapshot types.WorkspaceSnapshot
+			data     []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+func (s *SQL) DeleteSnapshot(ctx context.Context, jobID string) error {
+	return s.execRow(ctx, `DELETE FROM workspace_snapshots WHERE job_id = $1`, jobID)
+}
+
+// Cache entries
+
+func (s *SQL) PutCacheEntry(ctx context.Context, entry *types.CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO cache_entries (project, key, digest, last_used_at, data)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (project, key) DO UPDATE
+		SET digest = EXCLUDED.digest, last_used_at = EXCLUDED.last_used_at, data = EXCLUDED.data`,
+		entry.Project, entry.Key, entry.Digest, entry.LastUsedAt, data)
+	return err
+}
+
+// scanCacheEntry decodes an entry. The last_used_at column is authoritative
+// since TouchCacheEntry only updates the column.
+func scanCacheEntry(row interface{ Scan(...any) error }) (*types.CacheEntry, error) {
+	var (
+		entry    types.CacheEntry
+		lastUsed time.Time
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&lastUsed, &data), data, &entry); err != nil {
+		return nil, err
+	}
+	entry.LastUsedAt = lastUsed
+	return &entry, nil
+}
+
+func (s *SQL) GetCacheEntry(ctx context.Context, project, key string) (*types.CacheEntry, error) {
+	return scanCacheEntry(s.db.QueryRowContext(ctx, `
+		SELECT last_used_at, data FROM cache_entries WHERE project = $1 AND key = $2`, project, key))
+}
+
+func (s *SQL) TouchCacheEntry(ctx context.Context, project, key string, t time.Time) error {
+	return s.execRow(ctx, `UPDATE cache_entries SET last_used_at = $3 WHERE project = $1 AND key = $2`, project, key, t)
+}
+
+func (s *SQL) ListCacheEntries(ctx context.Context, project string) ([]*types.CacheEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT last_used_at, data FROM cache_entries WHERE project = $1
+		ORDER BY last_used_at, key`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*types.CacheEntry{}
+	for rows.Next() {
+		entry, err := scanCacheEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQL) DeleteCacheEntry(ctx context.Context, project, key string) error {
+	return s.execRow(ctx, `DELETE FROM cache_entries WHERE project = $1 AND key = $2`, project, key)
+}
+
+func (s *SQL) CountCacheDigest(ctx context.Context, digest string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM cache_entries WHERE digest = $1`, digest).Scan(&n)
+	return n, err
+}
+
+func (s *SQL) AddCacheStats(ctx context.Context, delta *types.CacheStats) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO cache_stats (project, key, hits, fallback_hits, misses, saves, refused_saves, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (project, key) DO UPDATE
+		SET hits = cache_stats.hits + EXCLUDED.hits,
+			fallback_hits = cache_stats.fallback_hits + EXCLUDED.fallback_hits,
+			misses = cache_stats.misses + EXCLUDED.misses,
+			saves = cache_stats.saves + EXCLUDED.saves,
+			refused_saves = cache_stats.refused_saves + EXCLUDED.refused_saves,
+			updated_at = EXCLUDED.updated_at`,
+		delta.Project, delta.Key, delta.Hits, delta.FallbackHits, delta.Misses, delta.Saves, delta.RefusedSaves, delta.UpdatedAt)
+	return err
+}
+
+func (s *SQL) ListCacheStats(ctx context.Context, project string) ([]*types.CacheStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT project, key, hits, fallback_hits, misses, saves, refused_saves, updated_at
+		FROM cache_stats WHERE project = $1 ORDER BY key`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*types.CacheStats{}
+	for rows.Next() {
+		var stats types.CacheStats
+		if err := rows.Scan(&stats.Project, &stats.Key, &stats.Hits, &stats.FallbackHits, &stats.Misses, &stats.Saves, &stats.RefusedSaves, &stats.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, &stats)
+	}
+	return list, rows.Err()
+}
+
+// Secrets
+
+func (s *SQL) PutSecret(ctx context.Context, secret *types.Secret) error {
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO secrets (project, name, key_id, wrapped_key, ciphertext, data)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project, name) DO UPDATE
+		SET key_id = EXCLUDED.key_id, wrapped_key = EXCLUDED.wrapped_key,
+		    ciphertext = EXCLUDED.ciphertext, data = EXCLUDED.data`,
+		secret.Project, secret.Name, secret.Sealed.KeyID, secret.Sealed.WrappedKey, secret.Sealed.Ciphertext, data)
+	return err
+}
+
+// scanSecret decodes a secret. The sealed value is not part of the JSON
+// document and is restored from its columns.
+func scanSecret(row interface{ Scan(...any) error }) (*types.Secret, error) {
+	var (
+		secret types.Secret
+		sealed types.SealedValue
+		data   []byte
+	)
+	if err := decodeDoc(row.Scan(&sealed.KeyID, &sealed.WrappedKey, &sealed.Ciphertext, &data), data, &secret); err != nil {
+		return nil, err
+	}
+	secret.Sealed = sealed
+	return &secret, nil
+}
+
+func (s *SQL) GetSecret(ctx context.Context, project, name string) (*types.Secret, error) {
+	return scanSecret(s.db.QueryRowContext(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM secrets WHERE project = $1 AND name = $2`, project, name))
+}
+
+func (s *SQL) ListSecrets(ctx context.Context, project string) ([]*types.Secret, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM secrets WHERE project = $1 ORDER BY name`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	secrets := []*types.Secret{}
+	for rows.Next() {
+		secret, err := scanSecret(rows)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, rows.Err()
+}
+
+func (s *SQL) DeleteSecret(ctx context.Context, project, name string) error {
+	return s.execRow(ctx, `DELETE FROM secrets WHERE project = $1 AND name = $2`, project, name)
+}
+
+// SCM credentials
+
+func (s *SQL) PutSCMCredential(ctx context.Context, credential *types.SCMCredential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO scm_credentials (organization, project, provider, key_id, wrapped_key, ciphertext, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (organization, project, provider) DO UPDATE
+		SET key_id = EXCLUDED.key_id, wrapped_key = EXCLUDED.wrapped_key,
+		    ciphertext = EXCLUDED.ciphertext, data = EXCLUDED.data`,
+		credential.Organization, credential.Project, credential.Provider,
+		credential.Sealed.KeyID, credential.Sealed.WrappedKey, credential.Sealed.Ciphertext, data)
+	return err
+}
+
+// scanSCMCredential decodes a credential, restoring its sealed value from
+// its columns as scanSecret does.
+func scanSCMCredential(row interface{ Scan(...any) error }) (*types.SCMCredential, error) {
+	var (
+		credential types.SCMCredential
+		sealed     types.SealedValue
+		data       []byte
+	)
+	if err := decodeDoc(row.Scan(&sealed.KeyID, &sealed.WrappedKey, &sealed.Ciphertext, &data), data, &credential); err != nil {
+		return nil, err
+	}
+	credential.Sealed = sealed
+	return &credential, nil
+}
+
+func (s *SQL) GetSCMCredential(ctx context.Context, organization, project, provider string) (*types.SCMCredential, error) {
+	return scanSCMCredential(s.db.QueryRowContext(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM scm_credentials
+		WHERE organization = $1 AND project = $2 AND provider = $3`, organization, project, provider))
+}
+
+func (s *SQL) ListSCMCredentials(ctx context.Context, organization string) ([]*types.SCMCredential, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM scm_credentials
+		WHERE organization = $1 ORDER BY project, provider`, organization)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*types.SCMCredential{}
+	for rows.Next() {
+		credential, err := scanSCMCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, credential)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQL) DeleteSCMCredential(ctx context.Context, organization, project, provider string) error {
+	return s.execRow(ctx, `DELETE FROM scm_credentials WHERE organization = $1 AND project = $2 AND provider = $3`, organization, project, provider)
+}
+
+// Variables
+
+func (s *SQL) PutVariable(ctx context.Context, variable *types.Variable) error {
+	data, err := json.Marshal(variable)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO variables (project, name, data) VALUES ($1, $2, $3)
+		ON CONFLICT (project, name) DO UPDATE SET data = EXCLUDED.data`,
+		variable.Project, variable.Name, data)
+	return err
+}
+
+func scanVariable(row interface{ Scan(...any) error }) (*types.Variable, error) {
+	var (
+		variable types.Variable
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &variable); err != nil {
+		return nil, err
+	}
+	return &variable, nil
+}
+
+func (s *SQL) GetVariable(ctx context.Context, project, name string) (*types.Variable, error) {
+	return scanVariable(s.db.QueryRowContext(ctx, `SELECT data FROM variables WHERE project = $1 AND name = $2`, project, name))
+}
+
+func (s *SQL) ListVariables(ctx context.Context, project string) ([]*types.Variable, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM variables WHERE project = $1 ORDER BY name`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	variables := []*types.Variable{}
+	for rows.Next() {
+		variable, err := scanVariable(rows)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, variable)
+	}
+	return variables, rows.Err()
+}
+
+func (s *SQL) DeleteVariable(ctx context.Context, project, name string) error {
+	return s.execRow(ctx, `DELETE FROM variables WHERE project = $1 AND name = $2`, project, name)
+}
+
+func (s *SQL) GetProtectedBranches(ctx context.Context, project string) (*types.ProtectedBranches, error) {
+	var (
+		branches types.ProtectedBranches
+		data     []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM protected_branches WHERE project = $1`, project)
+	if err := decodeDoc(row.Scan(&data), data, &branches); err != nil {
+		return nil, err
+	}
+	return &branches, nil
+}
+
+func (s *SQL) PutProtectedBranches(ctx context.Context, branches *types.ProtectedBranches) error {
+	data, err := json.Marshal(branches)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO protected_branches (project, data) VALUES ($1, $2)
+		ON CONFLICT (project) DO UPDATE SET data = EXCLUDED.data`,
+		branches.Project, data)
+	return err
+}
+
+// Required checks
+
+func (s *SQL) GetRequiredChecks(ctx context.Context, project string) (*types.RequiredChecks, error) {
+	var (
+		checks types.RequiredChecks
+		data   []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM required_checks WHERE project = $1`, project)
+	if err := decodeDoc(row.Scan(&data), data, &checks); err != nil {
+		return nil, err
+	}
+	return &checks, nil
+}
+
+func (s *SQL) PutRequiredChecks(ctx context.Context, checks *types.RequiredChecks) error {
+	data, err := json.Marshal(checks)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO required_checks (project, data) VALUES ($1, $2)
+		ON CONFLICT (project) DO UPDATE SET data = EXCLUDED.data`,
+		checks.Project, data)
+	return err
+}
+
+// Project quotas
+
+func scanProjectQuota(row interface{ Scan(...any) error }) (*types.ProjectQuota, error) {
+	var (
+		quota types.ProjectQuota
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &quota); err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+func (s *SQL) GetProjectQuota(ctx context.Context, project string) (*types.ProjectQuota, error) {
+	return scanProjectQuota(s.db.QueryRowContext(ctx, `SELECT data FROM project_quotas WHERE project = $1`, project))
+}
+
+func (s *SQL) PutProjectQuota(ctx context.Context, quota *types.ProjectQuota) error {
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO project_quotas (project, data) VALUES ($1, $2)
+		ON CONFLICT (project) DO UPDATE SET data = EXCLUDED.data`,
+		quota.Project, data)
+	return err
+}
+
+func (s *SQL) ListProjectQuotas(ctx context.Context) ([]*types.ProjectQuota, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM project_quotas ORDER BY project`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	quotas := []*types.ProjectQuota{}
+	for rows.Next() {
+		quota, err := scanProjectQuota(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, rows.Err()
+}
+
+func (s *SQL) DeleteProjectQuota(ctx context.Context, project string) error {
+	return s.execRow(ctx, `DELETE FROM project_quotas WHERE project = $1`, project)
+}
+
+// Retention policies
+
+func scanRetentionPolicy(row interface{ Scan(...any) error }) (*types.RetentionPolicy, error) {
+	var (
+		policy types.RetentionPolicy
+		data   []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (s *SQL) GetRetentionPolicy(ctx context.Context, project string) (*types.RetentionPolicy, error) {
+	return scanRetentionPolicy(s.db.QueryRowContext(ctx, `SELECT data FROM retention_policies WHERE project = $1`, project))
+}
+
+func (s *SQL) PutRetentionPolicy(ctx context.Context, policy *types.RetentionPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO retention_policies (project, data) VALUES ($1, $2)
+		ON CONFLICT (project) DO UPDATE SET data = EXCLUDED.data`,
+		policy.Project, data)
+	return err
+}
+
+func (s *SQL) ListRetentionPolicies(ctx context.Context) ([]*types.RetentionPolicy, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM retention_policies ORDER BY project`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	policies := []*types.RetentionPolicy{}
+	for rows.Next() {
+		policy, err := scanRetentionPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func (s *SQL) DeleteRetentionPolicy(ctx context.Context, project string) error {
+	return s.execRow(ctx, `DELETE FROM retention_policies WHERE project = $1`, project)
+}
+
+// Scheduler pause
+
+func (s *SQL) GetSchedulerPause(ctx context.Context) (*types.SchedulerPause, error) {
+	var (
+		pause types.SchedulerPause
+		data  []byte
+	)
+	row := s.db.QueryRowContext(ctx, `SELECT data FROM scheduler_pause`)
+	if err := decodeDoc(row.Scan(&data), data, &pause); err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
+
+func (s *SQL) CreateSchedulerPause(ctx context.Context, pause *types.SchedulerPause) error {
+	data, err := json.Marshal(pause)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO scheduler_pause (data) VALUES ($1)`, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQL) DeleteSchedulerPause(ctx context.Context) error {
+	return s.execRow(ctx, `DELETE FROM scheduler_pause`)
+}
+
+// Templates
+
+func (s *SQL) CreateTemplate(ctx context.Context, template *types.Template) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO templates (name, version, created_at, data) VALUES ($1, $2, $3, $4)`,
+		template.Name, template.Version, template.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanTemplate(row interface{ Scan(...any) error }) (*types.Template, error) {
+	var (
+		template types.Template
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (s *SQL) GetTemplate(ctx context.Context, name, version string) (*types.Template, error) {
+	return scanTemplate(s.db.QueryRowContext(ctx, `SELECT data FROM templates WHERE name = $1 AND version = $2`, name, version))
+}
+
+func (s *SQL) ListTemplates(ctx context.Context, name string) ([]*types.Template, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM templates WHERE $1 = '' OR name = $1
+		ORDER BY created_at, name, version`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	templates := []*types.Template{}
+	for rows.Next() {
+		template, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+func (s *SQL) DeleteTemplate(ctx context.Context, name, version string) error {
+	return s.execRow(ctx, `DELETE FROM templates WHERE name = $1 AND version = $2`, name, version)
+}
+
+// Webhook deliveries
+
+func (s *SQL) CreateWebhookDelivery(ctx context.Context, delivery *types.WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (id, provider, repository, event, status, created_at, updated_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		delivery.ID, delivery.Provider, delivery.Repository, delivery.Event, delivery.Status, delivery.ReceivedAt, delivery.UpdatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (*types.WebhookDelivery, error) {
+	var (
+		delivery types.WebhookDelivery
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (s *SQL) GetWebhookDelivery(ctx context.Context, id string) (*types.WebhookDelivery, error) {
+	return scanWebhookDelivery(s.db.QueryRowContext(ctx, `SELECT data FROM webhook_deliveries WHERE id = $1`, id))
+}
+
+func (s *SQL) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter) ([]*types.WebhookDelivery, error) {
+	after, order, args := pageSQL(filter.Page, 5)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+s.dialect.withoutPayload+` FROM webhook_deliveries
+		WHERE ($1 = '' OR provider = $1)
+		  AND ($2 = '' OR repository = $2)
+		  AND ($3 = '' OR event = $3)
+		  AND ($4 = '' OR status = $4)
+		  AND `+after+`
+		`+order,
+		append([]any{filter.Provider, filter.Repository, filter.Event, filter.Status}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*types.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQL) UpdateWebhookDelivery(ctx context.Context, id string, fn func(*types.WebhookDelivery) error) (*types.WebhookDelivery, error) {
+	var delivery *types.WebhookDelivery
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		delivery, err = scanWebhookDelivery(tx.QueryRowContext(ctx, `SELECT data FROM webhook_deliveries WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(delivery); err != nil {
+			return err
+		}
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries SET status = $2, updated_at = $3, data = $4
+			WHERE id = $1`,
+			delivery.ID, delivery.Status, delivery.UpdatedAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *SQL) DeleteWebhookDeliveries(ctx context.Context, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Schedules
+
+func (s *SQL) CreateSchedule(ctx context.Context, schedule *types.Schedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO schedules (id, repository, enabled, next_run_at, created_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		schedule.ID, schedule.Repository, schedule.Enabled, schedule.NextRunAt, schedule.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func scanSchedule(row interface{ Scan(...any) error }) (*types.Schedule, error) {
+	var (
+		schedule types.Schedule
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (s *SQL) GetSchedule(ctx context.Context, id string) (*types.Schedule, error) {
+	return scanSchedule(s.db.QueryRowContext(ctx, `SELECT data FROM schedules WHERE id = $1`, id))
+}
+
+func (s *SQL) ListSchedules(ctx context.Context) ([]*types.Schedule, error) {
+	return s.listSchedules(ctx, `SELECT data FROM schedules ORDER BY created_at`)
+}
+
+func (s *SQL) ListDueSchedules(ctx context.Context, t time.Time) ([]*types.Schedule, error) {
+	return s.listSchedules(ctx, `
+		SELECT data FROM schedules WHERE enabled AND next_run_at <= $1
+		ORDER BY next_run_at`, t)
+}
+
+func (s *SQL) listSchedules(ctx context.Context, query string, args ...any) ([]*types.Schedule, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	schedules := []*types.Schedule{}
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *SQL) UpdateSchedule(ctx context.Context, id string, fn func(*types.Schedule) error) (*types.Schedule, error) {
+	var schedule *types.Schedule
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		schedule, err = scanSchedule(tx.QueryRowContext(ctx, `SELECT data FROM schedules WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(schedule); err != nil {
+			return err
+		}
+		data, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE schedules SET repository = $2, enabled = $3, next_run_at = $4, data = $5
+			WHERE id = $1`,
+			schedule.ID, schedule.Repository, schedule.Enabled, schedule.NextRunAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+func (s *SQL) DeleteSchedule(ctx context.Context, id string) error {
+	return s.execRow(ctx, `DELETE FROM schedules WHERE id = $1`, id)
+}
+
+// Environments and deployments
+
+func scanEnvironment(row interface{ Scan(...any) error }) (*types.Environment, error) {
+	var (
+		env  types.Environment
+		data []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+func (s *SQL) GetEnvironment(ctx context.Context, project, name string) (*types.Environment, error) {
+	return scanEnvironment(s.db.QueryRowContext(ctx, `SELECT data FROM environments WHERE project = $1 AND name = $2`, project, name))
+}
+
+func (s *SQL) ListEnvironments(ctx context.Context, project string) ([]*types.Environment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM environments WHERE project = $1 ORDER BY name`, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	envs := []*types.Environment{}
+	for rows.Next() {
+		env, err := scanEnvironment(rows)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	return envs, rows.Err()
+}
+
+// UpdateEnvironment inserts a placeholder row first if the environment does
+// not exist, so that concurrent first updates queue up on its row lock.
+func (s *SQL) UpdateEnvironment(ctx context.Context, project, name string, fn func(*types.Environment) error) (*types.Environment, error) {
+	var env *types.Environment
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		placeholder, err := json.Marshal(&types.Environment{Project: project, Name: name})
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO environments (project, name, created_at, updated_at, data)
+			VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, $3)
+			ON CONFLICT (project, name) DO NOTHING`,
+			project, name, placeholder)
+		if err != nil {
+			return err
+		}
+		env, err = scanEnvironment(tx.QueryRowContext(ctx, `SELECT data FROM environments WHERE project = $1 AND name = $2`+s.dialect.forUpdate, project, name))
+		if err != nil {
+			return err
+		}
+		if err := fn(env); err != nil {
+			return err
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE environments SET created_at = $3, updated_at = $4, data = $5
+			WHERE project = $1 AND name = $2`,
+			project, name, env.CreatedAt, env.UpdatedAt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (s *SQL) PutDeployment(ctx context.Context, deployment *types.Deployment) error {
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO deployments (id, project, environment, created_at, updated_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET updated_at = EXCLUDED.updated_at, data = EXCLUDED.data`,
+		deployment.ID, deployment.Project, deployment.Environment, deployment.CreatedAt, deployment.UpdatedAt, data)
+	return err
+}
+
+func (s *SQL) ListDeployments(ctx context.Context, filter DeploymentFilter) ([]*types.Deployment, error) {
+	after, order, args := pageSQL(filter.Page, 3)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM deployments
+		WHERE ($1 = '' OR project = $1)
+		  AND ($2 = '' OR environment = $2)
+		  AND `+after+`
+		`+order,
+		append([]any{filter.Project, filter.Environment}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deployments := []*types.Deployment{}
+	for rows.Next() {
+		var (
+			data       []byte
+			deployment types.Deployment
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &deployment); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, &deployment)
+	}
+	return deployments, rows.Err()
+}
+
+// Notifiers
+
+func (s *SQL) CreateNotifier(ctx context.Context, notifier *types.Notifier) error {
+	data, err := json.Marshal(notifier)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO notifiers (id, project, organization, created_at, key_id, wrapped_key, ciphertext, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		notifier.ID, notifier.Project, notifier.Organization, notifier.CreatedAt,
+		notifier.SigningKey.KeyID, notifier.SigningKey.WrappedKey, notifier.SigningKey.Ciphertext, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// scanNotifier decodes a notifier, restoring its sealed signing key from its
+// columns as scanSecret does.
+func scanNotifier(row interface{ Scan(...any) error }) (*types.Notifier, error) {
+	var (
+		notifier types.Notifier
+		sealed   types.SealedValue
+		data     []byte
+	)
+	if err := decodeDoc(row.Scan(&sealed.KeyID, &sealed.WrappedKey, &sealed.Ciphertext, &data), data, &notifier); err != nil {
+		return nil, err
+	}
+	notifier.SigningKey = sealed
+	return &notifier, nil
+}
+
+func (s *SQL) GetNotifier(ctx context.Context, id string) (*types.Notifier, error) {
+	return scanNotifier(s.db.QueryRowContext(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM notifiers WHERE id = $1`, id))
+}
+
+func (s *SQL) ListNotifiers(ctx context.Context, project string) ([]*types.Notifier, error) {
+	return s.listNotifiers(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM notifiers
+		WHERE organization = '' AND ($1 = '' OR project = $1)
+		ORDER BY created_at, id`, project)
+}
+
+func (s *SQL) ListOrganizationNotifiers(ctx context.Context, organization string) ([]*types.Notifier, error) {
+	return s.listNotifiers(ctx, `
+		SELECT key_id, wrapped_key, ciphertext, data FROM notifiers
+		WHERE organization <> '' AND ($1 = '' OR organization = $1)
+		ORDER BY created_at, id`, organization)
+}
+
+func (s *SQL) listNotifiers(ctx context.Context, query string, args ...any) ([]*types.Notifier, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifiers := []*types.Notifier{}
+	for rows.Next() {
+		notifier, err := scanNotifier(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, rows.Err()
+}
+
+func (s *SQL) UpdateNotifier(ctx context.Context, id string, fn func(*types.Notifier) error) (*types.Notifier, error) {
+	var notifier *types.Notifier
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		notifier, err = scanNotifier(tx.QueryRowContext(ctx, `
+			SELECT key_id, wrapped_key, ciphertext, data FROM notifiers WHERE id = $1`+s.dialect.forUpdate, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(notifier); err != nil {
+			return err
+		}
+		data, err := json.Marshal(notifier)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE notifiers SET key_id = $2, wrapped_key = $3, ciphertext = $4, data = $5
+			WHERE id = $1`,
+			notifier.ID, notifier.SigningKey.KeyID, notifier.SigningKey.WrappedKey, notifier.SigningKey.Ciphertext, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notifier, nil
+}
+
+func (s *SQL) DeleteNotifier(ctx context.Context, id string) error {
+	return s.execRow(ctx, `DELETE FROM notifiers WHERE id = $1`, id)
+}
+
+func (s *SQL) CreateNotifierDelivery(ctx context.Context, delivery *types.NotifierDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO notifier_deliveries (id, notifier_id, created_at, data)
+		VALUES ($1, $2, $3, $4)`,
+		delivery.ID, delivery.NotifierID, delivery.CreatedAt, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQL) ListNotifierDeliveries(ctx context.Context, notifierID string, page Page) ([]*types.NotifierDelivery, error) {
+	// Deliveries are never updated after they are made.
+	page.Sort = SortCreated
+	after, order, args := pageSQL(page, 2)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM notifier_deliveries
+		WHERE notifier_id = $1 AND `+after+`
+		`+order,
+		append([]any{notifierID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*types.NotifierDelivery{}
+	for rows.Next() {
+		var (
+			delivery types.NotifierDelivery
+			data     []byte
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQL) DeleteNotifierDeliveries(ctx context.Context, t time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM notifier_deliveries WHERE created_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Notification preferences
+
+func scanNotificationPreferences(row interface{ Scan(...any) error }) (*types.NotificationPreferences, error) {
+	var (
+		prefs types.NotificationPreferences
+		data  []byte
+	)
+	if err := decodeDoc(row.Scan(&data), data, &prefs); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+func (s *SQL) GetNotificationPreferences(ctx context.Context, user string) (*types.NotificationPreferences, error) {
+	return scanNotificationPreferences(s.db.QueryRowContext(ctx, `SELECT data FROM notification_preferences WHERE user_name = $1`, user))
+}
+
+func (s *SQL) PutNotificationPreferences(ctx context.Context, prefs *types.NotificationPreferences) error {
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO notification_preferences (user_name, data) VALUES ($1, $2)
+		ON CONFLICT (user_name) DO UPDATE SET data = EXCLUDED.data`,
+		prefs.User, data)
+	return err
+}
+
+func (s *SQL) ListNotificationPreferences(ctx context.Context) ([]*types.NotificationPreferences, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM notification_preferences ORDER BY user_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*types.NotificationPreferences{}
+	for rows.Next() {
+		prefs, err := scanNotificationPreferences(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, prefs)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQL) DeleteNotificationPreferences(ctx context.Context, user string) error {
+	return s.execRow(ctx, `DELETE FROM notification_preferences WHERE user_name = $1`, user)
+}
+
+// Audit
+
+func (s *SQL) AppendAudit(ctx context.Context, event *types.AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO audit_events (id, actor, resource, created_at, data)
+		VALUES ($1, $2, $3, $4, $5)`,
+		event.ID, event.Actor, event.Resource, event.At, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQL) ListAudit(ctx context.Context, filter AuditFilter) ([]*types.AuditEvent, error) {
+	// Events have one time only, kept in created_at.
+	filter.Page.Sort = SortCreated
+	var since, until *time.Time
+	if !filter.Since.IsZero() {
+		since = &filter.Since
+	}
+	if !filter.Until.IsZero() {
+		until = &filter.Until
+	}
+	resource := strings.TrimSuffix(filter.Resource, "/")
+	after, order, args := pageSQL(filter.Page, 6)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT data FROM audit_events
+		WHERE ($1 = '' OR actor = $1)
+		  AND ($2 = '' OR resource = $2 OR resource LIKE $3 ESCAPE '\')
+		  AND (CAST($4 AS TIMESTAMPTZ) IS NULL OR created_at >= $4)
+		  AND (CAST($5 AS TIMESTAMPTZ) IS NULL OR created_at < $5)
+		  AND `+after+`
+		`+order,
+		append([]any{filter.Actor, resource, escapeLike(resource) + "/%", since, until}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*types.AuditEvent{}
+	for rows.Next() {
+		var (
+			data  []byte
+			event types.AuditEvent
+		)
+		if err := decodeDoc(rows.Scan(&data), data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, for matching s
+// literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// execRow runs a statement that changes a single row, such as a DELETE by
+// primary key, returning ErrNotFound if nothing matched.
+func (s *SQL) execRow(ctx context.Context, query string, args ...any) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Locks
+
+// TryLock takes the lock called name: an advisory lock of PostgreSQL, or
+// a lock held in the process with SQLite.
+func (s *SQL) TryLock(ctx context.Context, name string) (Lease, bool, error) {
+	return s.dialect.tryLock(ctx, s.db, name)
+}
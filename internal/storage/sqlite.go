@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteOptions are the connection parameters of SQLite databases. WAL
+// journaling lets reads go on while a transaction writes, and transactions
+// take the write lock as they begin, which stands in for FOR UPDATE and
+// keeps two transactions from deadlocking on upgrading their locks.
+const sqliteOptions = "_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(10000)" +
+	"&_pragma=foreign_keys(1)&_time_format=sqlite&_txlock=immediate"
+
+// OpenSQLite opens the SQLite database in the file at path, creating it if
+// needed, and applies pending migrations. SQLite suits a single server: the
+// locks of LockStore are held in the process, so servers sharing the file
+// would not exclude each other.
+func OpenSQLite(ctx context.Context, path string) (*SQL, error) {
+	if path == "" || strings.Contains(path, "?") {
+		return nil, fmt.Errorf("storage: invalid sqlite database path %q", path)
+	}
+	db := sql.OpenDB(sqliteConnector{dsn: path + "?" + sqliteOptions})
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: opening sqlite: %w", err)
+	}
+	d := newSQLiteDialect()
+	if err := migrate(ctx, db, d); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: migrating sqlite: %w", err)
+	}
+	return &SQL{db: db, dialect: d}, nil
+}
+
+// newSQLiteDialect returns the dialect of SQLite, with locks of its own.
+func newSQLiteDialect() *dialect {
+	locks := &sqliteLocks{held: map[string]*sqliteLease{}}
+	return &dialect{
+		migrations: "migrations/sqlite",
+		anyOf: func(n int) string {
+			return fmt.Sprintf("IN (SELECT value FROM json_each($%d))", n)
+		},
+		list: func(values []string) any {
+			data, _ := json.Marshal(values)
+			return string(data)
+		},
+		// Documents are stored as bytes, which the JSON functions would
+		// take for SQLite's binary JSON.
+		withoutPayload: "json_remove(CAST(data AS TEXT), '$.payload')",
+		matchLogs:      sqliteMatchLogs,
+		tryLock:        locks.tryLock,
+	}
+}
+
+// sqliteMatchLogs matches log lines against their FTS5 index, turning the
+// query into FTS5's syntax as parseLogQuery reads it: every word and phrase
+// quoted, and NOT before each excluded word. A query with nothing to
+// include matches no line, as it does in the in-memory store.
+func sqliteMatchLogs(n int, q string) (string, any) {
+	query := parseLogQuery(q)
+	if len(query.include) == 0 {
+		// The condition still takes its argument, as the others of the
+		// search do.
+		return fmt.Sprintf("FALSE AND $%d = ''", n), ""
+	}
+	terms := make([]string, 0, len(query.include)+len(query.exclude))
+	for _, term := range query.include {
+		terms = append(terms, ftsString(term))
+	}
+	for _, term := range query.exclude {
+		terms = append(terms, "NOT "+ftsString(term))
+	}
+	cond := fmt.Sprintf("rowid IN (SELECT rowid FROM job_log_lines_search WHERE job_log_lines_search MATCH $%d)", n)
+	return cond, strings.Join(terms, " ")
+}
+
+// ftsString quotes s as an FTS5 string, which matches its words as a phrase.
+func ftsString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// sqliteDriver opens the connections of every SQLite store.
+var sqliteDriver = &sqlite.Driver{}
+
+// sqliteConnector opens connections to the database dsn names.
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := sqliteDriver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := conn.(sqliteConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("storage: sqlite connection lacks context support")
+	}
+	return utcConn{sc}, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return sqliteDriver
+}
+
+// sqliteConn is what database/sql uses of a SQLite connection.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// utcConn is a SQLite connection that writes times in UTC. SQLite keeps
+// times as text, which only compares in time order if every time has the
+// same offset.
+type utcConn struct {
+	sqliteConn
+}
+
+// CheckNamedValue converts an argument as database/sql would, then moves
+// times to UTC.
+func (utcConn) CheckNamedValue(arg *driver.NamedValue) error {
+	v, err := driver.DefaultParameterConverter.ConvertValue(arg.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := v.(time.Time); ok {
+		v = t.UTC()
+	}
+	arg.Value = v
+	return nil
+}
+
+// sqliteLocks holds the locks of a SQLite store, which are only among the
+// users of the store in this process.
+type sqliteLocks struct {
+	mu   sync.Mutex
+	held map[string]*sqliteLease
+}
+
+type sqliteLease struct {
+	locks *sqliteLocks
+	name  string
+}
+
+func (l *sqliteLocks) tryLock(_ context.Context, _ *sql.DB, name string) (Lease, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, held := l.held[name]; held {
+		return nil, false, nil
+	}
+	lease := &sqliteLease{locks: l, name: name}
+	l.held[name] = lease
+	return lease, true, nil
+}
+
+func (l *sqliteLease) Lost() <-chan struct{} {
+	return nil
+}
+
+func (l *sqliteLease) Release(context.Context) error {
+	l.locks.mu.Lock()
+	defer l.locks.mu.Unlock()
+	if l.locks.held[l.name] == l {
+		delete(l.locks.held, l.name)
+	}
+	return nil
+}
@@ -0,0 +1,649 @@
+// Package storage defines the persistence interfaces used by the control
+// plane and provides their implementations.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+var (
+	// ErrNotFound is returned when a requested record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when creating a record whose ID already exists.
+	ErrConflict = errors.New("already exists")
+)
+
+// AgentStore persists registered agents.
+type AgentStore interface {
+	CreateAgent(ctx context.Context, agent *types.Agent) error
+	GetAgent(ctx context.Context, id string) (*types.Agent, error)
+	ListAgents(ctx context.Context) ([]*types.Agent, error)
+	// UpdateAgent loads the agent, applies fn and saves the result atomically.
+	// If fn returns an error nothing is written and the error is returned.
+	UpdateAgent(ctx context.Context, id string, fn func(*types.Agent) error) (*types.Agent, error)
+}
+
+// SortField names the time a list is ordered by.
+type SortField string
+
+const (
+	SortCreated SortField = "created"
+	SortUpdated SortField = "updated"
+)
+
+// Cursor is the position of a record in a list: its sort time and ID.
+type Cursor struct {
+	Time time.Time
+	ID   string
+}
+
+// Page selects part of a list. The zero Page selects the whole list, oldest
+// first by creation time.
+type Page struct {
+	// Sort is the time records are ordered by; empty means SortCreated.
+	// Records with the same time are ordered by ID.
+	Sort SortField
+	// Desc lists the newest records first.
+	Desc bool
+	// After, if set, skips the records up to and including the one at
+	// After.
+	After *Cursor
+	// Limit caps the number of records returned; 0 means no limit.
+	Limit int
+}
+
+// Position returns the cursor of a record with the given times and ID in a
+// list ordered as p is.
+func (p Page) Position(created, updated time.Time, id string) Cursor {
+	if p.Sort == SortUpdated {
+		return Cursor{Time: updated, ID: id}
+	}
+	return Cursor{Time: created, ID: id}
+}
+
+// BranchRefs returns the refs a run or job of branch may carry: the
+// qualified ref set by webhooks and schedules, and the bare branch name
+// runs submitted through the API may give.
+func BranchRefs(branch string) []string {
+	return []string{"refs/heads/" + branch, branch}
+}
+
+// JobFilter narrows the result of JobStore.ListJobs. Zero values match all jobs.
+type JobFilter struct {
+	State        types.JobState
+	Repository   string
+	Organization string
+	// Branch matches jobs whose ref is one of BranchRefs(Branch).
+	Branch  string
+	AgentID string
+	Page    Page
+}
+
+// JobStore persists jobs and their state history.
+type JobStore interface {
+	CreateJob(ctx context.Context, job *types.Job) error
+	GetJob(ctx context.Context, id string) (*types.Job, error)
+	// ListJobs returns the jobs matching filter, in the order and range
+	// filter.Page selects.
+	ListJobs(ctx context.Context, filter JobFilter) ([]*types.Job, error)
+	// CountJobs returns how many jobs of repository were created at or
+	// after since.
+	CountJobs(ctx context.Context, repository string, since time.Time) (int, error)
+	// UpdateJob loads the job, applies fn and saves the result atomically.
+	// If fn returns an error nothing is written and the error is returned.
+	UpdateJob(ctx context.Context, id string, fn func(*types.Job) error) (*types.Job, error)
+	// DeleteJob deletes the job with its test reports and annotations. Its
+	// artifacts, log and snapshot have contents in the blob store and are
+	// deleted first by their services.
+	DeleteJob(ctx context.Context, id string) error
+}
+
+// PipelineFilter narrows the result of PipelineStore.ListPipelines. Zero
+// values match all pipelines.
+type PipelineFilter struct {
+	State        types.PipelineState
+	Repository   string
+	Organization string
+	// Name matches runs of the pipeline of that name.
+	Name string
+	// Branch matches runs whose ref is one of BranchRefs(Branch).
+	Branch string
+	Page   Page
+}
+
+// PipelineStore persists pipeline runs.
+type PipelineStore interface {
+	CreatePipeline(ctx context.Context, pipeline *types.Pipeline) error
+	GetPipeline(ctx context.Context, id string) (*types.Pipeline, error)
+	// ListPipelines returns the runs matching filter, in the order and range
+	// filter.Page selects.
+	ListPipelines(ctx context.Context, filter PipelineFilter) ([]*types.Pipeline, error)
+	// LatestPipeline returns the most recent run of repository at one of
+	// refs that is in one of states, or ErrNotFound if there is none.
+	LatestPipeline(ctx context.Context, repository string, refs []string, states []types.PipelineState) (*types.Pipeline, error)
+	// UpdatePipeline loads the pipeline, applies fn and saves the result
+	// atomically. If fn returns an error nothing is written and the error is
+	// returned.
+	UpdatePipeline(ctx context.Context, id string, fn func(*types.Pipeline) error) (*types.Pipeline, error)
+	// DeletePipeline deletes the run but not its jobs.
+	DeletePipeline(ctx context.Context, id string) error
+}
+
+// TokenStore persists API tokens.
+type TokenStore interface {
+	CreateToken(ctx context.Context, token *types.APIToken) error
+	// GetTokenByHash returns the token whose secret hashes to hash.
+	GetTokenByHash(ctx context.Context, hash string) (*types.APIToken, error)
+	ListTokens(ctx context.Context) ([]*types.APIToken, error)
+	DeleteToken(ctx context.Context, id string) error
+}
+
+// AgentTokenStore persists the registration tokens handed out for
+// registering agents.
+type AgentTokenStore interface {
+	// CreateAgentToken fails with ErrConflict if a token with the same ID
+	// or hash exists.
+	CreateAgentToken(ctx context.Context, token *types.AgentToken) error
+	GetAgentToken(ctx context.Context, id string) (*types.AgentToken, error)
+	// GetAgentTokenByHash returns the token whose secret hashes to hash.
+	GetAgentTokenByHash(ctx context.Context, hash string) (*types.AgentToken, error)
+	// ListAgentTokens returns every token, oldest first.
+	ListAgentTokens(ctx context.Context) ([]*types.AgentToken, error)
+	// UpdateAgentToken applies fn to the token atomically and returns the
+	// result; an error from fn aborts the update.
+	UpdateAgentToken(ctx context.Context, id string, fn func(*types.AgentToken) error) (*types.AgentToken, error)
+}
+
+// RBACStore persists teams and role bindings.
+type RBACStore interface {
+	CreateRoleBinding(ctx context.Context, binding *types.RoleBinding) error
+	ListRoleBindings(ctx context.Context) ([]*types.RoleBinding, error)
+	DeleteRoleBinding(ctx context.Context, id string) error
+	// PutTeam creates the team or replaces its members.
+	PutTeam(ctx context.Context, team *types.Team) error
+	ListTeams(ctx context.Context) ([]*types.Team, error)
+	DeleteTeam(ctx context.Context, name string) error
+}
+
+// OrganizationStore persists organizations and the projects they own.
+type OrganizationStore interface {
+	CreateOrganization(ctx context.Context, org *types.Organization) error
+	GetOrganization(ctx context.Context, name string) (*types.Organization, error)
+	// ListOrganizations returns every organization ordered by name.
+	ListOrganizations(ctx context.Context) ([]*types.Organization, error)
+	// UpdateOrganization loads the organization, applies fn and saves the
+	// result atomically. If fn returns an error nothing is written and the
+	// error is returned.
+	UpdateOrganization(ctx context.Context, name string, fn func(*types.Organization) error) (*types.Organization, error)
+	// DeleteOrganization removes an organization. It fails if the
+	// organization still owns projects.
+	DeleteOrganization(ctx context.Context, name string) error
+	// CreateProject records a project, failing with ErrConflict if a
+	// project of that name exists in any organization and with ErrNotFound
+	// if its organization does not exist.
+	CreateProject(ctx context.Context, project *types.Project) error
+	GetProject(ctx context.Context, name string) (*types.Project, error)
+	// ListProjects returns every project ordered by name.
+	ListProjects(ctx context.Context) ([]*types.Project, error)
+}
+
+// OrganizationOf returns the organization that owns project, or "" if no
+// organization does.
+func OrganizationOf(ctx context.Context, store OrganizationStore, project string) (string, error) {
+	if project == "" {
+		return "", nil
+	}
+	p, err := store.GetProject(ctx, project)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("looking up project %s: %w", project, err)
+	}
+	return p.Organization, nil
+}
+
+// ArtifactStore persists artifact metadata. The contents live in a blob
+// store.
+type ArtifactStore interface {
+	// PutArtifact creates the artifact or replaces the one at the same job
+	// and path.
+	PutArtifact(ctx context.Context, artifact *types.Artifact) error
+	GetArtifact(ctx context.Context, jobID, path string) (*types.Artifact, error)
+	// ListArtifacts returns a job's artifacts ordered by path.
+	ListArtifacts(ctx context.Context, jobID string) ([]*types.Artifact, error)
+	// ListExpiredArtifacts returns artifacts that expired before t, oldest
+	// first, up to limit.
+	ListExpiredArtifacts(ctx context.Context, t time.Time, limit int) ([]*types.Artifact, error)
+	DeleteArtifact(ctx context.Context, jobID, path string) error
+	// PutTestReport creates the test report or replaces the one parsed
+	// from the same artifact. Reports are not deleted with their artifacts.
+	PutTestReport(ctx context.Context, report *types.TestReport) error
+	// ListTestReports returns a job's test reports ordered by path.
+	ListTestReports(ctx context.Context, jobID string) ([]*types.TestReport, error)
+}
+
+// AnnotationStore persists the annotations jobs publish on their runs.
+// Like test reports, they are kept for as long as their jobs.
+type AnnotationStore interface {
+	// AddAnnotations stores annotations in order.
+	AddAnnotations(ctx context.Context, annotations []*types.Annotation) error
+	// ListAnnotations returns the annotations of the jobs with the given
+	// IDs in the order they were stored.
+	ListAnnotations(ctx context.Context, jobIDs []string) ([]*types.Annotation, error)
+	// CountAnnotations returns how many annotations the job has.
+	CountAnnotations(ctx context.Context, jobID string) (int, error)
+}
+
+// JobLogStore persists the records of where job logs are kept. The contents
+// live in a blob store.
+type JobLogStore interface {
+	// PutJobLog creates the job's log record or replaces it.
+	PutJobLog(ctx context.Context, log *types.JobLog) error
+	GetJobLog(ctx context.Context, jobID string) (*types.JobLog, error)
+	// ListExpiredJobLogs returns logs that expired before t, oldest first,
+	// up to limit.
+	ListExpiredJobLogs(ctx context.Context, t time.Time, limit int) ([]*types.JobLog, error)
+	// DeleteJobLog removes the job's log record and its lines from the
+	// search index.
+	DeleteJobLog(ctx context.Context, jobID string) error
+}
+
+// LogSearch narrows the result of LogIndexStore.SearchLogs.
+type LogSearch struct {
+	// Query is the words the lines must all contain, in any case. Quoted
+	// phrases must appear as written and words prefixed with - must not
+	// appear.
+	Query string
+	// Project and JobID, if set, confine the search to a project or job.
+	Project string
+	JobID   string
+	// Page orders lines by when their job finished; lines never change, so
+	// SortUpdated orders them the same way.
+	Page Page
+}
+
+// LogIndexStore keeps the full-text index of the logs of finished jobs.
+type LogIndexStore interface {
+	// IndexJobLog replaces the indexed lines of a job.
+	IndexJobLog(ctx context.Context, jobID string, lines []*types.LogLine) error
+	SearchLogs(ctx context.Context, search LogSearch) ([]*types.LogLine, error)
+}
+
+// SnapshotStore persists the records of workspace snapshots. The contents
+// live in a blob store.
+type SnapshotStore interface {
+	// PutSnapshot creates the job's snapshot record or replaces it.
+	PutSnapshot(ctx context.Context, snapshot *types.WorkspaceSnapshot) error
+	GetSnapshot(ctx context.Context, jobID string) (*types.WorkspaceSnapshot, error)
+	// ListExpiredSnapshots returns snapshots that expired before t, oldest
+	// first, up to limit.
+	ListExpiredSnapshots(ctx context.Context, t time.Time, limit int) ([]*types.WorkspaceSnapshot, error)
+	DeleteSnapshot(ctx context.Context, jobID string) error
+}
+
+// CacheStore persists dependency cache entries.
+type CacheStore interface {
+	// PutCacheEntry creates the entry or replaces the one with the same
+	// project and key.
+	PutCacheEntry(ctx context.Context, entry *types.CacheEntry) error
+	GetCacheEntry(ctx context.Context, project, key string) (*types.CacheEntry, error)
+	// TouchCacheEntry records that the entry was used at t.
+	TouchCacheEntry(ctx context.Context, project, key string, t time.Time) error
+	// ListCacheEntries returns a project's entries, least recently used
+	// first.
+	ListCacheEntries(ctx context.Context, project string) ([]*types.CacheEntry, error)
+	DeleteCacheEntry(ctx context.Context, project, key string) error
+	// CountCacheDigest returns how many entries, across all projects, refer
+	// to the contents with digest.
+	CountCacheDigest(ctx context.Context, digest string) (int, error)
+	// AddCacheStats adds the counts of delta to the statistics of its
+	// project and key, creating them if needed, and sets their UpdatedAt
+	// to that of delta.
+	AddCacheStats(ctx context.Context, delta *types.CacheStats) error
+	// ListCacheStats returns the statistics of a project's keys, by key.
+	ListCacheStats(ctx context.Context, project string) ([]*types.CacheStats, error)
+}
+
+// SecretStore persists encrypted project secrets.
+type SecretStore interface {
+	// PutSecret creates the secret or replaces the one with the same
+	// project and name.
+	PutSecret(ctx context.Context, secret *types.Secret) error
+	GetSecret(ctx context.Context, project, name string) (*types.Secret, error)
+	// ListSecrets returns a project's secrets ordered by name.
+	ListSecrets(ctx context.Context, project string) ([]*types.Secret, error)
+	DeleteSecret(ctx context.Context, project, name string) error
+}
+
+// SCMCredentialStore persists the encrypted credentials of organizations
+// and projects for their SCM providers.
+type SCMCredentialStore interface {
+	// PutSCMCredential creates the credential or replaces the one with the
+	// same organization, project and provider.
+	PutSCMCredential(ctx context.Context, credential *types.SCMCredential) error
+	// GetSCMCredential returns the credential of a project, or of the
+	// organization if project is empty.
+	GetSCMCredential(ctx context.Context, organization, project, provider string) (*types.SCMCredential, error)
+	// ListSCMCredentials returns the credentials of an organization and its
+	// projects, ordered by project, the organization's first, then
+	// provider.
+	ListSCMCredentials(ctx context.Context, organization string) ([]*types.SCMCredential, error)
+	DeleteSCMCredential(ctx context.Context, organization, project, provider string) error
+}
+
+// VariableStore persists plain environment variables, global or of a
+// project, and the branches each project protects.
+type VariableStore interface {
+	// PutVariable creates the variable or replaces the one with the same
+	// project and name.
+	PutVariable(ctx context.Context, variable *types.Variable) error
+	GetVariable(ctx context.Context, project, name string) (*types.Variable, error)
+	// ListVariables returns a project's variables, or the global ones if
+	// project is empty, ordered by name.
+	ListVariables(ctx context.Context, project string) ([]*types.Variable, error)
+	DeleteVariable(ctx context.Context, project, name string) error
+	// GetProtectedBranches returns ErrNotFound if the project never set
+	// its protected branches.
+	GetProtectedBranches(ctx context.Context, project string) (*types.ProtectedBranches, error)
+	PutProtectedBranches(ctx context.Context, branches *types.ProtectedBranches) error
+}
+
+// RequiredCheckStore persists the checks projects require of their runs.
+type RequiredCheckStore interface {
+	// GetRequiredChecks returns ErrNotFound if the project never set its
+	// required checks.
+	GetRequiredChecks(ctx context.Context, project string) (*types.RequiredChecks, error)
+	PutRequiredChecks(ctx context.Context, checks *types.RequiredChecks) error
+}
+
+// ProjectQuotaStore persists the quotas admins set on projects.
+type ProjectQuotaStore interface {
+	// GetProjectQuota returns ErrNotFound if the project has no quota.
+	GetProjectQuota(ctx context.Context, project string) (*types.ProjectQuota, error)
+	// PutProjectQuota creates the quota or replaces the project's.
+	PutProjectQuota(ctx context.Context, quota *types.ProjectQuota) error
+	// ListProjectQuotas returns every quota ordered by project.
+	ListProjectQuotas(ctx context.Context) ([]*types.ProjectQuota, error)
+	DeleteProjectQuota(ctx context.Context, project string) error
+}
+
+// RetentionPolicyStore persists the retention policies garbage collection
+// applies to projects.
+type RetentionPolicyStore interface {
+	// GetRetentionPolicy returns ErrNotFound if the project has no policy.
+	GetRetentionPolicy(ctx context.Context, project string) (*types.RetentionPolicy, error)
+	// PutRetentionPolicy creates the policy or replaces the project's.
+	PutRetentionPolicy(ctx context.Context, policy *types.RetentionPolicy) error
+	// ListRetentionPolicies returns every policy ordered by project.
+	ListRetentionPolicies(ctx context.Context) ([]*types.RetentionPolicy, error)
+	DeleteRetentionPolicy(ctx context.Context, project string) error
+}
+
+// SchedulerPauseStore persists the server-wide pause of scheduling, so that
+// it holds across replicas and restarts.
+type SchedulerPauseStore interface {
+	// GetSchedulerPause returns ErrNotFound if scheduling is not paused.
+	GetSchedulerPause(ctx context.Context) (*types.SchedulerPause, error)
+	// CreateSchedulerPause returns ErrConflict if scheduling is already
+	// paused.
+	CreateSchedulerPause(ctx context.Context, pause *types.SchedulerPause) error
+	// DeleteSchedulerPause returns ErrNotFound if scheduling is not paused.
+	DeleteSchedulerPause(ctx context.Context) error
+}
+
+// TemplateStore persists published pipeline templates.
+type TemplateStore interface {
+	// CreateTemplate returns ErrConflict if the version of the template
+	// was published already.
+	CreateTemplate(ctx context.Context, template *types.Template) error
+	GetTemplate(ctx context.Context, name, version string) (*types.Template, error)
+	// ListTemplates returns the versions of the template called name, or
+	// of every template if name is empty, oldest first.
+	ListTemplates(ctx context.Context, name string) ([]*types.Template, error)
+	DeleteTemplate(ctx context.Context, name, version string) error
+}
+
+// WebhookDeliveryFilter narrows the result of
+// WebhookDeliveryStore.ListWebhookDeliveries. Zero values match all
+// deliveries.
+type WebhookDeliveryFilter struct {
+	Provider   string
+	Repository string
+	Event      string
+	Status     types.DeliveryStatus
+	// Page orders deliveries by when they were received (SortCreated) or
+	// last processed (SortUpdated).
+	Page Page
+}
+
+// WebhookDeliveryStore persists received webhook deliveries.
+type WebhookDeliveryStore interface {
+	CreateWebhookDelivery(ctx context.Context, delivery *types.WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, id string) (*types.WebhookDelivery, error)
+	// ListWebhookDeliveries returns the deliveries matching filter, in the
+	// order and range filter.Page selects, without their payloads.
+	ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter) ([]*types.WebhookDelivery, error)
+	// UpdateWebhookDelivery loads the delivery, applies fn and saves the
+	// result atomically. If fn returns an error nothing is written and the
+	// error is returned.
+	UpdateWebhookDelivery(ctx context.Context, id string, fn func(*types.WebhookDelivery) error) (*types.WebhookDelivery, error)
+	// DeleteWebhookDeliveries deletes the deliveries received before t and
+	// returns how many there were.
+	DeleteWebhookDeliveries(ctx context.Context, t time.Time) (int, error)
+}
+
+// ScheduleStore persists cron schedules.
+type ScheduleStore interface {
+	CreateSchedule(ctx context.Context, schedule *types.Schedule) error
+	GetSchedule(ctx context.Context, id string) (*types.Schedule, error)
+	// ListSchedules returns every schedule, oldest first.
+	ListSchedules(ctx context.Context) ([]*types.Schedule, error)
+	// ListDueSchedules returns the enabled schedules due to run at t, the
+	// longest overdue first.
+	ListDueSchedules(ctx context.Context, t time.Time) ([]*types.Schedule, error)
+	// UpdateSchedule loads the schedule, applies fn and saves the result
+	// atomically. If fn returns an error nothing is written and the error is
+	// returned.
+	UpdateSchedule(ctx context.Context, id string, fn func(*types.Schedule) error) (*types.Schedule, error)
+	DeleteSchedule(ctx context.Context, id string) error
+}
+
+// DeploymentFilter narrows the result of EnvironmentStore.ListDeployments.
+// Zero values match all deployments.
+type DeploymentFilter struct {
+	Project     string
+	Environment string
+	Page        Page
+}
+
+// EnvironmentStore persists the environments projects deploy to and the
+// history of their deployments.
+type EnvironmentStore interface {
+	GetEnvironment(ctx context.Context, project, name string) (*types.Environment, error)
+	// ListEnvironments returns a project's environments ordered by name.
+	ListEnvironments(ctx context.Context, project string) ([]*types.Environment, error)
+	// UpdateEnvironment loads the environment, or starts a new one with
+	// only its project and name set if there is none, applies fn and saves
+	// the result atomically. If fn returns an error nothing is written and
+	// the error is returned.
+	UpdateEnvironment(ctx context.Context, project, name string, fn func(*types.Environment) error) (*types.Environment, error)
+	// PutDeployment creates the deployment or replaces the one with the
+	// same ID.
+	PutDeployment(ctx context.Context, deployment *types.Deployment) error
+	// ListDeployments returns the deployments matching filter, in the order
+	// and range filter.Page selects.
+	ListDeployments(ctx context.Context, filter DeploymentFilter) ([]*types.Deployment, error)
+}
+
+// NotifierStore persists the notifiers of projects and organizations, and
+// their deliveries.
+type NotifierStore interface {
+	CreateNotifier(ctx context.Context, notifier *types.Notifier) error
+	GetNotifier(ctx context.Context, id string) (*types.Notifier, error)
+	// ListNotifiers returns the notifiers of project, or of every project if
+	// it is empty, oldest first. Organization notifiers are left out.
+	ListNotifiers(ctx context.Context, project string) ([]*types.Notifier, error)
+	// ListOrganizationNotifiers returns the notifiers of organization, or of
+	// every organization if it is empty, oldest first.
+	ListOrganizationNotifiers(ctx context.Context, organization string) ([]*types.Notifier, error)
+	// UpdateNotifier loads the notifier, applies fn and saves the result
+	// atomically. If fn returns an error nothing is written and the error is
+	// returned.
+	UpdateNotifier(ctx context.Context, id string, fn func(*types.Notifier) error) (*types.Notifier, error)
+	// DeleteNotifier deletes the notifier and its deliveries.
+	DeleteNotifier(ctx context.Context, id string) error
+	CreateNotifierDelivery(ctx context.Context, delivery *types.NotifierDelivery) error
+	// ListNotifierDeliveries returns the deliveries of the notifier, in the
+	// order and range page selects.
+	ListNotifierDeliveries(ctx context.Context, notifierID string, page Page) ([]*types.NotifierDelivery, error)
+	// DeleteNotifierDeliveries deletes the deliveries made before t and
+	// returns how many there were.
+	DeleteNotifierDeliveries(ctx context.Context, t time.Time) (int, error)
+}
+
+// NotificationPreferenceStore persists the notification preferences of
+// users.
+type NotificationPreferenceStore interface {
+	// GetNotificationPreferences returns ErrNotFound if the user has none.
+	GetNotificationPreferences(ctx context.Context, user string) (*types.NotificationPreferences, error)
+	// PutNotificationPreferences creates the preferences or replaces the
+	// user's.
+	PutNotificationPreferences(ctx context.Context, prefs *types.NotificationPreferences) error
+	// ListNotificationPreferences returns the preferences of every user,
+	// ordered by user.
+	ListNotificationPreferences(ctx context.Context) ([]*types.NotificationPreferences, error)
+	DeleteNotificationPreferences(ctx context.Context, user string) error
+}
+
+// AuditFilter narrows the result of AuditStore.ListAudit. Zero values match
+// all events.
+type AuditFilter struct {
+	Actor string
+	// Resource matches events on the resource path and the paths beneath
+	// it, so that /jobs/{id} includes /jobs/{id}/cancel.
+	Resource string
+	// Since and Until bound the time of the events, inclusive and
+	// exclusive respectively.
+	Since time.Time
+	Until time.Time
+	// Page orders events by time; they are never updated, so SortUpdated
+	// orders them the same way.
+	Page Page
+}
+
+// AuditStore persists the audit log. It offers no way to change or delete
+// events once appended.
+type AuditStore interface {
+	AppendAudit(ctx context.Context, event *types.AuditEvent) error
+	// ListAudit returns the events matching filter, in the order and range
+	// filter.Page selects.
+	ListAudit(ctx context.Context, filter AuditFilter) ([]*types.AuditEvent, error)
+}
+
+// Lease is a lock held through a LockStore.
+type Lease interface {
+	// Lost is closed if the lock is lost before Release, for example
+	// because the database connection holding it broke.
+	Lost() <-chan struct{}
+	// Release gives the lock up.
+	Release(ctx context.Context) error
+}
+
+// LockStore hands out named locks held by at most one holder at a time
+// among all servers sharing the store.
+type LockStore interface {
+	// TryLock takes the lock called name if nobody holds it, and reports
+	// false without waiting if somebody does.
+	TryLock(ctx context.Context, name string) (Lease, bool, error)
+}
+
+// SchemaStatus compares the schema of a store with the migrations the
+// running binary carries.
+type SchemaStatus struct {
+	// Version is the last migration applied and Latest the last one
+	// known. Dirty is set when a migration failed halfway.
+	Version int  `json:"version"`
+	Latest  int  `json:"latest"`
+	Dirty   bool `json:"dirty,omitempty"`
+}
+
+// Current reports whether every known migration is applied. A schema newer
+// than the binary counts as current, as it is during a rolling upgrade.
+func (s SchemaStatus) Current() bool {
+	return !s.Dirty && s.Version >= s.Latest
+}
+
+// HealthStore reports whether the store can serve requests.
+type HealthStore interface {
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+	Schema(ctx context.Context) (SchemaStatus, error)
+}
+
+// Store is the full persistence layer used by the control plane.
+type Store interface {
+	AgentStore
+	JobStore
+	PipelineStore
+	TokenStore
+	AgentTokenStore
+	RBACStore
+	OrganizationStore
+	ArtifactStore
+	AnnotationStore
+	JobLogStore
+	LogIndexStore
+	SnapshotStore
+	CacheStore
+	SecretStore
+	SCMCredentialStore
+	VariableStore
+	RequiredCheckStore
+	ProjectQuotaStore
+	RetentionPolicyStore
+	SchedulerPauseStore
+	TemplateStore
+	WebhookDeliveryStore
+	ScheduleStore
+	EnvironmentStore
+	NotifierStore
+	NotificationPreferenceStore
+	AuditStore
+	LockStore
+	HealthStore
+	Close() error
+}
+
+// Open returns the store selected by databaseURL. An empty URL selects the
+// in-memory store; postgres:// and postgresql:// URLs select PostgreSQL, and
+// sqlite:// URLs followed by the path of the database file select SQLite.
+// Both apply any pending migrations.
+func Open(ctx context.Context, databaseURL string) (Store, error) {
+	switch {
+	case databaseURL == "":
+		return NewMemory(), nil
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		return OpenPostgres(ctx, databaseURL)
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		return OpenSQLite(ctx, strings.TrimPrefix(databaseURL, "sqlite://"))
+	default:
+		return nil, fmt.Errorf("storage: unsupported database URL scheme in %q", redactURL(databaseURL))
+	}
+}
+
+// redactURL strips credentials from a URL for use in error messages.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"open-cicd/internal/types"
+)
+
+// stores returns a store of every kind that needs no server.
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "cicd.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Store{"memory": NewMemory(), "sqlite": db}
+}
+
+func TestJobStore(t *testing.T) {
+	base := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	jobs := []*types.Job{
+		{ID: "j1", Name: "build", Repository: "acme/app", Ref: "refs/heads/main", State: types.JobStateQueued, CreatedAt: base, UpdatedAt: base},
+		{ID: "j2", Name: "test", Repository: "acme/app", Ref: "main", State: types.JobStateRunning, AgentID: "a", CreatedAt: base.Add(time.Second), UpdatedAt: base.Add(time.Second)},
+		{ID: "j3", Name: "build", Repository: "acme/web", Ref: "refs/heads/dev", State: types.JobStateQueued, CreatedAt: base.Add(2 * time.Second), UpdatedAt: base.Add(2 * time.Second)},
+	}
+	tests := []struct {
+		name   string
+		filter JobFilter
+		want   []string
+	}{
+		{"all", JobFilter{}, []string{"j1", "j2", "j3"}},
+		{"state", JobFilter{State: types.JobStateQueued}, []string{"j1", "j3"}},
+		{"repository", JobFilter{Repository: "acme/app"}, []string{"j1", "j2"}},
+		{"branch matches both forms of ref", JobFilter{Branch: "main"}, []string{"j1", "j2"}},
+		{"agent", JobFilter{AgentID: "a"}, []string{"j2"}},
+		{"newest first", JobFilter{Page: Page{Desc: true}}, []string{"j3", "j2", "j1"}},
+		{"limit", JobFilter{Page: Page{Limit: 2}}, []string{"j1", "j2"}},
+		{"after", JobFilter{Page: Page{After: &Cursor{Time: base, ID: "j1"}}}, []string{"j2", "j3"}},
+		{"no match", JobFilter{Repository: "acme/none"}, []string{}},
+	}
+	for kind, store := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			for _, job := range jobs {
+				if err := store.CreateJob(ctx, job); err != nil {
+					t.Fatalf("CreateJob(%s): %v", job.ID, err)
+				}
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					got, err := store.ListJobs(ctx, tt.filter)
+					if err != nil {
+						t.Fatalf("ListJobs: %v", err)
+					}
+					ids := []string{}
+					for _, job := range got {
+						ids = append(ids, job.ID)
+					}
+					if !slices.Equal(ids, tt.want) {
+						t.Errorf("ListJobs = %v, want %v", ids, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestUpdateJob(t *testing.T) {
+	errRejected := errors.New("rejected")
+	for kind, store := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+			job := &types.Job{ID: "j1", Name: "build", State: types.JobStateQueued, CreatedAt: now, UpdatedAt: now}
+			if err := store.CreateJob(ctx, job); err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+			if err := store.CreateJob(ctx, job); err == nil {
+				t.Errorf("CreateJob of an existing ID succeeded")
+			}
+
+			updated, err := store.UpdateJob(ctx, "j1", func(j *types.Job) error {
+				j.AgentID = "a"
+				j.LeaseToken++
+				return j.Transition(types.JobStateAssigned, now.Add(time.Second), "")
+			})
+			if err != nil {
+				t.Fatalf("UpdateJob: %v", err)
+			}
+			if updated.State != types.JobStateAssigned || updated.AgentID != "a" || updated.LeaseToken != 1 {
+				t.Errorf("updated job is %s on %q under lease %d, want assigned on a under lease 1", updated.State, updated.AgentID, updated.LeaseToken)
+			}
+
+			// A rejected update writes nothing.
+			_, err = store.UpdateJob(ctx, "j1", func(j *types.Job) error {
+				j.AgentID = "b"
+				return errRejected
+			})
+			if !errors.Is(err, errRejected) {
+				t.Errorf("UpdateJob error = %v, want %v", err, errRejected)
+			}
+			got, err := store.GetJob(ctx, "j1")
+			if err != nil {
+				t.Fatalf("GetJob: %v", err)
+			}
+			if got.AgentID != "a" || got.LeaseToken != 1 || len(got.Transitions) != 1 {
+				t.Errorf("job is on %q under lease %d with %d transitions, want on a under lease 1 with 1", got.AgentID, got.LeaseToken, len(got.Transitions))
+			}
+
+			if _, err := store.GetJob(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetJob of a missing job error = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := store.UpdateJob(ctx, "missing", func(*types.Job) error { return nil }); !errors.Is(err, ErrNotFound) {
+				t.Errorf("UpdateJob of a missing job error = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestOrganizationProjects(t *testing.T) {
+	for kind, store := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+			if err := store.CreateOrganization(ctx, &types.Organization{Name: "acme", RegistrationTokenHash: "h1", CreatedAt: now}); err != nil {
+				t.Fatalf("CreateOrganization: %v", err)
+			}
+			if err := store.CreateProject(ctx, &types.Project{Name: "acme/app", Organization: "acme", CreatedAt: now}); err != nil {
+				t.Fatalf("CreateProject: %v", err)
+			}
+			if err := store.CreateProject(ctx, &types.Project{Name: "acme/app", Organization: "acme", CreatedAt: now}); !errors.Is(err, ErrConflict) {
+				t.Errorf("CreateProject of an existing project error = %v, want %v", err, ErrConflict)
+			}
+			if err := store.CreateProject(ctx, &types.Project{Name: "other/app", Organization: "other", CreatedAt: now}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("CreateProject in a missing organization error = %v, want %v", err, ErrNotFound)
+			}
+
+			if err := store.DeleteOrganization(ctx, "acme"); err == nil {
+				t.Errorf("DeleteOrganization of an organization owning a project succeeded")
+			}
+			if _, err := store.GetOrganization(ctx, "acme"); err != nil {
+				t.Errorf("GetOrganization after a refused delete: %v", err)
+			}
+			if err := store.DeleteOrganization(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("DeleteOrganization of a missing organization error = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	for kind, store := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			lease, ok, err := store.TryLock(ctx, "scheduler")
+			if err != nil || !ok {
+				t.Fatalf("TryLock = %v, %v, want the lock", ok, err)
+			}
+			if _, ok, err := store.TryLock(ctx, "scheduler"); err != nil || ok {
+				t.Errorf("TryLock of a held lock = %v, %v, want false", ok, err)
+			}
+			other, ok, err := store.TryLock(ctx, "cron")
+			if err != nil || !ok {
+				t.Fatalf("TryLock of another lock = %v, %v, want the lock", ok, err)
+			}
+			defer other.Release(ctx)
+
+			if err := lease.Release(ctx); err != nil {
+				t.Fatalf("Release: %v", err)
+			}
+			again, ok, err := store.TryLock(ctx, "scheduler")
+			if err != nil || !ok {
+				t.Fatalf("TryLock after Release = %v, %v, want the lock", ok, err)
+			}
+			again.Release(ctx)
+		})
+	}
+}
+
+func TestSearchLogs(t *testing.T) {
+	finished := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	line := func(job, project string, n int, text string) *types.LogLine {
+		return &types.LogLine{ID: fmt.Sprintf("%s:%d", job, n), JobID: job, Project: project, Number: n, Text: text, FinishedAt: finished}
+	}
+	logs := map[string][]*types.LogLine{
+		"j1": {line("j1", "acme/app", 1, "go build ./..."), line("j1", "acme/app", 2, "panic: runtime error")},
+		"j2": {line("j2", "acme/web", 1, "npm ERR! missing script"), line("j2", "acme/web", 2, "runtime error in test")},
+	}
+	tests := []struct {
+		name   string
+		search LogSearch
+		want   []string
+	}{
+		{"word in any case", LogSearch{Query: "RUNTIME"}, []string{"j1:2", "j2:2"}},
+		{"every word", LogSearch{Query: "error panic"}, []string{"j1:2"}},
+		{"phrase", LogSearch{Query: `"missing script"`}, []string{"j2:1"}},
+		{"excluded word", LogSearch{Query: "error -panic"}, []string{"j2:2"}},
+		{"project", LogSearch{Query: "error", Project: "acme/app"}, []string{"j1:2"}},
+		{"job", LogSearch{Query: "error", JobID: "j2"}, []string{"j2:2"}},
+		{"only excluded words", LogSearch{Query: "-panic"}, []string{}},
+	}
+	for kind, store := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			for job, lines := range logs {
+				if err := store.IndexJobLog(ctx, job, lines); err != nil {
+					t.Fatalf("IndexJobLog(%s): %v", job, err)
+				}
+			}
+			// Indexing a log again replaces its lines.
+			if err := store.IndexJobLog(ctx, "j1", logs["j1"]); err != nil {
+				t.Fatalf("IndexJobLog: %v", err)
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					got, err := store.SearchLogs(ctx, tt.search)
+					if err != nil {
+						t.Fatalf("SearchLogs: %v", err)
+					}
+					ids := []string{}
+					for _, l := range got {
+						ids = append(ids, l.ID)
+					}
+					slices.Sort(ids)
+					if !slices.Equal(ids, tt.want) {
+						t.Errorf("SearchLogs = %v, want %v", ids, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
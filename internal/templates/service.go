@@ -0,0 +1,187 @@
+// Package templates publishes the pipeline templates definitions include,
+// and loads them, and template files from shared repositories, when
+// definitions are expanded.
+package templates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+	"open-cicd/internal/version"
+)
+
+// ErrRepositoryNotAllowed is returned for template files in repositories the
+// server is not configured to read templates from.
+var ErrRepositoryNotAllowed = errors.New("repository is not an allowed template repository")
+
+// Fetcher reads a file from a Git repository at a ref. It is satisfied by
+// webhooks.GitFetcher.
+type Fetcher interface {
+	FetchFile(ctx context.Context, cloneURL, ref, path string) ([]byte, error)
+}
+
+// Service stores published templates and loads the templates of pipeline
+// definitions. It implements pipeline.TemplateLoader.
+type Service struct {
+	store        storage.TemplateStore
+	fetcher      Fetcher
+	repositories []string
+	now          func() time.Time
+}
+
+// NewService returns a Service that keeps templates in store and reads
+// template files with fetcher from the repositories whose URLs start with
+// one of repositories.
+func NewService(store storage.TemplateStore, fetcher Fetcher, repositories []string) *Service {
+	var prefixes []string
+	for _, r := range repositories {
+		if r = strings.TrimSpace(r); r != "" {
+			prefixes = append(prefixes, r)
+		}
+	}
+	return &Service{store: store, fetcher: fetcher, repositories: prefixes, now: time.Now}
+}
+
+// Publish stores a new version of the template in req.Source on behalf of
+// publishedBy. Errors in the source are returned as a pipeline.ErrorList;
+// publishing a version again returns storage.ErrConflict.
+func (s *Service) Publish(ctx context.Context, req types.PublishTemplateRequest, publishedBy string) (*types.Template, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	parsed, err := pipeline.ParseTemplate([]byte(req.Source))
+	if err != nil {
+		return nil, err
+	}
+	// Versions are stored in one spelling, so that v1.2 and 1.2.0 are the
+	// same version.
+	number, _ := version.Parse(req.Version)
+	template := &types.Template{
+		Name:        parsed.Name,
+		Version:     number.String(),
+		Description: parsed.Description,
+		Source:      req.Source,
+		PublishedBy: publishedBy,
+		CreatedAt:   s.now(),
+	}
+	if err := s.store.CreateTemplate(ctx, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// List returns the published versions of the template called name, or of
+// every template if name is empty, oldest first.
+func (s *Service) List(ctx context.Context, name string) ([]*types.Template, error) {
+	return s.store.ListTemplates(ctx, name)
+}
+
+// Get returns the version of the template called name, the newest if
+// version is pipeline.LatestVersion.
+func (s *Service) Get(ctx context.Context, name, ver string) (*types.Template, error) {
+	if ver != pipeline.LatestVersion {
+		number, err := version.Parse(ver)
+		if err != nil {
+			return nil, err
+		}
+		return s.store.GetTemplate(ctx, name, number.String())
+	}
+	versions, err := s.store.ListTemplates(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		latest *types.Template
+		newest version.Number
+	)
+	for _, t := range versions {
+		number, err := version.Parse(t.Version)
+		if err != nil {
+			continue
+		}
+		if latest == nil || number.Compare(newest) > 0 {
+			latest, newest = t, number
+		}
+	}
+	if latest == nil {
+		return nil, storage.ErrNotFound
+	}
+	return latest, nil
+}
+
+// Delete removes a published version. Runs already expanded with it are not
+// affected, but definitions including it no longer expand.
+func (s *Service) Delete(ctx context.Context, name, ver string) error {
+	number, err := version.Parse(ver)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+	return s.store.DeleteTemplate(ctx, name, number.String())
+}
+
+// Resolve expands the templates the pipeline file source includes, without
+// running it. Errors in the definition are returned as a
+// pipeline.ErrorList.
+func (s *Service) Resolve(ctx context.Context, source string) (*types.ResolveTemplatesResponse, error) {
+	def, err := pipeline.Parse([]byte(source))
+	if err != nil {
+		return nil, err
+	}
+	resp := &types.ResolveTemplatesResponse{Definition: source}
+	if len(def.Include) == 0 {
+		return resp, nil
+	}
+	for _, inc := range def.Include {
+		resp.Includes = append(resp.Includes, inc.String())
+	}
+	if err := def.Expand(ctx, s); err != nil {
+		return nil, err
+	}
+	expanded, err := def.YAML()
+	if err != nil {
+		return nil, fmt.Errorf("encoding expanded definition: %w", err)
+	}
+	resp.Definition = string(expanded)
+	return resp, nil
+}
+
+// LoadTemplate loads a published template or a template file from an
+// allowed repository.
+func (s *Service) LoadTemplate(ctx context.Context, inc pipeline.Include) (*pipeline.Template, error) {
+	if inc.Template != "" {
+		name, ver := inc.TemplateRef()
+		t, err := s.Get(ctx, name, ver)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, fmt.Errorf("template %s has no version %s", name, ver)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pipeline.ParseTemplate([]byte(t.Source))
+	}
+	if !s.allowed(inc.Repository) {
+		return nil, ErrRepositoryNotAllowed
+	}
+	data, err := s.fetcher.FetchFile(ctx, inc.Repository, inc.Ref, inc.File)
+	if err != nil {
+		return nil, err
+	}
+	return pipeline.ParseTemplate(data)
+}
+
+// allowed reports whether template files may be read from the repository
+// at cloneURL.
+func (s *Service) allowed(cloneURL string) bool {
+	for _, prefix := range s.repositories {
+		if strings.HasPrefix(cloneURL, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+// Package tracing sets up OpenTelemetry tracing and carries trace context
+// across the asynchronous hops of a job, so that one trace covers its
+// submission, scheduling, assignment and completion.
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"open-cicd/internal/types"
+)
+
+// instrumentationName identifies the spans created by the server.
+const instrumentationName = "open-cicd"
+
+// Tracer returns the tracer for server spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Enabled reports whether the environment configures an OTLP endpoint.
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs the global tracer provider and W3C trace context
+// propagation. When Enabled, spans are batched to an OTLP/gRPC exporter that
+// takes the rest of its settings (headers, TLS, timeout) from the standard
+// OTEL_EXPORTER_OTLP_* variables; the sampler follows OTEL_TRACES_SAMPLER and
+// the resource OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES. Otherwise
+// spans are dropped but incoming trace context is still passed on. The
+// returned function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", instrumentationName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Inject returns the trace context of ctx in a form that can be stored with
+// a job, or nil if ctx carries none.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx joined to the trace stored by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// JobContext returns ctx joined to the trace the job was submitted in.
+func JobContext(ctx context.Context, job *types.Job) context.Context {
+	return Extract(ctx, job.TraceContext)
+}
+
+// JobAttributes describe a job on its spans.
+func JobAttributes(job *types.Job) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("job.id", job.ID),
+		attribute.String("job.name", job.Name),
+		attribute.String("job.priority", string(job.Priority)),
+	}
+	if job.Repository != "" {
+		attrs = append(attrs, attribute.String("job.repository", job.Repository))
+	}
+	if job.PipelineID != "" {
+		attrs = append(attrs, attribute.String("pipeline.id", job.PipelineID))
+	}
+	if job.AgentID != "" {
+		attrs = append(attrs, attribute.String("agent.id", job.AgentID))
+	}
+	return attrs
+}
+
+// ObserveJob records spans for the phases of a job. It is meant to be
+// registered as a job manager observer: a "job.queued" span covers the wait
+// from queueing to assignment and a "job.run" span the time from starting on
+// an agent to a final state. Both are backdated to the job's transitions and
+// belong to the trace the job was submitted in. Updates that did not change
+// the job's state are ignored.
+func ObserveJob(job *types.Job) {
+	if len(job.Transitions) < 2 {
+		return
+	}
+	last := job.Transitions[len(job.Transitions)-1]
+	if !last.At.Equal(job.UpdatedAt) {
+		return
+	}
+	ctx := JobContext(context.Background(), job)
+	switch {
+	case last.To == types.JobStateAssigned && last.From == types.JobStateQueued:
+		queued := job.Transitions[len(job.Transitions)-2]
+		_, span := Tracer().Start(ctx, "job.queued", trace.WithTimestamp(queued.At), trace.WithAttributes(JobAttributes(job)...))
+		if queued.Reason != "" {
+			span.SetAttributes(attribute.String("job.queue_reason", queued.Reason))
+		}
+		span.End(trace.WithTimestamp(last.At))
+	case last.To.Terminal():
+		started, ok := job.LastTransition(types.JobStateRunning)
+		if !ok {
+			return
+		}
+		_, span := Tracer().Start(ctx, "job.run", trace.WithTimestamp(started.At), trace.WithAttributes(JobAttributes(job)...))
+		span.SetAttributes(attribute.String("job.outcome", string(last.To)))
+		if job.ExitCode != nil {
+			span.SetAttributes(attribute.Int("job.exit_code", *job.ExitCode))
+		}
+		if last.To.Failure() {
+			span.SetStatus(codes.Error, last.Reason)
+		}
+		span.End(trace.WithTimestamp(last.At))
+	}
+}
+
+// RecordError marks span as failed with err.
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
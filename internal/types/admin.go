@@ -0,0 +1,81 @@
+package types
+
+import "time"
+
+// SchedulerPause records that scheduling was paused server-wide, such as
+// during an incident: queued jobs stay queued until it is resumed, while
+// jobs already assigned to agents run on.
+type SchedulerPause struct {
+	By        string    `json:"by,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// PauseSchedulingRequest is the body of POST /admin/scheduler/pause.
+type PauseSchedulingRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// SchedulerStatus is what GET /admin/scheduler reports of the scheduler.
+type SchedulerStatus struct {
+	// Leader is set on the replica that schedules jobs. Only the leader has
+	// a queue and connected agents to report.
+	Leader bool `json:"leader"`
+	// Draining is set while the replica is shutting down.
+	Draining bool            `json:"draining,omitempty"`
+	Paused   *SchedulerPause `json:"paused,omitempty"`
+	// Queue lists the queued jobs in the order the scheduler takes them
+	// when every job fits an agent and projects have equal shares.
+	Queue []QueuedJob `json:"queue"`
+	// Agents lists every agent with the jobs assigned to it.
+	Agents []AgentAssignments `json:"agents"`
+}
+
+// QueuedJob is a job in the scheduler's queue.
+type QueuedJob struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Repository string            `json:"repository,omitempty"`
+	PipelineID string            `json:"pipeline_id,omitempty"`
+	Priority   Priority          `json:"priority,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	QueuedAt   time.Time         `json:"queued_at"`
+}
+
+// AgentAssignments is an agent and the jobs it holds.
+type AgentAssignments struct {
+	ID           string     `json:"id"`
+	Hostname     string     `json:"hostname"`
+	Organization string     `json:"organization,omitempty"`
+	State        AgentState `json:"state"`
+	// Connected is set when the agent has its job stream open to the
+	// leader, and FreeSlots is then how many more jobs it announced it
+	// takes.
+	Connected bool      `json:"connected"`
+	FreeSlots int       `json:"free_slots"`
+	Capacity  int       `json:"capacity"`
+	Jobs      []HeldJob `json:"jobs"`
+}
+
+// LogLevel is the body and response of /admin/log-level.
+type LogLevel struct {
+	// Level is one of debug, info, warn or error.
+	Level string `json:"level" openapi:"required"`
+}
+
+// ReconcileReport is what POST /admin/agents/reconcile changed to bring the
+// recorded state of agents and their jobs in line with the connected
+// agents.
+type ReconcileReport struct {
+	// Offline are the agents recorded online or draining that were not
+	// connected, and Online those recorded offline that were.
+	Offline []string `json:"offline"`
+	Online  []string `json:"online"`
+	// Requeued are the jobs of agents that are not connected handed back
+	// to the queue, and Expired those whose leases had run out.
+	Requeued []string `json:"requeued"`
+	Expired  []string `json:"expired"`
+	// Redelivered are the connected agents sent the jobs they were
+	// assigned but have not started again.
+	Redelivered []string `json:"redelivered"`
+}
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// AgentState is the lifecycle state of a registered agent.
+type AgentState string
+
+const (
+	// AgentStateRegistered is the initial state after a successful registration.
+	AgentStateRegistered AgentState = "registered"
+	// AgentStateOnline means the agent is connected and accepting work.
+	AgentStateOnline AgentState = "online"
+	// AgentStateDraining means the agent finishes current work but takes no new jobs.
+	AgentStateDraining AgentState = "draining"
+	// AgentStateOffline means the agent is unreachable or has disconnected.
+	AgentStateOffline AgentState = "offline"
+)
+
+// AgentStates lists every agent state.
+var AgentStates = []AgentState{AgentStateRegistered, AgentStateOnline, AgentStateDraining, AgentStateOffline}
+
+// agentTransitions defines the agent state machine. Any transition not listed
+// here is rejected.
+var agentTransitions = map[AgentState][]AgentState{
+	AgentStateRegistered: {AgentStateOnline, AgentStateOffline},
+	AgentStateOnline:     {AgentStateDraining, AgentStateOffline},
+	AgentStateDraining:   {AgentStateOnline, AgentStateOffline},
+	AgentStateOffline:    {AgentStateOnline},
+}
+
+// Valid reports whether s is a known agent state.
+func (s AgentState) Valid() bool {
+	_, ok := agentTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether the state machine allows moving from s to next.
+func (s AgentState) CanTransitionTo(next AgentState) bool {
+	for _, allowed := range agentTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentTransport is how an agent speaks the agent protocol to the server.
+type AgentTransport string
+
+const (
+	// AgentTransportGRPC is the gRPC port of the server.
+	AgentTransportGRPC AgentTransport = "grpc"
+	// AgentTransportHTTP is the fallback over plain HTTP requests to the
+	// server's HTTP port, for networks that only let HTTPS through.
+	AgentTransportHTTP AgentTransport = "http"
+)
+
+// Agent is a build agent known to the control plane.
+type Agent struct {
+	ID             string            `json:"id"`
+	Hostname       string            `json:"hostname"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Capacity       int               `json:"capacity"`
+	State          AgentState        `json:"state"`
+	CredentialHash string            `json:"-"`
+	// Organization is the organization whose registration token the agent
+	// registered with. Agents of no organization are shared and run jobs
+	// of any; an organization's agents only run its own.
+	Organization string `json:"organization,omitempty"`
+	// CertificateFingerprint is the hex SHA-256 digest of the client
+	// certificate the agent registered with, if any.
+	CertificateFingerprint string    `json:"certificate_fingerprint,omitempty"`
+	RegisteredAt           time.Time `json:"registered_at"`
+	// LastSeenAt is the time of the agent's latest heartbeat.
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Resources is what the agent last reported of its machine, if it
+	// reports it; jobs are then only assigned to it as far as they fit.
+	Resources *AgentResources `json:"resources,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	// Version is the build version the agent registered with, and Platform
+	// the GOOS/GOARCH it runs on. AutoUpdate agents install new versions
+	// when the server rolls one out.
+	Version    string `json:"version,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	AutoUpdate bool   `json:"auto_update,omitempty"`
+	// Shells are the shells the agent has, if it said; see RunsPlatform.
+	Shells []Shell `json:"shells,omitempty"`
+	// Transport is how the agent speaks the agent protocol, if it does.
+	Transport AgentTransport `json:"transport,omitempty"`
+	// Update is the latest update the agent was asked to install.
+	Update *AgentUpdate `json:"update,omitempty"`
+	// Drain is set while the agent is drained for maintenance.
+	Drain *AgentDrain `json:"drain,omitempty"`
+}
+
+// AgentDrain records that an agent was drained for maintenance, such as
+// patching its host. It takes no new jobs, even after reconnecting, until it
+// is resumed; the jobs it holds run to completion.
+type AgentDrain struct {
+	By        string    `json:"by,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AgentUpdate is an update the rolling update asked an agent to install.
+// The agent is drained until it restarts into the new version, and
+// registers again when it does.
+type AgentUpdate struct {
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"started_at"`
+	// Error is why the agent could not install the update. It then runs
+	// jobs again, and is not asked to install the version again.
+	Error string `json:"error,omitempty"`
+}
+
+// Transition moves the agent to next, enforcing the agent state machine.
+func (a *Agent) Transition(next AgentState, at time.Time) error {
+	if !a.State.CanTransitionTo(next) {
+		return fmt.Errorf("%w: agent %s cannot move from %s to %s", ErrInvalidTransition, a.ID, a.State, next)
+	}
+	a.State = next
+	a.UpdatedAt = at
+	return nil
+}
+
+// Serves reports whether the agent may run job.
+func (a *Agent) Serves(job *Job) bool {
+	return a.Organization == "" || a.Organization == job.Organization
+}
+
+// Clone returns a deep copy of the agent.
+func (a *Agent) Clone() *Agent {
+	c := *a
+	if a.Labels != nil {
+		c.Labels = make(map[string]string, len(a.Labels))
+		for k, v := range a.Labels {
+			c.Labels[k] = v
+		}
+	}
+	if a.Update != nil {
+		u := *a.Update
+		c.Update = &u
+	}
+	if a.Drain != nil {
+		d := *a.Drain
+		c.Drain = &d
+	}
+	if a.Resources != nil {
+		r := *a.Resources
+		c.Resources = &r
+	}
+	if a.Shells != nil {
+		c.Shells = append([]Shell(nil), a.Shells...)
+	}
+	return &c
+}
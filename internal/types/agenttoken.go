@@ -0,0 +1,122 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AgentToken is a registration token handed out for registering agents,
+// unlike the shared ones of the server's configuration and the one of each
+// organization limited in time, in how many agents it registers and in the
+// labels they may carry. Only a hash of the secret is stored; the secret
+// itself is shown once when the token is created.
+type AgentToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Organization, if set, registers agents into that organization, whose
+	// jobs only they run; otherwise they are shared.
+	Organization string `json:"organization,omitempty"`
+	// Labels, if set, are the only labels agents may register with: each
+	// label of an agent must be one of them, with the same value.
+	Labels map[string]string `json:"labels,omitempty"`
+	// MaxUses is how many agents the token registers; zero means no limit.
+	// Uses counts those it registered.
+	MaxUses    int        `json:"max_uses,omitempty"`
+	Uses       int        `json:"uses"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// RevokedAt and RevokedBy record who revoked the token, if anyone did.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+	Hash      string     `json:"-"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Clone returns a deep copy of the token.
+func (t *AgentToken) Clone() *AgentToken {
+	c := *t
+	if t.Labels != nil {
+		c.Labels = make(map[string]string, len(t.Labels))
+		for k, v := range t.Labels {
+			c.Labels[k] = v
+		}
+	}
+	if t.LastUsedAt != nil {
+		at := *t.LastUsedAt
+		c.LastUsedAt = &at
+	}
+	if t.RevokedAt != nil {
+		at := *t.RevokedAt
+		c.RevokedAt = &at
+	}
+	return &c
+}
+
+// Usable returns nil if the token may register another agent at now, and
+// why not otherwise.
+func (t *AgentToken) Usable(now time.Time) error {
+	switch {
+	case t.RevokedAt != nil:
+		return errors.New("token was revoked")
+	case !now.Before(t.ExpiresAt):
+		return errors.New("token expired")
+	case t.MaxUses > 0 && t.Uses >= t.MaxUses:
+		return fmt.Errorf("token was used %d times, its limit", t.Uses)
+	}
+	return nil
+}
+
+// Admits returns nil if an agent with labels may register with the token,
+// and the first label it may not carry otherwise.
+func (t *AgentToken) Admits(labels map[string]string) error {
+	if len(t.Labels) == 0 {
+		return nil
+	}
+	for k, v := range labels {
+		if allowed, ok := t.Labels[k]; !ok || allowed != v {
+			return fmt.Errorf("label %s=%s is not allowed by the token, which allows %s", k, v, FormatLabels(t.Labels))
+		}
+	}
+	return nil
+}
+
+// CreateAgentTokenRequest is the body of POST /agent-tokens.
+type CreateAgentTokenRequest struct {
+	Name string `json:"name" openapi:"required"`
+	// Organization registers the token's agents into one organization.
+	Organization string            `json:"organization,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	MaxUses      int               `json:"max_uses,omitempty"`
+	// ExpiresIn is how long the token stays valid, e.g. "24h".
+	ExpiresIn Duration `json:"expires_in" openapi:"required"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateAgentTokenRequest) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	if r.Organization != "" && !organizationNamePattern.MatchString(r.Organization) {
+		return fmt.Errorf("invalid organization name %q", r.Organization)
+	}
+	if err := ValidateLabels(r.Labels); err != nil {
+		return err
+	}
+	if r.MaxUses < 0 {
+		return errors.New("max_uses must not be negative")
+	}
+	if r.ExpiresIn <= 0 {
+		return errors.New("expires_in is required and must be positive")
+	}
+	return nil
+}
+
+// CreateAgentTokenResponse is returned by POST /agent-tokens. Token is the
+// registration token and is only ever shown in this response.
+type CreateAgentTokenResponse struct {
+	AgentToken
+	Token string `json:"token"`
+}
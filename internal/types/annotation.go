@@ -0,0 +1,160 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxAnnotationsPerRequest bounds the annotations of one
+	// CreateAnnotationsRequest, and MaxAnnotationsPerJob those a job may
+	// publish in all.
+	MaxAnnotationsPerRequest = 100
+	MaxAnnotationsPerJob     = 1000
+
+	maxAnnotationTitleLen   = 255
+	maxAnnotationMessageLen = 64 << 10
+)
+
+// AnnotationLevel is how much an annotation matters.
+type AnnotationLevel string
+
+const (
+	AnnotationNotice  AnnotationLevel = "notice"
+	AnnotationWarning AnnotationLevel = "warning"
+	AnnotationError   AnnotationLevel = "error"
+	// AnnotationSummary is a markdown report of what a step did, such as
+	// a coverage table, shown with the run rather than against a file.
+	AnnotationSummary AnnotationLevel = "summary"
+)
+
+// Annotation is a finding or summary a step publishes while its job runs,
+// such as a lint warning on a line of a file, kept with the run so that it
+// shows up without reading through the log.
+type Annotation struct {
+	JobID      string          `json:"job_id"`
+	JobName    string          `json:"job_name"`
+	PipelineID string          `json:"pipeline_id,omitempty"`
+	Project    string          `json:"project,omitempty"`
+	Level      AnnotationLevel `json:"level"`
+	Title      string          `json:"title,omitempty"`
+	// Message is markdown.
+	Message string `json:"message"`
+	// Path is the file of the repository the annotation is about, if any,
+	// and StartLine and EndLine the lines within it, if it says.
+	Path      string    `json:"path,omitempty"`
+	StartLine int       `json:"start_line,omitempty"`
+	EndLine   int       `json:"end_line,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Clone returns a copy of the annotation.
+func (a *Annotation) Clone() *Annotation {
+	c := *a
+	return &c
+}
+
+// NewAnnotation is an annotation in a CreateAnnotationsRequest.
+type NewAnnotation struct {
+	Level     AnnotationLevel `json:"level"`
+	Title     string          `json:"title,omitempty"`
+	Message   string          `json:"message"`
+	Path      string          `json:"path,omitempty"`
+	StartLine int             `json:"start_line,omitempty"`
+	EndLine   int             `json:"end_line,omitempty"`
+}
+
+// Validate checks the annotation's level, its length and where it points.
+func (a *NewAnnotation) Validate() error {
+	switch a.Level {
+	case AnnotationNotice, AnnotationWarning, AnnotationError, AnnotationSummary:
+	case "":
+		return errors.New("level is required")
+	default:
+		return fmt.Errorf("unknown level %q, expected notice, warning, error or summary", a.Level)
+	}
+	switch {
+	case strings.TrimSpace(a.Message) == "":
+		return errors.New("message is required")
+	case len(a.Message) > maxAnnotationMessageLen:
+		return fmt.Errorf("message is longer than %d bytes", maxAnnotationMessageLen)
+	case len(a.Title) > maxAnnotationTitleLen:
+		return fmt.Errorf("title is longer than %d bytes", maxAnnotationTitleLen)
+	}
+	if a.Path == "" {
+		if a.StartLine != 0 || a.EndLine != 0 {
+			return errors.New("lines need a path")
+		}
+		return nil
+	}
+	if p := a.Path; path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") || strings.ContainsAny(p, "\\\x00") {
+		return errors.New("path must be a clean path relative to the repository")
+	}
+	switch {
+	case a.StartLine < 0 || a.EndLine < 0:
+		return errors.New("lines must be positive")
+	case a.EndLine != 0 && a.StartLine == 0:
+		return errors.New("end_line needs a start_line")
+	case a.EndLine != 0 && a.EndLine < a.StartLine:
+		return errors.New("end_line is before start_line")
+	}
+	return nil
+}
+
+// CreateAnnotationsRequest is the body of POST /jobs/{id}/annotations.
+type CreateAnnotationsRequest struct {
+	Annotations []NewAnnotation `json:"annotations"`
+}
+
+// Validate checks every annotation of the request.
+func (r *CreateAnnotationsRequest) Validate() error {
+	switch {
+	case len(r.Annotations) == 0:
+		return errors.New("annotations are required")
+	case len(r.Annotations) > MaxAnnotationsPerRequest:
+		return fmt.Errorf("at most %d annotations may be published at once", MaxAnnotationsPerRequest)
+	}
+	for i := range r.Annotations {
+		if err := r.Annotations[i].Validate(); err != nil {
+			return fmt.Errorf("annotations[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// AnnotationCounts counts annotations by level.
+type AnnotationCounts struct {
+	Notices   int `json:"notices"`
+	Warnings  int `json:"warnings"`
+	Errors    int `json:"errors"`
+	Summaries int `json:"summaries"`
+}
+
+// CountAnnotations counts annotations by level.
+func CountAnnotations(annotations []*Annotation) AnnotationCounts {
+	var c AnnotationCounts
+	for _, a := range annotations {
+		switch a.Level {
+		case AnnotationNotice:
+			c.Notices++
+		case AnnotationWarning:
+			c.Warnings++
+		case AnnotationError:
+			c.Errors++
+		case AnnotationSummary:
+			c.Summaries++
+		}
+	}
+	return c
+}
+
+// PipelineDetail is the response of GET /pipelines/{id}: the run with the
+// annotations its jobs published, in the order they were published.
+type PipelineDetail struct {
+	*Pipeline
+	AnnotationCounts AnnotationCounts `json:"annotation_counts"`
+	Annotations      []*Annotation    `json:"annotations"`
+}
@@ -0,0 +1,501 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrorResponse is the JSON body returned for failed requests. Code is one
+// of the registry in errors.go and is what clients should branch on;
+// Message is meant for people. Details, when present, has the shape its code
+// documents. RequestID matches the X-Request-ID response header and the
+// server's logs of the request.
+type ErrorResponse struct {
+	Code      ErrorCode `json:"code" openapi:"required"`
+	Message   string    `json:"message" openapi:"required"`
+	Details   any       `json:"details,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// RegisterAgentRequest is the body of POST /register.
+type RegisterAgentRequest struct {
+	Hostname string            `json:"hostname" openapi:"required"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Capacity int               `json:"capacity"`
+	Token    string            `json:"token" openapi:"required"`
+	// Version is the agent's build version and Platform its GOOS/GOARCH,
+	// such as linux/amd64. Servers with a minimum agent version refuse
+	// agents older than it, and those that do not say.
+	Version  string `json:"version,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	// Shells are the shells the agent found on its host. Agents that do
+	// not say are assumed to have every shell their platform runs.
+	Shells []Shell `json:"shells,omitempty"`
+	// AutoUpdate says the agent installs new versions it is asked to.
+	AutoUpdate bool `json:"auto_update,omitempty"`
+	// Transport is how the agent reached the server, set by the server.
+	Transport AgentTransport `json:"-"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *RegisterAgentRequest) Validate() error {
+	if strings.TrimSpace(r.Hostname) == "" {
+		return errors.New("hostname is required")
+	}
+	if r.Token == "" {
+		return errors.New("token is required")
+	}
+	if r.Capacity < 0 {
+		return errors.New("capacity must not be negative")
+	}
+	if goos, goarch, ok := strings.Cut(r.Platform, "/"); r.Platform != "" && (!ok || goos == "" || goarch == "" || strings.Contains(goarch, "/")) {
+		return fmt.Errorf("platform %q is not GOOS/GOARCH, such as linux/amd64", r.Platform)
+	}
+	for _, s := range r.Shells {
+		if s == "" || !s.Valid() {
+			return fmt.Errorf("unknown shell %q", s)
+		}
+	}
+	return ValidateLabels(r.Labels)
+}
+
+// RegisterAgentResponse is returned after a successful registration. The
+// credential is only ever shown once; the server stores a hash of it.
+type RegisterAgentResponse struct {
+	AgentID    string     `json:"agent_id"`
+	Credential string     `json:"credential"`
+	State      AgentState `json:"state"`
+	// HeartbeatInterval is how often the agent must call
+	// POST /agents/{id}/heartbeat to stay online.
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+}
+
+// HeartbeatResponse is returned by POST /agents/{id}/heartbeat.
+type HeartbeatResponse struct {
+	State             AgentState `json:"state"`
+	HeartbeatInterval Duration   `json:"heartbeat_interval"`
+}
+
+// UpdateAgentStateRequest is the body of PUT /agents/{id}/state.
+type UpdateAgentStateRequest struct {
+	State AgentState `json:"state" openapi:"required"`
+}
+
+// Validate checks that the requested state is known.
+func (r *UpdateAgentStateRequest) Validate() error {
+	if !r.State.Valid() {
+		return errors.New("unknown agent state " + string(r.State))
+	}
+	return nil
+}
+
+// DrainAgentRequest is the optional body of POST /agents/{id}/drain.
+type DrainAgentRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// AgentDrainStatus reports the progress of draining an agent: the jobs it
+// still holds, whether assigned, running or being cancelled. Drained is set
+// once a draining agent holds none, when its host can be taken down.
+type AgentDrainStatus struct {
+	Agent   *Agent    `json:"agent"`
+	Jobs    []HeldJob `json:"jobs"`
+	Drained bool      `json:"drained"`
+}
+
+// HeldJob is a job an agent holds.
+type HeldJob struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	State      JobState `json:"state"`
+	PipelineID string   `json:"pipeline_id,omitempty"`
+}
+
+// CreateJobRequest is the body of POST /jobs.
+type CreateJobRequest struct {
+	Name       string   `json:"name" openapi:"required"`
+	Image      string   `json:"image,omitempty"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Commands   []string `json:"commands,omitempty"`
+	// OS restricts the job to agents running that operating system, and
+	// Shell is what its commands run with, sh by default, or powershell
+	// when OS is windows.
+	OS    string `json:"os,omitempty"`
+	Shell Shell  `json:"shell,omitempty"`
+	// Arch restricts the job to agents of that architecture, such as
+	// arm64. Images are variants of the image keyed by architecture, used
+	// in place of Image, and ResolveImage has the server look up the
+	// variants of Image in its registry when the job is submitted.
+	Arch         string            `json:"arch,omitempty"`
+	Images       map[string]string `json:"images,omitempty"`
+	ResolveImage bool              `json:"resolve_image,omitempty"`
+	// Tasks run in place of Commands, one container after another.
+	Tasks     []Task     `json:"tasks,omitempty"`
+	Services  []Service  `json:"services,omitempty"`
+	Resources *Resources `json:"resources,omitempty"`
+	// Requests is what the job needs of an agent to be scheduled on it.
+	Requests *ResourceRequests `json:"requests,omitempty"`
+	// Security restricts the privileges of the job's task containers.
+	Security  *SecurityContext  `json:"security,omitempty"`
+	Workspace string            `json:"workspace,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Timeout   Duration          `json:"timeout,omitempty"`
+	// LogLimit caps the output kept in the job's log, such as "50Mi".
+	LogLimit string `json:"log_limit,omitempty"`
+	// Repository groups the job for fair scheduling; jobs of one repository
+	// are dispatched in order, alternating with other repositories.
+	Repository string `json:"repository,omitempty"`
+	// Ref is the git ref the job builds, if any, and Commit the commit.
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Environment makes the job a deploy job to the named environment of
+	// the repository.
+	Environment string            `json:"environment,omitempty"`
+	Priority    Priority          `json:"priority,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Secrets names project secrets to inject into the environment, or
+	// reads them from Vault as NAME=vault:<path>#<key>.
+	Secrets []string     `json:"secrets,omitempty"`
+	Retry   *RetryPolicy `json:"retry,omitempty"`
+	// IDTokens maps environment variables to the audiences of the OIDC ID
+	// tokens the job gets in them.
+	IDTokens map[string]string `json:"id_tokens,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateJobRequest) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	if err := validateExecution(r.Image != "" || len(r.Images) > 0, r.Commands, r.Tasks, r.Services, r.Resources, r.Workspace); err != nil {
+		return err
+	}
+	if err := ValidateImages(r.Image, r.Images, r.ResolveImage, r.Arch); err != nil {
+		return err
+	}
+	if _, err := r.Requests.Amounts(); err != nil {
+		return err
+	}
+	if err := r.Security.Validate(); err != nil {
+		return err
+	}
+	if err := validatePlatform(r.OS, r.Shell); err != nil {
+		return err
+	}
+	if r.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if r.LogLimit != "" {
+		if _, err := ParseLogLimit(r.LogLimit); err != nil {
+			return err
+		}
+	}
+	if r.Priority != "" && !r.Priority.Valid() {
+		return fmt.Errorf("unknown priority %q", r.Priority)
+	}
+	if err := ValidateLabels(r.Labels); err != nil {
+		return err
+	}
+	if r.Retry != nil {
+		if err := r.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, entry := range r.Secrets {
+		if _, err := ParseSecretRef(entry); err != nil {
+			return err
+		}
+	}
+	if len(r.Secrets) > 0 && r.Repository == "" {
+		return errors.New("repository is required to use secrets")
+	}
+	if err := ValidateIDTokens(r.IDTokens); err != nil {
+		return err
+	}
+	if len(r.IDTokens) > 0 && r.Repository == "" {
+		return errors.New("repository is required to get ID tokens")
+	}
+	if r.Environment != "" {
+		if err := ValidateEnvironmentName(r.Environment); err != nil {
+			return err
+		}
+		if r.Repository == "" {
+			return errors.New("repository is required to deploy to an environment")
+		}
+	}
+	return nil
+}
+
+// JobStatusRequest is the body of POST /jobs/{id}/status, sent by agents as a
+// job progresses.
+type JobStatusRequest struct {
+	State    JobState `json:"state" openapi:"required"`
+	AgentID  string   `json:"agent_id,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	// Infrastructure marks a failure of the environment the job ran in
+	// rather than of its commands, for retry policies.
+	Infrastructure bool `json:"infrastructure,omitempty"`
+	// LeaseToken is the fencing token of the assignment an agent reports
+	// on. Reports naming an agent are refused unless it holds that lease.
+	LeaseToken int64 `json:"lease_token,omitempty"`
+	// Results are recorded on a job reported succeeded.
+	Results map[string]string `json:"results,omitempty"`
+}
+
+// Validate checks that the requested state is known.
+func (r *JobStatusRequest) Validate() error {
+	if !r.State.Valid() {
+		return errors.New("unknown job state " + string(r.State))
+	}
+	if len(r.Results) > 0 && r.State != JobStateSucceeded {
+		return errors.New("results can only be reported with state succeeded")
+	}
+	if err := ValidateResults(r.Results); err != nil {
+		return err
+	}
+	if r.State == JobStateCancelling {
+		return errors.New("use POST /jobs/{id}/cancel to cancel a job")
+	}
+	if r.State == JobStatePending || r.State == JobStateSkipped {
+		return errors.New("job state " + string(r.State) + " is only set by the pipeline")
+	}
+	if r.State == JobStateAssigned && r.AgentID == "" {
+		return errors.New("agent_id is required when assigning a job")
+	}
+	return nil
+}
+
+// CancelJobRequest is the optional body of POST /jobs/{id}/cancel.
+type CancelJobRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// CreatePipelineRequest is the JSON body of POST /pipelines. The definition
+// may also be sent as a raw YAML body, with repository and ref passed as
+// query parameters.
+type CreatePipelineRequest struct {
+	Definition string `json:"definition" openapi:"required"`
+	Repository string `json:"repository,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	// Inputs are the values of the inputs the definition declares; the
+	// YAML form takes them as repeated input=NAME=VALUE query parameters.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+// Validate checks the request for missing fields. The definition itself is
+// validated by the pipeline parser.
+func (r *CreatePipelineRequest) Validate() error {
+	if strings.TrimSpace(r.Definition) == "" {
+		return errors.New("definition is required")
+	}
+	return nil
+}
+
+// StartPipelineRequest is the body of POST /pipelines/{name}/runs.
+type StartPipelineRequest struct {
+	Repository string `json:"repository" openapi:"required"`
+	// Ref picks the run whose definition is run again, the latest of the
+	// pipeline at that ref; without it, the latest at any ref.
+	Ref string `json:"ref,omitempty"`
+	// Inputs are the values of the inputs the pipeline declares.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+// Validate checks the request for missing fields. The inputs are checked
+// against the pipeline's declaration when it is started.
+func (r *StartPipelineRequest) Validate() error {
+	if r.Repository == "" {
+		return errors.New("repository is required")
+	}
+	return nil
+}
+
+// DryRunPipelineRequest is the body of POST /pipelines/dry-run.
+type DryRunPipelineRequest struct {
+	Definition string `json:"definition" openapi:"required"`
+	Repository string `json:"repository,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	// Trigger is the event conditions are evaluated against, such as a
+	// push with its branch and changed files. Without one the run is
+	// taken to be submitted through the API.
+	Trigger *Trigger `json:"trigger,omitempty"`
+	// Inputs are the values of the inputs the definition declares.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+// Validate checks that a definition is present.
+func (r *DryRunPipelineRequest) Validate() error {
+	if strings.TrimSpace(r.Definition) == "" {
+		return errors.New("definition is required")
+	}
+	return nil
+}
+
+// ValidatePipelineRequest is the body of POST /pipelines/validate.
+type ValidatePipelineRequest struct {
+	Definition string `json:"definition" openapi:"required"`
+	// Repository, if set, is the project whose variables and secrets the
+	// expressions of the definition must refer to. Without one they are
+	// not checked.
+	Repository string `json:"repository,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+}
+
+// Validate checks that a definition is present.
+func (r *ValidatePipelineRequest) Validate() error {
+	if strings.TrimSpace(r.Definition) == "" {
+		return errors.New("definition is required")
+	}
+	return nil
+}
+
+// PipelineValidation is the result of POST /pipelines/validate. A
+// definition with errors would be refused when run; warnings point at what
+// is likely a mistake but does not keep it from running.
+type PipelineValidation struct {
+	Valid    bool              `json:"valid"`
+	Errors   []PipelineProblem `json:"errors"`
+	Warnings []PipelineProblem `json:"warnings"`
+}
+
+// PipelineProblem is a problem found in a pipeline definition, at a line
+// and field path of it when known.
+type PipelineProblem struct {
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// CreateTokenRequest is the body of POST /tokens.
+type CreateTokenRequest struct {
+	Name  string `json:"name" openapi:"required"`
+	User  string `json:"user" openapi:"required"`
+	Scope Scope  `json:"scope" openapi:"required"`
+	// Organization confines the token to one organization.
+	Organization string `json:"organization,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateTokenRequest) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	if strings.TrimSpace(r.User) == "" {
+		return errors.New("user is required")
+	}
+	if !r.Scope.Valid() {
+		return fmt.Errorf("unknown scope %q, expected read-only, submit-jobs or admin", r.Scope)
+	}
+	if r.Organization != "" && !organizationNamePattern.MatchString(r.Organization) {
+		return fmt.Errorf("invalid organization name %q", r.Organization)
+	}
+	return nil
+}
+
+// CreateTokenResponse is returned by POST /tokens. Token is the bearer secret
+// and is only ever shown in this response.
+type CreateTokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// PasswordLoginRequest is the body of POST /auth/sso/{provider}/login, which
+// signs in to a directory such as LDAP with a password.
+type PasswordLoginRequest struct {
+	Username string `json:"username" openapi:"required"`
+	Password string `json:"password" openapi:"required"`
+}
+
+// Validate checks the request for missing fields.
+func (r *PasswordLoginRequest) Validate() error {
+	if strings.TrimSpace(r.Username) == "" {
+		return errors.New("username is required")
+	}
+	if r.Password == "" {
+		return errors.New("password is required")
+	}
+	return nil
+}
+
+// LivenessResponse is returned by GET /healthz.
+type LivenessResponse struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ReadinessResponse is returned by GET /readyz.
+type ReadinessResponse struct {
+	// Status is ready when every check passes, and not_ready otherwise.
+	Status    string           `json:"status"`
+	Timestamp string           `json:"timestamp"`
+	Checks    []ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck is the outcome of one check of a readiness probe.
+type ReadinessCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Message says what was found, and why the check failed if it did.
+	Message  string   `json:"message,omitempty"`
+	Duration Duration `json:"duration"`
+}
+
+// HealthResponse is returned by GET /health.
+type HealthResponse struct {
+	// Status is healthy, or saturated when the server turns submissions
+	// away until the queue drains.
+	Status    string     `json:"status"`
+	Timestamp string     `json:"timestamp"`
+	Queue     Saturation `json:"queue"`
+}
+
+// JobDetails is returned by GET /jobs/{id}: the job and, while it is
+// queued, where it stands in the queue.
+type JobDetails struct {
+	Job
+	Queue *QueueStatus `json:"queue,omitempty"`
+}
+
+// QueueStatus says why a queued job has not started and when it may. It
+// is an estimate: jobs are taken in turns by project and by how much of
+// the fleet each project uses, not strictly in order.
+type QueueStatus struct {
+	// Position is the job's place, counted from 1, among the queued jobs
+	// that wait for the same agents: those of a higher priority, and those
+	// of the same priority queued before it.
+	Position int `json:"position"`
+	// Labels are the agent labels the job waits for.
+	Labels map[string]string `json:"labels,omitempty"`
+	// MatchingAgents counts the agents that could run the job and are not
+	// offline, and FreeSlots the slots of the online ones that no job
+	// holds.
+	MatchingAgents int `json:"matching_agents"`
+	FreeSlots      int `json:"free_slots"`
+	// Reason says why the job has not started, such as "no agent has
+	// labels gpu=true".
+	Reason string `json:"reason"`
+	// EstimatedStart is when the job should start, judging by how long
+	// the jobs ahead of it and those holding the agents took before; nil
+	// when there is no telling, as when no agent can run it.
+	EstimatedStart *time.Time `json:"estimated_start,omitempty"`
+}
+
+// Saturation describes whether the job queue is taking more work than the
+// agents can keep up with.
+type Saturation struct {
+	Saturated bool `json:"saturated"`
+	// Reasons say why the queue is saturated.
+	Reasons []string `json:"reasons,omitempty"`
+	// Rejecting is set when saturated submissions are refused with 503
+	// rather than queued with a warning.
+	Rejecting bool `json:"rejecting"`
+	// QueuedJobs counts the jobs waiting for an agent. When
+	// MaxQueuedJobs is set, the count stops a little past it.
+	QueuedJobs    int       `json:"queued_jobs"`
+	MaxQueuedJobs int       `json:"max_queued_jobs,omitempty"`
+	OnlineAgents  int       `json:"online_agents"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
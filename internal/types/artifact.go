@@ -0,0 +1,105 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxArtifactPathLen bounds the length of an artifact path.
+const maxArtifactPathLen = 1024
+
+// Artifact is a file an agent uploaded as an output of a job. Artifacts are
+// addressed by their job and a slash-separated path within it.
+type Artifact struct {
+	JobID string `json:"job_id"`
+	Path  string `json:"path"`
+	// Project is the repository of the job, which decides the retention.
+	Project     string `json:"project,omitempty"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type,omitempty"`
+	// Report is the format of a test report artifact, whose results are
+	// parsed into a TestReport when it is uploaded.
+	Report    TestReportFormat `json:"report,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	// ExpiresAt is when the artifact is deleted; nil keeps it forever.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Clone returns a deep copy of the artifact.
+func (a *Artifact) Clone() *Artifact {
+	c := *a
+	if a.ExpiresAt != nil {
+		t := *a.ExpiresAt
+		c.ExpiresAt = &t
+	}
+	return &c
+}
+
+// ValidateArtifactPath checks that p is a clean relative path such as
+// "dist/app.tar.gz" that stays within its job.
+func ValidateArtifactPath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("artifact path is required")
+	case len(p) > maxArtifactPathLen:
+		return errors.New("artifact path is too long")
+	case strings.HasPrefix(p, "/"), strings.HasSuffix(p, "/"):
+		return errors.New("artifact path must be relative and name a file")
+	case path.Clean(p) != p:
+		return errors.New("artifact path must be clean")
+	case p == "." || p == ".." || strings.HasPrefix(p, "../"):
+		return errors.New("artifact path must not leave the job")
+	case strings.ContainsAny(p, "\\\x00"):
+		return errors.New("artifact path contains invalid characters")
+	}
+	return nil
+}
+
+const (
+	// DefaultArtifactLinkLifetime is how long signed artifact links last
+	// when their creator does not say.
+	DefaultArtifactLinkLifetime = 24 * time.Hour
+	// maxArtifactLinkLifetime bounds how long a signed artifact link may
+	// last.
+	maxArtifactLinkLifetime = 7 * 24 * time.Hour
+)
+
+// CreateArtifactLinkRequest is the body of POST /jobs/{id}/artifact-links.
+type CreateArtifactLinkRequest struct {
+	Path string `json:"path" openapi:"required"`
+	// ExpiresIn is how long the link lasts, e.g. "2h"; at most a week; a
+	// day if unset.
+	ExpiresIn Duration `json:"expires_in,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateArtifactLinkRequest) Validate() error {
+	if err := ValidateArtifactPath(r.Path); err != nil {
+		return err
+	}
+	if r.ExpiresIn < 0 || time.Duration(r.ExpiresIn) > maxArtifactLinkLifetime {
+		return fmt.Errorf("expires_in must be positive and at most %s", maxArtifactLinkLifetime)
+	}
+	return nil
+}
+
+// Lifetime returns how long the link lasts.
+func (r *CreateArtifactLinkRequest) Lifetime() time.Duration {
+	if r.ExpiresIn == 0 {
+		return DefaultArtifactLinkLifetime
+	}
+	return time.Duration(r.ExpiresIn)
+}
+
+// ArtifactLink is a signed link to an artifact that anyone holding it may
+// download, without an API token, until it expires.
+type ArtifactLink struct {
+	URL       string    `json:"url"`
+	JobID     string    `json:"job_id"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
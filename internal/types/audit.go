@@ -0,0 +1,63 @@
+package types
+
+import "time"
+
+// AuditOutcome summarizes the response to an audited request.
+type AuditOutcome string
+
+const (
+	// AuditSucceeded is a request answered with a 1xx, 2xx or 3xx status.
+	AuditSucceeded AuditOutcome = "succeeded"
+	// AuditRejected is a request refused with a 4xx status.
+	AuditRejected AuditOutcome = "rejected"
+	// AuditFailed is a request that met a server error.
+	AuditFailed AuditOutcome = "failed"
+)
+
+// OutcomeOf returns the outcome of a request answered with status.
+func OutcomeOf(status int) AuditOutcome {
+	switch {
+	case status >= 500:
+		return AuditFailed
+	case status >= 400:
+		return AuditRejected
+	default:
+		return AuditSucceeded
+	}
+}
+
+// AuditEvent records one mutating API request. Events are only ever
+// appended, never changed or deleted.
+type AuditEvent struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+	// Actor is who made the request: the user of its token, or the token's
+	// name if it acts as no user.
+	Actor   string `json:"actor"`
+	TokenID string `json:"token_id"`
+	Method  string `json:"method"`
+	// Route is the path template the request matched, such as
+	// /jobs/{id}/cancel, and Resource the path itself.
+	Route    string `json:"route"`
+	Resource string `json:"resource"`
+	// Payload summarizes the request body: the top-level fields of a JSON
+	// body, with collections abbreviated to their size and the values of
+	// secrets redacted, or the type and size of any other body.
+	Payload    map[string]string `json:"payload,omitempty"`
+	Status     int               `json:"status"`
+	Outcome    AuditOutcome      `json:"outcome"`
+	RequestID  string            `json:"request_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+}
+
+// Clone returns a deep copy of the event.
+func (e *AuditEvent) Clone() *AuditEvent {
+	c := *e
+	if e.Payload != nil {
+		c.Payload = make(map[string]string, len(e.Payload))
+		for k, v := range e.Payload {
+			c.Payload[k] = v
+		}
+	}
+	return &c
+}
@@ -0,0 +1,192 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxCacheKeyLen bounds the length of a cache key.
+const maxCacheKeyLen = 255
+
+// CacheEntry maps a project's cache key, typically derived from a lockfile
+// hash, to content-addressed cache contents.
+type CacheEntry struct {
+	Project string `json:"project"`
+	Key     string `json:"key"`
+	// Digest identifies the contents as "sha256:<hex>". Entries with the
+	// same contents share one blob.
+	Digest     string    `json:"digest"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// ValidateCacheKey checks that key is non-empty and made of letters, digits
+// and the characters "._-+=".
+func ValidateCacheKey(key string) error {
+	if key == "" {
+		return errors.New("cache key is required")
+	}
+	if len(key) > maxCacheKeyLen {
+		return errors.New("cache key is too long")
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '_' || c == '-' || c == '+' || c == '=':
+		default:
+			return errors.New("cache key may only contain letters, digits and ._-+=")
+		}
+	}
+	if key == "." || key == ".." {
+		return errors.New("cache key must not be . or ..")
+	}
+	return nil
+}
+
+// CachePolicy governs how the jobs of a pipeline run use the caches they
+// mount. The server enforces it, whatever the agents ask for.
+type CachePolicy struct {
+	// FallbackKeys are key prefixes tried in order when a cache has no
+	// entry under its own key: the most recently saved entry whose key
+	// starts with the prefix is restored instead, so that for example a
+	// changed lockfile starts from the previous cache rather than none.
+	FallbackKeys []string `yaml:"fallback_keys,omitempty" json:"fallback_keys,omitempty"`
+	// ReadOnlyPullRequests keeps the runs of pull requests from saving
+	// caches, so that unreviewed code cannot poison those of other runs.
+	ReadOnlyPullRequests bool `yaml:"read_only_pull_requests,omitempty" json:"read_only_pull_requests,omitempty"`
+	// WriteBranches, if set, are the only branches whose runs save caches,
+	// such as [main]; the runs of other refs only restore them.
+	WriteBranches []string `yaml:"write_branches,omitempty" json:"write_branches,omitempty"`
+}
+
+// Validate checks the policy for malformed fields.
+func (p *CachePolicy) Validate() error {
+	for _, prefix := range p.FallbackKeys {
+		if err := ValidateCacheKey(prefix); err != nil {
+			return fmt.Errorf("fallback key %q: %w", prefix, err)
+		}
+	}
+	for _, branch := range p.WriteBranches {
+		if strings.TrimSpace(branch) == "" {
+			return errors.New("write_branches must not be empty")
+		}
+	}
+	return nil
+}
+
+// ReadOnly returns why the jobs of a run of ref started by trigger may not
+// save caches, or "" if they may. A nil policy lets every run save.
+func (p *CachePolicy) ReadOnly(trigger *Trigger, ref string) string {
+	if p == nil {
+		return ""
+	}
+	pullRequest := trigger != nil && trigger.Event == TriggerEventPullRequest
+	if pullRequest && p.ReadOnlyPullRequests {
+		return "caches are read-only on pull requests"
+	}
+	if len(p.WriteBranches) == 0 {
+		return ""
+	}
+	branch, ok := strings.CutPrefix(ref, "refs/heads/")
+	if !ok && !strings.HasPrefix(ref, "refs/") {
+		branch, ok = ref, true
+	}
+	if pullRequest || !ok || !slices.Contains(p.WriteBranches, branch) {
+		return "caches are only saved on " + strings.Join(p.WriteBranches, ", ")
+	}
+	return ""
+}
+
+// CacheStats counts the lookups and saves of a project's cache key, or of
+// all its keys when Key is empty.
+type CacheStats struct {
+	Project string `json:"project"`
+	Key     string `json:"key,omitempty"`
+	// Hits are lookups that found the key, FallbackHits those that
+	// restored a fallback key instead and Misses those that found neither.
+	Hits         int64 `json:"hits"`
+	FallbackHits int64 `json:"fallback_hits"`
+	Misses       int64 `json:"misses"`
+	// HitRate is the share of lookups that restored a cache, fallback
+	// keys included.
+	HitRate float64 `json:"hit_rate"`
+	Saves   int64   `json:"saves"`
+	// RefusedSaves are saves the cache policy of the run refused.
+	RefusedSaves int64     `json:"refused_saves"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Add adds the counts of o to s and keeps the later UpdatedAt.
+func (s *CacheStats) Add(o *CacheStats) {
+	s.Hits += o.Hits
+	s.FallbackHits += o.FallbackHits
+	s.Misses += o.Misses
+	s.Saves += o.Saves
+	s.RefusedSaves += o.RefusedSaves
+	if o.UpdatedAt.After(s.UpdatedAt) {
+		s.UpdatedAt = o.UpdatedAt
+	}
+}
+
+// ComputeHitRate sets HitRate from the counts.
+func (s *CacheStats) ComputeHitRate() {
+	s.HitRate = 0
+	if lookups := s.Hits + s.FallbackHits + s.Misses; lookups > 0 {
+		s.HitRate = float64(s.Hits+s.FallbackHits) / float64(lookups)
+	}
+}
+
+// CacheStatsReport is returned by GET /cache/stats.
+type CacheStatsReport struct {
+	// Total adds up the statistics of every key listed.
+	Total CacheStats   `json:"total"`
+	Keys  []CacheStats `json:"keys"`
+}
+
+// CacheMount is a directory of a job's workspace kept between the runs of its
+// project in the cache entry stored under Key.
+type CacheMount struct {
+	Key string `json:"key"`
+	// Path is relative to the workspace.
+	Path string `json:"path"`
+}
+
+// Limits of the results a job reports.
+const (
+	maxResults        = 64
+	maxResultValueLen = 4096
+)
+
+// resultKeyPattern matches the keys of job results. They have no dots, so
+// that ${{ results.stage/step.key }} tells the job name from the key.
+var resultKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]{0,63}$`)
+
+// ValidateResultKey checks the key of a job result.
+func ValidateResultKey(key string) error {
+	if !resultKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid result key %q, expected letters, digits, '_' and '-'", key)
+	}
+	return nil
+}
+
+// ValidateResults checks the results a job reports: at most 64 of them, with
+// keys of letters, digits, "_" and "-" and values of at most 4096 bytes.
+func ValidateResults(results map[string]string) error {
+	if len(results) > maxResults {
+		return fmt.Errorf("a job may report at most %d results", maxResults)
+	}
+	for k, v := range results {
+		if err := ValidateResultKey(k); err != nil {
+			return err
+		}
+		if len(v) > maxResultValueLen {
+			return fmt.Errorf("result %s is longer than %d bytes", k, maxResultValueLen)
+		}
+	}
+	return nil
+}
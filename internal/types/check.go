@@ -0,0 +1,106 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// maxRequiredChecks bounds the checks a project may require.
+const maxRequiredChecks = 50
+
+var checkNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// RequiredCheck is a pipeline, or a stage of one, that must pass before
+// changes are merged. Each is reported to the SCM as a commit status of its
+// own, named by CheckContext, so that branch protection rules can require
+// them one by one, such as tests but not a slow security scan.
+type RequiredCheck struct {
+	// Name names the check on the SCM. It shares the names of the statuses
+	// of whole runs, open-cicd/<pipeline>: a check named after its pipeline
+	// is that status, and is not posted twice.
+	Name string `json:"name" openapi:"required"`
+	// Pipeline is the name of the pipeline the check follows.
+	Pipeline string `json:"pipeline" openapi:"required"`
+	// Stage, if set, is the stage of the pipeline the check follows;
+	// otherwise it follows the whole run.
+	Stage string `json:"stage,omitempty"`
+	// Context is the name of the check's commit statuses.
+	Context string `json:"context"`
+}
+
+// CheckContext returns the name of the commit statuses of the check with
+// the given name.
+func CheckContext(name string) string {
+	return "open-cicd/" + name
+}
+
+// Matches reports whether the check follows runs of run's pipeline.
+func (c *RequiredCheck) Matches(run *Pipeline) bool {
+	return c.Pipeline == run.Name
+}
+
+// RequiredChecks are the checks a project requires.
+type RequiredChecks struct {
+	Project   string          `json:"project"`
+	Checks    []RequiredCheck `json:"checks"`
+	UpdatedBy string          `json:"updated_by,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at,omitempty"`
+}
+
+// Clone returns a deep copy of the checks.
+func (r *RequiredChecks) Clone() *RequiredChecks {
+	c := *r
+	c.Checks = append([]RequiredCheck{}, r.Checks...)
+	return &c
+}
+
+// PutRequiredChecksRequest is the body of
+// PUT /projects/{project}/required-checks. It replaces every check of the
+// project.
+type PutRequiredChecksRequest struct {
+	Checks []RequiredCheck `json:"checks" openapi:"required"`
+}
+
+// Validate checks the request for missing, malformed or duplicate checks.
+func (r *PutRequiredChecksRequest) Validate() error {
+	if len(r.Checks) > maxRequiredChecks {
+		return fmt.Errorf("at most %d checks may be required", maxRequiredChecks)
+	}
+	seen := make(map[string]bool, len(r.Checks))
+	for i, c := range r.Checks {
+		switch {
+		case c.Name == "":
+			return fmt.Errorf("checks[%d]: name is required", i)
+		case !checkNamePattern.MatchString(c.Name):
+			return fmt.Errorf("checks[%d]: name %q must be lowercase letters, digits and ._- of at most 63 characters", i, c.Name)
+		case seen[c.Name]:
+			return fmt.Errorf("checks[%d]: check %q is listed twice", i, c.Name)
+		case c.Pipeline == "":
+			return fmt.Errorf("checks[%d]: pipeline is required", i)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// CheckState is the state of a required check, common to whole runs and
+// stages.
+type CheckState string
+
+const (
+	CheckPending   CheckState = "pending"
+	CheckRunning   CheckState = "running"
+	CheckSucceeded CheckState = "succeeded"
+	CheckFailed    CheckState = "failed"
+	CheckCancelled CheckState = "cancelled"
+)
+
+// CheckResult is the state of a required check for one run.
+type CheckResult struct {
+	Check RequiredCheck
+	State CheckState
+	// Description says why the check is in its state, such as that its
+	// stage was skipped.
+	Description string
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Thursday.
+	from := time.Date(2026, 10, 15, 10, 30, 20, 0, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("loading time zone: %v", err)
+	}
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2026, 10, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2026, 10, 15, 10, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", from, time.Date(2026, 10, 15, 10, 45, 0, 0, time.UTC)},
+		{"0,30 9-17 * * *", from, time.Date(2026, 10, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", from, time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"@daily", from, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 feb *", from, time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either matches.
+		{"0 12 20 * mon", from, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)},
+		{"0 12 17 * mon", from, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", from, time.Time{}},
+		// 02:30 does not happen on the day clocks go forward.
+		{"30 2 * * *", time.Date(2027, 3, 13, 3, 0, 0, 0, newYork), time.Date(2027, 3, 15, 2, 30, 0, 0, newYork)},
+		// 01:30 happens twice on the day clocks go back; the first counts.
+		{"30 1 * * *", time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 1, 1, 30, 0, 0, newYork)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+			}
+			if got := c.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"", "must have 5 fields"},
+		{"* * * *", "must have 5 fields"},
+		{"* * * * * *", "must have 5 fields"},
+		{"60 * * * *", "minute 60 is not between 0 and 59"},
+		{"* 24 * * *", "hour 24 is not between 0 and 23"},
+		{"* * 0 * *", "day of month 0 is not between 1 and 31"},
+		{"* * * 13 *", "month 13 is not between 1 and 12"},
+		{"* * * * 8", "day of week 8 is not between 0 and 7"},
+		{"* * * foo *", `month "foo" is not a number`},
+		{"5-1 * * * *", `minute range "5-1" is backwards`},
+		{"*/0 * * * *", `minute step "0" is not a positive number`},
+		{"@never", "must have 5 fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseCron(%q) error = %v, want one mentioning %q", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
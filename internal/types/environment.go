@@ -0,0 +1,91 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// environmentNamePattern restricts environment names to lowercase DNS
+// labels, such as staging or production.
+var environmentNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidateEnvironmentName checks that name can name an environment.
+func ValidateEnvironmentName(name string) error {
+	if !environmentNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid environment name %q: use up to 63 lowercase letters, digits and dashes", name)
+	}
+	return nil
+}
+
+// DeploymentState is the lifecycle state of a deployment.
+type DeploymentState string
+
+const (
+	// DeploymentStateInProgress means the deploy job was handed to an agent
+	// and has not finished.
+	DeploymentStateInProgress DeploymentState = "in_progress"
+	DeploymentStateSucceeded  DeploymentState = "succeeded"
+	// DeploymentStateFailed means the deploy job failed or timed out,
+	// including attempts that were retried.
+	DeploymentStateFailed DeploymentState = "failed"
+	// DeploymentStateCancelled means the deploy job was cancelled, or
+	// handed back to the queue before it finished.
+	DeploymentStateCancelled DeploymentState = "cancelled"
+)
+
+// Deployment is one attempt of a deploy job to roll a commit out to an
+// environment.
+type Deployment struct {
+	ID          string          `json:"id"`
+	Project     string          `json:"project"`
+	Environment string          `json:"environment"`
+	JobID       string          `json:"job_id"`
+	Attempt     int             `json:"attempt"`
+	PipelineID  string          `json:"pipeline_id,omitempty"`
+	Ref         string          `json:"ref,omitempty"`
+	Commit      string          `json:"commit,omitempty"`
+	State       DeploymentState `json:"state"`
+	Reason      string          `json:"reason,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Clone returns a deep copy of the deployment.
+func (d *Deployment) Clone() *Deployment {
+	c := *d
+	if d.FinishedAt != nil {
+		t := *d.FinishedAt
+		c.FinishedAt = &t
+	}
+	return &c
+}
+
+// Environment is a place a project deploys to, such as staging or
+// production. It is created by the first job deploying to it.
+type Environment struct {
+	Project string `json:"project"`
+	Name    string `json:"name"`
+	// Current is the last deployment that succeeded, and so tells which
+	// commit is deployed.
+	Current *Deployment `json:"current,omitempty"`
+	// Active is the deployment in progress. It holds the environment's
+	// lock: no other deploy job of the project starts on the environment
+	// until it finishes.
+	Active    *Deployment `json:"active,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the environment.
+func (e *Environment) Clone() *Environment {
+	c := *e
+	if e.Current != nil {
+		c.Current = e.Current.Clone()
+	}
+	if e.Active != nil {
+		c.Active = e.Active.Clone()
+	}
+	return &c
+}
@@ -0,0 +1,207 @@
+package types
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrInvalidTransition is returned when a state machine rejects a transition.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// ErrorCode names the kind of a failed request in ErrorResponse, so that
+// clients can branch on it rather than on the message. Codes are stable;
+// messages are for people and may change.
+type ErrorCode string
+
+// The error code registry. Every error the API returns carries one of these
+// codes; the generic codes are used where no more specific one applies.
+const (
+	// Generic codes, one per HTTP status the API answers with.
+
+	// CodeBadRequest: the request is malformed or a parameter is invalid.
+	CodeBadRequest ErrorCode = "BAD_REQUEST"
+	// CodeUnauthenticated: the request has no valid credentials.
+	CodeUnauthenticated ErrorCode = "UNAUTHENTICATED"
+	// CodeForbidden: the credentials do not allow the request.
+	CodeForbidden ErrorCode = "FORBIDDEN"
+	// CodeNotFound: the resource does not exist.
+	CodeNotFound ErrorCode = "NOT_FOUND"
+	// CodeMethodNotAllowed: the path does not take the request's method.
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	// CodeConflict: the resource is not in a state that allows the request.
+	CodeConflict ErrorCode = "CONFLICT"
+	// CodePayloadTooLarge: the request body is too large.
+	CodePayloadTooLarge ErrorCode = "PAYLOAD_TOO_LARGE"
+	// CodeUnprocessable: the request is well formed but cannot be carried out.
+	CodeUnprocessable ErrorCode = "UNPROCESSABLE"
+	// CodeUpgradeRequired: the endpoint only serves WebSocket connections.
+	CodeUpgradeRequired ErrorCode = "UPGRADE_REQUIRED"
+	// CodeTooManyRequests: a limit was reached; the request may be retried
+	// later.
+	CodeTooManyRequests ErrorCode = "TOO_MANY_REQUESTS"
+	// CodeInternal: the server failed; the request ID locates it in the
+	// server's logs.
+	CodeInternal ErrorCode = "INTERNAL"
+	// CodeUnavailable: the server cannot take the request right now.
+	CodeUnavailable ErrorCode = "UNAVAILABLE"
+
+	// Request bodies.
+
+	// CodeInvalidRequestBody: the JSON body does not match the API
+	// document. Details lists the problems as {path, message} objects.
+	CodeInvalidRequestBody ErrorCode = "INVALID_REQUEST_BODY"
+	// CodeInvalidPipeline: a pipeline definition or template does not parse
+	// or validate. Details lists the problems as {line, path, message}
+	// objects.
+	CodeInvalidPipeline ErrorCode = "INVALID_PIPELINE"
+	// CodeInvalidInputs: the inputs passed to a run are not declared by the
+	// pipeline or not values it takes, or required inputs are missing.
+	// Details lists the problems as {line, path, message} objects.
+	CodeInvalidInputs ErrorCode = "INVALID_INPUTS"
+
+	// Authentication and authorization.
+
+	// CodeInsufficientScope: the token's scope is below the one the route
+	// requires.
+	CodeInsufficientScope ErrorCode = "INSUFFICIENT_SCOPE"
+
+	// Limits.
+
+	// CodeRateLimited: the caller made too many requests; retry after the
+	// Retry-After header.
+	CodeRateLimited ErrorCode = "RATE_LIMITED"
+	// CodeQuotaExceeded: the project used up its daily job quota.
+	CodeQuotaExceeded ErrorCode = "QUOTA_EXCEEDED"
+	// CodeQueueLimitExceeded: the project has as many jobs queued as its
+	// quota allows.
+	CodeQueueLimitExceeded ErrorCode = "QUEUE_LIMIT_EXCEEDED"
+	// CodeQueueFull: the job queue is saturated and refuses submissions.
+	CodeQueueFull ErrorCode = "QUEUE_FULL"
+
+	// Missing resources.
+
+	CodeAgentNotFound         ErrorCode = "AGENT_NOT_FOUND"
+	CodeAgentTokenNotFound    ErrorCode = "AGENT_TOKEN_NOT_FOUND"
+	CodeArtifactNotFound      ErrorCode = "ARTIFACT_NOT_FOUND"
+	CodeCacheNotFound         ErrorCode = "CACHE_NOT_FOUND"
+	CodeDeliveryNotFound      ErrorCode = "DELIVERY_NOT_FOUND"
+	CodeEnvironmentNotFound   ErrorCode = "ENVIRONMENT_NOT_FOUND"
+	CodeJobNotFound           ErrorCode = "JOB_NOT_FOUND"
+	CodeNotifierNotFound      ErrorCode = "NOTIFIER_NOT_FOUND"
+	CodeOrganizationNotFound  ErrorCode = "ORGANIZATION_NOT_FOUND"
+	CodePipelineNotFound      ErrorCode = "PIPELINE_NOT_FOUND"
+	CodePreferencesNotFound   ErrorCode = "PREFERENCES_NOT_FOUND"
+	CodeQuotaNotFound         ErrorCode = "QUOTA_NOT_FOUND"
+	CodeReleaseNotFound       ErrorCode = "RELEASE_NOT_FOUND"
+	CodeRetentionNotFound     ErrorCode = "RETENTION_NOT_FOUND"
+	CodeRoleBindingNotFound   ErrorCode = "ROLE_BINDING_NOT_FOUND"
+	CodeScheduleNotFound      ErrorCode = "SCHEDULE_NOT_FOUND"
+	CodeSCMCredentialNotFound ErrorCode = "SCM_CREDENTIAL_NOT_FOUND"
+	CodeSecretNotFound        ErrorCode = "SECRET_NOT_FOUND"
+	CodeSnapshotNotFound      ErrorCode = "SNAPSHOT_NOT_FOUND"
+	CodeSSOProviderNotFound   ErrorCode = "SSO_PROVIDER_NOT_FOUND"
+	CodeStageNotFound         ErrorCode = "STAGE_NOT_FOUND"
+	CodeTeamNotFound          ErrorCode = "TEAM_NOT_FOUND"
+	CodeTemplateNotFound      ErrorCode = "TEMPLATE_NOT_FOUND"
+	CodeTokenNotFound         ErrorCode = "TOKEN_NOT_FOUND"
+	CodeVariableNotFound      ErrorCode = "VARIABLE_NOT_FOUND"
+	// CodeRepositoryNotFound: the SCM provider has no such repository, or
+	// the credential given may not see it.
+	CodeRepositoryNotFound ErrorCode = "REPOSITORY_NOT_FOUND"
+	// CodeIDTokensNotConfigured: the server issues no job ID tokens, so it
+	// has no OIDC discovery documents.
+	CodeIDTokensNotConfigured ErrorCode = "ID_TOKENS_NOT_CONFIGURED"
+	// CodeArtifactLinksNotConfigured: the server has no key to sign links
+	// to artifacts with, so they cannot be shared.
+	CodeArtifactLinksNotConfigured ErrorCode = "ARTIFACT_LINKS_NOT_CONFIGURED"
+	// CodeBadgesNotConfigured: the server has no key to derive status badge
+	// tokens from, so it serves no badges.
+	CodeBadgesNotConfigured ErrorCode = "BADGES_NOT_CONFIGURED"
+
+	// Conflicts with existing resources.
+
+	CodeOrganizationExists     ErrorCode = "ORGANIZATION_EXISTS"
+	CodeProjectExists          ErrorCode = "PROJECT_EXISTS"
+	CodeProjectInOrganization  ErrorCode = "PROJECT_IN_ORGANIZATION"
+	CodeTemplateVersionExists  ErrorCode = "TEMPLATE_VERSION_EXISTS"
+	CodeDeliveryAlreadyStarted ErrorCode = "DELIVERY_ALREADY_STARTED"
+
+	// SCM providers.
+
+	// CodeSCMAccessDenied: the SCM provider refused the credential given.
+	CodeSCMAccessDenied ErrorCode = "SCM_ACCESS_DENIED"
+	// CodeSCMUnavailable: a request to the SCM provider failed.
+	CodeSCMUnavailable ErrorCode = "SCM_UNAVAILABLE"
+	// CodeWebhooksNotConfigured: the server cannot receive the webhooks of
+	// the repository, lacking an external URL or a webhook secret for it.
+	CodeWebhooksNotConfigured ErrorCode = "WEBHOOKS_NOT_CONFIGURED"
+
+	// Job states.
+
+	// CodeJobFinished: the job already finished.
+	CodeJobFinished ErrorCode = "JOB_FINISHED"
+	// CodeJobNotInProgress: the job is not running or cancelling.
+	CodeJobNotInProgress ErrorCode = "JOB_NOT_IN_PROGRESS"
+	// CodeAgentMismatch: the job is assigned to another agent.
+	CodeAgentMismatch ErrorCode = "AGENT_MISMATCH"
+
+	// Replicas.
+
+	// CodeNotLeader: the request needs the replica that schedules jobs,
+	// to which agents are connected, and reached another one.
+	CodeNotLeader ErrorCode = "NOT_LEADER"
+)
+
+// ErrorCodes lists every code of the registry.
+var ErrorCodes = []ErrorCode{
+	CodeBadRequest, CodeUnauthenticated, CodeForbidden, CodeNotFound, CodeMethodNotAllowed, CodeConflict,
+	CodePayloadTooLarge, CodeUnprocessable, CodeUpgradeRequired, CodeTooManyRequests,
+	CodeInternal, CodeUnavailable,
+	CodeInvalidRequestBody, CodeInvalidPipeline, CodeInvalidInputs,
+	CodeInsufficientScope,
+	CodeRateLimited, CodeQuotaExceeded, CodeQueueLimitExceeded, CodeQueueFull,
+	CodeAgentNotFound, CodeArtifactNotFound, CodeCacheNotFound, CodeDeliveryNotFound,
+	CodeEnvironmentNotFound, CodeJobNotFound, CodeNotifierNotFound,
+	CodeOrganizationNotFound, CodePipelineNotFound, CodeQuotaNotFound,
+	CodeReleaseNotFound, CodeRetentionNotFound, CodeRoleBindingNotFound, CodeScheduleNotFound, CodeSCMCredentialNotFound,
+	CodeSecretNotFound, CodeSnapshotNotFound, CodeSSOProviderNotFound, CodeStageNotFound, CodeTeamNotFound,
+	CodeTemplateNotFound, CodeTokenNotFound, CodeVariableNotFound, CodeRepositoryNotFound,
+	CodeIDTokensNotConfigured, CodeArtifactLinksNotConfigured, CodeBadgesNotConfigured, CodeOrganizationExists, CodeProjectExists,
+	CodeProjectInOrganization, CodeTemplateVersionExists, CodeDeliveryAlreadyStarted,
+	CodeSCMAccessDenied, CodeSCMUnavailable, CodeWebhooksNotConfigured,
+	CodeJobFinished, CodeJobNotInProgress, CodeAgentMismatch,
+	CodeNotLeader,
+}
+
+// StatusErrorCode returns the generic code of an HTTP error status.
+func StatusErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnprocessableEntity:
+		return CodeUnprocessable
+	case http.StatusUpgradeRequired:
+		return CodeUpgradeRequired
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	default:
+		if status >= 400 && status < 500 {
+			return CodeBadRequest
+		}
+		return CodeInternal
+	}
+}
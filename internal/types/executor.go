@@ -0,0 +1,367 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultWorkspace is where the job workspace is mounted in every container
+// when a job does not choose another path.
+const DefaultWorkspace = "/workspace"
+
+// DefaultEntrypoint runs a task's commands as a shell script that stops at
+// the first failing command.
+var DefaultEntrypoint = []string{"/bin/sh", "-e", "-c"}
+
+// serviceNamePattern matches DNS labels, since services are reachable from
+// the job's containers under their names.
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Task is one part of a job run in its own container. The tasks of a job run
+// one after another and share the workspace, so a job can build in one image
+// and test in another.
+type Task struct {
+	Name string `json:"name" yaml:"name"`
+	// Image defaults to the job's image.
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Entrypoint defaults to the job's entrypoint.
+	Entrypoint []string          `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Commands   []string          `json:"commands" yaml:"commands"`
+	Env        map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+}
+
+// Service is a sidecar container, such as a database, started before a job's
+// tasks and stopped after them. Tasks reach it under its name.
+type Service struct {
+	Name  string `json:"name" yaml:"name"`
+	Image string `json:"image" yaml:"image"`
+	// Entrypoint and Command override those of the image.
+	Entrypoint []string          `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Command    []string          `json:"command,omitempty" yaml:"command,omitempty"`
+	Env        map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+}
+
+// Resources limits what each container of a job may use. CPU is a number of
+// cores, either decimal ("1.5") or in millicores ("500m"); Memory is a number
+// of bytes with an optional K, M, G or T suffix, or Ki, Mi, Gi or Ti for
+// powers of 1024.
+type Resources struct {
+	CPU    string `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+}
+
+// Limits parses the limits. Zero means unlimited.
+func (r *Resources) Limits() (cpuMillis, memoryBytes int64, err error) {
+	if r == nil {
+		return 0, 0, nil
+	}
+	if r.CPU != "" {
+		if cpuMillis, err = parseCPU("cpu limit", r.CPU); err != nil {
+			return 0, 0, err
+		}
+	}
+	if r.Memory != "" {
+		if memoryBytes, err = parseMemory("memory limit", r.Memory); err != nil {
+			return 0, 0, err
+		}
+	}
+	return cpuMillis, memoryBytes, nil
+}
+
+// SecurityContext restricts what the task containers of a job may do, so
+// that they need not run as root with the image's default privileges.
+// Executors that cannot apply it refuse the job rather than run it without.
+type SecurityContext struct {
+	// RunAsUser and RunAsGroup are the numeric user and group the tasks run
+	// as, in place of the image's.
+	RunAsUser  *int64 `json:"run_as_user,omitempty" yaml:"run_as_user,omitempty"`
+	RunAsGroup *int64 `json:"run_as_group,omitempty" yaml:"run_as_group,omitempty"`
+	// ReadOnlyRootFilesystem mounts the image read-only; only the
+	// workspace, which holds the caches, stays writable.
+	ReadOnlyRootFilesystem bool `json:"read_only_root_filesystem,omitempty" yaml:"read_only_root_filesystem,omitempty"`
+	// NoNewPrivileges keeps the tasks' processes from gaining privileges,
+	// as through setuid binaries such as sudo.
+	NoNewPrivileges bool `json:"no_new_privileges,omitempty" yaml:"no_new_privileges,omitempty"`
+	// CapAdd and CapDrop are the Linux capabilities, such as NET_ADMIN,
+	// added to and dropped from the container runtime's defaults; ALL in
+	// CapDrop drops every one but those in CapAdd.
+	CapAdd  []string `json:"cap_add,omitempty" yaml:"cap_add,omitempty"`
+	CapDrop []string `json:"cap_drop,omitempty" yaml:"cap_drop,omitempty"`
+}
+
+// capabilities are the Linux capabilities, as named without their CAP_
+// prefix.
+var capabilities = []string{
+	"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND", "BPF",
+	"CHECKPOINT_RESTORE", "CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER",
+	"FSETID", "IPC_LOCK", "IPC_OWNER", "KILL", "LEASE", "LINUX_IMMUTABLE",
+	"MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE",
+	"NET_BROADCAST", "NET_RAW", "PERFMON", "SETFCAP", "SETGID", "SETPCAP",
+	"SETUID", "SYSLOG", "SYS_ADMIN", "SYS_BOOT", "SYS_CHROOT", "SYS_MODULE",
+	"SYS_NICE", "SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE",
+	"SYS_TIME", "SYS_TTY_CONFIG", "WAKE_ALARM",
+}
+
+// Validate checks for negative IDs and unknown or conflicting
+// capabilities.
+func (s *SecurityContext) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if (s.RunAsUser != nil && *s.RunAsUser < 0) || (s.RunAsGroup != nil && *s.RunAsGroup < 0) {
+		return errors.New("run_as_user and run_as_group must not be negative")
+	}
+	if s.RunAsGroup != nil && s.RunAsUser == nil {
+		return errors.New("run_as_group requires run_as_user")
+	}
+	dropped := make(map[string]bool, len(s.CapDrop))
+	for _, c := range s.CapDrop {
+		if c != "ALL" && !slices.Contains(capabilities, c) {
+			return fmt.Errorf("cap_drop: unknown capability %q", c)
+		}
+		dropped[c] = true
+	}
+	for _, c := range s.CapAdd {
+		if !slices.Contains(capabilities, c) {
+			return fmt.Errorf("cap_add: unknown capability %q; capabilities are named without CAP_, such as NET_ADMIN", c)
+		}
+		if dropped[c] {
+			return fmt.Errorf("capability %s is both added and dropped", c)
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the security context.
+func (s *SecurityContext) Clone() *SecurityContext {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	if s.RunAsUser != nil {
+		u := *s.RunAsUser
+		c.RunAsUser = &u
+	}
+	if s.RunAsGroup != nil {
+		g := *s.RunAsGroup
+		c.RunAsGroup = &g
+	}
+	c.CapAdd = append([]string(nil), s.CapAdd...)
+	c.CapDrop = append([]string(nil), s.CapDrop...)
+	return &c
+}
+
+// parseCPU parses a number of cores; what names it in errors, as in
+// "cpu limit".
+func parseCPU(what, s string) (int64, error) {
+	if millis, ok := strings.CutSuffix(s, "m"); ok {
+		n, err := strconv.ParseInt(millis, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid %s %q", what, s)
+		}
+		return n, nil
+	}
+	cores, err := strconv.ParseFloat(s, 64)
+	if err != nil || cores <= 0 || cores > 1<<20 {
+		return 0, fmt.Errorf("invalid %s %q", what, s)
+	}
+	return max(int64(cores*1000), 1), nil
+}
+
+var memoryUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseMemory parses an amount of bytes; what names it in errors.
+func parseMemory(what, s string) (int64, error) {
+	digits, factor := s, int64(1)
+	for _, u := range memoryUnits {
+		if d, ok := strings.CutSuffix(s, u.suffix); ok {
+			digits, factor = d, u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/factor {
+		return 0, fmt.Errorf("invalid %s %q", what, s)
+	}
+	return n * factor, nil
+}
+
+// ParseLogLimit parses the log limit of a job, an amount of bytes written
+// as memory limits are.
+func ParseLogLimit(s string) (int64, error) {
+	return parseMemory("log limit", s)
+}
+
+// ValidateServiceName checks that name can be used as a hostname.
+func ValidateServiceName(name string) error {
+	if !serviceNamePattern.MatchString(name) {
+		return fmt.Errorf("service name %q must be a lowercase DNS label", name)
+	}
+	return nil
+}
+
+// ValidateWorkspace checks that p is a clean absolute path other than the
+// root directory.
+func ValidateWorkspace(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p || p == "/" {
+		return fmt.Errorf("workspace %q must be a clean absolute path other than /", p)
+	}
+	return nil
+}
+
+// ExecSpec is what an agent needs to run a job with the Docker executor,
+// with every default filled in.
+type ExecSpec struct {
+	Workspace string `json:"workspace"`
+	// Shell is the shell of the job; tasks without an entrypoint run their
+	// commands from a script file with it.
+	Shell       Shell     `json:"shell"`
+	CPUMillis   int64     `json:"cpu_millis,omitempty"`
+	MemoryBytes int64     `json:"memory_bytes,omitempty"`
+	Tasks       []Task    `json:"tasks"`
+	Services    []Service `json:"services,omitempty"`
+	// Security applies to every task; services run as their images say.
+	Security *SecurityContext `json:"security,omitempty"`
+}
+
+// ExecSpec returns the execution spec of the job. A job without tasks runs
+// its commands as a single task named after the job. Task environments are
+// merged over the job's, and tasks without an entrypoint get the job's, or
+// its shell's if it has one.
+func (j *Job) ExecSpec() (*ExecSpec, error) {
+	cpu, memory, err := j.Resources.Limits()
+	if err != nil {
+		return nil, err
+	}
+	spec := &ExecSpec{
+		Workspace:   j.Workspace,
+		Shell:       j.Shell.Default(),
+		CPUMillis:   cpu,
+		MemoryBytes: memory,
+		Services:    j.Services,
+		Security:    j.Security,
+	}
+	if spec.Workspace == "" {
+		spec.Workspace = DefaultWorkspace
+	}
+	tasks := j.Tasks
+	if len(tasks) == 0 {
+		tasks = []Task{{Name: j.Name, Commands: j.Commands}}
+	}
+	for _, t := range tasks {
+		if t.Image == "" {
+			t.Image = j.Image
+		}
+		if len(t.Entrypoint) == 0 {
+			t.Entrypoint = j.Entrypoint
+		}
+		if len(t.Entrypoint) == 0 {
+			t.Entrypoint = spec.Shell.Entrypoint()
+		}
+		env := make(map[string]string, len(j.Env)+len(t.Env))
+		for _, level := range []map[string]string{j.Env, t.Env} {
+			for k, v := range level {
+				env[k] = v
+			}
+		}
+		t.Env = env
+		spec.Tasks = append(spec.Tasks, t)
+	}
+	return spec, nil
+}
+
+// ReproduceBundle is what running a job again outside CI takes, as
+// returned by GET /jobs/{id}/reproduce: its source and its execution spec,
+// whose task environments hold the project variables that applied to the
+// job. The values of secrets and ID tokens are left out.
+type ReproduceBundle struct {
+	JobID      string `json:"job_id"`
+	Name       string `json:"name"`
+	Repository string `json:"repository,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	// Spec has the secret expressions of the job's commands, environment
+	// and images replaced by references to the variables named in
+	// Secrets, such as ${NAME}.
+	Spec ExecSpec `json:"spec"`
+	// Secrets names the variables the job got its secrets and ID tokens
+	// in, which whoever runs the bundle must supply.
+	Secrets []string `json:"secrets,omitempty"`
+}
+
+// validateExecution checks the execution fields shared by jobs: either
+// commands or tasks, well-formed services and limits, and an image for every
+// container when services are used, since they need the Docker executor.
+func validateExecution(hasImage bool, commands []string, tasks []Task, services []Service, resources *Resources, workspace string) error {
+	switch {
+	case len(commands) == 0 && len(tasks) == 0:
+		return errors.New("at least one command or task is required")
+	case len(commands) > 0 && len(tasks) > 0:
+		return errors.New("commands and tasks cannot be combined")
+	}
+	if err := validateCommands("command", commands); err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(tasks))
+	for i, t := range tasks {
+		if strings.TrimSpace(t.Name) == "" {
+			return fmt.Errorf("task %d: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate task name %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Commands) == 0 {
+			return fmt.Errorf("task %q has no commands", t.Name)
+		}
+		if err := validateCommands("task "+t.Name+" command", t.Commands); err != nil {
+			return err
+		}
+		if len(services) > 0 && t.Image == "" && !hasImage {
+			return fmt.Errorf("task %q needs an image to run with services", t.Name)
+		}
+	}
+	if len(services) > 0 && len(tasks) == 0 && !hasImage {
+		return errors.New("image is required to run with services")
+	}
+	seen := make(map[string]bool, len(services))
+	for _, s := range services {
+		if err := ValidateServiceName(s.Name); err != nil {
+			return err
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("duplicate service name %q", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Image == "" {
+			return fmt.Errorf("service %q: image is required", s.Name)
+		}
+	}
+	if _, _, err := resources.Limits(); err != nil {
+		return err
+	}
+	if workspace != "" {
+		return ValidateWorkspace(workspace)
+	}
+	return nil
+}
+
+func validateCommands(what string, commands []string) error {
+	for i, c := range commands {
+		if strings.TrimSpace(c) == "" {
+			return fmt.Errorf("%s %d is empty", what, i)
+		}
+	}
+	return nil
+}
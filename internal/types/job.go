@@ -0,0 +1,428 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JobState is the lifecycle state of a job.
+type JobState string
+
+const (
+	// JobStatePending means the job belongs to a pipeline stage that is
+	// waiting for the stages it needs to succeed.
+	JobStatePending  JobState = "pending"
+	JobStateQueued   JobState = "queued"
+	JobStateAssigned JobState = "assigned"
+	JobStateRunning  JobState = "running"
+	// JobStateCancelling means cancellation was requested and the assigned
+	// agent has been asked to stop the job.
+	JobStateCancelling JobState = "cancelling"
+	JobStateSucceeded  JobState = "succeeded"
+	JobStateFailed     JobState = "failed"
+	JobStateCancelled  JobState = "cancelled"
+	// JobStateSkipped means a stage the job's stage needs did not succeed,
+	// so the job never ran.
+	JobStateSkipped JobState = "skipped"
+	// JobStateTimedOut means the job ran past its timeout and its agent was
+	// told to stop it. It is a failure, kept apart from jobs whose commands
+	// failed.
+	JobStateTimedOut JobState = "timed_out"
+)
+
+// jobTransitions defines the job state machine. Terminal states have no
+// outgoing transitions.
+var jobTransitions = map[JobState][]JobState{
+	JobStatePending: {JobStateQueued, JobStateSkipped, JobStateCancelled},
+	// A queued job fails when no agent can ever take it.
+	JobStateQueued:   {JobStateAssigned, JobStateFailed, JobStateCancelled},
+	JobStateAssigned: {JobStateRunning, JobStateQueued, JobStateFailed, JobStateCancelling, JobStateCancelled},
+	JobStateRunning:  {JobStateSucceeded, JobStateFailed, JobStateTimedOut, JobStateCancelling, JobStateCancelled, JobStateQueued},
+	// An agent may finish the job before it sees the cancel signal.
+	JobStateCancelling: {JobStateCancelled, JobStateSucceeded, JobStateFailed, JobStateTimedOut},
+	JobStateSucceeded:  nil,
+	JobStateFailed:     nil,
+	JobStateTimedOut:   nil,
+	JobStateCancelled:  nil,
+	JobStateSkipped:    nil,
+}
+
+// Valid reports whether s is a known job state.
+func (s JobState) Valid() bool {
+	_, ok := jobTransitions[s]
+	return ok
+}
+
+// Terminal reports whether s is a final state.
+func (s JobState) Terminal() bool {
+	return s.Valid() && len(jobTransitions[s]) == 0
+}
+
+// Failure reports whether s is a final state of a job that did not
+// succeed by its own doing: failed or timed out.
+func (s JobState) Failure() bool {
+	return s == JobStateFailed || s == JobStateTimedOut
+}
+
+// Held reports whether s is a state of a job an agent holds: assigned,
+// running or being cancelled.
+func (s JobState) Held() bool {
+	return s == JobStateAssigned || s == JobStateRunning || s == JobStateCancelling
+}
+
+// CanTransitionTo reports whether the state machine allows moving from s to next.
+func (s JobState) CanTransitionTo(next JobState) bool {
+	for _, allowed := range jobTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Priority orders queued jobs. Higher priority jobs are always dispatched
+// before lower priority ones.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities lists every priority from highest to lowest.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// Valid reports whether p is a known priority.
+func (p Priority) Valid() bool {
+	return p.Rank() >= 0
+}
+
+// Rank returns the position of p in Priorities, or -1 if p is unknown.
+func (p Priority) Rank() int {
+	for i, known := range Priorities {
+		if p == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// MatchLabels reports whether labels contains every key in required with the
+// same value.
+func MatchLabels(labels, required map[string]string) bool {
+	for k, v := range required {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,61}[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// ValidateLabels checks agent labels and required job labels, such as
+// os=linux or gpu=true. Keys may contain letters, digits, '.', '_', '-' and
+// '/'; values the same except '/'. Both start and end with a letter or digit
+// and are at most 63 characters long.
+func ValidateLabels(labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("label name %q must be 1 to 63 letters, digits, '.', '_', '-' or '/', starting and ending with a letter or digit", k)
+		}
+		if v := labels[k]; !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("label %s value %q must be at most 63 letters, digits, '.', '_' or '-', starting and ending with a letter or digit", k, v)
+		}
+	}
+	return nil
+}
+
+// FormatLabels renders labels as "k=v, ..." sorted by key.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// JobTransition records a single state change of a job.
+type JobTransition struct {
+	From   JobState  `json:"from,omitempty"`
+	To     JobState  `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Job is a unit of work executed by a single agent.
+type Job struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Repository string `json:"repository,omitempty"`
+	// Organization owns the job's project, if any organization does.
+	Organization string `json:"organization,omitempty"`
+	Ref          string `json:"ref,omitempty"`
+	Commit       string `json:"commit,omitempty"`
+	PipelineID   string `json:"pipeline_id,omitempty"`
+	Stage        string `json:"stage,omitempty"`
+	// Environment names the environment the job deploys to, if it is a
+	// deploy job. Deploy jobs of one project and environment never run at
+	// the same time.
+	Environment string   `json:"environment,omitempty"`
+	Image       string   `json:"image,omitempty"`
+	Entrypoint  []string `json:"entrypoint,omitempty"`
+	Commands    []string `json:"commands"`
+	// OS restricts the job to agents running that operating system, and
+	// Shell is what its commands run with, sh by default, or powershell
+	// when OS is windows. Jobs only land on agents whose operating system
+	// their shell runs on.
+	OS    string `json:"os,omitempty"`
+	Shell Shell  `json:"shell,omitempty"`
+	// Arch restricts the job to agents of that processor architecture, as
+	// GOARCH names it. Images, when set, are the variants of the job's
+	// image keyed by architecture, one of which is run in place of Image
+	// on agents of its architecture; the job runs on no others.
+	Arch   string            `json:"arch,omitempty"`
+	Images map[string]string `json:"images,omitempty"`
+	// Tasks, when set, replace Commands with a sequence of containers.
+	Tasks     []Task     `json:"tasks,omitempty"`
+	Services  []Service  `json:"services,omitempty"`
+	Resources *Resources `json:"resources,omitempty"`
+	// Requests is what the job needs of an agent to be scheduled on it.
+	Requests *ResourceRequests `json:"requests,omitempty"`
+	// Security restricts the privileges of the job's task containers.
+	Security  *SecurityContext  `json:"security,omitempty"`
+	Workspace string            `json:"workspace,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Timeout   Duration          `json:"timeout,omitempty"`
+	// LogLimit caps the output kept in the job's log, as an amount of bytes
+	// such as "50Mi"; see ParseLogLimit. The server's limit applies when it
+	// is lower or the job sets none.
+	LogLimit string   `json:"log_limit,omitempty"`
+	Priority Priority `json:"priority"`
+	// Labels are required agent labels; the job only runs on agents that
+	// carry every one of them with the same value.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Secrets names the project secrets injected into the job's environment
+	// when it is dispatched, and the Vault references read then, as
+	// SecretRef parses them. Their values are never stored with the job.
+	Secrets []string `json:"secrets,omitempty"`
+	// IDTokens maps the environment variables the job gets OIDC ID tokens
+	// in to the audience of each token. Tokens are issued when the job is
+	// dispatched and never stored with it.
+	IDTokens map[string]string `json:"id_tokens,omitempty"`
+	// Restricted jobs, those of runs of code from forks, are dispatched
+	// without their secrets and ID tokens.
+	Restricted bool `json:"restricted,omitempty"`
+	// Matrix holds the axis values of the matrix leg the job was expanded
+	// from, keyed by axis name.
+	Matrix map[string]string `json:"matrix,omitempty"`
+	// AllowFailure means a failure of the job does not fail its stage.
+	AllowFailure bool `json:"allow_failure,omitempty"`
+	// Retry re-queues the job when it fails in a way the policy covers.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Outputs are the workspace paths the job's agent snapshots when it
+	// succeeds, for the jobs of downstream stages to restore.
+	Outputs []string `json:"outputs,omitempty"`
+	// Caches are workspace directories the job's agent restores from the
+	// project's cache before the job starts and saves when it succeeds.
+	Caches []CacheMount `json:"caches,omitempty"`
+	// CacheFallbacks are the key prefixes tried in order when a cache the
+	// job mounts has no entry, and CacheReadOnly, if set, why the job may
+	// restore its caches but not save them; see CachePolicy.
+	CacheFallbacks []string `json:"cache_fallbacks,omitempty"`
+	CacheReadOnly  string   `json:"cache_read_only,omitempty"`
+	// Results are the key=value results the job reported when it
+	// succeeded, such as the digest of an image it pushed.
+	Results map[string]string `json:"results,omitempty"`
+	// Trigger is set on the jobs of trigger steps, which the server runs
+	// itself by starting a downstream run, Downstream, rather than handing
+	// them to an agent.
+	Trigger    *PipelineTrigger `json:"trigger,omitempty"`
+	Downstream string           `json:"downstream,omitempty"`
+	// Attempt counts the job's runs, starting at 1. Attempts records the
+	// earlier ones, which failed and were retried; the job's own state and
+	// exit code describe the current one.
+	Attempt  int          `json:"attempt,omitempty"`
+	Attempts []JobAttempt `json:"attempts,omitempty"`
+	// RetryAt holds a retried job back from scheduling until its backoff
+	// has passed.
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+	State    JobState   `json:"state"`
+	AgentID  string     `json:"agent_id,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	// LeaseToken is the fencing token of the job's latest assignment. It
+	// grows with every assignment, so that an agent still acting on an
+	// earlier one is told apart from the one holding the job now. It is
+	// handed only to that agent, never served with the job.
+	LeaseToken int64 `json:"-"`
+	// LeaseExpiresAt is when the lease of the agent holding the job runs
+	// out unless the agent renews it; nil while no agent holds the job.
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	// RequeueRequested is set while the server is shutting down to ask the
+	// assigned agent to stop and hand the job back by reporting it queued.
+	RequeueRequested bool `json:"requeue_requested,omitempty"`
+	// CancelledBy names who asked for the job to be cancelled.
+	CancelledBy string `json:"cancelled_by,omitempty"`
+	// RetryOf is the job this one runs again, after it was retried by hand
+	// or its pipeline was re-run.
+	RetryOf string `json:"retry_of,omitempty"`
+	// TraceContext carries the W3C trace context of the request that
+	// submitted the job, so that scheduling and execution join its trace.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	Transitions  []JobTransition   `json:"transitions"`
+}
+
+// Transition moves the job to next, enforcing the job state machine and
+// recording the change in the job's history.
+func (j *Job) Transition(next JobState, at time.Time, reason string) error {
+	if !j.State.CanTransitionTo(next) {
+		return fmt.Errorf("%w: job %s cannot move from %s to %s", ErrInvalidTransition, j.ID, j.State, next)
+	}
+	j.Transitions = append(j.Transitions, JobTransition{From: j.State, To: next, At: at, Reason: reason})
+	j.State = next
+	j.UpdatedAt = at
+	if !next.Held() {
+		// A job no agent holds has no lease to renew.
+		j.LeaseExpiresAt = nil
+	}
+	return nil
+}
+
+// HoldsLease reports whether agentID holds the lease on the job with the
+// fencing token: the job is held by that agent under that very assignment.
+func (j *Job) HoldsLease(agentID string, token int64) bool {
+	return j.State.Held() && j.AgentID == agentID && j.LeaseToken == token
+}
+
+// LeaseExpired reports whether the lease on a held job ran out by now.
+func (j *Job) LeaseExpired(now time.Time) bool {
+	return j.LeaseExpiresAt != nil && !now.Before(*j.LeaseExpiresAt)
+}
+
+// LastTransition returns the job's most recent move to state.
+func (j *Job) LastTransition(state JobState) (JobTransition, bool) {
+	for i := len(j.Transitions) - 1; i >= 0; i-- {
+		if j.Transitions[i].To == state {
+			return j.Transitions[i], true
+		}
+	}
+	return JobTransition{}, false
+}
+
+// Passed reports whether the job counts as a success for its stage: it
+// succeeded, or it failed or timed out and failure is allowed.
+func (j *Job) Passed() bool {
+	return j.State == JobStateSucceeded || (j.State.Failure() && j.AllowFailure)
+}
+
+// Deadline returns when a running job times out, or false if it has no
+// timeout or is not running. The timeout counts from when the job started.
+func (j *Job) Deadline() (time.Time, bool) {
+	if j.Timeout <= 0 || j.State != JobStateRunning {
+		return time.Time{}, false
+	}
+	started, ok := j.LastTransition(JobStateRunning)
+	if !ok {
+		return time.Time{}, false
+	}
+	return started.At.Add(j.Timeout.Std()), true
+}
+
+// Clone returns a deep copy of the job.
+func (j *Job) Clone() *Job {
+	c := *j
+	c.Entrypoint = append([]string(nil), j.Entrypoint...)
+	c.Commands = append([]string(nil), j.Commands...)
+	c.Tasks = nil
+	for _, t := range j.Tasks {
+		t.Entrypoint = append([]string(nil), t.Entrypoint...)
+		t.Commands = append([]string(nil), t.Commands...)
+		t.Env = cloneMap(t.Env)
+		c.Tasks = append(c.Tasks, t)
+	}
+	c.Services = nil
+	for _, svc := range j.Services {
+		svc.Entrypoint = append([]string(nil), svc.Entrypoint...)
+		svc.Command = append([]string(nil), svc.Command...)
+		svc.Env = cloneMap(svc.Env)
+		c.Services = append(c.Services, svc)
+	}
+	if j.Resources != nil {
+		r := *j.Resources
+		c.Resources = &r
+	}
+	if j.Requests != nil {
+		r := *j.Requests
+		c.Requests = &r
+	}
+	c.Security = j.Security.Clone()
+	c.Secrets = append([]string(nil), j.Secrets...)
+	c.Outputs = append([]string(nil), j.Outputs...)
+	c.Caches = append([]CacheMount(nil), j.Caches...)
+	c.CacheFallbacks = append([]string(nil), j.CacheFallbacks...)
+	c.Results = cloneMap(j.Results)
+	if j.Trigger != nil {
+		t := *j.Trigger
+		t.Inputs = cloneMap(j.Trigger.Inputs)
+		c.Trigger = &t
+	}
+	c.Env = cloneMap(j.Env)
+	c.Images = cloneMap(j.Images)
+	c.IDTokens = cloneMap(j.IDTokens)
+	c.Labels = cloneMap(j.Labels)
+	c.Matrix = cloneMap(j.Matrix)
+	c.TraceContext = cloneMap(j.TraceContext)
+	if j.Retry != nil {
+		r := *j.Retry
+		r.ExitCodes = append([]int(nil), j.Retry.ExitCodes...)
+		c.Retry = &r
+	}
+	c.Attempts = nil
+	for _, a := range j.Attempts {
+		if a.ExitCode != nil {
+			code := *a.ExitCode
+			a.ExitCode = &code
+		}
+		c.Attempts = append(c.Attempts, a)
+	}
+	if j.RetryAt != nil {
+		t := *j.RetryAt
+		c.RetryAt = &t
+	}
+	if j.ExitCode != nil {
+		code := *j.ExitCode
+		c.ExitCode = &code
+	}
+	if j.LeaseExpiresAt != nil {
+		t := *j.LeaseExpiresAt
+		c.LeaseExpiresAt = &t
+	}
+	c.Transitions = append([]JobTransition(nil), j.Transitions...)
+	return &c
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+package types
+
+import "time"
+
+// JobLog records where the output of a job is kept: the compressed segments
+// it was written in, in order. The contents live in a blob store.
+type JobLog struct {
+	JobID string `json:"job_id"`
+	// Project is the repository of the job, which decides the retention.
+	// It is set once the job has finished.
+	Project string `json:"project,omitempty"`
+	// Size is the length of the log in bytes, over all segments.
+	Size      int64        `json:"size"`
+	Segments  []LogSegment `json:"segments"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	// ExpiresAt is when the log is deleted; nil keeps it forever, as for
+	// jobs that have not finished.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// LogSegment is a run of consecutive chunks of a job's log, stored as one
+// compressed blob.
+type LogSegment struct {
+	// Offset is the position of the segment's first byte within the log
+	// and Size the number of bytes it holds.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+	// StoredSize is the size of the segment once compressed.
+	StoredSize int64     `json:"stored_size"`
+	Chunks     int       `json:"chunks"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// End returns the offset just past the segment.
+func (s LogSegment) End() int64 {
+	return s.Offset + s.Size
+}
+
+// Clone returns a deep copy of the log record.
+func (l *JobLog) Clone() *JobLog {
+	c := *l
+	c.Segments = append([]LogSegment(nil), l.Segments...)
+	if l.ExpiresAt != nil {
+		t := *l.ExpiresAt
+		c.ExpiresAt = &t
+	}
+	return &c
+}
+
+// LogLine is a line of a finished job's output, as kept in the log search
+// index.
+type LogLine struct {
+	// ID is the job ID and line number, unique across the index.
+	ID      string `json:"id"`
+	JobID   string `json:"job_id"`
+	Project string `json:"project"`
+	// Number is the line's position in the log, counted from 1, and Offset
+	// the position of its first byte, from which the log can be read.
+	Number int    `json:"line"`
+	Offset int64  `json:"offset"`
+	Text   string `json:"text"`
+	// FinishedAt is when the job finished; search results are ordered by
+	// it.
+	FinishedAt time.Time `json:"finished_at"`
+}
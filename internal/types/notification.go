@@ -0,0 +1,464 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotifierKind is where a notifier delivers its messages.
+type NotifierKind string
+
+const (
+	// NotifierSlack posts messages to a Slack incoming webhook.
+	NotifierSlack NotifierKind = "slack"
+	// NotifierWebhook posts the event and message as JSON to any URL.
+	NotifierWebhook NotifierKind = "webhook"
+	// NotifierEmail mails messages through the server's SMTP relay.
+	NotifierEmail NotifierKind = "email"
+)
+
+// NotificationEvent is something that happened to a project that notifiers
+// can subscribe to.
+type NotificationEvent string
+
+const (
+	EventPipelineFailed    NotificationEvent = "pipeline_failed"
+	EventPipelineSucceeded NotificationEvent = "pipeline_succeeded"
+	// EventPipelineFixed is a run that succeeded after the previous run of
+	// the same pipeline on the same ref failed.
+	EventPipelineFixed NotificationEvent = "pipeline_fixed"
+	// EventApprovalNeeded is a manual stage of a run that started awaiting
+	// approval.
+	EventApprovalNeeded NotificationEvent = "approval_needed"
+	// EventJobStuck is a job that stayed queued for longer than the
+	// notifier's StuckAfter.
+	EventJobStuck NotificationEvent = "job_stuck"
+	// EventJobLost is a job that hung on its agent, assigned without
+	// starting or running without output, and was given up on: failed, or
+	// retried if its retry policy covers it.
+	EventJobLost NotificationEvent = "job_lost"
+	// EventPipelineStarted is a run whose first job started.
+	EventPipelineStarted NotificationEvent = "pipeline_started"
+	// EventPipelineFinished is a run that succeeded, failed or was
+	// cancelled.
+	EventPipelineFinished NotificationEvent = "pipeline_finished"
+	// EventJobFailed is a job that failed or timed out for good, without
+	// being retried.
+	EventJobFailed NotificationEvent = "job_failed"
+	// EventAgentOffline is an agent of an organization that stopped
+	// sending heartbeats or disconnected. Only organization notifiers
+	// deliver it.
+	EventAgentOffline NotificationEvent = "agent_offline"
+)
+
+// NotificationEvents lists every event, in the order they are documented.
+var NotificationEvents = []NotificationEvent{
+	EventPipelineFailed, EventPipelineSucceeded, EventPipelineFixed, EventApprovalNeeded, EventJobStuck, EventJobLost,
+	EventPipelineStarted, EventPipelineFinished, EventJobFailed, EventAgentOffline,
+}
+
+// DefaultStuckAfter is how long a job stays queued before it counts as
+// stuck when the notifier does not say.
+const DefaultStuckAfter = 15 * time.Minute
+
+// Notifier delivers messages about a project's events to a chat channel, an
+// HTTP endpoint or email addresses. Organization notifiers deliver those of
+// every project of their organization, and those of its agents.
+type Notifier struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Project      string              `json:"project,omitempty"`
+	Organization string              `json:"organization,omitempty"`
+	Kind         NotifierKind        `json:"kind"`
+	Events       []NotificationEvent `json:"events"`
+	// URL is where slack and webhook notifiers post to. Slack webhook URLs
+	// are credentials, so URLSecret may name a project secret holding it
+	// instead.
+	URL       string `json:"url,omitempty"`
+	URLSecret string `json:"url_secret,omitempty"`
+	// SigningSecret names a project secret webhook bodies are signed with,
+	// as HMAC-SHA256 in the X-Open-CICD-Signature-256 header. Organization
+	// notifiers have no project secrets to name; their key is sealed with
+	// them as SigningKey instead, and HasSigningKey tells whether they have
+	// one.
+	SigningSecret string      `json:"signing_secret,omitempty"`
+	SigningKey    SealedValue `json:"-"`
+	HasSigningKey bool        `json:"has_signing_key,omitempty"`
+	// To are the recipients of email notifiers.
+	To []string `json:"to,omitempty"`
+	// Template is a text/template for the message, given the event, the
+	// project, the pipeline run and for job_stuck and job_lost the job.
+	// Empty uses a built-in message per event.
+	Template string `json:"template,omitempty"`
+	// HTMLTemplate is an html/template for the HTML part of the emails of
+	// email notifiers, given the same data. Empty uses a built-in one
+	// unless Template is set, in which case emails are plain text only.
+	HTMLTemplate string `json:"html_template,omitempty"`
+	// StuckAfter is how long a job stays queued before job_stuck fires.
+	StuckAfter Duration `json:"stuck_after,omitempty"`
+	Enabled    bool     `json:"enabled"`
+	// LastDeliveryAt is when the latest delivery finished, after its
+	// retries, and LastError why it failed, if it did.
+	LastDeliveryAt *time.Time `json:"last_delivery_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the notifier.
+func (n *Notifier) Clone() *Notifier {
+	c := *n
+	c.Events = slices.Clone(n.Events)
+	c.To = slices.Clone(n.To)
+	if n.LastDeliveryAt != nil {
+		t := *n.LastDeliveryAt
+		c.LastDeliveryAt = &t
+	}
+	return &c
+}
+
+// Subscribed reports whether the notifier is enabled and delivers event.
+func (n *Notifier) Subscribed(event NotificationEvent) bool {
+	return n.Enabled && slices.Contains(n.Events, event)
+}
+
+// StuckThreshold returns how long a job stays queued before the notifier
+// reports it as stuck.
+func (n *Notifier) StuckThreshold() time.Duration {
+	if n.StuckAfter <= 0 {
+		return DefaultStuckAfter
+	}
+	return n.StuckAfter.Std()
+}
+
+// Validate checks the notifier's settings, whether it is being created or
+// was just changed.
+func (n *Notifier) Validate() error {
+	if strings.TrimSpace(n.Name) == "" {
+		return errors.New("name is required")
+	}
+	if (n.Project == "") == (n.Organization == "") {
+		return errors.New("exactly one of project and organization is required")
+	}
+	if len(n.Events) == 0 {
+		return errors.New("events must name at least one event")
+	}
+	for _, event := range n.Events {
+		if !slices.Contains(NotificationEvents, event) {
+			return fmt.Errorf("unknown event %q, expected one of %s", event, joinEvents(NotificationEvents))
+		}
+		if event == EventAgentOffline && n.Organization == "" {
+			return fmt.Errorf("%s only applies to organization notifiers", event)
+		}
+	}
+	if n.Organization != "" && (n.URLSecret != "" || n.SigningSecret != "") {
+		return errors.New("organization notifiers have no project secrets: give url and signing_key instead of url_secret and signing_secret")
+	}
+	if n.HasSigningKey && n.Organization == "" {
+		return errors.New("signing_key only applies to organization notifiers; name a project secret in signing_secret")
+	}
+	switch n.Kind {
+	case NotifierSlack, NotifierWebhook:
+		if (n.URL == "") == (n.URLSecret == "") {
+			return errors.New("exactly one of url and url_secret is required")
+		}
+		if n.URL != "" {
+			if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("url %q is not an http or https URL", n.URL)
+			}
+		}
+		if len(n.To) > 0 {
+			return fmt.Errorf("to only applies to email notifiers")
+		}
+	case NotifierEmail:
+		if n.URL != "" || n.URLSecret != "" {
+			return errors.New("url and url_secret do not apply to email notifiers")
+		}
+		if len(n.To) == 0 {
+			return errors.New("to must name at least one address")
+		}
+		for _, addr := range n.To {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return fmt.Errorf("invalid address %q", addr)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, expected slack, webhook or email", n.Kind)
+	}
+	if (n.SigningSecret != "" || n.HasSigningKey) && n.Kind != NotifierWebhook {
+		return errors.New("signing_secret and signing_key only apply to webhook notifiers")
+	}
+	if n.StuckAfter < 0 {
+		return errors.New("stuck_after must not be negative")
+	}
+	if n.Template != "" {
+		if _, err := template.New("message").Parse(n.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	if n.HTMLTemplate != "" {
+		if n.Kind != NotifierEmail {
+			return errors.New("html_template only applies to email notifiers")
+		}
+		if _, err := htmltemplate.New("message").Parse(n.HTMLTemplate); err != nil {
+			return fmt.Errorf("invalid html_template: %w", err)
+		}
+	}
+	return nil
+}
+
+func joinEvents(events []NotificationEvent) string {
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = string(e)
+	}
+	return strings.Join(names, ", ")
+}
+
+// CreateNotifierRequest is the body of POST /notifiers. It names either the
+// project or the organization the notifier belongs to.
+type CreateNotifierRequest struct {
+	Name          string              `json:"name" openapi:"required"`
+	Project       string              `json:"project,omitempty"`
+	Organization  string              `json:"organization,omitempty"`
+	Kind          NotifierKind        `json:"kind" openapi:"required"`
+	Events        []NotificationEvent `json:"events" openapi:"required"`
+	URL           string              `json:"url,omitempty"`
+	URLSecret     string              `json:"url_secret,omitempty"`
+	SigningSecret string              `json:"signing_secret,omitempty"`
+	// SigningKey is the key the bodies of an organization's webhook
+	// notifier are signed with. It is sealed and never shown again.
+	SigningKey   string   `json:"signing_key,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Template     string   `json:"template,omitempty"`
+	HTMLTemplate string   `json:"html_template,omitempty"`
+	StuckAfter   Duration `json:"stuck_after,omitempty"`
+	Enabled      *bool    `json:"enabled,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateNotifierRequest) Validate() error {
+	if strings.TrimSpace(r.Project) == "" && strings.TrimSpace(r.Organization) == "" {
+		return errors.New("project or organization is required")
+	}
+	return r.Notifier().Validate()
+}
+
+// Notifier returns the notifier the request describes, without its ID and
+// times and with its signing key yet to be sealed. Notifiers are enabled
+// unless the request says otherwise.
+func (r *CreateNotifierRequest) Notifier() *Notifier {
+	return &Notifier{
+		Name:          r.Name,
+		Project:       r.Project,
+		Organization:  r.Organization,
+		Kind:          r.Kind,
+		Events:        slices.Clone(r.Events),
+		URL:           r.URL,
+		URLSecret:     r.URLSecret,
+		SigningSecret: r.SigningSecret,
+		HasSigningKey: r.SigningKey != "",
+		To:            slices.Clone(r.To),
+		Template:      r.Template,
+		HTMLTemplate:  r.HTMLTemplate,
+		StuckAfter:    r.StuckAfter,
+		Enabled:       r.Enabled == nil || *r.Enabled,
+	}
+}
+
+// UpdateNotifierRequest is the body of PATCH /notifiers/{id}. Only the
+// fields that are set are changed; the result is validated as a whole.
+type UpdateNotifierRequest struct {
+	Name          *string              `json:"name,omitempty"`
+	Events        *[]NotificationEvent `json:"events,omitempty"`
+	URL           *string              `json:"url,omitempty"`
+	URLSecret     *string              `json:"url_secret,omitempty"`
+	SigningSecret *string              `json:"signing_secret,omitempty"`
+	// SigningKey replaces the signing key of an organization notifier;
+	// an empty one removes it.
+	SigningKey   *string   `json:"signing_key,omitempty"`
+	To           *[]string `json:"to,omitempty"`
+	Template     *string   `json:"template,omitempty"`
+	HTMLTemplate *string   `json:"html_template,omitempty"`
+	StuckAfter   *Duration `json:"stuck_after,omitempty"`
+	Enabled      *bool     `json:"enabled,omitempty"`
+}
+
+// Apply changes the notifier's fields that are set in the request.
+func (r *UpdateNotifierRequest) Apply(n *Notifier) {
+	if r.Name != nil {
+		n.Name = *r.Name
+	}
+	if r.Events != nil {
+		n.Events = slices.Clone(*r.Events)
+	}
+	if r.URL != nil {
+		n.URL = *r.URL
+	}
+	if r.URLSecret != nil {
+		n.URLSecret = *r.URLSecret
+	}
+	if r.SigningSecret != nil {
+		n.SigningSecret = *r.SigningSecret
+	}
+	if r.SigningKey != nil {
+		// The caller seals the new key.
+		n.SigningKey = SealedValue{}
+		n.HasSigningKey = *r.SigningKey != ""
+	}
+	if r.To != nil {
+		n.To = slices.Clone(*r.To)
+	}
+	if r.Template != nil {
+		n.Template = *r.Template
+	}
+	if r.HTMLTemplate != nil {
+		n.HTMLTemplate = *r.HTMLTemplate
+	}
+	if r.StuckAfter != nil {
+		n.StuckAfter = *r.StuckAfter
+	}
+	if r.Enabled != nil {
+		n.Enabled = *r.Enabled
+	}
+}
+
+// UserEvents lists the events users can be mailed about for the projects
+// they follow. job_stuck is left to notifiers, which set its threshold.
+var UserEvents = []NotificationEvent{EventPipelineFailed, EventPipelineSucceeded, EventPipelineFixed, EventApprovalNeeded, EventJobLost}
+
+// NotifierDeliveryStatus is the outcome of a notifier's delivery, after its
+// retries.
+type NotifierDeliveryStatus string
+
+const (
+	NotifierDelivered NotifierDeliveryStatus = "delivered"
+	NotifierFailed    NotifierDeliveryStatus = "failed"
+)
+
+// NotifierDelivery is a message a notifier sent, or failed to send, kept
+// for a while so that failing endpoints can be diagnosed.
+type NotifierDelivery struct {
+	ID         string                 `json:"id"`
+	NotifierID string                 `json:"notifier_id"`
+	Event      NotificationEvent      `json:"event"`
+	Project    string                 `json:"project,omitempty"`
+	Pipeline   string                 `json:"pipeline,omitempty"`
+	Job        string                 `json:"job,omitempty"`
+	Agent      string                 `json:"agent,omitempty"`
+	Status     NotifierDeliveryStatus `json:"status"`
+	// Attempts lists every try, the retries after the first one waiting
+	// twice as long as the one before.
+	Attempts  []NotifierAttempt `json:"attempts"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// NotifierAttempt is one try of a notifier's delivery. StatusCode is that
+// of the endpoint's answer, and zero when there was none, as for email.
+type NotifierAttempt struct {
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// Clone returns a deep copy of the delivery.
+func (d *NotifierDelivery) Clone() *NotifierDelivery {
+	c := *d
+	c.Attempts = slices.Clone(d.Attempts)
+	return &c
+}
+
+// NotificationPreferences are a user's own email notifications: the events
+// of the projects they follow they are mailed about, and the events they
+// are never mailed about, even by the email notifiers of projects that
+// name their address.
+type NotificationPreferences struct {
+	User string `json:"user"`
+	// Email is the address the user's notifications are mailed to.
+	Email string `json:"email"`
+	// Projects are the projects the user follows; of them, only those the
+	// user may view are mailed about.
+	Projects []string            `json:"projects"`
+	Events   []NotificationEvent `json:"events"`
+	Muted    []NotificationEvent `json:"muted"`
+	// Enabled turns the user's notifications off, muted events included,
+	// while false.
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the preferences.
+func (p *NotificationPreferences) Clone() *NotificationPreferences {
+	c := *p
+	c.Projects = slices.Clone(p.Projects)
+	c.Events = slices.Clone(p.Events)
+	c.Muted = slices.Clone(p.Muted)
+	return &c
+}
+
+// Follows reports whether the user is mailed about event for project.
+func (p *NotificationPreferences) Follows(project string, event NotificationEvent) bool {
+	return p.Enabled && slices.Contains(p.Projects, project) && slices.Contains(p.Events, event)
+}
+
+// Mutes reports whether the user is never mailed about event.
+func (p *NotificationPreferences) Mutes(event NotificationEvent) bool {
+	return p.Enabled && slices.Contains(p.Muted, event)
+}
+
+// PutNotificationPreferencesRequest is the body of
+// PUT /notifications/preferences.
+type PutNotificationPreferencesRequest struct {
+	Email    string              `json:"email" openapi:"required"`
+	Projects []string            `json:"projects,omitempty"`
+	Events   []NotificationEvent `json:"events,omitempty"`
+	Muted    []NotificationEvent `json:"muted,omitempty"`
+	Enabled  *bool               `json:"enabled,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *PutNotificationPreferencesRequest) Validate() error {
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		return fmt.Errorf("invalid email %q", r.Email)
+	}
+	for _, project := range r.Projects {
+		if strings.TrimSpace(project) == "" {
+			return errors.New("projects must not be empty")
+		}
+	}
+	if len(r.Projects) > 0 && len(r.Events) == 0 {
+		return errors.New("events must name at least one event for the projects followed")
+	}
+	for _, event := range r.Events {
+		if !slices.Contains(UserEvents, event) {
+			return fmt.Errorf("unknown event %q, expected one of %s", event, joinEvents(UserEvents))
+		}
+	}
+	for _, event := range r.Muted {
+		if !slices.Contains(NotificationEvents, event) {
+			return fmt.Errorf("unknown muted event %q, expected one of %s", event, joinEvents(NotificationEvents))
+		}
+	}
+	return nil
+}
+
+// Preferences returns the preferences of user the request describes.
+// Preferences are enabled unless the request says otherwise.
+func (r *PutNotificationPreferencesRequest) Preferences(user string) *NotificationPreferences {
+	return &NotificationPreferences{
+		User:     user,
+		Email:    r.Email,
+		Projects: append([]string{}, r.Projects...),
+		Events:   append([]NotificationEvent{}, r.Events...),
+		Muted:    append([]NotificationEvent{}, r.Muted...),
+		Enabled:  r.Enabled == nil || *r.Enabled,
+	}
+}
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxIDTokens bounds the ID tokens one job gets.
+const maxIDTokens = 10
+
+// ValidateIDTokens checks the ID tokens a job asks for, mapping environment
+// variable names to audiences.
+func ValidateIDTokens(tokens map[string]string) error {
+	if len(tokens) > maxIDTokens {
+		return fmt.Errorf("a job can get at most %d ID tokens", maxIDTokens)
+	}
+	for name, audience := range tokens {
+		if !secretNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid ID token variable name %q", name)
+		}
+		if audience == "" || strings.ContainsAny(audience, " \t\r\n") || len(audience) > 256 {
+			return fmt.Errorf("ID token %s needs an audience of at most 256 characters without spaces", name)
+		}
+	}
+	return nil
+}
+
+// OIDCConfiguration is the OpenID Provider metadata the server serves at
+// /.well-known/openid-configuration, as far as cloud providers need it to
+// trust the ID tokens of jobs.
+type OIDCConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// JSONWebKeySet is the set of public keys ID tokens are signed with, served
+// at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey is an RSA public key as RFC 7517 describes it.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// N and E are the modulus and exponent, base64url encoded.
+	N string `json:"n"`
+	E string `json:"e"`
+}
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// organizationNamePattern restricts organization names to lowercase DNS
+// labels, so they are safe in URLs and log lines.
+var organizationNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Organization is a tenant of the server. It owns projects, and through them
+// their jobs, pipelines, secrets and schedules, as well as the agents that
+// registered with its registration token.
+type Organization struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	// RegistrationTokenHash is the hash of the token the organization's
+	// agents register with.
+	RegistrationTokenHash string    `json:"-"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// Project is a repository, such as "owner/repo", owned by an organization.
+// A project never moves to another organization, so work recorded under it
+// never changes hands. Repositories without a project belong to no
+// organization.
+type Project struct {
+	Name         string    `json:"name"`
+	Organization string    `json:"organization"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ProjectBadge is the URL of a branch's status badge, returned by
+// GET /projects/{project}/badge. The URL carries the project's badge token,
+// so anyone holding it may see whether the project's branches pass.
+type ProjectBadge struct {
+	Project string `json:"project"`
+	Branch  string `json:"branch"`
+	URL     string `json:"url"`
+}
+
+// CreateOrganizationRequest is the body of POST /orgs.
+type CreateOrganizationRequest struct {
+	Name        string `json:"name" openapi:"required"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateOrganizationRequest) Validate() error {
+	if !organizationNamePattern.MatchString(r.Name) {
+		return fmt.Errorf("invalid organization name %q: use up to 63 lowercase letters, digits and dashes", r.Name)
+	}
+	return nil
+}
+
+// CreateOrganizationResponse is returned by POST /orgs and
+// POST /orgs/{name}/registration-token. RegistrationToken is the token the
+// organization's agents register with and is only ever shown in this
+// response.
+type CreateOrganizationResponse struct {
+	Organization
+	RegistrationToken string `json:"registration_token"`
+}
+
+// CreateProjectRequest is the body of POST /orgs/{name}/projects.
+type CreateProjectRequest struct {
+	Name string `json:"name" openapi:"required"`
+}
+
+// Validate checks that the project is named like a repository.
+func (r *CreateProjectRequest) Validate() error {
+	owner, repo, ok := strings.Cut(r.Name, "/")
+	if !ok || owner == "" || repo == "" || strings.ContainsAny(r.Name, " \t\n*") {
+		return fmt.Errorf("invalid project name %q, expected a repository such as owner/repo", r.Name)
+	}
+	return nil
+}
+
+// BootstrapProjectRequest is the body of POST /projects, which onboards a
+// repository in one step.
+type BootstrapProjectRequest struct {
+	Organization string `json:"organization" openapi:"required"`
+	// RepositoryURL is the HTTPS or SSH URL of the repository, such as
+	// https://github.com/owner/repo.
+	RepositoryURL string `json:"repository_url" openapi:"required"`
+	// Provider is github or gitlab. Without it the provider is told from
+	// the host of RepositoryURL.
+	Provider string `json:"provider,omitempty"`
+	// Credential is an access token of the provider that may read the
+	// repository and manage its webhooks. It is only used for the request
+	// and never stored. Without it the credential the organization stores
+	// for the provider is used.
+	Credential string `json:"credential,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *BootstrapProjectRequest) Validate() error {
+	if !organizationNamePattern.MatchString(r.Organization) {
+		return fmt.Errorf("invalid organization name %q", r.Organization)
+	}
+	if strings.TrimSpace(r.RepositoryURL) == "" {
+		return errors.New("repository_url is required")
+	}
+	switch r.Provider {
+	case "", "github", "gitlab":
+	default:
+		return fmt.Errorf("unknown provider %q, expected github or gitlab", r.Provider)
+	}
+	if r.Credential != "" && strings.TrimSpace(r.Credential) == "" {
+		return errors.New("credential must not be blank")
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// PipelineState is the lifecycle state of a pipeline run.
+type PipelineState string
+
+const (
+	PipelineStatePending   PipelineState = "pending"
+	PipelineStateRunning   PipelineState = "running"
+	PipelineStateSucceeded PipelineState = "succeeded"
+	PipelineStateFailed    PipelineState = "failed"
+	PipelineStateCancelled PipelineState = "cancelled"
+)
+
+// pipelineTransitions defines the pipeline state machine.
+var pipelineTransitions = map[PipelineState][]PipelineState{
+	PipelineStatePending:   {PipelineStateRunning, PipelineStateFailed, PipelineStateCancelled},
+	PipelineStateRunning:   {PipelineStateSucceeded, PipelineStateFailed, PipelineStateCancelled},
+	PipelineStateSucceeded: nil,
+	PipelineStateFailed:    nil,
+	PipelineStateCancelled: nil,
+}
+
+// Valid reports whether s is a known pipeline state.
+func (s PipelineState) Valid() bool {
+	_, ok := pipelineTransitions[s]
+	return ok
+}
+
+// Terminal reports whether s is a final state.
+func (s PipelineState) Terminal() bool {
+	return s.Valid() && len(pipelineTransitions[s]) == 0
+}
+
+// CanTransitionTo reports whether the state machine allows moving from s to next.
+func (s PipelineState) CanTransitionTo(next PipelineState) bool {
+	for _, allowed := range pipelineTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline is a single run of a pipeline definition, made up of jobs.
+type Pipeline struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Repository string `json:"repository,omitempty"`
+	// Organization owns the run's project, if any organization does.
+	Organization string          `json:"organization,omitempty"`
+	Ref          string          `json:"ref,omitempty"`
+	Commit       string          `json:"commit,omitempty"`
+	Trigger      *Trigger        `json:"trigger,omitempty"`
+	State        PipelineState   `json:"state"`
+	Stages       []PipelineStage `json:"stages"`
+	JobIDs       []string        `json:"job_ids"`
+	// Concurrency is the concurrency group of the run, if its definition
+	// sets one. WaitingFor is the earlier run of the group that has to
+	// finish before any stage of this one starts.
+	Concurrency string `json:"concurrency,omitempty"`
+	WaitingFor  string `json:"waiting_for,omitempty"`
+	// RerunOf is the run this one re-runs, on behalf of RerunBy. Jobs of
+	// the earlier run that are listed in JobIDs were carried over from it
+	// rather than run again.
+	RerunOf string `json:"rerun_of,omitempty"`
+	RerunBy string `json:"rerun_by,omitempty"`
+	// Restricted runs, those of code from forks, get neither secrets nor
+	// ID tokens and only restore caches.
+	Restricted bool `json:"restricted,omitempty"`
+	// AwaitingAuthorization holds every job of a run of a pull request
+	// from a fork pending until a maintainer authorizes the run, which
+	// Authorization then records.
+	AwaitingAuthorization bool              `json:"awaiting_authorization,omitempty"`
+	Authorization         *RunAuthorization `json:"authorization,omitempty"`
+	// Results gathers the results the succeeded jobs of the run reported,
+	// keyed "<job name>.<key>", such as "release/image.digest".
+	Results map[string]string `json:"results,omitempty"`
+	// Inputs are the values the run was started with for the inputs its
+	// definition declares, defaults included.
+	Inputs map[string]string `json:"inputs,omitempty"`
+	// OutputExpressions are the outputs the definition declares, with
+	// every expression but those of results resolved; Outputs are their
+	// values, set once the run succeeds.
+	OutputExpressions map[string]string `json:"output_expressions,omitempty"`
+	Outputs           map[string]string `json:"outputs,omitempty"`
+	// Parent is the run whose trigger step started this one, and Children
+	// are the runs the trigger steps of this one started.
+	Parent   *PipelineLink  `json:"parent,omitempty"`
+	Children []PipelineLink `json:"children,omitempty"`
+	// Definition is the pipeline file the run was created from.
+	Definition string    `json:"definition,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// PipelineStage is a stage of a pipeline run and the jobs expanded from it.
+type PipelineStage struct {
+	Name   string   `json:"name"`
+	Needs  []string `json:"needs,omitempty"`
+	JobIDs []string `json:"job_ids"`
+	// Manual stages wait for an approval before their jobs are queued.
+	// Approvers, if any, are the only ones who may decide; otherwise
+	// anyone who may run the project's pipelines can.
+	Manual    bool      `json:"manual,omitempty"`
+	Approvers []Subject `json:"approvers,omitempty"`
+	// Approval records the decision on a manual stage once it is made.
+	Approval *StageApproval `json:"approval,omitempty"`
+	// AwaitingSince is when a manual stage started awaiting approval, once
+	// the stages it needs succeeded.
+	AwaitingSince *time.Time `json:"awaiting_since,omitempty"`
+}
+
+// ApprovalDecision is the outcome of an approval.
+type ApprovalDecision string
+
+const (
+	// Approved releases the jobs of a manual stage.
+	Approved ApprovalDecision = "approved"
+	// Rejected skips them, and with them the stages that need the stage.
+	Rejected ApprovalDecision = "rejected"
+)
+
+// StageApproval is the decision on a manual stage.
+type StageApproval struct {
+	Decision ApprovalDecision `json:"decision"`
+	By       string           `json:"by"`
+	Comment  string           `json:"comment,omitempty"`
+	At       time.Time        `json:"at"`
+}
+
+// Reason describes the approval for the transitions of the stage's jobs.
+func (a *StageApproval) Reason() string {
+	reason := string(a.Decision) + " by " + a.By
+	if a.Comment != "" {
+		reason += ": " + a.Comment
+	}
+	return reason
+}
+
+// StageDecisionRequest is the optional body of
+// POST /pipelines/{id}/stages/{stage}/approve and .../reject.
+type StageDecisionRequest struct {
+	Comment string `json:"comment,omitempty"`
+}
+
+// RunAuthorization records who let a run of a pull request from a fork
+// start.
+type RunAuthorization struct {
+	By      string `json:"by"`
+	Comment string `json:"comment,omitempty"`
+	// Secrets is set when the run was let have secrets and ID tokens too,
+	// lifting its restriction.
+	Secrets bool      `json:"secrets,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Reason describes the authorization for the transitions of the run's
+// jobs.
+func (a *RunAuthorization) Reason() string {
+	reason := "authorized by " + a.By
+	if a.Comment != "" {
+		reason += ": " + a.Comment
+	}
+	return reason
+}
+
+// AuthorizePipelineRequest is the optional body of
+// POST /pipelines/{id}/authorize.
+type AuthorizePipelineRequest struct {
+	Comment string `json:"comment,omitempty"`
+	// Secrets lets the run have the project's secrets and ID tokens, which
+	// runs of code from forks are otherwise denied. Only those who may
+	// manage the project can grant them.
+	Secrets bool `json:"secrets,omitempty"`
+}
+
+// RerunPipelineRequest is the optional body of POST /pipelines/{id}/rerun.
+type RerunPipelineRequest struct {
+	// FailedOnly runs again only the stages that did not succeed, and
+	// re-uses the jobs of the others.
+	FailedOnly bool `json:"failed_only,omitempty"`
+}
+
+// Transition moves the pipeline to next, enforcing the pipeline state machine.
+func (p *Pipeline) Transition(next PipelineState, at time.Time) error {
+	if !p.State.CanTransitionTo(next) {
+		return fmt.Errorf("%w: pipeline %s cannot move from %s to %s", ErrInvalidTransition, p.ID, p.State, next)
+	}
+	p.State = next
+	p.UpdatedAt = at
+	return nil
+}
+
+// Stage returns the stage of the run with the given name, or nil.
+func (p *Pipeline) Stage(name string) *PipelineStage {
+	for i := range p.Stages {
+		if p.Stages[i].Name == name {
+			return &p.Stages[i]
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the pipeline.
+func (p *Pipeline) Clone() *Pipeline {
+	c := *p
+	c.JobIDs = append([]string(nil), p.JobIDs...)
+	c.Results = cloneMap(p.Results)
+	c.Inputs = cloneMap(p.Inputs)
+	c.OutputExpressions = cloneMap(p.OutputExpressions)
+	c.Outputs = cloneMap(p.Outputs)
+	c.Children = append([]PipelineLink(nil), p.Children...)
+	if p.Parent != nil {
+		l := *p.Parent
+		c.Parent = &l
+	}
+	if p.Authorization != nil {
+		a := *p.Authorization
+		c.Authorization = &a
+	}
+	if p.Trigger != nil {
+		t := *p.Trigger
+		t.Inputs = cloneMap(p.Trigger.Inputs)
+		if t.Parent != nil {
+			l := *t.Parent
+			t.Parent = &l
+		}
+		c.Trigger = &t
+	}
+	c.Stages = make([]PipelineStage, len(p.Stages))
+	for i, st := range p.Stages {
+		st.Needs = append([]string(nil), st.Needs...)
+		st.JobIDs = append([]string(nil), st.JobIDs...)
+		st.Approvers = append([]Subject(nil), st.Approvers...)
+		if st.Approval != nil {
+			a := *st.Approval
+			st.Approval = &a
+		}
+		if st.AwaitingSince != nil {
+			t := *st.AwaitingSince
+			st.AwaitingSince = &t
+		}
+		c.Stages[i] = st
+	}
+	return &c
+}
+
+// PipelineLink points from a run to another it started or was started by.
+type PipelineLink struct {
+	PipelineID string `json:"pipeline_id"`
+	Repository string `json:"repository"`
+	// JobID is the job of the trigger step that started the downstream
+	// run.
+	JobID string `json:"job_id"`
+}
+
+// PipelineTrigger is what a trigger step starts: a run of the pipeline file
+// at a ref of another repository, given inputs.
+type PipelineTrigger struct {
+	Repository string `yaml:"repository" json:"repository"`
+	CloneURL   string `yaml:"clone_url" json:"clone_url"`
+	Ref        string `yaml:"ref" json:"ref"`
+	// Inputs are the values of the inputs the downstream definition
+	// declares, which may refer to the results of the stages the step's
+	// stage needs.
+	Inputs map[string]string `yaml:"inputs,omitempty" json:"inputs,omitempty"`
+	// Wait keeps the step running until the downstream run finishes, and
+	// fails it unless that run succeeds. The step's job then reports the
+	// outputs of the downstream run as its results.
+	Wait bool `yaml:"wait,omitempty" json:"wait,omitempty"`
+}
+
+// StageState is the state of a pipeline stage, derived from its jobs.
+type StageState string
+
+const (
+	// StageStateWaiting means the stage is waiting for the stages it needs.
+	StageStateWaiting StageState = "waiting"
+	// StageStateAwaitingApproval means a manual stage is ready to run
+	// once approved.
+	StageStateAwaitingApproval StageState = "awaiting_approval"
+	StageStateQueued           StageState = "queued"
+	StageStateRunning          StageState = "running"
+	StageStateSucceeded        StageState = "succeeded"
+	StageStateFailed           StageState = "failed"
+	StageStateCancelled        StageState = "cancelled"
+	StageStateSkipped          StageState = "skipped"
+)
+
+// PipelineGraph is the stage dependency graph of a pipeline run, for
+// rendering. There is an edge from each stage to every stage that needs it.
+type PipelineGraph struct {
+	PipelineID string        `json:"pipeline_id"`
+	State      PipelineState `json:"state"`
+	Nodes      []GraphNode   `json:"nodes"`
+	Edges      []GraphEdge   `json:"edges"`
+}
+
+// GraphNode is a stage of a pipeline graph.
+type GraphNode struct {
+	Stage string     `json:"stage"`
+	State StageState `json:"state"`
+	// Level is the length of the longest chain of needs leading to the
+	// stage. Stages without needs are on level 0.
+	Level int        `json:"level"`
+	Jobs  []GraphJob `json:"jobs"`
+	// Manual and Approval are those of the stage of the run.
+	Manual   bool           `json:"manual,omitempty"`
+	Approval *StageApproval `json:"approval,omitempty"`
+}
+
+// GraphJob is a job of a graph node. Jobs expanded from a matrix step carry
+// the values of their leg.
+type GraphJob struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	State        JobState          `json:"state"`
+	Matrix       map[string]string `json:"matrix,omitempty"`
+	AllowFailure bool              `json:"allow_failure,omitempty"`
+	// Attempt is set once the job has been retried.
+	Attempt int `json:"attempt,omitempty"`
+	// ReusedFrom is the earlier run the job ran in, if the run re-uses its
+	// result instead of running it again.
+	ReusedFrom string `json:"reused_from,omitempty"`
+}
+
+// GraphEdge is a dependency: To needs From.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
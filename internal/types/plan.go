@@ -0,0 +1,37 @@
+package types
+
+// PipelinePlan is which stages and steps of a definition would run for a
+// trigger, as decided by their path filters and if conditions.
+type PipelinePlan struct {
+	Name        string   `json:"name"`
+	Paths       []string `json:"paths,omitempty"`
+	PathsIgnore []string `json:"paths_ignore,omitempty"`
+	// ChangedFiles are the files the trigger changed, if known, that the
+	// path filters were matched against.
+	ChangedFiles []string `json:"changed_files,omitempty"`
+	// Runs is false when the path filters of the pipeline leave out every
+	// changed file, in which case no stage runs.
+	Runs   bool        `json:"runs"`
+	Stages []StagePlan `json:"stages"`
+	// Jobs is how many jobs the run would have.
+	Jobs int `json:"jobs"`
+}
+
+// StagePlan is whether a stage would run. A stage that runs may still have
+// no jobs if none of its steps do.
+type StagePlan struct {
+	Name        string     `json:"name"`
+	If          string     `json:"if,omitempty"`
+	Paths       []string   `json:"paths,omitempty"`
+	PathsIgnore []string   `json:"paths_ignore,omitempty"`
+	Runs        bool       `json:"runs"`
+	Steps       []StepPlan `json:"steps"`
+}
+
+// StepPlan is whether a step would run, and as how many jobs.
+type StepPlan struct {
+	Name string `json:"name"`
+	If   string `json:"if,omitempty"`
+	Runs bool   `json:"runs"`
+	Jobs int    `json:"jobs"`
+}
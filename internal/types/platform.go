@@ -0,0 +1,204 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Operating systems jobs can ask for, as GOOS names them.
+const (
+	OSLinux   = "linux"
+	OSDarwin  = "darwin"
+	OSWindows = "windows"
+)
+
+// ValidateOS checks that os is an operating system jobs can ask for.
+func ValidateOS(os string) error {
+	switch os {
+	case OSLinux, OSDarwin, OSWindows:
+		return nil
+	}
+	return fmt.Errorf("unknown os %q, want one of %s, %s or %s", os, OSLinux, OSDarwin, OSWindows)
+}
+
+// Archs are the processor architectures jobs can ask for, as GOARCH names
+// them.
+var Archs = []string{"amd64", "arm64", "arm", "386", "ppc64le", "s390x", "riscv64"}
+
+// ValidateArch checks that arch is an architecture jobs can ask for.
+func ValidateArch(arch string) error {
+	if !slices.Contains(Archs, arch) {
+		return fmt.Errorf("unknown arch %q, want one of %s", arch, strings.Join(Archs, ", "))
+	}
+	return nil
+}
+
+// ValidateImages checks how a job picks its image by architecture: from
+// image, the same on every agent, or from images, its variants keyed by
+// architecture, but not both. Resolving image into its variants needs an
+// image, and a job restricted to one arch needs a variant for it.
+func ValidateImages(image string, images map[string]string, resolve bool, arch string) error {
+	if arch != "" {
+		if err := ValidateArch(arch); err != nil {
+			return err
+		}
+	}
+	for _, a := range slices.Sorted(maps.Keys(images)) {
+		if err := ValidateArch(a); err != nil {
+			return fmt.Errorf("images: %w", err)
+		}
+		if strings.TrimSpace(images[a]) == "" {
+			return fmt.Errorf("images: the %s image is empty", a)
+		}
+	}
+	switch {
+	case image != "" && len(images) > 0:
+		return errors.New("image and images cannot be combined")
+	case resolve && image == "":
+		return errors.New("resolve_image needs an image")
+	case arch != "" && len(images) > 0 && images[arch] == "":
+		return fmt.Errorf("images has no image for arch %s", arch)
+	}
+	return nil
+}
+
+// Shell is the shell a job's commands are run with.
+type Shell string
+
+// Shells. Sh, the default, and Bash run the commands as one script that
+// stops at the first failing command; Pwsh (PowerShell 7, on any operating
+// system), PowerShell (Windows PowerShell) and Cmd run them from a script
+// file the agent writes, stopping at the first command that fails or exits
+// non-zero.
+const (
+	ShellSh         Shell = "sh"
+	ShellBash       Shell = "bash"
+	ShellPwsh       Shell = "pwsh"
+	ShellPowerShell Shell = "powershell"
+	ShellCmd        Shell = "cmd"
+)
+
+// Shells are all the shells, in the order agents look for them.
+var Shells = []Shell{ShellSh, ShellBash, ShellPwsh, ShellPowerShell, ShellCmd}
+
+// Valid reports whether s is a known shell or empty, for the default.
+func (s Shell) Valid() bool {
+	return s == "" || slices.Contains(Shells, s)
+}
+
+// Default returns s, or ShellSh if it is empty.
+func (s Shell) Default() Shell {
+	if s == "" {
+		return ShellSh
+	}
+	return s
+}
+
+// ShellFor returns shell, or PowerShell if it is empty and os is Windows,
+// since every Windows machine has it and none has sh.
+func ShellFor(os string, shell Shell) Shell {
+	if shell == "" && os == OSWindows {
+		return ShellPowerShell
+	}
+	return shell
+}
+
+// RunsOn reports whether the shell can run on the operating system goos:
+// the POSIX shells everywhere but Windows, Windows PowerShell and cmd only
+// there, and pwsh anywhere.
+func (s Shell) RunsOn(goos string) bool {
+	switch s.Default() {
+	case ShellPwsh:
+		return true
+	case ShellPowerShell, ShellCmd:
+		return goos == OSWindows
+	default:
+		return goos != OSWindows
+	}
+}
+
+// Entrypoint returns the entrypoint that runs a task's commands, passed as
+// a single newline-separated script argument, with the shell. Shells that
+// run script files have none; their executors write the file themselves.
+func (s Shell) Entrypoint() []string {
+	switch s.Default() {
+	case ShellSh:
+		return DefaultEntrypoint
+	case ShellBash:
+		return []string{"bash", "-e", "-o", "pipefail", "-c"}
+	}
+	return nil
+}
+
+// PlatformOS returns the operating system of a GOOS/GOARCH platform. Agents
+// that do not say, such as the built-in Kubernetes executor, run Linux.
+func PlatformOS(platform string) string {
+	goos, _, _ := strings.Cut(platform, "/")
+	if goos == "" {
+		return OSLinux
+	}
+	return goos
+}
+
+// PlatformArch returns the architecture of a GOOS/GOARCH platform. Agents
+// that do not say, such as the built-in Kubernetes executor, run amd64.
+func PlatformArch(platform string) string {
+	_, goarch, _ := strings.Cut(platform, "/")
+	if goarch == "" {
+		return "amd64"
+	}
+	return goarch
+}
+
+// validatePlatform checks the operating system and shell a job asks for, and
+// that the shell, or the default on the operating system, runs on it.
+func validatePlatform(os string, shell Shell) error {
+	shell = ShellFor(os, shell)
+	if os != "" {
+		if err := ValidateOS(os); err != nil {
+			return err
+		}
+	}
+	if !shell.Valid() {
+		return fmt.Errorf("unknown shell %q", shell)
+	}
+	if os != "" && !shell.RunsOn(os) {
+		return fmt.Errorf("the %s shell does not run on %s", shell.Default(), os)
+	}
+	return nil
+}
+
+// OS returns the operating system of the agent.
+func (a *Agent) OS() string {
+	return PlatformOS(a.Platform)
+}
+
+// Arch returns the processor architecture of the agent.
+func (a *Agent) Arch() string {
+	return PlatformArch(a.Platform)
+}
+
+// RunsPlatform reports whether the agent can run job: it runs the operating
+// system and architecture the job asks for, if any, one the job has an
+// image variant for, if it has variants, and one the job's shell runs on,
+// and has the shell, if it says which shells it has.
+func (a *Agent) RunsPlatform(job *Job) bool {
+	os := a.OS()
+	if job.OS != "" && job.OS != os {
+		return false
+	}
+	arch := a.Arch()
+	if job.Arch != "" && job.Arch != arch {
+		return false
+	}
+	if len(job.Images) > 0 && job.Images[arch] == "" {
+		return false
+	}
+	if !job.Shell.RunsOn(os) {
+		return false
+	}
+	return a.Shells == nil || slices.Contains(a.Shells, job.Shell.Default())
+}
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxQuotaWeight bounds the fair-share weight of a project.
+const MaxQuotaWeight = 1000
+
+// ProjectQuota limits what one project may take of the shared agent fleet.
+// Zero limits are unlimited. Projects without a quota of their own have
+// no limits and a weight of 1.
+type ProjectQuota struct {
+	Project string `json:"project"`
+	// MaxConcurrentJobs is how many of the project's jobs may be assigned
+	// to agents or running at once; further jobs stay queued.
+	MaxConcurrentJobs int `json:"max_concurrent_jobs,omitempty"`
+	// MaxQueuedJobs is how many of the project's jobs may wait for an
+	// agent; submissions beyond it are refused.
+	MaxQueuedJobs int `json:"max_queued_jobs,omitempty"`
+	// Weight is the project's share of contended agents: the scheduler
+	// next serves the project with the fewest running jobs per unit of
+	// weight, so a project of weight 2 gets twice the agents of a project of
+	// weight 1 when both have work queued.
+	Weight    int       `json:"weight"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// DefaultProjectQuota returns the quota of a project that has none.
+func DefaultProjectQuota(project string) *ProjectQuota {
+	return &ProjectQuota{Project: project, Weight: 1}
+}
+
+// PutProjectQuotaRequest is the body of PUT /projects/{project}/quota.
+type PutProjectQuotaRequest struct {
+	MaxConcurrentJobs int `json:"max_concurrent_jobs,omitempty"`
+	MaxQueuedJobs     int `json:"max_queued_jobs,omitempty"`
+	// Weight defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// Validate checks the request for malformed fields.
+func (r *PutProjectQuotaRequest) Validate() error {
+	switch {
+	case r.MaxConcurrentJobs < 0:
+		return errors.New("max_concurrent_jobs must not be negative")
+	case r.MaxQueuedJobs < 0:
+		return errors.New("max_queued_jobs must not be negative")
+	case r.Weight < 0 || r.Weight > MaxQuotaWeight:
+		return fmt.Errorf("weight must be between 1 and %d", MaxQuotaWeight)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role is a set of permissions granted on a project through a RoleBinding.
+type Role string
+
+const (
+	// RoleViewer may read jobs, pipelines and logs.
+	RoleViewer Role = "viewer"
+	// RoleDeveloper may also run and cancel jobs and pipelines.
+	RoleDeveloper Role = "developer"
+	// RoleAdmin may do everything, including managing access.
+	RoleAdmin Role = "admin"
+)
+
+// Action is something a caller wants to do to a project.
+type Action string
+
+const (
+	ActionView   Action = "view"
+	ActionRun    Action = "run"
+	ActionManage Action = "manage"
+)
+
+// roleActions lists the actions each role permits.
+var roleActions = map[Role][]Action{
+	RoleViewer:    {ActionView},
+	RoleDeveloper: {ActionView, ActionRun},
+	RoleAdmin:     {ActionView, ActionRun, ActionManage},
+}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	_, ok := roleActions[r]
+	return ok
+}
+
+// Allows reports whether the role permits action.
+func (r Role) Allows(action Action) bool {
+	for _, a := range roleActions[r] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// AllProjects is the project of bindings that apply to every project and to
+// resources that belong to no project, such as agents and tokens.
+const AllProjects = "*"
+
+// SubjectKind says whether a binding's subject is a user, a team or a
+// group of an SSO provider.
+type SubjectKind string
+
+const (
+	SubjectUser SubjectKind = "user"
+	SubjectTeam SubjectKind = "team"
+	// SubjectGroup is a group the SSO provider a user signed in through
+	// puts them in, by the name in its groups claim.
+	SubjectGroup SubjectKind = "group"
+)
+
+// Subject is who a role is bound to.
+type Subject struct {
+	Kind SubjectKind `json:"kind" openapi:"required"`
+	Name string      `json:"name" openapi:"required"`
+}
+
+// ParseSubject parses a subject written as "team:<name>" for a team,
+// "group:<name>" for an SSO group, or as "user:<name>" or just "<name>" for
+// a user.
+func ParseSubject(s string) (Subject, error) {
+	kind, name := SubjectUser, s
+	if k, n, ok := strings.Cut(s, ":"); ok {
+		kind, name = SubjectKind(k), n
+	}
+	if !kind.Valid() {
+		return Subject{}, fmt.Errorf("unknown subject kind %q in %q, expected user, team or group", kind, s)
+	}
+	if strings.TrimSpace(name) == "" {
+		return Subject{}, fmt.Errorf("subject %q has no name", s)
+	}
+	return Subject{Kind: kind, Name: name}, nil
+}
+
+// Valid reports whether k is a known subject kind.
+func (k SubjectKind) Valid() bool {
+	return k == SubjectUser || k == SubjectTeam || k == SubjectGroup
+}
+
+// String formats the subject the way ParseSubject reads it.
+func (s Subject) String() string {
+	if s.Kind == SubjectTeam || s.Kind == SubjectGroup {
+		return string(s.Kind) + ":" + s.Name
+	}
+	return s.Name
+}
+
+// RoleBinding grants a role on a project to a user, team or SSO group. Projects are
+// repositories such as "owner/repo", or AllProjects.
+type RoleBinding struct {
+	ID      string  `json:"id"`
+	Subject Subject `json:"subject"`
+	Role    Role    `json:"role"`
+	Project string  `json:"project"`
+	// Organization, if set, limits the binding to the projects of one
+	// organization: AllProjects then means all of them, and the
+	// organization's agents and tokens.
+	Organization string    `json:"organization,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Team is a named group of users that roles can be bound to.
+type Team struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the team.
+func (t *Team) Clone() *Team {
+	c := *t
+	c.Members = append([]string(nil), t.Members...)
+	return &c
+}
+
+// HasMember reports whether user belongs to the team.
+func (t *Team) HasMember(user string) bool {
+	for _, m := range t.Members {
+		if m == user {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRoleBindingRequest is the body of POST /rbac/bindings.
+type CreateRoleBindingRequest struct {
+	Subject Subject `json:"subject" openapi:"required"`
+	Role    Role    `json:"role" openapi:"required"`
+	Project string  `json:"project" openapi:"required"`
+	// Organization limits the binding to the projects of one organization.
+	Organization string `json:"organization,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateRoleBindingRequest) Validate() error {
+	if !r.Subject.Kind.Valid() {
+		return fmt.Errorf("subject kind must be %q, %q or %q", SubjectUser, SubjectTeam, SubjectGroup)
+	}
+	if strings.TrimSpace(r.Subject.Name) == "" {
+		return errors.New("subject name is required")
+	}
+	if !r.Role.Valid() {
+		return fmt.Errorf("unknown role %q, expected viewer, developer or admin", r.Role)
+	}
+	if strings.TrimSpace(r.Project) == "" {
+		return errors.New(`project is required; use "*" for all projects`)
+	}
+	if r.Organization != "" && !organizationNamePattern.MatchString(r.Organization) {
+		return fmt.Errorf("invalid organization name %q", r.Organization)
+	}
+	return nil
+}
+
+// PutTeamRequest is the body of PUT /rbac/teams/{name}.
+type PutTeamRequest struct {
+	Members []string `json:"members"`
+}
+
+// Validate checks that every member is named.
+func (r *PutTeamRequest) Validate() error {
+	for _, m := range r.Members {
+		if strings.TrimSpace(m) == "" {
+			return errors.New("member names must not be empty")
+		}
+	}
+	return nil
+}
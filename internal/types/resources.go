@@ -0,0 +1,94 @@
+package types
+
+import "time"
+
+// ResourceRequests is what a job needs of an agent to be scheduled on it.
+// CPU and Memory are written as in Resources; Disk is free space in the
+// agent's work directory, written like Memory. A job without requests is
+// taken to need its limits.
+type ResourceRequests struct {
+	CPU    string `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Disk   string `json:"disk,omitempty" yaml:"disk,omitempty"`
+}
+
+// Amounts parses the requests. Zero means nothing is requested.
+func (r *ResourceRequests) Amounts() (ResourceAmounts, error) {
+	var a ResourceAmounts
+	if r == nil {
+		return a, nil
+	}
+	var err error
+	if r.CPU != "" {
+		if a.CPUMillis, err = parseCPU("cpu request", r.CPU); err != nil {
+			return ResourceAmounts{}, err
+		}
+	}
+	if r.Memory != "" {
+		if a.MemoryBytes, err = parseMemory("memory request", r.Memory); err != nil {
+			return ResourceAmounts{}, err
+		}
+	}
+	if r.Disk != "" {
+		if a.DiskBytes, err = parseMemory("disk request", r.Disk); err != nil {
+			return ResourceAmounts{}, err
+		}
+	}
+	return a, nil
+}
+
+// ResourceAmounts are amounts of the resources jobs are scheduled by.
+type ResourceAmounts struct {
+	CPUMillis   int64 `json:"cpu_millis"`
+	MemoryBytes int64 `json:"memory_bytes"`
+	DiskBytes   int64 `json:"disk_bytes"`
+}
+
+// Add returns the sum of a and b.
+func (a ResourceAmounts) Add(b ResourceAmounts) ResourceAmounts {
+	return ResourceAmounts{a.CPUMillis + b.CPUMillis, a.MemoryBytes + b.MemoryBytes, a.DiskBytes + b.DiskBytes}
+}
+
+// Sub returns what is left of a once b is taken, never below zero.
+func (a ResourceAmounts) Sub(b ResourceAmounts) ResourceAmounts {
+	return ResourceAmounts{max(a.CPUMillis-b.CPUMillis, 0), max(a.MemoryBytes-b.MemoryBytes, 0), max(a.DiskBytes-b.DiskBytes, 0)}
+}
+
+// Min returns the smaller of a and b in every resource.
+func (a ResourceAmounts) Min(b ResourceAmounts) ResourceAmounts {
+	return ResourceAmounts{min(a.CPUMillis, b.CPUMillis), min(a.MemoryBytes, b.MemoryBytes), min(a.DiskBytes, b.DiskBytes)}
+}
+
+// Covers reports whether a is at least b in every resource.
+func (a ResourceAmounts) Covers(b ResourceAmounts) bool {
+	return a.CPUMillis >= b.CPUMillis && a.MemoryBytes >= b.MemoryBytes && a.DiskBytes >= b.DiskBytes
+}
+
+// AgentResources is what an agent last reported of its machine in a
+// heartbeat: how much it has in all, and how much of that was free.
+type AgentResources struct {
+	Total      ResourceAmounts `json:"total"`
+	Available  ResourceAmounts `json:"available"`
+	ReportedAt time.Time       `json:"reported_at"`
+}
+
+// ResourceRequests returns what the job needs of an agent: its requests,
+// or its limits for those it does not request. Malformed amounts, which
+// validation keeps out, count as nothing.
+func (j *Job) ResourceRequests() ResourceAmounts {
+	requested, err := j.Requests.Amounts()
+	if err != nil {
+		requested = ResourceAmounts{}
+	}
+	cpu, memory, err := j.Resources.Limits()
+	if err != nil {
+		return requested
+	}
+	if requested.CPUMillis == 0 {
+		requested.CPUMillis = cpu
+	}
+	if requested.MemoryBytes == 0 {
+		requested.MemoryBytes = memory
+	}
+	return requested
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+// RetentionPolicy says how much of a project's history garbage collection
+// keeps. Zero limits keep everything; runs still in progress and their
+// jobs are never collected.
+type RetentionPolicy struct {
+	Project string `json:"project"`
+	// KeepRuns is how many of the project's newest finished runs are kept;
+	// older ones are deleted with their jobs, logs, artifacts, test reports
+	// and workspace snapshots.
+	KeepRuns int `json:"keep_runs,omitempty"`
+	// ArtifactRetention is how long after their upload artifacts are kept.
+	ArtifactRetention Duration `json:"artifact_retention,omitempty"`
+	// LogRetention is how long after their job finished logs are kept.
+	LogRetention Duration `json:"log_retention,omitempty"`
+	// CacheQuota is how many bytes the project's caches may take; the least
+	// recently used are evicted beyond it.
+	CacheQuota int64     `json:"cache_quota,omitempty"`
+	UpdatedBy  string    `json:"updated_by,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+}
+
+// PutRetentionPolicyRequest is the body of PUT /projects/{project}/retention.
+type PutRetentionPolicyRequest struct {
+	KeepRuns          int      `json:"keep_runs,omitempty"`
+	ArtifactRetention Duration `json:"artifact_retention,omitempty"`
+	LogRetention      Duration `json:"log_retention,omitempty"`
+	CacheQuota        int64    `json:"cache_quota,omitempty"`
+}
+
+// Validate checks the request for malformed fields.
+func (r *PutRetentionPolicyRequest) Validate() error {
+	switch {
+	case r.KeepRuns < 0:
+		return errors.New("keep_runs must not be negative")
+	case r.ArtifactRetention < 0:
+		return errors.New("artifact_retention must not be negative")
+	case r.LogRetention < 0:
+		return errors.New("log_retention must not be negative")
+	case r.CacheQuota < 0:
+		return errors.New("cache_quota must not be negative")
+	case r.KeepRuns == 0 && r.ArtifactRetention == 0 && r.LogRetention == 0 && r.CacheQuota == 0:
+		return errors.New("at least one of keep_runs, artifact_retention, log_retention and cache_quota is required")
+	}
+	return nil
+}
+
+// GCKind is a kind of record garbage collection deletes.
+type GCKind string
+
+const (
+	GCRun      GCKind = "run"
+	GCJob      GCKind = "job"
+	GCArtifact GCKind = "artifact"
+	GCLog      GCKind = "log"
+	GCSnapshot GCKind = "snapshot"
+	GCCache    GCKind = "cache"
+)
+
+// MaxGCReportItems bounds the items a GCReport lists.
+const MaxGCReportItems = 1000
+
+// GCReport is what a garbage collection of a project deleted, or would
+// delete when it is a dry run.
+type GCReport struct {
+	Project string `json:"project"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+	// Deleted counts the records deleted by kind, those of deleted runs
+	// included.
+	Deleted map[GCKind]int `json:"deleted"`
+	// Reclaimed is the bytes of blob storage freed by kind.
+	Reclaimed      map[GCKind]int64 `json:"reclaimed"`
+	ReclaimedBytes int64            `json:"reclaimed_bytes"`
+	// Items lists the runs, artifacts, logs and caches deleted, at most
+	// MaxGCReportItems of them; Truncated is set when there were more.
+	Items      []GCItem  `json:"items"`
+	Truncated  bool      `json:"truncated,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// GCItem is a record a garbage collection deleted.
+type GCItem struct {
+	Kind GCKind `json:"kind"`
+	// ID is the ID of a run, the job ID and path of an artifact, the job ID
+	// of a log or the key of a cache.
+	ID string `json:"id"`
+	// Bytes is the storage the record and, for runs, everything deleted
+	// with it took.
+	Bytes  int64  `json:"bytes"`
+	Reason string `json:"reason"`
+}
+
+// NewGCReport returns an empty report of a collection of project.
+func NewGCReport(project string, dryRun bool, started time.Time) *GCReport {
+	return &GCReport{
+		Project:   project,
+		DryRun:    dryRun,
+		Deleted:   make(map[GCKind]int),
+		Reclaimed: make(map[GCKind]int64),
+		Items:     []GCItem{},
+		StartedAt: started,
+	}
+}
+
+// Count records n deleted records of kind that took bytes.
+func (r *GCReport) Count(kind GCKind, n int, bytes int64) {
+	r.Deleted[kind] += n
+	if bytes > 0 {
+		r.Reclaimed[kind] += bytes
+		r.ReclaimedBytes += bytes
+	}
+}
+
+// Add lists item, unless the report already lists MaxGCReportItems.
+func (r *GCReport) Add(item GCItem) {
+	if len(r.Items) >= MaxGCReportItems {
+		r.Truncated = true
+		return
+	}
+	r.Items = append(r.Items, item)
+}
@@ -0,0 +1,138 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// MaxRetryAttempts caps RetryPolicy.MaxAttempts.
+	MaxRetryAttempts = 10
+	// maxRetryBackoff caps the delay between attempts when the policy sets
+	// no MaxBackoff.
+	maxRetryBackoff = time.Hour
+)
+
+// RetryPolicy re-runs a job automatically when it fails. Without ExitCodes
+// or Infrastructure every failure is retried; with them, only the failures
+// they describe.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, the first included.
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+	// Backoff is the delay before the second attempt. It doubles with every
+	// further attempt, up to MaxBackoff.
+	Backoff    Duration `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+	MaxBackoff Duration `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+	// ExitCodes retries failures with one of these exit codes.
+	ExitCodes []int `yaml:"exit_codes,omitempty" json:"exit_codes,omitempty"`
+	// Infrastructure retries failures of the environment the job ran in
+	// rather than of its commands, such as an image that cannot be pulled
+	// or a pod that was evicted.
+	Infrastructure bool `yaml:"infrastructure,omitempty" json:"infrastructure,omitempty"`
+}
+
+// Validate checks the policy's bounds.
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 || p.MaxAttempts > MaxRetryAttempts {
+		return fmt.Errorf("retry max_attempts must be between 1 and %d", MaxRetryAttempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("retry backoff must not be negative")
+	}
+	if p.MaxBackoff > 0 && p.MaxBackoff < p.Backoff {
+		return errors.New("retry max_backoff must not be shorter than backoff")
+	}
+	for _, code := range p.ExitCodes {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("retry exit code %d is not between 1 and 255", code)
+		}
+	}
+	return nil
+}
+
+// Retries reports whether a failure with the given exit code, or an
+// infrastructure failure, is retried. It does not consider attempts left.
+func (p *RetryPolicy) Retries(exitCode *int, infrastructure bool) bool {
+	if len(p.ExitCodes) == 0 && !p.Infrastructure {
+		return true
+	}
+	if infrastructure {
+		return p.Infrastructure
+	}
+	return exitCode != nil && slices.Contains(p.ExitCodes, *exitCode)
+}
+
+// Delay returns how long to wait before the given attempt, counting from 1.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	limit := p.MaxBackoff.Std()
+	if limit == 0 {
+		limit = maxRetryBackoff
+	}
+	d := p.Backoff.Std()
+	for i := 2; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// JobAttempt records an attempt of a job that failed and was retried.
+type JobAttempt struct {
+	Attempt        int       `json:"attempt"`
+	AgentID        string    `json:"agent_id,omitempty"`
+	ExitCode       *int      `json:"exit_code,omitempty"`
+	Infrastructure bool      `json:"infrastructure,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	FinishedAt     time.Time `json:"finished_at"`
+}
+
+// retry moves a failing job back to the queue for its next attempt, if its
+// retry policy covers the failure and attempts are left. It reports whether
+// it did.
+func (j *Job) retry(at time.Time, exitCode *int, infrastructure bool, reason string) (bool, error) {
+	p := j.Retry
+	attempt := max(j.Attempt, 1)
+	if p == nil || attempt >= p.MaxAttempts || !p.Retries(exitCode, infrastructure) {
+		return false, nil
+	}
+	if j.State != JobStateAssigned && j.State != JobStateRunning {
+		return false, nil
+	}
+	delay := p.Delay(attempt + 1)
+	why := fmt.Sprintf("retrying as attempt %d of %d in %s", attempt+1, p.MaxAttempts, delay)
+	if reason != "" {
+		why = reason + "; " + why
+	}
+	if err := j.Transition(JobStateQueued, at, why); err != nil {
+		return false, err
+	}
+	record := JobAttempt{Attempt: attempt, AgentID: j.AgentID, Infrastructure: infrastructure, Reason: reason, FinishedAt: at}
+	if exitCode != nil {
+		code := *exitCode
+		record.ExitCode = &code
+	}
+	j.Attempts = append(j.Attempts, record)
+	j.Attempt = attempt + 1
+	j.AgentID = ""
+	j.ExitCode = nil
+	retryAt := at.Add(delay)
+	j.RetryAt = &retryAt
+	return true, nil
+}
+
+// Fail moves the job to failed, unless its retry policy covers the failure
+// and attempts are left, in which case it is queued for its next attempt
+// after the policy's backoff. It reports whether the job was re-queued.
+func (j *Job) Fail(at time.Time, exitCode *int, infrastructure bool, reason string) (bool, error) {
+	retried, err := j.retry(at, exitCode, infrastructure, reason)
+	if err != nil || retried {
+		return retried, err
+	}
+	return false, j.Transition(JobStateFailed, at, reason)
+}
+
+// Waiting reports whether the job is held back at now by a retry backoff.
+func (j *Job) Waiting(now time.Time) bool {
+	return j.RetryAt != nil && now.Before(*j.RetryAt)
+}
@@ -0,0 +1,219 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule runs the pipeline of a repository's ref at the times given by a
+// cron expression.
+type Schedule struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Repository string `json:"repository"`
+	CloneURL   string `json:"clone_url"`
+	// Ref is the fully qualified ref whose pipeline file is run, e.g.
+	// refs/heads/main.
+	Ref  string `json:"ref"`
+	Cron string `json:"cron"`
+	// Timezone is the IANA time zone the cron expression is evaluated in.
+	Timezone string `json:"timezone"`
+	Enabled  bool   `json:"enabled"`
+	// SkipIfActive skips a run while the previous run of the schedule has
+	// not finished.
+	SkipIfActive bool `json:"skip_if_active"`
+	// CatchUp starts a single run for the times missed while the server was
+	// down or the schedule could not run; otherwise they are skipped.
+	CatchUp bool `json:"catch_up"`
+	// NextRunAt is when the schedule next runs; it is unset while the
+	// schedule is disabled.
+	NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt      *time.Time `json:"last_run_at,omitempty"`
+	LastPipelineID string     `json:"last_pipeline_id,omitempty"`
+	// LastError is why the last run did not start a pipeline, if it did not.
+	LastError string    `json:"last_error,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the schedule.
+func (s *Schedule) Clone() *Schedule {
+	c := *s
+	if s.NextRunAt != nil {
+		t := *s.NextRunAt
+		c.NextRunAt = &t
+	}
+	if s.LastRunAt != nil {
+		t := *s.LastRunAt
+		c.LastRunAt = &t
+	}
+	return &c
+}
+
+// Location returns the time zone of the schedule.
+func (s *Schedule) Location() (*time.Location, error) {
+	return LoadTimezone(s.Timezone)
+}
+
+// Next returns the first time after t the schedule runs at, or nil if its
+// expression never matches.
+func (s *Schedule) Next(t time.Time) (*time.Time, error) {
+	cron, err := ParseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := s.Location()
+	if err != nil {
+		return nil, err
+	}
+	next := cron.Next(t.In(loc))
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// LoadTimezone returns the IANA time zone name, UTC when empty.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// QualifyRef returns ref as a fully qualified ref, treating bare names as
+// branches.
+func QualifyRef(ref string) string {
+	if strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return "refs/heads/" + ref
+}
+
+// CreateScheduleRequest is the body of POST /schedules.
+type CreateScheduleRequest struct {
+	Name       string `json:"name" openapi:"required"`
+	Repository string `json:"repository" openapi:"required"`
+	CloneURL   string `json:"clone_url" openapi:"required"`
+	// Ref is a branch name or a fully qualified ref.
+	Ref          string `json:"ref" openapi:"required"`
+	Cron         string `json:"cron" openapi:"required"`
+	Timezone     string `json:"timezone,omitempty"`
+	Enabled      *bool  `json:"enabled,omitempty"`
+	SkipIfActive bool   `json:"skip_if_active,omitempty"`
+	CatchUp      *bool  `json:"catch_up,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *CreateScheduleRequest) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	if strings.TrimSpace(r.Repository) == "" {
+		return errors.New("repository is required")
+	}
+	if strings.TrimSpace(r.CloneURL) == "" {
+		return errors.New("clone_url is required")
+	}
+	if strings.TrimSpace(r.Ref) == "" {
+		return errors.New("ref is required")
+	}
+	return validateTiming(r.Cron, r.Timezone)
+}
+
+// UpdateScheduleRequest is the body of PATCH /schedules/{id}. Only the
+// fields that are set are changed.
+type UpdateScheduleRequest struct {
+	Name         *string `json:"name,omitempty"`
+	CloneURL     *string `json:"clone_url,omitempty"`
+	Ref          *string `json:"ref,omitempty"`
+	Cron         *string `json:"cron,omitempty"`
+	Timezone     *string `json:"timezone,omitempty"`
+	Enabled      *bool   `json:"enabled,omitempty"`
+	SkipIfActive *bool   `json:"skip_if_active,omitempty"`
+	CatchUp      *bool   `json:"catch_up,omitempty"`
+}
+
+// Validate checks the fields that are set.
+func (r *UpdateScheduleRequest) Validate() error {
+	if r.Name != nil && strings.TrimSpace(*r.Name) == "" {
+		return errors.New("name must not be empty")
+	}
+	if r.CloneURL != nil && strings.TrimSpace(*r.CloneURL) == "" {
+		return errors.New("clone_url must not be empty")
+	}
+	if r.Ref != nil && strings.TrimSpace(*r.Ref) == "" {
+		return errors.New("ref must not be empty")
+	}
+	if r.Cron != nil {
+		if err := validateCron(*r.Cron); err != nil {
+			return err
+		}
+	}
+	if r.Timezone != nil {
+		if _, err := LoadTimezone(*r.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply changes the schedule's fields that are set in the request.
+func (r *UpdateScheduleRequest) Apply(s *Schedule) {
+	if r.Name != nil {
+		s.Name = *r.Name
+	}
+	if r.CloneURL != nil {
+		s.CloneURL = *r.CloneURL
+	}
+	if r.Ref != nil {
+		s.Ref = QualifyRef(*r.Ref)
+	}
+	if r.Cron != nil {
+		s.Cron = strings.TrimSpace(*r.Cron)
+	}
+	if r.Timezone != nil {
+		s.Timezone = *r.Timezone
+	}
+	if r.Enabled != nil {
+		s.Enabled = *r.Enabled
+	}
+	if r.SkipIfActive != nil {
+		s.SkipIfActive = *r.SkipIfActive
+	}
+	if r.CatchUp != nil {
+		s.CatchUp = *r.CatchUp
+	}
+}
+
+func validateTiming(cron, timezone string) error {
+	if strings.TrimSpace(cron) == "" {
+		return errors.New("cron is required")
+	}
+	if err := validateCron(cron); err != nil {
+		return err
+	}
+	_, err := LoadTimezone(timezone)
+	return err
+}
+
+// validateCron parses expr and rejects expressions that never match, such
+// as the 30th of February.
+func validateCron(expr string) error {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+	if cron.Next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return nil
+}
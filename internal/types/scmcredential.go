@@ -0,0 +1,150 @@
+package types
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SCMCredentialKind is how a credential authenticates to its provider.
+type SCMCredentialKind string
+
+const (
+	// SCMCredentialToken is an access token, such as a GitHub personal
+	// access token or a GitLab project or group access token. It clones
+	// over HTTPS, posts commit statuses and registers webhooks.
+	SCMCredentialToken SCMCredentialKind = "token"
+	// SCMCredentialDeployKey is the private half of an SSH deploy key. It
+	// only clones, over SSH.
+	SCMCredentialDeployKey SCMCredentialKind = "deploy_key"
+	// SCMCredentialGitHubApp is a GitHub App installation: the server signs
+	// in as the app with its private key and uses the installation tokens
+	// it is given, which last an hour, for everything a token does.
+	SCMCredentialGitHubApp SCMCredentialKind = "github_app"
+)
+
+// maxCredentialBytes bounds the size of a token or private key.
+const maxCredentialBytes = 16 << 10
+
+// SCMCredential is a credential the server reaches an SCM provider with on
+// behalf of the projects of an organization, or of one of them. A
+// project's own credential for a provider takes precedence over its
+// organization's. The token or key itself is never returned by the API.
+type SCMCredential struct {
+	Organization string `json:"organization"`
+	// Project is empty for the credential of the whole organization.
+	Project  string            `json:"project,omitempty"`
+	Provider string            `json:"provider"`
+	Kind     SCMCredentialKind `json:"kind"`
+	// AppID and InstallationID identify the GitHub App installation of
+	// github_app credentials.
+	AppID          int64     `json:"app_id,omitempty"`
+	InstallationID int64     `json:"installation_id,omitempty"`
+	UpdatedBy      string    `json:"updated_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// Sealed is the encrypted token or private key.
+	Sealed SealedValue `json:"-"`
+}
+
+// ValidateSCMProvider checks that provider is one credentials can be kept
+// for.
+func ValidateSCMProvider(provider string) error {
+	switch provider {
+	case "github", "gitlab":
+		return nil
+	}
+	return fmt.Errorf("unknown provider %q, expected github or gitlab", provider)
+}
+
+// PutSCMCredentialRequest is the body of PUT
+// /orgs/{name}/scm-credentials/{provider} and
+// /projects/{project}/scm-credentials/{provider}.
+type PutSCMCredentialRequest struct {
+	Kind SCMCredentialKind `json:"kind" openapi:"required"`
+	// Token is the access token of token credentials.
+	Token string `json:"token,omitempty"`
+	// PrivateKey is the PEM encoded private key of deploy_key credentials,
+	// in OpenSSH or PEM form, and of github_app ones, as GitHub generates
+	// it.
+	PrivateKey     string `json:"private_key,omitempty"`
+	AppID          int64  `json:"app_id,omitempty"`
+	InstallationID int64  `json:"installation_id,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields, for a
+// credential of provider.
+func (r *PutSCMCredentialRequest) Validate(provider string) error {
+	if err := ValidateSCMProvider(provider); err != nil {
+		return err
+	}
+	if len(r.Token) > maxCredentialBytes || len(r.PrivateKey) > maxCredentialBytes {
+		return fmt.Errorf("token and private_key must be at most %d bytes", maxCredentialBytes)
+	}
+	switch r.Kind {
+	case SCMCredentialToken:
+		if strings.TrimSpace(r.Token) == "" {
+			return errors.New("token is required")
+		}
+		if r.PrivateKey != "" || r.AppID != 0 || r.InstallationID != 0 {
+			return errors.New("token credentials take only a token")
+		}
+	case SCMCredentialDeployKey:
+		if r.Token != "" || r.AppID != 0 || r.InstallationID != 0 {
+			return errors.New("deploy_key credentials take only a private_key")
+		}
+		if !strings.Contains(r.PrivateKey, "PRIVATE KEY-----") {
+			return errors.New("private_key must be a PEM encoded SSH private key")
+		}
+	case SCMCredentialGitHubApp:
+		if provider != "github" {
+			return fmt.Errorf("github_app credentials are for github, not %s", provider)
+		}
+		if r.Token != "" {
+			return errors.New("github_app credentials take no token")
+		}
+		if r.AppID <= 0 || r.InstallationID <= 0 {
+			return errors.New("app_id and installation_id are required")
+		}
+		if _, err := ParseRSAPrivateKey(r.PrivateKey); err != nil {
+			return fmt.Errorf("private_key: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, expected %s, %s or %s", r.Kind, SCMCredentialToken, SCMCredentialDeployKey, SCMCredentialGitHubApp)
+	}
+	return nil
+}
+
+// Secret returns the value of the request that is stored encrypted: the
+// token or the private key.
+func (r *PutSCMCredentialRequest) Secret() string {
+	if r.Kind == SCMCredentialToken {
+		return strings.TrimSpace(r.Token)
+	}
+	return r.PrivateKey
+}
+
+// ParseRSAPrivateKey parses a PEM encoded RSA private key, in PKCS #1 or
+// PKCS #8 form.
+func ParseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("holds no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("holds no RSA private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("holds a %T, not an RSA private key", parsed)
+	}
+	return key, nil
+}
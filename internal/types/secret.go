@@ -0,0 +1,102 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// secretNamePattern matches names that are valid environment variables,
+// since secrets are injected into jobs under their names.
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// maxSecretBytes bounds the size of a secret value.
+const maxSecretBytes = 64 << 10
+
+// Secret is a named value stored encrypted for a project. The value itself
+// is never returned by the API.
+type Secret struct {
+	Project   string    `json:"project"`
+	Name      string    `json:"name"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Sealed is the encrypted value.
+	Sealed SealedValue `json:"-"`
+}
+
+// SealedValue is a value encrypted with envelope encryption: Ciphertext is
+// sealed with a random data key, and WrappedKey is that data key sealed
+// with the master key KeyID.
+type SealedValue struct {
+	KeyID      string
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+// ValidateSecretName checks that name can be used as an environment
+// variable.
+func ValidateSecretName(name string) error {
+	if !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("secret name %q must start with a letter or underscore and contain only letters, digits and underscores", name)
+	}
+	return nil
+}
+
+// vaultPrefix starts the reference of a secret read from HashiCorp Vault.
+const vaultPrefix = "vault:"
+
+// SecretRef is an entry of the secrets a job declares: either the name of a
+// project secret, or NAME=vault:<path>#<key>, which injects the key of the
+// Vault secret at path under NAME.
+type SecretRef struct {
+	Name string
+	// VaultPath and VaultKey locate the value in Vault, for references to
+	// it.
+	VaultPath string
+	VaultKey  string
+}
+
+// Vault reports whether the value is read from Vault.
+func (r SecretRef) Vault() bool {
+	return r.VaultPath != ""
+}
+
+// ParseSecretRef parses an entry of the secrets a job declares.
+func ParseSecretRef(entry string) (SecretRef, error) {
+	name, ref, isRef := strings.Cut(entry, "=")
+	if err := ValidateSecretName(name); err != nil {
+		return SecretRef{}, err
+	}
+	if !isRef {
+		return SecretRef{Name: name}, nil
+	}
+	location, ok := strings.CutPrefix(ref, vaultPrefix)
+	if !ok {
+		return SecretRef{}, fmt.Errorf("secret %s: reference %q must start with %s", name, ref, vaultPrefix)
+	}
+	path, key, ok := strings.Cut(location, "#")
+	path = strings.Trim(path, "/")
+	if !ok || path == "" || key == "" {
+		return SecretRef{}, fmt.Errorf("secret %s: Vault reference %q must be vault:<path>#<key>", name, ref)
+	}
+	return SecretRef{Name: name, VaultPath: path, VaultKey: key}, nil
+}
+
+// PutSecretRequest is the body of PUT /secrets/{name}.
+type PutSecretRequest struct {
+	Value string `json:"value" openapi:"required"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *PutSecretRequest) Validate() error {
+	if r.Value == "" {
+		return errors.New("value is required")
+	}
+	if len(r.Value) > maxSecretBytes {
+		return fmt.Errorf("value must be at most %d bytes", maxSecretBytes)
+	}
+	return nil
+}
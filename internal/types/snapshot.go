@@ -0,0 +1,56 @@
+package types
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// WorkspaceSnapshot is the archive of the outputs a job left in its
+// workspace, taken by its agent when the job succeeded and restored into the
+// workspaces of the jobs of downstream stages. The contents, a gzipped tar
+// of the output paths, live in a blob store.
+type WorkspaceSnapshot struct {
+	JobID string `json:"job_id"`
+	// Project is the repository of the job, which decides the retention.
+	Project    string `json:"project,omitempty"`
+	PipelineID string `json:"pipeline_id,omitempty"`
+	Stage      string `json:"stage,omitempty"`
+	// Paths are the outputs of the job, relative to its workspace.
+	Paths     []string  `json:"paths"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the snapshot is deleted; nil keeps it forever.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Clone returns a deep copy of the snapshot.
+func (s *WorkspaceSnapshot) Clone() *WorkspaceSnapshot {
+	c := *s
+	c.Paths = append([]string(nil), s.Paths...)
+	if s.ExpiresAt != nil {
+		t := *s.ExpiresAt
+		c.ExpiresAt = &t
+	}
+	return &c
+}
+
+// ValidateOutputPath checks that p is a clean relative path such as "bin" or
+// "dist/app.tar.gz" that stays within the workspace.
+func ValidateOutputPath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("output path is required")
+	case strings.HasPrefix(p, "/"):
+		return errors.New("output path must be relative to the workspace")
+	case path.Clean(p) != p:
+		return errors.New("output path must be clean")
+	case p == "." || p == ".." || strings.HasPrefix(p, "../"):
+		return errors.New("output path must name something within the workspace")
+	case strings.ContainsAny(p, "\\\x00"):
+		return errors.New("output path contains invalid characters")
+	}
+	return nil
+}
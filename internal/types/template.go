@@ -0,0 +1,70 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/version"
+)
+
+// maxTemplateBytes bounds the size of a published template file.
+const maxTemplateBytes = 256 << 10
+
+// Template is a published version of a template file: a library of steps,
+// such as lint, test or build image, that pipeline definitions include by
+// name and version and extend. Published versions never change; fixing a
+// template means publishing a new version.
+type Template struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	// Source is the template file as published.
+	Source      string    `json:"source"`
+	PublishedBy string    `json:"published_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Clone returns a copy of the template.
+func (t *Template) Clone() *Template {
+	c := *t
+	return &c
+}
+
+// PublishTemplateRequest is the body of POST /templates. The template's
+// name and description are read from its source.
+type PublishTemplateRequest struct {
+	// Version is a MAJOR.MINOR.PATCH version, such as 1.2.0.
+	Version string `json:"version"`
+	Source  string `json:"source"`
+}
+
+// Validate checks the request for missing or malformed fields. The source
+// itself is checked when it is parsed.
+func (r *PublishTemplateRequest) Validate() error {
+	switch {
+	case r.Version == "":
+		return errors.New("version is required")
+	case r.Source == "":
+		return errors.New("source is required")
+	case len(r.Source) > maxTemplateBytes:
+		return fmt.Errorf("source must be at most %d bytes", maxTemplateBytes)
+	}
+	if _, err := version.Parse(r.Version); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResolveTemplatesRequest is the body of POST /templates/resolve.
+type ResolveTemplatesRequest struct {
+	Definition string `json:"definition"`
+}
+
+// ResolveTemplatesResponse is a pipeline definition with its templates
+// expanded, as it would run.
+type ResolveTemplatesResponse struct {
+	Definition string `json:"definition"`
+	// Includes lists the templates the definition included.
+	Includes []string `json:"includes,omitempty"`
+}
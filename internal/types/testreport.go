@@ -0,0 +1,146 @@
+package types
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// TestReportFormat is the format of a test report artifact.
+type TestReportFormat string
+
+const (
+	// TestReportJUnit is JUnit XML, written by most test runners.
+	TestReportJUnit TestReportFormat = "junit"
+	// TestReportGoTest is the output of go test -json.
+	TestReportGoTest TestReportFormat = "go-test-json"
+)
+
+// ParseTestReportFormat checks that s names a test report format.
+func ParseTestReportFormat(s string) (TestReportFormat, error) {
+	switch f := TestReportFormat(s); f {
+	case TestReportJUnit, TestReportGoTest:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown test report format %q, expected junit or go-test-json", s)
+}
+
+// TestStatus is the outcome of a test case.
+type TestStatus string
+
+const (
+	TestPassed  TestStatus = "passed"
+	TestFailed  TestStatus = "failed"
+	TestSkipped TestStatus = "skipped"
+)
+
+// TestCase is the result of one test.
+type TestCase struct {
+	Name string `json:"name"`
+	// Classname is the class or package the test belongs to, if the report
+	// says.
+	Classname string     `json:"classname,omitempty"`
+	Status    TestStatus `json:"status"`
+	Duration  Duration   `json:"duration"`
+	// Message is why the test failed or was skipped, and Output what it
+	// printed, cut to the last few kilobytes.
+	Message string `json:"message,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// TestSummary counts the outcomes of a set of tests.
+type TestSummary struct {
+	Total    int      `json:"total"`
+	Passed   int      `json:"passed"`
+	Failed   int      `json:"failed"`
+	Skipped  int      `json:"skipped"`
+	Duration Duration `json:"duration"`
+}
+
+// Add counts the outcomes of other into s.
+func (s *TestSummary) Add(other TestSummary) {
+	s.Total += other.Total
+	s.Passed += other.Passed
+	s.Failed += other.Failed
+	s.Skipped += other.Skipped
+	s.Duration += other.Duration
+}
+
+// TestSuite is a group of test cases, such as a JUnit testsuite or a Go
+// package.
+type TestSuite struct {
+	Name    string      `json:"name"`
+	Summary TestSummary `json:"summary"`
+	Cases   []TestCase  `json:"cases"`
+}
+
+// Summarize counts the suite's cases into its summary. The duration is
+// kept if the report gave one for the whole suite.
+func (s *TestSuite) Summarize() {
+	duration := s.Summary.Duration
+	s.Summary = TestSummary{Total: len(s.Cases)}
+	var sum Duration
+	for _, c := range s.Cases {
+		switch c.Status {
+		case TestPassed:
+			s.Summary.Passed++
+		case TestFailed:
+			s.Summary.Failed++
+		case TestSkipped:
+			s.Summary.Skipped++
+		}
+		sum += c.Duration
+	}
+	s.Summary.Duration = duration
+	if duration == 0 {
+		s.Summary.Duration = sum
+	}
+}
+
+// TestReport is the parsed contents of a test report artifact. It is kept
+// after the artifact itself expires, so that results can be compared over
+// time.
+type TestReport struct {
+	JobID string `json:"job_id"`
+	// Path is the path of the artifact the report was parsed from.
+	Path       string           `json:"path"`
+	Project    string           `json:"project"`
+	PipelineID string           `json:"pipeline_id,omitempty"`
+	Ref        string           `json:"ref,omitempty"`
+	Format     TestReportFormat `json:"format"`
+	Summary    TestSummary      `json:"summary"`
+	Suites     []TestSuite      `json:"suites"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// Clone returns a deep copy of the report.
+func (r *TestReport) Clone() *TestReport {
+	c := *r
+	c.Suites = make([]TestSuite, len(r.Suites))
+	for i, s := range r.Suites {
+		s.Cases = slices.Clone(s.Cases)
+		c.Suites[i] = s
+	}
+	return &c
+}
+
+// FailedOnly drops the cases that did not fail, and the suites left
+// without any. Summaries still count every case.
+func (r *TestReport) FailedOnly() {
+	suites := r.Suites[:0]
+	for _, s := range r.Suites {
+		s.Cases = slices.DeleteFunc(s.Cases, func(c TestCase) bool { return c.Status != TestFailed })
+		if len(s.Cases) > 0 {
+			suites = append(suites, s)
+		}
+	}
+	r.Suites = suites
+}
+
+// JobTests is the body of GET /jobs/{id}/tests: the results of every test
+// report a job uploaded.
+type JobTests struct {
+	JobID   string        `json:"job_id"`
+	Summary TestSummary   `json:"summary"`
+	Reports []*TestReport `json:"reports"`
+}
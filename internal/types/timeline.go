@@ -0,0 +1,177 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// PipelineTimeline is when a pipeline run, each of its stages and each of
+// their jobs waited, started and finished. Times are unset until reached.
+type PipelineTimeline struct {
+	PipelineID string        `json:"pipeline_id"`
+	State      PipelineState `json:"state"`
+	CreatedAt  time.Time     `json:"created_at"`
+	// StartedAt is when the first job of the run started, FinishedAt when
+	// the run reached its final state.
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// QueueTime is how long the run waited for its first job to start and
+	// Duration how long it took from its creation to its end.
+	QueueTime Duration        `json:"queue_time"`
+	Duration  Duration        `json:"duration"`
+	Stages    []StageTimeline `json:"stages"`
+}
+
+// StageTimeline is the timeline of a stage of a run: from its first job
+// being queued to its last job finishing.
+type StageTimeline struct {
+	Stage      string        `json:"stage"`
+	State      StageState    `json:"state"`
+	QueuedAt   *time.Time    `json:"queued_at,omitempty"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	QueueTime  Duration      `json:"queue_time"`
+	Duration   Duration      `json:"duration"`
+	Jobs       []JobTimeline `json:"jobs"`
+}
+
+// JobTimeline is the timeline of a job. QueueTime counts every stretch the
+// job spent queued or assigned, including after being requeued; Duration
+// runs from its first start to its end.
+type JobTimeline struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	State      JobState   `json:"state"`
+	QueuedAt   *time.Time `json:"queued_at,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	QueueTime  Duration   `json:"queue_time"`
+	Duration   Duration   `json:"duration"`
+	// ReusedFrom is the earlier run the job ran in, if the run re-uses its
+	// result instead of running it again.
+	ReusedFrom string `json:"reused_from,omitempty"`
+}
+
+// AnalyticsInterval is the width of the buckets of pipeline analytics.
+type AnalyticsInterval string
+
+const (
+	IntervalHour AnalyticsInterval = "hour"
+	IntervalDay  AnalyticsInterval = "day"
+	IntervalWeek AnalyticsInterval = "week"
+)
+
+// ParseAnalyticsInterval parses an interval, where empty means IntervalDay.
+func ParseAnalyticsInterval(s string) (AnalyticsInterval, error) {
+	switch i := AnalyticsInterval(s); i {
+	case "":
+		return IntervalDay, nil
+	case IntervalHour, IntervalDay, IntervalWeek:
+		return i, nil
+	}
+	return "", fmt.Errorf("interval must be %s, %s or %s", IntervalHour, IntervalDay, IntervalWeek)
+}
+
+// Truncate returns the start of the bucket t falls in, in UTC. Weeks start
+// on Monday.
+func (i AnalyticsInterval) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	switch i {
+	case IntervalHour:
+		return t.Truncate(time.Hour)
+	case IntervalWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// PipelineAnalytics summarizes the durations of the runs that finished,
+// created between Since and Until, per pipeline and per interval.
+type PipelineAnalytics struct {
+	Since     time.Time         `json:"since"`
+	Until     time.Time         `json:"until"`
+	Interval  AnalyticsInterval `json:"interval"`
+	Pipelines []PipelineStats   `json:"pipelines"`
+}
+
+// PipelineStats are the statistics of the runs of one pipeline, named by its
+// project and name, over the whole range and per bucket, oldest first.
+// Buckets without runs are left out.
+type PipelineStats struct {
+	Repository string `json:"repository,omitempty"`
+	Name       string `json:"name"`
+	RunStats
+	Buckets []PipelineBucket `json:"buckets"`
+}
+
+// PipelineBucket holds the statistics of the runs created within one
+// interval starting at Start.
+type PipelineBucket struct {
+	Start time.Time `json:"start"`
+	RunStats
+}
+
+// RunStats counts finished runs and gives percentiles of their durations,
+// from creation to end.
+type RunStats struct {
+	Runs      int      `json:"runs"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Cancelled int      `json:"cancelled"`
+	P50       Duration `json:"p50_duration"`
+	P95       Duration `json:"p95_duration"`
+}
+
+// PipelineComparison is how a run, Head, differs from an earlier one, Base,
+// typically of the same pipeline: which jobs either has alone, how much
+// longer or shorter each job both have took, and which variables differ.
+// Deltas are head minus base, negative when head was faster.
+type PipelineComparison struct {
+	Base           ComparedRun `json:"base"`
+	Head           ComparedRun `json:"head"`
+	DurationDelta  Duration    `json:"duration_delta"`
+	QueueTimeDelta Duration    `json:"queue_time_delta"`
+	// Added are the names of the jobs only head has, Removed those only
+	// base has.
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Jobs compares the jobs both runs have, by name, those that slowed
+	// down the most first.
+	Jobs      []JobComparison  `json:"jobs"`
+	Variables []VariableChange `json:"variables"`
+}
+
+// ComparedRun is a run of a comparison.
+type ComparedRun struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Ref       string        `json:"ref,omitempty"`
+	Commit    string        `json:"commit,omitempty"`
+	State     PipelineState `json:"state"`
+	CreatedAt time.Time     `json:"created_at"`
+	QueueTime Duration      `json:"queue_time"`
+	Duration  Duration      `json:"duration"`
+}
+
+// JobComparison compares the job of the same name in both runs.
+type JobComparison struct {
+	Name           string   `json:"name"`
+	Stage          string   `json:"stage"`
+	BaseState      JobState `json:"base_state"`
+	HeadState      JobState `json:"head_state"`
+	BaseDuration   Duration `json:"base_duration"`
+	HeadDuration   Duration `json:"head_duration"`
+	DurationDelta  Duration `json:"duration_delta"`
+	QueueTimeDelta Duration `json:"queue_time_delta"`
+}
+
+// VariableChange is a variable set differently in the two runs: an input
+// of the run, or, if Job is set, a variable in the environment of a job
+// both runs have. Base or Head is null where the variable is unset.
+type VariableChange struct {
+	Job  string  `json:"job,omitempty"`
+	Name string  `json:"name"`
+	Base *string `json:"base"`
+	Head *string `json:"head"`
+}
@@ -0,0 +1,89 @@
+package types
+
+import "time"
+
+// Scope is the level of access an API token grants. Each scope includes
+// everything the scopes below it allow.
+type Scope string
+
+const (
+	// ScopeReadOnly allows reading agents, jobs, pipelines and logs.
+	ScopeReadOnly Scope = "read-only"
+	// ScopeSubmitJobs additionally allows submitting, updating and
+	// cancelling jobs and pipelines.
+	ScopeSubmitJobs Scope = "submit-jobs"
+	// ScopeAdmin allows everything, including managing agents and tokens.
+	ScopeAdmin Scope = "admin"
+)
+
+// scopeLevels orders scopes from least to most privileged.
+var scopeLevels = map[Scope]int{
+	ScopeReadOnly:   1,
+	ScopeSubmitJobs: 2,
+	ScopeAdmin:      3,
+}
+
+// Valid reports whether s is a known scope.
+func (s Scope) Valid() bool {
+	_, ok := scopeLevels[s]
+	return ok
+}
+
+// Allows reports whether a token with scope s may perform an action that
+// requires scope required.
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && scopeLevels[s] >= scopeLevels[required]
+}
+
+// APIToken is a bearer token for the HTTP API. Only a hash of the secret is
+// stored; the secret itself is shown once when the token is created.
+type APIToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// User is who the token acts as; role bindings decide what that user
+	// may do, within the limits of Scope.
+	User  string `json:"user,omitempty"`
+	Scope Scope  `json:"scope"`
+	// Organization, if set, confines the token to one organization: it can
+	// reach nothing outside it, whatever its user's role bindings grant.
+	Organization string `json:"organization,omitempty"`
+	// Provider is the SSO provider a session token was signed in through,
+	// and Groups the groups the provider put its user in, which role
+	// bindings to group:<name> apply to. Both are empty for tokens created
+	// through the API.
+	Provider string   `json:"provider,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Hash     string   `json:"-"`
+	// ExpiresAt is when the token stops being accepted; nil never.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token is no longer accepted at now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// SSOProvider is an identity provider users can sign in with, as listed by
+// GET /auth/sso.
+type SSOProvider struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	// Kind is SSOKindOIDC or SSOKindLDAP.
+	Kind SSOKind `json:"kind"`
+	// LoginURL is where a browser starts signing in to an OpenID Connect
+	// provider, and where the username and password of a directory are
+	// posted.
+	LoginURL string `json:"login_url"`
+}
+
+// SSOKind is how signing in through a provider works.
+type SSOKind string
+
+const (
+	// SSOKindOIDC providers sign people in in the browser and redirect
+	// back.
+	SSOKindOIDC SSOKind = "oidc"
+	// SSOKindLDAP directories check a username and password.
+	SSOKindLDAP SSOKind = "ldap"
+)
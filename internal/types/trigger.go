@@ -0,0 +1,79 @@
+package types
+
+// TriggerEvent is the kind of SCM event that started a pipeline run.
+type TriggerEvent string
+
+const (
+	TriggerEventPush        TriggerEvent = "push"
+	TriggerEventTag         TriggerEvent = "tag"
+	TriggerEventPullRequest TriggerEvent = "pull_request"
+	TriggerEventManual      TriggerEvent = "manual"
+	TriggerEventSchedule    TriggerEvent = "schedule"
+	// TriggerEventPipeline is a run started by a trigger step of another
+	// pipeline.
+	TriggerEventPipeline TriggerEvent = "pipeline"
+)
+
+// TriggerTrust classifies the code a pipeline run is started for by who
+// could have written it.
+type TriggerTrust string
+
+const (
+	// TriggerTrusted code was pushed to the repository, or to a branch of
+	// it a pull request comes from, by someone who may write to it.
+	TriggerTrusted TriggerTrust = "trusted"
+	// TriggerFork code comes from a pull request from a fork, which anyone
+	// may open. Its runs are restricted and wait for a maintainer to
+	// authorize them.
+	TriggerFork TriggerTrust = "fork"
+)
+
+// Trigger describes what caused a pipeline run. Webhook payloads from every
+// SCM provider are normalised into this form.
+type Trigger struct {
+	Provider   string       `json:"provider,omitempty"`
+	Event      TriggerEvent `json:"event"`
+	Repository string       `json:"repository,omitempty"`
+	CloneURL   string       `json:"clone_url,omitempty"`
+	// Ref is the fully qualified ref to fetch, e.g. refs/heads/main or
+	// refs/pull/42/head.
+	Ref    string `json:"ref,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	// Tag is the tag pushed, for tag events.
+	Tag    string `json:"tag,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Before is the commit a pushed branch pointed to before the push, if
+	// it existed, from which ChangedFiles can be worked out when the
+	// provider does not list them.
+	Before      string `json:"before,omitempty"`
+	PullRequest int    `json:"pull_request,omitempty"`
+	// HeadRepository is the repository the changes of a pull request come
+	// from, and Fork is set when that is another repository than
+	// Repository, or one that no longer exists; see Trust. Runs that
+	// restricted runs trigger are marked Fork too.
+	HeadRepository string `json:"head_repository,omitempty"`
+	Fork           bool   `json:"fork,omitempty"`
+	Actor          string `json:"actor,omitempty"`
+	// ChangedFiles are the paths a push added, modified or removed, when
+	// the provider reports them or they were diffed from Before.
+	ChangedFiles []string `json:"changed_files,omitempty"`
+	// Schedule is the ID of the schedule that started a scheduled run.
+	Schedule string `json:"schedule,omitempty"`
+	// Delivery is the ID of the webhook delivery that started the run.
+	Delivery string `json:"delivery,omitempty"`
+	// Parent is the run, and its trigger step's job, that started a
+	// downstream run.
+	Parent *PipelineLink `json:"parent,omitempty"`
+	// Inputs are the values the run's ${{ inputs.NAME }} expressions
+	// resolve to.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+// Trust classifies the code t started a run for. Runs without a trigger
+// were submitted through the API and are trusted.
+func (t *Trigger) Trust() TriggerTrust {
+	if t != nil && t.Fork {
+		return TriggerFork
+	}
+	return TriggerTrusted
+}
@@ -0,0 +1,163 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxVariableBytes bounds the size of a variable value.
+const maxVariableBytes = 64 << 10
+
+// Variable is a plain environment variable given to the jobs of a project,
+// or of every project if it is global. Unlike secrets, values are stored
+// and returned as they are, and jobs get them without declaring them.
+//
+// Variables are merged into a job's environment when it is dispatched,
+// from the lowest precedence to the highest: global variables, then the
+// project's variables, then the environment the job's definition sets, then
+// the secrets it declares. A later value replaces an earlier one of the same
+// name.
+type Variable struct {
+	// Project is the project the variable belongs to, empty for a global
+	// variable.
+	Project string `json:"project,omitempty"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	// Branches, if any, limits the variable to jobs on branches matching
+	// one of these patterns, in which * matches any run of characters but
+	// /, as in release/*.
+	Branches []string `json:"branches,omitempty"`
+	// Protected limits the variable to jobs on the protected branches of
+	// their project.
+	Protected bool      `json:"protected,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the variable.
+func (v *Variable) Clone() *Variable {
+	c := *v
+	c.Branches = append([]string(nil), v.Branches...)
+	return &c
+}
+
+// Applies reports whether the variable is given to jobs on branch, which is
+// empty for refs other than branches, such as tags. protected says whether
+// the branch is protected in the job's project.
+func (v *Variable) Applies(branch string, protected bool) bool {
+	if v.Protected && !protected {
+		return false
+	}
+	return len(v.Branches) == 0 || (branch != "" && MatchBranch(v.Branches, branch))
+}
+
+// ValidateVariableName checks that name can be used as an environment
+// variable.
+func ValidateVariableName(name string) error {
+	if !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("variable name %q must start with a letter or underscore and contain only letters, digits and underscores", name)
+	}
+	return nil
+}
+
+// PutVariableRequest is the body of PUT /variables/{name} and
+// PUT /projects/{project}/variables/{name}.
+type PutVariableRequest struct {
+	Value     string   `json:"value"`
+	Branches  []string `json:"branches,omitempty"`
+	Protected bool     `json:"protected,omitempty"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *PutVariableRequest) Validate() error {
+	if len(r.Value) > maxVariableBytes {
+		return fmt.Errorf("value must be at most %d bytes", maxVariableBytes)
+	}
+	return validateBranchPatterns("branches", r.Branches)
+}
+
+// ResolvedVariables lists the variables given to the jobs of a project on a
+// ref, as returned by GET /projects/{project}/variables/resolved.
+type ResolvedVariables struct {
+	Project string `json:"project"`
+	Ref     string `json:"ref"`
+	// Branch is the branch of Ref, empty if Ref is not a branch, and
+	// Protected whether the project protects it.
+	Branch    string `json:"branch,omitempty"`
+	Protected bool   `json:"protected"`
+	// Variables are in the order they are merged, lowest precedence first.
+	Variables []ResolvedVariable `json:"variables"`
+}
+
+// ResolvedVariable is a variable that applies to a ref.
+type ResolvedVariable struct {
+	Variable
+	// Overridden is set when a variable later in the list has the same
+	// name, so the job gets that one's value instead.
+	Overridden bool `json:"overridden,omitempty"`
+}
+
+// ProtectedBranches are the branches of a project that protected variables
+// are given to, typically those only trusted people can push to.
+type ProtectedBranches struct {
+	Project string `json:"project"`
+	// Patterns match branch names as in Variable.Branches.
+	Patterns  []string  `json:"patterns"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// Protects reports whether branch is protected. Refs other than branches
+// never are.
+func (p *ProtectedBranches) Protects(branch string) bool {
+	return branch != "" && MatchBranch(p.Patterns, branch)
+}
+
+// PutProtectedBranchesRequest is the body of
+// PUT /projects/{project}/protected-branches.
+type PutProtectedBranchesRequest struct {
+	Patterns []string `json:"patterns" openapi:"required"`
+}
+
+// Validate checks the request for missing or malformed fields.
+func (r *PutProtectedBranchesRequest) Validate() error {
+	return validateBranchPatterns("patterns", r.Patterns)
+}
+
+// RefBranch returns the branch name of ref: refs/heads/main and main are
+// both on branch main, while other qualified refs, such as tags, are on
+// none.
+func RefBranch(ref string) string {
+	if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		return branch
+	}
+	if strings.HasPrefix(ref, "refs/") {
+		return ""
+	}
+	return ref
+}
+
+// MatchBranch reports whether branch matches one of patterns.
+func MatchBranch(patterns []string, branch string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBranchPatterns(field string, patterns []string) error {
+	for i, p := range patterns {
+		if strings.TrimSpace(p) == "" {
+			return fmt.Errorf("%s[%d]: pattern is empty", field, i)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s[%d]: invalid pattern %q", field, i, p)
+		}
+	}
+	return nil
+}
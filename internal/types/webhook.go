@@ -0,0 +1,89 @@
+package types
+
+import "time"
+
+// DeliveryStatus is the outcome of processing a webhook delivery.
+type DeliveryStatus string
+
+const (
+	// DeliveryTriggered means the delivery started at least one run.
+	DeliveryTriggered DeliveryStatus = "triggered"
+	// DeliveryIgnored means the event does not start runs, such as a
+	// deleted branch or a commit without a pipeline file.
+	DeliveryIgnored DeliveryStatus = "ignored"
+	// DeliveryRejected means the delivery can never start a run as it is,
+	// such as a malformed payload or an invalid pipeline file.
+	DeliveryRejected DeliveryStatus = "rejected"
+	// DeliveryFailed means processing failed for a reason that may pass,
+	// such as the repository being unreachable or a quota being used up.
+	// Failed deliveries are the ones worth redelivering.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Valid reports whether s is a known delivery status.
+func (s DeliveryStatus) Valid() bool {
+	switch s {
+	case DeliveryTriggered, DeliveryIgnored, DeliveryRejected, DeliveryFailed:
+		return true
+	}
+	return false
+}
+
+// WebhookDelivery is a verified webhook delivery from an SCM provider, kept
+// so that it can be inspected and processed again.
+type WebhookDelivery struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	// Event is the provider's event header, such as push for GitHub or
+	// Push Hook for GitLab, and DeliveryID the provider's ID of the
+	// delivery, if it sends one.
+	Event      string `json:"event"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Repository string `json:"repository"`
+	// Payload is the body of the delivery; it is left out of lists.
+	Payload string `json:"payload,omitempty"`
+	// Status, StatusCode, Message and PipelineIDs are those of the latest
+	// attempt.
+	Status      DeliveryStatus `json:"status"`
+	StatusCode  int            `json:"status_code"`
+	Message     string         `json:"message,omitempty"`
+	PipelineIDs []string       `json:"pipeline_ids,omitempty"`
+	// Attempts lists every time the delivery was processed, the first when
+	// it was received and the others when it was redelivered.
+	Attempts   []DeliveryAttempt `json:"attempts"`
+	ReceivedAt time.Time         `json:"received_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// DeliveryAttempt is one processing of a webhook delivery.
+type DeliveryAttempt struct {
+	Status     DeliveryStatus `json:"status"`
+	StatusCode int            `json:"status_code"`
+	Message    string         `json:"message,omitempty"`
+	// PipelineIDs are the runs the attempt started.
+	PipelineIDs []string `json:"pipeline_ids,omitempty"`
+	// By is who asked for a redelivery; it is empty for the attempt made
+	// on receipt.
+	By string    `json:"by,omitempty"`
+	At time.Time `json:"at"`
+}
+
+// Record appends the attempt and makes it the delivery's latest outcome.
+func (d *WebhookDelivery) Record(a DeliveryAttempt) {
+	d.Attempts = append(d.Attempts, a)
+	d.Status, d.StatusCode, d.Message = a.Status, a.StatusCode, a.Message
+	d.PipelineIDs = append([]string(nil), a.PipelineIDs...)
+	d.UpdatedAt = a.At
+}
+
+// Clone returns a deep copy of the delivery.
+func (d *WebhookDelivery) Clone() *WebhookDelivery {
+	c := *d
+	c.PipelineIDs = append([]string(nil), d.PipelineIDs...)
+	c.Attempts = make([]DeliveryAttempt, len(d.Attempts))
+	for i, a := range d.Attempts {
+		a.PipelineIDs = append([]string(nil), a.PipelineIDs...)
+		c.Attempts[i] = a
+	}
+	return &c
+}
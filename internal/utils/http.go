@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"open-cicd/internal/types"
+)
+
+// MaxBodyBytes caps the size of JSON request bodies accepted by the API.
+const MaxBodyBytes = 1 << 20
+
+// WriteJSON writes v as a JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// requestIDHeader is the response header middleware.RequestID sets before
+// handlers run; error bodies repeat it.
+const requestIDHeader = "X-Request-ID"
+
+// WriteError writes a JSON error body with the given status code and the
+// generic error code of that status.
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	WriteErrorDetails(w, status, types.StatusErrorCode(status), msg, nil)
+}
+
+// WriteErrorCode writes a JSON error body with the given status and error
+// code.
+func WriteErrorCode(w http.ResponseWriter, status int, code types.ErrorCode, msg string) {
+	WriteErrorDetails(w, status, code, msg, nil)
+}
+
+// WriteErrorDetails writes a JSON error body with the given status, error
+// code and details, such as the list of problems found in a request body.
+func WriteErrorDetails(w http.ResponseWriter, status int, code types.ErrorCode, msg string, details any) {
+	WriteJSON(w, status, types.ErrorResponse{
+		Code:      code,
+		Message:   msg,
+		Details:   details,
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// DecodeJSON reads a JSON request body into v, rejecting unknown fields and
+// bodies larger than MaxBodyBytes.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("request body is empty")
+		}
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	if dec.More() {
+		return errors.New("request body must contain a single JSON object")
+	}
+	return nil
+}
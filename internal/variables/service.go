@@ -0,0 +1,149 @@
+// Package variables stores the plain environment variables given to jobs,
+// globally and per project, and resolves the ones that apply to a job's
+// branch.
+package variables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// Service stores and resolves variables.
+type Service struct {
+	store storage.VariableStore
+	now   func() time.Time
+}
+
+// NewService returns a Service that keeps variables in store.
+func NewService(store storage.VariableStore) *Service {
+	return &Service{store: store, now: time.Now}
+}
+
+// Put stores the variable name of project, or the global one if project is
+// empty, replacing any earlier value, on behalf of updatedBy.
+func (s *Service) Put(ctx context.Context, project, name string, req types.PutVariableRequest, updatedBy string) (*types.Variable, error) {
+	if err := types.ValidateVariableName(name); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	variable := &types.Variable{
+		Project:   project,
+		Name:      name,
+		Value:     req.Value,
+		Branches:  req.Branches,
+		Protected: req.Protected,
+		UpdatedBy: updatedBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	previous, err := s.store.GetVariable(ctx, project, name)
+	switch {
+	case err == nil:
+		variable.CreatedAt = previous.CreatedAt
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	if err := s.store.PutVariable(ctx, variable); err != nil {
+		return nil, fmt.Errorf("storing variable: %w", err)
+	}
+	return variable, nil
+}
+
+// List returns the variables of project, or the global ones if project is
+// empty, ordered by name.
+func (s *Service) List(ctx context.Context, project string) ([]*types.Variable, error) {
+	return s.store.ListVariables(ctx, project)
+}
+
+// Delete removes the variable name of project, or the global one if project
+// is empty.
+func (s *Service) Delete(ctx context.Context, project, name string) error {
+	return s.store.DeleteVariable(ctx, project, name)
+}
+
+// ProtectedBranches returns the branches project protects, which are none
+// until it sets them.
+func (s *Service) ProtectedBranches(ctx context.Context, project string) (*types.ProtectedBranches, error) {
+	branches, err := s.store.GetProtectedBranches(ctx, project)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &types.ProtectedBranches{Project: project, Patterns: []string{}}, nil
+	}
+	return branches, err
+}
+
+// SetProtectedBranches replaces the branches project protects, on behalf of
+// updatedBy.
+func (s *Service) SetProtectedBranches(ctx context.Context, project string, req types.PutProtectedBranchesRequest, updatedBy string) (*types.ProtectedBranches, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	branches := &types.ProtectedBranches{
+		Project:   project,
+		Patterns:  append([]string{}, req.Patterns...),
+		UpdatedBy: updatedBy,
+		UpdatedAt: s.now(),
+	}
+	if err := s.store.PutProtectedBranches(ctx, branches); err != nil {
+		return nil, fmt.Errorf("storing protected branches: %w", err)
+	}
+	return branches, nil
+}
+
+// Resolve returns the variables given to the jobs of project on ref, in the
+// order they are merged: global variables first, then the project's, each
+// ordered by name. A variable is marked overridden when a later one has the
+// same name.
+func (s *Service) Resolve(ctx context.Context, project, ref string) (*types.ResolvedVariables, error) {
+	protected, err := s.ProtectedBranches(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("loading protected branches of %s: %w", project, err)
+	}
+	branch := types.RefBranch(ref)
+	resolved := &types.ResolvedVariables{
+		Project:   project,
+		Ref:       ref,
+		Branch:    branch,
+		Protected: protected.Protects(branch),
+		Variables: []types.ResolvedVariable{},
+	}
+	latest := make(map[string]int)
+	for _, scope := range []string{"", project} {
+		variables, err := s.store.ListVariables(ctx, scope)
+		if err != nil {
+			return nil, fmt.Errorf("listing variables: %w", err)
+		}
+		for _, v := range variables {
+			if !v.Applies(branch, resolved.Protected) {
+				continue
+			}
+			if i, ok := latest[v.Name]; ok {
+				resolved.Variables[i].Overridden = true
+			}
+			latest[v.Name] = len(resolved.Variables)
+			resolved.Variables = append(resolved.Variables, types.ResolvedVariable{Variable: *v})
+		}
+	}
+	return resolved, nil
+}
+
+// Env returns the environment the variables resolved for project on ref
+// give a job.
+func (s *Service) Env(ctx context.Context, project, ref string) (map[string]string, error) {
+	resolved, err := s.Resolve(ctx, project, ref)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string, len(resolved.Variables))
+	for _, v := range resolved.Variables {
+		env[v.Name] = v.Value
+	}
+	return env, nil
+}
@@ -0,0 +1,314 @@
+// Package vault reads secrets from HashiCorp Vault over its HTTP API. The
+// server logs in with AppRole or Kubernetes auth, reads the secrets jobs
+// reference when they are dispatched and revokes the leases of dynamic
+// secrets once the jobs are done with them.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth methods.
+const (
+	AuthAppRole    = "approle"
+	AuthKubernetes = "kubernetes"
+)
+
+// defaultTokenFile is the service account token Kubernetes mounts into pods.
+const defaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// requestTimeout bounds every API call.
+const requestTimeout = 15 * time.Second
+
+// renewBefore is how long before its lease runs out the client token is
+// replaced by logging in again.
+const renewBefore = 30 * time.Second
+
+// Config locates a Vault server and the credentials the client logs in
+// with.
+type Config struct {
+	Address string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// CAFile holds the PEM CAs the server certificate is verified against;
+	// the system roots are used without one.
+	CAFile string
+	// AuthMethod is AuthAppRole or AuthKubernetes, and AuthMount the path
+	// it is mounted at, which defaults to its name.
+	AuthMethod string
+	AuthMount  string
+	// RoleID and SecretID are the AppRole credentials.
+	RoleID   string
+	SecretID string
+	// Role is the Kubernetes auth role, logged in to with the service
+	// account token in TokenFile, by default that of the server's own pod.
+	Role      string
+	TokenFile string
+}
+
+// Secret is a secret read from Vault.
+type Secret struct {
+	// Data holds the fields of the secret; values that are not strings
+	// are JSON encoded. The fields of KV version 2 secrets are unwrapped.
+	Data map[string]string
+	// LeaseID is set for dynamic secrets, which are revoked with it.
+	LeaseID       string
+	LeaseDuration time.Duration
+}
+
+// APIError is an error status returned by Vault.
+type APIError struct {
+	Code   int
+	Errors []string
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault: %d %s", e.Code, http.StatusText(e.Code))
+	}
+	return fmt.Sprintf("vault: %d: %s", e.Code, strings.Join(e.Errors, "; "))
+}
+
+// IsNotFound reports whether err is an API error for a missing secret.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// IsForbidden reports whether err is an API error for a secret the client is
+// not allowed to read.
+func IsForbidden(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+// Client is a minimal Vault API client.
+type Client struct {
+	cfg  Config
+	base string
+	http *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	now     func() time.Time
+}
+
+// NewClient returns a client for the Vault server described by cfg. It logs
+// in on first use.
+func NewClient(cfg Config) (*Client, error) {
+	switch cfg.AuthMethod {
+	case AuthAppRole:
+		if cfg.RoleID == "" || cfg.SecretID == "" {
+			return nil, errors.New("AppRole auth needs a role ID and secret ID")
+		}
+	case AuthKubernetes:
+		if cfg.Role == "" {
+			return nil, errors.New("Kubernetes auth needs a role")
+		}
+		if cfg.TokenFile == "" {
+			cfg.TokenFile = defaultTokenFile
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth method %q, expected %s or %s", cfg.AuthMethod, AuthAppRole, AuthKubernetes)
+	}
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = cfg.AuthMethod
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &Client{
+		cfg:  cfg,
+		base: strings.TrimSuffix(cfg.Address, "/") + "/v1/",
+		http: &http.Client{Transport: transport},
+		now:  time.Now,
+	}, nil
+}
+
+// response is the body of a successful API call.
+type response struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int64          `json:"lease_duration"`
+	Data          map[string]any `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// Read returns the secret at path, such as secret/data/ci for the ci secret
+// of a KV version 2 engine mounted at secret, or database/creds/ci for
+// credentials of a database engine role.
+func (c *Client) Read(ctx context.Context, path string) (*Secret, error) {
+	var resp response
+	if err := c.authed(ctx, http.MethodGet, strings.Trim(path, "/"), nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, kv2 := data["metadata"]; kv2 {
+			data = inner
+		}
+	}
+	secret := &Secret{
+		Data:          make(map[string]string, len(data)),
+		LeaseID:       resp.LeaseID,
+		LeaseDuration: time.Duration(resp.LeaseDuration) * time.Second,
+	}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			secret.Data[k] = s
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("encoding field %s of %s: %w", k, path, err)
+		}
+		secret.Data[k] = string(encoded)
+	}
+	return secret, nil
+}
+
+// Revoke revokes the lease of a dynamic secret, invalidating it.
+func (c *Client) Revoke(ctx context.Context, leaseID string) error {
+	return c.authed(ctx, http.MethodPut, "sys/leases/revoke", map[string]string{"lease_id": leaseID}, nil)
+}
+
+// authed sends a request with the client token, logging in first if there
+// is none or it is about to expire, and once more if Vault refuses it.
+func (c *Client) authed(ctx context.Context, method, p string, body, out any) error {
+	token, err := c.currentToken(ctx, false)
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, method, p, token, body, out)
+	if !IsForbidden(err) {
+		return err
+	}
+	// The token may have been revoked; a fresh one tells the two apart.
+	if token, err = c.currentToken(ctx, true); err != nil {
+		return err
+	}
+	return c.do(ctx, method, p, token, body, out)
+}
+
+// currentToken returns the client token, logging in for a new one if it is
+// missing, expiring or refresh is set.
+func (c *Client) currentToken(ctx context.Context, refresh bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !refresh && c.token != "" && (c.expires.IsZero() || c.now().Before(c.expires.Add(-renewBefore))) {
+		return c.token, nil
+	}
+	token, ttl, err := c.login(ctx)
+	if err != nil {
+		return "", fmt.Errorf("logging in to Vault: %w", err)
+	}
+	c.token = token
+	c.expires = time.Time{}
+	if ttl > 0 {
+		c.expires = c.now().Add(ttl)
+	}
+	return token, nil
+}
+
+// login authenticates with the configured auth method.
+func (c *Client) login(ctx context.Context) (string, time.Duration, error) {
+	body := map[string]string{}
+	switch c.cfg.AuthMethod {
+	case AuthAppRole:
+		body["role_id"], body["secret_id"] = c.cfg.RoleID, c.cfg.SecretID
+	case AuthKubernetes:
+		// Projected service account tokens are rotated, so the file is
+		// read for every login.
+		jwt, err := os.ReadFile(c.cfg.TokenFile)
+		if err != nil {
+			return "", 0, fmt.Errorf("reading service account token: %w", err)
+		}
+		body["role"], body["jwt"] = c.cfg.Role, strings.TrimSpace(string(jwt))
+	}
+	var resp response
+	if err := c.do(ctx, http.MethodPost, "auth/"+strings.Trim(c.cfg.AuthMount, "/")+"/login", "", body, &resp); err != nil {
+		return "", 0, err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", 0, errors.New("login response has no client token")
+	}
+	return resp.Auth.ClientToken, time.Duration(resp.Auth.LeaseDuration) * time.Second, nil
+}
+
+// do sends a JSON request and decodes the response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, p, token string, body, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+p, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, p, err)
+	}
+	return nil
+}
+
+// apiError decodes the errors of a failed response.
+func apiError(resp *http.Response) error {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &body); err != nil && len(data) > 0 {
+		body.Errors = []string{strings.TrimSpace(string(data))}
+	}
+	return &APIError{Code: resp.StatusCode, Errors: body.Errors}
+}
@@ -0,0 +1,89 @@
+// Package version holds the version the binaries were built as and orders
+// versions, so that the server can tell which agents are out of date.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the running binary. Releases set it when
+// building:
+//
+//	go build -ldflags "-X open-cicd/internal/version.Version=1.4.0" ./cmd/agent
+//
+// Other builds are "dev", which is older than every release.
+var Version = "dev"
+
+// Number is a parsed MAJOR.MINOR.PATCH version with an optional pre-release
+// suffix, as in 1.4.0-rc.1. Build metadata after "+" is ignored.
+type Number struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+// Parse parses a version such as 1.4.0 or v1.4.0-rc.1. Missing minor and
+// patch numbers count as zero.
+func Parse(s string) (Number, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	v, _, _ = strings.Cut(v, "+")
+	v, pre, _ := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if v == "" || len(parts) > 3 {
+		return Number{}, fmt.Errorf("version %q is not MAJOR.MINOR.PATCH", s)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Number{}, fmt.Errorf("version %q is not MAJOR.MINOR.PATCH", s)
+		}
+		nums[i] = n
+	}
+	return Number{Major: nums[0], Minor: nums[1], Patch: nums[2], Pre: pre}, nil
+}
+
+// Compare returns -1, 0 or 1 as n is older than, the same as or newer than
+// o. A pre-release is older than the release it precedes.
+func (n Number) Compare(o Number) int {
+	for _, d := range [][2]int{{n.Major, o.Major}, {n.Minor, o.Minor}, {n.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case n.Pre == o.Pre:
+		return 0
+	case n.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case n.Pre < o.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (n Number) String() string {
+	s := fmt.Sprintf("%d.%d.%d", n.Major, n.Minor, n.Patch)
+	if n.Pre != "" {
+		s += "-" + n.Pre
+	}
+	return s
+}
+
+// Older reports whether version v is older than version than. Versions that
+// do not parse, such as "dev" or an empty one, are older than any that do.
+func Older(v, than string) bool {
+	t, err := Parse(than)
+	if err != nil {
+		return false
+	}
+	n, err := Parse(v)
+	return err != nil || n.Compare(t) < 0
+}
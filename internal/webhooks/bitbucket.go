@@ -0,0 +1,180 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"open-cicd/internal/types"
+)
+
+// VerifyBitbucketSignature checks an X-Hub-Signature header from Bitbucket
+// Server against the HMAC-SHA256 of body.
+func VerifyBitbucketSignature(secret string, body []byte, header string) error {
+	return verifySHA256(secret, body, header)
+}
+
+type bitbucketRepository struct {
+	Slug    string `json:"slug"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+	Links struct {
+		Clone []struct {
+			Href string `json:"href"`
+			Name string `json:"name"`
+		} `json:"clone"`
+	} `json:"links"`
+}
+
+// fullName returns the repository as PROJECT/slug.
+func (r *bitbucketRepository) fullName() string {
+	if r.Project.Key == "" || r.Slug == "" {
+		return ""
+	}
+	return r.Project.Key + "/" + r.Slug
+}
+
+// cloneURL returns the HTTP clone URL of the repository.
+func (r *bitbucketRepository) cloneURL() string {
+	for _, link := range r.Links.Clone {
+		if link.Name == "http" || link.Name == "https" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+type bitbucketActor struct {
+	Name string `json:"name"`
+}
+
+type bitbucketRefsChangedEvent struct {
+	Actor      bitbucketActor      `json:"actor"`
+	Repository bitbucketRepository `json:"repository"`
+	Changes    []struct {
+		Ref struct {
+			ID        string `json:"id"`
+			DisplayID string `json:"displayId"`
+			Type      string `json:"type"`
+		} `json:"ref"`
+		FromHash string `json:"fromHash"`
+		ToHash   string `json:"toHash"`
+		Type     string `json:"type"`
+	} `json:"changes"`
+}
+
+type bitbucketPullRequestEvent struct {
+	Actor       bitbucketActor `json:"actor"`
+	PullRequest struct {
+		ID      int `json:"id"`
+		FromRef struct {
+			DisplayID    string              `json:"displayId"`
+			LatestCommit string              `json:"latestCommit"`
+			Repository   bitbucketRepository `json:"repository"`
+		} `json:"fromRef"`
+		ToRef struct {
+			Repository bitbucketRepository `json:"repository"`
+		} `json:"toRef"`
+	} `json:"pullRequest"`
+}
+
+// BitbucketRepository extracts the repository, as PROJECT/slug, from a
+// delivery so the matching secret can be looked up before the signature is
+// checked. Pull request events name the repository the pull request targets.
+func BitbucketRepository(body []byte) (string, error) {
+	var payload struct {
+		Repository  bitbucketRepository `json:"repository"`
+		PullRequest struct {
+			ToRef struct {
+				Repository bitbucketRepository `json:"repository"`
+			} `json:"toRef"`
+		} `json:"pullRequest"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("decoding payload: %w", err)
+	}
+	if name := payload.Repository.fullName(); name != "" {
+		return name, nil
+	}
+	if name := payload.PullRequest.ToRef.Repository.fullName(); name != "" {
+		return name, nil
+	}
+	return "", errors.New("payload has no repository")
+}
+
+// ParseBitbucketEvent converts a Bitbucket Server delivery, named by its
+// X-Event-Key header, into triggers. A push may update several branches and
+// tags at once and yields a trigger for each, a tag event for tags; deleted
+// refs are left out. Other events and pull request changes that do not
+// change code return ErrIgnored.
+func ParseBitbucketEvent(event string, body []byte) ([]*types.Trigger, error) {
+	switch event {
+	case "repo:refs_changed":
+		var e bitbucketRefsChangedEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding refs_changed event: %w", err)
+		}
+		cloneURL := e.Repository.cloneURL()
+		if cloneURL == "" {
+			return nil, errors.New("payload has no HTTP clone link")
+		}
+		var triggers []*types.Trigger
+		for _, c := range e.Changes {
+			if c.Type == "DELETE" || (c.Ref.Type != "BRANCH" && c.Ref.Type != "TAG") {
+				continue
+			}
+			t := &types.Trigger{
+				Provider:   "bitbucket",
+				Event:      types.TriggerEventPush,
+				Repository: e.Repository.fullName(),
+				CloneURL:   cloneURL,
+				Ref:        c.Ref.ID,
+				Branch:     c.Ref.DisplayID,
+				Commit:     c.ToHash,
+				Actor:      e.Actor.Name,
+			}
+			if c.Ref.Type == "TAG" {
+				t.Event, t.Branch, t.Tag = types.TriggerEventTag, "", c.Ref.DisplayID
+			} else {
+				t.Before = pushedFrom(c.FromHash)
+			}
+			triggers = append(triggers, t)
+		}
+		if len(triggers) == 0 {
+			return nil, fmt.Errorf("%w: push changed no branches or tags", ErrIgnored)
+		}
+		return triggers, nil
+
+	case "pr:opened", "pr:from_ref_updated":
+		var e bitbucketPullRequestEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding pull request event: %w", err)
+		}
+		pr := e.PullRequest
+		repo := &pr.ToRef.Repository
+		cloneURL := repo.cloneURL()
+		if cloneURL == "" {
+			return nil, errors.New("payload has no HTTP clone link")
+		}
+		head := pr.FromRef.Repository.fullName()
+		// Pull request refs live in the target repository, so runs of pull
+		// requests from forks fetch from there too.
+		return []*types.Trigger{{
+			Provider:       "bitbucket",
+			Event:          types.TriggerEventPullRequest,
+			Repository:     repo.fullName(),
+			CloneURL:       cloneURL,
+			Ref:            fmt.Sprintf("refs/pull-requests/%d/from", pr.ID),
+			Branch:         pr.FromRef.DisplayID,
+			Commit:         pr.FromRef.LatestCommit,
+			PullRequest:    pr.ID,
+			HeadRepository: head,
+			Fork:           head != repo.fullName(),
+			Actor:          e.Actor.Name,
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported event %q", ErrIgnored, event)
+	}
+}
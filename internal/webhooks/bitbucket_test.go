@@ -0,0 +1,32 @@
+package webhooks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyBitbucketSignature(t *testing.T) {
+	body := []byte(`{"eventKey":"repo:refs_changed"}`)
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"valid", githubSignature("s3cret", body), true},
+		{"wrong secret", githubSignature("other", body), false},
+		{"other body", githubSignature("s3cret", []byte(`{}`)), false},
+		{"missing header", "", false},
+		{"no prefix", githubSignature("s3cret", body)[len("sha256="):], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyBitbucketSignature("s3cret", body, tt.header)
+			if tt.valid && err != nil {
+				t.Errorf("VerifyBitbucketSignature = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyBitbucketSignature = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"open-cicd/internal/storage"
+	"open-cicd/internal/types"
+)
+
+// pruneInterval is how often deliveries past their retention are deleted.
+const pruneInterval = time.Hour
+
+// ParseDelivery parses the payload of a verified delivery into the triggers
+// of the runs it starts, each naming the delivery. Events that start no run
+// return an error wrapping ErrIgnored.
+func ParseDelivery(d *types.WebhookDelivery) ([]*types.Trigger, error) {
+	body := []byte(d.Payload)
+	var triggers []*types.Trigger
+	switch d.Provider {
+	case "github":
+		t, err := ParseGitHubEvent(d.Event, body)
+		if err != nil {
+			return nil, err
+		}
+		triggers = []*types.Trigger{t}
+	case "gitlab":
+		t, err := ParseGitLabEvent(d.Event, body)
+		if err != nil {
+			return nil, err
+		}
+		triggers = []*types.Trigger{t}
+	case "bitbucket":
+		var err error
+		if triggers, err = ParseBitbucketEvent(d.Event, body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown webhook provider %q", d.Provider)
+	}
+	for _, t := range triggers {
+		t.Delivery = d.ID
+	}
+	return triggers, nil
+}
+
+// Record stores a delivery along with the outcome of processing it on
+// receipt.
+func (s *Service) Record(ctx context.Context, d *types.WebhookDelivery) error {
+	return s.deliveries.CreateWebhookDelivery(ctx, d)
+}
+
+// Delivery returns a delivery with its payload.
+func (s *Service) Delivery(ctx context.Context, id string) (*types.WebhookDelivery, error) {
+	return s.deliveries.GetWebhookDelivery(ctx, id)
+}
+
+// Deliveries returns the deliveries matching filter, without payloads.
+func (s *Service) Deliveries(ctx context.Context, filter storage.WebhookDeliveryFilter) ([]*types.WebhookDelivery, error) {
+	return s.deliveries.ListWebhookDeliveries(ctx, filter)
+}
+
+// RecordAttempt records the outcome of redelivering a delivery.
+func (s *Service) RecordAttempt(ctx context.Context, id string, a types.DeliveryAttempt) (*types.WebhookDelivery, error) {
+	return s.deliveries.UpdateWebhookDelivery(ctx, id, func(d *types.WebhookDelivery) error {
+		d.Record(a)
+		return nil
+	})
+}
+
+// Run deletes the deliveries received longer than the retention ago, on
+// start and then every pruneInterval, until ctx is cancelled. Without a
+// retention deliveries are kept forever and Run returns at once.
+func (s *Service) Run(ctx context.Context) {
+	if s.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := s.deliveries.DeleteWebhookDeliveries(ctx, time.Now().Add(-s.retention))
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "deleting old webhook deliveries", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Deleted old webhook deliveries", "deliveries", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
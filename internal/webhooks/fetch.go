@@ -0,0 +1,204 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"open-cicd/internal/scm"
+)
+
+// ErrFileNotFound is returned when the pipeline file does not exist at the
+// requested ref.
+var ErrFileNotFound = errors.New("file not found in repository")
+
+// ErrInvalidRef is returned for a ref that is not a valid git ref name, or
+// that git would take for an option.
+var ErrInvalidRef = errors.New("invalid git ref")
+
+// objectID matches a full SHA-1 or SHA-256 commit ID.
+var objectID = regexp.MustCompile(`^(?:[0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// Fetcher reads a single file from a repository at a given ref, and lists
+// the files changed between two commits.
+type Fetcher interface {
+	FetchFile(ctx context.Context, cloneURL, ref, path string) ([]byte, error)
+	ChangedFiles(ctx context.Context, cloneURL, from, to string) ([]string, error)
+}
+
+// GitCredentials looks up how fetches from a repository authenticate, as
+// credentials.Service does. A nil GitAuth fetches anonymously.
+type GitCredentials interface {
+	GitAuth(ctx context.Context, cloneURL string) (*scm.GitAuth, error)
+}
+
+// GitFetcher fetches files with the git command line client, using a shallow
+// fetch into a temporary repository that is removed afterwards.
+type GitFetcher struct {
+	// Dir is the parent directory for temporary clones; empty uses os.TempDir.
+	Dir string
+	// Credentials, if set, authenticates fetches from the repositories it
+	// has a credential for.
+	Credentials GitCredentials
+}
+
+// FetchFile implements Fetcher. The ref comes from a pipeline definition,
+// so it is checked to be a ref name before it is handed to git.
+func (f *GitFetcher) FetchFile(ctx context.Context, cloneURL, ref, path string) ([]byte, error) {
+	if err := checkRef(ctx, ref); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(f.Dir, "opencicd-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git(ctx, dir, nil, "init", "--quiet"); err != nil {
+		return nil, err
+	}
+	remote, env, err := f.authenticate(ctx, dir, cloneURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := git(ctx, dir, env, "fetch", "--quiet", "--depth", "1", "--no-tags", "--end-of-options", remote, ref); err != nil {
+		return nil, err
+	}
+	out, err := git(ctx, dir, nil, "show", "FETCH_HEAD:"+path)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "exists on disk, but not in") {
+			return nil, fmt.Errorf("%w: %s at %s", ErrFileNotFound, path, ref)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChangedFiles implements Fetcher by fetching both commits, without their
+// history, and diffing their trees. The commits come from a webhook
+// delivery, so both must be full commit IDs.
+func (f *GitFetcher) ChangedFiles(ctx context.Context, cloneURL, from, to string) ([]string, error) {
+	for _, id := range []string{from, to} {
+		if !objectID.MatchString(id) {
+			return nil, fmt.Errorf("%w: %q is not a commit ID", ErrInvalidRef, id)
+		}
+	}
+	dir, err := os.MkdirTemp(f.Dir, "opencicd-diff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git(ctx, dir, nil, "init", "--quiet"); err != nil {
+		return nil, err
+	}
+	remote, env, err := f.authenticate(ctx, dir, cloneURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := git(ctx, dir, env, "fetch", "--quiet", "--depth", "1", "--no-tags", "--filter=blob:none", "--end-of-options", remote, from, to); err != nil {
+		return nil, err
+	}
+	out, err := git(ctx, dir, nil, "diff", "--name-only", "--no-renames", "-z", "--end-of-options", from, to, "--")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// checkRef returns ErrInvalidRef unless ref is a branch, tag or commit
+// name as git check-ref-format accepts it.
+func checkRef(ctx context.Context, ref string) error {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("%w: %q", ErrInvalidRef, ref)
+	}
+	if _, err := git(ctx, "", nil, "check-ref-format", "--allow-onelevel", ref); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidRef, ref)
+	}
+	return nil
+}
+
+// authenticate returns the URL to fetch from the repository at cloneURL and
+// the environment of git that authenticates the fetch: tokens are sent
+// over HTTPS in a header set through the environment, so that they do not
+// show in the command line, and deploy keys are written to the temporary
+// repository dir and used over SSH. Repositories are fetched from the URL
+// the credential works with, HTTPS or SSH.
+func (f *GitFetcher) authenticate(ctx context.Context, dir, cloneURL string) (string, []string, error) {
+	if f.Credentials == nil {
+		return cloneURL, nil, nil
+	}
+	auth, err := f.Credentials.GitAuth(ctx, cloneURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("looking up SCM credential: %w", err)
+	}
+	switch {
+	case auth == nil:
+		return cloneURL, nil, nil
+	case auth.SSHKey != "":
+		keyFile := filepath.Join(dir, ".git", "opencicd-deploy-key")
+		key := strings.TrimSpace(auth.SSHKey) + "\n"
+		if err := os.WriteFile(keyFile, []byte(key), 0o600); err != nil {
+			return "", nil, err
+		}
+		ssh := "ssh -i '" + keyFile + "' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new"
+		return sshURL(cloneURL), []string{"GIT_SSH_COMMAND=" + ssh}, nil
+	default:
+		basic := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		return httpsURL(cloneURL), []string{
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic " + basic,
+		}, nil
+	}
+}
+
+// sshURL returns the SSH URL of a repository given by its HTTPS URL, as
+// providers serve them both; other URLs are returned as they are.
+func sshURL(cloneURL string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return cloneURL
+	}
+	return "ssh://git@" + u.Hostname() + u.Path
+}
+
+// httpsURL returns the HTTPS URL of a repository given by its SSH URL;
+// other URLs are returned as they are.
+func httpsURL(cloneURL string) string {
+	if strings.HasPrefix(cloneURL, "https://") || strings.HasPrefix(cloneURL, "http://") {
+		return cloneURL
+	}
+	host, repo, err := scm.ParseRepositoryURL(cloneURL)
+	if err != nil {
+		return cloneURL
+	}
+	return "https://" + host + "/" + repo + ".git"
+}
+
+func git(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFetchFileRefs(t *testing.T) {
+	tests := []struct {
+		ref   string
+		valid bool
+	}{
+		{"main", true},
+		{"refs/heads/release/1.x", true},
+		{"v1.2.0", true},
+		{"3f786850e387550fdab836ed7e6dc881de23001b", true},
+		{"", false},
+		{"--upload-pack=touch /tmp/pwned", false},
+		{"-n", false},
+		{"main..other", false},
+		{"with space", false},
+		{"refs/heads/main.lock", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			err := checkRef(context.Background(), tt.ref)
+			if tt.valid && err != nil {
+				t.Errorf("checkRef = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidRef) {
+				t.Errorf("checkRef = %v, want %v", err, ErrInvalidRef)
+			}
+		})
+	}
+
+	// Invalid refs are refused before anything is fetched.
+	f := &GitFetcher{Dir: t.TempDir()}
+	if _, err := f.FetchFile(context.Background(), "https://git.invalid/acme/app.git", "--upload-pack=touch /tmp/pwned", "ci.yml"); !errors.Is(err, ErrInvalidRef) {
+		t.Errorf("FetchFile = %v, want %v", err, ErrInvalidRef)
+	}
+}
+
+func TestChangedFilesCommitIDs(t *testing.T) {
+	sha := "3f786850e387550fdab836ed7e6dc881de23001b"
+	f := &GitFetcher{Dir: t.TempDir()}
+	for _, id := range []string{"", "main", "3f78685", "--output=/tmp/pwned", "3F786850E387550FDAB836ED7E6DC881DE23001B", sha + "0"} {
+		if _, err := f.ChangedFiles(context.Background(), "https://git.invalid/acme/app.git", sha, id); !errors.Is(err, ErrInvalidRef) {
+			t.Errorf("ChangedFiles to %q = %v, want %v", id, err, ErrInvalidRef)
+		}
+		if _, err := f.ChangedFiles(context.Background(), "https://git.invalid/acme/app.git", id, sha); !errors.Is(err, ErrInvalidRef) {
+			t.Errorf("ChangedFiles from %q = %v, want %v", id, err, ErrInvalidRef)
+		}
+	}
+}
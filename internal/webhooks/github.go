@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+var (
+	// ErrInvalidSignature is returned when a delivery's signature does not verify.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrIgnored is returned for well-formed events that do not trigger a run.
+	ErrIgnored = errors.New("event ignored")
+)
+
+// zeroSHA is the commit SHA GitHub reports for deleted refs.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// VerifyGitHubSignature checks an X-Hub-Signature-256 header against the
+// HMAC-SHA256 of body.
+func VerifyGitHubSignature(secret string, body []byte, header string) error {
+	return verifySHA256(secret, body, header)
+}
+
+// verifySHA256 checks a "sha256=<hex>" signature header against the
+// HMAC-SHA256 of body.
+func verifySHA256(secret string, body []byte, header string) error {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+}
+
+type githubPushEvent struct {
+	Ref        string           `json:"ref"`
+	Before     string           `json:"before"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Repository githubRepository `json:"repository"`
+	Pusher     struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	Commits []pushCommit `json:"commits"`
+}
+
+// pushCommit lists the files a pushed commit changed, in the form both
+// GitHub and GitLab send.
+type pushCommit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// pushedFrom returns the commit a branch pointed to before a push, or ""
+// if the push created it.
+func pushedFrom(before string) string {
+	if before == zeroSHA {
+		return ""
+	}
+	return before
+}
+
+// changedFiles returns the paths the commits changed, sorted, or nil if
+// there are no commits to tell.
+func changedFiles(commits []pushCommit) []string {
+	if len(commits) == 0 {
+		return nil
+	}
+	files := []string{}
+	for _, c := range commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			files = append(files, list...)
+		}
+	}
+	slices.Sort(files)
+	return slices.Compact(files)
+}
+
+type githubPullRequestEvent struct {
+	Action      string           `json:"action"`
+	Number      int              `json:"number"`
+	Repository  githubRepository `json:"repository"`
+	PullRequest struct {
+		Head struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+			// Repo is null once the fork a pull request comes from is
+			// deleted.
+			Repo *githubRepository `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// GitHubRepository extracts the repository full name from a delivery so the
+// matching secret can be looked up before the signature is checked.
+func GitHubRepository(body []byte) (string, error) {
+	var payload struct {
+		Repository githubRepository `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("decoding payload: %w", err)
+	}
+	if payload.Repository.FullName == "" {
+		return "", errors.New("payload has no repository")
+	}
+	return payload.Repository.FullName, nil
+}
+
+// ParseGitHubEvent converts a push or pull_request delivery into a Trigger;
+// pushes of tags are tag events. Other events, branch deletions and pull
+// request actions that do not change code return ErrIgnored.
+func ParseGitHubEvent(event string, body []byte) (*types.Trigger, error) {
+	switch event {
+	case "push":
+		var e githubPushEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding push event: %w", err)
+		}
+		if e.Deleted || e.After == zeroSHA {
+			return nil, fmt.Errorf("%w: ref %s was deleted", ErrIgnored, e.Ref)
+		}
+		t := &types.Trigger{
+			Provider:   "github",
+			Event:      types.TriggerEventPush,
+			Repository: e.Repository.FullName,
+			CloneURL:   e.Repository.CloneURL,
+			Ref:        e.Ref,
+			Commit:     e.After,
+			Actor:      e.Pusher.Name,
+		}
+		if tag, ok := strings.CutPrefix(e.Ref, "refs/tags/"); ok {
+			t.Event, t.Tag = types.TriggerEventTag, tag
+			return t, nil
+		}
+		branch, ok := strings.CutPrefix(e.Ref, "refs/heads/")
+		if !ok {
+			return nil, fmt.Errorf("%w: push to %s is not a branch or tag", ErrIgnored, e.Ref)
+		}
+		t.Branch = branch
+		t.Before = pushedFrom(e.Before)
+		t.ChangedFiles = changedFiles(e.Commits)
+		return t, nil
+
+	case "pull_request":
+		var e githubPullRequestEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding pull_request event: %w", err)
+		}
+		switch e.Action {
+		case "opened", "synchronize", "reopened":
+		default:
+			return nil, fmt.Errorf("%w: pull_request action %q", ErrIgnored, e.Action)
+		}
+		t := &types.Trigger{
+			Provider:    "github",
+			Event:       types.TriggerEventPullRequest,
+			Repository:  e.Repository.FullName,
+			CloneURL:    e.Repository.CloneURL,
+			Ref:         fmt.Sprintf("refs/pull/%d/head", e.Number),
+			Branch:      e.PullRequest.Head.Ref,
+			Commit:      e.PullRequest.Head.SHA,
+			PullRequest: e.Number,
+			Fork:        true,
+			Actor:       e.Sender.Login,
+		}
+		if head := e.PullRequest.Head.Repo; head != nil {
+			t.HeadRepository = head.FullName
+			t.Fork = !strings.EqualFold(head.FullName, e.Repository.FullName)
+		}
+		return t, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported event %q", ErrIgnored, event)
+	}
+}
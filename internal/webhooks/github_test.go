@@ -0,0 +1,181 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"open-cicd/internal/types"
+)
+
+func githubSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyGitHubSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	valid := githubSignature("s3cret", body)
+	tests := []struct {
+		name   string
+		secret string
+		body   []byte
+		header string
+		valid  bool
+	}{
+		{"valid", "s3cret", body, valid, true},
+		{"wrong secret", "other", body, valid, false},
+		{"changed body", "s3cret", []byte(`{"ref":"refs/heads/evil"}`), valid, false},
+		{"missing header", "s3cret", body, "", false},
+		{"sha1 header", "s3cret", body, "sha1=" + valid[len("sha256="):], false},
+		{"no prefix", "s3cret", body, valid[len("sha256="):], false},
+		{"not hex", "s3cret", body, "sha256=zz", false},
+		{"truncated", "s3cret", body, valid[:len(valid)-2], false},
+		{"empty secret signs too", "", body, githubSignature("", body), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyGitHubSignature(tt.secret, tt.body, tt.header)
+			if tt.valid && err != nil {
+				t.Errorf("VerifyGitHubSignature = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyGitHubSignature = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestSecretsLookup(t *testing.T) {
+	secrets := NewSecrets(map[string]string{"Acme/App": "one", "acme/web": "two", "*": "fallback"})
+	tests := []struct {
+		repo   string
+		want   string
+		wantOK bool
+	}{
+		{"acme/app", "one", true},
+		{"ACME/WEB", "two", true},
+		{"other/repo", "fallback", true},
+	}
+	for _, tt := range tests {
+		got, ok := secrets.Lookup(tt.repo)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.repo, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	strict := NewSecrets(map[string]string{"acme/app": "one"})
+	if _, ok := strict.Lookup("acme/web"); ok {
+		t.Errorf("Lookup of an unlisted repository without a fallback succeeded")
+	}
+}
+
+func TestParseGitHubEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		body    string
+		want    *types.Trigger
+		ignored bool
+	}{
+		{
+			name:  "push to a branch",
+			event: "push",
+			body:  `{"ref":"refs/heads/main","after":"abc","repository":{"full_name":"acme/app","clone_url":"https://github.com/acme/app.git"},"pusher":{"name":"jdoe"}}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventPush, Repository: "acme/app",
+				CloneURL: "https://github.com/acme/app.git", Ref: "refs/heads/main", Branch: "main", Commit: "abc", Actor: "jdoe",
+			},
+		},
+		{
+			name:  "changed files of a push",
+			event: "push",
+			body:  `{"ref":"refs/heads/main","after":"abc","repository":{"full_name":"acme/app"},"commits":[{"added":["b.go"],"modified":["a.go"]},{"removed":["b.go","c.go"]}]}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventPush, Repository: "acme/app",
+				Ref: "refs/heads/main", Branch: "main", Commit: "abc", ChangedFiles: []string{"a.go", "b.go", "c.go"},
+			},
+		},
+		{
+			name:    "deleted branch",
+			event:   "push",
+			body:    `{"ref":"refs/heads/main","after":"0000000000000000000000000000000000000000","deleted":true,"repository":{"full_name":"acme/app"}}`,
+			ignored: true,
+		},
+		{
+			name:  "push of a tag",
+			event: "push",
+			body:  `{"ref":"refs/tags/v1","after":"abc","repository":{"full_name":"acme/app"}}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventTag, Repository: "acme/app",
+				Ref: "refs/tags/v1", Tag: "v1", Commit: "abc",
+			},
+		},
+		{
+			name:    "push to another ref",
+			event:   "push",
+			body:    `{"ref":"refs/notes/commits","after":"abc","repository":{"full_name":"acme/app"}}`,
+			ignored: true,
+		},
+		{
+			name:  "opened pull request",
+			event: "pull_request",
+			body:  `{"action":"opened","number":7,"repository":{"full_name":"acme/app"},"pull_request":{"head":{"ref":"feature","sha":"def","repo":{"full_name":"Acme/App"}}},"sender":{"login":"jdoe"}}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventPullRequest, Repository: "acme/app",
+				Ref: "refs/pull/7/head", Branch: "feature", Commit: "def", PullRequest: 7, HeadRepository: "Acme/App", Actor: "jdoe",
+			},
+		},
+		{
+			name:  "pull request from a fork",
+			event: "pull_request",
+			body:  `{"action":"synchronize","number":8,"repository":{"full_name":"acme/app"},"pull_request":{"head":{"ref":"main","sha":"fed","repo":{"full_name":"mallory/app"}}},"sender":{"login":"mallory"}}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventPullRequest, Repository: "acme/app",
+				Ref: "refs/pull/8/head", Branch: "main", Commit: "fed", PullRequest: 8, HeadRepository: "mallory/app", Fork: true, Actor: "mallory",
+			},
+		},
+		{
+			name:  "pull request from a deleted repository is a fork",
+			event: "pull_request",
+			body:  `{"action":"reopened","number":9,"repository":{"full_name":"acme/app"},"pull_request":{"head":{"ref":"old","sha":"abc","repo":null}}}`,
+			want: &types.Trigger{
+				Provider: "github", Event: types.TriggerEventPullRequest, Repository: "acme/app",
+				Ref: "refs/pull/9/head", Branch: "old", Commit: "abc", PullRequest: 9, Fork: true,
+			},
+		},
+		{
+			name:    "closed pull request",
+			event:   "pull_request",
+			body:    `{"action":"closed","number":7,"repository":{"full_name":"acme/app"}}`,
+			ignored: true,
+		},
+		{
+			name:    "other event",
+			event:   "issues",
+			body:    `{}`,
+			ignored: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGitHubEvent(tt.event, []byte(tt.body))
+			if tt.ignored {
+				if !errors.Is(err, ErrIgnored) {
+					t.Errorf("ParseGitHubEvent error = %v, want %v", err, ErrIgnored)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseGitHubEvent: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseGitHubEvent = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package webhooks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"open-cicd/internal/types"
+)
+
+// VerifyGitLabToken checks an X-Gitlab-Token header against the secret
+// token configured for the webhook. GitLab sends the token itself rather
+// than a signature.
+func VerifyGitLabToken(secret, header string) error {
+	if header == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(header)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	GitHTTPURL        string `json:"git_http_url"`
+}
+
+type gitlabPushEvent struct {
+	Ref          string        `json:"ref"`
+	Before       string        `json:"before"`
+	After        string        `json:"after"`
+	CheckoutSHA  string        `json:"checkout_sha"`
+	UserUsername string        `json:"user_username"`
+	Project      gitlabProject `json:"project"`
+	Commits      []pushCommit  `json:"commits"`
+	// TotalCommitsCount exceeds the number of commits listed when GitLab
+	// left some out, and with them the files they changed.
+	TotalCommitsCount int `json:"total_commits_count"`
+}
+
+type gitlabMergeRequestEvent struct {
+	Project gitlabProject `json:"project"`
+	User    struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+		// The source project differs from the target project for merge
+		// requests from forks.
+		SourceProjectID int           `json:"source_project_id"`
+		TargetProjectID int           `json:"target_project_id"`
+		Source          gitlabProject `json:"source"`
+		// OldRev is only set on updates that pushed new commits.
+		OldRev     string `json:"oldrev"`
+		LastCommit struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// GitLabRepository extracts the project path from a delivery so the
+// matching token can be looked up before it is checked.
+func GitLabRepository(body []byte) (string, error) {
+	var payload struct {
+		Project gitlabProject `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("decoding payload: %w", err)
+	}
+	if payload.Project.PathWithNamespace == "" {
+		return "", errors.New("payload has no project")
+	}
+	return payload.Project.PathWithNamespace, nil
+}
+
+// ParseGitLabEvent converts a push, tag push or merge request delivery,
+// named by its X-Gitlab-Event header, into a Trigger. Other events, branch
+// deletions and merge request actions that do not change code return
+// ErrIgnored.
+func ParseGitLabEvent(event string, body []byte) (*types.Trigger, error) {
+	switch event {
+	case "Push Hook":
+		var e gitlabPushEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding push event: %w", err)
+		}
+		if e.After == zeroSHA || e.CheckoutSHA == "" {
+			return nil, fmt.Errorf("%w: ref %s was deleted", ErrIgnored, e.Ref)
+		}
+		branch, ok := strings.CutPrefix(e.Ref, "refs/heads/")
+		if !ok {
+			return nil, fmt.Errorf("%w: push to %s is not a branch", ErrIgnored, e.Ref)
+		}
+		t := &types.Trigger{
+			Provider:   "gitlab",
+			Event:      types.TriggerEventPush,
+			Repository: e.Project.PathWithNamespace,
+			CloneURL:   e.Project.GitHTTPURL,
+			Ref:        e.Ref,
+			Branch:     branch,
+			Commit:     e.CheckoutSHA,
+			Before:     pushedFrom(e.Before),
+			Actor:      e.UserUsername,
+		}
+		if e.TotalCommitsCount <= len(e.Commits) {
+			t.ChangedFiles = changedFiles(e.Commits)
+		}
+		return t, nil
+
+	case "Tag Push Hook":
+		var e gitlabPushEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding tag push event: %w", err)
+		}
+		if e.After == zeroSHA || e.CheckoutSHA == "" {
+			return nil, fmt.Errorf("%w: ref %s was deleted", ErrIgnored, e.Ref)
+		}
+		tag, ok := strings.CutPrefix(e.Ref, "refs/tags/")
+		if !ok {
+			return nil, fmt.Errorf("%w: tag push to %s is not a tag", ErrIgnored, e.Ref)
+		}
+		return &types.Trigger{
+			Provider:   "gitlab",
+			Event:      types.TriggerEventTag,
+			Repository: e.Project.PathWithNamespace,
+			CloneURL:   e.Project.GitHTTPURL,
+			Ref:        e.Ref,
+			Tag:        tag,
+			Commit:     e.CheckoutSHA,
+			Actor:      e.UserUsername,
+		}, nil
+
+	case "Merge Request Hook":
+		var e gitlabMergeRequestEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("decoding merge request event: %w", err)
+		}
+		mr := e.ObjectAttributes
+		switch {
+		case mr.Action == "open", mr.Action == "reopen":
+		case mr.Action == "update" && mr.OldRev != "":
+		default:
+			return nil, fmt.Errorf("%w: merge request action %q does not change code", ErrIgnored, mr.Action)
+		}
+		// Merge request refs live in the target project, so runs of merge
+		// requests from forks fetch from there too.
+		return &types.Trigger{
+			Provider:       "gitlab",
+			Event:          types.TriggerEventPullRequest,
+			Repository:     e.Project.PathWithNamespace,
+			CloneURL:       e.Project.GitHTTPURL,
+			Ref:            fmt.Sprintf("refs/merge-requests/%d/head", mr.IID),
+			Branch:         mr.SourceBranch,
+			Commit:         mr.LastCommit.ID,
+			PullRequest:    mr.IID,
+			HeadRepository: mr.Source.PathWithNamespace,
+			Fork:           mr.SourceProjectID != mr.TargetProjectID,
+			Actor:          e.User.Username,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported event %q", ErrIgnored, event)
+	}
+}
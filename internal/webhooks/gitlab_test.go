@@ -0,0 +1,32 @@
+package webhooks
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyGitLabToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		valid  bool
+	}{
+		{"matching token", "s3cret", "s3cret", true},
+		{"other token", "s3cret", "guess", false},
+		{"prefix of the token", "s3cret", "s3cr", false},
+		{"missing header", "s3cret", "", false},
+		{"empty secret and header", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyGitLabToken(tt.secret, tt.header)
+			if tt.valid && err != nil {
+				t.Errorf("VerifyGitLabToken = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyGitLabToken = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Package webhooks receives SCM webhook deliveries, authenticates them and
+// turns them into pipeline runs.
+package webhooks
+
+import "strings"
+
+// wildcardRepo is the Secrets key used for repositories without their own entry.
+const wildcardRepo = "*"
+
+// Secrets maps repository full names (owner/name) to webhook secrets, so
+// several repositories can deliver to one server with different secrets.
+type Secrets map[string]string
+
+// NewSecrets returns the secrets given by repository. The repository "*"
+// sets a fallback secret for unlisted repositories.
+func NewSecrets(secrets map[string]string) Secrets {
+	s := make(Secrets, len(secrets))
+	for repo, secret := range secrets {
+		s[strings.ToLower(repo)] = secret
+	}
+	return s
+}
+
+// Lookup returns the secret configured for repo, falling back to the
+// wildcard entry.
+func (s Secrets) Lookup(repo string) (string, bool) {
+	if secret, ok := s[strings.ToLower(repo)]; ok {
+		return secret, true
+	}
+	secret, ok := s[wildcardRepo]
+	return secret, ok
+}
@@ -0,0 +1,106 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"open-cicd/internal/jobs"
+	"open-cicd/internal/pipeline"
+	"open-cicd/internal/storage"
+	"open-cicd/internal/tracing"
+	"open-cicd/internal/types"
+)
+
+// Service turns normalised triggers into pipeline runs and keeps the
+// deliveries they came from.
+type Service struct {
+	fetcher    Fetcher
+	templates  pipeline.TemplateLoader
+	jobs       *jobs.Manager
+	deliveries storage.WebhookDeliveryStore
+	retention  time.Duration
+}
+
+// NewService returns a Service that reads pipeline files with fetcher,
+// expands the templates they include with templates and submits runs to
+// manager. Deliveries are recorded in deliveries and kept for retention,
+// or forever if it is 0.
+func NewService(fetcher Fetcher, templates pipeline.TemplateLoader, manager *jobs.Manager, deliveries storage.WebhookDeliveryStore, retention time.Duration) *Service {
+	return &Service{fetcher: fetcher, templates: templates, jobs: manager, deliveries: deliveries, retention: retention}
+}
+
+// Trigger fetches the pipeline file at the trigger's commit, parses and
+// expands it and enqueues a run. Definition errors are returned as a pipeline.ErrorList.
+func (s *Service) Trigger(ctx context.Context, t *types.Trigger) (run *types.Pipeline, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "webhook.trigger")
+	span.SetAttributes(
+		attribute.String("scm.provider", t.Provider),
+		attribute.String("scm.event", string(t.Event)),
+		attribute.String("scm.repository", t.Repository),
+		attribute.String("scm.ref", t.Ref),
+		attribute.String("scm.commit", t.Commit),
+	)
+	defer func() {
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+
+	ref := t.Ref
+	if t.Commit != "" {
+		ref = t.Commit
+	}
+	source, err := s.fetch(ctx, t.CloneURL, ref)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from %s: %w", pipeline.DefaultFilename, t.Repository, err)
+	}
+	def, source, err := pipeline.ParseExpanded(ctx, source, s.templates)
+	if err != nil {
+		return nil, err
+	}
+	if t.ChangedFiles == nil && t.Before != "" && t.Commit != "" && def.UsesChangedFiles() {
+		s.diff(ctx, t)
+	}
+	return s.jobs.SubmitPipeline(ctx, jobs.PipelineSubmission{
+		Definition: def,
+		Source:     string(source),
+		Repository: t.Repository,
+		Ref:        t.Ref,
+		Commit:     t.Commit,
+		Trigger:    t,
+		Inputs:     t.Inputs,
+	})
+}
+
+// diff works out the files a push changed from the commits before and after
+// it, for providers that do not list them. Failing that, the files are left
+// unknown, which runs every stage rather than leaving out any for lack of
+// information.
+func (s *Service) diff(ctx context.Context, t *types.Trigger) {
+	ctx, span := tracing.Tracer().Start(ctx, "webhook.diff")
+	defer span.End()
+	files, err := s.fetcher.ChangedFiles(ctx, t.CloneURL, t.Before, t.Commit)
+	if err != nil {
+		tracing.RecordError(span, err)
+		slog.WarnContext(ctx, "diffing pushed commits", "repository", t.Repository, "from", t.Before, "to", t.Commit, "error", err)
+		return
+	}
+	t.ChangedFiles = files
+}
+
+// fetch reads the pipeline file at ref in its own span, as cloning is often
+// the slowest part of handling a delivery.
+func (s *Service) fetch(ctx context.Context, cloneURL, ref string) ([]byte, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "webhook.fetch_definition")
+	defer span.End()
+	source, err := s.fetcher.FetchFile(ctx, cloneURL, ref, pipeline.DefaultFilename)
+	if err != nil {
+		tracing.RecordError(span, err)
+	}
+	return source, err
+}